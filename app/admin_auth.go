@@ -0,0 +1,149 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admin roles, each granting the permissions of the roles before it
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// adminIdentity represents an authenticated administrator
+type adminIdentity struct {
+	Actor string
+	Role  string
+}
+
+// AdminAuth implements role-based access control for admin endpoints
+type AdminAuth struct {
+	tokens   map[string]adminIdentity // Keyed by SHA-256 of the token
+	exporter *SIEMExporter            // Receives rejected requests, if set
+	mutex    sync.RWMutex
+}
+
+// NewAdminAuth creates a new admin authenticator configured from ADMIN_TOKENS
+// (comma-separated "actor:token:role" entries)
+func NewAdminAuth() *AdminAuth {
+	auth := &AdminAuth{
+		tokens: make(map[string]adminIdentity),
+	}
+
+	for i, entry := range strings.Split(os.Getenv("ADMIN_TOKENS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			log.Printf("Warning: Ignoring malformed ADMIN_TOKENS entry #%d", i+1)
+			continue
+		}
+		if err := auth.AddToken(parts[0], parts[1], parts[2]); err != nil {
+			log.Printf("Warning: Ignoring ADMIN_TOKENS entry: %v", err)
+		}
+	}
+
+	if len(auth.tokens) == 0 {
+		log.Println("Warning: No admin tokens configured, admin endpoints are disabled")
+	}
+
+	return auth
+}
+
+// AddToken registers an admin token for an actor with the given role
+func (a *AdminAuth) AddToken(actor, token, role string) error {
+	if _, ok := roleRank[role]; !ok {
+		return fmt.Errorf("invalid admin role: %s", role)
+	}
+	if actor == "" || token == "" {
+		return fmt.Errorf("admin actor and token are required")
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.tokens[hashAdminToken(token)] = adminIdentity{Actor: actor, Role: role}
+	return nil
+}
+
+// SetExporter streams requests rejected for a missing, invalid or insufficient token to a SIEM
+func (a *AdminAuth) SetExporter(exporter *SIEMExporter) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.exporter = exporter
+}
+
+// RequireRole returns a handler that only lets through admins holding at least the given role
+func (a *AdminAuth) RequireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		a.mutex.RLock()
+		exporter := a.exporter
+		a.mutex.RUnlock()
+
+		token := c.Get("X-Admin-Token")
+		if token == "" {
+			exporter.Export(requestSecurityEvent(c, SecurityAuth, "admin_token_missing", OutcomeDenied, 3, nil))
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Admin token is required",
+			})
+		}
+
+		a.mutex.RLock()
+		identity, ok := a.tokens[hashAdminToken(token)]
+		a.mutex.RUnlock()
+
+		if !ok {
+			exporter.Export(requestSecurityEvent(c, SecurityAuth, "admin_token_invalid", OutcomeDenied, 7, nil))
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid admin token",
+			})
+		}
+
+		if roleRank[identity.Role] < roleRank[role] {
+			exporter.Export(requestSecurityEvent(c, SecurityAuth, "admin_role_insufficient", OutcomeDenied, 6, map[string]interface{}{
+				"actor":         identity.Actor,
+				"role":          identity.Role,
+				"required_role": role,
+			}))
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{
+				"error": "Role " + role + " is required",
+			})
+		}
+
+		c.Locals("admin_actor", identity.Actor)
+		c.Locals("admin_role", identity.Role)
+		return c.Next()
+	}
+}
+
+// adminActor returns the authenticated admin actor for the request
+func adminActor(c *fiber.Ctx) string {
+	if actor, ok := c.Locals("admin_actor").(string); ok {
+		return actor
+	}
+	return "unknown"
+}
+
+// hashAdminToken hashes a token so plaintext tokens are not kept in memory
+func hashAdminToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
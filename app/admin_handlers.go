@@ -0,0 +1,809 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getSlowOperations returns recorded slow and expensive operations
+func (s *App) getSlowOperations(c *fiber.Ctx) error {
+	filter := SlowOperationFilter{
+		Kind:  c.Query("kind"),
+		Limit: 100,
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed <= 0 {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "limit must be a positive integer",
+			})
+		}
+		filter.Limit = parsed
+	}
+
+	if since := c.Query("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid since format. Use RFC3339",
+			})
+		}
+		filter.Since = parsed
+	}
+
+	slowOperations := s.analyticsService.SlowOperations()
+	durationThreshold, scannedThreshold := slowOperations.Thresholds()
+
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"operations": slowOperations.Query(filter),
+		"thresholds": fiber.Map{
+			"duration_ms":    durationThreshold.Milliseconds(),
+			"scanned_events": scannedThreshold,
+		},
+	})
+}
+
+// getAnonymousTraffic returns the volume of requests without a user ID and how they were handled
+func (s *App) getAnonymousTraffic(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"traffic":  s.anonymousPolicy.Traffic(),
+		"policies": s.anonymousPolicy.Policies(),
+	})
+}
+
+// getQueryCacheStats returns how cached query results were served
+func (s *App) getQueryCacheStats(c *fiber.Ctx) error {
+	freshFor, staleFor := s.analyticsService.QueryCache().TTLs()
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"stats":     s.analyticsService.QueryCache().Stats(),
+		"fresh_for": freshFor.String(),
+		"stale_for": staleFor.String(),
+	})
+}
+
+// getPipelineHooks returns the custom hooks the pipeline runs and the hooks registered with it
+func (s *App) getPipelineHooks(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"chain":      s.analyticsService.Hooks().Chain(),
+		"registered": RegisteredPipelineHooks(),
+	})
+}
+
+// getSIEMStats returns how security events are exported to the SIEM
+func (s *App) getSIEMStats(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"siem":   s.siem.Stats(),
+	})
+}
+
+// getMetricsPushStats returns how the internal metrics are pushed
+func (s *App) getMetricsPushStats(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"metrics_push": s.metricsPush.Stats(),
+	})
+}
+
+// getTrafficAlerts returns the traffic alerts firing and the ones resolved recently
+func (s *App) getTrafficAlerts(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":         "success",
+		"traffic_alerts": s.traffic.Alerts(),
+	})
+}
+
+// getDataQualityAlerts returns the data quality alerts of every project firing and resolved recently
+func (s *App) getDataQualityAlerts(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":              "success",
+		"data_quality_alerts": s.analyticsService.DataQuality().Alerts(""),
+	})
+}
+
+// getSLOs returns how the ingestion objectives are met, their error budgets and burn rate alerts
+func (s *App) getSLOs(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"slo":    s.slos.Report(),
+	})
+}
+
+// getRuntimeSettings returns all runtime-tunable settings and worker pool state
+func (s *App) getRuntimeSettings(c *fiber.Ctx) error {
+	pools := []WorkerPoolStats{s.trackingPool.Stats()}
+	if s.dispatcher != nil {
+		pools = append(pools, s.dispatcher.Stats())
+	} else if s.kafkaConsumer != nil {
+		pools = append(pools, s.kafkaConsumer.WorkerPool().Stats())
+	}
+
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"settings":     s.runtimeSettings.List(),
+		"worker_pools": pools,
+	})
+}
+
+// getRuntimeSetting returns a single runtime setting with its version as the ETag
+func (s *App) getRuntimeSetting(c *fiber.Ctx) error {
+	setting, err := s.runtimeSettings.Get(c.Params("name"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, ETag(setting.Version))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"setting": setting,
+	})
+}
+
+// updateRuntimeSetting adjusts a single runtime setting
+func (s *App) updateRuntimeSetting(c *fiber.Ctx) error {
+	var request struct {
+		Value interface{} `json:"value"`
+	}
+
+	if err := c.BodyParser(&request); err != nil || request.Value == nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	expectedVersion, status, err := ifMatchVersion(c)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	name := utils.CopyString(c.Params("name")) // Kept by the audit log beyond the request
+	previous, current, err := s.runtimeSettings.Update(name, request.Value, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	s.auditLog.Record(adminActor(c), "runtime.update", name, map[string]interface{}{
+		"previous": previous,
+		"value":    current.Value,
+		"version":  current.Version,
+	})
+
+	c.Set(fiber.HeaderETag, ETag(current.Version))
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"name":     name,
+		"previous": previous,
+		"value":    current.Value,
+		"version":  current.Version,
+	})
+}
+
+// getAuditLog returns recorded administrative actions
+func (s *App) getAuditLog(c *fiber.Ctx) error {
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "limit must be a positive integer",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"entries": s.auditLog.Entries(c.Query("action"), limit),
+	})
+}
+
+// pauseKafkaTopics halts consumption from the requested topics
+func (s *App) pauseKafkaTopics(c *fiber.Ctx) error {
+	return s.changeKafkaTopicState(c, "kafka.pause", func(topic string) error {
+		return s.kafkaConsumer.PauseTopic(topic)
+	})
+}
+
+// resumeKafkaTopics resumes consumption from the requested topics
+func (s *App) resumeKafkaTopics(c *fiber.Ctx) error {
+	return s.changeKafkaTopicState(c, "kafka.resume", func(topic string) error {
+		return s.kafkaConsumer.ResumeTopic(topic)
+	})
+}
+
+// changeKafkaTopicState applies a pause or resume to the topics in the request body (all topics if empty)
+func (s *App) changeKafkaTopicState(c *fiber.Ctx, action string, apply func(topic string) error) error {
+	if s.kafkaConsumer == nil {
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Kafka consumer is not running",
+		})
+	}
+
+	var request struct {
+		Topics []string `json:"topics"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+
+	topics := request.Topics
+	if len(topics) == 0 {
+		topics = s.kafkaConsumer.Topics()
+	}
+
+	// Validate all topics first so a typo doesn't leave the request half-applied
+	consumed := make(map[string]bool)
+	for _, topic := range s.kafkaConsumer.Topics() {
+		consumed[topic] = true
+	}
+	for _, topic := range topics {
+		if !consumed[topic] {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unknown topic: " + topic,
+			})
+		}
+	}
+
+	for _, topic := range topics {
+		if err := apply(topic); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	s.auditLog.Record(adminActor(c), action, "kafka", map[string]interface{}{
+		"topics": topics,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":        "success",
+		"paused_topics": s.kafkaConsumer.PausedTopics(),
+	})
+}
+
+// disableKafkaHandler stops handling the Kafka events of a type, dropping them until the handler
+// is enabled again, with an optional reason in the request body
+func (s *App) disableKafkaHandler(c *fiber.Ctx) error {
+	eventType := c.Params("event_type")
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+	if s.kafkaConsumer != nil && !s.kafkaConsumer.HasHandler(eventType) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": "No handler registered for event type: " + eventType,
+		})
+	}
+
+	s.kafkaHandlers.Disable(eventType, request.Reason)
+	s.auditLog.Record(adminActor(c), "kafka.handler.disable", "kafka", map[string]interface{}{
+		"event_type": eventType,
+		"reason":     request.Reason,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"handlers": s.kafkaHandlers.Stats(),
+	})
+}
+
+// enableKafkaHandler resumes handling the Kafka events of a type. Enabling a handler that is not
+// disabled does nothing.
+func (s *App) enableKafkaHandler(c *fiber.Ctx) error {
+	eventType := c.Params("event_type")
+	if s.kafkaHandlers.Enable(eventType) {
+		s.auditLog.Record(adminActor(c), "kafka.handler.enable", "kafka", map[string]interface{}{
+			"event_type": eventType,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"handlers": s.kafkaHandlers.Stats(),
+	})
+}
+
+// replayKafkaTopic re-consumes the messages a topic received between from and up to to (RFC3339,
+// the latest message when omitted) as a job, handling their events again except billing events
+func (s *App) replayKafkaTopic(c *fiber.Ctx) error {
+	var request struct {
+		Topic      string   `json:"topic"`
+		From       string   `json:"from"`
+		To         string   `json:"to"`
+		EventTypes []string `json:"event_types"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if request.Topic == "" || request.From == "" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "topic and from are required",
+		})
+	}
+	replay := KafkaReplayRequest{Topic: request.Topic, EventTypes: request.EventTypes}
+	var err error
+	if replay.From, err = time.Parse(time.RFC3339, request.From); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid from: use RFC3339",
+		})
+	}
+	if request.To != "" {
+		if replay.To, err = time.Parse(time.RFC3339, request.To); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid to: use RFC3339",
+			})
+		}
+		if !replay.To.After(replay.From) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "to must be after from",
+			})
+		}
+	}
+
+	if s.kafkaConsumer == nil {
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Kafka consumer is not running",
+		})
+	}
+	consumed := false
+	for _, topic := range s.kafkaConsumer.Topics() {
+		consumed = consumed || topic == replay.Topic
+	}
+	if !consumed {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unknown topic: " + replay.Topic,
+		})
+	}
+
+	actor := adminActor(c)
+	return s.acceptJob(c, "", JobKafkaReplay, func(ctx context.Context) (interface{}, error) {
+		result, err := s.kafkaConsumer.Replay(ctx, replay)
+		if err != nil {
+			return nil, err
+		}
+		s.auditLog.Record(actor, "kafka.replay", "kafka", map[string]interface{}{
+			"topic":    result.Topic,
+			"from":     result.From,
+			"to":       result.To,
+			"messages": result.Messages,
+			"replayed": result.Replayed,
+		})
+		return result, nil
+	})
+}
+
+// bootstrapProfiles seeds user profiles and lifecycle stages from the history of the auth and
+// billing services, read from Kafka or their bulk history endpoints between from and to (RFC3339,
+// optional). It always runs as a job.
+func (s *App) bootstrapProfiles(c *fiber.Ctx) error {
+	var request struct {
+		Source string   `json:"source"`
+		Topics []string `json:"topics"`
+		From   string   `json:"from"`
+		To     string   `json:"to"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	bootstrap := BootstrapRequest{Source: request.Source, Topics: request.Topics}
+	var err error
+	if request.From != "" {
+		if bootstrap.From, err = time.Parse(time.RFC3339, request.From); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid from: use RFC3339",
+			})
+		}
+	}
+	if request.To != "" {
+		if bootstrap.To, err = time.Parse(time.RFC3339, request.To); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid to: use RFC3339",
+			})
+		}
+	}
+	if !bootstrap.To.IsZero() && !bootstrap.To.After(bootstrap.From) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "to must be after from",
+		})
+	}
+
+	switch bootstrap.Source {
+	case BootstrapSourceKafka:
+		if s.kafkaConsumer == nil {
+			return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "Kafka consumer is not running",
+			})
+		}
+	case BootstrapSourceAPI:
+		if len(s.bootstrap.HistoryURLs()) == 0 {
+			return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "No history endpoints configured, set BOOTSTRAP_HISTORY_URLS",
+			})
+		}
+	default:
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "source must be " + BootstrapSourceKafka + " or " + BootstrapSourceAPI,
+		})
+	}
+
+	actor := adminActor(c)
+	return s.acceptJob(c, "", JobBootstrap, func(ctx context.Context) (interface{}, error) {
+		result, err := s.bootstrap.Run(ctx, s.kafkaConsumer, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		s.auditLog.Record(actor, "profiles.bootstrap", result.Source, map[string]interface{}{
+			"from":     result.From,
+			"to":       result.To,
+			"events":   result.Events,
+			"applied":  result.Applied,
+			"profiles": result.Profiles,
+		})
+		return result, nil
+	})
+}
+
+// getPlans returns the available billing plans
+func (s *App) getPlans(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"plans":  s.analyticsService.Plans().Plans(),
+	})
+}
+
+// setUserPlan assigns a billing plan to a user
+func (s *App) setUserPlan(c *fiber.Ctx) error {
+	var request struct {
+		Plan string `json:"plan"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	userID := utils.CopyString(c.Params("user_id"))
+	previous := s.analyticsService.Plans().PlanForUser(userID)
+	if err := s.analyticsService.Plans().SetUserPlan(userID, request.Plan); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "plan.assign", userID, map[string]interface{}{
+		"previous": previous.Name,
+		"plan":     request.Plan,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"user_id":  userID,
+		"previous": previous.Name,
+		"plan":     request.Plan,
+	})
+}
+
+// getCurrencies returns the conversion rates and the contract currency of each project
+func (s *App) getCurrencies(c *fiber.Ctx) error {
+	currencies := s.analyticsService.Currencies()
+
+	return c.JSON(fiber.Map{
+		"status":             "success",
+		"base_currency":      BaseCurrency,
+		"default_currency":   currencies.DefaultCurrency(),
+		"rates":              currencies.Rates(),
+		"project_currencies": currencies.ProjectCurrencies(),
+	})
+}
+
+// setProjectCurrency sets the contract currency amounts of a project are billed in
+func (s *App) setProjectCurrency(c *fiber.Ctx) error {
+	var request struct {
+		Currency string `json:"currency"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	projectID := utils.CopyString(c.Params("project_id"))
+	currencies := s.analyticsService.Currencies()
+	previous := currencies.ProjectCurrency(projectID)
+	if err := currencies.SetProjectCurrency(projectID, request.Currency); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	current := currencies.ProjectCurrency(projectID)
+
+	s.auditLog.Record(adminActor(c), "project.currency", projectID, map[string]interface{}{
+		"previous": previous,
+		"currency": current,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"project_id": projectID,
+		"previous":   previous,
+		"currency":   current,
+	})
+}
+
+// listAPIKeyDefaults returns the default event properties of all API keys
+func (s *App) listAPIKeyDefaults(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"defaults": s.analyticsService.KeyDefaults().List(),
+	})
+}
+
+// getAPIKeyDefaults returns the default event properties of an API key
+func (s *App) getAPIKeyDefaults(c *fiber.Ctx) error {
+	defaults, err := s.analyticsService.KeyDefaults().Get(c.Params("key_id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"defaults": defaults,
+	})
+}
+
+// setAPIKeyDefaults replaces the default event properties of an API key. The key is sent in the
+// body, so it does not end up in access logs; responses and the audit log only carry its ID.
+func (s *App) setAPIKeyDefaults(c *fiber.Ctx) error {
+	var request struct {
+		APIKey     string                 `json:"api_key"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	defaults, err := s.analyticsService.KeyDefaults().Set(request.APIKey, request.Properties)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "api_key.defaults.update", defaults.KeyID, map[string]interface{}{
+		"properties": defaults.Properties,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"defaults": defaults,
+	})
+}
+
+// deleteAPIKeyDefaults removes the default event properties of an API key
+func (s *App) deleteAPIKeyDefaults(c *fiber.Ctx) error {
+	keyID := utils.CopyString(c.Params("key_id"))
+	if err := s.analyticsService.KeyDefaults().Delete(keyID); err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "api_key.defaults.delete", keyID, nil)
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "API key defaults deleted",
+	})
+}
+
+// getRetention returns the retention policy, the projected storage cost under it and the last purge
+func (s *App) getRetention(c *fiber.Ctx) error {
+	retention := s.analyticsService.Retention()
+	overrides := make(map[string]string)
+	for eventType, ttl := range retention.Overrides() {
+		overrides[eventType] = formatRetention(ttl)
+	}
+
+	return c.JSON(fiber.Map{
+		"status":            "success",
+		"default_retention": formatRetention(retention.DefaultTTL()),
+		"overrides":         overrides,
+		"storage_estimate":  s.analyticsService.EstimateStorage(time.Now()),
+		"last_purge":        s.eventPurger.LastRun(),
+	})
+}
+
+// purgeExpiredEvents purges events past their retention without waiting for the next scheduled purge
+func (s *App) purgeExpiredEvents(c *fiber.Ctx) error {
+	actor := adminActor(c)
+	purge := func(ctx context.Context) PurgeResult {
+		result := s.eventPurger.run(ctx, time.Now())
+		s.auditLog.Record(actor, "retention.purge", "events", map[string]interface{}{
+			"purged": result.Purged,
+		})
+		return result
+	}
+	if prefersAsync(c) {
+		return s.acceptJob(c, "", JobRetentionRun, func(ctx context.Context) (interface{}, error) {
+			return purge(ctx), nil
+		})
+	}
+
+	result := purge(context.Background())
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"purge":  result,
+	})
+}
+
+// deleteEvents deletes the stored events matching filters, e.g. bad data sent by an
+// instrumentation bug, or only counts them with "dry_run". It always runs as a job.
+func (s *App) deleteEvents(c *fiber.Ctx) error {
+	var request struct {
+		ProjectID  string                 `json:"project_id"`
+		EventType  string                 `json:"event_type"`
+		APIKey     string                 `json:"api_key"`
+		Properties map[string]interface{} `json:"properties"`
+		From       string                 `json:"from"`
+		To         string                 `json:"to"`
+		DryRun     bool                   `json:"dry_run"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	deletion := EventDeletion{
+		ProjectID:  request.ProjectID,
+		EventType:  request.EventType,
+		APIKey:     request.APIKey,
+		Properties: request.Properties,
+		DryRun:     request.DryRun,
+	}
+	var err error
+	if request.From != "" {
+		if deletion.Start, err = time.Parse(time.RFC3339, request.From); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid from: use RFC3339",
+			})
+		}
+	}
+	if request.To != "" {
+		if deletion.End, err = time.Parse(time.RFC3339, request.To); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid to: use RFC3339",
+			})
+		}
+	}
+	if err := deletion.Validate(); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// The audit log keeps the ID of the API key, not the key itself
+	filters := map[string]interface{}{
+		"project_id": request.ProjectID,
+		"event_type": request.EventType,
+		"properties": request.Properties,
+		"from":       request.From,
+		"to":         request.To,
+	}
+	if request.APIKey != "" {
+		filters["api_key_id"] = APIKeyID(request.APIKey)
+	}
+	actor := adminActor(c)
+	return s.acceptJob(c, "", JobEventDelete, func(ctx context.Context) (interface{}, error) {
+		result, err := s.analyticsService.deleteEvents(ctx, deletion)
+		if err != nil {
+			return nil, err
+		}
+		s.auditLog.Record(actor, "events.delete", "events", map[string]interface{}{
+			"filters": filters,
+			"dry_run": result.DryRun,
+			"matched": result.Matched,
+			"deleted": result.Deleted,
+		})
+		return result, nil
+	})
+}
+
+// simulatePricing re-prices the usage of a period under a proposed pricing and returns the
+// per-customer deltas, to evaluate a pricing change before rollout
+func (s *App) simulatePricing(c *fiber.Ctx) error {
+	var request struct {
+		ProjectID string        `json:"project_id"`
+		StartDate string        `json:"start_date"`
+		EndDate   string        `json:"end_date"`
+		Pricing   PricingConfig `json:"pricing"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	simulation := PricingSimulation{ProjectID: request.ProjectID, Pricing: request.Pricing}
+	var err error
+	if simulation.Start, err = parseOptionalDate(request.StartDate, "start_date"); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if simulation.End, err = parseOptionalDate(request.EndDate, "end_date"); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := simulation.Validate(); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	if prefersAsync(c) {
+		return s.acceptJob(c, "", JobPricingSim, func(ctx context.Context) (interface{}, error) {
+			return s.analyticsService.simulatePricing(ctx, simulation)
+		})
+	}
+	result, err := s.analyticsService.simulatePricing(context.Background(), simulation)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"simulation": result,
+	})
+}
+
+// getBillingCorrelation returns the event billed under a correlation ID, so charges of the billing
+// service can be reconciled with the events they were made for
+func (s *App) getBillingCorrelation(c *fiber.Ctx) error {
+	event, err := s.analyticsService.EventByCorrelationID(c.Params("correlation_id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":         "success",
+		"correlation_id": event.BillingCorrelationID,
+		"billing_status": event.BillingStatus,
+		"event":          event,
+	})
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getProjectAggregation returns the aggregation-only event types of a project with their version as the ETag
+func (s *App) getProjectAggregation(c *fiber.Ctx) error {
+	aggregation := s.analyticsService.Aggregates().Get(c.Params("id"))
+
+	c.Set(fiber.HeaderETag, ETag(aggregation.Version))
+	return c.JSON(fiber.Map{
+		"status":      "success",
+		"aggregation": aggregation,
+	})
+}
+
+// updateProjectAggregation replaces the aggregation-only event types of a project. Replacing
+// existing ones requires If-Match with the version being updated.
+func (s *App) updateProjectAggregation(c *fiber.Ctx) error {
+	var request struct {
+		EventTypes []string `json:"event_types"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	aggregates := s.analyticsService.Aggregates()
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first settings of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if aggregates.Get(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := aggregates.Replace(projectID, request.EventTypes, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status":      "success",
+		"aggregation": updated,
+	})
+}
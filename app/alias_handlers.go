@@ -0,0 +1,61 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getProjectAliases returns the event and property aliases of a project with their version as the ETag
+func (s *App) getProjectAliases(c *fiber.Ctx) error {
+	aliases := s.analyticsService.Aliases().Get(c.Params("id"))
+
+	c.Set(fiber.HeaderETag, ETag(aliases.Version))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"aliases": aliases,
+	})
+}
+
+// updateProjectAliases replaces the aliases of a project. Replacing existing aliases requires
+// If-Match with the version being updated.
+func (s *App) updateProjectAliases(c *fiber.Ctx) error {
+	var request struct {
+		Events     map[string]string `json:"events"`
+		Properties map[string]string `json:"properties"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	aliases := s.analyticsService.Aliases()
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first aliases of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if aliases.Get(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := aliases.Replace(projectID, request.Events, request.Properties, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"aliases": updated,
+	})
+}
@@ -0,0 +1,157 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ProjectAliases maps renamed event types and properties of a project to their canonical names
+type ProjectAliases struct {
+	Events     map[string]string `json:"events"`     // Old event type -> canonical event type
+	Properties map[string]string `json:"properties"` // Old property name -> canonical property name
+	Version    int64             `json:"version"`    // Incremented on every update, exposed as the ETag
+}
+
+// AliasService applies per-project aliases at query time, so reports stay consistent after
+// instrumentation renames without rewriting stored events
+type AliasService struct {
+	projects map[string]*ProjectAliases // Replaced, never modified, so resolvers can keep using a snapshot
+	mutex    sync.RWMutex
+}
+
+// NewAliasService creates a new alias service
+func NewAliasService() *AliasService {
+	return &AliasService{
+		projects: make(map[string]*ProjectAliases),
+	}
+}
+
+// Get returns the aliases of a project
+func (s *AliasService) Get(projectID string) *ProjectAliases {
+	s.mutex.RLock()
+	aliases, exists := s.projects[projectID]
+	s.mutex.RUnlock()
+
+	if !exists {
+		return &ProjectAliases{Events: map[string]string{}, Properties: map[string]string{}}
+	}
+	return aliases.copy()
+}
+
+// Replace replaces the aliases of a project. The update is rejected with a VersionConflictError
+// unless expectedVersion is the current version (0 for a project without aliases).
+func (s *AliasService) Replace(projectID string, events, properties map[string]string, expectedVersion int64) (*ProjectAliases, error) {
+	if err := validateAliases("event", events); err != nil {
+		return nil, err
+	}
+	if err := validateAliases("property", properties); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var current int64
+	if existing, exists := s.projects[projectID]; exists {
+		current = existing.Version
+	}
+	if err := checkVersion("aliases", projectID, current, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	aliases := (&ProjectAliases{Events: events, Properties: properties, Version: current + 1}).copy()
+
+	// Copy on write, so snapshots taken by running queries are not affected
+	projects := make(map[string]*ProjectAliases, len(s.projects)+1)
+	for id, existing := range s.projects {
+		projects[id] = existing
+	}
+	projects[projectID] = aliases
+	s.projects = projects
+
+	return aliases.copy(), nil
+}
+
+// Resolver returns a function presenting stored events under their canonical names. It uses the
+// aliases at the time it was created, so a query sees one consistent set of aliases.
+func (s *AliasService) Resolver() func(event *AnalyticsEvent) *AnalyticsEvent {
+	s.mutex.RLock()
+	projects := s.projects
+	s.mutex.RUnlock()
+
+	return func(event *AnalyticsEvent) *AnalyticsEvent {
+		aliases, exists := projects[projectOrDefault(event.ProjectID)]
+		if !exists {
+			return event
+		}
+		return aliases.resolve(event)
+	}
+}
+
+// resolve returns the event with its type and properties renamed, or the event itself when no alias applies
+func (a *ProjectAliases) resolve(event *AnalyticsEvent) *AnalyticsEvent {
+	eventType, renamed := a.Events[event.EventType]
+
+	var properties map[string]interface{}
+	for name := range event.Properties {
+		if _, aliased := a.Properties[name]; aliased {
+			properties = make(map[string]interface{}, len(event.Properties))
+			break
+		}
+	}
+	if !renamed && properties == nil {
+		return event
+	}
+
+	resolved := *event
+	if renamed {
+		resolved.EventType = eventType
+	}
+	if properties != nil {
+		for name, value := range event.Properties {
+			if canonical, aliased := a.Properties[name]; aliased {
+				// A value sent under the canonical name wins over the aliased one
+				if _, exists := event.Properties[canonical]; exists {
+					continue
+				}
+				name = canonical
+			}
+			properties[name] = value
+		}
+		resolved.Properties = properties
+	}
+	return &resolved
+}
+
+// copy returns a deep copy of the aliases
+func (a *ProjectAliases) copy() *ProjectAliases {
+	copied := &ProjectAliases{
+		Events:     make(map[string]string, len(a.Events)),
+		Properties: make(map[string]string, len(a.Properties)),
+		Version:    a.Version,
+	}
+	for from, to := range a.Events {
+		copied.Events[from] = to
+	}
+	for from, to := range a.Properties {
+		copied.Properties[from] = to
+	}
+	return copied
+}
+
+// validateAliases checks that aliases are named and do not form chains, which would make the
+// canonical name depend on the order aliases are applied in
+func validateAliases(kind string, aliases map[string]string) error {
+	for from, to := range aliases {
+		if from == "" || to == "" {
+			return fmt.Errorf("%s aliases must map a non-empty name to a non-empty name", kind)
+		}
+		if from == to {
+			return fmt.Errorf("%s alias %s maps to itself", kind, from)
+		}
+		if _, chained := aliases[to]; chained {
+			return fmt.Errorf("%s alias %s -> %s targets another alias; map it to the canonical name %s", kind, from, to, aliases[to])
+		}
+	}
+	return nil
+}
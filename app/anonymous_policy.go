@@ -0,0 +1,291 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies for requests without a user ID
+const (
+	AnonymousReject         = "reject"          // Reject with 401 Unauthorized
+	AnonymousAttributeOwner = "attribute_owner" // Allow and bill the project owner
+	AnonymousNoBill         = "no_bill"         // Allow without billing
+)
+
+// anonymousPolicies are the supported anonymous-user policies
+var anonymousPolicies = map[string]bool{AnonymousReject: true, AnonymousAttributeOwner: true, AnonymousNoBill: true}
+
+// AnonymousUserID is the user ID of requests without one, used for rate limiting and sampling
+const AnonymousUserID = "anonymous"
+
+// AnonymousTraffic counts requests and what was done with the anonymous ones
+type AnonymousTraffic struct {
+	Requests   int64 `json:"requests"`   // Every request, authenticated or not
+	Anonymous  int64 `json:"anonymous"`  // Requests without a user ID
+	Rejected   int64 `json:"rejected"`   // Anonymous requests rejected
+	Attributed int64 `json:"attributed"` // Anonymous requests billed to the project owner
+	Unbilled   int64 `json:"unbilled"`   // Anonymous requests allowed without billing
+}
+
+// RouteGroupTraffic is the traffic of the routes under a prefix with its own policy
+type RouteGroupTraffic struct {
+	RouteGroup string `json:"route_group"`
+	Policy     string `json:"policy"`
+	AnonymousTraffic
+}
+
+// AnonymousTrafficReport is the anonymous traffic since startup, overall and per route group and project
+type AnonymousTrafficReport struct {
+	AnonymousTraffic
+	AnonymousRate float64             `json:"anonymous_rate"` // Percentage of requests without a user ID
+	RouteGroups   []RouteGroupTraffic `json:"route_groups"`   // Sorted by prefix
+	Projects      map[string]int64    `json:"projects"`       // Anonymous requests per project
+	Since         time.Time           `json:"since"`
+}
+
+// AnonymousPolicy decides what happens to requests without a user ID, per route group. A route
+// group is a path prefix; a request follows the policy of the longest prefix matching its path,
+// and "/" holds the default policy.
+type AnonymousPolicy struct {
+	policies map[string]string // Policy per route group prefix
+	owners   map[string]string // User billed for anonymous requests, per project
+	traffic  map[string]*AnonymousTraffic
+	projects map[string]int64
+	since    time.Time
+	mutex    sync.RWMutex
+}
+
+// NewAnonymousPolicy creates an anonymous-user policy configured from ANONYMOUS_USER_POLICIES, a
+// comma-separated list of prefix:policy entries ("/:no_bill" by default), and PROJECT_OWNERS, a
+// comma-separated list of project:user entries
+func NewAnonymousPolicy() *AnonymousPolicy {
+	policy := &AnonymousPolicy{
+		policies: map[string]string{"/": AnonymousNoBill},
+		owners:   make(map[string]string),
+		traffic:  make(map[string]*AnonymousTraffic),
+		projects: make(map[string]int64),
+		since:    time.Now(),
+	}
+
+	if value := os.Getenv("ANONYMOUS_USER_POLICIES"); value != "" {
+		policies, err := parseKeyValues(value)
+		if err == nil {
+			err = policy.ReplacePolicies(policies)
+		}
+		if err != nil {
+			log.Printf("Warning: Ignoring ANONYMOUS_USER_POLICIES: %v", err)
+		}
+	}
+	if value := os.Getenv("PROJECT_OWNERS"); value != "" {
+		owners, err := parseKeyValues(value)
+		if err == nil {
+			err = policy.ReplaceOwners(owners)
+		}
+		if err != nil {
+			log.Printf("Warning: Ignoring PROJECT_OWNERS: %v", err)
+		}
+	}
+
+	return policy
+}
+
+// Admit applies the policy of the request's route group and records the request in the traffic
+// metrics. It returns the user the request is billed to, empty when it is not billed, and an
+// error when an anonymous request is rejected.
+func (p *AnonymousPolicy) Admit(path, projectID, userID string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	group, policy := p.resolve(path)
+	traffic, exists := p.traffic[group]
+	if !exists {
+		traffic = &AnonymousTraffic{}
+		p.traffic[group] = traffic
+	}
+	traffic.Requests++
+	if userID != "" {
+		return userID, nil
+	}
+
+	traffic.Anonymous++
+	p.projects[projectID]++
+	switch policy {
+	case AnonymousReject:
+		traffic.Rejected++
+		return "", fmt.Errorf("authentication required: provide a user ID")
+	case AnonymousAttributeOwner:
+		if owner, exists := p.owners[projectID]; exists {
+			traffic.Attributed++
+			return owner, nil
+		}
+		// Without an owner there is nobody to bill, the request is served for free
+		traffic.Unbilled++
+		return "", nil
+	default:
+		traffic.Unbilled++
+		return "", nil
+	}
+}
+
+// Policy returns the policy applying to a path and the route group it belongs to
+func (p *AnonymousPolicy) Policy(path string) (string, string) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.resolve(path)
+}
+
+// resolve returns the longest route group prefix matching the path and its policy
+func (p *AnonymousPolicy) resolve(path string) (string, string) {
+	group := ""
+	for prefix := range p.policies {
+		if len(prefix) > len(group) && matchesRouteGroup(path, prefix) {
+			group = prefix
+		}
+	}
+	return group, p.policies[group]
+}
+
+// matchesRouteGroup reports whether the path is the prefix or below it
+func matchesRouteGroup(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// Policies returns the policy of every route group
+func (p *AnonymousPolicy) Policies() map[string]string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	policies := make(map[string]string, len(p.policies))
+	for prefix, policy := range p.policies {
+		policies[prefix] = policy
+	}
+	return policies
+}
+
+// ReplacePolicies replaces the policy of every route group. The default policy ("/") is kept
+// unless replaced.
+func (p *AnonymousPolicy) ReplacePolicies(policies map[string]string) error {
+	for prefix, policy := range policies {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("route group %q must be a path starting with /", prefix)
+		}
+		if !anonymousPolicies[policy] {
+			return fmt.Errorf("invalid policy %q for %s. Valid policies are: reject, attribute_owner, no_bill", policy, prefix)
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	replaced := map[string]string{"/": p.policies["/"]}
+	for prefix, policy := range policies {
+		replaced[prefix] = policy
+	}
+	p.policies = replaced
+	return nil
+}
+
+// Owners returns the user billed for anonymous requests of every project
+func (p *AnonymousPolicy) Owners() map[string]string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	owners := make(map[string]string, len(p.owners))
+	for projectID, owner := range p.owners {
+		owners[projectID] = owner
+	}
+	return owners
+}
+
+// ReplaceOwners replaces the owners of every project
+func (p *AnonymousPolicy) ReplaceOwners(owners map[string]string) error {
+	for projectID, owner := range owners {
+		if projectID == "" || owner == "" {
+			return fmt.Errorf("project and owner must not be empty")
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.owners = make(map[string]string, len(owners))
+	for projectID, owner := range owners {
+		p.owners[projectID] = owner
+	}
+	return nil
+}
+
+// Traffic returns the anonymous traffic since startup
+func (p *AnonymousPolicy) Traffic() *AnonymousTrafficReport {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	report := &AnonymousTrafficReport{
+		RouteGroups: make([]RouteGroupTraffic, 0, len(p.traffic)),
+		Projects:    make(map[string]int64, len(p.projects)),
+		Since:       p.since,
+	}
+	for group, traffic := range p.traffic {
+		report.Requests += traffic.Requests
+		report.Anonymous += traffic.Anonymous
+		report.Rejected += traffic.Rejected
+		report.Attributed += traffic.Attributed
+		report.Unbilled += traffic.Unbilled
+		// Groups whose prefix was removed report the policy their paths follow now
+		_, policy := p.resolve(group)
+		report.RouteGroups = append(report.RouteGroups, RouteGroupTraffic{RouteGroup: group, Policy: policy, AnonymousTraffic: *traffic})
+	}
+	sort.Slice(report.RouteGroups, func(i, j int) bool {
+		return report.RouteGroups[i].RouteGroup < report.RouteGroups[j].RouteGroup
+	})
+	for projectID, requests := range p.projects {
+		report.Projects[projectID] = requests
+	}
+	if report.Requests > 0 {
+		report.AnonymousRate = float64(report.Anonymous) / float64(report.Requests) * 100
+	}
+	return report
+}
+
+// parseKeyValues parses a comma-separated list of key:value entries
+func parseKeyValues(value string) (map[string]string, error) {
+	entries := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, val, found := strings.Cut(entry, ":")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected key:value", entry)
+		}
+		entries[key] = strings.TrimSpace(val)
+	}
+	return entries, nil
+}
+
+// runtimeKeyValues converts a JSON object or a "key:value,..." string into values by key
+func runtimeKeyValues(value interface{}) (map[string]string, error) {
+	switch v := value.(type) {
+	case string:
+		return parseKeyValues(v)
+	case map[string]interface{}:
+		entries := make(map[string]string, len(v))
+		for key, raw := range v {
+			str, ok := raw.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string for %s, got %T", key, raw)
+			}
+			entries[key] = str
+		}
+		return entries, nil
+	default:
+		return nil, fmt.Errorf("expected an object, got %T", value)
+	}
+}
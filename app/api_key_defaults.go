@@ -0,0 +1,156 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxKeyDefaultProperties is the maximum number of default properties per API key
+const maxKeyDefaultProperties = 50
+
+// APIKeyDefaults is the context attached server-side to every event sent with an API key.
+// The key itself is never returned; it is identified by its KeyID.
+type APIKeyDefaults struct {
+	KeyID      string                 `json:"key_id"`   // Fingerprint of the API key
+	KeyHint    string                 `json:"key_hint"` // Last characters of the API key
+	Properties map[string]interface{} `json:"properties"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+}
+
+// APIKeyDefaultsService holds the default event context of API keys, such as the app version,
+// environment or service name of a backend emitter, so it does not have to be sent with every event
+type APIKeyDefaultsService struct {
+	defaults map[string]*APIKeyDefaults // Key ID -> defaults
+	mutex    sync.RWMutex
+}
+
+// NewAPIKeyDefaultsService creates a new API key defaults service
+func NewAPIKeyDefaultsService() *APIKeyDefaultsService {
+	return &APIKeyDefaultsService{
+		defaults: make(map[string]*APIKeyDefaults),
+	}
+}
+
+// APIKeyID returns the identifier of an API key, so keys are not exposed in URLs and logs
+func APIKeyID(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Set replaces the default properties of an API key
+func (s *APIKeyDefaultsService) Set(apiKey string, properties map[string]interface{}) (*APIKeyDefaults, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("api_key is required")
+	}
+	if len(properties) == 0 {
+		return nil, fmt.Errorf("properties is required; delete the defaults to remove them")
+	}
+	if len(properties) > maxKeyDefaultProperties {
+		return nil, fmt.Errorf("at most %d default properties can be set, got %d", maxKeyDefaultProperties, len(properties))
+	}
+	for name, value := range properties {
+		if name == "" {
+			return nil, fmt.Errorf("property names must not be empty")
+		}
+		switch value.(type) {
+		case string, float64, bool:
+		default:
+			return nil, fmt.Errorf("property %s must be a string, number or boolean, got %T", name, value)
+		}
+	}
+
+	hint := apiKey
+	if len(hint) > 4 {
+		hint = hint[len(hint)-4:]
+	}
+	defaults := &APIKeyDefaults{
+		KeyID:      APIKeyID(apiKey),
+		KeyHint:    "..." + hint,
+		Properties: make(map[string]interface{}, len(properties)),
+		UpdatedAt:  time.Now(),
+	}
+	for name, value := range properties {
+		defaults.Properties[name] = value
+	}
+
+	s.mutex.Lock()
+	s.defaults[defaults.KeyID] = defaults
+	s.mutex.Unlock()
+
+	return defaults.copy(), nil
+}
+
+// Get returns the defaults with the given key ID
+func (s *APIKeyDefaultsService) Get(keyID string) (*APIKeyDefaults, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	defaults, exists := s.defaults[keyID]
+	if !exists {
+		return nil, fmt.Errorf("no defaults for API key %s", keyID)
+	}
+	return defaults.copy(), nil
+}
+
+// List returns the defaults of all API keys, most recently updated first
+func (s *APIKeyDefaultsService) List() []*APIKeyDefaults {
+	s.mutex.RLock()
+	list := make([]*APIKeyDefaults, 0, len(s.defaults))
+	for _, defaults := range s.defaults {
+		list = append(list, defaults.copy())
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].UpdatedAt.After(list[j].UpdatedAt)
+	})
+	return list
+}
+
+// Delete removes the defaults with the given key ID
+func (s *APIKeyDefaultsService) Delete(keyID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.defaults[keyID]; !exists {
+		return fmt.Errorf("no defaults for API key %s", keyID)
+	}
+	delete(s.defaults, keyID)
+	return nil
+}
+
+// Apply returns the event properties with the API key's defaults added. Properties sent with the
+// event win over the defaults. The input is never modified.
+func (s *APIKeyDefaultsService) Apply(apiKey string, properties map[string]interface{}) map[string]interface{} {
+	s.mutex.RLock()
+	defaults, exists := s.defaults[APIKeyID(apiKey)]
+	s.mutex.RUnlock()
+
+	if !exists {
+		return properties
+	}
+
+	// Set replaces the defaults instead of modifying them, so they can be read without the lock
+	merged := make(map[string]interface{}, len(defaults.Properties)+len(properties))
+	for name, value := range defaults.Properties {
+		merged[name] = value
+	}
+	for name, value := range properties {
+		merged[name] = value
+	}
+	return merged
+}
+
+// copy returns a copy of the defaults
+func (d *APIKeyDefaults) copy() *APIKeyDefaults {
+	copied := *d
+	copied.Properties = make(map[string]interface{}, len(d.Properties))
+	for name, value := range d.Properties {
+		copied.Properties[name] = value
+	}
+	return &copied
+}
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// apiKeyIngestRoutes are the routes events are sent to, requiring the ingest scope
+var apiKeyIngestRoutes = map[string]bool{
+	"/api/v1/analytics/events":       true,
+	"/api/v1/analytics/mobile/batch": true,
+	"/api/v1/analytics/identify":     true,
+}
+
+// apiKeyReadPosts are the POST routes computing results without changing anything
+var apiKeyReadPosts = map[string]bool{
+	"/api/v1/analytics/usage/batch": true,
+	"/api/v1/retention/compute":     true,
+}
+
+// apiKeyExemptPrefixes are the routes authorized by other means: admin tokens, public dashboard
+// tokens and share tokens
+var apiKeyExemptPrefixes = []string{"/api/v1/admin/", "/api/v1/public/", "/api/v1/shared/"}
+
+// apiKeyScope returns the scope a request needs, or "" for routes API keys do not apply to.
+// Events are ingested, GET requests and computations read, and other requests change
+// configuration.
+func apiKeyScope(method, path string) string {
+	// Routes match whatever the case of the path, so it is classified in lower case
+	path = strings.ToLower(strings.TrimSuffix(path, "/"))
+	if !strings.HasPrefix(path, "/api/") {
+		return ""
+	}
+	for _, prefix := range apiKeyExemptPrefixes {
+		if strings.HasPrefix(path+"/", prefix) {
+			return ""
+		}
+	}
+
+	switch {
+	case method == fiber.MethodPost && apiKeyIngestRoutes[path]:
+		return APIKeyScopeIngest
+	case method == fiber.MethodPost && strings.HasPrefix(path, "/api/v1/heatmaps/") && strings.HasSuffix(path, "/points"):
+		return APIKeyScopeIngest
+	case method == fiber.MethodGet || method == fiber.MethodHead || method == fiber.MethodOptions:
+		return APIKeyScopeRead
+	case method == fiber.MethodPost && apiKeyReadPosts[path]:
+		return APIKeyScopeRead
+	}
+	return APIKeyScopeAdmin
+}
+
+// requireAPIKey returns a handler rejecting requests with an unknown, revoked or expired API key,
+// or a key without the scope of the route, once API keys are managed. Events may also be sent
+// with the accepted write keys of the request's project and by internal producers, which
+// requireWriteKey and ServiceAuth check instead.
+func (s *App) requireAPIKey() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !s.apiKeys.Enforced() {
+			return c.Next()
+		}
+		scope := apiKeyScope(c.Method(), c.Path())
+		if scope == "" {
+			return c.Next()
+		}
+
+		key := c.Get("X-API-Key")
+		if key == "" {
+			key = c.Query("api_key")
+		}
+		if scope == APIKeyScopeIngest && (hasServiceCredentials(c) || s.serviceAuth.IsServiceKey(key) || (key != "" && s.writeKeys.Accepts(projectIDFromRequest(c), key))) {
+			return c.Next()
+		}
+		if err := s.apiKeys.Authorize(key, scope); err != nil {
+			var rejected *APIKeyError
+			errors.As(err, &rejected)
+			status := http.StatusUnauthorized
+			if rejected.Scope != "" {
+				status = http.StatusForbidden
+			}
+			s.siem.Export(requestSecurityEvent(c, SecurityAuth, "api_key_rejected", OutcomeDenied, 5, map[string]interface{}{
+				"key_id":     rejected.KeyID,
+				"key_status": rejected.Status,
+				"scope":      scope,
+			}))
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Next()
+	}
+}
+
+// listAPIKeys returns the API keys with the requests sent with each
+func (s *App) listAPIKeys(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"api_keys": s.apiKeys.List(),
+	})
+}
+
+// getAPIKey returns an API key with its traffic
+func (s *App) getAPIKey(c *fiber.Ctx) error {
+	key, err := s.apiKeys.Get(c.Params("key_id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"api_key": key,
+	})
+}
+
+// createAPIKey creates an API key with the given scopes. The key is only part of this response.
+func (s *App) createAPIKey(c *fiber.Ctx) error {
+	var request struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	key, err := s.apiKeys.Create(request.Name, request.Scopes)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "api_key.create", key.ID, map[string]interface{}{
+		"name":   key.Name,
+		"scopes": key.Scopes,
+	})
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"status":  "success",
+		"api_key": key,
+	})
+}
+
+// rotateAPIKey replaces an API key by a new one with the same scopes, accepting the old key for a
+// grace period ("grace_period" in the body or ?grace_period, e.g. "24h", default
+// API_KEY_GRACE_PERIOD)
+func (s *App) rotateAPIKey(c *fiber.Ctx) error {
+	var request struct {
+		Name        string `json:"name"`
+		GracePeriod string `json:"grace_period"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+	if request.GracePeriod == "" {
+		request.GracePeriod = c.Query("grace_period")
+	}
+	gracePeriod := s.apiKeys.GracePeriod()
+	if request.GracePeriod != "" {
+		var err error
+		if gracePeriod, err = time.ParseDuration(request.GracePeriod); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid grace_period: " + err.Error(),
+			})
+		}
+	}
+
+	replacement, retired, err := s.apiKeys.Rotate(c.Params("key_id"), request.Name, gracePeriod)
+	if err != nil {
+		return c.Status(notFoundOrBadRequest(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "api_key.rotate", retired.ID, map[string]interface{}{
+		"replacement_id": replacement.ID,
+		"expires_at":     retired.ExpiresAt,
+	})
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"status":   "success",
+		"api_key":  replacement,
+		"retiring": retired,
+	})
+}
+
+// revokeAPIKey stops accepting an API key immediately
+func (s *App) revokeAPIKey(c *fiber.Ctx) error {
+	key, err := s.apiKeys.Revoke(utils.CopyString(c.Params("key_id")))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "api_key.revoke", key.ID, map[string]interface{}{
+		"requests": key.Requests,
+	})
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"api_key": key,
+	})
+}
@@ -0,0 +1,398 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// APIKeyUsageStore durably stores the requests of API keys per day (UTC), shared by the
+// instances of the service. Keys are identified by their APIKeyID.
+type APIKeyUsageStore interface {
+	// Add adds request counts of keys on a day and returns their totals after adding
+	Add(day string, counts map[string]int64) (map[string]int64, error)
+	// Load returns the totals of keys on a day; keys without requests are left out
+	Load(day string, keyIDs []string) (map[string]int64, error)
+}
+
+// MemoryAPIKeyUsageStore is an APIKeyUsageStore of a single instance, keeping the usage of the
+// last API_KEY_USAGE_DAYS days
+type MemoryAPIKeyUsageStore struct {
+	days  map[string]map[string]int64 // Day -> key ID -> requests
+	keep  int
+	mutex sync.Mutex
+}
+
+// NewMemoryAPIKeyUsageStore creates an in-memory API key usage store keeping API_KEY_USAGE_DAYS
+// days (default 31)
+func NewMemoryAPIKeyUsageStore() *MemoryAPIKeyUsageStore {
+	return &MemoryAPIKeyUsageStore{
+		days: make(map[string]map[string]int64),
+		keep: getEnvInt("API_KEY_USAGE_DAYS", 31),
+	}
+}
+
+// Add adds request counts of keys on a day and returns their totals, dropping the oldest days
+func (s *MemoryAPIKeyUsageStore) Add(day string, counts map[string]int64) (map[string]int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	usage, exists := s.days[day]
+	if !exists {
+		usage = make(map[string]int64)
+		s.days[day] = usage
+		s.prune()
+	}
+	totals := make(map[string]int64, len(counts))
+	for keyID, count := range counts {
+		usage[keyID] += count
+		totals[keyID] = usage[keyID]
+	}
+	return totals, nil
+}
+
+// Load returns the totals of keys on a day
+func (s *MemoryAPIKeyUsageStore) Load(day string, keyIDs []string) (map[string]int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	totals := make(map[string]int64, len(keyIDs))
+	for _, keyID := range keyIDs {
+		if total, exists := s.days[day][keyID]; exists {
+			totals[keyID] = total
+		}
+	}
+	return totals, nil
+}
+
+// prune drops the days beyond the kept number. Callers must hold the lock.
+func (s *MemoryAPIKeyUsageStore) prune() {
+	if len(s.days) <= s.keep {
+		return
+	}
+	days := make([]string, 0, len(s.days))
+	for day := range s.days {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	for _, day := range days[:len(days)-s.keep] {
+		delete(s.days, day)
+	}
+}
+
+// APIKeyUsageStats reports the cached usage counters
+type APIKeyUsageStats struct {
+	Keys          int64 `json:"keys"`           // Keys with a cached counter
+	Pending       int64 `json:"pending"`        // Requests counted but not flushed yet
+	Flushes       int64 `json:"flushes"`        // Flushes that stored counts
+	FlushFailures int64 `json:"flush_failures"` // Failed flushes, retried with the next flush
+	Refreshes     int64 `json:"refreshes"`      // Totals loaded from the store
+	Untracked     int64 `json:"untracked"`      // Requests of keys beyond the maximum number of counters
+}
+
+// apiKeyCounter counts the requests of an API key on a day. Its fields are updated atomically.
+type apiKeyCounter struct {
+	keyID       string
+	day         string
+	stored      int64 // Total in the store at the last flush or refresh
+	pending     int64 // Counted since, not flushed yet
+	lastSeen    int64 // Unix nanoseconds of the last request
+	refreshedAt int64 // Unix nanoseconds of the last flush or refresh
+	refreshing  int32 // 1 while the total is loaded from the store
+	evicted     int32 // 1 once removed from the counters
+}
+
+// apiKeyUsageDay caches the UTC day of the current time, so it is not formatted on every request
+type apiKeyUsageDay struct {
+	day        string
+	start, end int64 // Unix nanoseconds
+}
+
+// APIKeyUsage counts the requests of API keys per day (UTC) on the middleware hot path. Requests
+// are counted in memory with atomic operations and flushed to the durable store every
+// API_KEY_USAGE_FLUSH_INTERVAL; counters whose total was last read from the store more than
+// API_KEY_USAGE_REFRESH_INTERVAL ago reload it in the background, picking up the requests other
+// instances counted. Counts returned for a key are its total in the store plus what this
+// instance counted since, so they lag the other instances by up to the refresh interval.
+type APIKeyUsage struct {
+	store           APIKeyUsageStore
+	counters        sync.Map // API key -> *apiKeyCounter
+	keys            int64
+	maxKeys         int64
+	flushInterval   time.Duration
+	refreshInterval time.Duration
+	clock           Clock
+	today           atomic.Value     // *apiKeyUsageDay
+	retired         []*apiKeyCounter // Counters of past days and evicted counters with counts to flush
+	stats           APIKeyUsageStats
+	flushMutex      sync.Mutex // Serializes flushes and refreshes, so older totals do not overwrite newer ones
+	mutex           sync.Mutex // Guards retired
+	stop            chan struct{}
+	stopOnce        sync.Once
+}
+
+// NewAPIKeyUsage creates API key usage counters flushed to the store every
+// API_KEY_USAGE_FLUSH_INTERVAL (default 10s) and refreshed from it after
+// API_KEY_USAGE_REFRESH_INTERVAL (default 1m, 0 never reloads), for at most API_KEY_USAGE_MAX_KEYS
+// keys (default 100000) at once
+func NewAPIKeyUsage(store APIKeyUsageStore) *APIKeyUsage {
+	return &APIKeyUsage{
+		store:           store,
+		maxKeys:         int64(getEnvInt("API_KEY_USAGE_MAX_KEYS", 100000)),
+		flushInterval:   getEnvDuration("API_KEY_USAGE_FLUSH_INTERVAL", 10*time.Second),
+		refreshInterval: getEnvDuration("API_KEY_USAGE_REFRESH_INTERVAL", time.Minute),
+		clock:           SystemClock(),
+		stop:            make(chan struct{}),
+	}
+}
+
+// SetClock sets the clock requests are counted with
+func (u *APIKeyUsage) SetClock(clock Clock) {
+	u.clock = clock
+}
+
+// Start flushes the counters on the flush interval until stopped
+func (u *APIKeyUsage) Start() {
+	if u.flushInterval <= 0 {
+		log.Printf("API key usage is only flushed on shutdown")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(u.flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-u.stop:
+				return
+			case now := <-ticker.C:
+				u.Flush(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the background flushes and flushes the remaining counts
+func (u *APIKeyUsage) Stop() {
+	u.stopOnce.Do(func() {
+		close(u.stop)
+		u.Flush(u.clock.Now())
+	})
+}
+
+// Record counts a request of an API key and returns the key's requests today, including this
+// one. Requests of keys beyond the maximum number of counters are not counted and return 0.
+func (u *APIKeyUsage) Record(apiKey string) int64 {
+	now := u.clock.Now().UnixNano()
+	counter := u.counter(apiKey, u.day(now), true)
+	if counter == nil {
+		atomic.AddInt64(&u.stats.Untracked, 1)
+		return 0
+	}
+
+	pending := atomic.AddInt64(&counter.pending, 1)
+	if atomic.LoadInt32(&counter.evicted) == 1 {
+		// Evicted by a flush that may not have seen this request
+		u.retire(counter)
+	}
+	atomic.StoreInt64(&counter.lastSeen, now)
+	if u.refreshInterval > 0 && now-atomic.LoadInt64(&counter.refreshedAt) >= int64(u.refreshInterval) && atomic.CompareAndSwapInt32(&counter.refreshing, 0, 1) {
+		go u.refresh(counter)
+	}
+	return atomic.LoadInt64(&counter.stored) + pending
+}
+
+// Usage returns the requests of an API key today as known to this instance
+func (u *APIKeyUsage) Usage(apiKey string) int64 {
+	counter := u.counter(apiKey, u.day(u.clock.Now().UnixNano()), false)
+	if counter == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&counter.stored) + atomic.LoadInt64(&counter.pending)
+}
+
+// day returns the UTC day of a time, formatted when the day changes
+func (u *APIKeyUsage) day(now int64) string {
+	if today, ok := u.today.Load().(*apiKeyUsageDay); ok && now >= today.start && now < today.end {
+		return today.day
+	}
+	start := time.Unix(0, now).UTC().Truncate(24 * time.Hour)
+	today := &apiKeyUsageDay{day: start.Format("2006-01-02"), start: start.UnixNano(), end: start.Add(24 * time.Hour).UnixNano()}
+	u.today.Store(today)
+	return today.day
+}
+
+// counter returns the counter of an API key on a day, creating it when create is set and the
+// maximum number of counters is not reached. The counter of a previous day is retired.
+func (u *APIKeyUsage) counter(apiKey, day string, create bool) *apiKeyCounter {
+	value, exists := u.counters.Load(apiKey)
+	if exists && value.(*apiKeyCounter).day == day {
+		return value.(*apiKeyCounter)
+	}
+	if !create {
+		return nil
+	}
+
+	if !exists && atomic.AddInt64(&u.keys, 1) > u.maxKeys {
+		atomic.AddInt64(&u.keys, -1)
+		return nil
+	}
+	counter := &apiKeyCounter{keyID: APIKeyID(apiKey), day: day}
+	if !exists {
+		if _, loaded := u.counters.LoadOrStore(apiKey, counter); loaded {
+			atomic.AddInt64(&u.keys, -1)
+			return u.counter(apiKey, day, create)
+		}
+		return counter
+	}
+
+	// A new day: the previous counter is flushed under its own day
+	if !u.counters.CompareAndSwap(apiKey, value, counter) {
+		return u.counter(apiKey, day, create)
+	}
+	previous := value.(*apiKeyCounter)
+	atomic.StoreInt32(&previous.evicted, 1)
+	u.retire(previous)
+	return counter
+}
+
+// retire keeps a counter removed from the counters until its counts are flushed
+func (u *APIKeyUsage) retire(counter *apiKeyCounter) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for _, retired := range u.retired {
+		if retired == counter {
+			return
+		}
+	}
+	u.retired = append(u.retired, counter)
+}
+
+// refresh loads the total of a counter from the store
+func (u *APIKeyUsage) refresh(counter *apiKeyCounter) {
+	defer atomic.StoreInt32(&counter.refreshing, 0)
+
+	u.flushMutex.Lock()
+	defer u.flushMutex.Unlock()
+
+	totals, err := u.store.Load(counter.day, []string{counter.keyID})
+	if err != nil {
+		log.Printf("Warning: Failed to load the usage of API key %s: %v", counter.keyID, err)
+		return
+	}
+	atomic.StoreInt64(&counter.stored, totals[counter.keyID])
+	atomic.StoreInt64(&counter.refreshedAt, u.clock.Now().UnixNano())
+	atomic.AddInt64(&u.stats.Refreshes, 1)
+}
+
+// Flush adds the pending counts to the store and updates the counters with the stored totals.
+// Counters idle for the refresh interval are dropped. Counts that fail to be stored are kept
+// for the next flush. It returns how many requests were stored.
+func (u *APIKeyUsage) Flush(now time.Time) int64 {
+	u.flushMutex.Lock()
+	defer u.flushMutex.Unlock()
+
+	u.mutex.Lock()
+	counters := u.retired
+	u.retired = nil
+	u.mutex.Unlock()
+
+	idleSince := now.Add(-u.refreshInterval).UnixNano()
+	u.counters.Range(func(key, value interface{}) bool {
+		counter := value.(*apiKeyCounter)
+		counters = append(counters, counter)
+		if atomic.LoadInt64(&counter.pending) == 0 && atomic.LoadInt64(&counter.lastSeen) < idleSince {
+			// Requests recording after this see the flag and retire the counter themselves
+			atomic.StoreInt32(&counter.evicted, 1)
+			if u.counters.CompareAndDelete(key, value) {
+				atomic.AddInt64(&u.keys, -1)
+			}
+		}
+		return true
+	})
+
+	// Pending counts by day and key ID
+	counts := make(map[string]map[string]int64)
+	flushed := make(map[string][]pendingAPIKeyCount)
+	for _, counter := range counters {
+		pending := atomic.SwapInt64(&counter.pending, 0)
+		if pending == 0 {
+			continue
+		}
+		if counts[counter.day] == nil {
+			counts[counter.day] = make(map[string]int64)
+		}
+		counts[counter.day][counter.keyID] += pending
+		flushed[counter.day] = append(flushed[counter.day], pendingAPIKeyCount{counter: counter, count: pending})
+		atomic.AddInt64(&counter.stored, pending) // Until the store returns the total
+	}
+
+	var stored int64
+	for day, dayCounts := range counts {
+		totals, err := u.store.Add(day, dayCounts)
+		if err != nil {
+			atomic.AddInt64(&u.stats.FlushFailures, 1)
+			log.Printf("Warning: Failed to store the API key usage of %s: %v", day, err)
+			for _, pending := range flushed[day] {
+				atomic.AddInt64(&pending.counter.stored, -pending.count)
+				atomic.AddInt64(&pending.counter.pending, pending.count)
+				if atomic.LoadInt32(&pending.counter.evicted) == 1 {
+					u.retire(pending.counter) // Live counters are flushed again with the others
+				}
+			}
+			continue
+		}
+
+		atomic.AddInt64(&u.stats.Flushes, 1)
+		for _, pending := range flushed[day] {
+			stored += pending.count
+			atomic.StoreInt64(&pending.counter.stored, totals[pending.counter.keyID])
+			atomic.StoreInt64(&pending.counter.refreshedAt, now.UnixNano())
+		}
+	}
+	return stored
+}
+
+// pendingAPIKeyCount is a count taken from a counter by a flush
+type pendingAPIKeyCount struct {
+	counter *apiKeyCounter
+	count   int64
+}
+
+// Stats returns the counters of the cached usage
+func (u *APIKeyUsage) Stats() APIKeyUsageStats {
+	stats := APIKeyUsageStats{
+		Keys:          atomic.LoadInt64(&u.keys),
+		Flushes:       atomic.LoadInt64(&u.stats.Flushes),
+		FlushFailures: atomic.LoadInt64(&u.stats.FlushFailures),
+		Refreshes:     atomic.LoadInt64(&u.stats.Refreshes),
+		Untracked:     atomic.LoadInt64(&u.stats.Untracked),
+	}
+	u.counters.Range(func(key, value interface{}) bool {
+		stats.Pending += atomic.LoadInt64(&value.(*apiKeyCounter).pending)
+		return true
+	})
+	u.mutex.Lock()
+	for _, counter := range u.retired {
+		stats.Pending += atomic.LoadInt64(&counter.pending)
+	}
+	u.mutex.Unlock()
+	return stats
+}
+
+// WriteMetrics writes the usage counter statistics in the Prometheus text exposition format
+func (u *APIKeyUsage) WriteMetrics(w io.Writer) error {
+	stats := u.Stats()
+	_, err := fmt.Fprintf(w, "# HELP analytics_api_key_usage_keys API keys with a cached usage counter.\n# TYPE analytics_api_key_usage_keys gauge\nanalytics_api_key_usage_keys %d\n"+
+		"# HELP analytics_api_key_usage_pending Requests counted per API key but not flushed to the store yet.\n# TYPE analytics_api_key_usage_pending gauge\nanalytics_api_key_usage_pending %d\n"+
+		"# HELP analytics_api_key_usage_flushes_total Flushes of API key usage to the store by outcome.\n# TYPE analytics_api_key_usage_flushes_total counter\n"+
+		"analytics_api_key_usage_flushes_total{outcome=\"stored\"} %d\nanalytics_api_key_usage_flushes_total{outcome=\"failed\"} %d\n"+
+		"# HELP analytics_api_key_usage_untracked_total Requests of API keys beyond the maximum number of counters.\n# TYPE analytics_api_key_usage_untracked_total counter\nanalytics_api_key_usage_untracked_total %d\n",
+		stats.Keys, stats.Pending, stats.Flushes, stats.FlushFailures, stats.Untracked)
+	return err
+}
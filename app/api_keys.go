@@ -0,0 +1,397 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// API key scopes
+const (
+	APIKeyScopeIngest = "ingest" // Send events
+	APIKeyScopeRead   = "read"   // Query analytics and stream dashboards
+	APIKeyScopeAdmin  = "admin"  // Change configuration; grants the other scopes too
+)
+
+// apiKeyScopes are the supported scopes, in the order they are described in errors
+var apiKeyScopes = []string{APIKeyScopeIngest, APIKeyScopeRead, APIKeyScopeAdmin}
+
+// API key states
+const (
+	APIKeyActive   = "active"
+	APIKeyRetiring = "retiring" // Replaced by a rotation, accepted until its grace period ends
+	APIKeyExpired  = "expired"  // Grace period over
+	APIKeyRevoked  = "revoked"
+)
+
+// Limits of API keys
+const (
+	apiKeyPrefix         = "ak_"
+	maxAPIKeyGracePeriod = 90 * 24 * time.Hour
+	apiKeyVisibleLength  = len(apiKeyPrefix) + 6 // Characters of a key shown to recognize it
+)
+
+// APIKey is a managed key clients call the API with, limited to its scopes. The key itself is
+// only returned when created; afterwards it is identified by its ID and prefix.
+type APIKey struct {
+	ID         string     `json:"id"` // APIKeyID of the key
+	Name       string     `json:"name,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`  // End of the grace period of a retiring key
+	ReplacedBy string     `json:"replaced_by,omitempty"` // ID of the key a rotation created in its place
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Requests   int64      `json:"requests"` // Requests authenticated with the key
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Key        string     `json:"key,omitempty"` // Only set when the key is created
+}
+
+// HasScope reports whether the key grants a scope. The admin scope grants every scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope || granted == APIKeyScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyError is the reason a request's API key was rejected
+type APIKeyError struct {
+	KeyID  string // Empty for missing and unknown keys
+	Status string // State of a known key that is no longer accepted
+	Scope  string // Scope the key lacks, for keys that are accepted
+}
+
+func (e *APIKeyError) Error() string {
+	switch {
+	case e.Scope != "":
+		return fmt.Sprintf("API key %s lacks the %s scope", e.KeyID, e.Scope)
+	case e.Status == APIKeyRevoked:
+		return fmt.Sprintf("API key %s has been revoked", e.KeyID)
+	case e.Status == APIKeyExpired:
+		return fmt.Sprintf("API key %s was rotated and its grace period is over", e.KeyID)
+	case e.Status == apiKeyMissing:
+		return "API key is required"
+	case e.KeyID == "":
+		return "invalid API key"
+	}
+	return fmt.Sprintf("API key %s is %s", e.KeyID, e.Status)
+}
+
+// apiKeyMissing is the status of the APIKeyError of requests without a key
+const apiKeyMissing = "missing"
+
+// apiKey is a registered key with its traffic, counted without holding the service's lock
+type apiKey struct {
+	APIKey
+	requests atomic.Int64
+	lastUsed atomic.Int64 // Unix nanoseconds, 0 before the first request
+}
+
+// APIKeyService manages the API keys of the service. Keys are stored by the SHA-256 of the key,
+// which is only known to the caller that created it. As long as no key exists, requests are
+// accepted with any API key or none, as before keys were managed, unless API_KEYS_REQUIRED is set;
+// once a key exists, requests must use a known, unrevoked key granting the scope of the route.
+type APIKeyService struct {
+	keys        map[string]*apiKey // Keyed by APIKeyID
+	required    bool               // Whether API keys are checked before any key exists
+	gracePeriod time.Duration      // Default grace period of rotations
+	clock       Clock
+	mutex       sync.RWMutex
+}
+
+// NewAPIKeyService creates an API key service configured from API_KEYS (comma-separated
+// "name:key:scope+scope" entries), API_KEYS_REQUIRED and API_KEY_GRACE_PERIOD
+func NewAPIKeyService() *APIKeyService {
+	service := &APIKeyService{
+		keys:        make(map[string]*apiKey),
+		required:    os.Getenv("API_KEYS_REQUIRED") == "true",
+		gracePeriod: getEnvDuration("API_KEY_GRACE_PERIOD", 24*time.Hour),
+		clock:       SystemClock(),
+	}
+
+	for i, entry := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			log.Printf("Warning: Ignoring malformed API_KEYS entry #%d", i+1)
+			continue
+		}
+		if _, err := service.Register(parts[0], parts[1], strings.Split(parts[2], "+")); err != nil {
+			log.Printf("Warning: Ignoring API_KEYS entry #%d: %v", i+1, err)
+		}
+	}
+
+	return service
+}
+
+// SetClock replaces the clock grace periods are measured with
+func (s *APIKeyService) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// GracePeriod returns the default grace period of rotations
+func (s *APIKeyService) GracePeriod() time.Duration {
+	return s.gracePeriod
+}
+
+// Enforced reports whether API keys are checked, because keys exist or are required
+func (s *APIKeyService) Enforced() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.required || len(s.keys) > 0
+}
+
+// Required reports whether API keys are checked before any key exists
+func (s *APIKeyService) Required() bool {
+	return s.required
+}
+
+// Create generates a new active key with the given scopes
+func (s *APIKeyService) Create(name string, scopes []string) (*APIKey, error) {
+	scopes, err := normalizeAPIKeyScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	created := s.add(name, key, scopes)
+	created.Key = key
+	return created, nil
+}
+
+// Register adds a key chosen by the operator, such as one configured in API_KEYS
+func (s *APIKeyService) Register(name, key string, scopes []string) (*APIKey, error) {
+	if len(key) < 16 {
+		return nil, fmt.Errorf("API keys need at least 16 characters")
+	}
+	scopes, err := normalizeAPIKeyScopes(scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.keys[APIKeyID(key)]; exists {
+		return nil, fmt.Errorf("API key %s already exists", APIKeyID(key))
+	}
+	return s.add(name, key, scopes), nil
+}
+
+// Rotate replaces an active key by a new one with the same scopes. The old key is accepted for
+// the grace period and is then expired; without a grace period, it stops being accepted at once.
+func (s *APIKeyService) Rotate(keyID, name string, gracePeriod time.Duration) (replacement *APIKey, retired *APIKey, err error) {
+	if gracePeriod < 0 || gracePeriod > maxAPIKeyGracePeriod {
+		return nil, nil, fmt.Errorf("grace period must be between 0s and %s", maxAPIKeyGracePeriod)
+	}
+
+	newKey, err := generateAPIKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, err := s.get(keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := s.clock.Now()
+	if status := key.status(now); status != APIKeyActive {
+		return nil, nil, fmt.Errorf("API key %s is %s, only active keys can be rotated", keyID, status)
+	}
+	if name == "" {
+		name = key.Name
+	}
+
+	replacement = s.add(name, newKey, key.Scopes)
+	replacement.Key = newKey
+	expiresAt := now.Add(gracePeriod)
+	key.ExpiresAt = &expiresAt
+	key.ReplacedBy = replacement.ID
+	return replacement, key.snapshot(now), nil
+}
+
+// Revoke stops accepting a key immediately, whether active or retiring
+func (s *APIKeyService) Revoke(keyID string) (*APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, err := s.get(keyID)
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	if key.RevokedAt == nil {
+		key.RevokedAt = &now
+	}
+	return key.snapshot(now), nil
+}
+
+// List returns the keys with their traffic, oldest first
+func (s *APIKeyService) List() []*APIKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := s.clock.Now()
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key.snapshot(now))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// Get returns a key with its traffic
+func (s *APIKeyService) Get(keyID string) (*APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key, err := s.get(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return key.snapshot(s.clock.Now()), nil
+}
+
+// Authorize checks that a managed key is accepted and grants a scope, and counts the request for
+// the key. It returns an APIKeyError when the key is not accepted.
+func (s *APIKeyService) Authorize(key, scope string) error {
+	if key == "" {
+		return &APIKeyError{Status: apiKeyMissing}
+	}
+
+	s.mutex.RLock()
+	registered, exists := s.keys[APIKeyID(key)]
+	var status string
+	if exists {
+		status = registered.status(s.clock.Now())
+	}
+	s.mutex.RUnlock()
+
+	if !exists {
+		return &APIKeyError{}
+	}
+	if status != APIKeyActive && status != APIKeyRetiring {
+		return &APIKeyError{KeyID: registered.ID, Status: status}
+	}
+	if !registered.HasScope(scope) {
+		return &APIKeyError{KeyID: registered.ID, Scope: scope}
+	}
+	registered.requests.Add(1)
+	registered.lastUsed.Store(s.clock.Now().UnixNano())
+	return nil
+}
+
+// add registers a key and returns its snapshot. Callers must hold the lock.
+func (s *APIKeyService) add(name, key string, scopes []string) *APIKey {
+	prefix := key
+	if len(prefix) > apiKeyVisibleLength {
+		prefix = prefix[:apiKeyVisibleLength]
+	}
+	registered := &apiKey{
+		APIKey: APIKey{
+			ID:        APIKeyID(key),
+			Name:      name,
+			Prefix:    prefix,
+			Scopes:    scopes,
+			CreatedAt: s.clock.Now(),
+		},
+	}
+	s.keys[registered.ID] = registered
+	return registered.snapshot(registered.CreatedAt)
+}
+
+// get returns a key. Callers must hold the lock.
+func (s *APIKeyService) get(keyID string) (*apiKey, error) {
+	key, exists := s.keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("API key %s not found", keyID)
+	}
+	return key, nil
+}
+
+// generateAPIKey returns a new random key
+func generateAPIKey() (string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %w", err)
+	}
+	return apiKeyPrefix + hex.EncodeToString(secret), nil
+}
+
+// normalizeAPIKeyScopes validates scopes and returns them sorted without duplicates
+func normalizeAPIKeyScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required. Valid scopes are: %s", strings.Join(apiKeyScopes, ", "))
+	}
+	seen := make(map[string]bool, len(scopes))
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		valid := false
+		for _, known := range apiKeyScopes {
+			valid = valid || scope == known
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid scope: %s. Valid scopes are: %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+// status returns the state of the key at a time. Callers must hold the lock.
+func (k *apiKey) status(now time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return APIKeyRevoked
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return APIKeyExpired
+	case k.ExpiresAt != nil:
+		return APIKeyRetiring
+	}
+	return APIKeyActive
+}
+
+// snapshot returns a copy of the key with its state and traffic at a time. Callers must hold the lock.
+func (k *apiKey) snapshot(now time.Time) *APIKey {
+	snapshot := k.APIKey
+	snapshot.Scopes = append([]string(nil), k.Scopes...)
+	snapshot.Status = k.status(now)
+	snapshot.Requests = k.requests.Load()
+	if lastUsed := k.lastUsed.Load(); lastUsed > 0 {
+		at := time.Unix(0, lastUsed).UTC()
+		snapshot.LastUsedAt = &at
+	}
+	return &snapshot
+}
@@ -0,0 +1,376 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+)
+
+// APIUsageEventType is the event type of the API usage records published to Kafka
+const APIUsageEventType = "analytics.api.request"
+
+// APIUsageRecord describes a served API request. Records are published by the tracking
+// middleware for every request, billed or not, so other services can subscribe to them.
+type APIUsageRecord struct {
+	ProjectID      string    `json:"project_id"`
+	UserID         string    `json:"user_id,omitempty"`        // Empty for anonymous requests
+	BilledUserID   string    `json:"billed_user_id,omitempty"` // Empty when the request was not billed
+	APIKeyID       string    `json:"api_key_id,omitempty"`     // Fingerprint of the API key, never the key itself
+	Method         string    `json:"method"`
+	Route          string    `json:"route"` // Route pattern, e.g. /api/v1/funnels/:id/compute
+	Path           string    `json:"path"`
+	StatusCode     int       `json:"status_code"`
+	ResponseTimeMs int64     `json:"response_time_ms"`
+	ResponseSize   int64     `json:"response_size"`
+	IPAddress      string    `json:"ip_address,omitempty"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// APIUsagePublisher delivers API usage records to the API metrics
+type APIUsagePublisher interface {
+	// Publish sends a record without blocking the request
+	Publish(record *APIUsageRecord)
+	// Close flushes pending records
+	Close()
+}
+
+// directAPIUsagePublisher records usage into the API metrics in-process, used without Kafka
+type directAPIUsagePublisher struct {
+	metrics *APIMetrics
+}
+
+// NewDirectAPIUsagePublisher creates a publisher recording usage straight into the API metrics
+func NewDirectAPIUsagePublisher(metrics *APIMetrics) APIUsagePublisher {
+	return &directAPIUsagePublisher{metrics: metrics}
+}
+
+// Publish records the usage
+func (p *directAPIUsagePublisher) Publish(record *APIUsageRecord) {
+	p.metrics.Record(record)
+}
+
+// Close does nothing, records are never pending
+func (p *directAPIUsagePublisher) Close() {}
+
+// KafkaAPIUsagePublisher publishes API usage records to a Kafka topic, keyed by project
+type KafkaAPIUsagePublisher struct {
+	producer sarama.AsyncProducer
+	topic    string
+	dropped  atomic.Int64
+	done     chan struct{}
+}
+
+// NewKafkaAPIUsagePublisher creates a publisher producing usage records to the topic
+func NewKafkaAPIUsagePublisher(brokers []string, topic string) (*KafkaAPIUsagePublisher, error) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Errors = true
+	config.Producer.RequiredAcks = sarama.WaitForLocal
+
+	producer, err := sarama.NewAsyncProducer(brokers, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka producer: %w", err)
+	}
+
+	publisher := &KafkaAPIUsagePublisher{
+		producer: producer,
+		topic:    topic,
+		done:     make(chan struct{}),
+	}
+	go publisher.logErrors()
+
+	return publisher, nil
+}
+
+// Publish queues the record for the producer, dropping it if the producer is backed up
+func (p *KafkaAPIUsagePublisher) Publish(record *APIUsageRecord) {
+	value, err := json.Marshal(NewAPIUsageEvent(record))
+	if err != nil {
+		log.Printf("Warning: Failed to marshal API usage record: %v", err)
+		return
+	}
+
+	select {
+	case p.producer.Input() <- &sarama.ProducerMessage{
+		Topic: p.topic,
+		Key:   sarama.StringEncoder(record.ProjectID),
+		Value: sarama.ByteEncoder(value),
+	}:
+	default:
+		if p.dropped.Add(1)%1000 == 1 {
+			log.Printf("Warning: Kafka producer is backed up, dropping API usage records (%d so far)", p.dropped.Load())
+		}
+	}
+}
+
+// Dropped returns the number of records dropped because the producer was backed up
+func (p *KafkaAPIUsagePublisher) Dropped() int64 {
+	return p.dropped.Load()
+}
+
+// Close flushes pending records and closes the producer
+func (p *KafkaAPIUsagePublisher) Close() {
+	if err := p.producer.Close(); err != nil {
+		log.Printf("Error closing Kafka producer: %v", err)
+	}
+	<-p.done
+}
+
+// logErrors logs the records the producer failed to deliver
+func (p *KafkaAPIUsagePublisher) logErrors() {
+	defer close(p.done)
+	for err := range p.producer.Errors() {
+		log.Printf("Warning: Failed to publish API usage record: %v", err.Err)
+	}
+}
+
+// NewAPIUsageEvent wraps a usage record in the cross-service event envelope of the Kafka topics
+func NewAPIUsageEvent(record *APIUsageRecord) *CrossServiceEvent {
+	data := make(map[string]interface{})
+	encoded, _ := json.Marshal(record)
+	_ = json.Unmarshal(encoded, &data)
+
+	return &CrossServiceEvent{
+		ID:        uuid.New().String(),
+		Source:    "analytics",
+		EventType: APIUsageEventType,
+		UserID:    record.UserID,
+		Timestamp: record.Timestamp,
+		Data:      data,
+	}
+}
+
+// APITrafficStats summarizes API requests
+type APITrafficStats struct {
+	Requests          int64   `json:"requests"`
+	ClientErrors      int64   `json:"client_errors"` // 4xx responses
+	ServerErrors      int64   `json:"server_errors"` // 5xx responses
+	ErrorRate         float64 `json:"error_rate"`    // Percentage of requests with a 4xx or 5xx response
+	Anonymous         int64   `json:"anonymous"`     // Requests without a user ID
+	AvgResponseTimeMs float64 `json:"avg_response_time_ms"`
+	MaxResponseTimeMs int64   `json:"max_response_time_ms"`
+	ResponseBytes     int64   `json:"response_bytes"`
+
+	totalResponseTimeMs int64
+}
+
+// APIRouteMetrics is the traffic of a single route
+type APIRouteMetrics struct {
+	Method string `json:"method"`
+	Route  string `json:"route"`
+	APITrafficStats
+}
+
+// APIMetricsPoint is the traffic of a project in one hour
+type APIMetricsPoint struct {
+	Time time.Time `json:"time"`
+	APITrafficStats
+}
+
+// APIMetricsReport is the API traffic of a project in a time range
+type APIMetricsReport struct {
+	ProjectID string            `json:"project_id"`
+	TimeRange TimeRange         `json:"time_range"`
+	Totals    APITrafficStats   `json:"totals"`
+	Routes    []APIRouteMetrics `json:"routes"`   // Busiest routes first
+	Timeline  []APIMetricsPoint `json:"timeline"` // Hours with traffic, oldest first
+}
+
+// APIMetrics aggregates API usage records into hourly per-project, per-route traffic
+type APIMetrics struct {
+	buckets   map[string]map[time.Time]map[string]*APIRouteMetrics // Project -> hour -> route
+	retention time.Duration                                        // Age of the newest record after which hours are dropped
+	latest    time.Time
+	slos      *SLOTracker // Also counts the requests of ingestion routes, if set
+	mutex     sync.RWMutex
+}
+
+// NewAPIMetrics creates API metrics keeping API_METRICS_RETENTION of hourly traffic (default 30 days)
+func NewAPIMetrics() *APIMetrics {
+	return &APIMetrics{
+		buckets:   make(map[string]map[time.Time]map[string]*APIRouteMetrics),
+		retention: getEnvDuration("API_METRICS_RETENTION", 30*24*time.Hour),
+	}
+}
+
+// SetSLOTracker counts every recorded request against the ingestion objectives too
+func (m *APIMetrics) SetSLOTracker(slos *SLOTracker) {
+	m.slos = slos
+}
+
+// HandleEvent records the usage record carried by an API usage event consumed from Kafka
+func (m *APIMetrics) HandleEvent(ctx context.Context, event *CrossServiceEvent) error {
+	encoded, err := json.Marshal(event.Data)
+	if err != nil {
+		return fmt.Errorf("failed to read API usage record: %w", err)
+	}
+	var record APIUsageRecord
+	if err := json.Unmarshal(encoded, &record); err != nil {
+		return fmt.Errorf("failed to read API usage record: %w", err)
+	}
+	if record.Method == "" || record.Timestamp.IsZero() {
+		return fmt.Errorf("invalid API usage record: method and timestamp are required")
+	}
+
+	m.Record(&record)
+	return nil
+}
+
+// Record adds a usage record to the hour it happened in
+func (m *APIMetrics) Record(record *APIUsageRecord) {
+	projectID := projectOrDefault(record.ProjectID)
+	hour := record.Timestamp.UTC().Truncate(time.Hour)
+	route := record.Route
+	if route == "" {
+		route = record.Path
+	}
+	if m.slos != nil {
+		m.slos.Record(record)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if record.Timestamp.After(m.latest) {
+		m.latest = record.Timestamp
+		m.prune()
+	}
+	// Records arriving after their hour was dropped are ignored
+	if hour.Add(time.Hour).Before(m.latest.Add(-m.retention)) {
+		return
+	}
+
+	hours, exists := m.buckets[projectID]
+	if !exists {
+		hours = make(map[time.Time]map[string]*APIRouteMetrics)
+		m.buckets[projectID] = hours
+	}
+	routes, exists := hours[hour]
+	if !exists {
+		routes = make(map[string]*APIRouteMetrics)
+		hours[hour] = routes
+	}
+	key := record.Method + " " + route
+	metrics, exists := routes[key]
+	if !exists {
+		metrics = &APIRouteMetrics{Method: record.Method, Route: route}
+		routes[key] = metrics
+	}
+	metrics.APITrafficStats.record(record)
+}
+
+// prune drops the hours past the retention. Callers must hold the lock.
+func (m *APIMetrics) prune() {
+	cutoff := m.latest.Add(-m.retention)
+	for projectID, hours := range m.buckets {
+		for hour := range hours {
+			if hour.Add(time.Hour).Before(cutoff) {
+				delete(hours, hour)
+			}
+		}
+		if len(hours) == 0 {
+			delete(m.buckets, projectID)
+		}
+	}
+}
+
+// Report returns the API traffic of a project in the hours overlapping the time range
+func (m *APIMetrics) Report(projectID string, start, end time.Time) (*APIMetricsReport, error) {
+	if !end.After(start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+
+	report := &APIMetricsReport{
+		ProjectID: projectOrDefault(projectID),
+		TimeRange: TimeRange{Start: start, End: end},
+		Routes:    []APIRouteMetrics{},
+		Timeline:  []APIMetricsPoint{},
+	}
+
+	m.mutex.RLock()
+	routes := make(map[string]*APIRouteMetrics)
+	for hour, hourRoutes := range m.buckets[report.ProjectID] {
+		if !hour.Add(time.Hour).After(start) || !hour.Before(end) {
+			continue
+		}
+		point := APIMetricsPoint{Time: hour}
+		for key, metrics := range hourRoutes {
+			point.add(&metrics.APITrafficStats)
+			total, exists := routes[key]
+			if !exists {
+				total = &APIRouteMetrics{Method: metrics.Method, Route: metrics.Route}
+				routes[key] = total
+			}
+			total.add(&metrics.APITrafficStats)
+		}
+		point.finish()
+		report.Timeline = append(report.Timeline, point)
+	}
+	m.mutex.RUnlock()
+
+	for _, route := range routes {
+		report.Totals.add(&route.APITrafficStats)
+		route.finish()
+		report.Routes = append(report.Routes, *route)
+	}
+	report.Totals.finish()
+
+	sort.Slice(report.Routes, func(i, j int) bool {
+		if report.Routes[i].Requests != report.Routes[j].Requests {
+			return report.Routes[i].Requests > report.Routes[j].Requests
+		}
+		if report.Routes[i].Route != report.Routes[j].Route {
+			return report.Routes[i].Route < report.Routes[j].Route
+		}
+		return report.Routes[i].Method < report.Routes[j].Method
+	})
+	sort.Slice(report.Timeline, func(i, j int) bool {
+		return report.Timeline[i].Time.Before(report.Timeline[j].Time)
+	})
+
+	return report, nil
+}
+
+// record counts a request
+func (s *APITrafficStats) record(record *APIUsageRecord) {
+	s.Requests++
+	switch {
+	case record.StatusCode >= 500:
+		s.ServerErrors++
+	case record.StatusCode >= 400:
+		s.ClientErrors++
+	}
+	if record.UserID == "" {
+		s.Anonymous++
+	}
+	s.totalResponseTimeMs += record.ResponseTimeMs
+	s.MaxResponseTimeMs = max(s.MaxResponseTimeMs, record.ResponseTimeMs)
+	s.ResponseBytes += record.ResponseSize
+}
+
+// add adds the requests of other to the stats
+func (s *APITrafficStats) add(other *APITrafficStats) {
+	s.Requests += other.Requests
+	s.ClientErrors += other.ClientErrors
+	s.ServerErrors += other.ServerErrors
+	s.Anonymous += other.Anonymous
+	s.totalResponseTimeMs += other.totalResponseTimeMs
+	s.MaxResponseTimeMs = max(s.MaxResponseTimeMs, other.MaxResponseTimeMs)
+	s.ResponseBytes += other.ResponseBytes
+}
+
+// finish computes the rates and averages
+func (s *APITrafficStats) finish() {
+	if s.Requests == 0 {
+		return
+	}
+	s.ErrorRate = float64(s.ClientErrors+s.ServerErrors) / float64(s.Requests) * 100
+	s.AvgResponseTimeMs = float64(s.totalResponseTimeMs) / float64(s.Requests)
+}
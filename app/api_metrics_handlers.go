@@ -0,0 +1,33 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getProjectAPIMetrics returns the API traffic of a project per route and hour, over ?start_date
+// and ?end_date (default the last 30 days)
+func (s *App) getProjectAPIMetrics(c *fiber.Ctx) error {
+	start, end, err := queryTimeRange(map[string]interface{}{
+		"start_date": c.Query("start_date"),
+		"end_date":   c.Query("end_date"),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	report, err := s.apiMetrics.Report(c.Params("id"), start, end)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"metrics": report,
+	})
+}
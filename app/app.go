@@ -1,11 +1,16 @@
 package app
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,20 +19,73 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"github.com/gofiber/fiber/v2/utils"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/trace"
 )
 
 // App represents the analytics application
 type App struct {
-	app              *fiber.App
-	tracer           trace.Tracer
-	port             string
-	analyticsService *AnalyticsService
-	kafkaConsumer    *KafkaConsumerService
-	dashboardService *DashboardService
-	funnelService    *FunnelService
-	heatmapService   *HeatmapService
+	app                   *fiber.App
+	tracer                trace.Tracer
+	port                  string
+	analyticsService      *AnalyticsService
+	kafkaConsumer         *KafkaConsumerService
+	dashboardService      *DashboardService
+	funnelService         *FunnelService
+	heatmapService        *HeatmapService
+	heatmapRefresher      *HeatmapRefresher
+	derivedMetrics        *DerivedMetrics
+	liveFunnels           *LiveFunnels // Funnels whose users are followed as events are stored
+	queryService          *QueryService
+	formService           *FormService
+	retentionService      *RetentionService
+	sessionService        *SessionService
+	performanceService    *PerformanceService
+	savedQueryService     *SavedQueryService
+	savedDashboardService *SavedDashboardService
+	organizationService   *OrganizationService
+	projectConfigService  *ProjectConfigService
+	goalService           *GoalService
+	trackingPool          *WorkerPool
+	ingestion             *AsyncIngestion
+	jobs                  *Jobs // Long computations accepted with "Prefer: respond-async"
+	eventPurger           *EventPurger
+	billingReconciler     *BillingReconciler // Retries billing events the billing service did not receive
+	adminAuth             *AdminAuth
+	auditLog              *AuditLog
+	serviceAuth           *ServiceAuth
+	exportKeys            *ExportKeys    // Public keys exports of each project are encrypted to
+	writeKeys             *WriteKeys     // Keys SDKs send the events of each project with
+	apiKeys               *APIKeyService // Managed API keys and their scopes
+	runtimeSettings       *RuntimeSettings
+	anonymousPolicy       *AnonymousPolicy
+	apiMetrics            *APIMetrics
+	caches                *CacheRegistry       // Bounded caches reported on /metrics
+	faults                *FaultInjector       // Faults injected into dependencies for testing
+	siem                  *SIEMExporter        // Streams security events to an external SIEM
+	metricsPush           *MetricsPusher       // Pushes the internal metrics where they cannot be scraped
+	traffic               *TrafficMonitor      // Alerts on anomalies in the ingestion traffic
+	slos                  *SLOTracker          // Error budgets and burn rate alerts of the ingestion objectives
+	funnelWebhook         *FunnelWebhook       // Posted funnel results computed in the background
+	apiKeyUsage           *APIKeyUsage         // Requests per API key, counted on every request
+	timeline              *UserTimeline        // Events, sessions and cross-service events per user
+	profiles              *UserProfiles        // Profiles and lifecycle stages from auth and billing events
+	bootstrap             *ProfileBootstrap    // Seeds the profiles from the history of other services
+	features              *FeatureFlags        // Analytics features each project may use, by plan
+	kafkaHandlers         *KafkaHandlerMetrics // Times, counts and disables Kafka event handlers
+	dispatcher            *UserDispatcher      // Processes each user's events in order, nil when disabled
+	rateLimiter           *RateLimiter         // Limits requests per user and endpoint, set up with the routes
+	sessionQuality        *SessionQuality      // Scores sessions for timelines and the quality report
+	benchmarks            *BenchmarkService    // Anonymized norms of the projects opting in
+	requestSampler        *RequestSampler      // Samples requests per endpoint, set up with the routes
+	apiUsage              APIUsagePublisher    // Publishes request usage to Kafka, or straight to apiMetrics
+	usageBatchMaxUsers    int                  // Maximum user IDs per batch usage request
+	usageBatchConcurrency int                  // Usage summaries computed in parallel per batch request
+	mobileBatchMaxBytes   int                  // Maximum decompressed size of a mobile batch
+	heatmapImportMaxBytes int                  // Maximum decompressed size of an imported heatmap grid
+	heatmapPointsMaxBatch int                  // Maximum points appended to a heatmap per request
+	jobProgressInterval   time.Duration        // How often job progress is pushed over WebSockets
 }
 
 // NewApp creates a new analytics application instance
@@ -64,35 +122,490 @@ func NewApp(port string) *App {
 	// Initialize heatmap service
 	heatmapService := NewHeatmapService(analyticsService)
 
+	// Initialize goals
+	goalService := NewGoalService(analyticsService)
+
+	// Initialize saved queries and dashboards, sharing one token signer
+	tokenSigner := NewTokenSigner()
+	savedQueryService := NewSavedQueryService(tokenSigner)
+	savedDashboardService := NewSavedDashboardService(savedQueryService, tokenSigner)
+	// Share tokens follow the analytics service's clock, which may be replaced after startup
+	serviceClock := clockFunc(func() time.Time { return analyticsService.Clock().Now() })
+	tokenSigner.SetClock(serviceClock)
+	savedQueryService.SetClock(serviceClock)
+	savedDashboardService.SetClock(serviceClock)
+
 	// Create app instance first
 	appInstance := &App{
-		app:              app,
-		tracer:           tracer,
-		port:             port,
-		analyticsService: analyticsService,
-		kafkaConsumer:    nil, // Will be initialized after creation
-		dashboardService: dashboardService,
-		funnelService:    funnelService,
-		heatmapService:   heatmapService,
+		app:                   app,
+		tracer:                tracer,
+		port:                  port,
+		analyticsService:      analyticsService,
+		kafkaConsumer:         nil, // Will be initialized after creation
+		dashboardService:      dashboardService,
+		funnelService:         funnelService,
+		heatmapService:        heatmapService,
+		heatmapRefresher:      NewHeatmapRefresher(heatmapService, dashboardService.BroadcastHeatmapUpdated),
+		queryService:          NewQueryService(analyticsService),
+		formService:           NewFormService(analyticsService),
+		retentionService:      NewRetentionService(analyticsService),
+		sessionService:        NewSessionService(analyticsService),
+		performanceService:    NewPerformanceService(analyticsService),
+		savedQueryService:     savedQueryService,
+		savedDashboardService: savedDashboardService,
+		organizationService:   NewOrganizationService(analyticsService),
+		projectConfigService:  NewProjectConfigService(funnelService, savedQueryService, savedDashboardService, goalService, analyticsService.DataQuality(), analyticsService.Schemas()),
+		goalService:           goalService,
+		eventPurger:           NewEventPurger(analyticsService),
+		billingReconciler:     NewBillingReconciler(analyticsService.BillingEvents()),
+		trackingPool:          NewWorkerPool("tracking", getEnvInt("TRACKING_WORKER_POOL_SIZE", 16), getEnvInt("TRACKING_QUEUE_CAPACITY", 10000)),
+		ingestion:             NewAsyncIngestion(analyticsService),
+		jobs:                  NewJobs(),
+		adminAuth:             NewAdminAuth(),
+		auditLog:              NewAuditLog(),
+		serviceAuth:           NewServiceAuth(),
+		exportKeys:            NewExportKeys(),
+		writeKeys:             NewWriteKeys(),
+		apiKeys:               NewAPIKeyService(),
+		runtimeSettings:       NewRuntimeSettings(),
+		anonymousPolicy:       NewAnonymousPolicy(),
+		apiMetrics:            NewAPIMetrics(),
+		caches:                NewCacheRegistry(),
+		faults:                NewFaultInjector(),
+		siem:                  NewSIEMExporter(),
+		traffic:               NewTrafficMonitor(),
+		slos:                  NewSLOTracker(),
+		funnelWebhook:         NewFunnelWebhook(),
+		apiKeyUsage:           NewAPIKeyUsage(NewMemoryAPIKeyUsageStore()),
+		timeline:              NewUserTimeline(analyticsService, NewServiceEventLog()),
+		profiles:              NewUserProfiles(),
+		features:              NewFeatureFlags(),
+		kafkaHandlers:         NewKafkaHandlerMetrics(),
+		usageBatchMaxUsers:    getEnvInt("USAGE_BATCH_MAX_USERS", 1000),
+		usageBatchConcurrency: getEnvInt("USAGE_BATCH_CONCURRENCY", 8),
+		mobileBatchMaxBytes:   getEnvInt("MOBILE_BATCH_MAX_BYTES", 5<<20),
+		heatmapImportMaxBytes: getEnvInt("HEATMAP_IMPORT_MAX_BYTES", 64<<20),
+		heatmapPointsMaxBatch: getEnvInt("HEATMAP_POINTS_MAX_BATCH", 10000),
+		jobProgressInterval:   getEnvDuration("JOB_PROGRESS_INTERVAL", time.Second),
+	}
+
+	analyticsService.SetFaultInjector(appInstance.faults)
+
+	// Process the events of a user in order across HTTP and Kafka ingestion
+	if partitions := getEnvInt("ORDERED_PROCESSING_PARTITIONS", 16); partitions > 0 {
+		appInstance.dispatcher = NewUserDispatcher(partitions, getEnvInt("ORDERED_PROCESSING_QUEUE_CAPACITY", 1000))
+		appInstance.ingestion.SetDispatcher(appInstance.dispatcher)
 	}
 
-	// Start dashboard service
+	// Stream audit entries and rejected admin tokens to the SIEM
+	appInstance.auditLog.SetExporter(appInstance.siem)
+	appInstance.adminAuth.SetExporter(appInstance.siem)
+	appInstance.serviceAuth.SetExporter(appInstance.siem)
+	// Projects requiring encrypted exports get their security events encrypted too
+	appInstance.siem.SetExportKeys(appInstance.exportKeys)
+
+	// Traffic alerts go to the log, the event bus and the SIEM
+	appInstance.traffic.SetBus(analyticsService.Bus())
+	appInstance.traffic.SetExporter(appInstance.siem)
+
+	// Count ingestion requests against their objectives, alerting on the event bus
+	appInstance.apiMetrics.SetSLOTracker(appInstance.slos)
+	appInstance.slos.SetBus(analyticsService.Bus())
+
+	// Post funnel results recomputed in the background to the funnel webhook
+	analyticsService.QueryCache().SetRevalidated(func(projectID string, value interface{}) {
+		if result, ok := value.(*FunnelResult); ok {
+			appInstance.funnelWebhook.Notify(projectID, FunnelTriggerRevalidated, result)
+		}
+	})
+
+	// Score the sessions of timelines and the session quality report
+	appInstance.sessionQuality = NewSessionQuality(analyticsService, appInstance.heatmapService.Frustration())
+	appInstance.timeline.SetSessionQuality(appInstance.sessionQuality)
+
+	// Compare the funnels and sessions of the projects opting in
+	appInstance.benchmarks = NewBenchmarkService(funnelService, appInstance.sessionService)
+
+	// Let funnel steps reference the events of other services kept for user timelines
+	funnelService.SetServiceEventLog(appInstance.timeline.ServiceEvents())
+
+	// Seed the profiles of existing customers from the history of the auth and billing services
+	appInstance.bootstrap = NewProfileBootstrap(appInstance.profiles)
+
+	appInstance.caches.Register(
+		analyticsService.QueryCache().Cache(),
+		analyticsService.MobileBatches().Cache(),
+		appInstance.ingestion.Receipts(),
+		appInstance.jobs.Cache(),
+		appInstance.timeline.ServiceEvents().Cache(),
+		appInstance.profiles.Cache(),
+		appInstance.serviceAuth.Nonces(),
+		appInstance.traffic.Baselines(),
+	)
+
+	// Add the custom enrichers, validators and sinks declared in PIPELINE_HOOKS, registered by
+	// packages linked into the binary or by the Go plugins listed in PIPELINE_PLUGINS
+	if err := LoadPipelinePlugins(os.Getenv("PIPELINE_PLUGINS")); err != nil {
+		log.Printf("Error: %v", err)
+	}
+	if err := analyticsService.Hooks().Configure(os.Getenv("PIPELINE_HOOKS")); err != nil {
+		log.Printf("Error: Pipeline hooks are not configured: %v", err)
+	}
+
+	// Start dashboard service, pushing stored events to the projects' real-time dashboards
 	dashboardService.Start()
+	if err := analyticsService.Bus().SubscribeEvents(TopicEventStored, "dashboards", dashboardService.BroadcastEvent); err != nil {
+		log.Printf("Warning: Failed to subscribe dashboards to stored events: %v", err)
+	}
+	// Live dashboard metrics end at the service's clock
+	dashboardService.Aggregator().SetClock(analyticsService.Clock())
+	// Dashboard segment channels follow the users' lifecycle stages
+	dashboardService.SetUserProfiles(appInstance.profiles)
+
+	// Persist stored events in the event store of EVENT_STORE_URL, if any, and reload those
+	// stored before the restart
+	if store, err := NewEventStoreFromEnv(); err != nil {
+		log.Printf("Error: Events are only kept in memory: %v", err)
+	} else if store != nil {
+		analyticsService.SetEventStore(store)
+		ctx, cancel := context.WithTimeout(context.Background(), getEnvDuration("EVENT_STORE_TIMEOUT", 10*time.Second))
+		if loaded, err := analyticsService.LoadStoredEvents(ctx); err != nil {
+			log.Printf("Error: %v", err)
+		} else {
+			log.Printf("Loaded %d events from the event store", loaded)
+		}
+		cancel()
+	}
+
+	// Store the events accepted into the ingestion log once the event store is available
+	analyticsService.IngestionCircuit().Start(analyticsService.RecoverIngestion)
+
+	// Purge events past their retention in the background
+	appInstance.eventPurger.Start()
+
+	// Retry the billing events of API calls the billing service did not receive in the background
+	appInstance.billingReconciler.Start()
+
+	// Regenerate scheduled heatmaps in the background
+	appInstance.heatmapRefresher.Start()
+
+	// Flush the requests counted per API key to the store in the background
+	appInstance.apiKeyUsage.Start()
+
+	// Push the internal metrics in the background, when configured
+	appInstance.metricsPush = NewMetricsPusher(appInstance.writeMetrics)
+	appInstance.metricsPush.Start()
+
+	// Recompute the dashboard metrics derived from funnels and segments in the background
+	appInstance.derivedMetrics = NewDerivedMetrics(funnelService, savedQueryService, appInstance.queryService, dashboardService)
+	appInstance.derivedMetrics.SetFunnelWebhook(appInstance.funnelWebhook)
+	dashboardService.SetDerivedMetrics(appInstance.derivedMetrics)
+	appInstance.derivedMetrics.Start()
+
+	// Follow the users of live funnels as their events are stored, pushing the funnels to dashboards
+	appInstance.liveFunnels = NewLiveFunnels(funnelService, dashboardService)
+	appInstance.liveFunnels.SetClock(analyticsService.Clock())
+	if err := analyticsService.Bus().SubscribeEvents(TopicEventStored, "live_funnels", appInstance.liveFunnels.Observe); err != nil {
+		log.Printf("Warning: Failed to subscribe live funnels to stored events: %v", err)
+	}
+	appInstance.liveFunnels.Start()
 
 	// Initialize Kafka consumer service
 	kafkaConsumer := appInstance.initializeKafkaConsumer()
 	appInstance.kafkaConsumer = kafkaConsumer
 
+	// Publish API usage through Kafka when the consumer reads it back
+	appInstance.apiUsage = appInstance.initializeAPIUsagePublisher()
+
+	// Expose tunables of the initialized services
+	appInstance.registerRuntimeSettings()
+
+	// Connect saved query types to the services computing them
+	appInstance.registerQueryExecutors()
+
 	return appInstance
 }
 
+// registerRuntimeSettings registers the settings that can be adjusted at runtime
+func (s *App) registerRuntimeSettings() {
+	for _, setting := range workerPoolSettings("tracking", s.trackingPool) {
+		s.runtimeSettings.Register(setting)
+	}
+	for _, setting := range workerPoolSettings("ingestion", s.ingestion.WorkerPool()) {
+		s.runtimeSettings.Register(setting)
+	}
+	if s.dispatcher != nil {
+		s.runtimeSettings.Register(&RuntimeSetting{
+			Name:        "ordered.queue_capacity",
+			Description: "Maximum queued events per partition of the ordered processing of user events",
+			Get:         func() interface{} { return s.dispatcher.Capacity() },
+			Set: func(value interface{}) error {
+				capacity, err := runtimeInt(value)
+				if err != nil {
+					return err
+				}
+				return s.dispatcher.SetCapacity(capacity)
+			},
+		})
+	}
+	for _, setting := range workerPoolSettings("jobs", s.jobs.WorkerPool()) {
+		s.runtimeSettings.Register(setting)
+	}
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "ingestion.max_queue_age",
+		Description: "How long an asynchronously accepted event may wait in the queue before it is shed",
+		Get:         func() interface{} { return s.ingestion.MaxQueueAge().String() },
+		Set: func(value interface{}) error {
+			maxQueueAge, err := runtimeDuration(value)
+			if err != nil {
+				return err
+			}
+			return s.ingestion.SetMaxQueueAge(maxQueueAge)
+		},
+	})
+
+	if s.kafkaConsumer != nil && s.dispatcher == nil {
+		for _, setting := range workerPoolSettings("kafka", s.kafkaConsumer.WorkerPool()) {
+			s.runtimeSettings.Register(setting)
+		}
+	}
+
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "log.level",
+		Description: "Log level (debug, info, warn, error)",
+		Get:         func() interface{} { return GetLogLevel() },
+		Set: func(value interface{}) error {
+			level, err := runtimeString(value)
+			if err != nil {
+				return err
+			}
+			return SetLogLevel(level)
+		},
+	})
+
+	storageSampler := s.analyticsService.StorageSampler()
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "storage.detail_sample_rates",
+		Description: "Share of events stored in full detail per event type, e.g. {\"mouse_move\": 0.01}",
+		Get:         func() interface{} { return storageSampler.DetailRates() },
+		Set: func(value interface{}) error {
+			rates, err := runtimeRates(value)
+			if err != nil {
+				return err
+			}
+			return storageSampler.ReplaceDetailRates(rates)
+		},
+	})
+
+	schemas := s.analyticsService.Schemas()
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "schemas.grace_period",
+		Description: "How long the previous version of a schema stays active after a breaking update",
+		Get:         func() interface{} { return schemas.GracePeriod().String() },
+		Set: func(value interface{}) error {
+			gracePeriod, err := runtimeDuration(value)
+			if err != nil {
+				return err
+			}
+			return schemas.SetGracePeriod(gracePeriod)
+		},
+	})
+
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "sessions.quality_weights",
+		Description: "Weights of the session quality score, e.g. {\"depth\": 0.3, \"duration\": 0.3, \"conversions\": 0.4, \"rage_clicks\": 0.1}",
+		Get:         func() interface{} { return s.sessionQuality.Weights() },
+		Set: func(value interface{}) error {
+			weights, err := runtimeRates(value)
+			if err != nil {
+				return err
+			}
+			return s.sessionQuality.SetWeights(weights)
+		},
+	})
+
+	lateEvents := s.analyticsService.LateEvents()
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "events.lateness_window",
+		Description: "How old a client timestamp may be before the event is rejected",
+		Get:         func() interface{} { return lateEvents.Window().String() },
+		Set: func(value interface{}) error {
+			window, err := runtimeDuration(value)
+			if err != nil {
+				return err
+			}
+			return lateEvents.SetWindow(window)
+		},
+	})
+
+	cardinality := s.analyticsService.Cardinality()
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "properties.cardinality_limit",
+		Description: "Distinct values per property and project before new values are hashed (0 disables)",
+		Get:         func() interface{} { return cardinality.Limit() },
+		Set: func(value interface{}) error {
+			limit, err := runtimeInt(value)
+			if err != nil {
+				return err
+			}
+			return cardinality.SetLimit(limit)
+		},
+	})
+
+	retention := s.analyticsService.Retention()
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "retention.default",
+		Description: "Retention of event types without an override, e.g. \"365d\"",
+		Get:         func() interface{} { return formatRetention(retention.DefaultTTL()) },
+		Set: func(value interface{}) error {
+			str, err := runtimeString(value)
+			if err != nil {
+				return err
+			}
+			ttl, err := parseRetention(str)
+			if err != nil {
+				return err
+			}
+			return retention.SetDefaultTTL(ttl)
+		},
+	})
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "retention.overrides",
+		Description: "Retention per event type, e.g. {\"conversion\": \"730d\", \"mouse_move\": \"7d\"}",
+		Get: func() interface{} {
+			overrides := make(map[string]string)
+			for eventType, ttl := range retention.Overrides() {
+				overrides[eventType] = formatRetention(ttl)
+			}
+			return overrides
+		},
+		Set: func(value interface{}) error {
+			overrides, err := runtimeRetentionOverrides(value)
+			if err != nil {
+				return err
+			}
+			return retention.ReplaceOverrides(overrides)
+		},
+	})
+
+	currencies := s.analyticsService.Currencies()
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "billing.currency_rates",
+		Description: "Conversion rates from USD per currency, e.g. {\"EUR\": 0.92}",
+		Get:         func() interface{} { return currencies.Rates() },
+		Set: func(value interface{}) error {
+			rates, err := runtimeRates(value)
+			if err != nil {
+				return err
+			}
+			return currencies.ReplaceRates(rates)
+		},
+	})
+
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "anonymous.policies",
+		Description: "Policy for requests without a user ID per route prefix (reject, attribute_owner, no_bill), e.g. {\"/\": \"no_bill\", \"/api/v1/analytics\": \"reject\"}",
+		Get:         func() interface{} { return s.anonymousPolicy.Policies() },
+		Set: func(value interface{}) error {
+			policies, err := runtimeKeyValues(value)
+			if err != nil {
+				return err
+			}
+			return s.anonymousPolicy.ReplacePolicies(policies)
+		},
+	})
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "anonymous.project_owners",
+		Description: "User billed for anonymous requests per project under attribute_owner, e.g. {\"web\": \"owner-1\"}",
+		Get:         func() interface{} { return s.anonymousPolicy.Owners() },
+		Set: func(value interface{}) error {
+			owners, err := runtimeKeyValues(value)
+			if err != nil {
+				return err
+			}
+			return s.anonymousPolicy.ReplaceOwners(owners)
+		},
+	})
+
+	queryCache := s.analyticsService.QueryCache()
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "query_cache.fresh_for",
+		Description: "How long cached trend and funnel results are served as fresh (0 disables caching)",
+		Get: func() interface{} {
+			freshFor, _ := queryCache.TTLs()
+			return freshFor.String()
+		},
+		Set: func(value interface{}) error {
+			freshFor, err := runtimeDuration(value)
+			if err != nil {
+				return err
+			}
+			_, staleFor := queryCache.TTLs()
+			return queryCache.SetTTLs(freshFor, staleFor)
+		},
+	})
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "query_cache.stale_for",
+		Description: "How long stale trend and funnel results are still served while recomputed in the background",
+		Get: func() interface{} {
+			_, staleFor := queryCache.TTLs()
+			return staleFor.String()
+		},
+		Set: func(value interface{}) error {
+			staleFor, err := runtimeDuration(value)
+			if err != nil {
+				return err
+			}
+			freshFor, _ := queryCache.TTLs()
+			return queryCache.SetTTLs(freshFor, staleFor)
+		},
+	})
+
+	slowOperations := s.analyticsService.SlowOperations()
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "slow_operations.duration_threshold",
+		Description: "Duration after which an operation is logged as slow",
+		Get: func() interface{} {
+			duration, _ := slowOperations.Thresholds()
+			return duration.String()
+		},
+		Set: func(value interface{}) error {
+			duration, err := runtimeDuration(value)
+			if err != nil {
+				return err
+			}
+			_, scanned := slowOperations.Thresholds()
+			slowOperations.SetThresholds(duration, scanned)
+			return nil
+		},
+	})
+	s.runtimeSettings.Register(&RuntimeSetting{
+		Name:        "slow_operations.scanned_events_threshold",
+		Description: "Scanned-event count after which an operation is logged as expensive",
+		Get: func() interface{} {
+			_, scanned := slowOperations.Thresholds()
+			return scanned
+		},
+		Set: func(value interface{}) error {
+			scanned, err := runtimeInt(value)
+			if err != nil {
+				return err
+			}
+			duration, _ := slowOperations.Thresholds()
+			slowOperations.SetThresholds(duration, int64(scanned))
+			return nil
+		},
+	})
+}
+
 // initializeKafkaConsumer initializes the Kafka consumer service
 func (s *App) initializeKafkaConsumer() *KafkaConsumerService {
 	// Get Kafka configuration from environment
 	brokers := s.getKafkaBrokers()
 	topics := s.getKafkaTopics()
+	prefixes := ParseTopicPrefixes(os.Getenv("KAFKA_TOPIC_PREFIXES"))
 
-	if len(brokers) == 0 || len(topics) == 0 {
+	if len(brokers) == 0 || (len(topics) == 0 && len(prefixes) == 0) {
 		log.Println("Warning: Kafka configuration not found, consumer service will not start")
 		return nil
 	}
@@ -102,6 +615,18 @@ func (s *App) initializeKafkaConsumer() *KafkaConsumerService {
 		log.Printf("Warning: Failed to create Kafka consumer: %v", err)
 		return nil
 	}
+	consumer.SetFaultInjector(s.faults)
+	if len(prefixes) > 0 {
+		consumer.DiscoverTopics(prefixes, getEnvDuration("KAFKA_TOPIC_REFRESH_INTERVAL", time.Minute))
+	}
+	consumer.SetServiceEventLog(s.timeline.ServiceEvents())
+	consumer.SetUserProfiles(s.profiles)
+	consumer.SetPlans(s.analyticsService.Plans())
+	consumer.SetDashboardMetrics(s.dashboardService.Aggregator())
+	consumer.SetHandlerMetrics(s.kafkaHandlers)
+	if s.dispatcher != nil {
+		consumer.SetDispatcher(s.dispatcher)
+	}
 
 	// Start the consumer service
 	if err := consumer.Start(); err != nil {
@@ -109,10 +634,43 @@ func (s *App) initializeKafkaConsumer() *KafkaConsumerService {
 		return nil
 	}
 
-	log.Printf("Kafka consumer service started for topics: %v", topics)
+	log.Printf("Kafka consumer service started for topics: %v", consumer.Topics())
 	return consumer
 }
 
+// initializeAPIUsagePublisher publishes API usage records to the API_USAGE_TOPIC Kafka topic
+// (default analytics) and consumes them into the API metrics. Without a consumer of the topic the
+// records are recorded in-process instead.
+func (s *App) initializeAPIUsagePublisher() APIUsagePublisher {
+	direct := NewDirectAPIUsagePublisher(s.apiMetrics)
+	if s.kafkaConsumer == nil {
+		return direct
+	}
+
+	topic := os.Getenv("API_USAGE_TOPIC")
+	if topic == "" {
+		topic = "analytics"
+	}
+	consumed := false
+	for _, t := range s.kafkaConsumer.Topics() {
+		consumed = consumed || t == topic
+	}
+	if !consumed {
+		log.Printf("Warning: Kafka topic %s is not consumed, recording API usage in-process", topic)
+		return direct
+	}
+
+	publisher, err := NewKafkaAPIUsagePublisher(s.getKafkaBrokers(), topic)
+	if err != nil {
+		log.Printf("Warning: Failed to create API usage publisher, recording API usage in-process: %v", err)
+		return direct
+	}
+	s.kafkaConsumer.RegisterHandler(APIUsageEventType, s.apiMetrics.HandleEvent)
+
+	log.Printf("Publishing API usage to Kafka topic: %s", topic)
+	return publisher
+}
+
 // getKafkaBrokers gets Kafka broker addresses from environment
 func (s *App) getKafkaBrokers() []string {
 	brokers := os.Getenv("KAFKA_BROKERS")
@@ -122,10 +680,14 @@ func (s *App) getKafkaBrokers() []string {
 	return strings.Split(brokers, ",")
 }
 
-// getKafkaTopics gets Kafka topics from environment
+// getKafkaTopics gets Kafka topics from environment. Without KAFKA_TOPICS, the default topics are
+// consumed unless topics are discovered by KAFKA_TOPIC_PREFIXES.
 func (s *App) getKafkaTopics() []string {
 	topics := os.Getenv("KAFKA_TOPICS")
 	if topics == "" {
+		if os.Getenv("KAFKA_TOPIC_PREFIXES") != "" {
+			return nil
+		}
 		return []string{"billing", "auth", "payments", "analytics"} // Default topics
 	}
 	return strings.Split(topics, ",")
@@ -134,53 +696,303 @@ func (s *App) getKafkaTopics() []string {
 // SetupRoutes configures all the application routes
 func (s *App) SetupRoutes() {
 	// Initialize middleware
-	apiTrackingMiddleware := NewAPITrackingMiddleware(s.analyticsService)
+	apiTrackingMiddleware := NewAPITrackingMiddleware(s.analyticsService, s.trackingPool, s.anonymousPolicy, s.apiUsage, s.apiKeyUsage)
 	rateLimitMiddleware := NewRateLimitMiddleware(s.analyticsService)
 	samplingMiddleware := NewSamplingMiddleware(s.analyticsService)
+	s.rateLimiter = rateLimitMiddleware.RateLimiter()
+	s.requestSampler = samplingMiddleware.Sampler()
+	s.caches.Register(s.rateLimiter.Cache())
 
 	// Apply global middleware for all routes
 	s.app.Use(apiTrackingMiddleware.TrackAPIUsage())
+	s.app.Use(s.requireAPIKey())
 	s.app.Use(rateLimitMiddleware.RateLimit())
 	s.app.Use(samplingMiddleware.Sample())
+	s.app.Use(s.resolveRegion())
 
 	// Health check endpoint
 	s.app.Get("/health", s.healthCheck)
 
+	// Cache size and eviction metrics for Prometheus
+	s.app.Get("/metrics", s.getMetrics)
+
 	// Analytics endpoints
 	analytics := s.app.Group("/api/v1/analytics")
-	analytics.Post("/events", s.trackEvent)
+	analytics.Post("/events", s.serviceAuth.Authenticate(), s.requireWriteKey(), s.trackEvent)
+	analytics.Post("/mobile/batch", s.serviceAuth.Authenticate(), s.requireWriteKey(), s.trackMobileBatch)
+	analytics.Post("/identify", s.serviceAuth.Authenticate(), s.requireWriteKey(), s.identifyUser)
+	analytics.Get("/receipts/:id", s.getIngestionReceipt)
 	analytics.Get("/usage", s.getUsage)
+	analytics.Post("/usage/batch", s.getUsageBatch)
+	analytics.Get("/validation-errors", s.getValidationErrors)
+	analytics.Get("/dirty-buckets", s.getDirtyBuckets)
+	analytics.Delete("/dirty-buckets", s.acknowledgeDirtyBuckets)
+
+	// Rate limits, quotas, sample rates and plan caps of the caller, for SDKs to adapt to
+	s.app.Get("/api/v1/limits", s.getLimits)
+
+	// How current the data is at each stage of the pipeline
+	s.app.Get("/api/v1/status/freshness", s.getFreshness)
+
+	// Status and progress of long computations accepted with "Prefer: respond-async"
+	s.app.Get("/api/v1/jobs/:id", s.getJob)
+	s.app.Get("/api/v1/jobs/:id/progress", websocket.New(s.streamJobProgress(false)))
 
 	// Real-time dashboard WebSocket endpoint
-	s.app.Get("/api/v1/dashboard/feed", websocket.New(s.dashboardService.HandleWebSocket))
+	s.app.Get("/api/v1/dashboard/feed", websocket.New(s.dashboardService.HandleWebSocket, s.dashboardService.WebSocketConfig()))
 
 	// Funnel analysis endpoints
 	funnels := s.app.Group("/api/v1/funnels")
 	funnels.Post("/", s.createFunnel)
+	funnels.Get("/", s.listFunnels)
+	funnels.Get("/suggestions", s.suggestFunnels)
+	funnels.Get("/live", s.listLiveFunnels)
+	funnels.Get("/:id", s.getFunnel)
+	funnels.Put("/:id", s.updateFunnel)
 	funnels.Get("/:id/compute", s.computeFunnel)
 	funnels.Get("/:id/steps", s.getFunnelSteps)
+	funnels.Get("/:id/live", s.getLiveFunnel)
+	funnels.Put("/:id/live", s.enableLiveFunnel)
+	funnels.Delete("/:id/live", s.disableLiveFunnel)
+
+	// Retention analysis endpoints
+	s.app.Post("/api/v1/retention/compute", s.computeRetention)
 
 	// Heatmap endpoints
-	heatmaps := s.app.Group("/api/v1/heatmaps")
+	heatmaps := s.app.Group("/api/v1/heatmaps", s.requireFeature(FeatureHeatmaps))
 	heatmaps.Post("/", s.createHeatmap)
+	heatmaps.Get("/", s.listHeatmaps)
 	heatmaps.Post("/generate", s.generateHeatmap)
 	heatmaps.Get("/:id", s.getHeatmap)
+	heatmaps.Get("/:id/data", s.requireFeature(FeatureExports), s.exportHeatmapData)
+	heatmaps.Get("/:id/render", s.renderHeatmap)
+	heatmaps.Put("/:id/data", s.importHeatmapData)
+	heatmaps.Post("/:id/points", s.appendHeatmapPoints)
+	heatmaps.Put("/:id", s.updateHeatmap)
+	heatmaps.Delete("/:id", s.deleteHeatmap)
+
+	// UX analytics endpoints
+	s.app.Get("/api/v1/ux/frustration", s.getFrustrationReport)
+	s.app.Get("/api/v1/sessions", s.getSessions)
+	s.app.Get("/api/v1/sessions/quality", s.getSessionQualityReport)
+	s.app.Get("/api/v1/forms/:form_id/report", s.getFormReport)
+	s.app.Get("/api/v1/performance/report", s.getPerformanceReport)
+
+	// Breakdowns served from the daily rollups
+	s.app.Get("/api/v1/pages", s.getRollupBreakdown(RollupPage))
+	s.app.Get("/api/v1/devices", s.getRollupBreakdown(RollupDevice))
+	s.app.Get("/api/v1/countries", s.getRollupBreakdown(RollupCountry))
+	s.app.Get("/api/v1/campaigns", s.getRollupBreakdown(RollupCampaign))
+
+	// Chronological view of one user's activity, for support and debugging
+	s.app.Get("/api/v1/users/:id/timeline", s.getUserTimeline)
+	s.app.Get("/api/v1/users/:id/profile", s.getUserProfile)
+	s.app.Get("/api/v1/users/:id/identity", s.getUserIdentity)
+	s.app.Get("/api/v1/users/:id/sessions", s.getUserSessions)
+
+	// Ad-hoc query endpoints
+	s.app.Get("/api/v1/trends", s.getTrend)
+	s.app.Get("/api/v1/segments", s.getSegment)
+	s.app.Get("/api/v1/properties/:key/values", s.getPropertyValues)
+
+	// Saved query endpoints
+	queries := s.app.Group("/api/v1/queries")
+	queries.Post("/", s.createSavedQuery)
+	queries.Get("/", s.listSavedQueries)
+	queries.Get("/:id", s.getSavedQuery)
+	queries.Put("/:id", s.updateSavedQuery)
+	queries.Delete("/:id", s.deleteSavedQuery)
+	queries.Get("/:id/run", s.runSavedQuery)
+	queries.Post("/:id/share", s.shareSavedQuery)
+	queries.Delete("/:id/share", s.revokeSavedQueryShares)
+
+	// Read-only execution of shared queries, authorized by the share token alone
+	s.app.Get("/api/v1/shared/:token", s.runSharedQuery)
+
+	// Saved dashboard endpoints
+	dashboards := s.app.Group("/api/v1/dashboards")
+	dashboards.Post("/", s.createDashboard)
+	dashboards.Get("/", s.listDashboards)
+	dashboards.Get("/:id", s.getDashboard)
+	dashboards.Put("/:id", s.updateDashboard)
+	dashboards.Delete("/:id", s.deleteDashboard)
+	dashboards.Get("/:id/snapshot", s.getDashboardSnapshot)
+	dashboards.Post("/:id/public-tokens", s.createPublicDashboardToken)
+	dashboards.Delete("/:id/public-tokens", s.revokePublicDashboardTokens)
+
+	// Embedded dashboards, authorized by the public token alone
+	public := s.app.Group("/api/v1/public/dashboards")
+	public.Get("/:token/snapshot", s.authorizePublicDashboard(PublicScopeSnapshot), s.getPublicDashboardSnapshot)
+	public.Get("/:token/stream", s.authorizePublicDashboard(PublicScopeStream), websocket.New(s.dashboardService.HandlePublicWebSocket, s.dashboardService.WebSocketConfig()))
+
+	// Fingerprints of every configuration resource, for drift detection
+	s.app.Get("/api/v1/resources", s.listResources)
+
+	// Project configuration as code
+	projects := s.app.Group("/api/v1/projects")
+	projects.Get("/:id/config", s.requireProjectFeature(FeatureExports), s.getProjectConfig)
+	projects.Put("/:id/config", s.putProjectConfig)
+	projects.Get("/:id/aliases", s.getProjectAliases)
+	projects.Put("/:id/aliases", s.updateProjectAliases)
+	projects.Get("/:id/dimensions", s.getProjectDimensions)
+	projects.Put("/:id/dimensions", s.updateProjectDimensions)
+	projects.Get("/:id/dimensions/:name/values", s.getDimensionValues)
+	projects.Get("/:id/api-metrics", s.getProjectAPIMetrics)
+	projects.Get("/:id/quotas", s.getProjectQuotas)
+	projects.Put("/:id/quotas", s.updateProjectQuotas)
+	projects.Get("/:id/quotas/usage", s.getProjectQuotaUsage)
+	projects.Get("/:id/goals", s.getProjectGoals)
+	projects.Put("/:id/goals", s.updateProjectGoals)
+	projects.Get("/:id/goals/report", s.getProjectGoalReport)
+	projects.Get("/:id/monitors", s.getProjectMonitors)
+	projects.Put("/:id/monitors", s.updateProjectMonitors)
+	projects.Get("/:id/aggregation", s.getProjectAggregation)
+	projects.Put("/:id/aggregation", s.updateProjectAggregation)
+	projects.Get("/:id/export-keys", s.getProjectExportKeys)
+	projects.Put("/:id/export-keys", s.updateProjectExportKeys)
+	projects.Get("/:id/write-keys", s.listWriteKeys)
+	projects.Post("/:id/write-keys", s.createWriteKey)
+	projects.Post("/:id/write-keys/:key_id/rotate", s.rotateWriteKey)
+	projects.Delete("/:id/write-keys/:key_id", s.revokeWriteKey)
+	projects.Get("/:id/quarantine", s.getProjectQuarantine)
+	projects.Put("/:id/quarantine", s.updateProjectQuarantine)
+	projects.Get("/:id/quarantine/events", s.listQuarantinedEvents)
+	projects.Get("/:id/quarantine/events/:event_id", s.getQuarantinedEvent)
+	projects.Delete("/:id/quarantine/events", s.discardQuarantinedEvents)
+	projects.Delete("/:id/quarantine/events/:event_id", s.discardQuarantinedEvents)
+	projects.Post("/:id/quarantine/revalidate", s.revalidateQuarantinedEvents)
+	projects.Get("/:id/features", s.getProjectFeatures)
+	projects.Get("/:id/benchmarking", s.getProjectBenchmarking)
+	projects.Put("/:id/benchmarking", s.updateProjectBenchmarking)
+
+	// Anonymized norms across the projects opting in
+	s.app.Get("/api/v1/benchmarks", s.getBenchmarks)
+
+	// Organization endpoints
+	orgs := s.app.Group("/api/v1/orgs")
+	orgs.Get("/:id", s.getOrganization)
+	orgs.Get("/:id/usage", s.getOrganizationUsage)
+
+	// Event schema endpoints
+	schemas := s.app.Group("/api/v1/schemas")
+	schemas.Get("/", s.listSchemas)
+	schemas.Get("/:event_type", s.getSchema)
+	schemas.Put("/:event_type", s.updateSchema)
+	schemas.Get("/:event_type/versions", s.getSchemaVersions)
 
 	// Kafka consumer status endpoint
 	s.app.Get("/api/v1/kafka/status", s.getKafkaStatus)
+
+	// Admin endpoints
+	admin := s.app.Group("/api/v1/admin", s.adminAuth.RequireRole(RoleViewer))
+	admin.Get("/slow-operations", s.getSlowOperations)
+	admin.Get("/runtime", s.getRuntimeSettings)
+	admin.Get("/runtime/:name", s.getRuntimeSetting)
+	admin.Put("/runtime/:name", s.adminAuth.RequireRole(RoleOperator), s.updateRuntimeSetting)
+	admin.Get("/audit-log", s.adminAuth.RequireRole(RoleAdmin), s.getAuditLog)
+	admin.Get("/anonymous-traffic", s.getAnonymousTraffic)
+	admin.Get("/query-cache", s.getQueryCacheStats)
+	admin.Get("/pipeline-hooks", s.getPipelineHooks)
+	admin.Get("/faults", s.getFaults)
+	admin.Get("/siem", s.getSIEMStats)
+	admin.Get("/metrics-push", s.getMetricsPushStats)
+	admin.Get("/traffic-alerts", s.getTrafficAlerts)
+	admin.Get("/data-quality-alerts", s.getDataQualityAlerts)
+	admin.Get("/slo", s.getSLOs)
+	admin.Put("/faults/:dependency", s.adminAuth.RequireRole(RoleOperator), s.setFault)
+	admin.Delete("/faults/:dependency", s.adminAuth.RequireRole(RoleOperator), s.clearFault)
+	admin.Delete("/faults", s.adminAuth.RequireRole(RoleOperator), s.clearFaults)
+	admin.Post("/kafka/pause", s.adminAuth.RequireRole(RoleOperator), s.pauseKafkaTopics)
+	admin.Post("/kafka/resume", s.adminAuth.RequireRole(RoleOperator), s.resumeKafkaTopics)
+	admin.Post("/kafka/replay", s.adminAuth.RequireRole(RoleOperator), s.replayKafkaTopic)
+	admin.Post("/bootstrap", s.adminAuth.RequireRole(RoleOperator), s.bootstrapProfiles)
+	admin.Post("/kafka/handlers/:event_type/disable", s.adminAuth.RequireRole(RoleOperator), s.disableKafkaHandler)
+	admin.Post("/kafka/handlers/:event_type/enable", s.adminAuth.RequireRole(RoleOperator), s.enableKafkaHandler)
+	admin.Get("/plans", s.getPlans)
+	admin.Put("/users/:user_id/plan", s.adminAuth.RequireRole(RoleAdmin), s.setUserPlan)
+	admin.Get("/rate-limits", s.getRateLimits)
+	admin.Get("/rate-limits/users/:user_id", s.getUserRateLimits)
+	admin.Put("/rate-limits/users/:user_id", s.adminAuth.RequireRole(RoleAdmin), s.setUserRateLimit)
+	admin.Delete("/rate-limits/users/:user_id", s.adminAuth.RequireRole(RoleAdmin), s.clearUserRateLimit)
+	admin.Get("/currencies", s.getCurrencies)
+	admin.Get("/billing/correlations/:correlation_id", s.getBillingCorrelation)
+	admin.Get("/billing/events", s.getBillingEvents)
+	admin.Post("/pricing/simulate", s.adminAuth.RequireRole(RoleAdmin), s.simulatePricing)
+	admin.Get("/retention", s.getRetention)
+	admin.Post("/retention/purge", s.adminAuth.RequireRole(RoleOperator), s.purgeExpiredEvents)
+	admin.Post("/events/delete", s.adminAuth.RequireRole(RoleAdmin), s.deleteEvents)
+	admin.Get("/rollups", s.getRollups)
+	admin.Get("/jobs/:id", s.getAdminJob)
+	admin.Get("/jobs/:id/progress", websocket.New(s.streamJobProgress(true)))
+	admin.Post("/rollups/rebuild", s.adminAuth.RequireRole(RoleOperator), s.rebuildRollups)
+	admin.Put("/projects/:project_id/currency", s.adminAuth.RequireRole(RoleAdmin), s.setProjectCurrency)
+	admin.Put("/projects/:project_id/features", s.adminAuth.RequireRole(RoleAdmin), s.setProjectFeatures)
+	admin.Get("/regions", s.getRegions)
+	admin.Get("/projects/:project_id/region-policy", s.getRegionPolicy)
+	admin.Put("/projects/:project_id/region-policy", s.adminAuth.RequireRole(RoleAdmin), s.setRegionPolicy)
+	admin.Get("/api-key-defaults", s.listAPIKeyDefaults)
+	admin.Get("/api-key-defaults/:key_id", s.getAPIKeyDefaults)
+	admin.Put("/api-key-defaults", s.adminAuth.RequireRole(RoleOperator), s.setAPIKeyDefaults)
+	admin.Delete("/api-key-defaults/:key_id", s.adminAuth.RequireRole(RoleOperator), s.deleteAPIKeyDefaults)
+	admin.Get("/api-keys", s.listAPIKeys)
+	admin.Get("/api-keys/:key_id", s.getAPIKey)
+	admin.Post("/api-keys", s.adminAuth.RequireRole(RoleAdmin), s.createAPIKey)
+	admin.Post("/api-keys/:key_id/rotate", s.adminAuth.RequireRole(RoleAdmin), s.rotateAPIKey)
+	admin.Delete("/api-keys/:key_id", s.adminAuth.RequireRole(RoleAdmin), s.revokeAPIKey)
+	admin.Get("/orgs", s.listOrganizations)
+	admin.Post("/orgs", s.adminAuth.RequireRole(RoleAdmin), s.createOrganization)
+	admin.Put("/orgs/:id/projects/:project_id", s.adminAuth.RequireRole(RoleAdmin), s.addOrganizationProject)
+	admin.Delete("/orgs/:id/projects/:project_id", s.adminAuth.RequireRole(RoleAdmin), s.removeOrganizationProject)
 }
 
 // Start begins the application server
 func (s *App) Start(ctx context.Context) error {
-	log.Printf("Starting analytics service on port %s", s.port)
-	return s.app.Listen(":" + s.port)
+	tlsConfig, err := LoadServerTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil {
+		log.Printf("Starting analytics service on port %s", s.port)
+		return s.app.Listen(":" + s.port)
+	}
+
+	listener, err := tls.Listen("tcp", ":"+s.port, tlsConfig)
+	if err != nil {
+		return fmt.Errorf("failed to listen on port %s: %w", s.port, err)
+	}
+	log.Printf("Starting analytics service on port %s with TLS", s.port)
+	return s.app.Listener(listener)
 }
 
 // Stop gracefully shuts down the application
 func (s *App) Stop() {
+	s.apiUsage.Close()
 	if s.kafkaConsumer != nil {
 		s.kafkaConsumer.Stop()
 	}
+	s.trackingPool.Stop()
+	s.ingestion.Stop()
+	if s.dispatcher != nil {
+		s.dispatcher.Stop()
+	}
+	s.jobs.Stop()
+	s.eventPurger.Stop()
+	s.billingReconciler.Stop()
+	s.heatmapRefresher.Stop()
+	s.derivedMetrics.Stop()
+	s.liveFunnels.Stop()
+	s.funnelWebhook.Stop()
+	s.apiKeyUsage.Stop()
+	s.analyticsService.Bus().Stop()
+	s.analyticsService.IngestionCircuit().Stop()
+	if err := s.analyticsService.CloseEventStore(); err != nil {
+		log.Printf("Warning: Failed to close the event store: %v", err)
+	}
+	if err := s.analyticsService.CloseBillingEvents(); err != nil {
+		log.Printf("Warning: Failed to close the billing event store: %v", err)
+	}
+	s.metricsPush.Stop()
+	s.siem.Stop()
 	log.Println("Analytics service stopped")
 }
 
@@ -191,26 +1003,86 @@ func (s *App) healthCheck(c *fiber.Ctx) error {
 		kafkaStatus = "running"
 	}
 
+	// Ingestion keeps accepting events while the event store is down, but reports it
+	status := "healthy"
+	storage := s.analyticsService.IngestionCircuit().Status()
+	if storage.Degraded() {
+		status = "degraded"
+	}
+
 	return c.JSON(fiber.Map{
-		"status":  "healthy",
+		"status":  status,
 		"service": "analytics",
 		"kafka":   kafkaStatus,
+		"storage": storage,
 	})
 }
 
+// getMetrics reports the bounded caches in the Prometheus text exposition format
+func (s *App) getMetrics(c *fiber.Ctx) error {
+	var metrics bytes.Buffer
+	if err := s.writeMetrics(&metrics); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	c.Set(fiber.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	return c.Send(metrics.Bytes())
+}
+
+// writeMetrics writes the internal metrics in the Prometheus text exposition format
+func (s *App) writeMetrics(metrics io.Writer) error {
+	err := s.caches.WriteMetrics(metrics)
+	if err == nil {
+		err = s.analyticsService.Bus().WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.siem.WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.traffic.WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.analyticsService.DataQuality().WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.analyticsService.IngestionCircuit().WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.slos.WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.funnelWebhook.WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.apiKeyUsage.WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.kafkaHandlers.WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.analyticsService.EventWriter().WriteMetrics(metrics)
+	}
+	if err == nil {
+		err = s.metricsPush.WriteMetrics(metrics)
+	}
+	return err
+}
+
 // trackEvent handles analytics event tracking
 func (s *App) trackEvent(c *fiber.Ctx) error {
 	// Parse request body
 	var eventData map[string]interface{}
 	if err := c.BodyParser(&eventData); err != nil {
+		s.observeTraffic(c, TrafficMalformed)
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
 
-	// Extract headers
-	apiKey := c.Get("X-API-Key")
-	userID := c.Get("X-User-ID")
+	// Extract headers, copied since the event outlives the request
+	apiKey := utils.CopyString(c.Get("X-API-Key"))
+	userID := utils.CopyString(c.Get("X-User-ID"))
 
 	if apiKey == "" {
 		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
@@ -219,13 +1091,62 @@ func (s *App) trackEvent(c *fiber.Ctx) error {
 	}
 
 	if userID == "" {
+		s.observeTraffic(c, TrafficMalformed)
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": "User ID is required",
 		})
 	}
 
-	// Track the event
-	event, err := s.analyticsService.TrackEvent(c.Context(), eventData, apiKey, userID)
+	// SDKs preferring an asynchronous response get a receipt to check the outcome with
+	if prefersAsync(c) {
+		s.observeTraffic(c, TrafficReceived)
+		return s.acceptEventAsync(c, eventData, apiKey, userID)
+	}
+
+	// Store the event after the user's events already dispatched, shedding it when the user's
+	// queue is full instead of holding the request. Once ordered processing is stopped, events are
+	// stored right away.
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	var event *AnalyticsEvent
+	var err error
+	if s.dispatcher != nil {
+		event, err = s.analyticsService.trackEventDispatched(ctx, eventData, apiKey, userID, func() func(task func()) {
+			if run := s.dispatcher.TryReserve(userID); run != nil || !s.dispatcher.Stopped() {
+				return run
+			}
+			return func(task func()) {
+				if task != nil {
+					task()
+				}
+			}
+		})
+	} else {
+		event, err = s.analyticsService.TrackEvent(ctx, eventData, apiKey, userID)
+	}
+	s.observeTraffic(c, TrafficOutcome(err))
+	var overQuota *QuotaExceededError
+	if errors.As(err, &overQuota) {
+		// Dropping is the intended outcome, so SDKs must not retry the event
+		return c.JSON(fiber.Map{
+			"status": "dropped",
+			"reason": overQuota.Error(),
+		})
+	}
+	var quarantined *QuarantinedError
+	if errors.As(err, &quarantined) {
+		// Kept until it is re-validated, so SDKs must not retry the event either
+		return c.Status(http.StatusAccepted).JSON(fiber.Map{
+			"status":        "quarantined",
+			"quarantine_id": quarantined.QuarantineID,
+			"reason":        quarantined.Err.Error(),
+		})
+	}
+	if errors.Is(err, errIngestionUnavailable) {
+		c.Set("Retry-After", "1")
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -233,12 +1154,40 @@ func (s *App) trackEvent(c *fiber.Ctx) error {
 	}
 
 	// Return success response
-	return c.JSON(fiber.Map{
-		"status":           "success",
-		"event_id":         event.ID,
-		"tracked_at":       event.Timestamp,
-		"billing_event_id": event.BillingEventID,
-	})
+	response := fiber.Map{
+		"status":                 "success",
+		"event_id":               event.ID,
+		"region":                 event.Region,
+		"tracked_at":             event.Timestamp,
+		"received_at":            event.ReceivedAt,
+		"billing_correlation_id": event.BillingCorrelationID,
+		"billing_status":         event.BillingStatus,
+	}
+	if event.Aggregated {
+		// Only counted, so the event ID cannot be looked up
+		response["aggregated"] = true
+	}
+	if event.Late {
+		response["late"] = true
+	}
+	if event.Queued {
+		// Accepted into the ingestion log while the event store is down, not queryable yet
+		response["queued"] = true
+	}
+	if event.ClockSkewMs != 0 {
+		// tracked_at was corrected for the device's clock
+		response["clock_skew_ms"] = event.ClockSkewMs
+	}
+	if len(event.LimitedProperties) > 0 {
+		// Let SDK developers notice properties that carry unbounded values
+		response["limited_properties"] = event.LimitedProperties
+	}
+	return c.JSON(response)
+}
+
+// observeTraffic counts a submitted event for traffic alerts, by the client IP and user agent of the request
+func (s *App) observeTraffic(c *fiber.Ctx, outcome string) {
+	s.traffic.Observe(projectIDFromRequest(c), c.IP(), c.Get(fiber.HeaderUserAgent), outcome)
 }
 
 // getUsage retrieves usage statistics
@@ -255,15 +1204,37 @@ func (s *App) getUsage(c *fiber.Ctx) error {
 	}
 
 	if startDate == "" {
-		startDate = time.Now().AddDate(0, 0, -30).Format("2006-01-02") // Default to 30 days ago
+		startDate = s.analyticsService.Clock().Now().AddDate(0, 0, -30).Format("2006-01-02") // Default to 30 days ago
 	}
 
 	if endDate == "" {
-		endDate = time.Now().Format("2006-01-02") // Default to today
+		endDate = s.analyticsService.Clock().Now().Format("2006-01-02") // Default to today
 	}
 
-	// Get usage statistics
-	usage, err := s.analyticsService.GetUsage(c.Context(), userID, startDate, endDate)
+	// Dashboards polling the usage revalidate it without it being computed again while the
+	// stored events and the settings it is computed with are unchanged
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	breakdown := c.Query("breakdown")
+	etag := ContentETag(s.analyticsService.UsageVersion(ctx, breakdown), userID, startDate, endDate)
+	if ifNoneMatch(c, etag) {
+		c.Set(fiber.HeaderETag, etag)
+		c.Set(fiber.HeaderCacheControl, "private, no-cache")
+		return c.SendStatus(http.StatusNotModified)
+	}
+
+	// Get usage statistics, billed in the project's contract currency
+	var usage *UsageSummary
+	var err error
+	if breakdown != "" {
+		usage, err = s.analyticsService.GetUsageBreakdown(ctx, userID, startDate, endDate, breakdown)
+	} else {
+		usage, err = s.analyticsService.GetUsage(ctx, userID, startDate, endDate)
+	}
+	if errors.Is(err, errEventStoreUnavailable) {
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -271,26 +1242,122 @@ func (s *App) getUsage(c *fiber.Ctx) error {
 	}
 
 	// Return usage data
-	return c.JSON(fiber.Map{
+	response := fiber.Map{
 		"total_events":    usage.TotalEvents,
 		"events_by_type":  usage.EventsByType,
 		"billing_summary": usage.BillingSummary,
 		"total_cost":      usage.BillingSummary.TotalCost,
 		"cost_breakdown":  usage.BillingSummary.CostBreakdown,
+	}
+	if usage.Breakdown != nil {
+		response["breakdown"] = usage.Breakdown
+	}
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+	return c.JSON(response)
+}
+
+// getUsageBatch retrieves usage statistics for many users in one request
+func (s *App) getUsageBatch(c *fiber.Ctx) error {
+	var request struct {
+		UserIDs   []string `json:"user_ids"`
+		StartDate string   `json:"start_date"`
+		EndDate   string   `json:"end_date"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if len(request.UserIDs) == 0 {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "user_ids is required",
+		})
+	}
+
+	if len(request.UserIDs) > s.usageBatchMaxUsers {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("At most %d user IDs can be requested at once", s.usageBatchMaxUsers),
+		})
+	}
+
+	if request.StartDate == "" {
+		request.StartDate = s.analyticsService.Clock().Now().AddDate(0, 0, -30).Format("2006-01-02") // Default to 30 days ago
+	}
+	if request.EndDate == "" {
+		request.EndDate = s.analyticsService.Clock().Now().Format("2006-01-02") // Default to today
+	}
+
+	// Reject an invalid period up front instead of failing every user
+	if _, err := parseQueryDate(request.StartDate); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid start_date format. Use YYYY-MM-DD",
+		})
+	}
+	if _, err := parseQueryDate(request.EndDate); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid end_date format. Use YYYY-MM-DD",
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	results := s.analyticsService.GetUsageBatch(ctx, request.UserIDs, request.StartDate, request.EndDate, s.usageBatchConcurrency)
+
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+
+	status := "success"
+	if failed > 0 {
+		status = "partial"
+	}
+
+	return c.JSON(fiber.Map{
+		"status":     status,
+		"start_date": request.StartDate,
+		"end_date":   request.EndDate,
+		"succeeded":  len(results) - failed,
+		"failed":     failed,
+		"results":    results,
 	})
 }
 
 // getKafkaStatus returns the status of the Kafka consumer service
 func (s *App) getKafkaStatus(c *fiber.Ctx) error {
+	apiUsage := fiber.Map{"transport": "in-process"}
+	if publisher, ok := s.apiUsage.(*KafkaAPIUsagePublisher); ok {
+		apiUsage = fiber.Map{"transport": "kafka", "dropped": publisher.Dropped()}
+	}
+
 	status := "disabled"
+	topics := s.getKafkaTopics()
+	pausedTopics := []string{}
+	var group *KafkaGroupStatus
 	if s.kafkaConsumer != nil {
 		status = "running"
+		membership := s.kafkaConsumer.Group()
+		group = &membership
+		topics = s.kafkaConsumer.Topics()
+		pausedTopics = s.kafkaConsumer.PausedTopics()
+		if len(topics) > 0 && len(pausedTopics) == len(topics) {
+			status = "paused"
+		}
 	}
 
 	return c.JSON(fiber.Map{
-		"status":  status,
-		"topics":  s.getKafkaTopics(),
-		"brokers": s.getKafkaBrokers(),
+		"status":         status,
+		"topics":         topics,
+		"topic_prefixes": ParseTopicPrefixes(os.Getenv("KAFKA_TOPIC_PREFIXES")),
+		"brokers":        s.getKafkaBrokers(),
+		"paused_topics":  pausedTopics,
+		"group":          group,
+		"handlers":       s.kafkaHandlers.Stats(),
+		"api_usage":      apiUsage,
 	})
 }
 
@@ -309,64 +1376,314 @@ func (s *App) GetDashboardService() *DashboardService {
 	return s.dashboardService
 }
 
+// GetKafkaHandlerMetrics returns the metrics of the Kafka event handlers for testing purposes
+func (s *App) GetKafkaHandlerMetrics() *KafkaHandlerMetrics {
+	return s.kafkaHandlers
+}
+
+// GetSessionQuality returns the session scoring model for testing purposes
+func (s *App) GetSessionQuality() *SessionQuality {
+	return s.sessionQuality
+}
+
+// GetRateLimiter returns the limiter of requests per user and endpoint, once the routes are set up
+func (s *App) GetRateLimiter() *RateLimiter {
+	return s.rateLimiter
+}
+
+// GetUserDispatcher returns the dispatcher processing each user's events in order (nil when
+// disabled) for testing purposes
+func (s *App) GetUserDispatcher() *UserDispatcher {
+	return s.dispatcher
+}
+
+// GetKafkaConsumer returns the Kafka consumer service (nil when Kafka is unavailable) for testing purposes
+func (s *App) GetKafkaConsumer() *KafkaConsumerService {
+	return s.kafkaConsumer
+}
+
+// GetAdminAuth returns the admin authenticator for testing purposes
+func (s *App) GetAdminAuth() *AdminAuth {
+	return s.adminAuth
+}
+
+// GetAuditLog returns the audit log for testing purposes
+func (s *App) GetAuditLog() *AuditLog {
+	return s.auditLog
+}
+
+// GetRuntimeSettings returns the runtime settings registry for testing purposes
+func (s *App) GetRuntimeSettings() *RuntimeSettings {
+	return s.runtimeSettings
+}
+
+// GetBenchmarks returns the benchmark service for testing purposes
+func (s *App) GetBenchmarks() *BenchmarkService {
+	return s.benchmarks
+}
+
 // GetFunnelService returns the funnel service for testing purposes
 func (s *App) GetFunnelService() *FunnelService {
 	return s.funnelService
 }
 
+// GetGoalService returns the goal service for testing purposes
+func (s *App) GetGoalService() *GoalService {
+	return s.goalService
+}
+
 // GetHeatmapService returns the heatmap service for testing purposes
 func (s *App) GetHeatmapService() *HeatmapService {
 	return s.heatmapService
 }
 
+// GetDerivedMetrics returns the dashboard metrics derived from funnels and segments
+func (s *App) GetDerivedMetrics() *DerivedMetrics {
+	return s.derivedMetrics
+}
+
+// GetLiveFunnels returns the funnels whose users are followed as their events are stored
+func (s *App) GetLiveFunnels() *LiveFunnels {
+	return s.liveFunnels
+}
+
+// GetSavedQueryService returns the saved query service for testing purposes
+func (s *App) GetSavedQueryService() *SavedQueryService {
+	return s.savedQueryService
+}
+
+// GetSavedDashboardService returns the saved dashboard service for testing purposes
+func (s *App) GetSavedDashboardService() *SavedDashboardService {
+	return s.savedDashboardService
+}
+
+// GetEventPurger returns the event purger for testing purposes
+func (s *App) GetEventPurger() *EventPurger {
+	return s.eventPurger
+}
+
+// GetBillingReconciler returns the billing reconciler for testing purposes
+func (s *App) GetBillingReconciler() *BillingReconciler {
+	return s.billingReconciler
+}
+
+// GetCacheRegistry returns the registry of bounded caches
+func (s *App) GetCacheRegistry() *CacheRegistry {
+	return s.caches
+}
+
+// GetFaultInjector returns the injector of faults into dependencies
+func (s *App) GetFaultInjector() *FaultInjector {
+	return s.faults
+}
+
+// GetServiceAuth returns the authenticator of internal producers
+func (s *App) GetServiceAuth() *ServiceAuth {
+	return s.serviceAuth
+}
+
+// GetSIEMExporter returns the exporter of security events to the SIEM
+func (s *App) GetSIEMExporter() *SIEMExporter {
+	return s.siem
+}
+
+// GetAPIKeys returns the managed API keys
+func (s *App) GetAPIKeys() *APIKeyService {
+	return s.apiKeys
+}
+
+// GetAPIKeyUsage returns the requests counted per API key
+func (s *App) GetAPIKeyUsage() *APIKeyUsage {
+	return s.apiKeyUsage
+}
+
+// GetFunnelWebhook returns the webhook posted funnel results computed in the background
+func (s *App) GetFunnelWebhook() *FunnelWebhook {
+	return s.funnelWebhook
+}
+
+// GetSLOTracker returns the tracker of the ingestion objectives
+func (s *App) GetSLOTracker() *SLOTracker {
+	return s.slos
+}
+
+// GetTrafficMonitor returns the monitor raising traffic alerts
+func (s *App) GetTrafficMonitor() *TrafficMonitor {
+	return s.traffic
+}
+
+// GetUserProfiles returns the profiles and lifecycle stages of users
+func (s *App) GetUserProfiles() *UserProfiles {
+	return s.profiles
+}
+
+// GetFeatureFlags returns the analytics features each project may use
+func (s *App) GetFeatureFlags() *FeatureFlags {
+	return s.features
+}
+
+// GetProfileBootstrap returns the bootstrap seeding user profiles from history
+func (s *App) GetProfileBootstrap() *ProfileBootstrap {
+	return s.bootstrap
+}
+
+// GetUserTimeline returns the timeline of users' events, sessions and cross-service events
+func (s *App) GetUserTimeline() *UserTimeline {
+	return s.timeline
+}
+
+// GetOrganizationService returns the organization service for testing purposes
+func (s *App) GetOrganizationService() *OrganizationService {
+	return s.organizationService
+}
+
 // createFunnel handles funnel creation requests
 func (s *App) createFunnel(c *fiber.Ctx) error {
-	var request struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Steps       []struct {
-			Name        string                 `json:"name"`
-			EventType   string                 `json:"event_type"`
-			Filters     map[string]interface{} `json:"filters,omitempty"`
-			Order       int                    `json:"order"`
-			Description string                 `json:"description,omitempty"`
-		} `json:"steps"`
+	var request funnelRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// With ?upsert=true an existing funnel with the same ID, or the same name when no ID is given, is replaced
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	var funnel *Funnel
+	var created bool
+	var err error
+	if c.QueryBool("upsert") {
+		funnel, created, err = s.funnelService.UpsertFunnel(ctx, request.ID, request.Name, request.Description, request.steps())
+	} else {
+		funnel, created, err = s.funnelService.CreateFunnelWithID(ctx, request.ID, request.Name, request.Description, request.steps())
+	}
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	message := "Funnel created successfully"
+	if !created {
+		message = "Funnel already exists"
 	}
 
+	c.Set(fiber.HeaderETag, ETag(funnel.Version))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"funnel":  funnel,
+		"created": created,
+		"message": message,
+	})
+}
+
+// listFunnels returns the stored funnels of the project
+func (s *App) listFunnels(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"funnels": s.funnelService.ListFunnels(ctx),
+	})
+}
+
+// getFunnel returns a funnel definition with its version as the ETag
+func (s *App) getFunnel(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	funnel, err := s.funnelService.GetFunnel(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, ETag(funnel.Version))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"funnel": funnel,
+	})
+}
+
+// updateFunnel replaces a funnel definition, requiring If-Match with the version being updated. Funnels
+// that do not exist yet may be created under the requested ID without If-Match.
+func (s *App) updateFunnel(c *fiber.Ctx) error {
+	var request funnelRequest
+
 	if err := c.BodyParser(&request); err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
 
-	// Convert request steps to Step structs
-	var steps []Step
-	for _, reqStep := range request.Steps {
-		step := Step{
-			ID:          fmt.Sprintf("step_%d", reqStep.Order),
-			Name:        reqStep.Name,
-			EventType:   reqStep.EventType,
-			Filters:     reqStep.Filters,
-			Order:       reqStep.Order,
-			Description: reqStep.Description,
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	funnelID := utils.CopyString(c.Params("id"))
+
+	if c.Get(fiber.HeaderIfMatch) == "" {
+		if _, err := s.funnelService.GetFunnel(ctx, funnelID); err != nil {
+			funnel, created, err := s.funnelService.CreateFunnelWithID(ctx, funnelID, request.Name, request.Description, request.steps())
+			if err != nil {
+				return writeUpdateError(c, err, http.StatusBadRequest)
+			}
+
+			c.Set(fiber.HeaderETag, ETag(funnel.Version))
+			return c.Status(createdStatus(created)).JSON(fiber.Map{
+				"status":  "success",
+				"funnel":  funnel,
+				"created": created,
+			})
 		}
-		steps = append(steps, step)
 	}
 
-	funnel, err := s.funnelService.CreateFunnel(c.Context(), request.Name, request.Description, steps)
+	expectedVersion, status, err := ifMatchVersion(c)
 	if err != nil {
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+		return c.Status(status).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
 
+	funnel, err := s.funnelService.UpdateFunnel(ctx, funnelID, request.Name, request.Description, request.steps(), expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, notFoundOrBadRequest(err))
+	}
+
+	c.Set(fiber.HeaderETag, ETag(funnel.Version))
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"funnel":  funnel,
-		"message": "Funnel created successfully",
+		"message": "Funnel updated successfully",
 	})
 }
 
+// funnelRequest is the body of funnel create and update requests
+type funnelRequest struct {
+	ID          string `json:"id"` // Optional client-supplied ID on creation
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Steps       []struct {
+		Name        string                 `json:"name"`
+		EventType   string                 `json:"event_type"`
+		Source      string                 `json:"source,omitempty"`
+		Filters     map[string]interface{} `json:"filters,omitempty"`
+		Order       int                    `json:"order"`
+		Description string                 `json:"description,omitempty"`
+	} `json:"steps"`
+}
+
+// steps converts the request steps to Step structs
+func (r funnelRequest) steps() []Step {
+	var steps []Step
+	for _, reqStep := range r.Steps {
+		step := Step{
+			ID:          fmt.Sprintf("step_%d", reqStep.Order),
+			Name:        reqStep.Name,
+			EventType:   reqStep.EventType,
+			Source:      reqStep.Source,
+			Filters:     reqStep.Filters,
+			Order:       reqStep.Order,
+			Description: reqStep.Description,
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
 // computeFunnel handles funnel computation requests
 func (s *App) computeFunnel(c *fiber.Ctx) error {
 	funnelID := c.Params("id")
@@ -376,41 +1693,111 @@ func (s *App) computeFunnel(c *fiber.Ctx) error {
 		})
 	}
 
-	// Parse query parameters
-	startDate := c.Query("start_date")
-	endDate := c.Query("end_date")
-	userID := c.Query("user_id")
+	parameters := copyQueryParameters(c, "start_date", "end_date", "user_id", "breakdown")
+	parameters["region"] = regionFromRequest(c)
+	if _, _, err := s.funnelTimeRange(parameters["start_date"], parameters["end_date"]); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
-	if startDate == "" {
-		startDate = time.Now().AddDate(0, 0, -30).Format("2006-01-02")
+	// Updating the funnel changes its version, so results of the previous steps are not served
+	projectID := projectIDFromRequest(c)
+	funnel, err := s.funnelService.GetFunnel(ContextWithProject(c.Context(), projectID), funnelID)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
 	}
-	if endDate == "" {
-		endDate = time.Now().Format("2006-01-02")
+	parameters["funnel_id"] = funnel.ID
+	parameters["version"] = strconv.FormatInt(funnel.Version, 10)
+
+	if prefersAsync(c) {
+		start, end, _ := s.funnelTimeRange(parameters["start_date"], parameters["end_date"])
+		return s.acceptJob(c, projectID, JobFunnel, func(ctx context.Context) (interface{}, error) {
+			result, err := s.funnelService.ComputeFunnel(ContextWithRegion(ContextWithProject(ctx, projectID), parameters["region"]), FunnelQuery{
+				FunnelID:  parameters["funnel_id"],
+				UserID:    parameters["user_id"],
+				Start:     start,
+				End:       end,
+				Breakdown: parameters["breakdown"],
+			})
+			if err != nil {
+				return nil, err
+			}
+			s.funnelWebhook.Notify(projectID, FunnelTriggerJob, result)
+			return result, nil
+		})
 	}
 
-	// Parse dates
-	start, err := time.Parse("2006-01-02", startDate)
+	result, err := s.cachedQuery(c, "funnel", projectID, parameters, func() (interface{}, error) {
+		start, end, err := s.funnelTimeRange(parameters["start_date"], parameters["end_date"])
+		if err != nil {
+			return nil, err
+		}
+		return s.funnelService.ComputeFunnel(ContextWithRegion(ContextWithProject(context.Background(), projectID), parameters["region"]), FunnelQuery{
+			FunnelID:  parameters["funnel_id"],
+			UserID:    parameters["user_id"],
+			Start:     start,
+			End:       end,
+			Breakdown: parameters["breakdown"],
+		})
+	})
+	if errors.Is(err, errFunnelNotFound) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid start_date format. Use YYYY-MM-DD",
+			"error": err.Error(),
 		})
 	}
 
-	end, err := time.Parse("2006-01-02", endDate)
-	if err != nil {
+	return sendQueryResult(c, result, fiber.Map{
+		"status": "success",
+		"result": result,
+	})
+}
+
+// suggestFunnels handles requests for funnels suggested from the event sequences of the project's
+// users. Results are cached, see cachedQuery.
+func (s *App) suggestFunnels(c *fiber.Ctx) error {
+	parameters := copyQueryParameters(c, "start_date", "end_date", "min_steps", "max_steps", "min_support", "limit")
+	parameters["region"] = regionFromRequest(c)
+	timeRange := map[string]interface{}{
+		"start_date": parameters["start_date"],
+		"end_date":   parameters["end_date"],
+	}
+	if _, _, err := queryTimeRange(timeRange); err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid end_date format. Use YYYY-MM-DD",
+			"error": err.Error(),
 		})
 	}
-
-	query := FunnelQuery{
-		FunnelID: funnelID,
-		UserID:   userID,
-		Start:    start,
-		End:      end,
+	var minSupport float64
+	if parameters["min_support"] != "" {
+		parsed, err := strconv.ParseFloat(parameters["min_support"], 64)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "min_support must be a share of users between 0 and 1",
+			})
+		}
+		minSupport = parsed
 	}
-
-	result, err := s.funnelService.ComputeFunnel(c.Context(), query)
+	minSteps, maxSteps, limit := c.QueryInt("min_steps"), c.QueryInt("max_steps"), c.QueryInt("limit")
+
+	projectID := projectIDFromRequest(c)
+	result, err := s.cachedQuery(c, "funnel_suggestions", projectID, parameters, func() (interface{}, error) {
+		start, end, _ := queryTimeRange(timeRange)
+		return s.funnelService.SuggestFunnels(ContextWithRegion(ContextWithProject(context.Background(), projectID), parameters["region"]), FunnelSuggestionQuery{
+			Start:      start,
+			End:        end,
+			MinSteps:   minSteps,
+			MaxSteps:   maxSteps,
+			MinSupport: minSupport,
+			Limit:      limit,
+		})
+	})
 	if err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -423,6 +1810,27 @@ func (s *App) computeFunnel(c *fiber.Ctx) error {
 	})
 }
 
+// funnelTimeRange parses the YYYY-MM-DD dates of a funnel computation, the last 30 days by default.
+// The end date is included, so the range ends at the start of the next day.
+func (s *App) funnelTimeRange(startDate, endDate string) (time.Time, time.Time, error) {
+	if startDate == "" {
+		startDate = s.analyticsService.Clock().Now().AddDate(0, 0, -30).Format("2006-01-02")
+	}
+	if endDate == "" {
+		endDate = s.analyticsService.Clock().Now().Format("2006-01-02")
+	}
+
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid start_date format. Use YYYY-MM-DD")
+	}
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("Invalid end_date format. Use YYYY-MM-DD")
+	}
+	return start, end.AddDate(0, 0, 1), nil
+}
+
 // getFunnelSteps retrieves the steps for a specific funnel
 func (s *App) getFunnelSteps(c *fiber.Ctx) error {
 	funnelID := c.Params("id")
@@ -432,7 +1840,13 @@ func (s *App) getFunnelSteps(c *fiber.Ctx) error {
 		})
 	}
 
-	steps, err := s.funnelService.GetFunnelSteps(c.Context(), funnelID)
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	steps, err := s.funnelService.GetFunnelSteps(ctx, funnelID)
+	if errors.Is(err, errFunnelNotFound) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 	if err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
@@ -447,14 +1861,7 @@ func (s *App) getFunnelSteps(c *fiber.Ctx) error {
 
 // createHeatmap handles heatmap creation requests
 func (s *App) createHeatmap(c *fiber.Ctx) error {
-	var request struct {
-		Name        string `json:"name"`
-		Description string `json:"description"`
-		Type        string `json:"type"`
-		Page        string `json:"page"`
-		Width       int    `json:"width"`
-		Height      int    `json:"height"`
-	}
+	var request heatmapRequest
 
 	if err := c.BodyParser(&request); err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
@@ -462,13 +1869,22 @@ func (s *App) createHeatmap(c *fiber.Ctx) error {
 		})
 	}
 
-	heatmap, err := s.heatmapService.CreateHeatmap(c.Context(), request.Name, request.Description, request.Type, request.Page, request.Width, request.Height)
+	schedule, err := request.schedule()
 	if err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
 
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	heatmap, err := s.heatmapService.CreateHeatmap(ctx, request.Name, request.Description, request.Type, request.Page, request.Width, request.Height, schedule)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, ETag(heatmap.Version))
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"heatmap": heatmap,
@@ -488,15 +1904,26 @@ func (s *App) generateHeatmap(c *fiber.Ctx) error {
 
 	// Set default time range if not provided
 	if request.Start.IsZero() {
-		request.Start = time.Now().AddDate(0, 0, -30)
+		request.Start = s.analyticsService.Clock().Now().AddDate(0, 0, -30)
 	}
 	if request.End.IsZero() {
-		request.End = time.Now()
+		request.End = s.analyticsService.Clock().Now()
 	}
 
-	result, err := s.heatmapService.GenerateHeatmap(c.Context(), request)
+	ctx := ContextWithBillingUser(ContextWithProject(c.Context(), projectIDFromRequest(c)), utils.CopyString(c.Get("X-User-ID")))
+	result, err := s.heatmapService.GenerateHeatmap(ctx, request)
 	if err != nil {
-		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+		var limitErr *PlanLimitError
+		if errors.As(err, &limitErr) {
+			return c.Status(http.StatusPaymentRequired).JSON(fiber.Map{
+				"error":      err.Error(),
+				"plan":       limitErr.Plan,
+				"limit":      limitErr.Limit,
+				"allowed":    limitErr.Allowed,
+				"upgrade_to": limitErr.UpgradeTo,
+			})
+		}
+		return c.Status(notFoundOrBadRequest(err)).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
@@ -516,15 +1943,107 @@ func (s *App) getHeatmap(c *fiber.Ctx) error {
 		})
 	}
 
-	heatmap, err := s.heatmapService.GetHeatmap(c.Context(), heatmapID)
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	heatmap, err := s.heatmapService.GetHeatmap(ctx, heatmapID)
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, ETag(heatmap.Version))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"heatmap": heatmap,
+	})
+}
+
+// updateHeatmap replaces a heatmap configuration, requiring If-Match with the version being updated
+func (s *App) updateHeatmap(c *fiber.Ctx) error {
+	var request heatmapRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	expectedVersion, status, err := ifMatchVersion(c)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	schedule, err := request.schedule()
 	if err != nil {
 		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
 			"error": err.Error(),
 		})
 	}
 
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	heatmap, err := s.heatmapService.UpdateHeatmap(ctx, c.Params("id"), request.Name, request.Description, request.Type, request.Page, request.Width, request.Height, schedule, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, notFoundOrBadRequest(err))
+	}
+
+	c.Set(fiber.HeaderETag, ETag(heatmap.Version))
 	return c.JSON(fiber.Map{
 		"status":  "success",
 		"heatmap": heatmap,
+		"message": "Heatmap updated successfully",
+	})
+}
+
+// listHeatmaps lists the project's heatmaps, optionally filtered by ?page and ?type
+func (s *App) listHeatmaps(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	heatmaps := s.heatmapService.ListHeatmaps(ctx, HeatmapFilter{
+		Page: c.Query("page"),
+		Type: c.Query("type"),
+	})
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"heatmaps": heatmaps,
+		"count":    len(heatmaps),
 	})
 }
+
+// deleteHeatmap removes a heatmap and its data
+func (s *App) deleteHeatmap(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	if err := s.heatmapService.DeleteHeatmap(ctx, c.Params("id")); err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Heatmap deleted successfully",
+	})
+}
+
+// heatmapRequest is the body of heatmap create and update requests
+type heatmapRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Page        string `json:"page"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Schedule    *struct {
+		Refresh string `json:"refresh"`
+		Window  string `json:"window"`
+	} `json:"schedule"`
+}
+
+// schedule returns the requested regeneration schedule, or nil without one
+func (r heatmapRequest) schedule() (*HeatmapSchedule, error) {
+	if r.Schedule == nil {
+		return nil, nil
+	}
+	return NewHeatmapSchedule(r.Schedule.Refresh, r.Schedule.Window)
+}
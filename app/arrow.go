@@ -0,0 +1,481 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// ArrowStreamMediaType is the media type of the Arrow IPC streaming format
+const ArrowStreamMediaType = "application/vnd.apache.arrow.stream"
+
+// Maximum number of rows per Arrow record batch
+const arrowBatchRows = 64 * 1024
+
+// Types of Arrow columns
+const (
+	ArrowInt64     = "int64"
+	ArrowFloat64   = "float64"
+	ArrowUtf8      = "utf8"
+	ArrowBool      = "bool"
+	ArrowTimestamp = "timestamp" // Milliseconds since the epoch, in UTC
+)
+
+// ArrowColumn is a named, typed column of an Arrow table
+type ArrowColumn struct {
+	Name   string
+	Type   string
+	Values []interface{} // nil values are null
+}
+
+// ArrowTable is a set of equally long columns written as Arrow record batches
+type ArrowTable struct {
+	Columns []*ArrowColumn
+}
+
+// NewArrowTable creates a table with empty columns of the given names and types
+func NewArrowTable(columns ...ArrowColumn) *ArrowTable {
+	table := &ArrowTable{}
+	for _, column := range columns {
+		table.Columns = append(table.Columns, &ArrowColumn{Name: column.Name, Type: column.Type})
+	}
+	return table
+}
+
+// Append adds a row with one value per column
+func (t *ArrowTable) Append(values ...interface{}) {
+	for i, column := range t.Columns {
+		column.Values = append(column.Values, values[i])
+	}
+}
+
+// Rows returns the number of rows of the table
+func (t *ArrowTable) Rows() int {
+	if len(t.Columns) == 0 {
+		return 0
+	}
+	return len(t.Columns[0].Values)
+}
+
+// Arrow format constants, see Schema.fbs and Message.fbs of the Arrow specification
+const (
+	arrowMetadataV5          = 4
+	arrowHeaderSchema        = 1
+	arrowHeaderRecordBatch   = 3
+	arrowTypeInt             = 2
+	arrowTypeFloatingPoint   = 3
+	arrowTypeUtf8            = 5
+	arrowTypeBool            = 6
+	arrowTypeTimestamp       = 10
+	arrowPrecisionDouble     = 2
+	arrowTimeUnitMillisecond = 1
+	arrowContinuation        = 0xFFFFFFFF
+)
+
+// WriteArrowStream writes the table in the Arrow IPC streaming format: the schema, the rows in
+// record batches and the end-of-stream marker
+func WriteArrowStream(w io.Writer, table *ArrowTable) error {
+	rows := table.Rows()
+	for _, column := range table.Columns {
+		if len(column.Values) != rows {
+			return fmt.Errorf("column %s has %d values, expected %d", column.Name, len(column.Values), rows)
+		}
+		if _, err := arrowFieldType(column.Type); err != nil {
+			return err
+		}
+	}
+
+	if err := writeArrowMessage(w, arrowSchemaMessage(table), nil); err != nil {
+		return err
+	}
+	// Empty tables are written as a single empty batch
+	for start := 0; ; start += arrowBatchRows {
+		end := min(start+arrowBatchRows, rows)
+		metadata, body, err := arrowRecordBatch(table, start, end)
+		if err != nil {
+			return err
+		}
+		if err := writeArrowMessage(w, metadata, body); err != nil {
+			return err
+		}
+		if end == rows {
+			break
+		}
+	}
+
+	_, err := w.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0})
+	return err
+}
+
+// writeArrowMessage writes an encapsulated message: continuation marker, metadata length,
+// flatbuffer metadata and body, each padded to 8 bytes
+func writeArrowMessage(w io.Writer, metadata, body []byte) error {
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint32(prefix, arrowContinuation)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(metadata)))
+	for _, part := range [][]byte{prefix, metadata, body} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arrowSchemaMessage encodes the Schema message describing the table's columns
+func arrowSchemaMessage(table *ArrowTable) []byte {
+	fields := make(fbVector, 0, len(table.Columns))
+	for _, column := range table.Columns {
+		typeID, _ := arrowFieldType(column.Type)
+		fields = append(fields, &fbTable{
+			fbRef(fbString(column.Name)),
+			fbBool(true),
+			fbUint8(typeID),
+			fbRef(arrowTypeTable(column.Type)),
+			fbField{}, // dictionary
+			fbRef(fbVector{}),
+		})
+	}
+
+	schema := &fbTable{
+		fbInt16(0), // little endian
+		fbRef(fields),
+	}
+	return fbFinish(arrowMessage(arrowHeaderSchema, schema, 0))
+}
+
+// arrowRecordBatch encodes the RecordBatch message and body of the table's rows [start, end)
+func arrowRecordBatch(table *ArrowTable, start, end int) ([]byte, []byte, error) {
+	var body bytes.Buffer
+	var nodes, buffers []byte
+	addBuffer := func(data []byte) {
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(body.Len()))
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(data)))
+		body.Write(data)
+		for body.Len()%8 != 0 {
+			body.WriteByte(0)
+		}
+	}
+
+	length := end - start
+	for _, column := range table.Columns {
+		values := column.Values[start:end]
+		validity, nulls := arrowValidity(values)
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(length))
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(nulls))
+		addBuffer(validity)
+
+		buffersOfColumn, err := arrowColumnBuffers(column, values)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, data := range buffersOfColumn {
+			addBuffer(data)
+		}
+	}
+
+	batch := &fbTable{
+		fbInt64(int64(length)),
+		fbRef(fbStructs{count: len(table.Columns), data: nodes}),
+		fbRef(fbStructs{count: len(buffers) / 16, data: buffers}),
+	}
+	return fbFinish(arrowMessage(arrowHeaderRecordBatch, batch, int64(body.Len()))), body.Bytes(), nil
+}
+
+// arrowMessage wraps a message header in a Message table
+func arrowMessage(headerType uint8, header *fbTable, bodyLength int64) *fbTable {
+	return &fbTable{
+		fbInt16(arrowMetadataV5),
+		fbUint8(headerType),
+		fbRef(header),
+		fbInt64(bodyLength),
+	}
+}
+
+// arrowFieldType returns the Type union member of a column type
+func arrowFieldType(columnType string) (uint8, error) {
+	switch columnType {
+	case ArrowInt64:
+		return arrowTypeInt, nil
+	case ArrowFloat64:
+		return arrowTypeFloatingPoint, nil
+	case ArrowUtf8:
+		return arrowTypeUtf8, nil
+	case ArrowBool:
+		return arrowTypeBool, nil
+	case ArrowTimestamp:
+		return arrowTypeTimestamp, nil
+	}
+	return 0, fmt.Errorf("unsupported Arrow column type: %s", columnType)
+}
+
+// arrowTypeTable returns the type table of a column type
+func arrowTypeTable(columnType string) *fbTable {
+	switch columnType {
+	case ArrowInt64:
+		return &fbTable{fbInt32(64), fbBool(true)}
+	case ArrowFloat64:
+		return &fbTable{fbInt16(arrowPrecisionDouble)}
+	case ArrowTimestamp:
+		return &fbTable{fbInt16(arrowTimeUnitMillisecond), fbRef(fbString("UTC"))}
+	}
+	return &fbTable{}
+}
+
+// arrowValidity returns the validity bitmap of the values and their null count. Columns without
+// nulls have an empty bitmap.
+func arrowValidity(values []interface{}) ([]byte, int) {
+	nulls := 0
+	bitmap := make([]byte, (len(values)+7)/8)
+	for i, value := range values {
+		if value == nil {
+			nulls++
+			continue
+		}
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+	if nulls == 0 {
+		return nil, 0
+	}
+	return bitmap, nulls
+}
+
+// arrowColumnBuffers returns the data buffers of the values of a column
+func arrowColumnBuffers(column *ArrowColumn, values []interface{}) ([][]byte, error) {
+	invalid := func(value interface{}) error {
+		return fmt.Errorf("column %s: %T is not a valid %s value", column.Name, value, column.Type)
+	}
+
+	switch column.Type {
+	case ArrowInt64, ArrowFloat64, ArrowTimestamp:
+		data := make([]byte, 0, 8*len(values))
+		for _, value := range values {
+			if !arrowValueMatches(column.Type, value) {
+				return nil, invalid(value)
+			}
+			var bits uint64
+			switch typed := value.(type) {
+			case int64:
+				bits = uint64(typed)
+			case int:
+				bits = uint64(typed)
+			case float64:
+				bits = math.Float64bits(typed)
+			case time.Time:
+				bits = uint64(typed.UnixMilli())
+			}
+			data = binary.LittleEndian.AppendUint64(data, bits)
+		}
+		return [][]byte{data}, nil
+
+	case ArrowUtf8:
+		offsets := make([]byte, 4, 4*(len(values)+1))
+		var data []byte
+		for _, value := range values {
+			if value != nil {
+				text, ok := value.(string)
+				if !ok {
+					return nil, invalid(value)
+				}
+				data = append(data, text...)
+			}
+			offsets = binary.LittleEndian.AppendUint32(offsets, uint32(len(data)))
+		}
+		return [][]byte{offsets, data}, nil
+
+	case ArrowBool:
+		data := make([]byte, (len(values)+7)/8)
+		for i, value := range values {
+			if value == nil {
+				continue
+			}
+			flag, ok := value.(bool)
+			if !ok {
+				return nil, invalid(value)
+			}
+			if flag {
+				data[i/8] |= 1 << (i % 8)
+			}
+		}
+		return [][]byte{data}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported Arrow column type: %s", column.Type)
+}
+
+// arrowValueMatches reports whether a value is stored in a fixed-width column of the given type
+func arrowValueMatches(columnType string, value interface{}) bool {
+	switch value.(type) {
+	case nil:
+		return true
+	case int64, int:
+		return columnType == ArrowInt64
+	case float64:
+		return columnType == ArrowFloat64
+	case time.Time:
+		return columnType == ArrowTimestamp
+	}
+	return false
+}
+
+// The Arrow metadata is encoded as flatbuffers. The encoder below lays objects out front to
+// back, so every offset points forward as the format requires: a table's vtable precedes it
+// and the objects it references follow it.
+
+// fbObject is a flatbuffer table, vector or string
+type fbObject interface {
+	write(b *fbBuilder) int
+}
+
+// fbField is a table field: a little-endian scalar or a reference to an object. Fields with
+// neither are absent.
+type fbField struct {
+	scalar []byte
+	object fbObject
+}
+
+// fbTable is a table whose fields are given in field ID order
+type fbTable []fbField
+
+// fbVector is a vector of tables
+type fbVector []fbObject
+
+// fbString is a string
+type fbString string
+
+// fbStructs is a vector of 8-byte aligned structs
+type fbStructs struct {
+	count int
+	data  []byte
+}
+
+// Constructors of scalar and reference fields
+func fbUint8(value uint8) fbField { return fbField{scalar: []byte{value}} }
+func fbInt16(value int16) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint16(nil, uint16(value))}
+}
+func fbInt32(value int32) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint32(nil, uint32(value))}
+}
+func fbInt64(value int64) fbField {
+	return fbField{scalar: binary.LittleEndian.AppendUint64(nil, uint64(value))}
+}
+func fbRef(object fbObject) fbField { return fbField{object: object} }
+
+func fbBool(value bool) fbField {
+	if value {
+		return fbUint8(1)
+	}
+	return fbUint8(0)
+}
+
+// fbBuilder accumulates an encoded flatbuffer
+type fbBuilder struct {
+	bytes []byte
+}
+
+// fbFinish encodes a root table, padded to 8 bytes
+func fbFinish(root *fbTable) []byte {
+	b := &fbBuilder{}
+	b.reserve(4)
+	b.putUint32(0, uint32(root.write(b)))
+	b.align(8)
+	return b.bytes
+}
+
+// align pads the buffer to a multiple of n bytes
+func (b *fbBuilder) align(n int) {
+	for len(b.bytes)%n != 0 {
+		b.bytes = append(b.bytes, 0)
+	}
+}
+
+// reserve appends n zero bytes and returns their position
+func (b *fbBuilder) reserve(n int) int {
+	position := len(b.bytes)
+	b.bytes = append(b.bytes, make([]byte, n)...)
+	return position
+}
+
+func (b *fbBuilder) putUint16(position int, value uint16) {
+	binary.LittleEndian.PutUint16(b.bytes[position:], value)
+}
+
+func (b *fbBuilder) putUint32(position int, value uint32) {
+	binary.LittleEndian.PutUint32(b.bytes[position:], value)
+}
+
+// putOffset points the offset at position to the object at target
+func (b *fbBuilder) putOffset(position, target int) {
+	b.putUint32(position, uint32(target-position))
+}
+
+func (t *fbTable) write(b *fbBuilder) int {
+	fields := *t
+	b.align(2)
+	vtable := b.reserve(4 + 2*len(fields))
+	b.align(8)
+	table := b.reserve(4)
+
+	positions := make([]int, len(fields))
+	for i, field := range fields {
+		size := len(field.scalar)
+		if field.object != nil {
+			size = 4
+		}
+		if size == 0 {
+			continue
+		}
+		b.align(size)
+		positions[i] = b.reserve(size)
+		copy(b.bytes[positions[i]:], field.scalar)
+	}
+
+	b.putUint16(vtable, uint16(4+2*len(fields)))
+	b.putUint16(vtable+2, uint16(len(b.bytes)-table))
+	for i, position := range positions {
+		if position != 0 {
+			b.putUint16(vtable+4+2*i, uint16(position-table))
+		}
+	}
+	b.putUint32(table, uint32(int32(table-vtable)))
+
+	for i, field := range fields {
+		if field.object != nil {
+			b.putOffset(positions[i], field.object.write(b))
+		}
+	}
+	return table
+}
+
+func (v fbVector) write(b *fbBuilder) int {
+	b.align(4)
+	vector := b.reserve(4 + 4*len(v))
+	b.putUint32(vector, uint32(len(v)))
+	for i, object := range v {
+		b.putOffset(vector+4+4*i, object.write(b))
+	}
+	return vector
+}
+
+func (s fbString) write(b *fbBuilder) int {
+	b.align(4)
+	position := b.reserve(4 + len(s) + 1)
+	b.putUint32(position, uint32(len(s)))
+	copy(b.bytes[position+4:], s)
+	return position
+}
+
+func (s fbStructs) write(b *fbBuilder) int {
+	// The structs follow the 4-byte length and must be 8-byte aligned
+	b.align(4)
+	if len(b.bytes)%8 == 0 {
+		b.reserve(4)
+	}
+	position := b.reserve(4 + len(s.data))
+	b.putUint32(position, uint32(s.count))
+	copy(b.bytes[position+4:], s.data)
+	return position
+}
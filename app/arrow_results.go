@@ -0,0 +1,174 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// wantsArrow reports whether the request asks for Arrow record batches through ?format=arrow or
+// the Accept header
+func wantsArrow(c *fiber.Ctx) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "arrow"
+	}
+	return strings.Contains(c.Get(fiber.HeaderAccept), ArrowStreamMediaType)
+}
+
+// sendQueryResult responds with the JSON body, or with the query result as an Arrow stream when
+// the request asks for it
+func sendQueryResult(c *fiber.Ctx, result interface{}, body fiber.Map) error {
+	c.Vary(fiber.HeaderAccept)
+	if !wantsArrow(c) {
+		return c.JSON(body)
+	}
+
+	table, err := ArrowTableFor(result)
+	if err != nil {
+		return c.Status(http.StatusNotAcceptable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var stream bytes.Buffer
+	if err := WriteArrowStream(&stream, table); err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	c.Set(fiber.HeaderContentType, ArrowStreamMediaType)
+	return c.Send(stream.Bytes())
+}
+
+// ArrowTableFor returns the rows of a query result as an Arrow table. Results broken down by a
+// dimension have a leading "value" column and the rows of every value.
+func ArrowTableFor(result interface{}) (*ArrowTable, error) {
+	switch result := result.(type) {
+	case *TrendResult:
+		return trendArrowTable(result), nil
+	case *SegmentResult:
+		table := NewArrowTable(ArrowColumn{Name: "user_id", Type: ArrowUtf8})
+		for _, userID := range result.Users {
+			table.Append(userID)
+		}
+		return table, nil
+	case *FunnelResult:
+		return funnelArrowTable(result), nil
+	case *RetentionResult:
+		table := NewArrowTable(
+			ArrowColumn{Name: "cohort", Type: ArrowUtf8},
+			ArrowColumn{Name: "cohort_users", Type: ArrowInt64},
+			ArrowColumn{Name: "day", Type: ArrowInt64},
+			ArrowColumn{Name: "retained_users", Type: ArrowInt64},
+			ArrowColumn{Name: "rate", Type: ArrowFloat64},
+			ArrowColumn{Name: "complete", Type: ArrowBool},
+		)
+		for _, cohort := range result.Cohorts {
+			for _, cell := range cohort.Retention {
+				table.Append(cohort.Date, cohort.Users, int64(cell.Day), cell.Users, cell.Rate, cell.Complete)
+			}
+		}
+		return table, nil
+	case *UsageSummary:
+		return usageArrowTable(result), nil
+	case *RollupReport:
+		table := NewArrowTable(
+			ArrowColumn{Name: result.Dimension, Type: ArrowUtf8},
+			ArrowColumn{Name: "events", Type: ArrowInt64},
+			ArrowColumn{Name: "unique_users", Type: ArrowInt64},
+		)
+		for _, group := range result.Groups {
+			table.Append(group.Value, group.Events, group.UniqueUsers)
+		}
+		return table, nil
+	}
+	return nil, fmt.Errorf("%T results are not available as Arrow", result)
+}
+
+// trendArrowTable returns a row per trend interval
+func trendArrowTable(result *TrendResult) *ArrowTable {
+	columns := []ArrowColumn{
+		{Name: "timestamp", Type: ArrowTimestamp},
+		{Name: "count", Type: ArrowInt64},
+		{Name: "unique_users", Type: ArrowInt64},
+	}
+	if len(result.Breakdown) == 0 {
+		table := NewArrowTable(columns...)
+		for _, point := range result.Points {
+			table.Append(point.Timestamp, point.Count, point.UniqueUsers)
+		}
+		return table
+	}
+
+	table := NewArrowTable(append([]ArrowColumn{{Name: "value", Type: ArrowUtf8}}, columns...)...)
+	for _, series := range result.Breakdown {
+		for _, point := range series.Points {
+			table.Append(series.Value, point.Timestamp, point.Count, point.UniqueUsers)
+		}
+	}
+	return table
+}
+
+// funnelArrowTable returns a row per funnel step
+func funnelArrowTable(result *FunnelResult) *ArrowTable {
+	columns := []ArrowColumn{
+		{Name: "step_id", Type: ArrowUtf8},
+		{Name: "step_name", Type: ArrowUtf8},
+		{Name: "event_count", Type: ArrowInt64},
+		{Name: "unique_users", Type: ArrowInt64},
+		{Name: "drop_off_rate", Type: ArrowFloat64},
+		{Name: "conversion_rate", Type: ArrowFloat64},
+	}
+	if len(result.Breakdown) == 0 {
+		table := NewArrowTable(columns...)
+		for _, step := range result.Steps {
+			table.Append(step.StepID, step.StepName, step.EventCount, step.UniqueUsers, step.DropOffRate, step.ConversionRate)
+		}
+		return table
+	}
+
+	table := NewArrowTable(append([]ArrowColumn{{Name: "value", Type: ArrowUtf8}}, columns...)...)
+	for _, segment := range result.Breakdown {
+		for _, step := range segment.Steps {
+			table.Append(segment.Value, step.StepID, step.StepName, step.EventCount, step.UniqueUsers, step.DropOffRate, step.ConversionRate)
+		}
+	}
+	return table
+}
+
+// usageArrowTable returns a row per event type
+func usageArrowTable(result *UsageSummary) *ArrowTable {
+	columns := []ArrowColumn{
+		{Name: "event_type", Type: ArrowUtf8},
+		{Name: "events", Type: ArrowInt64},
+	}
+	if len(result.Breakdown) == 0 {
+		table := NewArrowTable(columns...)
+		for _, eventType := range sortedKeys(result.EventsByType) {
+			table.Append(eventType, result.EventsByType[eventType])
+		}
+		return table
+	}
+
+	table := NewArrowTable(append([]ArrowColumn{{Name: "value", Type: ArrowUtf8}}, columns...)...)
+	for _, usage := range result.Breakdown {
+		for _, eventType := range sortedKeys(usage.EventsByType) {
+			table.Append(usage.Value, eventType, usage.EventsByType[eventType])
+		}
+	}
+	return table
+}
+
+// sortedKeys returns the keys of event counts in order
+func sortedKeys(counts map[string]int64) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,238 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Statuses of an ingestion receipt
+const (
+	ReceiptPending     = "pending"     // Queued, not processed yet
+	ReceiptStored      = "stored"      // Tracked; the receipt has the event ID
+	ReceiptRejected    = "rejected"    // Failed validation; the receipt has the reason
+	ReceiptDropped     = "dropped"     // Shed under load, or over its event type's daily quota
+	ReceiptQuarantined = "quarantined" // Failed validation and kept in the project's quarantine; the receipt has the reason
+)
+
+// IngestionReceipt tells an SDK what became of an event accepted for asynchronous ingestion
+type IngestionReceipt struct {
+	ID          string     `json:"receipt_id"`
+	ProjectID   string     `json:"project_id"`
+	Status      string     `json:"status"`
+	Reason      string     `json:"reason,omitempty"`
+	EventID     string     `json:"event_id,omitempty"`
+	AcceptedAt  time.Time  `json:"accepted_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// OverloadedError is returned when the ingestion queue is full and an event is shed on arrival
+type OverloadedError struct {
+	Receipt *IngestionReceipt
+}
+
+func (e *OverloadedError) Error() string {
+	return "ingestion queue is full, retry later"
+}
+
+// AsyncIngestion accepts events without processing them in the request. Events are tracked by a
+// worker pool and every event gets a receipt recording whether it was stored, rejected or shed.
+// With a dispatcher, the pool validates and bills the events and the dispatcher stores them.
+type AsyncIngestion struct {
+	service     *AnalyticsService
+	pool        *WorkerPool
+	dispatcher  *UserDispatcher // Stores events in order per user, if set
+	maxQueueAge time.Duration   // Events queued longer are shed instead of processed
+	receipts    *BoundedCache   // Receipt ID -> receipt, kept for the receipt TTL after its last change
+	mutex       sync.RWMutex
+}
+
+// NewAsyncIngestion creates an asynchronous ingestion pipeline configured from
+// INGESTION_WORKER_POOL_SIZE, INGESTION_QUEUE_CAPACITY, INGESTION_MAX_QUEUE_AGE, INGESTION_RECEIPT_TTL
+// and INGESTION_MAX_RECEIPTS (default 1000000)
+func NewAsyncIngestion(service *AnalyticsService) *AsyncIngestion {
+	receipts := NewBoundedCache("ingestion_receipts", getEnvInt("INGESTION_MAX_RECEIPTS", 1000000), getEnvDuration("INGESTION_RECEIPT_TTL", 24*time.Hour))
+	// The service's clock may be replaced after the pipeline is created
+	receipts.SetClock(clockFunc(func() time.Time { return service.Clock().Now() }))
+
+	return &AsyncIngestion{
+		service:     service,
+		pool:        NewWorkerPool("ingestion", getEnvInt("INGESTION_WORKER_POOL_SIZE", 8), getEnvInt("INGESTION_QUEUE_CAPACITY", 10000)),
+		maxQueueAge: getEnvDuration("INGESTION_MAX_QUEUE_AGE", 30*time.Second),
+		receipts:    receipts,
+	}
+}
+
+// Receipts returns the cache of receipts
+func (a *AsyncIngestion) Receipts() *BoundedCache {
+	return a.receipts
+}
+
+// SetDispatcher stores accepted events through a dispatcher keeping each user's events in order,
+// once the pool validated and billed them
+func (a *AsyncIngestion) SetDispatcher(dispatcher *UserDispatcher) {
+	a.dispatcher = dispatcher
+}
+
+// WorkerPool returns the pool processing accepted events
+func (a *AsyncIngestion) WorkerPool() *WorkerPool {
+	return a.pool
+}
+
+// MaxQueueAge returns how long an event may wait in the queue before it is shed
+func (a *AsyncIngestion) MaxQueueAge() time.Duration {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.maxQueueAge
+}
+
+// SetMaxQueueAge sets how long an event may wait in the queue before it is shed
+func (a *AsyncIngestion) SetMaxQueueAge(maxQueueAge time.Duration) error {
+	if maxQueueAge <= 0 {
+		return fmt.Errorf("maximum queue age must be positive, got %s", maxQueueAge)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.maxQueueAge = maxQueueAge
+	return nil
+}
+
+// Submit queues an event and returns its pending receipt. When the queue is full the event is
+// shed right away and an OverloadedError carrying its dropped receipt is returned.
+func (a *AsyncIngestion) Submit(projectID string, eventData map[string]interface{}, apiKey, userID string) (*IngestionReceipt, error) {
+	acceptedAt := a.service.Clock().Now()
+	receipt := &IngestionReceipt{
+		ID:         a.service.ids.NewID(),
+		ProjectID:  projectID,
+		Status:     ReceiptPending,
+		AcceptedAt: acceptedAt,
+	}
+	pending := receipt.copy()
+	a.receipts.Set(receipt.ID, receipt)
+
+	// The request context ends with the request, the event is processed after it
+	ctx := ContextWithProject(context.Background(), projectID)
+	token := a.service.freshness.queue(projectID, acceptedAt)
+	prepare := func() *AnalyticsEvent {
+		a.service.freshness.dequeue(token)
+		return a.prepare(ctx, receipt, eventData, apiKey, userID, acceptedAt)
+	}
+
+	queued := false
+	if a.dispatcher == nil {
+		queued = a.pool.TrySubmit(func() {
+			defer a.service.freshness.done(token)
+			if event := prepare(); event != nil {
+				a.store(receipt, event)
+			}
+		})
+	} else {
+		// The event takes its place in the user's queue right away, but is validated and billed
+		// by the pool, so the queue only waits for it to be prepared
+		prepared := make(chan *AnalyticsEvent, 1)
+		queued = a.dispatcher.TrySubmit(userID, func() {
+			defer a.service.freshness.done(token)
+			if event := <-prepared; event != nil {
+				a.store(receipt, event)
+			}
+		})
+		if queued && !a.pool.TrySubmit(func() { prepared <- prepare() }) {
+			prepared <- nil
+			dropped := a.complete(receipt, ReceiptDropped, "", "ingestion queue is full")
+			return dropped, &OverloadedError{Receipt: dropped}
+		}
+	}
+	if !queued {
+		a.service.freshness.done(token)
+		dropped := a.complete(receipt, ReceiptDropped, "", "ingestion queue is full")
+		return dropped, &OverloadedError{Receipt: dropped}
+	}
+	return pending, nil
+}
+
+// prepare validates and bills a queued event, unless it waited longer than the maximum queue age.
+// It returns nil for events that are not stored, whose receipt is completed.
+func (a *AsyncIngestion) prepare(ctx context.Context, receipt *IngestionReceipt, eventData map[string]interface{}, apiKey, userID string, acceptedAt time.Time) *AnalyticsEvent {
+	if waited := a.service.Clock().Now().Sub(acceptedAt); waited > a.MaxQueueAge() {
+		a.complete(receipt, ReceiptDropped, "", fmt.Sprintf("shed after waiting %s in the ingestion queue", waited.Round(time.Millisecond)))
+		return nil
+	}
+
+	event, err := a.service.prepareEvent(ctx, eventData, apiKey, userID, acceptedAt)
+	var overQuota *QuotaExceededError
+	if errors.As(err, &overQuota) {
+		a.complete(receipt, ReceiptDropped, "", err.Error())
+		return nil
+	}
+	var quarantined *QuarantinedError
+	if errors.As(err, &quarantined) {
+		a.complete(receipt, ReceiptQuarantined, "", err.Error())
+		return nil
+	}
+	if err != nil {
+		a.complete(receipt, ReceiptRejected, "", err.Error())
+		return nil
+	}
+
+	a.service.billEvent(ctx, event, apiKey, userID)
+	return event
+}
+
+// store stores a prepared event and completes its receipt
+func (a *AsyncIngestion) store(receipt *IngestionReceipt, event *AnalyticsEvent) {
+	stored, err := a.service.acceptEvent(event)
+	if err != nil {
+		a.complete(receipt, ReceiptRejected, "", err.Error())
+		return
+	}
+	a.complete(receipt, ReceiptStored, stored.ID, "")
+}
+
+// Receipt returns a receipt of the given project
+func (a *AsyncIngestion) Receipt(projectID, receiptID string) (*IngestionReceipt, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	value, exists := a.receipts.Get(receiptID)
+	if !exists || value.(*IngestionReceipt).ProjectID != projectID {
+		return nil, fmt.Errorf("receipt not found: %s", receiptID)
+	}
+	return value.(*IngestionReceipt).copy(), nil
+}
+
+// Stop lets the workers process the queued events and exit
+func (a *AsyncIngestion) Stop() {
+	a.pool.Stop()
+}
+
+// complete records the outcome of an event and returns its receipt. The receipt is kept for the
+// receipt TTL from now on.
+func (a *AsyncIngestion) complete(receipt *IngestionReceipt, status, eventID, reason string) *IngestionReceipt {
+	completedAt := a.service.Clock().Now()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	receipt.Status = status
+	receipt.EventID = eventID
+	receipt.Reason = reason
+	receipt.CompletedAt = &completedAt
+	// Restart the TTL, unless the receipt was evicted to make room
+	if _, exists := a.receipts.Peek(receipt.ID); exists {
+		a.receipts.Set(receipt.ID, receipt)
+	}
+	return receipt.copy()
+}
+
+// copy returns a copy of the receipt
+func (r *IngestionReceipt) copy() *IngestionReceipt {
+	copied := *r
+	if r.CompletedAt != nil {
+		completedAt := *r.CompletedAt
+		copied.CompletedAt = &completedAt
+	}
+	return &copied
+}
@@ -0,0 +1,94 @@
+package app
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AuditEntry represents a single administrative action
+type AuditEntry struct {
+	ID        string                 `json:"id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Actor     string                 `json:"actor"`
+	Action    string                 `json:"action"`
+	Resource  string                 `json:"resource"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// AuditLog is an append-only, in-memory log of administrative actions
+type AuditLog struct {
+	entries    []AuditEntry
+	maxEntries int
+	exporter   *SIEMExporter // Receives every entry, if set
+	mutex      sync.RWMutex
+}
+
+// NewAuditLog creates a new audit log
+func NewAuditLog() *AuditLog {
+	return &AuditLog{
+		maxEntries: getEnvInt("AUDIT_LOG_SIZE", 10000),
+	}
+}
+
+// SetExporter streams every recorded entry to a SIEM
+func (l *AuditLog) SetExporter(exporter *SIEMExporter) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.exporter = exporter
+}
+
+// Record appends an entry to the audit log
+func (l *AuditLog) Record(actor, action, resource string, details map[string]interface{}) AuditEntry {
+	entry := AuditEntry{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now(),
+		Actor:     actor,
+		Action:    action,
+		Resource:  resource,
+		Details:   details,
+	}
+
+	l.mutex.Lock()
+	l.entries = append(l.entries, entry)
+	if l.maxEntries > 0 && len(l.entries) > l.maxEntries {
+		l.entries = l.entries[len(l.entries)-l.maxEntries:]
+	}
+	exporter := l.exporter
+	l.mutex.Unlock()
+
+	exporter.Export(SecurityEvent{
+		Timestamp: entry.Timestamp,
+		Category:  SecurityAdmin,
+		Action:    action,
+		Outcome:   OutcomeSuccess,
+		Severity:  5,
+		Actor:     actor,
+		Resource:  resource,
+		Details:   details,
+	})
+
+	log.Printf("Audit: %s performed %s on %s", actor, action, resource)
+
+	return entry
+}
+
+// Entries returns audit entries newest first, optionally filtered by action
+func (l *AuditLog) Entries(action string, limit int) []AuditEntry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	results := make([]AuditEntry, 0)
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if action != "" && l.entries[i].Action != action {
+			continue
+		}
+		results = append(results, l.entries[i])
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+	}
+	return results
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getBenchmarks returns the anonymized benchmarks with the project's own values compared to them.
+// Only projects contributing to the benchmarks can read them.
+func (s *App) getBenchmarks(c *fiber.Ctx) error {
+	projectID := projectIDFromRequest(c)
+	if !s.benchmarks.Settings(projectID).OptIn {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{
+			"error": "benchmarks are only available to projects opting in; opt in with PUT /api/v1/projects/" + projectID + "/benchmarking",
+		})
+	}
+
+	benchmarks := s.benchmarks.Benchmarks(c.Context())
+	project, err := s.benchmarks.Project(c.Context(), projectID, benchmarks)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"benchmarks": benchmarks,
+		"project":    project,
+	})
+}
+
+// getProjectBenchmarking returns whether a project opts in to the benchmarks with its version as the ETag
+func (s *App) getProjectBenchmarking(c *fiber.Ctx) error {
+	settings := s.benchmarks.Settings(c.Params("id"))
+
+	c.Set(fiber.HeaderETag, ETag(settings.Version))
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"benchmarking": settings,
+	})
+}
+
+// updateProjectBenchmarking opts a project in or out of the benchmarks. Replacing existing
+// settings requires If-Match with the version being updated.
+func (s *App) updateProjectBenchmarking(c *fiber.Ctx) error {
+	var request struct {
+		OptIn    bool   `json:"opt_in"`
+		Industry string `json:"industry"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first settings of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if s.benchmarks.Settings(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := s.benchmarks.UpdateSettings(projectID, request.OptIn, request.Industry, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"benchmarking": updated,
+	})
+}
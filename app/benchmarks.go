@@ -0,0 +1,343 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchmarkIndustryPattern is the format of industry tags
+var benchmarkIndustryPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+// BenchmarkSettings is whether a project contributes to the cross-project benchmarks, and the
+// industry it is compared within
+type BenchmarkSettings struct {
+	OptIn    bool   `json:"opt_in"`
+	Industry string `json:"industry,omitempty"`
+	Version  int64  `json:"version"` // Incremented on every update, exposed as the ETag
+}
+
+// BenchmarkGroup is the aggregate of the projects of an industry, or of every industry. Groups
+// with fewer projects than the minimum are suppressed and carry no values.
+type BenchmarkGroup struct {
+	Industry   string `json:"industry,omitempty"` // Empty for every industry
+	Suppressed bool   `json:"suppressed,omitempty"`
+	// Median over the projects of each project's median funnel conversion rate, in percent
+	MedianConversionRate *float64 `json:"median_conversion_rate,omitempty"`
+	ConversionProjects   int      `json:"conversion_projects,omitempty"` // Projects with a funnel reached by users
+	// Average over the projects of each project's bounce rate, in percent
+	AverageBounceRate *float64 `json:"average_bounce_rate,omitempty"`
+	BounceProjects    int      `json:"bounce_projects,omitempty"` // Projects with sessions
+}
+
+// Benchmarks are the aggregate norms of the opted-in projects over a window
+type Benchmarks struct {
+	TimeRange   TimeRange        `json:"time_range"`
+	MinProjects int              `json:"min_projects"` // Projects a group needs to be published
+	Overall     BenchmarkGroup   `json:"overall"`
+	Industries  []BenchmarkGroup `json:"industries"` // By industry tag
+	ComputedAt  time.Time        `json:"computed_at"`
+}
+
+// ProjectBenchmark is a project's own values, to compare with the benchmarks of its industry
+type ProjectBenchmark struct {
+	ProjectID      string              `json:"project_id"`
+	Industry       string              `json:"industry"`
+	ConversionRate *float64            `json:"conversion_rate,omitempty"` // Median of its funnels
+	BounceRate     *float64            `json:"bounce_rate,omitempty"`
+	Funnels        []FunnelBenchmark   `json:"funnels"`
+	Sessions       int                 `json:"sessions"`
+	Comparison     BenchmarkComparison `json:"comparison"`
+}
+
+// BenchmarkComparison is how far a project's values are from the benchmarks, in percentage points
+type BenchmarkComparison struct {
+	ComparedWith        string   `json:"compared_with"` // Its industry, or overall while its industry is suppressed
+	ConversionRateDelta *float64 `json:"conversion_rate_delta,omitempty"`
+	BounceRateDelta     *float64 `json:"bounce_rate_delta,omitempty"`
+}
+
+// FunnelBenchmark is the conversion rate of one of a project's funnels
+type FunnelBenchmark struct {
+	FunnelID       string  `json:"funnel_id"`
+	Name           string  `json:"name"`
+	ConversionRate float64 `json:"conversion_rate"`
+	TotalUsers     int64   `json:"total_users"`
+}
+
+// BenchmarkService computes anonymized benchmarks across the projects opting in: the median
+// funnel conversion rate and the average bounce rate per industry tag. Benchmarks only publish
+// aggregates of at least a minimum number of projects and never name the projects they cover.
+type BenchmarkService struct {
+	funnels     *FunnelService
+	sessions    *SessionService
+	clock       Clock
+	settings    map[string]*BenchmarkSettings
+	window      time.Duration
+	refresh     time.Duration
+	minProjects int
+	cached      *Benchmarks
+	mutex       sync.RWMutex
+	compute     sync.Mutex // Serializes computations, so concurrent requests share one
+}
+
+// NewBenchmarkService creates a benchmark service comparing the last BENCHMARK_WINDOW (default
+// 720h) of the opted-in projects, publishing groups of at least BENCHMARK_MIN_PROJECTS (default 5)
+// projects and recomputing them at most every BENCHMARK_REFRESH_INTERVAL (default 1h)
+func NewBenchmarkService(funnels *FunnelService, sessions *SessionService) *BenchmarkService {
+	service := &BenchmarkService{
+		funnels:     funnels,
+		sessions:    sessions,
+		clock:       SystemClock(),
+		settings:    make(map[string]*BenchmarkSettings),
+		window:      getEnvDuration("BENCHMARK_WINDOW", 30*24*time.Hour),
+		refresh:     getEnvDuration("BENCHMARK_REFRESH_INTERVAL", time.Hour),
+		minProjects: getEnvInt("BENCHMARK_MIN_PROJECTS", 5),
+	}
+	if service.window <= 0 {
+		service.window = 30 * 24 * time.Hour
+	}
+	if service.minProjects < 2 {
+		service.minProjects = 2 // A group of one project would expose its values
+	}
+	return service
+}
+
+// SetClock replaces the clock benchmark windows end at
+func (s *BenchmarkService) SetClock(clock Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clock = clock
+}
+
+// Settings returns the benchmark settings of a project
+func (s *BenchmarkService) Settings(projectID string) BenchmarkSettings {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if settings, exists := s.settings[projectID]; exists {
+		return *settings
+	}
+	return BenchmarkSettings{}
+}
+
+// UpdateSettings opts a project in or out of the benchmarks. Opting in requires an industry tag
+// of lowercase letters, digits, dashes and underscores. The update is rejected with a
+// VersionConflictError unless expectedVersion is the current version (0 for a project without
+// settings). Changes are reflected once the benchmarks are next recomputed.
+func (s *BenchmarkService) UpdateSettings(projectID string, optIn bool, industry string, expectedVersion int64) (BenchmarkSettings, error) {
+	industry = strings.ToLower(strings.TrimSpace(industry))
+	if optIn && industry == "" {
+		return BenchmarkSettings{}, fmt.Errorf("industry is required to opt in")
+	}
+	if industry != "" && !benchmarkIndustryPattern.MatchString(industry) {
+		return BenchmarkSettings{}, fmt.Errorf("industry must be at most 50 lowercase letters, digits, dashes or underscores")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var current int64
+	if existing, exists := s.settings[projectID]; exists {
+		current = existing.Version
+	}
+	if err := checkVersion("benchmarking", projectID, current, expectedVersion); err != nil {
+		return BenchmarkSettings{}, err
+	}
+
+	updated := &BenchmarkSettings{OptIn: optIn, Industry: industry, Version: current + 1}
+	s.settings[projectID] = updated
+	return *updated, nil
+}
+
+// Benchmarks returns the benchmarks, recomputed when older than the refresh interval
+func (s *BenchmarkService) Benchmarks(ctx context.Context) *Benchmarks {
+	s.compute.Lock()
+	defer s.compute.Unlock()
+
+	s.mutex.RLock()
+	now := s.clock.Now()
+	cached := s.cached
+	s.mutex.RUnlock()
+	if cached != nil && now.Sub(cached.ComputedAt) < s.refresh {
+		return cached
+	}
+
+	benchmarks := s.computeBenchmarks(ctx, now)
+	s.mutex.Lock()
+	s.cached = benchmarks
+	s.mutex.Unlock()
+	return benchmarks
+}
+
+// Project computes a project's own values over the benchmark window, compared with the
+// benchmarks of its industry
+func (s *BenchmarkService) Project(ctx context.Context, projectID string, benchmarks *Benchmarks) (*ProjectBenchmark, error) {
+	settings := s.Settings(projectID)
+	project, err := s.projectValues(ctx, projectID, benchmarks.TimeRange)
+	if err != nil {
+		return nil, err
+	}
+	project.Industry = settings.Industry
+
+	group := benchmarks.Overall
+	project.Comparison.ComparedWith = "overall"
+	for _, industry := range benchmarks.Industries {
+		if industry.Industry == settings.Industry && !industry.Suppressed {
+			group = industry
+			project.Comparison.ComparedWith = industry.Industry
+		}
+	}
+	if project.ConversionRate != nil && group.MedianConversionRate != nil {
+		delta := roundBenchmark(*project.ConversionRate - *group.MedianConversionRate)
+		project.Comparison.ConversionRateDelta = &delta
+	}
+	if project.BounceRate != nil && group.AverageBounceRate != nil {
+		delta := roundBenchmark(*project.BounceRate - *group.AverageBounceRate)
+		project.Comparison.BounceRateDelta = &delta
+	}
+	return project, nil
+}
+
+// computeBenchmarks aggregates the values of every opted-in project over the window ending now
+func (s *BenchmarkService) computeBenchmarks(ctx context.Context, now time.Time) *Benchmarks {
+	s.mutex.RLock()
+	industries := make(map[string][]string) // Opted-in projects by industry
+	for projectID, settings := range s.settings {
+		if settings.OptIn {
+			industries[settings.Industry] = append(industries[settings.Industry], projectID)
+		}
+	}
+	s.mutex.RUnlock()
+
+	benchmarks := &Benchmarks{
+		TimeRange:   TimeRange{Start: now.Add(-s.window), End: now},
+		MinProjects: s.minProjects,
+		Industries:  make([]BenchmarkGroup, 0, len(industries)),
+		ComputedAt:  now,
+	}
+	// Values of suppressed industries only count overall when together they are enough to be
+	// published, so the overall values cannot be differenced with the industries' values
+	var allConversions, allBounces, suppressedConversions, suppressedBounces []float64
+	for industry, projectIDs := range industries {
+		var conversions, bounces []float64
+		for _, projectID := range projectIDs {
+			project, err := s.projectValues(ctx, projectID, benchmarks.TimeRange)
+			if err != nil {
+				continue
+			}
+			if project.ConversionRate != nil {
+				conversions = append(conversions, *project.ConversionRate)
+			}
+			if project.BounceRate != nil {
+				bounces = append(bounces, *project.BounceRate)
+			}
+		}
+		group := s.group(industry, conversions, bounces)
+		if group.MedianConversionRate != nil {
+			allConversions = append(allConversions, conversions...)
+		} else {
+			suppressedConversions = append(suppressedConversions, conversions...)
+		}
+		if group.AverageBounceRate != nil {
+			allBounces = append(allBounces, bounces...)
+		} else {
+			suppressedBounces = append(suppressedBounces, bounces...)
+		}
+		benchmarks.Industries = append(benchmarks.Industries, group)
+	}
+	if len(suppressedConversions) >= s.minProjects {
+		allConversions = append(allConversions, suppressedConversions...)
+	}
+	if len(suppressedBounces) >= s.minProjects {
+		allBounces = append(allBounces, suppressedBounces...)
+	}
+	benchmarks.Overall = s.group("", allConversions, allBounces)
+
+	sort.Slice(benchmarks.Industries, func(i, j int) bool {
+		return benchmarks.Industries[i].Industry < benchmarks.Industries[j].Industry
+	})
+	return benchmarks
+}
+
+// group aggregates the values of the projects of a group, publishing each value only when
+// enough projects contribute to it
+func (s *BenchmarkService) group(industry string, conversions, bounces []float64) BenchmarkGroup {
+	group := BenchmarkGroup{Industry: industry}
+	if len(conversions) >= s.minProjects {
+		value := roundBenchmark(median(conversions))
+		group.MedianConversionRate = &value
+		group.ConversionProjects = len(conversions)
+	}
+	if len(bounces) >= s.minProjects {
+		var total float64
+		for _, bounce := range bounces {
+			total += bounce
+		}
+		value := roundBenchmark(total / float64(len(bounces)))
+		group.AverageBounceRate = &value
+		group.BounceProjects = len(bounces)
+	}
+	group.Suppressed = group.MedianConversionRate == nil && group.AverageBounceRate == nil
+	return group
+}
+
+// projectValues computes the funnel conversion rates and the bounce rate of a project over a
+// time range. Only funnels reached by users count in its conversion rate.
+func (s *BenchmarkService) projectValues(ctx context.Context, projectID string, timeRange TimeRange) (*ProjectBenchmark, error) {
+	ctx = ContextWithProject(ctx, projectID)
+	project := &ProjectBenchmark{ProjectID: projectID, Funnels: make([]FunnelBenchmark, 0)}
+
+	var conversions []float64
+	for _, funnel := range s.funnels.ListFunnels(ctx) {
+		result, err := s.funnels.ComputeFunnel(ctx, FunnelQuery{FunnelID: funnel.ID, Start: timeRange.Start, End: timeRange.End})
+		if err != nil {
+			return nil, err
+		}
+		project.Funnels = append(project.Funnels, FunnelBenchmark{
+			FunnelID:       funnel.ID,
+			Name:           funnel.Name,
+			ConversionRate: roundBenchmark(result.ConversionRate),
+			TotalUsers:     result.TotalUsers,
+		})
+		if result.TotalUsers > 0 {
+			conversions = append(conversions, result.ConversionRate)
+		}
+	}
+	if len(conversions) > 0 {
+		value := roundBenchmark(median(conversions))
+		project.ConversionRate = &value
+	}
+
+	sessions, err := s.sessions.Sessions(ctx, SessionQuery{Start: timeRange.Start, End: timeRange.End, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	project.Sessions = sessions.Stats.Sessions
+	if sessions.Stats.Sessions > 0 {
+		value := roundBenchmark(sessions.Stats.BounceRate)
+		project.BounceRate = &value
+	}
+	return project, nil
+}
+
+// median returns the median of values, averaging the middle two of an even number
+func median(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// roundBenchmark rounds a rate in percent to two decimals
+func roundBenchmark(value float64) float64 {
+	return math.Round(value*100) / 100
+}
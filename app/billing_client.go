@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 )
@@ -13,25 +14,28 @@ import (
 type BillingClient struct {
 	baseURL    string
 	httpClient *http.Client
+	faults     *FaultInjector // Latency and errors injected into requests for testing, if any
 }
 
 // UsageRecord represents a usage record sent to the billing service
 type UsageRecord struct {
-	UserID    string                 `json:"user_id"`
-	Service   string                 `json:"service"`
-	Metric    string                 `json:"metric"`
-	Amount    int64                  `json:"amount"`
-	Timestamp time.Time              `json:"timestamp"`
-	Details   map[string]interface{} `json:"details,omitempty"`
+	CorrelationID string                 `json:"correlation_id,omitempty"` // Shared with the billing event of the same charge
+	UserID        string                 `json:"user_id"`
+	Service       string                 `json:"service"`
+	Metric        string                 `json:"metric"`
+	Amount        int64                  `json:"amount"`
+	Timestamp     time.Time              `json:"timestamp"`
+	Details       map[string]interface{} `json:"details,omitempty"`
 }
 
 // BillingServiceEvent represents a billing event sent to the billing service
 type BillingServiceEvent struct {
-	UserID    string                 `json:"user_id"`
-	Service   string                 `json:"service"`
-	EventType string                 `json:"event_type"`
-	Timestamp time.Time              `json:"timestamp"`
-	Details   map[string]interface{} `json:"details,omitempty"`
+	CorrelationID string                 `json:"correlation_id,omitempty"` // Shared with the usage record of the same charge
+	UserID        string                 `json:"user_id"`
+	Service       string                 `json:"service"`
+	EventType     string                 `json:"event_type"`
+	Timestamp     time.Time              `json:"timestamp"`
+	Details       map[string]interface{} `json:"details,omitempty"`
 }
 
 // BillingResponse represents the response from the billing service
@@ -53,26 +57,38 @@ func NewBillingClient(baseURL string) *BillingClient {
 	}
 }
 
+// SetFaultInjector sets the injector adding latency and errors to the client's requests
+func (c *BillingClient) SetFaultInjector(faults *FaultInjector) {
+	c.faults = faults
+}
+
 // TrackUsage sends a usage record to the billing service
 func (c *BillingClient) TrackUsage(ctx context.Context, record *UsageRecord) error {
+	if err := c.faults.Inject(FaultBilling, "usage"); err != nil {
+		return fmt.Errorf("failed to send usage record: %w", err)
+	}
+
 	jsonData, err := json.Marshal(record)
 	if err != nil {
 		return fmt.Errorf("failed to marshal usage record: %w", err)
 	}
 
 	url := fmt.Sprintf("%s/usage", c.baseURL)
+	ctx, cancel := outboundContext(ctx)
+	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	setIdempotencyKey(req, record.CorrelationID)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send usage record: %w", err)
 	}
-	defer resp.Body.Close()
+	defer closeBody(resp)
 
 	if resp.StatusCode != http.StatusCreated {
 		return fmt.Errorf("billing service returned status %d", resp.StatusCode)
@@ -83,24 +99,31 @@ func (c *BillingClient) TrackUsage(ctx context.Context, record *UsageRecord) err
 
 // TrackEvent sends a billing event to the billing service
 func (c *BillingClient) TrackEvent(ctx context.Context, event *BillingServiceEvent) error {
+	if err := c.faults.Inject(FaultBilling, "event"); err != nil {
+		return fmt.Errorf("failed to send billing event: %w", err)
+	}
+
 	jsonData, err := json.Marshal(event)
 	if err != nil {
 		return fmt.Errorf("failed to marshal billing event: %w", err)
 	}
 
 	url := fmt.Sprintf("%s/event", c.baseURL)
+	ctx, cancel := outboundContext(ctx)
+	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	setIdempotencyKey(req, event.CorrelationID)
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send billing event: %w", err)
 	}
-	defer resp.Body.Close()
+	defer closeBody(resp)
 
 	if resp.StatusCode != http.StatusCreated {
 		return fmt.Errorf("billing service returned status %d", resp.StatusCode)
@@ -109,15 +132,49 @@ func (c *BillingClient) TrackEvent(ctx context.Context, event *BillingServiceEve
 	return nil
 }
 
+// outboundContext returns a context with the deadline of ctx but none of its values or
+// cancellation. Handlers pass contexts derived from fasthttp's request context, which is reused
+// once the handler returns, while the HTTP transport may still be dialing with the context.
+func outboundContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		return context.WithCancel(context.Background())
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// closeBody reads the rest of a response body before closing it, so the connection is reused
+func closeBody(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// setIdempotencyKey lets the billing service drop retried records by their correlation ID
+func setIdempotencyKey(req *http.Request, correlationID string) {
+	if correlationID != "" {
+		req.Header.Set("Idempotency-Key", correlationID)
+	}
+}
+
 // TrackAPICall tracks a single API call for billing purposes
 func (c *BillingClient) TrackAPICall(ctx context.Context, userID, endpoint string, metadata map[string]interface{}) error {
+	return c.TrackCorrelatedAPICall(ctx, "", userID, endpoint, metadata)
+}
+
+// TrackCorrelatedAPICall tracks a single API call for billing purposes. The usage record and
+// billing event carry the correlation ID, so the billing service can reconcile them with the
+// analytics record of the call and bill retries once.
+func (c *BillingClient) TrackCorrelatedAPICall(ctx context.Context, correlationID, userID, endpoint string, metadata map[string]interface{}) error {
 	// Create usage record for the API call
 	usageRecord := &UsageRecord{
-		UserID:    userID,
-		Service:   "analytics",
-		Metric:    "api_call",
-		Amount:    1,
-		Timestamp: time.Now(),
+		CorrelationID: correlationID,
+		UserID:        userID,
+		Service:       "analytics",
+		Metric:        "api_call",
+		Amount:        1,
+		Timestamp:     time.Now(),
 		Details: map[string]interface{}{
 			"endpoint": endpoint,
 			"metadata": metadata,
@@ -131,10 +188,11 @@ func (c *BillingClient) TrackAPICall(ctx context.Context, userID, endpoint strin
 
 	// Create billing event for the API call
 	billingEvent := &BillingServiceEvent{
-		UserID:    userID,
-		Service:   "analytics",
-		EventType: "api_call",
-		Timestamp: time.Now(),
+		CorrelationID: correlationID,
+		UserID:        userID,
+		Service:       "analytics",
+		EventType:     "api_call",
+		Timestamp:     time.Now(),
 		Details: map[string]interface{}{
 			"endpoint": endpoint,
 			"metadata": metadata,
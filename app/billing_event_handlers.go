@@ -0,0 +1,78 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxBillingEventsLimit caps the billing events returned at once
+const maxBillingEventsLimit = 1000
+
+// getBillingEvents returns the stored billing events of API calls with the state of their
+// delivery, oldest first, to audit what was charged and what the billing service received
+func (s *App) getBillingEvents(c *fiber.Ctx) error {
+	filter := BillingEventFilter{
+		UserID: c.Query("user_id"),
+		Limit:  c.QueryInt("limit", 100),
+	}
+	if filter.Limit <= 0 || filter.Limit > maxBillingEventsLimit {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "limit must be between 1 and 1000",
+		})
+	}
+	if statuses := c.Query("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			if !validBillingEventStatus(status) {
+				return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+					"error": "status must be one of: " + strings.Join(billingEventStatuses, ", "),
+				})
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	var err error
+	if start := c.Query("start_date"); start != "" {
+		if filter.Start, err = parseQueryDate(start); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid start_date: use YYYY-MM-DD or RFC3339",
+			})
+		}
+	}
+	if end := c.Query("end_date"); end != "" {
+		if filter.End, err = parseQueryDate(end); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid end_date: use YYYY-MM-DD or RFC3339",
+			})
+		}
+		// An end date is included, so its range ends at the start of the next day
+		if _, err := time.Parse("2006-01-02", end); err == nil {
+			filter.End = filter.End.AddDate(0, 0, 1)
+		}
+	}
+
+	billing := s.analyticsService.BillingEvents()
+	events, err := billing.Store().Query(c.Context(), filter)
+	if err != nil {
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	summary, err := billing.Summary(c.Context(), filter)
+	if err != nil {
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":              "success",
+		"events":              events,
+		"count":               len(events),
+		"summary":             summary,
+		"last_reconciliation": s.billingReconciler.LastRun(),
+	})
+}
@@ -0,0 +1,392 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Delivery states of billing events
+const (
+	BillingEventPending   = "pending"   // Not delivered to the billing service yet
+	BillingEventDelivered = "delivered" // Accepted by the billing service
+	BillingEventFailed    = "failed"    // Rejected or unreachable, retried by the reconciliation job
+	BillingEventAbandoned = "abandoned" // Not retried anymore after too many failed attempts
+)
+
+// billingEventStatuses are the delivery states, in the order they are summarized
+var billingEventStatuses = []string{BillingEventPending, BillingEventDelivered, BillingEventFailed, BillingEventAbandoned}
+
+// validBillingEventStatus reports whether status is a delivery state
+func validBillingEventStatus(status string) bool {
+	for _, valid := range billingEventStatuses {
+		if status == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// StoredBillingEvent is a billing event with the state of its delivery to the billing service.
+// The endpoint and metadata of the call are kept so failed deliveries can be sent again.
+type StoredBillingEvent struct {
+	BillingEvent
+	Endpoint      string                 `json:"endpoint"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"` // Without the API key, replaced by its ID, or the IP address
+	Status        string                 `json:"status"`
+	Attempts      int                    `json:"attempts"`
+	LastError     string                 `json:"last_error,omitempty"`
+	LastAttemptAt *time.Time             `json:"last_attempt_at,omitempty"`
+	NextAttemptAt *time.Time             `json:"next_attempt_at,omitempty"` // When a failed delivery is retried
+	DeliveredAt   *time.Time             `json:"delivered_at,omitempty"`
+	// Metadata as sent to the billing service, only held in memory: deliveries of events loaded
+	// from a log send the stored Metadata
+	sentMetadata map[string]interface{}
+}
+
+// SetMetadata sets the metadata sent to the billing service, and stores it without the caller's
+// API key, replaced by its ID, and IP address
+func (e *StoredBillingEvent) SetMetadata(metadata map[string]interface{}) {
+	e.sentMetadata = metadata
+	e.Metadata = make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		switch k {
+		case "ip_address":
+		case "api_key":
+			if apiKey, ok := v.(string); ok && apiKey != "" {
+				e.Metadata["api_key_id"] = APIKeyID(apiKey)
+			}
+		default:
+			e.Metadata[k] = v
+		}
+	}
+}
+
+// deliveredMetadata returns the metadata sent to the billing service
+func (e *StoredBillingEvent) deliveredMetadata() map[string]interface{} {
+	if e.sentMetadata != nil {
+		return e.sentMetadata
+	}
+	return e.Metadata
+}
+
+// copy returns a copy of the event, so stores and their callers do not share it
+func (e *StoredBillingEvent) copy() *StoredBillingEvent {
+	copied := *e
+	return &copied
+}
+
+// BillingEventFilter selects stored billing events. Empty fields match every event.
+type BillingEventFilter struct {
+	UserID   string
+	Statuses []string  // Every status when nil
+	Start    time.Time // Timestamps from Start, unbounded when zero
+	End      time.Time // up to End, exclusive, unbounded when zero
+	Limit    int       // Maximum number of events, 0 for all
+}
+
+// matches reports whether a billing event is selected by the filter
+func (f BillingEventFilter) matches(event *StoredBillingEvent) bool {
+	if f.UserID != "" && event.UserID != f.UserID {
+		return false
+	}
+	if f.Statuses != nil {
+		found := false
+		for _, status := range f.Statuses {
+			found = found || event.Status == status
+		}
+		if !found {
+			return false
+		}
+	}
+	return (f.Start.IsZero() || !event.Timestamp.Before(f.Start)) && (f.End.IsZero() || event.Timestamp.Before(f.End))
+}
+
+// BillingEventStore keeps the billing events generated for API calls with their delivery state,
+// so charges the billing service did not receive are not lost
+type BillingEventStore interface {
+	// Save stores an event, replacing the one stored under the same ID
+	Save(ctx context.Context, event *StoredBillingEvent) error
+	// Query returns the events selected by the filter, oldest first
+	Query(ctx context.Context, filter BillingEventFilter) ([]*StoredBillingEvent, error)
+	// Delete deletes the events with the given IDs
+	Delete(ctx context.Context, ids []string) error
+	// Close releases the store's resources
+	Close() error
+}
+
+// NewBillingEventStoreFromEnv opens the billing event log at BILLING_EVENT_STORE_PATH. Without
+// one, billing events are only kept in memory, at most BILLING_EVENT_STORE_MAX_EVENTS of them
+// (default 100000).
+func NewBillingEventStoreFromEnv() (BillingEventStore, error) {
+	path := os.Getenv("BILLING_EVENT_STORE_PATH")
+	if path == "" {
+		return NewBoundedMemoryBillingEventStore(getEnvInt("BILLING_EVENT_STORE_MAX_EVENTS", 100000)), nil
+	}
+	return OpenFileBillingEventStore(path)
+}
+
+// MemoryBillingEventStore is a BillingEventStore holding events in memory, for tests and
+// development
+type MemoryBillingEventStore struct {
+	events    map[string]*StoredBillingEvent
+	maxEvents int // Events held at most, unbounded when 0
+	mutex     sync.RWMutex
+}
+
+// NewMemoryBillingEventStore creates an empty, unbounded in-memory billing event store
+func NewMemoryBillingEventStore() *MemoryBillingEventStore {
+	return &MemoryBillingEventStore{events: make(map[string]*StoredBillingEvent)}
+}
+
+// NewBoundedMemoryBillingEventStore creates an empty in-memory billing event store holding at
+// most maxEvents events. When full, the oldest delivered events are evicted, then the oldest
+// abandoned ones; events not delivered yet are never evicted, and new events are refused while
+// the store only holds those.
+func NewBoundedMemoryBillingEventStore(maxEvents int) *MemoryBillingEventStore {
+	store := NewMemoryBillingEventStore()
+	store.maxEvents = max(maxEvents, 1)
+	return store
+}
+
+// Save stores a copy of the event
+func (s *MemoryBillingEventStore) Save(ctx context.Context, event *StoredBillingEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.events[event.ID]; !exists && s.maxEvents > 0 && len(s.events) >= s.maxEvents && s.evict() == 0 {
+		return fmt.Errorf("billing event store is full with %d undelivered events", len(s.events))
+	}
+	s.events[event.ID] = event.copy()
+	return nil
+}
+
+// evict deletes the oldest delivered events, then the oldest abandoned ones, to free a tenth of
+// the store, and returns how many were deleted
+func (s *MemoryBillingEventStore) evict() int {
+	settled := make([]*StoredBillingEvent, 0)
+	for _, event := range s.events {
+		if event.Status == BillingEventDelivered || event.Status == BillingEventAbandoned {
+			settled = append(settled, event)
+		}
+	}
+	sort.Slice(settled, func(i, j int) bool {
+		if settled[i].Status != settled[j].Status {
+			return settled[i].Status == BillingEventDelivered
+		}
+		return settled[i].Timestamp.Before(settled[j].Timestamp)
+	})
+
+	evicted := min(len(settled), max(s.maxEvents/10, 1))
+	for _, event := range settled[:evicted] {
+		delete(s.events, event.ID)
+	}
+	if evicted > 0 {
+		log.Printf("Warning: Billing event store is full, evicted %d settled events", evicted)
+	}
+	return evicted
+}
+
+// Query returns copies of the events selected by the filter, oldest first
+func (s *MemoryBillingEventStore) Query(ctx context.Context, filter BillingEventFilter) ([]*StoredBillingEvent, error) {
+	s.mutex.RLock()
+	events := make([]*StoredBillingEvent, 0)
+	for _, event := range s.events {
+		if filter.matches(event) {
+			events = append(events, event.copy())
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Timestamp.Before(events[j].Timestamp)
+		}
+		return events[i].ID < events[j].ID
+	})
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// Delete deletes the events with the given IDs
+func (s *MemoryBillingEventStore) Delete(ctx context.Context, ids []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, id := range ids {
+		delete(s.events, id)
+	}
+	return nil
+}
+
+// Close does nothing, the events stay in memory
+func (s *MemoryBillingEventStore) Close() error {
+	return nil
+}
+
+// Len returns the number of stored events
+func (s *MemoryBillingEventStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.events)
+}
+
+// billingEventLogRecord is a line of the billing event log: an event as saved, or the ID of a
+// deleted one
+type billingEventLogRecord struct {
+	Event   *StoredBillingEvent `json:"event,omitempty"`
+	Deleted string              `json:"deleted,omitempty"`
+}
+
+// FileBillingEventStore is a BillingEventStore appending every change to a log file, synced
+// before Save returns, so billing events outlive restarts. The events are held in memory and the
+// log is compacted to their latest state when opened and after deletions.
+type FileBillingEventStore struct {
+	*MemoryBillingEventStore
+	path    string
+	file    *os.File
+	records int // Lines in the log
+	mutex   sync.Mutex
+}
+
+// OpenFileBillingEventStore opens the billing event log at path, creating it if needed, and
+// loads the events it holds
+func OpenFileBillingEventStore(path string) (*FileBillingEventStore, error) {
+	store := &FileBillingEventStore{MemoryBillingEventStore: NewMemoryBillingEventStore(), path: path}
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open billing event log %s: %w", path, err)
+	}
+	if file != nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record billingEventLogRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue // A line cut short by a crash
+			}
+			if record.Event != nil {
+				store.events[record.Event.ID] = record.Event
+			} else if record.Deleted != "" {
+				delete(store.events, record.Deleted)
+			}
+		}
+		err := scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read billing event log %s: %w", path, err)
+		}
+	}
+
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Save stores the event and appends it to the log
+func (s *FileBillingEventStore) Save(ctx context.Context, event *StoredBillingEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.append(billingEventLogRecord{Event: event}); err != nil {
+		return err
+	}
+	return s.MemoryBillingEventStore.Save(ctx, event)
+}
+
+// Delete deletes the events, then compacts the log once most of its lines are outdated
+func (s *FileBillingEventStore) Delete(ctx context.Context, ids []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.MemoryBillingEventStore.Delete(ctx, ids)
+	if s.records > 2*s.Len() {
+		return s.compact()
+	}
+	for _, id := range ids {
+		if err := s.append(billingEventLogRecord{Deleted: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the log
+func (s *FileBillingEventStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// append writes a record to the log and syncs it
+func (s *FileBillingEventStore) append(record billingEventLogRecord) error {
+	if s.file == nil {
+		return fmt.Errorf("billing event log %s is closed", s.path)
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode billing event: %w", err)
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write billing event log %s: %w", s.path, err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync billing event log %s: %w", s.path, err)
+	}
+	s.records++
+	return nil
+}
+
+// compact rewrites the log with the latest state of the held events, replacing the old log
+// atomically
+func (s *FileBillingEventStore) compact() error {
+	temp, err := os.CreateTemp(filepath.Dir(s.path), ".billing-events-*")
+	if err != nil {
+		return fmt.Errorf("failed to compact billing event log %s: %w", s.path, err)
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	for _, event := range s.events {
+		line, err := json.Marshal(billingEventLogRecord{Event: event})
+		if err != nil {
+			temp.Close()
+			return fmt.Errorf("failed to encode billing event: %w", err)
+		}
+		writer.Write(append(line, '\n'))
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compact billing event log %s: %w", s.path, err)
+	}
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to compact billing event log %s: %w", s.path, err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open billing event log %s: %w", s.path, err)
+	}
+	s.records = len(s.events)
+	return nil
+}
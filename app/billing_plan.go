@@ -0,0 +1,175 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plan describes the limits of a billing plan
+type Plan struct {
+	Name             string `json:"name"`
+	MaxHeatmapWidth  int    `json:"max_heatmap_width"`
+	MaxHeatmapHeight int    `json:"max_heatmap_height"`
+	RateLimit        int    `json:"rate_limit"`           // Requests per rate limit window and endpoint
+	UpgradeTo        string `json:"upgrade_to,omitempty"` // Next plan with higher limits
+}
+
+// Plans available to users
+var defaultPlans = map[string]Plan{
+	"free":       {Name: "free", MaxHeatmapWidth: 1920, MaxHeatmapHeight: 1080, RateLimit: 100, UpgradeTo: "pro"},
+	"pro":        {Name: "pro", MaxHeatmapWidth: 3840, MaxHeatmapHeight: 2160, RateLimit: 1000, UpgradeTo: "enterprise"},
+	"enterprise": {Name: "enterprise", MaxHeatmapWidth: 7680, MaxHeatmapHeight: 4320, RateLimit: 10000},
+}
+
+// PlanLimitError is returned when a request exceeds the limits of the user's plan
+type PlanLimitError struct {
+	Plan      string `json:"plan"`
+	Limit     string `json:"limit"`
+	Requested string `json:"requested"`
+	Allowed   string `json:"allowed"`
+	UpgradeTo string `json:"upgrade_to,omitempty"`
+}
+
+// Error describes the exceeded limit and how to lift it
+func (e *PlanLimitError) Error() string {
+	message := fmt.Sprintf("%s %s exceeds the %s plan's maximum of %s", e.Limit, e.Requested, e.Plan, e.Allowed)
+	if e.UpgradeTo != "" {
+		return message + fmt.Sprintf("; upgrade to the %s plan to lift this limit", e.UpgradeTo)
+	}
+	return message
+}
+
+// PlanService assigns billing plans to users
+type PlanService struct {
+	plans        map[string]Plan
+	assignments  map[string]string    // Plan name by user ID
+	subscribedAt map[string]time.Time // Time of the billing event last changing a user's subscription
+	defaultPlan  string
+	mutex        sync.RWMutex
+}
+
+// NewPlanService creates a plan service; users without an assignment get DEFAULT_PLAN (default:
+// free). The rate limit of each plan is configured with RATE_LIMIT_FREE, RATE_LIMIT_PRO and
+// RATE_LIMIT_ENTERPRISE.
+func NewPlanService() *PlanService {
+	defaultPlan := os.Getenv("DEFAULT_PLAN")
+	if _, exists := defaultPlans[defaultPlan]; !exists {
+		if defaultPlan != "" {
+			log.Printf("Warning: Unknown DEFAULT_PLAN %q, using free", defaultPlan)
+		}
+		defaultPlan = "free"
+	}
+
+	plans := make(map[string]Plan, len(defaultPlans))
+	for name, plan := range defaultPlans {
+		plan.RateLimit = getEnvInt("RATE_LIMIT_"+strings.ToUpper(name), plan.RateLimit)
+		plans[name] = plan
+	}
+
+	return &PlanService{
+		plans:        plans,
+		assignments:  make(map[string]string),
+		subscribedAt: make(map[string]time.Time),
+		defaultPlan:  defaultPlan,
+	}
+}
+
+// PlanForUser returns the plan assigned to a user, or the default plan
+func (s *PlanService) PlanForUser(userID string) Plan {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if name, exists := s.assignments[userID]; exists {
+		return s.plans[name]
+	}
+	return s.plans[s.defaultPlan]
+}
+
+// SetUserPlan assigns a plan to a user
+func (s *PlanService) SetUserPlan(userID, planName string) error {
+	if userID == "" {
+		return fmt.Errorf("user ID is required")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.plans[planName]; !exists {
+		return fmt.Errorf("unknown plan: %s", planName)
+	}
+	s.assignments[userID] = planName
+	return nil
+}
+
+// ApplySubscription assigns the plan of a billing subscription event to its user: created and
+// updated subscriptions assign their "plan", and cancelled ones return the user to the default
+// plan. Events older than the one that last changed the user's subscription are ignored, as are
+// plans that do not exist. It reports whether the event was applied.
+func (s *PlanService) ApplySubscription(event *CrossServiceEvent) bool {
+	if s == nil || event.UserID == "" {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if last, exists := s.subscribedAt[event.UserID]; exists && event.Timestamp.Before(last) {
+		return false
+	}
+	switch event.EventType {
+	case "billing.user.subscription.created", "billing.user.subscription.updated":
+		planName, _ := event.Data["plan"].(string)
+		if _, exists := s.plans[planName]; !exists {
+			log.Printf("Warning: Ignoring subscription of user %s to unknown plan %q", event.UserID, planName)
+			return false
+		}
+		s.assignments[event.UserID] = planName
+	case "billing.user.subscription.cancelled":
+		delete(s.assignments, event.UserID)
+	default:
+		return false
+	}
+	s.subscribedAt[event.UserID] = event.Timestamp
+	return true
+}
+
+// Plans returns the available plans, sorted by name
+func (s *PlanService) Plans() []Plan {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	plans := make([]Plan, 0, len(s.plans))
+	for _, plan := range s.plans {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].Name < plans[j].Name
+	})
+	return plans
+}
+
+// billingUserContextKey is the context key holding the user billed for a request
+type billingUserContextKey struct{}
+
+// ContextWithBillingUser returns a context carrying the user billed for the work done
+func ContextWithBillingUser(ctx context.Context, userID string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, billingUserContextKey{}, userID)
+}
+
+// BillingUserFromContext returns the user billed for the work done, or an empty string
+func BillingUserFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	userID, _ := ctx.Value(billingUserContextKey{}).(string)
+	return userID
+}
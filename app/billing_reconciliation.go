@@ -0,0 +1,261 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxBillingRetryBackoff caps the delay between retries of a billing event
+const maxBillingRetryBackoff = time.Hour
+
+// BillingReconciliation is the result of a reconciliation run
+type BillingReconciliation struct {
+	RanAt     time.Time `json:"ran_at"`
+	Retried   int       `json:"retried"`
+	Delivered int       `json:"delivered"`
+	Failed    int       `json:"failed"`    // Retried again by a later run
+	Abandoned int       `json:"abandoned"` // Failed for the last time
+	Pruned    int       `json:"pruned"`    // Delivered and abandoned events past the retention
+	Error     string    `json:"error,omitempty"`
+}
+
+// BillingEventLog records the billing events of API calls in a BillingEventStore before they are
+// sent to the billing service, and keeps the state of their delivery. Failed deliveries are
+// retried by Reconcile with exponential backoff.
+type BillingEventLog struct {
+	store          BillingEventStore
+	client         *BillingClient
+	clock          Clock
+	maxAttempts    int
+	backoff        time.Duration
+	batchSize      int
+	retention      time.Duration
+	reconcileMutex sync.Mutex // Serializes reconciliation runs
+}
+
+// NewBillingEventLog creates a log of billing events delivered with the client. Deliveries are
+// attempted BILLING_RECONCILE_MAX_ATTEMPTS times (default 10), BILLING_RECONCILE_BACKOFF apart
+// at first (default 1m) and twice as long after each failure, at most an hour. A reconciliation
+// retries at most BILLING_RECONCILE_BATCH_SIZE events (default 1000). Delivered and abandoned
+// events are kept for BILLING_EVENT_RETENTION (default 30 days).
+func NewBillingEventLog(store BillingEventStore, client *BillingClient) *BillingEventLog {
+	return &BillingEventLog{
+		store:       store,
+		client:      client,
+		clock:       SystemClock(),
+		maxAttempts: max(getEnvInt("BILLING_RECONCILE_MAX_ATTEMPTS", 10), 1),
+		backoff:     max(getEnvDuration("BILLING_RECONCILE_BACKOFF", time.Minute), time.Second),
+		batchSize:   max(getEnvInt("BILLING_RECONCILE_BATCH_SIZE", 1000), 1),
+		retention:   getEnvDuration("BILLING_EVENT_RETENTION", 30*24*time.Hour),
+	}
+}
+
+// SetClock sets the clock deliveries and retries are timed with
+func (l *BillingEventLog) SetClock(clock Clock) {
+	l.clock = clock
+}
+
+// Store returns the store of the billing events
+func (l *BillingEventLog) Store() BillingEventStore {
+	return l.store
+}
+
+// Record stores a billing event, then delivers it. Events the store fails to keep are still
+// delivered. It returns the error of the delivery, which is retried by Reconcile.
+func (l *BillingEventLog) Record(ctx context.Context, event *StoredBillingEvent) error {
+	event.Status = BillingEventPending
+	if err := l.store.Save(ctx, event); err != nil {
+		log.Printf("Error: Failed to store billing event %s: %v", event.ID, err)
+	}
+	return l.deliver(ctx, event)
+}
+
+// deliver sends an event to the billing service and stores the outcome. Usage records and events
+// carry the billing event's ID as their idempotency key, so retries are billed once.
+func (l *BillingEventLog) deliver(ctx context.Context, event *StoredBillingEvent) error {
+	err := l.client.TrackCorrelatedAPICall(ctx, event.ID, event.UserID, event.Endpoint, event.deliveredMetadata())
+
+	now := l.clock.Now()
+	event.Attempts++
+	event.LastAttemptAt = &now
+	event.NextAttemptAt = nil
+	switch {
+	case err == nil:
+		event.Status = BillingEventDelivered
+		event.LastError = ""
+		event.DeliveredAt = &now
+	case event.Attempts >= l.maxAttempts:
+		event.Status = BillingEventAbandoned
+		event.LastError = err.Error()
+		log.Printf("Error: Billing event %s for user %s was not delivered after %d attempts: %v", event.ID, event.UserID, event.Attempts, err)
+	default:
+		event.Status = BillingEventFailed
+		event.LastError = err.Error()
+		next := now.Add(min(l.backoff<<min(event.Attempts-1, 20), maxBillingRetryBackoff))
+		event.NextAttemptAt = &next
+	}
+
+	if saveErr := l.store.Save(ctx, event); saveErr != nil {
+		log.Printf("Error: Failed to store the delivery of billing event %s: %v", event.ID, saveErr)
+	}
+	return err
+}
+
+// Reconcile retries the failed deliveries that are due, and pending events left undelivered for
+// longer than the backoff, e.g. by a restart, then prunes the events past the retention
+func (l *BillingEventLog) Reconcile(ctx context.Context) BillingReconciliation {
+	l.reconcileMutex.Lock()
+	defer l.reconcileMutex.Unlock()
+
+	now := l.clock.Now()
+	result := BillingReconciliation{RanAt: now}
+	events, err := l.store.Query(ctx, BillingEventFilter{Statuses: []string{BillingEventPending, BillingEventFailed}})
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to query billing events: %v", err)
+		return result
+	}
+
+	for _, event := range events {
+		if result.Retried >= l.batchSize {
+			break
+		}
+		due := event.NextAttemptAt != nil && !event.NextAttemptAt.After(now)
+		stale := event.Status == BillingEventPending && event.Timestamp.Add(l.backoff).Before(now)
+		if !due && !stale {
+			continue
+		}
+
+		result.Retried++
+		l.deliver(ctx, event)
+		switch event.Status {
+		case BillingEventDelivered:
+			result.Delivered++
+		case BillingEventAbandoned:
+			result.Abandoned++
+		default:
+			result.Failed++
+		}
+	}
+
+	if l.retention > 0 {
+		expired, err := l.store.Query(ctx, BillingEventFilter{
+			Statuses: []string{BillingEventDelivered, BillingEventAbandoned},
+			End:      now.Add(-l.retention),
+		})
+		if err == nil && len(expired) > 0 {
+			ids := make([]string, len(expired))
+			for i, event := range expired {
+				ids[i] = event.ID
+			}
+			err = l.store.Delete(ctx, ids)
+			if err == nil {
+				result.Pruned = len(ids)
+			}
+		}
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to prune billing events: %v", err)
+		}
+	}
+
+	if result.Retried > 0 {
+		log.Printf("Reconciled billing events: %d retried, %d delivered, %d failed, %d abandoned",
+			result.Retried, result.Delivered, result.Failed, result.Abandoned)
+	}
+	return result
+}
+
+// Summary counts the events selected by the filter per delivery status, ignoring its statuses
+// and limit
+func (l *BillingEventLog) Summary(ctx context.Context, filter BillingEventFilter) (map[string]int, error) {
+	filter.Statuses, filter.Limit = nil, 0
+	events, err := l.store.Query(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := make(map[string]int, len(billingEventStatuses))
+	for _, status := range billingEventStatuses {
+		summary[status] = 0
+	}
+	for _, event := range events {
+		summary[event.Status]++
+	}
+	return summary, nil
+}
+
+// BillingEvents returns the log of the billing events of API calls
+func (s *AnalyticsService) BillingEvents() *BillingEventLog {
+	return s.billingEvents
+}
+
+// CloseBillingEvents closes the store of the billing events
+func (s *AnalyticsService) CloseBillingEvents() error {
+	return s.billingEvents.store.Close()
+}
+
+// BillingReconciler periodically retries the billing events the billing service did not receive
+type BillingReconciler struct {
+	events   *BillingEventLog
+	interval time.Duration
+	lastRun  *BillingReconciliation
+	stop     chan struct{}
+	stopOnce sync.Once
+	mutex    sync.RWMutex
+}
+
+// NewBillingReconciler creates a reconciler running every interval (BILLING_RECONCILE_INTERVAL,
+// default 1m)
+func NewBillingReconciler(events *BillingEventLog) *BillingReconciler {
+	return &BillingReconciler{
+		events:   events,
+		interval: getEnvDuration("BILLING_RECONCILE_INTERVAL", time.Minute),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the reconciler in the background until Stop is called
+func (r *BillingReconciler) Start() {
+	if r.interval <= 0 {
+		log.Printf("Billing reconciliation disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.Run()
+			}
+		}
+	}()
+}
+
+// Stop stops the background reconciliations
+func (r *BillingReconciler) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// Run reconciles the billing events now and records the result
+func (r *BillingReconciler) Run() BillingReconciliation {
+	result := r.events.Reconcile(context.Background())
+
+	r.mutex.Lock()
+	r.lastRun = &result
+	r.mutex.Unlock()
+	return result
+}
+
+// LastRun returns the result of the most recent reconciliation, or nil before the first one
+func (r *BillingReconciler) LastRun() *BillingReconciliation {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.lastRun
+}
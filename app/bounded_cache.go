@@ -0,0 +1,329 @@
+package app
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BoundedCacheStats describes the size and activity of a bounded cache
+type BoundedCacheStats struct {
+	Name        string `json:"name"`
+	Entries     int    `json:"entries"`
+	MaxEntries  int    `json:"max_entries"`
+	TTL         string `json:"ttl,omitempty"`
+	Hits        int64  `json:"hits"`
+	Misses      int64  `json:"misses"`
+	Evictions   int64  `json:"evictions"`   // Least recently used entries dropped to make room
+	Expirations int64  `json:"expirations"` // Entries dropped after their TTL
+}
+
+// boundedCacheEntry is a cached value
+type boundedCacheEntry struct {
+	key       string
+	value     interface{}
+	expiresAt time.Time // Zero when the cache has no TTL
+}
+
+// BoundedCache is a string-keyed LRU cache holding at most a maximum number of entries. Entries
+// expire a TTL after they were last set; when the cache is full, setting a new key evicts the
+// least recently used entry. It is safe for concurrent use.
+type BoundedCache struct {
+	name       string
+	maxEntries int           // 0 for no limit
+	ttl        time.Duration // 0 for no expiry
+	entries    map[string]*list.Element
+	order      *list.List // Most recently used first
+	stats      BoundedCacheStats
+	clock      Clock
+	mutex      sync.Mutex
+}
+
+// NewBoundedCache creates a cache holding at most maxEntries entries, each expiring ttl after it
+// was set. A maxEntries or ttl of 0 disables the limit or expiry.
+func NewBoundedCache(name string, maxEntries int, ttl time.Duration) *BoundedCache {
+	return &BoundedCache{
+		name:       name,
+		maxEntries: max(maxEntries, 0),
+		ttl:        max(ttl, 0),
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		clock:      SystemClock(),
+	}
+}
+
+// Name returns the name the cache is reported under
+func (c *BoundedCache) Name() string {
+	return c.name
+}
+
+// Get returns the value of a key and marks it as recently used
+func (c *BoundedCache) Get(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element := c.lookup(key)
+	if element == nil {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*boundedCacheEntry).value, true
+}
+
+// Peek returns the value of a key without marking it as recently used or counting a hit
+func (c *BoundedCache) Peek(key string) (interface{}, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element := c.lookup(key)
+	if element == nil {
+		return nil, false
+	}
+	return element.Value.(*boundedCacheEntry).value, true
+}
+
+// Set stores the value of a key, evicting the least recently used entry when the cache is full
+func (c *BoundedCache) Set(key string, value interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.set(key, value)
+}
+
+// Update replaces the value of a key with the result of update, which gets the current value and
+// whether it exists. The cache is locked while update runs, so it must not use the cache.
+func (c *BoundedCache) Update(key string, update func(value interface{}, exists bool) interface{}) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var current interface{}
+	element := c.lookup(key)
+	if element != nil {
+		current = element.Value.(*boundedCacheEntry).value
+	}
+	c.set(key, update(current, element != nil))
+}
+
+// Delete removes a key
+func (c *BoundedCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, exists := c.entries[key]; exists {
+		c.remove(element)
+	}
+}
+
+// Each calls fn with every unexpired entry, most recently used first, without changing their
+// order. The cache is locked while fn runs, so it must not use the cache.
+func (c *BoundedCache) Each(fn func(key string, value interface{})) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.clock.Now()
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*boundedCacheEntry)
+		if !c.expired(entry, now) {
+			fn(entry.key, entry.value)
+		}
+	}
+}
+
+// Len returns the number of entries, including expired entries not dropped yet
+func (c *BoundedCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.entries)
+}
+
+// Clear removes all entries
+func (c *BoundedCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// Limits returns the maximum number of entries and the TTL
+func (c *BoundedCache) Limits() (int, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.maxEntries, c.ttl
+}
+
+// SetLimits sets the maximum number of entries and the TTL, evicting the least recently used
+// entries the cache no longer has room for. The TTL applies to entries set from then on.
+func (c *BoundedCache) SetLimits(maxEntries int, ttl time.Duration) error {
+	if maxEntries < 0 || ttl < 0 {
+		return fmt.Errorf("cache %s limits must not be negative", c.name)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.maxEntries = maxEntries
+	c.ttl = ttl
+	c.evict()
+	return nil
+}
+
+// SetClock sets the clock entry expiry is measured with
+func (c *BoundedCache) SetClock(clock Clock) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clock = clock
+}
+
+// Stats returns the size of the cache and its activity since startup
+func (c *BoundedCache) Stats() BoundedCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Name = c.name
+	stats.Entries = len(c.entries)
+	stats.MaxEntries = c.maxEntries
+	if c.ttl > 0 {
+		stats.TTL = c.ttl.String()
+	}
+	return stats
+}
+
+// lookup returns the element of an unexpired key, dropping the key if it expired. Callers must
+// hold the lock.
+func (c *BoundedCache) lookup(key string) *list.Element {
+	element, exists := c.entries[key]
+	if !exists {
+		return nil
+	}
+	if c.expired(element.Value.(*boundedCacheEntry), c.clock.Now()) {
+		c.remove(element)
+		c.stats.Expirations++
+		return nil
+	}
+	return element
+}
+
+// set stores a value as the most recently used entry. Callers must hold the lock.
+func (c *BoundedCache) set(key string, value interface{}) {
+	var expiresAt time.Time
+	if c.ttl > 0 {
+		expiresAt = c.clock.Now().Add(c.ttl)
+	}
+
+	if element, exists := c.entries[key]; exists {
+		entry := element.Value.(*boundedCacheEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&boundedCacheEntry{key: key, value: value, expiresAt: expiresAt})
+	c.evict()
+}
+
+// evict drops entries until the cache is within its maximum size, expired entries first and then
+// the least recently used ones. Callers must hold the lock.
+func (c *BoundedCache) evict() {
+	if c.maxEntries == 0 || len(c.entries) <= c.maxEntries {
+		return
+	}
+
+	if c.ttl > 0 {
+		now := c.clock.Now()
+		for element := c.order.Back(); element != nil && len(c.entries) > c.maxEntries; {
+			previous := element.Prev()
+			if c.expired(element.Value.(*boundedCacheEntry), now) {
+				c.remove(element)
+				c.stats.Expirations++
+			}
+			element = previous
+		}
+	}
+	for len(c.entries) > c.maxEntries {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+// expired reports whether an entry is past its TTL
+func (c *BoundedCache) expired(entry *boundedCacheEntry, now time.Time) bool {
+	return !entry.expiresAt.IsZero() && !now.Before(entry.expiresAt)
+}
+
+// remove drops an element. Callers must hold the lock.
+func (c *BoundedCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*boundedCacheEntry).key)
+}
+
+// CacheRegistry keeps the bounded caches of an application, so their sizes and evictions can be
+// reported together
+type CacheRegistry struct {
+	caches map[string]*BoundedCache
+	mutex  sync.RWMutex
+}
+
+// NewCacheRegistry creates an empty cache registry
+func NewCacheRegistry() *CacheRegistry {
+	return &CacheRegistry{
+		caches: make(map[string]*BoundedCache),
+	}
+}
+
+// Register adds caches to the registry, replacing caches registered under the same names
+func (r *CacheRegistry) Register(caches ...*BoundedCache) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, cache := range caches {
+		r.caches[cache.Name()] = cache
+	}
+}
+
+// Stats returns the stats of the registered caches ordered by name
+func (r *CacheRegistry) Stats() []BoundedCacheStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	stats := make([]BoundedCacheStats, 0, len(r.caches))
+	for _, cache := range r.caches {
+		stats = append(stats, cache.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// WriteMetrics writes the stats of the registered caches in the Prometheus text exposition format
+func (r *CacheRegistry) WriteMetrics(w io.Writer) error {
+	stats := r.Stats()
+	metrics := []struct {
+		name, kind, help string
+		value            func(BoundedCacheStats) int64
+	}{
+		{"analytics_cache_entries", "gauge", "Entries held by the cache.", func(s BoundedCacheStats) int64 { return int64(s.Entries) }},
+		{"analytics_cache_max_entries", "gauge", "Maximum number of entries of the cache, 0 when unbounded.", func(s BoundedCacheStats) int64 { return int64(s.MaxEntries) }},
+		{"analytics_cache_hits_total", "counter", "Lookups that found an entry.", func(s BoundedCacheStats) int64 { return s.Hits }},
+		{"analytics_cache_misses_total", "counter", "Lookups that found no entry.", func(s BoundedCacheStats) int64 { return s.Misses }},
+		{"analytics_cache_evictions_total", "counter", "Least recently used entries dropped to make room.", func(s BoundedCacheStats) int64 { return s.Evictions }},
+		{"analytics_cache_expirations_total", "counter", "Entries dropped after their TTL.", func(s BoundedCacheStats) int64 { return s.Expirations }},
+	}
+
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, cache := range stats {
+			if _, err := fmt.Fprintf(w, "%s{cache=%q} %d\n", metric.name, cache.Name, metric.value(cache)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
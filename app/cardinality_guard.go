@@ -0,0 +1,163 @@
+package app
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// CardinalityLimitedPrefix marks property values folded into a hash bucket
+const CardinalityLimitedPrefix = "limited:"
+
+// propertyCardinality tracks the distinct values seen for a property of a project
+type propertyCardinality struct {
+	values  map[string]struct{} // At most the limit's number of values
+	limited int64               // Values folded into buckets since the limit was reached
+}
+
+// PropertyCardinality reports a property that reached the distinct-value limit
+type PropertyCardinality struct {
+	Property       string `json:"property"`
+	DistinctValues int    `json:"distinct_values"`
+	LimitedValues  int64  `json:"limited_values"`
+}
+
+// CardinalityGuard tracks the distinct string values of each event property per project. Once a
+// property reaches the limit, values not seen before are replaced by one of a fixed number of hash
+// buckets, keeping aggregations and indexes bounded when properties carry user-generated IDs.
+type CardinalityGuard struct {
+	limit      int
+	buckets    int
+	properties map[string]map[string]*propertyCardinality // Project -> property -> cardinality
+	issues     *ValidationLog
+	mutex      sync.Mutex
+}
+
+// NewCardinalityGuard creates a guard configured from PROPERTY_CARDINALITY_LIMIT and
+// PROPERTY_CARDINALITY_BUCKETS, reporting properties reaching the limit to the validation log
+func NewCardinalityGuard(issues *ValidationLog) *CardinalityGuard {
+	return &CardinalityGuard{
+		limit:      getEnvInt("PROPERTY_CARDINALITY_LIMIT", 1000),
+		buckets:    getEnvInt("PROPERTY_CARDINALITY_BUCKETS", 100),
+		properties: make(map[string]map[string]*propertyCardinality),
+		issues:     issues,
+	}
+}
+
+// Apply returns the properties to store for an event. Values of properties over the limit are replaced
+// by their hash bucket in a copy; the input is never modified. It also returns the limited property names.
+func (g *CardinalityGuard) Apply(projectID, eventType string, properties map[string]interface{}) (map[string]interface{}, []string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.limit <= 0 || len(properties) == 0 {
+		return properties, nil
+	}
+
+	byProperty, exists := g.properties[projectID]
+	if !exists {
+		byProperty = make(map[string]*propertyCardinality)
+		g.properties[projectID] = byProperty
+	}
+
+	var result map[string]interface{}
+	var limited []string
+	for property, raw := range properties {
+		value, ok := raw.(string)
+		if !ok {
+			continue
+		}
+
+		cardinality, exists := byProperty[property]
+		if !exists {
+			cardinality = &propertyCardinality{values: make(map[string]struct{})}
+			byProperty[property] = cardinality
+		}
+		if _, seen := cardinality.values[value]; seen {
+			continue
+		}
+		if len(cardinality.values) < g.limit {
+			cardinality.values[value] = struct{}{}
+			continue
+		}
+
+		if cardinality.limited == 0 {
+			g.issues.Record(projectID, ValidationIssueCardinality, eventType, property, fmt.Sprintf(
+				"property '%s' exceeded %d distinct values; new values are hashed into %d buckets. Avoid unique IDs in properties that are grouped on.",
+				property, g.limit, g.buckets))
+		}
+		cardinality.limited++
+
+		if result == nil {
+			result = make(map[string]interface{}, len(properties))
+			for key, original := range properties {
+				result[key] = original
+			}
+		}
+		result[property] = g.bucket(value)
+		limited = append(limited, property)
+	}
+
+	if result == nil {
+		return properties, nil
+	}
+	sort.Strings(limited)
+	return result, limited
+}
+
+// bucket returns the hash bucket a value is folded into. Callers must hold the lock.
+func (g *CardinalityGuard) bucket(value string) string {
+	buckets := g.buckets
+	if buckets <= 0 {
+		buckets = 1
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(value))
+	return fmt.Sprintf("%s%d", CardinalityLimitedPrefix, hash.Sum32()%uint32(buckets))
+}
+
+// LimitedProperties returns the properties of a project that reached the limit, most limited first
+func (g *CardinalityGuard) LimitedProperties(projectID string) []PropertyCardinality {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	properties := make([]PropertyCardinality, 0)
+	for property, cardinality := range g.properties[projectID] {
+		if cardinality.limited > 0 {
+			properties = append(properties, PropertyCardinality{
+				Property:       property,
+				DistinctValues: len(cardinality.values),
+				LimitedValues:  cardinality.limited,
+			})
+		}
+	}
+
+	sort.Slice(properties, func(i, j int) bool {
+		if properties[i].LimitedValues != properties[j].LimitedValues {
+			return properties[i].LimitedValues > properties[j].LimitedValues
+		}
+		return properties[i].Property < properties[j].Property
+	})
+	return properties
+}
+
+// Limit returns the number of distinct values tracked per property before values are hashed
+func (g *CardinalityGuard) Limit() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.limit
+}
+
+// SetLimit sets the number of distinct values tracked per property. Zero disables the guard.
+// Lowering the limit only affects values not seen yet.
+func (g *CardinalityGuard) SetLimit(limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("cardinality limit must not be negative, got %d", limit)
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.limit = limit
+	return nil
+}
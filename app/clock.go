@@ -0,0 +1,109 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock tells the current time. Services take it instead of calling time.Now, so time-window
+// logic can be tested without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator creates unique identifiers for events and other records
+type IDGenerator interface {
+	NewID() string
+}
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+// Now returns the current local time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clockFunc is a Clock reading the time from a function
+type clockFunc func() time.Time
+
+// Now returns the function's time
+func (f clockFunc) Now() time.Time {
+	return f()
+}
+
+// uuidGenerator creates random UUIDs
+type uuidGenerator struct{}
+
+// NewID returns a random UUID
+func (uuidGenerator) NewID() string {
+	return uuid.New().String()
+}
+
+// SystemClock returns the wall clock used by default
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// UUIDGenerator returns the random UUID generator used by default
+func UUIDGenerator() IDGenerator {
+	return uuidGenerator{}
+}
+
+// FakeClock is a Clock for tests that only moves when told to
+type FakeClock struct {
+	now   time.Time
+	mutex sync.RWMutex
+}
+
+// NewFakeClock creates a fake clock stopped at the given time
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the fake clock's time
+func (c *FakeClock) Now() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.now
+}
+
+// Set moves the fake clock to the given time
+func (c *FakeClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+}
+
+// Advance moves the fake clock forward by the given duration
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// SequentialIDGenerator is an IDGenerator for tests returning predictable IDs. The IDs keep the
+// UUID format, so code slicing or parsing them behaves as in production.
+type SequentialIDGenerator struct {
+	next  uint64
+	mutex sync.Mutex
+}
+
+// NewSequentialIDGenerator creates a generator whose first ID starts with 00000001
+func NewSequentialIDGenerator() *SequentialIDGenerator {
+	return &SequentialIDGenerator{next: 1}
+}
+
+// NewID returns the next ID, e.g. 00000001-0000-4000-8000-000000000000. The counter leads, so
+// prefixes of the IDs, such as the ones session IDs are made of, stay unique.
+func (g *SequentialIDGenerator) NewID() string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	id := fmt.Sprintf("%08d-0000-4000-8000-000000000000", g.next)
+	g.next++
+	return id
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// eventTime is when an event happened according to the device and after correcting its clock
+type eventTime struct {
+	Timestamp       time.Time  // Corrected time the event happened
+	ClientTimestamp *time.Time // Time the event happened according to the device's clock
+	SentAt          *time.Time // Time the device sent the event according to its clock
+	ClockSkew       time.Duration
+}
+
+// EventOrderError reports an event claiming to have happened after it was sent, which no working
+// SDK produces
+type EventOrderError struct {
+	Timestamp time.Time
+	SentAt    time.Time
+}
+
+func (e *EventOrderError) Error() string {
+	return fmt.Sprintf("timestamp %s is after sent_at %s", e.Timestamp.Format(time.RFC3339Nano), e.SentAt.Format(time.RFC3339Nano))
+}
+
+// resolveEventTime determines when an event happened from its optional timestamp and sent_at
+// fields. When both are given, the device's clock skew is the difference between receivedAt and
+// sent_at, and the timestamp is shifted by it: the time between the event and sending it is
+// measured on the device's clock alone, so a wrong clock cancels out.
+func resolveEventTime(eventData map[string]interface{}, receivedAt time.Time) (eventTime, error) {
+	resolved := eventTime{Timestamp: receivedAt}
+
+	raw, exists := eventData["timestamp"]
+	if !exists {
+		return resolved, nil
+	}
+	timestamp, err := parseEventTimestamp(raw)
+	if err != nil {
+		return resolved, err
+	}
+	resolved.Timestamp = timestamp
+	resolved.ClientTimestamp = &timestamp
+
+	raw, exists = eventData["sent_at"]
+	if !exists {
+		return resolved, nil
+	}
+	sentAt, err := parseEventTimestamp(raw)
+	if err != nil {
+		return resolved, fmt.Errorf("invalid sent_at: %w", err)
+	}
+	if timestamp.After(sentAt) {
+		return resolved, &EventOrderError{Timestamp: timestamp, SentAt: sentAt}
+	}
+
+	resolved.SentAt = &sentAt
+	resolved.ClockSkew = receivedAt.Sub(sentAt)
+	resolved.Timestamp = timestamp.Add(resolved.ClockSkew)
+	return resolved, nil
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnvInt reads an integer from the environment, falling back to the default when unset or invalid
+func getEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Warning: Invalid value for %s: %q, using default %d", name, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvFloat reads a number from the environment, falling back to the default when unset or invalid
+func getEnvFloat(name string, defaultValue float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Warning: Invalid value for %s: %q, using default %v", name, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvDuration reads a duration (e.g. "500ms", "5m") from the environment, falling back to the default
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Warning: Invalid value for %s: %q, using default %s", name, value, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// BaseCurrency is the currency all prices are defined in
+const BaseCurrency = "USD"
+
+// CurrencyService converts billed amounts into the contract currency of each project
+type CurrencyService struct {
+	rates             map[string]float64 // Units of a currency per unit of BaseCurrency
+	projectCurrencies map[string]string  // Contract currency by project ID
+	defaultCurrency   string
+	mutex             sync.RWMutex
+}
+
+// NewCurrencyService creates a currency service configured from BILLING_CURRENCY_RATES, a
+// comma-separated list of currency:rate entries relative to USD, and BILLING_DEFAULT_CURRENCY
+func NewCurrencyService() *CurrencyService {
+	service := &CurrencyService{
+		rates:             map[string]float64{BaseCurrency: 1.0},
+		projectCurrencies: make(map[string]string),
+		defaultCurrency:   BaseCurrency,
+	}
+
+	if value := os.Getenv("BILLING_CURRENCY_RATES"); value != "" {
+		rates, err := parseRates(value)
+		if err == nil {
+			err = service.ReplaceRates(rates)
+		}
+		if err != nil {
+			log.Printf("Warning: Ignoring BILLING_CURRENCY_RATES: %v", err)
+		}
+	}
+
+	if currency := os.Getenv("BILLING_DEFAULT_CURRENCY"); currency != "" {
+		currency = strings.ToUpper(currency)
+		if _, exists := service.rates[currency]; exists {
+			service.defaultCurrency = currency
+		} else {
+			log.Printf("Warning: No conversion rate for BILLING_DEFAULT_CURRENCY %q, using %s", currency, BaseCurrency)
+		}
+	}
+
+	return service
+}
+
+// Rate returns the conversion rate from BaseCurrency to a currency
+func (s *CurrencyService) Rate(currency string) (float64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rate, exists := s.rates[strings.ToUpper(currency)]
+	if !exists {
+		return 0, fmt.Errorf("no conversion rate for currency: %s", currency)
+	}
+	return rate, nil
+}
+
+// Rates returns the conversion rates from BaseCurrency by currency
+func (s *CurrencyService) Rates() map[string]float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rates := make(map[string]float64, len(s.rates))
+	for currency, rate := range s.rates {
+		rates[currency] = rate
+	}
+	return rates
+}
+
+// ReplaceRates replaces every conversion rate, e.g. with the rates published by the billing
+// service. Rates of currencies assigned to a project cannot be dropped.
+func (s *CurrencyService) ReplaceRates(rates map[string]float64) error {
+	normalized := map[string]float64{BaseCurrency: 1.0}
+	for currency, rate := range rates {
+		currency = strings.ToUpper(currency)
+		if len(currency) != 3 {
+			return fmt.Errorf("invalid currency code: %s", currency)
+		}
+		if rate <= 0 {
+			return fmt.Errorf("conversion rate for %s must be positive, got %v", currency, rate)
+		}
+		if currency == BaseCurrency && rate != 1.0 {
+			return fmt.Errorf("conversion rate for %s must be 1", BaseCurrency)
+		}
+		normalized[currency] = rate
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for projectID, currency := range s.projectCurrencies {
+		if _, exists := normalized[currency]; !exists {
+			return fmt.Errorf("currency %s is still used by project %s", currency, projectID)
+		}
+	}
+	if _, exists := normalized[s.defaultCurrency]; !exists {
+		return fmt.Errorf("currency %s is the default currency", s.defaultCurrency)
+	}
+
+	s.rates = normalized
+	return nil
+}
+
+// SetProjectCurrency sets the contract currency of a project. An empty currency resets it to the default.
+func (s *CurrencyService) SetProjectCurrency(projectID, currency string) error {
+	projectID = projectOrDefault(projectID)
+	currency = strings.ToUpper(currency)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if currency == "" {
+		delete(s.projectCurrencies, projectID)
+		return nil
+	}
+	if _, exists := s.rates[currency]; !exists {
+		return fmt.Errorf("no conversion rate for currency: %s", currency)
+	}
+	s.projectCurrencies[projectID] = currency
+	return nil
+}
+
+// ProjectCurrency returns the contract currency of a project
+func (s *CurrencyService) ProjectCurrency(projectID string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if currency, exists := s.projectCurrencies[projectOrDefault(projectID)]; exists {
+		return currency
+	}
+	return s.defaultCurrency
+}
+
+// ProjectCurrencies returns the contract currency of every project with one assigned
+func (s *CurrencyService) ProjectCurrencies() map[string]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	currencies := make(map[string]string, len(s.projectCurrencies))
+	for projectID, currency := range s.projectCurrencies {
+		currencies[projectID] = currency
+	}
+	return currencies
+}
+
+// DefaultCurrency returns the currency of projects without an assigned currency
+func (s *CurrencyService) DefaultCurrency() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.defaultCurrency
+}
+
+// ConvertSummary converts a billing summary priced in BaseCurrency into a currency.
+// Summaries that cannot be converted are returned unchanged.
+func (s *CurrencyService) ConvertSummary(summary BillingSummary, currency string) BillingSummary {
+	rate, err := s.Rate(currency)
+	if err != nil || summary.Currency != BaseCurrency {
+		return summary
+	}
+
+	converted := BillingSummary{
+		TotalCost:     summary.TotalCost * rate,
+		CostBreakdown: make(map[string]float64, len(summary.CostBreakdown)),
+		Currency:      strings.ToUpper(currency),
+	}
+	for key, amount := range summary.CostBreakdown {
+		converted.CostBreakdown[key] = amount * rate
+	}
+	if converted.Currency != BaseCurrency {
+		converted.BaseTotalCost = summary.TotalCost
+		converted.ExchangeRate = rate
+	}
+	return converted
+}
@@ -0,0 +1,250 @@
+package app
+
+import (
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Live dashboard metrics computed by the aggregator
+const (
+	DashboardTotalEvents     = "total_events"
+	DashboardEventsPerMinute = "events_per_minute"
+	DashboardActiveUsers     = "active_users"
+	DashboardConversionRate  = "conversion_rate" // Share of the active users who converted
+	DashboardTopPages        = "top_pages"
+)
+
+// Limits of the aggregated counters
+const (
+	aggregationMinutes = 60 // Minutes of counters kept, the longest dashboard granularity
+	topPagesLimit      = 10
+)
+
+// DashboardPageViews is a page of the top_pages metric with its views over the window
+type DashboardPageViews struct {
+	Page  string `json:"page"`
+	Views int64  `json:"views"`
+}
+
+// aggregateBucket holds the counters of a project for one minute
+type aggregateBucket struct {
+	minute    int64 // Minutes since the Unix epoch
+	events    int64
+	users     map[string]bool
+	converted map[string]bool // Users with a conversion event
+	pages     map[string]int64
+}
+
+// projectAggregates are the counters of a project's last hour, one bucket per minute
+type projectAggregates struct {
+	buckets [aggregationMinutes]*aggregateBucket
+	latest  int64 // Minute of the latest counted event
+}
+
+// MetricAggregator maintains rolling per-minute counters of each project's events, from which
+// the live dashboard metrics are computed over any window up to an hour: total_events,
+// events_per_minute, active_users, conversion_rate and top_pages. Events are counted in the
+// minute they happened; events older than an hour are not counted.
+type MetricAggregator struct {
+	projects    map[string]*projectAggregates
+	conversions map[string]bool // Event types converting a user
+	maxProjects int
+	clock       Clock
+	mutex       sync.Mutex
+}
+
+// NewMetricAggregator creates an aggregator counting the events of at most
+// DASHBOARD_AGGREGATION_MAX_PROJECTS (default 10000) projects at once, with users converting
+// through events of the DASHBOARD_CONVERSION_EVENTS types (default: purchase,signup)
+func NewMetricAggregator() *MetricAggregator {
+	aggregator := &MetricAggregator{
+		projects:    make(map[string]*projectAggregates),
+		conversions: make(map[string]bool),
+		maxProjects: getEnvInt("DASHBOARD_AGGREGATION_MAX_PROJECTS", 10000),
+		clock:       SystemClock(),
+	}
+
+	conversions := os.Getenv("DASHBOARD_CONVERSION_EVENTS")
+	if conversions == "" {
+		conversions = "purchase,signup"
+	}
+	for _, eventType := range strings.Split(conversions, ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			aggregator.conversions[eventType] = true
+		}
+	}
+	return aggregator
+}
+
+// SetClock replaces the clock windows end at
+func (a *MetricAggregator) SetClock(clock Clock) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.clock = clock
+}
+
+// Record counts a stored analytics event in the metrics of its project
+func (a *MetricAggregator) Record(event *AnalyticsEvent) {
+	a.count(projectOrDefault(event.ProjectID), event.EventType, event.UserID, event.Page, event.Timestamp)
+}
+
+// RecordServiceEvent counts an event consumed from another service. Such events are not tied to
+// a project, so they count in the default project's metrics. Does nothing without an aggregator.
+func (a *MetricAggregator) RecordServiceEvent(event *CrossServiceEvent) {
+	if a == nil {
+		return
+	}
+	a.count(DefaultProjectID, event.EventType, event.UserID, "", event.Timestamp)
+}
+
+// Value computes a metric of a project over the window ending now; it is a MetricProvider.
+// Windows are rounded to whole minutes, the current one included, and capped at an hour.
+func (a *MetricAggregator) Value(projectID, metric string, window time.Duration) interface{} {
+	minutes := int64(window / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	if minutes > aggregationMinutes {
+		minutes = aggregationMinutes
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var buckets []*aggregateBucket
+	now := a.clock.Now().Unix() / 60
+	if project, exists := a.projects[projectOrDefault(projectID)]; exists {
+		for minute := now - minutes + 1; minute <= now; minute++ {
+			if bucket := project.buckets[bucketSlot(minute)]; bucket != nil && bucket.minute == minute {
+				buckets = append(buckets, bucket)
+			}
+		}
+	}
+
+	switch metric {
+	case DashboardTotalEvents, DashboardEventsPerMinute:
+		var events int64
+		for _, bucket := range buckets {
+			events += bucket.events
+		}
+		if metric == DashboardTotalEvents {
+			return events
+		}
+		return math.Round(float64(events)/float64(minutes)*100) / 100
+	case DashboardActiveUsers, DashboardConversionRate:
+		users := make(map[string]bool)
+		converted := make(map[string]bool)
+		for _, bucket := range buckets {
+			for userID := range bucket.users {
+				users[userID] = true
+			}
+			for userID := range bucket.converted {
+				converted[userID] = true
+			}
+		}
+		if metric == DashboardActiveUsers {
+			return len(users)
+		}
+		if len(users) == 0 {
+			return 0.0
+		}
+		return math.Round(float64(len(converted))/float64(len(users))*10000) / 10000
+	case DashboardTopPages:
+		views := make(map[string]int64)
+		for _, bucket := range buckets {
+			for page, count := range bucket.pages {
+				views[page] += count
+			}
+		}
+		pages := make([]DashboardPageViews, 0, len(views))
+		for page, count := range views {
+			pages = append(pages, DashboardPageViews{Page: page, Views: count})
+		}
+		sort.Slice(pages, func(i, j int) bool {
+			if pages[i].Views != pages[j].Views {
+				return pages[i].Views > pages[j].Views
+			}
+			return pages[i].Page < pages[j].Page
+		})
+		return pages[:min(topPagesLimit, len(pages))]
+	}
+	return "N/A"
+}
+
+// count adds an event to the bucket of the minute it happened in. Events from the future are
+// counted now.
+func (a *MetricAggregator) count(projectID, eventType, userID, page string, at time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := a.clock.Now().Unix() / 60
+	minute := at.Unix() / 60
+	if at.IsZero() || minute > now {
+		minute = now
+	}
+	if minute <= now-aggregationMinutes {
+		return
+	}
+
+	project, exists := a.projects[projectID]
+	if !exists {
+		if len(a.projects) >= a.maxProjects && !a.pruneIdle(now) {
+			return
+		}
+		project = &projectAggregates{}
+		a.projects[projectID] = project
+	}
+	project.latest = max(project.latest, minute)
+
+	slot := bucketSlot(minute)
+	bucket := project.buckets[slot]
+	if bucket == nil || bucket.minute != minute {
+		if bucket != nil && bucket.minute > minute {
+			return // The slot holds a later minute; the event is older than an hour
+		}
+		bucket = &aggregateBucket{
+			minute:    minute,
+			users:     make(map[string]bool),
+			converted: make(map[string]bool),
+			pages:     make(map[string]int64),
+		}
+		project.buckets[slot] = bucket
+	}
+
+	bucket.events++
+	if userID != "" {
+		bucket.users[userID] = true
+		if a.conversions[eventType] {
+			bucket.converted[userID] = true
+		}
+	}
+	if page != "" {
+		bucket.pages[page]++
+	}
+}
+
+// pruneIdle forgets the projects without events in the last hour, reporting whether any were.
+// Callers must hold the lock.
+func (a *MetricAggregator) pruneIdle(now int64) bool {
+	pruned := false
+	for projectID, project := range a.projects {
+		if project.latest <= now-aggregationMinutes {
+			delete(a.projects, projectID)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// bucketSlot returns the index of a minute's bucket
+func bucketSlot(minute int64) int {
+	slot := int(minute % aggregationMinutes)
+	if slot < 0 {
+		slot += aggregationMinutes
+	}
+	return slot
+}
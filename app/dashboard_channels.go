@@ -0,0 +1,275 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Kinds of channels dashboard clients subscribe to, named "<kind>:<value>"
+const (
+	DashboardChannelMetric    = "metric"     // Broadcast metrics of a type, e.g. metric:heatmap.updated
+	DashboardChannelEventType = "event_type" // Events of a type, e.g. event_type:purchase
+	DashboardChannelPage      = "page"       // Events on a page, e.g. page:/checkout
+	DashboardChannelSegment   = "segment"    // Events of users in a lifecycle stage, e.g. segment:subscribed
+)
+
+// dashboardChannelKinds lists the kinds of channels, in the order they are described in errors
+var dashboardChannelKinds = []string{DashboardChannelMetric, DashboardChannelEventType, DashboardChannelPage, DashboardChannelSegment}
+
+// dashboardChannels are the channels a client subscribed to, by kind. A client without channels
+// receives every broadcast of its project.
+type dashboardChannels map[string]map[string]bool
+
+// parseDashboardChannel splits a channel name into its kind and value
+func parseDashboardChannel(channel string) (string, string, error) {
+	kind, value, found := strings.Cut(channel, ":")
+	if !found || value == "" {
+		return "", "", fmt.Errorf("invalid channel: %s. Channels are named <kind>:<value>", channel)
+	}
+	for _, known := range dashboardChannelKinds {
+		if kind == known {
+			return kind, value, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid channel kind: %s. Valid kinds are: %s", kind, strings.Join(dashboardChannelKinds, ", "))
+}
+
+// parseChannelList reads the "channels" of a subscribe or unsubscribe message
+func parseChannelList(msg map[string]interface{}) ([]string, error) {
+	values, ok := msg["channels"].([]interface{})
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("channels must be a non-empty list")
+	}
+	channels := make([]string, 0, len(values))
+	for _, value := range values {
+		channel, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("channels must be strings")
+		}
+		channels = append(channels, channel)
+	}
+	return channels, nil
+}
+
+// validateChannel checks that a client may subscribe to a channel. Embedded dashboards only
+// subscribe to the metrics they show, and segments are lifecycle stages.
+func (c *dashboardClient) validateChannel(kind, value string) error {
+	if c.public && kind != DashboardChannelMetric {
+		return fmt.Errorf("only metric channels are available on this dashboard")
+	}
+	if kind == DashboardChannelMetric && !c.allowsMetric(value) {
+		return fmt.Errorf("metric is not available on this dashboard")
+	}
+	if kind == DashboardChannelSegment && !isLifecycleStage(value) {
+		return fmt.Errorf("invalid segment: %s. Valid segments are: %s", value, strings.Join(lifecycleStages, ", "))
+	}
+	return nil
+}
+
+// subscribeChannels adds channels to the client's filter. Either every channel is added or none.
+func (s *DashboardService) subscribeChannels(client *dashboardClient, msg map[string]interface{}) {
+	channels, err := parseChannelList(msg)
+	if err != nil {
+		client.writeJSON(map[string]string{"type": "error", "error": err.Error()})
+		return
+	}
+
+	type parsedChannel struct{ kind, value string }
+	parsed := make([]parsedChannel, 0, len(channels))
+	for _, channel := range channels {
+		kind, value, err := parseDashboardChannel(channel)
+		if err == nil {
+			err = client.validateChannel(kind, value)
+		}
+		if err != nil {
+			client.writeJSON(map[string]string{"type": "error", "channel": channel, "error": err.Error()})
+			return
+		}
+		parsed = append(parsed, parsedChannel{kind: kind, value: value})
+	}
+
+	client.stateMu.Lock()
+	if client.channels == nil {
+		client.channels = make(dashboardChannels)
+	}
+	added := 0
+	for _, channel := range parsed {
+		if !client.channels[channel.kind][channel.value] {
+			added++
+		}
+	}
+	if client.channels.count()+added > s.maxChannels {
+		client.stateMu.Unlock()
+		client.writeJSON(map[string]string{"type": "error", "error": fmt.Sprintf("too many channels, at most %d can be subscribed to", s.maxChannels)})
+		return
+	}
+	for _, channel := range parsed {
+		if client.channels[channel.kind] == nil {
+			client.channels[channel.kind] = make(map[string]bool)
+		}
+		client.channels[channel.kind][channel.value] = true
+	}
+	subscribed := client.channels.names()
+	client.stateMu.Unlock()
+
+	client.writeJSON(map[string]interface{}{"type": "subscribed", "channels": subscribed})
+}
+
+// unsubscribeChannels removes channels from the client's filter. Once every channel is removed,
+// the client receives every broadcast again.
+func (s *DashboardService) unsubscribeChannels(client *dashboardClient, msg map[string]interface{}) {
+	channels, err := parseChannelList(msg)
+	if err != nil {
+		client.writeJSON(map[string]string{"type": "error", "error": err.Error()})
+		return
+	}
+
+	client.stateMu.Lock()
+	for _, channel := range channels {
+		if kind, value, err := parseDashboardChannel(channel); err == nil {
+			delete(client.channels[kind], value)
+			if len(client.channels[kind]) == 0 {
+				delete(client.channels, kind)
+			}
+		}
+	}
+	subscribed := client.channels.names()
+	client.stateMu.Unlock()
+
+	client.writeJSON(map[string]interface{}{"type": "unsubscribed", "channels": subscribed})
+}
+
+// count returns the number of channels
+func (channels dashboardChannels) count() int {
+	count := 0
+	for _, values := range channels {
+		count += len(values)
+	}
+	return count
+}
+
+// names returns the sorted names of the channels
+func (channels dashboardChannels) names() []string {
+	names := make([]string, 0, channels.count())
+	for kind, values := range channels {
+		for value := range values {
+			names = append(names, kind+":"+value)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// wants reports whether a broadcast matches one of the client's channels. Events match their
+// type, their page and the lifecycle stage of their user, looked up with segment when needed.
+func (c *dashboardClient) wants(message sequencedMessage, segment func() string) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if len(c.channels) == 0 {
+		return true
+	}
+	switch message := message.(type) {
+	case DashboardMetric:
+		return c.channels[DashboardChannelMetric][message.Type]
+	case DashboardEvent:
+		if c.channels[DashboardChannelEventType][message.EventType] {
+			return true
+		}
+		if page, _ := message.Data["page"].(string); page != "" && c.channels[DashboardChannelPage][page] {
+			return true
+		}
+		if stages := c.channels[DashboardChannelSegment]; len(stages) > 0 {
+			stage := segment()
+			return stage != "" && stages[stage]
+		}
+	}
+	return false
+}
+
+// SetUserProfiles sets the profiles the lifecycle stage of the users of events is looked up in,
+// for clients subscribed to segment channels
+func (s *DashboardService) SetUserProfiles(profiles *UserProfiles) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.profiles = profiles
+}
+
+// eventSegment returns a function looking up the lifecycle stage of an event's user once, or ""
+// for anonymous users and users without a profile. Callers must hold the lock.
+func (s *DashboardService) eventSegment(message sequencedMessage) func() string {
+	looked, stage := false, ""
+	return func() string {
+		event, isEvent := message.(DashboardEvent)
+		if looked || !isEvent || event.UserID == "" || s.profiles == nil {
+			return stage
+		}
+		looked = true
+		if profile, exists := s.profiles.Get(event.UserID); exists {
+			stage = profile.Stage
+		}
+		return stage
+	}
+}
+
+// isLifecycleStage reports whether a value names a lifecycle stage
+func isLifecycleStage(value string) bool {
+	for _, stage := range lifecycleStages {
+		if value == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue queues a frame for the client's writer without waiting. It returns false when the
+// queue is full, meaning the client does not keep up.
+func (c *dashboardClient) enqueue(frame *dashboardFrame) bool {
+	select {
+	case <-c.closed:
+		return true // Dropped, the client is going away
+	default:
+	}
+	select {
+	case c.queue <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// send queues a frame for the client's writer, waiting for room unless the client disconnects
+func (c *dashboardClient) send(frame *dashboardFrame) error {
+	select {
+	case c.queue <- frame:
+		return nil
+	case <-c.closed:
+		return fmt.Errorf("dashboard client disconnected")
+	}
+}
+
+// writeLoop writes the client's queued frames in order until it disconnects
+func (c *dashboardClient) writeLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case frame := <-c.queue:
+			if err := c.writeFrame(frame); err != nil {
+				log.Printf("Error sending message to client: %v", err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close closes the client's connection and stops its writer
+func (c *dashboardClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,283 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of derived dashboard metrics, named "<kind>:<id>:<field>"
+const (
+	DerivedMetricFunnel  = "funnel"  // Computed from a stored funnel
+	DerivedMetricSegment = "segment" // Computed from a saved segment query
+)
+
+// Fields each kind of derived metric provides
+var derivedMetricFields = map[string][]string{
+	DerivedMetricFunnel:  {"conversion_rate", "total_users"},
+	DerivedMetricSegment: {"active_users", "event_count"},
+}
+
+// derivedMetric is a metric derived from a funnel or segment, e.g. funnel:checkout:conversion_rate
+type derivedMetric struct {
+	kind  string
+	id    string
+	field string
+}
+
+// derivedMetricKey identifies a derived metric computed for a project over a granularity window
+type derivedMetricKey struct {
+	projectID   string
+	metric      string
+	granularity string
+}
+
+// derivedMetricValue is the last computed value of a derived metric
+type derivedMetricValue struct {
+	value      interface{}
+	computedAt time.Time
+}
+
+// parseDerivedMetric parses a derived metric name. It reports false for metrics of other kinds.
+func parseDerivedMetric(metric string) (derivedMetric, bool, error) {
+	kind, rest, found := strings.Cut(metric, ":")
+	fields, derived := derivedMetricFields[kind]
+	if !found || !derived {
+		return derivedMetric{}, false, nil
+	}
+
+	separator := strings.LastIndex(rest, ":")
+	if separator <= 0 {
+		return derivedMetric{}, true, fmt.Errorf("invalid metric: %s. Derived metrics are named %s:<id>:<field>", metric, kind)
+	}
+	parsed := derivedMetric{kind: kind, id: rest[:separator], field: rest[separator+1:]}
+	for _, field := range fields {
+		if parsed.field == field {
+			return parsed, true, nil
+		}
+	}
+	return derivedMetric{}, true, fmt.Errorf("invalid %s metric field: %s. Valid fields are: %s", kind, parsed.field, strings.Join(fields, ", "))
+}
+
+// DerivedMetrics computes the dashboard metrics derived from stored funnels and saved segment
+// queries, such as funnel:<id>:conversion_rate and segment:<id>:active_users, over the
+// subscription's granularity window. Values are computed when first requested and recomputed on
+// a cadence while their project has connected dashboards; changed values are pushed to them on
+// the live feed. Requests between recomputations are served the last value.
+type DerivedMetrics struct {
+	funnels    *FunnelService
+	queries    *SavedQueryService
+	segments   *QueryService
+	dashboards *DashboardService
+	webhook    *FunnelWebhook // Notified of the funnels recomputed on the cadence, if set
+	cadence    time.Duration
+	maxEntries int
+	values     map[derivedMetricKey]*derivedMetricValue
+	stop       chan struct{}
+	stopOnce   sync.Once
+	mutex      sync.Mutex
+}
+
+// NewDerivedMetrics creates the derived metrics of the dashboards, recomputed every
+// DASHBOARD_DERIVED_METRIC_CADENCE (default 1m) for at most DASHBOARD_DERIVED_METRIC_MAX_ENTRIES
+// (default 1000) metrics, projects and granularities at once
+func NewDerivedMetrics(funnels *FunnelService, queries *SavedQueryService, segments *QueryService, dashboards *DashboardService) *DerivedMetrics {
+	return &DerivedMetrics{
+		funnels:    funnels,
+		queries:    queries,
+		segments:   segments,
+		dashboards: dashboards,
+		cadence:    getEnvDuration("DASHBOARD_DERIVED_METRIC_CADENCE", time.Minute),
+		maxEntries: getEnvInt("DASHBOARD_DERIVED_METRIC_MAX_ENTRIES", 1000),
+		values:     make(map[derivedMetricKey]*derivedMetricValue),
+		stop:       make(chan struct{}),
+	}
+}
+
+// SetFunnelWebhook sets the webhook posted the funnel results recomputed on the cadence
+func (d *DerivedMetrics) SetFunnelWebhook(webhook *FunnelWebhook) {
+	d.webhook = webhook
+}
+
+// Start recomputes the derived metrics in use on the cadence until stopped
+func (d *DerivedMetrics) Start() {
+	if d.cadence <= 0 {
+		log.Printf("Derived dashboard metrics are recomputed on every request")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(d.cadence)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stop:
+				return
+			case now := <-ticker.C:
+				d.Run(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the background recomputations
+func (d *DerivedMetrics) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
+}
+
+// Validate checks that a derived metric refers to a funnel or segment of the project
+func (d *DerivedMetrics) Validate(projectID, metric string) error {
+	parsed, _, err := parseDerivedMetric(metric)
+	if err != nil {
+		return err
+	}
+	_, err = d.lookup(projectOrDefault(projectID), parsed)
+	return err
+}
+
+// Value returns a derived metric of a project over a granularity window, computing it unless it
+// was computed within the cadence
+func (d *DerivedMetrics) Value(projectID, metric, granularity string) (interface{}, error) {
+	key := derivedMetricKey{projectID: projectOrDefault(projectID), metric: metric, granularity: granularity}
+	now := time.Now()
+
+	d.mutex.Lock()
+	cached, exists := d.values[key]
+	full := !exists && len(d.values) >= d.maxEntries
+	d.mutex.Unlock()
+	if exists && now.Sub(cached.computedAt) < d.cadence {
+		return cached.value, nil
+	}
+	if full {
+		return nil, fmt.Errorf("too many derived metrics in use, at most %d can be computed", d.maxEntries)
+	}
+
+	value, _, err := d.compute(key, now)
+	if err != nil || d.cadence <= 0 {
+		return value, err
+	}
+
+	d.mutex.Lock()
+	d.values[key] = &derivedMetricValue{value: value, computedAt: now}
+	d.mutex.Unlock()
+	return value, nil
+}
+
+// Run recomputes the derived metrics of the projects with connected dashboards and pushes the
+// changed values to them. Metrics of projects without dashboards are forgotten. The recomputed
+// funnel results are posted to the funnel webhook. It returns how many values changed.
+func (d *DerivedMetrics) Run(now time.Time) int {
+	d.mutex.Lock()
+	keys := make([]derivedMetricKey, 0, len(d.values))
+	for key := range d.values {
+		if !d.dashboards.hasClients(key.projectID) {
+			delete(d.values, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	d.mutex.Unlock()
+
+	changed := 0
+	notified := make(map[derivedMetricKey]bool) // Funnels and granularities posted to the webhook
+	for _, key := range keys {
+		value, result, err := d.compute(key, now)
+		if err != nil {
+			// The funnel or segment was deleted; dashboards keep the last value
+			log.Printf("Warning: Failed to compute dashboard metric %s of project %s: %v", key.metric, key.projectID, err)
+			d.mutex.Lock()
+			delete(d.values, key)
+			d.mutex.Unlock()
+			continue
+		}
+
+		// A funnel's metrics share its result, which is posted once
+		if funnel, ok := result.(*FunnelResult); ok {
+			funnelKey := derivedMetricKey{projectID: key.projectID, metric: funnel.FunnelID, granularity: key.granularity}
+			if !notified[funnelKey] {
+				notified[funnelKey] = true
+				d.webhook.Notify(key.projectID, FunnelTriggerScheduled, funnel)
+			}
+		}
+
+		d.mutex.Lock()
+		previous, exists := d.values[key]
+		d.values[key] = &derivedMetricValue{value: value, computedAt: now}
+		d.mutex.Unlock()
+		if exists && previous.value == value {
+			continue
+		}
+
+		changed++
+		d.dashboards.BroadcastMetric(DashboardMetric{
+			ProjectID: key.projectID,
+			Type:      key.metric,
+			Value:     value,
+			Timestamp: now,
+			Metadata: map[string]interface{}{
+				"source":      "derived",
+				"granularity": key.granularity,
+			},
+		})
+	}
+	return changed
+}
+
+// lookup checks that the funnel or saved segment query of a derived metric exists in the project,
+// returning the segment query
+func (d *DerivedMetrics) lookup(projectID string, metric derivedMetric) (*SavedQuery, error) {
+	ctx := ContextWithProject(context.Background(), projectID)
+	if metric.kind == DerivedMetricFunnel {
+		_, err := d.funnels.GetFunnel(ctx, metric.id)
+		return nil, err
+	}
+
+	query, err := d.queries.GetQuery(ctx, metric.id)
+	if err != nil {
+		return nil, err
+	}
+	if query.Type != SavedQuerySegment {
+		return nil, fmt.Errorf("saved query %s is a %s query, not a segment", metric.id, query.Type)
+	}
+	return query, nil
+}
+
+// compute computes a derived metric over the granularity window ending at now, returning the
+// funnel or segment result it was derived from
+func (d *DerivedMetrics) compute(key derivedMetricKey, now time.Time) (interface{}, interface{}, error) {
+	metric, _, err := parseDerivedMetric(key.metric)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Unknown funnels would otherwise be computed from a sample definition
+	query, err := d.lookup(key.projectID, metric)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx := ContextWithProject(context.Background(), key.projectID)
+	start := now.Add(-dashboardGranularities[key.granularity])
+
+	if metric.kind == DerivedMetricFunnel {
+		result, err := d.funnels.ComputeFunnel(ctx, FunnelQuery{FunnelID: metric.id, Start: start, End: now})
+		if err != nil {
+			return nil, nil, err
+		}
+		if metric.field == "conversion_rate" {
+			return result.ConversionRate, result, nil
+		}
+		return result.TotalUsers, result, nil
+	}
+
+	result, err := d.segments.ComputeSegment(ctx, savedSegmentQuery(query.Parameters, start, now))
+	if err != nil {
+		return nil, nil, err
+	}
+	if metric.field == "active_users" {
+		return result.UserCount, result, nil
+	}
+	return result.EventCount, result, nil
+}
@@ -0,0 +1,315 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Default lifetime of public dashboard tokens when the request does not specify one
+const defaultPublicTokenTTL = 90 * 24 * time.Hour
+
+// DashboardWidgetSnapshot is the current value of a dashboard widget
+type DashboardWidgetSnapshot struct {
+	Title     string      `json:"title"`
+	Metric    string      `json:"metric,omitempty"`
+	QueryType string      `json:"query_type,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// dashboardSnapshot computes the current value of every widget of a dashboard
+func (s *App) dashboardSnapshot(ctx context.Context, dashboard *SavedDashboard, granularity string) []DashboardWidgetSnapshot {
+	ctx = ContextWithProject(ctx, dashboard.ProjectID)
+
+	snapshots := make([]DashboardWidgetSnapshot, 0, len(dashboard.Widgets))
+	for _, widget := range dashboard.Widgets {
+		snapshot := DashboardWidgetSnapshot{Title: widget.Title, Metric: widget.Metric}
+
+		if widget.Metric != "" {
+			result, err := s.dashboardService.metricValue(dashboard.ProjectID, widget.Metric, granularity)
+			if err != nil {
+				snapshot.Error = err.Error()
+			} else {
+				snapshot.Result = result
+			}
+		} else if query, err := s.savedQueryService.GetQuery(ctx, widget.QueryID); err != nil {
+			snapshot.Error = "query is no longer available"
+		} else {
+			snapshot.QueryType = query.Type
+			result, err := s.savedQueryService.RunQuery(ctx, query.ID)
+			if err != nil {
+				snapshot.Error = err.Error()
+			} else {
+				snapshot.Result = result
+			}
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots
+}
+
+// createDashboard handles saved dashboard creation requests
+func (s *App) createDashboard(c *fiber.Ctx) error {
+	var request dashboardRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// With ?upsert=true an existing dashboard with the same ID, or the same name when no ID is given, is replaced
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	var dashboard *SavedDashboard
+	var created bool
+	var err error
+	if c.QueryBool("upsert") {
+		dashboard, created, err = s.savedDashboardService.UpsertDashboard(ctx, request.ID, request.Name, request.Description, request.Widgets)
+	} else {
+		dashboard, created, err = s.savedDashboardService.CreateDashboardWithID(ctx, request.ID, request.Name, request.Description, request.Widgets)
+	}
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	message := "Dashboard saved successfully"
+	if !created {
+		message = "Dashboard already exists"
+	}
+
+	c.Set(fiber.HeaderETag, ETag(dashboard.Version))
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"dashboard": dashboard,
+		"created":   created,
+		"message":   message,
+	})
+}
+
+// dashboardRequest is the body of saved dashboard create and update requests
+type dashboardRequest struct {
+	ID          string            `json:"id"` // Optional client-supplied ID on creation
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Widgets     []DashboardWidget `json:"widgets"`
+}
+
+// listDashboards returns the saved dashboards of the project
+func (s *App) listDashboards(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"dashboards": s.savedDashboardService.ListDashboards(ctx),
+	})
+}
+
+// getDashboard retrieves a specific saved dashboard
+func (s *App) getDashboard(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	dashboard, err := s.savedDashboardService.GetDashboard(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, ETag(dashboard.Version))
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"dashboard": dashboard,
+	})
+}
+
+// updateDashboard replaces a saved dashboard, requiring If-Match with the version being updated. Dashboards
+// that do not exist yet may be created under the requested ID without If-Match.
+func (s *App) updateDashboard(c *fiber.Ctx) error {
+	var request dashboardRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	id := utils.CopyString(c.Params("id"))
+
+	if c.Get(fiber.HeaderIfMatch) == "" {
+		if _, err := s.savedDashboardService.GetDashboard(ctx, id); err != nil {
+			dashboard, created, err := s.savedDashboardService.CreateDashboardWithID(ctx, id, request.Name, request.Description, request.Widgets)
+			if err != nil {
+				return writeUpdateError(c, err, http.StatusBadRequest)
+			}
+
+			c.Set(fiber.HeaderETag, ETag(dashboard.Version))
+			return c.Status(createdStatus(created)).JSON(fiber.Map{
+				"status":    "success",
+				"dashboard": dashboard,
+				"created":   created,
+			})
+		}
+	}
+
+	expectedVersion, status, err := ifMatchVersion(c)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	dashboard, err := s.savedDashboardService.UpdateDashboard(ctx, id, request.Name, request.Description, request.Widgets, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, notFoundOrBadRequest(err))
+	}
+
+	c.Set(fiber.HeaderETag, ETag(dashboard.Version))
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"dashboard": dashboard,
+		"message":   "Dashboard updated successfully",
+	})
+}
+
+// deleteDashboard removes a saved dashboard
+func (s *App) deleteDashboard(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	if err := s.savedDashboardService.DeleteDashboard(ctx, c.Params("id")); err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Dashboard deleted successfully",
+	})
+}
+
+// getDashboardSnapshot returns the current widget values of a saved dashboard
+func (s *App) getDashboardSnapshot(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	dashboard, err := s.savedDashboardService.GetDashboard(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return s.writeDashboardSnapshot(c, dashboard)
+}
+
+// createPublicDashboardToken issues a public token for embedding a saved dashboard
+func (s *App) createPublicDashboardToken(c *fiber.Ctx) error {
+	var request struct {
+		Scopes []string `json:"scopes"`
+		TTL    string   `json:"ttl"` // Go duration, e.g. "720h"
+	}
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+
+	ttl := defaultPublicTokenTTL
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid ttl. Use a duration such as 24h",
+			})
+		}
+		ttl = parsed
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	token, expiresAt, err := s.savedDashboardService.CreatePublicToken(ctx, c.Params("id"), request.Scopes, ttl)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	s.siem.Export(requestSecurityEvent(c, SecurityExport, "public_dashboard_token_created", OutcomeSuccess, 4, map[string]interface{}{
+		"project_id": ProjectFromContext(ctx),
+		"scopes":     request.Scopes,
+		"expires_at": expiresAt,
+	}))
+
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"token":        token,
+		"snapshot_url": "/api/v1/public/dashboards/" + token + "/snapshot",
+		"stream_url":   "/api/v1/public/dashboards/" + token + "/stream",
+		"expires_at":   expiresAt,
+	})
+}
+
+// revokePublicDashboardTokens invalidates every public token of a saved dashboard
+func (s *App) revokePublicDashboardTokens(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	if err := s.savedDashboardService.RevokePublicTokens(ctx, c.Params("id")); err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Public tokens revoked",
+	})
+}
+
+// authorizePublicDashboard resolves the public token of the request for the scope and stores the dashboard in the "public_dashboard" local
+func (s *App) authorizePublicDashboard(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		dashboard, err := s.savedDashboardService.ResolvePublicToken(c.Params("token"), scope)
+		if err != nil {
+			event := requestSecurityEvent(c, SecurityAuth, "public_dashboard_token_rejected", OutcomeDenied, 5, map[string]interface{}{
+				"scope":  scope,
+				"reason": err.Error(),
+			})
+			event.Resource = c.Route().Path // Without the token
+			s.siem.Export(event)
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		c.Locals("public_dashboard", dashboard)
+		return c.Next()
+	}
+}
+
+// getPublicDashboardSnapshot returns the current widget values of an embedded dashboard
+func (s *App) getPublicDashboardSnapshot(c *fiber.Ctx) error {
+	dashboard := c.Locals("public_dashboard").(*SavedDashboard)
+	return s.writeDashboardSnapshot(c, dashboard)
+}
+
+// writeDashboardSnapshot responds with the dashboard's widget values, without its ID or project
+func (s *App) writeDashboardSnapshot(c *fiber.Ctx, dashboard *SavedDashboard) error {
+	granularity := c.Query("granularity", "1m")
+	if _, valid := dashboardGranularities[granularity]; !valid {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid granularity. Valid granularities are: 1m, 5m, 15m, 1h",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"dashboard": fiber.Map{
+			"name":        dashboard.Name,
+			"description": dashboard.Description,
+		},
+		"widgets":      s.dashboardSnapshot(c.Context(), dashboard, granularity),
+		"generated_at": time.Now(),
+	})
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/gofiber/contrib/websocket"
+)
+
+// WebSocket subprotocols of the dashboard feeds. Clients requesting none receive JSON.
+const (
+	DashboardProtocolJSON    = "analytics.v1.json"
+	DashboardProtocolMsgpack = "analytics.v1.msgpack" // Messages are MessagePack binary frames
+)
+
+// dashboardCompression configures permessage-deflate on dashboard connections
+type dashboardCompression struct {
+	enabled   bool
+	level     int
+	threshold int // Messages shorter than this many bytes are sent uncompressed
+}
+
+// newDashboardCompression reads the compression settings from the environment
+func newDashboardCompression() dashboardCompression {
+	level := getEnvInt("DASHBOARD_COMPRESSION_LEVEL", flate.BestSpeed)
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		log.Printf("Warning: Invalid value for DASHBOARD_COMPRESSION_LEVEL: %d, using default %d", level, flate.BestSpeed)
+		level = flate.BestSpeed
+	}
+	return dashboardCompression{
+		enabled:   os.Getenv("DASHBOARD_COMPRESSION") != "false",
+		level:     level,
+		threshold: getEnvInt("DASHBOARD_COMPRESSION_THRESHOLD", 256),
+	}
+}
+
+// WebSocketConfig returns the configuration of the dashboard feeds: the subprotocols clients can
+// negotiate and whether permessage-deflate is offered
+func (s *DashboardService) WebSocketConfig() websocket.Config {
+	return websocket.Config{
+		Subprotocols:      []string{DashboardProtocolMsgpack, DashboardProtocolJSON},
+		EnableCompression: s.compression.enabled,
+	}
+}
+
+// dashboardFrame is a JSON message to send, with its MessagePack encoding once a binary client
+// needed it, so a broadcast is re-encoded once for all of them. The clients' writers may encode it
+// concurrently.
+type dashboardFrame struct {
+	data    []byte
+	msgpack []byte
+	err     error
+	encode  sync.Once
+}
+
+// binary returns the MessagePack encoding of the frame
+func (f *dashboardFrame) binary() ([]byte, error) {
+	f.encode.Do(func() {
+		f.msgpack, f.err = MsgpackFromJSON(f.data)
+	})
+	return f.msgpack, f.err
+}
+
+// setupConnection applies the negotiated protocol and the compression level to a new client
+func (s *DashboardService) setupConnection(client *dashboardClient) {
+	client.binary = client.conn.Subprotocol() == DashboardProtocolMsgpack
+	client.compressFrom = s.compression.threshold
+	if s.compression.enabled {
+		if err := client.conn.SetCompressionLevel(s.compression.level); err != nil {
+			log.Printf("Error setting dashboard compression level: %v", err)
+		}
+	}
+}
+
+// writeFrame sends a message in the client's encoding. Short messages are not compressed, as
+// deflate does not make them smaller. Only the client's writer calls it, as connections do not
+// support concurrent writers.
+func (c *dashboardClient) writeFrame(frame *dashboardFrame) error {
+	messageType, data := websocket.TextMessage, frame.data
+	if c.binary {
+		packed, err := frame.binary()
+		if err != nil {
+			return err
+		}
+		messageType, data = websocket.BinaryMessage, packed
+	}
+
+	c.conn.EnableWriteCompression(len(data) >= c.compressFrom)
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// decodeClientMessage decodes a message from a client, JSON or MessagePack depending on its frame
+func decodeClientMessage(messageType int, message []byte) (map[string]interface{}, error) {
+	if messageType == websocket.BinaryMessage {
+		value, err := DecodeMsgpack(message)
+		if err != nil {
+			return nil, err
+		}
+		msg, _ := value.(map[string]interface{})
+		return msg, nil
+	}
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
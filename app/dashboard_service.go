@@ -11,15 +11,26 @@ import (
 
 // DashboardService provides real-time analytics data for dashboards
 type DashboardService struct {
-	clients    map[*websocket.Conn]bool
-	broadcast  chan interface{}
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
-	mutex      sync.RWMutex
+	clients        map[*websocket.Conn]*dashboardClient
+	broadcast      chan dashboardBroadcast
+	register       chan *dashboardClient
+	unregister     chan *websocket.Conn
+	history        map[string]*dashboardHistory // Recent broadcasts per project for resuming clients
+	historySize    int
+	metricProvider MetricProvider
+	aggregator     *MetricAggregator // Counts the events the default metric provider computes from
+	derived        *DerivedMetrics   // Metrics of funnels and segments, if set
+	profiles       *UserProfiles     // Lifecycle stages of the users, for segment channels
+	compression    dashboardCompression
+	queueSize      int // Messages queued per client before it is disconnected as too slow
+	maxChannels    int // Channels a client may subscribe to
+	mutex          sync.RWMutex
 }
 
 // DashboardMetric represents a real-time metric for dashboards
 type DashboardMetric struct {
+	Seq       uint64                 `json:"seq,omitempty"`
+	ProjectID string                 `json:"project_id,omitempty"`
 	Type      string                 `json:"type"`
 	Value     interface{}            `json:"value"`
 	Timestamp time.Time              `json:"timestamp"`
@@ -28,22 +39,94 @@ type DashboardMetric struct {
 
 // DashboardEvent represents a real-time event for dashboards
 type DashboardEvent struct {
+	Seq       uint64                 `json:"seq,omitempty"`
+	ProjectID string                 `json:"project_id,omitempty"`
 	EventType string                 `json:"event_type"`
 	UserID    string                 `json:"user_id"`
 	Data      map[string]interface{} `json:"data"`
 	Timestamp time.Time              `json:"timestamp"`
 }
 
+// DashboardResumeResult describes the outcome of replaying history to a reconnecting client
+type DashboardResumeResult struct {
+	Type      string `json:"type"`
+	FromSeq   uint64 `json:"from_seq"`
+	Replayed  int    `json:"replayed"`
+	OldestSeq uint64 `json:"oldest_seq"`
+	LatestSeq uint64 `json:"latest_seq"`
+	Truncated bool   `json:"truncated"` // Some requested messages were no longer buffered
+}
+
+// sequencedMessage is implemented by messages that carry a per-project sequence number
+type sequencedMessage interface {
+	withSequence(projectID string, seq uint64) interface{}
+}
+
+// dashboardBroadcast is a message queued for the clients of a project
+type dashboardBroadcast struct {
+	projectID string
+	message   sequencedMessage
+}
+
+// dashboardClient is a connected dashboard with its project and subscriptions
+type dashboardClient struct {
+	conn           *websocket.Conn
+	projectID      string
+	subscriptions  map[string]*dashboardSubscription // Metrics pushed on an interval
+	events         *eventBatch                       // Set when events are coalesced instead of sent one by one
+	channels       dashboardChannels                 // Set when only the broadcasts of some channels are wanted
+	public         bool                              // Embedded dashboards only see their metrics and aggregated event counts
+	allowedMetrics map[string]bool
+	binary         bool                 // Negotiated MessagePack instead of JSON
+	compressFrom   int                  // Messages shorter than this many bytes are sent uncompressed
+	queue          chan *dashboardFrame // Messages waiting for the client's writer
+	closed         chan struct{}
+	closeOnce      sync.Once
+	stateMu        sync.Mutex
+}
+
+// dashboardHistory is a ring buffer of recently broadcast messages
+type dashboardHistory struct {
+	entries []dashboardHistoryEntry
+	next    int // Index of the slot to overwrite next
+	lastSeq uint64
+}
+
+// dashboardHistoryEntry is a broadcast message kept for replay
+type dashboardHistoryEntry struct {
+	seq     uint64
+	data    []byte
+	message sequencedMessage // Matched against the channels of resuming clients
+}
+
 // NewDashboardService creates a new dashboard service instance
 func NewDashboardService() *DashboardService {
+	aggregator := NewMetricAggregator()
+	queueSize := getEnvInt("DASHBOARD_CLIENT_QUEUE_SIZE", 256)
+	if queueSize < 1 {
+		log.Printf("Warning: Invalid value for DASHBOARD_CLIENT_QUEUE_SIZE: %d, using default %d", queueSize, 256)
+		queueSize = 256
+	}
 	return &DashboardService{
-		clients:    make(map[*websocket.Conn]bool),
-		broadcast:  make(chan interface{}, 100),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
+		clients:        make(map[*websocket.Conn]*dashboardClient),
+		broadcast:      make(chan dashboardBroadcast, 100),
+		register:       make(chan *dashboardClient),
+		unregister:     make(chan *websocket.Conn),
+		history:        make(map[string]*dashboardHistory),
+		historySize:    getEnvInt("DASHBOARD_HISTORY_SIZE", 1000),
+		compression:    newDashboardCompression(),
+		queueSize:      queueSize,
+		maxChannels:    getEnvInt("DASHBOARD_MAX_CHANNELS", 100),
+		metricProvider: aggregator.Value,
+		aggregator:     aggregator,
 	}
 }
 
+// Aggregator returns the counters of the events metric values are computed from
+func (s *DashboardService) Aggregator() *MetricAggregator {
+	return s.aggregator
+}
+
 // Start begins the dashboard service
 func (s *DashboardService) Start() {
 	go s.run()
@@ -55,15 +138,17 @@ func (s *DashboardService) run() {
 		select {
 		case client := <-s.register:
 			s.mutex.Lock()
-			s.clients[client] = true
+			s.clients[client.conn] = client
+			count := len(s.clients)
 			s.mutex.Unlock()
-			log.Printf("Dashboard client connected. Total clients: %d", len(s.clients))
+			log.Printf("Dashboard client connected. Total clients: %d", count)
 
-		case client := <-s.unregister:
+		case conn := <-s.unregister:
 			s.mutex.Lock()
-			delete(s.clients, client)
+			delete(s.clients, conn)
+			count := len(s.clients)
 			s.mutex.Unlock()
-			log.Printf("Dashboard client disconnected. Total clients: %d", len(s.clients))
+			log.Printf("Dashboard client disconnected. Total clients: %d", count)
 
 		case message := <-s.broadcast:
 			s.broadcastToClients(message)
@@ -71,35 +156,110 @@ func (s *DashboardService) run() {
 	}
 }
 
-// broadcastToClients sends a message to all connected clients
-func (s *DashboardService) broadcastToClients(message interface{}) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+// broadcastToClients sequences a message, records it in the project history and queues it for the
+// project's clients subscribed to it
+func (s *DashboardService) broadcastToClients(broadcast dashboardBroadcast) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 
-	data, err := json.Marshal(message)
+	history := s.projectHistory(broadcast.projectID)
+	seq := history.lastSeq + 1
+
+	data, err := json.Marshal(broadcast.message.withSequence(broadcast.projectID, seq))
 	if err != nil {
 		log.Printf("Error marshaling message: %v", err)
 		return
 	}
 
-	for client := range s.clients {
-		err := client.WriteMessage(websocket.TextMessage, data)
-		if err != nil {
-			log.Printf("Error sending message to client: %v", err)
-			client.Close()
-			delete(s.clients, client)
+	history.append(seq, data, broadcast.message, s.historySize)
+	frame := &dashboardFrame{data: data}
+
+	event, isEvent := broadcast.message.(DashboardEvent)
+	segment := s.eventSegment(broadcast.message)
+	for conn, client := range s.clients {
+		if client.projectID != broadcast.projectID || !client.wants(broadcast.message, segment) {
+			continue
+		}
+
+		// Clients that asked for coalesced updates receive events in periodic batches
+		if isEvent && client.coalesceEvent(event, seq) {
+			continue
+		}
+		if !client.receives(broadcast.message) {
+			continue
+		}
+
+		// A client that does not keep up is disconnected rather than holding up the others; it
+		// can reconnect and resume from its last seq
+		if !client.enqueue(frame) {
+			log.Printf("Dashboard client of project %s is too slow, disconnecting", client.projectID)
+			client.close()
+			delete(s.clients, conn)
 		}
 	}
 }
 
+// projectHistory returns the history buffer for a project, creating it if needed. Callers must hold the lock.
+func (s *DashboardService) projectHistory(projectID string) *dashboardHistory {
+	history, exists := s.history[projectID]
+	if !exists {
+		history = &dashboardHistory{}
+		s.history[projectID] = history
+	}
+	return history
+}
+
 // HandleWebSocket handles WebSocket connections for real-time dashboard
 func (s *DashboardService) HandleWebSocket(c *websocket.Conn) {
+	s.serve(&dashboardClient{
+		conn:          c,
+		projectID:     c.Query("project_id", DefaultProjectID),
+		subscriptions: make(map[string]*dashboardSubscription),
+	})
+}
+
+// HandlePublicWebSocket serves an embedded dashboard, authorized beforehand and stored in the
+// "public_dashboard" local. The client only receives the dashboard's metrics and aggregated event counts.
+func (s *DashboardService) HandlePublicWebSocket(c *websocket.Conn) {
+	dashboard, ok := c.Locals("public_dashboard").(*SavedDashboard)
+	if !ok {
+		c.Close()
+		return
+	}
+
+	allowedMetrics := make(map[string]bool)
+	for _, metric := range dashboard.Metrics() {
+		allowedMetrics[metric] = true
+	}
+
+	s.serve(&dashboardClient{
+		conn:           c,
+		projectID:      dashboard.ProjectID,
+		subscriptions:  make(map[string]*dashboardSubscription),
+		public:         true,
+		allowedMetrics: allowedMetrics,
+	})
+}
+
+// serve registers a client and handles its messages until it disconnects
+func (s *DashboardService) serve(client *dashboardClient) {
+	c := client.conn
+	s.setupConnection(client)
+	client.queue = make(chan *dashboardFrame, s.queueSize)
+	client.closed = make(chan struct{})
+	go client.writeLoop()
+
 	// Register the client
-	s.register <- c
+	s.register <- client
+
+	// Push interval-based subscriptions until the client disconnects
+	done := make(chan struct{})
+	defer close(done)
+	go s.pushLoop(client, done)
 
 	// Handle incoming messages from client
 	for {
-		_, message, err := c.ReadMessage()
+		messageType, message, err := c.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
@@ -108,17 +268,18 @@ func (s *DashboardService) HandleWebSocket(c *websocket.Conn) {
 		}
 
 		// Handle client message (e.g., subscription to specific metrics)
-		s.handleClientMessage(c, message)
+		s.handleClientMessage(client, messageType, message)
 	}
 
 	// Unregister the client when done
 	s.unregister <- c
+	client.close()
 }
 
 // handleClientMessage processes messages from dashboard clients
-func (s *DashboardService) handleClientMessage(conn *websocket.Conn, message []byte) {
-	var msg map[string]interface{}
-	if err := json.Unmarshal(message, &msg); err != nil {
+func (s *DashboardService) handleClientMessage(client *dashboardClient, messageType int, message []byte) {
+	msg, err := decodeClientMessage(messageType, message)
+	if err != nil {
 		log.Printf("Error parsing client message: %v", err)
 		return
 	}
@@ -127,50 +288,112 @@ func (s *DashboardService) handleClientMessage(conn *websocket.Conn, message []b
 	if msgType, ok := msg["type"].(string); ok {
 		switch msgType {
 		case "subscribe":
-			if metric, ok := msg["metric"].(string); ok {
-				s.sendMetricUpdate(conn, metric)
+			if _, ok := msg["channels"]; ok {
+				s.subscribeChannels(client, msg)
+				return
 			}
+			s.subscribe(client, msg)
+		case "unsubscribe":
+			if _, ok := msg["channels"]; ok {
+				s.unsubscribeChannels(client, msg)
+				return
+			}
+			s.unsubscribe(client, msg)
+		case "resume":
+			// Replayed history contains raw events, which embedded dashboards must not see
+			if client.public {
+				client.writeJSON(map[string]string{"type": "error", "error": "resume is not available for public dashboards"})
+				return
+			}
+			fromSeq, _ := msg["from_seq"].(float64)
+			s.resumeClient(client, uint64(fromSeq))
 		case "ping":
 			// Respond to ping with pong
-			conn.WriteJSON(map[string]string{"type": "pong"})
+			client.writeJSON(map[string]string{"type": "pong"})
+		}
+	}
+}
+
+// resumeClient replays buffered messages from fromSeq onwards, of the client's channels if it has
+// any, before live updates continue
+func (s *DashboardService) resumeClient(client *dashboardClient, fromSeq uint64) {
+	// Hold the lock so no live broadcast is interleaved with the replay
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries, result := s.replay(client.projectID, fromSeq)
+	result.Replayed = 0
+	for _, entry := range entries {
+		if !client.wants(entry.message, s.eventSegment(entry.message)) {
+			continue
+		}
+		result.Replayed++
+		if err := client.write(entry.data); err != nil {
+			log.Printf("Error replaying message to client: %v", err)
+			return
 		}
 	}
+
+	client.writeJSON(result)
+}
+
+// Replay returns the buffered messages of a project with a sequence number of at least fromSeq
+func (s *DashboardService) Replay(projectID string, fromSeq uint64) ([]json.RawMessage, DashboardResumeResult) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entries, result := s.replay(projectID, fromSeq)
+	messages := make([]json.RawMessage, 0, len(entries))
+	for _, entry := range entries {
+		messages = append(messages, entry.data)
+	}
+	return messages, result
 }
 
-// sendMetricUpdate sends a specific metric update to a client
-func (s *DashboardService) sendMetricUpdate(conn *websocket.Conn, metric string) {
-	// Generate mock metric data for now
-	// In production, this would query real-time data sources
+// replay collects buffered messages for a project. Callers must hold the lock.
+func (s *DashboardService) replay(projectID string, fromSeq uint64) ([]dashboardHistoryEntry, DashboardResumeResult) {
+	result := DashboardResumeResult{Type: "resume.complete", FromSeq: fromSeq}
+
+	history, exists := s.history[projectID]
+	if !exists {
+		return nil, result
+	}
+
+	entries := history.since(fromSeq)
+	result.Replayed = len(entries)
+	result.LatestSeq = history.lastSeq
+	result.OldestSeq = history.oldestSeq()
+	result.Truncated = fromSeq < result.OldestSeq
+
+	return entries, result
+}
+
+// sendMetricUpdate sends a specific metric update, aggregated over the granularity window, to a client
+func (s *DashboardService) sendMetricUpdate(client *dashboardClient, metric, granularity string) {
+	value, err := s.metricValue(client.projectID, metric, granularity)
+	if err != nil {
+		client.writeJSON(map[string]string{"type": "error", "metric": metric, "error": err.Error()})
+		return
+	}
+
 	metricData := DashboardMetric{
+		ProjectID: client.projectID,
 		Type:      metric,
-		Value:     generateMockMetricValue(metric),
+		Value:     value,
 		Timestamp: time.Now(),
 		Metadata: map[string]interface{}{
-			"source": "analytics",
+			"source":      "analytics",
+			"granularity": granularity,
 		},
 	}
 
-	conn.WriteJSON(metricData)
+	client.writeJSON(metricData)
 }
 
-// generateMockMetricValue generates mock values for different metrics
-func generateMockMetricValue(metric string) interface{} {
-	switch metric {
-	case "total_events":
-		return 1234
-	case "active_users":
-		return 567
-	case "events_per_minute":
-		return 89
-	case "conversion_rate":
-		return 0.045
-	default:
-		return "N/A"
-	}
-}
-
-// BroadcastEvent broadcasts an analytics event to all dashboard clients
+// BroadcastEvent counts an analytics event in the live metrics and broadcasts it to the
+// dashboard clients of its project
 func (s *DashboardService) BroadcastEvent(event *AnalyticsEvent) {
+	s.aggregator.Record(event)
 	dashboardEvent := DashboardEvent{
 		EventType: event.EventType,
 		UserID:    event.UserID,
@@ -182,12 +405,43 @@ func (s *DashboardService) BroadcastEvent(event *AnalyticsEvent) {
 		Timestamp: event.Timestamp,
 	}
 
-	s.broadcast <- dashboardEvent
+	s.broadcast <- dashboardBroadcast{projectID: projectOrDefault(event.ProjectID), message: dashboardEvent}
 }
 
-// BroadcastMetric broadcasts a metric update to all dashboard clients
+// BroadcastMetric broadcasts a metric update to the dashboard clients of its project
 func (s *DashboardService) BroadcastMetric(metric DashboardMetric) {
-	s.broadcast <- metric
+	s.broadcast <- dashboardBroadcast{projectID: projectOrDefault(metric.ProjectID), message: metric}
+}
+
+// BroadcastHeatmapUpdated notifies the dashboard clients of a project that a heatmap was
+// regenerated. The message carries the heatmap's stats; clients fetch the data grid when needed.
+func (s *DashboardService) BroadcastHeatmapUpdated(heatmap *Heatmap) {
+	s.BroadcastMetric(DashboardMetric{
+		ProjectID: heatmap.ProjectID,
+		Type:      "heatmap.updated",
+		Value: map[string]interface{}{
+			"heatmap_id":   heatmap.ID,
+			"name":         heatmap.Name,
+			"page":         heatmap.Page,
+			"type":         heatmap.Type,
+			"stats":        heatmap.Stats,
+			"generated_at": heatmap.GeneratedAt,
+			"data_source":  heatmap.DataSource,
+		},
+		Timestamp: time.Now(),
+	})
+}
+
+// hasClients reports whether dashboards of a project are connected
+func (s *DashboardService) hasClients(projectID string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, client := range s.clients {
+		if client.projectID == projectID {
+			return true
+		}
+	}
+	return false
 }
 
 // GetConnectedClientsCount returns the number of connected dashboard clients
@@ -196,3 +450,92 @@ func (s *DashboardService) GetConnectedClientsCount() int {
 	defer s.mutex.RUnlock()
 	return len(s.clients)
 }
+
+// withSequence returns a copy of the event stamped with its project and sequence number
+func (e DashboardEvent) withSequence(projectID string, seq uint64) interface{} {
+	e.ProjectID = projectID
+	e.Seq = seq
+	return e
+}
+
+// withSequence returns a copy of the metric stamped with its project and sequence number
+func (m DashboardMetric) withSequence(projectID string, seq uint64) interface{} {
+	m.ProjectID = projectID
+	m.Seq = seq
+	return m
+}
+
+// receives reports whether a broadcast message is delivered to the client
+func (c *dashboardClient) receives(message sequencedMessage) bool {
+	if !c.public {
+		return true
+	}
+	metric, isMetric := message.(DashboardMetric)
+	return isMetric && c.allowedMetrics[metric.Type]
+}
+
+// allowsMetric reports whether the client may subscribe to a metric
+func (c *dashboardClient) allowsMetric(metric string) bool {
+	return !c.public || c.allowedMetrics[metric]
+}
+
+// write queues a JSON message for the client in its encoding
+func (c *dashboardClient) write(data []byte) error {
+	return c.send(&dashboardFrame{data: data})
+}
+
+// writeJSON queues a JSON-encoded value to the client in its encoding
+func (c *dashboardClient) writeJSON(v interface{}) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = c.write(data)
+	}
+	if err != nil {
+		log.Printf("Error sending message to client: %v", err)
+	}
+}
+
+// append records a message, overwriting the oldest entry once the buffer is full
+func (h *dashboardHistory) append(seq uint64, data []byte, message sequencedMessage, size int) {
+	h.lastSeq = seq
+	if size <= 0 {
+		return
+	}
+
+	entry := dashboardHistoryEntry{seq: seq, data: data, message: message}
+	if len(h.entries) < size {
+		h.entries = append(h.entries, entry)
+		return
+	}
+
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % size
+}
+
+// since returns buffered entries with a sequence number of at least fromSeq, oldest first
+func (h *dashboardHistory) since(fromSeq uint64) []dashboardHistoryEntry {
+	var entries []dashboardHistoryEntry
+	for i := 0; i < len(h.entries); i++ {
+		entry := h.entries[(h.next+i)%len(h.entries)]
+		if entry.seq >= fromSeq {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// oldestSeq returns the sequence number of the oldest buffered entry
+func (h *dashboardHistory) oldestSeq() uint64 {
+	if len(h.entries) == 0 {
+		return h.lastSeq + 1
+	}
+	return h.entries[h.next%len(h.entries)].seq
+}
+
+// projectOrDefault returns the project ID, or the default project when empty
+func projectOrDefault(projectID string) string {
+	if projectID == "" {
+		return DefaultProjectID
+	}
+	return projectID
+}
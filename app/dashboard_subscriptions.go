@@ -0,0 +1,267 @@
+package app
+
+import (
+	"fmt"
+	"time"
+)
+
+// Push intervals clients may request for their subscriptions
+var dashboardPushIntervals = map[string]time.Duration{
+	"1s":  time.Second,
+	"5s":  5 * time.Second,
+	"30s": 30 * time.Second,
+}
+
+// Aggregation windows clients may request for metric values
+var dashboardGranularities = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+}
+
+// MetricProvider computes the value of a dashboard metric for a project over an aggregation window
+type MetricProvider func(projectID, metric string, window time.Duration) interface{}
+
+// dashboardSubscription is a metric pushed to a client on an interval
+type dashboardSubscription struct {
+	metric      string
+	interval    time.Duration
+	granularity string
+	nextPush    time.Time
+}
+
+// DashboardEventBatch represents events coalesced over a push interval
+type DashboardEventBatch struct {
+	Type        string           `json:"type"`
+	ProjectID   string           `json:"project_id"`
+	Count       int64            `json:"count"`
+	ByType      map[string]int64 `json:"by_type"`
+	FirstSeq    uint64           `json:"first_seq"`
+	LastSeq     uint64           `json:"last_seq"`
+	WindowStart time.Time        `json:"window_start"`
+	WindowEnd   time.Time        `json:"window_end"`
+}
+
+// eventBatch accumulates events for a client that asked for coalesced updates
+type eventBatch struct {
+	interval time.Duration
+	nextPush time.Time
+	pending  *DashboardEventBatch
+}
+
+// parseSubscriptionOptions validates the interval and granularity of a subscribe message
+func parseSubscriptionOptions(msg map[string]interface{}) (time.Duration, string, error) {
+	var interval time.Duration
+	if value, ok := msg["interval"].(string); ok && value != "" {
+		parsed, valid := dashboardPushIntervals[value]
+		if !valid {
+			return 0, "", fmt.Errorf("invalid interval: %s. Valid intervals are: 1s, 5s, 30s", value)
+		}
+		interval = parsed
+	}
+
+	granularity := "1m"
+	if value, ok := msg["granularity"].(string); ok && value != "" {
+		if _, valid := dashboardGranularities[value]; !valid {
+			return 0, "", fmt.Errorf("invalid granularity: %s. Valid granularities are: 1m, 5m, 15m, 1h", value)
+		}
+		granularity = value
+	}
+
+	return interval, granularity, nil
+}
+
+// subscribe handles a metric or event-stream subscription from a client
+func (s *DashboardService) subscribe(client *dashboardClient, msg map[string]interface{}) {
+	interval, granularity, err := parseSubscriptionOptions(msg)
+	if err != nil {
+		client.writeJSON(map[string]string{"type": "error", "error": err.Error()})
+		return
+	}
+
+	// Coalesce live events into periodic batches
+	if stream, _ := msg["stream"].(string); stream == "events" {
+		client.stateMu.Lock()
+		if interval > 0 {
+			client.events = &eventBatch{interval: interval, nextPush: time.Now().Add(interval)}
+		} else {
+			client.events = nil
+		}
+		client.stateMu.Unlock()
+
+		client.writeJSON(map[string]interface{}{
+			"type":     "subscribed",
+			"stream":   "events",
+			"interval": interval.String(),
+		})
+		return
+	}
+
+	metric, ok := msg["metric"].(string)
+	if !ok || metric == "" {
+		client.writeJSON(map[string]string{"type": "error", "error": "metric or stream is required"})
+		return
+	}
+	if !client.allowsMetric(metric) {
+		client.writeJSON(map[string]string{"type": "error", "error": "metric is not available on this dashboard"})
+		return
+	}
+	if err := s.validateMetric(client.projectID, metric); err != nil {
+		client.writeJSON(map[string]string{"type": "error", "metric": metric, "error": err.Error()})
+		return
+	}
+
+	// Without an interval the metric is sent once, as before
+	if interval > 0 {
+		client.stateMu.Lock()
+		client.subscriptions[metric] = &dashboardSubscription{
+			metric:      metric,
+			interval:    interval,
+			granularity: granularity,
+			nextPush:    time.Now().Add(interval),
+		}
+		client.stateMu.Unlock()
+
+		client.writeJSON(map[string]interface{}{
+			"type":        "subscribed",
+			"metric":      metric,
+			"interval":    interval.String(),
+			"granularity": granularity,
+		})
+	}
+
+	s.sendMetricUpdate(client, metric, granularity)
+}
+
+// unsubscribe stops periodic pushes of a metric or coalesced events
+func (s *DashboardService) unsubscribe(client *dashboardClient, msg map[string]interface{}) {
+	client.stateMu.Lock()
+	defer client.stateMu.Unlock()
+
+	if stream, _ := msg["stream"].(string); stream == "events" {
+		client.events = nil
+		return
+	}
+	if metric, ok := msg["metric"].(string); ok {
+		delete(client.subscriptions, metric)
+	}
+}
+
+// pushLoop sends due metric updates and event batches until the client disconnects
+func (s *DashboardService) pushLoop(client *dashboardClient, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			s.pushDue(client, now)
+		}
+	}
+}
+
+// pushDue sends every subscription and event batch whose interval has elapsed
+func (s *DashboardService) pushDue(client *dashboardClient, now time.Time) {
+	client.stateMu.Lock()
+	var due []*dashboardSubscription
+	for _, subscription := range client.subscriptions {
+		if !now.Before(subscription.nextPush) {
+			due = append(due, subscription)
+			subscription.nextPush = subscription.nextPush.Add(subscription.interval)
+			if subscription.nextPush.Before(now) {
+				subscription.nextPush = now.Add(subscription.interval)
+			}
+		}
+	}
+
+	var batch *DashboardEventBatch
+	if client.events != nil && !now.Before(client.events.nextPush) {
+		batch = client.events.pending
+		client.events.pending = nil
+		client.events.nextPush = now.Add(client.events.interval)
+	}
+	client.stateMu.Unlock()
+
+	for _, subscription := range due {
+		s.sendMetricUpdate(client, subscription.metric, subscription.granularity)
+	}
+
+	if batch != nil {
+		batch.WindowEnd = now
+		client.writeJSON(batch)
+	}
+}
+
+// coalesceEvent adds an event to the client's pending batch. It returns false if the client wants every event.
+func (c *dashboardClient) coalesceEvent(event DashboardEvent, seq uint64) bool {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	if c.events == nil {
+		return false
+	}
+
+	if c.events.pending == nil {
+		c.events.pending = &DashboardEventBatch{
+			Type:        "events.batch",
+			ProjectID:   c.projectID,
+			ByType:      make(map[string]int64),
+			FirstSeq:    seq,
+			WindowStart: time.Now(),
+		}
+	}
+
+	batch := c.events.pending
+	batch.Count++
+	batch.ByType[event.EventType]++
+	batch.LastSeq = seq
+	return true
+}
+
+// SetMetricProvider replaces the source of dashboard metric values
+func (s *DashboardService) SetMetricProvider(provider MetricProvider) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.metricProvider = provider
+}
+
+// SetDerivedMetrics serves the metrics derived from funnels and segments, e.g. funnel:<id>:conversion_rate
+func (s *DashboardService) SetDerivedMetrics(derived *DerivedMetrics) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.derived = derived
+}
+
+// validateMetric checks that a derived metric refers to a funnel or segment of the project
+func (s *DashboardService) validateMetric(projectID, metric string) error {
+	if _, derived, err := parseDerivedMetric(metric); !derived || err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	derived := s.derived
+	s.mutex.RUnlock()
+	if derived == nil {
+		return fmt.Errorf("derived metrics are not available")
+	}
+	return derived.Validate(projectID, metric)
+}
+
+// metricValue computes a metric value for the given granularity
+func (s *DashboardService) metricValue(projectID, metric, granularity string) (interface{}, error) {
+	s.mutex.RLock()
+	provider := s.metricProvider
+	derived := s.derived
+	s.mutex.RUnlock()
+
+	if _, isDerived, _ := parseDerivedMetric(metric); isDerived {
+		if derived == nil {
+			return nil, fmt.Errorf("derived metrics are not available")
+		}
+		return derived.Value(projectID, metric, granularity)
+	}
+	return provider(projectID, metric, dashboardGranularities[granularity]), nil
+}
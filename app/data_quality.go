@@ -0,0 +1,563 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Types of data quality monitors
+const (
+	MonitorEventDisappeared = "event_disappeared" // An event type usually sent is no longer sent at all
+	MonitorNullRate         = "null_rate"         // A property is missing or null in too many events of a type
+	MonitorVolumeBand       = "volume_band"       // The events of a type, or all events, are outside an expected band
+)
+
+// monitorTypes lists every monitor type, in the order they are documented
+var monitorTypes = []string{MonitorEventDisappeared, MonitorNullRate, MonitorVolumeBand}
+
+// Maximum number of data quality monitors of a project
+const maxMonitorsPerProject = 50
+
+// DataQualityMonitor checks the events a project sends for a sign of broken instrumentation
+type DataQualityMonitor struct {
+	Name        string  `json:"name"`
+	Type        string  `json:"type"`
+	EventType   string  `json:"event_type,omitempty"`    // As sent; every event type of volume bands when empty
+	Property    string  `json:"property,omitempty"`      // Property checked by null rate monitors
+	MaxNullRate float64 `json:"max_null_rate,omitempty"` // Share of events without the property above which it alerts
+	MinEvents   int64   `json:"min_events,omitempty"`    // Events of a window (or of the baseline of disappearances) below which nothing alerts
+	Min         *int64  `json:"min,omitempty"`           // Fewest events per window of a volume band
+	Max         *int64  `json:"max,omitempty"`           // Most events per window of a volume band
+	Tolerance   float64 `json:"tolerance,omitempty"`     // Band around the baseline of volume bands without min and max
+}
+
+// ProjectMonitors are the data quality monitors of a project
+type ProjectMonitors struct {
+	Monitors []DataQualityMonitor `json:"monitors"` // Ordered by name
+	Version  int64                `json:"version"`  // Incremented on every update, exposed as the ETag
+}
+
+// DataQualityAlert is a monitor of a project that found a problem in the events of a window
+type DataQualityAlert struct {
+	ID          string     `json:"id"`
+	Monitor     string     `json:"monitor"`
+	Type        string     `json:"type"`
+	ProjectID   string     `json:"project_id"`
+	EventType   string     `json:"event_type,omitempty"`
+	Property    string     `json:"property,omitempty"`
+	Events      int64      `json:"events"`                 // Events checked in the last window the problem held
+	NullRate    float64    `json:"null_rate,omitempty"`    // Share of them without the property
+	Baseline    float64    `json:"baseline,omitempty"`     // Usual events per window
+	ExpectedMin *float64   `json:"expected_min,omitempty"` // Band the events were expected in
+	ExpectedMax *float64   `json:"expected_max,omitempty"`
+	FiredAt     time.Time  `json:"fired_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+}
+
+// DataQualityAlertReport lists the data quality alerts firing and the ones resolved recently
+type DataQualityAlertReport struct {
+	Window   string             `json:"window"`
+	Firing   []DataQualityAlert `json:"firing"`
+	Resolved []DataQualityAlert `json:"resolved"` // Most recent first
+}
+
+// isDataQualityAlert reports whether a payload is a data quality alert
+func isDataQualityAlert(payload interface{}) bool {
+	alert, ok := payload.(*DataQualityAlert)
+	return ok && alert != nil
+}
+
+// copy returns a copy of the monitors, so callers cannot modify the ones in effect
+func (m *ProjectMonitors) copy() *ProjectMonitors {
+	monitors := make([]DataQualityMonitor, len(m.Monitors))
+	copy(monitors, m.Monitors)
+	return &ProjectMonitors{Monitors: monitors, Version: m.Version}
+}
+
+// band returns the events per window a volume band expects, given the baseline if there is one
+func (m DataQualityMonitor) band(baseline float64, hasBaseline bool) (lower, upper float64, ok bool) {
+	if m.Min != nil || m.Max != nil {
+		lower, upper = 0, math.Inf(1)
+		if m.Min != nil {
+			lower = float64(*m.Min)
+		}
+		if m.Max != nil {
+			upper = float64(*m.Max)
+		}
+		return lower, upper, true
+	}
+	if !hasBaseline || baseline < float64(m.MinEvents) {
+		return 0, 0, false
+	}
+	return baseline * (1 - m.Tolerance), baseline * (1 + m.Tolerance), true
+}
+
+// dataQualityCounts counts the events a monitor checked in a window
+type dataQualityCounts struct {
+	events int64
+	nulls  int64
+}
+
+// dataQualityWindow counts the events received in a window, by monitor
+type dataQualityWindow struct {
+	start  time.Time
+	warmup bool // First window of the monitors, which only sets baselines
+	counts map[string]*dataQualityCounts
+}
+
+// DataQualityMonitors check the events projects send for signs of broken instrumentation, so it
+// is caught before weekly reports are wrong: an event type that disappears, a property that is
+// suddenly missing from many events, or a volume of events outside an expected band. Events are
+// counted in fixed windows; when a window closes, every monitor is evaluated over it.
+// Disappearances and volume bands without explicit bounds are measured against a moving average
+// of the events per window, which is not updated while the monitor fires; the first window, and
+// the first window of a monitor added during it, only set baselines. Alerts fire once and resolve
+// after a window in which the problem no longer holds; both are logged and published on the
+// event bus. Windows close on the first observation, report or metrics scrape after they end.
+type DataQualityMonitors struct {
+	window      time.Duration
+	maxResolved int
+
+	projects  map[string]*ProjectMonitors // Replaced, never modified
+	added     map[string]time.Time        // When each monitor was added, by monitor key
+	current   *dataQualityWindow
+	baselines map[string]float64 // Moving average of events per window, by monitor key
+	firing    map[string]*DataQualityAlert
+	resolved  []DataQualityAlert // Oldest first
+	fired     map[string]int64   // Alerts fired by monitor type
+	bus       *EventBus
+	clock     Clock
+	mutex     sync.Mutex
+}
+
+// NewDataQualityMonitors creates monitors evaluated every DATA_QUALITY_WINDOW (default 1h)
+func NewDataQualityMonitors() *DataQualityMonitors {
+	window := getEnvDuration("DATA_QUALITY_WINDOW", time.Hour)
+	if window <= 0 {
+		window = time.Hour
+	}
+	monitors := &DataQualityMonitors{
+		window:      window,
+		maxResolved: 100,
+		projects:    make(map[string]*ProjectMonitors),
+		added:       make(map[string]time.Time),
+		baselines:   make(map[string]float64),
+		firing:      make(map[string]*DataQualityAlert),
+		fired:       make(map[string]int64),
+		clock:       SystemClock(),
+	}
+	monitors.current = monitors.newWindow(monitors.clock.Now())
+	monitors.current.warmup = true
+	return monitors
+}
+
+// SetClock replaces the clock windows are measured with, starting a new window
+func (m *DataQualityMonitors) SetClock(clock Clock) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.clock = clock
+	m.current = m.newWindow(clock.Now())
+	m.current.warmup = true
+}
+
+// SetBus publishes fired and resolved alerts on TopicDataQualityAlert
+func (m *DataQualityMonitors) SetBus(bus *EventBus) {
+	m.bus = bus
+}
+
+// Get returns the monitors of a project
+func (m *DataQualityMonitors) Get(projectID string) *ProjectMonitors {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	monitors, exists := m.projects[projectID]
+	if !exists {
+		return &ProjectMonitors{Monitors: []DataQualityMonitor{}}
+	}
+	return monitors.copy()
+}
+
+// Replace replaces the monitors of a project. The update is rejected with a VersionConflictError
+// unless expectedVersion is the current version (0 for a project without monitors). Monitors kept
+// unchanged keep their baseline; the alerts of removed monitors resolve when the window closes.
+func (m *DataQualityMonitors) Replace(projectID string, monitors []DataQualityMonitor, expectedVersion int64) (*ProjectMonitors, error) {
+	monitors, err := normalizeMonitors(monitors)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.roll(m.clock.Now())
+
+	var current int64
+	existing := make(map[string]DataQualityMonitor)
+	if previous, exists := m.projects[projectID]; exists {
+		current = previous.Version
+		for _, monitor := range previous.Monitors {
+			existing[monitor.Name] = monitor
+		}
+	}
+	if err := checkVersion("monitors", projectID, current, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	// A changed monitor starts over, as its baseline counted other events
+	now := m.clock.Now()
+	for _, monitor := range monitors {
+		key := monitorKey(projectID, monitor.Name)
+		if previous, exists := existing[monitor.Name]; exists && sameMonitor(previous, monitor) {
+			delete(existing, monitor.Name)
+			continue
+		}
+		delete(m.baselines, key)
+		delete(m.current.counts, key)
+		m.added[key] = now
+	}
+	for name := range existing {
+		key := monitorKey(projectID, name)
+		delete(m.baselines, key)
+		delete(m.current.counts, key)
+		delete(m.added, key)
+	}
+
+	updated := &ProjectMonitors{Monitors: monitors, Version: current + 1}
+	projects := make(map[string]*ProjectMonitors, len(m.projects)+1)
+	for id, existing := range m.projects {
+		projects[id] = existing
+	}
+	projects[projectID] = updated
+	m.projects = projects
+
+	return updated.copy(), nil
+}
+
+// Observe counts a received event for the monitors of its project
+func (m *DataQualityMonitors) Observe(event *AnalyticsEvent) {
+	projectID := projectOrDefault(event.ProjectID)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.roll(m.clock.Now())
+
+	monitors, exists := m.projects[projectID]
+	if !exists {
+		return
+	}
+	for _, monitor := range monitors.Monitors {
+		if monitor.EventType != "" && monitor.EventType != event.EventType {
+			continue
+		}
+		// Aggregation-only events have no properties to check
+		if monitor.Type == MonitorNullRate && event.Aggregated {
+			continue
+		}
+
+		key := monitorKey(projectID, monitor.Name)
+		counts, exists := m.current.counts[key]
+		if !exists {
+			counts = &dataQualityCounts{}
+			m.current.counts[key] = counts
+		}
+		counts.events++
+		if monitor.Type == MonitorNullRate && isNullProperty(event.Properties, monitor.Property) {
+			counts.nulls++
+		}
+	}
+}
+
+// Alerts returns the alerts of a project (of every project when empty) firing, oldest first, and
+// the ones resolved recently
+func (m *DataQualityMonitors) Alerts(projectID string) *DataQualityAlertReport {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.roll(m.clock.Now())
+
+	report := &DataQualityAlertReport{
+		Window:   m.window.String(),
+		Firing:   make([]DataQualityAlert, 0),
+		Resolved: make([]DataQualityAlert, 0),
+	}
+	for _, alert := range m.firing {
+		if projectID == "" || alert.ProjectID == projectID {
+			report.Firing = append(report.Firing, *alert)
+		}
+	}
+	sort.Slice(report.Firing, func(i, j int) bool {
+		if !report.Firing[i].FiredAt.Equal(report.Firing[j].FiredAt) {
+			return report.Firing[i].FiredAt.Before(report.Firing[j].FiredAt)
+		}
+		return monitorKey(report.Firing[i].ProjectID, report.Firing[i].Monitor) < monitorKey(report.Firing[j].ProjectID, report.Firing[j].Monitor)
+	})
+	for i := len(m.resolved) - 1; i >= 0; i-- {
+		if projectID == "" || m.resolved[i].ProjectID == projectID {
+			report.Resolved = append(report.Resolved, m.resolved[i])
+		}
+	}
+	return report
+}
+
+// WriteMetrics writes the alerts firing and fired by monitor type in the Prometheus text
+// exposition format
+func (m *DataQualityMonitors) WriteMetrics(w io.Writer) error {
+	m.mutex.Lock()
+	m.roll(m.clock.Now())
+	firing := make(map[string]int, len(monitorTypes))
+	for _, alert := range m.firing {
+		firing[alert.Type]++
+	}
+	fired := make(map[string]int64, len(m.fired))
+	for monitorType, count := range m.fired {
+		fired[monitorType] = count
+	}
+	m.mutex.Unlock()
+
+	if _, err := fmt.Fprint(w, "# HELP analytics_data_quality_alerts_firing Data quality alerts currently firing, by monitor type.\n# TYPE analytics_data_quality_alerts_firing gauge\n"); err != nil {
+		return err
+	}
+	for _, monitorType := range monitorTypes {
+		if _, err := fmt.Fprintf(w, "analytics_data_quality_alerts_firing{type=%q} %d\n", monitorType, firing[monitorType]); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(w, "# HELP analytics_data_quality_alerts_total Data quality alerts fired, by monitor type.\n# TYPE analytics_data_quality_alerts_total counter\n"); err != nil {
+		return err
+	}
+	for _, monitorType := range monitorTypes {
+		if _, err := fmt.Fprintf(w, "analytics_data_quality_alerts_total{type=%q} %d\n", monitorType, fired[monitorType]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newWindow returns an empty window holding the given time
+func (m *DataQualityMonitors) newWindow(now time.Time) *dataQualityWindow {
+	return &dataQualityWindow{
+		start:  now.Truncate(m.window),
+		counts: make(map[string]*dataQualityCounts),
+	}
+}
+
+// roll closes the current window once the given time is past it, evaluating the monitors over
+// it. When no event arrived for a whole window since, an empty window is evaluated too, so an
+// event type that stopped being sent is caught.
+func (m *DataQualityMonitors) roll(now time.Time) {
+	end := m.current.start.Add(m.window)
+	if now.Before(end) {
+		return
+	}
+	closed := m.current
+	m.current = m.newWindow(now)
+	m.evaluate(closed, end)
+	if !now.Before(end.Add(m.window)) {
+		m.evaluate(&dataQualityWindow{start: end, counts: make(map[string]*dataQualityCounts)}, end.Add(m.window))
+	}
+}
+
+// evaluate fires the alerts of the monitors that found a problem in a closed window and resolves
+// the ones firing that no longer do
+func (m *DataQualityMonitors) evaluate(window *dataQualityWindow, end time.Time) {
+	held := make(map[string]bool)
+
+	for projectID, monitors := range m.projects {
+		for _, monitor := range monitors.Monitors {
+			key := monitorKey(projectID, monitor.Name)
+			counts := window.counts[key]
+			if counts == nil {
+				counts = &dataQualityCounts{}
+			}
+			// Windows the monitor did not count whole only set its baseline if it has none
+			partial := window.warmup || m.added[key].After(window.start)
+			baseline, hasBaseline := m.baselines[key]
+			alert := DataQualityAlert{
+				Monitor:   monitor.Name,
+				Type:      monitor.Type,
+				ProjectID: projectID,
+				EventType: monitor.EventType,
+				Property:  monitor.Property,
+				Events:    counts.events,
+			}
+
+			problem := false
+			switch monitor.Type {
+			case MonitorNullRate:
+				if counts.events > 0 {
+					alert.NullRate = float64(counts.nulls) / float64(counts.events)
+				}
+				problem = counts.events >= monitor.MinEvents && alert.NullRate > monitor.MaxNullRate
+			case MonitorEventDisappeared:
+				alert.Baseline = baseline
+				problem = !partial && hasBaseline && baseline >= float64(monitor.MinEvents) && counts.events == 0
+			case MonitorVolumeBand:
+				alert.Baseline = baseline
+				lower, upper, ok := monitor.band(baseline, hasBaseline)
+				if ok && !partial {
+					problem = float64(counts.events) < lower || float64(counts.events) > upper
+					alert.ExpectedMin = &lower
+					if !math.IsInf(upper, 1) {
+						alert.ExpectedMax = &upper
+					}
+				}
+			}
+
+			if problem {
+				held[key] = true
+				m.hold(key, alert, end)
+				continue
+			}
+			if monitor.Type == MonitorNullRate || (partial && hasBaseline) {
+				continue
+			}
+			// Only windows without a problem move the baseline, by a fifth of the difference
+			if !hasBaseline {
+				m.baselines[key] = float64(counts.events)
+			} else {
+				m.baselines[key] = baseline + 0.2*(float64(counts.events)-baseline)
+			}
+		}
+	}
+
+	for key, alert := range m.firing {
+		if held[key] {
+			continue
+		}
+		delete(m.firing, key)
+		resolvedAt := end
+		alert.ResolvedAt = &resolvedAt
+		m.resolved = append(m.resolved, *alert)
+		if len(m.resolved) > m.maxResolved {
+			m.resolved = m.resolved[len(m.resolved)-m.maxResolved:]
+		}
+		m.notify(alert, OutcomeResolved)
+	}
+}
+
+// hold fires an alert whose problem holds, or updates the counts of the alert already firing
+func (m *DataQualityMonitors) hold(key string, alert DataQualityAlert, end time.Time) {
+	if firing, exists := m.firing[key]; exists {
+		firing.Events = alert.Events
+		firing.NullRate = alert.NullRate
+		return
+	}
+
+	alert.ID = uuid.New().String()
+	alert.FiredAt = end
+	m.firing[key] = &alert
+	m.fired[alert.Type]++
+	m.notify(&alert, OutcomeDetected)
+}
+
+// notify sends a fired or resolved alert to the log and the event bus
+func (m *DataQualityMonitors) notify(alert *DataQualityAlert, outcome string) {
+	log.Printf("Warning: Data quality alert %s (%s) %s for project %s: %d events in the window ending %s",
+		alert.Monitor, alert.Type, outcome, alert.ProjectID, alert.Events, alert.FiredAt.Format(time.RFC3339))
+
+	// Subscribers get a copy, as the alert keeps changing while it fires
+	published := *alert
+	if m.bus != nil {
+		if err := m.bus.Publish(TopicDataQualityAlert, &published); err != nil {
+			log.Printf("Warning: Failed to publish data quality alert: %v", err)
+		}
+	}
+}
+
+// normalizeMonitors validates monitors and fills in their defaults, ordered by name
+func normalizeMonitors(monitors []DataQualityMonitor) ([]DataQualityMonitor, error) {
+	if len(monitors) > maxMonitorsPerProject {
+		return nil, fmt.Errorf("a project can have at most %d monitors", maxMonitorsPerProject)
+	}
+
+	normalized := make([]DataQualityMonitor, 0, len(monitors))
+	seen := make(map[string]bool)
+	for _, monitor := range monitors {
+		if monitor.Name == "" {
+			return nil, fmt.Errorf("monitors require a name")
+		}
+		if seen[monitor.Name] {
+			return nil, fmt.Errorf("duplicate monitor %s", monitor.Name)
+		}
+		seen[monitor.Name] = true
+		if monitor.MinEvents < 0 {
+			return nil, fmt.Errorf("min_events of %s must not be negative", monitor.Name)
+		}
+
+		switch monitor.Type {
+		case MonitorEventDisappeared:
+			if monitor.EventType == "" {
+				return nil, fmt.Errorf("monitor %s requires an event_type", monitor.Name)
+			}
+			if monitor.MinEvents == 0 {
+				monitor.MinEvents = 10
+			}
+		case MonitorNullRate:
+			if monitor.EventType == "" || monitor.Property == "" {
+				return nil, fmt.Errorf("monitor %s requires an event_type and a property", monitor.Name)
+			}
+			if monitor.MaxNullRate <= 0 || monitor.MaxNullRate >= 1 {
+				return nil, fmt.Errorf("max_null_rate of %s must be between 0 and 1, exclusive, got %v", monitor.Name, monitor.MaxNullRate)
+			}
+			if monitor.MinEvents == 0 {
+				monitor.MinEvents = 20
+			}
+		case MonitorVolumeBand:
+			if monitor.Min != nil && *monitor.Min < 0 {
+				return nil, fmt.Errorf("min of %s must not be negative", monitor.Name)
+			}
+			if monitor.Min != nil && monitor.Max != nil && *monitor.Max < *monitor.Min {
+				return nil, fmt.Errorf("max of %s must not be below its min", monitor.Name)
+			}
+			if monitor.Min == nil && monitor.Max == nil {
+				if monitor.Tolerance == 0 {
+					monitor.Tolerance = 0.5
+				}
+				if monitor.Tolerance < 0 || monitor.Tolerance > 1 {
+					return nil, fmt.Errorf("tolerance of %s must be between 0 and 1, got %v", monitor.Name, monitor.Tolerance)
+				}
+			} else if monitor.Tolerance != 0 {
+				return nil, fmt.Errorf("tolerance of %s only applies without min and max", monitor.Name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid type for %s: %s. Valid types are: %s, %s, %s", monitor.Name, monitor.Type, MonitorEventDisappeared, MonitorNullRate, MonitorVolumeBand)
+		}
+		if monitor.Type != MonitorNullRate && (monitor.Property != "" || monitor.MaxNullRate != 0) {
+			return nil, fmt.Errorf("property and max_null_rate of %s require the %s type", monitor.Name, MonitorNullRate)
+		}
+		if monitor.Type != MonitorVolumeBand && (monitor.Min != nil || monitor.Max != nil || monitor.Tolerance != 0) {
+			return nil, fmt.Errorf("min, max and tolerance of %s require the %s type", monitor.Name, MonitorVolumeBand)
+		}
+		normalized = append(normalized, monitor)
+	}
+
+	sort.Slice(normalized, func(i, j int) bool { return normalized[i].Name < normalized[j].Name })
+	return normalized, nil
+}
+
+// sameMonitor reports whether two monitors check the same thing the same way
+func sameMonitor(a, b DataQualityMonitor) bool {
+	sameBound := func(x, y *int64) bool { return (x == nil) == (y == nil) && (x == nil || *x == *y) }
+	return a.Type == b.Type && a.EventType == b.EventType && a.Property == b.Property && a.MaxNullRate == b.MaxNullRate &&
+		a.MinEvents == b.MinEvents && a.Tolerance == b.Tolerance && sameBound(a.Min, b.Min) && sameBound(a.Max, b.Max)
+}
+
+// isNullProperty reports whether a property is missing, null or an empty string
+func isNullProperty(properties map[string]interface{}, name string) bool {
+	value, exists := properties[name]
+	return !exists || value == nil || value == ""
+}
+
+// monitorKey identifies a monitor of a project
+func monitorKey(projectID, name string) string {
+	return projectID + "\x00" + name
+}
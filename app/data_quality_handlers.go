@@ -0,0 +1,63 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getProjectMonitors returns the data quality monitors of a project with their version as the
+// ETag, and the project's alerts firing and resolved recently
+func (s *App) getProjectMonitors(c *fiber.Ctx) error {
+	quality := s.analyticsService.DataQuality()
+	monitors := quality.Get(c.Params("id"))
+
+	c.Set(fiber.HeaderETag, ETag(monitors.Version))
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"monitors": monitors,
+		"alerts":   quality.Alerts(c.Params("id")),
+	})
+}
+
+// updateProjectMonitors replaces the data quality monitors of a project. Replacing existing
+// monitors requires If-Match with the version being updated.
+func (s *App) updateProjectMonitors(c *fiber.Ctx) error {
+	var request struct {
+		Monitors []DataQualityMonitor `json:"monitors"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	quality := s.analyticsService.DataQuality()
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first monitors of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if quality.Get(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := quality.Replace(projectID, request.Monitors, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"monitors": updated,
+	})
+}
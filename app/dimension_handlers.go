@@ -0,0 +1,75 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getProjectDimensions returns the custom dimensions of a project with their version as the ETag
+func (s *App) getProjectDimensions(c *fiber.Ctx) error {
+	dimensions := s.analyticsService.Dimensions().Get(c.Params("id"))
+
+	c.Set(fiber.HeaderETag, ETag(dimensions.Version))
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"dimensions": dimensions,
+	})
+}
+
+// updateProjectDimensions replaces the custom dimensions of a project. Replacing existing
+// dimensions requires If-Match with the version being updated.
+func (s *App) updateProjectDimensions(c *fiber.Ctx) error {
+	var request struct {
+		Dimensions []CustomDimension `json:"dimensions"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	registry := s.analyticsService.Dimensions()
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first dimensions of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if registry.Get(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := registry.Replace(projectID, request.Dimensions, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"dimensions": updated,
+	})
+}
+
+// getDimensionValues returns the indexed values of a project's dimension, most frequent first
+func (s *App) getDimensionValues(c *fiber.Ctx) error {
+	values, err := s.analyticsService.Dimensions().Values(c.Params("id"), c.Params("name"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"values": values,
+	})
+}
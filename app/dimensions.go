@@ -0,0 +1,321 @@
+package app
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Types of custom dimension values
+const (
+	DimensionString = "string"
+	DimensionNumber = "number"
+	DimensionBool   = "bool"
+	DimensionEnum   = "enum"
+)
+
+// dimensionTypes are the supported custom dimension types
+var dimensionTypes = map[string]bool{DimensionString: true, DimensionNumber: true, DimensionBool: true, DimensionEnum: true}
+
+// Maximum number of custom dimensions of a project
+const maxDimensionsPerProject = 50
+
+// Maximum number of distinct values indexed per dimension
+const maxIndexedDimensionValues = 1000
+
+// NoDimensionValue is the breakdown value of events without the dimension's property
+const NoDimensionValue = "(none)"
+
+// dimensionNamePattern restricts dimension names to identifiers usable in query parameters
+var dimensionNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// CustomDimension is a named, typed property of a project's events that can be used to break
+// down trends, funnels and usage
+type CustomDimension struct {
+	Name        string   `json:"name"`
+	Property    string   `json:"property"`         // Event property holding the value
+	Type        string   `json:"type"`             // string, number, bool or enum
+	Values      []string `json:"values,omitempty"` // Allowed values of enum dimensions
+	Description string   `json:"description,omitempty"`
+}
+
+// ProjectDimensions are the custom dimensions registered by a project
+type ProjectDimensions struct {
+	Dimensions []CustomDimension `json:"dimensions"`
+	Version    int64             `json:"version"` // Incremented on every update, exposed as the ETag
+}
+
+// DimensionValue is an indexed value of a dimension and the number of events carrying it
+type DimensionValue struct {
+	Value  string `json:"value"`
+	Events int64  `json:"events"`
+}
+
+// DimensionRegistry holds the custom dimensions of every project. Events are validated against
+// them on ingestion, and the values of stored events are indexed.
+type DimensionRegistry struct {
+	projects map[string]*ProjectDimensions          // Replaced, never modified, so validations can keep using a snapshot
+	index    map[string]map[string]map[string]int64 // Project -> dimension -> value -> events
+	mutex    sync.RWMutex
+}
+
+// NewDimensionRegistry creates a new dimension registry
+func NewDimensionRegistry() *DimensionRegistry {
+	return &DimensionRegistry{
+		projects: make(map[string]*ProjectDimensions),
+		index:    make(map[string]map[string]map[string]int64),
+	}
+}
+
+// Get returns the custom dimensions of a project
+func (r *DimensionRegistry) Get(projectID string) *ProjectDimensions {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	dimensions, exists := r.projects[projectID]
+	if !exists {
+		return &ProjectDimensions{Dimensions: []CustomDimension{}}
+	}
+	return dimensions.copy()
+}
+
+// Lookup returns a custom dimension of a project by name
+func (r *DimensionRegistry) Lookup(projectID, name string) (*CustomDimension, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if dimensions, exists := r.projects[projectID]; exists {
+		for _, dimension := range dimensions.Dimensions {
+			if dimension.Name == name {
+				copied := dimension
+				return &copied, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("dimension not found: %s", name)
+}
+
+// Replace replaces the custom dimensions of a project. The update is rejected with a
+// VersionConflictError unless expectedVersion is the current version (0 for a project without
+// dimensions). The values indexed for removed or retyped dimensions are dropped.
+func (r *DimensionRegistry) Replace(projectID string, dimensions []CustomDimension, expectedVersion int64) (*ProjectDimensions, error) {
+	if err := validateDimensions(dimensions); err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var current int64
+	previous := make(map[string]CustomDimension)
+	if existing, exists := r.projects[projectID]; exists {
+		current = existing.Version
+		for _, dimension := range existing.Dimensions {
+			previous[dimension.Name] = dimension
+		}
+	}
+	if err := checkVersion("dimensions", projectID, current, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	updated := (&ProjectDimensions{Dimensions: dimensions, Version: current + 1}).copy()
+	r.projects[projectID] = updated
+
+	index := r.index[projectID]
+	kept := make(map[string]bool)
+	for _, dimension := range updated.Dimensions {
+		if old, exists := previous[dimension.Name]; exists && old.Property == dimension.Property && old.Type == dimension.Type {
+			kept[dimension.Name] = true
+		}
+	}
+	for name := range index {
+		if !kept[name] {
+			delete(index, name)
+		}
+	}
+
+	return updated.copy(), nil
+}
+
+// Validate checks the registered dimension properties of an event. Properties that are not
+// registered as dimensions are not checked.
+func (r *DimensionRegistry) Validate(projectID string, properties map[string]interface{}) error {
+	r.mutex.RLock()
+	dimensions, exists := r.projects[projectID]
+	r.mutex.RUnlock()
+	if !exists {
+		return nil
+	}
+
+	for _, dimension := range dimensions.Dimensions {
+		value, present := properties[dimension.Property]
+		if !present {
+			continue
+		}
+		if _, err := dimension.format(value); err != nil {
+			return fmt.Errorf("property '%s' of dimension '%s' %w", dimension.Property, dimension.Name, err)
+		}
+	}
+	return nil
+}
+
+// Index records the dimension values of a stored event
+func (r *DimensionRegistry) Index(event *AnalyticsEvent) {
+	projectID := projectOrDefault(event.ProjectID)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	dimensions, exists := r.projects[projectID]
+	if !exists || len(event.Properties) == 0 {
+		return
+	}
+	for _, dimension := range dimensions.Dimensions {
+		raw, present := event.Properties[dimension.Property]
+		if !present {
+			continue
+		}
+		value, err := dimension.format(raw)
+		if err != nil {
+			continue
+		}
+
+		byDimension, exists := r.index[projectID]
+		if !exists {
+			byDimension = make(map[string]map[string]int64)
+			r.index[projectID] = byDimension
+		}
+		values, exists := byDimension[dimension.Name]
+		if !exists {
+			values = make(map[string]int64)
+			byDimension[dimension.Name] = values
+		}
+		if _, seen := values[value]; seen || len(values) < maxIndexedDimensionValues {
+			values[value]++
+		}
+	}
+}
+
+// Values returns the indexed values of a dimension, most frequent first
+func (r *DimensionRegistry) Values(projectID, name string) ([]DimensionValue, error) {
+	if _, err := r.Lookup(projectID, name); err != nil {
+		return nil, err
+	}
+
+	r.mutex.RLock()
+	values := make([]DimensionValue, 0)
+	for value, events := range r.index[projectID][name] {
+		values = append(values, DimensionValue{Value: value, Events: events})
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].Events != values[j].Events {
+			return values[i].Events > values[j].Events
+		}
+		return values[i].Value < values[j].Value
+	})
+	return values, nil
+}
+
+// Value returns the dimension's value of an event as a breakdown key, NoDimensionValue when the
+// event does not carry a valid value
+func (d *CustomDimension) Value(event *AnalyticsEvent) string {
+	raw, present := event.Properties[d.Property]
+	if !present {
+		return NoDimensionValue
+	}
+	value, err := d.format(raw)
+	if err != nil {
+		return NoDimensionValue
+	}
+	return value
+}
+
+// format checks a property value against the dimension's type and returns it as a string
+func (d *CustomDimension) format(value interface{}) (string, error) {
+	switch d.Type {
+	case DimensionNumber:
+		switch number := value.(type) {
+		case float64:
+			return strconv.FormatFloat(number, 'f', -1, 64), nil
+		case int:
+			return strconv.Itoa(number), nil
+		case int64:
+			return strconv.FormatInt(number, 10), nil
+		}
+		return "", fmt.Errorf("must be a number")
+	case DimensionBool:
+		if flag, ok := value.(bool); ok {
+			return strconv.FormatBool(flag), nil
+		}
+		return "", fmt.Errorf("must be a boolean")
+	case DimensionEnum:
+		if str, ok := value.(string); ok {
+			for _, allowed := range d.Values {
+				if str == allowed {
+					return str, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("must be one of: %v", d.Values)
+	default:
+		if str, ok := value.(string); ok {
+			return str, nil
+		}
+		return "", fmt.Errorf("must be a string")
+	}
+}
+
+// copy returns a deep copy of the dimensions
+func (p *ProjectDimensions) copy() *ProjectDimensions {
+	copied := &ProjectDimensions{
+		Dimensions: make([]CustomDimension, len(p.Dimensions)),
+		Version:    p.Version,
+	}
+	for i, dimension := range p.Dimensions {
+		dimension.Values = append([]string(nil), dimension.Values...)
+		copied.Dimensions[i] = dimension
+	}
+	return copied
+}
+
+// validateDimensions checks that dimensions are named, typed and map to distinct properties
+func validateDimensions(dimensions []CustomDimension) error {
+	if len(dimensions) > maxDimensionsPerProject {
+		return fmt.Errorf("a project can register at most %d dimensions", maxDimensionsPerProject)
+	}
+
+	names := make(map[string]bool)
+	properties := make(map[string]string)
+	for _, dimension := range dimensions {
+		if !dimensionNamePattern.MatchString(dimension.Name) {
+			return fmt.Errorf("invalid dimension name %q: use lowercase letters, digits and underscores, starting with a letter", dimension.Name)
+		}
+		if names[dimension.Name] {
+			return fmt.Errorf("dimension %s is registered twice", dimension.Name)
+		}
+		names[dimension.Name] = true
+
+		if dimension.Property == "" {
+			return fmt.Errorf("property is required for dimension %s", dimension.Name)
+		}
+		if other, exists := properties[dimension.Property]; exists {
+			return fmt.Errorf("dimensions %s and %s map to the same property %s", other, dimension.Name, dimension.Property)
+		}
+		properties[dimension.Property] = dimension.Name
+
+		if !dimensionTypes[dimension.Type] {
+			return fmt.Errorf("invalid type %q for dimension %s. Valid types are: string, number, bool, enum", dimension.Type, dimension.Name)
+		}
+		if dimension.Type == DimensionEnum && len(dimension.Values) == 0 {
+			return fmt.Errorf("enum dimension %s must list its values", dimension.Name)
+		}
+		if dimension.Type != DimensionEnum && len(dimension.Values) > 0 {
+			return fmt.Errorf("only enum dimensions list values, %s is a %s", dimension.Name, dimension.Type)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum number of aggregation-only event types of a project
+const maxAggregatedEventTypesPerProject = 100
+
+// ProjectAggregation lists the event types of a project stored only as aggregate counters
+type ProjectAggregation struct {
+	EventTypes []string `json:"event_types"` // Ordered
+	Version    int64    `json:"version"`     // Incremented on every update, exposed as the ETag
+}
+
+// aggregateKey identifies the counter of an event type in an hour
+type aggregateKey struct {
+	region    string // Region the events were routed to
+	eventType string // As sent; aliases are applied when querying
+	hour      int64  // Unix time of the hour's start, in UTC
+}
+
+// EventAggregates de-identifies high-volume telemetry: events of the event types a project marks
+// as aggregation-only are not stored. Only their number per hour is counted, without their user,
+// properties or any other per-event record.
+type EventAggregates struct {
+	projects map[string]*ProjectAggregation    // Replaced, never modified, so checks can keep using a snapshot
+	counts   map[string]map[aggregateKey]int64 // Project -> counter -> events
+	aliases  *AliasService                     // Event type aliases applied when querying
+	mutex    sync.RWMutex
+}
+
+// NewEventAggregates creates empty aggregates resolving event types with the given aliases
+func NewEventAggregates(aliases *AliasService) *EventAggregates {
+	return &EventAggregates{
+		projects: make(map[string]*ProjectAggregation),
+		counts:   make(map[string]map[aggregateKey]int64),
+		aliases:  aliases,
+	}
+}
+
+// Get returns the aggregation-only event types of a project
+func (a *EventAggregates) Get(projectID string) *ProjectAggregation {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	aggregation, exists := a.projects[projectID]
+	if !exists {
+		return &ProjectAggregation{EventTypes: []string{}}
+	}
+	return aggregation.copy()
+}
+
+// Replace replaces the aggregation-only event types of a project. The update is rejected with a
+// VersionConflictError unless expectedVersion is the current version (0 for a project without
+// any). Events stored before an event type became aggregation-only are kept.
+func (a *EventAggregates) Replace(projectID string, eventTypes []string, expectedVersion int64) (*ProjectAggregation, error) {
+	if len(eventTypes) > maxAggregatedEventTypesPerProject {
+		return nil, fmt.Errorf("a project can have at most %d aggregation-only event types", maxAggregatedEventTypesPerProject)
+	}
+	seen := make(map[string]bool, len(eventTypes))
+	for _, eventType := range eventTypes {
+		if eventType == "" {
+			return nil, fmt.Errorf("aggregation-only event types must not be empty")
+		}
+		if seen[eventType] {
+			return nil, fmt.Errorf("duplicate aggregation-only event type %s", eventType)
+		}
+		seen[eventType] = true
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var current int64
+	if existing, exists := a.projects[projectID]; exists {
+		current = existing.Version
+	}
+	if err := checkVersion("aggregation", projectID, current, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	updated := (&ProjectAggregation{EventTypes: eventTypes, Version: current + 1}).copy()
+	sort.Strings(updated.EventTypes)
+	projects := make(map[string]*ProjectAggregation, len(a.projects)+1)
+	for id, existing := range a.projects {
+		projects[id] = existing
+	}
+	projects[projectID] = updated
+	a.projects = projects
+
+	return updated.copy(), nil
+}
+
+// AggregationOnly reports whether the events of a type of a project are only counted
+func (a *EventAggregates) AggregationOnly(projectID, eventType string) bool {
+	a.mutex.RLock()
+	aggregation, exists := a.projects[projectID]
+	a.mutex.RUnlock()
+	if !exists {
+		return false
+	}
+
+	index := sort.SearchStrings(aggregation.EventTypes, eventType)
+	return index < len(aggregation.EventTypes) && aggregation.EventTypes[index] == eventType
+}
+
+// Add counts an event in the hour of its timestamp
+func (a *EventAggregates) Add(event *AnalyticsEvent) {
+	projectID := projectOrDefault(event.ProjectID)
+	key := aggregateKey{
+		region:    event.Region,
+		eventType: event.EventType,
+		hour:      event.Timestamp.UTC().Truncate(time.Hour).Unix(),
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.counts[projectID] == nil {
+		a.counts[projectID] = make(map[aggregateKey]int64)
+	}
+	a.counts[projectID][key]++
+}
+
+// AddToTrend adds the counted events of a project's regions (every region when nil) and event
+// type (every type when empty) in [start, end) to the points of a trend, like trendPoints buckets
+// events. Events are counted per hour, so the hours start and end fall in are counted whole. It
+// returns the number of events added.
+func (a *EventAggregates) AddToTrend(points []TrendPoint, projectID string, regions []string, eventType string, start, end time.Time, interval time.Duration) int64 {
+	canonical := a.aliases.Get(projectID).Events
+	var inRegions map[string]bool
+	if regions != nil {
+		inRegions = make(map[string]bool, len(regions))
+		for _, region := range regions {
+			inRegions[region] = true
+		}
+	}
+	bucketStart := start.Truncate(interval)
+	firstHour := start.Truncate(time.Hour).Unix()
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	var total int64
+	for key, count := range a.counts[projectID] {
+		if key.hour < firstHour || !time.Unix(key.hour, 0).Before(end) {
+			continue
+		}
+		if inRegions != nil && !inRegions[key.region] {
+			continue
+		}
+		if eventType != "" {
+			keyType := key.eventType
+			if renamed, exists := canonical[keyType]; exists {
+				keyType = renamed
+			}
+			if keyType != eventType {
+				continue
+			}
+		}
+		index := int(time.Unix(key.hour, 0).Sub(bucketStart) / interval)
+		if index < 0 || index >= len(points) {
+			continue
+		}
+		points[index].Count += count
+		total += count
+	}
+	return total
+}
+
+// copy returns a deep copy of the aggregation settings
+func (p *ProjectAggregation) copy() *ProjectAggregation {
+	return &ProjectAggregation{
+		EventTypes: append([]string{}, p.EventTypes...),
+		Version:    p.Version,
+	}
+}
@@ -0,0 +1,264 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+)
+
+// EventTopic is a topic of the event bus. Every topic carries payloads of a single type, and
+// publishing anything else is an error.
+type EventTopic struct {
+	Name    string
+	accepts func(payload interface{}) bool
+}
+
+// TopicEventStored carries every *AnalyticsEvent the analytics service stored, with its
+// properties even when only the event itself was kept
+var TopicEventStored = EventTopic{Name: "event.stored", accepts: isAnalyticsEvent}
+
+// TopicTrafficAlert carries every *TrafficAlert the traffic monitor fired or resolved
+var TopicTrafficAlert = EventTopic{Name: "traffic.alert", accepts: isTrafficAlert}
+
+// TopicDataQualityAlert carries every *DataQualityAlert the data quality monitors fired or resolved
+var TopicDataQualityAlert = EventTopic{Name: "data_quality.alert", accepts: isDataQualityAlert}
+
+// TopicSLOAlert carries every *SLOAlert the SLO tracker fired or resolved
+var TopicSLOAlert = EventTopic{Name: "slo.alert", accepts: isSLOAlert}
+
+// isAnalyticsEvent reports whether a payload is an analytics event
+func isAnalyticsEvent(payload interface{}) bool {
+	event, ok := payload.(*AnalyticsEvent)
+	return ok && event != nil
+}
+
+// EventBusStats represents the delivery counters of a subscription
+type EventBusStats struct {
+	Topic      string `json:"topic"`
+	Subscriber string `json:"subscriber"`
+	Queued     int    `json:"queued"`
+	Capacity   int    `json:"capacity"`
+	Delivered  int64  `json:"delivered"`
+	Dropped    int64  `json:"dropped"` // Published while the queue was full
+	Failed     int64  `json:"failed"`  // Handler panicked
+}
+
+// eventSubscription is a subscriber of a topic with its own bounded queue
+type eventSubscription struct {
+	topic      EventTopic
+	subscriber string
+	handler    func(payload interface{})
+	queue      chan interface{}
+	delivered  int64
+	dropped    int64
+	failed     int64
+}
+
+// EventBus delivers what the analytics service publishes to the services subscribed to it, so
+// the service does not depend on them and new consumers only need to subscribe. Every
+// subscription has a bounded queue drained by a goroutine of its own: a slow subscriber neither
+// blocks publishing nor delays other subscribers, and payloads published while its queue is full
+// are dropped and counted.
+type EventBus struct {
+	subscriptions map[string][]*eventSubscription // Topic name -> subscriptions
+	capacity      int
+	pending       int // Payloads queued or being handled
+	stopped       bool
+	mutex         sync.Mutex
+	idle          *sync.Cond
+	workers       sync.WaitGroup
+}
+
+// NewEventBus creates an event bus whose subscriptions queue up to EVENT_BUS_QUEUE_CAPACITY
+// payloads (default: 1000)
+func NewEventBus() *EventBus {
+	bus := &EventBus{
+		subscriptions: make(map[string][]*eventSubscription),
+		capacity:      getEnvInt("EVENT_BUS_QUEUE_CAPACITY", 1000),
+	}
+	if bus.capacity < 1 {
+		log.Printf("Warning: EVENT_BUS_QUEUE_CAPACITY must be positive, using 1000")
+		bus.capacity = 1000
+	}
+	bus.idle = sync.NewCond(&bus.mutex)
+	return bus
+}
+
+// Subscribe calls the handler with every payload published to the topic from now on. The
+// subscriber name identifies the subscription in the stats.
+func (b *EventBus) Subscribe(topic EventTopic, subscriber string, handler func(payload interface{})) error {
+	if topic.Name == "" || topic.accepts == nil {
+		return fmt.Errorf("unknown topic: %q", topic.Name)
+	}
+	if subscriber == "" {
+		return fmt.Errorf("subscriber name is required")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stopped {
+		return fmt.Errorf("event bus is stopped")
+	}
+	for _, existing := range b.subscriptions[topic.Name] {
+		if existing.subscriber == subscriber {
+			return fmt.Errorf("%s is already subscribed to %s", subscriber, topic.Name)
+		}
+	}
+
+	subscription := &eventSubscription{
+		topic:      topic,
+		subscriber: subscriber,
+		handler:    handler,
+		queue:      make(chan interface{}, b.capacity),
+	}
+	b.subscriptions[topic.Name] = append(b.subscriptions[topic.Name], subscription)
+	b.workers.Add(1)
+	go b.deliver(subscription)
+	return nil
+}
+
+// SubscribeEvents subscribes a handler of analytics events to a topic carrying them
+func (b *EventBus) SubscribeEvents(topic EventTopic, subscriber string, handler func(*AnalyticsEvent)) error {
+	return b.Subscribe(topic, subscriber, func(payload interface{}) {
+		handler(payload.(*AnalyticsEvent))
+	})
+}
+
+// Publish queues the payload for every subscriber of the topic without waiting for them.
+// Publishing after the bus stopped is a no-op.
+func (b *EventBus) Publish(topic EventTopic, payload interface{}) error {
+	if topic.accepts == nil || !topic.accepts(payload) {
+		return fmt.Errorf("invalid payload for topic %s: %T", topic.Name, payload)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.stopped {
+		return nil
+	}
+	for _, subscription := range b.subscriptions[topic.Name] {
+		select {
+		case subscription.queue <- payload:
+			b.pending++
+		default:
+			subscription.dropped++
+			log.Printf("Warning: Event bus queue of %s for %s is full, dropping payload", subscription.subscriber, topic.Name)
+		}
+	}
+	return nil
+}
+
+// deliver hands the queued payloads of a subscription to its handler until the bus stops
+func (b *EventBus) deliver(subscription *eventSubscription) {
+	defer b.workers.Done()
+	for payload := range subscription.queue {
+		failed := !b.handle(subscription, payload)
+
+		b.mutex.Lock()
+		if failed {
+			subscription.failed++
+		} else {
+			subscription.delivered++
+		}
+		b.pending--
+		if b.pending == 0 {
+			b.idle.Broadcast()
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// handle calls the handler of a subscription, recovering from panics so the subscription keeps
+// receiving payloads. It reports whether the handler returned.
+func (b *EventBus) handle(subscription *eventSubscription, payload interface{}) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error: Event bus subscriber %s of %s panicked: %v", subscription.subscriber, subscription.topic.Name, r)
+			ok = false
+		}
+	}()
+	subscription.handler(payload)
+	return true
+}
+
+// Drain waits until every payload published so far has been handled
+func (b *EventBus) Drain() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.pending > 0 {
+		b.idle.Wait()
+	}
+}
+
+// Stop stops accepting payloads and waits until the queued ones have been handled
+func (b *EventBus) Stop() {
+	b.mutex.Lock()
+	if b.stopped {
+		b.mutex.Unlock()
+		return
+	}
+	b.stopped = true
+	for _, subscriptions := range b.subscriptions {
+		for _, subscription := range subscriptions {
+			close(subscription.queue)
+		}
+	}
+	b.mutex.Unlock()
+	b.workers.Wait()
+}
+
+// Stats returns the delivery counters of every subscription, ordered by topic and subscriber
+func (b *EventBus) Stats() []EventBusStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	stats := make([]EventBusStats, 0)
+	for _, subscriptions := range b.subscriptions {
+		for _, subscription := range subscriptions {
+			stats = append(stats, EventBusStats{
+				Topic:      subscription.topic.Name,
+				Subscriber: subscription.subscriber,
+				Queued:     len(subscription.queue),
+				Capacity:   cap(subscription.queue),
+				Delivered:  subscription.delivered,
+				Dropped:    subscription.dropped,
+				Failed:     subscription.failed,
+			})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Topic != stats[j].Topic {
+			return stats[i].Topic < stats[j].Topic
+		}
+		return stats[i].Subscriber < stats[j].Subscriber
+	})
+	return stats
+}
+
+// WriteMetrics writes the delivery counters of the subscriptions in the Prometheus text format
+func (b *EventBus) WriteMetrics(w io.Writer) error {
+	stats := b.Stats()
+	metrics := []struct {
+		name, kind, help string
+		value            func(EventBusStats) int64
+	}{
+		{"analytics_event_bus_queued", "gauge", "Payloads waiting in the subscription's queue.", func(s EventBusStats) int64 { return int64(s.Queued) }},
+		{"analytics_event_bus_delivered_total", "counter", "Payloads handled by the subscriber.", func(s EventBusStats) int64 { return s.Delivered }},
+		{"analytics_event_bus_dropped_total", "counter", "Payloads dropped because the subscription's queue was full.", func(s EventBusStats) int64 { return s.Dropped }},
+		{"analytics_event_bus_failed_total", "counter", "Payloads whose handler panicked.", func(s EventBusStats) int64 { return s.Failed }},
+	}
+
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind); err != nil {
+			return err
+		}
+		for _, stat := range stats {
+			if _, err := fmt.Fprintf(w, "%s{topic=%q,subscriber=%q} %d\n", metric.name, stat.Topic, stat.Subscriber, metric.value(stat)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
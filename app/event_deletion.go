@@ -0,0 +1,140 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// eventDeletionSampleSize is how many matched events a dry run returns
+const eventDeletionSampleSize = 10
+
+// EventDeletion selects the stored events of a bulk deletion, e.g. those sent with a staging API
+// key to production. Every field set must match; at least one of EventType, APIKey and Properties
+// must be set.
+type EventDeletion struct {
+	ProjectID  string                 // Every project when empty
+	EventType  string                 // Under its name as sent or its canonical name
+	APIKey     string                 // API key the events were sent with
+	Properties map[string]interface{} // Properties the events must have, with the same values
+	Start      time.Time              // Timestamps from Start, unbounded when zero
+	End        time.Time              // up to End, exclusive, unbounded when zero
+	DryRun     bool                   // Only count the matching events
+}
+
+// EventDeletionResult summarizes a bulk deletion
+type EventDeletionResult struct {
+	DryRun        bool                   `json:"dry_run"`
+	Matched       int64                  `json:"matched"`
+	Deleted       int64                  `json:"deleted"`
+	MatchedByType map[string]int64       `json:"matched_by_type"`
+	Projects      []string               `json:"projects"`
+	FirstEventAt  *time.Time             `json:"first_event_at,omitempty"`
+	LastEventAt   *time.Time             `json:"last_event_at,omitempty"`
+	Sample        []*AnalyticsEvent      `json:"sample,omitempty"`  // Oldest matched events of a dry run
+	Rollups       []*RollupRebuildResult `json:"rollups,omitempty"` // Rebuilds of the days of deleted events
+}
+
+// Validate checks that the deletion is narrower than a time range
+func (d EventDeletion) Validate() error {
+	if d.EventType == "" && d.APIKey == "" && len(d.Properties) == 0 {
+		return fmt.Errorf("at least one of event_type, api_key or properties is required")
+	}
+	if !d.Start.IsZero() && !d.End.IsZero() && !d.End.After(d.Start) {
+		return fmt.Errorf("to must be after from")
+	}
+	return nil
+}
+
+// matches reports whether a stored event is selected by the deletion
+func (d EventDeletion) matches(stored *AnalyticsEvent, resolve func(*AnalyticsEvent) *AnalyticsEvent) bool {
+	if (d.ProjectID != "" && projectOrDefault(stored.ProjectID) != d.ProjectID) ||
+		(d.APIKey != "" && stored.APIKeyID != APIKeyID(d.APIKey)) ||
+		(!d.Start.IsZero() && stored.Timestamp.Before(d.Start)) ||
+		(!d.End.IsZero() && !stored.Timestamp.Before(d.End)) {
+		return false
+	}
+	if d.EventType != "" && stored.EventType != d.EventType && resolve(stored).EventType != d.EventType {
+		return false
+	}
+	return len(d.Properties) == 0 || matchesProperties(stored.Properties, d.Properties)
+}
+
+// DeleteEvents deletes the stored events selected by the deletion, e.g. bad data sent by an
+// instrumentation bug, or only counts them for a dry run. Deleted events are removed from the
+// event store and hourly series, and the rollups of their days are rebuilt from the events left.
+func (s *AnalyticsService) DeleteEvents(deletion EventDeletion) (*EventDeletionResult, error) {
+	return s.deleteEvents(context.Background(), deletion)
+}
+
+// deleteEvents deletes events, reporting the scanned events to the job running with the context
+func (s *AnalyticsService) deleteEvents(ctx context.Context, deletion EventDeletion) (*EventDeletionResult, error) {
+	if err := deletion.Validate(); err != nil {
+		return nil, err
+	}
+	result := &EventDeletionResult{DryRun: deletion.DryRun, MatchedByType: make(map[string]int64), Projects: make([]string, 0)}
+	resolve := s.aliases.Resolver()
+	var matched []*AnalyticsEvent
+
+	// Matching and deleting under one lock, events stored meanwhile are neither deleted nor missed
+	s.mutex.Lock()
+	s.scanEventsReporting(ctx, nil, func(stored *AnalyticsEvent) {
+		if deletion.matches(stored, resolve) {
+			matched = append(matched, stored)
+		}
+	})
+	if !deletion.DryRun {
+		for _, event := range matched {
+			delete(s.events[event.Region], event.ID)
+			delete(s.correlations, event.BillingCorrelationID)
+		}
+	}
+	s.mutex.Unlock()
+
+	sortStoredEvents(matched)
+	days := make(map[string][2]time.Time) // First and last day of the deleted events per project
+	ids := make([]string, 0, len(matched))
+	for _, event := range matched {
+		result.Matched++
+		result.MatchedByType[resolve(event).EventType]++
+		ids = append(ids, event.ID)
+
+		projectID := projectOrDefault(event.ProjectID)
+		day := event.Timestamp.UTC().Truncate(rollupDay)
+		span, exists := days[projectID]
+		if !exists {
+			span = [2]time.Time{day, day}
+			result.Projects = append(result.Projects, projectID)
+		}
+		span[1] = day // Events are sorted oldest first
+		days[projectID] = span
+	}
+	sort.Strings(result.Projects)
+	if len(matched) > 0 {
+		first, last := matched[0].Timestamp, matched[len(matched)-1].Timestamp
+		result.FirstEventAt, result.LastEventAt = &first, &last
+	}
+
+	if deletion.DryRun {
+		result.Sample = matched[:min(len(matched), eventDeletionSampleSize)]
+		return result, nil
+	}
+	result.Deleted = result.Matched
+	if result.Deleted == 0 {
+		return result, nil
+	}
+
+	s.storeWriter.Delete(ids)
+	for _, event := range matched {
+		s.series.Remove(resolve(event))
+	}
+	for _, projectID := range result.Projects {
+		span := days[projectID]
+		result.Rollups = append(result.Rollups, s.rebuildRollups(context.Background(), projectID, span[0], span[1].Add(rollupDay)))
+		s.queryCache.ExpireProject(projectID)
+	}
+	log.Printf("Deleted %d events of %d projects", result.Deleted, len(result.Projects))
+	return result, nil
+}
@@ -0,0 +1,316 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// What happens to the events of a type beyond its daily limit
+const (
+	QuotaDrop   = "drop"   // Events are neither stored nor billed
+	QuotaSample = "sample" // A share of the events is stored and billed, the others are dropped
+)
+
+// Maximum number of event type quotas of a project
+const maxQuotasPerProject = 100
+
+// EventTypeQuota caps the events of a type a project stores per day (UTC)
+type EventTypeQuota struct {
+	EventType  string  `json:"event_type"`
+	DailyLimit int64   `json:"daily_limit"`
+	Action     string  `json:"action"`                // QuotaDrop or QuotaSample beyond the limit
+	SampleRate float64 `json:"sample_rate,omitempty"` // Share of the events kept beyond the limit when sampling
+}
+
+// ProjectQuotas are the event type quotas of a project
+type ProjectQuotas struct {
+	Quotas  []EventTypeQuota `json:"quotas"`  // Ordered by event type
+	Version int64            `json:"version"` // Incremented on every update, exposed as the ETag
+}
+
+// EventTypeUsage is how many events of a type a project sent on a day and what became of them
+type EventTypeUsage struct {
+	EventType string          `json:"event_type"`
+	Quota     *EventTypeQuota `json:"quota,omitempty"` // The quota in effect now, if any
+	Received  int64           `json:"received"`        // Events reaching the quota check
+	Accepted  int64           `json:"accepted"`        // Within the daily limit
+	Sampled   int64           `json:"sampled"`         // Kept by sampling beyond the limit
+	Dropped   int64           `json:"dropped"`         // Beyond the limit and not kept
+}
+
+// QuotaUsageReport is the usage of every event type a project sent on a day
+type QuotaUsageReport struct {
+	ProjectID  string           `json:"project_id"`
+	Date       string           `json:"date"`
+	EventTypes []EventTypeUsage `json:"event_types"` // Ordered by event type
+}
+
+// QuotaStatus is what is left today (UTC) of a project's quota of an event type
+type QuotaStatus struct {
+	EventTypeQuota
+	Used      int64 `json:"used"`      // Events accepted within the daily limit today
+	Remaining int64 `json:"remaining"` // Events still accepted today before the action applies
+	Exceeded  bool  `json:"exceeded"`  // Whether events are now dropped or sampled
+}
+
+// QuotaExceededError is returned for an event dropped because its type exceeded its daily quota
+type QuotaExceededError struct {
+	ProjectID  string
+	EventType  string
+	DailyLimit int64
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("daily quota of %d %s events exceeded for project %s", e.DailyLimit, e.EventType, e.ProjectID)
+}
+
+// quotaCounters count the events of a type a project sent on a day
+type quotaCounters struct {
+	received, accepted, sampled, dropped int64
+}
+
+// EventQuotas caps noisy event types per project and day, so a chatty SDK feature (e.g. mouse
+// moves) can be kept within budget without disabling it. Usage is counted for every event type,
+// quota or not, and kept for EVENT_QUOTA_USAGE_DAYS days.
+type EventQuotas struct {
+	projects  map[string]*ProjectQuotas                       // Replaced, never modified, so checks can keep using a snapshot
+	usage     map[string]map[string]map[string]*quotaCounters // Date -> project -> event type -> counters
+	usageDays int
+	mutex     sync.RWMutex
+}
+
+// NewEventQuotas creates event quotas keeping usage for EVENT_QUOTA_USAGE_DAYS days (default 31)
+func NewEventQuotas() *EventQuotas {
+	return &EventQuotas{
+		projects:  make(map[string]*ProjectQuotas),
+		usage:     make(map[string]map[string]map[string]*quotaCounters),
+		usageDays: getEnvInt("EVENT_QUOTA_USAGE_DAYS", 31),
+	}
+}
+
+// Get returns the quotas of a project
+func (q *EventQuotas) Get(projectID string) *ProjectQuotas {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	quotas, exists := q.projects[projectID]
+	if !exists {
+		return &ProjectQuotas{Quotas: []EventTypeQuota{}}
+	}
+	return quotas.copy()
+}
+
+// Replace replaces the quotas of a project. The update is rejected with a VersionConflictError
+// unless expectedVersion is the current version (0 for a project without quotas). Events already
+// counted today still count against the new limits.
+func (q *EventQuotas) Replace(projectID string, quotas []EventTypeQuota, expectedVersion int64) (*ProjectQuotas, error) {
+	quotas, err := normalizeQuotas(quotas)
+	if err != nil {
+		return nil, err
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var current int64
+	if existing, exists := q.projects[projectID]; exists {
+		current = existing.Version
+	}
+	if err := checkVersion("quotas", projectID, current, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	updated := &ProjectQuotas{Quotas: quotas, Version: current + 1}
+	projects := make(map[string]*ProjectQuotas, len(q.projects)+1)
+	for id, existing := range q.projects {
+		projects[id] = existing
+	}
+	projects[projectID] = updated
+	q.projects = projects
+
+	return updated.copy(), nil
+}
+
+// Admit counts an event received at the given time against the daily quota of its type. It
+// returns the sample rate of an event kept by sampling beyond the limit (0 within the limit), or
+// a QuotaExceededError when the event is dropped. The sampling decision is deterministic per
+// event ID, so retried deliveries of an event are treated the same way.
+func (q *EventQuotas) Admit(projectID, eventType, eventID string, receivedAt time.Time) (float64, error) {
+	date := receivedAt.UTC().Format("2006-01-02")
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	counters := q.counters(date, projectID, eventType)
+	counters.received++
+
+	quota := q.projects[projectID].lookup(eventType)
+	if quota == nil || counters.accepted < quota.DailyLimit {
+		counters.accepted++
+		return 0, nil
+	}
+	if quota.Action == QuotaSample && sampleFraction("quota/"+eventID) < quota.SampleRate {
+		counters.sampled++
+		return quota.SampleRate, nil
+	}
+	counters.dropped++
+	return 0, &QuotaExceededError{ProjectID: projectID, EventType: eventType, DailyLimit: quota.DailyLimit}
+}
+
+// Usage returns the usage of every event type a project sent on a date (YYYY-MM-DD)
+func (q *EventQuotas) Usage(projectID, date string) (*QuotaUsageReport, error) {
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		return nil, fmt.Errorf("invalid date format, use YYYY-MM-DD: %s", date)
+	}
+
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	report := &QuotaUsageReport{ProjectID: projectID, Date: date, EventTypes: []EventTypeUsage{}}
+	seen := make(map[string]bool)
+	for eventType, counters := range q.usage[date][projectID] {
+		seen[eventType] = true
+		report.EventTypes = append(report.EventTypes, EventTypeUsage{
+			EventType: eventType,
+			Quota:     q.projects[projectID].lookup(eventType),
+			Received:  counters.received,
+			Accepted:  counters.accepted,
+			Sampled:   counters.sampled,
+			Dropped:   counters.dropped,
+		})
+	}
+	// Event types with a quota are listed even on days they were not sent
+	if quotas, exists := q.projects[projectID]; exists {
+		for i := range quotas.Quotas {
+			if !seen[quotas.Quotas[i].EventType] {
+				quota := quotas.Quotas[i]
+				report.EventTypes = append(report.EventTypes, EventTypeUsage{EventType: quota.EventType, Quota: &quota})
+			}
+		}
+	}
+	sort.Slice(report.EventTypes, func(i, j int) bool {
+		return report.EventTypes[i].EventType < report.EventTypes[j].EventType
+	})
+	return report, nil
+}
+
+// Status returns what is left of each quota of a project on the day (UTC) of the given time
+func (q *EventQuotas) Status(projectID string, now time.Time) []QuotaStatus {
+	date := now.UTC().Format("2006-01-02")
+
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	statuses := []QuotaStatus{}
+	quotas, exists := q.projects[projectID]
+	if !exists {
+		return statuses
+	}
+	for _, quota := range quotas.Quotas {
+		status := QuotaStatus{EventTypeQuota: quota}
+		if counters, exists := q.usage[date][projectID][quota.EventType]; exists {
+			status.Used = counters.accepted
+		}
+		status.Remaining = max(quota.DailyLimit-status.Used, 0)
+		status.Exceeded = status.Remaining == 0
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// counters returns the counters of an event type of a project on a date, creating them and
+// dropping days past the usage retention on the first event of a day. The caller must hold the
+// write lock.
+func (q *EventQuotas) counters(date, projectID, eventType string) *quotaCounters {
+	projects, exists := q.usage[date]
+	if !exists {
+		projects = make(map[string]map[string]*quotaCounters)
+		q.usage[date] = projects
+
+		if day, err := time.Parse("2006-01-02", date); err == nil {
+			oldest := day.AddDate(0, 0, -q.usageDays).Format("2006-01-02")
+			for kept := range q.usage {
+				if kept <= oldest {
+					delete(q.usage, kept)
+				}
+			}
+		}
+	}
+	eventTypes, exists := projects[projectID]
+	if !exists {
+		eventTypes = make(map[string]*quotaCounters)
+		projects[projectID] = eventTypes
+	}
+	counters, exists := eventTypes[eventType]
+	if !exists {
+		counters = &quotaCounters{}
+		eventTypes[eventType] = counters
+	}
+	return counters
+}
+
+// lookup returns a copy of the quota of an event type, nil when it has none
+func (p *ProjectQuotas) lookup(eventType string) *EventTypeQuota {
+	if p == nil {
+		return nil
+	}
+	for _, quota := range p.Quotas {
+		if quota.EventType == eventType {
+			copied := quota
+			return &copied
+		}
+	}
+	return nil
+}
+
+// copy returns a deep copy of the quotas
+func (p *ProjectQuotas) copy() *ProjectQuotas {
+	return &ProjectQuotas{
+		Quotas:  append([]EventTypeQuota{}, p.Quotas...),
+		Version: p.Version,
+	}
+}
+
+// normalizeQuotas validates quotas, defaults their action to dropping and orders them by event type
+func normalizeQuotas(quotas []EventTypeQuota) ([]EventTypeQuota, error) {
+	if len(quotas) > maxQuotasPerProject {
+		return nil, fmt.Errorf("a project can have at most %d quotas", maxQuotasPerProject)
+	}
+
+	normalized := make([]EventTypeQuota, 0, len(quotas))
+	seen := make(map[string]bool)
+	for _, quota := range quotas {
+		if quota.EventType == "" {
+			return nil, fmt.Errorf("quotas require an event_type")
+		}
+		if seen[quota.EventType] {
+			return nil, fmt.Errorf("duplicate quota for event type %s", quota.EventType)
+		}
+		seen[quota.EventType] = true
+		if quota.DailyLimit < 0 {
+			return nil, fmt.Errorf("daily_limit of %s must not be negative", quota.EventType)
+		}
+
+		switch quota.Action {
+		case "", QuotaDrop:
+			if quota.SampleRate != 0 {
+				return nil, fmt.Errorf("sample_rate of %s requires the %s action", quota.EventType, QuotaSample)
+			}
+			quota.Action = QuotaDrop
+		case QuotaSample:
+			if quota.SampleRate <= 0 || quota.SampleRate >= 1 {
+				return nil, fmt.Errorf("sample_rate of %s must be between 0 and 1, exclusive, got %v", quota.EventType, quota.SampleRate)
+			}
+		default:
+			return nil, fmt.Errorf("invalid action for %s: %s. Valid actions are: %s, %s", quota.EventType, quota.Action, QuotaDrop, QuotaSample)
+		}
+		normalized = append(normalized, quota)
+	}
+
+	sort.Slice(normalized, func(i, j int) bool {
+		return normalized[i].EventType < normalized[j].EventType
+	})
+	return normalized, nil
+}
@@ -0,0 +1,486 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errEventStoreUnavailable = errors.New("event store unavailable")
+
+// EventStoreFilter selects stored events. Empty fields match every event.
+type EventStoreFilter struct {
+	ProjectID string
+	UserID    string
+	EventType string
+	Regions   []string  // Every region when nil
+	Start     time.Time // Timestamps from Start, unbounded when zero
+	End       time.Time // up to End, exclusive, unbounded when zero
+	Limit     int       // Maximum number of events, 0 for all
+}
+
+// matches reports whether an event is selected by the filter
+func (f EventStoreFilter) matches(event *AnalyticsEvent) bool {
+	if (f.ProjectID != "" && projectOrDefault(event.ProjectID) != f.ProjectID) ||
+		(f.UserID != "" && event.UserID != f.UserID) ||
+		(f.EventType != "" && event.EventType != f.EventType) {
+		return false
+	}
+	if f.Regions != nil {
+		found := false
+		for _, region := range f.Regions {
+			found = found || event.Region == region
+		}
+		if !found {
+			return false
+		}
+	}
+	return (f.Start.IsZero() || !event.Timestamp.Before(f.Start)) && (f.End.IsZero() || event.Timestamp.Before(f.End))
+}
+
+// EventStore durably stores events, so they outlive restarts of the service. Events are written
+// in batches and queried by user, event type and time.
+type EventStore interface {
+	// Insert stores events; events already stored under the same ID are left unchanged
+	Insert(ctx context.Context, events []*AnalyticsEvent) error
+	// Query returns the events selected by the filter, oldest first
+	Query(ctx context.Context, filter EventStoreFilter) ([]*AnalyticsEvent, error)
+	// Delete deletes the events with the given IDs
+	Delete(ctx context.Context, ids []string) error
+	// Close releases the store's connections
+	Close() error
+}
+
+// NewEventStoreFromEnv opens the event store of EVENT_STORE_URL, e.g. a postgres:// URL. Without
+// one, it returns nil and events are only kept in memory.
+func NewEventStoreFromEnv() (EventStore, error) {
+	storeURL := os.Getenv("EVENT_STORE_URL")
+	if storeURL == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EVENT_STORE_URL: %w", err)
+	}
+
+	switch parsed.Scheme {
+	case "postgres", "postgresql":
+		ctx, cancel := context.WithTimeout(context.Background(), getEnvDuration("EVENT_STORE_TIMEOUT", 10*time.Second))
+		defer cancel()
+		return NewPostgresEventStore(ctx, storeURL)
+	default:
+		return nil, fmt.Errorf("unsupported event store: %s. Supported stores are: postgres", parsed.Scheme)
+	}
+}
+
+// MemoryEventStore is an EventStore holding events in memory, for tests and development: events
+// outlive the services using the store, but not the process
+type MemoryEventStore struct {
+	events map[string]*AnalyticsEvent
+	mutex  sync.RWMutex
+}
+
+// NewMemoryEventStore creates an empty in-memory event store
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{events: make(map[string]*AnalyticsEvent)}
+}
+
+// Insert stores events not stored yet
+func (s *MemoryEventStore) Insert(ctx context.Context, events []*AnalyticsEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, event := range events {
+		if _, exists := s.events[event.ID]; !exists {
+			s.events[event.ID] = event
+		}
+	}
+	return nil
+}
+
+// Query returns the events selected by the filter, oldest first
+func (s *MemoryEventStore) Query(ctx context.Context, filter EventStoreFilter) ([]*AnalyticsEvent, error) {
+	s.mutex.RLock()
+	events := make([]*AnalyticsEvent, 0)
+	for _, event := range s.events {
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+	}
+	s.mutex.RUnlock()
+
+	sortStoredEvents(events)
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// Delete deletes the events with the given IDs
+func (s *MemoryEventStore) Delete(ctx context.Context, ids []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, id := range ids {
+		delete(s.events, id)
+	}
+	return nil
+}
+
+// Close does nothing, the events stay in memory
+func (s *MemoryEventStore) Close() error {
+	return nil
+}
+
+// Len returns the number of stored events
+func (s *MemoryEventStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.events)
+}
+
+// sortStoredEvents sorts events oldest first, then by ID
+func sortStoredEvents(events []*AnalyticsEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Timestamp.Before(events[j].Timestamp)
+		}
+		return events[i].ID < events[j].ID
+	})
+}
+
+// EventWriterStats reports the writes of events to the store
+type EventWriterStats struct {
+	Pending        int   `json:"pending"`         // Events not written yet
+	PendingDeletes int   `json:"pending_deletes"` // Deleted events not deleted from the store yet
+	Written        int64 `json:"written"`
+	Batches        int64 `json:"batches"`
+	FailedBatches  int64 `json:"failed_batches"` // Retried with the next flush
+	Dropped        int64 `json:"dropped"`        // Oldest pending events dropped beyond the maximum
+}
+
+// EventWriter writes stored events to the event store in batches, in the background, so ingestion
+// does not wait for the store. Batches are written every EVENT_STORE_FLUSH_INTERVAL or as soon as
+// a batch is full; batches the store fails to write are retried with the next flush.
+type EventWriter struct {
+	store         EventStore
+	pending       []*AnalyticsEvent
+	deletes       []string
+	batchSize     int
+	maxPending    int
+	flushInterval time.Duration
+	timeout       time.Duration
+	stats         EventWriterStats
+	circuit       *IngestionCircuit // Told about failed and successful writes, if any
+	full          chan struct{}
+	stop          chan struct{}
+	stopOnce      sync.Once
+	done          sync.WaitGroup
+	flushMutex    sync.Mutex // Serializes flushes, so batches are written in order
+	mutex         sync.Mutex // Guards pending, deletes and stats
+}
+
+// NewEventWriter creates a writer of batches of EVENT_STORE_BATCH_SIZE events (default 500),
+// flushed every EVENT_STORE_FLUSH_INTERVAL (default 1s), keeping at most EVENT_STORE_MAX_PENDING
+// events (default 100000) while the store is unavailable. Every write times out after
+// EVENT_STORE_TIMEOUT (default 10s).
+func NewEventWriter(store EventStore) *EventWriter {
+	return &EventWriter{
+		store:         store,
+		batchSize:     max(getEnvInt("EVENT_STORE_BATCH_SIZE", 500), 1),
+		maxPending:    max(getEnvInt("EVENT_STORE_MAX_PENDING", 100000), 1),
+		flushInterval: getEnvDuration("EVENT_STORE_FLUSH_INTERVAL", time.Second),
+		timeout:       getEnvDuration("EVENT_STORE_TIMEOUT", 10*time.Second),
+		full:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+}
+
+// Start flushes the pending events on the flush interval, and whenever a batch is full, until
+// stopped
+func (w *EventWriter) Start() {
+	if w.flushInterval <= 0 {
+		log.Printf("Events are only written to the event store when a batch is full and on shutdown")
+	}
+
+	w.done.Add(1)
+	go func() {
+		defer w.done.Done()
+		var tick <-chan time.Time
+		if w.flushInterval > 0 {
+			ticker := time.NewTicker(w.flushInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-tick:
+			case <-w.full:
+			}
+			w.Flush()
+		}
+	}()
+}
+
+// Stop stops the background flushes and flushes the remaining events
+func (w *EventWriter) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		w.done.Wait()
+		w.Flush()
+	})
+}
+
+// Add queues an event to be written. Does nothing without a writer.
+func (w *EventWriter) Add(event *AnalyticsEvent) {
+	if w == nil {
+		return
+	}
+
+	w.mutex.Lock()
+	w.pending = append(w.pending, event)
+	if dropped := len(w.pending) - w.maxPending; dropped > 0 {
+		w.pending = append([]*AnalyticsEvent(nil), w.pending[dropped:]...)
+		w.stats.Dropped += int64(dropped)
+	}
+	full := len(w.pending) >= w.batchSize
+	w.mutex.Unlock()
+
+	if full {
+		select {
+		case w.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Delete queues events to be deleted from the store, after the events queued before. Events not
+// written yet are dropped instead. Does nothing without a writer.
+func (w *EventWriter) Delete(ids []string) {
+	if w == nil || len(ids) == 0 {
+		return
+	}
+	deleted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	// A fresh slice, the batch being flushed may still be read from the old one
+	kept := make([]*AnalyticsEvent, 0, len(w.pending))
+	for _, event := range w.pending {
+		if !deleted[event.ID] {
+			kept = append(kept, event)
+		}
+	}
+	w.pending = kept
+	w.deletes = append(w.deletes, ids...)
+}
+
+// Query returns the events selected by the filter, oldest first: the stored events and those not
+// written yet, without the deleted events not deleted from the store yet
+func (w *EventWriter) Query(ctx context.Context, filter EventStoreFilter) ([]*AnalyticsEvent, error) {
+	stored, err := w.store.Query(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errEventStoreUnavailable, err)
+	}
+
+	w.mutex.Lock()
+	excluded := make(map[string]bool, len(w.deletes)+len(w.pending))
+	for _, id := range w.deletes {
+		excluded[id] = true
+	}
+	events := make([]*AnalyticsEvent, 0, len(stored))
+	for _, event := range w.pending {
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+		excluded[event.ID] = true // Pending events may have been written since the query
+	}
+	w.mutex.Unlock()
+
+	for _, event := range stored {
+		if !excluded[event.ID] {
+			events = append(events, event)
+		}
+	}
+	sortStoredEvents(events)
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+// Flush writes the pending events in batches, then deletes the queued deleted events. Writes stop
+// at the first failure; the events left are retried with the next flush. It returns the number of
+// events written.
+func (w *EventWriter) Flush() int {
+	w.flushMutex.Lock()
+	defer w.flushMutex.Unlock()
+
+	written := 0
+	for {
+		w.mutex.Lock()
+		// A copy, the pending events change while the batch is written
+		batch := slices.Clone(w.pending[:min(len(w.pending), w.batchSize)])
+		w.mutex.Unlock()
+		if len(batch) == 0 {
+			break
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+		err := w.store.Insert(ctx, batch)
+		cancel()
+
+		w.mutex.Lock()
+		if err != nil {
+			w.stats.FailedBatches++
+			w.mutex.Unlock()
+			w.circuit.Failure(err)
+			log.Printf("Warning: Failed to write %d events to the event store: %v", len(batch), err)
+			return written
+		}
+		// Events of the batch may have been dropped or deleted while it was written
+		written += len(batch)
+		w.stats.Written += int64(len(batch))
+		w.stats.Batches++
+		w.pending = w.withoutWritten(batch)
+		w.mutex.Unlock()
+		w.circuit.Success()
+	}
+
+	w.mutex.Lock()
+	deletes := w.deletes
+	w.deletes = nil
+	w.mutex.Unlock()
+	if len(deletes) == 0 {
+		return written
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	if err := w.store.Delete(ctx, deletes); err != nil {
+		log.Printf("Warning: Failed to delete %d events from the event store: %v", len(deletes), err)
+		w.mutex.Lock()
+		w.stats.FailedBatches++
+		w.deletes = append(deletes, w.deletes...)
+		w.mutex.Unlock()
+	}
+	return written
+}
+
+// withoutWritten returns the pending events without those of a written batch. Callers must hold
+// the lock.
+func (w *EventWriter) withoutWritten(batch []*AnalyticsEvent) []*AnalyticsEvent {
+	written := make(map[*AnalyticsEvent]bool, len(batch))
+	for _, event := range batch {
+		written[event] = true
+	}
+	pending := make([]*AnalyticsEvent, 0, len(w.pending))
+	for _, event := range w.pending {
+		if !written[event] {
+			pending = append(pending, event)
+		}
+	}
+	return pending
+}
+
+// Stats returns the writes of events to the store
+func (w *EventWriter) Stats() EventWriterStats {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	stats := w.stats
+	stats.Pending = len(w.pending)
+	stats.PendingDeletes = len(w.deletes)
+	return stats
+}
+
+// WriteMetrics writes the event store writes in the Prometheus text exposition format. Does
+// nothing without a writer.
+func (w *EventWriter) WriteMetrics(out io.Writer) error {
+	if w == nil {
+		return nil
+	}
+	stats := w.Stats()
+	_, err := fmt.Fprintf(out, "# HELP analytics_event_store_pending Events not written to the event store yet.\n# TYPE analytics_event_store_pending gauge\nanalytics_event_store_pending %d\n"+
+		"# HELP analytics_event_store_written_total Events written to the event store.\n# TYPE analytics_event_store_written_total counter\nanalytics_event_store_written_total %d\n"+
+		"# HELP analytics_event_store_failed_batches_total Batches the event store failed to write or delete, retried with the next flush.\n# TYPE analytics_event_store_failed_batches_total counter\nanalytics_event_store_failed_batches_total %d\n"+
+		"# HELP analytics_event_store_dropped_total Events dropped while the event store was unavailable.\n# TYPE analytics_event_store_dropped_total counter\nanalytics_event_store_dropped_total %d\n",
+		stats.Pending, stats.Written, stats.FailedBatches, stats.Dropped)
+	return err
+}
+
+// SetEventStore writes the events stored from now on to the store, in batches in the background,
+// and serves usage from it. Stored events written before are not copied; see LoadStoredEvents.
+// Failed writes open the ingestion circuit.
+func (s *AnalyticsService) SetEventStore(store EventStore) {
+	writer := NewEventWriter(store)
+	writer.circuit = s.circuit
+	writer.Start()
+	s.storeWriter = writer
+}
+
+// EventWriter returns the writer of events to the event store, nil without one
+func (s *AnalyticsService) EventWriter() *EventWriter {
+	return s.storeWriter
+}
+
+// CloseEventStore writes the pending events to the event store, then closes it. Does nothing
+// without one.
+func (s *AnalyticsService) CloseEventStore() error {
+	if s.storeWriter == nil {
+		return nil
+	}
+	s.storeWriter.Stop()
+	return s.storeWriter.store.Close()
+}
+
+// LoadStoredEvents loads the events of the event store into memory, counting them in the rollups,
+// series and dimensions, e.g. after a restart. Events already in memory are skipped. It returns
+// the number of events loaded.
+func (s *AnalyticsService) LoadStoredEvents(ctx context.Context) (int, error) {
+	if s.storeWriter == nil {
+		return 0, nil
+	}
+	events, err := s.storeWriter.store.Query(ctx, EventStoreFilter{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to load stored events: %w", err)
+	}
+
+	loaded := make([]*AnalyticsEvent, 0, len(events))
+	resolve := s.aliases.Resolver()
+	s.mutex.Lock()
+	for _, event := range events {
+		if _, exists := s.events[event.Region][event.ID]; exists {
+			continue
+		}
+		if s.events[event.Region] == nil {
+			s.events[event.Region] = make(map[string]*AnalyticsEvent)
+		}
+		s.events[event.Region][event.ID] = event
+		if event.BillingCorrelationID != "" {
+			s.correlations[event.BillingCorrelationID] = event
+		}
+		resolved := resolve(event)
+		s.rollups.Add(resolved)
+		s.series.Add(resolved)
+		loaded = append(loaded, event)
+	}
+	s.mutex.Unlock()
+
+	for _, event := range loaded {
+		s.dimensions.Index(event)
+	}
+	return len(loaded), nil
+}
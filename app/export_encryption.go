@@ -0,0 +1,404 @@
+package app
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Maximum number of export recipients of a project
+const maxExportRecipientsPerProject = 20
+
+// ExportContentType is the content type of encrypted exports
+const ExportContentType = "application/vnd.age"
+
+// ExportRecipient is a public key exports of a project are encrypted to. PGP keys are rejected:
+// neither the standard library nor golang.org/x/crypto has a maintained OpenPGP implementation
+// (x/crypto/openpgp is deprecated and frozen), and a recipient that cannot decrypt age files
+// would need every export encrypted twice.
+type ExportRecipient struct {
+	Name      string `json:"name"`       // Who holds the private key, e.g. "security-team"
+	PublicKey string `json:"public_key"` // age X25519 recipient, "age1..."
+}
+
+// errPGPNotSupported is returned for PGP public keys registered as export recipients
+var errPGPNotSupported = errors.New("PGP public keys are not supported, exports are encrypted with age: generate a recipient with age-keygen")
+
+// ProjectExportKeys are the recipients exports of a project are encrypted to
+type ProjectExportKeys struct {
+	Recipients []ExportRecipient `json:"recipients"` // Ordered by name
+	Required   bool              `json:"required"`   // Whether every export is encrypted, even when not requested
+	Version    int64             `json:"version"`    // Incremented on every update, exposed as the ETag
+}
+
+// ExportKeys holds the public keys each project registers for its exports. Exports are encrypted
+// in the age format (age-encryption.org/v1) to every recipient of the project, so a downloaded or
+// stored export can only be read by the holders of the matching private keys.
+type ExportKeys struct {
+	projects map[string]*ProjectExportKeys // Replaced, never modified, so encryptions can keep using a snapshot
+	mutex    sync.RWMutex
+}
+
+// NewExportKeys creates an empty registry of export keys
+func NewExportKeys() *ExportKeys {
+	return &ExportKeys{
+		projects: make(map[string]*ProjectExportKeys),
+	}
+}
+
+// Get returns the export recipients of a project
+func (k *ExportKeys) Get(projectID string) *ProjectExportKeys {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	keys, exists := k.projects[projectID]
+	if !exists {
+		return &ProjectExportKeys{Recipients: []ExportRecipient{}}
+	}
+	return keys.copy()
+}
+
+// Replace replaces the export recipients of a project and whether its exports must be encrypted.
+// The update is rejected with a VersionConflictError unless expectedVersion is the current version
+// (0 for a project without any). Exports encrypted before remain readable with the keys they were
+// encrypted to.
+func (k *ExportKeys) Replace(projectID string, recipients []ExportRecipient, required bool, expectedVersion int64) (*ProjectExportKeys, error) {
+	if required && len(recipients) == 0 {
+		return nil, fmt.Errorf("encryption can only be required with at least one export recipient")
+	}
+	if len(recipients) > maxExportRecipientsPerProject {
+		return nil, fmt.Errorf("a project can have at most %d export recipients", maxExportRecipientsPerProject)
+	}
+	names := make(map[string]bool, len(recipients))
+	for _, recipient := range recipients {
+		if recipient.Name == "" {
+			return nil, fmt.Errorf("export recipients must have a name")
+		}
+		if names[recipient.Name] {
+			return nil, fmt.Errorf("duplicate export recipient %s", recipient.Name)
+		}
+		names[recipient.Name] = true
+		if strings.Contains(recipient.PublicKey, "BEGIN PGP") {
+			return nil, fmt.Errorf("invalid public key of export recipient %s: %w", recipient.Name, errPGPNotSupported)
+		}
+		if _, err := parseAgeRecipient(recipient.PublicKey); err != nil {
+			return nil, fmt.Errorf("invalid public key of export recipient %s: %w", recipient.Name, err)
+		}
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	var current int64
+	if existing, exists := k.projects[projectID]; exists {
+		current = existing.Version
+	}
+	if err := checkVersion("export keys", projectID, current, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	updated := (&ProjectExportKeys{Recipients: recipients, Required: required, Version: current + 1}).copy()
+	sort.Slice(updated.Recipients, func(i, j int) bool {
+		return updated.Recipients[i].Name < updated.Recipients[j].Name
+	})
+	projects := make(map[string]*ProjectExportKeys, len(k.projects)+1)
+	for id, existing := range k.projects {
+		projects[id] = existing
+	}
+	projects[projectID] = updated
+	k.projects = projects
+
+	return updated.copy(), nil
+}
+
+// Required reports whether every export of a project must be encrypted
+func (k *ExportKeys) Required(projectID string) bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	keys, exists := k.projects[projectID]
+	return exists && keys.Required
+}
+
+// Encrypt returns a writer encrypting an export of a project to dst, for every recipient of the
+// project. The export is only complete once the writer is closed. It fails for projects without
+// recipients.
+func (k *ExportKeys) Encrypt(projectID string, dst io.Writer) (io.WriteCloser, error) {
+	k.mutex.RLock()
+	keys, exists := k.projects[projectID]
+	k.mutex.RUnlock()
+	if !exists || len(keys.Recipients) == 0 {
+		return nil, fmt.Errorf("project %s has no export keys; register them with PUT /api/v1/projects/%s/export-keys", projectID, projectID)
+	}
+
+	publicKeys := make([]*ecdh.PublicKey, 0, len(keys.Recipients))
+	for _, recipient := range keys.Recipients {
+		publicKey, err := parseAgeRecipient(recipient.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return newAgeWriter(dst, publicKeys)
+}
+
+// Seal encrypts a whole export of a project to every recipient of the project
+func (k *ExportKeys) Seal(projectID string, document []byte) ([]byte, error) {
+	var encrypted bytes.Buffer
+	writer, err := k.Encrypt(projectID, &encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(document); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return encrypted.Bytes(), nil
+}
+
+// copy returns a deep copy of the export keys
+func (p *ProjectExportKeys) copy() *ProjectExportKeys {
+	return &ProjectExportKeys{
+		Recipients: append([]ExportRecipient{}, p.Recipients...),
+		Required:   p.Required,
+		Version:    p.Version,
+	}
+}
+
+// Sizes of the age format
+const (
+	ageFileKeySize = 16
+	ageNonceSize   = 16
+	ageChunkSize   = 64 * 1024
+)
+
+// ageBase64 is the unpadded base64 encoding of age headers
+var ageBase64 = base64.RawStdEncoding
+
+// ageWriter encrypts a payload in the STREAM construction of age: chunks of 64 KiB sealed with
+// ChaCha20-Poly1305, the nonce counting the chunks and flagging the last one
+type ageWriter struct {
+	dst     io.Writer
+	aead    cipher.AEAD
+	buffer  []byte
+	counter uint64
+	closed  bool
+}
+
+// newAgeWriter writes the header of an age file encrypted to the X25519 recipients and returns a
+// writer encrypting the payload
+func newAgeWriter(dst io.Writer, recipients []*ecdh.PublicKey) (io.WriteCloser, error) {
+	fileKey := make([]byte, ageFileKeySize)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, err
+	}
+
+	var header strings.Builder
+	header.WriteString("age-encryption.org/v1\n")
+	for _, recipient := range recipients {
+		share, body, err := wrapAgeFileKey(fileKey, recipient)
+		if err != nil {
+			return nil, err
+		}
+		header.WriteString("-> X25519 " + ageBase64.EncodeToString(share) + "\n")
+		encoded := ageBase64.EncodeToString(body)
+		for len(encoded) >= 64 {
+			header.WriteString(encoded[:64] + "\n")
+			encoded = encoded[64:]
+		}
+		header.WriteString(encoded + "\n")
+	}
+	header.WriteString("---")
+
+	mac := hmac.New(sha256.New, ageKey(fileKey, nil, "header"))
+	mac.Write([]byte(header.String()))
+	header.WriteString(" " + ageBase64.EncodeToString(mac.Sum(nil)) + "\n")
+
+	nonce := make([]byte, ageNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(ageKey(fileKey, nonce, "payload"))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(dst, header.String()); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(nonce); err != nil {
+		return nil, err
+	}
+	return &ageWriter{dst: dst, aead: aead, buffer: make([]byte, 0, ageChunkSize)}, nil
+}
+
+// Write encrypts every full chunk, keeping the rest until more is written or the writer is closed
+func (w *ageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("export is already complete")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only flushed once more follows, since the last chunk is flagged
+		if len(w.buffer) == ageChunkSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):ageChunkSize], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close encrypts the last chunk
+func (w *ageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+// flush seals the buffered chunk
+func (w *ageWriter) flush(last bool) error {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], w.counter)
+	if last {
+		nonce[11] = 1
+	}
+	w.counter++
+
+	_, err := w.dst.Write(w.aead.Seal(nil, nonce, w.buffer, nil))
+	w.buffer = w.buffer[:0]
+	return err
+}
+
+// wrapAgeFileKey encrypts the file key to an X25519 recipient, returning the ephemeral share and
+// the wrapped key
+func wrapAgeFileKey(fileKey []byte, recipient *ecdh.PublicKey) ([]byte, []byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+	share := ephemeral.PublicKey().Bytes()
+
+	salt := append(append([]byte{}, share...), recipient.Bytes()...)
+	aead, err := chacha20poly1305.New(ageKey(secret, salt, "age-encryption.org/v1/X25519"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return share, aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil), nil
+}
+
+// ageKey derives a 32-byte key with HKDF-SHA256
+func ageKey(secret, salt []byte, info string) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic(err) // HKDF only fails past 255 blocks of output
+	}
+	return key
+}
+
+// parseAgeRecipient decodes an age X25519 recipient, the Bech32 encoding of the public key with
+// the "age" prefix
+func parseAgeRecipient(recipient string) (*ecdh.PublicKey, error) {
+	prefix, data, err := decodeBech32(recipient)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "age" {
+		return nil, fmt.Errorf("expected an age recipient starting with age1")
+	}
+	return ecdh.X25519().NewPublicKey(data)
+}
+
+// bech32Charset maps the 5-bit groups of Bech32 to characters
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// decodeBech32 decodes a lowercase or uppercase Bech32 string (BIP 173) into its prefix and data, checking its checksum
+func decodeBech32(encoded string) (string, []byte, error) {
+	if strings.ToUpper(encoded) == encoded {
+		encoded = strings.ToLower(encoded)
+	}
+	separator := strings.LastIndexByte(encoded, '1')
+	if separator < 1 || separator+7 > len(encoded) {
+		return "", nil, fmt.Errorf("malformed Bech32 string")
+	}
+	prefix := encoded[:separator]
+
+	values := make([]byte, 0, len(encoded)-separator-1)
+	for _, char := range encoded[separator+1:] {
+		value := strings.IndexRune(bech32Charset, char)
+		if value < 0 {
+			return "", nil, fmt.Errorf("invalid Bech32 character %q", char)
+		}
+		values = append(values, byte(value))
+	}
+
+	checked := make([]byte, 0, len(prefix)*2+1+len(values))
+	for i := 0; i < len(prefix); i++ {
+		checked = append(checked, prefix[i]>>5)
+	}
+	checked = append(checked, 0)
+	for i := 0; i < len(prefix); i++ {
+		checked = append(checked, prefix[i]&31)
+	}
+	if bech32Polymod(append(checked, values...)) != 1 {
+		return "", nil, fmt.Errorf("invalid Bech32 checksum")
+	}
+
+	// Regroup the 5-bit values without the checksum into bytes
+	var data []byte
+	var accumulator, bits uint
+	for _, value := range values[:len(values)-6] {
+		accumulator = accumulator<<5 | uint(value)
+		bits += 5
+		for bits >= 8 {
+			bits -= 8
+			data = append(data, byte(accumulator>>bits))
+		}
+	}
+	if bits >= 5 || accumulator&(1<<bits-1) != 0 {
+		return "", nil, fmt.Errorf("invalid Bech32 padding")
+	}
+	return prefix, data, nil
+}
+
+// bech32Polymod computes the Bech32 checksum of values
+func bech32Polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	checksum := uint32(1)
+	for _, value := range values {
+		top := checksum >> 25
+		checksum = (checksum&0x1ffffff)<<5 ^ uint32(value)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				checksum ^= generator[i]
+			}
+		}
+	}
+	return checksum
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getProjectExportKeys returns the export recipients of a project with their version as the ETag
+func (s *App) getProjectExportKeys(c *fiber.Ctx) error {
+	keys := s.exportKeys.Get(c.Params("id"))
+
+	c.Set(fiber.HeaderETag, ETag(keys.Version))
+	return c.JSON(fiber.Map{
+		"status":      "success",
+		"export_keys": keys,
+	})
+}
+
+// updateProjectExportKeys replaces the export recipients of a project. Replacing existing ones
+// requires If-Match with the version being updated.
+func (s *App) updateProjectExportKeys(c *fiber.Ctx) error {
+	var request struct {
+		Recipients []ExportRecipient `json:"recipients"`
+		Required   bool              `json:"required"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first keys of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if s.exportKeys.Get(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := s.exportKeys.Replace(projectID, request.Recipients, request.Required, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	// Whoever controls the keys can read every later export
+	names := make([]string, 0, len(updated.Recipients))
+	for _, recipient := range updated.Recipients {
+		names = append(names, recipient.Name)
+	}
+	s.siem.Export(requestSecurityEvent(c, SecurityAdmin, "export_keys.update", OutcomeSuccess, 6, map[string]interface{}{
+		"project_id": projectID,
+		"recipients": names,
+		"required":   updated.Required,
+		"version":    updated.Version,
+	}))
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status":      "success",
+		"export_keys": updated,
+	})
+}
+
+// encryptExport reports whether an export of a project is encrypted to its export keys: when the
+// project requires it, or the request asks for it through ?encrypt=true or by accepting ExportContentType.
+// Security events of projects requiring it are encrypted by the SIEM exporter.
+func (s *App) encryptExport(c *fiber.Ctx, projectID string) bool {
+	return s.exportKeys.Required(projectID) || c.Query("encrypt") == "true" || c.Get(fiber.HeaderAccept) == ExportContentType
+}
+
+// sendEncryptedExport responds with a document encrypted to the export keys of a project, as a download
+func (s *App) sendEncryptedExport(c *fiber.Ctx, projectID, filename string, document []byte) error {
+	encrypted, err := s.exportKeys.Seal(projectID, document)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Attachment(filename + ".age")
+	c.Set(fiber.HeaderContentType, ExportContentType)
+	return c.Send(encrypted)
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// setFaultRequest is the body of a fault rule update
+type setFaultRequest struct {
+	Operation string  `json:"operation"`
+	LatencyMs int64   `json:"latency_ms"`
+	ErrorRate float64 `json:"error_rate"`
+	Error     string  `json:"error"`
+	Remaining int     `json:"remaining"`
+	Duration  string  `json:"duration"` // How long the rule lasts, e.g. "10m"; the maximum duration when empty
+}
+
+// getFaults returns whether fault injection is enabled and the rules in effect
+func (s *App) getFaults(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"enabled": s.faults.Enabled(),
+		"rules":   s.faults.Rules(),
+	})
+}
+
+// setFault sets the latency and errors injected into the calls of a dependency
+func (s *App) setFault(c *fiber.Ctx) error {
+	if !s.faults.Enabled() {
+		return c.Status(http.StatusForbidden).JSON(fiber.Map{
+			"error": "fault injection is disabled",
+		})
+	}
+
+	var request setFaultRequest
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		parsed, err := time.ParseDuration(request.Duration)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid duration: " + request.Duration,
+			})
+		}
+		duration = parsed
+	}
+
+	rule, err := s.faults.SetRule(FaultRule{
+		Dependency: utils.CopyString(c.Params("dependency")),
+		Operation:  request.Operation,
+		LatencyMs:  request.LatencyMs,
+		ErrorRate:  request.ErrorRate,
+		Error:      request.Error,
+		Remaining:  request.Remaining,
+	}, duration)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "faults.set", rule.Dependency, map[string]interface{}{
+		"rule": rule,
+	})
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"rule":   rule,
+	})
+}
+
+// clearFault removes the rule of a dependency and the operation given in the query, if any
+func (s *App) clearFault(c *fiber.Ctx) error {
+	dependency := utils.CopyString(c.Params("dependency"))
+	operation := utils.CopyString(c.Query("operation"))
+	if !s.faults.ClearRule(dependency, operation) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": "no fault rule for " + faultRuleKey(dependency, operation),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "faults.clear", dependency, map[string]interface{}{
+		"operation": operation,
+	})
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+// clearFaults removes every fault rule
+func (s *App) clearFaults(c *fiber.Ctx) error {
+	cleared := s.faults.Clear()
+
+	s.auditLog.Record(adminActor(c), "faults.clear", "*", map[string]interface{}{
+		"cleared": cleared,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"cleared": cleared,
+	})
+}
@@ -0,0 +1,239 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dependencies faults can be injected into, and the operations of each
+const (
+	FaultBilling = "billing" // Operations: usage, event
+	FaultKafka   = "kafka"   // Operations: the event types of consumed messages
+	FaultStore   = "store"   // Operations: write
+)
+
+// faultDependencies lists the dependencies faults can be injected into
+var faultDependencies = []string{FaultBilling, FaultKafka, FaultStore}
+
+// FaultRule injects latency and errors into the calls of a dependency
+type FaultRule struct {
+	Dependency string    `json:"dependency"`
+	Operation  string    `json:"operation,omitempty"` // Only this operation, every operation when empty
+	LatencyMs  int64     `json:"latency_ms"`          // Added to every matching call
+	ErrorRate  float64   `json:"error_rate"`          // Share of matching calls failing, from 0 to 1
+	Error      string    `json:"error,omitempty"`     // Message of the injected errors
+	Remaining  int       `json:"remaining,omitempty"` // Calls left to affect, unlimited when 0
+	ExpiresAt  time.Time `json:"expires_at"`
+	Injected   int64     `json:"injected"` // Calls affected so far
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// InjectedFaultError is returned by calls failed on purpose
+type InjectedFaultError struct {
+	Dependency string
+	Operation  string
+	Message    string
+}
+
+func (e *InjectedFaultError) Error() string {
+	return fmt.Sprintf("injected %s %s fault: %s", e.Dependency, e.Operation, e.Message)
+}
+
+// FaultInjector adds latency and errors to the calls the service makes to its dependencies, to
+// validate how retries, the billing status and alerting cope with them. It is disabled unless
+// FAULT_INJECTION_ENABLED is true, and cannot be enabled when ENVIRONMENT is production. Rules
+// expire after at most FAULT_INJECTION_MAX_DURATION (default: 1h), so forgotten faults stop.
+type FaultInjector struct {
+	enabled     bool
+	maxDuration time.Duration
+	rules       map[string]*FaultRule // Dependency/operation -> rule
+	random      func() float64
+	clock       Clock
+	mutex       sync.Mutex
+}
+
+// NewFaultInjector creates a fault injector configured from FAULT_INJECTION_ENABLED, ENVIRONMENT
+// and FAULT_INJECTION_MAX_DURATION
+func NewFaultInjector() *FaultInjector {
+	enabled := os.Getenv("FAULT_INJECTION_ENABLED") == "true"
+	if environment := strings.ToLower(os.Getenv("ENVIRONMENT")); enabled && (environment == "production" || environment == "prod") {
+		log.Printf("Warning: Fault injection cannot be enabled in production, ignoring FAULT_INJECTION_ENABLED")
+		enabled = false
+	}
+	if enabled {
+		log.Printf("Warning: Fault injection is enabled")
+	}
+
+	return &FaultInjector{
+		enabled:     enabled,
+		maxDuration: getEnvDuration("FAULT_INJECTION_MAX_DURATION", time.Hour),
+		rules:       make(map[string]*FaultRule),
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())).Float64,
+		clock:       SystemClock(),
+	}
+}
+
+// Enabled reports whether faults can be injected
+func (f *FaultInjector) Enabled() bool {
+	return f != nil && f.enabled
+}
+
+// SetRandom replaces the source deciding which calls fail, e.g. with a fixed sequence in tests
+func (f *FaultInjector) SetRandom(random func() float64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.random = random
+}
+
+// SetClock sets the clock rules expire by
+func (f *FaultInjector) SetClock(clock Clock) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.clock = clock
+}
+
+// faultRuleKey returns the key of the rule of a dependency and operation
+func faultRuleKey(dependency, operation string) string {
+	return dependency + "/" + operation
+}
+
+// SetRule validates and sets the rule of its dependency and operation, lasting for the duration
+// (at most the maximum duration, which is also the default)
+func (f *FaultInjector) SetRule(rule FaultRule, duration time.Duration) (*FaultRule, error) {
+	if !f.Enabled() {
+		return nil, fmt.Errorf("fault injection is disabled")
+	}
+	known := false
+	for _, dependency := range faultDependencies {
+		known = known || dependency == rule.Dependency
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown dependency: %s. Valid dependencies are: %s", rule.Dependency, strings.Join(faultDependencies, ", "))
+	}
+	if rule.LatencyMs < 0 {
+		return nil, fmt.Errorf("latency must not be negative")
+	}
+	if rule.ErrorRate < 0 || rule.ErrorRate > 1 {
+		return nil, fmt.Errorf("error rate must be between 0 and 1, got %v", rule.ErrorRate)
+	}
+	if rule.LatencyMs == 0 && rule.ErrorRate == 0 {
+		return nil, fmt.Errorf("a rule must add latency or errors")
+	}
+	if rule.Remaining < 0 {
+		return nil, fmt.Errorf("remaining must not be negative")
+	}
+	if duration < 0 {
+		return nil, fmt.Errorf("duration must not be negative")
+	}
+	if duration == 0 || duration > f.maxDuration {
+		duration = f.maxDuration
+	}
+	if rule.Error == "" {
+		rule.Error = "fault injected for testing"
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rule.Injected = 0
+	rule.CreatedAt = f.clock.Now()
+	rule.ExpiresAt = rule.CreatedAt.Add(duration)
+	f.rules[faultRuleKey(rule.Dependency, rule.Operation)] = &rule
+	copied := rule
+	return &copied, nil
+}
+
+// ClearRule removes the rule of a dependency and operation, reporting whether there was one
+func (f *FaultInjector) ClearRule(dependency, operation string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := faultRuleKey(dependency, operation)
+	_, exists := f.rules[key]
+	delete(f.rules, key)
+	return exists
+}
+
+// Clear removes every rule and returns how many there were
+func (f *FaultInjector) Clear() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	count := len(f.rules)
+	f.rules = make(map[string]*FaultRule)
+	return count
+}
+
+// Rules returns the rules in effect, ordered by dependency and operation
+func (f *FaultInjector) Rules() []FaultRule {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.clock.Now()
+	rules := make([]FaultRule, 0, len(f.rules))
+	for key, rule := range f.rules {
+		if !now.Before(rule.ExpiresAt) {
+			delete(f.rules, key)
+			continue
+		}
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Dependency != rules[j].Dependency {
+			return rules[i].Dependency < rules[j].Dependency
+		}
+		return rules[i].Operation < rules[j].Operation
+	})
+	return rules
+}
+
+// Inject applies the rule of a dependency's operation, or of all its operations, to a call: it
+// waits for the rule's latency and returns an InjectedFaultError for the failing share of calls.
+// It returns nil right away when fault injection is disabled or no rule matches.
+func (f *FaultInjector) Inject(dependency, operation string) error {
+	if !f.Enabled() {
+		return nil
+	}
+
+	f.mutex.Lock()
+	key := faultRuleKey(dependency, operation)
+	rule, exists := f.rules[key]
+	if !exists {
+		key = faultRuleKey(dependency, "")
+		rule, exists = f.rules[key]
+	}
+	if !exists {
+		f.mutex.Unlock()
+		return nil
+	}
+	if !f.clock.Now().Before(rule.ExpiresAt) {
+		delete(f.rules, key)
+		f.mutex.Unlock()
+		return nil
+	}
+
+	latency := time.Duration(rule.LatencyMs) * time.Millisecond
+	fail := rule.ErrorRate > 0 && f.random() < rule.ErrorRate
+	message := rule.Error
+	rule.Injected++
+	if rule.Remaining > 0 {
+		rule.Remaining--
+		if rule.Remaining == 0 {
+			delete(f.rules, key)
+		}
+	}
+	f.mutex.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if fail {
+		return &InjectedFaultError{Dependency: dependency, Operation: operation, Message: message}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// requireFeature rejects requests of projects that may not use a feature
+func (s *App) requireFeature(feature string) fiber.Handler {
+	return s.requireFeatureOf(feature, projectIDFromRequest)
+}
+
+// requireProjectFeature rejects requests to /projects/:id routes of projects that may not use a feature
+func (s *App) requireProjectFeature(feature string) fiber.Handler {
+	return s.requireFeatureOf(feature, func(c *fiber.Ctx) string {
+		return c.Params("id")
+	})
+}
+
+// requireFeatureOf rejects requests whose project, as told by projectID, may not use a feature
+func (s *App) requireFeatureOf(feature string, projectID func(c *fiber.Ctx) string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if project := projectID(c); !s.features.Enabled(project, feature) {
+			return s.featureNotEnabled(c, utils.CopyString(project), feature)
+		}
+		return c.Next()
+	}
+}
+
+// featureNotEnabled responds that a project may not use a feature, naming the project's plan
+func (s *App) featureNotEnabled(c *fiber.Ctx, projectID, feature string) error {
+	project := s.features.Project(projectID)
+	response := fiber.Map{
+		"error":      "feature not enabled",
+		"feature":    feature,
+		"project_id": project.ProjectID,
+	}
+	if project.Plan != "" {
+		response["plan"] = project.Plan
+	}
+	return c.Status(http.StatusForbidden).JSON(response)
+}
+
+// getProjectFeatures returns the plan of a project and the features it may use, along with the
+// features of every plan
+func (s *App) getProjectFeatures(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"features": s.features.Project(c.Params("id")),
+		"plans":    s.features.PlanFeatures(),
+	})
+}
+
+// setProjectFeatures replaces the plan of a project and the features enabled or disabled
+// regardless of it
+func (s *App) setProjectFeatures(c *fiber.Ctx) error {
+	var request struct {
+		Plan      string          `json:"plan"`
+		Overrides map[string]bool `json:"overrides"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	projectID := utils.CopyString(c.Params("project_id"))
+	previous := s.features.Project(projectID)
+	if err := s.features.SetProject(projectID, request.Plan, request.Overrides); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	features := s.features.Project(projectID)
+
+	s.auditLog.Record(adminActor(c), "project.features", projectID, map[string]interface{}{
+		"previous": previous,
+		"features": features,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"features": features,
+	})
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Analytics capabilities packaged into plans and toggled per project
+const (
+	FeatureHeatmaps      = "heatmaps"       // Heatmap generation and reads
+	FeatureSessionReplay = "session_replay" // Recording and replaying sessions
+	FeatureExports       = "exports"        // Downloading data and configuration exports
+	FeatureExperiments   = "experiments"    // A/B experiments and their results
+)
+
+// analyticsFeatures lists every feature, sorted by name
+var analyticsFeatures = []string{FeatureExperiments, FeatureExports, FeatureHeatmaps, FeatureSessionReplay}
+
+// defaultPlanFeatures are the features each plan includes unless configured otherwise
+var defaultPlanFeatures = map[string][]string{
+	"free":       {FeatureHeatmaps},
+	"pro":        {FeatureHeatmaps, FeatureExports, FeatureSessionReplay},
+	"enterprise": analyticsFeatures,
+}
+
+// ProjectFeatures reports the features enabled for a project, from its plan and overrides
+type ProjectFeatures struct {
+	ProjectID string          `json:"project_id"`
+	Plan      string          `json:"plan,omitempty"` // Without a plan, every feature is enabled
+	Features  map[string]bool `json:"features"`
+	Overrides map[string]bool `json:"overrides,omitempty"` // Features enabled or disabled regardless of the plan
+}
+
+// FeatureFlags decides which analytics features each project may use. Features come with the
+// project's plan, and can be enabled or disabled per project regardless of it.
+type FeatureFlags struct {
+	planFeatures map[string]map[string]bool // Features by plan name
+	projectPlans map[string]string          // Plan name by project ID
+	overrides    map[string]map[string]bool // Enabled or disabled features by project ID
+	defaultPlan  string
+	mutex        sync.RWMutex
+}
+
+// NewFeatureFlags creates feature flags where each plan includes the comma-separated features of
+// FEATURES_<PLAN> (e.g. FEATURES_PRO=heatmaps,exports), or its default features when unset.
+// Projects without a plan get FEATURE_DEFAULT_PLAN, or every feature when it is unset.
+func NewFeatureFlags() *FeatureFlags {
+	flags := &FeatureFlags{
+		planFeatures: make(map[string]map[string]bool, len(defaultPlanFeatures)),
+		projectPlans: make(map[string]string),
+		overrides:    make(map[string]map[string]bool),
+	}
+
+	for plan, features := range defaultPlanFeatures {
+		if value, exists := os.LookupEnv("FEATURES_" + strings.ToUpper(plan)); exists {
+			features = nil
+			for _, feature := range strings.Split(value, ",") {
+				feature = strings.TrimSpace(feature)
+				if feature == "" {
+					continue
+				}
+				if !isAnalyticsFeature(feature) {
+					log.Printf("Warning: Unknown feature %q in FEATURES_%s, ignoring", feature, strings.ToUpper(plan))
+					continue
+				}
+				features = append(features, feature)
+			}
+		}
+		flags.planFeatures[plan] = make(map[string]bool, len(features))
+		for _, feature := range features {
+			flags.planFeatures[plan][feature] = true
+		}
+	}
+
+	defaultPlan := os.Getenv("FEATURE_DEFAULT_PLAN")
+	if _, exists := flags.planFeatures[defaultPlan]; exists {
+		flags.defaultPlan = defaultPlan
+	} else if defaultPlan != "" {
+		log.Printf("Warning: Unknown FEATURE_DEFAULT_PLAN %q, enabling every feature", defaultPlan)
+	}
+	return flags
+}
+
+// Features returns every feature, sorted by name
+func (f *FeatureFlags) Features() []string {
+	return append([]string(nil), analyticsFeatures...)
+}
+
+// PlanFeatures returns the features each plan includes, sorted by name
+func (f *FeatureFlags) PlanFeatures() map[string][]string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	plans := make(map[string][]string, len(f.planFeatures))
+	for plan, features := range f.planFeatures {
+		plans[plan] = make([]string, 0, len(features))
+		for feature := range features {
+			plans[plan] = append(plans[plan], feature)
+		}
+		sort.Strings(plans[plan])
+	}
+	return plans
+}
+
+// Enabled reports whether a project may use a feature
+func (f *FeatureFlags) Enabled(projectID, feature string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.enabled(projectOrDefault(projectID), feature)
+}
+
+// Project returns the plan, overrides and enabled features of a project
+func (f *FeatureFlags) Project(projectID string) ProjectFeatures {
+	projectID = projectOrDefault(projectID)
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	project := ProjectFeatures{
+		ProjectID: projectID,
+		Plan:      f.plan(projectID),
+		Features:  make(map[string]bool, len(analyticsFeatures)),
+	}
+	for _, feature := range analyticsFeatures {
+		project.Features[feature] = f.enabled(projectID, feature)
+	}
+	if overrides := f.overrides[projectID]; len(overrides) > 0 {
+		project.Overrides = make(map[string]bool, len(overrides))
+		for feature, enabled := range overrides {
+			project.Overrides[feature] = enabled
+		}
+	}
+	return project
+}
+
+// SetProject replaces the plan and overrides of a project. An empty plan falls back to the
+// default plan.
+func (f *FeatureFlags) SetProject(projectID, plan string, overrides map[string]bool) error {
+	projectID = projectOrDefault(projectID)
+	for feature := range overrides {
+		if !isAnalyticsFeature(feature) {
+			return fmt.Errorf("unknown feature: %s. Valid features are: %s", feature, strings.Join(analyticsFeatures, ", "))
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if plan == "" {
+		delete(f.projectPlans, projectID)
+	} else if _, exists := f.planFeatures[plan]; !exists {
+		return fmt.Errorf("unknown plan: %s", plan)
+	} else {
+		f.projectPlans[projectID] = plan
+	}
+
+	if len(overrides) == 0 {
+		delete(f.overrides, projectID)
+		return nil
+	}
+	f.overrides[projectID] = make(map[string]bool, len(overrides))
+	for feature, enabled := range overrides {
+		f.overrides[projectID][feature] = enabled
+	}
+	return nil
+}
+
+// plan returns the plan of a project, or the default plan. The caller must hold the mutex.
+func (f *FeatureFlags) plan(projectID string) string {
+	if plan, exists := f.projectPlans[projectID]; exists {
+		return plan
+	}
+	return f.defaultPlan
+}
+
+// enabled reports whether a project may use a feature. The caller must hold the mutex.
+func (f *FeatureFlags) enabled(projectID, feature string) bool {
+	if enabled, exists := f.overrides[projectID][feature]; exists {
+		return enabled
+	}
+	plan := f.plan(projectID)
+	if plan == "" {
+		return isAnalyticsFeature(feature)
+	}
+	return f.planFeatures[plan][feature]
+}
+
+// isAnalyticsFeature reports whether a feature exists
+func isAnalyticsFeature(feature string) bool {
+	for _, known := range analyticsFeatures {
+		if feature == known {
+			return true
+		}
+	}
+	return false
+}
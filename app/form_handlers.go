@@ -0,0 +1,38 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getFormReport returns the completion rate and per-field drop-off, time and errors of a form
+// over ?start_date and ?end_date (default the last 30 days)
+func (s *App) getFormReport(c *fiber.Ctx) error {
+	start, end, err := queryTimeRange(map[string]interface{}{
+		"start_date": c.Query("start_date"),
+		"end_date":   c.Query("end_date"),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	report, err := s.formService.Report(ctx, FormQuery{
+		FormID: c.Params("form_id"),
+		Start:  start,
+		End:    end,
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"report": report,
+	})
+}
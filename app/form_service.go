@@ -0,0 +1,277 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Event types of form interactions. They carry the form in the "form_id" property and, except
+// for submits, the field in "field". Errors may describe the problem in "error".
+const (
+	FormFocusEvent  = "form_focus"
+	FormBlurEvent   = "form_blur"
+	FormChangeEvent = "form_change"
+	FormSubmitEvent = "form_submit"
+	FormErrorEvent  = "form_error"
+)
+
+// formEventTypes are the event types of form interactions
+var formEventTypes = map[string]bool{
+	FormFocusEvent:  true,
+	FormBlurEvent:   true,
+	FormChangeEvent: true,
+	FormSubmitEvent: true,
+	FormErrorEvent:  true,
+}
+
+// FormService computes completion and per-field analytics of forms from interaction events
+type FormService struct {
+	analyticsService *AnalyticsService
+}
+
+// FormQuery represents a query for a form report
+type FormQuery struct {
+	FormID string    `json:"form_id"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// FormReport represents the analytics of a form. Each user interacting with the form is an attempt
+// to fill it; users who submitted it completed it.
+type FormReport struct {
+	FormID         string        `json:"form_id"`
+	TimeRange      TimeRange     `json:"time_range"`
+	StartedUsers   int64         `json:"started_users"`   // Users who interacted with the form
+	SubmittedUsers int64         `json:"submitted_users"` // Users who submitted the form
+	CompletionRate float64       `json:"completion_rate"` // Percentage of started users who submitted
+	AbandonedUsers int64         `json:"abandoned_users"`
+	Submissions    int64         `json:"submissions"`
+	Errors         int64         `json:"errors"`
+	Fields         []FieldReport `json:"fields"` // In the order users fill them in
+	ComputedAt     time.Time     `json:"computed_at"`
+}
+
+// FieldReport represents the analytics of a single form field
+type FieldReport struct {
+	Field       string  `json:"field"`
+	Users       int64   `json:"users"`         // Users who interacted with the field
+	Focuses     int64   `json:"focuses"`       // Times the field was focused
+	Changes     int64   `json:"changes"`       // Times the field's value was changed
+	DropOffs    int64   `json:"drop_offs"`     // Abandoning users whose last interaction was the field
+	DropOffRate float64 `json:"drop_off_rate"` // Percentage of the field's users who dropped off at it
+	// Time between focusing and leaving the field, over every visit
+	AvgTimeMs    int64   `json:"avg_time_ms"`
+	MedianTimeMs int64   `json:"median_time_ms"`
+	TotalTimeMs  int64   `json:"total_time_ms"`
+	Errors       int64   `json:"errors"`
+	ErrorUsers   int64   `json:"error_users"`
+	ErrorRate    float64 `json:"error_rate"` // Percentage of the field's users who got an error
+	// Most frequent error messages first
+	TopErrors []FieldError `json:"top_errors,omitempty"`
+
+	position float64 // Average position in the users' order of first interaction
+}
+
+// FieldError is an error message of a field and how often it occurred
+type FieldError struct {
+	Message string `json:"message"`
+	Count   int64  `json:"count"`
+}
+
+// Error messages listed per field
+const maxFieldErrors = 5
+
+// fieldStats accumulates the interactions with a field
+type fieldStats struct {
+	report     FieldReport
+	users      map[string]bool
+	errorUsers map[string]bool
+	errors     map[string]int64
+	durations  []time.Duration
+	positions  []int
+}
+
+// NewFormService creates a new form service instance
+func NewFormService(analyticsService *AnalyticsService) *FormService {
+	return &FormService{
+		analyticsService: analyticsService,
+	}
+}
+
+// IsFormEvent reports whether the event type is a form interaction
+func IsFormEvent(eventType string) bool {
+	return formEventTypes[eventType]
+}
+
+// Report computes the completion rate and per-field drop-off, time and errors of the project's
+// form in the time range
+func (s *FormService) Report(ctx context.Context, query FormQuery) (*FormReport, error) {
+	if query.FormID == "" {
+		return nil, fmt.Errorf("form ID is required")
+	}
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+
+	start := time.Now()
+
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		Start:     query.Start,
+		End:       query.End,
+	})
+
+	// Group the form's interactions by user, oldest first
+	userEvents := make(map[string][]*AnalyticsEvent)
+	for _, event := range events {
+		if !IsFormEvent(event.EventType) {
+			continue
+		}
+		if formID, _ := event.Properties["form_id"].(string); formID != query.FormID {
+			continue
+		}
+		userEvents[event.UserID] = append(userEvents[event.UserID], event)
+	}
+
+	report := &FormReport{
+		FormID:     query.FormID,
+		TimeRange:  TimeRange{Start: query.Start, End: query.End},
+		Fields:     []FieldReport{},
+		ComputedAt: time.Now(),
+	}
+
+	fields := make(map[string]*fieldStats)
+	fieldFor := func(name string) *fieldStats {
+		stats, exists := fields[name]
+		if !exists {
+			stats = &fieldStats{
+				report:     FieldReport{Field: name},
+				users:      make(map[string]bool),
+				errorUsers: make(map[string]bool),
+				errors:     make(map[string]int64),
+			}
+			fields[name] = stats
+		}
+		return stats
+	}
+
+	for userID, interactions := range userEvents {
+		report.StartedUsers++
+
+		submitted := false
+		lastField := ""
+		focused := make(map[string]time.Time)
+		seen := make(map[string]bool)
+		for _, event := range interactions {
+			if event.EventType == FormSubmitEvent {
+				report.Submissions++
+				submitted = true
+				continue
+			}
+
+			name, _ := event.Properties["field"].(string)
+			if name == "" {
+				continue
+			}
+			field := fieldFor(name)
+			field.users[userID] = true
+			lastField = name
+			if !seen[name] {
+				field.positions = append(field.positions, len(seen))
+				seen[name] = true
+			}
+
+			switch event.EventType {
+			case FormFocusEvent:
+				field.report.Focuses++
+				focused[name] = event.Timestamp
+			case FormBlurEvent:
+				if focusedAt, ok := focused[name]; ok {
+					field.durations = append(field.durations, event.Timestamp.Sub(focusedAt))
+					delete(focused, name)
+				}
+			case FormChangeEvent:
+				field.report.Changes++
+			case FormErrorEvent:
+				report.Errors++
+				field.report.Errors++
+				field.errorUsers[userID] = true
+				message, _ := event.Properties["error"].(string)
+				if message == "" {
+					message = "unknown"
+				}
+				field.errors[message]++
+			}
+		}
+
+		if submitted {
+			report.SubmittedUsers++
+			continue
+		}
+		report.AbandonedUsers++
+		if lastField != "" {
+			fields[lastField].report.DropOffs++
+		}
+	}
+
+	if report.StartedUsers > 0 {
+		report.CompletionRate = float64(report.SubmittedUsers) / float64(report.StartedUsers) * 100
+	}
+
+	for _, stats := range fields {
+		field := stats.report
+		field.Users = int64(len(stats.users))
+		field.ErrorUsers = int64(len(stats.errorUsers))
+		if field.Users > 0 {
+			field.DropOffRate = float64(field.DropOffs) / float64(field.Users) * 100
+			field.ErrorRate = float64(field.ErrorUsers) / float64(field.Users) * 100
+		}
+
+		if len(stats.durations) > 0 {
+			sort.Slice(stats.durations, func(i, j int) bool { return stats.durations[i] < stats.durations[j] })
+			var total time.Duration
+			for _, duration := range stats.durations {
+				total += duration
+			}
+			field.TotalTimeMs = total.Milliseconds()
+			field.AvgTimeMs = (total / time.Duration(len(stats.durations))).Milliseconds()
+			field.MedianTimeMs = stats.durations[len(stats.durations)/2].Milliseconds()
+		}
+
+		for message, count := range stats.errors {
+			field.TopErrors = append(field.TopErrors, FieldError{Message: message, Count: count})
+		}
+		sort.Slice(field.TopErrors, func(i, j int) bool {
+			if field.TopErrors[i].Count != field.TopErrors[j].Count {
+				return field.TopErrors[i].Count > field.TopErrors[j].Count
+			}
+			return field.TopErrors[i].Message < field.TopErrors[j].Message
+		})
+		if len(field.TopErrors) > maxFieldErrors {
+			field.TopErrors = field.TopErrors[:maxFieldErrors]
+		}
+
+		total := 0
+		for _, position := range stats.positions {
+			total += position
+		}
+		field.position = float64(total) / float64(len(stats.positions))
+		report.Fields = append(report.Fields, field)
+	}
+	sort.Slice(report.Fields, func(i, j int) bool {
+		if report.Fields[i].position != report.Fields[j].position {
+			return report.Fields[i].position < report.Fields[j].position
+		}
+		return report.Fields[i].Field < report.Fields[j].Field
+	})
+
+	s.analyticsService.SlowOperations().Observe(SlowOperationForm, map[string]interface{}{
+		"form_id": query.FormID,
+		"start":   query.Start,
+		"end":     query.End,
+	}, time.Since(start), int64(len(events)), s.analyticsService.calculateAPICallCost("/api/v1/forms/report", "GET"))
+
+	return report, nil
+}
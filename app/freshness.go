@@ -0,0 +1,213 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// Stages of the ingestion pipeline, in the order events go through them
+const (
+	FreshnessIngest  = "ingest"  // Accepted by the API and taken off the ingestion queue
+	FreshnessStore   = "store"   // Stored and readable by raw event queries
+	FreshnessRollups = "rollups" // Counted in the daily rollups
+	FreshnessCaches  = "caches"  // Reflected by the cached query results
+)
+
+// FreshnessStage reports how current a stage of the pipeline is. The watermark is the time
+// through which every event the API received has gone through the stage, and the lag is how far
+// the watermark trails the current time: 0 when the stage is caught up.
+type FreshnessStage struct {
+	Stage      string     `json:"stage"`
+	Newest     *time.Time `json:"newest,omitempty"` // Received time of the newest event the stage processed
+	Watermark  time.Time  `json:"watermark"`
+	LagSeconds float64    `json:"lag_seconds"`
+	Pending    int        `json:"pending"` // Events received but not through the stage yet
+}
+
+// FreshnessReport reports how current a project's data is at each stage of the pipeline. The
+// report's watermark and lag are those of the stage trailing the most.
+type FreshnessReport struct {
+	ProjectID  string           `json:"project_id"`
+	Stages     []FreshnessStage `json:"stages"`
+	Watermark  time.Time        `json:"watermark"`
+	LagSeconds float64          `json:"lag_seconds"`
+	CheckedAt  time.Time        `json:"checked_at"`
+}
+
+// projectFreshness holds the received time of the newest event each stage processed for a project
+type projectFreshness struct {
+	accepted time.Time
+	stored   time.Time
+	rolledUp time.Time
+}
+
+// pendingEvent is an event received but not stored yet
+type pendingEvent struct {
+	projectID  string
+	receivedAt time.Time
+	queued     bool // Waiting in the ingestion queue, rather than being processed
+}
+
+// PipelineFreshness tracks the events going through the pipeline, to report how far each stage
+// trails the events received
+type PipelineFreshness struct {
+	projects map[string]*projectFreshness
+	pending  map[uint64]*pendingEvent
+	next     uint64
+	mutex    sync.Mutex
+}
+
+// NewPipelineFreshness creates a tracker with no events received yet
+func NewPipelineFreshness() *PipelineFreshness {
+	return &PipelineFreshness{
+		projects: make(map[string]*projectFreshness),
+		pending:  make(map[uint64]*pendingEvent),
+	}
+}
+
+// queue records an event accepted into the ingestion queue and returns its token, which is
+// passed to done once the event left the pipeline, whatever became of it
+func (f *PipelineFreshness) queue(projectID string, receivedAt time.Time) uint64 {
+	return f.add(projectID, receivedAt, true)
+}
+
+// process records an event being processed and returns its token, which is passed to done once
+// the event left the pipeline, whatever became of it
+func (f *PipelineFreshness) process(projectID string, receivedAt time.Time) uint64 {
+	return f.add(projectID, receivedAt, false)
+}
+
+// add records a pending event
+func (f *PipelineFreshness) add(projectID string, receivedAt time.Time, queued bool) uint64 {
+	projectID = projectOrDefault(projectID)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.next++
+	f.pending[f.next] = &pendingEvent{projectID: projectID, receivedAt: receivedAt, queued: queued}
+	project := f.project(projectID)
+	if receivedAt.After(project.accepted) {
+		project.accepted = receivedAt
+	}
+	return f.next
+}
+
+// dequeue records a queued event being taken off the ingestion queue
+func (f *PipelineFreshness) dequeue(token uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if event, exists := f.pending[token]; exists {
+		event.queued = false
+	}
+}
+
+// done records an event leaving the pipeline, stored or not
+func (f *PipelineFreshness) done(token uint64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.pending, token)
+}
+
+// stored records an event stored and counted in the rollups
+func (f *PipelineFreshness) stored(event *AnalyticsEvent) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	project := f.project(projectOrDefault(event.ProjectID))
+	if event.ReceivedAt.After(project.stored) {
+		project.stored = event.ReceivedAt
+	}
+	if event.ReceivedAt.After(project.rolledUp) {
+		project.rolledUp = event.ReceivedAt
+	}
+}
+
+// project returns the newest events of a project, creating them if needed. The caller must hold
+// the mutex.
+func (f *PipelineFreshness) project(projectID string) *projectFreshness {
+	project, exists := f.projects[projectID]
+	if !exists {
+		project = &projectFreshness{}
+		f.projects[projectID] = project
+	}
+	return project
+}
+
+// Report reports the freshness of a project's data at each stage. Rollups are counted as events
+// are stored, so they trail the store by the same events. Cached results reflect the events
+// received before they were computed: the caches are as current as their oldest result still
+// served, and never more current than the rollups.
+func (f *PipelineFreshness) Report(projectID string, cache *QueryCache, now time.Time) *FreshnessReport {
+	projectID = projectOrDefault(projectID)
+
+	f.mutex.Lock()
+	newest := projectFreshness{}
+	if project, exists := f.projects[projectID]; exists {
+		newest = *project
+	}
+	queued, processing := 0, 0
+	queuedSince, processingSince := now, now
+	for _, event := range f.pending {
+		if event.projectID != projectID {
+			continue
+		}
+		if event.queued {
+			queued++
+			queuedSince = earliest(queuedSince, event.receivedAt)
+		} else {
+			processing++
+		}
+		processingSince = earliest(processingSince, event.receivedAt)
+	}
+	f.mutex.Unlock()
+
+	cached, oldest, newestCached := cache.ComputedRange(projectID)
+	stages := []FreshnessStage{
+		freshnessStage(FreshnessIngest, newest.accepted, queuedSince, queued, now),
+		freshnessStage(FreshnessStore, newest.stored, processingSince, queued+processing, now),
+		freshnessStage(FreshnessRollups, newest.rolledUp, processingSince, queued+processing, now),
+		freshnessStage(FreshnessCaches, newestCached, earliest(processingSince, oldest), queued+processing, now),
+	}
+	if cached == 0 {
+		// Nothing cached is served, queries compute from the rollups
+		stages[3] = freshnessStage(FreshnessCaches, time.Time{}, processingSince, queued+processing, now)
+	}
+
+	report := &FreshnessReport{
+		ProjectID: projectID,
+		Stages:    stages,
+		Watermark: now,
+		CheckedAt: now,
+	}
+	for _, stage := range stages {
+		if stage.Watermark.Before(report.Watermark) {
+			report.Watermark = stage.Watermark
+		}
+		report.LagSeconds = max(report.LagSeconds, stage.LagSeconds)
+	}
+	return report
+}
+
+// freshnessStage reports a stage whose events received before the watermark were all processed
+func freshnessStage(stage string, newest, watermark time.Time, pending int, now time.Time) FreshnessStage {
+	report := FreshnessStage{
+		Stage:      stage,
+		Watermark:  watermark,
+		LagSeconds: max(now.Sub(watermark).Seconds(), 0),
+		Pending:    pending,
+	}
+	if !newest.IsZero() {
+		report.Newest = &newest
+	}
+	return report
+}
+
+// earliest returns the earlier of two times, ignoring zero times
+func earliest(a, b time.Time) time.Time {
+	if b.IsZero() || (!a.IsZero() && a.Before(b)) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,329 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// ClickEventType is the event type of clicks. Clicks carry their position on the page in the
+// "x" and "y" properties and, optionally, the clicked element in "selector".
+const ClickEventType = "click"
+
+// Kinds of frustration signals
+const (
+	FrustrationRageClick = "rage_click"
+	FrustrationDeadClick = "dead_click"
+)
+
+// FrustrationService detects rage clicks and dead clicks in the click stream
+type FrustrationService struct {
+	analyticsService *AnalyticsService
+	rageClickCount   int           // Clicks in a burst making it a rage click
+	rageClickWindow  time.Duration // Time from the first to the last click of a burst
+	rageClickRadius  float64       // Distance in pixels from the first click of a burst
+	deadClickWindow  time.Duration // Time within which a click should cause another event
+}
+
+// FrustrationQuery represents a query for the frustration report
+type FrustrationQuery struct {
+	Page  string    `json:"page,omitempty"` // Empty for every page
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Limit int       `json:"limit,omitempty"` // Maximum number of hotspots returned
+}
+
+// FrustrationReport summarizes the rage and dead clicks of a project for UX triage
+type FrustrationReport struct {
+	Page          string               `json:"page,omitempty"`
+	TimeRange     TimeRange            `json:"time_range"`
+	TotalClicks   int                  `json:"total_clicks"`
+	RageClicks    int                  `json:"rage_clicks"` // Bursts of rapid clicks in the same area
+	DeadClicks    int                  `json:"dead_clicks"` // Clicks not followed by any other event
+	AffectedUsers int                  `json:"affected_users"`
+	Pages         []PageFrustration    `json:"pages"`    // Most frustrating pages first
+	Hotspots      []FrustrationHotspot `json:"hotspots"` // Most frequent signals first
+	ComputedAt    time.Time            `json:"computed_at"`
+}
+
+// PageFrustration is the frustration of a single page
+type PageFrustration struct {
+	Page            string  `json:"page"`
+	Clicks          int     `json:"clicks"`
+	RageClicks      int     `json:"rage_clicks"`
+	DeadClicks      int     `json:"dead_clicks"`
+	AffectedUsers   int     `json:"affected_users"`
+	DeadClickRate   float64 `json:"dead_click_rate"`  // Percentage of clicks that were dead
+	FrustrationRate float64 `json:"frustration_rate"` // Percentage of clicking users with a signal
+}
+
+// FrustrationHotspot is an element, or area of a page, where a signal repeatedly occurs
+type FrustrationHotspot struct {
+	Kind     string    `json:"kind"` // rage_click or dead_click
+	Page     string    `json:"page"`
+	Selector string    `json:"selector,omitempty"`
+	X        int       `json:"x"` // Position of the first occurrence
+	Y        int       `json:"y"`
+	Count    int       `json:"count"`
+	Users    int       `json:"users"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// frustrationSignal is a single rage or dead click
+type frustrationSignal struct {
+	kind  string
+	click *AnalyticsEvent
+	x, y  float64
+}
+
+// Size of the page areas grouping signals on elements without a selector
+const frustrationAreaSize = 50
+
+// NewFrustrationService creates a detector configured by FRUSTRATION_RAGE_CLICK_COUNT (default 3),
+// FRUSTRATION_RAGE_CLICK_WINDOW (1s), FRUSTRATION_RAGE_CLICK_RADIUS (30 pixels) and
+// FRUSTRATION_DEAD_CLICK_WINDOW (2s)
+func NewFrustrationService(analyticsService *AnalyticsService) *FrustrationService {
+	return &FrustrationService{
+		analyticsService: analyticsService,
+		rageClickCount:   getEnvInt("FRUSTRATION_RAGE_CLICK_COUNT", 3),
+		rageClickWindow:  getEnvDuration("FRUSTRATION_RAGE_CLICK_WINDOW", time.Second),
+		rageClickRadius:  getEnvFloat("FRUSTRATION_RAGE_CLICK_RADIUS", 30),
+		deadClickWindow:  getEnvDuration("FRUSTRATION_DEAD_CLICK_WINDOW", 2*time.Second),
+	}
+}
+
+// Report detects the rage and dead clicks of the project's clicks in the time range
+func (s *FrustrationService) Report(ctx context.Context, query FrustrationQuery) (*FrustrationReport, error) {
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	if query.Limit <= 0 {
+		query.Limit = 20
+	}
+
+	clicks, signals := s.detect(ctx, query.Page, query.Start, query.End)
+
+	report := &FrustrationReport{
+		Page:        query.Page,
+		TimeRange:   TimeRange{Start: query.Start, End: query.End},
+		TotalClicks: len(clicks),
+		Pages:       []PageFrustration{},
+		Hotspots:    []FrustrationHotspot{},
+		ComputedAt:  time.Now(),
+	}
+
+	pages := make(map[string]*PageFrustration)
+	clickingUsers := make(map[string]map[string]bool)
+	for _, click := range clicks {
+		page, exists := pages[click.Page]
+		if !exists {
+			page = &PageFrustration{Page: click.Page}
+			pages[click.Page] = page
+			clickingUsers[click.Page] = make(map[string]bool)
+		}
+		page.Clicks++
+		clickingUsers[click.Page][click.UserID] = true
+	}
+
+	affected := make(map[string]bool)
+	affectedByPage := make(map[string]map[string]bool)
+	hotspots := make(map[string]*FrustrationHotspot)
+	hotspotUsers := make(map[string]map[string]bool)
+	for _, signal := range signals {
+		page := pages[signal.click.Page]
+		if signal.kind == FrustrationRageClick {
+			report.RageClicks++
+			page.RageClicks++
+		} else {
+			report.DeadClicks++
+			page.DeadClicks++
+		}
+		affected[signal.click.UserID] = true
+		if affectedByPage[page.Page] == nil {
+			affectedByPage[page.Page] = make(map[string]bool)
+		}
+		affectedByPage[page.Page][signal.click.UserID] = true
+
+		selector, _ := signal.click.Properties["selector"].(string)
+		key := fmt.Sprintf("%s|%s|%s", signal.kind, signal.click.Page, selector)
+		if selector == "" {
+			key += fmt.Sprintf("|%d,%d", int(signal.x)/frustrationAreaSize, int(signal.y)/frustrationAreaSize)
+		}
+		hotspot, exists := hotspots[key]
+		if !exists {
+			hotspot = &FrustrationHotspot{
+				Kind:     signal.kind,
+				Page:     signal.click.Page,
+				Selector: selector,
+				X:        int(signal.x),
+				Y:        int(signal.y),
+			}
+			hotspots[key] = hotspot
+			hotspotUsers[key] = make(map[string]bool)
+		}
+		hotspot.Count++
+		hotspotUsers[key][signal.click.UserID] = true
+		if signal.click.Timestamp.After(hotspot.LastSeen) {
+			hotspot.LastSeen = signal.click.Timestamp
+		}
+	}
+	report.AffectedUsers = len(affected)
+
+	for _, page := range pages {
+		page.AffectedUsers = len(affectedByPage[page.Page])
+		page.DeadClickRate = float64(page.DeadClicks) / float64(page.Clicks) * 100
+		page.FrustrationRate = float64(page.AffectedUsers) / float64(len(clickingUsers[page.Page])) * 100
+		report.Pages = append(report.Pages, *page)
+	}
+	sort.Slice(report.Pages, func(i, j int) bool {
+		a, b := report.Pages[i], report.Pages[j]
+		if a.RageClicks+a.DeadClicks != b.RageClicks+b.DeadClicks {
+			return a.RageClicks+a.DeadClicks > b.RageClicks+b.DeadClicks
+		}
+		return a.Page < b.Page
+	})
+
+	for key, hotspot := range hotspots {
+		hotspot.Users = len(hotspotUsers[key])
+		report.Hotspots = append(report.Hotspots, *hotspot)
+	}
+	sort.Slice(report.Hotspots, func(i, j int) bool {
+		a, b := report.Hotspots[i], report.Hotspots[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.LastSeen.After(b.LastSeen)
+	})
+	if len(report.Hotspots) > query.Limit {
+		report.Hotspots = report.Hotspots[:query.Limit]
+	}
+
+	return report, nil
+}
+
+// Counts returns the number of rage clicks and dead clicks on a page in the time range
+func (s *FrustrationService) Counts(ctx context.Context, page string, start, end time.Time) (int, int) {
+	_, signals := s.detect(ctx, page, start, end)
+	rageClicks, deadClicks := 0, 0
+	for _, signal := range signals {
+		if signal.kind == FrustrationRageClick {
+			rageClicks++
+		} else {
+			deadClicks++
+		}
+	}
+	return rageClicks, deadClicks
+}
+
+// detect returns the project's clicks on the page (every page if empty) in the time range, and
+// their rage and dead clicks. A rage click is a burst of at least rageClickCount clicks of a user
+// within rageClickWindow and rageClickRadius of its first click. A dead click is a click not
+// followed by another event of the user, such as a navigation or a change, within deadClickWindow.
+func (s *FrustrationService) detect(ctx context.Context, page string, start, end time.Time) ([]*AnalyticsEvent, []frustrationSignal) {
+	// Events after the range may still be what a click in the range caused
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		Start:     start,
+		End:       end.Add(s.deadClickWindow),
+	})
+
+	clicks := make([]*AnalyticsEvent, 0)
+	userEvents := make(map[string][]*AnalyticsEvent)
+	for _, event := range events {
+		userEvents[event.UserID] = append(userEvents[event.UserID], event)
+		if event.EventType == ClickEventType && event.Timestamp.Before(end) && (page == "" || event.Page == page) {
+			clicks = append(clicks, event)
+		}
+	}
+
+	userClicks := make(map[string][]*AnalyticsEvent)
+	for _, click := range clicks {
+		userClicks[click.UserID] = append(userClicks[click.UserID], click)
+	}
+	signals := make([]frustrationSignal, 0)
+	inBurst := make(map[string]bool)
+	for _, clicks := range userClicks {
+		signals = append(signals, s.rageClicks(clicks, inBurst)...)
+	}
+
+	// The clicks of a burst are reported as its rage click only
+	for _, click := range clicks {
+		if !inBurst[click.ID] && s.isDeadClick(click, userEvents[click.UserID]) {
+			x, y := clickPosition(click)
+			signals = append(signals, frustrationSignal{kind: FrustrationDeadClick, click: click, x: x, y: y})
+		}
+	}
+
+	return clicks, signals
+}
+
+// isDeadClick reports whether no other event of the user followed the click within the window.
+// The user's events are ordered by time; events at the same time as the click count as following it.
+func (s *FrustrationService) isDeadClick(click *AnalyticsEvent, events []*AnalyticsEvent) bool {
+	index := sort.Search(len(events), func(i int) bool {
+		return !events[i].Timestamp.Before(click.Timestamp)
+	})
+	for _, event := range events[index:] {
+		if event.Timestamp.Sub(click.Timestamp) > s.deadClickWindow {
+			return true
+		}
+		if event.EventType != ClickEventType {
+			return false
+		}
+	}
+	return true
+}
+
+// rageClicks finds the bursts of a user's clicks, ordered by time, and marks their clicks in
+// inBurst. Each burst is a single rage click at the position of its first click.
+func (s *FrustrationService) rageClicks(clicks []*AnalyticsEvent, inBurst map[string]bool) []frustrationSignal {
+	signals := make([]frustrationSignal, 0)
+	for i := 0; i < len(clicks); {
+		first := clicks[i]
+		x, y := clickPosition(first)
+		burst := 1
+		for j := i + 1; j < len(clicks); j++ {
+			next := clicks[j]
+			if next.Page != first.Page || next.Timestamp.Sub(first.Timestamp) > s.rageClickWindow {
+				break
+			}
+			nextX, nextY := clickPosition(next)
+			if math.Hypot(nextX-x, nextY-y) > s.rageClickRadius {
+				break
+			}
+			burst++
+		}
+
+		if burst >= s.rageClickCount {
+			signals = append(signals, frustrationSignal{kind: FrustrationRageClick, click: first, x: x, y: y})
+			for _, click := range clicks[i : i+burst] {
+				inBurst[click.ID] = true
+			}
+			i += burst
+		} else {
+			i++
+		}
+	}
+	return signals
+}
+
+// clickPosition returns the x and y properties of a click
+func clickPosition(click *AnalyticsEvent) (float64, float64) {
+	return numberProperty(click.Properties, "x"), numberProperty(click.Properties, "y")
+}
+
+// numberProperty returns a numeric event property, or 0 if it is missing
+func numberProperty(properties map[string]interface{}, key string) float64 {
+	switch value := properties[key].(type) {
+	case float64:
+		return value
+	case int:
+		return float64(value)
+	case int64:
+		return float64(value)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getFrustrationReport returns the project's rage and dead clicks, optionally on a single ?page,
+// over ?start_date and ?end_date (default the last 30 days)
+func (s *App) getFrustrationReport(c *fiber.Ctx) error {
+	start, end, err := queryTimeRange(map[string]interface{}{
+		"start_date": c.Query("start_date"),
+		"end_date":   c.Query("end_date"),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	report, err := s.heatmapService.Frustration().Report(ctx, FrustrationQuery{
+		Page:  c.Query("page"),
+		Start: start,
+		End:   end,
+		Limit: c.QueryInt("limit", 20),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"report": report,
+	})
+}
+
+// getSessionQualityReport returns the quality scores of the project's sessions starting between
+// ?start_date and ?end_date (default the last 30 days), with the ?limit lowest scoring sessions
+func (s *App) getSessionQualityReport(c *fiber.Ctx) error {
+	start, end, err := queryTimeRange(map[string]interface{}{
+		"start_date": c.Query("start_date"),
+		"end_date":   c.Query("end_date"),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	report, err := s.sessionQuality.Report(ctx, SessionQualityQuery{
+		Start: start,
+		End:   end,
+		Limit: c.QueryInt("limit", 10),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"report": report,
+	})
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Limits of the properties captured at funnel steps
+const (
+	maxCapturedProperties = 10 // Properties captured per step
+	maxCapturedValues     = 20 // Most frequent values reported per property
+)
+
+// CapturedProperty is the distribution of a property captured at a funnel step, over the users
+// reaching the step, with how many of them went on to complete the funnel
+type CapturedProperty struct {
+	Property     string `json:"property"`
+	Users        int64  `json:"users"`         // Users reaching the step with the property
+	UsersWithout int64  `json:"users_without"` // Users reaching the step without it, or with a null value
+	// The most frequent values, then by value; OtherUsers counts the users with the other values
+	Values     []CapturedValue `json:"values"`
+	OtherUsers int64           `json:"other_users"`
+	// Set when every value is a number: the values of the users reaching the step, and of the
+	// ones among them who completed the funnel
+	Numeric          *NumericDistribution `json:"numeric,omitempty"`
+	ConvertedNumeric *NumericDistribution `json:"converted_numeric,omitempty"`
+}
+
+// CapturedValue is a value of a captured property and the users reaching the step with it
+type CapturedValue struct {
+	Value          string  `json:"value"`
+	Users          int64   `json:"users"`
+	Converted      int64   `json:"converted"`       // Of them, users who completed the funnel
+	ConversionRate float64 `json:"conversion_rate"` // Converted users in percent
+}
+
+// validateCapture checks the properties a funnel step captures
+func validateCapture(step int, properties []string) error {
+	if len(properties) > maxCapturedProperties {
+		return fmt.Errorf("step %d can capture at most %d properties", step, maxCapturedProperties)
+	}
+	seen := make(map[string]bool, len(properties))
+	for _, property := range properties {
+		if property == "" {
+			return fmt.Errorf("captured properties of step %d must not be empty", step)
+		}
+		if seen[property] {
+			return fmt.Errorf("step %d captures %s twice", step, property)
+		}
+		seen[property] = true
+	}
+	return nil
+}
+
+// captureValues returns the values of the properties a step captures from the event reaching it,
+// nil when the step captures nothing
+func captureValues(step Step, event *AnalyticsEvent) []interface{} {
+	if len(step.Capture) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(step.Capture))
+	for i, property := range step.Capture {
+		values[i] = event.Properties[property]
+	}
+	return values
+}
+
+// captureAccumulator collects the values of a captured property of the users reaching a step
+type captureAccumulator struct {
+	property  string
+	without   int64
+	values    map[string]*CapturedValue
+	numbers   []float64
+	converted []float64
+	numeric   bool
+}
+
+// newCaptureAccumulators returns an accumulator per property a step captures
+func newCaptureAccumulators(step Step) []*captureAccumulator {
+	accumulators := make([]*captureAccumulator, len(step.Capture))
+	for i, property := range step.Capture {
+		accumulators[i] = &captureAccumulator{property: property, values: make(map[string]*CapturedValue), numeric: true}
+	}
+	return accumulators
+}
+
+// add counts the value a user reached the step with
+func (a *captureAccumulator) add(raw interface{}, converted bool) {
+	if raw == nil {
+		a.without++
+		return
+	}
+
+	value := fmt.Sprint(raw)
+	count, exists := a.values[value]
+	if !exists {
+		count = &CapturedValue{Value: value}
+		a.values[value] = count
+	}
+	count.Users++
+	if converted {
+		count.Converted++
+	}
+
+	if number, ok := propertyNumber(raw); ok && a.numeric {
+		a.numbers = append(a.numbers, number)
+		if converted {
+			a.converted = append(a.converted, number)
+		}
+	} else {
+		a.numeric = false
+	}
+}
+
+// result returns the distribution of the values collected
+func (a *captureAccumulator) result() CapturedProperty {
+	captured := CapturedProperty{Property: a.property, UsersWithout: a.without, Values: make([]CapturedValue, 0, len(a.values))}
+	for _, value := range a.values {
+		captured.Users += value.Users
+		value.ConversionRate = math.Round(10000*float64(value.Converted)/float64(value.Users)) / 100
+		captured.Values = append(captured.Values, *value)
+	}
+	sort.Slice(captured.Values, func(i, j int) bool {
+		if captured.Values[i].Users != captured.Values[j].Users {
+			return captured.Values[i].Users > captured.Values[j].Users
+		}
+		return captured.Values[i].Value < captured.Values[j].Value
+	})
+	if len(captured.Values) > maxCapturedValues {
+		for _, other := range captured.Values[maxCapturedValues:] {
+			captured.OtherUsers += other.Users
+		}
+		captured.Values = captured.Values[:maxCapturedValues]
+	}
+
+	if a.numeric && len(a.numbers) > 0 {
+		captured.Numeric = numericDistribution(a.numbers, defaultPropertyBuckets)
+		if len(a.converted) > 0 {
+			captured.ConvertedNumeric = numericDistribution(a.converted, defaultPropertyBuckets)
+		}
+	}
+	return captured
+}
@@ -2,22 +2,38 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
-// FunnelService computes conversion funnels from analytics events
+// errFunnelNotFound is returned for funnels that do not exist in the context's project
+var errFunnelNotFound = errors.New("funnel not found")
+
+// StepSourceAnalytics is the source of steps matching only events tracked by the analytics service
+const StepSourceAnalytics = "analytics"
+
+// FunnelService computes conversion funnels from analytics events and the events of other
+// services consumed from Kafka
 type FunnelService struct {
 	analyticsService *AnalyticsService
+	serviceEvents    *ServiceEventLog   // Events of other services steps can reference, if any
+	funnels          map[string]*Funnel // In-memory storage for now
+	mutex            sync.RWMutex
 }
 
 // Funnel represents a conversion funnel with multiple steps
 type Funnel struct {
 	ID          string    `json:"id"`
+	ProjectID   string    `json:"project_id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
 	Steps       []Step    `json:"steps"`
+	Version     int64     `json:"version"` // Incremented on every update, exposed as the ETag
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
@@ -27,11 +43,20 @@ type Step struct {
 	ID          string                 `json:"id"`
 	Name        string                 `json:"name"`
 	EventType   string                 `json:"event_type"`
+	Source      string                 `json:"source,omitempty"` // StepSourceAnalytics, auth, billing or payments, empty for any
 	Filters     map[string]interface{} `json:"filters,omitempty"`
+	Capture     []string               `json:"capture,omitempty"` // Properties whose values at the step are reported
 	Order       int                    `json:"order"`
 	Description string                 `json:"description,omitempty"`
 }
 
+// funnelEvent is an event a funnel step can match: an analytics event, or the event of another
+// service with its qualified type and its data as properties
+type funnelEvent struct {
+	*AnalyticsEvent
+	service string // Service of a cross-service event, empty for analytics events
+}
+
 // FunnelResult represents the computed results of a funnel
 type FunnelResult struct {
 	FunnelID       string       `json:"funnel_id"`
@@ -40,7 +65,17 @@ type FunnelResult struct {
 	Steps          []StepResult `json:"steps"`
 	ConversionRate float64      `json:"conversion_rate"`
 	TotalUsers     int64        `json:"total_users"`
-	ComputedAt     time.Time    `json:"computed_at"`
+	// Funnels of the users per value of the breakdown dimension, computed from stored events
+	Breakdown  []FunnelSegment `json:"breakdown,omitempty"`
+	ComputedAt time.Time       `json:"computed_at"`
+}
+
+// FunnelSegment is the funnel of the users whose first step carried one value of a dimension
+type FunnelSegment struct {
+	Value          string       `json:"value"`
+	Steps          []StepResult `json:"steps"`
+	ConversionRate float64      `json:"conversion_rate"`
+	TotalUsers     int64        `json:"total_users"`
 }
 
 // StepResult represents the results for a specific funnel step
@@ -51,6 +86,8 @@ type StepResult struct {
 	UniqueUsers    int64   `json:"unique_users"`
 	DropOffRate    float64 `json:"drop_off_rate"`
 	ConversionRate float64 `json:"conversion_rate"`
+	// Distributions of the properties the step captures, from the events the users reached it with
+	Captured []CapturedProperty `json:"captured,omitempty"`
 }
 
 // TimeRange represents a time period for funnel analysis
@@ -65,67 +102,275 @@ type FunnelQuery struct {
 	UserID   string    `json:"user_id,omitempty"`
 	Start    time.Time `json:"start"`
 	End      time.Time `json:"end"`
+	// Custom dimension splitting the users
+	Breakdown string `json:"breakdown,omitempty"`
 }
 
 // NewFunnelService creates a new funnel service instance
 func NewFunnelService(analyticsService *AnalyticsService) *FunnelService {
 	return &FunnelService{
 		analyticsService: analyticsService,
+		funnels:          make(map[string]*Funnel),
 	}
 }
 
-// CreateFunnel creates a new conversion funnel
+// SetServiceEventLog sets the log of cross-service events funnel steps can reference
+func (s *FunnelService) SetServiceEventLog(events *ServiceEventLog) {
+	s.serviceEvents = events
+}
+
+// CreateFunnel creates a new conversion funnel in the context's project
 func (s *FunnelService) CreateFunnel(ctx context.Context, name, description string, steps []Step) (*Funnel, error) {
-	if name == "" {
-		return nil, fmt.Errorf("funnel name is required")
+	funnel, _, err := s.CreateFunnelWithID(ctx, "", name, description, steps)
+	return funnel, err
+}
+
+// CreateFunnelWithID creates a funnel under a client-supplied ID, or a generated one when empty. Retrying
+// with the same definition returns the existing funnel, reporting it was not created; a different
+// definition is rejected with a ResourceExistsError.
+func (s *FunnelService) CreateFunnelWithID(ctx context.Context, funnelID, name, description string, steps []Step) (*Funnel, bool, error) {
+	if err := validateFunnel(name, steps); err != nil {
+		return nil, false, err
+	}
+	if funnelID != "" {
+		if err := validateResourceID(funnelID); err != nil {
+			return nil, false, err
+		}
 	}
 
-	if len(steps) < 2 {
-		return nil, fmt.Errorf("funnel must have at least 2 steps")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	projectID := ProjectFromContext(ctx)
+	if existing, exists := s.funnels[funnelID]; exists {
+		candidate := Funnel{Name: name, Description: description, Steps: steps}
+		if existing.ProjectID != projectID || existing.Fingerprint() != candidate.Fingerprint() {
+			return nil, false, &ResourceExistsError{Resource: ResourceFunnel, ID: funnelID}
+		}
+		copied := *existing
+		return &copied, false, nil
 	}
 
-	// Validate step order
-	for i, step := range steps {
-		if step.Order != i+1 {
-			return nil, fmt.Errorf("step order must be sequential starting from 1")
+	funnel := s.insert(projectID, funnelID, name, description, steps)
+	copied := *funnel
+	return &copied, true, nil
+}
+
+// UpsertFunnel creates or replaces a funnel of the context's project, matched by ID when one is given
+// and by name otherwise. Replacing a funnel with an identical definition leaves its version unchanged.
+func (s *FunnelService) UpsertFunnel(ctx context.Context, funnelID, name, description string, steps []Step) (*Funnel, bool, error) {
+	if err := validateFunnel(name, steps); err != nil {
+		return nil, false, err
+	}
+	if funnelID != "" {
+		if err := validateResourceID(funnelID); err != nil {
+			return nil, false, err
 		}
-		if step.EventType == "" {
-			return nil, fmt.Errorf("event type is required for step %d", i+1)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	projectID := ProjectFromContext(ctx)
+	var existing *Funnel
+	if funnelID != "" {
+		existing = s.funnels[funnelID]
+		if existing != nil && existing.ProjectID != projectID {
+			return nil, false, &ResourceExistsError{Resource: ResourceFunnel, ID: funnelID}
+		}
+	} else {
+		// Several funnels may share a name; the oldest one is replaced
+		for _, funnel := range s.funnels {
+			if funnel.ProjectID == projectID && funnel.Name == name && (existing == nil || funnel.CreatedAt.Before(existing.CreatedAt)) {
+				existing = funnel
+			}
 		}
 	}
 
+	if existing == nil {
+		funnel := s.insert(projectID, funnelID, name, description, steps)
+		copied := *funnel
+		return &copied, true, nil
+	}
+
+	candidate := Funnel{Name: name, Description: description, Steps: steps}
+	if existing.Fingerprint() != candidate.Fingerprint() {
+		existing.Name = name
+		existing.Description = description
+		existing.Steps = steps
+		existing.Version++
+		existing.UpdatedAt = s.analyticsService.Clock().Now()
+	}
+
+	copied := *existing
+	return &copied, false, nil
+}
+
+// insert stores a new funnel, generating its ID when empty. Callers must hold the lock.
+func (s *FunnelService) insert(projectID, funnelID, name, description string, steps []Step) *Funnel {
+	if funnelID == "" {
+		funnelID = "funnel_" + s.analyticsService.ids.NewID()
+	}
+
+	now := s.analyticsService.Clock().Now()
 	funnel := &Funnel{
-		ID:          generateFunnelID(),
+		ID:          funnelID,
+		ProjectID:   projectID,
 		Name:        name,
 		Description: description,
 		Steps:       steps,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		Version:     1,
+		CreatedAt:   now,
+		UpdatedAt:   now,
 	}
 
 	// In a real implementation, this would be stored in a database
+	s.funnels[funnel.ID] = funnel
+
 	log.Printf("Created funnel: %s with %d steps", funnel.ID, len(funnel.Steps))
+	return funnel
+}
+
+// Fingerprint identifies the funnel's definition, ignoring its ID, version and timestamps
+func (f *Funnel) Fingerprint() string {
+	return fingerprint(struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Steps       []Step `json:"steps"`
+	}{f.Name, f.Description, f.Steps})
+}
+
+// GetFunnel returns a stored funnel of the context's project
+func (s *FunnelService) GetFunnel(ctx context.Context, funnelID string) (*Funnel, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	funnel, err := s.lookup(ProjectFromContext(ctx), funnelID)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *funnel
+	return &copied, nil
+}
 
+// ListFunnels returns the stored funnels of the context's project, oldest first
+func (s *FunnelService) ListFunnels(ctx context.Context) []*Funnel {
+	projectID := ProjectFromContext(ctx)
+
+	s.mutex.RLock()
+	funnels := make([]*Funnel, 0)
+	for _, funnel := range s.funnels {
+		if funnel.ProjectID == projectID {
+			copied := *funnel
+			funnels = append(funnels, &copied)
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(funnels, func(i, j int) bool {
+		return funnels[i].CreatedAt.Before(funnels[j].CreatedAt)
+	})
+	return funnels
+}
+
+// DeleteFunnel removes a stored funnel of the context's project
+func (s *FunnelService) DeleteFunnel(ctx context.Context, funnelID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.lookup(ProjectFromContext(ctx), funnelID); err != nil {
+		return err
+	}
+
+	delete(s.funnels, funnelID)
+	return nil
+}
+
+// lookup returns a stored funnel of a project. Callers must hold the lock.
+func (s *FunnelService) lookup(projectID, funnelID string) (*Funnel, error) {
+	funnel, exists := s.funnels[funnelID]
+	if !exists || funnel.ProjectID != projectID {
+		return nil, fmt.Errorf("%w: %s", errFunnelNotFound, funnelID)
+	}
 	return funnel, nil
 }
 
+// UpdateFunnel replaces the definition of a funnel of the context's project. The update is rejected with a
+// VersionConflictError unless expectedVersion is the funnel's current version.
+func (s *FunnelService) UpdateFunnel(ctx context.Context, funnelID, name, description string, steps []Step, expectedVersion int64) (*Funnel, error) {
+	if err := validateFunnel(name, steps); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	funnel, err := s.lookup(ProjectFromContext(ctx), funnelID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion("funnel", funnelID, funnel.Version, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	funnel.Name = name
+	funnel.Description = description
+	funnel.Steps = steps
+	funnel.Version++
+	funnel.UpdatedAt = s.analyticsService.Clock().Now()
+
+	copied := *funnel
+	return &copied, nil
+}
+
+// validateFunnel checks the name and step order of a funnel definition
+func validateFunnel(name string, steps []Step) error {
+	if name == "" {
+		return fmt.Errorf("funnel name is required")
+	}
+
+	if len(steps) < 2 {
+		return fmt.Errorf("funnel must have at least 2 steps")
+	}
+
+	// Validate step order
+	for i, step := range steps {
+		if step.Order != i+1 {
+			return fmt.Errorf("step order must be sequential starting from 1")
+		}
+		if step.EventType == "" {
+			return fmt.Errorf("event type is required for step %d", i+1)
+		}
+		if step.Source != "" && step.Source != StepSourceAnalytics && !timelineServices[step.Source] {
+			return fmt.Errorf("invalid source for step %d: %s. Valid sources are: analytics, auth, billing, payments", i+1, step.Source)
+		}
+		if err := validateCapture(i+1, step.Capture); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // ComputeFunnel computes the conversion funnel results for a given time range
 func (s *FunnelService) ComputeFunnel(ctx context.Context, query FunnelQuery) (*FunnelResult, error) {
 	if query.FunnelID == "" {
 		return nil, fmt.Errorf("funnel ID is required")
 	}
+	var dimension *CustomDimension
+	if query.Breakdown != "" {
+		var err error
+		if dimension, err = s.analyticsService.Dimensions().Lookup(ProjectFromContext(ctx), query.Breakdown); err != nil {
+			return nil, err
+		}
+	}
 
-	// In a real implementation, this would fetch the funnel definition from a database
-	// For now, we'll create a mock funnel
-	funnel := &Funnel{
-		ID:   query.FunnelID,
-		Name: "Sample Funnel",
-		Steps: []Step{
-			{ID: "step1", Name: "Page View", EventType: "page_view", Order: 1},
-			{ID: "step2", Name: "Add to Cart", EventType: "add_to_cart", Order: 2},
-			{ID: "step3", Name: "Checkout", EventType: "checkout", Order: 3},
-			{ID: "step4", Name: "Purchase", EventType: "purchase", Order: 4},
-		},
+	start := time.Now()
+
+	funnel, err := s.GetFunnel(ctx, query.FunnelID)
+	if err != nil {
+		return nil, err
 	}
 
 	// Compute funnel results
@@ -133,56 +378,210 @@ func (s *FunnelService) ComputeFunnel(ctx context.Context, query FunnelQuery) (*
 		FunnelID:   funnel.ID,
 		FunnelName: funnel.Name,
 		TimeRange:  TimeRange{Start: query.Start, End: query.End},
-		ComputedAt: time.Now(),
+		ComputedAt: s.analyticsService.Clock().Now(),
 	}
 
-	// In a real implementation, this would query the analytics database
-	// For now, we'll generate mock data
-	result.Steps = s.generateMockStepResults(funnel.Steps)
+	// Each user's events are walked in order, so steps count the users reaching them in sequence
+	events := s.funnelEvents(ctx, funnel.Steps, query)
+	overall := s.computeSegments(events, funnel.Steps, func(*AnalyticsEvent) string { return "" })
+	if len(overall) > 0 {
+		result.Steps = overall[0].Steps
+	} else {
+		result.Steps = emptyStepResults(funnel.Steps)
+	}
 	result.TotalUsers = s.calculateTotalUsers(result.Steps)
 	result.ConversionRate = s.calculateOverallConversionRate(result.Steps)
+	if dimension != nil {
+		result.Breakdown = s.computeSegments(events, funnel.Steps, dimension.Value)
+	}
+
+	s.analyticsService.SlowOperations().Observe(SlowOperationFunnel, map[string]interface{}{
+		"funnel_id": query.FunnelID,
+		"user_id":   query.UserID,
+		"start":     query.Start,
+		"end":       query.End,
+	}, time.Since(start), s.analyticsService.EventCount(), s.analyticsService.calculateAPICallCost("/api/v1/funnels/:id/compute", "GET"))
 
 	return result, nil
 }
 
-// generateMockStepResults generates mock step results for demonstration
-func (s *FunnelService) generateMockStepResults(steps []Step) []StepResult {
-	var results []StepResult
-	var previousUsers int64 = 1000 // Start with 1000 users
+// funnelEvents returns the project's stored events in the query's range, oldest first. When steps
+// reference the events of other services, their events in the range are merged in; they are not
+// tied to a project and count in the funnels of every project.
+func (s *FunnelService) funnelEvents(ctx context.Context, steps []Step, query FunnelQuery) []funnelEvent {
+	stored := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		UserID:    query.UserID,
+		Start:     query.Start,
+		End:       query.End,
+	})
+	events := make([]funnelEvent, 0, len(stored))
+	for _, event := range stored {
+		events = append(events, funnelEvent{AnalyticsEvent: event})
+	}
 
-	for i, step := range steps {
-		// Simulate drop-off rates
-		var currentUsers int64
-		if i == 0 {
-			currentUsers = previousUsers
-		} else {
-			// Simulate realistic drop-off (e.g., 70% retention between steps)
-			currentUsers = int64(float64(previousUsers) * 0.7)
+	if crossServiceSteps(steps) {
+		events = append(events, s.serviceFunnelEvents(query)...)
+	}
+	// Events of the same time keep the order they were received in, e.g. a batch sent at once
+	sort.SliceStable(events, func(i, j int) bool {
+		if !events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Timestamp.Before(events[j].Timestamp)
 		}
+		return events[i].ReceivedAt.Before(events[j].ReceivedAt)
+	})
+	return events
+}
+
+// serviceFunnelEvents returns the events of other services in the query's range
+func (s *FunnelService) serviceFunnelEvents(query FunnelQuery) []funnelEvent {
+	var events []funnelEvent
+	for _, event := range s.serviceEvents.Query(query.UserID, query.Start, query.End) {
+		events = append(events, funnelEvent{
+			AnalyticsEvent: &AnalyticsEvent{
+				ID:         event.ID,
+				EventType:  qualifiedServiceEventType(event),
+				UserID:     event.UserID,
+				Timestamp:  event.Timestamp,
+				Properties: event.Data,
+				Source:     serviceEventSource(event),
+			},
+			service: serviceEventSource(event),
+		})
+	}
+	return events
+}
 
-		dropOffRate := 0.0
-		if i > 0 {
-			dropOffRate = float64(previousUsers-currentUsers) / float64(previousUsers) * 100
+// crossServiceSteps reports whether any step can match the events of other services
+func crossServiceSteps(steps []Step) bool {
+	for _, step := range steps {
+		if step.Source != "" && step.Source != StepSourceAnalytics {
+			return true
 		}
+		if step.Source == "" && timelineServices[strings.SplitN(step.EventType, ".", 2)[0]] && strings.Contains(step.EventType, ".") {
+			return true
+		}
+	}
+	return false
+}
 
-		conversionRate := 0.0
-		if i > 0 {
-			conversionRate = float64(currentUsers) / float64(1000) * 100
+// matches reports whether an event performs the step. Steps of a service match its events by
+// plain or qualified type; steps without a source match analytics events by type and the events
+// of other services by qualified type.
+func (step Step) matches(event funnelEvent) bool {
+	if event.service == "" {
+		if step.Source != "" && step.Source != StepSourceAnalytics || event.EventType != step.EventType {
+			return false
+		}
+	} else {
+		if step.Source == StepSourceAnalytics || step.Source != "" && step.Source != event.service {
+			return false
 		}
+		if event.EventType != step.EventType && (step.Source == "" || event.EventType != step.Source+"."+step.EventType) {
+			return false
+		}
+	}
+	return matchesProperties(event.Properties, step.Filters)
+}
 
-		stepResult := StepResult{
-			StepID:         step.ID,
-			StepName:       step.Name,
-			EventCount:     currentUsers * 2, // Assume 2 events per user on average
-			UniqueUsers:    currentUsers,
-			DropOffRate:    dropOffRate,
-			ConversionRate: conversionRate,
+// computeSegments computes the funnel from the events for each value of a segment's events, e.g.
+// a dimension. Users enter the segment of their first step's value and reach a step by performing
+// it after the previous one; the properties a step captures are taken from the event reaching it.
+func (s *FunnelService) computeSegments(events []funnelEvent, steps []Step, value func(*AnalyticsEvent) string) []FunnelSegment {
+	// Steps reached by each user and the events of each step, oldest events first
+	type progress struct {
+		value    string
+		reached  int
+		events   []int64
+		captured [][]interface{} // Values of the properties captured at each step reached
+	}
+	users := make(map[string]*progress)
+	for _, event := range events {
+		// Events without a user cannot be followed through the funnel
+		if event.UserID == "" {
+			continue
+		}
+		user := users[event.UserID]
+		next := 0
+		if user != nil {
+			next = user.reached
 		}
 
-		results = append(results, stepResult)
-		previousUsers = currentUsers
+		// An event advances the user to the next step or repeats a step already reached;
+		// users enter the funnel with its first step
+		for i := min(next, len(steps)-1); i >= 0; i-- {
+			if !steps[i].matches(event) {
+				continue
+			}
+			if user == nil {
+				user = &progress{value: value(event.AnalyticsEvent), events: make([]int64, len(steps)), captured: make([][]interface{}, len(steps))}
+				users[event.UserID] = user
+			}
+			user.events[i]++
+			if i == next {
+				user.captured[i] = captureValues(steps[i], event.AnalyticsEvent)
+				user.reached++
+			}
+			break
+		}
 	}
 
+	segments := make(map[string]*FunnelSegment)
+	captures := make(map[string][][]*captureAccumulator) // Segment value -> step -> captured property
+	for _, user := range users {
+		segment, exists := segments[user.value]
+		if !exists {
+			segment = &FunnelSegment{Value: user.value, Steps: emptyStepResults(steps)}
+			segments[user.value] = segment
+			captures[user.value] = make([][]*captureAccumulator, len(steps))
+			for i, step := range steps {
+				captures[user.value][i] = newCaptureAccumulators(step)
+			}
+		}
+		converted := user.reached == len(steps)
+		for i := 0; i < user.reached; i++ {
+			segment.Steps[i].UniqueUsers++
+			segment.Steps[i].EventCount += user.events[i]
+			for j, accumulator := range captures[user.value][i] {
+				accumulator.add(user.captured[i][j], converted)
+			}
+		}
+	}
+
+	result := make([]FunnelSegment, 0, len(segments))
+	for _, segment := range segments {
+		for i, accumulators := range captures[segment.Value] {
+			for _, accumulator := range accumulators {
+				segment.Steps[i].Captured = append(segment.Steps[i].Captured, accumulator.result())
+			}
+		}
+		entered := segment.Steps[0].UniqueUsers
+		for i := 1; i < len(segment.Steps); i++ {
+			previous := segment.Steps[i-1].UniqueUsers
+			if previous > 0 {
+				segment.Steps[i].DropOffRate = float64(previous-segment.Steps[i].UniqueUsers) / float64(previous) * 100
+			}
+			segment.Steps[i].ConversionRate = float64(segment.Steps[i].UniqueUsers) / float64(entered) * 100
+		}
+		segment.TotalUsers = s.calculateTotalUsers(segment.Steps)
+		segment.ConversionRate = s.calculateOverallConversionRate(segment.Steps)
+		result = append(result, *segment)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalUsers != result[j].TotalUsers {
+			return result[i].TotalUsers > result[j].TotalUsers
+		}
+		return result[i].Value < result[j].Value
+	})
+	return result
+}
+
+// emptyStepResults returns the results of steps no user reached
+func emptyStepResults(steps []Step) []StepResult {
+	results := make([]StepResult, len(steps))
+	for i, step := range steps {
+		results[i] = StepResult{StepID: step.ID, StepName: step.Name}
+	}
 	return results
 }
 
@@ -216,17 +615,9 @@ func (s *FunnelService) GetFunnelSteps(ctx context.Context, funnelID string) ([]
 		return nil, fmt.Errorf("funnel ID is required")
 	}
 
-	// In a real implementation, this would fetch from a database
-	// For now, return a mock funnel
-	return []Step{
-		{ID: "step1", Name: "Page View", EventType: "page_view", Order: 1},
-		{ID: "step2", Name: "Add to Cart", EventType: "add_to_cart", Order: 2},
-		{ID: "step3", Name: "Checkout", EventType: "checkout", Order: 3},
-		{ID: "step4", Name: "Purchase", EventType: "purchase", Order: 4},
-	}, nil
-}
-
-// generateFunnelID generates a unique funnel ID
-func generateFunnelID() string {
-	return fmt.Sprintf("funnel_%d", time.Now().UnixNano())
+	funnel, err := s.GetFunnel(ctx, funnelID)
+	if err != nil {
+		return nil, err
+	}
+	return funnel.Steps, nil
 }
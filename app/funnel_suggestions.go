@@ -0,0 +1,272 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Limits of funnel suggestions
+const (
+	maxSuggestedSteps      = 6     // Longest suggested funnel
+	maxSuggestionEventType = 100   // Most frequent event types considered as steps
+	maxSuggestionSequences = 10000 // Frequent sequences explored before mining stops
+)
+
+// FunnelSuggestionQuery configures mining the project's events for candidate funnels
+type FunnelSuggestionQuery struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	MinSteps int       `json:"min_steps"` // Shortest suggested funnel (default 2)
+	MaxSteps int       `json:"max_steps"` // Longest suggested funnel (default 4)
+	// Share of the users with events who must complete a funnel for it to be suggested (default 0.05)
+	MinSupport float64 `json:"min_support"`
+	Limit      int     `json:"limit"` // Suggestions returned (default 10)
+}
+
+// FunnelSuggestion is a candidate funnel: event types users were observed performing in order
+type FunnelSuggestion struct {
+	Name           string  `json:"name"`
+	Steps          []Step  `json:"steps"`           // Ready to create the funnel with
+	StepUsers      []int64 `json:"step_users"`      // Users who performed the steps up to each one, in order
+	Support        int64   `json:"support"`         // Users who performed every step in order
+	SupportRate    float64 `json:"support_rate"`    // Of the users with events, in percent
+	ConversionRate float64 `json:"conversion_rate"` // Of the users who performed the first step, in percent
+}
+
+// FunnelSuggestionsResult lists the funnels suggested from observed event sequences
+type FunnelSuggestionsResult struct {
+	TimeRange   TimeRange          `json:"time_range"`
+	Users       int64              `json:"users"` // Users with events in the period
+	MinUsers    int64              `json:"min_users"`
+	Suggestions []FunnelSuggestion `json:"suggestions"`
+	Truncated   bool               `json:"truncated,omitempty"` // Mining stopped before exploring every frequent sequence
+	ComputedAt  time.Time          `json:"computed_at"`
+}
+
+// SuggestFunnels mines the project's events over the time range for event types frequently
+// performed in the same order by a user, and suggests them as funnels. Users support a sequence
+// when they performed its event types in that order, other events in between, as funnels count
+// users. Frequent sequences are suggested unless a longer one has the same users, most supported
+// first.
+func (s *FunnelService) SuggestFunnels(ctx context.Context, query FunnelSuggestionQuery) (*FunnelSuggestionsResult, error) {
+	if query.MinSteps == 0 {
+		query.MinSteps = 2
+	}
+	if query.MaxSteps == 0 {
+		query.MaxSteps = 4
+	}
+	if query.MinSupport == 0 {
+		query.MinSupport = 0.05
+	}
+	if query.Limit == 0 {
+		query.Limit = 10
+	}
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	if query.MinSteps < 2 || query.MaxSteps < query.MinSteps || query.MaxSteps > maxSuggestedSteps {
+		return nil, fmt.Errorf("steps must be between 2 and %d, min_steps at most max_steps", maxSuggestedSteps)
+	}
+	if math.IsNaN(query.MinSupport) || query.MinSupport < 0 || query.MinSupport > 1 {
+		return nil, fmt.Errorf("min_support must be a share of users between 0 and 1")
+	}
+	if query.Limit < 0 || query.Limit > 100 {
+		return nil, fmt.Errorf("limit must be between 1 and 100")
+	}
+
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		Start:     query.Start,
+		End:       query.End,
+	})
+
+	// Event types of each user in the order performed, repeats in a row collapsed
+	sequences := make(map[string][]string)
+	typeUsers := make(map[string]map[string]bool)
+	for _, event := range events {
+		sequence := sequences[event.UserID]
+		if len(sequence) == 0 || sequence[len(sequence)-1] != event.EventType {
+			sequences[event.UserID] = append(sequence, event.EventType)
+		}
+		if typeUsers[event.EventType] == nil {
+			typeUsers[event.EventType] = make(map[string]bool)
+		}
+		typeUsers[event.EventType][event.UserID] = true
+	}
+
+	result := &FunnelSuggestionsResult{
+		TimeRange:   TimeRange{Start: query.Start, End: query.End},
+		Users:       int64(len(sequences)),
+		Suggestions: []FunnelSuggestion{},
+		ComputedAt:  time.Now(),
+	}
+	result.MinUsers = int64(math.Max(2, math.Ceil(query.MinSupport*float64(result.Users))))
+
+	// Only event types performed by enough users can be steps, the most frequent ones at most
+	var candidates []string
+	for eventType, users := range typeUsers {
+		if int64(len(users)) >= result.MinUsers {
+			candidates = append(candidates, eventType)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if len(typeUsers[candidates[i]]) != len(typeUsers[candidates[j]]) {
+			return len(typeUsers[candidates[i]]) > len(typeUsers[candidates[j]])
+		}
+		return candidates[i] < candidates[j]
+	})
+	if len(candidates) > maxSuggestionEventType {
+		candidates = candidates[:maxSuggestionEventType]
+	}
+
+	miner := &sequenceMiner{
+		sequences:  sequences,
+		candidates: candidates,
+		minUsers:   result.MinUsers,
+		minSteps:   query.MinSteps,
+		maxSteps:   query.MaxSteps,
+		budget:     maxSuggestionSequences,
+	}
+	initial := make(map[string]int, len(sequences))
+	for userID := range sequences {
+		initial[userID] = 0
+	}
+	miner.extend(nil, nil, initial)
+	result.Truncated = miner.budget <= 0
+
+	suggestions := miner.closed()
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.Support != b.Support {
+			return a.Support > b.Support
+		}
+		if len(a.Steps) != len(b.Steps) {
+			return len(a.Steps) > len(b.Steps)
+		}
+		return a.Name < b.Name
+	})
+	if len(suggestions) > query.Limit {
+		suggestions = suggestions[:query.Limit]
+	}
+	for i := range suggestions {
+		suggestions[i].SupportRate = math.Round(10000*float64(suggestions[i].Support)/float64(result.Users)) / 100
+	}
+	result.Suggestions = append(result.Suggestions, suggestions...)
+	return result, nil
+}
+
+// sequenceMiner grows sequences of event types one step at a time while enough users performed
+// them in order
+type sequenceMiner struct {
+	sequences  map[string][]string // User ID -> event types in order
+	candidates []string
+	minUsers   int64
+	minSteps   int
+	maxSteps   int
+	budget     int                // Frequent sequences left to explore
+	frequent   []FunnelSuggestion // Of at least minSteps steps
+}
+
+// extend tries every candidate as the next step of a sequence. positions holds, for each user
+// who performed the sequence, the index of their events following its earliest completion;
+// stepUsers the users who performed each step so far.
+func (m *sequenceMiner) extend(sequence []string, stepUsers []int64, positions map[string]int) {
+	if len(sequence) >= m.minSteps {
+		m.frequent = append(m.frequent, newFunnelSuggestion(sequence, stepUsers))
+	}
+	if len(sequence) == m.maxSteps {
+		return
+	}
+
+	for _, candidate := range m.candidates {
+		if containsEventType(sequence, candidate) {
+			continue
+		}
+		next := make(map[string]int)
+		for userID, position := range positions {
+			events := m.sequences[userID]
+			for i := position; i < len(events); i++ {
+				if events[i] == candidate {
+					next[userID] = i + 1
+					break
+				}
+			}
+		}
+		if int64(len(next)) < m.minUsers || m.budget <= 0 {
+			continue
+		}
+		m.budget--
+		m.extend(append(sequence[:len(sequence):len(sequence)], candidate), append(stepUsers[:len(stepUsers):len(stepUsers)], int64(len(next))), next)
+	}
+}
+
+// closed returns the frequent sequences no longer frequent sequence contains with the same
+// support: every user of such a sequence also performed the steps of the longer one, so the
+// longer sequence describes them better.
+func (m *sequenceMiner) closed() []FunnelSuggestion {
+	bySupport := make(map[int64][]FunnelSuggestion)
+	for _, sequence := range m.frequent {
+		bySupport[sequence.Support] = append(bySupport[sequence.Support], sequence)
+	}
+
+	var closed []FunnelSuggestion
+	for _, sequences := range bySupport {
+		for _, sequence := range sequences {
+			contained := false
+			for _, other := range sequences {
+				if len(other.Steps) > len(sequence.Steps) && isSubsequence(sequence.Steps, other.Steps) {
+					contained = true
+					break
+				}
+			}
+			if !contained {
+				closed = append(closed, sequence)
+			}
+		}
+	}
+	return closed
+}
+
+// isSubsequence reports whether the event types of steps appear in order among those of other
+func isSubsequence(steps, other []Step) bool {
+	matched := 0
+	for _, step := range other {
+		if matched < len(steps) && steps[matched].EventType == step.EventType {
+			matched++
+		}
+	}
+	return matched == len(steps)
+}
+
+// newFunnelSuggestion returns the funnel of a sequence of event types
+func newFunnelSuggestion(sequence []string, stepUsers []int64) FunnelSuggestion {
+	suggestion := FunnelSuggestion{
+		Name:           strings.Join(sequence, " → "),
+		StepUsers:      stepUsers,
+		Support:        stepUsers[len(stepUsers)-1],
+		ConversionRate: math.Round(10000*float64(stepUsers[len(stepUsers)-1])/float64(stepUsers[0])) / 100,
+	}
+	for i, eventType := range sequence {
+		suggestion.Steps = append(suggestion.Steps, Step{
+			ID:        fmt.Sprintf("step%d", i+1),
+			Name:      eventType,
+			EventType: eventType,
+			Order:     i + 1,
+		})
+	}
+	return suggestion
+}
+
+// containsEventType reports whether a sequence has an event type
+func containsEventType(sequence []string, eventType string) bool {
+	for _, step := range sequence {
+		if step == eventType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Headers of funnel webhook deliveries
+const (
+	HeaderWebhookID        = "X-Webhook-ID"        // Unique per delivery, the same across retries
+	HeaderWebhookTimestamp = "X-Webhook-Timestamp" // Unix seconds when the delivery was signed
+	HeaderWebhookSignature = "X-Webhook-Signature" // "sha256=" and the hex HMAC-SHA256 of the timestamp and body
+)
+
+// Computations that notify the funnel webhook when they complete
+const (
+	FunnelTriggerScheduled   = "scheduled"   // Recomputation of a dashboard metric derived from the funnel
+	FunnelTriggerRevalidated = "revalidated" // Background recomputation of a stale cached funnel result
+	FunnelTriggerJob         = "job"         // Funnel computation accepted with "Prefer: respond-async"
+)
+
+// FunnelWebhookPayload is the body posted to the funnel webhook
+type FunnelWebhookPayload struct {
+	ID          string        `json:"id"`
+	Type        string        `json:"type"` // Always "funnel.completed"
+	ProjectID   string        `json:"project_id"`
+	Trigger     string        `json:"trigger"`
+	Result      *FunnelResult `json:"result"`
+	CompletedAt time.Time     `json:"completed_at"`
+}
+
+// FunnelWebhookStats reports the funnel webhook deliveries
+type FunnelWebhookStats struct {
+	Enabled   bool   `json:"enabled"`
+	Queued    int    `json:"queued"`
+	Sent      int64  `json:"sent"`
+	Failed    int64  `json:"failed"`  // Deliveries that still failed after the retries
+	Dropped   int64  `json:"dropped"` // Deliveries dropped because the queue was full
+	LastError string `json:"last_error,omitempty"`
+}
+
+// queuedFunnelWebhook is a delivery waiting to be sent
+type queuedFunnelWebhook struct {
+	id   string
+	body []byte
+}
+
+// FunnelWebhook posts the results of funnel computations that complete in the background to a
+// configured webhook, so downstream systems can react without polling. Deliveries are signed
+// with an HMAC of their timestamp and body, and sent by a single goroutine from a bounded
+// queue, retried with exponential backoff; deliveries are dropped and counted when the queue
+// is full.
+type FunnelWebhook struct {
+	url        string // Empty when the webhook is disabled
+	secret     []byte
+	client     *http.Client
+	clock      Clock
+	queue      chan queuedFunnelWebhook
+	maxRetries int
+	retryDelay time.Duration // Doubled after every failed attempt
+	sent       int64
+	failed     int64
+	dropped    int64
+	lastError  string
+	stopped    bool
+	quit       chan struct{} // Closed when stopping, so failed deliveries are no longer retried
+	done       chan struct{}
+	mutex      sync.RWMutex
+}
+
+// NewFunnelWebhook creates the funnel webhook configured from FUNNEL_WEBHOOK_URL,
+// FUNNEL_WEBHOOK_SECRET, FUNNEL_WEBHOOK_QUEUE_CAPACITY, FUNNEL_WEBHOOK_MAX_RETRIES,
+// FUNNEL_WEBHOOK_RETRY_DELAY and FUNNEL_WEBHOOK_TIMEOUT. The webhook is disabled when
+// FUNNEL_WEBHOOK_URL is unset, or invalid or without a secret.
+func NewFunnelWebhook() *FunnelWebhook {
+	webhook := &FunnelWebhook{
+		secret:     []byte(os.Getenv("FUNNEL_WEBHOOK_SECRET")),
+		client:     &http.Client{Timeout: getEnvDuration("FUNNEL_WEBHOOK_TIMEOUT", 10*time.Second)},
+		clock:      SystemClock(),
+		maxRetries: getEnvInt("FUNNEL_WEBHOOK_MAX_RETRIES", 3),
+		retryDelay: getEnvDuration("FUNNEL_WEBHOOK_RETRY_DELAY", time.Second),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	endpoint := os.Getenv("FUNNEL_WEBHOOK_URL")
+	if endpoint == "" {
+		close(webhook.done)
+		return webhook
+	}
+	if err := validateWebhookURL(endpoint, webhook.secret); err != nil {
+		log.Printf("Error: The funnel webhook is disabled: %v", err)
+		close(webhook.done)
+		return webhook
+	}
+
+	webhook.url = endpoint
+	webhook.queue = make(chan queuedFunnelWebhook, getEnvInt("FUNNEL_WEBHOOK_QUEUE_CAPACITY", 1000))
+	go webhook.run()
+	log.Printf("Posting completed funnel computations to %s", endpoint)
+	return webhook
+}
+
+// validateWebhookURL checks that the webhook is an HTTP(S) URL with a signing secret
+func validateWebhookURL(endpoint string, secret []byte) error {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return fmt.Errorf("invalid FUNNEL_WEBHOOK_URL: %s. Webhooks are http:// or https:// URLs", endpoint)
+	}
+	if len(secret) == 0 {
+		return fmt.Errorf("FUNNEL_WEBHOOK_SECRET is required to sign deliveries")
+	}
+	return nil
+}
+
+// SetClock sets the clock timestamping deliveries
+func (w *FunnelWebhook) SetClock(clock Clock) {
+	w.clock = clock
+}
+
+// Enabled reports whether completed funnel computations are posted
+func (w *FunnelWebhook) Enabled() bool {
+	return w != nil && w.url != ""
+}
+
+// Notify queues the result of a funnel computation of a project that completed in the
+// background. It never blocks: deliveries are dropped when the queue is full.
+func (w *FunnelWebhook) Notify(projectID, trigger string, result *FunnelResult) {
+	if !w.Enabled() || result == nil {
+		return
+	}
+
+	// Formatted now, so later changes to the result are not posted
+	payload := FunnelWebhookPayload{
+		ID:          uuid.New().String(),
+		Type:        "funnel.completed",
+		ProjectID:   projectOrDefault(projectID),
+		Trigger:     trigger,
+		Result:      result,
+		CompletedAt: w.clock.Now(),
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Warning: Failed to encode the funnel webhook of funnel %s: %v", result.FunnelID, err)
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stopped {
+		w.dropped++
+		return
+	}
+	select {
+	case w.queue <- queuedFunnelWebhook{id: payload.ID, body: body}:
+	default:
+		w.dropped++
+		log.Printf("Warning: Funnel webhook queue is full, dropping the result of funnel %s", result.FunnelID)
+	}
+}
+
+// Stop sends the queued deliveries, without retrying them
+func (w *FunnelWebhook) Stop() {
+	if !w.Enabled() {
+		return
+	}
+
+	w.mutex.Lock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.quit)
+		close(w.queue)
+	}
+	w.mutex.Unlock()
+	<-w.done
+}
+
+// Stats returns the delivery counters of the webhook
+func (w *FunnelWebhook) Stats() FunnelWebhookStats {
+	if !w.Enabled() {
+		return FunnelWebhookStats{}
+	}
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	return FunnelWebhookStats{
+		Enabled:   true,
+		Queued:    len(w.queue),
+		Sent:      atomic.LoadInt64(&w.sent),
+		Failed:    atomic.LoadInt64(&w.failed),
+		Dropped:   w.dropped,
+		LastError: w.lastError,
+	}
+}
+
+// WriteMetrics writes the delivery counters in the Prometheus text exposition format
+func (w *FunnelWebhook) WriteMetrics(out io.Writer) error {
+	stats := w.Stats()
+	_, err := fmt.Fprintf(out, "# HELP analytics_funnel_webhook_queued Funnel results waiting to be posted to the webhook.\n# TYPE analytics_funnel_webhook_queued gauge\nanalytics_funnel_webhook_queued %d\n"+
+		"# HELP analytics_funnel_webhook_deliveries_total Funnel webhook deliveries by outcome.\n# TYPE analytics_funnel_webhook_deliveries_total counter\n"+
+		"analytics_funnel_webhook_deliveries_total{outcome=\"sent\"} %d\nanalytics_funnel_webhook_deliveries_total{outcome=\"failed\"} %d\nanalytics_funnel_webhook_deliveries_total{outcome=\"dropped\"} %d\n",
+		stats.Queued, stats.Sent, stats.Failed, stats.Dropped)
+	return err
+}
+
+// run delivers queued results until the queue is closed
+func (w *FunnelWebhook) run() {
+	defer close(w.done)
+	for queued := range w.queue {
+		w.deliver(queued)
+	}
+	w.client.CloseIdleConnections()
+}
+
+// deliver posts a result, retrying with exponential backoff. Every attempt is signed anew, so
+// receivers can reject old timestamps.
+func (w *FunnelWebhook) deliver(queued queuedFunnelWebhook) {
+	err := w.send(queued)
+	for attempt := 0; err != nil && attempt < w.maxRetries; attempt++ {
+		select {
+		case <-time.After(w.retryDelay << attempt):
+		case <-w.quit:
+			attempt = w.maxRetries
+			continue
+		}
+		err = w.send(queued)
+	}
+	if err == nil {
+		atomic.AddInt64(&w.sent, 1)
+		return
+	}
+
+	atomic.AddInt64(&w.failed, 1)
+	w.mutex.Lock()
+	w.lastError = err.Error()
+	w.mutex.Unlock()
+	log.Printf("Warning: Failed to post funnel webhook %s: %v", queued.id, err)
+}
+
+// send posts a signed delivery, failing on responses other than 2xx
+func (w *FunnelWebhook) send(queued queuedFunnelWebhook) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(queued.body))
+	if err != nil {
+		return err
+	}
+	timestamp := w.clock.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderWebhookID, queued.id)
+	req.Header.Set(HeaderWebhookTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderWebhookSignature, SignWebhookPayload(w.secret, timestamp, queued.body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhookPayload returns the signature of a webhook delivery: "sha256=" and the hex
+// HMAC-SHA256 of its timestamp, a dot and its body
+func SignWebhookPayload(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
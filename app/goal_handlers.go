@@ -0,0 +1,76 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getProjectGoals returns the goals of a project with their version as the ETag
+func (s *App) getProjectGoals(c *fiber.Ctx) error {
+	goals := s.goalService.Get(c.Params("id"))
+
+	c.Set(fiber.HeaderETag, ETag(goals.Version))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"goals":  goals,
+	})
+}
+
+// updateProjectGoals replaces the goals of a project. Replacing existing goals requires If-Match
+// with the version being updated.
+func (s *App) updateProjectGoals(c *fiber.Ctx) error {
+	var request struct {
+		Goals []Goal `json:"goals"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first goals of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if s.goalService.Get(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := s.goalService.Replace(projectID, request.Goals, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"goals":  updated,
+	})
+}
+
+// getProjectGoalReport returns how often each goal of a project was completed between start_date
+// and end_date (default: the last 30 days)
+func (s *App) getProjectGoalReport(c *fiber.Ctx) error {
+	start, end, err := s.funnelTimeRange(c.Query("start_date"), c.Query("end_date"))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), utils.CopyString(c.Params("id")))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"report": s.goalService.Report(ctx, start, end),
+	})
+}
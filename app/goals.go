@@ -0,0 +1,179 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum number of goals of a project
+const maxGoalsPerProject = 50
+
+// Goal is a conversion a project tracks: an event of a type, optionally on a page and with
+// properties of given values
+type Goal struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	EventType   string                 `json:"event_type"`
+	Page        string                 `json:"page,omitempty"`
+	Filters     map[string]interface{} `json:"filters,omitempty"` // Properties the event must have, compared as text
+}
+
+// ProjectGoals are the goals of a project
+type ProjectGoals struct {
+	Goals   []Goal `json:"goals"`   // Ordered by name
+	Version int64  `json:"version"` // Incremented on every update, exposed as the ETag
+}
+
+// GoalResult is how often a goal was completed in a time range
+type GoalResult struct {
+	Name           string  `json:"name"`
+	Completions    int64   `json:"completions"`     // Events completing the goal
+	Users          int64   `json:"users"`           // Distinct users completing it
+	ConversionRate float64 `json:"conversion_rate"` // Percentage of the active users completing it
+}
+
+// GoalReport is how often each goal of a project was completed in a time range
+type GoalReport struct {
+	ProjectID   string       `json:"project_id"`
+	Start       time.Time    `json:"start"`
+	End         time.Time    `json:"end"`
+	ActiveUsers int64        `json:"active_users"` // Distinct users sending any event
+	Goals       []GoalResult `json:"goals"`        // Ordered by name
+}
+
+// GoalService holds the goals of each project and reports their completions from the stored events
+type GoalService struct {
+	analytics *AnalyticsService
+	projects  map[string]*ProjectGoals // Replaced, never modified, so reports can keep using a snapshot
+	mutex     sync.RWMutex
+}
+
+// NewGoalService creates a goal service reporting on the events of the analytics service
+func NewGoalService(analytics *AnalyticsService) *GoalService {
+	return &GoalService{
+		analytics: analytics,
+		projects:  make(map[string]*ProjectGoals),
+	}
+}
+
+// Get returns the goals of a project
+func (s *GoalService) Get(projectID string) *ProjectGoals {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	goals, exists := s.projects[projectID]
+	if !exists {
+		return &ProjectGoals{Goals: []Goal{}}
+	}
+	return goals.copy()
+}
+
+// Replace replaces the goals of a project. The update is rejected with a VersionConflictError
+// unless expectedVersion is the current version (0 for a project without goals).
+func (s *GoalService) Replace(projectID string, goals []Goal, expectedVersion int64) (*ProjectGoals, error) {
+	goals, err := normalizeGoals(goals)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var current int64
+	if existing, exists := s.projects[projectID]; exists {
+		current = existing.Version
+	}
+	if err := checkVersion("goals", projectID, current, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	updated := &ProjectGoals{Goals: goals, Version: current + 1}
+	projects := make(map[string]*ProjectGoals, len(s.projects)+1)
+	for id, existing := range s.projects {
+		projects[id] = existing
+	}
+	projects[projectID] = updated
+	s.projects = projects
+
+	return updated.copy(), nil
+}
+
+// Report counts the completions of every goal of the context's project between start and end
+func (s *GoalService) Report(ctx context.Context, start, end time.Time) *GoalReport {
+	projectID := ProjectFromContext(ctx)
+	goals := s.Get(projectID).Goals
+
+	report := &GoalReport{ProjectID: projectID, Start: start, End: end, Goals: make([]GoalResult, 0, len(goals))}
+	activeUsers := make(map[string]bool)
+	goalUsers := make([]map[string]bool, len(goals))
+	completions := make([]int64, len(goals))
+	for i := range goals {
+		goalUsers[i] = make(map[string]bool)
+	}
+
+	for _, event := range s.analytics.QueryEvents(ctx, EventFilter{ProjectID: projectID, Start: start, End: end}) {
+		activeUsers[event.UserID] = true
+		for i, goal := range goals {
+			if goal.Matches(event) {
+				completions[i]++
+				goalUsers[i][event.UserID] = true
+			}
+		}
+	}
+
+	report.ActiveUsers = int64(len(activeUsers))
+	for i, goal := range goals {
+		result := GoalResult{Name: goal.Name, Completions: completions[i], Users: int64(len(goalUsers[i]))}
+		if report.ActiveUsers > 0 {
+			result.ConversionRate = float64(result.Users) / float64(report.ActiveUsers) * 100
+		}
+		report.Goals = append(report.Goals, result)
+	}
+	return report
+}
+
+// Matches reports whether an event completes the goal
+func (g Goal) Matches(event *AnalyticsEvent) bool {
+	if event.EventType != g.EventType || (g.Page != "" && event.Page != g.Page) {
+		return false
+	}
+	return matchesProperties(event.Properties, g.Filters)
+}
+
+// copy returns a copy of the goals, so callers cannot modify the ones in effect
+func (p *ProjectGoals) copy() *ProjectGoals {
+	goals := make([]Goal, len(p.Goals))
+	copy(goals, p.Goals)
+	return &ProjectGoals{Goals: goals, Version: p.Version}
+}
+
+// normalizeGoals validates goals and orders them by name
+func normalizeGoals(goals []Goal) ([]Goal, error) {
+	if len(goals) > maxGoalsPerProject {
+		return nil, fmt.Errorf("a project can have at most %d goals", maxGoalsPerProject)
+	}
+
+	normalized := make([]Goal, 0, len(goals))
+	seen := make(map[string]bool)
+	for _, goal := range goals {
+		if goal.Name == "" {
+			return nil, fmt.Errorf("goals require a name")
+		}
+		if seen[goal.Name] {
+			return nil, fmt.Errorf("duplicate goal %s", goal.Name)
+		}
+		seen[goal.Name] = true
+		if goal.EventType == "" {
+			return nil, fmt.Errorf("goal %s requires an event_type", goal.Name)
+		}
+		normalized = append(normalized, goal)
+	}
+
+	sort.Slice(normalized, func(i, j int) bool {
+		return normalized[i].Name < normalized[j].Name
+	})
+	return normalized, nil
+}
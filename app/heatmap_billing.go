@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// HeatmapPricingTier prices the pixels of a heatmap grid up to a size. Tiers are graduated:
+// each tier only prices the pixels that fall within it.
+type HeatmapPricingTier struct {
+	UpToPixels        int64   `json:"up_to_pixels"` // 0 for the unbounded last tier
+	PricePerMegapixel float64 `json:"price_per_megapixel"`
+}
+
+// Pixel pricing of heatmap generation, cheapest for typical desktop resolutions
+var heatmapPricingTiers = []HeatmapPricingTier{
+	{UpToPixels: 2_000_000, PricePerMegapixel: 0.002},
+	{UpToPixels: 8_000_000, PricePerMegapixel: 0.004},
+	{UpToPixels: 0, PricePerMegapixel: 0.008},
+}
+
+// Price of scanning 1000 events for a heatmap
+const heatmapScannedEventsPrice = 0.0001
+
+// HeatmapTierCharge is the charge for the pixels of a grid falling within a pricing tier
+type HeatmapTierCharge struct {
+	Tier   int     `json:"tier"`
+	Pixels int64   `json:"pixels"`
+	Amount float64 `json:"amount"`
+}
+
+// HeatmapBilling describes what a heatmap generation was billed for
+type HeatmapBilling struct {
+	BillingEventID string              `json:"billing_event_id,omitempty"`
+	GridWidth      int                 `json:"grid_width"`
+	GridHeight     int                 `json:"grid_height"`
+	Pixels         int64               `json:"pixels"`
+	ScannedEvents  int64               `json:"scanned_events"`
+	PixelCharges   []HeatmapTierCharge `json:"pixel_charges"`
+	ScanCost       float64             `json:"scan_cost"`
+	BaseCost       float64             `json:"base_cost"`
+	TotalCost      float64             `json:"total_cost"`
+	Currency       string              `json:"currency"`
+	ExchangeRate   float64             `json:"exchange_rate,omitempty"` // Rate from USD when converted
+}
+
+// calculateHeatmapBilling prices a heatmap generation by grid size and scanned events
+func calculateHeatmapBilling(width, height int, scannedEvents int64, baseCost float64) *HeatmapBilling {
+	billing := &HeatmapBilling{
+		GridWidth:     width,
+		GridHeight:    height,
+		Pixels:        int64(width) * int64(height),
+		ScannedEvents: scannedEvents,
+		PixelCharges:  []HeatmapTierCharge{},
+		ScanCost:      float64(scannedEvents) / 1000 * heatmapScannedEventsPrice,
+		BaseCost:      baseCost,
+		Currency:      BaseCurrency,
+	}
+
+	remaining := billing.Pixels
+	var lowerBound int64
+	for i, tier := range heatmapPricingTiers {
+		if remaining <= 0 {
+			break
+		}
+
+		pixels := remaining
+		if tier.UpToPixels > 0 && pixels > tier.UpToPixels-lowerBound {
+			pixels = tier.UpToPixels - lowerBound
+		}
+
+		charge := HeatmapTierCharge{
+			Tier:   i + 1,
+			Pixels: pixels,
+			Amount: float64(pixels) / 1_000_000 * tier.PricePerMegapixel,
+		}
+		billing.PixelCharges = append(billing.PixelCharges, charge)
+		billing.TotalCost += charge.Amount
+
+		remaining -= pixels
+		lowerBound = tier.UpToPixels
+	}
+
+	billing.TotalCost += billing.ScanCost + billing.BaseCost
+	return billing
+}
+
+// convert converts the charges of a heatmap generation priced in BaseCurrency into a currency
+func (b *HeatmapBilling) convert(currency string, rate float64) {
+	for i := range b.PixelCharges {
+		b.PixelCharges[i].Amount *= rate
+	}
+	b.ScanCost *= rate
+	b.BaseCost *= rate
+	b.TotalCost *= rate
+	b.Currency = currency
+	b.ExchangeRate = rate
+}
+
+// checkHeatmapResolution returns a PlanLimitError if the grid exceeds the plan's maximum resolution
+func checkHeatmapResolution(plan Plan, width, height int) error {
+	if width <= plan.MaxHeatmapWidth && height <= plan.MaxHeatmapHeight {
+		return nil
+	}
+
+	return &PlanLimitError{
+		Plan:      plan.Name,
+		Limit:     "heatmap resolution",
+		Requested: fmt.Sprintf("%dx%d", width, height),
+		Allowed:   fmt.Sprintf("%dx%d", plan.MaxHeatmapWidth, plan.MaxHeatmapHeight),
+		UpgradeTo: plan.UpgradeTo,
+	}
+}
+
+// emitBillingEvent sends the heatmap generation charge to the billing service
+func (s *HeatmapService) emitBillingEvent(ctx context.Context, userID string, query HeatmapQuery, billing *HeatmapBilling) {
+	billing.BillingEventID = s.analyticsService.ids.NewID()
+
+	event := &BillingServiceEvent{
+		CorrelationID: billing.BillingEventID,
+		UserID:        userID,
+		Service:       "analytics",
+		EventType:     "heatmap_generation",
+		Timestamp:     s.analyticsService.Clock().Now(),
+		Details: map[string]interface{}{
+			"billing_event_id": billing.BillingEventID,
+			"page":             query.Page,
+			"type":             query.Type,
+			"grid_width":       billing.GridWidth,
+			"grid_height":      billing.GridHeight,
+			"pixels":           billing.Pixels,
+			"scanned_events":   billing.ScannedEvents,
+			"pixel_charges":    billing.PixelCharges,
+			"scan_cost":        billing.ScanCost,
+			"base_cost":        billing.BaseCost,
+			"amount":           billing.TotalCost,
+			"currency":         billing.Currency,
+		},
+	}
+
+	if err := s.analyticsService.billingClient.TrackEvent(ctx, event); err != nil {
+		// Log the error but don't fail the generation
+		log.Printf("Warning: Failed to track heatmap billing event: %v", err)
+	}
+}
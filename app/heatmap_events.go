@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Event types of the scroll and mouse movement heatmaps. Like clicks, they carry their position on
+// the page in the "x" and "y" properties.
+const (
+	ScrollEventType = "scroll"
+	MoveEventType   = "mouse_move"
+)
+
+// Properties of the viewport an interaction happened in. Coordinates of events carrying them are
+// scaled from the viewport to the heatmap's dimensions.
+const (
+	ViewportWidthProperty  = "viewport_width"
+	ViewportHeightProperty = "viewport_height"
+)
+
+// heatmapEventTypes maps heatmap types to the event types they are generated from
+var heatmapEventTypes = map[string]string{
+	"click":    ClickEventType,
+	"scroll":   ScrollEventType,
+	"movement": MoveEventType,
+}
+
+// validateCoordinates checks the position and viewport properties of click, scroll and mouse
+// movement events: x and y go together and are non-negative numbers, and a viewport has both a
+// positive width and height. Other events are not checked.
+func validateCoordinates(eventType string, properties map[string]interface{}) error {
+	if eventType != ClickEventType && eventType != ScrollEventType && eventType != MoveEventType {
+		return nil
+	}
+
+	_, hasX := properties["x"]
+	_, hasY := properties["y"]
+	if hasX != hasY {
+		return fmt.Errorf("%s events need both the x and y properties", eventType)
+	}
+	for _, property := range []string{"x", "y"} {
+		if raw, exists := properties[property]; exists {
+			if value, ok := propertyNumber(raw); !ok || value < 0 {
+				return fmt.Errorf("property '%s' of %s events must be a non-negative number", property, eventType)
+			}
+		}
+	}
+
+	_, hasWidth := properties[ViewportWidthProperty]
+	_, hasHeight := properties[ViewportHeightProperty]
+	if hasWidth != hasHeight {
+		return fmt.Errorf("%s events need both the %s and %s properties", eventType, ViewportWidthProperty, ViewportHeightProperty)
+	}
+	for _, property := range []string{ViewportWidthProperty, ViewportHeightProperty} {
+		if raw, exists := properties[property]; exists {
+			if value, ok := propertyNumber(raw); !ok || value <= 0 {
+				return fmt.Errorf("property '%s' of %s events must be a positive number", property, eventType)
+			}
+		}
+	}
+	return nil
+}
+
+// eventCell returns the cell of a width x height grid an event's position falls in. Positions are
+// scaled from the event's viewport when it has one, and taken as grid coordinates otherwise.
+// Events without a position, or outside the grid, have none.
+func eventCell(event *AnalyticsEvent, width, height int) (int, int, bool) {
+	x, hasX := propertyNumber(event.Properties["x"])
+	y, hasY := propertyNumber(event.Properties["y"])
+	if !hasX || !hasY {
+		return 0, 0, false
+	}
+	viewportWidth, hasWidth := propertyNumber(event.Properties[ViewportWidthProperty])
+	viewportHeight, hasHeight := propertyNumber(event.Properties[ViewportHeightProperty])
+	if hasWidth && hasHeight && viewportWidth > 0 && viewportHeight > 0 {
+		x = x * float64(width) / viewportWidth
+		y = y * float64(height) / viewportHeight
+	}
+
+	cellX, cellY := int(math.Floor(x)), int(math.Floor(y))
+	if cellX < 0 || cellX >= width || cellY < 0 || cellY >= height {
+		return 0, 0, false
+	}
+	return cellX, cellY, true
+}
+
+// aggregateEvents adds up the project's events of the query's heatmap type on its page in the time
+// range, optionally of a single user, into an intensity grid: each event adds 1 to the cell of its
+// position. Cells below the query's threshold are left out. It returns the grid, a point per
+// active cell, most intense first, the number of events plotted and the number of events scanned.
+func (s *HeatmapService) aggregateEvents(ctx context.Context, query HeatmapQuery) ([][]int, []HeatmapPoint, int, int) {
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		UserID:    query.UserID,
+		EventType: heatmapEventTypes[query.Type],
+		Page:      query.Page,
+		Start:     query.Start,
+		End:       query.End,
+	})
+
+	data := newHeatmapGrid(query.Width, query.Height)
+	for _, event := range events {
+		if x, y, ok := eventCell(event, query.Width, query.Height); ok {
+			data[y][x]++
+		}
+	}
+
+	plotted := 0
+	points := make([]HeatmapPoint, 0)
+	for y, row := range data {
+		for x, intensity := range row {
+			if intensity == 0 {
+				continue
+			}
+			if intensity < query.Threshold {
+				row[x] = 0
+				continue
+			}
+			plotted += intensity
+			points = append(points, HeatmapPoint{X: x, Y: y, Intensity: intensity, Weight: 1.0})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Intensity > points[j].Intensity
+	})
+	return data, points, plotted, len(events)
+}
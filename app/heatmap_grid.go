@@ -0,0 +1,163 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Formats heatmap grids are exported and imported in
+const (
+	HeatmapGridCSV    = "csv"  // One line of comma-separated intensities per row, top row first
+	HeatmapGridBinary = "grid" // Header followed by little-endian uint32 intensities, row by row
+)
+
+// Content types of the heatmap grid formats
+const (
+	HeatmapGridCSVContentType    = "text/csv"
+	HeatmapGridBinaryContentType = "application/octet-stream"
+)
+
+// heatmapGridMagic starts binary heatmap grids. The last two bytes are the format version.
+var heatmapGridMagic = []byte{'H', 'M', 'G', 'R', 'I', 'D', 0, 1}
+
+// heatmapGridHeaderSize is the size of the magic, width and height of binary heatmap grids
+const heatmapGridHeaderSize = 16
+
+// maxHeatmapIntensity is the highest intensity imported grids may hold
+const maxHeatmapIntensity = 1<<31 - 1
+
+// Data sources of a heatmap's latest data
+const (
+	HeatmapDataGenerated = "generated" // Generated from the project's events
+	HeatmapDataImported  = "imported"  // Imported from an externally generated grid
+	HeatmapDataPushed    = "pushed"    // Added up from points pushed by clients
+)
+
+// HeatmapGridFormat returns the grid format named by a query parameter, or given by a content type
+func HeatmapGridFormat(format, contentType string) (string, error) {
+	if format == "" {
+		if strings.Contains(contentType, HeatmapGridBinaryContentType) {
+			return HeatmapGridBinary, nil
+		}
+		return HeatmapGridCSV, nil
+	}
+	if format != HeatmapGridCSV && format != HeatmapGridBinary {
+		return "", fmt.Errorf("invalid grid format: %s. Valid formats are: %s, %s", format, HeatmapGridCSV, HeatmapGridBinary)
+	}
+	return format, nil
+}
+
+// HeatmapGridContentType returns the content type of a grid format
+func HeatmapGridContentType(format string) string {
+	if format == HeatmapGridBinary {
+		return HeatmapGridBinaryContentType
+	}
+	return HeatmapGridCSVContentType
+}
+
+// EncodeHeatmapGrid encodes an intensity grid, indexed by row then column, in a grid format
+func EncodeHeatmapGrid(format string, data [][]int) ([]byte, error) {
+	height := len(data)
+	width := 0
+	if height > 0 {
+		width = len(data[0])
+	}
+
+	if format == HeatmapGridBinary {
+		encoded := make([]byte, 0, heatmapGridHeaderSize+4*width*height)
+		encoded = append(encoded, heatmapGridMagic...)
+		encoded = binary.LittleEndian.AppendUint32(encoded, uint32(width))
+		encoded = binary.LittleEndian.AppendUint32(encoded, uint32(height))
+		for _, row := range data {
+			for _, intensity := range row {
+				encoded = binary.LittleEndian.AppendUint32(encoded, uint32(intensity))
+			}
+		}
+		return encoded, nil
+	}
+
+	var buf bytes.Buffer
+	for _, row := range data {
+		for x, intensity := range row {
+			if x > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(strconv.Itoa(intensity))
+		}
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeHeatmapGrid decodes an intensity grid of the given dimensions from a grid format.
+// Grids of other dimensions and intensities out of range are rejected.
+func DecodeHeatmapGrid(format string, body []byte, width, height int) ([][]int, error) {
+	if format == HeatmapGridBinary {
+		return decodeBinaryHeatmapGrid(body, width, height)
+	}
+
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = width
+	reader.ReuseRecord = true
+	data := make([][]int, 0, height)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV grid: %w", err)
+		}
+		if len(data) == height {
+			return nil, fmt.Errorf("grid has more than %d rows", height)
+		}
+
+		row := make([]int, width)
+		for x, field := range record {
+			intensity, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || intensity < 0 || intensity > maxHeatmapIntensity {
+				return nil, fmt.Errorf("invalid intensity %q at row %d, column %d: intensities must be integers from 0 to %d", field, len(data)+1, x+1, maxHeatmapIntensity)
+			}
+			row[x] = intensity
+		}
+		data = append(data, row)
+	}
+	if len(data) != height {
+		return nil, fmt.Errorf("grid has %d rows, the heatmap is %d high", len(data), height)
+	}
+	return data, nil
+}
+
+// decodeBinaryHeatmapGrid decodes a binary intensity grid of the given dimensions
+func decodeBinaryHeatmapGrid(body []byte, width, height int) ([][]int, error) {
+	if len(body) < heatmapGridHeaderSize || !bytes.Equal(body[:len(heatmapGridMagic)], heatmapGridMagic) {
+		return nil, fmt.Errorf("invalid binary grid: missing %q header", heatmapGridMagic[:6])
+	}
+	gridWidth := binary.LittleEndian.Uint32(body[8:12])
+	gridHeight := binary.LittleEndian.Uint32(body[12:16])
+	if int64(gridWidth) != int64(width) || int64(gridHeight) != int64(height) {
+		return nil, fmt.Errorf("grid is %dx%d, the heatmap is %dx%d", gridWidth, gridHeight, width, height)
+	}
+	if len(body) != heatmapGridHeaderSize+4*width*height {
+		return nil, fmt.Errorf("invalid binary grid: expected %d bytes of intensities, got %d", 4*width*height, len(body)-heatmapGridHeaderSize)
+	}
+
+	data := newHeatmapGrid(width, height)
+	offset := heatmapGridHeaderSize
+	for y := range data {
+		for x := range data[y] {
+			intensity := binary.LittleEndian.Uint32(body[offset:])
+			if intensity > maxHeatmapIntensity {
+				return nil, fmt.Errorf("invalid intensity %d at row %d, column %d: intensities must be integers from 0 to %d", intensity, y+1, x+1, maxHeatmapIntensity)
+			}
+			data[y][x] = int(intensity)
+			offset += 4
+		}
+	}
+	return data, nil
+}
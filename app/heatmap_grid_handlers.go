@@ -0,0 +1,190 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// exportHeatmapData exports the latest data grid of a heatmap as a CSV matrix or binary grid,
+// chosen with ?format or the Accept header
+func (s *App) exportHeatmapData(c *fiber.Ctx) error {
+	format, err := HeatmapGridFormat(c.Query("format"), c.Get(fiber.HeaderAccept))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	heatmap, err := s.heatmapService.GetHeatmap(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	document, err := EncodeHeatmapGrid(format, heatmap.Data)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	encrypted := s.encryptExport(c, heatmap.ProjectID)
+	s.siem.Export(requestSecurityEvent(c, SecurityExport, "heatmap_data_exported", OutcomeSuccess, 3, map[string]interface{}{
+		"project_id": heatmap.ProjectID,
+		"heatmap_id": heatmap.ID,
+		"format":     format,
+		"encrypted":  encrypted,
+	}))
+
+	filename := heatmap.ID + "." + format
+	if encrypted {
+		return s.sendEncryptedExport(c, heatmap.ProjectID, filename, document)
+	}
+	c.Set(fiber.HeaderETag, ETag(heatmap.Version))
+	c.Attachment(filename)
+	c.Set(fiber.HeaderContentType, HeatmapGridContentType(format))
+	return c.Send(document)
+}
+
+// renderHeatmap renders the latest data grid of a heatmap as a PNG or SVG image of one pixel per
+// cell, colored through ?gradient with ?opacity over a ?background color. Cells without activity
+// are transparent unless a background is given, so the image can be composited over a screenshot.
+func (s *App) renderHeatmap(c *fiber.Ctx) error {
+	format, err := HeatmapRenderFormat(c.Query("format"))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	options, err := ParseHeatmapRenderOptions(c.Query("gradient"), c.Query("opacity"), c.Query("background"))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	heatmap, err := s.heatmapService.GetHeatmap(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	image, err := RenderHeatmap(format, heatmap.Data, options)
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, ETag(heatmap.Version))
+	c.Set(fiber.HeaderContentType, HeatmapRenderContentType(format))
+	return c.Send(image)
+}
+
+// importHeatmapData replaces the latest data of a heatmap with an externally generated grid of
+// its dimensions, sent as a CSV matrix or binary grid chosen with ?format or the Content-Type
+// header, optionally gzip-compressed
+func (s *App) importHeatmapData(c *fiber.Ctx) error {
+	format, err := HeatmapGridFormat(c.Query("format"), c.Get(fiber.HeaderContentType))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	heatmap, err := s.heatmapService.GetHeatmap(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	body, err := decompressedBody(c, s.heatmapImportMaxBytes)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	data, err := DecodeHeatmapGrid(format, body, heatmap.Width, heatmap.Height)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// The heatmap may have been resized or deleted since it was read
+	heatmap, err = s.heatmapService.ImportData(ctx, heatmap.ID, data)
+	if err != nil {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	s.dashboardService.BroadcastHeatmapUpdated(heatmap)
+
+	heatmap.Data = nil
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"heatmap": heatmap,
+	})
+}
+
+// appendHeatmapPoints adds a batch of points, e.g. aggregated client-side, to the latest data of
+// a heatmap, as JSON optionally gzip-compressed
+func (s *App) appendHeatmapPoints(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	heatmap, err := s.heatmapService.GetHeatmap(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	body, err := decompressedBody(c, s.heatmapImportMaxBytes)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	var request struct {
+		Points []HeatmapPoint `json:"points"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid JSON body",
+		})
+	}
+	if len(request.Points) == 0 || len(request.Points) > s.heatmapPointsMaxBatch {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("points must hold from 1 to %d points", s.heatmapPointsMaxBatch),
+		})
+	}
+	if err := validateHeatmapPoints(request.Points, heatmap.Width, heatmap.Height); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// The heatmap may have been resized or deleted since it was read
+	heatmap, err = s.heatmapService.AppendPoints(ctx, heatmap.ID, request.Points)
+	if err != nil {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	s.dashboardService.BroadcastHeatmapUpdated(heatmap)
+
+	heatmap.Data = nil
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"appended": len(request.Points),
+		"heatmap":  heatmap,
+	})
+}
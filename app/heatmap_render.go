@@ -0,0 +1,231 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// Image formats heatmaps are rendered in
+const (
+	HeatmapRenderPNG = "png"
+	HeatmapRenderSVG = "svg"
+)
+
+// Content types of the heatmap image formats
+const (
+	HeatmapRenderPNGContentType = "image/png"
+	HeatmapRenderSVGContentType = "image/svg+xml"
+)
+
+// heatmapGradients are the named color gradients, from the lowest intensity to the highest
+var heatmapGradients = map[string]string{
+	"classic":   "0000ff,00ffff,00ff00,ffff00,ff0000",
+	"fire":      "000000,ff0000,ffff00,ffffff",
+	"grayscale": "000000,ffffff",
+	"viridis":   "440154,3b528b,21918c,5ec962,fde725",
+}
+
+// defaultHeatmapGradient is the gradient heatmaps are rendered through when none is given
+const defaultHeatmapGradient = "classic"
+
+// HeatmapRenderOptions controls how an intensity grid is drawn
+type HeatmapRenderOptions struct {
+	Gradient []color.NRGBA // Colors evenly spaced from the lowest intensity to the highest
+	Opacity  float64       // Applied to the colors of every cell, from 0 to 1
+	// Drawn behind the cells, and in cells without activity. Nil leaves them transparent, e.g.
+	// to overlay the image on a screenshot of the page.
+	Background *color.NRGBA
+}
+
+// ParseHeatmapRenderOptions parses the gradient (a name, or comma-separated #rrggbb or #rrggbbaa
+// colors), opacity and background color of a rendering. Empty values take the defaults: the
+// classic gradient, fully opaque over a transparent background.
+func ParseHeatmapRenderOptions(gradient, opacity, background string) (HeatmapRenderOptions, error) {
+	options := HeatmapRenderOptions{Opacity: 1}
+
+	if gradient == "" {
+		gradient = defaultHeatmapGradient
+	}
+	if named, exists := heatmapGradients[gradient]; exists {
+		gradient = named
+	}
+	for _, stop := range strings.Split(gradient, ",") {
+		parsed, err := parseHexColor(stop)
+		if err != nil {
+			return options, fmt.Errorf("invalid gradient %q: expected one of classic, fire, grayscale, viridis, or comma-separated colors such as 0000ff,ff0000", gradient)
+		}
+		options.Gradient = append(options.Gradient, parsed)
+	}
+	if len(options.Gradient) < 2 {
+		return options, fmt.Errorf("a gradient needs at least 2 colors")
+	}
+
+	if opacity != "" {
+		parsed, err := strconv.ParseFloat(opacity, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return options, fmt.Errorf("invalid opacity %q: expected a number from 0 to 1", opacity)
+		}
+		options.Opacity = parsed
+	}
+
+	if background != "" && background != "transparent" {
+		parsed, err := parseHexColor(background)
+		if err != nil {
+			return options, fmt.Errorf("invalid background %q: expected a color such as ffffff, or transparent", background)
+		}
+		options.Background = &parsed
+	}
+	return options, nil
+}
+
+// parseHexColor parses a rrggbb or rrggbbaa color, optionally prefixed with #
+func parseHexColor(value string) (color.NRGBA, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(value) != 6 && len(value) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", value)
+	}
+	if len(value) == 6 {
+		value += "ff"
+	}
+	parsed, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", value)
+	}
+	return color.NRGBA{R: uint8(parsed >> 24), G: uint8(parsed >> 16), B: uint8(parsed >> 8), A: uint8(parsed)}, nil
+}
+
+// HeatmapRenderFormat returns the image format named by a query parameter, PNG by default
+func HeatmapRenderFormat(format string) (string, error) {
+	switch format {
+	case "", HeatmapRenderPNG:
+		return HeatmapRenderPNG, nil
+	case HeatmapRenderSVG:
+		return HeatmapRenderSVG, nil
+	default:
+		return "", fmt.Errorf("invalid image format: %s. Valid formats are: %s, %s", format, HeatmapRenderPNG, HeatmapRenderSVG)
+	}
+}
+
+// HeatmapRenderContentType returns the content type of an image format
+func HeatmapRenderContentType(format string) string {
+	if format == HeatmapRenderSVG {
+		return HeatmapRenderSVGContentType
+	}
+	return HeatmapRenderPNGContentType
+}
+
+// RenderHeatmap draws an intensity grid, indexed by row then column, as an image of one pixel per
+// cell. Cells are colored by their intensity relative to the grid's highest through the gradient;
+// cells without activity show the background.
+func RenderHeatmap(format string, data [][]int, options HeatmapRenderOptions) ([]byte, error) {
+	height := len(data)
+	width := 0
+	if height > 0 {
+		width = len(data[0])
+	}
+	if width == 0 {
+		return nil, fmt.Errorf("the heatmap has no data to render")
+	}
+
+	highest := 0
+	for _, row := range data {
+		for _, intensity := range row {
+			highest = max(highest, intensity)
+		}
+	}
+	colorOf := func(intensity int) color.NRGBA {
+		cell := gradientColor(options.Gradient, float64(intensity)/float64(highest))
+		cell.A = uint8(float64(cell.A)*options.Opacity + 0.5)
+		return cell
+	}
+
+	if format == HeatmapRenderSVG {
+		return renderHeatmapSVG(data, width, height, colorOf, options.Background), nil
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y, row := range data {
+		for x, intensity := range row {
+			switch {
+			case intensity > 0:
+				img.SetNRGBA(x, y, over(colorOf(intensity), options.Background))
+			case options.Background != nil:
+				img.SetNRGBA(x, y, *options.Background)
+			}
+		}
+	}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		return nil, fmt.Errorf("failed to encode the heatmap: %w", err)
+	}
+	return encoded.Bytes(), nil
+}
+
+// renderHeatmapSVG draws the active cells as rectangles, merging runs of a row with the same color
+func renderHeatmapSVG(data [][]int, width, height int, colorOf func(int) color.NRGBA, background *color.NRGBA) []byte {
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, width, height, width, height)
+	if background != nil {
+		fmt.Fprintf(&svg, `<rect width="%d" height="%d" %s/>`, width, height, svgFill(*background))
+	}
+	for y, row := range data {
+		for x := 0; x < len(row); {
+			if row[x] <= 0 {
+				x++
+				continue
+			}
+			cell := colorOf(row[x])
+			run := 1
+			for x+run < len(row) && row[x+run] > 0 && colorOf(row[x+run]) == cell {
+				run++
+			}
+			fmt.Fprintf(&svg, `<rect x="%d" y="%d" width="%d" height="1" %s/>`, x, y, run, svgFill(cell))
+			x += run
+		}
+	}
+	svg.WriteString("</svg>")
+	return svg.Bytes()
+}
+
+// svgFill returns the fill attributes of a color
+func svgFill(fill color.NRGBA) string {
+	if fill.A == 255 {
+		return fmt.Sprintf(`fill="#%02x%02x%02x"`, fill.R, fill.G, fill.B)
+	}
+	return fmt.Sprintf(`fill="#%02x%02x%02x" fill-opacity="%.3g"`, fill.R, fill.G, fill.B, float64(fill.A)/255)
+}
+
+// gradientColor interpolates the color at position t, from 0 to 1, of evenly spaced stops
+func gradientColor(stops []color.NRGBA, t float64) color.NRGBA {
+	t = min(max(t, 0), 1)
+	position := t * float64(len(stops)-1)
+	index := min(int(position), len(stops)-2)
+	fraction := position - float64(index)
+	from, to := stops[index], stops[index+1]
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*fraction + 0.5)
+	}
+	return color.NRGBA{R: mix(from.R, to.R), G: mix(from.G, to.G), B: mix(from.B, to.B), A: mix(from.A, to.A)}
+}
+
+// over composites a color over a background, nil for a transparent one
+func over(fill color.NRGBA, background *color.NRGBA) color.NRGBA {
+	if background == nil || fill.A == 255 {
+		return fill
+	}
+	alpha := float64(fill.A) / 255
+	backgroundAlpha := float64(background.A) / 255 * (1 - alpha)
+	outAlpha := alpha + backgroundAlpha
+	if outAlpha == 0 {
+		return color.NRGBA{}
+	}
+	blend := func(a, b uint8) uint8 {
+		return uint8((float64(a)*alpha+float64(b)*backgroundAlpha)/outAlpha + 0.5)
+	}
+	return color.NRGBA{R: blend(fill.R, background.R), G: blend(fill.G, background.G), B: blend(fill.B, background.B), A: uint8(outAlpha*255 + 0.5)}
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// minHeatmapRefresh is the shortest refresh interval of a heatmap schedule
+const minHeatmapRefresh = 5 * time.Minute
+
+// HeatmapSchedule regenerates a stored heatmap on an interval over a rolling time window, so
+// embedded heatmaps stay current without clients triggering the computation
+type HeatmapSchedule struct {
+	Refresh   string     `json:"refresh"` // Interval between regenerations, e.g. "1h"
+	Window    string     `json:"window"`  // Time range ending at each regeneration, e.g. "7d"
+	NextRunAt time.Time  `json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at,omitempty"`
+	LastError string     `json:"last_error,omitempty"` // Why the last regeneration failed
+
+	refresh time.Duration
+	window  time.Duration
+}
+
+// NewHeatmapSchedule creates a schedule from a refresh interval (a Go duration of at least 5m) and
+// a rolling window (e.g. "7d" or "12h"). The first regeneration is due right away.
+func NewHeatmapSchedule(refresh, window string) (*HeatmapSchedule, error) {
+	refreshInterval, err := time.ParseDuration(refresh)
+	if err != nil || refreshInterval < minHeatmapRefresh {
+		return nil, fmt.Errorf("invalid refresh %q, expected a duration of at least %s", refresh, minHeatmapRefresh)
+	}
+	windowDuration, err := parseRetention(window)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window %q, expected e.g. 7d or 12h", window)
+	}
+
+	return &HeatmapSchedule{
+		Refresh: refreshInterval.String(),
+		Window:  formatRetention(windowDuration),
+		refresh: refreshInterval,
+		window:  windowDuration,
+	}, nil
+}
+
+// copy returns a copy of the schedule
+func (s *HeatmapSchedule) copy() *HeatmapSchedule {
+	copied := *s
+	if s.LastRunAt != nil {
+		lastRunAt := *s.LastRunAt
+		copied.LastRunAt = &lastRunAt
+	}
+	return &copied
+}
+
+// dueHeatmaps returns the scheduled heatmaps whose regeneration is due
+func (s *HeatmapService) dueHeatmaps(now time.Time) []*Heatmap {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	due := make([]*Heatmap, 0)
+	for _, heatmap := range s.heatmaps {
+		if heatmap.Schedule != nil && !heatmap.Schedule.NextRunAt.After(now) {
+			due = append(due, heatmap.copy())
+		}
+	}
+	return due
+}
+
+// recordScheduledRun records a scheduled regeneration and schedules the next one. Runs of a
+// configuration replaced in the meantime are ignored, its new schedule already applies.
+func (s *HeatmapService) recordScheduledRun(generated *Heatmap, now time.Time, runErr error) *Heatmap {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	heatmap, exists := s.heatmaps[generated.ID]
+	if !exists || heatmap.Version != generated.Version || heatmap.Schedule == nil {
+		return nil
+	}
+
+	schedule := heatmap.Schedule.copy()
+	schedule.LastRunAt = &now
+	schedule.NextRunAt = now.Add(schedule.refresh)
+	schedule.LastError = ""
+	if runErr != nil {
+		schedule.LastError = runErr.Error()
+	}
+	heatmap.Schedule = schedule
+	return heatmap.copy()
+}
+
+// HeatmapRefresher periodically regenerates the heatmaps whose schedule is due
+type HeatmapRefresher struct {
+	heatmaps  *HeatmapService
+	onUpdated func(*Heatmap) // Called with every regenerated heatmap, e.g. to notify dashboards
+	interval  time.Duration  // How often schedules are checked
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewHeatmapRefresher creates a refresher checking schedules every HEATMAP_REFRESH_CHECK_INTERVAL (default 1m)
+func NewHeatmapRefresher(heatmaps *HeatmapService, onUpdated func(*Heatmap)) *HeatmapRefresher {
+	return &HeatmapRefresher{
+		heatmaps:  heatmaps,
+		onUpdated: onUpdated,
+		interval:  getEnvDuration("HEATMAP_REFRESH_CHECK_INTERVAL", time.Minute),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start runs the refresher in the background until Stop is called
+func (r *HeatmapRefresher) Start() {
+	if r.interval <= 0 {
+		log.Printf("Heatmap refresher disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case now := <-ticker.C:
+				r.Run(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the background regenerations
+func (r *HeatmapRefresher) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// Run regenerates the heatmaps due at now over their rolling windows and returns how many were
+// regenerated. Failures are recorded in the schedule and retried at the next refresh.
+func (r *HeatmapRefresher) Run(now time.Time) int {
+	regenerated := 0
+	for _, heatmap := range r.heatmaps.dueHeatmaps(now) {
+		ctx := ContextWithProject(context.Background(), heatmap.ProjectID)
+		_, err := r.heatmaps.GenerateHeatmap(ctx, HeatmapQuery{
+			HeatmapID: heatmap.ID,
+			Start:     now.Add(-heatmap.Schedule.window),
+			End:       now,
+		})
+		if err != nil {
+			log.Printf("Warning: Scheduled regeneration of heatmap %s failed: %v", heatmap.ID, err)
+		}
+
+		updated := r.heatmaps.recordScheduledRun(heatmap, now, err)
+		if err != nil || updated == nil {
+			continue
+		}
+		regenerated++
+		if r.onUpdated != nil {
+			r.onUpdated(updated)
+		}
+	}
+	return regenerated
+}
@@ -5,26 +5,43 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"sort"
+	"sync"
 	"time"
 )
 
 // HeatmapService generates heatmaps from analytics events
 type HeatmapService struct {
 	analyticsService *AnalyticsService
+	frustration      *FrustrationService
+	heatmaps         map[string]*Heatmap // In-memory storage for now
+	mutex            sync.RWMutex
 }
 
 // Heatmap represents a heatmap visualization
 type Heatmap struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	Type        string    `json:"type"` // "click", "scroll", "movement"
-	Page        string    `json:"page"`
-	Data        [][]int   `json:"data"` // 2D grid representing heatmap intensity
-	Width       int       `json:"width"`
-	Height      int       `json:"height"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          string           `json:"id"`
+	ProjectID   string           `json:"project_id"`
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Type        string           `json:"type"` // "click", "scroll", "movement"
+	Page        string           `json:"page"`
+	Data        [][]int          `json:"data,omitempty"` // 2D grid representing heatmap intensity, omitted in listings
+	Width       int              `json:"width"`
+	Height      int              `json:"height"`
+	Stats       *HeatmapStats    `json:"stats,omitempty"`        // Statistics of the latest generated data
+	GeneratedAt *time.Time       `json:"generated_at,omitempty"` // When the latest data was generated
+	DataSource  string           `json:"data_source,omitempty"`  // Whether the latest data was generated or imported
+	Schedule    *HeatmapSchedule `json:"schedule,omitempty"`     // Automatic regeneration, if any
+	Version     int64            `json:"version"`                // Incremented on every update, exposed as the ETag
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+// HeatmapFilter selects the heatmaps of a listing. Empty fields match every heatmap.
+type HeatmapFilter struct {
+	Page string
+	Type string
 }
 
 // HeatmapPoint represents a single point in a heatmap
@@ -45,21 +62,25 @@ type HeatmapQuery struct {
 	Height    int       `json:"height"`
 	UserID    string    `json:"user_id,omitempty"`
 	Threshold int       `json:"threshold"` // Minimum intensity to include
+	// Stored heatmap to generate. Its page, type and dimensions are used, and the result is
+	// kept as its latest data.
+	HeatmapID string `json:"heatmap_id,omitempty"`
 }
 
 // HeatmapResult represents the computed heatmap results
 type HeatmapResult struct {
-	HeatmapID   string         `json:"heatmap_id"`
-	HeatmapName string         `json:"heatmap_name"`
-	Page        string         `json:"page"`
-	Type        string         `json:"type"`
-	TimeRange   TimeRange      `json:"time_range"`
-	Data        [][]int        `json:"data"`
-	Width       int            `json:"width"`
-	Height      int            `json:"height"`
-	Points      []HeatmapPoint `json:"points"`
-	Stats       HeatmapStats   `json:"stats"`
-	ComputedAt  time.Time      `json:"computed_at"`
+	HeatmapID   string          `json:"heatmap_id"`
+	HeatmapName string          `json:"heatmap_name"`
+	Page        string          `json:"page"`
+	Type        string          `json:"type"`
+	TimeRange   TimeRange       `json:"time_range"`
+	Data        [][]int         `json:"data"`
+	Width       int             `json:"width"`
+	Height      int             `json:"height"`
+	Points      []HeatmapPoint  `json:"points"`
+	Stats       HeatmapStats    `json:"stats"`
+	Billing     *HeatmapBilling `json:"billing"`
+	ComputedAt  time.Time       `json:"computed_at"`
 }
 
 // HeatmapStats represents statistics about the heatmap
@@ -70,65 +91,160 @@ type HeatmapStats struct {
 	AvgIntensity float64 `json:"avg_intensity"`
 	HotspotCount int     `json:"hotspot_count"`
 	CoverageArea float64 `json:"coverage_area"` // Percentage of area with activity
+	// Frustration signals of click heatmaps
+	RageClicks int `json:"rage_clicks,omitempty"`
+	DeadClicks int `json:"dead_clicks,omitempty"`
 }
 
 // NewHeatmapService creates a new heatmap service instance
 func NewHeatmapService(analyticsService *AnalyticsService) *HeatmapService {
 	return &HeatmapService{
 		analyticsService: analyticsService,
+		frustration:      NewFrustrationService(analyticsService),
+		heatmaps:         make(map[string]*Heatmap),
+	}
+}
+
+// Frustration returns the detector of rage and dead clicks
+func (s *HeatmapService) Frustration() *FrustrationService {
+	return s.frustration
+}
+
+// CreateHeatmap creates a new heatmap, regenerated automatically when a schedule is given
+func (s *HeatmapService) CreateHeatmap(ctx context.Context, name, description, heatmapType, page string, width, height int, schedule *HeatmapSchedule) (*Heatmap, error) {
+	if err := validateHeatmap(name, heatmapType, page, width, height); err != nil {
+		return nil, err
+	}
+
+	now := s.analyticsService.Clock().Now()
+	heatmap := &Heatmap{
+		ID:          s.newHeatmapID(),
+		ProjectID:   ProjectFromContext(ctx),
+		Name:        name,
+		Description: description,
+		Type:        heatmapType,
+		Page:        page,
+		Width:       width,
+		Height:      height,
+		Data:        newHeatmapGrid(width, height),
+		Version:     1,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if schedule != nil {
+		heatmap.Schedule = schedule.copy()
+		heatmap.Schedule.NextRunAt = heatmap.CreatedAt
 	}
+
+	s.mutex.Lock()
+	s.heatmaps[heatmap.ID] = heatmap
+	s.mutex.Unlock()
+
+	log.Printf("Created heatmap: %s for page: %s, type: %s, dimensions: %dx%d",
+		heatmap.ID, page, heatmapType, width, height)
+
+	return heatmap.copy(), nil
 }
 
-// CreateHeatmap creates a new heatmap
-func (s *HeatmapService) CreateHeatmap(ctx context.Context, name, description, heatmapType, page string, width, height int) (*Heatmap, error) {
+// UpdateHeatmap replaces the configuration of a heatmap, including its schedule. The update is
+// rejected with a VersionConflictError unless expectedVersion is the heatmap's current version.
+func (s *HeatmapService) UpdateHeatmap(ctx context.Context, heatmapID, name, description, heatmapType, page string, width, height int, schedule *HeatmapSchedule, expectedVersion int64) (*Heatmap, error) {
+	if err := validateHeatmap(name, heatmapType, page, width, height); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	heatmap, exists := s.heatmaps[heatmapID]
+	if !exists || heatmap.ProjectID != ProjectFromContext(ctx) {
+		return nil, fmt.Errorf("heatmap not found: %s", heatmapID)
+	}
+	if err := checkVersion("heatmap", heatmapID, heatmap.Version, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	// The latest data no longer matches a heatmap of another page, type or size
+	reset := heatmapType != heatmap.Type || page != heatmap.Page || width != heatmap.Width || height != heatmap.Height
+	if reset {
+		heatmap.Data = newHeatmapGrid(width, height)
+		heatmap.Stats = nil
+		heatmap.GeneratedAt = nil
+		heatmap.DataSource = ""
+	}
+	heatmap.Name = name
+	heatmap.Description = description
+	heatmap.Type = heatmapType
+	heatmap.Page = page
+	heatmap.Width = width
+	heatmap.Height = height
+	heatmap.Version++
+	heatmap.UpdatedAt = s.analyticsService.Clock().Now()
+
+	// A new schedule, or cleared data, starts with a regeneration; otherwise the timing is kept
+	switch {
+	case schedule == nil:
+		heatmap.Schedule = nil
+	case reset || heatmap.Schedule == nil || heatmap.Schedule.Refresh != schedule.Refresh || heatmap.Schedule.Window != schedule.Window:
+		heatmap.Schedule = schedule.copy()
+		heatmap.Schedule.NextRunAt = heatmap.UpdatedAt
+	}
+
+	return heatmap.copy(), nil
+}
+
+// validateHeatmap checks a heatmap configuration
+func validateHeatmap(name, heatmapType, page string, width, height int) error {
 	if name == "" {
-		return nil, fmt.Errorf("heatmap name is required")
+		return fmt.Errorf("heatmap name is required")
 	}
 
 	if page == "" {
-		return nil, fmt.Errorf("page is required")
+		return fmt.Errorf("page is required")
 	}
 
 	if heatmapType == "" {
-		return nil, fmt.Errorf("heatmap type is required")
+		return fmt.Errorf("heatmap type is required")
 	}
 
 	if width <= 0 || height <= 0 {
-		return nil, fmt.Errorf("width and height must be positive")
+		return fmt.Errorf("width and height must be positive")
 	}
 
 	// Validate heatmap type
 	validTypes := map[string]bool{"click": true, "scroll": true, "movement": true}
 	if !validTypes[heatmapType] {
-		return nil, fmt.Errorf("invalid heatmap type: %s. Valid types are: click, scroll, movement", heatmapType)
+		return fmt.Errorf("invalid heatmap type: %s. Valid types are: click, scroll, movement", heatmapType)
 	}
 
-	heatmap := &Heatmap{
-		ID:          generateHeatmapID(),
-		Name:        name,
-		Description: description,
-		Type:        heatmapType,
-		Page:        page,
-		Width:       width,
-		Height:      height,
-		Data:        make([][]int, height),
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-	}
+	return nil
+}
 
-	// Initialize the 2D grid
-	for i := range heatmap.Data {
-		heatmap.Data[i] = make([]int, width)
+// newHeatmapGrid initializes an empty 2D intensity grid
+func newHeatmapGrid(width, height int) [][]int {
+	grid := make([][]int, height)
+	for i := range grid {
+		grid[i] = make([]int, width)
 	}
-
-	log.Printf("Created heatmap: %s for page: %s, type: %s, dimensions: %dx%d",
-		heatmap.ID, page, heatmapType, width, height)
-
-	return heatmap, nil
+	return grid
 }
 
-// GenerateHeatmap generates a heatmap from analytics events
+// GenerateHeatmap generates a heatmap from the positions of the project's click, scroll or mouse
+// movement events on the page in the time range
 func (s *HeatmapService) GenerateHeatmap(ctx context.Context, query HeatmapQuery) (*HeatmapResult, error) {
+	var stored *Heatmap
+	if query.HeatmapID != "" {
+		heatmap, err := s.GetHeatmap(ctx, query.HeatmapID)
+		if err != nil {
+			return nil, err
+		}
+		stored = heatmap
+		query.Page = heatmap.Page
+		query.Type = heatmap.Type
+		query.Width = heatmap.Width
+		query.Height = heatmap.Height
+	}
+
 	if query.Page == "" {
 		return nil, fmt.Errorf("page is required")
 	}
@@ -136,6 +252,9 @@ func (s *HeatmapService) GenerateHeatmap(ctx context.Context, query HeatmapQuery
 	if query.Type == "" {
 		return nil, fmt.Errorf("heatmap type is required")
 	}
+	if _, valid := heatmapEventTypes[query.Type]; !valid {
+		return nil, fmt.Errorf("invalid heatmap type: %s. Valid types are: click, scroll, movement", query.Type)
+	}
 
 	if query.Width <= 0 || query.Height <= 0 {
 		return nil, fmt.Errorf("width and height must be positive")
@@ -149,12 +268,18 @@ func (s *HeatmapService) GenerateHeatmap(ctx context.Context, query HeatmapQuery
 		query.Height = 1080 // Default desktop height
 	}
 
-	// Generate mock heatmap data for demonstration
-	// In production, this would query the analytics database for real event data
-	heatmapData, points := s.generateMockHeatmapData(query)
+	// Block resolutions beyond the billed user's plan before doing any work
+	billingUserID := BillingUserFromContext(ctx)
+	if err := checkHeatmapResolution(s.analyticsService.Plans().PlanForUser(billingUserID), query.Width, query.Height); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+
+	heatmapData, points, plotted, scanned := s.aggregateEvents(ctx, query)
 
 	result := &HeatmapResult{
-		HeatmapID:   generateHeatmapID(),
+		HeatmapID:   s.newHeatmapID(),
 		HeatmapName: fmt.Sprintf("%s Heatmap - %s", query.Type, query.Page),
 		Page:        query.Page,
 		Type:        query.Type,
@@ -164,183 +289,45 @@ func (s *HeatmapService) GenerateHeatmap(ctx context.Context, query HeatmapQuery
 		Height:      query.Height,
 		Points:      points,
 		Stats:       s.calculateHeatmapStats(heatmapData, points),
-		ComputedAt:  time.Now(),
+		ComputedAt:  s.analyticsService.Clock().Now(),
 	}
-
-	return result, nil
-}
-
-// generateMockHeatmapData generates mock heatmap data for demonstration
-func (s *HeatmapService) generateMockHeatmapData(query HeatmapQuery) ([][]int, []HeatmapPoint) {
-	width := query.Width
-	height := query.Height
-
-	// Create 2D grid
-	data := make([][]int, height)
-	for i := range data {
-		data[i] = make([]int, width)
+	result.Stats.TotalPoints = plotted
+	if query.Type == ClickEventType {
+		result.Stats.RageClicks, result.Stats.DeadClicks = s.frustration.Counts(ctx, query.Page, query.Start, query.End)
 	}
 
-	var points []HeatmapPoint
-
-	// Generate mock click points for demonstration
-	// In production, this would be based on real event data
-	switch query.Type {
-	case "click":
-		points = s.generateMockClickPoints(width, height)
-	case "scroll":
-		points = s.generateMockScrollPoints(width, height)
-	case "movement":
-		points = s.generateMockMovementPoints(width, height)
-	}
+	// Bill proportionally to the grid size and scanned events
+	baseCost := s.analyticsService.calculateAPICallCost("/api/v1/heatmaps/generate", "POST")
+	result.Billing = calculateHeatmapBilling(query.Width, query.Height, int64(scanned), baseCost)
+	cost := result.Billing.TotalCost
 
-	// Apply points to the grid
-	for _, point := range points {
-		// Ensure coordinates are within bounds
-		if point.X >= 0 && point.X < width && point.Y >= 0 && point.Y < height {
-			data[point.Y][point.X] += point.Intensity
+	// Charge in the project's contract currency
+	currencies := s.analyticsService.Currencies()
+	if currency := currencies.ProjectCurrency(ProjectFromContext(ctx)); currency != BaseCurrency {
+		if rate, err := currencies.Rate(currency); err == nil {
+			result.Billing.convert(currency, rate)
 		}
 	}
 
-	// Apply Gaussian blur for more realistic heatmap appearance
-	data = s.applyGaussianBlur(data, 3)
-
-	return data, points
-}
-
-// generateMockClickPoints generates mock click points
-func (s *HeatmapService) generateMockClickPoints(width, height int) []HeatmapPoint {
-	var points []HeatmapPoint
-
-	// Generate some realistic click patterns
-	clickAreas := []struct {
-		x, y, radius int
-		intensity    int
-	}{
-		{width / 4, height / 4, 50, 10},        // Top-left area
-		{width / 2, height / 2, 80, 15},        // Center area
-		{3 * width / 4, 3 * height / 4, 60, 8}, // Bottom-right area
-		{width / 2, height / 4, 40, 12},        // Top-center area
-	}
-
-	for _, area := range clickAreas {
-		// Generate multiple clicks in each area
-		for i := 0; i < 20; i++ {
-			x := area.x + (i%area.radius - area.radius/2)
-			y := area.y + (i%area.radius - area.radius/2)
-
-			// Add some randomness
-			x += (i*7)%20 - 10
-			y += (i*11)%20 - 10
-
-			points = append(points, HeatmapPoint{
-				X:         x,
-				Y:         y,
-				Intensity: area.intensity,
-				Weight:    1.0,
-			})
-		}
+	if billingUserID != "" {
+		s.emitBillingEvent(ctx, billingUserID, query, result.Billing)
 	}
 
-	return points
-}
-
-// generateMockScrollPoints generates mock scroll points
-func (s *HeatmapService) generateMockScrollPoints(width, height int) []HeatmapPoint {
-	var points []HeatmapPoint
-
-	// Scroll patterns are typically more vertical
-	for y := 0; y < height; y += 50 {
-		for x := 0; x < width; x += 100 {
-			intensity := 5 + (y % 20) // Higher intensity in middle areas
-			points = append(points, HeatmapPoint{
-				X:         x,
-				Y:         y,
-				Intensity: intensity,
-				Weight:    0.8,
-			})
-		}
+	if stored != nil {
+		result.HeatmapID = stored.ID
+		result.HeatmapName = stored.Name
+		s.storeLatestData(stored, result)
 	}
 
-	return points
-}
-
-// generateMockMovementPoints generates mock mouse movement points
-func (s *HeatmapService) generateMockMovementPoints(width, height int) []HeatmapPoint {
-	var points []HeatmapPoint
-
-	// Generate a path-like pattern
-	path := []struct {
-		x, y int
-	}{
-		{0, height / 2},
-		{width / 4, height / 3},
-		{width / 2, height / 2},
-		{3 * width / 4, 2 * height / 3},
-		{width, height / 2},
-	}
-
-	for i := 0; i < len(path)-1; i++ {
-		start := path[i]
-		end := path[i+1]
-
-		// Generate points along the path
-		steps := 50
-		for j := 0; j <= steps; j++ {
-			t := float64(j) / float64(steps)
-			x := int(float64(start.x)*(1-t) + float64(end.x)*t)
-			y := int(float64(start.y)*(1-t) + float64(end.y)*t)
-
-			// Add some randomness
-			x += (j*13)%30 - 15
-			y += (j*17)%30 - 15
-
-			points = append(points, HeatmapPoint{
-				X:         x,
-				Y:         y,
-				Intensity: 3,
-				Weight:    0.6,
-			})
-		}
-	}
-
-	return points
-}
-
-// applyGaussianBlur applies a simple Gaussian blur to the heatmap data
-func (s *HeatmapService) applyGaussianBlur(data [][]int, radius int) [][]int {
-	height := len(data)
-	width := len(data[0])
-
-	// Create a copy for the blurred result
-	blurred := make([][]int, height)
-	for i := range blurred {
-		blurred[i] = make([]int, width)
-	}
-
-	// Simple blur implementation
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			sum := 0
-			count := 0
-
-			for dy := -radius; dy <= radius; dy++ {
-				for dx := -radius; dx <= radius; dx++ {
-					ny, nx := y+dy, x+dx
-					if ny >= 0 && ny < height && nx >= 0 && nx < width {
-						sum += data[ny][nx]
-						count++
-					}
-				}
-			}
-
-			if count > 0 {
-				blurred[y][x] = sum / count
-			}
-		}
-	}
+	s.analyticsService.SlowOperations().Observe(SlowOperationHeatmap, map[string]interface{}{
+		"page":    query.Page,
+		"type":    query.Type,
+		"width":   query.Width,
+		"height":  query.Height,
+		"user_id": query.UserID,
+	}, time.Since(start), int64(scanned), cost)
 
-	return blurred
+	return result, nil
 }
 
 // calculateHeatmapStats calculates statistics for the heatmap
@@ -402,28 +389,170 @@ func (s *HeatmapService) calculateHeatmapStats(data [][]int, points []HeatmapPoi
 	}
 }
 
-// GetHeatmap retrieves a heatmap by ID
+// GetHeatmap retrieves a heatmap of the project by ID, with its latest data
 func (s *HeatmapService) GetHeatmap(ctx context.Context, heatmapID string) (*Heatmap, error) {
 	if heatmapID == "" {
 		return nil, fmt.Errorf("heatmap ID is required")
 	}
 
-	// In a real implementation, this would fetch from a database
-	// For now, return a mock heatmap
-	return &Heatmap{
-		ID:          heatmapID,
-		Name:        "Sample Heatmap",
-		Description: "A sample heatmap for demonstration",
-		Type:        "click",
-		Page:        "/home",
-		Width:       1920,
-		Height:      1080,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-	}, nil
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	heatmap, exists := s.heatmaps[heatmapID]
+	if !exists || heatmap.ProjectID != ProjectFromContext(ctx) {
+		return nil, fmt.Errorf("heatmap not found: %s", heatmapID)
+	}
+	return heatmap.copy(), nil
+}
+
+// ListHeatmaps returns the heatmaps of the project matching the filter, oldest first. The data
+// grids are left out; get a heatmap for its latest data.
+func (s *HeatmapService) ListHeatmaps(ctx context.Context, filter HeatmapFilter) []*Heatmap {
+	projectID := ProjectFromContext(ctx)
+
+	s.mutex.RLock()
+	heatmaps := make([]*Heatmap, 0)
+	for _, heatmap := range s.heatmaps {
+		if heatmap.ProjectID != projectID {
+			continue
+		}
+		if (filter.Page != "" && heatmap.Page != filter.Page) || (filter.Type != "" && heatmap.Type != filter.Type) {
+			continue
+		}
+		copied := heatmap.copy()
+		copied.Data = nil
+		heatmaps = append(heatmaps, copied)
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(heatmaps, func(i, j int) bool {
+		if !heatmaps[i].CreatedAt.Equal(heatmaps[j].CreatedAt) {
+			return heatmaps[i].CreatedAt.Before(heatmaps[j].CreatedAt)
+		}
+		return heatmaps[i].ID < heatmaps[j].ID
+	})
+	return heatmaps
+}
+
+// DeleteHeatmap removes a heatmap of the project with its data
+func (s *HeatmapService) DeleteHeatmap(ctx context.Context, heatmapID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	heatmap, exists := s.heatmaps[heatmapID]
+	if !exists || heatmap.ProjectID != ProjectFromContext(ctx) {
+		return fmt.Errorf("heatmap not found: %s", heatmapID)
+	}
+	delete(s.heatmaps, heatmapID)
+	return nil
+}
+
+// storeLatestData keeps a generated result as the latest data of a stored heatmap. Results of a
+// configuration replaced during the generation are discarded.
+func (s *HeatmapService) storeLatestData(generated *Heatmap, result *HeatmapResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	heatmap, exists := s.heatmaps[generated.ID]
+	if !exists || heatmap.Version != generated.Version {
+		return
+	}
+	stats := result.Stats
+	computedAt := result.ComputedAt
+	heatmap.Data = result.Data
+	heatmap.Stats = &stats
+	heatmap.GeneratedAt = &computedAt
+	heatmap.DataSource = HeatmapDataGenerated
+}
+
+// ImportData replaces the latest data of a heatmap of the project with an externally generated
+// grid of the heatmap's dimensions, e.g. recomputed in a notebook from exported data
+func (s *HeatmapService) ImportData(ctx context.Context, heatmapID string, data [][]int) (*Heatmap, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	heatmap, exists := s.heatmaps[heatmapID]
+	if !exists || heatmap.ProjectID != ProjectFromContext(ctx) {
+		return nil, fmt.Errorf("heatmap not found: %s", heatmapID)
+	}
+	if len(data) != heatmap.Height || len(data[0]) != heatmap.Width {
+		return nil, fmt.Errorf("grid does not match the heatmap's dimensions of %dx%d", heatmap.Width, heatmap.Height)
+	}
+
+	stats := s.calculateHeatmapStats(data, nil)
+	importedAt := s.analyticsService.Clock().Now()
+	heatmap.Data = data
+	heatmap.Stats = &stats
+	heatmap.GeneratedAt = &importedAt
+	heatmap.DataSource = HeatmapDataImported
+	return heatmap.copy(), nil
+}
+
+// AppendPoints adds points to the latest data of a heatmap of the project, each adding its
+// intensity, 1 when unset, to the cell of its coordinates. The points are added atomically, all or
+// none: concurrent appends all count, and readers see the grid before or after every point.
+func (s *HeatmapService) AppendPoints(ctx context.Context, heatmapID string, points []HeatmapPoint) (*Heatmap, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	heatmap, exists := s.heatmaps[heatmapID]
+	if !exists || heatmap.ProjectID != ProjectFromContext(ctx) {
+		return nil, fmt.Errorf("heatmap not found: %s", heatmapID)
+	}
+	if err := validateHeatmapPoints(points, heatmap.Width, heatmap.Height); err != nil {
+		return nil, err
+	}
+
+	// Readers share the current grid, so points are added to a copy replacing it
+	data := newHeatmapGrid(heatmap.Width, heatmap.Height)
+	if len(heatmap.Data) == heatmap.Height {
+		for y := range data {
+			copy(data[y], heatmap.Data[y])
+		}
+	}
+	for _, point := range points {
+		data[point.Y][point.X] = min(data[point.Y][point.X]+max(point.Intensity, 1), maxHeatmapIntensity)
+	}
+
+	// Pushed points add up across appends, other data is replaced
+	totalPoints := len(points)
+	if heatmap.DataSource == HeatmapDataPushed && heatmap.Stats != nil {
+		totalPoints += heatmap.Stats.TotalPoints
+	}
+	stats := s.calculateHeatmapStats(data, nil)
+	stats.TotalPoints = totalPoints
+	pushedAt := s.analyticsService.Clock().Now()
+	heatmap.Data = data
+	heatmap.Stats = &stats
+	heatmap.GeneratedAt = &pushedAt
+	heatmap.DataSource = HeatmapDataPushed
+	return heatmap.copy(), nil
+}
+
+// validateHeatmapPoints checks that points lie within a grid of the given dimensions and have a
+// valid intensity
+func validateHeatmapPoints(points []HeatmapPoint, width, height int) error {
+	for i, point := range points {
+		if point.X < 0 || point.X >= width || point.Y < 0 || point.Y >= height {
+			return fmt.Errorf("point %d at (%d, %d) is outside the heatmap's dimensions of %dx%d", i, point.X, point.Y, width, height)
+		}
+		if point.Intensity < 0 || point.Intensity > maxHeatmapIntensity {
+			return fmt.Errorf("point %d has an invalid intensity %d: intensities must be integers from 0 to %d", i, point.Intensity, maxHeatmapIntensity)
+		}
+	}
+	return nil
+}
+
+// copy returns a copy of the heatmap. The data grid is shared, it is replaced rather than modified.
+func (h *Heatmap) copy() *Heatmap {
+	copied := *h
+	if h.Schedule != nil {
+		copied.Schedule = h.Schedule.copy()
+	}
+	return &copied
 }
 
-// generateHeatmapID generates a unique heatmap ID
-func generateHeatmapID() string {
-	return fmt.Sprintf("heatmap_%d", time.Now().UnixNano())
+// newHeatmapID generates a unique heatmap ID with the service's ID generator
+func (s *HeatmapService) newHeatmapID() string {
+	return "heatmap_" + s.analyticsService.ids.NewID()
 }
@@ -0,0 +1,261 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// HourlyStats summarizes the events per hour within a trend point
+type HourlyStats struct {
+	Min int64   `json:"min"`
+	Max int64   `json:"max"`
+	Avg float64 `json:"avg"`
+	// Set when several downsampled series were combined: their minimums and maximums were added up,
+	// so min and max bound the true values
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+// SeriesStats describes the size of the hourly series
+type SeriesStats struct {
+	HourlyDays        int        `json:"hourly_days"`      // Days of series still counted per hour
+	DownsampledDays   int        `json:"downsampled_days"` // Days of series only summarized
+	DownsampleAfter   int        `json:"downsample_after_days"`
+	DownsampledBefore *time.Time `json:"downsampled_before,omitempty"` // Days before are summarized, nil before the first downsampling
+}
+
+// seriesKey identifies the series of an event type in a region
+type seriesKey struct {
+	region    string
+	eventType string // Canonical when counted; aliases added later are applied when querying
+}
+
+// seriesDay is a day of a series: its events per hour until downsampled, then only their total,
+// minimum and maximum
+type seriesDay struct {
+	hours  *[24]int64 // nil once downsampled
+	events int64
+	min    int64
+	max    int64
+}
+
+// summary returns the total, minimum and maximum events per hour of the day
+func (d *seriesDay) summary() (int64, int64, int64) {
+	if d.hours == nil {
+		return d.events, d.min, d.max
+	}
+	minimum, maximum := d.hours[0], d.hours[0]
+	for _, count := range d.hours {
+		minimum = min(minimum, count)
+		maximum = max(maximum, count)
+	}
+	return d.events, minimum, maximum
+}
+
+// HourlySeries counts the events of every project, event type and region per hour. Days older than
+// the downsampling horizon are compacted into their total, minimum and maximum events per hour,
+// bounding storage while keeping the shape of each day for multi-year daily trends.
+type HourlySeries struct {
+	days              map[string]map[string]map[seriesKey]*seriesDay // Project -> date (YYYY-MM-DD in UTC) -> series
+	aliases           *AliasService                                  // Event type aliases applied when querying
+	downsampleAfter   int                                            // Days kept per hour
+	downsampledBefore time.Time
+	mutex             sync.RWMutex
+}
+
+// NewHourlySeries creates empty series resolving event types with the given aliases. Days are kept
+// per hour for TREND_DOWNSAMPLE_AFTER_DAYS days (default 30).
+func NewHourlySeries(aliases *AliasService) *HourlySeries {
+	return &HourlySeries{
+		days:            make(map[string]map[string]map[seriesKey]*seriesDay),
+		aliases:         aliases,
+		downsampleAfter: max(getEnvInt("TREND_DOWNSAMPLE_AFTER_DAYS", 30), 1),
+	}
+}
+
+// Add counts an event in the hour of its timestamp. Events of a downsampled day only add to its
+// total.
+func (s *HourlySeries) Add(event *AnalyticsEvent) {
+	projectID := projectOrDefault(event.ProjectID)
+	timestamp := event.Timestamp.UTC()
+	date := timestamp.Format("2006-01-02")
+	key := seriesKey{region: event.Region, eventType: event.EventType}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.days[projectID] == nil {
+		s.days[projectID] = make(map[string]map[seriesKey]*seriesDay)
+	}
+	if s.days[projectID][date] == nil {
+		s.days[projectID][date] = make(map[seriesKey]*seriesDay)
+	}
+	day, exists := s.days[projectID][date][key]
+	if !exists {
+		day = &seriesDay{}
+		if !timestamp.Before(s.downsampledBefore) {
+			day.hours = &[24]int64{}
+		}
+		s.days[projectID][date][key] = day
+	}
+	day.events++
+	if day.hours != nil {
+		day.hours[timestamp.Hour()]++
+	}
+}
+
+// Remove uncounts a deleted event. Events of a downsampled day are only removed from its total.
+func (s *HourlySeries) Remove(event *AnalyticsEvent) {
+	timestamp := event.Timestamp.UTC()
+	key := seriesKey{region: event.Region, eventType: event.EventType}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	day, exists := s.days[projectOrDefault(event.ProjectID)][timestamp.Format("2006-01-02")][key]
+	if !exists || day.events == 0 {
+		return
+	}
+	day.events--
+	if day.hours != nil && day.hours[timestamp.Hour()] > 0 {
+		day.hours[timestamp.Hour()]--
+	}
+}
+
+// Downsample compacts the days before the horizon, TREND_DOWNSAMPLE_AFTER_DAYS days before the day
+// of now, and returns the number of series days compacted
+func (s *HourlySeries) Downsample(now time.Time) int {
+	horizon := now.UTC().Truncate(rollupDay).AddDate(0, 0, -s.downsampleAfter)
+	before := horizon.Format("2006-01-02")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	compacted := 0
+	for _, dates := range s.days {
+		for date, series := range dates {
+			if date >= before {
+				continue
+			}
+			for _, day := range series {
+				if day.hours != nil {
+					day.events, day.min, day.max = day.summary()
+					day.hours = nil
+					compacted++
+				}
+			}
+		}
+	}
+	if horizon.After(s.downsampledBefore) {
+		s.downsampledBefore = horizon
+	}
+	return compacted
+}
+
+// DownsampledBefore returns the time before which days are only summarized, zero before the first
+// downsampling
+func (s *HourlySeries) DownsampledBefore() time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.downsampledBefore
+}
+
+// AddStats sets the minimum, maximum and average events per hour of the points of a trend of the
+// regions (every region when nil) over whole days, bucketed like DailyRollups.Trend. Days without
+// any series of the project, e.g. counted before the series were, are left out; points without
+// such days get no stats.
+func (s *HourlySeries) AddStats(points []TrendPoint, projectID string, regions []string, eventType string, start, end time.Time, interval time.Duration) {
+	canonical := s.aliases.Get(projectID).Events
+	var inRegions map[string]bool
+	if regions != nil {
+		inRegions = make(map[string]bool, len(regions))
+		for _, region := range regions {
+			inRegions[region] = true
+		}
+	}
+	bucketStart := start.Truncate(interval)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	events := make([]int64, len(points))
+	days := make([]int, len(points))
+	for day := start.UTC().Truncate(rollupDay); day.Before(end); day = day.Add(rollupDay) {
+		series, exists := s.days[projectID][day.Format("2006-01-02")]
+		index := int(day.Sub(bucketStart) / interval)
+		if !exists || index < 0 || index >= len(points) {
+			continue
+		}
+
+		// Hours counted separately add up exactly, downsampled days only add up their summaries
+		combined := &seriesDay{hours: &[24]int64{}}
+		var total, minimum, maximum int64
+		matched, downsampled := 0, false
+		for key, counts := range series {
+			if inRegions != nil && !inRegions[key.region] {
+				continue
+			}
+			if eventType != "" {
+				keyType := key.eventType
+				if renamed, exists := canonical[keyType]; exists {
+					keyType = renamed
+				}
+				if keyType != eventType {
+					continue
+				}
+			}
+			matched++
+			if counts.hours == nil {
+				downsampled = true
+				total += counts.events
+				minimum += counts.min
+				maximum += counts.max
+				continue
+			}
+			combined.events += counts.events
+			for hour, count := range counts.hours {
+				combined.hours[hour] += count
+			}
+		}
+		dayEvents, dayMin, dayMax := combined.summary()
+
+		stats := points[index].Hourly
+		if stats == nil {
+			stats = &HourlyStats{Min: dayMin + minimum, Max: dayMax + maximum}
+			points[index].Hourly = stats
+		}
+		stats.Min = min(stats.Min, dayMin+minimum)
+		stats.Max = max(stats.Max, dayMax+maximum)
+		stats.Approximate = stats.Approximate || (downsampled && matched > 1)
+		events[index] += dayEvents + total
+		days[index]++
+	}
+	for i := range points {
+		if points[i].Hourly != nil {
+			points[i].Hourly.Avg = float64(events[i]) / float64(days[i]*24)
+		}
+	}
+}
+
+// Stats returns the number of days of series kept per hour and downsampled
+func (s *HourlySeries) Stats() SeriesStats {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	stats := SeriesStats{DownsampleAfter: s.downsampleAfter}
+	for _, dates := range s.days {
+		for _, series := range dates {
+			for _, day := range series {
+				if day.hours != nil {
+					stats.HourlyDays++
+				} else {
+					stats.DownsampledDays++
+				}
+			}
+		}
+	}
+	if !s.downsampledBefore.IsZero() {
+		before := s.downsampledBefore
+		stats.DownsampledBefore = &before
+	}
+	return stats
+}
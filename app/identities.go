@@ -0,0 +1,172 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IdentityMerge records that the events of a user ID, e.g. an anonymous device ID, belong to
+// another user, e.g. the account the device logged in to
+type IdentityMerge struct {
+	ProjectID  string    `json:"project_id"`
+	FromUserID string    `json:"from_user_id"`
+	IntoUserID string    `json:"into_user_id"` // Canonical user the merged IDs now count as
+	Merged     bool      `json:"merged"`       // False when the IDs were already merged
+	MergedAt   time.Time `json:"merged_at"`
+}
+
+// UserIdentity is a canonical user with the user IDs merged into it
+type UserIdentity struct {
+	UserID       string   `json:"user_id"`                  // Canonical user ID
+	MergedIDs    []string `json:"merged_ids"`               // Ordered
+	MergedFromID string   `json:"merged_from_id,omitempty"` // ID looked up, when merged into UserID
+}
+
+// projectIdentities are the merged user IDs of a project. Every merged ID maps straight to its
+// canonical user, so resolving an ID is a single lookup however many merges led to it.
+type projectIdentities struct {
+	canonical map[string]string   // Merged user ID -> canonical user ID
+	members   map[string][]string // Canonical user ID -> user IDs merged into it
+}
+
+// IdentityMerges keeps the user IDs merged by identity resolution per project, and applies them at
+// query time: events keep the user ID they were sent with, and count under their canonical user,
+// so unique users, funnels and trends do not count a person twice once their anonymous and
+// identified IDs are merged, including for the events stored before the merge.
+type IdentityMerges struct {
+	projects  map[string]*projectIdentities
+	maxMerged int // Merged user IDs per project
+	mutex     sync.RWMutex
+}
+
+// NewIdentityMerges creates identity merges keeping at most IDENTITY_MAX_MERGED_IDS (default
+// 1000000) merged user IDs per project
+func NewIdentityMerges() *IdentityMerges {
+	return &IdentityMerges{
+		projects:  make(map[string]*projectIdentities),
+		maxMerged: getEnvInt("IDENTITY_MAX_MERGED_IDS", 1000000),
+	}
+}
+
+// Merge merges a user ID into another one of the project, e.g. an anonymous ID into the user who
+// logged in. The IDs already merged into fromUserID follow it; merging IDs already merged is a
+// no-op reported with Merged false.
+func (m *IdentityMerges) Merge(projectID, fromUserID, intoUserID string, mergedAt time.Time) (*IdentityMerge, error) {
+	if fromUserID == "" || intoUserID == "" {
+		return nil, fmt.Errorf("both user IDs are required")
+	}
+	if fromUserID == AnonymousUserID || intoUserID == AnonymousUserID {
+		return nil, fmt.Errorf("the shared %s user ID cannot be merged", AnonymousUserID)
+	}
+	if fromUserID == intoUserID {
+		return nil, fmt.Errorf("a user ID cannot be merged into itself")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	identities, exists := m.projects[projectID]
+	if !exists {
+		identities = &projectIdentities{canonical: make(map[string]string), members: make(map[string][]string)}
+		m.projects[projectID] = identities
+	}
+
+	from, into := identities.resolve(fromUserID), identities.resolve(intoUserID)
+	merge := &IdentityMerge{ProjectID: projectID, FromUserID: fromUserID, IntoUserID: into, MergedAt: mergedAt}
+	if from == into {
+		return merge, nil
+	}
+	if len(identities.canonical)+1 > m.maxMerged {
+		return nil, fmt.Errorf("project %s has reached its maximum of %d merged user IDs", projectID, m.maxMerged)
+	}
+
+	moved := append(identities.members[from], from)
+	for _, userID := range moved {
+		identities.canonical[userID] = into
+	}
+	identities.members[into] = append(identities.members[into], moved...)
+	delete(identities.members, from)
+
+	merge.Merged = true
+	log.Printf("Merged user %s into %s in project %s", fromUserID, into, projectID)
+	return merge, nil
+}
+
+// Identity returns the canonical user of a user ID of the project, with every ID merged into it
+func (m *IdentityMerges) Identity(projectID, userID string) *UserIdentity {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	identity := &UserIdentity{UserID: userID, MergedIDs: []string{}}
+	identities, exists := m.projects[projectID]
+	if !exists {
+		return identity
+	}
+	identity.UserID = identities.resolve(userID)
+	if identity.UserID != userID {
+		identity.MergedFromID = userID
+	}
+	identity.MergedIDs = append(identity.MergedIDs, identities.members[identity.UserID]...)
+	sort.Strings(identity.MergedIDs)
+	return identity
+}
+
+// Resolve returns the canonical user of a user ID of the project, the ID itself when not merged
+func (m *IdentityMerges) Resolve(projectID, userID string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	identities, exists := m.projects[projectID]
+	if !exists {
+		return userID
+	}
+	return identities.resolve(userID)
+}
+
+// Resolver returns a function presenting stored events under their canonical user. Events of a
+// merged user ID are copied, keeping the ID they were sent with as OriginalUserID.
+func (m *IdentityMerges) Resolver() func(event *AnalyticsEvent) *AnalyticsEvent {
+	return func(event *AnalyticsEvent) *AnalyticsEvent {
+		canonical := m.Resolve(projectOrDefault(event.ProjectID), event.UserID)
+		if canonical == event.UserID {
+			return event
+		}
+		resolved := *event
+		resolved.UserID = canonical
+		resolved.OriginalUserID = event.UserID
+		return &resolved
+	}
+}
+
+// userResolver returns a function resolving the user IDs of a project to their canonical user
+func (m *IdentityMerges) userResolver(projectID string) func(userID string) string {
+	return func(userID string) string {
+		return m.Resolve(projectID, userID)
+	}
+}
+
+// resolve returns the canonical user of a user ID. Callers must hold the lock.
+func (p *projectIdentities) resolve(userID string) string {
+	if canonical, merged := p.canonical[userID]; merged {
+		return canonical
+	}
+	return userID
+}
+
+// MergeUsers merges a user ID of a project into another one, e.g. an anonymous ID into the user who
+// logged in, so their events count as one user in every report, including the ones computed before
+func (s *AnalyticsService) MergeUsers(projectID, fromUserID, intoUserID string) (*IdentityMerge, error) {
+	merge, err := s.identities.Merge(projectID, fromUserID, intoUserID, s.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	if merge.Merged {
+		// Cached results counted the merged IDs as distinct users
+		s.rollups.touch()
+		s.queryCache.ExpireProject(projectID)
+	}
+	return merge, nil
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// identifyUser merges the anonymous ID a client tracked events under into the user it identified,
+// so the events of both count as one user in the project's reports
+func (s *App) identifyUser(c *fiber.Ctx) error {
+	var request struct {
+		AnonymousID string `json:"anonymous_id"`
+		UserID      string `json:"user_id"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	merge, err := s.analyticsService.MergeUsers(projectIDFromRequest(c), request.AnonymousID, request.UserID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"merge":  merge,
+	})
+}
+
+// getUserIdentity returns the canonical user of a user ID in the project and the IDs merged into it
+func (s *App) getUserIdentity(c *fiber.Ctx) error {
+	identity := s.analyticsService.Identities().Identity(projectIDFromRequest(c), utils.CopyString(c.Params("id")))
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"identity": identity,
+	})
+}
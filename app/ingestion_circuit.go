@@ -0,0 +1,456 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// errIngestionUnavailable is returned for events that could neither be stored nor logged
+var errIngestionUnavailable = errors.New("ingestion unavailable")
+
+// errUserQueueFull is returned for events shed because the ordered processing queue of their user
+// is full
+var errUserQueueFull = fmt.Errorf("%w: the user's event queue is full", errIngestionUnavailable)
+
+// States of the ingestion circuit
+const (
+	IngestionCircuitClosed = "closed" // Events are stored
+	IngestionCircuitOpen   = "open"   // The event store is down: events are only logged
+)
+
+// IngestionCircuitStatus reports the state of the ingestion circuit and its write-ahead log
+type IngestionCircuitStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"consecutive_failures"` // Failed writes since the last successful one
+	LastError string     `json:"last_error,omitempty"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	// Events accepted into the write-ahead log and not stored yet, and their size
+	Backlog      int64 `json:"backlog"`
+	BacklogBytes int64 `json:"backlog_bytes"`
+	Logged       int64 `json:"logged"`   // Events accepted into the log
+	Drained      int64 `json:"drained"`  // Logged events stored once the store recovered
+	Rejected     int64 `json:"rejected"` // Events rejected with the log full or failing
+}
+
+// Degraded reports whether events are being, or still have to be, stored from the log
+func (s IngestionCircuitStatus) Degraded() bool {
+	return s.State == IngestionCircuitOpen || s.Backlog > 0
+}
+
+// walRecord is an event accepted into the write-ahead log
+type walRecord struct {
+	Event         *AnalyticsEvent `json:"event"`
+	DetailDropped bool            `json:"detail_dropped,omitempty"` // Stored without its properties
+}
+
+// IngestionCircuit keeps ingestion accepting events while the event store is down. After
+// INGESTION_CIRCUIT_FAILURES consecutive failed writes (default 3) the circuit opens: events are
+// only appended to a write-ahead log, synced to disk, instead of failing. Every
+// INGESTION_CIRCUIT_PROBE_INTERVAL (default 5s) the store is probed; once it answers, the circuit
+// closes and the logged events are stored in the order they were accepted.
+//
+// The log is kept at INGESTION_WAL_PATH, so events logged before a restart are stored after it.
+// Without one, a temporary file is used, lost with the process. The log holds at most
+// INGESTION_WAL_MAX_BYTES (default 1GiB); events beyond it are rejected.
+type IngestionCircuit struct {
+	threshold     int
+	probeInterval time.Duration
+	path          string
+	maxBytes      int64
+
+	state     string
+	failures  int
+	lastError string
+	openedAt  *time.Time
+	stats     IngestionCircuitStatus
+	clock     Clock
+	mutex     sync.Mutex // Guards the state and stats
+
+	wal      *os.File
+	walMutex sync.Mutex // Serializes appends and drains of the log
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     sync.WaitGroup
+}
+
+// NewIngestionCircuit creates a closed circuit configured from INGESTION_CIRCUIT_FAILURES,
+// INGESTION_CIRCUIT_PROBE_INTERVAL, INGESTION_WAL_PATH and INGESTION_WAL_MAX_BYTES. Events left in
+// the log at INGESTION_WAL_PATH count as its backlog.
+func NewIngestionCircuit() *IngestionCircuit {
+	circuit := &IngestionCircuit{
+		threshold:     max(getEnvInt("INGESTION_CIRCUIT_FAILURES", 3), 1),
+		probeInterval: getEnvDuration("INGESTION_CIRCUIT_PROBE_INTERVAL", 5*time.Second),
+		path:          os.Getenv("INGESTION_WAL_PATH"),
+		maxBytes:      int64(getEnvInt("INGESTION_WAL_MAX_BYTES", 1<<30)),
+		state:         IngestionCircuitClosed,
+		clock:         SystemClock(),
+		stop:          make(chan struct{}),
+	}
+	if circuit.path != "" {
+		if err := circuit.openLog(); err != nil {
+			log.Printf("Error: Failed to open the ingestion log %s: %v", circuit.path, err)
+		}
+	}
+	return circuit
+}
+
+// SetClock sets the clock the circuit opens by
+func (c *IngestionCircuit) SetClock(clock Clock) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clock = clock
+}
+
+// openLog opens the log, counting the events left in it. Callers must hold the log lock, or own
+// the circuit.
+func (c *IngestionCircuit) openLog() error {
+	var file *os.File
+	var err error
+	if c.path != "" {
+		file, err = os.OpenFile(c.path, os.O_CREATE|os.O_RDWR, 0o600)
+	} else {
+		file, err = os.CreateTemp("", "analytics-ingestion-*.wal")
+		if err == nil {
+			log.Printf("Warning: Logging events to %s, which does not outlive the process; set INGESTION_WAL_PATH to keep them across restarts", file.Name())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	backlog, size, err := countRecords(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	c.wal = file
+
+	c.mutex.Lock()
+	c.stats.Backlog, c.stats.BacklogBytes = backlog, size
+	c.mutex.Unlock()
+	if backlog > 0 {
+		log.Printf("Found %d events in the ingestion log %s, stored once the event store is available", backlog, c.path)
+	}
+	return nil
+}
+
+// countRecords counts the records of a log from its start, returning their size. A record cut
+// short by a crash is not counted, and is overwritten by the next one.
+func countRecords(file *os.File) (int64, int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	var records, size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return records, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		records++
+		size += int64(len(line))
+	}
+}
+
+// Allow reports whether events should be written to the store, false while the circuit is open
+func (c *IngestionCircuit) Allow() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state == IngestionCircuitClosed
+}
+
+// Failure records a failed write to the store, opening the circuit after enough consecutive ones.
+// Does nothing without a circuit.
+func (c *IngestionCircuit) Failure(err error) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.failures++
+	c.lastError = err.Error()
+	if c.state == IngestionCircuitClosed && c.failures >= c.threshold {
+		openedAt := c.clock.Now()
+		c.state = IngestionCircuitOpen
+		c.openedAt = &openedAt
+		log.Printf("Warning: Event store failed %d writes in a row, accepting events into the ingestion log until it recovers: %v", c.failures, err)
+	}
+}
+
+// Success records a successful write to, or probe of, the store, closing the circuit. Does
+// nothing without a circuit.
+func (c *IngestionCircuit) Success() {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == IngestionCircuitOpen {
+		log.Printf("Event store recovered after %s, storing the logged events", c.clock.Now().Sub(*c.openedAt).Round(time.Second))
+	}
+	c.state = IngestionCircuitClosed
+	c.failures = 0
+	c.lastError = ""
+	c.openedAt = nil
+}
+
+// Append accepts an event into the log, synced to disk before it returns. stored is the event as
+// it is stored, e.g. without its properties outside the storage sample.
+func (c *IngestionCircuit) Append(event, stored *AnalyticsEvent) error {
+	line, err := json.Marshal(walRecord{Event: event, DetailDropped: stored.DetailDropped})
+	if err != nil {
+		return fmt.Errorf("failed to encode event %s: %w", event.ID, err)
+	}
+	line = append(line, '\n')
+
+	c.walMutex.Lock()
+	defer c.walMutex.Unlock()
+
+	if err := c.append(line); err != nil {
+		c.mutex.Lock()
+		c.stats.Rejected++
+		c.mutex.Unlock()
+		return fmt.Errorf("%w: %w", errIngestionUnavailable, err)
+	}
+	c.mutex.Lock()
+	c.stats.Backlog++
+	c.stats.BacklogBytes += int64(len(line))
+	c.stats.Logged++
+	c.mutex.Unlock()
+	return nil
+}
+
+// append writes a record to the log and syncs it. Callers must hold the log lock.
+func (c *IngestionCircuit) append(line []byte) error {
+	if c.wal == nil {
+		if err := c.openLog(); err != nil {
+			return fmt.Errorf("failed to open the ingestion log: %w", err)
+		}
+	}
+	c.mutex.Lock()
+	size := c.stats.BacklogBytes
+	c.mutex.Unlock()
+	if size+int64(len(line)) > c.maxBytes {
+		return fmt.Errorf("the ingestion log is full with %d bytes of events waiting for the event store", size)
+	}
+
+	// A failed write may have left part of the record, which the next one overwrites
+	if _, err := c.wal.WriteAt(line, size); err != nil {
+		return fmt.Errorf("failed to write to the ingestion log: %w", err)
+	}
+	if err := c.wal.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the ingestion log: %w", err)
+	}
+	return nil
+}
+
+// drain passes the logged events to store in the order they were accepted, then empties the log.
+// It returns the number of events drained.
+func (c *IngestionCircuit) drain(store func(record walRecord)) (int, error) {
+	c.walMutex.Lock()
+	defer c.walMutex.Unlock()
+
+	c.mutex.Lock()
+	size := c.stats.BacklogBytes
+	c.mutex.Unlock()
+	if c.wal == nil || size == 0 {
+		return 0, nil
+	}
+
+	records := make([]walRecord, 0)
+	reader := bufio.NewReader(io.NewSectionReader(c.wal, 0, size))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the ingestion log: %w", err)
+		}
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil || record.Event == nil {
+			log.Printf("Warning: Skipping an unreadable record of the ingestion log: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+
+	for _, record := range records {
+		store(record)
+	}
+	if err := c.wal.Truncate(0); err != nil {
+		return len(records), fmt.Errorf("failed to empty the ingestion log: %w", err)
+	}
+	if err := c.wal.Sync(); err != nil {
+		return len(records), fmt.Errorf("failed to sync the ingestion log: %w", err)
+	}
+
+	c.mutex.Lock()
+	c.stats.Backlog, c.stats.BacklogBytes = 0, 0
+	c.stats.Drained += int64(len(records))
+	c.mutex.Unlock()
+	return len(records), nil
+}
+
+// Status returns the state of the circuit and its log
+func (c *IngestionCircuit) Status() IngestionCircuitStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	status := c.stats
+	status.State = c.state
+	status.Failures = c.failures
+	status.LastError = c.lastError
+	if c.openedAt != nil {
+		openedAt := *c.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// Start probes the store and drains the log every probe interval, until stopped
+func (c *IngestionCircuit) Start(recover func(ctx context.Context) (int, error)) {
+	if c.probeInterval <= 0 {
+		log.Printf("Ingestion log draining disabled")
+		return
+	}
+
+	c.done.Add(1)
+	go func() {
+		defer c.done.Done()
+		ticker := time.NewTicker(c.probeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), c.probeInterval)
+			if drained, err := recover(ctx); err != nil {
+				debugf("Ingestion log not drained: %v", err)
+			} else if drained > 0 {
+				log.Printf("Stored %d events from the ingestion log", drained)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Stop stops the background probes and closes the log. A temporary log is removed with the events
+// left in it; a log at INGESTION_WAL_PATH keeps them for the next start.
+func (c *IngestionCircuit) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+		c.done.Wait()
+
+		c.walMutex.Lock()
+		defer c.walMutex.Unlock()
+		if c.wal == nil {
+			return
+		}
+		if backlog := c.Status().Backlog; backlog > 0 {
+			log.Printf("Warning: %d events are left in the ingestion log %s", backlog, c.wal.Name())
+		}
+		c.wal.Close()
+		if c.path == "" {
+			os.Remove(c.wal.Name())
+		}
+		c.wal = nil
+	})
+}
+
+// WriteMetrics writes the state of the circuit and its log in the Prometheus text exposition format
+func (c *IngestionCircuit) WriteMetrics(out io.Writer) error {
+	status := c.Status()
+	open := 0
+	if status.State == IngestionCircuitOpen {
+		open = 1
+	}
+	_, err := fmt.Fprintf(out, "# HELP analytics_ingestion_circuit_open Whether events are only accepted into the ingestion log while the event store is down.\n# TYPE analytics_ingestion_circuit_open gauge\nanalytics_ingestion_circuit_open %d\n"+
+		"# HELP analytics_ingestion_log_backlog Events in the ingestion log not stored yet.\n# TYPE analytics_ingestion_log_backlog gauge\nanalytics_ingestion_log_backlog %d\n"+
+		"# HELP analytics_ingestion_log_events_total Events accepted into the ingestion log.\n# TYPE analytics_ingestion_log_events_total counter\nanalytics_ingestion_log_events_total %d\n"+
+		"# HELP analytics_ingestion_log_drained_total Logged events stored once the event store recovered.\n# TYPE analytics_ingestion_log_drained_total counter\nanalytics_ingestion_log_drained_total %d\n"+
+		"# HELP analytics_ingestion_log_rejected_total Events rejected with the ingestion log full or failing.\n# TYPE analytics_ingestion_log_rejected_total counter\nanalytics_ingestion_log_rejected_total %d\n",
+		open, status.Backlog, status.Logged, status.Drained, status.Rejected)
+	return err
+}
+
+// IngestionCircuit returns the circuit keeping ingestion up while the event store is down
+func (s *AnalyticsService) IngestionCircuit() *IngestionCircuit {
+	return s.circuit
+}
+
+// logEvent accepts an event into the ingestion log while the event store is down, to be stored
+// once it recovers
+func (s *AnalyticsService) logEvent(event, stored *AnalyticsEvent) (*AnalyticsEvent, error) {
+	if err := s.circuit.Append(event, stored); err != nil {
+		return nil, fmt.Errorf("failed to store event: %w", err)
+	}
+	event.Queued = true
+	debugf("Logged event %s while the event store is down", event.ID)
+	return event, nil
+}
+
+// probeStore checks that events can be written to the event store again
+func (s *AnalyticsService) probeStore(ctx context.Context) error {
+	if err := s.faults.Inject(FaultStore, "write"); err != nil {
+		return err
+	}
+	if s.storeWriter != nil {
+		if _, err := s.storeWriter.store.Query(ctx, EventStoreFilter{Limit: 1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecoverIngestion probes the event store while the circuit is open, closing it once the store
+// answers, then stores the events of the ingestion log. It returns the number of events stored.
+func (s *AnalyticsService) RecoverIngestion(ctx context.Context) (int, error) {
+	if !s.circuit.Allow() {
+		if err := s.probeStore(ctx); err != nil {
+			s.circuit.Failure(err)
+			return 0, fmt.Errorf("event store still unavailable: %w", err)
+		}
+		s.circuit.Success()
+	}
+
+	return s.circuit.drain(func(record walRecord) {
+		// Events may have been stored before a crash left them in the log
+		s.mutex.RLock()
+		_, exists := s.events[record.Event.Region][record.Event.ID]
+		s.mutex.RUnlock()
+		if exists {
+			return
+		}
+
+		stored := record.Event
+		if record.DetailDropped {
+			stripped := *record.Event
+			stripped.Properties = nil
+			stripped.DetailDropped = true
+			stored = &stripped
+		}
+		s.storeEvent(record.Event, stored)
+	})
+}
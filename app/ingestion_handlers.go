@@ -0,0 +1,68 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// prefersAsync reports whether the client asked for an asynchronous response with
+// "Prefer: respond-async"
+func prefersAsync(c *fiber.Ctx) bool {
+	for _, preference := range strings.Split(c.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptEventAsync queues an event for ingestion and answers 202 Accepted with a receipt. Events
+// shed because the queue is full are answered with 503 and a dropped receipt.
+func (s *App) acceptEventAsync(c *fiber.Ctx, eventData map[string]interface{}, apiKey, userID string) error {
+	// The event is tracked after the request, so it carries the requested region itself
+	if _, tagged := eventData["region"]; !tagged && regionFromRequest(c) != "" {
+		eventData["region"] = regionFromRequest(c)
+	}
+	receipt, err := s.ingestion.Submit(projectIDFromRequest(c), eventData, apiKey, userID)
+	var overloaded *OverloadedError
+	if errors.As(err, &overloaded) {
+		c.Set("Retry-After", "1")
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error":   err.Error(),
+			"receipt": overloaded.Receipt,
+		})
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	statusURL := "/api/v1/analytics/receipts/" + receipt.ID
+	c.Set("Location", statusURL)
+	c.Set("Preference-Applied", "respond-async")
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{
+		"status":      "accepted",
+		"receipt_id":  receipt.ID,
+		"accepted_at": receipt.AcceptedAt,
+		"status_url":  statusURL,
+	})
+}
+
+// getIngestionReceipt returns whether an asynchronously accepted event was stored, rejected or dropped
+func (s *App) getIngestionReceipt(c *fiber.Ctx) error {
+	receipt, err := s.ingestion.Receipt(projectIDFromRequest(c), c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"receipt": receipt,
+	})
+}
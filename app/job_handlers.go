@@ -0,0 +1,134 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+// acceptJob queues a computation as a job of a project, empty for administrative jobs, and
+// answers 202 Accepted with the job and the URLs reporting its progress. Jobs that cannot be
+// queued are answered with 503.
+func (s *App) acceptJob(c *fiber.Ctx, projectID, kind string, run func(ctx context.Context) (interface{}, error)) error {
+	job, err := s.jobs.Submit(projectID, kind, run)
+	var queueFull *JobQueueFullError
+	if errors.As(err, &queueFull) {
+		c.Set("Retry-After", "1")
+		return c.Status(http.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	statusURL := "/api/v1/jobs/" + job.ID
+	if projectID == "" {
+		statusURL = "/api/v1/admin/jobs/" + job.ID
+	}
+	c.Set("Location", statusURL)
+	c.Set("Preference-Applied", "respond-async")
+	return c.Status(http.StatusAccepted).JSON(fiber.Map{
+		"status":       "accepted",
+		"job":          job,
+		"status_url":   statusURL,
+		"progress_url": statusURL + "/progress",
+	})
+}
+
+// getJob returns the status, progress and, once done, the result of a job of the project
+func (s *App) getJob(c *fiber.Ctx) error {
+	job, err := s.jobs.Job(c.Params("id"))
+	if err != nil || job.ProjectID != projectIDFromRequest(c) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": "job not found: " + c.Params("id"),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"job":    job,
+	})
+}
+
+// getAdminJob returns the status, progress and, once done, the result of any job
+func (s *App) getAdminJob(c *fiber.Ctx) error {
+	job, err := s.jobs.Job(c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"job":    job,
+	})
+}
+
+// streamJobProgress returns a WebSocket handler pushing a "job.progress" message with the job
+// every JOB_PROGRESS_INTERVAL while it runs, and a final "job.completed" message once it succeeded
+// or failed. Clients see the jobs of the ?project_id, administrators every job.
+func (s *App) streamJobProgress(admin bool) func(*websocket.Conn) {
+	return func(c *websocket.Conn) {
+		jobID := c.Params("id")
+		job, err := s.jobs.Job(jobID)
+		if err == nil && !admin && job.ProjectID != c.Query("project_id", DefaultProjectID) {
+			err = fmt.Errorf("job not found: %s", jobID)
+		}
+		var done <-chan struct{}
+		if err == nil {
+			done, err = s.jobs.Done(jobID)
+		}
+		if err != nil {
+			c.WriteJSON(map[string]string{"type": "error", "error": err.Error()})
+			c.Close()
+			return
+		}
+
+		// Clients only listen, reading detects when they disconnect. The connection is released
+		// when the handler returns, so the reader is waited for after closing it.
+		disconnected := make(chan struct{})
+		go func() {
+			defer close(disconnected)
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		defer func() {
+			c.Close()
+			<-disconnected
+		}()
+
+		ticker := time.NewTicker(s.jobProgressInterval)
+		defer ticker.Stop()
+		for {
+			messageType := "job.progress"
+			if job.Done() {
+				messageType = "job.completed"
+			}
+			if err := c.WriteJSON(fiber.Map{"type": messageType, "job": job}); err != nil || job.Done() {
+				return
+			}
+
+			select {
+			case <-ticker.C:
+			case <-done:
+			case <-disconnected:
+				return
+			}
+			if job, err = s.jobs.Job(jobID); err != nil {
+				return
+			}
+		}
+	}
+}
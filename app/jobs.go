@@ -0,0 +1,268 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Statuses of a job
+const (
+	JobQueued    = "queued"    // Waiting for a worker
+	JobRunning   = "running"   // Computing; the job reports its progress
+	JobSucceeded = "succeeded" // Done; the job has its result
+	JobFailed    = "failed"    // Done; the job has the error
+)
+
+// Kinds of jobs
+const (
+	JobFunnel       = "funnel"             // Funnel computation
+	JobRetention    = "retention"          // Retention analysis of daily cohorts
+	JobRollups      = "rollups"            // Rebuild of the daily rollups
+	JobRetentionRun = "retention_run"      // Purge of the events past their retention
+	JobKafkaReplay  = "kafka_replay"       // Re-consumption of a Kafka topic over a time range
+	JobBootstrap    = "bootstrap"          // Seeding of user profiles from the history of other services
+	JobEventDelete  = "event_delete"       // Bulk deletion of the events matching filters
+	JobPricingSim   = "pricing_simulation" // Re-pricing of a period's usage under a proposed pricing
+)
+
+// jobProgressBatch is how many scanned events are counted before they are reported to the job
+const jobProgressBatch = 1024
+
+// JobProgress reports how far a job got through the events it scans
+type JobProgress struct {
+	EventsScanned int64      `json:"events_scanned"`
+	EventsTotal   int64      `json:"events_total"` // Events to scan, known once the job starts scanning
+	Percent       float64    `json:"percent"`
+	ETA           *time.Time `json:"eta,omitempty"`         // Estimated completion from the scan rate so far
+	ETASeconds    float64    `json:"eta_seconds,omitempty"` // Seconds until the estimated completion
+}
+
+// Job is a long-running computation accepted with "Prefer: respond-async"
+type Job struct {
+	ID          string      `json:"job_id"`
+	ProjectID   string      `json:"project_id,omitempty"` // Empty for administrative jobs
+	Kind        string      `json:"kind"`
+	Status      string      `json:"status"`
+	Progress    JobProgress `json:"progress"`
+	Result      interface{} `json:"result,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	StartedAt   *time.Time  `json:"started_at,omitempty"`
+	CompletedAt *time.Time  `json:"completed_at,omitempty"`
+}
+
+// Done reports whether the job succeeded or failed
+func (j *Job) Done() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+// runningJob is a job and the events it scanned so far
+type runningJob struct {
+	job     Job           // Guarded by Jobs.mutex
+	scanned int64         // Atomic
+	total   int64         // Atomic
+	done    chan struct{} // Closed when the job succeeded or failed
+}
+
+// expect adds events the job is about to scan to its total. Does nothing without a job.
+func (r *runningJob) expect(events int64) {
+	if r != nil {
+		atomic.AddInt64(&r.total, events)
+	}
+}
+
+// scan counts events the job scanned. Does nothing without a job.
+func (r *runningJob) scan(events int64) {
+	if r != nil {
+		atomic.AddInt64(&r.scanned, events)
+	}
+}
+
+// jobContextKey is the context key of the running job
+type jobContextKey struct{}
+
+// contextWithJob returns a context reporting the events scanned with it to a job
+func contextWithJob(ctx context.Context, job *runningJob) context.Context {
+	return context.WithValue(ctx, jobContextKey{}, job)
+}
+
+// jobFromContext returns the job running with the context, nil outside jobs
+func jobFromContext(ctx context.Context) *runningJob {
+	job, _ := ctx.Value(jobContextKey{}).(*runningJob)
+	return job
+}
+
+// JobQueueFullError is returned when a job cannot be queued
+type JobQueueFullError struct{}
+
+func (e *JobQueueFullError) Error() string {
+	return "job queue is full, retry later"
+}
+
+// Jobs runs long computations in the background, so clients can follow their progress instead of
+// waiting on a request. Jobs are run by a worker pool and kept for the job TTL after they change.
+type Jobs struct {
+	pool  *WorkerPool
+	jobs  *BoundedCache // Job ID -> *runningJob
+	clock Clock
+	mutex sync.RWMutex
+}
+
+// NewJobs creates a job runner configured from JOBS_WORKER_POOL_SIZE (default 2),
+// JOBS_QUEUE_CAPACITY (default 100), JOBS_MAX_ENTRIES (default 10000) and JOB_TTL (default 24h)
+func NewJobs() *Jobs {
+	return &Jobs{
+		pool:  NewWorkerPool("jobs", getEnvInt("JOBS_WORKER_POOL_SIZE", 2), getEnvInt("JOBS_QUEUE_CAPACITY", 100)),
+		jobs:  NewBoundedCache("jobs", getEnvInt("JOBS_MAX_ENTRIES", 10000), getEnvDuration("JOB_TTL", 24*time.Hour)),
+		clock: SystemClock(),
+	}
+}
+
+// SetClock sets the clock timing jobs and estimating their completion
+func (j *Jobs) SetClock(clock Clock) {
+	j.clock = clock
+	j.jobs.SetClock(clock)
+}
+
+// Cache returns the cache of jobs
+func (j *Jobs) Cache() *BoundedCache {
+	return j.jobs
+}
+
+// WorkerPool returns the pool running jobs
+func (j *Jobs) WorkerPool() *WorkerPool {
+	return j.pool
+}
+
+// Submit queues a job of a project, empty for administrative jobs, and returns it. The
+// computation gets a context reporting the events it scans to the job. A JobQueueFullError is
+// returned when the queue is full.
+func (j *Jobs) Submit(projectID, kind string, run func(ctx context.Context) (interface{}, error)) (*Job, error) {
+	running := &runningJob{
+		job: Job{
+			ID:        uuid.New().String(),
+			ProjectID: projectID,
+			Kind:      kind,
+			Status:    JobQueued,
+			CreatedAt: j.clock.Now(),
+		},
+		done: make(chan struct{}),
+	}
+	j.jobs.Set(running.job.ID, running)
+
+	queued := j.pool.TrySubmit(func() {
+		j.run(running, run)
+	})
+	if !queued {
+		j.jobs.Delete(running.job.ID)
+		return nil, &JobQueueFullError{}
+	}
+	return j.snapshot(running), nil
+}
+
+// run runs a queued job and records its outcome
+func (j *Jobs) run(running *runningJob, run func(ctx context.Context) (interface{}, error)) {
+	startedAt := j.clock.Now()
+	j.mutex.Lock()
+	running.job.Status = JobRunning
+	running.job.StartedAt = &startedAt
+	j.mutex.Unlock()
+
+	var result interface{}
+	err := fmt.Errorf("job panicked")
+	defer func() {
+		j.complete(running, result, err)
+	}()
+	result, err = run(contextWithJob(context.Background(), running))
+	if err != nil {
+		log.Printf("Warning: %s job %s failed: %v", running.job.Kind, running.job.ID, err)
+	}
+}
+
+// complete records the result or error of a job. The job is kept for the job TTL from now on.
+func (j *Jobs) complete(running *runningJob, result interface{}, err error) {
+	completedAt := j.clock.Now()
+
+	j.mutex.Lock()
+	if err != nil {
+		running.job.Status = JobFailed
+		running.job.Error = err.Error()
+	} else {
+		running.job.Status = JobSucceeded
+		running.job.Result = result
+	}
+	running.job.CompletedAt = &completedAt
+	// Restart the TTL, unless the job was evicted to make room
+	if _, exists := j.jobs.Peek(running.job.ID); exists {
+		j.jobs.Set(running.job.ID, running)
+	}
+	j.mutex.Unlock()
+	close(running.done)
+}
+
+// Job returns a job with its current progress
+func (j *Jobs) Job(jobID string) (*Job, error) {
+	value, exists := j.jobs.Get(jobID)
+	if !exists {
+		return nil, fmt.Errorf("job not found: %s", jobID)
+	}
+	return j.snapshot(value.(*runningJob)), nil
+}
+
+// Done returns a channel closed when a job succeeded or failed
+func (j *Jobs) Done(jobID string) (<-chan struct{}, error) {
+	value, exists := j.jobs.Peek(jobID)
+	if !exists {
+		return nil, fmt.Errorf("job not found: %s", jobID)
+	}
+	return value.(*runningJob).done, nil
+}
+
+// Stop lets the workers run the queued jobs and exit
+func (j *Jobs) Stop() {
+	j.pool.Stop()
+}
+
+// snapshot returns a copy of a job with its progress
+func (j *Jobs) snapshot(running *runningJob) *Job {
+	now := j.clock.Now()
+	j.mutex.RLock()
+	job := running.job
+	j.mutex.RUnlock()
+
+	var startedAt time.Time
+	if job.StartedAt != nil {
+		startedAt = *job.StartedAt
+	}
+	job.Progress = EstimateJobProgress(job.Status, atomic.LoadInt64(&running.scanned), atomic.LoadInt64(&running.total), startedAt, now)
+	return &job
+}
+
+// EstimateJobProgress returns the progress of a job in a status that scanned events of the total
+// since it started. The completion of running jobs is estimated from the rate events were scanned
+// at so far; they report at most 99.9 percent, as they still compute their result once every
+// event is scanned.
+func EstimateJobProgress(status string, scanned, total int64, startedAt, now time.Time) JobProgress {
+	progress := JobProgress{EventsScanned: scanned, EventsTotal: total}
+	switch {
+	case status == JobSucceeded:
+		progress.Percent = 100
+	case total > 0:
+		progress.Percent = math.Min(math.Floor(1000*float64(scanned)/float64(total))/10, 99.9)
+	}
+
+	if status == JobRunning && scanned > 0 && scanned < total {
+		remaining := time.Duration(float64(now.Sub(startedAt)) * float64(total-scanned) / float64(scanned))
+		eta := now.Add(remaining)
+		progress.ETA = &eta
+		progress.ETASeconds = math.Ceil(remaining.Seconds())
+	}
+	return progress
+}
@@ -3,19 +3,59 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/google/uuid"
 )
 
-// KafkaConsumerService handles consuming events from Kafka topics
+// defaultKafkaGroupID is the consumer group the service joins without KAFKA_GROUP_ID
+const defaultKafkaGroupID = "analytics"
+
+// kafkaRejoinDelay is how long the service waits before rejoining its consumer group after a
+// failed session
+const kafkaRejoinDelay = 5 * time.Second
+
+// KafkaGroupStatus describes the service's membership of its consumer group
+type KafkaGroupStatus struct {
+	GroupID    string             `json:"group_id"`
+	MemberID   string             `json:"member_id,omitempty"`
+	Generation int32              `json:"generation,omitempty"`
+	Rebalances int64              `json:"rebalances"` // Sessions joined since startup
+	Partitions map[string][]int32 `json:"partitions"` // Assigned to this instance in the current session, per topic
+	Strategy   string             `json:"strategy"`
+}
+
+// KafkaConsumerService handles consuming events from Kafka topics as a member of a consumer
+// group, which spreads the partitions of the topics over the instances of the service and keeps
+// their committed offsets
 type KafkaConsumerService struct {
-	consumer sarama.Consumer
-	topics   []string
+	client   sarama.Client
+	group    sarama.ConsumerGroup
+	groupID  string
+	strategy string
+	topics   []string // Configured and discovered topics being consumed
+	prefixes []string // Prefixes of the topics discovered from the cluster metadata, if any
+	refresh  time.Duration
 	handlers map[string]EventHandler
+	workers  *WorkerPool              // Executes event handlers
+	ordered  *UserDispatcher          // Executes event handlers in order per user instead, if set
+	paused   map[string]chan struct{} // Closed when the topic is resumed
+	faults   *FaultInjector           // Faults injected into handling events for testing, if any
+	events   *ServiceEventLog         // Keeps the events of other services for user timelines, if any
+	profiles *UserProfiles            // Profiles and lifecycle stages updated by auth and billing events, if any
+	plans    *PlanService             // Plans assigned by billing subscription events, if any
+	live     *MetricAggregator        // Counts consumed events in the live dashboard metrics, if any
+	metrics  *KafkaHandlerMetrics     // Times, counts and retries handlers, and disables them, if set
+	rejoin   context.CancelFunc       // Ends the current group session to rejoin with new topics
+	session  KafkaGroupStatus
 	mu       sync.RWMutex
 	running  bool
 	ctx      context.Context
@@ -25,23 +65,52 @@ type KafkaConsumerService struct {
 // EventHandler defines the interface for handling different types of events
 type EventHandler func(ctx context.Context, event *CrossServiceEvent) error
 
-// NewKafkaConsumerService creates a new Kafka consumer service
+// NewKafkaConsumerService creates a new Kafka consumer service joining the KAFKA_GROUP_ID
+// consumer group. Partitions are assigned with the KAFKA_REBALANCE_STRATEGY, and offsets are
+// committed every KAFKA_OFFSET_COMMIT_INTERVAL. Partitions without a committed offset start from
+// the KAFKA_OFFSET_RESET position.
 func NewKafkaConsumerService(brokers []string, topics []string) (*KafkaConsumerService, error) {
+	groupID := os.Getenv("KAFKA_GROUP_ID")
+	if groupID == "" {
+		groupID = defaultKafkaGroupID
+	}
+	strategy, err := ParseRebalanceStrategy(os.Getenv("KAFKA_REBALANCE_STRATEGY"))
+	if err != nil {
+		return nil, err
+	}
+	initial, err := ParseOffsetReset(os.Getenv("KAFKA_OFFSET_RESET"))
+	if err != nil {
+		return nil, err
+	}
+
 	config := sarama.NewConfig()
 	config.Consumer.Return.Errors = true
-	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	config.Consumer.Offsets.Initial = initial
+	config.Consumer.Offsets.AutoCommit.Enable = true
+	config.Consumer.Offsets.AutoCommit.Interval = getEnvDuration("KAFKA_OFFSET_COMMIT_INTERVAL", time.Second)
+	config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{strategy}
 
-	consumer, err := sarama.NewConsumer(brokers, config)
+	client, err := sarama.NewClient(brokers, config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Kafka consumer: %w", err)
 	}
+	group, err := sarama.NewConsumerGroupFromClient(groupID, client)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to create Kafka consumer group: %w", err)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	service := &KafkaConsumerService{
-		consumer: consumer,
-		topics:   topics,
+		client:   client,
+		group:    group,
+		groupID:  groupID,
+		strategy: strategy.Name(),
+		topics:   append([]string(nil), topics...),
 		handlers: make(map[string]EventHandler),
+		paused:   make(map[string]chan struct{}),
+		workers:  NewWorkerPool("kafka", getEnvInt("KAFKA_WORKER_POOL_SIZE", 8), getEnvInt("KAFKA_QUEUE_CAPACITY", 1000)),
 		ctx:      ctx,
 		cancel:   cancel,
 	}
@@ -52,6 +121,34 @@ func NewKafkaConsumerService(brokers []string, topics []string) (*KafkaConsumerS
 	return service, nil
 }
 
+// ParseRebalanceStrategy returns the strategy assigning partitions to the members of a consumer
+// group: range (the default), roundrobin or sticky
+func ParseRebalanceStrategy(name string) (sarama.BalanceStrategy, error) {
+	switch name {
+	case "", sarama.RangeBalanceStrategyName:
+		return sarama.NewBalanceStrategyRange(), nil
+	case sarama.RoundRobinBalanceStrategyName:
+		return sarama.NewBalanceStrategyRoundRobin(), nil
+	case sarama.StickyBalanceStrategyName:
+		return sarama.NewBalanceStrategySticky(), nil
+	default:
+		return nil, fmt.Errorf("invalid Kafka rebalance strategy: %s. Valid strategies are: range, roundrobin, sticky", name)
+	}
+}
+
+// ParseOffsetReset returns the offset partitions without a committed offset start from: the
+// newest (the default) or the oldest retained
+func ParseOffsetReset(value string) (int64, error) {
+	switch value {
+	case "", "newest":
+		return sarama.OffsetNewest, nil
+	case "oldest":
+		return sarama.OffsetOldest, nil
+	default:
+		return 0, fmt.Errorf("invalid Kafka offset reset: %s. Valid values are: newest, oldest", value)
+	}
+}
+
 // RegisterHandler registers an event handler for a specific event type
 func (s *KafkaConsumerService) RegisterHandler(eventType string, handler EventHandler) {
 	s.mu.Lock()
@@ -95,66 +192,410 @@ func (s *KafkaConsumerService) Start() error {
 	s.running = true
 	s.mu.Unlock()
 
-	log.Printf("Starting Kafka consumer for topics: %v", s.topics)
+	log.Printf("Starting Kafka consumer group %s for topics: %v", s.groupID, s.topics)
 
-	for _, topic := range s.topics {
-		go s.consumeTopic(topic)
+	if len(s.prefixes) > 0 {
+		log.Printf("Discovering Kafka topics with prefixes %v every %s", s.prefixes, s.refresh)
+		s.discoverTopics()
+		go s.refreshTopics()
 	}
 
+	go s.consume()
+	go s.logGroupErrors()
+
 	return nil
 }
 
-// Stop stops the consumer service
-func (s *KafkaConsumerService) Stop() {
+// consume takes part in the consumer group until the service stops, joining a new session after
+// every rebalance and whenever topics are discovered
+func (s *KafkaConsumerService) consume() {
+	for s.ctx.Err() == nil {
+		topics := s.Topics()
+		session, cancel := context.WithCancel(s.ctx)
+		s.mu.Lock()
+		s.rejoin = cancel
+		s.mu.Unlock()
+
+		var err error
+		if len(topics) == 0 {
+			// Nothing to consume until topics are discovered
+			<-session.Done()
+		} else {
+			err = s.group.Consume(session, topics, s)
+		}
+		cancel()
+
+		if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+			return
+		}
+		if err != nil && s.ctx.Err() == nil {
+			log.Printf("Error consuming Kafka topics as group %s, rejoining in %s: %v", s.groupID, kafkaRejoinDelay, err)
+			select {
+			case <-s.ctx.Done():
+			case <-time.After(kafkaRejoinDelay):
+			}
+		}
+	}
+}
+
+// logGroupErrors logs the errors of consuming partitions until the consumer group is closed
+func (s *KafkaConsumerService) logGroupErrors() {
+	for err := range s.group.Errors() {
+		log.Printf("Error consuming Kafka topics as group %s: %v", s.groupID, err)
+	}
+}
+
+// DiscoverTopics makes the service also consume every topic whose name starts with one of the
+// prefixes, looking for new ones in the cluster metadata every refresh interval. Must be called
+// before Start.
+func (s *KafkaConsumerService) DiscoverTopics(prefixes []string, refresh time.Duration) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.prefixes = prefixes
+	s.refresh = refresh
+}
 
-	if !s.running {
+// TopicPrefixes returns the prefixes of the topics discovered from the cluster metadata
+func (s *KafkaConsumerService) TopicPrefixes() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.prefixes
+}
+
+// refreshTopics looks for new topics matching the prefixes every refresh interval until the
+// service stops
+func (s *KafkaConsumerService) refreshTopics() {
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.discoverTopics()
+		}
+	}
+}
+
+// discoverTopics refreshes the cluster metadata and starts consuming the topics matching the
+// prefixes that are not consumed yet
+func (s *KafkaConsumerService) discoverTopics() {
+	if err := s.client.RefreshMetadata(); err != nil {
+		log.Printf("Warning: Failed to refresh Kafka metadata: %v", err)
+		return
+	}
+	available, err := s.client.Topics()
+	if err != nil {
+		log.Printf("Warning: Failed to list Kafka topics: %v", err)
 		return
 	}
 
+	s.mu.Lock()
+	var discovered []string
+	if s.running {
+		for _, topic := range MatchTopics(available, s.prefixes) {
+			if !s.hasTopic(topic) {
+				s.topics = append(s.topics, topic)
+				discovered = append(discovered, topic)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, topic := range discovered {
+		log.Printf("Discovered Kafka topic: %s", topic)
+	}
+	if len(discovered) > 0 {
+		s.rejoinGroup()
+	}
+}
+
+// rejoinGroup ends the current group session so the service joins again with its current topics
+func (s *KafkaConsumerService) rejoinGroup() {
+	s.mu.RLock()
+	rejoin := s.rejoin
+	s.mu.RUnlock()
+	if rejoin != nil {
+		rejoin()
+	}
+}
+
+// MatchTopics returns the topics whose name starts with one of the prefixes, sorted. Internal
+// topics, starting with "__", only match prefixes starting with "__".
+func MatchTopics(topics, prefixes []string) []string {
+	matched := make([]string, 0)
+	for _, topic := range topics {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(topic, prefix) && (!strings.HasPrefix(topic, "__") || strings.HasPrefix(prefix, "__")) {
+				matched = append(matched, topic)
+				break
+			}
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
+
+// ParseTopicPrefixes parses comma-separated topic prefixes. A trailing "*", as in "events.*",
+// is optional.
+func ParseTopicPrefixes(value string) []string {
+	prefixes := []string{}
+	for _, prefix := range strings.Split(value, ",") {
+		if prefix = strings.TrimSuffix(strings.TrimSpace(prefix), "*"); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// Stop stops the consumer service
+func (s *KafkaConsumerService) Stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
 	s.running = false
+	s.mu.Unlock()
+
 	s.cancel()
+	s.workers.Stop()
 
-	if err := s.consumer.Close(); err != nil {
-		log.Printf("Error closing Kafka consumer: %v", err)
+	// Leaving the group, once the session has ended, commits the offsets of the events handled
+	if err := s.group.Close(); err != nil {
+		log.Printf("Error closing Kafka consumer group: %v", err)
+	}
+	if err := s.client.Close(); err != nil {
+		log.Printf("Error closing Kafka client: %v", err)
 	}
 
 	log.Println("Kafka consumer service stopped")
 }
 
-// consumeTopic consumes messages from a specific topic
-func (s *KafkaConsumerService) consumeTopic(topic string) {
-	partitionConsumer, err := s.consumer.ConsumePartition(topic, 0, sarama.OffsetNewest)
-	if err != nil {
-		log.Printf("Failed to start consuming from topic %s: %v", topic, err)
-		return
+// PauseTopic halts consumption from a topic until it is resumed
+func (s *KafkaConsumerService) PauseTopic(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasTopic(topic) {
+		return fmt.Errorf("topic %s is not consumed by this service", topic)
+	}
+	if _, paused := s.paused[topic]; paused {
+		return nil
 	}
-	defer partitionConsumer.Close()
 
-	log.Printf("Started consuming from topic: %s", topic)
+	s.group.Pause(map[string][]int32{topic: s.session.Partitions[topic]})
+	s.paused[topic] = make(chan struct{})
+	log.Printf("Paused consumption from topic: %s", topic)
+	return nil
+}
+
+// ResumeTopic resumes consumption from a paused topic
+func (s *KafkaConsumerService) ResumeTopic(topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.hasTopic(topic) {
+		return fmt.Errorf("topic %s is not consumed by this service", topic)
+	}
+	resumed, paused := s.paused[topic]
+	if !paused {
+		return nil
+	}
+
+	s.group.Resume(map[string][]int32{topic: s.session.Partitions[topic]})
+	delete(s.paused, topic)
+	close(resumed)
+	log.Printf("Resumed consumption from topic: %s", topic)
+	return nil
+}
+
+// PausedTopics returns the topics whose consumption is currently paused
+func (s *KafkaConsumerService) PausedTopics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	topics := make([]string, 0, len(s.paused))
+	for _, topic := range s.topics {
+		if _, paused := s.paused[topic]; paused {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// Topics returns the topics consumed by the service, the configured ones then those discovered
+func (s *KafkaConsumerService) Topics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.topics...)
+}
+
+// hasTopic reports whether the service consumes the topic. Callers must hold the lock.
+func (s *KafkaConsumerService) hasTopic(topic string) bool {
+	for _, t := range s.topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// pauseSignal returns a channel closed on resume if the topic is paused, or nil otherwise
+func (s *KafkaConsumerService) pauseSignal(topic string) chan struct{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.paused[topic]
+}
+
+// Group returns the service's membership of its consumer group
+func (s *KafkaConsumerService) Group() KafkaGroupStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status := s.session
+	status.GroupID = s.groupID
+	status.Strategy = s.strategy
+	status.Partitions = make(map[string][]int32, len(s.session.Partitions))
+	for topic, partitions := range s.session.Partitions {
+		status.Partitions[topic] = append([]int32(nil), partitions...)
+	}
+	return status
+}
+
+// Setup records the partitions assigned to the service when it joins a group session, and holds
+// off fetching those of paused topics
+func (s *KafkaConsumerService) Setup(session sarama.ConsumerGroupSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.session.MemberID = session.MemberID()
+	s.session.Generation = session.GenerationID()
+	s.session.Partitions = session.Claims()
+	s.session.Rebalances++
+	for topic := range s.paused {
+		s.group.Pause(map[string][]int32{topic: s.session.Partitions[topic]})
+	}
+	log.Printf("Joined Kafka consumer group %s (generation %d) with partitions %v", s.groupID, s.session.Generation, s.session.Partitions)
+	return nil
+}
+
+// Cleanup forgets the partitions assigned to the service when a group session ends
+func (s *KafkaConsumerService) Cleanup(session sarama.ConsumerGroupSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session.Partitions = nil
+	return nil
+}
+
+// ConsumeClaim handles the messages of a partition assigned to the service until the group
+// session ends. The offset of a message is marked for commit once its event was handled, after
+// those of the messages before it, so events are consumed at least once across restarts and
+// rebalances. Before returning, it waits for the handlers of the messages it read.
+func (s *KafkaConsumerService) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	debugf("Started consuming from topic %s partition %d at offset %d", claim.Topic(), claim.Partition(), claim.InitialOffset())
+	offsets := newClaimOffsets(func(offset int64) {
+		session.MarkOffset(claim.Topic(), claim.Partition(), offset, "")
+	})
+	defer offsets.Wait()
 
 	for {
+		// Hold off reading buffered messages while the topic is paused
+		if resumed := s.pauseSignal(claim.Topic()); resumed != nil {
+			select {
+			case <-session.Context().Done():
+				return nil
+			case <-resumed:
+			}
+		}
+
 		select {
-		case <-s.ctx.Done():
-			log.Printf("Stopping consumption from topic: %s", topic)
-			return
-		case msg := <-partitionConsumer.Messages():
-			s.handleMessage(msg)
-		case err := <-partitionConsumer.Errors():
-			log.Printf("Error consuming from topic %s: %v", topic, err)
+		case <-session.Context().Done():
+			return nil
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			done := offsets.Track(msg.Offset)
+			if !s.handleMessage(msg, done) {
+				// Left uncommitted for the next member of the group to consume
+				done(false)
+				return nil
+			}
 		}
 	}
 }
 
-// handleMessage processes a single Kafka message
-func (s *KafkaConsumerService) handleMessage(msg *sarama.ConsumerMessage) {
-	log.Printf("Received message from topic %s: %s", msg.Topic, string(msg.Value))
+// claimOffsets tracks the messages of a claimed partition being handled, to mark the offset of
+// the last message handled after all those before it. Handlers run concurrently and finish in
+// any order, and a marked offset commits every message before it.
+type claimOffsets struct {
+	mark     func(offset int64) // Marks the offset to resume the partition from
+	inflight []int64            // Offsets of the messages being handled, in order
+	handled  map[int64]bool     // Offsets of the messages handled, until those before them are
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+}
+
+// newClaimOffsets creates a tracker marking offsets with mark
+func newClaimOffsets(mark func(offset int64)) *claimOffsets {
+	return &claimOffsets{mark: mark, handled: make(map[int64]bool)}
+}
+
+// Track records a message being handled. The returned function must be called once when the
+// handling ends, with whether the message was handled; messages not handled hold off marking the
+// offsets after them, so they are consumed again after a restart or rebalance.
+func (o *claimOffsets) Track(offset int64) func(handled bool) {
+	o.mutex.Lock()
+	o.inflight = append(o.inflight, offset)
+	o.mutex.Unlock()
+	o.wg.Add(1)
+
+	var once sync.Once
+	return func(handled bool) {
+		once.Do(func() {
+			defer o.wg.Done()
+			if handled {
+				o.complete(offset)
+			}
+		})
+	}
+}
+
+// complete records a handled message, and marks the offset after the messages handled in a row
+// from the oldest one being handled
+func (o *claimOffsets) complete(offset int64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.handled[offset] = true
+
+	last := int64(-1)
+	for len(o.inflight) > 0 && o.handled[o.inflight[0]] {
+		last = o.inflight[0]
+		delete(o.handled, last)
+		o.inflight = o.inflight[1:]
+	}
+	if last >= 0 {
+		o.mark(last + 1)
+	}
+}
+
+// Wait waits for the handling of the tracked messages to end
+func (o *claimOffsets) Wait() {
+	o.wg.Wait()
+}
+
+// handleMessage processes a single Kafka message, calling done once its event was handled, and
+// reports whether it was queued: false when its event could not be handed to a handler because
+// the service is stopping
+func (s *KafkaConsumerService) handleMessage(msg *sarama.ConsumerMessage, done func(handled bool)) bool {
+	debugf("Received message from topic %s partition %d: %s", msg.Topic, msg.Partition, string(msg.Value))
 
 	var event CrossServiceEvent
 	if err := json.Unmarshal(msg.Value, &event); err != nil {
 		log.Printf("Failed to unmarshal message: %v", err)
-		return
+		done(true)
+		return true
 	}
 
 	// Set correlation ID if not present
@@ -162,27 +603,106 @@ func (s *KafkaConsumerService) handleMessage(msg *sarama.ConsumerMessage) {
 		event.CorrelationID = uuid.New().String()
 	}
 
-	// Route to appropriate handler
-	s.routeEvent(&event)
+	// Keep the event for the user's timeline and dashboards, then route to appropriate handler
+	s.events.Record(&event)
+	s.live.RecordServiceEvent(&event)
+	return s.routeEvent(&event, done)
 }
 
-// routeEvent routes an event to the appropriate handler
-func (s *KafkaConsumerService) routeEvent(event *CrossServiceEvent) {
+// routeEvent routes an event to the appropriate handler, calling done once the handler ran, and
+// reports whether it was queued: false when the handler could not be queued because the service
+// is stopping. Events whose handler failed after its retries are done with, so they do not hold
+// off the partition, unless the failure came from the service stopping.
+func (s *KafkaConsumerService) routeEvent(event *CrossServiceEvent, done func(handled bool)) bool {
 	s.mu.RLock()
 	handler, exists := s.handlers[event.EventType]
 	s.mu.RUnlock()
 
 	if !exists {
 		log.Printf("No handler registered for event type: %s", event.EventType)
-		return
+		done(true)
+		return true
 	}
 
-	// Execute handler in goroutine to avoid blocking
-	go func() {
-		if err := handler(s.ctx, event); err != nil {
+	// Execute handler on the worker pool, or after the user's previous events, to avoid blocking,
+	// waiting while the queue is full
+	submit := s.workers.Submit
+	if s.ordered != nil {
+		submit = func(task func()) bool {
+			return s.ordered.Submit(event.UserID, task)
+		}
+	}
+	queued := submit(func() {
+		handled := false
+		defer func() { done(handled) }() // Also when the handler panics
+
+		err := s.metrics.Run(s.ctx, event.EventType, func() error {
+			if err := s.faults.Inject(FaultKafka, event.EventType); err != nil {
+				return err
+			}
+			return handler(s.ctx, event)
+		})
+		var disabled *HandlerDisabledError
+		if errors.As(err, &disabled) {
+			debugf("Skipping event %s: %v", event.EventType, err)
+		} else if err != nil {
 			log.Printf("Error handling event %s: %v", event.EventType, err)
 		}
-	}()
+		handled = s.ctx.Err() == nil || err == nil
+	})
+	if !queued {
+		log.Printf("Warning: Consumer stopped, leaving event %s uncommitted", event.EventType)
+	}
+	return queued
+}
+
+// SetFaultInjector sets the injector adding latency and errors to handling events
+func (s *KafkaConsumerService) SetFaultInjector(faults *FaultInjector) {
+	s.faults = faults
+}
+
+// SetServiceEventLog sets the log keeping consumed events for user timelines
+func (s *KafkaConsumerService) SetServiceEventLog(events *ServiceEventLog) {
+	s.events = events
+}
+
+// SetUserProfiles sets the profiles updated by auth and billing events
+func (s *KafkaConsumerService) SetUserProfiles(profiles *UserProfiles) {
+	s.profiles = profiles
+}
+
+// SetPlans sets the plans assigned to users by billing subscription events
+func (s *KafkaConsumerService) SetPlans(plans *PlanService) {
+	s.plans = plans
+}
+
+// SetDashboardMetrics sets the aggregator counting consumed events in the live dashboard metrics
+func (s *KafkaConsumerService) SetDashboardMetrics(aggregator *MetricAggregator) {
+	s.live = aggregator
+}
+
+// SetDispatcher executes event handlers through a dispatcher keeping each user's events in order,
+// with the events of other ingestion paths, instead of the worker pool
+func (s *KafkaConsumerService) SetDispatcher(dispatcher *UserDispatcher) {
+	s.ordered = dispatcher
+}
+
+// SetHandlerMetrics sets the metrics timing, counting and retrying event handlers
+func (s *KafkaConsumerService) SetHandlerMetrics(metrics *KafkaHandlerMetrics) {
+	s.metrics = metrics
+}
+
+// HasHandler reports whether a handler is registered for an event type
+func (s *KafkaConsumerService) HasHandler(eventType string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.handlers[eventType]
+	return exists
+}
+
+// WorkerPool returns the pool executing event handlers
+func (s *KafkaConsumerService) WorkerPool() *WorkerPool {
+	return s.workers
 }
 
 // handleBillingEvent handles billing-related events
@@ -198,6 +718,10 @@ func (s *KafkaConsumerService) handleBillingEvent(ctx context.Context, event *Cr
 
 	// Store or process the billing event
 	log.Printf("Created billing event: %s with amount: %.2f", billingEvent.ID, billingEvent.Amount)
+	s.profiles.Apply(event, false)
+	if s.plans.ApplySubscription(event) {
+		log.Printf("Assigned plan %s to user %s", s.plans.PlanForUser(event.UserID).Name, event.UserID)
+	}
 
 	return nil
 }
@@ -207,6 +731,7 @@ func (s *KafkaConsumerService) handleAuthEvent(ctx context.Context, event *Cross
 	log.Printf("Processing auth event: %s for user: %s", event.EventType, event.UserID)
 
 	// Process authentication events (e.g., track user sessions, security metrics)
+	s.profiles.Apply(event, false)
 	log.Printf("Processed auth event: %s", event.EventType)
 
 	return nil
@@ -0,0 +1,315 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// kafkaHandlerLatencyBuckets are the upper bounds, in seconds, of the handler latency histogram
+var kafkaHandlerLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// HandlerDisabledError is returned when an event is not handled because its handler is disabled
+type HandlerDisabledError struct {
+	EventType string
+}
+
+func (e *HandlerDisabledError) Error() string {
+	return fmt.Sprintf("handler for event type %s is disabled", e.EventType)
+}
+
+// KafkaErrorBudget compares the share of failed events of a handler over the last budget windows
+// with the share allowed
+type KafkaErrorBudget struct {
+	Target    float64 `json:"target"`     // Share of events allowed to fail
+	ErrorRate float64 `json:"error_rate"` // Share of events that failed
+	Remaining float64 `json:"remaining"`  // Share of the allowed failures left, negative when overspent
+	Exhausted bool    `json:"exhausted"`
+}
+
+// KafkaHandlerStats reports the processing of the events of a type since startup
+type KafkaHandlerStats struct {
+	EventType      string           `json:"event_type"`
+	Disabled       bool             `json:"disabled"`
+	DisabledReason string           `json:"disabled_reason,omitempty"`
+	Succeeded      int64            `json:"succeeded"`
+	Failed         int64            `json:"failed"`  // Events that still failed after the retries
+	Retries        int64            `json:"retries"` // Attempts after a failure
+	Skipped        int64            `json:"skipped"` // Events dropped while the handler was disabled
+	AvgLatencyMS   float64          `json:"avg_latency_ms"`
+	MaxLatencyMS   float64          `json:"max_latency_ms"`
+	ErrorBudget    KafkaErrorBudget `json:"error_budget"`
+}
+
+// kafkaHandlerCounters are the counters of an event type's handler
+type kafkaHandlerCounters struct {
+	succeeded, failed, retries, skipped int64
+	attempts                            int64
+	latencySum, latencyMax              time.Duration
+	buckets                             []int64 // Attempts per latency bucket, the last one above every bound
+	disabledReason                      string
+	disabled                            bool
+	// Events of the current and previous budget windows
+	windowStart                    time.Time
+	windowEvents, windowFailed     int64
+	previousEvents, previousFailed int64
+}
+
+// KafkaHandlerMetrics times the handlers of Kafka events and counts their outcomes and retries per
+// event type, keeps an error budget per handler over sliding windows, and lets operators disable a
+// misbehaving handler at runtime. Failed handlers are retried with exponential backoff.
+type KafkaHandlerMetrics struct {
+	handlers    map[string]*kafkaHandlerCounters
+	maxRetries  int
+	retryDelay  time.Duration // Doubled after every failed attempt
+	errorBudget float64
+	window      time.Duration
+	clock       Clock
+	mutex       sync.RWMutex
+}
+
+// NewKafkaHandlerMetrics creates the handler metrics configured from KAFKA_HANDLER_MAX_RETRIES
+// (default 2), KAFKA_HANDLER_RETRY_DELAY (default 100ms), KAFKA_HANDLER_ERROR_BUDGET (default
+// 0.01) and KAFKA_HANDLER_BUDGET_WINDOW (default 1h)
+func NewKafkaHandlerMetrics() *KafkaHandlerMetrics {
+	return &KafkaHandlerMetrics{
+		handlers:    make(map[string]*kafkaHandlerCounters),
+		maxRetries:  max(getEnvInt("KAFKA_HANDLER_MAX_RETRIES", 2), 0),
+		retryDelay:  getEnvDuration("KAFKA_HANDLER_RETRY_DELAY", 100*time.Millisecond),
+		errorBudget: math.Max(getEnvFloat("KAFKA_HANDLER_ERROR_BUDGET", 0.01), 0),
+		window:      getEnvDuration("KAFKA_HANDLER_BUDGET_WINDOW", time.Hour),
+		clock:       SystemClock(),
+	}
+}
+
+// SetClock sets the clock rolling the error budget windows
+func (m *KafkaHandlerMetrics) SetClock(clock Clock) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.clock = clock
+}
+
+// Run handles an event with handle, retrying failures, and records the outcome. Events of disabled
+// handlers are counted as skipped and get a HandlerDisabledError. Retries stop when ctx is done.
+// Without metrics, handle is called once.
+func (m *KafkaHandlerMetrics) Run(ctx context.Context, eventType string, handle func() error) error {
+	if m == nil {
+		return handle()
+	}
+	if m.Disabled(eventType) {
+		m.mutex.Lock()
+		m.counters(eventType).skipped++
+		m.mutex.Unlock()
+		return &HandlerDisabledError{EventType: eventType}
+	}
+
+	err := m.attempt(eventType, handle)
+	retries := 0
+	for ; err != nil && retries < m.maxRetries; retries++ {
+		select {
+		case <-time.After(m.retryDelay << retries):
+		case <-ctx.Done():
+			m.record(eventType, retries, err)
+			return err
+		}
+		err = m.attempt(eventType, handle)
+	}
+	m.record(eventType, retries, err)
+	return err
+}
+
+// attempt calls a handler once, timing it
+func (m *KafkaHandlerMetrics) attempt(eventType string, handle func() error) error {
+	start := time.Now()
+	err := handle()
+	latency := time.Since(start)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counters := m.counters(eventType)
+	counters.attempts++
+	counters.latencySum += latency
+	if latency > counters.latencyMax {
+		counters.latencyMax = latency
+	}
+	bucket := sort.SearchFloat64s(kafkaHandlerLatencyBuckets, latency.Seconds())
+	counters.buckets[bucket]++
+	return err
+}
+
+// record counts the outcome of an event and its retries
+func (m *KafkaHandlerMetrics) record(eventType string, retries int, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counters := m.counters(eventType)
+	counters.retries += int64(retries)
+	m.roll(counters)
+	counters.windowEvents++
+	if err != nil {
+		counters.failed++
+		counters.windowFailed++
+	} else {
+		counters.succeeded++
+	}
+}
+
+// roll starts a new budget window once the current one is over. Callers must hold the lock.
+func (m *KafkaHandlerMetrics) roll(counters *kafkaHandlerCounters) {
+	now := m.clock.Now()
+	elapsed := now.Sub(counters.windowStart)
+	if elapsed < m.window {
+		return
+	}
+	counters.previousEvents, counters.previousFailed = 0, 0
+	if elapsed < 2*m.window {
+		counters.previousEvents, counters.previousFailed = counters.windowEvents, counters.windowFailed
+	}
+	counters.windowStart = now
+	counters.windowEvents, counters.windowFailed = 0, 0
+}
+
+// counters returns the counters of an event type, created on first use. Callers must hold the lock.
+func (m *KafkaHandlerMetrics) counters(eventType string) *kafkaHandlerCounters {
+	counters, exists := m.handlers[eventType]
+	if !exists {
+		counters = &kafkaHandlerCounters{
+			buckets:     make([]int64, len(kafkaHandlerLatencyBuckets)+1),
+			windowStart: m.clock.Now(),
+		}
+		m.handlers[eventType] = counters
+	}
+	return counters
+}
+
+// Disable stops handling events of a type until it is enabled again; they are dropped and counted
+// as skipped
+func (m *KafkaHandlerMetrics) Disable(eventType, reason string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counters := m.counters(eventType)
+	counters.disabled = true
+	counters.disabledReason = reason
+}
+
+// Enable resumes handling events of a type. It reports whether the handler was disabled.
+func (m *KafkaHandlerMetrics) Enable(eventType string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counters, exists := m.handlers[eventType]
+	if !exists || !counters.disabled {
+		return false
+	}
+	counters.disabled = false
+	counters.disabledReason = ""
+	return true
+}
+
+// Disabled reports whether the handler of an event type is disabled
+func (m *KafkaHandlerMetrics) Disabled(eventType string) bool {
+	if m == nil {
+		return false
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	counters, exists := m.handlers[eventType]
+	return exists && counters.disabled
+}
+
+// Stats returns the stats of the handlers that handled events or were disabled, by event type
+func (m *KafkaHandlerMetrics) Stats() []KafkaHandlerStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	stats := make([]KafkaHandlerStats, 0, len(m.handlers))
+	for eventType, counters := range m.handlers {
+		m.roll(counters)
+		handler := KafkaHandlerStats{
+			EventType:      eventType,
+			Disabled:       counters.disabled,
+			DisabledReason: counters.disabledReason,
+			Succeeded:      counters.succeeded,
+			Failed:         counters.failed,
+			Retries:        counters.retries,
+			Skipped:        counters.skipped,
+			MaxLatencyMS:   float64(counters.latencyMax) / float64(time.Millisecond),
+			ErrorBudget:    m.budget(counters),
+		}
+		if counters.attempts > 0 {
+			handler.AvgLatencyMS = float64(counters.latencySum) / float64(counters.attempts) / float64(time.Millisecond)
+		}
+		stats = append(stats, handler)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].EventType < stats[j].EventType
+	})
+	return stats
+}
+
+// budget returns the error budget of a handler over the current and previous windows. Callers
+// must hold the lock.
+func (m *KafkaHandlerMetrics) budget(counters *kafkaHandlerCounters) KafkaErrorBudget {
+	budget := KafkaErrorBudget{Target: m.errorBudget, Remaining: 1}
+	events := counters.windowEvents + counters.previousEvents
+	failed := counters.windowFailed + counters.previousFailed
+	if events == 0 {
+		return budget
+	}
+	budget.ErrorRate = math.Round(10000*float64(failed)/float64(events)) / 10000
+	allowed := m.errorBudget * float64(events)
+	if allowed > 0 {
+		budget.Remaining = math.Round(10000*(allowed-float64(failed))/allowed) / 10000
+	} else if failed > 0 {
+		budget.Remaining = -1
+	}
+	budget.Exhausted = float64(failed) > allowed
+	return budget
+}
+
+// WriteMetrics writes the handler counters, latency histograms and error budgets in the
+// Prometheus text exposition format
+func (m *KafkaHandlerMetrics) WriteMetrics(out io.Writer) error {
+	stats := m.Stats()
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var metrics []byte
+	metrics = append(metrics, "# HELP analytics_kafka_handler_events_total Kafka events by event type and handling outcome.\n# TYPE analytics_kafka_handler_events_total counter\n"...)
+	for _, handler := range stats {
+		metrics = fmt.Appendf(metrics, "analytics_kafka_handler_events_total{event_type=%q,outcome=\"succeeded\"} %d\nanalytics_kafka_handler_events_total{event_type=%q,outcome=\"failed\"} %d\nanalytics_kafka_handler_events_total{event_type=%q,outcome=\"skipped\"} %d\n",
+			handler.EventType, handler.Succeeded, handler.EventType, handler.Failed, handler.EventType, handler.Skipped)
+	}
+	metrics = append(metrics, "# HELP analytics_kafka_handler_retries_total Attempts of Kafka event handlers after a failure.\n# TYPE analytics_kafka_handler_retries_total counter\n"...)
+	for _, handler := range stats {
+		metrics = fmt.Appendf(metrics, "analytics_kafka_handler_retries_total{event_type=%q} %d\n", handler.EventType, handler.Retries)
+	}
+	metrics = append(metrics, "# HELP analytics_kafka_handler_duration_seconds Duration of Kafka event handler attempts.\n# TYPE analytics_kafka_handler_duration_seconds histogram\n"...)
+	for _, handler := range stats {
+		counters := m.handlers[handler.EventType]
+		var cumulative int64
+		for i, bound := range kafkaHandlerLatencyBuckets {
+			cumulative += counters.buckets[i]
+			metrics = fmt.Appendf(metrics, "analytics_kafka_handler_duration_seconds_bucket{event_type=%q,le=\"%g\"} %d\n", handler.EventType, bound, cumulative)
+		}
+		metrics = fmt.Appendf(metrics, "analytics_kafka_handler_duration_seconds_bucket{event_type=%q,le=\"+Inf\"} %d\nanalytics_kafka_handler_duration_seconds_sum{event_type=%q} %g\nanalytics_kafka_handler_duration_seconds_count{event_type=%q} %d\n",
+			handler.EventType, counters.attempts, handler.EventType, counters.latencySum.Seconds(), handler.EventType, counters.attempts)
+	}
+	metrics = append(metrics, "# HELP analytics_kafka_handler_disabled Whether the Kafka event handler is disabled.\n# TYPE analytics_kafka_handler_disabled gauge\n"...)
+	for _, handler := range stats {
+		disabled := 0
+		if handler.Disabled {
+			disabled = 1
+		}
+		metrics = fmt.Appendf(metrics, "analytics_kafka_handler_disabled{event_type=%q} %d\n", handler.EventType, disabled)
+	}
+	metrics = append(metrics, "# HELP analytics_kafka_handler_error_budget_remaining Share of the allowed handler failures left over the budget windows.\n# TYPE analytics_kafka_handler_error_budget_remaining gauge\n"...)
+	for _, handler := range stats {
+		metrics = fmt.Appendf(metrics, "analytics_kafka_handler_error_budget_remaining{event_type=%q} %g\n", handler.EventType, handler.ErrorBudget.Remaining)
+	}
+
+	_, err := out.Write(metrics)
+	return err
+}
@@ -0,0 +1,208 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+)
+
+// replayIdleTimeout is how long a replay waits for the next message of a partition before giving
+// up on reaching the end offset, which compacted or transactional topics may never deliver
+const replayIdleTimeout = 10 * time.Second
+
+// KafkaReplayRequest selects the messages of a topic to re-consume
+type KafkaReplayRequest struct {
+	Topic      string    `json:"topic"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to,omitempty"`          // Up to the latest message when zero
+	EventTypes []string  `json:"event_types,omitempty"` // Only events of these types when set
+}
+
+// KafkaReplayResult reports how the messages of a replay were processed
+type KafkaReplayResult struct {
+	Topic          string    `json:"topic"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	Partitions     int       `json:"partitions"`
+	Messages       int64     `json:"messages"`        // Read from the topic in the time range
+	Replayed       int64     `json:"replayed"`        // Handled again
+	SkippedBilling int64     `json:"skipped_billing"` // Billing events, never replayed
+	Skipped        int64     `json:"skipped"`         // Not of the requested event types, or of disabled handlers
+	Unhandled      int64     `json:"unhandled"`       // Without a registered handler
+	Failed         int64     `json:"failed"`          // Unreadable, or failed to be handled
+	CompletedAt    time.Time `json:"completed_at"`
+}
+
+// IsBillingEvent reports whether an event comes from the billing service. Billing events are not
+// replayed: their handling charges users, who must not be charged twice.
+func IsBillingEvent(event *CrossServiceEvent) bool {
+	return event.Source == "billing" || strings.HasPrefix(event.EventType, "billing.")
+}
+
+// Replay re-consumes the messages a topic received in a time range, for recovering from handlers
+// that mis-processed them. Each partition is read from the first offset at or after From, looked
+// up by timestamp, to the first offset at or after To. Messages go through a reprocessing pipeline
+// beside live consumption: events are handled again by their registered handler, synchronously,
+// except billing events and events of disabled handlers, and are not recorded in the service event
+// log again.
+func (s *KafkaConsumerService) Replay(ctx context.Context, request KafkaReplayRequest) (*KafkaReplayResult, error) {
+	s.mu.RLock()
+	consumed := s.hasTopic(request.Topic)
+	s.mu.RUnlock()
+	if !consumed {
+		return nil, fmt.Errorf("topic %s is not consumed by this service", request.Topic)
+	}
+	if request.To.IsZero() {
+		request.To = time.Now()
+	}
+	if !request.To.After(request.From) {
+		return nil, fmt.Errorf("to must be after from")
+	}
+
+	result := &KafkaReplayResult{
+		Topic: request.Topic,
+		From:  request.From,
+		To:    request.To,
+	}
+	log.Printf("Replaying Kafka topic %s from %s to %s", request.Topic, request.From.Format(time.RFC3339), request.To.Format(time.RFC3339))
+	partitions, err := s.readRange(ctx, request.Topic, request.From, request.To, func(msg *sarama.ConsumerMessage) {
+		result.Messages++
+		s.replayMessage(ctx, msg, request, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Partitions = partitions
+	result.CompletedAt = time.Now()
+	log.Printf("Replayed %d of %d messages of Kafka topic %s", result.Replayed, result.Messages, request.Topic)
+	return result, nil
+}
+
+// readRange reads the messages a topic received in [from, to) with a consumer of its own, beside
+// live consumption, and returns the number of partitions read. Each partition is read from the
+// first offset at or after from, looked up by timestamp, to the first offset at or after to.
+func (s *KafkaConsumerService) readRange(ctx context.Context, topic string, from, to time.Time, read func(msg *sarama.ConsumerMessage)) (int, error) {
+	partitions, err := s.client.Partitions(topic)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list partitions of topic %s: %w", topic, err)
+	}
+	ranges := make(map[int32][2]int64, len(partitions))
+	for _, partition := range partitions {
+		start, err := s.offsetForTime(topic, partition, from)
+		if err != nil {
+			return 0, err
+		}
+		end, err := s.offsetForTime(topic, partition, to)
+		if err != nil {
+			return 0, err
+		}
+		ranges[partition] = [2]int64{start, end}
+		jobFromContext(ctx).expect(end - start)
+	}
+
+	// Live consumption owns its partition consumers, reading a range takes its own
+	consumer, err := sarama.NewConsumerFromClient(s.client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create Kafka replay consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	for _, partition := range partitions {
+		offsets := ranges[partition]
+		if err := s.readPartition(ctx, consumer, topic, partition, offsets[0], offsets[1], read); err != nil {
+			return 0, err
+		}
+	}
+	return len(partitions), nil
+}
+
+// offsetForTime returns the offset of the first message of a partition at or after a time, or the
+// partition's next offset when there is none
+func (s *KafkaConsumerService) offsetForTime(topic string, partition int32, at time.Time) (int64, error) {
+	offset, err := s.client.GetOffset(topic, partition, at.UnixMilli())
+	if err == nil && offset < 0 {
+		offset, err = s.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up offset of topic %s partition %d: %w", topic, partition, err)
+	}
+	return offset, nil
+}
+
+// readPartition reads the messages of a partition in [start, end)
+func (s *KafkaConsumerService) readPartition(ctx context.Context, consumer sarama.Consumer, topic string, partition int32, start, end int64, read func(msg *sarama.ConsumerMessage)) error {
+	if start >= end {
+		return nil
+	}
+	partitionConsumer, err := consumer.ConsumePartition(topic, partition, start)
+	if err != nil {
+		return fmt.Errorf("failed to replay topic %s partition %d: %w", topic, partition, err)
+	}
+	defer partitionConsumer.Close()
+
+	idle := time.NewTimer(replayIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-idle.C:
+			log.Printf("Warning: Replay of topic %s partition %d stopped waiting for offset %d", topic, partition, end-1)
+			return nil
+		case err := <-partitionConsumer.Errors():
+			log.Printf("Error replaying topic %s: %v", topic, err)
+		case msg := <-partitionConsumer.Messages():
+			if msg.Offset >= end {
+				return nil
+			}
+			jobFromContext(ctx).scan(1)
+			read(msg)
+			if msg.Offset >= end-1 {
+				return nil
+			}
+			idle.Reset(replayIdleTimeout)
+		}
+	}
+}
+
+// replayMessage handles a replayed message again, counting the outcome in the result
+func (s *KafkaConsumerService) replayMessage(ctx context.Context, msg *sarama.ConsumerMessage, request KafkaReplayRequest, result *KafkaReplayResult) {
+	var event CrossServiceEvent
+	if err := json.Unmarshal(msg.Value, &event); err != nil {
+		log.Printf("Failed to unmarshal replayed message: %v", err)
+		result.Failed++
+		return
+	}
+	if event.CorrelationID == "" {
+		event.CorrelationID = uuid.New().String()
+	}
+
+	if IsBillingEvent(&event) {
+		result.SkippedBilling++
+		return
+	}
+	if s.metrics.Disabled(event.EventType) || len(request.EventTypes) > 0 && !containsEventType(request.EventTypes, event.EventType) {
+		result.Skipped++
+		return
+	}
+	s.mu.RLock()
+	handler, exists := s.handlers[event.EventType]
+	s.mu.RUnlock()
+	if !exists {
+		result.Unhandled++
+		return
+	}
+
+	if err := handler(ctx, &event); err != nil {
+		log.Printf("Error replaying event %s: %v", event.EventType, err)
+		result.Failed++
+		return
+	}
+	result.Replayed++
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getDirtyBuckets returns the project's buckets that received late events and must be recomputed
+func (s *App) getDirtyBuckets(c *fiber.Ctx) error {
+	lateEvents := s.analyticsService.LateEvents()
+	return c.JSON(fiber.Map{
+		"status":          "success",
+		"buckets":         lateEvents.DirtyBuckets(projectIDFromRequest(c)),
+		"lateness_window": lateEvents.Window().String(),
+	})
+}
+
+// acknowledgeDirtyBuckets clears the project's dirty buckets after recomputation. Only buckets last
+// marked at or before ?marked_before (RFC3339, default now) are cleared, so recompute jobs pass
+// the time they listed the buckets.
+func (s *App) acknowledgeDirtyBuckets(c *fiber.Ctx) error {
+	markedBefore := time.Now()
+	if value := c.Query("marked_before"); value != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "marked_before must be an RFC3339 timestamp",
+			})
+		}
+		markedBefore = parsed
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"cleared": s.analyticsService.LateEvents().Acknowledge(projectIDFromRequest(c), markedBefore),
+	})
+}
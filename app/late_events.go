@@ -0,0 +1,165 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dirtyBucketSize is the granularity of dirty buckets, the finest trend interval
+const dirtyBucketSize = time.Hour
+
+// maxClockAhead is how far in the future a client timestamp may be before the event is rejected
+const maxClockAhead = 5 * time.Minute
+
+// DirtyBucket is a closed time bucket of a project that received late events, so rollups and
+// cached results covering it must be recomputed
+type DirtyBucket struct {
+	ProjectID    string    `json:"project_id"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	EventTypes   []string  `json:"event_types"`
+	LateEvents   int64     `json:"late_events"`
+	LastMarkedAt time.Time `json:"last_marked_at"`
+}
+
+// LateEventTracker decides which client timestamps are accepted and tracks the buckets that late
+// events were routed into. Mobile SDKs deliver offline-queued events hours after they happened.
+type LateEventTracker struct {
+	window time.Duration                     // How old a client timestamp may be
+	dirty  map[string]map[int64]*DirtyBucket // Project -> bucket start (Unix seconds) -> bucket
+	mutex  sync.RWMutex
+}
+
+// NewLateEventTracker creates a tracker with the lateness window from EVENT_LATENESS_WINDOW
+func NewLateEventTracker() *LateEventTracker {
+	return &LateEventTracker{
+		window: getEnvDuration("EVENT_LATENESS_WINDOW", 72*time.Hour),
+		dirty:  make(map[string]map[int64]*DirtyBucket),
+	}
+}
+
+// Window returns how old a client timestamp may be
+func (t *LateEventTracker) Window() time.Duration {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.window
+}
+
+// SetWindow sets how old a client timestamp may be
+func (t *LateEventTracker) SetWindow(window time.Duration) error {
+	if window <= 0 {
+		return fmt.Errorf("lateness window must be positive, got %s", window)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.window = window
+	return nil
+}
+
+// CheckTimestamp returns an error when a client timestamp is older than the lateness window
+// or too far in the future to be trusted
+func (t *LateEventTracker) CheckTimestamp(timestamp, receivedAt time.Time) error {
+	window := t.Window()
+	if timestamp.Before(receivedAt.Add(-window)) {
+		return fmt.Errorf("timestamp %s is older than the lateness window of %s", timestamp.Format(time.RFC3339), window)
+	}
+	if timestamp.After(receivedAt.Add(maxClockAhead)) {
+		return fmt.Errorf("timestamp %s is in the future", timestamp.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// isLateEvent reports whether an event arrived after the bucket holding its timestamp closed
+func isLateEvent(event *AnalyticsEvent) bool {
+	return event.Timestamp.Truncate(dirtyBucketSize).Before(event.ReceivedAt.Truncate(dirtyBucketSize))
+}
+
+// Mark records the bucket of a late event as dirty
+func (t *LateEventTracker) Mark(event *AnalyticsEvent) {
+	start := event.Timestamp.Truncate(dirtyBucketSize)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	projectID := projectOrDefault(event.ProjectID)
+	buckets, exists := t.dirty[projectID]
+	if !exists {
+		buckets = make(map[int64]*DirtyBucket)
+		t.dirty[projectID] = buckets
+	}
+
+	bucket, exists := buckets[start.Unix()]
+	if !exists {
+		bucket = &DirtyBucket{
+			ProjectID: projectID,
+			Start:     start,
+			End:       start.Add(dirtyBucketSize),
+		}
+		buckets[start.Unix()] = bucket
+	}
+
+	bucket.LateEvents++
+	bucket.LastMarkedAt = event.ReceivedAt
+	index := sort.SearchStrings(bucket.EventTypes, event.EventType)
+	if index == len(bucket.EventTypes) || bucket.EventTypes[index] != event.EventType {
+		bucket.EventTypes = append(bucket.EventTypes, "")
+		copy(bucket.EventTypes[index+1:], bucket.EventTypes[index:])
+		bucket.EventTypes[index] = event.EventType
+	}
+}
+
+// DirtyBuckets returns the dirty buckets of a project, oldest first
+func (t *LateEventTracker) DirtyBuckets(projectID string) []DirtyBucket {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	buckets := make([]DirtyBucket, 0, len(t.dirty[projectID]))
+	for _, bucket := range t.dirty[projectID] {
+		copied := *bucket
+		copied.EventTypes = append([]string(nil), bucket.EventTypes...)
+		buckets = append(buckets, copied)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets
+}
+
+// Acknowledge clears the dirty buckets of a project last marked at or before markedBefore, once
+// they have been recomputed. Buckets receiving late events during the recomputation stay dirty.
+// It returns the number of cleared buckets.
+func (t *LateEventTracker) Acknowledge(projectID string, markedBefore time.Time) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	cleared := 0
+	for start, bucket := range t.dirty[projectID] {
+		if !bucket.LastMarkedAt.After(markedBefore) {
+			delete(t.dirty[projectID], start)
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// parseEventTimestamp parses a client timestamp given as RFC3339 or as Unix milliseconds
+func parseEventTimestamp(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		timestamp, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q, expected RFC3339 or Unix milliseconds", v)
+		}
+		return timestamp, nil
+	case float64:
+		return time.UnixMilli(int64(v)), nil
+	default:
+		return time.Time{}, fmt.Errorf("invalid timestamp of type %T, expected RFC3339 or Unix milliseconds", value)
+	}
+}
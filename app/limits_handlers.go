@@ -0,0 +1,76 @@
+package app
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// limitedEndpoints are the endpoints whose rate limits are reported by default: the ones SDKs send
+// events to
+var limitedEndpoints = []string{"/api/v1/analytics/events", "/api/v1/analytics/mobile/batch"}
+
+// ClientLimits is everything limiting what a client may send, so SDKs can slow down, batch or
+// sample before they are rejected
+type ClientLimits struct {
+	UserID         string             `json:"user_id"`
+	ProjectID      string             `json:"project_id"`
+	RateLimits     []RateLimitStatus  `json:"rate_limits"`
+	Quotas         []QuotaStatus      `json:"quotas"`
+	QuotasResetAt  time.Time          `json:"quotas_reset_at"`      // Next midnight (UTC), when daily quotas start over
+	DetailRates    map[string]float64 `json:"detail_sample_rates"`  // Share of events of a type stored with their properties
+	RequestRates   map[string]float64 `json:"request_sample_rates"` // Share of requests to an endpoint sampled
+	Plan           Plan               `json:"plan"`
+	MaxBatchEvents int                `json:"max_batch_events"` // Events per mobile batch
+	MaxBatchBytes  int                `json:"max_batch_bytes"`  // Decompressed size of a mobile batch
+}
+
+// getLimits returns the caller's rate limits, the remaining daily quotas of the project, the
+// active sample rates and the caps of the caller's plan. The caller is identified like the rate
+// limiter does, by X-User-ID or user_id, and rate limits are reported for the endpoints listed in
+// the comma-separated endpoints parameter (default: the ingestion endpoints).
+func (s *App) getLimits(c *fiber.Ctx) error {
+	userID := rateLimitedUserID(c)
+	projectID := projectIDFromRequest(c)
+	now := s.analyticsService.Clock().Now()
+
+	endpoints := requestedEndpoints(c)
+	limits := ClientLimits{
+		UserID:         userID,
+		ProjectID:      projectID,
+		RateLimits:     make([]RateLimitStatus, 0, len(endpoints)),
+		Quotas:         s.analyticsService.Quotas().Status(projectID, now),
+		QuotasResetAt:  now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour),
+		DetailRates:    s.analyticsService.StorageSampler().DetailRates(),
+		RequestRates:   s.requestSampler.SampleRates(),
+		Plan:           s.analyticsService.Plans().PlanForUser(userID),
+		MaxBatchEvents: s.analyticsService.MobileBatches().MaxEvents(),
+		MaxBatchBytes:  s.mobileBatchMaxBytes,
+	}
+	for _, endpoint := range endpoints {
+		limits.RateLimits = append(limits.RateLimits, s.rateLimiter.Status(userID, endpoint))
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"limits": limits,
+	})
+}
+
+// requestedEndpoints returns the endpoints listed in the comma-separated endpoints parameter, or
+// the ingestion endpoints
+func requestedEndpoints(c *fiber.Ctx) []string {
+	requested := c.Query("endpoints")
+	if requested == "" {
+		return limitedEndpoints
+	}
+
+	var endpoints []string
+	for _, endpoint := range strings.Split(requested, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	return endpoints
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// listLiveFunnels returns the state of the project's live funnels
+func (s *App) listLiveFunnels(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"funnels": s.liveFunnels.List(projectIDFromRequest(c)),
+	})
+}
+
+// getLiveFunnel returns where the users of a live funnel stand
+func (s *App) getLiveFunnel(c *fiber.Ctx) error {
+	state, err := s.liveFunnels.State(projectIDFromRequest(c), c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"funnel": state,
+	})
+}
+
+// enableLiveFunnel makes a funnel live, following its users from the events stored within the
+// window on
+func (s *App) enableLiveFunnel(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	state, err := s.liveFunnels.Enable(ctx, utils.CopyString(c.Params("id")))
+	if err != nil {
+		return c.Status(notFoundOrBadRequest(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"funnel": state,
+	})
+}
+
+// disableLiveFunnel stops following the users of a live funnel
+func (s *App) disableLiveFunnel(c *fiber.Ctx) error {
+	if err := s.liveFunnels.Disable(projectIDFromRequest(c), c.Params("id")); err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+	})
+}
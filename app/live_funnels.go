@@ -0,0 +1,394 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LiveFunnelMetric is the type of the dashboard metrics carrying the state of live funnels
+const LiveFunnelMetric = "funnel.live"
+
+// LiveFunnelStep is the state of a step of a live funnel
+type LiveFunnelStep struct {
+	StepResult
+	Current int64 `json:"current"` // Users whose furthest step is this one
+}
+
+// LiveFunnelState is the state of a live funnel: where the users active within the window stand
+type LiveFunnelState struct {
+	FunnelID       string           `json:"funnel_id"`
+	FunnelName     string           `json:"funnel_name"`
+	FunnelVersion  int64            `json:"funnel_version"`
+	Steps          []LiveFunnelStep `json:"steps"`
+	TotalUsers     int64            `json:"total_users"`
+	ConvertedUsers int64            `json:"converted_users"`
+	ConversionRate float64          `json:"conversion_rate"`
+	WindowSeconds  int              `json:"window_seconds"` // Users are followed until inactive for the window
+	DroppedUsers   int64            `json:"dropped_users"`  // Users not followed since the funnel was full
+	LiveSince      time.Time        `json:"live_since"`
+	UpdatedAt      time.Time        `json:"updated_at"` // Last time an event moved a user
+}
+
+// liveFunnelUser is the progress of a user through a live funnel
+type liveFunnelUser struct {
+	reached int       // Steps reached in order
+	events  []int64   // Events matching each step
+	lastAt  time.Time // Time of the user's latest event matching a step
+}
+
+// liveFunnel follows the users of a project through a funnel as their events are stored
+type liveFunnel struct {
+	funnel    *Funnel
+	users     map[string]*liveFunnelUser
+	reached   []int64 // Users having reached each step
+	events    []int64 // Events matching each step
+	dropped   int64
+	builtAt   time.Time // When the state was rebuilt from the stored events
+	since     time.Time
+	updatedAt time.Time
+	changed   bool // Users moved since the state was last pushed
+}
+
+// liveFunnelKey identifies a live funnel of a project
+type liveFunnelKey struct {
+	projectID string
+	funnelID  string
+}
+
+// LiveFunnels keeps per-user progress through the funnels designated live, moving users through
+// the steps as their events are stored instead of recomputing the funnel from stored events. The
+// state of the funnels users moved through is pushed to the project's dashboards as
+// funnel.live metrics every push interval.
+type LiveFunnels struct {
+	funnels       *FunnelService
+	dashboards    *DashboardService
+	live          map[liveFunnelKey]*liveFunnel
+	window        time.Duration
+	maxUsers      int
+	maxPerProject int
+	interval      time.Duration
+	clock         Clock
+	stop          chan struct{}
+	stopOnce      sync.Once
+	mutex         sync.Mutex
+}
+
+// NewLiveFunnels creates the live funnels, following users until inactive for LIVE_FUNNEL_WINDOW
+// (default 24h), at most LIVE_FUNNEL_MAX_USERS (default 100000) per funnel and
+// LIVE_FUNNEL_MAX_PER_PROJECT (default 10) funnels per project. Changed states are pushed every
+// LIVE_FUNNEL_PUSH_INTERVAL (default 1s).
+func NewLiveFunnels(funnels *FunnelService, dashboards *DashboardService) *LiveFunnels {
+	return &LiveFunnels{
+		funnels:       funnels,
+		dashboards:    dashboards,
+		live:          make(map[liveFunnelKey]*liveFunnel),
+		window:        getEnvDuration("LIVE_FUNNEL_WINDOW", 24*time.Hour),
+		maxUsers:      getEnvInt("LIVE_FUNNEL_MAX_USERS", 100000),
+		maxPerProject: getEnvInt("LIVE_FUNNEL_MAX_PER_PROJECT", 10),
+		interval:      getEnvDuration("LIVE_FUNNEL_PUSH_INTERVAL", time.Second),
+		clock:         SystemClock(),
+		stop:          make(chan struct{}),
+	}
+}
+
+// SetClock sets the clock users are expired with
+func (l *LiveFunnels) SetClock(clock Clock) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.clock = clock
+}
+
+// Start pushes the changed states to the dashboards every push interval until stopped
+func (l *LiveFunnels) Start() {
+	if l.interval <= 0 {
+		log.Printf("Live funnels are only pushed when requested")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				l.Push()
+			}
+		}
+	}()
+}
+
+// Stop stops the background pushes
+func (l *LiveFunnels) Stop() {
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// Enable makes a funnel of the project live, building its state from the events stored within
+// the window. Funnels with steps of other services cannot be live, since only analytics events
+// are followed.
+func (l *LiveFunnels) Enable(ctx context.Context, funnelID string) (*LiveFunnelState, error) {
+	projectID := ProjectFromContext(ctx)
+	funnel, err := l.funnels.GetFunnel(ctx, funnelID)
+	if err != nil {
+		return nil, err
+	}
+	if crossServiceSteps(funnel.Steps) {
+		return nil, fmt.Errorf("funnel %s has steps of other services, which live funnels do not follow", funnelID)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := liveFunnelKey{projectID: projectID, funnelID: funnel.ID}
+	if live, exists := l.live[key]; exists {
+		return live.state(l.window), nil
+	}
+	count := 0
+	for existing := range l.live {
+		if existing.projectID == projectID {
+			count++
+		}
+	}
+	if count >= l.maxPerProject {
+		return nil, fmt.Errorf("project %s already has %d live funnels", projectID, l.maxPerProject)
+	}
+
+	live := &liveFunnel{since: l.clock.Now()}
+	l.rebuild(ctx, live, funnel)
+	l.live[key] = live
+	return live.state(l.window), nil
+}
+
+// Disable stops following the users of a live funnel
+func (l *LiveFunnels) Disable(projectID, funnelID string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := liveFunnelKey{projectID: projectOrDefault(projectID), funnelID: funnelID}
+	if _, exists := l.live[key]; !exists {
+		return fmt.Errorf("live funnel not found: %s", funnelID)
+	}
+	delete(l.live, key)
+	return nil
+}
+
+// State returns the state of a live funnel
+func (l *LiveFunnels) State(projectID, funnelID string) (*LiveFunnelState, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	live, exists := l.live[liveFunnelKey{projectID: projectOrDefault(projectID), funnelID: funnelID}]
+	if !exists {
+		return nil, fmt.Errorf("live funnel not found: %s", funnelID)
+	}
+	live.expire(l.clock.Now().Add(-l.window))
+	return live.state(l.window), nil
+}
+
+// List returns the states of the live funnels of a project, sorted by funnel ID
+func (l *LiveFunnels) List(projectID string) []*LiveFunnelState {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	projectID = projectOrDefault(projectID)
+	cutoff := l.clock.Now().Add(-l.window)
+	states := make([]*LiveFunnelState, 0)
+	for key, live := range l.live {
+		if key.projectID == projectID {
+			live.expire(cutoff)
+			states = append(states, live.state(l.window))
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].FunnelID < states[j].FunnelID
+	})
+	return states
+}
+
+// Observe moves the user of a stored event through the live funnels of its project
+func (l *LiveFunnels) Observe(event *AnalyticsEvent) {
+	if event.UserID == "" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	projectID := projectOrDefault(event.ProjectID)
+	cutoff := l.clock.Now().Add(-l.window)
+	for key, live := range l.live {
+		// Events received until the state was rebuilt were counted from the stored events
+		if key.projectID != projectID || !event.ReceivedAt.After(live.builtAt) {
+			continue
+		}
+		if !event.Timestamp.Before(cutoff) {
+			live.observe(funnelEvent{AnalyticsEvent: event}, l.maxUsers)
+		}
+	}
+}
+
+// Push expires inactive users, and pushes the state of the live funnels users moved through to
+// the dashboards of their projects. Funnels whose definition changed are rebuilt from the stored
+// events, and funnels deleted or changed to follow other services stop being live. It returns
+// how many states were pushed.
+func (l *LiveFunnels) Push() int {
+	l.mutex.Lock()
+	now := l.clock.Now()
+	cutoff := now.Add(-l.window)
+	var pushed []DashboardMetric
+	for key, live := range l.live {
+		ctx := ContextWithProject(context.Background(), key.projectID)
+		funnel, err := l.funnels.GetFunnel(ctx, key.funnelID)
+		if err == nil && crossServiceSteps(funnel.Steps) {
+			err = fmt.Errorf("funnel %s now has steps of other services", key.funnelID)
+		}
+		if err != nil {
+			log.Printf("Warning: Live funnel %s of project %s is no longer followed: %v", key.funnelID, key.projectID, err)
+			delete(l.live, key)
+			continue
+		}
+		if funnel.Version != live.funnel.Version {
+			l.rebuild(ctx, live, funnel)
+		}
+
+		live.expire(cutoff)
+		if !live.changed || !l.dashboards.hasClients(key.projectID) {
+			continue
+		}
+		live.changed = false
+		pushed = append(pushed, DashboardMetric{
+			ProjectID: key.projectID,
+			Type:      LiveFunnelMetric,
+			Value:     live.state(l.window),
+			Timestamp: now,
+		})
+	}
+	l.mutex.Unlock()
+
+	for _, metric := range pushed {
+		l.dashboards.BroadcastMetric(metric)
+	}
+	return len(pushed)
+}
+
+// rebuild replaces the state of a live funnel with the progress of the users in the events stored
+// within the window. Callers must hold the lock.
+func (l *LiveFunnels) rebuild(ctx context.Context, live *liveFunnel, funnel *Funnel) {
+	now := l.clock.Now()
+	live.funnel = funnel
+	live.users = make(map[string]*liveFunnelUser)
+	live.reached = make([]int64, len(funnel.Steps))
+	live.events = make([]int64, len(funnel.Steps))
+	live.dropped = 0
+	live.builtAt = now
+	live.changed = true
+	for _, event := range l.funnels.funnelEvents(ctx, funnel.Steps, FunnelQuery{Start: now.Add(-l.window)}) {
+		// Events received after the rebuild are left to Observe
+		if event.UserID != "" && !event.ReceivedAt.After(now) {
+			live.observe(event, l.maxUsers)
+		}
+	}
+}
+
+// observe moves a user through the funnel with an event, like computeSegments does: the event
+// advances the user to the next step or repeats a step already reached, and users enter the
+// funnel with its first step
+func (f *liveFunnel) observe(event funnelEvent, maxUsers int) {
+	steps := f.funnel.Steps
+	user := f.users[event.UserID]
+	next := 0
+	if user != nil {
+		next = user.reached
+	}
+
+	for i := min(next, len(steps)-1); i >= 0; i-- {
+		if !steps[i].matches(event) {
+			continue
+		}
+		if user == nil {
+			if len(f.users) >= maxUsers {
+				f.dropped++
+				return
+			}
+			user = &liveFunnelUser{events: make([]int64, len(steps))}
+			f.users[event.UserID] = user
+		}
+		user.events[i]++
+		f.events[i]++
+		if i == next {
+			user.reached++
+			f.reached[i]++
+		}
+		if event.Timestamp.After(user.lastAt) {
+			user.lastAt = event.Timestamp
+		}
+		f.updatedAt = event.Timestamp
+		f.changed = true
+		return
+	}
+}
+
+// expire stops following the users without events since the cutoff
+func (f *liveFunnel) expire(cutoff time.Time) {
+	for userID, user := range f.users {
+		if !user.lastAt.Before(cutoff) {
+			continue
+		}
+		for i := 0; i < user.reached; i++ {
+			f.reached[i]--
+		}
+		for i, events := range user.events {
+			f.events[i] -= events
+		}
+		delete(f.users, userID)
+		f.changed = true
+	}
+}
+
+// state returns the state of the funnel with the rates computed like ComputeFunnel does
+func (f *liveFunnel) state(window time.Duration) *LiveFunnelState {
+	steps := f.funnel.Steps
+	state := &LiveFunnelState{
+		FunnelID:      f.funnel.ID,
+		FunnelName:    f.funnel.Name,
+		FunnelVersion: f.funnel.Version,
+		Steps:         make([]LiveFunnelStep, len(steps)),
+		WindowSeconds: int(window / time.Second),
+		DroppedUsers:  f.dropped,
+		LiveSince:     f.since,
+		UpdatedAt:     f.updatedAt,
+	}
+	if len(steps) == 0 {
+		return state
+	}
+
+	entered := f.reached[0]
+	for i, step := range steps {
+		result := StepResult{StepID: step.ID, StepName: step.Name, EventCount: f.events[i], UniqueUsers: f.reached[i]}
+		if i > 0 {
+			if previous := f.reached[i-1]; previous > 0 {
+				result.DropOffRate = float64(previous-f.reached[i]) / float64(previous) * 100
+			}
+			if entered > 0 {
+				result.ConversionRate = float64(f.reached[i]) / float64(entered) * 100
+			}
+		}
+		current := f.reached[i]
+		if i+1 < len(steps) {
+			current -= f.reached[i+1]
+		}
+		state.Steps[i] = LiveFunnelStep{StepResult: result, Current: current}
+	}
+	state.TotalUsers = entered
+	state.ConvertedUsers = f.reached[len(steps)-1]
+	if len(steps) > 1 && entered > 0 {
+		state.ConversionRate = float64(state.ConvertedUsers) / float64(entered) * 100
+	}
+	return state
+}
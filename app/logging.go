@@ -0,0 +1,63 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels, ordered from most to least verbose
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+var logLevelOrder = map[string]int32{
+	LogLevelDebug: 0,
+	LogLevelInfo:  1,
+	LogLevelWarn:  2,
+	LogLevelError: 3,
+}
+
+// currentLogLevel holds the active level as its numeric order
+var currentLogLevel atomic.Int32
+
+func init() {
+	level := strings.ToLower(os.Getenv("LOG_LEVEL"))
+	if _, ok := logLevelOrder[level]; !ok {
+		level = LogLevelInfo
+	}
+	currentLogLevel.Store(logLevelOrder[level])
+}
+
+// SetLogLevel changes the process-wide log level
+func SetLogLevel(level string) error {
+	order, ok := logLevelOrder[strings.ToLower(level)]
+	if !ok {
+		return fmt.Errorf("invalid log level: %s. Valid levels are: debug, info, warn, error", level)
+	}
+	currentLogLevel.Store(order)
+	return nil
+}
+
+// GetLogLevel returns the process-wide log level
+func GetLogLevel() string {
+	order := currentLogLevel.Load()
+	for level, value := range logLevelOrder {
+		if value == order {
+			return level
+		}
+	}
+	return LogLevelInfo
+}
+
+// debugf logs high-volume per-event messages that are only useful when debugging
+func debugf(format string, args ...interface{}) {
+	if currentLogLevel.Load() <= logLevelOrder[LogLevelDebug] {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,407 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// Protocols metrics are pushed with
+const (
+	MetricsPushPushgateway = "pushgateway"  // The text exposition format, PUT to a Prometheus Pushgateway
+	MetricsPushRemoteWrite = "remote_write" // Prometheus remote write, to Prometheus, Mimir, Thanos, VictoriaMetrics...
+)
+
+// MetricsPushStats reports how internal metrics are pushed
+type MetricsPushStats struct {
+	Enabled     bool       `json:"enabled"`
+	Endpoint    string     `json:"endpoint,omitempty"` // Scheme and host only, leaving out credentials
+	Protocol    string     `json:"protocol,omitempty"`
+	Interval    string     `json:"interval,omitempty"`
+	Job         string     `json:"job,omitempty"`
+	Instance    string     `json:"instance,omitempty"`
+	Pushed      int64      `json:"pushed"`
+	Failed      int64      `json:"failed"`
+	LastPushAt  *time.Time `json:"last_push_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// MetricsPusher periodically pushes the internal metrics served on /metrics, for deployments where
+// the service cannot be scraped
+type MetricsPusher struct {
+	url         string
+	endpoint    string
+	protocol    string
+	token       string // Sent as a bearer token, if set
+	job         string
+	instance    string
+	interval    time.Duration
+	gather      func(w io.Writer) error // Writes the metrics in the text exposition format
+	client      *http.Client
+	pushed      int64
+	failed      int64
+	lastPushAt  time.Time
+	lastError   string
+	lastErrorAt time.Time
+	mutex       sync.Mutex
+	stop        chan struct{}
+	stopOnce    sync.Once
+	done        sync.WaitGroup
+}
+
+// NewMetricsPusher creates a pusher of the metrics written by gather, configured from
+// METRICS_PUSH_URL, METRICS_PUSH_PROTOCOL, METRICS_PUSH_INTERVAL, METRICS_PUSH_JOB,
+// METRICS_PUSH_INSTANCE and METRICS_PUSH_TOKEN. Pushing is disabled when METRICS_PUSH_URL is unset
+// or the configuration is invalid.
+func NewMetricsPusher(gather func(w io.Writer) error) *MetricsPusher {
+	pusher := &MetricsPusher{
+		protocol: strings.ToLower(os.Getenv("METRICS_PUSH_PROTOCOL")),
+		token:    os.Getenv("METRICS_PUSH_TOKEN"),
+		job:      os.Getenv("METRICS_PUSH_JOB"),
+		instance: os.Getenv("METRICS_PUSH_INSTANCE"),
+		interval: getEnvDuration("METRICS_PUSH_INTERVAL", 15*time.Second),
+		gather:   gather,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		stop:     make(chan struct{}),
+	}
+	if pusher.protocol == "" {
+		pusher.protocol = MetricsPushPushgateway
+	}
+	if pusher.job == "" {
+		pusher.job = "analytics"
+	}
+	if pusher.instance == "" {
+		pusher.instance, _ = os.Hostname()
+	}
+
+	target := os.Getenv("METRICS_PUSH_URL")
+	if target == "" {
+		return pusher
+	}
+	if err := pusher.configure(target); err != nil {
+		log.Printf("Error: Metrics push is disabled: %v", err)
+		pusher.url = ""
+	}
+	return pusher
+}
+
+// configure validates the protocol, interval and grouping labels and the URL pushed to
+func (p *MetricsPusher) configure(target string) error {
+	if p.protocol != MetricsPushPushgateway && p.protocol != MetricsPushRemoteWrite {
+		return fmt.Errorf("invalid METRICS_PUSH_PROTOCOL: %s. Valid protocols are: %s, %s", p.protocol, MetricsPushPushgateway, MetricsPushRemoteWrite)
+	}
+	if p.interval <= 0 {
+		return fmt.Errorf("invalid METRICS_PUSH_INTERVAL: must be positive")
+	}
+	if p.instance == "" {
+		return fmt.Errorf("METRICS_PUSH_INSTANCE is required when the hostname is unknown")
+	}
+
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		return fmt.Errorf("invalid METRICS_PUSH_URL, expected https://host/path")
+	}
+	if parsed.Scheme == "http" {
+		log.Printf("Warning: Metrics are pushed without TLS")
+	}
+	p.endpoint = parsed.Scheme + "://" + parsed.Host
+
+	// Pushgateway groups pushed metrics by the labels in the path, replaced by every push
+	if p.protocol == MetricsPushPushgateway {
+		parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/metrics/job/" + url.PathEscape(p.job) + "/instance/" + url.PathEscape(p.instance)
+		parsed.RawPath = ""
+	}
+	p.url = parsed.String()
+	return nil
+}
+
+// Enabled reports whether metrics are pushed
+func (p *MetricsPusher) Enabled() bool {
+	return p.url != ""
+}
+
+// Start pushes the metrics every interval in the background until Stop is called
+func (p *MetricsPusher) Start() {
+	if !p.Enabled() {
+		return
+	}
+	log.Printf("Pushing metrics to %s with %s every %s", p.endpoint, p.protocol, p.interval)
+
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				if err := p.Push(); err != nil {
+					log.Printf("Warning: Failed to push metrics: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the background pushes, then pushes the final values of the metrics
+func (p *MetricsPusher) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		p.done.Wait()
+		if p.Enabled() {
+			if err := p.Push(); err != nil {
+				log.Printf("Warning: Failed to push final metrics: %v", err)
+			}
+		}
+	})
+}
+
+// Push gathers the metrics and pushes them once
+func (p *MetricsPusher) Push() error {
+	if !p.Enabled() {
+		return fmt.Errorf("metrics push is not configured")
+	}
+	err := p.push(time.Now())
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		p.failed++
+		p.lastError = err.Error()
+		p.lastErrorAt = time.Now()
+		return err
+	}
+	p.pushed++
+	p.lastPushAt = time.Now()
+	return nil
+}
+
+// push sends the metrics in the configured protocol, failing on responses other than 2xx
+func (p *MetricsPusher) push(now time.Time) error {
+	var exposition bytes.Buffer
+	if err := p.gather(&exposition); err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	method, body := http.MethodPut, exposition.Bytes()
+	if p.protocol == MetricsPushRemoteWrite {
+		samples, err := parseExposition(exposition.Bytes())
+		if err != nil {
+			return err
+		}
+		method, body = http.MethodPost, snappy.Encode(nil, encodeWriteRequest(samples, map[string]string{"job": p.job, "instance": p.instance}, now))
+	}
+
+	req, err := http.NewRequest(method, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if p.protocol == MetricsPushRemoteWrite {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	} else {
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("metrics endpoint responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Stats returns the configuration and push counters
+func (p *MetricsPusher) Stats() MetricsPushStats {
+	if !p.Enabled() {
+		return MetricsPushStats{}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats := MetricsPushStats{
+		Enabled:   true,
+		Endpoint:  p.endpoint,
+		Protocol:  p.protocol,
+		Interval:  p.interval.String(),
+		Job:       p.job,
+		Instance:  p.instance,
+		Pushed:    p.pushed,
+		Failed:    p.failed,
+		LastError: p.lastError,
+	}
+	if !p.lastPushAt.IsZero() {
+		lastPushAt := p.lastPushAt
+		stats.LastPushAt = &lastPushAt
+	}
+	if !p.lastErrorAt.IsZero() {
+		lastErrorAt := p.lastErrorAt
+		stats.LastErrorAt = &lastErrorAt
+	}
+	return stats
+}
+
+// WriteMetrics writes the push counters in the Prometheus text exposition format
+func (p *MetricsPusher) WriteMetrics(w io.Writer) error {
+	stats := p.Stats()
+	_, err := fmt.Fprintf(w, "# HELP analytics_metrics_pushes_total Pushes of the internal metrics by outcome.\n# TYPE analytics_metrics_pushes_total counter\n"+
+		"analytics_metrics_pushes_total{outcome=\"pushed\"} %d\nanalytics_metrics_pushes_total{outcome=\"failed\"} %d\n",
+		stats.Pushed, stats.Failed)
+	return err
+}
+
+// metricSample is a sample of the text exposition format
+type metricSample struct {
+	labels map[string]string // Including the metric name as __name__
+	value  float64
+}
+
+// parseExposition parses the samples of the text exposition format, skipping comments
+func parseExposition(data []byte) ([]metricSample, error) {
+	var samples []metricSample
+	for number, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sample, err := parseSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metrics line %d: %w", number+1, err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+// parseSample parses a `name{label="value",...} value` line
+func parseSample(line string) (metricSample, error) {
+	sample := metricSample{labels: make(map[string]string)}
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return sample, fmt.Errorf("missing value")
+	}
+	sample.labels["__name__"] = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for {
+			rest = strings.TrimLeft(rest, " ,")
+			if strings.HasPrefix(rest, "}") {
+				rest = rest[1:]
+				break
+			}
+			equals := strings.Index(rest, `="`)
+			if equals <= 0 {
+				return sample, fmt.Errorf("malformed labels")
+			}
+			name := strings.TrimSpace(rest[:equals])
+			rest = rest[equals+2:]
+
+			var value strings.Builder
+			closed := false
+			for i := 0; i < len(rest); i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+					if rest[i] == 'n' {
+						value.WriteByte('\n')
+					} else {
+						value.WriteByte(rest[i])
+					}
+					continue
+				}
+				if rest[i] == '"' {
+					rest = rest[i+1:]
+					closed = true
+					break
+				}
+				value.WriteByte(rest[i])
+			}
+			if !closed {
+				return sample, fmt.Errorf("unterminated label value")
+			}
+			sample.labels[name] = value.String()
+		}
+	}
+
+	// A timestamp may follow the value, pushes are stamped with their own time instead
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return sample, fmt.Errorf("missing value")
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("invalid value %q", fields[0])
+	}
+	sample.value = value
+	return sample, nil
+}
+
+// encodeWriteRequest encodes samples taken at a time as a remote write WriteRequest protobuf, with
+// extra labels added to every series
+func encodeWriteRequest(samples []metricSample, extra map[string]string, at time.Time) []byte {
+	var request []byte
+	for _, sample := range samples {
+		labels := make(map[string]string, len(sample.labels)+len(extra))
+		for name, value := range extra {
+			labels[name] = value
+		}
+		for name, value := range sample.labels {
+			labels[name] = value
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names) // Remote write requires labels sorted by name
+
+		var series []byte
+		for _, name := range names {
+			var label []byte
+			label = appendProtoBytes(label, 1, []byte(name))
+			label = appendProtoBytes(label, 2, []byte(labels[name]))
+			series = appendProtoBytes(series, 1, label)
+		}
+		var point []byte
+		point = binary.AppendUvarint(point, 1<<3|1) // value, 64-bit
+		point = binary.LittleEndian.AppendUint64(point, math.Float64bits(sample.value))
+		point = binary.AppendUvarint(point, 2<<3|0) // timestamp, varint
+		point = binary.AppendUvarint(point, uint64(at.UnixMilli()))
+		series = appendProtoBytes(series, 2, point)
+
+		request = appendProtoBytes(request, 1, series)
+	}
+	return request
+}
+
+// appendProtoBytes appends a length-delimited protobuf field
+func appendProtoBytes(buf []byte, field int, value []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field)<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
@@ -3,23 +3,38 @@ package app
 import (
 	"context"
 	"log"
+	"math"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 )
 
 // APITrackingMiddleware tracks all API requests for billing purposes
 type APITrackingMiddleware struct {
 	analyticsService *AnalyticsService
+	workers          *WorkerPool      // Runs usage tracking off the request path
+	anonymous        *AnonymousPolicy  // Decides whether requests without a user ID are served and billed
+	usage            APIUsagePublisher // Receives a usage record of every request
+	keyUsage         *APIKeyUsage      // Counts the requests of every API key
 }
 
 // NewAPITrackingMiddleware creates a new API tracking middleware
-func NewAPITrackingMiddleware(analyticsService *AnalyticsService) *APITrackingMiddleware {
+func NewAPITrackingMiddleware(analyticsService *AnalyticsService, workers *WorkerPool, anonymous *AnonymousPolicy, usage APIUsagePublisher, keyUsage *APIKeyUsage) *APITrackingMiddleware {
 	return &APITrackingMiddleware{
 		analyticsService: analyticsService,
+		workers:          workers,
+		anonymous:        anonymous,
+		usage:            usage,
+		keyUsage:         keyUsage,
 	}
 }
 
+// APIKeyRequestsLocal is the request local holding the requests of the request's API key today
+const APIKeyRequestsLocal = "api_key_requests"
+
 // TrackAPIUsage is the middleware function that tracks API usage
 func (m *APITrackingMiddleware) TrackAPIUsage() fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -29,12 +44,9 @@ func (m *APITrackingMiddleware) TrackAPIUsage() fiber.Handler {
 		userID := c.Get("X-User-ID")
 		apiKey := c.Get("X-API-Key")
 
-		// If no user ID in header, try to get from query params or generate anonymous ID
+		// If no user ID in header, try to get from query params
 		if userID == "" {
 			userID = c.Query("user_id")
-			if userID == "" {
-				userID = "anonymous" // Default for unauthenticated requests
-			}
 		}
 
 		// If no API key, try to get from query params
@@ -42,45 +54,90 @@ func (m *APITrackingMiddleware) TrackAPIUsage() fiber.Handler {
 			apiKey = c.Query("api_key")
 		}
 
-		// Create metadata for billing
-		metadata := map[string]interface{}{
-			"method":      c.Method(),
-			"path":        c.Path(),
-			"user_agent":  c.Get("User-Agent"),
-			"ip_address":  c.IP(),
-			"timestamp":   start,
-			"api_key":     apiKey,
-			"status_code": 0, // Will be updated after response
+		// Copy request values, the fiber context is reused once the handler returns
+		userID = utils.CopyString(userID)
+		apiKey = utils.CopyString(apiKey)
+		path := utils.CopyString(c.Path())
+		method := utils.CopyString(c.Method())
+		projectID := projectIDFromRequest(c)
+
+		// Count the key's requests for quota checks further down the chain
+		if apiKey != "" {
+			c.Locals(APIKeyRequestsLocal, m.keyUsage.Record(apiKey))
 		}
 
-		// Track the API usage asynchronously to avoid blocking the request
-		go func() {
-			ctx := context.Background()
-			if err := m.analyticsService.TrackAPIUsage(ctx, userID, c.Path(), c.Method(), metadata); err != nil {
-				log.Printf("Warning: Failed to track API usage: %v", err)
-			}
-		}()
+		// Apply the anonymous-user policy of the route group; unauthenticated requests are
+		// rejected, billed to the project owner or served without billing
+		billedUserID, err := m.anonymous.Admit(path, projectID, userID)
+		if err != nil {
+			err = c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+			m.publish(c, projectID, userID, "", apiKey, start)
+			return err
+		}
+		if billedUserID == "" {
+			err = c.Next()
+			m.publish(c, projectID, userID, "", apiKey, start)
+			return err
+		}
 
 		// Process the request
-		err := c.Next()
-
-		// Update metadata with response information
-		metadata["status_code"] = c.Response().StatusCode()
-		metadata["response_time_ms"] = time.Since(start).Milliseconds()
-		metadata["response_size"] = len(c.Response().Body())
+		err = c.Next()
 
-		// Track the completed request with response data
-		go func() {
-			ctx := context.Background()
-			if err := m.analyticsService.TrackAPIUsage(ctx, userID, c.Path(), c.Method(), metadata); err != nil {
-				log.Printf("Warning: Failed to track completed API usage: %v", err)
-			}
-		}()
+		// Bill the request once it completed, with its response information, under a correlation ID
+		// of its own, so retried deliveries of the same request are billed once
+		metadata := map[string]interface{}{
+			"method":           method,
+			"path":             path,
+			"user_agent":       utils.CopyString(c.Get("User-Agent")),
+			"ip_address":       utils.CopyString(c.IP()),
+			"timestamp":        start,
+			"api_key":          apiKey,
+			"status_code":      c.Response().StatusCode(),
+			"response_time_ms": time.Since(start).Milliseconds(),
+			"response_size":    len(c.Response().Body()),
+		}
+		m.track(m.analyticsService.NewID(), billedUserID, path, method, metadata)
+		m.publish(c, projectID, userID, billedUserID, apiKey, start)
 
 		return err
 	}
 }
 
+// publish sends the usage record of a completed request to the API metrics
+func (m *APITrackingMiddleware) publish(c *fiber.Ctx, projectID, userID, billedUserID, apiKey string, start time.Time) {
+	record := &APIUsageRecord{
+		ProjectID:      projectID,
+		UserID:         userID,
+		BilledUserID:   billedUserID,
+		Method:         utils.CopyString(c.Method()),
+		Route:          utils.CopyString(c.Route().Path),
+		Path:           utils.CopyString(c.Path()),
+		StatusCode:     c.Response().StatusCode(),
+		ResponseTimeMs: time.Since(start).Milliseconds(),
+		ResponseSize:   int64(len(c.Response().Body())),
+		IPAddress:      utils.CopyString(c.IP()),
+		Timestamp:      start,
+	}
+	if apiKey != "" {
+		record.APIKeyID = APIKeyID(apiKey)
+	}
+	m.usage.Publish(record)
+}
+
+// track submits a usage tracking task to the worker pool, dropping it if the queue is full
+func (m *APITrackingMiddleware) track(correlationID, userID, path, method string, metadata map[string]interface{}) {
+	queued := m.workers.TrySubmit(func() {
+		if err := m.analyticsService.TrackCorrelatedAPIUsage(context.Background(), correlationID, userID, path, method, metadata); err != nil {
+			log.Printf("Warning: Failed to track API usage: %v", err)
+		}
+	})
+	if !queued {
+		log.Printf("Warning: Tracking queue is full, dropping usage record for %s %s", method, path)
+	}
+}
+
 // RateLimitMiddleware implements basic rate limiting
 type RateLimitMiddleware struct {
 	analyticsService *AnalyticsService
@@ -89,28 +146,54 @@ type RateLimitMiddleware struct {
 
 // NewRateLimitMiddleware creates a new rate limiting middleware
 func NewRateLimitMiddleware(analyticsService *AnalyticsService) *RateLimitMiddleware {
+	rateLimiter := NewRateLimiter()
+	rateLimiter.SetClock(analyticsService.Clock())
+	rateLimiter.SetPlans(analyticsService.Plans())
+
 	return &RateLimitMiddleware{
 		analyticsService: analyticsService,
-		rateLimiter:      NewRateLimiter(),
+		rateLimiter:      rateLimiter,
 	}
 }
 
-// RateLimit is the middleware function that implements rate limiting
-func (m *RateLimitMiddleware) RateLimit() fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		userID := c.Get("X-User-ID")
+// RateLimiter returns the limiter the middleware applies
+func (m *RateLimitMiddleware) RateLimiter() *RateLimiter {
+	return m.rateLimiter
+}
+
+// rateLimitedUserID returns the user a request is rate limited and sampled for, from the
+// X-User-ID header or user_id query parameter
+func rateLimitedUserID(c *fiber.Ctx) string {
+	userID := c.Get("X-User-ID")
+	if userID == "" {
+		userID = c.Query("user_id")
 		if userID == "" {
-			userID = c.Query("user_id")
-			if userID == "" {
-				userID = "anonymous"
-			}
+			userID = AnonymousUserID
 		}
+	}
+	return userID
+}
+
+// RateLimit is the middleware function that implements rate limiting. Responses carry the
+// caller's limit on the endpoint in X-RateLimit-Limit, the requests left in X-RateLimit-Remaining
+// and when the window frees up in X-RateLimit-Reset (Unix seconds).
+func (m *RateLimitMiddleware) RateLimit() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := rateLimitedUserID(c)
 
 		// Check if user has exceeded rate limit
-		if !m.rateLimiter.AllowRequest(userID, c.Path()) {
+		allowed, status := m.rateLimiter.Allow(userID, c.Path())
+		c.Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+		c.Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+		c.Set("X-RateLimit-Reset", strconv.FormatInt(status.ResetAt.Unix(), 10))
+		if !allowed {
+			retryAfter := max(int(math.Ceil(status.ResetAt.Sub(m.analyticsService.Clock().Now()).Seconds())), 1)
+			c.Set("Retry-After", strconv.Itoa(retryAfter))
 			return c.Status(429).JSON(fiber.Map{
-				"error": "Rate limit exceeded",
-				"retry_after": 60, // Retry after 1 minute
+				"error":       "Rate limit exceeded",
+				"retry_after": retryAfter,
+				"limit":       status.Limit,
+				"tier":        status.Tier,
 			})
 		}
 
@@ -132,16 +215,15 @@ func NewSamplingMiddleware(analyticsService *AnalyticsService) *SamplingMiddlewa
 	}
 }
 
+// Sampler returns the sampler the middleware applies
+func (m *SamplingMiddleware) Sampler() *RequestSampler {
+	return m.sampler
+}
+
 // Sample is the middleware function that implements request sampling
 func (m *SamplingMiddleware) Sample() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		userID := c.Get("X-User-ID")
-		if userID == "" {
-			userID = c.Query("user_id")
-			if userID == "" {
-				userID = "anonymous"
-			}
-		}
+		userID := rateLimitedUserID(c)
 
 		// Check if this request should be sampled
 		if !m.sampler.ShouldSample(userID, c.Path()) {
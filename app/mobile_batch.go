@@ -0,0 +1,234 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MobileBatch is the envelope mobile SDKs use to deliver events queued while offline
+type MobileBatch struct {
+	BatchID string                   `json:"batch_id"` // Generated by the SDK and kept across retries
+	SentAt  interface{}              `json:"sent_at"`  // Device time of sending, applied to events without their own
+	UserID  string                   `json:"user_id"`  // Default for events without their own
+	Context map[string]interface{}   `json:"context"`  // Device context merged into each event's properties
+	Events  []map[string]interface{} `json:"events"`
+}
+
+// MobileBatchEventResult is the outcome of a single event of a batch
+type MobileBatchEventResult struct {
+	Index        int    `json:"index"`
+	EventID      string `json:"event_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Dropped      bool   `json:"dropped,omitempty"`       // Over its event type's daily quota; Error has the reason
+	QuarantineID string `json:"quarantine_id,omitempty"` // Kept in the project's quarantine; Error has the reason
+}
+
+// MobileBatchResult is the outcome of a batch. Retries of a batch get the result of its first delivery.
+type MobileBatchResult struct {
+	BatchID     string                   `json:"batch_id"`
+	ReceivedAt  time.Time                `json:"received_at"`
+	Accepted    int                      `json:"accepted"`
+	Rejected    int                      `json:"rejected"`
+	Dropped     int                      `json:"dropped"`     // Over their event type's daily quota, not to be retried
+	Quarantined int                      `json:"quarantined"` // Failed validation and kept for re-validation, not to be retried
+	Results     []MobileBatchEventResult `json:"results"`
+
+	events   []*AnalyticsEvent // Tracked events
+	outcomes []string          // Traffic outcome of every event of the batch
+}
+
+// Events returns the events tracked from the batch
+func (r *MobileBatchResult) Events() []*AnalyticsEvent {
+	return r.events
+}
+
+// Outcomes returns the traffic outcome of every event of the batch, in order
+func (r *MobileBatchResult) Outcomes() []string {
+	return r.outcomes
+}
+
+// BatchInProgressError is returned when a retry arrives while the batch is still being processed
+type BatchInProgressError struct {
+	BatchID string
+}
+
+// Error describes the batch being processed
+func (e *BatchInProgressError) Error() string {
+	return fmt.Sprintf("batch %s is still being processed; retry later", e.BatchID)
+}
+
+// mobileBatchEntry is a batch seen within the deduplication window
+type mobileBatchEntry struct {
+	result *MobileBatchResult // nil while the batch is being processed
+}
+
+// MobileBatchLog remembers the batches received within the deduplication window, so batches
+// retried after a lost response are not tracked twice
+type MobileBatchLog struct {
+	maxEvents int
+	batches   *BoundedCache // Project and batch ID -> entry
+	mutex     sync.Mutex
+}
+
+// NewMobileBatchLog creates a batch log configured from MOBILE_BATCH_DEDUP_WINDOW,
+// MOBILE_BATCH_MAX_EVENTS and MOBILE_BATCH_DEDUP_MAX_ENTRIES (default 100000). When more batches
+// arrive within the window, the least recently seen ones are forgotten first.
+func NewMobileBatchLog() *MobileBatchLog {
+	return &MobileBatchLog{
+		maxEvents: getEnvInt("MOBILE_BATCH_MAX_EVENTS", 500),
+		batches:   NewBoundedCache("mobile_batch_dedup", getEnvInt("MOBILE_BATCH_DEDUP_MAX_ENTRIES", 100000), getEnvDuration("MOBILE_BATCH_DEDUP_WINDOW", 24*time.Hour)),
+	}
+}
+
+// MaxEvents returns the maximum number of events per batch
+func (l *MobileBatchLog) MaxEvents() int {
+	return l.maxEvents
+}
+
+// Cache returns the cache of recent batches
+func (l *MobileBatchLog) Cache() *BoundedCache {
+	return l.batches
+}
+
+// begin registers a batch. It returns the result of an earlier delivery of the batch, or a
+// BatchInProgressError while that delivery is still being processed.
+func (l *MobileBatchLog) begin(projectID, batchID string) (*MobileBatchResult, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	key := projectID + "/" + batchID
+	if value, exists := l.batches.Get(key); exists {
+		entry := value.(*mobileBatchEntry)
+		if entry.result == nil {
+			return nil, &BatchInProgressError{BatchID: batchID}
+		}
+		return entry.result, nil
+	}
+
+	l.batches.Set(key, &mobileBatchEntry{})
+	return nil, nil
+}
+
+// finish stores the result of a batch for its retries
+func (l *MobileBatchLog) finish(projectID string, result *MobileBatchResult) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if value, exists := l.batches.Peek(projectID + "/" + result.BatchID); exists {
+		value.(*mobileBatchEntry).result = result
+	}
+}
+
+// TrackMobileBatch tracks the events of a mobile batch. It reports whether the batch is a retry of
+// a batch already tracked, in which case the first delivery's result is returned. Invalid events
+// are reported in the result without failing the others.
+func (s *AnalyticsService) TrackMobileBatch(ctx context.Context, batch MobileBatch, apiKey string) (*MobileBatchResult, bool, error) {
+	if err := validateResourceID(batch.BatchID); err != nil {
+		return nil, false, fmt.Errorf("invalid batch_id: %w", err)
+	}
+	if len(batch.Events) == 0 {
+		return nil, false, fmt.Errorf("events is required")
+	}
+	if len(batch.Events) > s.mobileBatches.MaxEvents() {
+		return nil, false, fmt.Errorf("at most %d events can be sent in a batch", s.mobileBatches.MaxEvents())
+	}
+
+	projectID := ProjectFromContext(ctx)
+	receivedAt := s.clock.Now()
+	previous, err := s.mobileBatches.begin(projectID, batch.BatchID)
+	if err != nil {
+		return nil, false, err
+	}
+	if previous != nil {
+		return previous, true, nil
+	}
+
+	deviceContext := flattenDeviceContext(batch.Context)
+	result := &MobileBatchResult{
+		BatchID:    batch.BatchID,
+		ReceivedAt: receivedAt,
+		Results:    make([]MobileBatchEventResult, len(batch.Events)),
+	}
+	for i, eventData := range batch.Events {
+		result.Results[i].Index = i
+
+		data := mobileEventData(eventData, batch, deviceContext)
+		event, err := s.TrackEvent(ctx, data, apiKey, s.getStringValue(data, "user_id"))
+		result.outcomes = append(result.outcomes, TrafficOutcome(err))
+		var overQuota *QuotaExceededError
+		if errors.As(err, &overQuota) {
+			result.Results[i].Error = err.Error()
+			result.Results[i].Dropped = true
+			result.Dropped++
+			continue
+		}
+		var quarantined *QuarantinedError
+		if errors.As(err, &quarantined) {
+			result.Results[i].Error = err.Error()
+			result.Results[i].QuarantineID = quarantined.QuarantineID
+			result.Quarantined++
+			continue
+		}
+		if err != nil {
+			result.Results[i].Error = err.Error()
+			result.Rejected++
+			continue
+		}
+		result.Results[i].EventID = event.ID
+		result.Accepted++
+		result.events = append(result.events, event)
+	}
+
+	s.mobileBatches.finish(projectID, result)
+	return result, false, nil
+}
+
+// mobileEventData fills in the batch's defaults and device context for one of its events
+func mobileEventData(eventData map[string]interface{}, batch MobileBatch, deviceContext map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(eventData)+2)
+	for key, value := range eventData {
+		data[key] = value
+	}
+	if _, exists := data["user_id"]; !exists && batch.UserID != "" {
+		data["user_id"] = batch.UserID
+	}
+	if _, exists := data["sent_at"]; !exists && batch.SentAt != nil {
+		data["sent_at"] = batch.SentAt
+	}
+
+	if len(deviceContext) > 0 {
+		properties := make(map[string]interface{}, len(deviceContext))
+		for key, value := range deviceContext {
+			properties[key] = value
+		}
+		// The event's own properties win over the device context
+		if own, ok := eventData["properties"].(map[string]interface{}); ok {
+			for key, value := range own {
+				properties[key] = value
+			}
+		}
+		data["properties"] = properties
+	}
+	return data
+}
+
+// flattenDeviceContext turns a nested device context block into flat properties,
+// e.g. {"device": {"model": "Pixel 8"}} into {"device.model": "Pixel 8"}
+func flattenDeviceContext(deviceContext map[string]interface{}) map[string]interface{} {
+	flat := make(map[string]interface{})
+	var flatten func(prefix string, values map[string]interface{})
+	flatten = func(prefix string, values map[string]interface{}) {
+		for key, value := range values {
+			if nested, ok := value.(map[string]interface{}); ok {
+				flatten(prefix+key+".", nested)
+				continue
+			}
+			flat[prefix+key] = value
+		}
+	}
+	flatten("", deviceContext)
+	return flat
+}
@@ -0,0 +1,110 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// decompressedBody returns the request body, decompressed when sent with Content-Encoding: gzip.
+// Decompressed bodies larger than maxBytes are rejected. The raw body is read instead of
+// c.Body(), which would decompress it without a size limit.
+func decompressedBody(c *fiber.Ctx, maxBytes int) ([]byte, error) {
+	body := c.Request().Body()
+	if !strings.EqualFold(c.Get(fiber.HeaderContentEncoding), "gzip") {
+		if len(body) > maxBytes {
+			return nil, fmt.Errorf("body exceeds %d bytes", maxBytes)
+		}
+		return body, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %w", err)
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(reader, int64(maxBytes)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip body: %w", err)
+	}
+	if len(decompressed) > maxBytes {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", maxBytes)
+	}
+	return decompressed, nil
+}
+
+// trackMobileBatch tracks a batch of events queued by a mobile SDK. Retried batches are
+// answered with the result of their first delivery without tracking the events again.
+func (s *App) trackMobileBatch(c *fiber.Ctx) error {
+	apiKey := utils.CopyString(c.Get("X-API-Key"))
+	if apiKey == "" {
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+			"error": "API key is required",
+		})
+	}
+
+	body, err := decompressedBody(c, s.mobileBatchMaxBytes)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	var batch MobileBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		s.observeTraffic(c, TrafficMalformed)
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	result, duplicate, err := s.analyticsService.TrackMobileBatch(ctx, batch, apiKey)
+	if err != nil {
+		var inProgress *BatchInProgressError
+		if errors.As(err, &inProgress) {
+			return c.Status(http.StatusConflict).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		s.observeTraffic(c, TrafficMalformed)
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Retries are counted as received, whatever the first delivery's outcome
+	for i := range batch.Events {
+		outcome := TrafficReceived
+		if !duplicate && i < len(result.Outcomes()) {
+			outcome = result.Outcomes()[i]
+		}
+		s.observeTraffic(c, outcome)
+	}
+
+	status := "success"
+	if result.Rejected > 0 || result.Quarantined > 0 {
+		status = "partial"
+	}
+
+	return c.JSON(fiber.Map{
+		"status":      status,
+		"batch_id":    result.BatchID,
+		"duplicate":   duplicate,
+		"received_at": result.ReceivedAt,
+		"accepted":    result.Accepted,
+		"rejected":    result.Rejected,
+		"dropped":     result.Dropped,
+		"quarantined": result.Quarantined,
+		"results":     result.Results,
+	})
+}
@@ -8,17 +8,51 @@ import (
 
 // AnalyticsEvent represents an analytics event that needs to be tracked
 type AnalyticsEvent struct {
-	ID             string                 `json:"id"`
-	EventType      string                 `json:"event_type"`
-	UserID         string                 `json:"user_id"`
+	ID        string `json:"id"`
+	ProjectID string `json:"project_id,omitempty"`
+	Region    string `json:"region,omitempty"` // Region whose store holds the event
+	EventType string `json:"event_type"`
+	UserID    string `json:"user_id"`
+	// User ID the event was sent with, when it was merged into UserID by identity resolution
+	OriginalUserID string                 `json:"original_user_id,omitempty"`
 	Page           string                 `json:"page,omitempty"`
+	SessionID      string                 `json:"session_id,omitempty"` // As sent by the client, shared by web and server-side events
 	Timestamp      time.Time              `json:"timestamp"`
+	ReceivedAt     time.Time              `json:"received_at"`
 	Properties     map[string]interface{} `json:"properties,omitempty"`
-	APIKey         string                 `json:"api_key"`
-	BillingEventID string                 `json:"billing_event_id,omitempty"`
-	Source         string                 `json:"source,omitempty"`
+	APIKeyID       string                 `json:"api_key_id,omitempty"` // Fingerprint of the API key, never the key itself
+	// Sent with the billing records of the event, for reconciliation with the billing service
+	BillingCorrelationID string `json:"billing_correlation_id,omitempty"`
+	BillingStatus        string `json:"billing_status,omitempty"` // BillingRecorded or BillingFailed
+	Source               string `json:"source,omitempty"`
+	// Set when only a sample of the event type is stored in full detail
+	DetailSampleRate float64 `json:"detail_sample_rate,omitempty"`
+	DetailDropped    bool    `json:"detail_dropped,omitempty"` // Properties were not stored
+	// Set when the event was kept by sampling after its type exceeded its daily quota
+	QuotaSampleRate float64 `json:"quota_sample_rate,omitempty"`
+	// Set when the event's type is aggregation-only: it was counted, but not stored
+	Aggregated bool `json:"aggregated,omitempty"`
+	// Properties whose value was replaced by a hash bucket by the cardinality guard
+	LimitedProperties []string `json:"limited_properties,omitempty"`
+	// Set when the event arrived after the bucket holding its timestamp closed
+	Late bool `json:"late,omitempty"`
+	// Set when the event was accepted into the ingestion log while the event store was down, and
+	// is stored once it recovers
+	Queued bool `json:"queued,omitempty"`
+	// Raw client times; Timestamp is ClientTimestamp corrected by the device's clock skew
+	ClientTimestamp *time.Time `json:"client_timestamp,omitempty"`
+	SentAt          *time.Time `json:"sent_at,omitempty"`
+	ClockSkewMs     int64      `json:"clock_skew_ms,omitempty"` // Server clock minus device clock
+	// Properties merged in from the context of the event's session when it was read
+	InheritedProperties []string `json:"inherited_properties,omitempty"`
 }
 
+// Billing statuses of an event
+const (
+	BillingRecorded = "recorded" // The billing service accepted the event's records
+	BillingFailed   = "failed"   // Sending the records failed; reconcile by correlation ID
+)
+
 // CrossServiceEvent represents events from other services (billing, auth, payments, etc.)
 type CrossServiceEvent struct {
 	ID            string                 `json:"id"`
@@ -37,6 +71,16 @@ type UsageSummary struct {
 	EventsByType   map[string]int64 `json:"events_by_type"`
 	BillingSummary BillingSummary   `json:"billing_summary"`
 	Period         UsagePeriod      `json:"period"`
+	// Usage per value of a custom dimension, when broken down
+	Breakdown []DimensionUsage `json:"breakdown,omitempty"`
+}
+
+// DimensionUsage is the usage of the events with one value of a custom dimension
+type DimensionUsage struct {
+	Value        string           `json:"value"`
+	TotalEvents  int64            `json:"total_events"`
+	EventsByType map[string]int64 `json:"events_by_type"`
+	TotalCost    float64          `json:"total_cost"`
 }
 
 // BillingSummary represents billing information for usage
@@ -44,6 +88,8 @@ type BillingSummary struct {
 	TotalCost     float64            `json:"total_cost"`
 	CostBreakdown map[string]float64 `json:"cost_breakdown"`
 	Currency      string             `json:"currency"`
+	BaseTotalCost float64            `json:"base_total_cost,omitempty"` // Total cost in USD when converted
+	ExchangeRate  float64            `json:"exchange_rate,omitempty"`   // Rate from USD when converted
 }
 
 // UsagePeriod represents the time period for usage queries
@@ -63,6 +109,40 @@ type BillingEvent struct {
 	Description string    `json:"description"`
 }
 
+// EventFilter narrows down stored analytics events. Zero values match everything.
+type EventFilter struct {
+	ProjectID string
+	UserID    string
+	EventType string
+	Page      string
+	Start     time.Time
+	End       time.Time
+	Sample    float64 // Share of users whose events match, every user when 0 or 1
+}
+
+// Matches reports whether the event satisfies the filter
+func (f EventFilter) Matches(event *AnalyticsEvent) bool {
+	if f.ProjectID != "" && projectOrDefault(event.ProjectID) != f.ProjectID {
+		return false
+	}
+	if f.UserID != "" && event.UserID != f.UserID {
+		return false
+	}
+	if f.EventType != "" && event.EventType != f.EventType {
+		return false
+	}
+	if f.Page != "" && event.Page != f.Page {
+		return false
+	}
+	if !f.Start.IsZero() && event.Timestamp.Before(f.Start) {
+		return false
+	}
+	if !f.End.IsZero() && !event.Timestamp.Before(f.End) {
+		return false
+	}
+	return inQuerySample(event, f.Sample)
+}
+
 // NewAnalyticsEvent creates a new analytics event with a unique ID
 func NewAnalyticsEvent(eventType, userID, page, apiKey string, properties map[string]interface{}) *AnalyticsEvent {
 	return &AnalyticsEvent{
@@ -72,11 +152,19 @@ func NewAnalyticsEvent(eventType, userID, page, apiKey string, properties map[st
 		Page:       page,
 		Timestamp:  time.Now(),
 		Properties: properties,
-		APIKey:     apiKey,
+		APIKeyID:   eventAPIKeyID(apiKey),
 		Source:     "analytics",
 	}
 }
 
+// eventAPIKeyID returns the APIKeyID events keep of the API key they were sent with, "" without one
+func eventAPIKeyID(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	return APIKeyID(apiKey)
+}
+
 // NewCrossServiceEvent creates a new cross-service event
 func NewCrossServiceEvent(source, eventType, userID string, data map[string]interface{}) *CrossServiceEvent {
 	return &CrossServiceEvent{
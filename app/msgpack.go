@@ -0,0 +1,296 @@
+package app
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// The MessagePack encoding covers the values JSON can hold, so the binary dashboard protocol
+// carries the same messages as the JSON one. Times are strings in both.
+
+// MsgpackFromJSON re-encodes a JSON document as MessagePack. Integers are encoded in the smallest
+// integer format holding them, other numbers as float64, and map keys are sorted.
+func MsgpackFromJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(make([]byte, 0, len(data)), value)
+}
+
+// appendMsgpack appends the MessagePack encoding of a value decoded from JSON
+func appendMsgpack(b []byte, value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if value {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return appendMsgpackInt(b, integer), nil
+		}
+		number, err := value.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgpackFloat(b, number), nil
+	case float64:
+		return appendMsgpackFloat(b, value), nil
+	case string:
+		return appendMsgpackString(b, value), nil
+	case []interface{}:
+		b = appendMsgpackLength(b, len(value), 0x90, 16, 0xdc)
+		var err error
+		for _, item := range value {
+			if b, err = appendMsgpack(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b = appendMsgpackLength(b, len(value), 0x80, 16, 0xde)
+		var err error
+		for _, key := range keys {
+			b = appendMsgpackString(b, key)
+			if b, err = appendMsgpack(b, value[key]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("%T values cannot be encoded as MessagePack", value)
+}
+
+// appendMsgpackInt appends an integer in the smallest format holding it
+func appendMsgpackInt(b []byte, value int64) []byte {
+	switch {
+	case value >= 0 && value <= math.MaxInt8:
+		return append(b, byte(value)) // Positive fixint
+	case value >= -32 && value < 0:
+		return append(b, byte(value)) // Negative fixint
+	case value >= 0 && value <= math.MaxUint8:
+		return append(b, 0xcc, byte(value))
+	case value >= 0 && value <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(value))
+	case value >= 0 && value <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(value))
+	case value >= 0:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(value))
+	case value >= math.MinInt8:
+		return append(b, 0xd0, byte(value))
+	case value >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(value))
+	case value >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(value))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(value))
+}
+
+// appendMsgpackFloat appends a float64
+func appendMsgpackFloat(b []byte, value float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(value))
+}
+
+// appendMsgpackString appends a UTF-8 string
+func appendMsgpackString(b []byte, value string) []byte {
+	if len(value) < 32 {
+		b = append(b, 0xa0|byte(len(value)))
+	} else if len(value) <= math.MaxUint8 {
+		b = append(b, 0xd9, byte(len(value)))
+	} else {
+		b = appendMsgpackLength(b, len(value), 0, 0, 0xda)
+	}
+	return append(b, value...)
+}
+
+// appendMsgpackLength appends the header of an array, map or string of a length: the fixed
+// format below fixedLimit, otherwise the 16-bit format or the 32-bit one that follows it
+func appendMsgpackLength(b []byte, length int, fixed byte, fixedLimit int, format16 byte) []byte {
+	switch {
+	case length < fixedLimit:
+		return append(b, fixed|byte(length))
+	case length <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, format16), uint16(length))
+	}
+	return binary.BigEndian.AppendUint32(append(b, format16+1), uint32(length))
+}
+
+// DecodeMsgpack decodes a MessagePack document into the values encoding/json decodes JSON
+// into: numbers are float64, binary data is a string and map keys must be strings
+func DecodeMsgpack(data []byte) (interface{}, error) {
+	decoder := &msgpackDecoder{data: data}
+	value, err := decoder.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.offset != len(data) {
+		return nil, fmt.Errorf("unexpected data after the MessagePack value")
+	}
+	return value, nil
+}
+
+// Nesting of MessagePack arrays and maps accepted from clients
+const maxMsgpackDepth = 32
+
+// msgpackDecoder reads MessagePack values from a buffer
+type msgpackDecoder struct {
+	data   []byte
+	offset int
+}
+
+// value decodes the next value
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, fmt.Errorf("MessagePack values are nested too deeply")
+	}
+	format, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	code := format[0]
+	switch {
+	case code <= 0x7f:
+		return float64(code), nil
+	case code >= 0xe0:
+		return float64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return d.mapOf(int(code&0x0f), depth)
+	case code&0xf0 == 0x90:
+		return d.arrayOf(int(code&0x0f), depth)
+	case code&0xe0 == 0xa0:
+		return d.stringOf(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		return d.sized(1, d.stringOf)
+	case 0xc5, 0xda:
+		return d.sized(2, d.stringOf)
+	case 0xc6, 0xdb:
+		return d.sized(4, d.stringOf)
+	case 0xca:
+		bits, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := d.uint(8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, err := d.uint(1 << (code - 0xcc))
+		return float64(value), err
+	case 0xd0:
+		value, err := d.uint(1)
+		return float64(int8(value)), err
+	case 0xd1:
+		value, err := d.uint(2)
+		return float64(int16(value)), err
+	case 0xd2:
+		value, err := d.uint(4)
+		return float64(int32(value)), err
+	case 0xd3:
+		value, err := d.uint(8)
+		return float64(int64(value)), err
+	case 0xdc:
+		return d.sized(2, func(length int) (interface{}, error) { return d.arrayOf(length, depth) })
+	case 0xdd:
+		return d.sized(4, func(length int) (interface{}, error) { return d.arrayOf(length, depth) })
+	case 0xde:
+		return d.sized(2, func(length int) (interface{}, error) { return d.mapOf(length, depth) })
+	case 0xdf:
+		return d.sized(4, func(length int) (interface{}, error) { return d.mapOf(length, depth) })
+	}
+	return nil, fmt.Errorf("unsupported MessagePack format 0x%02x", code)
+}
+
+// sized reads a length of the given bytes and decodes the value of that length
+func (d *msgpackDecoder) sized(size int, decode func(length int) (interface{}, error)) (interface{}, error) {
+	length, err := d.uint(size)
+	if err != nil {
+		return nil, err
+	}
+	// Every element takes at least a byte, so longer lengths cannot be valid
+	if length > uint64(len(d.data)-d.offset) {
+		return nil, fmt.Errorf("MessagePack length %d exceeds the message", length)
+	}
+	return decode(int(length))
+}
+
+// arrayOf decodes the elements of an array
+func (d *msgpackDecoder) arrayOf(length, depth int) (interface{}, error) {
+	values := make([]interface{}, 0, length)
+	for i := 0; i < length; i++ {
+		value, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// mapOf decodes the entries of a map
+func (d *msgpackDecoder) mapOf(length, depth int) (interface{}, error) {
+	values := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("MessagePack map keys must be strings")
+		}
+		if values[name], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// stringOf reads a string of a length
+func (d *msgpackDecoder) stringOf(length int) (interface{}, error) {
+	data, err := d.read(length)
+	return string(data), err
+}
+
+// uint reads a big-endian unsigned integer of 1, 2, 4 or 8 bytes
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	data, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+// read returns the next bytes
+func (d *msgpackDecoder) read(size int) ([]byte, error) {
+	if size > len(d.data)-d.offset {
+		return nil, fmt.Errorf("truncated MessagePack message")
+	}
+	data := d.data[d.offset : d.offset+size]
+	d.offset += size
+	return data, nil
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// createOrganization creates an organization owning a set of projects
+func (s *App) createOrganization(c *fiber.Ctx) error {
+	var request struct {
+		ID       string   `json:"id"`
+		Name     string   `json:"name"`
+		Currency string   `json:"currency"`
+		Projects []string `json:"projects"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	org, err := s.organizationService.CreateOrganization(c.Context(), request.ID, request.Name, request.Currency, request.Projects)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "org.create", org.ID, map[string]interface{}{
+		"name":     org.Name,
+		"currency": org.Currency,
+		"projects": org.Projects,
+	})
+
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"status":       "success",
+		"organization": org,
+	})
+}
+
+// listOrganizations returns all organizations
+func (s *App) listOrganizations(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":        "success",
+		"organizations": s.organizationService.ListOrganizations(c.Context()),
+	})
+}
+
+// addOrganizationProject attaches a project to an organization
+func (s *App) addOrganizationProject(c *fiber.Ctx) error {
+	orgID := utils.CopyString(c.Params("id"))
+	projectID := utils.CopyString(c.Params("project_id"))
+
+	org, err := s.organizationService.AddProject(c.Context(), orgID, projectID)
+	if err != nil {
+		return c.Status(organizationErrorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "org.add_project", orgID, map[string]interface{}{
+		"project_id": projectID,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"organization": org,
+	})
+}
+
+// removeOrganizationProject detaches a project from an organization
+func (s *App) removeOrganizationProject(c *fiber.Ctx) error {
+	orgID := utils.CopyString(c.Params("id"))
+	projectID := utils.CopyString(c.Params("project_id"))
+
+	org, err := s.organizationService.RemoveProject(c.Context(), orgID, projectID)
+	if err != nil {
+		return c.Status(organizationErrorStatus(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "org.remove_project", orgID, map[string]interface{}{
+		"project_id": projectID,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"organization": org,
+	})
+}
+
+// getOrganization returns an organization and its projects
+func (s *App) getOrganization(c *fiber.Ctx) error {
+	org, err := s.organizationService.GetOrganization(c.Context(), c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"organization": org,
+	})
+}
+
+// getOrganizationUsage rolls up usage, cost and event volumes of an organization's projects
+func (s *App) getOrganizationUsage(c *fiber.Ctx) error {
+	startDate := c.Query("start_date")
+	endDate := c.Query("end_date")
+
+	if startDate == "" {
+		startDate = time.Now().AddDate(0, 0, -30).Format("2006-01-02") // Default to 30 days ago
+	}
+
+	if endDate == "" {
+		endDate = time.Now().Format("2006-01-02") // Default to today
+	}
+
+	start, err := time.Parse("2006-01-02", startDate)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid start date format. Use YYYY-MM-DD",
+		})
+	}
+
+	end, err := time.Parse("2006-01-02", endDate)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid end date format. Use YYYY-MM-DD",
+		})
+	}
+
+	usage, err := s.organizationService.GetUsage(c.Context(), c.Params("id"), start, end, c.QueryBool("include_users"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(usage)
+}
+
+// organizationErrorStatus maps organization service errors to HTTP statuses
+func organizationErrorStatus(err error) int {
+	switch {
+	case strings.HasPrefix(err.Error(), "organization not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "already belongs to"):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
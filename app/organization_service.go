@@ -0,0 +1,310 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Organization groups the projects billed on one contract
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Projects  []string  `json:"projects"`
+	Currency  string    `json:"currency,omitempty"` // Contract currency, the default currency when empty
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OrganizationUsage rolls up usage, cost and event volumes of an organization's projects
+type OrganizationUsage struct {
+	OrgID          string           `json:"org_id"`
+	Name           string           `json:"name"`
+	TotalEvents    int64            `json:"total_events"`
+	UniqueUsers    int64            `json:"unique_users"`
+	EventsByType   map[string]int64 `json:"events_by_type"`
+	BillingSummary BillingSummary   `json:"billing_summary"`
+	Projects       []ProjectUsage   `json:"projects"`
+	Period         UsagePeriod      `json:"period"`
+}
+
+// ProjectUsage is the usage of a single project within an organization
+type ProjectUsage struct {
+	ProjectID      string           `json:"project_id"`
+	TotalEvents    int64            `json:"total_events"`
+	UniqueUsers    int64            `json:"unique_users"`
+	EventsByType   map[string]int64 `json:"events_by_type"`
+	BillingSummary BillingSummary   `json:"billing_summary"`
+	Users          []UserUsage      `json:"users,omitempty"` // Only when requested
+}
+
+// UserUsage is the usage of a single user within a project
+type UserUsage struct {
+	UserID      string  `json:"user_id"`
+	TotalEvents int64   `json:"total_events"`
+	TotalCost   float64 `json:"total_cost"`
+}
+
+// OrganizationService manages the organization → projects hierarchy
+type OrganizationService struct {
+	organizations    map[string]*Organization
+	projectOrgs      map[string]string // Organization ID by project ID
+	analyticsService *AnalyticsService
+	mutex            sync.RWMutex
+}
+
+// NewOrganizationService creates a new organization service instance
+func NewOrganizationService(analyticsService *AnalyticsService) *OrganizationService {
+	return &OrganizationService{
+		organizations:    make(map[string]*Organization),
+		projectOrgs:      make(map[string]string),
+		analyticsService: analyticsService,
+	}
+}
+
+// CreateOrganization creates an organization owning the given projects. An ID is generated when empty.
+func (s *OrganizationService) CreateOrganization(ctx context.Context, id, name, currency string, projects []string) (*Organization, error) {
+	if name == "" {
+		return nil, fmt.Errorf("organization name is required")
+	}
+	currency = strings.ToUpper(currency)
+	if currency != "" {
+		if _, err := s.analyticsService.Currencies().Rate(currency); err != nil {
+			return nil, err
+		}
+	}
+	if id == "" {
+		id = "org_" + uuid.New().String()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, exists := s.organizations[id]; exists {
+		return nil, fmt.Errorf("organization already exists: %s", id)
+	}
+	for _, projectID := range projects {
+		if err := s.checkProjectAvailable(projectID, id); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	org := &Organization{
+		ID:        id,
+		Name:      name,
+		Projects:  []string{},
+		Currency:  currency,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.organizations[id] = org
+	for _, projectID := range projects {
+		s.attach(org, projectID)
+	}
+
+	log.Printf("Created organization: %s with %d projects", org.ID, len(org.Projects))
+
+	return org.copy(), nil
+}
+
+// GetOrganization returns an organization by ID
+func (s *OrganizationService) GetOrganization(ctx context.Context, id string) (*Organization, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	org, exists := s.organizations[id]
+	if !exists {
+		return nil, fmt.Errorf("organization not found: %s", id)
+	}
+	return org.copy(), nil
+}
+
+// ListOrganizations returns all organizations, sorted by ID
+func (s *OrganizationService) ListOrganizations(ctx context.Context) []*Organization {
+	s.mutex.RLock()
+	orgs := make([]*Organization, 0, len(s.organizations))
+	for _, org := range s.organizations {
+		orgs = append(orgs, org.copy())
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(orgs, func(i, j int) bool {
+		return orgs[i].ID < orgs[j].ID
+	})
+	return orgs
+}
+
+// AddProject attaches a project to an organization. A project belongs to at most one organization.
+func (s *OrganizationService) AddProject(ctx context.Context, orgID, projectID string) (*Organization, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	org, exists := s.organizations[orgID]
+	if !exists {
+		return nil, fmt.Errorf("organization not found: %s", orgID)
+	}
+	if err := s.checkProjectAvailable(projectID, orgID); err != nil {
+		return nil, err
+	}
+
+	s.attach(org, projectID)
+	return org.copy(), nil
+}
+
+// RemoveProject detaches a project from an organization
+func (s *OrganizationService) RemoveProject(ctx context.Context, orgID, projectID string) (*Organization, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	org, exists := s.organizations[orgID]
+	if !exists {
+		return nil, fmt.Errorf("organization not found: %s", orgID)
+	}
+	if s.projectOrgs[projectID] != orgID {
+		return nil, fmt.Errorf("project %s does not belong to organization %s", projectID, orgID)
+	}
+
+	delete(s.projectOrgs, projectID)
+	for i, id := range org.Projects {
+		if id == projectID {
+			org.Projects = append(org.Projects[:i], org.Projects[i+1:]...)
+			break
+		}
+	}
+	org.UpdatedAt = time.Now()
+	return org.copy(), nil
+}
+
+// OrganizationForProject returns the ID of the organization owning a project
+func (s *OrganizationService) OrganizationForProject(projectID string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	orgID, exists := s.projectOrgs[projectID]
+	return orgID, exists
+}
+
+// GetUsage rolls up the usage of every project of an organization over the period. All amounts
+// are in the organization's contract currency. Per-user usage is included in each project when
+// includeUsers is set.
+func (s *OrganizationService) GetUsage(ctx context.Context, orgID string, start, end time.Time, includeUsers bool) (*OrganizationUsage, error) {
+	org, err := s.GetOrganization(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	currencies := s.analyticsService.Currencies()
+	currency := org.Currency
+	if currency == "" {
+		currency = currencies.DefaultCurrency()
+	}
+	billingSummary := func(eventsByType map[string]int64) BillingSummary {
+		return currencies.ConvertSummary(s.analyticsService.calculateBillingSummary(eventsByType), currency)
+	}
+
+	queryStart := time.Now()
+	usage := &OrganizationUsage{
+		OrgID:        org.ID,
+		Name:         org.Name,
+		EventsByType: make(map[string]int64),
+		Projects:     make([]ProjectUsage, 0, len(org.Projects)),
+		Period:       UsagePeriod{StartDate: start, EndDate: end},
+	}
+
+	var scannedEvents int64
+	orgUsers := make(map[string]bool)
+	for _, projectID := range org.Projects {
+		events := s.analyticsService.QueryEvents(ctx, EventFilter{
+			ProjectID: projectID,
+			Start:     start,
+			End:       end.Add(24 * time.Hour), // The end date is inclusive, as for user usage
+		})
+		scannedEvents += int64(len(events))
+
+		project := ProjectUsage{
+			ProjectID:    projectID,
+			EventsByType: make(map[string]int64),
+		}
+		userEventsByType := make(map[string]map[string]int64)
+		for _, event := range events {
+			project.TotalEvents++
+			project.EventsByType[event.EventType]++
+			usage.EventsByType[event.EventType]++
+			orgUsers[event.UserID] = true
+
+			if userEventsByType[event.UserID] == nil {
+				userEventsByType[event.UserID] = make(map[string]int64)
+			}
+			userEventsByType[event.UserID][event.EventType]++
+		}
+
+		project.UniqueUsers = int64(len(userEventsByType))
+		project.BillingSummary = billingSummary(project.EventsByType)
+		usage.TotalEvents += project.TotalEvents
+
+		if includeUsers {
+			project.Users = make([]UserUsage, 0, len(userEventsByType))
+			for userID, eventsByType := range userEventsByType {
+				var total int64
+				for _, count := range eventsByType {
+					total += count
+				}
+				project.Users = append(project.Users, UserUsage{
+					UserID:      userID,
+					TotalEvents: total,
+					TotalCost:   billingSummary(eventsByType).TotalCost,
+				})
+			}
+			sort.Slice(project.Users, func(i, j int) bool {
+				return project.Users[i].UserID < project.Users[j].UserID
+			})
+		}
+
+		usage.Projects = append(usage.Projects, project)
+	}
+
+	usage.UniqueUsers = int64(len(orgUsers))
+	usage.BillingSummary = billingSummary(usage.EventsByType)
+
+	s.analyticsService.SlowOperations().Observe(SlowOperationUsageQuery, map[string]interface{}{
+		"org_id": orgID,
+		"start":  start,
+		"end":    end,
+	}, time.Since(queryStart), scannedEvents, s.analyticsService.calculateAPICallCost("/api/v1/orgs/:id/usage", "GET"))
+
+	return usage, nil
+}
+
+// checkProjectAvailable returns an error if the project belongs to another organization. Callers must hold the lock.
+func (s *OrganizationService) checkProjectAvailable(projectID, orgID string) error {
+	if projectID == "" {
+		return fmt.Errorf("project ID is required")
+	}
+	if owner, exists := s.projectOrgs[projectID]; exists && owner != orgID {
+		return fmt.Errorf("project %s already belongs to organization %s", projectID, owner)
+	}
+	return nil
+}
+
+// attach adds a project to an organization. Callers must hold the lock.
+func (s *OrganizationService) attach(org *Organization, projectID string) {
+	if s.projectOrgs[projectID] == org.ID {
+		return
+	}
+	s.projectOrgs[projectID] = org.ID
+	org.Projects = append(org.Projects, projectID)
+	org.UpdatedAt = time.Now()
+}
+
+// copy returns a copy of the organization that does not share its project list
+func (o *Organization) copy() *Organization {
+	copied := *o
+	copied.Projects = append([]string{}, o.Projects...)
+	return &copied
+}
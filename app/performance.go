@@ -0,0 +1,297 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PerformanceEventType is the event type of web vitals measurements. The metrics are sent as
+// properties, in milliseconds except for the unitless CLS, with the device class in "device".
+const PerformanceEventType = "performance"
+
+// Web vitals supported by performance events
+const (
+	MetricLCP  = "lcp"  // Largest Contentful Paint
+	MetricFID  = "fid"  // First Input Delay
+	MetricINP  = "inp"  // Interaction to Next Paint
+	MetricCLS  = "cls"  // Cumulative Layout Shift
+	MetricTTFB = "ttfb" // Time to First Byte
+)
+
+// webVital describes a metric and the thresholds rating its values
+type webVital struct {
+	good float64 // Values up to this are good
+	poor float64 // Values above this are poor, in between they need improvement
+	max  float64 // Larger values are rejected as measurement errors
+}
+
+// webVitals are the supported metrics with the thresholds published for them
+var webVitals = map[string]webVital{
+	MetricLCP:  {good: 2500, poor: 4000, max: 600000},
+	MetricFID:  {good: 100, poor: 300, max: 600000},
+	MetricINP:  {good: 200, poor: 500, max: 600000},
+	MetricCLS:  {good: 0.1, poor: 0.25, max: 100},
+	MetricTTFB: {good: 800, poor: 1800, max: 600000},
+}
+
+// webVitalNames are the supported metrics in reporting order
+var webVitalNames = []string{MetricLCP, MetricFID, MetricINP, MetricCLS, MetricTTFB}
+
+// performanceSchema validates performance events: they must carry the page and at least one
+// supported metric, and every metric must be a plausible non-negative number
+func performanceSchema() *EventSchema {
+	return &EventSchema{
+		RequiredFields: []string{"event_type", "user_id", "page", "properties"},
+		FieldTypes: map[string]string{
+			"event_type": "string",
+			"user_id":    "string",
+			"page":       "string",
+			"properties": "map",
+			"session_id": "string",
+			"ip_address": "string",
+		},
+		CustomRules: map[string]ValidationRule{
+			"event_type": func(value interface{}) error {
+				if str, ok := value.(string); ok {
+					if str != PerformanceEventType {
+						return fmt.Errorf("event_type must be 'performance' for performance events")
+					}
+				}
+				return nil
+			},
+			"properties": validatePerformanceMetrics,
+		},
+	}
+}
+
+// validatePerformanceMetrics checks the metrics of a performance event
+func validatePerformanceMetrics(value interface{}) error {
+	properties, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	metrics := 0
+	for _, name := range webVitalNames {
+		raw, exists := properties[name]
+		if !exists {
+			continue
+		}
+		number, ok := raw.(float64)
+		if !ok {
+			return fmt.Errorf("metric '%s' must be a number", name)
+		}
+		if number < 0 || number > webVitals[name].max || math.IsNaN(number) {
+			return fmt.Errorf("metric '%s' must be between 0 and %g", name, webVitals[name].max)
+		}
+		metrics++
+	}
+	if metrics == 0 {
+		return fmt.Errorf("at least one metric is required: %s", strings.Join(webVitalNames, ", "))
+	}
+
+	if device, exists := properties["device"]; exists {
+		if _, ok := device.(string); !ok {
+			return fmt.Errorf("device must be a string")
+		}
+	}
+	return nil
+}
+
+// PerformanceService aggregates web vitals per page and device
+type PerformanceService struct {
+	analyticsService *AnalyticsService
+}
+
+// PerformanceQuery represents a query for the performance report
+type PerformanceQuery struct {
+	Page   string    `json:"page,omitempty"`   // Empty for every page
+	Device string    `json:"device,omitempty"` // Empty for every device
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// PerformanceReport represents the web vitals of a project, overall and per page and device
+type PerformanceReport struct {
+	TimeRange  TimeRange                `json:"time_range"`
+	Samples    int64                    `json:"samples"`
+	Metrics    map[string]MetricSummary `json:"metrics"`
+	Pages      []PagePerformance        `json:"pages"` // Sorted by page and device
+	ComputedAt time.Time                `json:"computed_at"`
+}
+
+// PagePerformance represents the web vitals of a page on a device class, and the conversion of
+// the users who measured them
+type PagePerformance struct {
+	Page           string                   `json:"page"`
+	Device         string                   `json:"device"`
+	Samples        int64                    `json:"samples"`
+	Metrics        map[string]MetricSummary `json:"metrics"`
+	Users          int64                    `json:"users"`
+	ConvertedUsers int64                    `json:"converted_users"` // Users with a conversion in the time range
+	ConversionRate float64                  `json:"conversion_rate"`
+}
+
+// MetricSummary represents the distribution of a metric
+type MetricSummary struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50"`
+	P75   float64 `json:"p75"`
+	P95   float64 `json:"p95"`
+	// Percentages of the values rated good, needing improvement and poor
+	Good             float64 `json:"good"`
+	NeedsImprovement float64 `json:"needs_improvement"`
+	Poor             float64 `json:"poor"`
+}
+
+// Device class of measurements without one
+const unknownDevice = "unknown"
+
+// performanceGroup accumulates the measurements of a page on a device
+type performanceGroup struct {
+	page    PagePerformance
+	metrics map[string][]float64
+	users   map[string]bool
+}
+
+// NewPerformanceService creates a new performance service instance
+func NewPerformanceService(analyticsService *AnalyticsService) *PerformanceService {
+	return &PerformanceService{
+		analyticsService: analyticsService,
+	}
+}
+
+// Report computes the percentiles of the project's web vitals per page and device in the time
+// range, along with the conversion rate of the measured users
+func (s *PerformanceService) Report(ctx context.Context, query PerformanceQuery) (*PerformanceReport, error) {
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		Start:     query.Start,
+		End:       query.End,
+	})
+
+	converted := make(map[string]bool)
+	groups := make(map[string]*performanceGroup)
+	overall := make(map[string][]float64)
+	var samples int64
+	for _, event := range events {
+		if event.EventType == "conversion" {
+			converted[event.UserID] = true
+			continue
+		}
+		// Measurements stored without their properties carry no metrics
+		if event.EventType != PerformanceEventType || event.DetailDropped {
+			continue
+		}
+		if query.Page != "" && event.Page != query.Page {
+			continue
+		}
+		device, _ := event.Properties["device"].(string)
+		if device == "" {
+			device = unknownDevice
+		}
+		if query.Device != "" && device != query.Device {
+			continue
+		}
+
+		key := event.Page + "|" + device
+		group, exists := groups[key]
+		if !exists {
+			group = &performanceGroup{
+				page:    PagePerformance{Page: event.Page, Device: device},
+				metrics: make(map[string][]float64),
+				users:   make(map[string]bool),
+			}
+			groups[key] = group
+		}
+		group.page.Samples++
+		group.users[event.UserID] = true
+		samples++
+
+		for _, name := range webVitalNames {
+			if value, ok := event.Properties[name].(float64); ok {
+				group.metrics[name] = append(group.metrics[name], value)
+				overall[name] = append(overall[name], value)
+			}
+		}
+	}
+
+	report := &PerformanceReport{
+		TimeRange:  TimeRange{Start: query.Start, End: query.End},
+		Samples:    samples,
+		Metrics:    summarizeMetrics(overall),
+		Pages:      []PagePerformance{},
+		ComputedAt: time.Now(),
+	}
+	for _, group := range groups {
+		page := group.page
+		page.Metrics = summarizeMetrics(group.metrics)
+		page.Users = int64(len(group.users))
+		for userID := range group.users {
+			if converted[userID] {
+				page.ConvertedUsers++
+			}
+		}
+		page.ConversionRate = float64(page.ConvertedUsers) / float64(page.Users) * 100
+		report.Pages = append(report.Pages, page)
+	}
+	sort.Slice(report.Pages, func(i, j int) bool {
+		if report.Pages[i].Page != report.Pages[j].Page {
+			return report.Pages[i].Page < report.Pages[j].Page
+		}
+		return report.Pages[i].Device < report.Pages[j].Device
+	})
+
+	return report, nil
+}
+
+// summarizeMetrics computes the distribution of every measured metric
+func summarizeMetrics(metrics map[string][]float64) map[string]MetricSummary {
+	summaries := make(map[string]MetricSummary, len(metrics))
+	for name, values := range metrics {
+		sort.Float64s(values)
+		thresholds := webVitals[name]
+
+		summary := MetricSummary{
+			Count: int64(len(values)),
+			P50:   percentile(values, 50),
+			P75:   percentile(values, 75),
+			P95:   percentile(values, 95),
+		}
+		for _, value := range values {
+			switch {
+			case value <= thresholds.good:
+				summary.Good++
+			case value <= thresholds.poor:
+				summary.NeedsImprovement++
+			default:
+				summary.Poor++
+			}
+		}
+		summary.Good = summary.Good / float64(len(values)) * 100
+		summary.NeedsImprovement = summary.NeedsImprovement / float64(len(values)) * 100
+		summary.Poor = summary.Poor / float64(len(values)) * 100
+		summaries[name] = summary
+	}
+	return summaries
+}
+
+// percentile returns the nearest-rank percentile of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,39 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getPerformanceReport returns the web vitals percentiles per page and device, optionally of a
+// single ?page and ?device, over ?start_date and ?end_date (default the last 30 days)
+func (s *App) getPerformanceReport(c *fiber.Ctx) error {
+	start, end, err := queryTimeRange(map[string]interface{}{
+		"start_date": c.Query("start_date"),
+		"end_date":   c.Query("end_date"),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	report, err := s.performanceService.Report(ctx, PerformanceQuery{
+		Page:   c.Query("page"),
+		Device: c.Query("device"),
+		Start:  start,
+		End:    end,
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"report": report,
+	})
+}
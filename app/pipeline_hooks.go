@@ -0,0 +1,250 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// EventEnricher adds to or rewrites an event before it is validated and stored, e.g. with
+// properties looked up from a platform team's own services. Enrichers should not change the
+// event's ID, project or region. Errors are logged and the event is stored as enriched so far.
+type EventEnricher interface {
+	Enrich(ctx context.Context, event *AnalyticsEvent) error
+}
+
+// EventValidator rejects events a platform team does not want stored. Rejected events are
+// recorded in the validation log like events failing their schema.
+type EventValidator interface {
+	Validate(ctx context.Context, event *AnalyticsEvent) error
+}
+
+// EventSink receives every stored event from the event bus, e.g. to forward it to a warehouse.
+// Sinks run outside the request, so errors are logged only.
+type EventSink interface {
+	Write(event *AnalyticsEvent) error
+}
+
+// registeredPipelineHooks holds the hooks made available by RegisterPipelineHook, by name
+var registeredPipelineHooks = struct {
+	hooks map[string]interface{}
+	mutex sync.RWMutex
+}{hooks: make(map[string]interface{})}
+
+// RegisterPipelineHook makes a hook available to the chain declared in PIPELINE_HOOKS. The hook
+// must implement EventEnricher, EventValidator or EventSink, or several of them. Call it from an
+// init function of the package providing the hook, linked into the binary or built as a Go
+// plugin listed in PIPELINE_PLUGINS. It panics if the name is registered twice or the hook
+// implements none of the interfaces.
+func RegisterPipelineHook(name string, hook interface{}) {
+	if name == "" {
+		panic("pipeline hook name is required")
+	}
+	if _, _, _, ok := pipelineHookKinds(hook); !ok {
+		panic(fmt.Sprintf("pipeline hook %s implements none of EventEnricher, EventValidator and EventSink", name))
+	}
+
+	registeredPipelineHooks.mutex.Lock()
+	defer registeredPipelineHooks.mutex.Unlock()
+	if _, exists := registeredPipelineHooks.hooks[name]; exists {
+		panic(fmt.Sprintf("pipeline hook %s is already registered", name))
+	}
+	registeredPipelineHooks.hooks[name] = hook
+}
+
+// RegisteredPipelineHooks returns the names of the registered hooks, sorted
+func RegisteredPipelineHooks() []string {
+	registeredPipelineHooks.mutex.RLock()
+	defer registeredPipelineHooks.mutex.RUnlock()
+
+	names := make([]string, 0, len(registeredPipelineHooks.hooks))
+	for name := range registeredPipelineHooks.hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadPipelinePlugins opens the Go plugins at the comma-separated paths. Plugins register their
+// hooks with RegisterPipelineHook from an init function, which runs when they are opened. Plugins
+// must be built with the same Go version and dependency versions as the service.
+func LoadPipelinePlugins(paths string) error {
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("failed to load pipeline plugin %s: %w", path, err)
+		}
+		log.Printf("Loaded pipeline plugin %s", path)
+	}
+	return nil
+}
+
+// pipelineHookKinds returns the interfaces a hook implements
+func pipelineHookKinds(hook interface{}) (EventEnricher, EventValidator, EventSink, bool) {
+	enricher, isEnricher := hook.(EventEnricher)
+	validator, isValidator := hook.(EventValidator)
+	sink, isSink := hook.(EventSink)
+	return enricher, validator, sink, isEnricher || isValidator || isSink
+}
+
+// PipelineHookChain lists the hooks of each kind a service runs, in the order they run
+type PipelineHookChain struct {
+	Enrichers  []string `json:"enrichers"`
+	Validators []string `json:"validators"`
+	Sinks      []string `json:"sinks"`
+}
+
+// namedEnricher is an enricher of the chain
+type namedEnricher struct {
+	name     string
+	enricher EventEnricher
+}
+
+// namedValidator is a validator of the chain
+type namedValidator struct {
+	name      string
+	validator EventValidator
+}
+
+// PipelineHooks runs the custom enrichers and validators of an analytics service on every event
+// it tracks, and subscribes its custom sinks to the stored events
+type PipelineHooks struct {
+	enrichers  []namedEnricher
+	validators []namedValidator
+	sinks      []string
+	bus        *EventBus
+	mutex      sync.RWMutex
+}
+
+// NewPipelineHooks creates an empty chain subscribing sinks to the bus
+func NewPipelineHooks(bus *EventBus) *PipelineHooks {
+	return &PipelineHooks{bus: bus}
+}
+
+// Add appends a hook to the chains of the interfaces it implements. Sinks are subscribed to the
+// stored events as "sink:<name>".
+func (h *PipelineHooks) Add(name string, hook interface{}) error {
+	enricher, validator, sink, ok := pipelineHookKinds(hook)
+	if !ok {
+		return fmt.Errorf("pipeline hook %s implements none of EventEnricher, EventValidator and EventSink", name)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, existing := range h.names() {
+		if existing == name {
+			return fmt.Errorf("pipeline hook %s is already in the chain", name)
+		}
+	}
+
+	if sink != nil {
+		err := h.bus.SubscribeEvents(TopicEventStored, "sink:"+name, func(event *AnalyticsEvent) {
+			if err := sink.Write(event); err != nil {
+				log.Printf("Warning: Pipeline sink %s failed to write event %s: %v", name, event.ID, err)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("failed to subscribe pipeline sink %s: %w", name, err)
+		}
+		h.sinks = append(h.sinks, name)
+	}
+	if enricher != nil {
+		h.enrichers = append(h.enrichers, namedEnricher{name: name, enricher: enricher})
+	}
+	if validator != nil {
+		h.validators = append(h.validators, namedValidator{name: name, validator: validator})
+	}
+	return nil
+}
+
+// names returns the names of the hooks in the chain. Callers must hold the lock.
+func (h *PipelineHooks) names() []string {
+	names := append([]string(nil), h.sinks...)
+	for _, enricher := range h.enrichers {
+		names = append(names, enricher.name)
+	}
+	for _, validator := range h.validators {
+		names = append(names, validator.name)
+	}
+	return names
+}
+
+// Configure adds the registered hooks named in the comma-separated chain, in its order. Nothing is
+// added when a name is not registered.
+func (h *PipelineHooks) Configure(chain string) error {
+	registeredPipelineHooks.mutex.RLock()
+	var names []string
+	var hooks []interface{}
+	var unknown []string
+	for _, name := range strings.Split(chain, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		hook, exists := registeredPipelineHooks.hooks[name]
+		if !exists {
+			unknown = append(unknown, name)
+			continue
+		}
+		names = append(names, name)
+		hooks = append(hooks, hook)
+	}
+	registeredPipelineHooks.mutex.RUnlock()
+
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown pipeline hooks: %s. Registered hooks are: %s", strings.Join(unknown, ", "), strings.Join(RegisteredPipelineHooks(), ", "))
+	}
+	for i, name := range names {
+		if err := h.Add(name, hooks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chain returns the hooks of each kind, in the order they run
+func (h *PipelineHooks) Chain() PipelineHookChain {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	chain := PipelineHookChain{Enrichers: []string{}, Validators: []string{}, Sinks: append([]string{}, h.sinks...)}
+	for _, enricher := range h.enrichers {
+		chain.Enrichers = append(chain.Enrichers, enricher.name)
+	}
+	for _, validator := range h.validators {
+		chain.Validators = append(chain.Validators, validator.name)
+	}
+	return chain
+}
+
+// Enrich runs the enrichers on the event in order, logging the ones failing
+func (h *PipelineHooks) Enrich(ctx context.Context, event *AnalyticsEvent) {
+	h.mutex.RLock()
+	enrichers := h.enrichers
+	h.mutex.RUnlock()
+
+	for _, enricher := range enrichers {
+		if err := enricher.enricher.Enrich(ctx, event); err != nil {
+			log.Printf("Warning: Pipeline enricher %s failed on event %s: %v", enricher.name, event.ID, err)
+		}
+	}
+}
+
+// Validate runs the validators on the event in order and returns the first rejection
+func (h *PipelineHooks) Validate(ctx context.Context, event *AnalyticsEvent) error {
+	h.mutex.RLock()
+	validators := h.validators
+	h.mutex.RUnlock()
+
+	for _, validator := range validators {
+		if err := validator.validator.Validate(ctx, event); err != nil {
+			return fmt.Errorf("rejected by %s: %w", validator.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresMigrations create the schema of the PostgreSQL event store. Applied migrations are
+// recorded in schema_migrations; new migrations are only ever appended.
+var postgresMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS analytics_events (
+		id          TEXT PRIMARY KEY,
+		project_id  TEXT NOT NULL,
+		region      TEXT NOT NULL,
+		user_id     TEXT NOT NULL,
+		event_type  TEXT NOT NULL,
+		"timestamp" TIMESTAMPTZ NOT NULL,
+		received_at TIMESTAMPTZ NOT NULL,
+		data        JSONB NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS analytics_events_user_id_timestamp ON analytics_events (user_id, "timestamp")`,
+	`CREATE INDEX IF NOT EXISTS analytics_events_event_type_timestamp ON analytics_events (event_type, "timestamp")`,
+	`CREATE INDEX IF NOT EXISTS analytics_events_project_id_timestamp ON analytics_events (project_id, "timestamp")`,
+}
+
+// postgresMigrationLock is the advisory lock serializing the migrations of instances starting
+// together
+const postgresMigrationLock = 7244083
+
+// PostgresEventStore is an EventStore keeping events in a PostgreSQL table, indexed by user, event
+// type and project with their timestamp. Each event is stored whole as JSON, with the columns it
+// is queried by. Statements run concurrently on a pool of connections.
+type PostgresEventStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresEventStore connects to the PostgreSQL database of the URL and migrates its schema.
+// The pool is sized by the URL's pool_max_conns parameter.
+func NewPostgresEventStore(ctx context.Context, databaseURL string) (*PostgresEventStore, error) {
+	pool, err := pgxpool.New(ctx, databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the event store: %w", err)
+	}
+	store := &PostgresEventStore{pool: pool}
+	if err := store.migrate(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// migrate applies the migrations not applied yet, each in its own transaction. The advisory lock
+// is held by a session, so the migrations run on a single connection of the pool.
+func (s *PostgresEventStore) migrate(ctx context.Context) error {
+	poolConn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the event store: %w", err)
+	}
+	defer poolConn.Release()
+	conn := poolConn.Conn()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", postgresMigrationLock); err != nil {
+		return fmt.Errorf("failed to lock event store migrations: %w", err)
+	}
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", postgresMigrationLock)
+
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var applied int
+	if err := conn.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&applied); err != nil {
+		return fmt.Errorf("failed to read the event store schema version: %w", err)
+	}
+
+	for version := applied + 1; version <= len(postgresMigrations); version++ {
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, postgresMigrations[version-1]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply event store migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// Insert stores events in one batch; events already stored under the same ID are left unchanged
+func (s *PostgresEventStore) Insert(ctx context.Context, events []*AnalyticsEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event %s: %w", event.ID, err)
+		}
+		batch.Queue(`INSERT INTO analytics_events (id, project_id, region, user_id, event_type, "timestamp", received_at, data)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (id) DO NOTHING`,
+			event.ID, projectOrDefault(event.ProjectID), event.Region, event.UserID, event.EventType, event.Timestamp, event.ReceivedAt, data)
+	}
+
+	// The batch runs in an implicit transaction: either every event is stored or none
+	if err := s.pool.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("failed to insert %d events: %w", len(events), err)
+	}
+	return nil
+}
+
+// Query returns the events selected by the filter, oldest first
+func (s *PostgresEventStore) Query(ctx context.Context, filter EventStoreFilter) ([]*AnalyticsEvent, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.ProjectID != "" {
+		where("project_id = $%d", filter.ProjectID)
+	}
+	if filter.UserID != "" {
+		where("user_id = $%d", filter.UserID)
+	}
+	if filter.EventType != "" {
+		where("event_type = $%d", filter.EventType)
+	}
+	if filter.Regions != nil {
+		where("region = ANY($%d)", filter.Regions)
+	}
+	if !filter.Start.IsZero() {
+		where(`"timestamp" >= $%d`, filter.Start)
+	}
+	if !filter.End.IsZero() {
+		where(`"timestamp" < $%d`, filter.End)
+	}
+
+	query := "SELECT data FROM analytics_events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY "timestamp", id`
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	defer rows.Close()
+
+	events := make([]*AnalyticsEvent, 0)
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read event: %w", err)
+		}
+		var event AnalyticsEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, fmt.Errorf("failed to decode event: %w", err)
+		}
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query events: %w", err)
+	}
+	return events, nil
+}
+
+// Delete deletes the events with the given IDs
+func (s *PostgresEventStore) Delete(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if _, err := s.pool.Exec(ctx, "DELETE FROM analytics_events WHERE id = ANY($1)", ids); err != nil {
+		return fmt.Errorf("failed to delete %d events: %w", len(ids), err)
+	}
+	return nil
+}
+
+// Close closes the connections to the database, waiting for the statements running on them
+func (s *PostgresEventStore) Close() error {
+	s.pool.Close()
+	return nil
+}
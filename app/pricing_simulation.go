@@ -0,0 +1,210 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// PricingConfig prices tracked events by type, in BaseCurrency
+type PricingConfig struct {
+	EventPrices  map[string]float64 `json:"event_prices"`  // Price of one event by type
+	DefaultPrice float64            `json:"default_price"` // Price of one event of any other type
+}
+
+// Pricing of the events billed in usage summaries
+var currentPricing = PricingConfig{
+	EventPrices: map[string]float64{
+		"page_view":  0.001,
+		"click":      0.002,
+		"conversion": 0.01,
+	},
+	DefaultPrice: 0.0005,
+}
+
+// Validate checks that the pricing has no negative prices
+func (p PricingConfig) Validate() error {
+	if p.DefaultPrice < 0 {
+		return fmt.Errorf("default_price must not be negative")
+	}
+	for eventType, price := range p.EventPrices {
+		if eventType == "" {
+			return fmt.Errorf("event_prices must not have an empty event type")
+		}
+		if price < 0 {
+			return fmt.Errorf("price of %s must not be negative", eventType)
+		}
+	}
+	return nil
+}
+
+// price returns the price of one event of a type
+func (p PricingConfig) price(eventType string) float64 {
+	if price, exists := p.EventPrices[eventType]; exists {
+		return price
+	}
+	return p.DefaultPrice
+}
+
+// summary prices events counted by type
+func (p PricingConfig) summary(eventsByType map[string]int64) BillingSummary {
+	summary := BillingSummary{
+		CostBreakdown: make(map[string]float64, len(eventsByType)),
+		Currency:      BaseCurrency,
+	}
+	for eventType, count := range eventsByType {
+		cost := float64(count) * p.price(eventType)
+		summary.CostBreakdown[eventType] = cost
+		summary.TotalCost += cost
+	}
+	return summary
+}
+
+// PricingSimulation re-prices the events of a period under a proposed pricing
+type PricingSimulation struct {
+	ProjectID string        // Every project when empty
+	Start     time.Time     // First day of the period
+	End       time.Time     // Last day of the period, inclusive
+	Pricing   PricingConfig // Proposed pricing
+}
+
+// CustomerPricingDelta is what a customer was billed for the period under the current pricing and
+// would be billed under the proposed one
+type CustomerPricingDelta struct {
+	UserID       string           `json:"user_id"`
+	TotalEvents  int64            `json:"total_events"`
+	EventsByType map[string]int64 `json:"events_by_type"`
+	CurrentCost  float64          `json:"current_cost"`
+	ProposedCost float64          `json:"proposed_cost"`
+	Delta        float64          `json:"delta"`
+	DeltaPercent *float64         `json:"delta_percent"` // Nil when the current cost is 0
+}
+
+// PricingSimulationResult compares the revenue of a period under the current and a proposed
+// pricing, per customer. Customers are sorted by their largest change first.
+type PricingSimulationResult struct {
+	ProjectID          string                 `json:"project_id,omitempty"`
+	Period             UsagePeriod            `json:"period"`
+	CurrentPricing     PricingConfig          `json:"current_pricing"`
+	ProposedPricing    PricingConfig          `json:"proposed_pricing"`
+	Currency           string                 `json:"currency"`
+	TotalEvents        int64                  `json:"total_events"`
+	UnattributedEvents int64                  `json:"unattributed_events"` // Events without a user, billed to no one
+	CurrentRevenue     float64                `json:"current_revenue"`
+	ProposedRevenue    float64                `json:"proposed_revenue"`
+	Delta              float64                `json:"delta"`
+	DeltaPercent       *float64               `json:"delta_percent"`
+	Increased          int                    `json:"customers_increased"`
+	Decreased          int                    `json:"customers_decreased"`
+	Unchanged          int                    `json:"customers_unchanged"`
+	Customers          []CustomerPricingDelta `json:"customers"`
+}
+
+// Validate checks the period and the proposed pricing of the simulation
+func (p PricingSimulation) Validate() error {
+	if p.Start.IsZero() || p.End.IsZero() {
+		return fmt.Errorf("start_date and end_date are required")
+	}
+	if p.End.Before(p.Start) {
+		return fmt.Errorf("end_date must not be before start_date")
+	}
+	if len(p.Pricing.EventPrices) == 0 && p.Pricing.DefaultPrice == 0 {
+		return fmt.Errorf("pricing with event_prices or a default_price is required")
+	}
+	return p.Pricing.Validate()
+}
+
+// SimulatePricing re-prices the usage of a historical period under a proposed pricing and returns
+// what each customer, a billed user, would pay compared to the current pricing, so pricing changes
+// can be evaluated against real usage before rollout. Events are priced under the canonical names
+// of their project's aliases, in BaseCurrency.
+func (s *AnalyticsService) SimulatePricing(simulation PricingSimulation) (*PricingSimulationResult, error) {
+	return s.simulatePricing(context.Background(), simulation)
+}
+
+// simulatePricing simulates a pricing, reporting the scanned events to the job running with the context
+func (s *AnalyticsService) simulatePricing(ctx context.Context, simulation PricingSimulation) (*PricingSimulationResult, error) {
+	if err := simulation.Validate(); err != nil {
+		return nil, err
+	}
+	result := &PricingSimulationResult{
+		ProjectID:       simulation.ProjectID,
+		Period:          UsagePeriod{StartDate: simulation.Start, EndDate: simulation.End},
+		CurrentPricing:  currentPricing,
+		ProposedPricing: simulation.Pricing,
+		Currency:        BaseCurrency,
+		Customers:       make([]CustomerPricingDelta, 0),
+	}
+	resolve := s.aliases.Resolver()
+	end := simulation.End.Add(24 * time.Hour) // The end date is inclusive, as for usage
+
+	usage := make(map[string]map[string]int64) // Events by type per user
+	s.mutex.RLock()
+	s.scanEventsReporting(ctx, nil, func(stored *AnalyticsEvent) {
+		if (simulation.ProjectID != "" && projectOrDefault(stored.ProjectID) != simulation.ProjectID) ||
+			stored.Timestamp.Before(simulation.Start) || !stored.Timestamp.Before(end) {
+			return
+		}
+		result.TotalEvents++
+		if stored.UserID == "" {
+			result.UnattributedEvents++
+			return
+		}
+		eventsByType, exists := usage[stored.UserID]
+		if !exists {
+			eventsByType = make(map[string]int64)
+			usage[stored.UserID] = eventsByType
+		}
+		eventsByType[resolve(stored).EventType]++
+	})
+	s.mutex.RUnlock()
+
+	for userID, eventsByType := range usage {
+		customer := CustomerPricingDelta{
+			UserID:       userID,
+			EventsByType: eventsByType,
+			CurrentCost:  currentPricing.summary(eventsByType).TotalCost,
+			ProposedCost: simulation.Pricing.summary(eventsByType).TotalCost,
+		}
+		for _, count := range eventsByType {
+			customer.TotalEvents += count
+		}
+		customer.Delta = customer.ProposedCost - customer.CurrentCost
+		customer.DeltaPercent = deltaPercent(customer.CurrentCost, customer.ProposedCost)
+
+		switch {
+		case customer.Delta > 0:
+			result.Increased++
+		case customer.Delta < 0:
+			result.Decreased++
+		default:
+			result.Unchanged++
+		}
+		result.CurrentRevenue += customer.CurrentCost
+		result.ProposedRevenue += customer.ProposedCost
+		result.Customers = append(result.Customers, customer)
+	}
+	result.Delta = result.ProposedRevenue - result.CurrentRevenue
+	result.DeltaPercent = deltaPercent(result.CurrentRevenue, result.ProposedRevenue)
+
+	sort.Slice(result.Customers, func(i, j int) bool {
+		a, b := math.Abs(result.Customers[i].Delta), math.Abs(result.Customers[j].Delta)
+		if a != b {
+			return a > b
+		}
+		return result.Customers[i].UserID < result.Customers[j].UserID
+	})
+	return result, nil
+}
+
+// deltaPercent returns the change from current to proposed in percent of current, or nil when
+// current is 0
+func deltaPercent(current, proposed float64) *float64 {
+	if current == 0 {
+		return nil
+	}
+	percent := math.Round(10000*(proposed-current)/current) / 100
+	return &percent
+}
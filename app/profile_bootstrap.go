@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Sources of the history a bootstrap seeds user profiles from
+const (
+	BootstrapSourceKafka = "kafka" // Messages still retained by the Kafka topics
+	BootstrapSourceAPI   = "api"   // Bulk history endpoints of the billing and auth services
+)
+
+// defaultBootstrapTopics are the topics carrying lifecycle events
+var defaultBootstrapTopics = []string{"billing", "auth"}
+
+// BootstrapRequest selects the history a bootstrap reads
+type BootstrapRequest struct {
+	Source string    `json:"source"`
+	Topics []string  `json:"topics,omitempty"` // Kafka topics read, billing and auth by default
+	From   time.Time `json:"from,omitempty"`   // From the oldest retained history when zero
+	To     time.Time `json:"to,omitempty"`     // Up to now when zero
+}
+
+// BootstrapResult reports how the history read by a bootstrap was applied to user profiles
+type BootstrapResult struct {
+	Source      string         `json:"source"`
+	Topics      []string       `json:"topics,omitempty"`
+	URLs        []string       `json:"urls,omitempty"`
+	From        time.Time      `json:"from"`
+	To          time.Time      `json:"to"`
+	Events      int64          `json:"events"`  // Read from the history
+	Applied     int64          `json:"applied"` // Lifecycle events applied to a profile
+	Ignored     int64          `json:"ignored"` // Other events, or events without a user
+	Failed      int64          `json:"failed"`  // Unreadable
+	Profiles    int            `json:"profiles"`
+	Stages      map[string]int `json:"stages"` // Profiles per lifecycle stage once done
+	CompletedAt time.Time      `json:"completed_at"`
+}
+
+// bootstrapPage is a page of a bulk history endpoint
+type bootstrapPage struct {
+	Events     []json.RawMessage `json:"events"`
+	NextCursor string            `json:"next_cursor"`
+}
+
+// ProfileBootstrap seeds user profiles and lifecycle stages from the history of the billing and
+// auth services, for customers who existed before the analytics service was deployed. History is
+// read from the Kafka topics, which only retain recent messages, or paged from the bulk history
+// endpoints of the services. Seeding goes through the same rules as live events, so it can run
+// while events are consumed, and be run again.
+type ProfileBootstrap struct {
+	profiles    *UserProfiles
+	historyURLs []string
+	pageSize    int
+	client      *http.Client
+}
+
+// NewProfileBootstrap creates a bootstrap reading the bulk history endpoints of
+// BOOTSTRAP_HISTORY_URLS, comma-separated, BOOTSTRAP_PAGE_SIZE events at a time (default 1000),
+// each request timing out after BOOTSTRAP_TIMEOUT (default 30s)
+func NewProfileBootstrap(profiles *UserProfiles) *ProfileBootstrap {
+	bootstrap := &ProfileBootstrap{
+		profiles: profiles,
+		pageSize: max(getEnvInt("BOOTSTRAP_PAGE_SIZE", 1000), 1),
+		client:   &http.Client{Timeout: getEnvDuration("BOOTSTRAP_TIMEOUT", 30*time.Second)},
+	}
+	for _, historyURL := range strings.Split(os.Getenv("BOOTSTRAP_HISTORY_URLS"), ",") {
+		if historyURL = strings.TrimSpace(historyURL); historyURL != "" {
+			bootstrap.historyURLs = append(bootstrap.historyURLs, historyURL)
+		}
+	}
+	return bootstrap
+}
+
+// HistoryURLs returns the bulk history endpoints read by API bootstraps
+func (b *ProfileBootstrap) HistoryURLs() []string {
+	return append([]string(nil), b.historyURLs...)
+}
+
+// Run reads the requested history and applies it to the user profiles. Kafka bootstraps need the
+// consumer of the topics.
+func (b *ProfileBootstrap) Run(ctx context.Context, consumer *KafkaConsumerService, request BootstrapRequest) (*BootstrapResult, error) {
+	if request.To.IsZero() {
+		request.To = time.Now()
+	}
+	if !request.To.After(request.From) {
+		return nil, fmt.Errorf("to must be after from")
+	}
+
+	result := &BootstrapResult{Source: request.Source, From: request.From, To: request.To}
+	var err error
+	switch request.Source {
+	case BootstrapSourceKafka:
+		err = b.readKafka(ctx, consumer, request, result)
+	case BootstrapSourceAPI:
+		err = b.readAPI(ctx, request, result)
+	default:
+		err = fmt.Errorf("unknown source: %s. Valid sources are: %s, %s", request.Source, BootstrapSourceKafka, BootstrapSourceAPI)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.Stages = b.profiles.Stages()
+	for _, count := range result.Stages {
+		result.Profiles += count
+	}
+	result.CompletedAt = time.Now()
+	log.Printf("Bootstrapped user profiles from %d %s events: %d applied, %d failed", result.Events, result.Source, result.Applied, result.Failed)
+	return result, nil
+}
+
+// readKafka applies the messages the topics retain in the time range
+func (b *ProfileBootstrap) readKafka(ctx context.Context, consumer *KafkaConsumerService, request BootstrapRequest, result *BootstrapResult) error {
+	if consumer == nil {
+		return fmt.Errorf("Kafka consumer is not running")
+	}
+	result.Topics = request.Topics
+	if len(result.Topics) == 0 {
+		result.Topics = defaultBootstrapTopics
+	}
+	consumer.mu.RLock()
+	for _, topic := range result.Topics {
+		if !consumer.hasTopic(topic) {
+			consumer.mu.RUnlock()
+			return fmt.Errorf("topic %s is not consumed by this service", topic)
+		}
+	}
+	consumer.mu.RUnlock()
+
+	for _, topic := range result.Topics {
+		_, err := consumer.readRange(ctx, topic, request.From, request.To, func(msg *sarama.ConsumerMessage) {
+			b.apply(msg.Value, result)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readAPI applies the events of every bulk history endpoint in the time range, page by page
+func (b *ProfileBootstrap) readAPI(ctx context.Context, request BootstrapRequest, result *BootstrapResult) error {
+	if len(b.historyURLs) == 0 {
+		return fmt.Errorf("no history endpoints configured, set BOOTSTRAP_HISTORY_URLS")
+	}
+	result.URLs = b.historyURLs
+
+	for _, historyURL := range b.historyURLs {
+		cursor := ""
+		for {
+			page, err := b.fetch(ctx, historyURL, request, cursor)
+			if err != nil {
+				return err
+			}
+			jobFromContext(ctx).scan(int64(len(page.Events)))
+			for _, raw := range page.Events {
+				b.apply(raw, result)
+			}
+			if page.NextCursor == "" || len(page.Events) == 0 {
+				break
+			}
+			cursor = page.NextCursor
+		}
+	}
+	return nil
+}
+
+// fetch requests a page of a bulk history endpoint
+func (b *ProfileBootstrap) fetch(ctx context.Context, historyURL string, request BootstrapRequest, cursor string) (*bootstrapPage, error) {
+	query := url.Values{}
+	if !request.From.IsZero() {
+		query.Set("from", request.From.UTC().Format(time.RFC3339))
+	}
+	query.Set("to", request.To.UTC().Format(time.RFC3339))
+	query.Set("limit", strconv.Itoa(b.pageSize))
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	separator := "?"
+	if strings.Contains(historyURL, "?") {
+		separator = "&"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, historyURL+separator+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request history from %s: %w", historyURL, err)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request history from %s: %w", historyURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("history endpoint %s returned status %d", historyURL, resp.StatusCode)
+	}
+
+	var page bootstrapPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("invalid history page from %s: %w", historyURL, err)
+	}
+	return &page, nil
+}
+
+// apply applies an event of the history to the user profiles, counting the outcome
+func (b *ProfileBootstrap) apply(raw []byte, result *BootstrapResult) {
+	result.Events++
+	var event CrossServiceEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		result.Failed++
+		return
+	}
+	if b.profiles.Apply(&event, true) {
+		result.Applied++
+	} else {
+		result.Ignored++
+	}
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// DefaultProjectID is used when a request or event does not specify a project
+const DefaultProjectID = "default"
+
+// projectContextKey is the context key holding the project ID
+type projectContextKey struct{}
+
+// ContextWithProject returns a context carrying the project ID
+func ContextWithProject(ctx context.Context, projectID string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, projectContextKey{}, projectID)
+}
+
+// ProjectFromContext returns the project ID carried by the context, or the default project
+func ProjectFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return DefaultProjectID
+	}
+	if projectID, ok := ctx.Value(projectContextKey{}).(string); ok && projectID != "" {
+		return projectID
+	}
+	return DefaultProjectID
+}
+
+// projectIDFromRequest extracts the project ID from the X-Project-ID header or project_id query parameter
+func projectIDFromRequest(c *fiber.Ctx) string {
+	projectID := c.Get("X-Project-ID")
+	if projectID == "" {
+		projectID = c.Query("project_id")
+	}
+	if projectID == "" {
+		return DefaultProjectID
+	}
+	return utils.CopyString(projectID)
+}
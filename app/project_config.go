@@ -0,0 +1,733 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProjectConfigVersion is the version of the project configuration document format
+const ProjectConfigVersion = 1
+
+// Actions of a project configuration change
+const (
+	ConfigActionCreate = "create"
+	ConfigActionUpdate = "update"
+	ConfigActionDelete = "delete"
+)
+
+// ProjectConfig is the declarative configuration of a project: every funnel, saved query,
+// dashboard, goal and alert, identified by name, and the event schemas it relies on. Segments are
+// saved queries of type segment; alerts are data quality monitors.
+type ProjectConfig struct {
+	Version    int               `json:"version" yaml:"version"`
+	Project    string            `json:"project,omitempty" yaml:"project,omitempty"`
+	Funnels    []FunnelConfig    `json:"funnels" yaml:"funnels"`
+	Queries    []QueryConfig     `json:"queries" yaml:"queries"`
+	Dashboards []DashboardConfig `json:"dashboards" yaml:"dashboards"`
+	Goals      []GoalConfig      `json:"goals" yaml:"goals"`
+	Alerts     []AlertConfig     `json:"alerts" yaml:"alerts"`
+	Schemas    []SchemaConfig    `json:"schemas" yaml:"schemas"`
+}
+
+// FunnelConfig declares a funnel; steps are ordered by their position
+type FunnelConfig struct {
+	Name        string             `json:"name" yaml:"name"`
+	Description string             `json:"description,omitempty" yaml:"description,omitempty"`
+	Steps       []FunnelStepConfig `json:"steps" yaml:"steps"`
+}
+
+// FunnelStepConfig declares a funnel step
+type FunnelStepConfig struct {
+	Name        string                 `json:"name" yaml:"name"`
+	EventType   string                 `json:"event_type" yaml:"event_type"`
+	Source      string                 `json:"source,omitempty" yaml:"source,omitempty"`
+	Filters     map[string]interface{} `json:"filters,omitempty" yaml:"filters,omitempty"`
+	Description string                 `json:"description,omitempty" yaml:"description,omitempty"`
+}
+
+// QueryConfig declares a saved query
+type QueryConfig struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Type        string                 `json:"type" yaml:"type"`
+	Description string                 `json:"description,omitempty" yaml:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty" yaml:"parameters,omitempty"`
+}
+
+// DashboardConfig declares a saved dashboard
+type DashboardConfig struct {
+	Name        string                  `json:"name" yaml:"name"`
+	Description string                  `json:"description,omitempty" yaml:"description,omitempty"`
+	Widgets     []DashboardWidgetConfig `json:"widgets" yaml:"widgets"`
+}
+
+// DashboardWidgetConfig declares a widget showing either a saved query, by name, or a live metric
+type DashboardWidgetConfig struct {
+	Title  string `json:"title" yaml:"title"`
+	Query  string `json:"query,omitempty" yaml:"query,omitempty"`
+	Metric string `json:"metric,omitempty" yaml:"metric,omitempty"`
+}
+
+// GoalConfig declares a goal
+type GoalConfig struct {
+	Name        string                 `json:"name" yaml:"name"`
+	Description string                 `json:"description,omitempty" yaml:"description,omitempty"`
+	EventType   string                 `json:"event_type" yaml:"event_type"`
+	Page        string                 `json:"page,omitempty" yaml:"page,omitempty"`
+	Filters     map[string]interface{} `json:"filters,omitempty" yaml:"filters,omitempty"`
+}
+
+// AlertConfig declares a data quality monitor alerting on the project's events
+type AlertConfig struct {
+	Name        string  `json:"name" yaml:"name"`
+	Type        string  `json:"type" yaml:"type"`
+	EventType   string  `json:"event_type,omitempty" yaml:"event_type,omitempty"`
+	Property    string  `json:"property,omitempty" yaml:"property,omitempty"`
+	MaxNullRate float64 `json:"max_null_rate,omitempty" yaml:"max_null_rate,omitempty"`
+	MinEvents   int64   `json:"min_events,omitempty" yaml:"min_events,omitempty"`
+	Min         *int64  `json:"min,omitempty" yaml:"min,omitempty"`
+	Max         *int64  `json:"max,omitempty" yaml:"max,omitempty"`
+	Tolerance   float64 `json:"tolerance,omitempty" yaml:"tolerance,omitempty"`
+}
+
+// SchemaConfig declares the required fields and field types of an event type
+type SchemaConfig struct {
+	EventType      string            `json:"event_type" yaml:"event_type"`
+	RequiredFields []string          `json:"required_fields" yaml:"required_fields"`
+	FieldTypes     map[string]string `json:"field_types,omitempty" yaml:"field_types,omitempty"`
+}
+
+// ConfigChange is a change needed to bring a project in line with its configuration document
+type ConfigChange struct {
+	Kind   string   `json:"kind"` // funnel, query, dashboard, goal or alert
+	Name   string   `json:"name"`
+	Action string   `json:"action"`
+	Fields []string `json:"fields,omitempty"` // Fields that differ, for updates
+}
+
+// ConfigValidationError lists every problem found in a configuration document
+type ConfigValidationError struct {
+	Problems []string
+}
+
+// Error summarizes the problems
+func (e *ConfigValidationError) Error() string {
+	return fmt.Sprintf("invalid project configuration: %s", strings.Join(e.Problems, "; "))
+}
+
+// ProjectConfigService exports and applies project configuration documents
+type ProjectConfigService struct {
+	funnels         *FunnelService
+	savedQueries    *SavedQueryService
+	savedDashboards *SavedDashboardService
+	goals           *GoalService
+	monitors        *DataQualityMonitors
+	schemas         *SchemaValidator
+	mutex           sync.Mutex // Serializes applies so concurrent imports cannot interleave
+}
+
+// NewProjectConfigService creates a new project configuration service
+func NewProjectConfigService(funnels *FunnelService, savedQueries *SavedQueryService, savedDashboards *SavedDashboardService, goals *GoalService, monitors *DataQualityMonitors, schemas *SchemaValidator) *ProjectConfigService {
+	return &ProjectConfigService{
+		funnels:         funnels,
+		savedQueries:    savedQueries,
+		savedDashboards: savedDashboards,
+		goals:           goals,
+		monitors:        monitors,
+		schemas:         schemas,
+	}
+}
+
+// ParseProjectConfig strictly decodes a JSON or YAML configuration document; unknown
+// sections and fields are rejected rather than silently dropped
+func ParseProjectConfig(data []byte, isYAML bool) (*ProjectConfig, error) {
+	if isYAML {
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("invalid YAML document: %w", err)
+		}
+		// Normalize through JSON so both formats share the same strict decoding
+		normalized, err := json.Marshal(document)
+		if err != nil {
+			return nil, fmt.Errorf("invalid YAML document: %w", err)
+		}
+		data = normalized
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var config ProjectConfig
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid configuration document: %w", err)
+	}
+	return &config, nil
+}
+
+// Export returns the configuration of the context's project. Schemas are shared by every project
+// and included in every project's document.
+func (s *ProjectConfigService) Export(ctx context.Context) *ProjectConfig {
+	config := &ProjectConfig{
+		Version:    ProjectConfigVersion,
+		Project:    ProjectFromContext(ctx),
+		Funnels:    make([]FunnelConfig, 0),
+		Queries:    make([]QueryConfig, 0),
+		Dashboards: make([]DashboardConfig, 0),
+		Goals:      make([]GoalConfig, 0),
+		Alerts:     make([]AlertConfig, 0),
+		Schemas:    make([]SchemaConfig, 0),
+	}
+
+	for _, funnel := range s.funnels.ListFunnels(ctx) {
+		config.Funnels = append(config.Funnels, funnelConfig(funnel))
+	}
+
+	queryNames := make(map[string]string)
+	for _, query := range s.savedQueries.ListQueries(ctx) {
+		queryNames[query.ID] = query.Name
+		config.Queries = append(config.Queries, queryConfig(query))
+	}
+
+	for _, dashboard := range s.savedDashboards.ListDashboards(ctx) {
+		config.Dashboards = append(config.Dashboards, dashboardConfig(dashboard, queryNames))
+	}
+
+	for _, goal := range s.goals.Get(ProjectFromContext(ctx)).Goals {
+		config.Goals = append(config.Goals, goalConfig(goal))
+	}
+
+	for _, monitor := range s.monitors.Get(ProjectFromContext(ctx)).Monitors {
+		config.Alerts = append(config.Alerts, alertConfig(monitor))
+	}
+
+	for _, schema := range s.schemas.ListSchemas() {
+		config.Schemas = append(config.Schemas, schemaConfig(schema))
+	}
+
+	return config
+}
+
+// Plan validates a configuration document and returns the changes applying it would make
+func (s *ProjectConfigService) Plan(ctx context.Context, config *ProjectConfig) ([]ConfigChange, error) {
+	if err := s.validate(ctx, config); err != nil {
+		return nil, err
+	}
+	return s.diff(ctx, config).changes(), nil
+}
+
+// Apply validates a configuration document and makes the context's project match it:
+// resources are created or updated by name, and project resources missing from the
+// document are deleted. Schemas are shared by every project, so a document may only list them
+// as they are; they are changed through the schema API.
+func (s *ProjectConfigService) Apply(ctx context.Context, config *ProjectConfig) ([]ConfigChange, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.validate(ctx, config); err != nil {
+		return nil, err
+	}
+	plan := s.diff(ctx, config)
+
+	// Queries come before dashboards, which reference them by ID
+	queryIDs := make(map[string]string)
+	for _, query := range config.Queries {
+		existing := plan.existingQueries[query.Name]
+		switch {
+		case existing == nil:
+			created, err := s.savedQueries.CreateQuery(ctx, query.Name, query.Description, query.Type, query.Parameters)
+			if err != nil {
+				return nil, fmt.Errorf("query %s: %w", query.Name, err)
+			}
+			queryIDs[query.Name] = created.ID
+		case plan.queries[query.Name] != nil:
+			if _, err := s.savedQueries.UpdateQuery(ctx, existing.ID, query.Name, query.Description, query.Type, query.Parameters, AnyVersion); err != nil {
+				return nil, fmt.Errorf("query %s: %w", query.Name, err)
+			}
+			queryIDs[query.Name] = existing.ID
+		default:
+			queryIDs[query.Name] = existing.ID
+		}
+	}
+
+	for _, funnel := range config.Funnels {
+		existing := plan.existingFunnels[funnel.Name]
+		var err error
+		switch {
+		case existing == nil:
+			_, err = s.funnels.CreateFunnel(ctx, funnel.Name, funnel.Description, funnel.steps())
+		case plan.funnels[funnel.Name] != nil:
+			_, err = s.funnels.UpdateFunnel(ctx, existing.ID, funnel.Name, funnel.Description, funnel.steps(), AnyVersion)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("funnel %s: %w", funnel.Name, err)
+		}
+	}
+
+	for _, dashboard := range config.Dashboards {
+		existing := plan.existingDashboards[dashboard.Name]
+		var err error
+		switch {
+		case existing == nil:
+			_, err = s.savedDashboards.CreateDashboard(ctx, dashboard.Name, dashboard.Description, dashboard.widgets(queryIDs))
+		case plan.dashboards[dashboard.Name] != nil:
+			_, err = s.savedDashboards.UpdateDashboard(ctx, existing.ID, dashboard.Name, dashboard.Description, dashboard.widgets(queryIDs), AnyVersion)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("dashboard %s: %w", dashboard.Name, err)
+		}
+	}
+
+	// Delete dashboards first so no remaining dashboard references a deleted query
+	for _, id := range plan.deletedDashboards {
+		if err := s.savedDashboards.DeleteDashboard(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range plan.deletedFunnels {
+		if err := s.funnels.DeleteFunnel(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range plan.deletedQueries {
+		if err := s.savedQueries.DeleteQuery(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	// Goals and alerts are replaced as a whole, keeping the baselines of unchanged alerts
+	projectID := ProjectFromContext(ctx)
+	if plan.changesKind("goal") {
+		if _, err := s.goals.Replace(projectID, config.goals(), AnyVersion); err != nil {
+			return nil, fmt.Errorf("goals: %w", err)
+		}
+	}
+	if plan.changesKind("alert") {
+		if _, err := s.monitors.Replace(projectID, config.alerts(), AnyVersion); err != nil {
+			return nil, fmt.Errorf("alerts: %w", err)
+		}
+	}
+
+	return plan.changes(), nil
+}
+
+// validate checks a whole document, collecting every problem instead of stopping at the first
+func (s *ProjectConfigService) validate(ctx context.Context, config *ProjectConfig) error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if config.Version != ProjectConfigVersion {
+		addProblem("unsupported version %d, expected %d", config.Version, ProjectConfigVersion)
+	}
+	if config.Project != "" && config.Project != ProjectFromContext(ctx) {
+		addProblem("document is for project %s, not %s", config.Project, ProjectFromContext(ctx))
+	}
+
+	funnelNames := make(map[string]bool)
+	for i, funnel := range config.Funnels {
+		if funnel.Name != "" && funnelNames[funnel.Name] {
+			addProblem("funnels[%d]: duplicate funnel name %q", i, funnel.Name)
+		}
+		funnelNames[funnel.Name] = true
+		if err := validateFunnel(funnel.Name, funnel.steps()); err != nil {
+			addProblem("funnels[%d]: %v", i, err)
+		}
+	}
+
+	queryNames := make(map[string]bool)
+	for i, query := range config.Queries {
+		if query.Name != "" && queryNames[query.Name] {
+			addProblem("queries[%d]: duplicate query name %q", i, query.Name)
+		}
+		queryNames[query.Name] = true
+		if err := s.savedQueries.checkQuery(query.Name, query.Type); err != nil {
+			addProblem("queries[%d]: %v", i, err)
+		}
+	}
+
+	dashboardNames := make(map[string]bool)
+	for i, dashboard := range config.Dashboards {
+		if dashboard.Name == "" {
+			addProblem("dashboards[%d]: dashboard name is required", i)
+		} else if dashboardNames[dashboard.Name] {
+			addProblem("dashboards[%d]: duplicate dashboard name %q", i, dashboard.Name)
+		}
+		dashboardNames[dashboard.Name] = true
+		if len(dashboard.Widgets) == 0 {
+			addProblem("dashboards[%d]: dashboard must have at least one widget", i)
+		}
+		for j, widget := range dashboard.Widgets {
+			if (widget.Query == "") == (widget.Metric == "") {
+				addProblem("dashboards[%d].widgets[%d]: widget must reference either a query or a metric", i, j)
+			} else if widget.Query != "" && !queryNames[widget.Query] {
+				addProblem("dashboards[%d].widgets[%d]: query %q is not defined in the document", i, j, widget.Query)
+			}
+		}
+	}
+
+	if _, err := normalizeGoals(config.goals()); err != nil {
+		addProblem("goals: %v", err)
+	}
+	if _, err := normalizeMonitors(config.alerts()); err != nil {
+		addProblem("alerts: %v", err)
+	}
+
+	// Schemas are shared by every project, so importing one project's document must not change them
+	eventTypes := make(map[string]bool)
+	for i, schema := range config.Schemas {
+		if schema.EventType == "" {
+			addProblem("schemas[%d]: event type is required", i)
+			continue
+		} else if eventTypes[schema.EventType] {
+			addProblem("schemas[%d]: duplicate schema for event type %q", i, schema.EventType)
+		}
+		eventTypes[schema.EventType] = true
+		current, err := s.schemas.GetSchema(schema.EventType)
+		if err != nil {
+			addProblem("schemas[%d]: there is no schema for event type %q; schemas are shared by every project and are created with PUT /api/v1/schemas/%s", i, schema.EventType, schema.EventType)
+		} else if fields := changedFields(schemaConfig(current), schema); len(fields) > 0 {
+			addProblem("schemas[%d]: %s of event type %q differ from the shared schema; schemas are shared by every project and are changed with PUT /api/v1/schemas/%s", i, strings.Join(fields, ", "), schema.EventType, schema.EventType)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ConfigValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// configPlan holds the differences between a document and the current project state
+type configPlan struct {
+	existingFunnels    map[string]*Funnel
+	existingQueries    map[string]*SavedQuery
+	existingDashboards map[string]*SavedDashboard
+
+	// Changes by name; a nil entry is a creation
+	funnels    map[string]*ConfigChange
+	queries    map[string]*ConfigChange
+	dashboards map[string]*ConfigChange
+	goals      map[string]*ConfigChange
+	alerts     map[string]*ConfigChange
+
+	deletedFunnels    []string
+	deletedQueries    []string
+	deletedDashboards []string
+	deletions         []ConfigChange
+	creations         []ConfigChange
+}
+
+// diff compares a validated document with the current state of the context's project
+func (s *ProjectConfigService) diff(ctx context.Context, config *ProjectConfig) *configPlan {
+	plan := &configPlan{
+		existingFunnels:    make(map[string]*Funnel),
+		existingQueries:    make(map[string]*SavedQuery),
+		existingDashboards: make(map[string]*SavedDashboard),
+		funnels:            make(map[string]*ConfigChange),
+		queries:            make(map[string]*ConfigChange),
+		dashboards:         make(map[string]*ConfigChange),
+		goals:              make(map[string]*ConfigChange),
+		alerts:             make(map[string]*ConfigChange),
+	}
+
+	// Resources are matched by name; when several share a name, the oldest is kept
+	declaredFunnels := make(map[string]bool)
+	for _, funnel := range config.Funnels {
+		declaredFunnels[funnel.Name] = true
+	}
+	for _, funnel := range s.funnels.ListFunnels(ctx) {
+		if _, seen := plan.existingFunnels[funnel.Name]; seen || !declaredFunnels[funnel.Name] {
+			plan.deletedFunnels = append(plan.deletedFunnels, funnel.ID)
+			plan.deletions = append(plan.deletions, ConfigChange{Kind: "funnel", Name: funnel.Name, Action: ConfigActionDelete})
+			continue
+		}
+		plan.existingFunnels[funnel.Name] = funnel
+	}
+
+	declaredQueries := make(map[string]bool)
+	for _, query := range config.Queries {
+		declaredQueries[query.Name] = true
+	}
+	queryNames := make(map[string]string)
+	for _, query := range s.savedQueries.ListQueries(ctx) {
+		queryNames[query.ID] = query.Name
+		if _, seen := plan.existingQueries[query.Name]; seen || !declaredQueries[query.Name] {
+			plan.deletedQueries = append(plan.deletedQueries, query.ID)
+			plan.deletions = append(plan.deletions, ConfigChange{Kind: "query", Name: query.Name, Action: ConfigActionDelete})
+			continue
+		}
+		plan.existingQueries[query.Name] = query
+	}
+
+	declaredDashboards := make(map[string]bool)
+	for _, dashboard := range config.Dashboards {
+		declaredDashboards[dashboard.Name] = true
+	}
+	existingDashboardConfigs := make(map[string]DashboardConfig)
+	for _, dashboard := range s.savedDashboards.ListDashboards(ctx) {
+		if _, seen := plan.existingDashboards[dashboard.Name]; seen || !declaredDashboards[dashboard.Name] {
+			plan.deletedDashboards = append(plan.deletedDashboards, dashboard.ID)
+			plan.deletions = append(plan.deletions, ConfigChange{Kind: "dashboard", Name: dashboard.Name, Action: ConfigActionDelete})
+			continue
+		}
+		plan.existingDashboards[dashboard.Name] = dashboard
+		existingDashboardConfigs[dashboard.Name] = dashboardConfig(dashboard, queryNames)
+	}
+
+	for _, query := range config.Queries {
+		existing, exists := plan.existingQueries[query.Name]
+		if !exists {
+			plan.creations = append(plan.creations, ConfigChange{Kind: "query", Name: query.Name, Action: ConfigActionCreate})
+			continue
+		}
+		if fields := changedFields(queryConfig(existing), query); len(fields) > 0 {
+			plan.queries[query.Name] = &ConfigChange{Kind: "query", Name: query.Name, Action: ConfigActionUpdate, Fields: fields}
+		}
+	}
+
+	for _, funnel := range config.Funnels {
+		existing, exists := plan.existingFunnels[funnel.Name]
+		if !exists {
+			plan.creations = append(plan.creations, ConfigChange{Kind: "funnel", Name: funnel.Name, Action: ConfigActionCreate})
+			continue
+		}
+		if fields := changedFields(funnelConfig(existing), funnel); len(fields) > 0 {
+			plan.funnels[funnel.Name] = &ConfigChange{Kind: "funnel", Name: funnel.Name, Action: ConfigActionUpdate, Fields: fields}
+		}
+	}
+
+	for _, dashboard := range config.Dashboards {
+		existing, exists := existingDashboardConfigs[dashboard.Name]
+		if !exists {
+			plan.creations = append(plan.creations, ConfigChange{Kind: "dashboard", Name: dashboard.Name, Action: ConfigActionCreate})
+			continue
+		}
+		if fields := changedFields(existing, dashboard); len(fields) > 0 {
+			plan.dashboards[dashboard.Name] = &ConfigChange{Kind: "dashboard", Name: dashboard.Name, Action: ConfigActionUpdate, Fields: fields}
+		}
+	}
+
+	projectID := ProjectFromContext(ctx)
+	existingGoals := make(map[string]interface{})
+	for _, goal := range s.goals.Get(projectID).Goals {
+		existingGoals[goal.Name] = goalConfig(goal)
+	}
+	desiredGoals, _ := normalizeGoals(config.goals())
+	for _, goal := range desiredGoals {
+		plan.diffNamed("goal", plan.goals, goal.Name, existingGoals, goalConfig(goal))
+	}
+	plan.deleteUndeclared("goal", existingGoals)
+
+	existingAlerts := make(map[string]interface{})
+	for _, monitor := range s.monitors.Get(projectID).Monitors {
+		existingAlerts[monitor.Name] = alertConfig(monitor)
+	}
+	// Defaults are filled in before comparing, so leaving them out is not a change
+	desiredAlerts, _ := normalizeMonitors(config.alerts())
+	for _, monitor := range desiredAlerts {
+		plan.diffNamed("alert", plan.alerts, monitor.Name, existingAlerts, alertConfig(monitor))
+	}
+	plan.deleteUndeclared("alert", existingAlerts)
+
+	return plan
+}
+
+// diffNamed records the change bringing a goal or alert in line with its declaration, removing it
+// from existing so the ones left over are the ones to delete
+func (p *configPlan) diffNamed(kind string, changes map[string]*ConfigChange, name string, existing map[string]interface{}, desired interface{}) {
+	current, exists := existing[name]
+	if !exists {
+		changes[name] = nil
+		p.creations = append(p.creations, ConfigChange{Kind: kind, Name: name, Action: ConfigActionCreate})
+		return
+	}
+	delete(existing, name)
+	if fields := changedFields(current, desired); len(fields) > 0 {
+		changes[name] = &ConfigChange{Kind: kind, Name: name, Action: ConfigActionUpdate, Fields: fields}
+	}
+}
+
+// deleteUndeclared records the deletion of the goals or alerts left over by diffNamed, by name
+func (p *configPlan) deleteUndeclared(kind string, existing map[string]interface{}) {
+	names := make([]string, 0, len(existing))
+	for name := range existing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.deletions = append(p.deletions, ConfigChange{Kind: kind, Name: name, Action: ConfigActionDelete})
+	}
+}
+
+// changes lists the planned changes: creations, then updates, then deletions
+func (p *configPlan) changes() []ConfigChange {
+	changes := append(make([]ConfigChange, 0), p.creations...)
+
+	var updates []ConfigChange
+	for _, byName := range []map[string]*ConfigChange{p.queries, p.funnels, p.dashboards, p.goals, p.alerts} {
+		for _, change := range byName {
+			if change != nil {
+				updates = append(updates, *change)
+			}
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		if updates[i].Kind != updates[j].Kind {
+			return updates[i].Kind < updates[j].Kind
+		}
+		return updates[i].Name < updates[j].Name
+	})
+
+	changes = append(changes, updates...)
+	return append(changes, p.deletions...)
+}
+
+// changesKind reports whether any resource of a kind is created, updated or deleted
+func (p *configPlan) changesKind(kind string) bool {
+	for _, change := range p.changes() {
+		if change.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// changedFields returns the JSON names of the fields that differ between two configurations of
+// the same type, compared in their JSON form so decoded and stored values compare equal
+func changedFields(current, desired interface{}) []string {
+	var fields []string
+	currentValue := reflect.ValueOf(current)
+	desiredValue := reflect.ValueOf(desired)
+	for i := 0; i < currentValue.NumField(); i++ {
+		field := currentValue.Type().Field(i)
+		if !sameJSON(currentValue.Field(i).Interface(), desiredValue.Field(i).Interface()) {
+			fields = append(fields, strings.Split(field.Tag.Get("json"), ",")[0])
+		}
+	}
+	return fields
+}
+
+// sameJSON reports whether two values have the same JSON encoding, treating empty
+// collections like missing ones
+func sameJSON(a, b interface{}) bool {
+	encodedA, _ := json.Marshal(a)
+	encodedB, _ := json.Marshal(b)
+	return normalizeEmptyJSON(encodedA) == normalizeEmptyJSON(encodedB)
+}
+
+func normalizeEmptyJSON(encoded []byte) string {
+	switch string(encoded) {
+	case "[]", "{}":
+		return "null"
+	}
+	return string(encoded)
+}
+
+// steps converts the declared steps to Step structs, ordered by position
+func (f FunnelConfig) steps() []Step {
+	steps := make([]Step, 0, len(f.Steps))
+	for i, step := range f.Steps {
+		steps = append(steps, Step{
+			ID:          fmt.Sprintf("step_%d", i+1),
+			Name:        step.Name,
+			EventType:   step.EventType,
+			Source:      step.Source,
+			Filters:     step.Filters,
+			Order:       i + 1,
+			Description: step.Description,
+		})
+	}
+	return steps
+}
+
+// goals converts the declared goals
+func (c *ProjectConfig) goals() []Goal {
+	goals := make([]Goal, 0, len(c.Goals))
+	for _, goal := range c.Goals {
+		goals = append(goals, Goal(goal))
+	}
+	return goals
+}
+
+// alerts converts the declared alerts to data quality monitors
+func (c *ProjectConfig) alerts() []DataQualityMonitor {
+	monitors := make([]DataQualityMonitor, 0, len(c.Alerts))
+	for _, alert := range c.Alerts {
+		monitors = append(monitors, DataQualityMonitor(alert))
+	}
+	return monitors
+}
+
+// widgets converts the declared widgets, resolving query names to saved query IDs
+func (d DashboardConfig) widgets(queryIDs map[string]string) []DashboardWidget {
+	widgets := make([]DashboardWidget, 0, len(d.Widgets))
+	for _, widget := range d.Widgets {
+		converted := DashboardWidget{Title: widget.Title, Metric: widget.Metric}
+		if widget.Query != "" {
+			converted.QueryID = queryIDs[widget.Query]
+		}
+		widgets = append(widgets, converted)
+	}
+	return widgets
+}
+
+// funnelConfig describes a stored funnel
+func funnelConfig(funnel *Funnel) FunnelConfig {
+	steps := append([]Step{}, funnel.Steps...)
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Order < steps[j].Order })
+
+	config := FunnelConfig{Name: funnel.Name, Description: funnel.Description, Steps: make([]FunnelStepConfig, 0, len(steps))}
+	for _, step := range steps {
+		config.Steps = append(config.Steps, FunnelStepConfig{
+			Name:        step.Name,
+			EventType:   step.EventType,
+			Source:      step.Source,
+			Filters:     step.Filters,
+			Description: step.Description,
+		})
+	}
+	return config
+}
+
+// queryConfig describes a saved query
+func queryConfig(query *SavedQuery) QueryConfig {
+	return QueryConfig{Name: query.Name, Type: query.Type, Description: query.Description, Parameters: query.Parameters}
+}
+
+// dashboardConfig describes a saved dashboard, referencing queries by name. Widgets of deleted
+// queries keep the query ID, which fails validation when the document is applied.
+func dashboardConfig(dashboard *SavedDashboard, queryNames map[string]string) DashboardConfig {
+	config := DashboardConfig{Name: dashboard.Name, Description: dashboard.Description, Widgets: make([]DashboardWidgetConfig, 0, len(dashboard.Widgets))}
+	for _, widget := range dashboard.Widgets {
+		converted := DashboardWidgetConfig{Title: widget.Title, Metric: widget.Metric}
+		if widget.QueryID != "" {
+			converted.Query = widget.QueryID
+			if name, exists := queryNames[widget.QueryID]; exists {
+				converted.Query = name
+			}
+		}
+		config.Widgets = append(config.Widgets, converted)
+	}
+	return config
+}
+
+// goalConfig describes a goal
+func goalConfig(goal Goal) GoalConfig {
+	return GoalConfig(goal)
+}
+
+// alertConfig describes a data quality monitor
+func alertConfig(monitor DataQualityMonitor) AlertConfig {
+	return AlertConfig(monitor)
+}
+
+// schemaConfig describes an event schema
+func schemaConfig(schema *SchemaDefinition) SchemaConfig {
+	return SchemaConfig{EventType: schema.EventType, RequiredFields: schema.RequiredFields, FieldTypes: schema.FieldTypes}
+}
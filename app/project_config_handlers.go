@@ -0,0 +1,97 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// wantsYAML reports whether the request asks for YAML through ?format=yaml or the given header
+func wantsYAML(c *fiber.Ctx, header string) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "yaml"
+	}
+	return strings.Contains(c.Get(header), "yaml")
+}
+
+// getProjectConfig exports the configuration of a project as JSON, or YAML when requested
+func (s *App) getProjectConfig(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), utils.CopyString(c.Params("id")))
+	config := s.projectConfigService.Export(ctx)
+	encrypted := s.encryptExport(c, ProjectFromContext(ctx))
+	s.siem.Export(requestSecurityEvent(c, SecurityExport, "project_config_exported", OutcomeSuccess, 3, map[string]interface{}{
+		"project_id": ProjectFromContext(ctx),
+		"encrypted":  encrypted,
+	}))
+
+	if !wantsYAML(c, fiber.HeaderAccept) && !encrypted {
+		return c.JSON(config)
+	}
+
+	var document []byte
+	var err error
+	if wantsYAML(c, fiber.HeaderAccept) {
+		document, err = yaml.Marshal(config)
+	} else {
+		document, err = json.Marshal(config)
+	}
+	if err != nil {
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if encrypted {
+		return s.sendEncryptedExport(c, ProjectFromContext(ctx), "config", document)
+	}
+	c.Set(fiber.HeaderContentType, "application/yaml")
+	return c.Send(document)
+}
+
+// putProjectConfig applies a JSON or YAML configuration document to a project. With
+// ?mode=diff the changes are only reported, not applied.
+func (s *App) putProjectConfig(c *fiber.Ctx) error {
+	mode := c.Query("mode", "apply")
+	if mode != "apply" && mode != "diff" {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "mode must be apply or diff",
+		})
+	}
+
+	config, err := ParseProjectConfig(c.Body(), wantsYAML(c, fiber.HeaderContentType))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), utils.CopyString(c.Params("id")))
+	var changes []ConfigChange
+	if mode == "diff" {
+		changes, err = s.projectConfigService.Plan(ctx, config)
+	} else {
+		changes, err = s.projectConfigService.Apply(ctx, config)
+	}
+	if err != nil {
+		var invalid *ConfigValidationError
+		if errors.As(err, &invalid) {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error":    "invalid project configuration",
+				"problems": invalid.Problems,
+			})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"applied": mode == "apply",
+		"changes": changes,
+	})
+}
@@ -0,0 +1,204 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Limits of property value queries
+const (
+	maxPropertyValues      = 1000 // Top values returned
+	maxPropertyHistogram   = 100  // Buckets of a numeric histogram
+	defaultPropertyValues  = 20
+	defaultPropertyBuckets = 10
+)
+
+// PropertyValuesQuery represents a query for the distribution of an event property's values
+type PropertyValuesQuery struct {
+	Property  string    `json:"property"`
+	EventType string    `json:"event_type,omitempty"` // Events of every type when empty
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Limit     int       `json:"limit,omitempty"`   // Top values returned (default 20)
+	Buckets   int       `json:"buckets,omitempty"` // Buckets of the histogram of numeric properties (default 10)
+}
+
+// PropertyValueCount is a value of a property and the events that had it
+type PropertyValueCount struct {
+	Value string  `json:"value"`
+	Count int64   `json:"count"`
+	Share float64 `json:"share"` // Of the events with the property, in percent
+	Users int64   `json:"users"`
+}
+
+// HistogramBucket counts the numeric values in [Lower, Upper), the last bucket including Upper
+type HistogramBucket struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	Count int64   `json:"count"`
+}
+
+// NumericDistribution summarizes the values of a property whose every value is a number
+type NumericDistribution struct {
+	Min       float64           `json:"min"`
+	Max       float64           `json:"max"`
+	Mean      float64           `json:"mean"`
+	Histogram []HistogramBucket `json:"histogram"`
+}
+
+// PropertyValuesResult is the distribution of a property's values over a period
+type PropertyValuesResult struct {
+	Property       string    `json:"property"`
+	EventType      string    `json:"event_type,omitempty"`
+	TimeRange      TimeRange `json:"time_range"`
+	TotalEvents    int64     `json:"total_events"`    // Events of the type in the period
+	EventsWithout  int64     `json:"events_without"`  // Of those, events missing the property or with a null value
+	DistinctValues int64     `json:"distinct_values"` // Distinct values of the property
+	// The most frequent values, then by value; OtherCount counts the events with the other values
+	Values     []PropertyValueCount `json:"values"`
+	OtherCount int64                `json:"other_count"`
+	Numeric    *NumericDistribution `json:"numeric,omitempty"` // Set when every value is a number
+	ComputedAt time.Time            `json:"computed_at"`
+}
+
+// ComputePropertyValues returns the top values of an event property of the project over the time
+// range with the events and users having each, and a histogram when the property is numeric
+func (s *QueryService) ComputePropertyValues(ctx context.Context, query PropertyValuesQuery) (*PropertyValuesResult, error) {
+	if query.Property == "" {
+		return nil, fmt.Errorf("property is required")
+	}
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultPropertyValues
+	}
+	if query.Limit < 0 || query.Limit > maxPropertyValues {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxPropertyValues)
+	}
+	if query.Buckets == 0 {
+		query.Buckets = defaultPropertyBuckets
+	}
+	if query.Buckets < 0 || query.Buckets > maxPropertyHistogram {
+		return nil, fmt.Errorf("buckets must be between 1 and %d", maxPropertyHistogram)
+	}
+
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		EventType: query.EventType,
+		Start:     query.Start,
+		End:       query.End,
+	})
+
+	result := &PropertyValuesResult{
+		Property:    query.Property,
+		EventType:   query.EventType,
+		TimeRange:   TimeRange{Start: query.Start, End: query.End},
+		TotalEvents: int64(len(events)),
+		Values:      []PropertyValueCount{},
+		ComputedAt:  time.Now(),
+	}
+
+	counts := make(map[string]*PropertyValueCount)
+	users := make(map[string]map[string]bool) // Value -> user IDs
+	var numbers []float64
+	numeric := true
+	for _, event := range events {
+		raw, exists := event.Properties[query.Property]
+		if !exists || raw == nil {
+			result.EventsWithout++
+			continue
+		}
+
+		value := fmt.Sprint(raw)
+		count, seen := counts[value]
+		if !seen {
+			count = &PropertyValueCount{Value: value}
+			counts[value] = count
+			users[value] = make(map[string]bool)
+		}
+		count.Count++
+		users[value][event.UserID] = true
+
+		if number, ok := propertyNumber(raw); ok && numeric {
+			numbers = append(numbers, number)
+		} else {
+			numeric = false
+		}
+	}
+
+	withProperty := result.TotalEvents - result.EventsWithout
+	for value, count := range counts {
+		count.Users = int64(len(users[value]))
+		count.Share = math.Round(10000*float64(count.Count)/float64(withProperty)) / 100
+		result.Values = append(result.Values, *count)
+	}
+	sort.Slice(result.Values, func(i, j int) bool {
+		if result.Values[i].Count != result.Values[j].Count {
+			return result.Values[i].Count > result.Values[j].Count
+		}
+		return result.Values[i].Value < result.Values[j].Value
+	})
+	result.DistinctValues = int64(len(result.Values))
+	if len(result.Values) > query.Limit {
+		for _, other := range result.Values[query.Limit:] {
+			result.OtherCount += other.Count
+		}
+		result.Values = result.Values[:query.Limit]
+	}
+
+	if numeric && len(numbers) > 0 {
+		result.Numeric = numericDistribution(numbers, query.Buckets)
+	}
+	return result, nil
+}
+
+// propertyNumber returns a property value as a number, if it is one
+func propertyNumber(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, !math.IsNaN(number) && !math.IsInf(number, 0)
+	case int:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	default:
+		return 0, false
+	}
+}
+
+// numericDistribution summarizes numbers in a histogram of equal-width buckets between their
+// minimum and maximum. Numbers that are all equal fill a single bucket.
+func numericDistribution(numbers []float64, buckets int) *NumericDistribution {
+	distribution := &NumericDistribution{Min: numbers[0], Max: numbers[0]}
+	var sum float64
+	for _, number := range numbers {
+		distribution.Min = math.Min(distribution.Min, number)
+		distribution.Max = math.Max(distribution.Max, number)
+		sum += number
+	}
+	distribution.Mean = sum / float64(len(numbers))
+
+	if distribution.Max == distribution.Min {
+		buckets = 1
+	}
+	width := (distribution.Max - distribution.Min) / float64(buckets)
+	distribution.Histogram = make([]HistogramBucket, buckets)
+	for i := range distribution.Histogram {
+		distribution.Histogram[i].Lower = distribution.Min + float64(i)*width
+		distribution.Histogram[i].Upper = distribution.Min + float64(i+1)*width
+	}
+	distribution.Histogram[buckets-1].Upper = distribution.Max
+
+	for _, number := range numbers {
+		bucket := buckets - 1
+		if width > 0 {
+			bucket = int(math.Min(float64(buckets-1), math.Floor((number-distribution.Min)/width)))
+		}
+		distribution.Histogram[bucket].Count++
+	}
+	return distribution
+}
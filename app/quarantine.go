@@ -0,0 +1,388 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuarantineSettings is whether a project keeps the events failing validation in quarantine
+// instead of rejecting them
+type QuarantineSettings struct {
+	Enabled bool  `json:"enabled"`
+	Version int64 `json:"version"` // Incremented on every update, exposed as the ETag
+}
+
+// QuarantinedEvent is an event that failed validation, kept as it was sent so it can be
+// re-validated once the schema or the instrumentation is fixed
+type QuarantinedEvent struct {
+	ID              string                 `json:"id"`
+	ProjectID       string                 `json:"project_id"`
+	EventType       string                 `json:"event_type,omitempty"`
+	UserID          string                 `json:"user_id,omitempty"`
+	APIKeyID        string                 `json:"api_key_id,omitempty"`
+	Data            map[string]interface{} `json:"data"`   // The event as sent
+	Errors          []string               `json:"errors"` // Why the last validation failed
+	ReceivedAt      time.Time              `json:"received_at"`
+	Attempts        int                    `json:"attempts"` // Validations, the first one included
+	LastValidatedAt time.Time              `json:"last_validated_at"`
+
+	apiKey string // Enriches the event again when it is promoted
+}
+
+// QuarantinedError is returned for an event kept in quarantine instead of being rejected. It
+// unwraps to the validation error.
+type QuarantinedError struct {
+	QuarantineID string
+	Err          error
+}
+
+func (e *QuarantinedError) Error() string {
+	return fmt.Sprintf("event quarantined as %s: %v", e.QuarantineID, e.Err)
+}
+
+func (e *QuarantinedError) Unwrap() error {
+	return e.Err
+}
+
+// QuarantineTransform fixes quarantined events before they are re-validated: it renames their
+// event type, then sets and removes properties
+type QuarantineTransform struct {
+	EventType        string                 `json:"event_type,omitempty"`
+	SetProperties    map[string]interface{} `json:"set_properties,omitempty"`
+	RemoveProperties []string               `json:"remove_properties,omitempty"`
+}
+
+// apply returns a copy of the event data with the transform applied
+func (t *QuarantineTransform) apply(data map[string]interface{}) map[string]interface{} {
+	transformed := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		transformed[key] = value
+	}
+	if t == nil {
+		return transformed
+	}
+
+	if t.EventType != "" {
+		transformed["event_type"] = t.EventType
+	}
+	if len(t.SetProperties) > 0 || len(t.RemoveProperties) > 0 {
+		properties := make(map[string]interface{})
+		if own, ok := data["properties"].(map[string]interface{}); ok {
+			for key, value := range own {
+				properties[key] = value
+			}
+		}
+		for key, value := range t.SetProperties {
+			properties[key] = value
+		}
+		for _, key := range t.RemoveProperties {
+			delete(properties, key)
+		}
+		transformed["properties"] = properties
+	}
+	return transformed
+}
+
+// QuarantinePromotion is the outcome of re-validating a quarantined event
+type QuarantinePromotion struct {
+	ID      string   `json:"id"`
+	EventID string   `json:"event_id,omitempty"` // Set once promoted into the event store
+	Errors  []string `json:"errors,omitempty"`   // Why the event is still quarantined
+}
+
+// QuarantineRevalidation is the outcome of re-validating quarantined events
+type QuarantineRevalidation struct {
+	Promoted    []QuarantinePromotion `json:"promoted"`
+	Quarantined []QuarantinePromotion `json:"quarantined"` // Still failing, or not stored for another reason
+}
+
+// EventQuarantine keeps the events failing validation of the projects that opted in, so they are
+// not lost while a schema or the instrumentation sending them is fixed. At most
+// QUARANTINE_MAX_EVENTS events are kept per project; further invalid events are rejected.
+type EventQuarantine struct {
+	settings  map[string]*QuarantineSettings
+	events    map[string]map[string]*QuarantinedEvent // Project -> quarantine ID -> event
+	maxEvents int
+	clock     Clock
+	ids       IDGenerator
+	mutex     sync.RWMutex
+
+	revalidating sync.Mutex // Held while quarantined events are tracked again
+}
+
+// NewEventQuarantine creates an empty quarantine
+func NewEventQuarantine() *EventQuarantine {
+	return &EventQuarantine{
+		settings:  make(map[string]*QuarantineSettings),
+		events:    make(map[string]map[string]*QuarantinedEvent),
+		maxEvents: getEnvInt("QUARANTINE_MAX_EVENTS", 10000),
+		clock:     SystemClock(),
+		ids:       UUIDGenerator(),
+	}
+}
+
+// SetClock replaces the clock validations are timed with
+func (q *EventQuarantine) SetClock(clock Clock) {
+	q.clock = clock
+}
+
+// Settings returns the quarantine settings of a project
+func (q *EventQuarantine) Settings(projectID string) QuarantineSettings {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	if settings, exists := q.settings[projectID]; exists {
+		return *settings
+	}
+	return QuarantineSettings{}
+}
+
+// UpdateSettings turns the quarantine of a project on or off. It returns a VersionConflictError
+// unless expectedVersion is the current version (0 for a project without settings) or
+// AnyVersion. Turning it off keeps the events already quarantined.
+func (q *EventQuarantine) UpdateSettings(projectID string, enabled bool, expectedVersion int64) (QuarantineSettings, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var current int64
+	if existing, exists := q.settings[projectID]; exists {
+		current = existing.Version
+	}
+	if err := checkVersion("quarantine", projectID, current, expectedVersion); err != nil {
+		return QuarantineSettings{}, err
+	}
+
+	updated := &QuarantineSettings{Enabled: enabled, Version: current + 1}
+	q.settings[projectID] = updated
+	return *updated, nil
+}
+
+// Enabled reports whether a project keeps invalid events in quarantine
+func (q *EventQuarantine) Enabled(projectID string) bool {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	settings, exists := q.settings[projectID]
+	return exists && settings.Enabled
+}
+
+// Add quarantines an event of a project that failed validation. It returns false when the
+// project's quarantine is full.
+func (q *EventQuarantine) Add(projectID string, data map[string]interface{}, apiKey, userID string, receivedAt time.Time, validationErr error) (*QuarantinedEvent, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.maxEvents > 0 && len(q.events[projectID]) >= q.maxEvents {
+		return nil, false
+	}
+
+	eventType, _ := data["event_type"].(string)
+	event := &QuarantinedEvent{
+		ID:              q.ids.NewID(),
+		ProjectID:       projectID,
+		EventType:       eventType,
+		UserID:          userID,
+		Data:            data,
+		Errors:          []string{validationErr.Error()},
+		ReceivedAt:      receivedAt,
+		Attempts:        1,
+		LastValidatedAt: q.clock.Now(),
+		apiKey:          apiKey,
+	}
+	if apiKey != "" {
+		event.APIKeyID = APIKeyID(apiKey)
+	}
+	if q.events[projectID] == nil {
+		q.events[projectID] = make(map[string]*QuarantinedEvent)
+	}
+	q.events[projectID][event.ID] = event
+	return event.copy(), true
+}
+
+// List returns the quarantined events of a project, optionally of one event type, oldest first
+func (q *EventQuarantine) List(projectID, eventType string, limit int) []*QuarantinedEvent {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	events := make([]*QuarantinedEvent, 0)
+	for _, event := range q.events[projectID] {
+		if eventType == "" || event.EventType == eventType {
+			events = append(events, event.copy())
+		}
+	}
+	sortQuarantinedEvents(events)
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events
+}
+
+// Count returns the number of quarantined events of a project per event type
+func (q *EventQuarantine) Count(projectID string) map[string]int {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	counts := make(map[string]int)
+	for _, event := range q.events[projectID] {
+		counts[event.EventType]++
+	}
+	return counts
+}
+
+// Get returns a quarantined event of a project
+func (q *EventQuarantine) Get(projectID, id string) (*QuarantinedEvent, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	event, exists := q.events[projectID][id]
+	if !exists {
+		return nil, fmt.Errorf("quarantined event %s not found in project %s", id, projectID)
+	}
+	return event.copy(), nil
+}
+
+// Discard removes quarantined events of a project: the given ones, or else those of an event
+// type, or else all of them. It returns the number of events removed.
+func (q *EventQuarantine) Discard(projectID string, ids []string, eventType string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	removed := 0
+	for _, event := range q.selectLocked(projectID, ids, eventType) {
+		delete(q.events[projectID], event.ID)
+		removed++
+	}
+	return removed
+}
+
+// Select returns copies of the given events of a project, or else those of an event type, or else
+// all of them, oldest first
+func (q *EventQuarantine) Select(projectID string, ids []string, eventType string) []*QuarantinedEvent {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	selected := q.selectLocked(projectID, ids, eventType)
+	for i, event := range selected {
+		selected[i] = event.copy()
+	}
+	sortQuarantinedEvents(selected)
+	return selected
+}
+
+// resolve records the outcome of re-validating a quarantined event: it leaves the quarantine once
+// stored, and otherwise keeps the new validation error
+func (q *EventQuarantine) resolve(projectID, id string, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	event, exists := q.events[projectID][id]
+	if !exists {
+		return
+	}
+	if err == nil {
+		delete(q.events[projectID], id)
+		return
+	}
+	event.Errors = []string{err.Error()}
+	event.Attempts++
+	event.LastValidatedAt = q.clock.Now()
+}
+
+// RevalidateQuarantined tracks the selected quarantined events of a project again, after applying
+// the transform if any, e.g. once their schema was fixed. Events passing validation are stored
+// and leave the quarantine; the others stay with their new validation errors.
+func (s *AnalyticsService) RevalidateQuarantined(ctx context.Context, projectID string, ids []string, eventType string, transform *QuarantineTransform) *QuarantineRevalidation {
+	// Concurrent re-validations would store the events they both selected twice
+	s.quarantine.revalidating.Lock()
+	defer s.quarantine.revalidating.Unlock()
+
+	result := &QuarantineRevalidation{
+		Promoted:    make([]QuarantinePromotion, 0),
+		Quarantined: make([]QuarantinePromotion, 0),
+	}
+	ctx = contextWithoutQuarantine(ContextWithProject(ctx, projectID))
+	for _, quarantined := range s.quarantine.Select(projectID, ids, eventType) {
+		event, err := s.trackEventReceivedAt(ctx, transform.apply(quarantined.Data), quarantined.apiKey, quarantined.UserID, quarantined.ReceivedAt)
+		s.quarantine.resolve(projectID, quarantined.ID, err)
+		if err != nil {
+			result.Quarantined = append(result.Quarantined, QuarantinePromotion{ID: quarantined.ID, Errors: []string{err.Error()}})
+			continue
+		}
+		result.Promoted = append(result.Promoted, QuarantinePromotion{ID: quarantined.ID, EventID: event.ID})
+	}
+	return result
+}
+
+// quarantineInvalid keeps an event failing validation in its project's quarantine when the
+// project opted in, returning a QuarantinedError, and otherwise returns the validation error
+func (s *AnalyticsService) quarantineInvalid(ctx context.Context, eventData map[string]interface{}, apiKey, userID string, receivedAt time.Time, err error) error {
+	err = fmt.Errorf("%w: %w", errInvalidEventData, err)
+	projectID := ProjectFromContext(ctx)
+	if !quarantineAllowed(ctx) || !s.quarantine.Enabled(projectID) {
+		return err
+	}
+	quarantined, added := s.quarantine.Add(projectID, eventData, apiKey, userID, receivedAt, err)
+	if !added {
+		return fmt.Errorf("%w (quarantine of project %s is full)", err, projectID)
+	}
+	return &QuarantinedError{QuarantineID: quarantined.ID, Err: err}
+}
+
+// selectLocked returns the given events of a project, or else those of an event type, or else
+// all of them. Callers must hold the lock.
+func (q *EventQuarantine) selectLocked(projectID string, ids []string, eventType string) []*QuarantinedEvent {
+	events := q.events[projectID]
+	selected := make([]*QuarantinedEvent, 0)
+	if len(ids) > 0 {
+		for _, id := range ids {
+			if event, exists := events[id]; exists {
+				selected = append(selected, event)
+			}
+		}
+		return selected
+	}
+	for _, event := range events {
+		if eventType == "" || event.EventType == eventType {
+			selected = append(selected, event)
+		}
+	}
+	return selected
+}
+
+// copy returns a copy of the event sharing its sent data, which is never modified
+func (e *QuarantinedEvent) copy() *QuarantinedEvent {
+	copied := *e
+	copied.Errors = append([]string(nil), e.Errors...)
+	return &copied
+}
+
+// sortQuarantinedEvents sorts events oldest first
+func sortQuarantinedEvents(events []*QuarantinedEvent) {
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].ReceivedAt.Equal(events[j].ReceivedAt) {
+			return events[i].ReceivedAt.Before(events[j].ReceivedAt)
+		}
+		return events[i].ID < events[j].ID
+	})
+}
+
+// quarantineContextKey marks contexts whose invalid events are rejected rather than quarantined
+type quarantineContextKey struct{}
+
+// contextWithoutQuarantine returns a context whose invalid events are rejected, so re-validated
+// events are not quarantined a second time
+func contextWithoutQuarantine(ctx context.Context) context.Context {
+	return context.WithValue(ctx, quarantineContextKey{}, true)
+}
+
+// quarantineAllowed reports whether invalid events tracked with the context may be quarantined
+func quarantineAllowed(ctx context.Context) bool {
+	if ctx == nil {
+		return true
+	}
+	skip, _ := ctx.Value(quarantineContextKey{}).(bool)
+	return !skip
+}
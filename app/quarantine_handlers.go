@@ -0,0 +1,148 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getProjectQuarantine returns whether a project quarantines invalid events, and how many events
+// of each type are in quarantine
+func (s *App) getProjectQuarantine(c *fiber.Ctx) error {
+	quarantine := s.analyticsService.Quarantine()
+	projectID := c.Params("id")
+	settings := quarantine.Settings(projectID)
+
+	c.Set(fiber.HeaderETag, ETag(settings.Version))
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"quarantine": settings,
+		"counts":     quarantine.Count(projectID),
+	})
+}
+
+// updateProjectQuarantine turns the quarantine of a project on or off. Replacing existing
+// settings requires If-Match with the version being updated.
+func (s *App) updateProjectQuarantine(c *fiber.Ctx) error {
+	var request struct {
+		Enabled bool `json:"enabled"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	quarantine := s.analyticsService.Quarantine()
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first settings of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if quarantine.Settings(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := quarantine.UpdateSettings(projectID, request.Enabled, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"quarantine": updated,
+	})
+}
+
+// listQuarantinedEvents returns the quarantined events of a project, oldest first, optionally of
+// one event_type (at most limit, default 100)
+func (s *App) listQuarantinedEvents(c *fiber.Ctx) error {
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "limit must be a positive integer",
+			})
+		}
+		limit = parsed
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"events": s.analyticsService.Quarantine().List(c.Params("id"), c.Query("event_type"), limit),
+	})
+}
+
+// getQuarantinedEvent returns a quarantined event with its validation errors
+func (s *App) getQuarantinedEvent(c *fiber.Ctx) error {
+	event, err := s.analyticsService.Quarantine().Get(c.Params("id"), c.Params("event_id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"event":  event,
+	})
+}
+
+// revalidateQuarantinedEvents tracks quarantined events again, once their schema or
+// instrumentation was fixed, optionally transforming them first. The events are selected by
+// "ids", else by "event_type", else all of the project's are.
+func (s *App) revalidateQuarantinedEvents(c *fiber.Ctx) error {
+	var request struct {
+		IDs       []string             `json:"ids"`
+		EventType string               `json:"event_type"`
+		Transform *QuarantineTransform `json:"transform"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+
+	projectID := utils.CopyString(c.Params("id"))
+	result := s.analyticsService.RevalidateQuarantined(c.Context(), projectID, request.IDs, request.EventType, request.Transform)
+	return c.JSON(fiber.Map{
+		"status":      "success",
+		"promoted":    result.Promoted,
+		"quarantined": result.Quarantined,
+	})
+}
+
+// discardQuarantinedEvents removes quarantined events for good: one event, or those of
+// ?event_type, or all of the project's
+func (s *App) discardQuarantinedEvents(c *fiber.Ctx) error {
+	quarantine := s.analyticsService.Quarantine()
+	projectID := c.Params("id")
+
+	var ids []string
+	if eventID := c.Params("event_id"); eventID != "" {
+		if _, err := quarantine.Get(projectID, eventID); err != nil {
+			return c.Status(http.StatusNotFound).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		ids = []string{eventID}
+	}
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"discarded": quarantine.Discard(projectID, ids, c.Query("event_type")),
+	})
+}
@@ -0,0 +1,281 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a cached query result, reported in the X-Cache response header
+const (
+	CacheHit    = "HIT"    // Fresh result served from the cache
+	CacheStale  = "STALE"  // Stale result served while it is recomputed in the background
+	CacheMiss   = "MISS"   // Result computed for the request
+	CacheBypass = "BYPASS" // Recomputed because the request asked for no-cache
+)
+
+// CacheStatus describes how a query result was served
+type CacheStatus struct {
+	State      string
+	ComputedAt time.Time
+	Age        time.Duration // Time since the result was computed
+	FreshFor   time.Duration // Time the result stays fresh, 0 once stale
+	StaleFor   time.Duration // Time a stale result may still be served while recomputed
+}
+
+// QueryCacheStats counts how cached query results were served
+type QueryCacheStats struct {
+	Entries       int   `json:"entries"`
+	Hits          int64 `json:"hits"`
+	StaleHits     int64 `json:"stale_hits"`
+	Misses        int64 `json:"misses"`
+	Bypasses      int64 `json:"bypasses"`
+	Revalidations int64 `json:"revalidations"`         // Background recomputations of stale results
+	Failures      int64 `json:"revalidation_failures"` // Background recomputations that failed, keeping the stale result
+	Evictions     int64 `json:"evictions"`
+}
+
+// queryCacheEntry is a cached result
+type queryCacheEntry struct {
+	projectID    string
+	value        interface{}
+	computedAt   time.Time
+	expired      bool // Stale regardless of its age, e.g. after late events
+	revalidating bool
+}
+
+// QueryCache caches the results of expensive queries with stale-while-revalidate semantics:
+// results are served from the cache while fresh; once stale, they are still served instantly
+// for a while, and recomputed in the background for the next request.
+type QueryCache struct {
+	entries  *BoundedCache // Key -> entry, kept while fresh or stale
+	freshFor time.Duration // How long a result is fresh
+	staleFor time.Duration // How long after that a stale result may still be served
+	stats    QueryCacheStats
+	clock    Clock
+	// Called with the project and result of every successful background recomputation
+	revalidated func(projectID string, value interface{})
+	mutex       sync.Mutex
+}
+
+// NewQueryCache creates a query cache configured by QUERY_CACHE_FRESH_FOR (default 30s),
+// QUERY_CACHE_STALE_FOR (5m) and QUERY_CACHE_MAX_ENTRIES (1000). When full, the least recently
+// used result is evicted.
+func NewQueryCache() *QueryCache {
+	freshFor := getEnvDuration("QUERY_CACHE_FRESH_FOR", 30*time.Second)
+	staleFor := getEnvDuration("QUERY_CACHE_STALE_FOR", 5*time.Minute)
+	return &QueryCache{
+		entries:  NewBoundedCache("query_cache", getEnvInt("QUERY_CACHE_MAX_ENTRIES", 1000), freshFor+staleFor),
+		freshFor: freshFor,
+		staleFor: staleFor,
+		clock:    SystemClock(),
+	}
+}
+
+// Cache returns the bounded cache holding the results
+func (c *QueryCache) Cache() *BoundedCache {
+	return c.entries
+}
+
+// QueryCacheKey builds the cache key of a query of a project from its kind and parameters,
+// independent of the parameters' order
+func QueryCacheKey(kind, projectID string, parameters map[string]string) string {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	fmt.Fprintf(&key, "%s|%s", kind, projectID)
+	for _, name := range names {
+		fmt.Fprintf(&key, "|%s=%s", name, parameters[name])
+	}
+	return key.String()
+}
+
+// Get returns the cached result of the project's query, computing it when missing, too stale or
+// when bypass is set. Stale results are returned immediately and recomputed in the background;
+// compute must therefore not depend on the request it was created for. Errors are not cached.
+func (c *QueryCache) Get(key, projectID string, bypass bool, compute func() (interface{}, error)) (interface{}, CacheStatus, error) {
+	c.mutex.Lock()
+	now := c.clock.Now()
+	value, exists := c.entries.Get(key)
+	if exists && !bypass {
+		entry := value.(*queryCacheEntry)
+		age := now.Sub(entry.computedAt)
+		switch {
+		case !entry.expired && age < c.freshFor:
+			c.stats.Hits++
+			c.mutex.Unlock()
+			return entry.value, c.status(CacheHit, entry, now), nil
+		case age < c.freshFor+c.staleFor:
+			c.stats.StaleHits++
+			if !entry.revalidating {
+				entry.revalidating = true
+				c.stats.Revalidations++
+				go c.revalidate(key, entry, compute)
+			}
+			c.mutex.Unlock()
+			return entry.value, c.status(CacheStale, entry, now), nil
+		}
+	}
+	state := CacheMiss
+	if bypass {
+		state = CacheBypass
+		c.stats.Bypasses++
+	} else {
+		c.stats.Misses++
+	}
+	c.mutex.Unlock()
+
+	value, err := compute()
+	if err != nil {
+		return nil, CacheStatus{State: state}, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.freshFor == 0 {
+		return value, CacheStatus{State: state, ComputedAt: c.clock.Now()}, nil
+	}
+	entry := c.store(key, projectID, value)
+	return value, c.status(state, entry, entry.computedAt), nil
+}
+
+// revalidate recomputes a stale result, keeping it if the computation fails
+func (c *QueryCache) revalidate(key string, stale *queryCacheEntry, compute func() (interface{}, error)) {
+	value, err := compute()
+
+	c.mutex.Lock()
+	stale.revalidating = false
+	if err != nil {
+		c.stats.Failures++
+		c.mutex.Unlock()
+		log.Printf("Warning: Failed to revalidate cached query %s: %v", key, err)
+		return
+	}
+	// The entry may have been evicted or replaced in the meantime
+	if current, exists := c.entries.Peek(key); !exists || current.(*queryCacheEntry) == stale {
+		c.store(key, stale.projectID, value)
+	}
+	revalidated := c.revalidated
+	c.mutex.Unlock()
+
+	if revalidated != nil {
+		revalidated(stale.projectID, value)
+	}
+}
+
+// SetRevalidated sets the function called with the project and result of every successful
+// background recomputation of a stale result
+func (c *QueryCache) SetRevalidated(revalidated func(projectID string, value interface{})) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.revalidated = revalidated
+}
+
+// store caches a result. Callers must hold the lock.
+func (c *QueryCache) store(key, projectID string, value interface{}) *queryCacheEntry {
+	entry := &queryCacheEntry{projectID: projectID, value: value, computedAt: c.clock.Now()}
+	c.entries.Set(key, entry)
+	return entry
+}
+
+// status describes how an entry is served at the given time
+func (c *QueryCache) status(state string, entry *queryCacheEntry, now time.Time) CacheStatus {
+	status := CacheStatus{
+		State:      state,
+		ComputedAt: entry.computedAt,
+		Age:        now.Sub(entry.computedAt),
+		StaleFor:   c.staleFor,
+	}
+	if !entry.expired && status.Age < c.freshFor {
+		status.FreshFor = c.freshFor - status.Age
+	}
+	return status
+}
+
+// ExpireProject marks the cached results of a project stale, so they are recomputed on their
+// next request. It is called when events change results that were final, such as late events.
+func (c *QueryCache) ExpireProject(projectID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries.Each(func(key string, value interface{}) {
+		if entry := value.(*queryCacheEntry); entry.projectID == projectID {
+			entry.expired = true
+		}
+	})
+}
+
+// ComputedRange returns the number of results of a project still served from the cache, and
+// when the oldest and newest of them were computed
+func (c *QueryCache) ComputedRange(projectID string) (int, time.Time, time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var count int
+	var oldest, newest time.Time
+	c.entries.Each(func(key string, value interface{}) {
+		entry := value.(*queryCacheEntry)
+		if entry.projectID != projectID {
+			return
+		}
+		count++
+		if oldest.IsZero() || entry.computedAt.Before(oldest) {
+			oldest = entry.computedAt
+		}
+		if entry.computedAt.After(newest) {
+			newest = entry.computedAt
+		}
+	})
+	return count, oldest, newest
+}
+
+// Stats returns how cached results were served since startup
+func (c *QueryCache) Stats() QueryCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.entries.Len()
+	stats.Evictions = c.entries.Stats().Evictions
+	return stats
+}
+
+// TTLs returns how long results are fresh and how long stale results may still be served
+func (c *QueryCache) TTLs() (time.Duration, time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.freshFor, c.staleFor
+}
+
+// SetTTLs sets how long results are fresh and how long stale results may still be served.
+// A freshness of 0 disables caching.
+func (c *QueryCache) SetTTLs(freshFor, staleFor time.Duration) error {
+	if freshFor < 0 || staleFor < 0 {
+		return fmt.Errorf("cache durations must not be negative")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.freshFor = freshFor
+	c.staleFor = staleFor
+	if freshFor == 0 {
+		c.entries.Clear()
+	}
+	maxEntries, _ := c.entries.Limits()
+	return c.entries.SetLimits(maxEntries, freshFor+staleFor)
+}
+
+// SetClock sets the clock result ages are measured with
+func (c *QueryCache) SetClock(clock Clock) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clock = clock
+	c.entries.SetClock(clock)
+}
@@ -0,0 +1,540 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Default lifetime of share tokens when the request does not specify one
+const defaultShareTokenTTL = 30 * 24 * time.Hour
+
+// registerQueryExecutors connects the saved query types to the services that compute them
+func (s *App) registerQueryExecutors() {
+	s.savedQueryService.RegisterExecutor(SavedQueryTrend, func(ctx context.Context, parameters map[string]interface{}) (interface{}, error) {
+		start, end, err := queryTimeRange(parameters)
+		if err != nil {
+			return nil, err
+		}
+		sample, _ := parameters["sample"].(float64)
+		return s.queryService.ComputeTrend(ctx, TrendQuery{
+			EventType: queryString(parameters, "event_type"),
+			Interval:  queryString(parameters, "interval"),
+			Start:     start,
+			End:       end,
+			Breakdown: queryString(parameters, "breakdown"),
+			Sample:    sample,
+		})
+	})
+
+	s.savedQueryService.RegisterExecutor(SavedQuerySegment, func(ctx context.Context, parameters map[string]interface{}) (interface{}, error) {
+		start, end, err := queryTimeRange(parameters)
+		if err != nil {
+			return nil, err
+		}
+		return s.queryService.ComputeSegment(ctx, savedSegmentQuery(parameters, start, end))
+	})
+
+	s.savedQueryService.RegisterExecutor(SavedQueryUsage, func(ctx context.Context, parameters map[string]interface{}) (interface{}, error) {
+		userID := queryString(parameters, "user_id")
+		if userID == "" {
+			return nil, fmt.Errorf("user_id parameter is required")
+		}
+		start, end, err := queryTimeRange(parameters)
+		if err != nil {
+			return nil, err
+		}
+		if breakdown := queryString(parameters, "breakdown"); breakdown != "" {
+			return s.analyticsService.GetUsageBreakdown(ctx, userID, start.Format("2006-01-02"), end.Format("2006-01-02"), breakdown)
+		}
+		return s.analyticsService.GetUsage(ctx, userID, start.Format("2006-01-02"), end.Format("2006-01-02"))
+	})
+
+	s.savedQueryService.RegisterExecutor(SavedQueryFunnel, func(ctx context.Context, parameters map[string]interface{}) (interface{}, error) {
+		start, end, err := queryTimeRange(parameters)
+		if err != nil {
+			return nil, err
+		}
+		return s.funnelService.ComputeFunnel(ctx, FunnelQuery{
+			FunnelID:  queryString(parameters, "funnel_id"),
+			UserID:    queryString(parameters, "user_id"),
+			Start:     start,
+			End:       end,
+			Breakdown: queryString(parameters, "breakdown"),
+		})
+	})
+}
+
+// savedSegmentQuery builds the segment query of a saved query's parameters over a time range
+func savedSegmentQuery(parameters map[string]interface{}, start, end time.Time) SegmentQuery {
+	properties, _ := parameters["properties"].(map[string]interface{})
+	limit, _ := parameters["limit"].(float64)
+	sample, _ := parameters["sample"].(float64)
+	return SegmentQuery{
+		EventType:  queryString(parameters, "event_type"),
+		Properties: properties,
+		Start:      start,
+		End:        end,
+		Limit:      int(limit),
+		Sample:     sample,
+	}
+}
+
+// queryString returns a string parameter of a saved query
+func queryString(parameters map[string]interface{}, key string) string {
+	value, _ := parameters[key].(string)
+	return value
+}
+
+// queryTimeRange resolves the time range of a saved query. Explicit start_date/end_date
+// parameters pin the range; otherwise it covers the last_days (default 30) up to now,
+// so shared reports stay current.
+func queryTimeRange(parameters map[string]interface{}) (time.Time, time.Time, error) {
+	end := time.Now()
+	if value := queryString(parameters, "end_date"); value != "" {
+		parsed, err := parseQueryDate(value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid end_date: %w", err)
+		}
+		end = parsed
+	}
+
+	days := 30.0
+	if value, ok := parameters["last_days"].(float64); ok && value > 0 {
+		days = value
+	}
+	start := end.Add(-time.Duration(days * float64(24*time.Hour)))
+	if value := queryString(parameters, "start_date"); value != "" {
+		parsed, err := parseQueryDate(value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start_date: %w", err)
+		}
+		start = parsed
+	}
+
+	return start, end, nil
+}
+
+// parseQueryDate parses a YYYY-MM-DD or RFC3339 date
+func parseQueryDate(value string) (time.Time, error) {
+	if parsed, err := time.Parse("2006-01-02", value); err == nil {
+		return parsed, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// getTrend handles ad-hoc trend requests. Results are cached, see cachedQuery.
+func (s *App) getTrend(c *fiber.Ctx) error {
+	parameters := copyQueryParameters(c, "event_type", "interval", "start_date", "end_date", "breakdown", "sample")
+	parameters["region"] = regionFromRequest(c)
+	timeRange := map[string]interface{}{
+		"start_date": parameters["start_date"],
+		"end_date":   parameters["end_date"],
+	}
+	if _, _, err := queryTimeRange(timeRange); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	sample, err := ParseQuerySample(parameters["sample"])
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	projectID := projectIDFromRequest(c)
+	result, err := s.cachedQuery(c, "trend", projectID, parameters, func() (interface{}, error) {
+		// Ranges relative to now move with every computation
+		start, end, _ := queryTimeRange(timeRange)
+		return s.queryService.ComputeTrend(ContextWithRegion(ContextWithProject(context.Background(), projectID), parameters["region"]), TrendQuery{
+			EventType: parameters["event_type"],
+			Interval:  parameters["interval"],
+			Start:     start,
+			End:       end,
+			Breakdown: parameters["breakdown"],
+			Sample:    sample,
+		})
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return sendQueryResult(c, result, fiber.Map{
+		"status": "success",
+		"result": result,
+	})
+}
+
+// getPropertyValues handles requests for the distribution of a property's values. Results are
+// cached, see cachedQuery.
+func (s *App) getPropertyValues(c *fiber.Ctx) error {
+	parameters := copyQueryParameters(c, "event_type", "start_date", "end_date", "limit", "buckets")
+	parameters["property"] = utils.CopyString(c.Params("key"))
+	parameters["region"] = regionFromRequest(c)
+	timeRange := map[string]interface{}{
+		"start_date": parameters["start_date"],
+		"end_date":   parameters["end_date"],
+	}
+	if _, _, err := queryTimeRange(timeRange); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	limit, buckets := c.QueryInt("limit"), c.QueryInt("buckets")
+
+	projectID := projectIDFromRequest(c)
+	result, err := s.cachedQuery(c, "property_values", projectID, parameters, func() (interface{}, error) {
+		start, end, _ := queryTimeRange(timeRange)
+		return s.queryService.ComputePropertyValues(ContextWithRegion(ContextWithProject(context.Background(), projectID), parameters["region"]), PropertyValuesQuery{
+			Property:  parameters["property"],
+			EventType: parameters["event_type"],
+			Start:     start,
+			End:       end,
+			Limit:     limit,
+			Buckets:   buckets,
+		})
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"result": result,
+	})
+}
+
+// cachedQuery serves a query result of the project through the query cache and describes its
+// freshness in the X-Cache, Age, X-Data-Computed-At and Cache-Control response headers. Requests
+// with "Cache-Control: no-cache" are recomputed. compute may run in the background after the
+// request returned, so it must only use copied request values.
+func (s *App) cachedQuery(c *fiber.Ctx, kind, projectID string, parameters map[string]string, compute func() (interface{}, error)) (interface{}, error) {
+	bypass := strings.Contains(strings.ToLower(c.Get("Cache-Control")), "no-cache")
+	key := QueryCacheKey(kind, projectID, parameters)
+	result, status, err := s.analyticsService.QueryCache().Get(key, projectID, bypass, compute)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Set("X-Cache", status.State)
+	c.Set("Age", strconv.Itoa(int(status.Age.Seconds())))
+	c.Set("X-Data-Computed-At", status.ComputedAt.UTC().Format(time.RFC3339))
+	c.Set("Cache-Control", fmt.Sprintf("private, max-age=%d, stale-while-revalidate=%d", int(status.FreshFor.Seconds()), int(status.StaleFor.Seconds())))
+	return result, nil
+}
+
+// copyQueryParameters returns copies of the request's query parameters, which outlive the request
+// when used by a background computation. Missing parameters are empty.
+func copyQueryParameters(c *fiber.Ctx, names ...string) map[string]string {
+	parameters := make(map[string]string, len(names))
+	for _, name := range names {
+		parameters[name] = utils.CopyString(c.Query(name))
+	}
+	return parameters
+}
+
+// getSegment handles ad-hoc segment requests
+func (s *App) getSegment(c *fiber.Ctx) error {
+	start, end, err := queryTimeRange(map[string]interface{}{
+		"start_date": c.Query("start_date"),
+		"end_date":   c.Query("end_date"),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	sample, err := ParseQuerySample(c.Query("sample"))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	result, err := s.queryService.ComputeSegment(ctx, SegmentQuery{
+		EventType: c.Query("event_type"),
+		Start:     start,
+		End:       end,
+		Limit:     c.QueryInt("limit", 1000),
+		Sample:    sample,
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return sendQueryResult(c, result, fiber.Map{
+		"status": "success",
+		"result": result,
+	})
+}
+
+// createSavedQuery handles saved query creation requests
+func (s *App) createSavedQuery(c *fiber.Ctx) error {
+	var request savedQueryRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// With ?upsert=true an existing query with the same ID, or the same name when no ID is given, is replaced
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	var query *SavedQuery
+	var created bool
+	var err error
+	if c.QueryBool("upsert") {
+		query, created, err = s.savedQueryService.UpsertQuery(ctx, request.ID, request.Name, request.Description, request.Type, request.Parameters)
+	} else {
+		query, created, err = s.savedQueryService.CreateQueryWithID(ctx, request.ID, request.Name, request.Description, request.Type, request.Parameters)
+	}
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	message := "Query saved successfully"
+	if !created {
+		message = "Query already exists"
+	}
+
+	c.Set(fiber.HeaderETag, ETag(query.Version))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"query":   query,
+		"created": created,
+		"message": message,
+	})
+}
+
+// updateSavedQuery replaces a saved query, requiring If-Match with the version being updated. Queries
+// that do not exist yet may be created under the requested ID without If-Match.
+func (s *App) updateSavedQuery(c *fiber.Ctx) error {
+	var request savedQueryRequest
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	id := utils.CopyString(c.Params("id"))
+
+	if c.Get(fiber.HeaderIfMatch) == "" {
+		if _, err := s.savedQueryService.GetQuery(ctx, id); err != nil {
+			query, created, err := s.savedQueryService.CreateQueryWithID(ctx, id, request.Name, request.Description, request.Type, request.Parameters)
+			if err != nil {
+				return writeUpdateError(c, err, http.StatusBadRequest)
+			}
+
+			c.Set(fiber.HeaderETag, ETag(query.Version))
+			return c.Status(createdStatus(created)).JSON(fiber.Map{
+				"status":  "success",
+				"query":   query,
+				"created": created,
+			})
+		}
+	}
+
+	expectedVersion, status, err := ifMatchVersion(c)
+	if err != nil {
+		return c.Status(status).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	query, err := s.savedQueryService.UpdateQuery(ctx, id, request.Name, request.Description, request.Type, request.Parameters, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, notFoundOrBadRequest(err))
+	}
+
+	c.Set(fiber.HeaderETag, ETag(query.Version))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"query":   query,
+		"message": "Query updated successfully",
+	})
+}
+
+// savedQueryRequest is the body of saved query create and update requests
+type savedQueryRequest struct {
+	ID          string                 `json:"id"` // Optional client-supplied ID on creation
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Type        string                 `json:"type"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// listSavedQueries returns the saved queries of the project
+func (s *App) listSavedQueries(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"queries": s.savedQueryService.ListQueries(ctx),
+	})
+}
+
+// getSavedQuery retrieves a specific saved query
+func (s *App) getSavedQuery(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	query, err := s.savedQueryService.GetQuery(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, ETag(query.Version))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"query":  query,
+	})
+}
+
+// deleteSavedQuery removes a saved query
+func (s *App) deleteSavedQuery(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	if err := s.savedQueryService.DeleteQuery(ctx, c.Params("id")); err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Query deleted successfully",
+	})
+}
+
+// runSavedQuery executes a saved query
+func (s *App) runSavedQuery(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	query, err := s.savedQueryService.GetQuery(ctx, c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	result, err := s.savedQueryService.RunQuery(ctx, query.ID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return sendQueryResult(c, result, fiber.Map{
+		"status": "success",
+		"query":  query,
+		"result": result,
+	})
+}
+
+// shareSavedQuery issues a share token for a saved query
+func (s *App) shareSavedQuery(c *fiber.Ctx) error {
+	var request struct {
+		TTL string `json:"ttl"` // Go duration, e.g. "720h"
+	}
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+
+	ttl := defaultShareTokenTTL
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid ttl. Use a duration such as 24h",
+			})
+		}
+		ttl = parsed
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	token, expiresAt, err := s.savedQueryService.CreateShareToken(ctx, c.Params("id"), ttl)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	s.siem.Export(requestSecurityEvent(c, SecurityExport, "share_token_created", OutcomeSuccess, 4, map[string]interface{}{
+		"project_id": ProjectFromContext(ctx),
+		"expires_at": expiresAt,
+	}))
+
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"token":      token,
+		"url":        "/api/v1/shared/" + token,
+		"expires_at": expiresAt,
+	})
+}
+
+// revokeSavedQueryShares invalidates every share token of a saved query
+func (s *App) revokeSavedQueryShares(c *fiber.Ctx) error {
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	if err := s.savedQueryService.RevokeShareTokens(ctx, c.Params("id")); err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"message": "Share tokens revoked",
+	})
+}
+
+// runSharedQuery executes the saved query a share token grants read-only access to
+func (s *App) runSharedQuery(c *fiber.Ctx) error {
+	query, err := s.savedQueryService.ResolveShareToken(c.Params("token"))
+	if err != nil {
+		event := requestSecurityEvent(c, SecurityAuth, "share_token_rejected", OutcomeDenied, 5, map[string]interface{}{
+			"reason": err.Error(),
+		})
+		event.Resource = c.Route().Path // Without the token
+		s.siem.Export(event)
+		return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	result, err := s.savedQueryService.RunQuery(ContextWithProject(c.Context(), query.ProjectID), query.ID)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Only expose what the report needs, not the query's ID or project
+	return sendQueryResult(c, result, fiber.Map{
+		"status": "success",
+		"query": fiber.Map{
+			"name":        query.Name,
+			"description": query.Description,
+			"type":        query.Type,
+		},
+		"result":       result,
+		"generated_at": time.Now(),
+	})
+}
@@ -0,0 +1,95 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// minQuerySample is the smallest share of users a query can be sampled at, the resolution of sampleFraction
+const minQuerySample = 0.0001
+
+// querySampleZ is the z-score of the confidence bounds of sampled results (95% confidence)
+const querySampleZ = 1.96
+
+// EstimateBounds is the 95% confidence interval of a count extrapolated from a sample
+type EstimateBounds struct {
+	Lower int64 `json:"lower"`
+	Upper int64 `json:"upper"`
+}
+
+// ParseQuerySample parses the ?sample share of users a query is evaluated against. Empty values
+// evaluate queries against every user (1).
+func ParseQuerySample(value string) (float64, error) {
+	if value == "" {
+		return 1, nil
+	}
+	sample, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(sample) || sample < minQuerySample || sample > 1 {
+		return 0, fmt.Errorf("invalid sample: %s. Use a share of users between %v and 1", value, minQuerySample)
+	}
+	return sample, nil
+}
+
+// inQuerySample reports whether an event belongs to the users a query samples. Users are sampled
+// deterministically, so every event of a sampled user is included and repeated queries see the
+// same users; events without a user are sampled on their own.
+func inQuerySample(event *AnalyticsEvent, sample float64) bool {
+	if sample <= 0 || sample >= 1 {
+		return true
+	}
+	return sampleFraction("query/"+querySampleUnit(event)) < sample
+}
+
+// querySampleUnit returns the unit an event is sampled by: its user, or the event itself
+func querySampleUnit(event *AnalyticsEvent) string {
+	if event.UserID == "" {
+		return "event:" + event.ID
+	}
+	return "user:" + event.UserID
+}
+
+// sampledCount tallies sampled events per sampling unit, to extrapolate their count
+type sampledCount map[string]int64
+
+// add counts an event of the sample
+func (c sampledCount) add(event *AnalyticsEvent) {
+	c[querySampleUnit(event)]++
+}
+
+// estimate extrapolates the events counted in a sample of users to every user. The bounds are
+// those of the Horvitz-Thompson estimator, whose variance grows with the square of each unit's
+// events; they never go below the events actually counted.
+func (c sampledCount) estimate(sample float64) (int64, *EstimateBounds) {
+	var counted int64
+	var squares float64
+	for _, events := range c {
+		counted += events
+		squares += float64(events) * float64(events)
+	}
+	return extrapolate(counted, squares, sample)
+}
+
+// extrapolate scales a count of a sample of units to every unit, given the sum of the squared
+// count of each sampled unit
+func extrapolate(counted int64, squares, sample float64) (int64, *EstimateBounds) {
+	estimate := float64(counted) / sample
+	margin := querySampleZ * math.Sqrt((1-sample)*squares) / sample
+	return int64(math.Round(estimate)), &EstimateBounds{
+		Lower: int64(math.Max(float64(counted), math.Floor(estimate-margin))),
+		Upper: int64(math.Ceil(estimate + margin)),
+	}
+}
+
+// extrapolateUsers scales a number of distinct users in a sample to every user
+func extrapolateUsers(counted int64, sample float64) (int64, *EstimateBounds) {
+	return extrapolate(counted, float64(counted), sample)
+}
+
+// shift moves the bounds by a count added exactly, e.g. of aggregation-only event types
+func (b *EstimateBounds) shift(delta int64) {
+	if b != nil {
+		b.Lower += delta
+		b.Upper += delta
+	}
+}
@@ -0,0 +1,365 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Trend intervals supported by ComputeTrend
+var trendIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+// QueryService computes ad-hoc trends and segments from stored analytics events
+type QueryService struct {
+	analyticsService *AnalyticsService
+}
+
+// TrendQuery represents a query for event counts over time
+type TrendQuery struct {
+	EventType string    `json:"event_type"`
+	Interval  string    `json:"interval"` // hour, day or week
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Breakdown string    `json:"breakdown,omitempty"` // Custom dimension splitting the counts
+	Sample    float64   `json:"sample,omitempty"`    // Share of users the counts are extrapolated from, every user when 0 or 1
+}
+
+// TrendPoint is the event count of a single interval
+type TrendPoint struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Count       int64     `json:"count"`
+	UniqueUsers int64     `json:"unique_users"`
+	// Minimum, maximum and average events per hour, for points served from the rollups
+	Hourly *HourlyStats `json:"hourly,omitempty"`
+	// Confidence bounds of the counts extrapolated from a sample of users
+	CountBounds       *EstimateBounds `json:"count_bounds,omitempty"`
+	UniqueUsersBounds *EstimateBounds `json:"unique_users_bounds,omitempty"`
+}
+
+// TrendResult represents the computed results of a trend
+type TrendResult struct {
+	EventType   string        `json:"event_type,omitempty"`
+	Interval    string        `json:"interval"`
+	TimeRange   TimeRange     `json:"time_range"`
+	Points      []TrendPoint  `json:"points"`
+	TotalEvents int64         `json:"total_events"`
+	Breakdown   []TrendSeries `json:"breakdown,omitempty"` // Counts per value of the breakdown dimension
+	Source      string        `json:"source"`              // "rollups" or "events" scanned
+	ComputedAt  time.Time     `json:"computed_at"`
+	// Share of users the counts were extrapolated from, omitted for exact counts
+	Sample            float64         `json:"sample,omitempty"`
+	TotalEventsBounds *EstimateBounds `json:"total_events_bounds,omitempty"`
+	// Interval asked for, when finer than the downsampled days of the time range allow
+	RequestedInterval string `json:"requested_interval,omitempty"`
+}
+
+// TrendSeries is the trend of the events with one value of a dimension
+type TrendSeries struct {
+	Value             string          `json:"value"`
+	Points            []TrendPoint    `json:"points"`
+	TotalEvents       int64           `json:"total_events"`
+	TotalEventsBounds *EstimateBounds `json:"total_events_bounds,omitempty"`
+}
+
+// SegmentQuery represents a query for the users who performed an event
+type SegmentQuery struct {
+	EventType  string                 `json:"event_type"`
+	Properties map[string]interface{} `json:"properties,omitempty"` // Event properties that must match exactly
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Limit      int                    `json:"limit,omitempty"`  // Maximum number of user IDs returned
+	Sample     float64                `json:"sample,omitempty"` // Share of users the counts are extrapolated from, every user when 0 or 1
+}
+
+// SegmentResult represents the users matching a segment
+type SegmentResult struct {
+	EventType  string    `json:"event_type,omitempty"`
+	TimeRange  TimeRange `json:"time_range"`
+	UserCount  int64     `json:"user_count"`
+	EventCount int64     `json:"event_count"`
+	Users      []string  `json:"users"` // Of the sample when sampled
+	ComputedAt time.Time `json:"computed_at"`
+	// Share of users the counts were extrapolated from, omitted for exact counts
+	Sample           float64         `json:"sample,omitempty"`
+	UserCountBounds  *EstimateBounds `json:"user_count_bounds,omitempty"`
+	EventCountBounds *EstimateBounds `json:"event_count_bounds,omitempty"`
+}
+
+// NewQueryService creates a new query service instance
+func NewQueryService(analyticsService *AnalyticsService) *QueryService {
+	return &QueryService{
+		analyticsService: analyticsService,
+	}
+}
+
+// ComputeTrend counts the project's events per interval over the time range
+func (s *QueryService) ComputeTrend(ctx context.Context, query TrendQuery) (*TrendResult, error) {
+	var err error
+	if query.Interval == "" {
+		query.Interval = "day"
+	}
+	interval, valid := trendIntervals[query.Interval]
+	if !valid {
+		return nil, fmt.Errorf("invalid interval: %s. Valid intervals are: hour, day, week", query.Interval)
+	}
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	if query.Sample, err = querySample(query.Sample); err != nil {
+		return nil, err
+	}
+	var dimension *CustomDimension
+	if query.Breakdown != "" {
+		if dimension, err = s.analyticsService.Dimensions().Lookup(ProjectFromContext(ctx), query.Breakdown); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+
+	// Days past the downsampling horizon only have daily summaries of their hours: finer trends
+	// reaching them are served per day over whole days, with the events per hour of each day
+	requestedInterval := ""
+	if dimension == nil && interval < rollupDay && query.Start.Before(s.analyticsService.Series().DownsampledBefore()) {
+		requestedInterval = query.Interval
+		query.Interval, interval = "day", rollupDay
+		query.Start = query.Start.UTC().Truncate(rollupDay)
+		if end := query.End.UTC().Truncate(rollupDay); !end.Equal(query.End) {
+			query.End = end.Add(rollupDay)
+		}
+	}
+
+	// Daily and weekly trends over whole days are served from the daily rollups, exactly even
+	// when a sample was asked for, as they do not scan events
+	if dimension == nil && interval >= rollupDay && query.Start.Equal(query.Start.Truncate(rollupDay)) && query.End.Equal(query.End.Truncate(rollupDay)) {
+		projectID := ProjectFromContext(ctx)
+		regions := s.analyticsService.readRegions(ctx, projectID)
+		points, total, rows := s.analyticsService.Rollups().Trend(projectID, regions, query.EventType, query.Start, query.End, interval)
+		total += s.analyticsService.Aggregates().AddToTrend(points, projectID, regions, query.EventType, query.Start, query.End, interval)
+		s.analyticsService.Series().AddStats(points, projectID, regions, query.EventType, query.Start, query.End, interval)
+		s.observeTrend(query, start, rows)
+		return &TrendResult{
+			EventType:         query.EventType,
+			Interval:          query.Interval,
+			RequestedInterval: requestedInterval,
+			TimeRange:         TimeRange{Start: query.Start, End: query.End},
+			Points:            points,
+			TotalEvents:       total,
+			Source:            "rollups",
+			ComputedAt:        time.Now(),
+		}, nil
+	}
+
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		EventType: query.EventType,
+		Start:     query.Start,
+		End:       query.End,
+		Sample:    query.Sample,
+	})
+
+	result := &TrendResult{
+		EventType:  query.EventType,
+		Interval:   query.Interval,
+		TimeRange:  TimeRange{Start: query.Start, End: query.End},
+		Points:     sampledTrendPoints(events, query.Start, query.End, interval, query.Sample),
+		Source:     "events",
+		ComputedAt: time.Now(),
+	}
+	result.TotalEvents, result.TotalEventsBounds = estimateEvents(events, query.Sample)
+	if query.Sample < 1 {
+		result.Sample = query.Sample
+	}
+
+	// Aggregation-only event types were counted instead of stored, exactly; breakdowns cannot split them
+	projectID := ProjectFromContext(ctx)
+	counted := make([]int64, len(result.Points))
+	for i, point := range result.Points {
+		counted[i] = point.Count
+	}
+	aggregated := s.analyticsService.Aggregates().AddToTrend(result.Points, projectID, s.analyticsService.readRegions(ctx, projectID), query.EventType, query.Start, query.End, interval)
+	result.TotalEvents += aggregated
+	result.TotalEventsBounds.shift(aggregated)
+	for i := range result.Points {
+		result.Points[i].CountBounds.shift(result.Points[i].Count - counted[i])
+	}
+
+	if dimension != nil {
+		byValue := make(map[string][]*AnalyticsEvent)
+		for _, event := range events {
+			value := dimension.Value(event)
+			byValue[value] = append(byValue[value], event)
+		}
+		result.Breakdown = make([]TrendSeries, 0, len(byValue))
+		for value, valueEvents := range byValue {
+			series := TrendSeries{
+				Value:  value,
+				Points: sampledTrendPoints(valueEvents, query.Start, query.End, interval, query.Sample),
+			}
+			series.TotalEvents, series.TotalEventsBounds = estimateEvents(valueEvents, query.Sample)
+			result.Breakdown = append(result.Breakdown, series)
+		}
+		sortTrendSeries(result.Breakdown)
+	}
+
+	s.observeTrend(query, start, s.analyticsService.EventCount())
+	return result, nil
+}
+
+// observeTrend records a trend computation that started at start and scanned the given number
+// of events or rollup rows in the slow operation log
+func (s *QueryService) observeTrend(query TrendQuery, start time.Time, scanned int64) {
+	s.analyticsService.SlowOperations().Observe(SlowOperationTrend, map[string]interface{}{
+		"event_type": query.EventType,
+		"interval":   query.Interval,
+		"start":      query.Start,
+		"end":        query.End,
+	}, time.Since(start), scanned, s.analyticsService.calculateAPICallCost("/api/v1/trends", "GET"))
+}
+
+// ComputeSegment finds the project's users who performed the event with matching properties
+func (s *QueryService) ComputeSegment(ctx context.Context, query SegmentQuery) (*SegmentResult, error) {
+	if query.EventType == "" {
+		return nil, fmt.Errorf("event type is required")
+	}
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	sample, err := querySample(query.Sample)
+	if err != nil {
+		return nil, err
+	}
+
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		EventType: query.EventType,
+		Start:     query.Start,
+		End:       query.End,
+		Sample:    sample,
+	})
+
+	result := &SegmentResult{
+		EventType:  query.EventType,
+		TimeRange:  TimeRange{Start: query.Start, End: query.End},
+		Users:      []string{},
+		ComputedAt: time.Now(),
+	}
+
+	users := make(map[string]bool)
+	counts := make(sampledCount)
+	for _, event := range events {
+		if !matchesProperties(event.Properties, query.Properties) {
+			continue
+		}
+		result.EventCount++
+		users[event.UserID] = true
+		counts.add(event)
+	}
+
+	for userID := range users {
+		result.Users = append(result.Users, userID)
+	}
+	sort.Strings(result.Users)
+	result.UserCount = int64(len(result.Users))
+	if sample < 1 {
+		result.Sample = sample
+		result.EventCount, result.EventCountBounds = counts.estimate(sample)
+		result.UserCount, result.UserCountBounds = extrapolateUsers(result.UserCount, sample)
+	}
+
+	if query.Limit > 0 && len(result.Users) > query.Limit {
+		result.Users = result.Users[:query.Limit]
+	}
+
+	return result, nil
+}
+
+// trendPoints counts events and their users per interval. Every bucket is built up front so
+// intervals without events are reported as zero.
+func trendPoints(events []*AnalyticsEvent, start, end time.Time, interval time.Duration) []TrendPoint {
+	return sampledTrendPoints(events, start, end, interval, 1)
+}
+
+// sampledTrendPoints counts the events of a sample of users and their users per interval, and
+// extrapolates the counts to every user with their confidence bounds
+func sampledTrendPoints(events []*AnalyticsEvent, start, end time.Time, interval time.Duration, sample float64) []TrendPoint {
+	bucketStart := start.Truncate(interval)
+	var points []TrendPoint
+	var users []map[string]bool
+	var counts []sampledCount
+	for t := bucketStart; t.Before(end); t = t.Add(interval) {
+		points = append(points, TrendPoint{Timestamp: t})
+		users = append(users, make(map[string]bool))
+		counts = append(counts, make(sampledCount))
+	}
+
+	for _, event := range events {
+		index := int(event.Timestamp.Sub(bucketStart) / interval)
+		if index < 0 || index >= len(points) {
+			continue
+		}
+		points[index].Count++
+		users[index][event.UserID] = true
+		if sample < 1 {
+			counts[index].add(event)
+		}
+	}
+	for i := range points {
+		points[i].UniqueUsers = int64(len(users[i]))
+		if sample < 1 {
+			points[i].Count, points[i].CountBounds = counts[i].estimate(sample)
+			points[i].UniqueUsers, points[i].UniqueUsersBounds = extrapolateUsers(points[i].UniqueUsers, sample)
+		}
+	}
+	return points
+}
+
+// estimateEvents counts the events of a sample of users, extrapolated to every user with the
+// confidence bounds. Events of every user are counted exactly, without bounds.
+func estimateEvents(events []*AnalyticsEvent, sample float64) (int64, *EstimateBounds) {
+	if sample >= 1 {
+		return int64(len(events)), nil
+	}
+	counts := make(sampledCount)
+	for _, event := range events {
+		counts.add(event)
+	}
+	return counts.estimate(sample)
+}
+
+// querySample validates the share of users a query samples, every user (1) when 0
+func querySample(sample float64) (float64, error) {
+	if sample == 0 {
+		return 1, nil
+	}
+	if sample < minQuerySample || sample > 1 {
+		return 0, fmt.Errorf("sample must be between %v and 1, got %v", minQuerySample, sample)
+	}
+	return sample, nil
+}
+
+// sortTrendSeries orders series by their number of events, largest first
+func sortTrendSeries(series []TrendSeries) {
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].TotalEvents != series[j].TotalEvents {
+			return series[i].TotalEvents > series[j].TotalEvents
+		}
+		return series[i].Value < series[j].Value
+	})
+}
+
+// matchesProperties reports whether every expected property has the same value in the event properties
+func matchesProperties(properties, expected map[string]interface{}) bool {
+	for key, value := range expected {
+		actual, exists := properties[key]
+		if !exists || fmt.Sprint(actual) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
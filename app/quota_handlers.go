@@ -0,0 +1,78 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getProjectQuotas returns the event type quotas of a project with their version as the ETag
+func (s *App) getProjectQuotas(c *fiber.Ctx) error {
+	quotas := s.analyticsService.Quotas().Get(c.Params("id"))
+
+	c.Set(fiber.HeaderETag, ETag(quotas.Version))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"quotas": quotas,
+	})
+}
+
+// updateProjectQuotas replaces the event type quotas of a project. Replacing existing quotas
+// requires If-Match with the version being updated.
+func (s *App) updateProjectQuotas(c *fiber.Ctx) error {
+	var request struct {
+		Quotas []EventTypeQuota `json:"quotas"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	quotas := s.analyticsService.Quotas()
+	projectID := utils.CopyString(c.Params("id"))
+
+	// The first quotas of a project may be set without If-Match; a concurrent update still conflicts
+	var expectedVersion int64
+	if quotas.Get(projectID).Version > 0 || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		var err error
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	updated, err := quotas.Replace(projectID, request.Quotas, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(updated.Version))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"quotas": updated,
+	})
+}
+
+// getProjectQuotaUsage returns how many events of each type a project sent on a day (default:
+// today, UTC) and how many of them were accepted, sampled and dropped
+func (s *App) getProjectQuotaUsage(c *fiber.Ctx) error {
+	date := c.Query("date", s.analyticsService.Clock().Now().UTC().Format("2006-01-02"))
+
+	report, err := s.analyticsService.Quotas().Usage(c.Params("id"), date)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"usage":  report,
+	})
+}
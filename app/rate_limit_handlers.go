@@ -0,0 +1,113 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// RateLimitTier is the rate limit of the users of a plan
+type RateLimitTier struct {
+	Plan      string `json:"plan"`
+	RateLimit int    `json:"rate_limit"` // Requests per window and endpoint
+}
+
+// getRateLimits returns the rate limit of every plan and the users whose limit is overridden
+func (s *App) getRateLimits(c *fiber.Ctx) error {
+	plans := s.analyticsService.Plans().Plans()
+	tiers := make([]RateLimitTier, 0, len(plans))
+	for _, plan := range plans {
+		tiers = append(tiers, RateLimitTier{Plan: plan.Name, RateLimit: plan.RateLimit})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":         "success",
+		"window_seconds": int(s.rateLimiter.Window().Seconds()),
+		"tiers":          tiers,
+		"overrides":      s.rateLimiter.Overrides(),
+	})
+}
+
+// getUserRateLimits returns a user's plan, the limit applying to them and where they stand on the
+// endpoints listed in the comma-separated endpoints parameter (default: the ingestion endpoints),
+// without counting a request
+func (s *App) getUserRateLimits(c *fiber.Ctx) error {
+	userID := c.Params("user_id")
+	limit, tier := s.rateLimiter.UserLimit(userID)
+
+	endpoints := requestedEndpoints(c)
+	statuses := make([]RateLimitStatus, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		statuses = append(statuses, s.rateLimiter.Status(userID, endpoint))
+	}
+
+	return c.JSON(fiber.Map{
+		"status":      "success",
+		"user_id":     userID,
+		"plan":        s.analyticsService.Plans().PlanForUser(userID).Name,
+		"limit":       limit,
+		"tier":        tier,
+		"rate_limits": statuses,
+	})
+}
+
+// setUserRateLimit overrides a user's rate limit regardless of their plan
+func (s *App) setUserRateLimit(c *fiber.Ctx) error {
+	var request struct {
+		Limit int `json:"limit"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	userID := utils.CopyString(c.Params("user_id"))
+	previous, previousTier := s.rateLimiter.UserLimit(userID)
+	if err := s.rateLimiter.SetUserLimit(userID, request.Limit); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.auditLog.Record(adminActor(c), "rate_limit.override", userID, map[string]interface{}{
+		"previous":      previous,
+		"previous_tier": previousTier,
+		"limit":         request.Limit,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"user_id":  userID,
+		"previous": previous,
+		"limit":    request.Limit,
+		"tier":     RateLimitOverrideTier,
+	})
+}
+
+// clearUserRateLimit removes the override of a user's rate limit, so their plan's applies again
+func (s *App) clearUserRateLimit(c *fiber.Ctx) error {
+	userID := utils.CopyString(c.Params("user_id"))
+	previous, _ := s.rateLimiter.UserLimit(userID)
+	if !s.rateLimiter.ClearUserLimit(userID) {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": "no rate limit override for user " + userID,
+		})
+	}
+
+	limit, tier := s.rateLimiter.UserLimit(userID)
+	s.auditLog.Record(adminActor(c), "rate_limit.clear", userID, map[string]interface{}{
+		"previous": previous,
+		"limit":    limit,
+	})
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"user_id":  userID,
+		"previous": previous,
+		"limit":    limit,
+		"tier":     tier,
+	})
+}
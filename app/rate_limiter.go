@@ -1,76 +1,224 @@
 package app
 
 import (
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
+// RateLimitOverrideTier is the tier of users whose limit is overridden regardless of their plan
+const RateLimitOverrideTier = "override"
+
+// RateLimitStatus is the state of a user's rate limit on an endpoint
+type RateLimitStatus struct {
+	Endpoint      string    `json:"endpoint"`
+	Limit         int       `json:"limit"`          // Maximum requests per window
+	Tier          string    `json:"tier,omitempty"` // Plan deciding the limit, or "override"
+	Remaining     int       `json:"remaining"`
+	WindowSeconds int       `json:"window_seconds"`
+	ResetAt       time.Time `json:"reset_at"` // When the oldest counted request leaves the window
+}
+
+// RateLimitOverride is the limit of a user set regardless of their plan
+type RateLimitOverride struct {
+	UserID string `json:"user_id"`
+	Limit  int    `json:"limit"` // Maximum requests per window
+}
+
 // RateLimiter implements basic rate limiting per user and endpoint
 type RateLimiter struct {
-	requests map[string][]time.Time
-	mutex    sync.RWMutex
-	limit    int           // Maximum requests per window
-	window   time.Duration // Time window for rate limiting
+	requests  *BoundedCache // User and endpoint -> request times within the window
+	mutex     sync.RWMutex
+	limit     int            // Maximum requests per window of users without a plan
+	plans     *PlanService   // Plans whose rate limit applies to their users, if set
+	overrides map[string]int // Maximum requests per window by user, regardless of their plan
+	window    time.Duration  // Time window for rate limiting
+	clock     Clock
 }
 
-// NewRateLimiter creates a new rate limiter instance
+// NewRateLimiter creates a new rate limiter instance tracking at most RATE_LIMITER_MAX_KEYS
+// (default 100000) users and endpoints. When more are active, the least recently seen ones
+// start over with a fresh window.
 func NewRateLimiter() *RateLimiter {
 	return &RateLimiter{
-		requests: make(map[string][]time.Time),
-		limit:    100,                    // 100 requests per minute by default
-		window:   time.Minute,            // 1 minute window
+		requests:  NewBoundedCache("rate_limiter", getEnvInt("RATE_LIMITER_MAX_KEYS", 100000), time.Minute),
+		limit:     100, // 100 requests per minute by default
+		overrides: make(map[string]int),
+		window:    time.Minute, // 1 minute window
+		clock:     SystemClock(),
 	}
 }
 
+// Cache returns the cache of request times
+func (r *RateLimiter) Cache() *BoundedCache {
+	return r.requests
+}
+
 // AllowRequest checks if a request should be allowed based on rate limiting
 func (r *RateLimiter) AllowRequest(userID, endpoint string) bool {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	allowed, _ := r.Allow(userID, endpoint)
+	return allowed
+}
 
-	key := userID + ":" + endpoint
-	now := time.Now()
+// Allow checks if a request should be allowed based on rate limiting, counting it if so, and
+// returns the state of the user's rate limit on the endpoint after the request
+func (r *RateLimiter) Allow(userID, endpoint string) (bool, RateLimitStatus) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 
-	// Clean up old requests outside the window
-	r.cleanupOldRequests(key, now)
+	now := r.clock.Now()
+	limit, tier := r.limitFor(userID)
+	allowed := false
+	var counted []time.Time
+	r.requests.Update(userID+":"+endpoint, func(value interface{}, exists bool) interface{} {
+		// Clean up old requests outside the window
+		var requests []time.Time
+		if exists {
+			requests = r.validRequests(value.([]time.Time), now)
+		}
 
-	// Check if user has exceeded the limit
-	if len(r.requests[key]) >= r.limit {
-		return false
-	}
+		// Check if user has exceeded the limit
+		if len(requests) >= limit {
+			counted = requests
+			return requests
+		}
 
-	// Add current request
-	r.requests[key] = append(r.requests[key], now)
-	return true
+		// Add current request
+		allowed = true
+		counted = append(requests, now)
+		return counted
+	})
+	return allowed, r.status(endpoint, limit, tier, counted, now)
 }
 
-// cleanupOldRequests removes requests that are outside the current window
-func (r *RateLimiter) cleanupOldRequests(key string, now time.Time) {
-	if requests, exists := r.requests[key]; exists {
-		var validRequests []time.Time
-		cutoff := now.Add(-r.window)
+// UserLimit returns the maximum requests per window of a user on every endpoint, with the tier
+// deciding it: "override", the name of the user's plan, or "" for the flat limit
+func (r *RateLimiter) UserLimit(userID string) (int, string) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.limitFor(userID)
+}
 
-		for _, reqTime := range requests {
-			if reqTime.After(cutoff) {
-				validRequests = append(validRequests, reqTime)
-			}
+// limitFor returns the maximum requests per window of a user with the tier deciding it: the
+// user's override, else the rate limit of the user's plan. Callers must hold the lock.
+func (r *RateLimiter) limitFor(userID string) (int, string) {
+	if limit, exists := r.overrides[userID]; exists {
+		return limit, RateLimitOverrideTier
+	}
+	if r.plans != nil {
+		if plan := r.plans.PlanForUser(userID); plan.RateLimit > 0 {
+			return plan.RateLimit, plan.Name
 		}
+	}
+	return r.limit, ""
+}
 
-		r.requests[key] = validRequests
+// status returns the state of a rate limit given the requests counted within the window
+func (r *RateLimiter) status(endpoint string, limit int, tier string, requests []time.Time, now time.Time) RateLimitStatus {
+	status := RateLimitStatus{
+		Endpoint:      endpoint,
+		Limit:         limit,
+		Tier:          tier,
+		Remaining:     max(limit-len(requests), 0),
+		WindowSeconds: int(r.window / time.Second),
+		ResetAt:       now,
+	}
+	if len(requests) > 0 {
+		status.ResetAt = requests[0].Add(r.window)
 	}
+	return status
 }
 
-// SetLimit sets the rate limit for requests
+// validRequests returns the requests inside the current window
+func (r *RateLimiter) validRequests(requests []time.Time, now time.Time) []time.Time {
+	var validRequests []time.Time
+	cutoff := now.Add(-r.window)
+
+	for _, reqTime := range requests {
+		if reqTime.After(cutoff) {
+			validRequests = append(validRequests, reqTime)
+		}
+	}
+	return validRequests
+}
+
+// SetLimit sets the rate limit for requests of users without a plan
 func (r *RateLimiter) SetLimit(limit int) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.limit = limit
 }
 
-// SetWindow sets the time window for rate limiting
+// SetPlans sets the plans whose rate limit applies to their users instead of the flat limit
+func (r *RateLimiter) SetPlans(plans *PlanService) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.plans = plans
+}
+
+// SetUserLimit overrides the rate limit of a user regardless of their plan
+func (r *RateLimiter) SetUserLimit(userID string, limit int) error {
+	if userID == "" {
+		return fmt.Errorf("user ID is required")
+	}
+	if limit <= 0 {
+		return fmt.Errorf("limit must be positive")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.overrides[userID] = limit
+	return nil
+}
+
+// ClearUserLimit removes the override of a user's rate limit, reporting whether there was one
+func (r *RateLimiter) ClearUserLimit(userID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, exists := r.overrides[userID]
+	delete(r.overrides, userID)
+	return exists
+}
+
+// Overrides returns the users whose rate limit is overridden, sorted by user ID
+func (r *RateLimiter) Overrides() []RateLimitOverride {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	overrides := make([]RateLimitOverride, 0, len(r.overrides))
+	for userID, limit := range r.overrides {
+		overrides = append(overrides, RateLimitOverride{UserID: userID, Limit: limit})
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].UserID < overrides[j].UserID
+	})
+	return overrides
+}
+
+// Window returns the time window requests are limited in
+func (r *RateLimiter) Window() time.Duration {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.window
+}
+
+// SetWindow sets the time window for rate limiting. Request times are kept for one window.
 func (r *RateLimiter) SetWindow(window time.Duration) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.window = window
+	maxEntries, _ := r.requests.Limits()
+	r.requests.SetLimits(maxEntries, window)
+}
+
+// SetClock sets the clock request times are read from
+func (r *RateLimiter) SetClock(clock Clock) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock = clock
+	r.requests.SetClock(clock)
 }
 
 // GetRemainingRequests returns the number of remaining requests for a user/endpoint
@@ -78,13 +226,13 @@ func (r *RateLimiter) GetRemainingRequests(userID, endpoint string) int {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	key := userID + ":" + endpoint
-	now := time.Now()
-
-	// Clean up old requests
-	r.cleanupOldRequests(key, now)
+	var requests []time.Time
+	if value, exists := r.requests.Peek(userID + ":" + endpoint); exists {
+		requests = r.validRequests(value.([]time.Time), r.clock.Now())
+	}
 
-	remaining := r.limit - len(r.requests[key])
+	limit, _ := r.limitFor(userID)
+	remaining := limit - len(requests)
 	if remaining < 0 {
 		remaining = 0
 	}
@@ -92,9 +240,22 @@ func (r *RateLimiter) GetRemainingRequests(userID, endpoint string) int {
 	return remaining
 }
 
+// Status returns the state of a user's rate limit on an endpoint, without counting a request
+func (r *RateLimiter) Status(userID, endpoint string) RateLimitStatus {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	now := r.clock.Now()
+	var requests []time.Time
+	if value, exists := r.requests.Peek(userID + ":" + endpoint); exists {
+		requests = r.validRequests(value.([]time.Time), now)
+	}
+
+	limit, tier := r.limitFor(userID)
+	return r.status(endpoint, limit, tier, requests, now)
+}
+
 // Reset clears all rate limiting data
 func (r *RateLimiter) Reset() {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-	r.requests = make(map[string][]time.Time)
+	r.requests.Clear()
 }
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// regionFromRequest extracts the requested region from the X-Region header or region query
+// parameter, empty when none was requested
+func regionFromRequest(c *fiber.Ctx) string {
+	region := c.Get("X-Region")
+	if region == "" {
+		region = c.Query("region")
+	}
+	return utils.CopyString(region)
+}
+
+// resolveRegion checks the requested region and carries it in the request context, so events are
+// tagged with it and reads narrowed to it. Reads of a region the project's policy does not allow
+// are rejected.
+func (s *App) resolveRegion() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		region := regionFromRequest(c)
+		if region == "" {
+			return c.Next()
+		}
+
+		regions := s.analyticsService.Regions()
+		if err := regions.CheckRegion(region); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if c.Method() == fiber.MethodGet {
+			if _, err := regions.ReadRegions(projectIDFromRequest(c), region); err != nil {
+				return c.Status(http.StatusForbidden).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+		}
+
+		// Contexts derived from the request context see the region
+		c.Locals(regionContextKey{}, region)
+		return c.Next()
+	}
+}
+
+// getRegions returns the configured regions and the projects' region policies
+func (s *App) getRegions(c *fiber.Ctx) error {
+	regions := s.analyticsService.Regions()
+	return c.JSON(fiber.Map{
+		"status":         "success",
+		"regions":        regions.Regions(),
+		"default_region": regions.DefaultRegion(),
+		"policies":       regions.Policies(),
+	})
+}
+
+// getRegionPolicy returns the region policy of a project
+func (s *App) getRegionPolicy(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"policy": s.analyticsService.Regions().Policy(c.Params("project_id")),
+	})
+}
+
+// setRegionPolicy sets where the events of a project are stored and which regions its reads see
+func (s *App) setRegionPolicy(c *fiber.Ctx) error {
+	var request RegionPolicy
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	projectID := utils.CopyString(c.Params("project_id"))
+	regions := s.analyticsService.Regions()
+	previous := regions.Policy(projectID)
+	policy, err := regions.SetPolicy(projectID, request)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	// Cached results may merge regions the project's reads no longer see
+	s.analyticsService.QueryCache().ExpireProject(projectID)
+
+	s.auditLog.Record(adminActor(c), "project.region_policy", projectID, map[string]interface{}{
+		"previous": previous,
+		"policy":   policy,
+	})
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"policy": policy,
+	})
+}
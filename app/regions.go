@@ -0,0 +1,339 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How read APIs treat the regions of a project's events
+const (
+	RegionReadsMerge    = "merge"    // Reads merge the events of every region, or see the requested region only
+	RegionReadsRestrict = "restrict" // Reads see one allowed region only, the home region unless another is requested
+)
+
+// RegionPolicy decides where the events of a project are stored and which regions its reads see
+type RegionPolicy struct {
+	ProjectID      string    `json:"project_id"`
+	HomeRegion     string    `json:"home_region"`     // Region of events without a region tag, or tagged with a region that is not allowed
+	AllowedRegions []string  `json:"allowed_regions"` // Regions events may be stored in, every region when empty
+	Reads          string    `json:"reads"`           // merge or restrict
+	UpdatedAt      time.Time `json:"updated_at,omitempty"`
+}
+
+// allows reports whether events of the project may be stored in and read from the region
+func (p *RegionPolicy) allows(region string) bool {
+	if len(p.AllowedRegions) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedRegions {
+		if allowed == region {
+			return true
+		}
+	}
+	return false
+}
+
+// copy returns a copy of the policy
+func (p *RegionPolicy) copy() *RegionPolicy {
+	copied := *p
+	copied.AllowedRegions = append([]string(nil), p.AllowedRegions...)
+	return &copied
+}
+
+// regionContextKey is the context key holding the region a request asks for
+type regionContextKey struct{}
+
+// ContextWithRegion returns a context carrying the region events are tagged with and reads are
+// narrowed to
+func ContextWithRegion(ctx context.Context, region string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, regionContextKey{}, region)
+}
+
+// RegionFromContext returns the region carried by the context, empty when none was requested
+func RegionFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	region, _ := ctx.Value(regionContextKey{}).(string)
+	return region
+}
+
+// RegionRouter tags events with the region they are stored in and decides which regions' events
+// the reads of each project see. Every region has a store of its own.
+type RegionRouter struct {
+	regions       []string
+	defaultRegion string
+	policies      map[string]*RegionPolicy // Project ID -> policy
+	clock         Clock
+	mutex         sync.RWMutex
+}
+
+// NewRegionRouter creates a router for the comma-separated regions of EVENT_REGIONS, storing
+// events without a region in DEFAULT_EVENT_REGION (default: the first region). Without
+// EVENT_REGIONS there is a single region, DEFAULT_EVENT_REGION or "default".
+func NewRegionRouter() *RegionRouter {
+	router := &RegionRouter{
+		defaultRegion: os.Getenv("DEFAULT_EVENT_REGION"),
+		policies:      make(map[string]*RegionPolicy),
+		clock:         SystemClock(),
+	}
+	for _, region := range strings.Split(os.Getenv("EVENT_REGIONS"), ",") {
+		if region = strings.TrimSpace(region); region != "" && !router.known(region) {
+			router.regions = append(router.regions, region)
+		}
+	}
+
+	switch {
+	case len(router.regions) == 0:
+		if router.defaultRegion == "" {
+			router.defaultRegion = "default"
+		}
+		router.regions = []string{router.defaultRegion}
+	case router.defaultRegion == "":
+		router.defaultRegion = router.regions[0]
+	case !router.known(router.defaultRegion):
+		log.Printf("Warning: DEFAULT_EVENT_REGION %q is not in EVENT_REGIONS, using %s", router.defaultRegion, router.regions[0])
+		router.defaultRegion = router.regions[0]
+	}
+	return router
+}
+
+// known reports whether a region is configured
+func (r *RegionRouter) known(region string) bool {
+	for _, known := range r.regions {
+		if known == region {
+			return true
+		}
+	}
+	return false
+}
+
+// Regions returns the configured regions
+func (r *RegionRouter) Regions() []string {
+	return append([]string(nil), r.regions...)
+}
+
+// DefaultRegion returns the region of events of projects without a policy that are not tagged
+func (r *RegionRouter) DefaultRegion() string {
+	return r.defaultRegion
+}
+
+// CheckRegion returns an error for regions that are not configured
+func (r *RegionRouter) CheckRegion(region string) error {
+	if !r.known(region) {
+		return fmt.Errorf("unknown region: %s. Valid regions are: %s", region, strings.Join(r.regions, ", "))
+	}
+	return nil
+}
+
+// Policy returns the policy of a project. Projects without one store events in the region they
+// are tagged with, the default region otherwise, and their reads merge every region.
+func (r *RegionRouter) Policy(projectID string) *RegionPolicy {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.policy(projectID).copy()
+}
+
+// policy returns the policy of a project. Callers must hold the lock.
+func (r *RegionRouter) policy(projectID string) *RegionPolicy {
+	if policy, exists := r.policies[projectID]; exists {
+		return policy
+	}
+	return &RegionPolicy{ProjectID: projectID, HomeRegion: r.defaultRegion, AllowedRegions: []string{}, Reads: RegionReadsMerge}
+}
+
+// Policies returns the policies set for projects, ordered by project
+func (r *RegionRouter) Policies() []*RegionPolicy {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	policies := make([]*RegionPolicy, 0, len(r.policies))
+	for _, policy := range r.policies {
+		policies = append(policies, policy.copy())
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].ProjectID < policies[j].ProjectID
+	})
+	return policies
+}
+
+// SetPolicy validates and sets the policy of a project. Reads default to merge, and the allowed
+// regions must include the home region. Events already stored stay in their region.
+func (r *RegionRouter) SetPolicy(projectID string, policy RegionPolicy) (*RegionPolicy, error) {
+	if err := validateResourceID(projectID); err != nil {
+		return nil, fmt.Errorf("invalid project ID: %w", err)
+	}
+	if policy.Reads == "" {
+		policy.Reads = RegionReadsMerge
+	}
+	if policy.Reads != RegionReadsMerge && policy.Reads != RegionReadsRestrict {
+		return nil, fmt.Errorf("invalid reads: %s. Valid values are: %s, %s", policy.Reads, RegionReadsMerge, RegionReadsRestrict)
+	}
+	if policy.HomeRegion == "" {
+		policy.HomeRegion = r.defaultRegion
+	}
+	if err := r.CheckRegion(policy.HomeRegion); err != nil {
+		return nil, err
+	}
+
+	allowed := make([]string, 0, len(policy.AllowedRegions))
+	seen := make(map[string]bool)
+	for _, region := range policy.AllowedRegions {
+		if err := r.CheckRegion(region); err != nil {
+			return nil, err
+		}
+		if !seen[region] {
+			seen[region] = true
+			allowed = append(allowed, region)
+		}
+	}
+	sort.Strings(allowed)
+	policy.AllowedRegions = allowed
+	if !policy.allows(policy.HomeRegion) {
+		return nil, fmt.Errorf("allowed regions must include the home region %s", policy.HomeRegion)
+	}
+
+	policy.ProjectID = projectID
+	policy.UpdatedAt = r.clock.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.policies[projectID] = &policy
+	return policy.copy(), nil
+}
+
+// Route returns the region an event of the project tagged with the requested region is stored
+// in: the requested region when the project allows it, its home region otherwise
+func (r *RegionRouter) Route(projectID, requested string) (string, error) {
+	if requested != "" {
+		if err := r.CheckRegion(requested); err != nil {
+			return "", err
+		}
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	policy := r.policy(projectID)
+	if requested == "" || !policy.allows(requested) {
+		return policy.HomeRegion, nil
+	}
+	return requested, nil
+}
+
+// ReadRegions returns the regions whose events reads of the project see, nil for every region.
+// Projects restricting reads see their home region unless they request another allowed region.
+func (r *RegionRouter) ReadRegions(projectID, requested string) ([]string, error) {
+	if requested != "" {
+		if err := r.CheckRegion(requested); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	policy := r.policy(projectID)
+	switch {
+	case requested == "" && policy.Reads == RegionReadsRestrict:
+		return []string{policy.HomeRegion}, nil
+	case requested == "":
+		return nil, nil
+	case policy.Reads == RegionReadsRestrict && !policy.allows(requested):
+		return nil, fmt.Errorf("project %s does not allow reading region %s", projectID, requested)
+	}
+	return []string{requested}, nil
+}
+
+// SetClock sets the clock policy updates are timed with
+func (r *RegionRouter) SetClock(clock Clock) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock = clock
+}
+
+// scanEvents calls fn with the stored events of the regions, of every region when nil. Callers
+// must hold the lock.
+func (s *AnalyticsService) scanEvents(regions []string, fn func(*AnalyticsEvent)) {
+	if regions == nil {
+		for _, events := range s.events {
+			for _, event := range events {
+				fn(event)
+			}
+		}
+		return
+	}
+	for _, region := range regions {
+		for _, event := range s.events[region] {
+			fn(event)
+		}
+	}
+}
+
+// scanEventsReporting scans the events of the regions like scanEvents, reporting the scanned
+// events to the job running with the context
+func (s *AnalyticsService) scanEventsReporting(ctx context.Context, regions []string, fn func(*AnalyticsEvent)) {
+	job := jobFromContext(ctx)
+	if job == nil {
+		s.scanEvents(regions, fn)
+		return
+	}
+
+	job.expect(s.countEvents(regions))
+	var scanned int64
+	s.scanEvents(regions, func(event *AnalyticsEvent) {
+		fn(event)
+		if scanned++; scanned == jobProgressBatch {
+			job.scan(scanned)
+			scanned = 0
+		}
+	})
+	job.scan(scanned)
+}
+
+// countEvents returns the number of events stored in the regions, of every region when nil
+func (s *AnalyticsService) countEvents(regions []string) int64 {
+	var count int64
+	if regions == nil {
+		for _, events := range s.events {
+			count += int64(len(events))
+		}
+		return count
+	}
+	for _, region := range regions {
+		count += int64(len(s.events[region]))
+	}
+	return count
+}
+
+// readRegions returns the regions reads of the project see with the context's region, none when
+// the project does not allow reading the requested region
+func (s *AnalyticsService) readRegions(ctx context.Context, projectID string) []string {
+	regions, err := s.regions.ReadRegions(projectID, RegionFromContext(ctx))
+	if err != nil {
+		return []string{}
+	}
+	return regions
+}
+
+// eventRegion returns the region requested for an event through its region field or the context
+func eventRegion(ctx context.Context, eventData map[string]interface{}) (string, error) {
+	value, exists := eventData["region"]
+	if !exists || value == nil {
+		return RegionFromContext(ctx), nil
+	}
+	region, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("region must be a string")
+	}
+	return region, nil
+}
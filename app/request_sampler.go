@@ -101,6 +101,18 @@ func (s *RequestSampler) SetGlobalSampleRate(rate float64) {
 	}
 }
 
+// SampleRates returns the configured sample rates by endpoint
+func (s *RequestSampler) SampleRates() map[string]float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rates := make(map[string]float64, len(s.sampleRates))
+	for endpoint, rate := range s.sampleRates {
+		rates[endpoint] = rate
+	}
+	return rates
+}
+
 // GetSamplingStats returns sampling statistics for monitoring
 func (s *RequestSampler) GetSamplingStats() map[string]interface{} {
 	s.mutex.RLock()
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// listResources returns the ID, version and definition fingerprint of every configuration resource of
+// the project, optionally filtered by ?kind=, so clients can detect drift in a single request
+func (s *App) listResources(c *fiber.Ctx) error {
+	kind := c.Query("kind")
+	if kind != "" && kind != ResourceFunnel && kind != ResourceQuery && kind != ResourceDashboard {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "kind must be funnel, query or dashboard",
+		})
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	resources := make([]ResourceFingerprint, 0)
+	if kind == "" || kind == ResourceFunnel {
+		for _, funnel := range s.funnelService.ListFunnels(ctx) {
+			resources = append(resources, ResourceFingerprint{Kind: ResourceFunnel, ID: funnel.ID, Name: funnel.Name, Version: funnel.Version, Fingerprint: funnel.Fingerprint()})
+		}
+	}
+	if kind == "" || kind == ResourceQuery {
+		for _, query := range s.savedQueryService.ListQueries(ctx) {
+			resources = append(resources, ResourceFingerprint{Kind: ResourceQuery, ID: query.ID, Name: query.Name, Version: query.Version, Fingerprint: query.Fingerprint()})
+		}
+	}
+	if kind == "" || kind == ResourceDashboard {
+		for _, dashboard := range s.savedDashboardService.ListDashboards(ctx) {
+			resources = append(resources, ResourceFingerprint{Kind: ResourceDashboard, ID: dashboard.ID, Name: dashboard.Name, Version: dashboard.Version, Fingerprint: dashboard.Fingerprint()})
+		}
+	}
+
+	sort.SliceStable(resources, func(i, j int) bool {
+		if resources[i].Kind != resources[j].Kind {
+			return resources[i].Kind < resources[j].Kind
+		}
+		return resources[i].ID < resources[j].ID
+	})
+
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"resources": resources,
+	})
+}
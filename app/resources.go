@@ -0,0 +1,66 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// Kinds of configuration resources
+const (
+	ResourceFunnel    = "funnel"
+	ResourceQuery     = "query"
+	ResourceDashboard = "dashboard"
+)
+
+// resourceIDPattern restricts client-supplied IDs to characters that are safe in URLs
+var resourceIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,127}$`)
+
+// ResourceFingerprint identifies the current definition of a configuration resource, letting
+// clients such as infrastructure-as-code tools detect drift without comparing every field
+type ResourceFingerprint struct {
+	Kind        string `json:"kind"`
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Version     int64  `json:"version"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// ResourceExistsError is returned when a client-supplied ID is already used by a resource with
+// a different definition, or by another project
+type ResourceExistsError struct {
+	Resource string
+	ID       string
+}
+
+// Error describes the conflicting ID
+func (e *ResourceExistsError) Error() string {
+	return fmt.Sprintf("%s %s already exists with a different definition", e.Resource, e.ID)
+}
+
+// validateResourceID checks a client-supplied resource ID
+func validateResourceID(id string) error {
+	if !resourceIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid id %q: use up to 128 letters, digits, '_', '.', ':' or '-', starting with a letter or digit", id)
+	}
+	return nil
+}
+
+// fingerprint hashes the JSON encoding of a resource definition. Map keys are encoded in
+// sorted order, so equal definitions always have the same fingerprint.
+func fingerprint(definition interface{}) string {
+	encoded, _ := json.Marshal(definition)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// createdStatus is the status of a create-or-replace response: 201 when the resource was created
+func createdStatus(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
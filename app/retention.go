@@ -0,0 +1,398 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default retention of events whose type has no override
+const defaultEventRetention = 365 * 24 * time.Hour
+
+// bytesPerGB converts stored bytes into the unit storage is priced in
+const bytesPerGB = 1 << 30
+
+// RetentionPolicy decides how long stored events are kept. Event types can override the default,
+// e.g. keeping conversions for two years but mouse movements for a week.
+type RetentionPolicy struct {
+	defaultTTL time.Duration
+	overrides  map[string]time.Duration // Retention per event type
+	mutex      sync.RWMutex
+}
+
+// NewRetentionPolicy creates a retention policy configured from EVENT_RETENTION and
+// EVENT_RETENTION_OVERRIDES, a comma-separated list of event_type:retention entries
+func NewRetentionPolicy() *RetentionPolicy {
+	policy := &RetentionPolicy{
+		defaultTTL: defaultEventRetention,
+		overrides:  make(map[string]time.Duration),
+	}
+
+	if value := os.Getenv("EVENT_RETENTION"); value != "" {
+		ttl, err := parseRetention(value)
+		if err != nil {
+			log.Printf("Warning: Ignoring EVENT_RETENTION: %v", err)
+		} else {
+			policy.defaultTTL = ttl
+		}
+	}
+
+	if value := os.Getenv("EVENT_RETENTION_OVERRIDES"); value != "" {
+		overrides, err := parseRetentionOverrides(value)
+		if err != nil {
+			log.Printf("Warning: Ignoring EVENT_RETENTION_OVERRIDES: %v", err)
+		} else {
+			policy.overrides = overrides
+		}
+	}
+
+	return policy
+}
+
+// TTL returns how long events of a type are kept
+func (p *RetentionPolicy) TTL(eventType string) time.Duration {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if ttl, exists := p.overrides[eventType]; exists {
+		return ttl
+	}
+	return p.defaultTTL
+}
+
+// Expired reports whether an event is past its retention at the given time
+func (p *RetentionPolicy) Expired(event *AnalyticsEvent, now time.Time) bool {
+	return event.Timestamp.Before(now.Add(-p.TTL(event.EventType)))
+}
+
+// DefaultTTL returns the retention of event types without an override
+func (p *RetentionPolicy) DefaultTTL() time.Duration {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.defaultTTL
+}
+
+// SetDefaultTTL sets the retention of event types without an override
+func (p *RetentionPolicy) SetDefaultTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("retention must be positive, got %s", ttl)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.defaultTTL = ttl
+	return nil
+}
+
+// Overrides returns the retention overrides by event type
+func (p *RetentionPolicy) Overrides() map[string]time.Duration {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	overrides := make(map[string]time.Duration, len(p.overrides))
+	for eventType, ttl := range p.overrides {
+		overrides[eventType] = ttl
+	}
+	return overrides
+}
+
+// ReplaceOverrides replaces every retention override
+func (p *RetentionPolicy) ReplaceOverrides(overrides map[string]time.Duration) error {
+	for eventType, ttl := range overrides {
+		if ttl <= 0 {
+			return fmt.Errorf("retention for %s must be positive, got %s", eventType, ttl)
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.overrides = make(map[string]time.Duration, len(overrides))
+	for eventType, ttl := range overrides {
+		p.overrides[eventType] = ttl
+	}
+	return nil
+}
+
+// parseRetention parses a retention in days (e.g. "730d") or as a Go duration (e.g. "36h")
+func parseRetention(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if days, found := strings.CutSuffix(value, "d"); found {
+		count, err := strconv.Atoi(days)
+		if err != nil || count <= 0 {
+			return 0, fmt.Errorf("invalid retention %q, expected a positive number of days", value)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid retention %q, expected e.g. 30d or 36h", value)
+	}
+	return ttl, nil
+}
+
+// parseRetentionOverrides parses a comma-separated list of event_type:retention entries
+func parseRetentionOverrides(value string) (map[string]time.Duration, error) {
+	overrides := make(map[string]time.Duration)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		eventType, retention, found := strings.Cut(entry, ":")
+		if !found || eventType == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected event_type:retention", entry)
+		}
+
+		ttl, err := parseRetention(retention)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", eventType, err)
+		}
+		overrides[eventType] = ttl
+	}
+	return overrides, nil
+}
+
+// formatRetention formats a retention in whole days when possible
+func formatRetention(ttl time.Duration) string {
+	if ttl%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", ttl/(24*time.Hour))
+	}
+	return ttl.String()
+}
+
+// runtimeRetentionOverrides converts a JSON object or an "event_type:retention,..." string into overrides
+func runtimeRetentionOverrides(value interface{}) (map[string]time.Duration, error) {
+	switch v := value.(type) {
+	case string:
+		return parseRetentionOverrides(v)
+	case map[string]interface{}:
+		overrides := make(map[string]time.Duration, len(v))
+		for eventType, raw := range v {
+			retention, ok := raw.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a retention such as \"30d\" for %s, got %T", eventType, raw)
+			}
+			ttl, err := parseRetention(retention)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", eventType, err)
+			}
+			overrides[eventType] = ttl
+		}
+		return overrides, nil
+	default:
+		return nil, fmt.Errorf("expected an object of retentions, got %T", value)
+	}
+}
+
+// PurgeResult summarizes a purge of expired events
+type PurgeResult struct {
+	RanAt        time.Time        `json:"ran_at"`
+	Purged       int64            `json:"purged"`
+	PurgedByType map[string]int64 `json:"purged_by_type"`
+	Downsampled  int              `json:"downsampled"` // Days of hourly series compacted into daily summaries
+}
+
+// PurgeExpiredEvents deletes the stored events past their type's retention and downsamples the
+// hourly series of days past the downsampling horizon
+func (s *AnalyticsService) PurgeExpiredEvents(now time.Time) PurgeResult {
+	return s.purgeExpiredEvents(context.Background(), now)
+}
+
+// purgeExpiredEvents purges expired events, reporting the scanned events to the job running with
+// the context
+func (s *AnalyticsService) purgeExpiredEvents(ctx context.Context, now time.Time) PurgeResult {
+	result := PurgeResult{RanAt: now, PurgedByType: make(map[string]int64)}
+
+	var purged []string
+	s.mutex.Lock()
+	job := jobFromContext(ctx)
+	job.expect(s.countEvents(nil))
+	for _, events := range s.events {
+		scanned := int64(len(events))
+		for id, event := range events {
+			if s.retention.Expired(event, now) {
+				delete(events, id)
+				delete(s.correlations, event.BillingCorrelationID)
+				purged = append(purged, id)
+				result.Purged++
+				result.PurgedByType[event.EventType]++
+			}
+		}
+		job.scan(scanned)
+	}
+	s.mutex.Unlock()
+	s.storeWriter.Delete(purged)
+
+	if result.Purged > 0 {
+		s.rollups.touch()
+		log.Printf("Purged %d expired events", result.Purged)
+	}
+
+	if result.Downsampled = s.series.Downsample(now); result.Downsampled > 0 {
+		log.Printf("Downsampled %d days of hourly series", result.Downsampled)
+	}
+	return result
+}
+
+// EventPurger periodically purges events past their retention and downsamples old hourly series
+type EventPurger struct {
+	analyticsService *AnalyticsService
+	interval         time.Duration
+	lastRun          *PurgeResult
+	stop             chan struct{}
+	stopOnce         sync.Once
+	mutex            sync.RWMutex
+}
+
+// NewEventPurger creates a purger running every interval (EVENT_PURGE_INTERVAL, default 1h)
+func NewEventPurger(analyticsService *AnalyticsService) *EventPurger {
+	return &EventPurger{
+		analyticsService: analyticsService,
+		interval:         getEnvDuration("EVENT_PURGE_INTERVAL", time.Hour),
+		stop:             make(chan struct{}),
+	}
+}
+
+// Start runs the purger in the background until Stop is called
+func (p *EventPurger) Start() {
+	if p.interval <= 0 {
+		log.Printf("Event purger disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				return
+			case now := <-ticker.C:
+				p.Run(now)
+			}
+		}
+	}()
+}
+
+// Stop stops the background purges
+func (p *EventPurger) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// Run purges expired events now and records the result
+func (p *EventPurger) Run(now time.Time) PurgeResult {
+	return p.run(context.Background(), now)
+}
+
+// run purges expired events, reporting the scanned events to the job running with the context
+func (p *EventPurger) run(ctx context.Context, now time.Time) PurgeResult {
+	result := p.analyticsService.purgeExpiredEvents(ctx, now)
+
+	p.mutex.Lock()
+	p.lastRun = &result
+	p.mutex.Unlock()
+	return result
+}
+
+// LastRun returns the result of the most recent purge, or nil before the first one
+func (p *EventPurger) LastRun() *PurgeResult {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.lastRun
+}
+
+// StorageEstimate projects the storage used by events once every type has reached its retention
+type StorageEstimate struct {
+	CostPerGBMonth float64                 `json:"cost_per_gb_month"`
+	StoredEvents   int64                   `json:"stored_events"`
+	ProjectedBytes int64                   `json:"projected_bytes"`
+	MonthlyCost    float64                 `json:"monthly_cost"`
+	Currency       string                  `json:"currency"`
+	EventTypes     []EventTypeStorageUsage `json:"event_types"`
+}
+
+// EventTypeStorageUsage is the storage estimate of an event type
+type EventTypeStorageUsage struct {
+	EventType       string  `json:"event_type"`
+	Retention       string  `json:"retention"`
+	StoredEvents    int64   `json:"stored_events"`
+	DailyEvents     float64 `json:"daily_events"` // Average over the last 7 days
+	AvgEventBytes   int64   `json:"avg_event_bytes"`
+	ProjectedEvents int64   `json:"projected_events"` // Daily events times retention in days
+	ProjectedBytes  int64   `json:"projected_bytes"`
+	MonthlyCost     float64 `json:"monthly_cost"`
+}
+
+// EstimateStorage projects the steady-state storage of each event type from its recent ingest rate,
+// average stored size and retention, priced at STORAGE_COST_PER_GB_MONTH
+func (s *AnalyticsService) EstimateStorage(now time.Time) StorageEstimate {
+	const window = 7 * 24 * time.Hour
+
+	type usage struct {
+		stored int64
+		recent int64
+		bytes  int64
+	}
+	byType := make(map[string]*usage)
+
+	s.mutex.RLock()
+	s.scanEvents(nil, func(event *AnalyticsEvent) {
+		u, exists := byType[event.EventType]
+		if !exists {
+			u = &usage{}
+			byType[event.EventType] = u
+		}
+		u.stored++
+		if !event.Timestamp.Before(now.Add(-window)) {
+			u.recent++
+		}
+		if encoded, err := json.Marshal(event); err == nil {
+			u.bytes += int64(len(encoded))
+		}
+	})
+	s.mutex.RUnlock()
+
+	estimate := StorageEstimate{
+		CostPerGBMonth: s.storageCostPerGBMonth,
+		Currency:       BaseCurrency,
+		EventTypes:     make([]EventTypeStorageUsage, 0, len(byType)),
+	}
+	for eventType, u := range byType {
+		ttl := s.retention.TTL(eventType)
+		daily := float64(u.recent) / window.Hours() * 24
+		avgBytes := u.bytes / u.stored
+		projected := int64(daily * ttl.Hours() / 24)
+		projectedBytes := projected * avgBytes
+
+		entry := EventTypeStorageUsage{
+			EventType:       eventType,
+			Retention:       formatRetention(ttl),
+			StoredEvents:    u.stored,
+			DailyEvents:     daily,
+			AvgEventBytes:   avgBytes,
+			ProjectedEvents: projected,
+			ProjectedBytes:  projectedBytes,
+			MonthlyCost:     float64(projectedBytes) / bytesPerGB * s.storageCostPerGBMonth,
+		}
+		estimate.EventTypes = append(estimate.EventTypes, entry)
+		estimate.StoredEvents += entry.StoredEvents
+		estimate.ProjectedBytes += entry.ProjectedBytes
+		estimate.MonthlyCost += entry.MonthlyCost
+	}
+
+	sort.Slice(estimate.EventTypes, func(i, j int) bool {
+		return estimate.EventTypes[i].ProjectedBytes > estimate.EventTypes[j].ProjectedBytes
+	})
+	return estimate
+}
@@ -0,0 +1,85 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// computeRetention handles retention analysis requests. The segment can be given inline or as
+// the ID of a saved segment query. Results are cached, see cachedQuery.
+func (s *App) computeRetention(c *fiber.Ctx) error {
+	var query RetentionQuery
+	if err := c.BodyParser(&query); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	projectID := projectIDFromRequest(c)
+	if query.SegmentID != "" {
+		if query.Segment != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "segment and segment_id are mutually exclusive",
+			})
+		}
+		segment, err := s.savedRetentionSegment(ContextWithProject(c.Context(), projectID), query.SegmentID)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		query.Segment = segment
+	}
+
+	// The resolved segment is part of the key, so changes to a saved segment are not served stale
+	encoded, err := json.Marshal(query)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	parameters := map[string]string{
+		"query":  string(encoded),
+		"region": regionFromRequest(c),
+	}
+
+	if prefersAsync(c) {
+		return s.acceptJob(c, projectID, JobRetention, func(ctx context.Context) (interface{}, error) {
+			return s.retentionService.ComputeRetention(ContextWithRegion(ContextWithProject(ctx, projectID), parameters["region"]), query)
+		})
+	}
+
+	result, err := s.cachedQuery(c, "retention", projectID, parameters, func() (interface{}, error) {
+		return s.retentionService.ComputeRetention(ContextWithRegion(ContextWithProject(context.Background(), projectID), parameters["region"]), query)
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return sendQueryResult(c, result, fiber.Map{
+		"status": "success",
+		"result": result,
+	})
+}
+
+// savedRetentionSegment returns the segment of a saved segment query
+func (s *App) savedRetentionSegment(ctx context.Context, id string) (*RetentionSegment, error) {
+	saved, err := s.savedQueryService.GetQuery(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if saved.Type != SavedQuerySegment {
+		return nil, fmt.Errorf("saved query %s is a %s query, not a segment", id, saved.Type)
+	}
+	properties, _ := saved.Parameters["properties"].(map[string]interface{})
+	return &RetentionSegment{
+		EventType:  queryString(saved.Parameters, "event_type"),
+		Properties: properties,
+	}, nil
+}
@@ -0,0 +1,236 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Days retention is reported for when the query does not list any
+var defaultRetentionDays = []int{1, 7, 30}
+
+// Limits of retention queries
+const (
+	maxRetentionDay     = 365 // Latest day after first seen retention can be reported for
+	maxRetentionCohorts = 366 // Daily cohorts a query can span
+)
+
+// RetentionService computes how many of the users first seen on each day come back on the days
+// after, from the stored events
+type RetentionService struct {
+	analyticsService *AnalyticsService
+}
+
+// RetentionSegment restricts retention to the users who performed an event with the properties
+// while their cohorts were formed
+type RetentionSegment struct {
+	EventType  string                 `json:"event_type"`
+	Properties map[string]interface{} `json:"properties,omitempty"` // Event properties that must match exactly
+}
+
+// RetentionQuery selects the cohorts of a retention analysis
+type RetentionQuery struct {
+	Start time.Time `json:"start"` // Day of the first cohort, 30 days before End when zero
+	End   time.Time `json:"end"`   // Cohorts are formed up to this time, now when zero
+	// Events users are first seen with and come back with, any event when empty
+	EventType string `json:"event_type,omitempty"`
+	// Events users come back with instead, if set
+	ReturnEventType string            `json:"return_event_type,omitempty"`
+	Days            []int             `json:"days,omitempty"` // Days after first seen retention is reported for, 1, 7 and 30 when empty
+	Segment         *RetentionSegment `json:"segment,omitempty"`
+	// Saved segment query the segment is taken from, resolved before computing
+	SegmentID string `json:"segment_id,omitempty"`
+}
+
+// RetentionResult is the retention matrix of daily cohorts
+type RetentionResult struct {
+	TimeRange       TimeRange          `json:"time_range"`
+	EventType       string             `json:"event_type,omitempty"`
+	ReturnEventType string             `json:"return_event_type,omitempty"`
+	Days            []int              `json:"days"`
+	Cohorts         []RetentionCohort  `json:"cohorts"`
+	Summary         []RetentionSummary `json:"summary"`
+	TotalUsers      int64              `json:"total_users"` // First seen in the time range
+	ComputedAt      time.Time          `json:"computed_at"`
+}
+
+// RetentionCohort is the users first seen on a day and how many of them came back
+type RetentionCohort struct {
+	Date      string          `json:"date"` // YYYY-MM-DD, in UTC
+	Users     int64           `json:"users"`
+	Retention []RetentionCell `json:"retention"` // One per day of the query
+}
+
+// RetentionCell counts the users of a cohort active on a day after they were first seen
+type RetentionCell struct {
+	Day   int     `json:"day"`
+	Users int64   `json:"users"`
+	Rate  float64 `json:"rate"` // Share of the cohort's users
+	// Whether the day is over; the counts of days still under way or to come may grow
+	Complete bool `json:"complete"`
+}
+
+// RetentionSummary is the retention on a day over every cohort for which the day is over,
+// weighted by the size of the cohorts
+type RetentionSummary struct {
+	Day      int     `json:"day"`
+	Cohorts  int     `json:"cohorts"`  // Cohorts with users for which the day is over
+	Users    int64   `json:"users"`    // Users of those cohorts
+	Retained int64   `json:"retained"` // Users of those cohorts active on the day
+	Rate     float64 `json:"rate"`
+}
+
+// NewRetentionService creates a new retention service instance
+func NewRetentionService(analyticsService *AnalyticsService) *RetentionService {
+	return &RetentionService{
+		analyticsService: analyticsService,
+	}
+}
+
+// ComputeRetention buckets the project's users by the UTC day of their first event, and counts
+// for each day of the query the users of each cohort active on that day after their first. Users
+// are first seen with their earliest event, even before the time range, so users first seen
+// earlier are in no cohort. Users merged by identity resolution count once.
+func (s *RetentionService) ComputeRetention(ctx context.Context, query RetentionQuery) (*RetentionResult, error) {
+	computeStart := time.Now()
+	now := s.analyticsService.Clock().Now()
+	if query.End.IsZero() {
+		query.End = now
+	}
+	if query.Start.IsZero() {
+		query.Start = query.End.AddDate(0, 0, -30)
+	}
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	first := query.Start.UTC().Truncate(rollupDay)
+	cohortCount := int((query.End.Sub(first) + rollupDay - 1) / rollupDay)
+	if cohortCount > maxRetentionCohorts {
+		return nil, fmt.Errorf("the time range spans %d days, at most %d daily cohorts are supported", cohortCount, maxRetentionCohorts)
+	}
+	days, err := retentionDays(query.Days)
+	if err != nil {
+		return nil, err
+	}
+	if query.Segment != nil && query.Segment.EventType == "" {
+		return nil, fmt.Errorf("segment event type is required")
+	}
+	returnEventType := query.ReturnEventType
+	if returnEventType == "" {
+		returnEventType = query.EventType
+	}
+
+	// Returns are looked for up to the last reported day of the last cohort
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		End:       first.Add(time.Duration(cohortCount+days[len(days)-1]+1) * rollupDay),
+	})
+
+	firstSeen := make(map[string]time.Time)
+	active := make(map[string]map[int]bool) // Days since the first cohort each user returned on
+	members := make(map[string]bool)        // Users of the segment, if any
+	for _, event := range events {
+		if query.EventType == "" || event.EventType == query.EventType {
+			if seen, exists := firstSeen[event.UserID]; !exists || event.Timestamp.Before(seen) {
+				firstSeen[event.UserID] = event.Timestamp
+			}
+		}
+		if returnEventType == "" || event.EventType == returnEventType {
+			if active[event.UserID] == nil {
+				active[event.UserID] = make(map[int]bool)
+			}
+			active[event.UserID][retentionDay(first, event.Timestamp)] = true
+		}
+		if query.Segment != nil && event.EventType == query.Segment.EventType && !event.Timestamp.Before(query.Start) && event.Timestamp.Before(query.End) && matchesProperties(event.Properties, query.Segment.Properties) {
+			members[event.UserID] = true
+		}
+	}
+
+	result := &RetentionResult{
+		TimeRange:       TimeRange{Start: query.Start, End: query.End},
+		EventType:       query.EventType,
+		ReturnEventType: query.ReturnEventType,
+		Days:            days,
+		Cohorts:         make([]RetentionCohort, cohortCount),
+		ComputedAt:      time.Now(),
+	}
+	for i := range result.Cohorts {
+		cohortDay := first.Add(time.Duration(i) * rollupDay)
+		cohort := &result.Cohorts[i]
+		cohort.Date = cohortDay.Format("2006-01-02")
+		cohort.Retention = make([]RetentionCell, len(days))
+		for j, n := range days {
+			cohort.Retention[j] = RetentionCell{Day: n, Complete: !now.Before(cohortDay.Add(time.Duration(n+1) * rollupDay))}
+		}
+	}
+
+	for userID, seen := range firstSeen {
+		if seen.Before(query.Start) || !seen.Before(query.End) || query.Segment != nil && !members[userID] {
+			continue
+		}
+		cohortIndex := retentionDay(first, seen)
+		cohort := &result.Cohorts[cohortIndex]
+		cohort.Users++
+		result.TotalUsers++
+		for j, n := range days {
+			if active[userID][cohortIndex+n] {
+				cohort.Retention[j].Users++
+			}
+		}
+	}
+
+	result.Summary = make([]RetentionSummary, len(days))
+	for j, n := range days {
+		summary := &result.Summary[j]
+		summary.Day = n
+		for _, cohort := range result.Cohorts {
+			cell := &cohort.Retention[j]
+			if cohort.Users > 0 {
+				cell.Rate = float64(cell.Users) / float64(cohort.Users)
+			}
+			if cohort.Users > 0 && cell.Complete {
+				summary.Cohorts++
+				summary.Users += cohort.Users
+				summary.Retained += cell.Users
+			}
+		}
+		if summary.Users > 0 {
+			summary.Rate = float64(summary.Retained) / float64(summary.Users)
+		}
+	}
+
+	s.analyticsService.SlowOperations().Observe(SlowOperationRetention, map[string]interface{}{
+		"event_type":        query.EventType,
+		"return_event_type": query.ReturnEventType,
+		"start":             query.Start,
+		"end":               query.End,
+	}, time.Since(computeStart), int64(len(events)), s.analyticsService.calculateAPICallCost("/api/v1/retention/compute", "POST"))
+
+	return result, nil
+}
+
+// retentionDays validates and sorts the days of a query, or returns the default days
+func retentionDays(requested []int) ([]int, error) {
+	if len(requested) == 0 {
+		return defaultRetentionDays, nil
+	}
+	days := make([]int, 0, len(requested))
+	seen := make(map[int]bool)
+	for _, n := range requested {
+		if n < 1 || n > maxRetentionDay {
+			return nil, fmt.Errorf("invalid retention day %d: days must be from 1 to %d", n, maxRetentionDay)
+		}
+		if !seen[n] {
+			seen[n] = true
+			days = append(days, n)
+		}
+	}
+	sort.Ints(days)
+	return days, nil
+}
+
+// retentionDay returns the number of UTC days from the first cohort's day to a time
+func retentionDay(first, at time.Time) int {
+	return int(at.UTC().Truncate(rollupDay).Sub(first) / rollupDay)
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getRollupBreakdown returns a handler breaking the project's events down by a dimension from the
+// daily rollups, optionally of a single ?event_type and filtered by the other dimensions, over
+// the whole days of ?start_date and ?end_date (default the last 30 days)
+func (s *App) getRollupBreakdown(dimension string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start, end, err := queryTimeRange(map[string]interface{}{
+			"start_date": c.Query("start_date"),
+			"end_date":   c.Query("end_date"),
+		})
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		filters := make(map[string]string)
+		for name := range rollupDimensions {
+			if value := c.Query(name); value != "" && name != dimension {
+				filters[name] = utils.CopyString(value)
+			}
+		}
+
+		projectID := projectIDFromRequest(c)
+		report, err := s.analyticsService.Rollups().Query(RollupQuery{
+			ProjectID: projectID,
+			Dimension: dimension,
+			EventType: utils.CopyString(c.Query("event_type")),
+			Start:     start,
+			End:       end,
+			Filters:   filters,
+			Regions:   s.analyticsService.readRegions(c.Context(), projectID),
+			Limit:     c.QueryInt("limit", 100),
+		})
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		return sendQueryResult(c, report, fiber.Map{
+			"status": "success",
+			"report": report,
+		})
+	}
+}
+
+// getRollups returns the size of the daily rollups and their latest rebuild
+func (s *App) getRollups(c *fiber.Ctx) error {
+	rollups := s.analyticsService.Rollups()
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"stats":        rollups.Stats(),
+		"last_rebuild": rollups.LastRebuild(),
+		"series":       s.analyticsService.Series().Stats(),
+	})
+}
+
+// rebuildRollups recomputes the daily rollups from the stored events, of the project_id in the
+// request body (every project when omitted) over the days from start_date up to end_date, exclusive
+func (s *App) rebuildRollups(c *fiber.Ctx) error {
+	var request struct {
+		ProjectID string `json:"project_id"`
+		StartDate string `json:"start_date"` // YYYY-MM-DD, unbounded when omitted
+		EndDate   string `json:"end_date"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+
+	start, err := parseOptionalDate(request.StartDate, "start_date")
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	end, err := parseOptionalDate(request.EndDate, "end_date")
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !start.IsZero() && !end.IsZero() && !end.After(start) {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "end_date must be after start_date",
+		})
+	}
+
+	actor := adminActor(c)
+	rebuild := func(ctx context.Context) *RollupRebuildResult {
+		result := s.analyticsService.rebuildRollups(ctx, request.ProjectID, start, end)
+		s.auditLog.Record(actor, "rollups.rebuild", "rollups", map[string]interface{}{
+			"project_id": request.ProjectID,
+			"start_date": request.StartDate,
+			"end_date":   request.EndDate,
+			"days":       result.Days,
+			"events":     result.Events,
+		})
+		return result
+	}
+	if prefersAsync(c) {
+		return s.acceptJob(c, "", JobRollups, func(ctx context.Context) (interface{}, error) {
+			return rebuild(ctx), nil
+		})
+	}
+
+	result := rebuild(context.Background())
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"rebuild": result,
+	})
+}
+
+// parseOptionalDate parses a YYYY-MM-DD date, the zero time when empty
+func parseOptionalDate(value, name string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s: use YYYY-MM-DD", name)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,437 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Dimensions reports can be broken down by from the daily rollups
+const (
+	RollupPage     = "page"
+	RollupDevice   = "device"
+	RollupCountry  = "country"
+	RollupCampaign = "campaign"
+)
+
+// rollupDimensions are the valid dimensions of rollup queries and filters
+var rollupDimensions = map[string]bool{
+	RollupPage:     true,
+	RollupDevice:   true,
+	RollupCountry:  true,
+	RollupCampaign: true,
+}
+
+// rollupDay is the granularity of rollups
+const rollupDay = 24 * time.Hour
+
+// unknownRollupValue stands for events without a page, device, country or campaign
+const unknownRollupValue = "unknown"
+
+// rollupKey identifies a row of a project's day
+type rollupKey struct {
+	region    string // Region whose store holds the events
+	eventType string // Canonical when rolled up; aliases added later are applied when querying
+	page      string
+	device    string
+	country   string
+	campaign  string // utm_campaign property
+}
+
+// dimension returns the key's value of a rollup dimension
+func (k rollupKey) dimension(name string) string {
+	switch name {
+	case RollupPage:
+		return k.page
+	case RollupDevice:
+		return k.device
+	case RollupCountry:
+		return k.country
+	case RollupCampaign:
+		return k.campaign
+	}
+	return ""
+}
+
+// rollupRow counts the events and distinct users of a key on a day, under the user IDs they were
+// sent with; identity merges are applied when querying
+type rollupRow struct {
+	events int64
+	users  map[string]struct{}
+}
+
+// rollupDays holds the rows per project, date (YYYY-MM-DD in UTC) and key
+type rollupDays map[string]map[string]map[rollupKey]*rollupRow
+
+// add counts an event in its project's day
+func (d rollupDays) add(event *AnalyticsEvent) {
+	projectID := projectOrDefault(event.ProjectID)
+	date := event.Timestamp.UTC().Format("2006-01-02")
+	if d[projectID] == nil {
+		d[projectID] = make(map[string]map[rollupKey]*rollupRow)
+	}
+	if d[projectID][date] == nil {
+		d[projectID][date] = make(map[rollupKey]*rollupRow)
+	}
+
+	key := rollupKey{
+		region:    event.Region,
+		eventType: event.EventType,
+		page:      rollupValue(event.Page),
+		device:    rollupValue(event.Properties["device"]),
+		country:   rollupValue(event.Properties["country"]),
+		campaign:  rollupValue(event.Properties["utm_campaign"]),
+	}
+	row, exists := d[projectID][date][key]
+	if !exists {
+		row = &rollupRow{users: make(map[string]struct{})}
+		d[projectID][date][key] = row
+	}
+	row.events++
+	row.users[event.UserID] = struct{}{}
+}
+
+// rollupValue returns a dimension value of a key, unknownRollupValue when missing
+func rollupValue(value interface{}) string {
+	if text, ok := value.(string); ok && text != "" {
+		return text
+	}
+	return unknownRollupValue
+}
+
+// RollupQuery selects the rollups of a project's days broken down by a dimension
+type RollupQuery struct {
+	ProjectID string
+	Dimension string            // page, device, country or campaign
+	EventType string            // All events when empty
+	Start     time.Time         // Days from the day of Start
+	End       time.Time         // up to End, exclusive
+	Filters   map[string]string // Required values of other dimensions
+	Regions   []string          // Regions whose events are counted, nil for every region
+	Limit     int               // Maximum number of groups, 0 for all
+}
+
+// RollupGroup is the number of events and distinct users with one value of a dimension
+type RollupGroup struct {
+	Value       string `json:"value"`
+	Events      int64  `json:"events"`
+	UniqueUsers int64  `json:"unique_users"`
+}
+
+// RollupReport is the breakdown of a project's events by a dimension
+type RollupReport struct {
+	Dimension   string            `json:"dimension"`
+	EventType   string            `json:"event_type,omitempty"`
+	Filters     map[string]string `json:"filters,omitempty"`
+	TimeRange   TimeRange         `json:"time_range"` // Whole days
+	Groups      []RollupGroup     `json:"groups"`     // Most events first
+	TotalGroups int               `json:"total_groups"`
+	TotalEvents int64             `json:"total_events"`
+	UniqueUsers int64             `json:"unique_users"`
+	ComputedAt  time.Time         `json:"computed_at"`
+}
+
+// RollupRebuildResult summarizes a rebuild of the rollups from the stored events
+type RollupRebuildResult struct {
+	ProjectID  string    `json:"project_id,omitempty"` // Every project when empty
+	Start      time.Time `json:"start"`                // Unbounded when zero
+	End        time.Time `json:"end"`
+	Projects   int       `json:"projects"`
+	Days       int       `json:"days"`
+	Rows       int       `json:"rows"`
+	Events     int64     `json:"events"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// RollupStats describes the size of the rollups
+type RollupStats struct {
+	Projects int `json:"projects"`
+	Days     int `json:"days"`
+	Rows     int `json:"rows"`
+}
+
+// DailyRollups counts events per project, day, event type, page, device, country and campaign as
+// they are stored, so the pages, devices, campaigns and daily trend reports do not scan raw
+// events. Rollups outlive the raw events they were computed from when these are purged.
+type DailyRollups struct {
+	days        rollupDays
+	aliases     *AliasService   // Event type aliases applied when querying
+	identities  *IdentityMerges // User ID merges applied when querying
+	lastRebuild *RollupRebuildResult
+	version     int64 // Incremented whenever the rollups or the events they count change
+	mutex       sync.RWMutex
+}
+
+// NewDailyRollups creates empty rollups resolving event types with the given aliases and users
+// with the given identity merges
+func NewDailyRollups(aliases *AliasService, identities *IdentityMerges) *DailyRollups {
+	return &DailyRollups{
+		days:       make(rollupDays),
+		aliases:    aliases,
+		identities: identities,
+	}
+}
+
+// Add counts a stored event, with its event type and properties under their canonical names
+func (r *DailyRollups) Add(event *AnalyticsEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.days.add(event)
+	r.version++
+}
+
+// Version returns a number incremented whenever an event is counted, the rollups are rebuilt or
+// stored events are purged, so results computed from the stored events can be revalidated by
+// comparing versions
+func (r *DailyRollups) Version() int64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.version
+}
+
+// touch increments the version after stored events changed without the rollups changing
+func (r *DailyRollups) touch() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.version++
+}
+
+// scan calls visit with the day and key of every row of the project's days in [start, end) with
+// the event type, filtered dimension values and one of the regions (any region when nil). It
+// returns the number of rows read.
+func (r *DailyRollups) scan(projectID string, regions []string, eventType string, start, end time.Time, filters map[string]string, visit func(day time.Time, key rollupKey, row *rollupRow)) int64 {
+	canonical := r.aliases.Get(projectID).Events
+	var inRegions map[string]bool
+	if regions != nil {
+		inRegions = make(map[string]bool, len(regions))
+		for _, region := range regions {
+			inRegions[region] = true
+		}
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var rows int64
+	for day := start.UTC().Truncate(rollupDay); day.Before(end); day = day.Add(rollupDay) {
+	keys:
+		for key, row := range r.days[projectID][day.Format("2006-01-02")] {
+			rows++
+			if inRegions != nil && !inRegions[key.region] {
+				continue
+			}
+			if eventType != "" {
+				keyType := key.eventType
+				if renamed, exists := canonical[keyType]; exists {
+					keyType = renamed
+				}
+				if keyType != eventType {
+					continue
+				}
+			}
+			for dimension, value := range filters {
+				if key.dimension(dimension) != value {
+					continue keys
+				}
+			}
+			visit(day, key, row)
+		}
+	}
+	return rows
+}
+
+// Query breaks the project's events down by a dimension over whole days
+func (r *DailyRollups) Query(query RollupQuery) (*RollupReport, error) {
+	dimensions := []string{query.Dimension}
+	for dimension := range query.Filters {
+		dimensions = append(dimensions, dimension)
+	}
+	for _, dimension := range dimensions {
+		if !rollupDimensions[dimension] {
+			return nil, fmt.Errorf("invalid dimension: %s. Valid dimensions are: page, device, country, campaign", dimension)
+		}
+	}
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+
+	events := make(map[string]int64)
+	users := make(map[string]map[string]struct{})
+	allUsers := make(map[string]struct{})
+	canonicalUser := r.identities.userResolver(query.ProjectID)
+	report := &RollupReport{
+		Dimension:  query.Dimension,
+		EventType:  query.EventType,
+		Filters:    query.Filters,
+		TimeRange:  TimeRange{Start: query.Start.UTC().Truncate(rollupDay), End: query.End},
+		Groups:     []RollupGroup{},
+		ComputedAt: time.Now(),
+	}
+	r.scan(query.ProjectID, query.Regions, query.EventType, query.Start, query.End, query.Filters, func(day time.Time, key rollupKey, row *rollupRow) {
+		value := key.dimension(query.Dimension)
+		events[value] += row.events
+		if users[value] == nil {
+			users[value] = make(map[string]struct{})
+		}
+		for userID := range row.users {
+			userID = canonicalUser(userID)
+			users[value][userID] = struct{}{}
+			allUsers[userID] = struct{}{}
+		}
+		report.TotalEvents += row.events
+	})
+
+	for value, count := range events {
+		report.Groups = append(report.Groups, RollupGroup{Value: value, Events: count, UniqueUsers: int64(len(users[value]))})
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Events != report.Groups[j].Events {
+			return report.Groups[i].Events > report.Groups[j].Events
+		}
+		return report.Groups[i].Value < report.Groups[j].Value
+	})
+	report.TotalGroups = len(report.Groups)
+	if query.Limit > 0 && len(report.Groups) > query.Limit {
+		report.Groups = report.Groups[:query.Limit]
+	}
+	report.UniqueUsers = int64(len(allUsers))
+	return report, nil
+}
+
+// Trend returns the points of a trend of the regions (every region when nil) over whole days, like
+// trendPoints does from raw events, with the number of events and of rollup rows read
+func (r *DailyRollups) Trend(projectID string, regions []string, eventType string, start, end time.Time, interval time.Duration) ([]TrendPoint, int64, int64) {
+	bucketStart := start.Truncate(interval)
+	var points []TrendPoint
+	var users []map[string]struct{}
+	for t := bucketStart; t.Before(end); t = t.Add(interval) {
+		points = append(points, TrendPoint{Timestamp: t})
+		users = append(users, make(map[string]struct{}))
+	}
+
+	var total int64
+	canonicalUser := r.identities.userResolver(projectID)
+	rows := r.scan(projectID, regions, eventType, start, end, nil, func(day time.Time, key rollupKey, row *rollupRow) {
+		index := int(day.Sub(bucketStart) / interval)
+		if index < 0 || index >= len(points) {
+			return
+		}
+		points[index].Count += row.events
+		total += row.events
+		for userID := range row.users {
+			users[index][canonicalUser(userID)] = struct{}{}
+		}
+	})
+	for i := range points {
+		points[i].UniqueUsers = int64(len(users[i]))
+	}
+	return points, total, rows
+}
+
+// replace swaps the rollups of the project (every project when empty) over the days in
+// [start, end) for the rebuilt ones. Zero bounds are unbounded.
+func (r *DailyRollups) replace(projectID string, start, end time.Time, rebuilt rollupDays, result *RollupRebuildResult) {
+	inRange := func(date string) bool {
+		return (start.IsZero() || date >= start.Format("2006-01-02")) && (end.IsZero() || date < end.Format("2006-01-02"))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for project, dates := range r.days {
+		if projectID != "" && project != projectID {
+			continue
+		}
+		for date := range dates {
+			if inRange(date) {
+				delete(dates, date)
+			}
+		}
+	}
+	for project, dates := range rebuilt {
+		if r.days[project] == nil {
+			r.days[project] = make(map[string]map[rollupKey]*rollupRow)
+		}
+		for date, rows := range dates {
+			r.days[project][date] = rows
+			result.Days++
+			result.Rows += len(rows)
+		}
+	}
+	result.Projects = len(rebuilt)
+	result.DurationMs = time.Since(result.StartedAt).Milliseconds()
+	r.lastRebuild = result
+	r.version++
+}
+
+// Stats returns the number of projects, days and rows of the rollups
+func (r *DailyRollups) Stats() RollupStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var stats RollupStats
+	for _, dates := range r.days {
+		if len(dates) > 0 {
+			stats.Projects++
+		}
+		stats.Days += len(dates)
+		for _, rows := range dates {
+			stats.Rows += len(rows)
+		}
+	}
+	return stats
+}
+
+// LastRebuild returns the latest rebuild, nil before the first one
+func (r *DailyRollups) LastRebuild() *RollupRebuildResult {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.lastRebuild
+}
+
+// RebuildRollups recomputes the daily rollups of a project (every project when empty) over the
+// days from the day of start up to the day of end, exclusive, from the stored events, e.g. after
+// property aliases changed. Zero bounds are unbounded. Days whose events were purged lose their
+// counts, and events stored without their properties by the storage sampler lose their device,
+// country and campaign. Ingestion waits for the rebuild, so no event is missed or counted twice.
+func (s *AnalyticsService) RebuildRollups(projectID string, start, end time.Time) *RollupRebuildResult {
+	return s.rebuildRollups(context.Background(), projectID, start, end)
+}
+
+// rebuildRollups rebuilds the rollups, reporting the scanned events to the job running with the context
+func (s *AnalyticsService) rebuildRollups(ctx context.Context, projectID string, start, end time.Time) *RollupRebuildResult {
+	if !start.IsZero() {
+		start = start.UTC().Truncate(rollupDay)
+	}
+	if !end.IsZero() {
+		end = end.UTC().Truncate(rollupDay)
+	}
+	result := &RollupRebuildResult{ProjectID: projectID, Start: start, End: end, StartedAt: time.Now()}
+	resolve := s.aliases.Resolver()
+	rebuilt := make(rollupDays)
+
+	s.mutex.RLock()
+	s.scanEventsReporting(ctx, nil, func(stored *AnalyticsEvent) {
+		if projectID != "" && projectOrDefault(stored.ProjectID) != projectID {
+			return
+		}
+		day := stored.Timestamp.UTC().Truncate(rollupDay)
+		if (!start.IsZero() && day.Before(start)) || (!end.IsZero() && !day.Before(end)) {
+			return
+		}
+		rebuilt.add(resolve(stored))
+		result.Events++
+	})
+	s.rollups.replace(projectID, start, end, rebuilt, result)
+	s.mutex.RUnlock()
+
+	for project := range rebuilt {
+		s.queryCache.ExpireProject(project)
+	}
+	log.Printf("Rebuilt rollups of %d days from %d events", result.Days, result.Events)
+	return result
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RuntimeSetting describes a value that can be inspected and adjusted without a restart
+type RuntimeSetting struct {
+	Name        string
+	Description string
+	Get         func() interface{}
+	Set         func(value interface{}) error
+}
+
+// RuntimeSettingValue represents the current state of a runtime setting
+type RuntimeSettingValue struct {
+	Name        string      `json:"name"`
+	Value       interface{} `json:"value"`
+	Description string      `json:"description"`
+	Version     int64       `json:"version"` // Incremented on every update, exposed as the ETag
+}
+
+// RuntimeSettings is a registry of tunable settings contributed by the services
+type RuntimeSettings struct {
+	settings map[string]*RuntimeSetting
+	versions map[string]int64
+	mutex    sync.RWMutex
+}
+
+// NewRuntimeSettings creates an empty runtime settings registry
+func NewRuntimeSettings() *RuntimeSettings {
+	return &RuntimeSettings{
+		settings: make(map[string]*RuntimeSetting),
+		versions: make(map[string]int64),
+	}
+}
+
+// Register adds a setting to the registry, replacing any setting with the same name
+func (r *RuntimeSettings) Register(setting *RuntimeSetting) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.settings[setting.Name] = setting
+	r.versions[setting.Name]++
+}
+
+// List returns all settings with their current values, sorted by name
+func (r *RuntimeSettings) List() []RuntimeSettingValue {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	values := make([]RuntimeSettingValue, 0, len(r.settings))
+	for _, setting := range r.settings {
+		values = append(values, RuntimeSettingValue{
+			Name:        setting.Name,
+			Value:       setting.Get(),
+			Description: setting.Description,
+			Version:     r.versions[setting.Name],
+		})
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Name < values[j].Name
+	})
+
+	return values
+}
+
+// Get returns a setting with its current value
+func (r *RuntimeSettings) Get(name string) (RuntimeSettingValue, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	setting, exists := r.settings[name]
+	if !exists {
+		return RuntimeSettingValue{}, fmt.Errorf("unknown runtime setting: %s", name)
+	}
+
+	return RuntimeSettingValue{
+		Name:        setting.Name,
+		Value:       setting.Get(),
+		Description: setting.Description,
+		Version:     r.versions[name],
+	}, nil
+}
+
+// Update changes a setting and returns its previous value and new state. The update is rejected
+// with a VersionConflictError unless expectedVersion is the setting's current version.
+func (r *RuntimeSettings) Update(name string, value interface{}, expectedVersion int64) (interface{}, RuntimeSettingValue, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	setting, exists := r.settings[name]
+	if !exists {
+		return nil, RuntimeSettingValue{}, fmt.Errorf("unknown runtime setting: %s", name)
+	}
+	if err := checkVersion("runtime setting", name, r.versions[name], expectedVersion); err != nil {
+		return nil, RuntimeSettingValue{}, err
+	}
+
+	previous := setting.Get()
+	if err := setting.Set(value); err != nil {
+		return nil, RuntimeSettingValue{}, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	r.versions[name]++
+
+	return previous, RuntimeSettingValue{
+		Name:        setting.Name,
+		Value:       setting.Get(),
+		Description: setting.Description,
+		Version:     r.versions[name],
+	}, nil
+}
+
+// runtimeInt converts a JSON-decoded value into an int
+func runtimeInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case float64:
+		if v != float64(int(v)) {
+			return 0, fmt.Errorf("expected an integer, got %v", v)
+		}
+		return int(v), nil
+	case int:
+		return v, nil
+	default:
+		return 0, fmt.Errorf("expected an integer, got %T", value)
+	}
+}
+
+// runtimeDuration converts a duration string (e.g. "30s") or milliseconds into a duration
+func runtimeDuration(value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case string:
+		return time.ParseDuration(v)
+	case float64:
+		return time.Duration(v * float64(time.Millisecond)), nil
+	default:
+		return 0, fmt.Errorf("expected a duration string or milliseconds, got %T", value)
+	}
+}
+
+// runtimeString converts a JSON-decoded value into a string
+func runtimeString(value interface{}) (string, error) {
+	str, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a string, got %T", value)
+	}
+	return str, nil
+}
+
+// runtimeRates converts a JSON object or an "key:rate,..." string into rates by key
+func runtimeRates(value interface{}) (map[string]float64, error) {
+	switch v := value.(type) {
+	case string:
+		return parseRates(v)
+	case map[string]interface{}:
+		rates := make(map[string]float64, len(v))
+		for key, raw := range v {
+			rate, ok := raw.(float64)
+			if !ok {
+				return nil, fmt.Errorf("expected a number for %s, got %T", key, raw)
+			}
+			rates[key] = rate
+		}
+		return rates, nil
+	default:
+		return nil, fmt.Errorf("expected an object of rates, got %T", value)
+	}
+}
+
+// workerPoolSettings returns the size and queue capacity settings for a worker pool
+func workerPoolSettings(prefix string, pool *WorkerPool) []*RuntimeSetting {
+	return []*RuntimeSetting{
+		{
+			Name:        prefix + ".worker_pool_size",
+			Description: "Number of workers in the " + prefix + " pool",
+			Get:         func() interface{} { return pool.Size() },
+			Set: func(value interface{}) error {
+				size, err := runtimeInt(value)
+				if err != nil {
+					return err
+				}
+				return pool.Resize(size)
+			},
+		},
+		{
+			Name:        prefix + ".queue_capacity",
+			Description: "Maximum queued tasks in the " + prefix + " pool",
+			Get:         func() interface{} { return pool.Capacity() },
+			Set: func(value interface{}) error {
+				capacity, err := runtimeInt(value)
+				if err != nil {
+					return err
+				}
+				return pool.SetCapacity(capacity)
+			},
+		},
+	}
+}
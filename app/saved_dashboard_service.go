@@ -0,0 +1,374 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scopes that can be granted to public dashboard tokens
+const (
+	PublicScopeSnapshot = "snapshot"
+	PublicScopeStream   = "stream"
+)
+
+// SavedDashboard is a named set of widgets that can be embedded through public tokens
+type SavedDashboard struct {
+	ID           string            `json:"id"`
+	ProjectID    string            `json:"project_id"`
+	Name         string            `json:"name"`
+	Description  string            `json:"description,omitempty"`
+	Widgets      []DashboardWidget `json:"widgets"`
+	Version      int64             `json:"version"` // Incremented on every update, exposed as the ETag
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	tokenVersion int               // Incremented to revoke every public token issued so far
+}
+
+// DashboardWidget shows either the result of a saved query or a live dashboard metric
+type DashboardWidget struct {
+	Title   string `json:"title"`
+	QueryID string `json:"query_id,omitempty"`
+	Metric  string `json:"metric,omitempty"`
+}
+
+// Metrics returns the live metrics shown by the dashboard
+func (d *SavedDashboard) Metrics() []string {
+	var metrics []string
+	for _, widget := range d.Widgets {
+		if widget.Metric != "" {
+			metrics = append(metrics, widget.Metric)
+		}
+	}
+	return metrics
+}
+
+// SavedDashboardService stores dashboards and issues public tokens for embedding them
+type SavedDashboardService struct {
+	dashboards   map[string]*SavedDashboard
+	savedQueries *SavedQueryService
+	signer       *TokenSigner
+	clock        Clock
+	mutex        sync.RWMutex
+}
+
+// NewSavedDashboardService creates a new saved dashboard service
+func NewSavedDashboardService(savedQueries *SavedQueryService, signer *TokenSigner) *SavedDashboardService {
+	return &SavedDashboardService{
+		dashboards:   make(map[string]*SavedDashboard),
+		savedQueries: savedQueries,
+		signer:       signer,
+		clock:        SystemClock(),
+	}
+}
+
+// SetClock replaces the clock dashboard timestamps and public token expiry are taken from
+func (s *SavedDashboardService) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// CreateDashboard saves a dashboard in the context's project
+func (s *SavedDashboardService) CreateDashboard(ctx context.Context, name, description string, widgets []DashboardWidget) (*SavedDashboard, error) {
+	dashboard, _, err := s.CreateDashboardWithID(ctx, "", name, description, widgets)
+	return dashboard, err
+}
+
+// CreateDashboardWithID saves a dashboard under a client-supplied ID, or a generated one when empty.
+// Retrying with the same definition returns the existing dashboard, reporting it was not created; a
+// different definition is rejected with a ResourceExistsError.
+func (s *SavedDashboardService) CreateDashboardWithID(ctx context.Context, id, name, description string, widgets []DashboardWidget) (*SavedDashboard, bool, error) {
+	if err := s.validateDashboard(ctx, name, widgets); err != nil {
+		return nil, false, err
+	}
+	if id != "" {
+		if err := validateResourceID(id); err != nil {
+			return nil, false, err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	projectID := ProjectFromContext(ctx)
+	if existing, exists := s.dashboards[id]; exists {
+		candidate := SavedDashboard{Name: name, Description: description, Widgets: widgets}
+		if existing.ProjectID != projectID || existing.Fingerprint() != candidate.Fingerprint() {
+			return nil, false, &ResourceExistsError{Resource: ResourceDashboard, ID: id}
+		}
+		copied := *existing
+		return &copied, false, nil
+	}
+
+	dashboard := s.insert(projectID, id, name, description, widgets)
+	copied := *dashboard
+	return &copied, true, nil
+}
+
+// UpsertDashboard creates or replaces a dashboard of the context's project, matched by ID when one is
+// given and by name otherwise. Replacing a dashboard with an identical definition leaves its version unchanged.
+func (s *SavedDashboardService) UpsertDashboard(ctx context.Context, id, name, description string, widgets []DashboardWidget) (*SavedDashboard, bool, error) {
+	if err := s.validateDashboard(ctx, name, widgets); err != nil {
+		return nil, false, err
+	}
+	if id != "" {
+		if err := validateResourceID(id); err != nil {
+			return nil, false, err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	projectID := ProjectFromContext(ctx)
+	var existing *SavedDashboard
+	if id != "" {
+		existing = s.dashboards[id]
+		if existing != nil && existing.ProjectID != projectID {
+			return nil, false, &ResourceExistsError{Resource: ResourceDashboard, ID: id}
+		}
+	} else {
+		// Several dashboards may share a name; the oldest one is replaced
+		for _, dashboard := range s.dashboards {
+			if dashboard.ProjectID == projectID && dashboard.Name == name && (existing == nil || dashboard.CreatedAt.Before(existing.CreatedAt)) {
+				existing = dashboard
+			}
+		}
+	}
+
+	if existing == nil {
+		dashboard := s.insert(projectID, id, name, description, widgets)
+		copied := *dashboard
+		return &copied, true, nil
+	}
+
+	candidate := SavedDashboard{Name: name, Description: description, Widgets: widgets}
+	if existing.Fingerprint() != candidate.Fingerprint() {
+		existing.Name = name
+		existing.Description = description
+		existing.Widgets = widgets
+		existing.Version++
+		existing.UpdatedAt = s.clock.Now()
+	}
+
+	copied := *existing
+	return &copied, false, nil
+}
+
+// insert stores a new dashboard, generating its ID when empty. Callers must hold the lock.
+func (s *SavedDashboardService) insert(projectID, id, name, description string, widgets []DashboardWidget) *SavedDashboard {
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	now := s.clock.Now()
+	dashboard := &SavedDashboard{
+		ID:          id,
+		ProjectID:   projectID,
+		Name:        name,
+		Description: description,
+		Widgets:     widgets,
+		Version:     1,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	s.dashboards[dashboard.ID] = dashboard
+
+	log.Printf("Saved dashboard: %s with %d widgets for project %s", dashboard.ID, len(widgets), dashboard.ProjectID)
+	return dashboard
+}
+
+// Fingerprint identifies the dashboard's definition, ignoring its ID, version and timestamps
+func (d *SavedDashboard) Fingerprint() string {
+	return fingerprint(struct {
+		Name        string            `json:"name"`
+		Description string            `json:"description"`
+		Widgets     []DashboardWidget `json:"widgets"`
+	}{d.Name, d.Description, d.Widgets})
+}
+
+// GetDashboard returns a saved dashboard of the context's project
+func (s *SavedDashboardService) GetDashboard(ctx context.Context, id string) (*SavedDashboard, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	dashboard, err := s.lookup(ProjectFromContext(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *dashboard
+	return &copied, nil
+}
+
+// UpdateDashboard replaces the name, description and widgets of a saved dashboard. The update is
+// rejected with a VersionConflictError unless expectedVersion is the dashboard's current version.
+func (s *SavedDashboardService) UpdateDashboard(ctx context.Context, id, name, description string, widgets []DashboardWidget, expectedVersion int64) (*SavedDashboard, error) {
+	if err := s.validateDashboard(ctx, name, widgets); err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dashboard, err := s.lookup(ProjectFromContext(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion("dashboard", id, dashboard.Version, expectedVersion); err != nil {
+		return nil, err
+	}
+
+	dashboard.Name = name
+	dashboard.Description = description
+	dashboard.Widgets = widgets
+	dashboard.Version++
+	dashboard.UpdatedAt = s.clock.Now()
+
+	copied := *dashboard
+	return &copied, nil
+}
+
+// validateDashboard checks that a dashboard is named, its widgets only reference saved queries of
+// the context's project and its derived metrics are well-formed
+func (s *SavedDashboardService) validateDashboard(ctx context.Context, name string, widgets []DashboardWidget) error {
+	if name == "" {
+		return fmt.Errorf("dashboard name is required")
+	}
+	if len(widgets) == 0 {
+		return fmt.Errorf("dashboard must have at least one widget")
+	}
+
+	for i, widget := range widgets {
+		if (widget.QueryID == "") == (widget.Metric == "") {
+			return fmt.Errorf("widget %d must reference either a query_id or a metric", i+1)
+		}
+		if widget.QueryID != "" {
+			if _, err := s.savedQueries.GetQuery(ctx, widget.QueryID); err != nil {
+				return fmt.Errorf("widget %d: %w", i+1, err)
+			}
+		}
+		if _, _, err := parseDerivedMetric(widget.Metric); err != nil {
+			return fmt.Errorf("widget %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// ListDashboards returns the saved dashboards of the context's project, oldest first
+func (s *SavedDashboardService) ListDashboards(ctx context.Context) []*SavedDashboard {
+	projectID := ProjectFromContext(ctx)
+
+	s.mutex.RLock()
+	dashboards := make([]*SavedDashboard, 0)
+	for _, dashboard := range s.dashboards {
+		if dashboard.ProjectID == projectID {
+			copied := *dashboard
+			dashboards = append(dashboards, &copied)
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(dashboards, func(i, j int) bool {
+		return dashboards[i].CreatedAt.Before(dashboards[j].CreatedAt)
+	})
+	return dashboards
+}
+
+// DeleteDashboard removes a saved dashboard, invalidating its public tokens
+func (s *SavedDashboardService) DeleteDashboard(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.lookup(ProjectFromContext(ctx), id); err != nil {
+		return err
+	}
+
+	delete(s.dashboards, id)
+	return nil
+}
+
+// CreatePublicToken issues a token granting read-only access to the dashboard within the scopes until it expires
+func (s *SavedDashboardService) CreatePublicToken(ctx context.Context, id string, scopes []string, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 {
+		return "", time.Time{}, fmt.Errorf("public token lifetime must be positive")
+	}
+	if len(scopes) == 0 {
+		scopes = []string{PublicScopeSnapshot, PublicScopeStream}
+	}
+	for _, scope := range scopes {
+		if scope != PublicScopeSnapshot && scope != PublicScopeStream {
+			return "", time.Time{}, fmt.Errorf("invalid scope: %s. Valid scopes are: snapshot, stream", scope)
+		}
+	}
+
+	dashboard, err := s.GetDashboard(ctx, id)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := s.clock.Now().Add(ttl)
+	token, err := s.signer.Sign(TokenClaims{
+		Kind:      TokenKindPublicDashboard,
+		Subject:   dashboard.ID,
+		ProjectID: dashboard.ProjectID,
+		Version:   dashboard.tokenVersion,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// RevokePublicTokens invalidates every public token issued for a dashboard
+func (s *SavedDashboardService) RevokePublicTokens(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dashboard, err := s.lookup(ProjectFromContext(ctx), id)
+	if err != nil {
+		return err
+	}
+
+	dashboard.tokenVersion++
+	dashboard.UpdatedAt = s.clock.Now()
+	return nil
+}
+
+// ResolvePublicToken verifies a public token for the scope and returns the dashboard it grants access to
+func (s *SavedDashboardService) ResolvePublicToken(token, scope string) (*SavedDashboard, error) {
+	claims, err := s.signer.Verify(token, TokenKindPublicDashboard)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.HasScope(scope) {
+		return nil, fmt.Errorf("token does not grant %s access", scope)
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	dashboard, err := s.lookup(claims.ProjectID, claims.Subject)
+	if err != nil || dashboard.tokenVersion != claims.Version {
+		return nil, fmt.Errorf("token has been revoked")
+	}
+
+	copied := *dashboard
+	return &copied, nil
+}
+
+// lookup returns a saved dashboard if it belongs to the project. Callers must hold the lock.
+func (s *SavedDashboardService) lookup(projectID, id string) (*SavedDashboard, error) {
+	dashboard, exists := s.dashboards[id]
+	if !exists || dashboard.ProjectID != projectID {
+		return nil, fmt.Errorf("dashboard not found: %s", id)
+	}
+	return dashboard, nil
+}
@@ -0,0 +1,401 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Saved query types
+const (
+	SavedQueryTrend   = "trend"
+	SavedQuerySegment = "segment"
+	SavedQueryUsage   = "usage"
+	SavedQueryFunnel  = "funnel"
+)
+
+// SavedQuery is a named query definition that can be re-run or shared
+type SavedQuery struct {
+	ID           string                 `json:"id"`
+	ProjectID    string                 `json:"project_id"`
+	Name         string                 `json:"name"`
+	Description  string                 `json:"description,omitempty"`
+	Type         string                 `json:"type"`
+	Parameters   map[string]interface{} `json:"parameters"`
+	Version      int64                  `json:"version"` // Incremented on every update, exposed as the ETag
+	CreatedAt    time.Time              `json:"created_at"`
+	UpdatedAt    time.Time              `json:"updated_at"`
+	shareVersion int                    // Incremented to revoke every share token issued so far
+}
+
+// QueryExecutor runs a saved query of a given type. The context carries the query's project.
+type QueryExecutor func(ctx context.Context, parameters map[string]interface{}) (interface{}, error)
+
+// SavedQueryService stores query definitions and issues signed share tokens for them
+type SavedQueryService struct {
+	queries   map[string]*SavedQuery
+	executors map[string]QueryExecutor
+	signer    *TokenSigner
+	clock     Clock
+	mutex     sync.RWMutex
+}
+
+// NewSavedQueryService creates a new saved query service signing share tokens with the signer
+func NewSavedQueryService(signer *TokenSigner) *SavedQueryService {
+	return &SavedQueryService{
+		queries:   make(map[string]*SavedQuery),
+		executors: make(map[string]QueryExecutor),
+		signer:    signer,
+		clock:     SystemClock(),
+	}
+}
+
+// SetClock replaces the clock query timestamps and share token expiry are taken from
+func (s *SavedQueryService) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// RegisterExecutor registers the executor for a query type
+func (s *SavedQueryService) RegisterExecutor(queryType string, executor QueryExecutor) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.executors[queryType] = executor
+}
+
+// CreateQuery saves a query definition in the context's project
+func (s *SavedQueryService) CreateQuery(ctx context.Context, name, description, queryType string, parameters map[string]interface{}) (*SavedQuery, error) {
+	query, _, err := s.CreateQueryWithID(ctx, "", name, description, queryType, parameters)
+	return query, err
+}
+
+// CreateQueryWithID saves a query under a client-supplied ID, or a generated one when empty. Retrying
+// with the same definition returns the existing query, reporting it was not created; a different
+// definition is rejected with a ResourceExistsError.
+func (s *SavedQueryService) CreateQueryWithID(ctx context.Context, id, name, description, queryType string, parameters map[string]interface{}) (*SavedQuery, bool, error) {
+	if id != "" {
+		if err := validateResourceID(id); err != nil {
+			return nil, false, err
+		}
+	}
+	if parameters == nil {
+		parameters = make(map[string]interface{})
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.validateQuery(name, queryType); err != nil {
+		return nil, false, err
+	}
+
+	projectID := ProjectFromContext(ctx)
+	if existing, exists := s.queries[id]; exists {
+		candidate := SavedQuery{Name: name, Description: description, Type: queryType, Parameters: parameters}
+		if existing.ProjectID != projectID || existing.Fingerprint() != candidate.Fingerprint() {
+			return nil, false, &ResourceExistsError{Resource: ResourceQuery, ID: id}
+		}
+		copied := *existing
+		return &copied, false, nil
+	}
+
+	query := s.insert(projectID, id, name, description, queryType, parameters)
+	copied := *query
+	return &copied, true, nil
+}
+
+// UpsertQuery creates or replaces a saved query of the context's project, matched by ID when one is
+// given and by name otherwise. Replacing a query with an identical definition leaves its version unchanged.
+func (s *SavedQueryService) UpsertQuery(ctx context.Context, id, name, description, queryType string, parameters map[string]interface{}) (*SavedQuery, bool, error) {
+	if id != "" {
+		if err := validateResourceID(id); err != nil {
+			return nil, false, err
+		}
+	}
+	if parameters == nil {
+		parameters = make(map[string]interface{})
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.validateQuery(name, queryType); err != nil {
+		return nil, false, err
+	}
+
+	projectID := ProjectFromContext(ctx)
+	var existing *SavedQuery
+	if id != "" {
+		existing = s.queries[id]
+		if existing != nil && existing.ProjectID != projectID {
+			return nil, false, &ResourceExistsError{Resource: ResourceQuery, ID: id}
+		}
+	} else {
+		// Several queries may share a name; the oldest one is replaced
+		for _, query := range s.queries {
+			if query.ProjectID == projectID && query.Name == name && (existing == nil || query.CreatedAt.Before(existing.CreatedAt)) {
+				existing = query
+			}
+		}
+	}
+
+	if existing == nil {
+		query := s.insert(projectID, id, name, description, queryType, parameters)
+		copied := *query
+		return &copied, true, nil
+	}
+
+	candidate := SavedQuery{Name: name, Description: description, Type: queryType, Parameters: parameters}
+	if existing.Fingerprint() != candidate.Fingerprint() {
+		existing.Name = name
+		existing.Description = description
+		existing.Type = queryType
+		existing.Parameters = parameters
+		existing.Version++
+		existing.UpdatedAt = s.clock.Now()
+	}
+
+	copied := *existing
+	return &copied, false, nil
+}
+
+// insert stores a new saved query, generating its ID when empty. Callers must hold the lock.
+func (s *SavedQueryService) insert(projectID, id, name, description, queryType string, parameters map[string]interface{}) *SavedQuery {
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	now := s.clock.Now()
+	query := &SavedQuery{
+		ID:          id,
+		ProjectID:   projectID,
+		Name:        name,
+		Description: description,
+		Type:        queryType,
+		Parameters:  parameters,
+		Version:     1,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	s.queries[query.ID] = query
+
+	log.Printf("Saved query: %s (%s) for project %s", query.ID, query.Type, query.ProjectID)
+	return query
+}
+
+// Fingerprint identifies the query's definition, ignoring its ID, version and timestamps
+func (q *SavedQuery) Fingerprint() string {
+	return fingerprint(struct {
+		Name        string                 `json:"name"`
+		Description string                 `json:"description"`
+		Type        string                 `json:"type"`
+		Parameters  map[string]interface{} `json:"parameters"`
+	}{q.Name, q.Description, q.Type, q.Parameters})
+}
+
+// GetQuery returns a saved query of the context's project
+func (s *SavedQueryService) GetQuery(ctx context.Context, id string) (*SavedQuery, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	query, err := s.lookup(ProjectFromContext(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *query
+	return &copied, nil
+}
+
+// UpdateQuery replaces the definition of a saved query of the context's project. The update is rejected
+// with a VersionConflictError unless expectedVersion is the query's current version.
+func (s *SavedQueryService) UpdateQuery(ctx context.Context, id, name, description, queryType string, parameters map[string]interface{}, expectedVersion int64) (*SavedQuery, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.validateQuery(name, queryType); err != nil {
+		return nil, err
+	}
+	query, err := s.lookup(ProjectFromContext(ctx), id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVersion("query", id, query.Version, expectedVersion); err != nil {
+		return nil, err
+	}
+	if parameters == nil {
+		parameters = make(map[string]interface{})
+	}
+
+	query.Name = name
+	query.Description = description
+	query.Type = queryType
+	query.Parameters = parameters
+	query.Version++
+	query.UpdatedAt = s.clock.Now()
+
+	copied := *query
+	return &copied, nil
+}
+
+// ListQueries returns the saved queries of the context's project, oldest first
+func (s *SavedQueryService) ListQueries(ctx context.Context) []*SavedQuery {
+	projectID := ProjectFromContext(ctx)
+
+	s.mutex.RLock()
+	queries := make([]*SavedQuery, 0)
+	for _, query := range s.queries {
+		if query.ProjectID == projectID {
+			copied := *query
+			queries = append(queries, &copied)
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].CreatedAt.Before(queries[j].CreatedAt)
+	})
+	return queries
+}
+
+// DeleteQuery removes a saved query, invalidating its share tokens
+func (s *SavedQueryService) DeleteQuery(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := s.lookup(ProjectFromContext(ctx), id); err != nil {
+		return err
+	}
+
+	delete(s.queries, id)
+	return nil
+}
+
+// RunQuery executes a saved query of the context's project
+func (s *SavedQueryService) RunQuery(ctx context.Context, id string) (interface{}, error) {
+	query, err := s.GetQuery(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.execute(ctx, query)
+}
+
+// CreateShareToken issues a signed token granting read-only execution of a saved query until it expires
+func (s *SavedQueryService) CreateShareToken(ctx context.Context, id string, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 {
+		return "", time.Time{}, fmt.Errorf("share token lifetime must be positive")
+	}
+
+	s.mutex.RLock()
+	query, err := s.lookup(ProjectFromContext(ctx), id)
+	var version int
+	if err == nil {
+		version = query.shareVersion
+	}
+	s.mutex.RUnlock()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := s.clock.Now().Add(ttl)
+	token, err := s.signer.Sign(TokenClaims{
+		Kind:      TokenKindQueryShare,
+		Subject:   id,
+		ProjectID: ProjectFromContext(ctx),
+		Version:   version,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// RevokeShareTokens invalidates every share token issued for a saved query
+func (s *SavedQueryService) RevokeShareTokens(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	query, err := s.lookup(ProjectFromContext(ctx), id)
+	if err != nil {
+		return err
+	}
+
+	query.shareVersion++
+	query.UpdatedAt = s.clock.Now()
+	return nil
+}
+
+// ResolveShareToken verifies a share token and returns the saved query it grants access to
+func (s *SavedQueryService) ResolveShareToken(token string) (*SavedQuery, error) {
+	claims, err := s.signer.Verify(token, TokenKindQueryShare)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	query, err := s.lookup(claims.ProjectID, claims.Subject)
+	if err != nil || query.shareVersion != claims.Version {
+		return nil, fmt.Errorf("share token has been revoked")
+	}
+
+	copied := *query
+	return &copied, nil
+}
+
+// execute runs a query with the executor registered for its type
+func (s *SavedQueryService) execute(ctx context.Context, query *SavedQuery) (interface{}, error) {
+	s.mutex.RLock()
+	executor, exists := s.executors[query.Type]
+	s.mutex.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("no executor for query type: %s", query.Type)
+	}
+
+	return executor(ctx, query.Parameters)
+}
+
+// lookup returns a saved query if it belongs to the project. Callers must hold the lock.
+func (s *SavedQueryService) lookup(projectID, id string) (*SavedQuery, error) {
+	query, exists := s.queries[id]
+	if !exists || query.ProjectID != projectID {
+		return nil, fmt.Errorf("saved query not found: %s", id)
+	}
+	return query, nil
+}
+
+// checkQuery validates the name and type of a query definition without saving it
+func (s *SavedQueryService) checkQuery(name, queryType string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.validateQuery(name, queryType)
+}
+
+// validateQuery checks the name and type of a query definition. Callers must hold the lock.
+func (s *SavedQueryService) validateQuery(name, queryType string) error {
+	if name == "" {
+		return fmt.Errorf("query name is required")
+	}
+	if _, exists := s.executors[queryType]; !exists {
+		return fmt.Errorf("invalid query type: %s. Valid types are: %s", queryType, strings.Join(s.queryTypes(), ", "))
+	}
+	return nil
+}
+
+// queryTypes returns the registered query types, sorted. Callers must hold the lock.
+func (s *SavedQueryService) queryTypes() []string {
+	types := make([]string, 0, len(s.executors))
+	for queryType := range s.executors {
+		types = append(types, queryType)
+	}
+	sort.Strings(types)
+	return types
+}
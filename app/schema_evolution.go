@@ -0,0 +1,215 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of schema changes
+const (
+	SchemaChangeRequiredAdded   = "required_field_added"   // Events without the field are now rejected
+	SchemaChangeRequiredRemoved = "required_field_removed" // Consumers can no longer rely on the field
+	SchemaChangeTypeChanged     = "field_type_changed"     // Events sending the old type are now rejected
+	SchemaChangeTypeAdded       = "field_type_added"
+	SchemaChangeTypeRemoved     = "field_type_removed"
+)
+
+// SchemaChange is a difference between two versions of an event schema
+type SchemaChange struct {
+	Change   string `json:"change"`
+	Field    string `json:"field"`
+	Breaking bool   `json:"breaking"`
+	Previous string `json:"previous,omitempty"` // Previous field type
+	Current  string `json:"current,omitempty"`  // New field type
+	Message  string `json:"message"`
+}
+
+// SchemaVersionStatus describes an active version of an event schema and how events validated against it
+type SchemaVersionStatus struct {
+	Version        int64             `json:"version"`
+	Current        bool              `json:"current"`
+	RequiredFields []string          `json:"required_fields"`
+	FieldTypes     map[string]string `json:"field_types"`
+	ActiveUntil    *time.Time        `json:"active_until,omitempty"` // End of the grace period of a previous version
+	// Events accepted and rejected by this version. A previous version only checks events
+	// rejected by the current one, so its accepted events still follow the old schema.
+	Validated int64 `json:"validated"`
+	Failed    int64 `json:"failed"`
+}
+
+// schemaEvolution is the last change of an event schema and the previous version kept during its grace period
+type schemaEvolution struct {
+	changes         []SchemaChange
+	previous        *EventSchema
+	previousVersion int64
+	graceEnds       time.Time
+}
+
+// schemaVersionCounts counts the events validated against a schema version
+type schemaVersionCounts struct {
+	validated int64
+	failed    int64
+}
+
+// diffSchemas returns the changes from the previous to the next version of a schema, sorted by field.
+// Removed required fields, new required fields and changed field types are breaking.
+func diffSchemas(previous, next *EventSchema) []SchemaChange {
+	changes := make([]SchemaChange, 0)
+
+	previousRequired := make(map[string]bool, len(previous.RequiredFields))
+	for _, field := range previous.RequiredFields {
+		previousRequired[field] = true
+	}
+	nextRequired := make(map[string]bool, len(next.RequiredFields))
+	for _, field := range next.RequiredFields {
+		nextRequired[field] = true
+		if !previousRequired[field] {
+			changes = append(changes, SchemaChange{Change: SchemaChangeRequiredAdded, Field: field, Breaking: true,
+				Message: fmt.Sprintf("field '%s' is now required; events without it will be rejected", field)})
+		}
+	}
+	for field := range previousRequired {
+		if !nextRequired[field] {
+			changes = append(changes, SchemaChange{Change: SchemaChangeRequiredRemoved, Field: field, Breaking: true,
+				Message: fmt.Sprintf("field '%s' is no longer required; reports relying on it may miss values", field)})
+		}
+	}
+
+	for field, fieldType := range next.FieldTypes {
+		previousType, exists := previous.FieldTypes[field]
+		switch {
+		case !exists:
+			changes = append(changes, SchemaChange{Change: SchemaChangeTypeAdded, Field: field, Current: fieldType,
+				Message: fmt.Sprintf("field '%s' must be a %s when sent", field, fieldType)})
+		case previousType != fieldType:
+			changes = append(changes, SchemaChange{Change: SchemaChangeTypeChanged, Field: field, Breaking: true, Previous: previousType, Current: fieldType,
+				Message: fmt.Sprintf("field '%s' changed from %s to %s; events sending a %s will be rejected", field, previousType, fieldType, previousType)})
+		}
+	}
+	for field, fieldType := range previous.FieldTypes {
+		if _, exists := next.FieldTypes[field]; !exists {
+			changes = append(changes, SchemaChange{Change: SchemaChangeTypeRemoved, Field: field, Previous: fieldType,
+				Message: fmt.Sprintf("field '%s' is no longer type-checked", field)})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Field != changes[j].Field {
+			return changes[i].Field < changes[j].Field
+		}
+		return changes[i].Change < changes[j].Change
+	})
+	return changes
+}
+
+// hasBreakingChange reports whether any of the changes is breaking
+func hasBreakingChange(changes []SchemaChange) bool {
+	for _, change := range changes {
+		if change.Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+// GracePeriod returns how long the previous version of a schema stays active after a breaking update
+func (s *SchemaValidator) GracePeriod() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.gracePeriod
+}
+
+// SetGracePeriod sets how long the previous version of a schema stays active after a breaking
+// update. Zero makes breaking updates take effect immediately. Running grace periods are kept.
+func (s *SchemaValidator) SetGracePeriod(gracePeriod time.Duration) error {
+	if gracePeriod < 0 {
+		return fmt.Errorf("grace period must not be negative, got %s", gracePeriod)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gracePeriod = gracePeriod
+	return nil
+}
+
+// DiffSchema returns the changes replacing an event type's schema with the given fields would make
+func (s *SchemaValidator) DiffSchema(eventType string, requiredFields []string, fieldTypes map[string]string) []SchemaChange {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	existing, exists := s.schemas[eventType]
+	if !exists {
+		return []SchemaChange{}
+	}
+	return diffSchemas(existing, &EventSchema{RequiredFields: requiredFields, FieldTypes: fieldTypes})
+}
+
+// SchemaVersions returns the active versions of an event type's schema, current first, with their
+// validation counts. A previous version is active until the grace period of a breaking update ends.
+func (s *SchemaValidator) SchemaVersions(eventType string) ([]SchemaVersionStatus, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	schema, exists := s.schemas[eventType]
+	if !exists {
+		return nil, fmt.Errorf("schema not found: %s", eventType)
+	}
+
+	current := s.definition(eventType, schema)
+	versions := []SchemaVersionStatus{s.versionStatus(eventType, current.Version, schema)}
+	versions[0].Current = true
+
+	if evolution := s.evolution[eventType]; evolution != nil && evolution.previous != nil && time.Now().Before(evolution.graceEnds) {
+		previous := s.versionStatus(eventType, evolution.previousVersion, evolution.previous)
+		activeUntil := evolution.graceEnds
+		previous.ActiveUntil = &activeUntil
+		versions = append(versions, previous)
+	}
+	return versions, nil
+}
+
+// versionStatus describes a version of a schema. Callers must hold the lock.
+func (s *SchemaValidator) versionStatus(eventType string, version int64, schema *EventSchema) SchemaVersionStatus {
+	status := SchemaVersionStatus{
+		Version:        version,
+		RequiredFields: append([]string{}, schema.RequiredFields...),
+		FieldTypes:     make(map[string]string, len(schema.FieldTypes)),
+	}
+	for field, fieldType := range schema.FieldTypes {
+		status.FieldTypes[field] = fieldType
+	}
+	if counts := s.counts[eventType][version]; counts != nil {
+		status.Validated = atomic.LoadInt64(&counts.validated)
+		status.Failed = atomic.LoadInt64(&counts.failed)
+	}
+	return status
+}
+
+// countValidation counts the outcome of validating an event against a schema version
+func (s *SchemaValidator) countValidation(eventType string, version int64, err error) {
+	s.mutex.RLock()
+	counts := s.counts[eventType][version]
+	s.mutex.RUnlock()
+
+	if counts == nil {
+		s.mutex.Lock()
+		byVersion, exists := s.counts[eventType]
+		if !exists {
+			byVersion = make(map[int64]*schemaVersionCounts)
+			s.counts[eventType] = byVersion
+		}
+		if counts = byVersion[version]; counts == nil {
+			counts = &schemaVersionCounts{}
+			byVersion[version] = counts
+		}
+		s.mutex.Unlock()
+	}
+
+	if err != nil {
+		atomic.AddInt64(&counts.failed, 1)
+	} else {
+		atomic.AddInt64(&counts.validated, 1)
+	}
+}
@@ -0,0 +1,99 @@
+package app
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// listSchemas returns the definitions of all event schemas
+func (s *App) listSchemas(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"schemas": s.analyticsService.Schemas().ListSchemas(),
+	})
+}
+
+// getSchema returns the schema of an event type with its version as the ETag
+func (s *App) getSchema(c *fiber.Ctx) error {
+	schema, err := s.analyticsService.Schemas().GetSchema(c.Params("event_type"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	c.Set(fiber.HeaderETag, ETag(schema.Version))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"schema": schema,
+	})
+}
+
+// updateSchema creates or replaces the schema of an event type. Replacing an existing schema
+// requires If-Match with the version being updated. With ?dry_run=true the changes from the
+// current version are only reported, so breaking changes can be reviewed first.
+func (s *App) updateSchema(c *fiber.Ctx) error {
+	var request struct {
+		RequiredFields []string          `json:"required_fields"`
+		FieldTypes     map[string]string `json:"field_types"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	schemas := s.analyticsService.Schemas()
+	eventType := utils.CopyString(c.Params("event_type"))
+
+	if c.QueryBool("dry_run") {
+		changes := schemas.DiffSchema(eventType, request.RequiredFields, request.FieldTypes)
+		return c.JSON(fiber.Map{
+			"status":   "success",
+			"changes":  changes,
+			"breaking": hasBreakingChange(changes),
+		})
+	}
+
+	// New schemas may be created without If-Match; a concurrent creation still conflicts
+	var expectedVersion int64
+	if _, err := schemas.GetSchema(eventType); err == nil || c.Get(fiber.HeaderIfMatch) != "" {
+		var status int
+		expectedVersion, status, err = ifMatchVersion(c)
+		if err != nil {
+			return c.Status(status).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+
+	schema, err := schemas.UpdateSchema(eventType, request.RequiredFields, request.FieldTypes, expectedVersion)
+	if err != nil {
+		return writeUpdateError(c, err, http.StatusBadRequest)
+	}
+
+	c.Set(fiber.HeaderETag, ETag(schema.Version))
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"schema": schema,
+	})
+}
+
+// getSchemaVersions returns the active versions of an event type's schema with their validation counts
+func (s *App) getSchemaVersions(c *fiber.Ctx) error {
+	versions, err := s.analyticsService.Schemas().SchemaVersions(c.Params("event_type"))
+	if err != nil {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":       "success",
+		"versions":     versions,
+		"grace_period": s.analyticsService.Schemas().GracePeriod().String(),
+	})
+}
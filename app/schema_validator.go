@@ -3,6 +3,9 @@ package app
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"sync"
+	"time"
 )
 
 // EventSchema defines the schema for analytics events
@@ -15,15 +18,41 @@ type EventSchema struct {
 // ValidationRule defines a custom validation rule
 type ValidationRule func(value interface{}) error
 
+// SchemaDefinition is the editable, serializable part of an event schema
+type SchemaDefinition struct {
+	EventType      string            `json:"event_type"`
+	RequiredFields []string          `json:"required_fields"`
+	FieldTypes     map[string]string `json:"field_types"`
+	CustomRules    []string          `json:"custom_rules,omitempty"` // Fields checked by built-in rules
+	Version        int64             `json:"version"`                // Incremented on every update, exposed as the ETag
+	// Changes from the previous version, and until when events valid under the
+	// previous version are still accepted after a breaking change
+	Changes         []SchemaChange `json:"changes,omitempty"`
+	Breaking        bool           `json:"breaking,omitempty"`
+	GracePeriodEnds *time.Time     `json:"grace_period_ends,omitempty"`
+}
+
+// Field types a schema can require
+var schemaFieldTypes = map[string]bool{"string": true, "float64": true, "map": true, "array": true}
+
 // SchemaValidator handles event schema validation
 type SchemaValidator struct {
-	schemas map[string]*EventSchema
+	schemas     map[string]*EventSchema
+	versions    map[string]int64
+	evolution   map[string]*schemaEvolution               // Last change of each schema
+	counts      map[string]map[int64]*schemaVersionCounts // Event type -> version -> validations
+	gracePeriod time.Duration                             // How long previous versions stay active after breaking changes
+	mutex       sync.RWMutex
 }
 
 // NewSchemaValidator creates a new schema validator
 func NewSchemaValidator() *SchemaValidator {
 	validator := &SchemaValidator{
-		schemas: make(map[string]*EventSchema),
+		schemas:     make(map[string]*EventSchema),
+		versions:    make(map[string]int64),
+		evolution:   make(map[string]*schemaEvolution),
+		counts:      make(map[string]map[int64]*schemaVersionCounts),
+		gracePeriod: getEnvDuration("SCHEMA_GRACE_PERIOD", 7*24*time.Hour),
 	}
 
 	// Register default schemas
@@ -80,6 +109,9 @@ func (s *SchemaValidator) registerDefaultSchemas() {
 		},
 	})
 
+	// Web vitals event schema
+	s.RegisterSchema(PerformanceEventType, performanceSchema())
+
 	// Generic event schema
 	s.RegisterSchema("generic", &EventSchema{
 		RequiredFields: []string{"event_type", "user_id"},
@@ -96,7 +128,165 @@ func (s *SchemaValidator) registerDefaultSchemas() {
 
 // RegisterSchema registers a new event schema
 func (s *SchemaValidator) RegisterSchema(eventType string, schema *EventSchema) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.schemas[eventType] = schema
+	s.versions[eventType]++
+	delete(s.evolution, eventType)
+}
+
+// GetSchema returns the definition of an event type's schema
+func (s *SchemaValidator) GetSchema(eventType string) (*SchemaDefinition, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	schema, exists := s.schemas[eventType]
+	if !exists {
+		return nil, fmt.Errorf("schema not found: %s", eventType)
+	}
+	return s.definition(eventType, schema), nil
+}
+
+// ListSchemas returns the definitions of all schemas, sorted by event type
+func (s *SchemaValidator) ListSchemas() []*SchemaDefinition {
+	s.mutex.RLock()
+	definitions := make([]*SchemaDefinition, 0, len(s.schemas))
+	for eventType, schema := range s.schemas {
+		definitions = append(definitions, s.definition(eventType, schema))
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].EventType < definitions[j].EventType
+	})
+	return definitions
+}
+
+// UpdateSchema creates or replaces the required fields and field types of an event type's schema,
+// keeping its built-in rules. The update is rejected with a VersionConflictError unless
+// expectedVersion is the schema's current version (0 for a schema that does not exist yet).
+// The returned definition lists the changes from the previous version. After a breaking change,
+// events valid under the previous version are still accepted until the grace period ends.
+func (s *SchemaValidator) UpdateSchema(eventType string, requiredFields []string, fieldTypes map[string]string, expectedVersion int64) (*SchemaDefinition, error) {
+	if eventType == "" {
+		return nil, fmt.Errorf("event type is required")
+	}
+	for field, fieldType := range fieldTypes {
+		if !schemaFieldTypes[fieldType] {
+			return nil, fmt.Errorf("invalid type %q for field '%s'. Valid types are: string, float64, map, array", fieldType, field)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := checkVersion("schema", eventType, s.versions[eventType], expectedVersion); err != nil {
+		return nil, err
+	}
+
+	// Replace rather than modify the schema, as validations may still be using it
+	schema := &EventSchema{
+		RequiredFields: append([]string{}, requiredFields...),
+		FieldTypes:     make(map[string]string, len(fieldTypes)),
+	}
+	for field, fieldType := range fieldTypes {
+		schema.FieldTypes[field] = fieldType
+	}
+	existing, exists := s.schemas[eventType]
+	if exists {
+		schema.CustomRules = existing.CustomRules
+
+		evolution := &schemaEvolution{changes: diffSchemas(existing, schema)}
+		if hasBreakingChange(evolution.changes) && s.gracePeriod > 0 {
+			evolution.previous = existing
+			evolution.previousVersion = s.versions[eventType]
+			evolution.graceEnds = time.Now().Add(s.gracePeriod)
+		}
+		s.evolution[eventType] = evolution
+	}
+
 	s.schemas[eventType] = schema
+	s.versions[eventType]++
+
+	// Only the validations of the active versions are kept
+	for version := range s.counts[eventType] {
+		if version != s.versions[eventType] && (s.evolution[eventType] == nil || version != s.evolution[eventType].previousVersion) {
+			delete(s.counts[eventType], version)
+		}
+	}
+
+	return s.definition(eventType, schema), nil
+}
+
+// definition describes a schema. Callers must hold the lock.
+func (s *SchemaValidator) definition(eventType string, schema *EventSchema) *SchemaDefinition {
+	definition := &SchemaDefinition{
+		EventType:      eventType,
+		RequiredFields: append([]string{}, schema.RequiredFields...),
+		FieldTypes:     make(map[string]string, len(schema.FieldTypes)),
+		Version:        s.versions[eventType],
+	}
+	for field, fieldType := range schema.FieldTypes {
+		definition.FieldTypes[field] = fieldType
+	}
+	for field := range schema.CustomRules {
+		definition.CustomRules = append(definition.CustomRules, field)
+	}
+	sort.Strings(definition.CustomRules)
+
+	if evolution := s.evolution[eventType]; evolution != nil {
+		definition.Changes = append([]SchemaChange{}, evolution.changes...)
+		definition.Breaking = hasBreakingChange(evolution.changes)
+		if evolution.previous != nil && time.Now().Before(evolution.graceEnds) {
+			graceEnds := evolution.graceEnds
+			definition.GracePeriodEnds = &graceEnds
+		}
+	}
+	return definition
+}
+
+// schemaFor returns the schema validating an event type, falling back to the generic schema
+func (s *SchemaValidator) schemaFor(eventType string) *EventSchema {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	schema, exists := s.schemas[eventType]
+	if !exists {
+		// Use generic schema if specific schema doesn't exist
+		schema = s.schemas["generic"]
+	}
+	return schema
+}
+
+// activeSchema is a version of a schema events are validated against
+type activeSchema struct {
+	name    string // Event type of the schema, "generic" for the fallback
+	version int64
+	schema  *EventSchema
+}
+
+// activeSchemas returns the current version of the schema validating an event type, followed by
+// the previous version while its grace period runs
+func (s *SchemaValidator) activeSchemas(eventType string) []activeSchema {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	name := eventType
+	schema, exists := s.schemas[name]
+	if !exists {
+		// Use generic schema if specific schema doesn't exist
+		name = "generic"
+		schema, exists = s.schemas[name]
+		if !exists {
+			return nil
+		}
+	}
+
+	active := []activeSchema{{name: name, version: s.versions[name], schema: schema}}
+	if evolution := s.evolution[name]; evolution != nil && evolution.previous != nil && time.Now().Before(evolution.graceEnds) {
+		active = append(active, activeSchema{name: name, version: evolution.previousVersion, schema: evolution.previous})
+	}
+	return active
 }
 
 // ValidateEvent validates an event against its schema
@@ -107,17 +297,30 @@ func (s *SchemaValidator) ValidateEvent(eventData map[string]interface{}) error
 		return fmt.Errorf("event_type is required and must be a string")
 	}
 
-	// Get schema for this event type
-	schema, exists := s.schemas[eventType]
-	if !exists {
-		// Use generic schema if specific schema doesn't exist
-		schema = s.schemas["generic"]
+	// Get the active versions of the schema for this event type
+	active := s.activeSchemas(eventType)
+	if len(active) == 0 {
+		return fmt.Errorf("no schema found for event type: %s", eventType)
 	}
 
-	if schema == nil {
-		return fmt.Errorf("no schema found for event type: %s", eventType)
+	// Events valid under the previous version are accepted during its grace period,
+	// but the error of the current version is reported
+	var err error
+	for i, version := range active {
+		versionErr := s.validateAgainst(eventData, version.schema)
+		s.countValidation(version.name, version.version, versionErr)
+		if versionErr == nil {
+			return nil
+		}
+		if i == 0 {
+			err = versionErr
+		}
 	}
+	return err
+}
 
+// validateAgainst validates an event against one version of a schema
+func (s *SchemaValidator) validateAgainst(eventData map[string]interface{}, schema *EventSchema) error {
 	// Validate required fields
 	if err := s.validateRequiredFields(eventData, schema.RequiredFields); err != nil {
 		return err
@@ -209,10 +412,7 @@ func (s *SchemaValidator) GetValidationErrors(eventData map[string]interface{})
 		return errors
 	}
 
-	schema, exists := s.schemas[eventType]
-	if !exists {
-		schema = s.schemas["generic"]
-	}
+	schema := s.schemaFor(eventType)
 
 	if schema == nil {
 		errors = append(errors, fmt.Sprintf("no schema found for event type: %s", eventType))
@@ -2,34 +2,185 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sort"
+	"sync"
 	"time"
-
-	"github.com/google/uuid"
 )
 
+// errInvalidEventData wraps the reasons events are rejected as invalid
+var errInvalidEventData = errors.New("invalid event data")
+
 // AnalyticsService handles analytics event processing and billing integration
 type AnalyticsService struct {
-	events          map[string]*AnalyticsEvent // In-memory storage for now
-	schemaValidator *SchemaValidator           // Schema validation for events
-	billingClient   *BillingClient             // Billing service integration
+	events          map[string]map[string]*AnalyticsEvent // In-memory storage per region and event ID for now
+	correlations    map[string]*AnalyticsEvent            // Stored events by billing correlation ID
+	schemaValidator *SchemaValidator                      // Schema validation for events
+	billingClient   *BillingClient                        // Billing service integration
+	billingEvents   *BillingEventLog                      // Billing events of API calls and their delivery
+	slowOperations  *SlowOperationLog                     // Log of expensive funnel/heatmap/query executions
+	storageSampler  *StorageSampler                       // Which events are stored in full detail
+	plans           *PlanService                          // Billing plans and their limits
+	currencies      *CurrencyService                      // Contract currency of each project
+	retention       *RetentionPolicy                      // How long events of each type are kept
+	validationLog   *ValidationLog                        // Problems found with the events projects send
+	cardinality     *CardinalityGuard                     // Limits distinct property values per project
+	aliases         *AliasService                         // Canonical names of renamed event types and properties
+	identities      *IdentityMerges                       // Canonical users of merged anonymous and identified user IDs
+	lateEvents      *LateEventTracker                     // Lateness window and buckets dirtied by late events
+	mobileBatches   *MobileBatchLog                       // Mobile batches received recently, to detect retries
+	keyDefaults     *APIKeyDefaultsService                // Properties added to every event of an API key
+	dimensions      *DimensionRegistry                    // Typed custom dimensions of each project
+	queryCache      *QueryCache                           // Results of trend and funnel queries
+	rollups         *DailyRollups                         // Daily event counts per page, device, country and campaign
+	regions         *RegionRouter                         // Region each project's events are stored in and read from
+	bus             *EventBus                             // Delivers stored events to the services consuming them
+	hooks           *PipelineHooks                        // Custom enrichers, validators and sinks
+	faults          *FaultInjector                        // Faults injected into storing events for testing, if any
+	quotas          *EventQuotas                          // Daily caps of noisy event types per project
+	quality         *DataQualityMonitors                  // Alerts on signs of broken instrumentation in received events
+	aggregates      *EventAggregates                      // Counters of event types stored as aggregates only
+	sessionContext  *SessionContext                       // Web session context merged into server-side events when read
+	freshness       *PipelineFreshness                    // How far each stage of the pipeline trails the events received
+	series          *HourlySeries                         // Events per hour, downsampled into daily summaries once old
+	storeWriter     *EventWriter                          // Writes stored events to the event store, nil without one
+	circuit         *IngestionCircuit                     // Accepts events into a log while the event store is down
+	quarantine      *EventQuarantine                      // Events failing validation of the projects keeping them
+	clock           Clock                                 // Time events are received at
+	ids             IDGenerator                           // IDs of events, billing events and sessions
+	mutex           sync.RWMutex
+
+	storageCostPerGBMonth float64 // Price of stored events, for storage estimates
 }
 
 // NewAnalyticsService creates a new analytics service instance
 func NewAnalyticsService() *AnalyticsService {
+	validationLog := NewValidationLog()
+	aliases := NewAliasService()
+	identities := NewIdentityMerges()
+	bus := NewEventBus()
+	quality := NewDataQualityMonitors()
+	quality.SetBus(bus)
+	billingClient := NewBillingClient(os.Getenv("BILLING_SERVICE_URL")) // Default billing service URL when unset
+	billingStore, err := NewBillingEventStoreFromEnv()
+	if err != nil {
+		log.Printf("Error: Billing events are only kept in memory: %v", err)
+		billingStore = NewMemoryBillingEventStore()
+	}
 	return &AnalyticsService{
-		events:          make(map[string]*AnalyticsEvent),
+		events:          make(map[string]map[string]*AnalyticsEvent),
+		correlations:    make(map[string]*AnalyticsEvent),
 		schemaValidator: NewSchemaValidator(),
-		billingClient:   NewBillingClient(""), // Use default billing service URL
+		billingClient:   billingClient,
+		billingEvents:   NewBillingEventLog(billingStore, billingClient),
+		slowOperations:  NewSlowOperationLog(),
+		storageSampler:  NewStorageSampler(),
+		plans:           NewPlanService(),
+		currencies:      NewCurrencyService(),
+		retention:       NewRetentionPolicy(),
+		validationLog:   validationLog,
+		cardinality:     NewCardinalityGuard(validationLog),
+		aliases:         aliases,
+		identities:      identities,
+		lateEvents:      NewLateEventTracker(),
+		mobileBatches:   NewMobileBatchLog(),
+		keyDefaults:     NewAPIKeyDefaultsService(),
+		dimensions:      NewDimensionRegistry(),
+		queryCache:      NewQueryCache(),
+		rollups:         NewDailyRollups(aliases, identities),
+		regions:         NewRegionRouter(),
+		bus:             bus,
+		hooks:           NewPipelineHooks(bus),
+		quotas:          NewEventQuotas(),
+		quality:         quality,
+		aggregates:      NewEventAggregates(aliases),
+		sessionContext:  NewSessionContext(),
+		freshness:       NewPipelineFreshness(),
+		series:          NewHourlySeries(aliases),
+		circuit:         NewIngestionCircuit(),
+		quarantine:      NewEventQuarantine(),
+		clock:           SystemClock(),
+		ids:             UUIDGenerator(),
+
+		storageCostPerGBMonth: getEnvFloat("STORAGE_COST_PER_GB_MONTH", 0.10),
 	}
 }
 
 // TrackEvent processes and stores an analytics event
 func (s *AnalyticsService) TrackEvent(ctx context.Context, eventData map[string]interface{}, apiKey, userID string) (*AnalyticsEvent, error) {
+	receivedAt := s.clock.Now()
+	defer s.freshness.done(s.freshness.process(ProjectFromContext(ctx), receivedAt))
+	return s.trackEventReceivedAt(ctx, eventData, apiKey, userID, receivedAt)
+}
+
+// trackEventDispatched tracks an event in the user's turn taken with reserve, which returns nil
+// when the user's queue is full. The turn is taken first, so events shed by a full queue are not
+// billed, and the event is billed while the events before it are processed, off the user's queue.
+func (s *AnalyticsService) trackEventDispatched(ctx context.Context, eventData map[string]interface{}, apiKey, userID string, reserve func() func(task func())) (*AnalyticsEvent, error) {
+	receivedAt := s.clock.Now()
+	defer s.freshness.done(s.freshness.process(ProjectFromContext(ctx), receivedAt))
+
+	run := reserve()
+	if run == nil {
+		return nil, errUserQueueFull
+	}
+	event, err := s.prepareEvent(ctx, eventData, apiKey, userID, receivedAt)
+	if err != nil {
+		run(nil)
+		return nil, err
+	}
+	s.billEvent(ctx, event, apiKey, userID)
+
+	var stored *AnalyticsEvent
+	run(func() { stored, err = s.acceptEvent(event) })
+	return stored, err
+}
+
+// trackEventReceivedAt tracks an event received at the given time. Events accepted for
+// asynchronous ingestion were received when they were queued, not when they are processed.
+func (s *AnalyticsService) trackEventReceivedAt(ctx context.Context, eventData map[string]interface{}, apiKey, userID string, receivedAt time.Time) (*AnalyticsEvent, error) {
+	event, err := s.prepareEvent(ctx, eventData, apiKey, userID, receivedAt)
+	if err != nil {
+		return nil, err
+	}
+	s.billEvent(ctx, event, apiKey, userID)
+	return s.acceptEvent(event)
+}
+
+// prepareEvent validates a received event and builds it as it is billed and stored
+func (s *AnalyticsService) prepareEvent(ctx context.Context, eventData map[string]interface{}, apiKey, userID string, receivedAt time.Time) (*AnalyticsEvent, error) {
 	// Validate required fields
 	if err := s.validateEventData(eventData); err != nil {
-		return nil, fmt.Errorf("invalid event data: %w", err)
+		eventType, _ := eventData["event_type"].(string)
+		s.validationLog.Record(ProjectFromContext(ctx), ValidationIssueSchema, eventType, "", err.Error())
+		return nil, s.quarantineInvalid(ctx, eventData, apiKey, userID, receivedAt, err)
+	}
+
+	// Offline-queued events carry the time they happened, corrected for the device's clock
+	// skew and accepted within the lateness window
+	happened, err := resolveEventTime(eventData, receivedAt)
+	if err == nil {
+		err = s.lateEvents.CheckTimestamp(happened.Timestamp, receivedAt)
+	}
+	if err != nil {
+		eventType, _ := eventData["event_type"].(string)
+		s.validationLog.Record(ProjectFromContext(ctx), ValidationIssueTimestamp, eventType, "timestamp", err.Error())
+		return nil, fmt.Errorf("%w: %w", errInvalidEventData, err)
+	}
+
+	// Events are stored in the region they are tagged with, when their project allows it
+	requestedRegion, err := eventRegion(ctx, eventData)
+	var region string
+	if err == nil {
+		region, err = s.regions.Route(ProjectFromContext(ctx), requestedRegion)
+	}
+	if err != nil {
+		eventType, _ := eventData["event_type"].(string)
+		s.validationLog.Record(ProjectFromContext(ctx), ValidationIssueSchema, eventType, "region", err.Error())
+		return nil, fmt.Errorf("%w: %w", errInvalidEventData, err)
 	}
 
 	// Enrich event data with additional metadata
@@ -37,16 +188,70 @@ func (s *AnalyticsService) TrackEvent(ctx context.Context, eventData map[string]
 
 	// Create analytics event
 	event := &AnalyticsEvent{
-		ID:         uuid.New().String(),
+		ID:         s.ids.NewID(),
+		ProjectID:  ProjectFromContext(ctx),
+		Region:     region,
 		EventType:  enrichedData["event_type"].(string),
 		UserID:     userID,
 		Page:       s.getStringValue(enrichedData, "page"),
-		Timestamp:  time.Now(),
+		SessionID:  s.getStringValue(eventData, "session_id"), // Not the ID generated for events without one
+		Timestamp:  happened.Timestamp,
+		ReceivedAt: receivedAt,
 		Properties: s.getMapValue(enrichedData, "properties"),
-		APIKey:     apiKey,
+		APIKeyID:   eventAPIKeyID(apiKey),
+
+		ClientTimestamp: happened.ClientTimestamp,
+		SentAt:          happened.SentAt,
+		ClockSkewMs:     happened.ClockSkew.Milliseconds(),
+	}
+	event.Late = isLateEvent(event)
+
+	// Add the context configured for the API key, e.g. the environment of a backend emitter
+	event.Properties = s.keyDefaults.Apply(apiKey, event.Properties)
+
+	// Custom enrichers and validators of platform teams run before the built-in checks
+	s.hooks.Enrich(ctx, event)
+	if err := s.hooks.Validate(ctx, event); err != nil {
+		s.validationLog.Record(event.ProjectID, ValidationIssueSchema, event.EventType, "", err.Error())
+		return nil, s.quarantineInvalid(ctx, eventData, apiKey, userID, receivedAt, err)
+	}
+
+	// Registered dimensions only accept values of their type
+	if err := s.dimensions.Validate(event.ProjectID, event.Properties); err != nil {
+		s.validationLog.Record(event.ProjectID, ValidationIssueSchema, event.EventType, "properties", err.Error())
+		return nil, s.quarantineInvalid(ctx, eventData, apiKey, userID, receivedAt, err)
+	}
+
+	// Heatmaps plot interactions at their position, scaled from the viewport they happened in
+	if err := validateCoordinates(event.EventType, event.Properties); err != nil {
+		s.validationLog.Record(event.ProjectID, ValidationIssueSchema, event.EventType, "properties", err.Error())
+		return nil, s.quarantineInvalid(ctx, eventData, apiKey, userID, receivedAt, err)
+	}
+
+	// Event types over their project's daily quota are dropped, or sampled, before they are billed
+	event.QuotaSampleRate, err = s.quotas.Admit(projectOrDefault(event.ProjectID), event.EventType, event.ID, receivedAt)
+	if err != nil {
+		debugf("Dropped event %s: %v", event.ID, err)
+		return nil, err
+	}
+
+	// Aggregation-only event types are only counted, so they keep nothing linking them to a user
+	if s.aggregates.AggregationOnly(projectOrDefault(event.ProjectID), event.EventType) {
+		event.Aggregated = true
+		event.UserID = ""
+		event.Page = ""
+		event.SessionID = ""
+		event.Properties = nil
 	}
 
-	// Track API call for billing purposes
+	// Keep unbounded user-generated values from blowing up aggregations
+	event.Properties, event.LimitedProperties = s.cardinality.Apply(event.ProjectID, event.EventType, event.Properties)
+	return event, nil
+}
+
+// billEvent tracks the API call of an event for billing purposes, under the correlation ID stored
+// with the event. The call is billed to the user even when the event keeps no user.
+func (s *AnalyticsService) billEvent(ctx context.Context, event *AnalyticsEvent, apiKey, userID string) {
 	endpoint := "/api/v1/analytics/events"
 	metadata := map[string]interface{}{
 		"event_type": event.EventType,
@@ -54,57 +259,128 @@ func (s *AnalyticsService) TrackEvent(ctx context.Context, eventData map[string]
 		"properties": event.Properties,
 	}
 
-	if err := s.billingClient.TrackAPICall(ctx, userID, endpoint, metadata); err != nil {
+	event.BillingCorrelationID = s.ids.NewID()
+	if err := s.billingClient.TrackCorrelatedAPICall(ctx, event.BillingCorrelationID, userID, endpoint, metadata); err != nil {
 		// Log the error but don't fail the event tracking
-		log.Printf("Warning: Failed to track billing event: %v", err)
-		// Generate a fallback billing event ID
-		event.BillingEventID = uuid.New().String()
+		log.Printf("Warning: Failed to track billing event %s: %v", event.BillingCorrelationID, err)
+		event.BillingStatus = BillingFailed
 	} else {
-		// Generate billing event ID for correlation
-		event.BillingEventID = uuid.New().String()
+		event.BillingStatus = BillingRecorded
 	}
+}
 
-	// Store event (in-memory for now)
-	s.events[event.ID] = event
+// acceptEvent stores a billed event, or logs it while the event store is down
+func (s *AnalyticsService) acceptEvent(event *AnalyticsEvent) (*AnalyticsEvent, error) {
+	// Billing counted every event; outside the storage sample only the event itself is kept,
+	// without its properties
+	stored := event
+	if rate := s.storageSampler.DetailRate(event.EventType); rate < 1.0 {
+		event.DetailSampleRate = rate
+		if !s.storageSampler.ShouldStoreDetail(event.ID, event.EventType) {
+			stripped := *event
+			stripped.Properties = nil
+			stripped.DetailDropped = true
+			stored = &stripped
+		}
+	}
+
+	// While the event store is down, events are accepted into the ingestion log instead of failing,
+	// and stored once it recovers
+	if !s.circuit.Allow() {
+		return s.logEvent(event, stored)
+	}
+	if err := s.faults.Inject(FaultStore, "write"); err != nil {
+		s.circuit.Failure(err)
+		return s.logEvent(event, stored)
+	}
+	s.circuit.Success()
+	return s.storeEvent(event, stored), nil
+}
+
+// storeEvent stores an accepted event, stored being the event as it is kept, e.g. without its
+// properties outside the storage sample
+func (s *AnalyticsService) storeEvent(event, stored *AnalyticsEvent) *AnalyticsEvent {
+	s.quality.Observe(event)
+	if event.Aggregated {
+		s.aggregates.Add(event)
+		s.series.Add(s.aliases.Resolver()(event))
+		debugf("Counted aggregation-only event: %s", event.EventType)
+		return event
+	}
+
+	// Store event in memory, written to the event store in the background. Rollups count it with
+	// its properties under the same lock, so rebuilds neither miss nor double count it.
+	s.mutex.Lock()
+	if s.events[event.Region] == nil {
+		s.events[event.Region] = make(map[string]*AnalyticsEvent)
+	}
+	s.events[event.Region][event.ID] = stored
+	s.correlations[stored.BillingCorrelationID] = stored
+	resolved := s.aliases.Resolver()(event)
+	s.rollups.Add(resolved)
+	s.series.Add(resolved)
+	s.mutex.Unlock()
+	s.freshness.stored(event)
+	s.dimensions.Index(stored)
+	s.storeWriter.Add(stored)
+
+	// Rollups and cached results covering a closed bucket must be recomputed once the event is stored
+	if event.Late {
+		s.lateEvents.Mark(event)
+		s.queryCache.ExpireProject(projectOrDefault(event.ProjectID))
+	}
+
+	// Dashboards and other consumers subscribe to stored events instead of being called here
+	if err := s.bus.Publish(TopicEventStored, event); err != nil {
+		log.Printf("Warning: Failed to publish event %s: %v", event.ID, err)
+	}
 
 	// Log the event for debugging
-	log.Printf("Tracked event: %s for user: %s, billing_event_id: %s", event.EventType, event.UserID, event.BillingEventID)
+	debugf("Tracked event: %s for user: %s, billing_correlation_id: %s", event.EventType, event.UserID, event.BillingCorrelationID)
 
-	return event, nil
+	return event
 }
 
-// TrackAPIUsage tracks API usage for any endpoint (for middleware usage)
+// TrackAPIUsage tracks API usage for any endpoint under a new correlation ID
 func (s *AnalyticsService) TrackAPIUsage(ctx context.Context, userID, endpoint, method string, metadata map[string]interface{}) error {
+	return s.TrackCorrelatedAPIUsage(ctx, s.ids.NewID(), userID, endpoint, method, metadata)
+}
+
+// TrackCorrelatedAPIUsage tracks an API call under its correlation ID, the ID of its billing
+// event (for middleware usage). Tracking the same ID again replaces the billing event, and the
+// billing service drops the repeated charge by its idempotency key.
+func (s *AnalyticsService) TrackCorrelatedAPIUsage(ctx context.Context, correlationID, userID, endpoint, method string, metadata map[string]interface{}) error {
 	if s.billingClient == nil {
 		return fmt.Errorf("billing client not initialized")
 	}
 
-	// Add method to metadata
-	if metadata == nil {
-		metadata = make(map[string]interface{})
+	// Add method to a copy of the metadata, the caller may still be reading it
+	enriched := make(map[string]interface{}, len(metadata)+2)
+	for k, v := range metadata {
+		enriched[k] = v
 	}
-	metadata["method"] = method
-	metadata["timestamp"] = time.Now()
-
-	// Track API call for billing
-	if err := s.billingClient.TrackAPICall(ctx, userID, endpoint, metadata); err != nil {
-		return fmt.Errorf("failed to track API call: %w", err)
+	enriched["method"] = method
+	enriched["timestamp"] = s.clock.Now()
+
+	// Store the billing event for cost tracking before sending it, so failed deliveries are retried
+	billingEvent := &StoredBillingEvent{
+		BillingEvent: BillingEvent{
+			ID:          correlationID,
+			UserID:      userID,
+			EventType:   "api_call",
+			Amount:      s.calculateAPICallCost(endpoint, method),
+			Currency:    "USD",
+			Timestamp:   s.clock.Now(),
+			Description: fmt.Sprintf("API call to %s %s", method, endpoint),
+		},
+		Endpoint: endpoint,
 	}
-
-	// Generate billing event for cost tracking
-	billingEvent := &BillingEvent{
-		ID:          uuid.New().String(),
-		UserID:      userID,
-		EventType:   "api_call",
-		Amount:      s.calculateAPICallCost(endpoint, method),
-		Currency:    "USD",
-		Timestamp:   time.Now(),
-		Description: fmt.Sprintf("API call to %s %s", method, endpoint),
+	billingEvent.SetMetadata(enriched)
+	if err := s.billingEvents.Record(ctx, billingEvent); err != nil {
+		return fmt.Errorf("failed to track API call %s: %w", correlationID, err)
 	}
 
-	// Store billing event (in-memory for now)
-	// In a real implementation, this would be sent to a billing service
-	log.Printf("Generated billing event: %s for user: %s, amount: %.4f", 
+	debugf("Generated billing event: %s for user: %s, amount: %.4f",
 		billingEvent.ID, billingEvent.UserID, billingEvent.Amount)
 
 	return nil
@@ -164,20 +440,27 @@ func (s *AnalyticsService) GetUsage(ctx context.Context, userID, startDateStr, e
 	}
 
 	// Calculate usage from stored events
+	queryStart := time.Now()
 	eventsByType := make(map[string]int64)
 	var totalEvents int64
+	resolve := s.aliases.Resolver()
 
-	for _, event := range s.events {
-		if event.UserID == userID &&
-			event.Timestamp.After(startDate) &&
-			event.Timestamp.Before(endDate.Add(24*time.Hour)) {
-			totalEvents++
-			eventsByType[event.EventType]++
-		}
+	scannedEvents, err := s.scanUsageEvents(ctx, userID, startDate, endDate, func(event *AnalyticsEvent) {
+		totalEvents++
+		eventsByType[resolve(event).EventType]++
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// Calculate billing summary (simulating billing integration)
-	billingSummary := s.calculateBillingSummary(eventsByType)
+	s.slowOperations.Observe(SlowOperationUsageQuery, map[string]interface{}{
+		"user_id":    userID,
+		"start_date": startDateStr,
+		"end_date":   endDateStr,
+	}, time.Since(queryStart), scannedEvents, s.calculateAPICallCost("/api/v1/analytics/usage", "GET"))
+
+	// Calculate billing summary (simulating billing integration) in the project's contract currency
+	billingSummary := s.currencies.ConvertSummary(s.calculateBillingSummary(eventsByType), s.currencies.ProjectCurrency(ProjectFromContext(ctx)))
 
 	usage := &UsageSummary{
 		UserID:         userID,
@@ -193,6 +476,327 @@ func (s *AnalyticsService) GetUsage(ctx context.Context, userID, startDateStr, e
 	return usage, nil
 }
 
+// UsageVersion returns a fingerprint of what the usage summaries of the context's project are
+// computed from: the rollup version, changing with the stored events, the project's aliases and,
+// for breakdowns, custom dimensions, the regions read and the contract currency's rate. Summaries
+// computed with the same fingerprint and parameters are the same.
+func (s *AnalyticsService) UsageVersion(ctx context.Context, breakdown string) string {
+	projectID := ProjectFromContext(ctx)
+	currency := s.currencies.ProjectCurrency(projectID)
+	rate, _ := s.currencies.Rate(currency)
+	version := fmt.Sprintf("%d|%d|%v|%s|%g", s.rollups.Version(), s.aliases.Get(projectID).Version, s.readRegions(ctx, projectID), currency, rate)
+	if breakdown != "" {
+		version += fmt.Sprintf("|%s|%d", breakdown, s.dimensions.Get(projectID).Version)
+	}
+	return version
+}
+
+// GetUsageBreakdown retrieves usage statistics for a user with the events split by the values of
+// a custom dimension of the context's project
+func (s *AnalyticsService) GetUsageBreakdown(ctx context.Context, userID, startDateStr, endDateStr, dimensionName string) (*UsageSummary, error) {
+	dimension, err := s.dimensions.Lookup(ProjectFromContext(ctx), dimensionName)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := s.GetUsage(ctx, userID, startDateStr, endDateStr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Same events as the usage summary
+	byValue := make(map[string]*DimensionUsage)
+	resolve := s.aliases.Resolver()
+	_, err = s.scanUsageEvents(ctx, userID, usage.Period.StartDate, usage.Period.EndDate, func(stored *AnalyticsEvent) {
+		event := resolve(stored)
+		value := dimension.Value(event)
+		breakdown, exists := byValue[value]
+		if !exists {
+			breakdown = &DimensionUsage{Value: value, EventsByType: make(map[string]int64)}
+			byValue[value] = breakdown
+		}
+		breakdown.TotalEvents++
+		breakdown.EventsByType[event.EventType]++
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	currency := s.currencies.ProjectCurrency(ProjectFromContext(ctx))
+	usage.Breakdown = make([]DimensionUsage, 0, len(byValue))
+	for _, breakdown := range byValue {
+		breakdown.TotalCost = s.currencies.ConvertSummary(s.calculateBillingSummary(breakdown.EventsByType), currency).TotalCost
+		usage.Breakdown = append(usage.Breakdown, *breakdown)
+	}
+	sort.Slice(usage.Breakdown, func(i, j int) bool {
+		if usage.Breakdown[i].TotalEvents != usage.Breakdown[j].TotalEvents {
+			return usage.Breakdown[i].TotalEvents > usage.Breakdown[j].TotalEvents
+		}
+		return usage.Breakdown[i].Value < usage.Breakdown[j].Value
+	})
+
+	return usage, nil
+}
+
+// scanUsageEvents calls fn with the events of a user within the days from startDate to endDate,
+// read from the event store when there is one, and returns the number of events scanned
+func (s *AnalyticsService) scanUsageEvents(ctx context.Context, userID string, startDate, endDate time.Time, fn func(*AnalyticsEvent)) (int64, error) {
+	regions := s.readRegions(ctx, ProjectFromContext(ctx))
+	inPeriod := func(event *AnalyticsEvent) bool {
+		return event.Timestamp.After(startDate) && event.Timestamp.Before(endDate.Add(24*time.Hour))
+	}
+
+	if s.storeWriter != nil {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		events, err := s.storeWriter.Query(ctx, EventStoreFilter{UserID: userID, Regions: regions, Start: startDate, End: endDate.Add(24 * time.Hour)})
+		if err != nil {
+			return 0, err
+		}
+		for _, event := range events {
+			if inPeriod(event) {
+				fn(event)
+			}
+		}
+		return int64(len(events)), nil
+	}
+
+	var scanned int64
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	s.scanEvents(regions, func(event *AnalyticsEvent) {
+		scanned++
+		if event.UserID == userID && inPeriod(event) {
+			fn(event)
+		}
+	})
+	return scanned, nil
+}
+
+// QueryEvents returns the stored events matching the filter, oldest first. Events are returned
+// and matched under the canonical names of their project's aliases and their canonical user, from
+// the regions the project's region policy lets reads with the context's region see, with the
+// context of their session merged in.
+func (s *AnalyticsService) QueryEvents(ctx context.Context, filter EventFilter) []*AnalyticsEvent {
+	resolve := s.aliases.Resolver()
+	identify := s.identities.Resolver()
+	projectID := filter.ProjectID
+	if projectID == "" {
+		projectID = ProjectFromContext(ctx)
+	}
+	// Events of every user ID merged with the one filtered by are its events
+	if filter.UserID != "" {
+		filter.UserID = s.identities.Resolve(projectID, filter.UserID)
+	}
+
+	// Events outside the filter still contribute the context of their session
+	sessions := s.sessionContext.collector()
+
+	s.mutex.RLock()
+	events := make([]*AnalyticsEvent, 0)
+	s.scanEventsReporting(ctx, s.readRegions(ctx, projectID), func(stored *AnalyticsEvent) {
+		event := identify(resolve(stored))
+		if projectOrDefault(event.ProjectID) == projectID {
+			sessions.add(event)
+		}
+		if filter.Matches(event) {
+			events = append(events, event)
+		}
+	})
+	s.mutex.RUnlock()
+
+	for i, event := range events {
+		events[i] = sessions.apply(event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+
+	return events
+}
+
+// EventByCorrelationID returns the stored event billed under a correlation ID, for reconciliation
+// with the billing service
+func (s *AnalyticsService) EventByCorrelationID(correlationID string) (*AnalyticsEvent, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	event, exists := s.correlations[correlationID]
+	if !exists {
+		return nil, fmt.Errorf("no event with billing correlation ID: %s", correlationID)
+	}
+	return event, nil
+}
+
+// EventCount returns the number of stored events
+func (s *AnalyticsService) EventCount() int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.countEvents(nil)
+}
+
+// StorageSampler returns the sampler deciding which events are stored in full detail
+func (s *AnalyticsService) StorageSampler() *StorageSampler {
+	return s.storageSampler
+}
+
+// Plans returns the service assigning billing plans to users
+func (s *AnalyticsService) Plans() *PlanService {
+	return s.plans
+}
+
+// Schemas returns the validator holding the event schemas
+func (s *AnalyticsService) Schemas() *SchemaValidator {
+	return s.schemaValidator
+}
+
+// Currencies returns the service converting billed amounts into contract currencies
+func (s *AnalyticsService) Currencies() *CurrencyService {
+	return s.currencies
+}
+
+// Retention returns the policy deciding how long events are kept
+func (s *AnalyticsService) Retention() *RetentionPolicy {
+	return s.retention
+}
+
+// Quarantine returns the events failing validation kept per project
+func (s *AnalyticsService) Quarantine() *EventQuarantine {
+	return s.quarantine
+}
+
+// ValidationLog returns the log of problems found with the events projects send
+func (s *AnalyticsService) ValidationLog() *ValidationLog {
+	return s.validationLog
+}
+
+// Cardinality returns the guard limiting distinct property values per project
+func (s *AnalyticsService) Cardinality() *CardinalityGuard {
+	return s.cardinality
+}
+
+// Aliases returns the service mapping renamed event types and properties to canonical names
+func (s *AnalyticsService) Aliases() *AliasService {
+	return s.aliases
+}
+
+// Identities returns the user IDs merged by identity resolution
+func (s *AnalyticsService) Identities() *IdentityMerges {
+	return s.identities
+}
+
+// LateEvents returns the tracker of late events and the buckets they dirtied
+func (s *AnalyticsService) LateEvents() *LateEventTracker {
+	return s.lateEvents
+}
+
+// KeyDefaults returns the service holding the default event properties of API keys
+func (s *AnalyticsService) KeyDefaults() *APIKeyDefaultsService {
+	return s.keyDefaults
+}
+
+// Dimensions returns the registry of the projects' custom dimensions
+func (s *AnalyticsService) Dimensions() *DimensionRegistry {
+	return s.dimensions
+}
+
+// Regions returns the router deciding where events are stored and which regions reads see
+func (s *AnalyticsService) Regions() *RegionRouter {
+	return s.regions
+}
+
+// Bus returns the bus stored events are published to
+func (s *AnalyticsService) Bus() *EventBus {
+	return s.bus
+}
+
+// Hooks returns the custom enrichers, validators and sinks of the pipeline
+func (s *AnalyticsService) Hooks() *PipelineHooks {
+	return s.hooks
+}
+
+// DataQuality returns the data quality monitors of projects and their alerts
+func (s *AnalyticsService) DataQuality() *DataQualityMonitors {
+	return s.quality
+}
+
+// Quotas returns the daily event type quotas of projects and their usage
+func (s *AnalyticsService) Quotas() *EventQuotas {
+	return s.quotas
+}
+
+// Aggregates returns the aggregation-only event types of projects and their counters
+func (s *AnalyticsService) Aggregates() *EventAggregates {
+	return s.aggregates
+}
+
+// MobileBatches returns the log of recently received mobile batches
+func (s *AnalyticsService) MobileBatches() *MobileBatchLog {
+	return s.mobileBatches
+}
+
+// QueryCache returns the cache of query results
+func (s *AnalyticsService) QueryCache() *QueryCache {
+	return s.queryCache
+}
+
+// Series returns the events per hour, downsampled into daily summaries once old
+func (s *AnalyticsService) Series() *HourlySeries {
+	return s.series
+}
+
+// Rollups returns the daily rollups of the stored events
+func (s *AnalyticsService) Rollups() *DailyRollups {
+	return s.rollups
+}
+
+// Clock returns the clock the service reads the current time from
+func (s *AnalyticsService) Clock() Clock {
+	return s.clock
+}
+
+// NewID returns a new ID from the service's ID generator
+func (s *AnalyticsService) NewID() string {
+	return s.ids.NewID()
+}
+
+// Freshness returns the tracker of how far each stage of the pipeline trails the events received
+func (s *AnalyticsService) Freshness() *PipelineFreshness {
+	return s.freshness
+}
+
+// SetClock replaces the clock of the service, e.g. with a FakeClock in tests.
+// It must be called before the service handles events.
+func (s *AnalyticsService) SetClock(clock Clock) {
+	s.clock = clock
+	s.queryCache.SetClock(clock)
+	s.mobileBatches.Cache().SetClock(clock)
+	s.regions.SetClock(clock)
+	s.quality.SetClock(clock)
+	s.circuit.SetClock(clock)
+	s.quarantine.SetClock(clock)
+	s.billingEvents.SetClock(clock)
+}
+
+// SetIDGenerator replaces the generator of event, billing event, session, funnel and heatmap IDs, e.g. with a
+// SequentialIDGenerator in tests. It must be called before the service handles events.
+func (s *AnalyticsService) SetIDGenerator(ids IDGenerator) {
+	s.ids = ids
+}
+
+// SetFaultInjector sets the injector adding latency and errors to storing events and to the
+// requests of the billing client
+func (s *AnalyticsService) SetFaultInjector(faults *FaultInjector) {
+	s.faults = faults
+	s.billingClient.SetFaultInjector(faults)
+}
+
+// SlowOperations returns the log of expensive operations
+func (s *AnalyticsService) SlowOperations() *SlowOperationLog {
+	return s.slowOperations
+}
+
 // validateEventData validates the incoming event data using schema validation
 func (s *AnalyticsService) validateEventData(eventData map[string]interface{}) error {
 	// Use the schema validator for comprehensive validation
@@ -209,12 +813,12 @@ func (s *AnalyticsService) enrichEventData(eventData map[string]interface{}, api
 
 	// Add timestamp if not present
 	if _, exists := enriched["timestamp"]; !exists {
-		enriched["timestamp"] = time.Now()
+		enriched["timestamp"] = s.clock.Now()
 	}
 
 	// Add session ID if not present
 	if _, exists := enriched["session_id"]; !exists {
-		enriched["session_id"] = fmt.Sprintf("sess_%s", uuid.New().String()[:8])
+		enriched["session_id"] = fmt.Sprintf("sess_%s", s.ids.NewID()[:8])
 	}
 
 	// Add IP address if not present (simulating IP detection)
@@ -262,29 +866,5 @@ func (s *AnalyticsService) getMapValue(eventData map[string]interface{}, key str
 
 // calculateBillingSummary calculates billing information based on event types
 func (s *AnalyticsService) calculateBillingSummary(eventsByType map[string]int64) BillingSummary {
-	costBreakdown := make(map[string]float64)
-	var totalCost float64
-
-	// Simple pricing model (events per type)
-	for eventType, count := range eventsByType {
-		var cost float64
-		switch eventType {
-		case "page_view":
-			cost = float64(count) * 0.001 // $0.001 per page view
-		case "click":
-			cost = float64(count) * 0.002 // $0.002 per click
-		case "conversion":
-			cost = float64(count) * 0.01 // $0.01 per conversion
-		default:
-			cost = float64(count) * 0.0005 // $0.0005 per other event
-		}
-		costBreakdown[eventType] = cost
-		totalCost += cost
-	}
-
-	return BillingSummary{
-		TotalCost:     totalCost,
-		CostBreakdown: costBreakdown,
-		Currency:      "USD",
-	}
+	return currentPricing.summary(eventsByType)
 }
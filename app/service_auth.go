@@ -0,0 +1,283 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Headers of signed requests
+const (
+	HeaderServiceKeyID     = "X-Service-Key-ID"
+	HeaderServiceTimestamp = "X-Service-Timestamp" // Unix seconds
+	HeaderServiceNonce     = "X-Service-Nonce"     // Unique per request, for replay protection
+	HeaderServiceSignature = "X-Service-Signature" // Hex HMAC-SHA256 of the canonical request
+)
+
+// Methods internal producers authenticate with
+const (
+	ServiceAuthMTLS = "mtls"
+	ServiceAuthHMAC = "hmac"
+)
+
+// ServiceIdentity is an internal producer authenticated by its client certificate or signing key
+type ServiceIdentity struct {
+	Name      string // Common name of the certificate, or ID of the signing key
+	Method    string
+	ProjectID string // Only project the producer may submit events to, empty for any
+}
+
+// serviceKey is a key internal producers sign requests with
+type serviceKey struct {
+	secret    []byte
+	projectID string
+}
+
+// ServiceAuth authenticates machine-to-machine event submission, by the verified client
+// certificate of a mutual TLS connection or by an HMAC signature of the request. Signatures cover
+// the method, path, timestamp, nonce and body; requests outside the allowed clock skew and nonces
+// seen before are rejected, so captured requests cannot be replayed. API keys of internal
+// producers can be restricted to authenticated requests, so a leaked key is useless on its own.
+type ServiceAuth struct {
+	keys        map[string]serviceKey // Keyed by key ID
+	serviceKeys map[string]bool       // API keys only accepted from authenticated producers
+	required    bool                  // Whether every submission must be authenticated
+	maxSkew     time.Duration
+	nonces      *BoundedCache // Nonces of accepted signed requests, kept for twice the skew
+	clock       Clock
+	exporter    *SIEMExporter // Receives rejected requests, if set
+}
+
+// NewServiceAuth creates an authenticator configured from SERVICE_SIGNING_KEYS (comma-separated
+// "key_id:secret" or "key_id:secret:project" entries), SERVICE_API_KEYS, SERVICE_AUTH_REQUIRED,
+// SERVICE_SIGNATURE_MAX_SKEW and SERVICE_NONCE_MAX_ENTRIES
+func NewServiceAuth() *ServiceAuth {
+	maxSkew := getEnvDuration("SERVICE_SIGNATURE_MAX_SKEW", 5*time.Minute)
+	auth := &ServiceAuth{
+		keys:        make(map[string]serviceKey),
+		serviceKeys: make(map[string]bool),
+		required:    os.Getenv("SERVICE_AUTH_REQUIRED") == "true",
+		maxSkew:     maxSkew,
+		nonces:      NewBoundedCache("service_nonces", getEnvInt("SERVICE_NONCE_MAX_ENTRIES", 1000000), 2*maxSkew),
+		clock:       SystemClock(),
+	}
+
+	for i, entry := range strings.Split(os.Getenv("SERVICE_SIGNING_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || len(parts[1]) < 32 {
+			log.Printf("Warning: Ignoring malformed SERVICE_SIGNING_KEYS entry #%d, secrets need at least 32 characters", i+1)
+			continue
+		}
+		key := serviceKey{secret: []byte(parts[1])}
+		if len(parts) == 3 {
+			key.projectID = parts[2]
+		}
+		auth.keys[parts[0]] = key
+	}
+
+	for _, apiKey := range strings.Split(os.Getenv("SERVICE_API_KEYS"), ",") {
+		if apiKey = strings.TrimSpace(apiKey); apiKey != "" {
+			auth.serviceKeys[apiKey] = true
+		}
+	}
+
+	return auth
+}
+
+// SetClock replaces the clock signature timestamps are checked against
+func (a *ServiceAuth) SetClock(clock Clock) {
+	a.clock = clock
+	a.nonces.SetClock(clock)
+}
+
+// SetExporter streams rejected requests to a SIEM
+func (a *ServiceAuth) SetExporter(exporter *SIEMExporter) {
+	a.exporter = exporter
+}
+
+// Nonces returns the cache of nonces of accepted signed requests
+func (a *ServiceAuth) Nonces() *BoundedCache {
+	return a.nonces
+}
+
+// Authenticate returns a handler identifying internal producers. Requests with an invalid
+// signature are rejected; the identity of authenticated producers is stored in the
+// "service_identity" local. Unauthenticated requests are only let through when service
+// authentication is not required and their API key is not one of an internal producer.
+func (a *ServiceAuth) Authenticate() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		identity, err := a.identify(c)
+		if err != nil {
+			a.exporter.Export(requestSecurityEvent(c, SecurityAuth, "service_signature_invalid", OutcomeDenied, 7, map[string]interface{}{
+				"key_id": utils.CopyString(c.Get(HeaderServiceKeyID)),
+				"reason": err.Error(),
+			}))
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+
+		if identity == nil {
+			if a.required || a.serviceKeys[c.Get("X-API-Key")] {
+				a.exporter.Export(requestSecurityEvent(c, SecurityAuth, "service_auth_missing", OutcomeDenied, 6, nil))
+				return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Requests must be signed or use a client certificate",
+				})
+			}
+			return c.Next()
+		}
+
+		if identity.ProjectID != "" && identity.ProjectID != projectIDFromRequest(c) {
+			a.exporter.Export(requestSecurityEvent(c, SecurityAuth, "service_project_forbidden", OutcomeDenied, 6, map[string]interface{}{
+				"service":    identity.Name,
+				"project_id": projectIDFromRequest(c),
+			}))
+			return c.Status(http.StatusForbidden).JSON(fiber.Map{
+				"error": "Service " + identity.Name + " cannot submit events to this project",
+			})
+		}
+
+		c.Locals("service_identity", identity)
+		return c.Next()
+	}
+}
+
+// IsServiceKey reports whether an API key is one of an internal producer
+func (a *ServiceAuth) IsServiceKey(apiKey string) bool {
+	return a.serviceKeys[apiKey]
+}
+
+// hasServiceCredentials reports whether a request is signed or presents a verified client
+// certificate, without verifying the signature
+func hasServiceCredentials(c *fiber.Ctx) bool {
+	if c.Get(HeaderServiceSignature) != "" || c.Get(HeaderServiceKeyID) != "" {
+		return true
+	}
+	state := c.Context().TLSConnectionState()
+	return state != nil && len(state.VerifiedChains) > 0
+}
+
+// identify returns the producer that signed the request or presented a verified client
+// certificate, or nil for requests that did neither
+func (a *ServiceAuth) identify(c *fiber.Ctx) (*ServiceIdentity, error) {
+	if c.Get(HeaderServiceSignature) != "" || c.Get(HeaderServiceKeyID) != "" {
+		return a.verifySignature(c)
+	}
+
+	state := c.Context().TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	return &ServiceIdentity{
+		Name:   state.VerifiedChains[0][0].Subject.CommonName,
+		Method: ServiceAuthMTLS,
+	}, nil
+}
+
+// verifySignature checks the key, timestamp, nonce and signature of a signed request
+func (a *ServiceAuth) verifySignature(c *fiber.Ctx) (*ServiceIdentity, error) {
+	keyID := c.Get(HeaderServiceKeyID)
+	key, exists := a.keys[keyID]
+	if !exists {
+		return nil, fmt.Errorf("unknown service key")
+	}
+
+	timestamp, err := strconv.ParseInt(c.Get(HeaderServiceTimestamp), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s", HeaderServiceTimestamp)
+	}
+	skew := a.clock.Now().Sub(time.Unix(timestamp, 0))
+	if skew > a.maxSkew || skew < -a.maxSkew {
+		return nil, fmt.Errorf("request timestamp is outside the allowed clock skew of %s", a.maxSkew)
+	}
+
+	nonce := c.Get(HeaderServiceNonce)
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return nil, fmt.Errorf("%s must have 16 to 128 characters", HeaderServiceNonce)
+	}
+
+	expected := SignServiceRequest(key.secret, c.Method(), c.OriginalURL(), timestamp, nonce, c.Request().Body())
+	if !hmac.Equal([]byte(c.Get(HeaderServiceSignature)), []byte(expected)) {
+		return nil, fmt.Errorf("invalid request signature")
+	}
+
+	// Only requests with a valid signature record their nonce, so unsigned traffic cannot fill the cache
+	replayed := false
+	a.nonces.Update(keyID+"/"+nonce, func(value interface{}, exists bool) interface{} {
+		replayed = exists
+		return true
+	})
+	if replayed {
+		return nil, fmt.Errorf("request has already been submitted")
+	}
+
+	return &ServiceIdentity{Name: utils.CopyString(keyID), Method: ServiceAuthHMAC, ProjectID: key.projectID}, nil
+}
+
+// SignServiceRequest returns the signature of a request: the hex HMAC-SHA256 of its method, path
+// with query string, timestamp, nonce and the hex SHA-256 of its body, separated by newlines
+func SignServiceRequest(secret []byte, method, path string, timestamp int64, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%s", strings.ToUpper(method), path, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LoadServerTLSConfig returns the TLS configuration of the listener from TLS_CERT_FILE and
+// TLS_KEY_FILE, or nil to serve plain HTTP when they are unset. With TLS_CLIENT_CA_FILE, client
+// certificates are verified against its CAs; they are required when TLS_CLIENT_AUTH is "require"
+// and optional, for listeners shared with public SDKs, when it is "verify_if_given" (the default).
+func LoadServerTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	caFile := os.Getenv("TLS_CLIENT_CA_FILE")
+	if caFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS_CLIENT_CA_FILE: %w", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("TLS_CLIENT_CA_FILE contains no PEM certificates")
+	}
+
+	switch clientAuth := os.Getenv("TLS_CLIENT_AUTH"); clientAuth {
+	case "", "verify_if_given":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid TLS_CLIENT_AUTH: %s. Valid values are: verify_if_given, require", clientAuth)
+	}
+	return config, nil
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Properties of a session's context inherited by default: where its visitor came from and on what device
+var defaultSessionContextProperties = []string{"referrer", "utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content", "device"}
+
+// SessionContext merges the context of a web session, such as its referrer, UTM parameters and
+// device, into the events of the session that lack it, typically events emitted by backend
+// services with the session_id of the web SDK. The context is the first value each property had
+// in the session, by event time. Merging happens when events are read: stored events are left
+// unchanged, and context arriving after the server-side events still applies.
+type SessionContext struct {
+	properties []string
+}
+
+// sessionContextValue is a context property of a session with the time of the event it came from
+type sessionContextValue struct {
+	value interface{}
+	at    time.Time
+}
+
+// sessionContexts collects the contexts of the sessions of a project while its events are scanned
+type sessionContexts struct {
+	properties []string
+	sessions   map[string]map[string]sessionContextValue // Session ID -> property -> first value
+}
+
+// NewSessionContext creates a session context merger inheriting the comma-separated
+// SESSION_CONTEXT_PROPERTIES (default: referrer, the UTM parameters and device)
+func NewSessionContext() *SessionContext {
+	properties := defaultSessionContextProperties
+	if value := os.Getenv("SESSION_CONTEXT_PROPERTIES"); value != "" {
+		properties = nil
+		for _, property := range strings.Split(value, ",") {
+			if property = strings.TrimSpace(property); property != "" {
+				properties = append(properties, property)
+			}
+		}
+	}
+	return &SessionContext{properties: properties}
+}
+
+// Properties returns the properties events inherit from their session
+func (s *SessionContext) Properties() []string {
+	return s.properties
+}
+
+// collector returns an empty collection of session contexts
+func (s *SessionContext) collector() *sessionContexts {
+	return &sessionContexts{
+		properties: s.properties,
+		sessions:   make(map[string]map[string]sessionContextValue),
+	}
+}
+
+// add records the context properties of an event in its session, keeping the earliest values
+func (c *sessionContexts) add(event *AnalyticsEvent) {
+	if event.SessionID == "" || len(event.Properties) == 0 {
+		return
+	}
+
+	session := c.sessions[event.SessionID]
+	for _, property := range c.properties {
+		value, exists := event.Properties[property]
+		if !exists || value == nil || value == "" {
+			continue
+		}
+		if first, seen := session[property]; seen && !event.Timestamp.Before(first.at) {
+			continue
+		}
+		if session == nil {
+			session = make(map[string]sessionContextValue)
+			c.sessions[event.SessionID] = session
+		}
+		session[property] = sessionContextValue{value: value, at: event.Timestamp}
+	}
+}
+
+// apply returns the event with the context properties of its session it lacks, or the event
+// itself when it lacks none. Events whose properties were not stored are left as they are.
+func (c *sessionContexts) apply(event *AnalyticsEvent) *AnalyticsEvent {
+	session := c.sessions[event.SessionID]
+	if event.SessionID == "" || event.DetailDropped || len(session) == 0 {
+		return event
+	}
+
+	var inherited []string
+	for property := range session {
+		if _, exists := event.Properties[property]; !exists {
+			inherited = append(inherited, property)
+		}
+	}
+	if len(inherited) == 0 {
+		return event
+	}
+	sort.Strings(inherited)
+
+	merged := *event
+	merged.Properties = make(map[string]interface{}, len(event.Properties)+len(inherited))
+	for name, value := range event.Properties {
+		merged.Properties[name] = value
+	}
+	for _, property := range inherited {
+		merged.Properties[property] = session[property].value
+	}
+	merged.InheritedProperties = inherited
+	return &merged
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getSessions returns the project's sessions starting between ?start_date and ?end_date (default
+// the last 30 days), newest first, with their stats. ?user_id restricts them to a user and
+// ?limit (default 100) caps the sessions listed.
+func (s *App) getSessions(c *fiber.Ctx) error {
+	return s.sendSessions(c, utils.CopyString(c.Query("user_id")))
+}
+
+// getUserSessions returns the sessions of a user and their stats, such as the user's session
+// count, average duration and bounce rate, over the same parameters as getSessions
+func (s *App) getUserSessions(c *fiber.Ctx) error {
+	return s.sendSessions(c, utils.CopyString(c.Params("id")))
+}
+
+// sendSessions responds with the sessions of the request's project, of a user if set
+func (s *App) sendSessions(c *fiber.Ctx, userID string) error {
+	start, end, err := queryTimeRange(map[string]interface{}{
+		"start_date": c.Query("start_date"),
+		"end_date":   c.Query("end_date"),
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	query := SessionQuery{
+		Start:  start,
+		End:    end,
+		UserID: userID,
+		Limit:  c.QueryInt("limit", defaultSessionLimit),
+	}
+
+	projectID := projectIDFromRequest(c)
+	parameters := copyQueryParameters(c, "start_date", "end_date", "limit")
+	parameters["user_id"] = userID
+	parameters["region"] = regionFromRequest(c)
+	result, err := s.cachedQuery(c, "sessions", projectID, parameters, func() (interface{}, error) {
+		return s.sessionService.Sessions(ContextWithRegion(ContextWithProject(context.Background(), projectID), parameters["region"]), query)
+	})
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status": "success",
+		"result": result,
+	})
+}
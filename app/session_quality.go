@@ -0,0 +1,314 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Components of a session's quality score, named by the weights of the scoring model
+const (
+	SessionQualityDepth       = "depth"       // Distinct pages viewed, up to the depth target
+	SessionQualityDuration    = "duration"    // Time from the first to the last event, up to the duration target
+	SessionQualityConversions = "conversions" // Whether the session converted
+	SessionQualityRageClicks  = "rage_clicks" // Share of the maximum score each rage click costs
+)
+
+// defaultSessionQualityWeights weigh engagement and conversions, and penalize each rage click
+// with a tenth of the maximum score
+var defaultSessionQualityWeights = map[string]float64{
+	SessionQualityDepth:       0.3,
+	SessionQualityDuration:    0.3,
+	SessionQualityConversions: 0.4,
+	SessionQualityRageClicks:  0.1,
+}
+
+// Width of the score buckets of the quality report
+const sessionQualityBucketWidth = 20
+
+// SessionScore is the quality of a session, between 0 and 100, and the signals it was scored on
+type SessionScore struct {
+	Score       float64 `json:"score"`
+	Pages       int     `json:"pages"`
+	Conversions int     `json:"conversions"`
+	RageClicks  int     `json:"rage_clicks"`
+}
+
+// SessionQualityQuery selects the sessions of a quality report
+type SessionQualityQuery struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Limit int       `json:"limit,omitempty"` // Maximum number of lowest scoring sessions listed
+}
+
+// SessionQualityReport summarizes the quality of a project's sessions, for monitoring the quality
+// of its traffic
+type SessionQualityReport struct {
+	TimeRange    TimeRange              `json:"time_range"`
+	Sessions     int                    `json:"sessions"`
+	AverageScore float64                `json:"average_score"`
+	MedianScore  float64                `json:"median_score"`
+	Distribution []SessionQualityBucket `json:"distribution"` // Sessions per score range, lowest first
+	Sources      []SessionQualitySource `json:"sources"`      // Most sessions first
+	Lowest       []ScoredSession        `json:"lowest"`       // Lowest scores first
+	Weights      map[string]float64     `json:"weights"`
+	ComputedAt   time.Time              `json:"computed_at"`
+}
+
+// SessionQualityBucket counts the sessions scoring in [Min, Max), the last bucket including 100
+type SessionQualityBucket struct {
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	Sessions int     `json:"sessions"`
+}
+
+// SessionQualitySource is the quality of the sessions of a traffic source
+type SessionQualitySource struct {
+	Source       string  `json:"source"` // utm_source of the session
+	Sessions     int     `json:"sessions"`
+	AverageScore float64 `json:"average_score"`
+}
+
+// ScoredSession is a session of a quality report
+type ScoredSession struct {
+	SessionID string    `json:"session_id"`
+	UserID    string    `json:"user_id"`
+	Start     time.Time `json:"start"`
+	SessionScore
+}
+
+// SessionQuality scores sessions by their depth, duration, conversions and rage clicks, weighted
+// by a configurable model. Scores are computed from the session's events whenever sessions are read.
+type SessionQuality struct {
+	analyticsService *AnalyticsService
+	frustration      *FrustrationService // Detects the rage clicks of a session
+	weights          map[string]float64
+	conversions      map[string]bool // Event types converting a session
+	depthTarget      int             // Distinct pages of a session scoring the full depth
+	durationTarget   time.Duration   // Duration of a session scoring the full duration
+	mutex            sync.RWMutex
+}
+
+// NewSessionQuality creates a session scoring model configured from SESSION_QUALITY_WEIGHTS, a
+// comma-separated list of component:weight entries overriding the defaults,
+// SESSION_QUALITY_CONVERSIONS (default: purchase,signup), SESSION_QUALITY_DEPTH_TARGET (default 5
+// pages) and SESSION_QUALITY_DURATION_TARGET (default 5m)
+func NewSessionQuality(analyticsService *AnalyticsService, frustration *FrustrationService) *SessionQuality {
+	quality := &SessionQuality{
+		analyticsService: analyticsService,
+		frustration:      frustration,
+		weights:          defaultSessionQualityWeights,
+		conversions:      make(map[string]bool),
+		depthTarget:      max(getEnvInt("SESSION_QUALITY_DEPTH_TARGET", 5), 1),
+		durationTarget:   getEnvDuration("SESSION_QUALITY_DURATION_TARGET", 5*time.Minute),
+	}
+	if quality.durationTarget <= 0 {
+		quality.durationTarget = 5 * time.Minute
+	}
+
+	conversions := os.Getenv("SESSION_QUALITY_CONVERSIONS")
+	if conversions == "" {
+		conversions = "purchase,signup"
+	}
+	for _, eventType := range strings.Split(conversions, ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			quality.conversions[eventType] = true
+		}
+	}
+
+	if value := os.Getenv("SESSION_QUALITY_WEIGHTS"); value != "" {
+		weights, err := parseRates(value)
+		if err == nil {
+			err = quality.SetWeights(weights)
+		}
+		if err != nil {
+			log.Printf("Warning: Ignoring SESSION_QUALITY_WEIGHTS: %v", err)
+		}
+	}
+	return quality
+}
+
+// Weights returns the weight of each component of the score
+func (q *SessionQuality) Weights() map[string]float64 {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	weights := make(map[string]float64, len(q.weights))
+	for component, weight := range q.weights {
+		weights[component] = weight
+	}
+	return weights
+}
+
+// SetWeights changes the weights of the given components; the others keep their weight. Weights
+// must not be negative, and depth, duration and conversions must not all weigh 0.
+func (q *SessionQuality) SetWeights(weights map[string]float64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	updated := make(map[string]float64, len(q.weights))
+	for component, weight := range q.weights {
+		updated[component] = weight
+	}
+	for component, weight := range weights {
+		if _, exists := defaultSessionQualityWeights[component]; !exists {
+			return fmt.Errorf("unknown score component: %s. Valid components are: %s, %s, %s, %s", component,
+				SessionQualityDepth, SessionQualityDuration, SessionQualityConversions, SessionQualityRageClicks)
+		}
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("weight of %s must not be negative, got %v", component, weight)
+		}
+		updated[component] = weight
+	}
+	if updated[SessionQualityDepth]+updated[SessionQualityDuration]+updated[SessionQualityConversions] == 0 {
+		return fmt.Errorf("%s, %s or %s must have a weight", SessionQualityDepth, SessionQualityDuration, SessionQualityConversions)
+	}
+
+	q.weights = updated
+	return nil
+}
+
+// Score scores a session from its events, ordered by time. Depth, duration and conversions each
+// score between 0 and 1, and their weighted average makes the score out of 100. Each rage click
+// then costs its weight times 100. Scores are clamped to [0, 100].
+func (q *SessionQuality) Score(events []*AnalyticsEvent) SessionScore {
+	score := SessionScore{}
+	if len(events) == 0 {
+		return score
+	}
+
+	pages := make(map[string]bool)
+	var clicks []*AnalyticsEvent
+	q.mutex.RLock()
+	for _, event := range events {
+		if event.Page != "" {
+			pages[event.Page] = true
+		}
+		if q.conversions[event.EventType] {
+			score.Conversions++
+		}
+		if event.EventType == ClickEventType {
+			clicks = append(clicks, event)
+		}
+	}
+	weights := q.weights
+	depthTarget, durationTarget := q.depthTarget, q.durationTarget
+	q.mutex.RUnlock()
+
+	score.Pages = len(pages)
+	if q.frustration != nil {
+		score.RageClicks = len(q.frustration.rageClicks(clicks, make(map[string]bool)))
+	}
+
+	duration := events[len(events)-1].Timestamp.Sub(events[0].Timestamp)
+	engagement := weights[SessionQualityDepth]*math.Min(float64(score.Pages)/float64(depthTarget), 1) +
+		weights[SessionQualityDuration]*math.Min(float64(duration)/float64(durationTarget), 1) +
+		weights[SessionQualityConversions]*math.Min(float64(score.Conversions), 1)
+	total := weights[SessionQualityDepth] + weights[SessionQualityDuration] + weights[SessionQualityConversions]
+	value := 100*engagement/total - 100*weights[SessionQualityRageClicks]*float64(score.RageClicks)
+	score.Score = math.Round(math.Max(0, math.Min(100, value))*10) / 10
+	return score
+}
+
+// Report scores the project's sessions starting in the time range. Sessions are the events
+// sharing a session ID; their events after the end of the range are not scored.
+func (q *SessionQuality) Report(ctx context.Context, query SessionQualityQuery) (*SessionQualityReport, error) {
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	if query.Limit <= 0 {
+		query.Limit = 10
+	}
+
+	events := q.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		Start:     query.Start,
+		End:       query.End,
+	})
+	var sessionIDs []string
+	sessionEvents := make(map[string][]*AnalyticsEvent)
+	for _, event := range events {
+		if event.SessionID == "" {
+			continue
+		}
+		if _, exists := sessionEvents[event.SessionID]; !exists {
+			sessionIDs = append(sessionIDs, event.SessionID)
+		}
+		sessionEvents[event.SessionID] = append(sessionEvents[event.SessionID], event)
+	}
+
+	report := &SessionQualityReport{
+		TimeRange:    TimeRange{Start: query.Start, End: query.End},
+		Sessions:     len(sessionIDs),
+		Distribution: make([]SessionQualityBucket, 100/sessionQualityBucketWidth),
+		Sources:      []SessionQualitySource{},
+		Lowest:       []ScoredSession{},
+		Weights:      q.Weights(),
+		ComputedAt:   time.Now(),
+	}
+	for i := range report.Distribution {
+		report.Distribution[i] = SessionQualityBucket{Min: float64(i * sessionQualityBucketWidth), Max: float64((i + 1) * sessionQualityBucketWidth)}
+	}
+
+	sessions := make([]ScoredSession, 0, len(sessionIDs))
+	sources := make(map[string]*SessionQualitySource)
+	var total float64
+	for _, sessionID := range sessionIDs {
+		events := sessionEvents[sessionID]
+		session := ScoredSession{
+			SessionID:    sessionID,
+			UserID:       events[0].UserID,
+			Start:        events[0].Timestamp,
+			SessionScore: q.Score(events),
+		}
+		sessions = append(sessions, session)
+		total += session.Score
+
+		bucket := min(int(session.Score)/sessionQualityBucketWidth, len(report.Distribution)-1)
+		report.Distribution[bucket].Sessions++
+
+		name := rollupValue(events[0].Properties["utm_source"])
+		source, exists := sources[name]
+		if !exists {
+			source = &SessionQualitySource{Source: name}
+			sources[name] = source
+		}
+		source.Sessions++
+		source.AverageScore += session.Score // Summed until all sessions are scored
+	}
+	if len(sessions) == 0 {
+		return report, nil
+	}
+
+	report.AverageScore = math.Round(total/float64(len(sessions))*10) / 10
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Score != sessions[j].Score {
+			return sessions[i].Score < sessions[j].Score
+		}
+		return sessions[i].SessionID < sessions[j].SessionID
+	})
+	middle := len(sessions) / 2
+	report.MedianScore = sessions[middle].Score
+	if len(sessions)%2 == 0 {
+		report.MedianScore = math.Round((sessions[middle-1].Score+sessions[middle].Score)/2*10) / 10
+	}
+	report.Lowest = sessions[:min(query.Limit, len(sessions))]
+
+	for _, source := range sources {
+		source.AverageScore = math.Round(source.AverageScore/float64(source.Sessions)*10) / 10
+		report.Sources = append(report.Sources, *source)
+	}
+	sort.Slice(report.Sources, func(i, j int) bool {
+		if report.Sources[i].Sessions != report.Sources[j].Sessions {
+			return report.Sources[i].Sessions > report.Sources[j].Sessions
+		}
+		return report.Sources[i].Source < report.Sources[j].Source
+	})
+	return report, nil
+}
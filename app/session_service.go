@@ -0,0 +1,245 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Limits of session queries
+const (
+	defaultSessionLimit = 100
+	maxSessionLimit     = 1000
+)
+
+// Session is a visit of a user: their events until they were inactive for the inactivity timeout
+// or the client started a new session
+type Session struct {
+	ID              string    `json:"id"` // Derived from the user and start, so it is stable across reads
+	UserID          string    `json:"user_id"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"` // Time of the last event
+	DurationSeconds float64   `json:"duration_seconds"`
+	EventCount      int       `json:"event_count"`
+	PageCount       int       `json:"page_count"` // Events with a page, i.e. page views
+	EntryPage       string    `json:"entry_page,omitempty"`
+	ExitPage        string    `json:"exit_page,omitempty"`
+	Bounce          bool      `json:"bounce"`                      // At most one page viewed
+	ClientSessionID string    `json:"client_session_id,omitempty"` // Session ID the SDK sent
+}
+
+// SessionStats summarizes sessions
+type SessionStats struct {
+	Sessions               int        `json:"sessions"`
+	Users                  int        `json:"users"`
+	TotalDurationSeconds   float64    `json:"total_duration_seconds"`
+	AverageDurationSeconds float64    `json:"average_duration_seconds"`
+	AveragePageCount       float64    `json:"average_page_count"`
+	AverageEventCount      float64    `json:"average_event_count"`
+	BounceRate             float64    `json:"bounce_rate"` // Share of sessions that bounced, in percent
+	FirstSession           *time.Time `json:"first_session,omitempty"`
+	LastSession            *time.Time `json:"last_session,omitempty"`
+}
+
+// SessionQuery selects sessions starting in a time range
+type SessionQuery struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	UserID string    `json:"user_id,omitempty"` // Sessions of a single user, including merged IDs
+	Limit  int       `json:"limit,omitempty"`   // Sessions listed, newest first; the stats cover all of them
+}
+
+// SessionList is the sessions of a query with their stats
+type SessionList struct {
+	TimeRange         TimeRange    `json:"time_range"`
+	UserID            string       `json:"user_id,omitempty"`
+	InactivityTimeout string       `json:"inactivity_timeout"`
+	Stats             SessionStats `json:"stats"`
+	Sessions          []*Session   `json:"sessions"`
+	Truncated         bool         `json:"truncated"` // More sessions matched than the limit
+	ComputedAt        time.Time    `json:"computed_at"`
+}
+
+// SessionService stitches the events of each user into sessions. A session ends once its user is
+// inactive for the inactivity timeout, or when the SDK sends a different session ID; events
+// without a session ID continue the current session. Sessions are stitched from the stored events
+// whenever they are read, so identity merges, late events and deletions are reflected in them.
+type SessionService struct {
+	analyticsService  *AnalyticsService
+	inactivityTimeout time.Duration
+	maxDuration       time.Duration // Sessions are split once they last this long
+}
+
+// NewSessionService creates a session service ending sessions after SESSION_INACTIVITY_TIMEOUT
+// (default 30m) of inactivity, and splitting sessions lasting longer than SESSION_MAX_DURATION
+// (default 24h)
+func NewSessionService(analyticsService *AnalyticsService) *SessionService {
+	service := &SessionService{
+		analyticsService:  analyticsService,
+		inactivityTimeout: getEnvDuration("SESSION_INACTIVITY_TIMEOUT", 30*time.Minute),
+		maxDuration:       getEnvDuration("SESSION_MAX_DURATION", 24*time.Hour),
+	}
+	if service.inactivityTimeout <= 0 {
+		service.inactivityTimeout = 30 * time.Minute
+	}
+	if service.maxDuration < service.inactivityTimeout {
+		service.maxDuration = 24 * time.Hour
+	}
+	return service
+}
+
+// InactivityTimeout returns the inactivity ending a session
+func (s *SessionService) InactivityTimeout() time.Duration {
+	return s.inactivityTimeout
+}
+
+// Sessions returns the sessions of the context's project starting in the time range, newest
+// first, with their stats. Sessions still going on at the end of the range are cut at its end.
+func (s *SessionService) Sessions(ctx context.Context, query SessionQuery) (*SessionList, error) {
+	if !query.End.After(query.Start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultSessionLimit
+	}
+	if query.Limit > maxSessionLimit {
+		return nil, fmt.Errorf("limit must be at most %d", maxSessionLimit)
+	}
+	computeStart := time.Now()
+
+	// Sessions started before the range are stitched so their later events are not taken for new
+	// sessions; they last at most the maximum duration
+	events := s.analyticsService.QueryEvents(ctx, EventFilter{
+		ProjectID: ProjectFromContext(ctx),
+		UserID:    query.UserID,
+		Start:     query.Start.Add(-s.maxDuration),
+		End:       query.End,
+	})
+	var sessions []*Session
+	for _, session := range s.Stitch(events) {
+		if !session.Start.Before(query.Start) {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].Start.Equal(sessions[j].Start) {
+			return sessions[i].Start.After(sessions[j].Start)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+
+	list := &SessionList{
+		TimeRange:         TimeRange{Start: query.Start, End: query.End},
+		InactivityTimeout: s.inactivityTimeout.String(),
+		Stats:             SummarizeSessions(sessions),
+		Sessions:          sessions[:min(query.Limit, len(sessions))],
+		Truncated:         len(sessions) > query.Limit,
+		ComputedAt:        time.Now(),
+	}
+	if query.UserID != "" {
+		list.UserID = s.analyticsService.identities.Resolve(ProjectFromContext(ctx), query.UserID)
+	}
+	if list.Sessions == nil {
+		list.Sessions = []*Session{}
+	}
+
+	s.analyticsService.SlowOperations().Observe(SlowOperationSessions, map[string]interface{}{
+		"user_id": query.UserID,
+		"start":   query.Start,
+		"end":     query.End,
+	}, time.Since(computeStart), int64(len(events)), s.analyticsService.calculateAPICallCost("/api/v1/sessions", "GET"))
+
+	return list, nil
+}
+
+// Stitch groups events, ordered by time, into the sessions of their users, in the order the
+// sessions started
+func (s *SessionService) Stitch(events []*AnalyticsEvent) []*Session {
+	var sessions []*Session
+	current := make(map[string]*Session) // Open session of each user
+	for _, event := range events {
+		session := current[event.UserID]
+		if session == nil || s.endsSession(session, event) {
+			session = &Session{
+				ID:     sessionID(event.UserID, event.Timestamp),
+				UserID: event.UserID,
+				Start:  event.Timestamp,
+			}
+			current[event.UserID] = session
+			sessions = append(sessions, session)
+		}
+
+		session.End = event.Timestamp
+		session.EventCount++
+		if event.Page != "" {
+			session.PageCount++
+			if session.EntryPage == "" {
+				session.EntryPage = event.Page
+			}
+			session.ExitPage = event.Page
+		}
+		if session.ClientSessionID == "" {
+			session.ClientSessionID = event.SessionID
+		}
+	}
+
+	for _, session := range sessions {
+		session.DurationSeconds = session.End.Sub(session.Start).Seconds()
+		session.Bounce = session.PageCount <= 1
+	}
+	return sessions
+}
+
+// endsSession reports whether an event starts a new session after the user's current one
+func (s *SessionService) endsSession(session *Session, event *AnalyticsEvent) bool {
+	if event.Timestamp.Sub(session.End) > s.inactivityTimeout || event.Timestamp.Sub(session.Start) >= s.maxDuration {
+		return true
+	}
+	return event.SessionID != "" && session.ClientSessionID != "" && event.SessionID != session.ClientSessionID
+}
+
+// SummarizeSessions returns the stats of sessions
+func SummarizeSessions(sessions []*Session) SessionStats {
+	stats := SessionStats{Sessions: len(sessions)}
+	if len(sessions) == 0 {
+		return stats
+	}
+
+	users := make(map[string]bool)
+	var pages, events, bounces int
+	for _, session := range sessions {
+		users[session.UserID] = true
+		stats.TotalDurationSeconds += session.DurationSeconds
+		pages += session.PageCount
+		events += session.EventCount
+		if session.Bounce {
+			bounces++
+		}
+		if stats.FirstSession == nil || session.Start.Before(*stats.FirstSession) {
+			start := session.Start
+			stats.FirstSession = &start
+		}
+		if stats.LastSession == nil || session.Start.After(*stats.LastSession) {
+			start := session.Start
+			stats.LastSession = &start
+		}
+	}
+
+	count := float64(len(sessions))
+	stats.Users = len(users)
+	stats.AverageDurationSeconds = stats.TotalDurationSeconds / count
+	stats.AveragePageCount = float64(pages) / count
+	stats.AverageEventCount = float64(events) / count
+	stats.BounceRate = float64(bounces) / count * 100
+	return stats
+}
+
+// sessionID returns the ID of the session of a user starting at a time
+func sessionID(userID string, start time.Time) string {
+	hash := sha256.Sum256([]byte(userID + "|" + strconv.FormatInt(start.UnixNano(), 10)))
+	return hex.EncodeToString(hash[:8])
+}
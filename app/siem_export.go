@@ -0,0 +1,552 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/google/uuid"
+)
+
+// Categories of the security events exported to a SIEM
+const (
+	SecurityAdmin   = "admin"   // Administrative changes, as recorded in the audit log
+	SecurityAuth    = "auth"    // Rejected admin, share and public dashboard tokens
+	SecurityExport  = "export"  // Data leaving the service: configuration exports, share links and public dashboard tokens
+	SecurityAnomaly = "anomaly" // Traffic alerts fired and resolved: spikes from a single client, malformed or misordered events
+)
+
+// securityCategories lists every category, in the order they are documented
+var securityCategories = []string{SecurityAdmin, SecurityAuth, SecurityExport, SecurityAnomaly}
+
+// Outcomes of the actions of security events
+const (
+	OutcomeSuccess  = "success"
+	OutcomeDenied   = "denied"
+	OutcomeDetected = "detected" // An anomaly started
+	OutcomeResolved = "resolved" // An anomaly ended
+)
+
+// Formats security events are exported in
+const (
+	SIEMFormatJSON = "json"
+	SIEMFormatCEF  = "cef" // ArcSight Common Event Format
+)
+
+// SecurityEvent is a security-relevant action exported to the SIEM
+type SecurityEvent struct {
+	ID        string                 `json:"id"`
+	Sequence  int64                  `json:"sequence"` // Increases by one per exported event, so the SIEM can detect gaps
+	Timestamp time.Time              `json:"timestamp"`
+	Category  string                 `json:"category"`
+	Action    string                 `json:"action"`
+	Outcome   string                 `json:"outcome"`
+	Severity  int                    `json:"severity"` // 0 (lowest) to 10, as in CEF
+	Actor     string                 `json:"actor,omitempty"`
+	Resource  string                 `json:"resource,omitempty"`
+	SourceIP  string                 `json:"source_ip,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// SIEMStats describes the export of security events
+type SIEMStats struct {
+	Enabled     bool       `json:"enabled"`
+	Endpoint    string     `json:"endpoint,omitempty"` // Without credentials, path or query
+	Format      string     `json:"format,omitempty"`
+	Categories  []string   `json:"categories,omitempty"`
+	Queued      int        `json:"queued"`
+	Capacity    int        `json:"capacity"`
+	Sent        int64      `json:"sent"`
+	Failed      int64      `json:"failed"`  // Given up on after the retries
+	Dropped     int64      `json:"dropped"` // Not queued because the queue was full
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// queuedSecurityEvent is an event waiting to be sent, formatted when it was exported so later
+// changes to its details are not exported
+type queuedSecurityEvent struct {
+	event   SecurityEvent
+	payload []byte
+}
+
+// siemTransport delivers formatted security events to a SIEM
+type siemTransport interface {
+	Send(event SecurityEvent, payload []byte) error
+	Close() error
+}
+
+// SIEMExporter streams security events to an external SIEM over syslog or HTTPS, as JSON or CEF.
+// Events are sent in order by a single goroutine from a bounded queue, so exporting never blocks
+// a request; events are dropped and counted when the queue is full. Events are only ever
+// appended: their sequence numbers let the SIEM detect events that were dropped or failed.
+type SIEMExporter struct {
+	transport   siemTransport // nil when export is disabled
+	endpoint    string
+	format      string
+	categories  map[string]bool
+	exportKeys  *ExportKeys // Details of events of projects requiring encrypted exports are encrypted to their keys
+	queue       chan queuedSecurityEvent
+	maxRetries  int
+	retryDelay  time.Duration // Doubled after every failed attempt
+	sequence    int64
+	sent        int64
+	failed      int64
+	dropped     int64
+	lastError   string
+	lastErrorAt time.Time
+	stopped     bool
+	quit        chan struct{} // Closed when stopping, so failed events are no longer retried
+	done        chan struct{}
+	mutex       sync.RWMutex
+}
+
+// NewSIEMExporter creates an exporter configured from SIEM_ENDPOINT, SIEM_FORMAT, SIEM_TOKEN,
+// SIEM_CATEGORIES, SIEM_QUEUE_CAPACITY, SIEM_MAX_RETRIES and SIEM_RETRY_DELAY. Export is disabled
+// when SIEM_ENDPOINT is unset or invalid.
+func NewSIEMExporter() *SIEMExporter {
+	exporter := &SIEMExporter{
+		format:     strings.ToLower(os.Getenv("SIEM_FORMAT")),
+		categories: make(map[string]bool),
+		maxRetries: getEnvInt("SIEM_MAX_RETRIES", 3),
+		retryDelay: getEnvDuration("SIEM_RETRY_DELAY", time.Second),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if exporter.format == "" {
+		exporter.format = SIEMFormatJSON
+	}
+
+	endpoint := os.Getenv("SIEM_ENDPOINT")
+	if endpoint == "" {
+		close(exporter.done)
+		return exporter
+	}
+
+	err := exporter.configure(endpoint, os.Getenv("SIEM_TOKEN"), os.Getenv("SIEM_CATEGORIES"))
+	if err != nil {
+		log.Printf("Error: SIEM export is disabled: %v", err)
+		exporter.transport = nil
+		close(exporter.done)
+		return exporter
+	}
+
+	exporter.queue = make(chan queuedSecurityEvent, getEnvInt("SIEM_QUEUE_CAPACITY", 10000))
+	go exporter.run()
+	log.Printf("Exporting security events to %s as %s", exporter.endpoint, exporter.format)
+	return exporter
+}
+
+// configure validates the format and categories and creates the transport of the endpoint
+func (e *SIEMExporter) configure(endpoint, token, categories string) error {
+	if e.format != SIEMFormatJSON && e.format != SIEMFormatCEF {
+		return fmt.Errorf("invalid SIEM_FORMAT: %s. Valid formats are: %s, %s", e.format, SIEMFormatJSON, SIEMFormatCEF)
+	}
+
+	if strings.TrimSpace(categories) == "" {
+		categories = strings.Join(securityCategories, ",")
+	}
+	for _, category := range strings.Split(categories, ",") {
+		category = strings.TrimSpace(category)
+		valid := false
+		for _, known := range securityCategories {
+			valid = valid || category == known
+		}
+		if !valid {
+			return fmt.Errorf("invalid SIEM_CATEGORIES entry: %s. Valid categories are: %s", category, strings.Join(securityCategories, ", "))
+		}
+		e.categories[category] = true
+	}
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("invalid SIEM_ENDPOINT, expected https://host/path or syslog+tcp://host:port")
+	}
+	e.endpoint = parsed.Scheme + "://" + parsed.Host
+
+	switch parsed.Scheme {
+	case "https", "http":
+		if parsed.Scheme == "http" {
+			log.Printf("Warning: Security events are exported to the SIEM without TLS")
+		}
+		contentType := "application/json"
+		if e.format == SIEMFormatCEF {
+			contentType = "text/plain"
+		}
+		e.transport = &httpSIEMTransport{
+			url:         endpoint,
+			token:       token,
+			contentType: contentType,
+			client:      &http.Client{Timeout: 10 * time.Second},
+		}
+	case "syslog+tcp", "syslog+udp", "syslog+tls":
+		if parsed.Port() == "" {
+			return fmt.Errorf("invalid SIEM_ENDPOINT, syslog endpoints require a port")
+		}
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "-"
+		}
+		e.transport = &syslogSIEMTransport{
+			network:  strings.TrimPrefix(parsed.Scheme, "syslog+"),
+			address:  parsed.Host,
+			hostname: hostname,
+		}
+	default:
+		return fmt.Errorf("unsupported SIEM_ENDPOINT scheme: %s. Use https, syslog+tcp, syslog+tls or syslog+udp", parsed.Scheme)
+	}
+	return nil
+}
+
+// Enabled reports whether security events are exported
+func (e *SIEMExporter) Enabled() bool {
+	return e != nil && e.transport != nil
+}
+
+// SetExportKeys encrypts the details of the events of projects requiring encrypted exports to
+// their export keys
+func (e *SIEMExporter) SetExportKeys(keys *ExportKeys) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.exportKeys = keys
+}
+
+// Export queues a security event for the SIEM. It is numbered and stamped with an ID and, unless
+// set, the current time. Events of categories that are not exported are ignored.
+func (e *SIEMExporter) Export(event SecurityEvent) {
+	if !e.Enabled() || !e.categories[event.Category] {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	event.ID = uuid.New().String()
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.sequence++
+	event.Sequence = e.sequence
+	event.Details = e.sealDetails(event.Details)
+	if e.stopped {
+		e.dropped++
+		return
+	}
+	select {
+	case e.queue <- queuedSecurityEvent{event: event, payload: formatSecurityEvent(event, e.format)}:
+	default:
+		e.dropped++
+		log.Printf("Warning: SIEM export queue is full, dropping security event %d (%s)", event.Sequence, event.Action)
+	}
+}
+
+// sealDetails replaces the details of an event of a project requiring encrypted exports with their
+// base64-encoded age encryption to the project's export keys, keeping only the project ID readable so
+// the SIEM can still route the event. Details that cannot be encrypted are dropped. Callers must
+// hold the lock.
+func (e *SIEMExporter) sealDetails(details map[string]interface{}) map[string]interface{} {
+	projectID, _ := details["project_id"].(string)
+	if e.exportKeys == nil || projectID == "" || !e.exportKeys.Required(projectID) {
+		return details
+	}
+
+	sealed := map[string]interface{}{"project_id": projectID}
+	document, err := json.Marshal(details)
+	if err == nil {
+		document, err = e.exportKeys.Seal(projectID, document)
+	}
+	if err != nil {
+		log.Printf("Warning: Failed to encrypt security event details of project %s, dropping them: %v", projectID, err)
+		return sealed
+	}
+	sealed["encrypted_details"] = base64.StdEncoding.EncodeToString(document)
+	return sealed
+}
+
+// Stop sends the queued events, without retrying them, and closes the connection to the SIEM
+func (e *SIEMExporter) Stop() {
+	if !e.Enabled() {
+		return
+	}
+
+	e.mutex.Lock()
+	if !e.stopped {
+		e.stopped = true
+		close(e.quit)
+		close(e.queue)
+	}
+	e.mutex.Unlock()
+	<-e.done
+}
+
+// Stats returns the configuration and delivery counters of the export
+func (e *SIEMExporter) Stats() SIEMStats {
+	if !e.Enabled() {
+		return SIEMStats{}
+	}
+
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	stats := SIEMStats{
+		Enabled:   true,
+		Endpoint:  e.endpoint,
+		Format:    e.format,
+		Queued:    len(e.queue),
+		Capacity:  cap(e.queue),
+		Sent:      atomic.LoadInt64(&e.sent),
+		Failed:    atomic.LoadInt64(&e.failed),
+		Dropped:   e.dropped,
+		LastError: e.lastError,
+	}
+	for category := range e.categories {
+		stats.Categories = append(stats.Categories, category)
+	}
+	sort.Strings(stats.Categories)
+	if !e.lastErrorAt.IsZero() {
+		lastErrorAt := e.lastErrorAt
+		stats.LastErrorAt = &lastErrorAt
+	}
+	return stats
+}
+
+// WriteMetrics writes the export counters in the Prometheus text exposition format
+func (e *SIEMExporter) WriteMetrics(w io.Writer) error {
+	stats := e.Stats()
+	_, err := fmt.Fprintf(w, "# HELP analytics_siem_queued Security events waiting to be exported.\n# TYPE analytics_siem_queued gauge\nanalytics_siem_queued %d\n"+
+		"# HELP analytics_siem_events_total Security events by export outcome.\n# TYPE analytics_siem_events_total counter\n"+
+		"analytics_siem_events_total{outcome=\"sent\"} %d\nanalytics_siem_events_total{outcome=\"failed\"} %d\nanalytics_siem_events_total{outcome=\"dropped\"} %d\n",
+		stats.Queued, stats.Sent, stats.Failed, stats.Dropped)
+	return err
+}
+
+// run delivers queued events until the queue is closed
+func (e *SIEMExporter) run() {
+	defer close(e.done)
+	for queued := range e.queue {
+		e.deliver(queued.event, queued.payload)
+	}
+	if err := e.transport.Close(); err != nil {
+		log.Printf("Warning: Failed to close the SIEM connection: %v", err)
+	}
+}
+
+// deliver sends an event, retrying with exponential backoff
+func (e *SIEMExporter) deliver(event SecurityEvent, payload []byte) {
+	err := e.transport.Send(event, payload)
+	for attempt := 0; err != nil && attempt < e.maxRetries; attempt++ {
+		select {
+		case <-time.After(e.retryDelay << attempt):
+		case <-e.quit:
+			attempt = e.maxRetries
+			continue
+		}
+		err = e.transport.Send(event, payload)
+	}
+	if err == nil {
+		atomic.AddInt64(&e.sent, 1)
+		return
+	}
+
+	atomic.AddInt64(&e.failed, 1)
+	e.mutex.Lock()
+	e.lastError = err.Error()
+	e.lastErrorAt = time.Now()
+	e.mutex.Unlock()
+	log.Printf("Warning: Failed to export security event %d (%s) to the SIEM: %v", event.Sequence, event.Action, err)
+}
+
+// requestSecurityEvent describes an action of a request: its admin actor or user, client IP and path
+func requestSecurityEvent(c *fiber.Ctx, category, action, outcome string, severity int, details map[string]interface{}) SecurityEvent {
+	actor, ok := c.Locals("admin_actor").(string)
+	if !ok {
+		actor = c.Get("X-User-ID")
+	}
+	if actor == "" {
+		actor = "anonymous"
+	}
+	return SecurityEvent{
+		Category: category,
+		Action:   action,
+		Outcome:  outcome,
+		Severity: severity,
+		Actor:    utils.CopyString(actor),
+		Resource: utils.CopyString(c.Path()),
+		SourceIP: c.IP(),
+		Details:  details,
+	}
+}
+
+// formatSecurityEvent formats an event as a JSON object or a CEF record
+func formatSecurityEvent(event SecurityEvent, format string) []byte {
+	if format == SIEMFormatCEF {
+		return []byte(formatCEF(event))
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		// Details that cannot be encoded are replaced rather than losing the event
+		event.Details = map[string]interface{}{"error": err.Error()}
+		payload, _ = json.Marshal(event)
+	}
+	return payload
+}
+
+// formatCEF formats an event as a CEF record, with the action as its signature and name
+func formatCEF(event SecurityEvent) string {
+	var record strings.Builder
+	fmt.Fprintf(&record, "CEF:0|Magebase|Analytics|1|%s|%s|%d|", cefHeader(event.Action), cefHeader(event.Action), event.Severity)
+
+	extensions := []string{
+		"rt=" + strconv.FormatInt(event.Timestamp.UnixMilli(), 10),
+		"externalId=" + cefValue(event.ID),
+		"cat=" + cefValue(event.Category),
+		"act=" + cefValue(event.Action),
+		"outcome=" + cefValue(event.Outcome),
+		"cn1Label=sequence",
+		"cn1=" + strconv.FormatInt(event.Sequence, 10),
+	}
+	if event.Actor != "" {
+		extensions = append(extensions, "suser="+cefValue(event.Actor))
+	}
+	if event.SourceIP != "" {
+		extensions = append(extensions, "src="+cefValue(event.SourceIP))
+	}
+	if event.Resource != "" {
+		extensions = append(extensions, "cs1Label=resource", "cs1="+cefValue(event.Resource))
+	}
+	if len(event.Details) > 0 {
+		if details, err := json.Marshal(event.Details); err == nil {
+			extensions = append(extensions, "msg="+cefValue(string(details)))
+		}
+	}
+	record.WriteString(strings.Join(extensions, " "))
+	return record.String()
+}
+
+// cefHeader escapes a CEF header field
+func cefHeader(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ").Replace(value)
+}
+
+// cefValue escapes a CEF extension value
+func cefValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
+
+// httpSIEMTransport posts every event to an HTTPS collector
+type httpSIEMTransport struct {
+	url         string
+	token       string // Sent as a bearer token, if set
+	contentType string
+	client      *http.Client
+}
+
+// Send posts an event, failing on responses other than 2xx
+func (t *httpSIEMTransport) Send(event SecurityEvent, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", t.contentType)
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("SIEM collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close releases idle connections
+func (t *httpSIEMTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
+
+// syslogSIEMTransport sends events as RFC 5424 syslog messages of the log audit facility. TCP and
+// TLS messages are framed by octet counting (RFC 6587); UDP sends a datagram per message.
+type syslogSIEMTransport struct {
+	network  string // tcp, tls or udp
+	address  string
+	hostname string
+	conn     net.Conn // Dialed on first use and after failures
+}
+
+// syslogAuditFacility is the log audit facility of RFC 5424
+const syslogAuditFacility = 13
+
+// Send writes an event to the syslog connection, reconnecting when it was lost
+func (t *syslogSIEMTransport) Send(event SecurityEvent, payload []byte) error {
+	if t.conn == nil {
+		var err error
+		dialer := &net.Dialer{Timeout: 5 * time.Second}
+		if t.network == "tls" {
+			t.conn, err = tls.DialWithDialer(dialer, "tcp", t.address, &tls.Config{MinVersion: tls.VersionTLS12})
+		} else {
+			t.conn, err = dialer.Dial(t.network, t.address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	message := fmt.Sprintf("<%d>1 %s %s analytics - %s - %s", syslogAuditFacility*8+syslogSeverity(event.Severity),
+		event.Timestamp.UTC().Format(time.RFC3339Nano), t.hostname, event.Category, payload)
+	if t.network != "udp" {
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+
+	t.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(t.conn, message); err != nil {
+		t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the syslog connection
+func (t *syslogSIEMTransport) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// syslogSeverity maps a CEF severity (0 to 10) to a syslog severity
+func syslogSeverity(severity int) int {
+	switch {
+	case severity >= 9:
+		return 2 // Critical
+	case severity >= 7:
+		return 4 // Warning
+	case severity >= 4:
+		return 5 // Notice
+	default:
+		return 6 // Informational
+	}
+}
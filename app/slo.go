@@ -0,0 +1,422 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Service level objectives of the ingestion endpoints
+const (
+	SLOIngestionAvailability = "ingestion_availability" // Ingestion requests answered without a 5xx
+	SLOIngestionLatency      = "ingestion_latency"      // Ingestion requests answered within the latency threshold
+)
+
+// defaultSLORoutes are the ingestion routes the objectives cover
+const defaultSLORoutes = "POST /api/v1/analytics/events,POST /api/v1/analytics/mobile/batch"
+
+// SLODefinition is a service level objective: the share of requests that must be good over the
+// SLO window
+type SLODefinition struct {
+	Name               string  `json:"name"`
+	Description        string  `json:"description"`
+	Objective          float64 `json:"objective"`                      // E.g. 0.999 for 99.9%
+	LatencyThresholdMs int64   `json:"latency_threshold_ms,omitempty"` // Slowest good response of latency objectives
+}
+
+// SLOStatus is how an objective is met over the SLO window, and how fast its error budget burns
+type SLOStatus struct {
+	SLODefinition
+	Requests             int64              `json:"requests"`
+	BadRequests          int64              `json:"bad_requests"`
+	SLI                  float64            `json:"sli"`                    // Share of good requests, 1 without requests
+	ErrorBudget          float64            `json:"error_budget"`           // Bad requests the objective allows
+	ErrorBudgetRemaining float64            `json:"error_budget_remaining"` // Share of the budget left, negative once overspent
+	BurnRates            map[string]float64 `json:"burn_rates"`             // By alert window; 1 spends the budget exactly over the SLO window
+	Alerting             bool               `json:"alerting"`
+}
+
+// SLOAlert fires when an objective burns its error budget too fast over both alert windows
+type SLOAlert struct {
+	ID            string     `json:"id"`
+	SLO           string     `json:"slo"`
+	BurnRate      float64    `json:"burn_rate"`       // Over the long alert window when it last held
+	ShortBurnRate float64    `json:"short_burn_rate"` // Over the short alert window when it last held
+	Threshold     float64    `json:"threshold"`
+	FiredAt       time.Time  `json:"fired_at"`
+	ResolvedAt    *time.Time `json:"resolved_at,omitempty"`
+}
+
+// SLOReport reports the objectives of the service and their alerts
+type SLOReport struct {
+	Window             string      `json:"window"`
+	Routes             []string    `json:"routes"`
+	AlertWindows       []string    `json:"alert_windows"` // Long, then short
+	BurnRateThreshold  float64     `json:"burn_rate_threshold"`
+	SLOs               []SLOStatus `json:"slos"`
+	Firing             []SLOAlert  `json:"firing"`
+	Resolved           []SLOAlert  `json:"resolved"` // Most recent first
+	ComputedAt         time.Time   `json:"computed_at"`
+	TrackingStartedAt  time.Time   `json:"tracking_started_at"`
+	WindowFullyTracked bool        `json:"window_fully_tracked"` // False until the service ran a full SLO window
+}
+
+// isSLOAlert reports whether a payload is an SLO alert
+func isSLOAlert(payload interface{}) bool {
+	alert, ok := payload.(*SLOAlert)
+	return ok && alert != nil
+}
+
+// sloBucket counts the ingestion requests of a minute
+type sloBucket struct {
+	requests int64
+	errors   int64 // Answered with a 5xx
+	slow     int64 // Answered without a 5xx, slower than the latency threshold
+}
+
+// SLOTracker computes the error budgets of the ingestion objectives from the API usage records of
+// the tracking middleware, counted per minute over the SLO window. Alerts follow the multiwindow
+// burn rate pattern: an objective alerts while it burns its budget at least the threshold times
+// faster than the SLO window allows over both the long and the short alert window, so short spikes
+// do not page and alerts resolve soon after the burn stops. Alerts are evaluated on the first
+// record, report or metrics scrape of every minute.
+type SLOTracker struct {
+	slos              []SLODefinition
+	routes            map[string]bool // "METHOD route" of the requests counted
+	latencyThreshold  time.Duration
+	window            time.Duration
+	longWindow        time.Duration
+	shortWindow       time.Duration
+	burnRateThreshold float64
+	maxResolved       int
+
+	buckets   map[time.Time]*sloBucket // By minute
+	firing    map[string]*SLOAlert     // By objective
+	resolved  []SLOAlert               // Oldest first
+	evaluated time.Time                // Minute alerts were last evaluated in
+	startedAt time.Time
+	bus       *EventBus
+	clock     Clock
+	mutex     sync.Mutex
+}
+
+// NewSLOTracker creates the ingestion objectives configured from SLO_INGESTION_AVAILABILITY
+// (default 0.999), SLO_INGESTION_LATENCY (0.99), SLO_INGESTION_LATENCY_THRESHOLD (500ms),
+// SLO_INGESTION_ROUTES, SLO_WINDOW (720h), SLO_BURN_RATE_ALERT (14.4),
+// SLO_BURN_RATE_LONG_WINDOW (1h) and SLO_BURN_RATE_SHORT_WINDOW (5m)
+func NewSLOTracker() *SLOTracker {
+	tracker := &SLOTracker{
+		routes:            make(map[string]bool),
+		latencyThreshold:  positiveDuration("SLO_INGESTION_LATENCY_THRESHOLD", 500*time.Millisecond),
+		window:            positiveDuration("SLO_WINDOW", 30*24*time.Hour),
+		longWindow:        positiveDuration("SLO_BURN_RATE_LONG_WINDOW", time.Hour),
+		shortWindow:       positiveDuration("SLO_BURN_RATE_SHORT_WINDOW", 5*time.Minute),
+		burnRateThreshold: getEnvFloat("SLO_BURN_RATE_ALERT", 14.4),
+		maxResolved:       100,
+		buckets:           make(map[time.Time]*sloBucket),
+		firing:            make(map[string]*SLOAlert),
+		clock:             SystemClock(),
+	}
+	tracker.startedAt = tracker.clock.Now()
+	tracker.slos = []SLODefinition{
+		{
+			Name:        SLOIngestionAvailability,
+			Description: "Ingestion requests answered without a server error",
+			Objective:   sloObjective("SLO_INGESTION_AVAILABILITY", 0.999),
+		},
+		{
+			Name:               SLOIngestionLatency,
+			Description:        "Ingestion requests answered without a server error within the latency threshold",
+			Objective:          sloObjective("SLO_INGESTION_LATENCY", 0.99),
+			LatencyThresholdMs: tracker.latencyThreshold.Milliseconds(),
+		},
+	}
+
+	routes := os.Getenv("SLO_INGESTION_ROUTES")
+	if routes == "" {
+		routes = defaultSLORoutes
+	}
+	for _, route := range strings.Split(routes, ",") {
+		if route = strings.Join(strings.Fields(route), " "); route != "" {
+			tracker.routes[route] = true
+		}
+	}
+	return tracker
+}
+
+// sloObjective reads an objective from the environment, which must be between 0 and 1 exclusive
+func sloObjective(name string, defaultValue float64) float64 {
+	objective := getEnvFloat(name, defaultValue)
+	if objective <= 0 || objective >= 1 {
+		log.Printf("Warning: %s must be between 0 and 1, using default %v", name, defaultValue)
+		return defaultValue
+	}
+	return objective
+}
+
+// positiveDuration reads a duration from the environment, falling back to the default unless positive
+func positiveDuration(name string, defaultValue time.Duration) time.Duration {
+	if value := getEnvDuration(name, defaultValue); value > 0 {
+		return value
+	}
+	return defaultValue
+}
+
+// SetClock replaces the clock windows are measured with
+func (t *SLOTracker) SetClock(clock Clock) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clock = clock
+	t.startedAt = clock.Now()
+}
+
+// SetBus publishes fired and resolved alerts on TopicSLOAlert
+func (t *SLOTracker) SetBus(bus *EventBus) {
+	t.bus = bus
+}
+
+// Definitions returns the objectives
+func (t *SLOTracker) Definitions() []SLODefinition {
+	return append([]SLODefinition(nil), t.slos...)
+}
+
+// Record counts a served request, if it is of an ingestion route
+func (t *SLOTracker) Record(record *APIUsageRecord) {
+	route := record.Route
+	if route == "" {
+		route = record.Path
+	}
+	if !t.routes[record.Method+" "+route] {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.clock.Now()
+	minute := record.Timestamp.Truncate(time.Minute)
+	if !minute.Add(time.Minute).After(now.Add(-t.window)) {
+		return
+	}
+	bucket, exists := t.buckets[minute]
+	if !exists {
+		bucket = &sloBucket{}
+		t.buckets[minute] = bucket
+	}
+	bucket.requests++
+	switch {
+	case record.StatusCode >= 500:
+		bucket.errors++
+	case time.Duration(record.ResponseTimeMs)*time.Millisecond > t.latencyThreshold:
+		bucket.slow++
+	}
+
+	if now.Truncate(time.Minute).After(t.evaluated) {
+		t.evaluate(now)
+	}
+}
+
+// Report returns how the objectives are met over the SLO window, with the alerts firing and the
+// ones resolved recently
+func (t *SLOTracker) Report() *SLOReport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := t.clock.Now()
+	t.evaluate(now)
+
+	report := &SLOReport{
+		Window:             t.window.String(),
+		Routes:             make([]string, 0, len(t.routes)),
+		AlertWindows:       []string{t.longWindow.String(), t.shortWindow.String()},
+		BurnRateThreshold:  t.burnRateThreshold,
+		SLOs:               make([]SLOStatus, 0, len(t.slos)),
+		Firing:             make([]SLOAlert, 0, len(t.firing)),
+		Resolved:           make([]SLOAlert, 0, len(t.resolved)),
+		ComputedAt:         now,
+		TrackingStartedAt:  t.startedAt,
+		WindowFullyTracked: !t.startedAt.After(now.Add(-t.window)),
+	}
+	for route := range t.routes {
+		report.Routes = append(report.Routes, route)
+	}
+	sort.Strings(report.Routes)
+
+	total := t.sum(now, t.window)
+	long, short := t.sum(now, t.longWindow), t.sum(now, t.shortWindow)
+	for _, slo := range t.slos {
+		requests, bad := slo.count(total)
+		status := SLOStatus{
+			SLODefinition:        slo,
+			Requests:             requests,
+			BadRequests:          bad,
+			SLI:                  1,
+			ErrorBudget:          (1 - slo.Objective) * float64(requests),
+			ErrorBudgetRemaining: 1,
+			BurnRates: map[string]float64{
+				t.longWindow.String():  slo.burnRate(long),
+				t.shortWindow.String(): slo.burnRate(short),
+			},
+			Alerting: t.firing[slo.Name] != nil,
+		}
+		if requests > 0 {
+			status.SLI = float64(requests-bad) / float64(requests)
+			status.ErrorBudgetRemaining = 1 - float64(bad)/status.ErrorBudget
+		}
+		report.SLOs = append(report.SLOs, status)
+	}
+
+	for _, alert := range t.firing {
+		report.Firing = append(report.Firing, *alert)
+	}
+	sort.Slice(report.Firing, func(i, j int) bool {
+		return report.Firing[i].SLO < report.Firing[j].SLO
+	})
+	for i := len(t.resolved) - 1; i >= 0; i-- {
+		report.Resolved = append(report.Resolved, t.resolved[i])
+	}
+	return report
+}
+
+// WriteMetrics writes the SLIs, remaining error budgets, burn rates and firing alerts of the
+// objectives in the Prometheus text exposition format
+func (t *SLOTracker) WriteMetrics(w io.Writer) error {
+	report := t.Report()
+
+	if _, err := fmt.Fprint(w, "# HELP analytics_slo_sli Share of good requests of a service level objective over the SLO window.\n# TYPE analytics_slo_sli gauge\n"); err != nil {
+		return err
+	}
+	for _, slo := range report.SLOs {
+		if _, err := fmt.Fprintf(w, "analytics_slo_sli{slo=%q} %g\n", slo.Name, slo.SLI); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(w, "# HELP analytics_slo_error_budget_remaining Share of the error budget of a service level objective left, negative once overspent.\n# TYPE analytics_slo_error_budget_remaining gauge\n"); err != nil {
+		return err
+	}
+	for _, slo := range report.SLOs {
+		if _, err := fmt.Fprintf(w, "analytics_slo_error_budget_remaining{slo=%q} %g\n", slo.Name, slo.ErrorBudgetRemaining); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(w, "# HELP analytics_slo_burn_rate Error budget burn rate of a service level objective over an alert window.\n# TYPE analytics_slo_burn_rate gauge\n"); err != nil {
+		return err
+	}
+	for _, slo := range report.SLOs {
+		for _, window := range report.AlertWindows {
+			if _, err := fmt.Fprintf(w, "analytics_slo_burn_rate{slo=%q,window=%q} %g\n", slo.Name, window, slo.BurnRates[window]); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := fmt.Fprint(w, "# HELP analytics_slo_alerts_firing Whether the burn rate alert of a service level objective fires.\n# TYPE analytics_slo_alerts_firing gauge\n"); err != nil {
+		return err
+	}
+	for _, slo := range report.SLOs {
+		firing := 0
+		if slo.Alerting {
+			firing = 1
+		}
+		if _, err := fmt.Fprintf(w, "analytics_slo_alerts_firing{slo=%q} %d\n", slo.Name, firing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sum adds up the buckets of the last d before now. Callers must hold the lock.
+func (t *SLOTracker) sum(now time.Time, d time.Duration) sloBucket {
+	var total sloBucket
+	since := now.Add(-d)
+	for minute, bucket := range t.buckets {
+		if minute.Add(time.Minute).After(since) && !minute.After(now) {
+			total.requests += bucket.requests
+			total.errors += bucket.errors
+			total.slow += bucket.slow
+		}
+	}
+	return total
+}
+
+// evaluate drops the minutes past the SLO window, then fires the alerts of objectives burning
+// their budget too fast and resolves the ones that stopped. Callers must hold the lock.
+func (t *SLOTracker) evaluate(now time.Time) {
+	t.evaluated = now.Truncate(time.Minute)
+	for minute := range t.buckets {
+		if !minute.Add(time.Minute).After(now.Add(-t.window)) {
+			delete(t.buckets, minute)
+		}
+	}
+
+	long, short := t.sum(now, t.longWindow), t.sum(now, t.shortWindow)
+	for _, slo := range t.slos {
+		burnRate, shortBurnRate := slo.burnRate(long), slo.burnRate(short)
+		firing, exists := t.firing[slo.Name]
+		if burnRate >= t.burnRateThreshold && shortBurnRate >= t.burnRateThreshold {
+			if exists {
+				firing.BurnRate, firing.ShortBurnRate = burnRate, shortBurnRate
+				continue
+			}
+			alert := &SLOAlert{
+				ID:            uuid.New().String(),
+				SLO:           slo.Name,
+				BurnRate:      burnRate,
+				ShortBurnRate: shortBurnRate,
+				Threshold:     t.burnRateThreshold,
+				FiredAt:       now,
+			}
+			t.firing[slo.Name] = alert
+			t.notify(alert, OutcomeDetected)
+			continue
+		}
+		if exists {
+			delete(t.firing, slo.Name)
+			resolvedAt := now
+			firing.ResolvedAt = &resolvedAt
+			t.resolved = append(t.resolved, *firing)
+			if len(t.resolved) > t.maxResolved {
+				t.resolved = t.resolved[len(t.resolved)-t.maxResolved:]
+			}
+			t.notify(firing, OutcomeResolved)
+		}
+	}
+}
+
+// notify sends a fired or resolved alert to the log and the event bus
+func (t *SLOTracker) notify(alert *SLOAlert, outcome string) {
+	log.Printf("Warning: SLO alert for %s %s: burning the error budget %.1fx over %s and %.1fx over %s (threshold %.1fx)",
+		alert.SLO, outcome, alert.BurnRate, t.longWindow, alert.ShortBurnRate, t.shortWindow, alert.Threshold)
+
+	// Subscribers get a copy, as the alert keeps changing while it fires
+	published := *alert
+	if t.bus != nil {
+		if err := t.bus.Publish(TopicSLOAlert, &published); err != nil {
+			log.Printf("Warning: Failed to publish SLO alert: %v", err)
+		}
+	}
+}
+
+// count returns the requests an objective covers among the counted ones, and how many were bad
+func (slo SLODefinition) count(bucket sloBucket) (int64, int64) {
+	if slo.LatencyThresholdMs > 0 {
+		return bucket.requests - bucket.errors, bucket.slow
+	}
+	return bucket.requests, bucket.errors
+}
+
+// burnRate returns how many times faster than the objective allows the counted requests spend
+// the error budget, 0 without requests
+func (slo SLODefinition) burnRate(bucket sloBucket) float64 {
+	requests, bad := slo.count(bucket)
+	if requests == 0 {
+		return 0
+	}
+	return float64(bad) / float64(requests) / (1 - slo.Objective)
+}
@@ -0,0 +1,139 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Slow operation kinds recorded by the services
+const (
+	SlowOperationFunnel     = "funnel"
+	SlowOperationHeatmap    = "heatmap"
+	SlowOperationUsageQuery = "usage_query"
+	SlowOperationTrend      = "trend"
+	SlowOperationForm       = "form"
+	SlowOperationRetention  = "retention"
+	SlowOperationSessions   = "sessions"
+)
+
+// SlowOperation represents a funnel, heatmap or query execution that exceeded a threshold
+type SlowOperation struct {
+	ID            string                 `json:"id"`
+	Kind          string                 `json:"kind"`
+	Parameters    map[string]interface{} `json:"parameters"`
+	DurationMs    float64                `json:"duration_ms"`
+	ScannedEvents int64                  `json:"scanned_events"`
+	Cost          float64                `json:"cost"`
+	Reasons       []string               `json:"reasons"` // "duration", "scanned_events"
+	RecordedAt    time.Time              `json:"recorded_at"`
+}
+
+// SlowOperationFilter narrows down the entries returned by Query
+type SlowOperationFilter struct {
+	Kind  string
+	Since time.Time
+	Limit int
+}
+
+// SlowOperationLog keeps a bounded log of expensive operations for operators
+type SlowOperationLog struct {
+	entries           []SlowOperation
+	maxEntries        int
+	durationThreshold time.Duration
+	scannedThreshold  int64
+	mutex             sync.RWMutex
+}
+
+// NewSlowOperationLog creates a new slow operation log configured from the environment
+func NewSlowOperationLog() *SlowOperationLog {
+	return &SlowOperationLog{
+		maxEntries:        getEnvInt("SLOW_OPERATION_LOG_SIZE", 1000),
+		durationThreshold: getEnvDuration("SLOW_OPERATION_THRESHOLD", 500*time.Millisecond),
+		scannedThreshold:  int64(getEnvInt("SLOW_OPERATION_SCANNED_EVENTS", 100000)),
+	}
+}
+
+// Observe records the operation if it exceeded the time or scanned-event threshold.
+// It returns true when the operation was recorded.
+func (l *SlowOperationLog) Observe(kind string, parameters map[string]interface{}, duration time.Duration, scannedEvents int64, cost float64) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var reasons []string
+	if l.durationThreshold > 0 && duration >= l.durationThreshold {
+		reasons = append(reasons, "duration")
+	}
+	if l.scannedThreshold > 0 && scannedEvents >= l.scannedThreshold {
+		reasons = append(reasons, "scanned_events")
+	}
+
+	if len(reasons) == 0 {
+		return false
+	}
+
+	l.entries = append(l.entries, SlowOperation{
+		ID:            uuid.New().String(),
+		Kind:          kind,
+		Parameters:    parameters,
+		DurationMs:    float64(duration.Microseconds()) / 1000,
+		ScannedEvents: scannedEvents,
+		Cost:          cost,
+		Reasons:       reasons,
+		RecordedAt:    time.Now(),
+	})
+
+	// Drop the oldest entries once the log is full
+	if l.maxEntries > 0 && len(l.entries) > l.maxEntries {
+		l.entries = l.entries[len(l.entries)-l.maxEntries:]
+	}
+
+	return true
+}
+
+// Query returns recorded operations matching the filter, newest first
+func (l *SlowOperationLog) Query(filter SlowOperationFilter) []SlowOperation {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	results := make([]SlowOperation, 0)
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		entry := l.entries[i]
+		if filter.Kind != "" && entry.Kind != filter.Kind {
+			continue
+		}
+		if !filter.Since.IsZero() && entry.RecordedAt.Before(filter.Since) {
+			continue
+		}
+
+		results = append(results, entry)
+		if filter.Limit > 0 && len(results) >= filter.Limit {
+			break
+		}
+	}
+
+	return results
+}
+
+// SetThresholds updates the duration and scanned-event thresholds. A zero value disables that threshold.
+func (l *SlowOperationLog) SetThresholds(duration time.Duration, scannedEvents int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.durationThreshold = duration
+	l.scannedThreshold = scannedEvents
+}
+
+// Thresholds returns the current duration and scanned-event thresholds
+func (l *SlowOperationLog) Thresholds() (time.Duration, int64) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.durationThreshold, l.scannedThreshold
+}
+
+// Reset clears all recorded operations
+func (l *SlowOperationLog) Reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = nil
+}
@@ -0,0 +1,15 @@
+package app
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// getFreshness handles GET /api/v1/status/freshness, reporting how current the project's data is
+// at each stage of the pipeline, for dashboards and freshness SLAs
+func (s *App) getFreshness(c *fiber.Ctx) error {
+	report := s.analyticsService.Freshness().Report(projectIDFromRequest(c), s.analyticsService.QueryCache(), s.analyticsService.Clock().Now())
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"freshness": report,
+	})
+}
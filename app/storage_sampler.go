@@ -0,0 +1,157 @@
+package app
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StorageSampler decides which events are stored in full detail. Events of a sampled type are
+// still stored and billed, but only a fraction keeps its properties (e.g. click coordinates).
+type StorageSampler struct {
+	detailRates map[string]float64 // Detail sample rate per event type (0.0 to 1.0), 1.0 when unset
+	mutex       sync.RWMutex
+}
+
+// NewStorageSampler creates a storage sampler configured from EVENT_DETAIL_SAMPLE_RATES,
+// a comma-separated list of event_type:rate entries
+func NewStorageSampler() *StorageSampler {
+	sampler := &StorageSampler{
+		detailRates: make(map[string]float64),
+	}
+
+	if value := os.Getenv("EVENT_DETAIL_SAMPLE_RATES"); value != "" {
+		rates, err := parseDetailSampleRates(value)
+		if err != nil {
+			log.Printf("Warning: Ignoring EVENT_DETAIL_SAMPLE_RATES: %v", err)
+		} else {
+			sampler.detailRates = rates
+		}
+	}
+
+	return sampler
+}
+
+// ShouldStoreDetail reports whether the event keeps its full detail. The decision is
+// deterministic per event ID, so retried deliveries of an event are sampled the same way.
+func (s *StorageSampler) ShouldStoreDetail(eventID, eventType string) bool {
+	rate := s.DetailRate(eventType)
+	if rate >= 1.0 {
+		return true
+	}
+	if rate <= 0.0 {
+		return false
+	}
+
+	return sampleFraction(eventID) < rate
+}
+
+// sampleFraction maps a key to a fraction in [0, 1), deterministically. Samplers of different
+// stages should prefix their keys, so their decisions about an event are independent.
+func sampleFraction(key string) float64 {
+	hash := md5.Sum([]byte(key))
+	return float64(binary.BigEndian.Uint32(hash[:4])%10000) / 10000.0
+}
+
+// DetailRate returns the detail sample rate of an event type
+func (s *StorageSampler) DetailRate(eventType string) float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rate, exists := s.detailRates[eventType]
+	if !exists {
+		return 1.0 // Default to storing every event in full detail
+	}
+	return rate
+}
+
+// SetDetailRate sets the detail sample rate of an event type. A rate of 1.0 stores every event in full detail.
+func (s *StorageSampler) SetDetailRate(eventType string, rate float64) error {
+	if rate < 0.0 || rate > 1.0 {
+		return fmt.Errorf("sample rate must be between 0 and 1, got %v", rate)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if rate == 1.0 {
+		delete(s.detailRates, eventType)
+		return nil
+	}
+	s.detailRates[eventType] = rate
+	return nil
+}
+
+// DetailRates returns the configured detail sample rates by event type
+func (s *StorageSampler) DetailRates() map[string]float64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rates := make(map[string]float64, len(s.detailRates))
+	for eventType, rate := range s.detailRates {
+		rates[eventType] = rate
+	}
+	return rates
+}
+
+// ReplaceDetailRates replaces every configured detail sample rate
+func (s *StorageSampler) ReplaceDetailRates(rates map[string]float64) error {
+	for eventType, rate := range rates {
+		if rate < 0.0 || rate > 1.0 {
+			return fmt.Errorf("sample rate for %s must be between 0 and 1, got %v", eventType, rate)
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.detailRates = make(map[string]float64, len(rates))
+	for eventType, rate := range rates {
+		if rate < 1.0 {
+			s.detailRates[eventType] = rate
+		}
+	}
+	return nil
+}
+
+// parseDetailSampleRates parses a comma-separated list of event_type:rate entries
+func parseDetailSampleRates(value string) (map[string]float64, error) {
+	rates, err := parseRates(value)
+	if err != nil {
+		return nil, err
+	}
+	for eventType, rate := range rates {
+		if rate < 0.0 || rate > 1.0 {
+			return nil, fmt.Errorf("invalid rate for %s: %v", eventType, rate)
+		}
+	}
+	return rates, nil
+}
+
+// parseRates parses a comma-separated list of key:rate entries
+func parseRates(value string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		key, rateStr, found := strings.Cut(entry, ":")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected key:rate", entry)
+		}
+
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate for %s: %s", key, rateStr)
+		}
+		rates[key] = rate
+	}
+	return rates, nil
+}
@@ -0,0 +1,106 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Kinds of signed tokens, so a token issued for one purpose cannot be used for another
+const (
+	TokenKindQueryShare      = "query_share"
+	TokenKindPublicDashboard = "public_dashboard"
+)
+
+// TokenClaims is the signed payload of a token
+type TokenClaims struct {
+	Kind      string   `json:"k"`
+	Subject   string   `json:"s"` // ID of the shared resource
+	ProjectID string   `json:"p"`
+	Version   int      `json:"v"` // Must match the resource's token version, allowing revocation
+	Scopes    []string `json:"sc,omitempty"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+// TokenSigner issues and verifies HMAC-signed tokens
+type TokenSigner struct {
+	secret []byte
+	clock  Clock
+}
+
+// NewTokenSigner creates a token signer using the SHARE_TOKEN_SECRET secret
+func NewTokenSigner() *TokenSigner {
+	secret := []byte(os.Getenv("SHARE_TOKEN_SECRET"))
+	if len(secret) == 0 {
+		log.Println("Warning: SHARE_TOKEN_SECRET not set, share tokens will not survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Failed to generate share token secret: %v", err)
+		}
+	}
+
+	return &TokenSigner{secret: secret, clock: SystemClock()}
+}
+
+// SetClock replaces the clock token expiry is checked against
+func (s *TokenSigner) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// Sign encodes and signs the claims
+func (s *TokenSigner) Sign(claims TokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token: %w", err)
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + s.signature(encoded), nil
+}
+
+// Verify checks the signature, kind and expiry of a token and returns its claims
+func (s *TokenSigner) Verify(token, kind string) (*TokenClaims, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(s.signature(encoded))) {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Kind != kind {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if s.clock.Now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("token has expired")
+	}
+
+	return &claims, nil
+}
+
+// HasScope reports whether the claims grant the scope
+func (c *TokenClaims) HasScope(scope string) bool {
+	for _, granted := range c.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// signature returns the HMAC signature of an encoded payload
+func (s *TokenSigner) signature(encoded string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,421 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Outcomes of submitted events, as observed by the traffic monitor
+const (
+	TrafficReceived   = "received"   // Accepted, dropped by a quota or queued for asynchronous ingestion
+	TrafficMalformed  = "malformed"  // Rejected as invalid
+	TrafficMisordered = "misordered" // Claimed to have happened after it was sent
+)
+
+// Rules of traffic alerts
+const (
+	TrafficRuleIPSpike         = "ip_spike"            // Sudden spike of events from a single client IP
+	TrafficRuleUserAgentSpike  = "user_agent_spike"    // Sudden spike of events from a single user agent
+	TrafficRuleMalformedSurge  = "malformed_surge"     // Large share of a project's events rejected as invalid
+	TrafficRuleImpossibleOrder = "impossible_ordering" // Events claiming to have happened after they were sent
+)
+
+// trafficRules lists every rule, in the order they are documented
+var trafficRules = []string{TrafficRuleIPSpike, TrafficRuleUserAgentSpike, TrafficRuleMalformedSurge, TrafficRuleImpossibleOrder}
+
+// maxTrafficUserAgentLength bounds the user agents counted, so clients cannot inflate memory use
+const maxTrafficUserAgentLength = 256
+
+// TrafficAlert is an anomaly in the ingestion traffic of a project, likely an SDK bug or abuse
+type TrafficAlert struct {
+	ID         string     `json:"id"`
+	Rule       string     `json:"rule"`
+	ProjectID  string     `json:"project_id"`
+	Subject    string     `json:"subject,omitempty"`  // Client IP or user agent of spikes
+	Count      int64      `json:"count"`              // Events matching the rule in the last window it held
+	Total      int64      `json:"total"`              // Events of the project in that window
+	Baseline   float64    `json:"baseline,omitempty"` // Usual events per window of the subject of spikes
+	FiredAt    time.Time  `json:"fired_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// TrafficAlertReport lists the traffic alerts firing and the ones resolved recently
+type TrafficAlertReport struct {
+	Window   string         `json:"window"`
+	Firing   []TrafficAlert `json:"firing"`
+	Resolved []TrafficAlert `json:"resolved"` // Most recent first
+}
+
+// isTrafficAlert reports whether a payload is a traffic alert
+func isTrafficAlert(payload interface{}) bool {
+	alert, ok := payload.(*TrafficAlert)
+	return ok && alert != nil
+}
+
+// trafficCounts counts the events of a project in a window by outcome
+type trafficCounts struct {
+	total      int64
+	malformed  int64
+	misordered int64
+}
+
+// trafficSubject is a client IP or user agent sending events to a project, with its spike rule
+type trafficSubject struct {
+	projectID string
+	rule      string
+	value     string
+}
+
+// trafficWindow counts the events received in a window of the monitor
+type trafficWindow struct {
+	start    time.Time
+	warmup   bool // First window of the monitor, which only sets baselines
+	projects map[string]*trafficCounts
+	subjects map[trafficSubject]int64
+}
+
+// TrafficMonitor raises alerts on anomalies in the metadata of ingested events: sudden spikes from
+// a single client IP or user agent, surges of malformed events and events claiming impossible
+// ordering. Events are counted in fixed windows; when a window closes, every rule is evaluated
+// over it. Spikes are measured against a moving average of the subject's events per window, which
+// is not updated while its alert fires, so sustained abuse does not become its own baseline; the
+// first window only sets baselines, so a restart does not alert on every busy client.
+// Alerts fire once and resolve after a window in which their rule no longer holds; both are
+// logged, published on the event bus and exported to the SIEM. Windows close on the first
+// observation, report or metrics scrape after they end.
+type TrafficMonitor struct {
+	window              time.Duration
+	spikeFactor         float64 // Events of a window over the subject's baseline that make a spike
+	spikeMinEvents      int64   // Events of a window below which nothing is a spike
+	malformedRatio      float64
+	malformedMinEvents  int64
+	misorderedMinEvents int64
+	maxSubjects         int // Subjects counted per window, further ones are ignored until the next
+	maxResolved         int
+
+	current   *trafficWindow
+	baselines *BoundedCache            // Moving average of events per window, by subject
+	firing    map[string]*TrafficAlert // Keyed by rule, project and subject
+	resolved  []TrafficAlert           // Oldest first
+	fired     map[string]int64         // Alerts fired by rule
+	bus       *EventBus
+	exporter  *SIEMExporter
+	clock     Clock
+	mutex     sync.Mutex
+}
+
+// NewTrafficMonitor creates a monitor configured from TRAFFIC_ALERT_WINDOW,
+// TRAFFIC_ALERT_SPIKE_FACTOR, TRAFFIC_ALERT_SPIKE_MIN_EVENTS, TRAFFIC_ALERT_MALFORMED_RATIO,
+// TRAFFIC_ALERT_MALFORMED_MIN_EVENTS, TRAFFIC_ALERT_MISORDERED_MIN_EVENTS,
+// TRAFFIC_ALERT_MAX_SUBJECTS and TRAFFIC_ALERT_MAX_BASELINES
+func NewTrafficMonitor() *TrafficMonitor {
+	window := getEnvDuration("TRAFFIC_ALERT_WINDOW", time.Minute)
+	if window <= 0 {
+		window = time.Minute
+	}
+	monitor := &TrafficMonitor{
+		window:              window,
+		spikeFactor:         getEnvFloat("TRAFFIC_ALERT_SPIKE_FACTOR", 10),
+		spikeMinEvents:      int64(getEnvInt("TRAFFIC_ALERT_SPIKE_MIN_EVENTS", 600)),
+		malformedRatio:      getEnvFloat("TRAFFIC_ALERT_MALFORMED_RATIO", 0.25),
+		malformedMinEvents:  int64(getEnvInt("TRAFFIC_ALERT_MALFORMED_MIN_EVENTS", 100)),
+		misorderedMinEvents: int64(getEnvInt("TRAFFIC_ALERT_MISORDERED_MIN_EVENTS", 20)),
+		maxSubjects:         getEnvInt("TRAFFIC_ALERT_MAX_SUBJECTS", 100000),
+		maxResolved:         100,
+		// Subjects not seen for a day lose their baseline
+		baselines: NewBoundedCache("traffic_baselines", getEnvInt("TRAFFIC_ALERT_MAX_BASELINES", 100000), 24*time.Hour),
+		firing:    make(map[string]*TrafficAlert),
+		fired:     make(map[string]int64),
+		clock:     SystemClock(),
+	}
+	monitor.current = monitor.newWindow(monitor.clock.Now())
+	monitor.current.warmup = true
+	return monitor
+}
+
+// SetClock replaces the clock windows are measured with, starting a new window
+func (m *TrafficMonitor) SetClock(clock Clock) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.clock = clock
+	m.baselines.SetClock(clock)
+	m.current = m.newWindow(clock.Now())
+	m.current.warmup = true
+}
+
+// SetBus publishes fired and resolved alerts on TopicTrafficAlert
+func (m *TrafficMonitor) SetBus(bus *EventBus) {
+	m.bus = bus
+}
+
+// SetExporter exports fired and resolved alerts to a SIEM
+func (m *TrafficMonitor) SetExporter(exporter *SIEMExporter) {
+	m.exporter = exporter
+}
+
+// Baselines returns the cache of the usual events per window of client IPs and user agents
+func (m *TrafficMonitor) Baselines() *BoundedCache {
+	return m.baselines
+}
+
+// Observe counts an event submitted to a project by a client IP and user agent
+func (m *TrafficMonitor) Observe(projectID, ip, userAgent, outcome string) {
+	projectID = projectOrDefault(projectID)
+	if len(userAgent) > maxTrafficUserAgentLength {
+		userAgent = userAgent[:maxTrafficUserAgentLength]
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.roll(m.clock.Now())
+
+	counts, exists := m.current.projects[projectID]
+	if !exists {
+		counts = &trafficCounts{}
+		m.current.projects[projectID] = counts
+	}
+	counts.total++
+	switch outcome {
+	case TrafficMalformed:
+		counts.malformed++
+	case TrafficMisordered:
+		counts.misordered++
+	}
+
+	if ip != "" {
+		m.count(trafficSubject{projectID: projectID, rule: TrafficRuleIPSpike, value: ip})
+	}
+	if userAgent != "" {
+		m.count(trafficSubject{projectID: projectID, rule: TrafficRuleUserAgentSpike, value: userAgent})
+	}
+}
+
+// TrafficOutcome classifies the result of tracking an event for the traffic monitor
+func TrafficOutcome(err error) string {
+	var misordered *EventOrderError
+	switch {
+	case errors.As(err, &misordered):
+		return TrafficMisordered
+	case errors.Is(err, errInvalidEventData):
+		return TrafficMalformed
+	default:
+		return TrafficReceived
+	}
+}
+
+// Alerts returns the alerts firing, oldest first, and the ones resolved recently
+func (m *TrafficMonitor) Alerts() *TrafficAlertReport {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.roll(m.clock.Now())
+
+	report := &TrafficAlertReport{
+		Window:   m.window.String(),
+		Firing:   make([]TrafficAlert, 0, len(m.firing)),
+		Resolved: make([]TrafficAlert, 0, len(m.resolved)),
+	}
+	for _, alert := range m.firing {
+		report.Firing = append(report.Firing, *alert)
+	}
+	sort.Slice(report.Firing, func(i, j int) bool {
+		if !report.Firing[i].FiredAt.Equal(report.Firing[j].FiredAt) {
+			return report.Firing[i].FiredAt.Before(report.Firing[j].FiredAt)
+		}
+		return trafficAlertKey(report.Firing[i].Rule, report.Firing[i].ProjectID, report.Firing[i].Subject) <
+			trafficAlertKey(report.Firing[j].Rule, report.Firing[j].ProjectID, report.Firing[j].Subject)
+	})
+	for i := len(m.resolved) - 1; i >= 0; i-- {
+		report.Resolved = append(report.Resolved, m.resolved[i])
+	}
+	return report
+}
+
+// WriteMetrics writes the alerts firing and fired by rule in the Prometheus text exposition format
+func (m *TrafficMonitor) WriteMetrics(w io.Writer) error {
+	m.mutex.Lock()
+	m.roll(m.clock.Now())
+	firing := make(map[string]int, len(trafficRules))
+	for _, alert := range m.firing {
+		firing[alert.Rule]++
+	}
+	fired := make(map[string]int64, len(m.fired))
+	for rule, count := range m.fired {
+		fired[rule] = count
+	}
+	m.mutex.Unlock()
+
+	if _, err := fmt.Fprint(w, "# HELP analytics_traffic_alerts_firing Traffic anomaly alerts currently firing, by rule.\n# TYPE analytics_traffic_alerts_firing gauge\n"); err != nil {
+		return err
+	}
+	for _, rule := range trafficRules {
+		if _, err := fmt.Fprintf(w, "analytics_traffic_alerts_firing{rule=%q} %d\n", rule, firing[rule]); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(w, "# HELP analytics_traffic_alerts_total Traffic anomaly alerts fired, by rule.\n# TYPE analytics_traffic_alerts_total counter\n"); err != nil {
+		return err
+	}
+	for _, rule := range trafficRules {
+		if _, err := fmt.Fprintf(w, "analytics_traffic_alerts_total{rule=%q} %d\n", rule, fired[rule]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newWindow returns an empty window holding the given time
+func (m *TrafficMonitor) newWindow(now time.Time) *trafficWindow {
+	return &trafficWindow{
+		start:    now.Truncate(m.window),
+		projects: make(map[string]*trafficCounts),
+		subjects: make(map[trafficSubject]int64),
+	}
+}
+
+// count adds an event of a subject to the current window
+func (m *TrafficMonitor) count(subject trafficSubject) {
+	if _, exists := m.current.subjects[subject]; !exists && len(m.current.subjects) >= m.maxSubjects {
+		return
+	}
+	m.current.subjects[subject]++
+}
+
+// roll closes the current window once the given time is past it, evaluating the rules over it
+func (m *TrafficMonitor) roll(now time.Time) {
+	if now.Before(m.current.start.Add(m.window)) {
+		return
+	}
+	closed := m.current
+	m.current = m.newWindow(now)
+	m.evaluate(closed, closed.start.Add(m.window))
+}
+
+// evaluate fires the alerts whose rule holds over a closed window and resolves the ones firing
+// whose rule no longer does
+func (m *TrafficMonitor) evaluate(window *trafficWindow, end time.Time) {
+	held := make(map[string]bool)
+
+	for subject, count := range window.subjects {
+		key := trafficAlertKey(subject.rule, subject.projectID, subject.value)
+		baselineKey := subject.projectID + "/" + subject.rule + "/" + subject.value
+		var baseline float64
+		if value, exists := m.baselines.Get(baselineKey); exists {
+			baseline = value.(float64)
+		}
+
+		if !window.warmup && count >= m.spikeMinEvents && float64(count) >= m.spikeFactor*baseline {
+			held[key] = true
+			m.hold(key, TrafficAlert{
+				Rule:      subject.rule,
+				ProjectID: subject.projectID,
+				Subject:   subject.value,
+				Count:     count,
+				Total:     window.projects[subject.projectID].total,
+				Baseline:  baseline,
+			}, end)
+			continue
+		}
+
+		// Only windows without a spike move the baseline, by a fifth of the difference
+		m.baselines.Update(baselineKey, func(value interface{}, exists bool) interface{} {
+			if !exists {
+				return float64(count)
+			}
+			return value.(float64) + 0.2*(float64(count)-value.(float64))
+		})
+	}
+
+	for projectID, counts := range window.projects {
+		if counts.total >= m.malformedMinEvents && float64(counts.malformed) >= m.malformedRatio*float64(counts.total) {
+			key := trafficAlertKey(TrafficRuleMalformedSurge, projectID, "")
+			held[key] = true
+			m.hold(key, TrafficAlert{Rule: TrafficRuleMalformedSurge, ProjectID: projectID, Count: counts.malformed, Total: counts.total}, end)
+		}
+		if counts.misordered >= m.misorderedMinEvents {
+			key := trafficAlertKey(TrafficRuleImpossibleOrder, projectID, "")
+			held[key] = true
+			m.hold(key, TrafficAlert{Rule: TrafficRuleImpossibleOrder, ProjectID: projectID, Count: counts.misordered, Total: counts.total}, end)
+		}
+	}
+
+	for key, alert := range m.firing {
+		if held[key] {
+			continue
+		}
+		delete(m.firing, key)
+		resolvedAt := end
+		alert.ResolvedAt = &resolvedAt
+		m.resolved = append(m.resolved, *alert)
+		if len(m.resolved) > m.maxResolved {
+			m.resolved = m.resolved[len(m.resolved)-m.maxResolved:]
+		}
+		m.notify(alert, OutcomeResolved)
+	}
+}
+
+// hold fires an alert whose rule holds, or updates the counts of the alert already firing
+func (m *TrafficMonitor) hold(key string, alert TrafficAlert, end time.Time) {
+	if firing, exists := m.firing[key]; exists {
+		firing.Count = alert.Count
+		firing.Total = alert.Total
+		return
+	}
+
+	alert.ID = uuid.New().String()
+	alert.FiredAt = end
+	m.firing[key] = &alert
+	m.fired[alert.Rule]++
+	m.notify(&alert, OutcomeDetected)
+}
+
+// notify sends a fired or resolved alert to the log, the event bus and the SIEM
+func (m *TrafficMonitor) notify(alert *TrafficAlert, outcome string) {
+	log.Printf("Warning: Traffic alert %s %s for project %s: %d of %d events in the window ending %s (subject %q)",
+		alert.Rule, outcome, alert.ProjectID, alert.Count, alert.Total, alert.FiredAt.Format(time.RFC3339), alert.Subject)
+
+	// Subscribers get a copy, as the alert keeps changing while it fires
+	published := *alert
+	if m.bus != nil {
+		if err := m.bus.Publish(TopicTrafficAlert, &published); err != nil {
+			log.Printf("Warning: Failed to publish traffic alert: %v", err)
+		}
+	}
+
+	severity := 6
+	if outcome == OutcomeResolved {
+		severity = 3
+	}
+	event := SecurityEvent{
+		Category: SecurityAnomaly,
+		Action:   "traffic_alert." + alert.Rule,
+		Outcome:  outcome,
+		Severity: severity,
+		Actor:    alert.Subject,
+		Resource: alert.ProjectID,
+		Details: map[string]interface{}{
+			"alert_id": alert.ID,
+			"count":    alert.Count,
+			"total":    alert.Total,
+			"baseline": alert.Baseline,
+		},
+	}
+	if alert.Rule == TrafficRuleIPSpike {
+		event.SourceIP = alert.Subject
+	}
+	m.exporter.Export(event)
+}
+
+// trafficAlertKey identifies the alert of a rule for a project and subject
+func trafficAlertKey(rule, projectID, subject string) string {
+	return rule + "\x00" + projectID + "\x00" + subject
+}
@@ -0,0 +1,72 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// UsageBatchResult is the usage of a single user within a batch, or why it could not be computed
+type UsageBatchResult struct {
+	UserID string        `json:"user_id"`
+	Usage  *UsageSummary `json:"usage,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// GetUsageBatch retrieves usage statistics for many users at once, computing up to
+// concurrency summaries in parallel. Results keep the order of userIDs; a failure for
+// one user is reported in its result without failing the others.
+func (s *AnalyticsService) GetUsageBatch(ctx context.Context, userIDs []string, startDateStr, endDateStr string, concurrency int) []UsageBatchResult {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make([]UsageBatchResult, len(userIDs))
+	seen := make(map[string]bool, len(userIDs))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, userID := range userIDs {
+		results[i].UserID = userID
+
+		if userID == "" {
+			results[i].Error = "user ID is required"
+			continue
+		}
+		if seen[userID] {
+			results[i].Error = "duplicate user ID"
+			continue
+		}
+		seen[userID] = true
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(result *UsageBatchResult) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			defer func() {
+				if r := recover(); r != nil {
+					result.Error = fmt.Sprintf("internal error: %v", r)
+				}
+			}()
+
+			if err := ctx.Err(); err != nil {
+				result.Error = err.Error()
+				return
+			}
+
+			usage, err := s.GetUsage(ctx, result.UserID, startDateStr, endDateStr)
+			if err != nil {
+				result.Error = err.Error()
+				return
+			}
+			result.Usage = usage
+		}(&results[i])
+	}
+
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,145 @@
+package app
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// UserDispatcher processes the events of a user one at a time, in the order they were dispatched,
+// whichever ingestion path they came through. Users are hash-partitioned over queues each drained
+// by a single worker, so events of different users still run in parallel. Sessionization,
+// identity merging and funnels rely on a user's events being processed in order.
+type UserDispatcher struct {
+	partitions []*WorkerPool
+	next       uint32 // Round-robin partition of events without a user
+}
+
+// NewUserDispatcher creates a dispatcher with the given number of partitions, each queueing at
+// most capacity events
+func NewUserDispatcher(partitions, capacity int) *UserDispatcher {
+	if partitions < 1 {
+		partitions = 1
+	}
+	dispatcher := &UserDispatcher{partitions: make([]*WorkerPool, partitions)}
+	for i := range dispatcher.partitions {
+		dispatcher.partitions[i] = NewWorkerPool(fmt.Sprintf("ordered-%d", i), 1, capacity)
+	}
+	return dispatcher
+}
+
+// Partition returns the partition processing the events of a user. Events without a user are
+// spread over the partitions, in no particular order.
+func (d *UserDispatcher) Partition(userID string) int {
+	if userID == "" {
+		return int(atomic.AddUint32(&d.next, 1) % uint32(len(d.partitions)))
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(userID))
+	return int(hash.Sum32() % uint32(len(d.partitions)))
+}
+
+// Submit queues a task after the user's previous ones, blocking while the user's partition is
+// full. It returns false if the dispatcher is stopped.
+func (d *UserDispatcher) Submit(userID string, task func()) bool {
+	return d.partitions[d.Partition(userID)].Submit(task)
+}
+
+// TrySubmit queues a task after the user's previous ones without blocking. It returns false if the
+// user's partition is full or the dispatcher is stopped.
+func (d *UserDispatcher) TrySubmit(userID string, task func()) bool {
+	return d.partitions[d.Partition(userID)].TrySubmit(task)
+}
+
+// Do runs a task after the user's previous ones and waits for it. It returns false, without
+// running the task, if the dispatcher is stopped. Tasks must not dispatch to the dispatcher and
+// wait themselves, or they would wait for their own partition.
+func (d *UserDispatcher) Do(userID string, task func()) bool {
+	done := make(chan struct{})
+	queued := d.Submit(userID, func() {
+		defer close(done)
+		task()
+	})
+	if queued {
+		<-done
+	}
+	return queued
+}
+
+// TryReserve takes the user's next turn without waiting for room in the user's partition, for a
+// task known later. The returned function runs the task in that turn and waits for it, or only
+// gives the turn up when called with nil; it must be called once. TryReserve returns nil if the
+// partition is full or the dispatcher is stopped. Tasks must not dispatch to the dispatcher and
+// wait themselves either.
+func (d *UserDispatcher) TryReserve(userID string) func(task func()) {
+	tasks := make(chan func(), 1)
+	done := make(chan struct{})
+	queued := d.TrySubmit(userID, func() {
+		defer close(done)
+		if task := <-tasks; task != nil {
+			task()
+		}
+	})
+	if !queued {
+		return nil
+	}
+	return func(task func()) {
+		tasks <- task
+		<-done
+	}
+}
+
+// Partitions returns the number of partitions
+func (d *UserDispatcher) Partitions() int {
+	return len(d.partitions)
+}
+
+// Capacity returns the maximum number of queued events per partition
+func (d *UserDispatcher) Capacity() int {
+	return d.partitions[0].Capacity()
+}
+
+// SetCapacity changes the maximum number of queued events per partition
+func (d *UserDispatcher) SetCapacity(capacity int) error {
+	for _, partition := range d.partitions {
+		if err := partition.SetCapacity(capacity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the partitions summed up as one pool, whose size is the number of partitions
+func (d *UserDispatcher) Stats() WorkerPoolStats {
+	stats := WorkerPoolStats{Name: "ordered", Size: len(d.partitions)}
+	for _, partition := range d.PartitionStats() {
+		stats.Running += partition.Running
+		stats.Busy += partition.Busy
+		stats.Queued += partition.Queued
+		stats.Capacity += partition.Capacity
+		stats.Processed += partition.Processed
+		stats.Dropped += partition.Dropped
+	}
+	return stats
+}
+
+// PartitionStats returns a snapshot of each partition, showing users hot enough to back one up
+func (d *UserDispatcher) PartitionStats() []WorkerPoolStats {
+	stats := make([]WorkerPoolStats, len(d.partitions))
+	for i, partition := range d.partitions {
+		stats[i] = partition.Stats()
+	}
+	return stats
+}
+
+// Stopped reports whether the dispatcher was stopped
+func (d *UserDispatcher) Stopped() bool {
+	return d.partitions[0].Stopped()
+}
+
+// Stop lets the partitions process their queued events and exit. Further events are rejected.
+func (d *UserDispatcher) Stop() {
+	for _, partition := range d.partitions {
+		partition.Stop()
+	}
+}
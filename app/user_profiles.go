@@ -0,0 +1,164 @@
+package app
+
+import (
+	"time"
+)
+
+// Lifecycle stages of a user, derived from the events of the auth and billing services
+const (
+	LifecycleRegistered = "registered" // Signed up, without a subscription
+	LifecycleSubscribed = "subscribed" // Paying subscriber
+	LifecyclePastDue    = "past_due"   // Subscriber whose last payment failed
+	LifecycleChurned    = "churned"    // Cancelled their subscription
+)
+
+// lifecycleStages lists every stage, in the order users usually go through them
+var lifecycleStages = []string{LifecycleRegistered, LifecycleSubscribed, LifecyclePastDue, LifecycleChurned}
+
+// UserProfile is what the analytics service knows of a user from the other services: when they
+// registered, their subscription and their lifecycle stage
+type UserProfile struct {
+	UserID         string     `json:"user_id"`
+	Stage          string     `json:"stage"`
+	StageChangedAt time.Time  `json:"stage_changed_at"` // Time of the event that set the stage
+	Plan           string     `json:"plan,omitempty"`
+	RegisteredAt   *time.Time `json:"registered_at,omitempty"`
+	SubscribedAt   *time.Time `json:"subscribed_at,omitempty"` // Start of the current or last subscription
+	CancelledAt    *time.Time `json:"cancelled_at,omitempty"`
+	LastLoginAt    *time.Time `json:"last_login_at,omitempty"`
+	LastPaymentAt  *time.Time `json:"last_payment_at,omitempty"`
+	Seeded         bool       `json:"seeded"` // Built or updated from history by a bootstrap
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// UserProfiles keeps the profile of every user seen in the events of the auth and billing
+// services, consumed live or seeded from their history. Events may arrive in any order: times are
+// kept as the earliest registration and the latest login and payment, and the stage is set by the
+// latest event changing it, so replaying history after live events changes nothing.
+type UserProfiles struct {
+	profiles *BoundedCache // User ID -> *UserProfile, never changed once cached
+	clock    Clock
+}
+
+// NewUserProfiles creates a store of at most USER_PROFILES_MAX_ENTRIES profiles (default 1000000).
+// When full, the least recently updated or read profile is evicted.
+func NewUserProfiles() *UserProfiles {
+	return &UserProfiles{
+		profiles: NewBoundedCache("user_profiles", getEnvInt("USER_PROFILES_MAX_ENTRIES", 1000000), 0),
+		clock:    SystemClock(),
+	}
+}
+
+// Cache returns the cache of profiles
+func (p *UserProfiles) Cache() *BoundedCache {
+	return p.profiles
+}
+
+// SetClock replaces the clock profiles are updated with
+func (p *UserProfiles) SetClock(clock Clock) {
+	p.clock = clock
+	p.profiles.SetClock(clock)
+}
+
+// Apply updates the profile of the event's user and reports whether the event was a lifecycle
+// event. Seeded events come from a bootstrap. Does nothing without a store.
+func (p *UserProfiles) Apply(event *CrossServiceEvent, seeded bool) bool {
+	if p == nil || event.UserID == "" || !isLifecycleEvent(event.EventType) {
+		return false
+	}
+
+	now := p.clock.Now()
+	p.profiles.Update(event.UserID, func(value interface{}, exists bool) interface{} {
+		profile := &UserProfile{UserID: event.UserID}
+		if exists {
+			copied := *value.(*UserProfile)
+			profile = &copied
+		}
+		profile.apply(event)
+		profile.Seeded = profile.Seeded || seeded
+		profile.UpdatedAt = now
+		return profile
+	})
+	return true
+}
+
+// Get returns the profile of a user
+func (p *UserProfiles) Get(userID string) (*UserProfile, bool) {
+	value, exists := p.profiles.Get(userID)
+	if !exists {
+		return nil, false
+	}
+	profile := *value.(*UserProfile)
+	return &profile, true
+}
+
+// Stages returns the number of profiles in every lifecycle stage
+func (p *UserProfiles) Stages() map[string]int {
+	stages := make(map[string]int, len(lifecycleStages))
+	for _, stage := range lifecycleStages {
+		stages[stage] = 0
+	}
+	p.profiles.Each(func(key string, value interface{}) {
+		stages[value.(*UserProfile).Stage]++
+	})
+	return stages
+}
+
+// isLifecycleEvent reports whether events of a type change user profiles
+func isLifecycleEvent(eventType string) bool {
+	switch eventType {
+	case "auth.user.registered", "auth.user.login",
+		"billing.user.subscription.created", "billing.user.subscription.updated", "billing.user.subscription.cancelled",
+		"billing.payment.completed", "billing.payment.failed":
+		return true
+	}
+	return false
+}
+
+// apply updates the profile with a lifecycle event
+func (profile *UserProfile) apply(event *CrossServiceEvent) {
+	at := event.Timestamp
+	switch event.EventType {
+	case "auth.user.registered":
+		if profile.RegisteredAt == nil || at.Before(*profile.RegisteredAt) {
+			profile.RegisteredAt = &at
+		}
+		profile.setStage(LifecycleRegistered, at, profile.Stage == "")
+	case "auth.user.login":
+		if profile.LastLoginAt == nil || at.After(*profile.LastLoginAt) {
+			profile.LastLoginAt = &at
+		}
+		profile.setStage(LifecycleRegistered, at, profile.Stage == "")
+	case "billing.user.subscription.created", "billing.user.subscription.updated":
+		if profile.setStage(LifecycleSubscribed, at, true) {
+			if plan, ok := event.Data["plan"].(string); ok && plan != "" {
+				profile.Plan = plan
+			}
+			if event.EventType == "billing.user.subscription.created" || profile.SubscribedAt == nil {
+				profile.SubscribedAt = &at
+			}
+		}
+	case "billing.user.subscription.cancelled":
+		if profile.setStage(LifecycleChurned, at, true) {
+			profile.CancelledAt = &at
+		}
+	case "billing.payment.completed":
+		if profile.LastPaymentAt == nil || at.After(*profile.LastPaymentAt) {
+			profile.LastPaymentAt = &at
+		}
+		profile.setStage(LifecycleSubscribed, at, profile.Stage == LifecyclePastDue)
+	case "billing.payment.failed":
+		profile.setStage(LifecyclePastDue, at, profile.Stage == LifecycleSubscribed)
+	}
+}
+
+// setStage moves the profile to a stage when the transition applies and the event is not older
+// than the one that set the current stage. It reports whether the stage was set.
+func (profile *UserProfile) setStage(stage string, at time.Time, applies bool) bool {
+	if !applies || at.Before(profile.StageChangedAt) {
+		return false
+	}
+	profile.Stage = stage
+	profile.StageChangedAt = at
+	return true
+}
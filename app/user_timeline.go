@@ -0,0 +1,342 @@
+package app
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of timeline entries
+const (
+	TimelineEntryEvent        = "event"         // An analytics event of the user
+	TimelineEntrySession      = "session"       // A session of the user, at the time it started
+	TimelineEntryServiceEvent = "service_event" // An event of another service about the user
+)
+
+// Timeline orders
+const (
+	TimelineNewestFirst = "desc"
+	TimelineOldestFirst = "asc"
+)
+
+// maxTimelineLimit is the most entries returned per timeline page
+const maxTimelineLimit = 1000
+
+// timelineServices are the sources of the cross-service events kept for user timelines
+var timelineServices = map[string]bool{"auth": true, "billing": true, "payments": true}
+
+// TimelineSession summarizes the events of a user sharing a session ID
+type TimelineSession struct {
+	SessionID       string        `json:"session_id"`
+	Start           time.Time     `json:"start"`
+	End             time.Time     `json:"end"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	EventCount      int           `json:"event_count"`
+	Pages           []string      `json:"pages,omitempty"` // Distinct pages in the order they were first viewed
+	Quality         *SessionScore `json:"quality,omitempty"`
+}
+
+// TimelineEntry is an analytics event, session or cross-service event of a user's timeline
+type TimelineEntry struct {
+	Kind         string             `json:"kind"`
+	Timestamp    time.Time          `json:"timestamp"`
+	Source       string             `json:"source"` // "analytics", or the service the event came from
+	Event        *AnalyticsEvent    `json:"event,omitempty"`
+	Session      *TimelineSession   `json:"session,omitempty"`
+	ServiceEvent *CrossServiceEvent `json:"service_event,omitempty"`
+	key          string             // Orders entries with the same timestamp, sessions before their first event
+}
+
+// TimelineQuery selects a page of a user's timeline
+type TimelineQuery struct {
+	UserID string
+	Start  time.Time // Optional
+	End    time.Time // Optional
+	Order  string    // TimelineNewestFirst (default) or TimelineOldestFirst
+	Limit  int
+	Cursor string // NextCursor of the previous page, empty for the first page
+}
+
+// TimelinePage is a page of a user's timeline
+type TimelinePage struct {
+	UserID     string          `json:"user_id"`
+	Entries    []TimelineEntry `json:"entries"`
+	NextCursor string          `json:"next_cursor,omitempty"` // Empty on the last page
+}
+
+// ServiceEventLog keeps the recent auth, billing and payments events consumed from Kafka per user,
+// so they can be shown on the user's timeline. Users are kept in a bounded cache, each with their
+// latest events.
+type ServiceEventLog struct {
+	users         *BoundedCache // User ID -> []*CrossServiceEvent, oldest first
+	eventsPerUser int
+}
+
+// NewServiceEventLog creates a cross-service event log keeping the last
+// SERVICE_EVENT_LOG_EVENTS_PER_USER (default 500) events of up to SERVICE_EVENT_LOG_MAX_USERS
+// (default 100000) users, for SERVICE_EVENT_LOG_TTL (default 30 days) after their last event
+func NewServiceEventLog() *ServiceEventLog {
+	return &ServiceEventLog{
+		users:         NewBoundedCache("service_events", getEnvInt("SERVICE_EVENT_LOG_MAX_USERS", 100000), getEnvDuration("SERVICE_EVENT_LOG_TTL", 30*24*time.Hour)),
+		eventsPerUser: getEnvInt("SERVICE_EVENT_LOG_EVENTS_PER_USER", 500),
+	}
+}
+
+// Cache returns the cache of users and their events
+func (l *ServiceEventLog) Cache() *BoundedCache {
+	return l.users
+}
+
+// Record keeps an event consumed from another service. Events without a user, or not from the
+// auth, billing or payments services, are ignored. Does nothing without a log.
+func (l *ServiceEventLog) Record(event *CrossServiceEvent) {
+	if l == nil || event.UserID == "" || !timelineServices[serviceEventSource(event)] {
+		return
+	}
+
+	recorded := *event
+	if recorded.ID == "" {
+		recorded.ID = uuid.New().String()
+	}
+	if recorded.Timestamp.IsZero() {
+		recorded.Timestamp = time.Now()
+	}
+
+	l.users.Update(recorded.UserID, func(value interface{}, exists bool) interface{} {
+		var events []*CrossServiceEvent
+		if exists {
+			events = value.([]*CrossServiceEvent)
+		}
+		// Readers hold the previous slice, so the events are copied rather than appended in place
+		if l.eventsPerUser > 0 && len(events) >= l.eventsPerUser {
+			events = events[len(events)-l.eventsPerUser+1:]
+		}
+		updated := make([]*CrossServiceEvent, len(events), len(events)+1)
+		copy(updated, events)
+		return append(updated, &recorded)
+	})
+}
+
+// Events returns the kept events of a user, oldest first
+func (l *ServiceEventLog) Events(userID string) []*CrossServiceEvent {
+	value, exists := l.users.Get(userID)
+	if !exists {
+		return nil
+	}
+	return value.([]*CrossServiceEvent)
+}
+
+// Query returns the kept events of a user, or of every user when userID is empty, with a
+// timestamp in [start, end). Zero times leave the range open. Reading does not keep users in the
+// log longer. Returns nothing without a log.
+func (l *ServiceEventLog) Query(userID string, start, end time.Time) []*CrossServiceEvent {
+	if l == nil {
+		return nil
+	}
+	var kept [][]*CrossServiceEvent
+	if userID != "" {
+		if value, exists := l.users.Peek(userID); exists {
+			kept = append(kept, value.([]*CrossServiceEvent))
+		}
+	} else {
+		l.users.Each(func(_ string, value interface{}) {
+			kept = append(kept, value.([]*CrossServiceEvent))
+		})
+	}
+
+	var events []*CrossServiceEvent
+	for _, userEvents := range kept {
+		for _, event := range userEvents {
+			if (start.IsZero() || !event.Timestamp.Before(start)) && (end.IsZero() || event.Timestamp.Before(end)) {
+				events = append(events, event)
+			}
+		}
+	}
+	return events
+}
+
+// qualifiedServiceEventType returns the type of a cross-service event prefixed with the service it
+// came from, e.g. "auth.user.registered" for a "user.registered" event of the auth service
+func qualifiedServiceEventType(event *CrossServiceEvent) string {
+	source := serviceEventSource(event)
+	if strings.HasPrefix(event.EventType, source+".") {
+		return event.EventType
+	}
+	return source + "." + event.EventType
+}
+
+// serviceEventSource returns the service an event came from: its source, or the first segment of
+// its type, e.g. "billing" for "billing.payment.completed"
+func serviceEventSource(event *CrossServiceEvent) string {
+	if event.Source != "" {
+		return event.Source
+	}
+	return strings.SplitN(event.EventType, ".", 2)[0]
+}
+
+// UserTimeline merges the analytics events, sessions and cross-service events of a user into one
+// chronological view, for support and debugging
+type UserTimeline struct {
+	analyticsService *AnalyticsService
+	serviceEvents    *ServiceEventLog
+	quality          *SessionQuality // Scores the sessions, if set
+}
+
+// NewUserTimeline creates a user timeline of the events of the analytics service and the
+// cross-service event log
+func NewUserTimeline(analyticsService *AnalyticsService, serviceEvents *ServiceEventLog) *UserTimeline {
+	return &UserTimeline{
+		analyticsService: analyticsService,
+		serviceEvents:    serviceEvents,
+	}
+}
+
+// ServiceEvents returns the log of cross-service events shown on timelines
+func (t *UserTimeline) ServiceEvents() *ServiceEventLog {
+	return t.serviceEvents
+}
+
+// SetSessionQuality sets the model scoring the sessions of timelines
+func (t *UserTimeline) SetSessionQuality(quality *SessionQuality) {
+	t.quality = quality
+}
+
+// Query returns a page of the timeline of a user in the project of the context. Cross-service
+// events are not tied to a project and appear on the user's timeline in every project.
+func (t *UserTimeline) Query(ctx context.Context, query TimelineQuery) (*TimelinePage, error) {
+	if query.UserID == "" {
+		return nil, fmt.Errorf("user ID is required")
+	}
+	if query.Order == "" {
+		query.Order = TimelineNewestFirst
+	}
+	if query.Order != TimelineNewestFirst && query.Order != TimelineOldestFirst {
+		return nil, fmt.Errorf("invalid order: %s. Use asc or desc", query.Order)
+	}
+	if query.Limit <= 0 || query.Limit > maxTimelineLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxTimelineLimit)
+	}
+	var after *TimelineEntry
+	if query.Cursor != "" {
+		cursor, err := decodeTimelineCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		after = cursor
+	}
+
+	events := t.analyticsService.QueryEvents(ctx, EventFilter{ProjectID: ProjectFromContext(ctx), UserID: query.UserID, Start: query.Start, End: query.End})
+	entries := make([]TimelineEntry, 0, len(events))
+	for _, event := range events {
+		entries = append(entries, TimelineEntry{
+			Kind:      TimelineEntryEvent,
+			Timestamp: event.Timestamp,
+			Source:    "analytics",
+			Event:     event,
+			key:       "1|event|" + event.ID,
+		})
+	}
+	for _, session := range timelineSessions(events, t.quality) {
+		entries = append(entries, TimelineEntry{
+			Kind:      TimelineEntrySession,
+			Timestamp: session.Start,
+			Source:    "analytics",
+			Session:   session,
+			key:       "0|session|" + session.SessionID,
+		})
+	}
+	for _, event := range t.serviceEvents.Events(query.UserID) {
+		if (query.Start.IsZero() || !event.Timestamp.Before(query.Start)) && (query.End.IsZero() || event.Timestamp.Before(query.End)) {
+			entries = append(entries, TimelineEntry{
+				Kind:         TimelineEntryServiceEvent,
+				Timestamp:    event.Timestamp,
+				Source:       serviceEventSource(event),
+				ServiceEvent: event,
+				key:          "1|service|" + event.ID,
+			})
+		}
+	}
+
+	before := func(a, b *TimelineEntry) bool {
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp) == (query.Order == TimelineOldestFirst)
+		}
+		return a.key != b.key && (a.key < b.key) == (query.Order == TimelineOldestFirst)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return before(&entries[i], &entries[j])
+	})
+
+	first := 0
+	if after != nil {
+		first = sort.Search(len(entries), func(i int) bool {
+			return before(after, &entries[i])
+		})
+	}
+	page := &TimelinePage{UserID: query.UserID, Entries: entries[first:]}
+	if len(page.Entries) > query.Limit {
+		page.Entries = page.Entries[:query.Limit]
+		page.NextCursor = encodeTimelineCursor(&page.Entries[query.Limit-1])
+	}
+	return page, nil
+}
+
+// timelineSessions summarizes the sessions of a user's events, sorted by time, scored by the
+// quality model if any
+func timelineSessions(events []*AnalyticsEvent, quality *SessionQuality) []*TimelineSession {
+	var sessions []*TimelineSession
+	byID := make(map[string]*TimelineSession)
+	sessionEvents := make(map[string][]*AnalyticsEvent)
+	viewed := make(map[string]bool) // Session ID and page
+	for _, event := range events {
+		if event.SessionID == "" {
+			continue
+		}
+		session, exists := byID[event.SessionID]
+		if !exists {
+			session = &TimelineSession{SessionID: event.SessionID, Start: event.Timestamp}
+			byID[event.SessionID] = session
+			sessions = append(sessions, session)
+		}
+		session.End = event.Timestamp
+		session.EventCount++
+		sessionEvents[event.SessionID] = append(sessionEvents[event.SessionID], event)
+		if event.Page != "" && !viewed[event.SessionID+"|"+event.Page] {
+			viewed[event.SessionID+"|"+event.Page] = true
+			session.Pages = append(session.Pages, event.Page)
+		}
+	}
+	for _, session := range sessions {
+		session.DurationSeconds = session.End.Sub(session.Start).Seconds()
+		if quality != nil {
+			score := quality.Score(sessionEvents[session.SessionID])
+			session.Quality = &score
+		}
+	}
+	return sessions
+}
+
+// encodeTimelineCursor returns an opaque cursor continuing a timeline after an entry
+func encodeTimelineCursor(entry *TimelineEntry) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(entry.Timestamp.UnixNano(), 10) + "|" + entry.key))
+}
+
+// decodeTimelineCursor returns the position of the entry a cursor continues after
+func decodeTimelineCursor(cursor string) (*TimelineEntry, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(decoded), "|", 2)
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &TimelineEntry{Timestamp: time.Unix(0, nanos), key: parts[1]}, nil
+}
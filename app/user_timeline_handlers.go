@@ -0,0 +1,73 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// getUserTimeline returns a page of the chronologically merged analytics events, sessions and
+// cross-service events of a user in the project
+func (s *App) getUserTimeline(c *fiber.Ctx) error {
+	query := TimelineQuery{
+		UserID: utils.CopyString(c.Params("id")),
+		Order:  c.Query("order"),
+		Limit:  100,
+		Cursor: c.Query("cursor"),
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "limit must be a positive integer",
+			})
+		}
+		query.Limit = parsed
+	}
+
+	for name, value := range map[string]*time.Time{"start_date": &query.Start, "end_date": &query.End} {
+		if c.Query(name) == "" {
+			continue
+		}
+		parsed, err := parseQueryDate(c.Query(name))
+		if err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid " + name + " format. Use YYYY-MM-DD or RFC3339",
+			})
+		}
+		*value = parsed
+	}
+
+	ctx := ContextWithProject(c.Context(), projectIDFromRequest(c))
+	page, err := s.timeline.Query(ctx, query)
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":   "success",
+		"timeline": page,
+	})
+}
+
+// getUserProfile returns the profile and lifecycle stage of a user, from the events of the auth
+// and billing services
+func (s *App) getUserProfile(c *fiber.Ctx) error {
+	profile, exists := s.profiles.Get(c.Params("id"))
+	if !exists {
+		return c.Status(http.StatusNotFound).JSON(fiber.Map{
+			"error": "Profile not found",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "success",
+		"profile": profile,
+	})
+}
@@ -0,0 +1,38 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// getValidationErrors returns the recent validation issues of the project, such as rejected events and
+// properties over the cardinality limit, along with every property whose values are being hashed
+func (s *App) getValidationErrors(c *fiber.Ctx) error {
+	kind := c.Query("kind")
+	if kind != "" && kind != ValidationIssueSchema && kind != ValidationIssueCardinality && kind != ValidationIssueTimestamp {
+		return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+			"error": "kind must be schema, cardinality or timestamp",
+		})
+	}
+
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "limit must be a positive integer",
+			})
+		}
+		limit = parsed
+	}
+
+	projectID := projectIDFromRequest(c)
+	return c.JSON(fiber.Map{
+		"status":             "success",
+		"errors":             s.analyticsService.ValidationLog().Query(projectID, kind, limit),
+		"limited_properties": s.analyticsService.Cardinality().LimitedProperties(projectID),
+		"cardinality_limit":  s.analyticsService.Cardinality().Limit(),
+	})
+}
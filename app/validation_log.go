@@ -0,0 +1,82 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of validation issues
+const (
+	ValidationIssueSchema      = "schema"      // The event was rejected by its schema
+	ValidationIssueCardinality = "cardinality" // A property exceeded the distinct-value limit
+	ValidationIssueTimestamp   = "timestamp"   // The event's timestamp was outside the lateness window
+)
+
+// ValidationIssue is a problem found with the events a project sends
+type ValidationIssue struct {
+	ID         string    `json:"id"`
+	ProjectID  string    `json:"project_id"`
+	Kind       string    `json:"kind"`
+	EventType  string    `json:"event_type,omitempty"`
+	Property   string    `json:"property,omitempty"`
+	Message    string    `json:"message"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// ValidationLog keeps a bounded log of validation issues so projects can fix their instrumentation
+type ValidationLog struct {
+	entries    []ValidationIssue
+	maxEntries int
+	mutex      sync.RWMutex
+}
+
+// NewValidationLog creates a new validation log sized from VALIDATION_LOG_SIZE
+func NewValidationLog() *ValidationLog {
+	return &ValidationLog{
+		maxEntries: getEnvInt("VALIDATION_LOG_SIZE", 1000),
+	}
+}
+
+// Record adds an issue to the log
+func (l *ValidationLog) Record(projectID, kind, eventType, property, message string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries = append(l.entries, ValidationIssue{
+		ID:         uuid.New().String(),
+		ProjectID:  projectID,
+		Kind:       kind,
+		EventType:  eventType,
+		Property:   property,
+		Message:    message,
+		RecordedAt: time.Now(),
+	})
+
+	// Drop the oldest entries once the log is full
+	if l.maxEntries > 0 && len(l.entries) > l.maxEntries {
+		l.entries = l.entries[len(l.entries)-l.maxEntries:]
+	}
+}
+
+// Query returns the issues of a project, optionally of one kind, newest first
+func (l *ValidationLog) Query(projectID, kind string, limit int) []ValidationIssue {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	results := make([]ValidationIssue, 0)
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		entry := l.entries[i]
+		if entry.ProjectID != projectID || (kind != "" && entry.Kind != kind) {
+			continue
+		}
+
+		results = append(results, entry)
+		if limit > 0 && len(results) >= limit {
+			break
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// AnyVersion matches every version of a resource, as requested with "If-Match: *"
+const AnyVersion int64 = -1
+
+// VersionConflictError is returned when a resource changed since the version an update was based on
+type VersionConflictError struct {
+	Resource string
+	ID       string
+	Expected int64
+	Current  int64
+}
+
+// Error describes the conflicting versions
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%s %s was modified concurrently: update is based on version %d, current version is %d", e.Resource, e.ID, e.Expected, e.Current)
+}
+
+// checkVersion returns a VersionConflictError unless the expected version is the current one
+func checkVersion(resource, id string, current, expected int64) error {
+	if expected == AnyVersion || expected == current {
+		return nil
+	}
+	return &VersionConflictError{Resource: resource, ID: id, Expected: expected, Current: current}
+}
+
+// ETag returns the entity tag of a resource version
+func ETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// parseIfMatch parses an If-Match header holding a single entity tag, weak or strong, or "*"
+func parseIfMatch(header string) (int64, error) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return AnyVersion, nil
+	}
+
+	tag := strings.TrimPrefix(header, "W/")
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		unquoted = tag // Tolerate bare versions
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid If-Match header %q, expected the ETag of the resource", header)
+	}
+	return version, nil
+}
+
+// ContentETag returns a weak entity tag of a representation computed from the given parts, for
+// responses without a version of their own
+func ContentETag(parts ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return `W/"` + hex.EncodeToString(hash[:8]) + `"`
+}
+
+// ifNoneMatch reports whether the If-None-Match header of a request matches an entity tag, in
+// which case a GET is answered with 304 Not Modified. Tags are compared weakly.
+func ifNoneMatch(c *fiber.Ctx, etag string) bool {
+	header := strings.TrimSpace(c.Get(fiber.HeaderIfNoneMatch))
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion returns the version an update is based on, taken from the If-Match header.
+// On failure it also returns the status to respond with: 428 when the header is missing.
+func ifMatchVersion(c *fiber.Ctx) (int64, int, error) {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return 0, http.StatusPreconditionRequired, fmt.Errorf("If-Match header is required; send the ETag of the version being updated")
+	}
+
+	version, err := parseIfMatch(header)
+	if err != nil {
+		return 0, http.StatusBadRequest, err
+	}
+	return version, 0, nil
+}
+
+// writeUpdateError responds to a failed create or update: 409 with the current version on a
+// version conflict, 409 when a client-supplied ID is taken, the given status otherwise
+func writeUpdateError(c *fiber.Ctx, err error, status int) error {
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		c.Set(fiber.HeaderETag, ETag(conflict.Current))
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error":           conflict.Error(),
+			"current_version": conflict.Current,
+		})
+	}
+
+	var exists *ResourceExistsError
+	if errors.As(err, &exists) {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": exists.Error(),
+		})
+	}
+
+	return c.Status(status).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
+
+// notFoundOrBadRequest returns 404 for errors about a missing resource, 400 otherwise
+func notFoundOrBadRequest(err error) int {
+	if strings.Contains(err.Error(), "not found") {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
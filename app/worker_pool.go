@@ -0,0 +1,214 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// WorkerPool runs submitted tasks on a resizable set of workers with a bounded queue
+type WorkerPool struct {
+	name      string
+	queue     []func()
+	capacity  int // Maximum queued tasks
+	size      int // Desired number of workers
+	running   int // Workers currently alive
+	busy      int // Workers currently executing a task
+	processed uint64
+	dropped   uint64
+	stopped   bool
+	mutex     sync.Mutex
+	notEmpty  *sync.Cond
+	notFull   *sync.Cond
+}
+
+// WorkerPoolStats represents a snapshot of a worker pool
+type WorkerPoolStats struct {
+	Name      string `json:"name"`
+	Size      int    `json:"size"`
+	Running   int    `json:"running"`
+	Busy      int    `json:"busy"`
+	Queued    int    `json:"queued"`
+	Capacity  int    `json:"capacity"`
+	Processed uint64 `json:"processed"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// NewWorkerPool creates and starts a worker pool
+func NewWorkerPool(name string, size, capacity int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	pool := &WorkerPool{
+		name:     name,
+		capacity: capacity,
+	}
+	pool.notEmpty = sync.NewCond(&pool.mutex)
+	pool.notFull = sync.NewCond(&pool.mutex)
+
+	pool.mutex.Lock()
+	pool.resizeLocked(size)
+	pool.mutex.Unlock()
+
+	return pool
+}
+
+// Submit queues a task, blocking while the queue is full. It returns false if the pool is stopped.
+func (p *WorkerPool) Submit(task func()) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for len(p.queue) >= p.capacity && !p.stopped {
+		p.notFull.Wait()
+	}
+	if p.stopped {
+		return false
+	}
+
+	p.queue = append(p.queue, task)
+	p.notEmpty.Signal()
+	return true
+}
+
+// TrySubmit queues a task without blocking. It returns false if the queue is full or the pool is stopped.
+func (p *WorkerPool) TrySubmit(task func()) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.stopped || len(p.queue) >= p.capacity {
+		p.dropped++
+		return false
+	}
+
+	p.queue = append(p.queue, task)
+	p.notEmpty.Signal()
+	return true
+}
+
+// Resize changes the number of workers
+func (p *WorkerPool) Resize(size int) error {
+	if size < 1 {
+		return fmt.Errorf("worker pool size must be at least 1")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.resizeLocked(size)
+	return nil
+}
+
+// resizeLocked starts missing workers or wakes idle ones so surplus workers exit
+func (p *WorkerPool) resizeLocked(size int) {
+	p.size = size
+	for p.running < p.size {
+		p.running++
+		go p.worker()
+	}
+	p.notEmpty.Broadcast()
+}
+
+// SetCapacity changes the maximum number of queued tasks
+func (p *WorkerPool) SetCapacity(capacity int) error {
+	if capacity < 1 {
+		return fmt.Errorf("queue capacity must be at least 1")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.capacity = capacity
+	p.notFull.Broadcast()
+	return nil
+}
+
+// Size returns the configured number of workers
+func (p *WorkerPool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.size
+}
+
+// Capacity returns the configured queue capacity
+func (p *WorkerPool) Capacity() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.capacity
+}
+
+// Stats returns a snapshot of the pool
+func (p *WorkerPool) Stats() WorkerPoolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return WorkerPoolStats{
+		Name:      p.name,
+		Size:      p.size,
+		Running:   p.running,
+		Busy:      p.busy,
+		Queued:    len(p.queue),
+		Capacity:  p.capacity,
+		Processed: p.processed,
+		Dropped:   p.dropped,
+	}
+}
+
+// Stopped reports whether the pool was stopped
+func (p *WorkerPool) Stopped() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stopped
+}
+
+// Stop lets the workers drain the queue and exit. Further submissions are rejected.
+func (p *WorkerPool) Stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.stopped = true
+	p.notEmpty.Broadcast()
+	p.notFull.Broadcast()
+}
+
+// worker executes queued tasks until the pool shrinks or stops
+func (p *WorkerPool) worker() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for {
+		for len(p.queue) == 0 && !p.stopped && p.running <= p.size {
+			p.notEmpty.Wait()
+		}
+
+		// Exit if the pool was shrunk or stopped with nothing left to drain
+		if p.running > p.size || len(p.queue) == 0 {
+			p.running--
+			return
+		}
+
+		task := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.notFull.Signal()
+		p.busy++
+
+		p.mutex.Unlock()
+		p.runTask(task)
+		p.mutex.Lock()
+
+		p.busy--
+		p.processed++
+	}
+}
+
+// runTask executes a task, recovering from panics so the worker survives
+func (p *WorkerPool) runTask(task func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Error: Task in worker pool %s panicked: %v", p.name, r)
+		}
+	}()
+	task()
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// requireWriteKey returns a handler rejecting events sent to a project with write keys without
+// one of its accepted keys. Internal producers authenticated by ServiceAuth are not subject to
+// write keys.
+func (s *App) requireWriteKey() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Locals("service_identity") != nil {
+			return c.Next()
+		}
+
+		projectID := projectIDFromRequest(c)
+		if err := s.writeKeys.Authorize(projectID, c.Get("X-API-Key")); err != nil {
+			var rejected *WriteKeyError
+			errors.As(err, &rejected)
+			s.siem.Export(requestSecurityEvent(c, SecurityAuth, "write_key_rejected", OutcomeDenied, 5, map[string]interface{}{
+				"project_id": projectID,
+				"key_id":     rejected.KeyID,
+				"key_status": rejected.Status,
+			}))
+			return c.Status(http.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return c.Next()
+	}
+}
+
+// listWriteKeys returns the write keys of a project with the requests sent with each
+func (s *App) listWriteKeys(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status":     "success",
+		"write_keys": s.writeKeys.List(c.Params("id")),
+	})
+}
+
+// createWriteKey creates a write key for a project. The key is only part of this response.
+func (s *App) createWriteKey(c *fiber.Ctx) error {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+
+	projectID := utils.CopyString(c.Params("id"))
+	key, err := s.writeKeys.Create(projectID, request.Name)
+	if err != nil {
+		return c.Status(http.StatusConflict).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.siem.Export(requestSecurityEvent(c, SecurityAdmin, "write_key.create", OutcomeSuccess, 5, map[string]interface{}{
+		"project_id": projectID,
+		"key_id":     key.ID,
+	}))
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"status":    "success",
+		"write_key": key,
+	})
+}
+
+// rotateWriteKey replaces a write key by a new one, accepting the old key for a grace period
+// ("grace_period" in the body or ?grace_period, e.g. "24h", default WRITE_KEY_GRACE_PERIOD)
+func (s *App) rotateWriteKey(c *fiber.Ctx) error {
+	var request struct {
+		Name        string `json:"name"`
+		GracePeriod string `json:"grace_period"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+	}
+	if request.GracePeriod == "" {
+		request.GracePeriod = c.Query("grace_period")
+	}
+	gracePeriod := s.writeKeys.GracePeriod()
+	if request.GracePeriod != "" {
+		var err error
+		if gracePeriod, err = time.ParseDuration(request.GracePeriod); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid grace_period: " + err.Error(),
+			})
+		}
+	}
+
+	projectID := utils.CopyString(c.Params("id"))
+	replacement, retired, err := s.writeKeys.Rotate(projectID, c.Params("key_id"), request.Name, gracePeriod)
+	if err != nil {
+		return c.Status(notFoundOrBadRequest(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.siem.Export(requestSecurityEvent(c, SecurityAdmin, "write_key.rotate", OutcomeSuccess, 5, map[string]interface{}{
+		"project_id":     projectID,
+		"key_id":         retired.ID,
+		"replacement_id": replacement.ID,
+		"expires_at":     retired.ExpiresAt,
+	}))
+	return c.Status(http.StatusCreated).JSON(fiber.Map{
+		"status":    "success",
+		"write_key": replacement,
+		"retiring":  retired,
+	})
+}
+
+// revokeWriteKey stops accepting a write key immediately
+func (s *App) revokeWriteKey(c *fiber.Ctx) error {
+	projectID := utils.CopyString(c.Params("id"))
+	key, err := s.writeKeys.Revoke(projectID, c.Params("key_id"))
+	if err != nil {
+		return c.Status(notFoundOrBadRequest(err)).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	s.siem.Export(requestSecurityEvent(c, SecurityAdmin, "write_key.revoke", OutcomeSuccess, 6, map[string]interface{}{
+		"project_id": projectID,
+		"key_id":     key.ID,
+		"requests":   key.Requests,
+	}))
+	return c.JSON(fiber.Map{
+		"status":    "success",
+		"write_key": key,
+	})
+}
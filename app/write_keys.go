@@ -0,0 +1,334 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Write key states
+const (
+	WriteKeyActive   = "active"
+	WriteKeyRetiring = "retiring" // Replaced by a rotation, accepted until its grace period ends
+	WriteKeyExpired  = "expired"  // Grace period over
+	WriteKeyRevoked  = "revoked"
+)
+
+// Limits of write keys
+const (
+	maxActiveWriteKeys     = 2 // Active keys of a project, so one can be rotated while the other is in use
+	maxWriteKeysPerProject = 20
+	writeKeyPrefix         = "wk_"
+	maxWriteKeyGracePeriod = 90 * 24 * time.Hour
+	writeKeyVisibleLength  = len(writeKeyPrefix) + 6 // Characters of a key shown to recognize it
+)
+
+// WriteKey is a key SDKs send events of a project with. The key itself is only returned when
+// created; afterwards it is identified by its ID and prefix.
+type WriteKey struct {
+	ID         string     `json:"id"` // APIKeyID of the key
+	ProjectID  string     `json:"project_id"`
+	Name       string     `json:"name,omitempty"`
+	Prefix     string     `json:"prefix"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`  // End of the grace period of a retiring key
+	ReplacedBy string     `json:"replaced_by,omitempty"` // ID of the key a rotation created in its place
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Requests   int64      `json:"requests"` // Requests authenticated with the key
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Key        string     `json:"key,omitempty"` // Only set when the key is created
+}
+
+// WriteKeyError is the reason a request's write key was rejected
+type WriteKeyError struct {
+	ProjectID string
+	KeyID     string // Empty for keys unknown to the project
+	Status    string // State of a known key that is no longer accepted
+}
+
+func (e *WriteKeyError) Error() string {
+	switch e.Status {
+	case WriteKeyRevoked:
+		return fmt.Sprintf("write key %s of project %s has been revoked", e.KeyID, e.ProjectID)
+	case WriteKeyExpired:
+		return fmt.Sprintf("write key %s of project %s was rotated and its grace period is over", e.KeyID, e.ProjectID)
+	}
+	return fmt.Sprintf("invalid write key for project %s", e.ProjectID)
+}
+
+// writeKey is a registered key with its traffic, counted without holding the registry's lock
+type writeKey struct {
+	WriteKey
+	hash     [sha256.Size]byte
+	requests atomic.Int64
+	lastUsed atomic.Int64 // Unix nanoseconds, 0 before the first request
+}
+
+// WriteKeys holds the write keys of each project. Projects without keys accept events with any
+// API key, as before write keys existed; once a project has keys, events must be sent with one
+// of its active or retiring keys. Rotating a key creates its replacement and keeps accepting the
+// old key for a grace period, so SDK deployments can be updated without dropping events.
+type WriteKeys struct {
+	projects    map[string][]*writeKey // Oldest first
+	byID        map[string]*writeKey
+	gracePeriod time.Duration // Default grace period of rotations
+	clock       Clock
+	mutex       sync.RWMutex
+}
+
+// NewWriteKeys creates an empty registry of write keys, with rotations granting a grace period of
+// WRITE_KEY_GRACE_PERIOD unless they ask for another
+func NewWriteKeys() *WriteKeys {
+	return &WriteKeys{
+		projects:    make(map[string][]*writeKey),
+		byID:        make(map[string]*writeKey),
+		gracePeriod: getEnvDuration("WRITE_KEY_GRACE_PERIOD", 7*24*time.Hour),
+		clock:       SystemClock(),
+	}
+}
+
+// SetClock replaces the clock grace periods are measured with
+func (k *WriteKeys) SetClock(clock Clock) {
+	k.clock = clock
+}
+
+// Create creates a new active key for a project. A project has at most two active keys.
+func (k *WriteKeys) Create(projectID, name string) (*WriteKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if err := k.checkCapacity(projectID); err != nil {
+		return nil, err
+	}
+	return k.create(projectID, name)
+}
+
+// GracePeriod returns the default grace period of rotations
+func (k *WriteKeys) GracePeriod() time.Duration {
+	return k.gracePeriod
+}
+
+// Rotate replaces an active key by a new one. The old key is accepted for the grace period and
+// is then expired; without a grace period, it stops being accepted at once.
+func (k *WriteKeys) Rotate(projectID, keyID, name string, gracePeriod time.Duration) (replacement *WriteKey, retired *WriteKey, err error) {
+	if gracePeriod < 0 || gracePeriod > maxWriteKeyGracePeriod {
+		return nil, nil, fmt.Errorf("grace period must be between 0s and %s", maxWriteKeyGracePeriod)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	key, err := k.get(projectID, keyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := k.clock.Now()
+	if status := key.status(now); status != WriteKeyActive {
+		return nil, nil, fmt.Errorf("write key %s is %s, only active keys can be rotated", keyID, status)
+	}
+	if name == "" {
+		name = key.Name
+	}
+	if len(k.projects[projectID]) >= maxWriteKeysPerProject {
+		k.prune(projectID, now)
+	}
+
+	replacement, err = k.create(projectID, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	expiresAt := now.Add(gracePeriod)
+	key.ExpiresAt = &expiresAt
+	key.ReplacedBy = replacement.ID
+	return replacement, key.snapshot(now), nil
+}
+
+// Revoke stops accepting a key immediately, whether active or retiring
+func (k *WriteKeys) Revoke(projectID, keyID string) (*WriteKey, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	key, err := k.get(projectID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	now := k.clock.Now()
+	if key.RevokedAt == nil {
+		key.RevokedAt = &now
+	}
+	return key.snapshot(now), nil
+}
+
+// List returns the keys of a project with their traffic, oldest first
+func (k *WriteKeys) List(projectID string) []*WriteKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	now := k.clock.Now()
+	keys := make([]*WriteKey, 0, len(k.projects[projectID]))
+	for _, key := range k.projects[projectID] {
+		keys = append(keys, key.snapshot(now))
+	}
+	return keys
+}
+
+// Get returns a key of a project with its traffic
+func (k *WriteKeys) Get(projectID, keyID string) (*WriteKey, error) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	key, err := k.get(projectID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return key.snapshot(k.clock.Now()), nil
+}
+
+// Authorize checks the API key of a request sending events to a project, and counts the request
+// for the key. It returns a WriteKeyError when the key is not accepted.
+func (k *WriteKeys) Authorize(projectID, apiKey string) error {
+	k.mutex.RLock()
+	keys := k.projects[projectID]
+	k.mutex.RUnlock()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	hash := sha256.Sum256([]byte(apiKey))
+	now := k.clock.Now()
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare(hash[:], key.hash[:]) != 1 {
+			continue
+		}
+		k.mutex.RLock()
+		status := key.status(now)
+		k.mutex.RUnlock()
+		if status != WriteKeyActive && status != WriteKeyRetiring {
+			return &WriteKeyError{ProjectID: projectID, KeyID: key.ID, Status: status}
+		}
+		key.requests.Add(1)
+		key.lastUsed.Store(now.UnixNano())
+		return nil
+	}
+	return &WriteKeyError{ProjectID: projectID}
+}
+
+// Accepts reports whether an API key is an active or retiring write key of a project, without
+// counting a request for it
+func (k *WriteKeys) Accepts(projectID, apiKey string) bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	key, exists := k.byID[APIKeyID(apiKey)]
+	if !exists || key.ProjectID != projectID {
+		return false
+	}
+	status := key.status(k.clock.Now())
+	return status == WriteKeyActive || status == WriteKeyRetiring
+}
+
+// checkCapacity rejects a new key when the project already has the maximum of active keys.
+// Callers must hold the lock.
+func (k *WriteKeys) checkCapacity(projectID string) error {
+	now := k.clock.Now()
+	active := 0
+	for _, key := range k.projects[projectID] {
+		if key.status(now) == WriteKeyActive {
+			active++
+		}
+	}
+	if active >= maxActiveWriteKeys {
+		return fmt.Errorf("project %s already has %d active write keys; rotate or revoke one instead", projectID, maxActiveWriteKeys)
+	}
+	if len(k.projects[projectID]) >= maxWriteKeysPerProject {
+		k.prune(projectID, now)
+	}
+	return nil
+}
+
+// create generates and registers a new active key. Callers must hold the lock.
+func (k *WriteKeys) create(projectID, name string) (*WriteKey, error) {
+	if len(k.projects[projectID]) >= maxWriteKeysPerProject {
+		return nil, fmt.Errorf("project %s has %d write keys still in their grace period or in use; revoke some first", projectID, maxWriteKeysPerProject)
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate write key: %w", err)
+	}
+	apiKey := writeKeyPrefix + hex.EncodeToString(secret)
+
+	key := &writeKey{
+		WriteKey: WriteKey{
+			ID:        APIKeyID(apiKey),
+			ProjectID: projectID,
+			Name:      name,
+			Prefix:    apiKey[:writeKeyVisibleLength],
+			CreatedAt: k.clock.Now(),
+		},
+		hash: sha256.Sum256([]byte(apiKey)),
+	}
+	// Requests read the slice without the lock, so it is replaced rather than appended to in place
+	keys := make([]*writeKey, 0, len(k.projects[projectID])+1)
+	k.projects[projectID] = append(append(keys, k.projects[projectID]...), key)
+	k.byID[key.ID] = key
+
+	created := key.snapshot(key.CreatedAt)
+	created.Key = apiKey
+	return created, nil
+}
+
+// prune forgets revoked and expired keys, the oldest first, until the project has room for a new
+// key. Callers must hold the lock.
+func (k *WriteKeys) prune(projectID string, now time.Time) {
+	keys := make([]*writeKey, 0, len(k.projects[projectID]))
+	excess := len(k.projects[projectID]) - maxWriteKeysPerProject + 1
+	for _, key := range k.projects[projectID] {
+		if status := key.status(now); excess > 0 && (status == WriteKeyRevoked || status == WriteKeyExpired) {
+			delete(k.byID, key.ID)
+			excess--
+			continue
+		}
+		keys = append(keys, key)
+	}
+	k.projects[projectID] = keys
+}
+
+// get returns a key of a project. Callers must hold the lock.
+func (k *WriteKeys) get(projectID, keyID string) (*writeKey, error) {
+	key, exists := k.byID[keyID]
+	if !exists || key.ProjectID != projectID {
+		return nil, fmt.Errorf("write key %s not found in project %s", keyID, projectID)
+	}
+	return key, nil
+}
+
+// status returns the state of the key at a time. Callers must hold the lock.
+func (k *writeKey) status(now time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return WriteKeyRevoked
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return WriteKeyExpired
+	case k.ExpiresAt != nil:
+		return WriteKeyRetiring
+	}
+	return WriteKeyActive
+}
+
+// snapshot returns a copy of the key with its state and traffic at a time. Callers must hold the lock.
+func (k *writeKey) snapshot(now time.Time) *WriteKey {
+	snapshot := k.WriteKey
+	snapshot.Status = k.status(now)
+	snapshot.Requests = k.requests.Load()
+	if lastUsed := k.lastUsed.Load(); lastUsed > 0 {
+		at := time.Unix(0, lastUsed).UTC()
+		snapshot.LastUsedAt = &at
+	}
+	return &snapshot
+}
@@ -0,0 +1,185 @@
+// Package billingstub provides an in-process stand-in for the billing service. It records the
+// requests BillingClient sends, so tests can verify the exact payloads without a real service.
+package billingstub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"magebase/apis/analytics/app"
+)
+
+// Endpoints of the billing service
+const (
+	UsagePath = "/usage"
+	EventPath = "/event"
+)
+
+// Request is a request received by the stub
+type Request struct {
+	Method         string
+	Path           string
+	ContentType    string
+	IdempotencyKey string // Correlation ID of the record, empty when uncorrelated
+	Body           []byte
+	ReceivedAt     time.Time
+}
+
+// Server is an httptest server implementing the billing service endpoints. Every request is
+// recorded, including the ones answered with a configured failure status.
+type Server struct {
+	server    *httptest.Server
+	requests  []Request
+	recording bool           // Whether requests are kept, or only counted
+	received  int            // Requests received since the last reset
+	statuses  map[string]int // Path -> status answered instead of 201 Created
+	nextID    int
+	mutex     sync.Mutex
+}
+
+// NewServer starts a billing service stub. Callers must Close it.
+func NewServer() *Server {
+	s := &Server{
+		recording: true,
+		statuses:  make(map[string]int),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// URL returns the base URL of the stub, for NewBillingClient or BILLING_SERVICE_URL
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// Close shuts the stub down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Client returns a billing client sending to the stub
+func (s *Server) Client() *app.BillingClient {
+	return app.NewBillingClient(s.server.URL)
+}
+
+// FailWith makes the stub answer requests to path with the given status. A status of 0 restores
+// the 201 Created answer.
+func (s *Server) FailWith(path string, status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if status == 0 {
+		delete(s.statuses, path)
+		return
+	}
+	s.statuses[path] = status
+}
+
+// Reset forgets the recorded requests and configured failures
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requests = nil
+	s.received = 0
+	s.statuses = make(map[string]int)
+}
+
+// SetRecording sets whether requests are recorded. Long-running load tests turn recording off so
+// the stub's memory stays flat; requests are still counted.
+func (s *Server) SetRecording(recording bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.recording = recording
+}
+
+// Received returns the number of requests received since the last reset, recorded or not
+func (s *Server) Received() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.received
+}
+
+// Requests returns the recorded requests, oldest first
+func (s *Server) Requests() []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]Request{}, s.requests...)
+}
+
+// UsageRecords returns the usage records posted to the usage endpoint, oldest first
+func (s *Server) UsageRecords() ([]app.UsageRecord, error) {
+	records := make([]app.UsageRecord, 0)
+	for _, request := range s.Requests() {
+		if request.Path != UsagePath {
+			continue
+		}
+		var record app.UsageRecord
+		if err := json.Unmarshal(request.Body, &record); err != nil {
+			return nil, fmt.Errorf("invalid usage record: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Events returns the billing events posted to the event endpoint, oldest first
+func (s *Server) Events() ([]app.BillingServiceEvent, error) {
+	events := make([]app.BillingServiceEvent, 0)
+	for _, request := range s.Requests() {
+		if request.Path != EventPath {
+			continue
+		}
+		var event app.BillingServiceEvent
+		if err := json.Unmarshal(request.Body, &event); err != nil {
+			return nil, fmt.Errorf("invalid billing event: %w", err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// handle records a request and answers it like the billing service
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	s.received++
+	if s.recording {
+		s.requests = append(s.requests, Request{
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			ContentType:    r.Header.Get("Content-Type"),
+			IdempotencyKey: r.Header.Get("Idempotency-Key"),
+			Body:           body,
+			ReceivedAt:     time.Now(),
+		})
+	}
+	status, failing := s.statuses[r.URL.Path]
+	s.nextID++
+	id := s.nextID
+	s.mutex.Unlock()
+
+	switch {
+	case r.URL.Path != UsagePath && r.URL.Path != EventPath:
+		http.NotFound(w, r)
+	case r.Method != http.MethodPost:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case failing:
+		http.Error(w, "stubbed failure", status)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(app.BillingResponse{ID: fmt.Sprintf("stub-%d", id)})
+	}
+}
@@ -0,0 +1,238 @@
+// Package soak drives the ingestion pipeline with a steady stream of events and reports its
+// throughput, allocations and latency, so load regressions fail tests instead of production.
+package soak
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Target sends a request to the service under test, e.g. the Test method of its Fiber app
+type Target func(req *http.Request) (*http.Response, error)
+
+// Config configures a soak run
+type Config struct {
+	Rate        int                           // Events sent per second, 0 to send as fast as the concurrency allows
+	Duration    time.Duration                 // How long events are sent
+	Concurrency int                           // Requests in flight at most
+	Path        string                        // Endpoint events are posted to
+	Body        func(i int) []byte            // Body of the i-th event
+	Headers     func(i int) map[string]string // Headers of the i-th event, e.g. its API key and user
+}
+
+// ConfigFromEnv overrides the defaults with SOAK_RATE, SOAK_DURATION and SOAK_CONCURRENCY, so
+// longer soaks can be run without changing the tests
+func ConfigFromEnv(defaults Config) (Config, error) {
+	config := defaults
+	if value := os.Getenv("SOAK_RATE"); value != "" {
+		rate, err := strconv.Atoi(value)
+		if err != nil || rate < 0 {
+			return config, fmt.Errorf("invalid SOAK_RATE: %s", value)
+		}
+		config.Rate = rate
+	}
+	if value := os.Getenv("SOAK_DURATION"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return config, fmt.Errorf("invalid SOAK_DURATION: %s", value)
+		}
+		config.Duration = duration
+	}
+	if value := os.Getenv("SOAK_CONCURRENCY"); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency < 1 {
+			return config, fmt.Errorf("invalid SOAK_CONCURRENCY: %s", value)
+		}
+		config.Concurrency = concurrency
+	}
+	return config, nil
+}
+
+// Report is the outcome of a soak run. Latencies of paced runs are measured from when an event
+// was due, so a stalled pipeline delaying later events shows in them.
+type Report struct {
+	Events         int           `json:"events"`
+	Errors         int           `json:"errors"` // Requests failing or answered with a status other than 2xx
+	Elapsed        time.Duration `json:"elapsed"`
+	Throughput     float64       `json:"throughput"` // Successful events per second
+	P50            time.Duration `json:"p50"`
+	P99            time.Duration `json:"p99"`
+	Max            time.Duration `json:"max"`
+	AllocsPerEvent float64       `json:"allocs_per_event"` // Heap allocations of the whole process per event
+	BytesPerEvent  float64       `json:"bytes_per_event"`
+	AllocRate      float64       `json:"alloc_rate"` // Bytes allocated per second
+	FirstError     string        `json:"first_error,omitempty"`
+}
+
+// String formats the report for test logs
+func (r Report) String() string {
+	return fmt.Sprintf("%d events, %d errors in %s: %.0f events/s, p50 %s, p99 %s, max %s, %.0f allocs/event, %.0f B/event, %.1f MB/s allocated",
+		r.Events, r.Errors, r.Elapsed.Round(time.Millisecond), r.Throughput, r.P50, r.P99, r.Max,
+		r.AllocsPerEvent, r.BytesPerEvent, r.AllocRate/(1<<20))
+}
+
+// Thresholds are the limits a soak run must stay within. Zero values are not checked.
+type Thresholds struct {
+	MinThroughput     float64       // Successful events per second
+	MaxP99            time.Duration // 99th percentile latency
+	MaxAllocsPerEvent float64
+	MaxErrorRate      float64 // Share of failed events, from 0 to 1
+}
+
+// Check returns an error listing every threshold the report exceeds
+func (r Report) Check(thresholds Thresholds) error {
+	var problems []string
+	if thresholds.MinThroughput > 0 && r.Throughput < thresholds.MinThroughput {
+		problems = append(problems, fmt.Sprintf("throughput %.0f events/s is below %.0f", r.Throughput, thresholds.MinThroughput))
+	}
+	if thresholds.MaxP99 > 0 && r.P99 > thresholds.MaxP99 {
+		problems = append(problems, fmt.Sprintf("p99 latency %s exceeds %s", r.P99, thresholds.MaxP99))
+	}
+	if thresholds.MaxAllocsPerEvent > 0 && r.AllocsPerEvent > thresholds.MaxAllocsPerEvent {
+		problems = append(problems, fmt.Sprintf("%.0f allocations per event exceed %.0f", r.AllocsPerEvent, thresholds.MaxAllocsPerEvent))
+	}
+	if r.Events > 0 && float64(r.Errors)/float64(r.Events) > thresholds.MaxErrorRate {
+		problems = append(problems, fmt.Sprintf("%d of %d events failed (first: %s)", r.Errors, r.Events, r.FirstError))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("soak run exceeded its thresholds: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// dueEvent is an event to send and when it was due
+type dueEvent struct {
+	index int
+	at    time.Time
+}
+
+// result is the outcome of a single event
+type result struct {
+	latency time.Duration
+	err     string
+}
+
+// Run posts events to the target for the configured duration and reports how the pipeline coped
+func Run(target Target, config Config) Report {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+
+	// Events are due at a steady pace, or as soon as a worker is free
+	due := make(chan dueEvent, config.Concurrency)
+	results := make(chan result, config.Concurrency)
+	var workers sync.WaitGroup
+	for w := 0; w < config.Concurrency; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for event := range due {
+				results <- send(target, config, event)
+			}
+		}()
+	}
+
+	var latencies []time.Duration
+	report := Report{}
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for result := range results {
+			report.Events++
+			if result.err != "" {
+				report.Errors++
+				if report.FirstError == "" {
+					report.FirstError = result.err
+				}
+				continue
+			}
+			latencies = append(latencies, result.latency)
+		}
+	}()
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	end := start.Add(config.Duration)
+	for i := 0; ; i++ {
+		dueAt := time.Now()
+		if config.Rate > 0 {
+			dueAt = start.Add(time.Duration(i) * time.Second / time.Duration(config.Rate))
+			time.Sleep(time.Until(dueAt))
+		}
+		if !dueAt.Before(end) {
+			break
+		}
+		due <- dueEvent{index: i, at: dueAt}
+	}
+	close(due)
+	workers.Wait()
+	close(results)
+	<-collected
+	report.Elapsed = time.Since(start)
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	if report.Events > 0 {
+		report.AllocsPerEvent = float64(after.Mallocs-before.Mallocs) / float64(report.Events)
+		report.BytesPerEvent = float64(after.TotalAlloc-before.TotalAlloc) / float64(report.Events)
+	}
+	report.AllocRate = float64(after.TotalAlloc-before.TotalAlloc) / report.Elapsed.Seconds()
+	report.Throughput = float64(len(latencies)) / report.Elapsed.Seconds()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report.P50 = Percentile(latencies, 50)
+	report.P99 = Percentile(latencies, 99)
+	report.Max = Percentile(latencies, 100)
+	return report
+}
+
+// send posts an event, timing it from when it was due
+func send(target Target, config Config, event dueEvent) result {
+	var body []byte
+	if config.Body != nil {
+		body = config.Body(event.index)
+	}
+	req := httptest.NewRequest(http.MethodPost, config.Path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if config.Headers != nil {
+		for name, value := range config.Headers(event.index) {
+			req.Header.Set(name, value)
+		}
+	}
+
+	resp, err := target(req)
+	latency := time.Since(event.at)
+	if err != nil {
+		return result{latency: latency, err: err.Error()}
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return result{latency: latency, err: fmt.Sprintf("status %d", resp.StatusCode)}
+	}
+	return result{latency: latency}
+}
+
+// Percentile returns the p-th percentile of sorted latencies, 0 when there are none
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(float64(len(sorted))*p/100+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
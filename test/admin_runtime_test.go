@@ -0,0 +1,181 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestAdminRuntimeAPI tests viewing and adjusting runtime settings through the admin API
+func TestAdminRuntimeAPI(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+	assert.NoError(t, application.GetAdminAuth().AddToken("alice", "operator-token", app.RoleOperator))
+	assert.NoError(t, application.GetAdminAuth().AddToken("root", "admin-token", app.RoleAdmin))
+
+	request := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("X-Admin-Token", token)
+		}
+		if method == "PUT" {
+			req.Header.Set("If-Match", "*")
+		}
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	t.Run("RequiresAdminToken", func(t *testing.T) {
+		assert.Equal(t, 401, request("GET", "/api/v1/admin/runtime", "", ""))
+		assert.Equal(t, 401, request("GET", "/api/v1/admin/runtime", "wrong-token", ""))
+		assert.Equal(t, 200, request("GET", "/api/v1/admin/runtime", "viewer-token", ""))
+	})
+
+	t.Run("ListSettings", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/admin/runtime", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+
+		var body struct {
+			Settings []app.RuntimeSettingValue `json:"settings"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+
+		names := make([]string, 0, len(body.Settings))
+		for _, setting := range body.Settings {
+			names = append(names, setting.Name)
+		}
+		assert.Contains(t, names, "tracking.worker_pool_size")
+		assert.Contains(t, names, "tracking.queue_capacity")
+		assert.Contains(t, names, "log.level")
+	})
+
+	t.Run("ViewerCannotUpdate", func(t *testing.T) {
+		assert.Equal(t, 403, request("PUT", "/api/v1/admin/runtime/tracking.worker_pool_size", "viewer-token", `{"value": 4}`))
+	})
+
+	t.Run("OperatorUpdatesSettingWithAudit", func(t *testing.T) {
+		assert.Equal(t, 200, request("PUT", "/api/v1/admin/runtime/tracking.worker_pool_size", "operator-token", `{"value": 4}`))
+
+		values := application.GetRuntimeSettings().List()
+		for _, value := range values {
+			if value.Name == "tracking.worker_pool_size" {
+				assert.Equal(t, 4, value.Value)
+			}
+		}
+
+		entries := application.GetAuditLog().Entries("runtime.update", 0)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, "alice", entries[0].Actor)
+		assert.Equal(t, "tracking.worker_pool_size", entries[0].Resource)
+	})
+
+	t.Run("InvalidUpdates", func(t *testing.T) {
+		assert.Equal(t, 400, request("PUT", "/api/v1/admin/runtime/unknown.setting", "operator-token", `{"value": 1}`))
+		assert.Equal(t, 400, request("PUT", "/api/v1/admin/runtime/tracking.worker_pool_size", "operator-token", `{"value": 0}`))
+		assert.Equal(t, 400, request("PUT", "/api/v1/admin/runtime/log.level", "operator-token", `{"value": "verbose"}`))
+	})
+
+	t.Run("UpdatesRequireMatchingVersion", func(t *testing.T) {
+		update := func(ifMatch string) *http.Response {
+			req := httptest.NewRequest("PUT", "/api/v1/admin/runtime/log.level", strings.NewReader(`{"value": "info"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Admin-Token", "operator-token")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp
+		}
+
+		req := httptest.NewRequest("GET", "/api/v1/admin/runtime/log.level", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		etag := resp.Header.Get("ETag")
+		assert.NotEmpty(t, etag)
+
+		assert.Equal(t, 428, update("").StatusCode)
+		assert.Equal(t, 400, update("not-a-version").StatusCode)
+
+		resp = update(etag)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+		resp = update(etag)
+		assert.Equal(t, 409, resp.StatusCode, "Updates based on a stale version should conflict")
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.NotNil(t, body["current_version"])
+	})
+
+	t.Run("AuditLogRequiresAdmin", func(t *testing.T) {
+		assert.Equal(t, 403, request("GET", "/api/v1/admin/audit-log", "operator-token", ""))
+		assert.Equal(t, 200, request("GET", "/api/v1/admin/audit-log", "admin-token", ""))
+	})
+}
+
+// TestWorkerPool tests the resizable worker pool
+func TestWorkerPool(t *testing.T) {
+	t.Run("ExecutesTasks", func(t *testing.T) {
+		pool := app.NewWorkerPool("test", 2, 10)
+		defer pool.Stop()
+
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		executed := 0
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			assert.True(t, pool.Submit(func() {
+				defer wg.Done()
+				mutex.Lock()
+				executed++
+				mutex.Unlock()
+			}))
+		}
+		wg.Wait()
+		assert.Equal(t, 5, executed)
+	})
+
+	t.Run("TrySubmitDropsWhenFull", func(t *testing.T) {
+		pool := app.NewWorkerPool("test", 1, 1)
+		defer pool.Stop()
+
+		block := make(chan struct{})
+		started := make(chan struct{})
+		assert.True(t, pool.Submit(func() {
+			close(started)
+			<-block
+		}))
+		<-started
+
+		assert.True(t, pool.TrySubmit(func() {}), "Queue has room for one task")
+		assert.False(t, pool.TrySubmit(func() {}), "Queue should be full")
+		assert.Equal(t, uint64(1), pool.Stats().Dropped)
+		close(block)
+	})
+
+	t.Run("Resize", func(t *testing.T) {
+		pool := app.NewWorkerPool("test", 4, 10)
+		defer pool.Stop()
+
+		assert.Error(t, pool.Resize(0))
+		assert.NoError(t, pool.Resize(1))
+		assert.Eventually(t, func() bool {
+			return pool.Stats().Running == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,122 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+	"magebase/apis/analytics/billingstub"
+)
+
+// TestAnonymousPolicy tests rejecting, attributing and not billing requests without a user ID per route group
+func TestAnonymousPolicy(t *testing.T) {
+	t.Run("RouteGroups", func(t *testing.T) {
+		policy := app.NewAnonymousPolicy()
+		assert.NoError(t, policy.ReplacePolicies(map[string]string{
+			"/api/v1/analytics":       app.AnonymousReject,
+			"/api/v1/analytics/usage": app.AnonymousAttributeOwner,
+		}))
+		assert.NoError(t, policy.ReplaceOwners(map[string]string{"web": "owner-1"}))
+
+		userID, err := policy.Admit("/api/v1/analytics/events", "web", "user1")
+		assert.NoError(t, err)
+		assert.Equal(t, "user1", userID, "Authenticated requests should be billed to their user")
+
+		_, err = policy.Admit("/api/v1/analytics/events", "web", "")
+		assert.Error(t, err)
+
+		userID, err = policy.Admit("/api/v1/analytics/usage", "web", "")
+		assert.NoError(t, err)
+		assert.Equal(t, "owner-1", userID, "The longest matching route group should apply")
+
+		userID, err = policy.Admit("/api/v1/analytics/usage", "mobile", "")
+		assert.NoError(t, err)
+		assert.Empty(t, userID, "Projects without an owner should not be billed")
+
+		userID, err = policy.Admit("/api/v1/analyticsx", "web", "")
+		assert.NoError(t, err)
+		assert.Empty(t, userID, "Route groups should only match whole path segments")
+
+		group, applied := policy.Policy("/health")
+		assert.Equal(t, "/", group)
+		assert.Equal(t, app.AnonymousNoBill, applied, "Other routes should follow the default policy")
+
+		traffic := policy.Traffic()
+		assert.Equal(t, int64(5), traffic.Requests)
+		assert.Equal(t, int64(4), traffic.Anonymous)
+		assert.Equal(t, int64(1), traffic.Rejected)
+		assert.Equal(t, int64(1), traffic.Attributed)
+		assert.Equal(t, int64(2), traffic.Unbilled)
+		assert.Equal(t, 80.0, traffic.AnonymousRate)
+		assert.Equal(t, int64(3), traffic.Projects["web"])
+		assert.Equal(t, 3, len(traffic.RouteGroups))
+		assert.Equal(t, "/", traffic.RouteGroups[0].RouteGroup)
+	})
+
+	t.Run("RejectsInvalidPolicies", func(t *testing.T) {
+		policy := app.NewAnonymousPolicy()
+		assert.Error(t, policy.ReplacePolicies(map[string]string{"/api": "ignore"}))
+		assert.Error(t, policy.ReplacePolicies(map[string]string{"api": app.AnonymousReject}))
+		assert.Error(t, policy.ReplaceOwners(map[string]string{"web": ""}))
+	})
+
+	t.Run("Middleware", func(t *testing.T) {
+		stub := billingstub.NewServer()
+		defer stub.Close()
+		t.Setenv("BILLING_SERVICE_URL", stub.URL())
+		t.Setenv("ANONYMOUS_USER_POLICIES", "/api/v1/analytics:reject,/api/v1/trends:attribute_owner")
+		t.Setenv("PROJECT_OWNERS", "web:owner-1")
+
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+
+		send := func(path, userID string) int {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("X-Project-ID", "web")
+			if userID != "" {
+				req.Header.Set("X-User-ID", userID)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, 401, send("/api/v1/analytics/validation-errors", ""))
+		assert.Equal(t, 200, send("/api/v1/analytics/validation-errors", "user1"))
+		assert.Equal(t, 200, send("/api/v1/trends?event_type=page_view", ""))
+		assert.Equal(t, 200, send("/health", ""))
+
+		// Each billed request is reported once it completes
+		assert.Eventually(t, func() bool {
+			records, err := stub.UsageRecords()
+			return err == nil && len(records) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		records, err := stub.UsageRecords()
+		assert.NoError(t, err)
+		billed := make(map[string]int)
+		for _, record := range records {
+			billed[record.UserID]++
+		}
+		assert.Equal(t, map[string]int{"user1": 1, "owner-1": 1}, billed, "Rejected and unbilled requests should not be billed")
+
+		req := httptest.NewRequest("GET", "/api/v1/admin/anonymous-traffic", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Traffic app.AnonymousTrafficReport `json:"traffic"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, int64(4), body.Traffic.Anonymous, "The admin request itself is anonymous too")
+		assert.Equal(t, int64(1), body.Traffic.Rejected)
+		assert.Equal(t, int64(1), body.Traffic.Attributed)
+	})
+}
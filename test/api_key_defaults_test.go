@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestAPIKeyDefaults tests adding default context to every event sent with an API key
+func TestAPIKeyDefaults(t *testing.T) {
+	t.Run("AppliedToEvents", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		_, err := service.KeyDefaults().Set("backend-key", map[string]interface{}{
+			"environment":  "production",
+			"service_name": "checkout",
+			"app_version":  "1.4.2",
+		})
+		assert.NoError(t, err)
+
+		track := func(apiKey string, properties map[string]interface{}) *app.AnalyticsEvent {
+			event, err := service.TrackEvent(context.Background(), map[string]interface{}{
+				"event_type": "purchase",
+				"user_id":    "user1",
+				"properties": properties,
+			}, apiKey, "user1")
+			assert.NoError(t, err)
+			return event
+		}
+
+		properties := map[string]interface{}{"app_version": "1.5.0"}
+		event := track("backend-key", properties)
+		assert.Equal(t, "production", event.Properties["environment"])
+		assert.Equal(t, "checkout", event.Properties["service_name"])
+		assert.Equal(t, "1.5.0", event.Properties["app_version"], "Properties sent with the event should win")
+		assert.Equal(t, 1, len(properties), "The caller's properties should not be modified")
+
+		other := track("other-key", map[string]interface{}{})
+		assert.Nil(t, other.Properties["environment"])
+	})
+
+	t.Run("RejectsInvalidDefaults", func(t *testing.T) {
+		defaults := app.NewAPIKeyDefaultsService()
+		_, err := defaults.Set("", map[string]interface{}{"environment": "production"})
+		assert.Error(t, err)
+		_, err = defaults.Set("key", nil)
+		assert.Error(t, err)
+		_, err = defaults.Set("key", map[string]interface{}{"device": map[string]interface{}{"model": "x"}})
+		assert.Error(t, err, "Nested values should be rejected")
+	})
+
+	t.Run("AdminEndpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+
+		request := func(method, path, body, token string) (int, string) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Admin-Token", token)
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp.StatusCode, string(content)
+		}
+
+		body := `{"api_key":"secret-backend-key","properties":{"environment":"staging"}}`
+		status, _ := request("PUT", "/api/v1/admin/api-key-defaults", body, "viewer-token")
+		assert.Equal(t, 403, status)
+
+		status, content := request("PUT", "/api/v1/admin/api-key-defaults", body, "operator-token")
+		assert.Equal(t, 200, status)
+		assert.NotContains(t, content, "secret-backend-key", "The API key should never be returned")
+
+		keyID := app.APIKeyID("secret-backend-key")
+		status, content = request("GET", "/api/v1/admin/api-key-defaults/"+keyID, "", "viewer-token")
+		assert.Equal(t, 200, status)
+		var got struct {
+			Defaults app.APIKeyDefaults `json:"defaults"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(content), &got))
+		assert.Equal(t, "staging", got.Defaults.Properties["environment"])
+		assert.Equal(t, "...-key", got.Defaults.KeyHint)
+
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"page_view","user_id":"user1"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "secret-backend-key")
+		req.Header.Set("X-User-ID", "user1")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		events := application.GetAnalyticsService().QueryEvents(context.Background(), app.EventFilter{EventType: "page_view"})
+		assert.Equal(t, "staging", events[0].Properties["environment"])
+
+		status, _ = request("DELETE", "/api/v1/admin/api-key-defaults/"+keyID, "", "operator-token")
+		assert.Equal(t, 200, status)
+		status, _ = request("GET", "/api/v1/admin/api-key-defaults/"+keyID, "", "viewer-token")
+		assert.Equal(t, 404, status)
+		assert.Equal(t, 1, len(application.GetAuditLog().Entries("api_key.defaults.update", 0)))
+		assert.Equal(t, 1, len(application.GetAuditLog().Entries("api_key.defaults.delete", 0)))
+	})
+}
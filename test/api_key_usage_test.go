@@ -0,0 +1,211 @@
+package test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// failingUsageStore is an API key usage store whose writes fail while failing is set
+type failingUsageStore struct {
+	*app.MemoryAPIKeyUsageStore
+	failing bool
+}
+
+// Add fails while failing is set
+func (s *failingUsageStore) Add(day string, counts map[string]int64) (map[string]int64, error) {
+	if s.failing {
+		return nil, fmt.Errorf("store unavailable")
+	}
+	return s.MemoryAPIKeyUsageStore.Add(day, counts)
+}
+
+// TestAPIKeyUsage tests counting requests per API key in memory with periodic flushes to the
+// durable store and lazy refreshes from it
+func TestAPIKeyUsage(t *testing.T) {
+	t.Setenv("API_KEY_USAGE_REFRESH_INTERVAL", "1m")
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	day := "2024-03-01"
+
+	newUsage := func(store app.APIKeyUsageStore) (*app.APIKeyUsage, *app.FakeClock) {
+		usage := app.NewAPIKeyUsage(store)
+		clock := app.NewFakeClock(start)
+		usage.SetClock(clock)
+		return usage, clock
+	}
+
+	t.Run("CountsAndFlushes", func(t *testing.T) {
+		store := app.NewMemoryAPIKeyUsageStore()
+		usage, _ := newUsage(store)
+		for i := 1; i <= 3; i++ {
+			assert.Equal(t, int64(i), usage.Record("key-a"))
+		}
+		usage.Record("key-b")
+		assert.Equal(t, int64(3), usage.Usage("key-a"))
+		assert.Equal(t, int64(0), usage.Usage("key-c"))
+		assert.Equal(t, int64(4), usage.Stats().Pending)
+
+		assert.Equal(t, int64(4), usage.Flush(start))
+		totals, err := store.Load(day, []string{app.APIKeyID("key-a"), app.APIKeyID("key-b")})
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{app.APIKeyID("key-a"): 3, app.APIKeyID("key-b"): 1}, totals, "Keys should be stored by their ID")
+		assert.Equal(t, int64(4), usage.Record("key-a"))
+		assert.Equal(t, int64(1), usage.Flush(start.Add(time.Second)), "Only new requests should be flushed")
+		assert.Equal(t, int64(0), usage.Stats().Pending)
+	})
+
+	t.Run("RefreshesTotalsOfOtherInstances", func(t *testing.T) {
+		store := app.NewMemoryAPIKeyUsageStore()
+		first, _ := newUsage(store)
+		second, clock := newUsage(store)
+
+		for i := 0; i < 5; i++ {
+			first.Record("shared")
+		}
+		first.Flush(start)
+
+		// The second instance loads the stored total in the background on its first request
+		second.Record("shared")
+		assert.Eventually(t, func() bool { return second.Usage("shared") == 6 }, time.Second, time.Millisecond)
+		assert.Equal(t, int64(1), second.Stats().Refreshes)
+
+		// Totals are only reloaded after the refresh interval
+		first.Record("shared")
+		first.Flush(start)
+		second.Record("shared")
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(t, int64(7), second.Usage("shared"))
+
+		clock.Advance(time.Minute)
+		second.Record("shared")
+		assert.Eventually(t, func() bool { return second.Usage("shared") == 9 }, time.Second, time.Millisecond)
+
+		second.Flush(clock.Now())
+		totals, err := store.Load(day, []string{app.APIKeyID("shared")})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(9), totals[app.APIKeyID("shared")])
+	})
+
+	t.Run("KeepsCountsWhenTheStoreFails", func(t *testing.T) {
+		store := &failingUsageStore{MemoryAPIKeyUsageStore: app.NewMemoryAPIKeyUsageStore(), failing: true}
+		usage, _ := newUsage(store)
+		usage.Record("key")
+		usage.Record("key")
+
+		assert.Equal(t, int64(0), usage.Flush(start))
+		assert.Equal(t, int64(1), usage.Stats().FlushFailures)
+		assert.Equal(t, int64(2), usage.Stats().Pending)
+		assert.Equal(t, int64(3), usage.Record("key"))
+
+		store.failing = false
+		assert.Equal(t, int64(3), usage.Flush(start))
+		assert.Equal(t, int64(3), usage.Usage("key"))
+	})
+
+	t.Run("RollsOverDaysAndEvictsIdleKeys", func(t *testing.T) {
+		store := app.NewMemoryAPIKeyUsageStore()
+		usage, clock := newUsage(store)
+		usage.Record("key")
+		usage.Record("idle")
+		usage.Flush(clock.Now())
+
+		clock.Set(time.Date(2024, 3, 2, 0, 0, 1, 0, time.UTC))
+		usage.Record("key")
+		usage.Record("key")
+		assert.Equal(t, int64(2), usage.Usage("key"), "Requests should be counted per day")
+		assert.Equal(t, int64(0), usage.Usage("idle"))
+
+		usage.Flush(clock.Now())
+		assert.Equal(t, int64(1), usage.Stats().Keys, "Keys idle for the refresh interval should be dropped")
+		totals, err := store.Load("2024-03-02", []string{app.APIKeyID("key")})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), totals[app.APIKeyID("key")])
+		totals, err = store.Load(day, []string{app.APIKeyID("key")})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), totals[app.APIKeyID("key")])
+	})
+
+	t.Run("LimitsKeys", func(t *testing.T) {
+		t.Setenv("API_KEY_USAGE_MAX_KEYS", "2")
+		usage, _ := newUsage(app.NewMemoryAPIKeyUsageStore())
+		usage.Record("a")
+		usage.Record("b")
+		assert.Equal(t, int64(0), usage.Record("c"))
+		assert.Equal(t, int64(2), usage.Record("a"))
+
+		var metrics strings.Builder
+		assert.NoError(t, usage.WriteMetrics(&metrics))
+		assert.Contains(t, metrics.String(), "analytics_api_key_usage_keys 2")
+		assert.Contains(t, metrics.String(), "analytics_api_key_usage_untracked_total 1")
+	})
+
+	t.Run("ConcurrentRequests", func(t *testing.T) {
+		store := app.NewMemoryAPIKeyUsageStore()
+		usage := app.NewAPIKeyUsage(store)
+		var wg sync.WaitGroup
+		for worker := 0; worker < 8; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					usage.Record(fmt.Sprintf("key-%d", i%4))
+					if worker == 0 && i%100 == 0 {
+						usage.Flush(time.Now())
+					}
+				}
+			}(worker)
+		}
+		wg.Wait()
+		usage.Stop()
+
+		today := time.Now().UTC().Format("2006-01-02")
+		var total int64
+		for i := 0; i < 4; i++ {
+			totals, err := store.Load(today, []string{app.APIKeyID(fmt.Sprintf("key-%d", i))})
+			assert.NoError(t, err)
+			total += totals[app.APIKeyID(fmt.Sprintf("key-%d", i))]
+		}
+		assert.Equal(t, int64(4000), total, "No request should be lost between flushes")
+	})
+
+	t.Run("Middleware", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("GET", "/health", nil)
+			req.Header.Set("X-API-Key", "middleware-key")
+			_, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, int64(3), application.GetAPIKeyUsage().Usage("middleware-key"))
+	})
+}
+
+// BenchmarkAPIKeyUsageRecord measures counting a request of an API key on the middleware path
+func BenchmarkAPIKeyUsageRecord(b *testing.B) {
+	usage := app.NewAPIKeyUsage(app.NewMemoryAPIKeyUsageStore())
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		usage.Record(keys[i])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			usage.Record(keys[i%len(keys)])
+			i++
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestAPIKeys tests managed API keys, their scopes and rotating them
+func TestAPIKeys(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	setup := func() (*app.APIKeyService, *app.FakeClock) {
+		keys := app.NewAPIKeyService()
+		clock := app.NewFakeClock(start)
+		keys.SetClock(clock)
+		return keys, clock
+	}
+
+	t.Run("Authorize", func(t *testing.T) {
+		keys, clock := setup()
+		assert.False(t, keys.Enforced(), "Keys should not be checked before any exists")
+
+		reader, err := keys.Create("dashboards", []string{"read", "read"})
+		assert.NoError(t, err)
+		assert.True(t, keys.Enforced())
+		assert.True(t, strings.HasPrefix(reader.Key, reader.Prefix))
+		assert.Equal(t, app.APIKeyID(reader.Key), reader.ID)
+		assert.Equal(t, []string{"read"}, reader.Scopes)
+		admin, err := keys.Create("ops", []string{"admin"})
+		assert.NoError(t, err)
+		_, err = keys.Create("none", nil)
+		assert.Error(t, err)
+		_, err = keys.Create("bad", []string{"write"})
+		assert.Error(t, err)
+
+		clock.Advance(time.Minute)
+		assert.NoError(t, keys.Authorize(reader.Key, app.APIKeyScopeRead))
+		var rejected *app.APIKeyError
+		assert.True(t, errors.As(keys.Authorize(reader.Key, app.APIKeyScopeIngest), &rejected))
+		assert.Equal(t, app.APIKeyScopeIngest, rejected.Scope)
+		assert.NoError(t, keys.Authorize(admin.Key, app.APIKeyScopeIngest), "The admin scope should grant every scope")
+		assert.True(t, errors.As(keys.Authorize("unknown-key", app.APIKeyScopeRead), &rejected))
+		assert.Empty(t, rejected.KeyID)
+		assert.Error(t, keys.Authorize("", app.APIKeyScopeRead))
+
+		listed := keys.List()
+		if assert.Len(t, listed, 2) {
+			assert.Equal(t, int64(1), listed[0].Requests, "Rejected requests should not be counted")
+			assert.Equal(t, start.Add(time.Minute), *listed[0].LastUsedAt)
+			assert.Empty(t, listed[0].Key, "Keys should only be returned when created")
+		}
+	})
+
+	t.Run("RotateAndRevoke", func(t *testing.T) {
+		keys, clock := setup()
+		old, err := keys.Create("sdk", []string{"ingest", "read"})
+		assert.NoError(t, err)
+
+		replacement, retired, err := keys.Rotate(old.ID, "", time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, "sdk", replacement.Name)
+		assert.Equal(t, old.Scopes, replacement.Scopes)
+		assert.Equal(t, app.APIKeyRetiring, retired.Status)
+		assert.Equal(t, replacement.ID, retired.ReplacedBy)
+		assert.NoError(t, keys.Authorize(old.Key, app.APIKeyScopeIngest), "The old key should work during the grace period")
+		_, _, err = keys.Rotate(old.ID, "", time.Hour)
+		assert.Error(t, err, "Retiring keys cannot be rotated again")
+
+		clock.Advance(time.Hour)
+		var rejected *app.APIKeyError
+		assert.True(t, errors.As(keys.Authorize(old.Key, app.APIKeyScopeIngest), &rejected))
+		assert.Equal(t, app.APIKeyExpired, rejected.Status)
+
+		revoked, err := keys.Revoke(replacement.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, app.APIKeyRevoked, revoked.Status)
+		assert.True(t, errors.As(keys.Authorize(replacement.Key, app.APIKeyScopeRead), &rejected))
+		assert.Contains(t, rejected.Error(), "revoked")
+		_, err = keys.Revoke("missing")
+		assert.Contains(t, err.Error(), "not found")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("alice", "admin-token", app.RoleAdmin))
+
+		sendTo := func(projectID, method, path, body, apiKey string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Project-ID", projectID)
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Admin-Token", "admin-token")
+			if apiKey != "" {
+				req.Header.Set("X-API-Key", apiKey)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp.StatusCode, decoded
+		}
+		send := func(method, path, body, apiKey string) (int, map[string]interface{}) {
+			return sendTo("api-keys", method, path, body, apiKey)
+		}
+		track := func(apiKey string) int {
+			status, _ := send("POST", "/api/v1/analytics/events", `{"event_type":"page_view","user_id":"user1"}`, apiKey)
+			return status
+		}
+		create := func(scopes string) string {
+			status, body := send("POST", "/api/v1/admin/api-keys", `{"name":"test","scopes":`+scopes+`}`, "")
+			assert.Equal(t, 201, status)
+			return body["api_key"].(map[string]interface{})["key"].(string)
+		}
+
+		assert.Equal(t, 200, track("legacy-key"), "Any key should be accepted before keys are managed")
+		ingest, read, admin := create(`["ingest"]`), create(`["read"]`), create(`["admin"]`)
+		status, _ := send("POST", "/api/v1/admin/api-keys", `{"scopes":["everything"]}`, "")
+		assert.Equal(t, 400, status)
+
+		assert.Equal(t, 401, track("legacy-key"), "Unknown keys should be rejected once keys are managed")
+		assert.Equal(t, 200, track(ingest))
+		assert.Equal(t, 403, track(read))
+		assert.Equal(t, 200, track(admin))
+
+		status, _ = send("GET", "/api/v1/funnels", "", read)
+		assert.Equal(t, 200, status)
+		status, _ = send("GET", "/api/v1/funnels", "", ingest)
+		assert.Equal(t, 403, status)
+		status, _ = send("GET", "/api/v1/funnels", "", "legacy-key")
+		assert.Equal(t, 401, status)
+		status, _ = send("POST", "/api/v1/funnels", `{"name":"Checkout","steps":[{"name":"View","event_type":"page_view"}]}`, read)
+		assert.Equal(t, 403, status, "Configuration changes should need the admin scope")
+		status, _ = send("POST", "/api/v1/funnels", `{"name":"Checkout","steps":[{"name":"View","event_type":"page_view"}]}`, "")
+		assert.Equal(t, 401, status, "Requests without a key should be rejected once keys are managed")
+		status, _ = send("GET", "/api/v1/funnels", "", "")
+		assert.Equal(t, 401, status)
+		status, _ = send("GET", "/API/v1/funnels/", "", "")
+		assert.Equal(t, 401, status, "Paths should need a key whatever their case")
+		status, _ = send("GET", "/Api/V1/Funnels", "", ingest)
+		assert.Equal(t, 403, status)
+		status, _ = send("GET", "/health", "", "legacy-key")
+		assert.Equal(t, 200, status, "Health checks should not need a key")
+
+		status, body := sendTo("web-a", "POST", "/api/v1/projects/web-a/write-keys", `{"name":"web"}`, admin)
+		assert.Equal(t, 201, status)
+		writeKey := body["write_key"].(map[string]interface{})
+		trackTo := func(projectID, apiKey string) int {
+			status, _ := sendTo(projectID, "POST", "/api/v1/analytics/events", `{"event_type":"page_view","user_id":"user1"}`, apiKey)
+			return status
+		}
+		assert.Equal(t, 200, trackTo("web-a", writeKey["key"].(string)), "Write keys should send events of their project")
+		assert.Equal(t, 401, trackTo("web-b", writeKey["key"].(string)), "Write keys should not send events of other projects")
+		status, _ = sendTo("web-a", "DELETE", "/api/v1/projects/web-a/write-keys/"+writeKey["id"].(string), "", admin)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 401, trackTo("web-a", writeKey["key"].(string)))
+		assert.Equal(t, 401, trackTo("web-b", writeKey["key"].(string)), "Revoked write keys should not be accepted in projects without keys")
+
+		status, body = send("GET", "/api/v1/admin/api-keys", "", "")
+		assert.Equal(t, 200, status)
+		listed := body["api_keys"].([]interface{})
+		assert.Len(t, listed, 3)
+		readID := app.APIKeyID(read)
+		status, body = send("GET", "/api/v1/admin/api-keys/"+readID, "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 1.0, body["api_key"].(map[string]interface{})["requests"])
+
+		status, body = send("POST", "/api/v1/admin/api-keys/"+readID+"/rotate", `{"grace_period":"0s"}`, "")
+		assert.Equal(t, 201, status)
+		rotated := body["api_key"].(map[string]interface{})["key"].(string)
+		status, _ = send("GET", "/api/v1/funnels", "", read)
+		assert.Equal(t, 401, status, "Keys rotated without a grace period should be rejected at once")
+		status, _ = send("GET", "/api/v1/funnels", "", rotated)
+		assert.Equal(t, 200, status)
+
+		status, _ = send("DELETE", "/api/v1/admin/api-keys/"+app.APIKeyID(ingest), "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 401, track(ingest))
+		status, _ = send("DELETE", "/api/v1/admin/api-keys/missing", "", "")
+		assert.Equal(t, 404, status)
+		status, _ = send("POST", "/api/v1/admin/api-keys/"+app.APIKeyID(admin)+"/rotate", `{"grace_period":"soon"}`, "")
+		assert.Equal(t, 400, status)
+	})
+}
@@ -0,0 +1,147 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestAPIMetrics tests aggregating API usage records into per-project API metrics
+func TestAPIMetrics(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Report", func(t *testing.T) {
+		metrics := app.NewAPIMetrics()
+		record := func(route string, status int, responseTimeMs int64, userID string, at time.Time) {
+			metrics.Record(&app.APIUsageRecord{
+				ProjectID:      "web",
+				UserID:         userID,
+				Method:         "GET",
+				Route:          route,
+				Path:           route,
+				StatusCode:     status,
+				ResponseTimeMs: responseTimeMs,
+				ResponseSize:   100,
+				Timestamp:      at,
+			})
+		}
+		record("/api/v1/trends", 200, 10, "user1", start)
+		record("/api/v1/trends", 500, 30, "user1", start.Add(10*time.Minute))
+		record("/api/v1/trends", 200, 20, "", start.Add(time.Hour))
+		record("/api/v1/segments", 404, 5, "user2", start.Add(time.Hour))
+		metrics.Record(&app.APIUsageRecord{ProjectID: "mobile", Method: "GET", Route: "/api/v1/trends", StatusCode: 200, Timestamp: start})
+
+		report, err := metrics.Report("web", start, start.Add(24*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), report.Totals.Requests, "Metrics should be scoped to their project")
+		assert.Equal(t, int64(1), report.Totals.ClientErrors)
+		assert.Equal(t, int64(1), report.Totals.ServerErrors)
+		assert.Equal(t, 50.0, report.Totals.ErrorRate)
+		assert.Equal(t, int64(1), report.Totals.Anonymous)
+		assert.Equal(t, int64(30), report.Totals.MaxResponseTimeMs)
+		assert.Equal(t, int64(400), report.Totals.ResponseBytes)
+
+		assert.Equal(t, 2, len(report.Routes))
+		assert.Equal(t, "/api/v1/trends", report.Routes[0].Route, "The busiest route should come first")
+		assert.Equal(t, int64(3), report.Routes[0].Requests)
+		assert.Equal(t, 20.0, report.Routes[0].AvgResponseTimeMs)
+
+		assert.Equal(t, 2, len(report.Timeline))
+		assert.Equal(t, start, report.Timeline[0].Time)
+		assert.Equal(t, int64(2), report.Timeline[0].Requests)
+		assert.Equal(t, int64(2), report.Timeline[1].Requests)
+
+		report, err = metrics.Report("web", start.Add(time.Hour), start.Add(2*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), report.Totals.Requests, "Only the hours in the time range should be reported")
+
+		_, err = metrics.Report("web", start, start)
+		assert.Error(t, err)
+	})
+
+	t.Run("ConsumesKafkaEvents", func(t *testing.T) {
+		metrics := app.NewAPIMetrics()
+
+		// Round trip through the JSON envelope published to the analytics topic
+		encoded, err := json.Marshal(app.NewAPIUsageEvent(&app.APIUsageRecord{
+			ProjectID:  "web",
+			UserID:     "user1",
+			Method:     "POST",
+			Route:      "/api/v1/analytics/events",
+			StatusCode: 200,
+			Timestamp:  start,
+		}))
+		assert.NoError(t, err)
+		var event app.CrossServiceEvent
+		assert.NoError(t, json.Unmarshal(encoded, &event))
+		assert.Equal(t, app.APIUsageEventType, event.EventType)
+
+		assert.NoError(t, metrics.HandleEvent(context.Background(), &event))
+		assert.Error(t, metrics.HandleEvent(context.Background(), &app.CrossServiceEvent{EventType: app.APIUsageEventType, Data: map[string]interface{}{}}))
+
+		report, err := metrics.Report("web", start, start.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), report.Totals.Requests)
+		assert.Equal(t, "POST", report.Routes[0].Method)
+	})
+
+	t.Run("Retention", func(t *testing.T) {
+		t.Setenv("API_METRICS_RETENTION", "24h")
+		metrics := app.NewAPIMetrics()
+		metrics.Record(&app.APIUsageRecord{ProjectID: "web", Method: "GET", Route: "/health", Timestamp: start})
+		metrics.Record(&app.APIUsageRecord{ProjectID: "web", Method: "GET", Route: "/health", Timestamp: start.Add(48 * time.Hour)})
+		metrics.Record(&app.APIUsageRecord{ProjectID: "web", Method: "GET", Route: "/health", Timestamp: start.Add(time.Hour)})
+
+		report, err := metrics.Report("web", start, start.Add(72*time.Hour))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), report.Totals.Requests, "Hours past the retention should be dropped")
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(path, projectID string) int {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("X-Project-ID", projectID)
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-API-Key", "secret-key")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+		assert.Equal(t, 200, send("/api/v1/funnels/", "web"))
+		assert.Equal(t, 200, send("/api/v1/funnels/", "web"))
+		assert.Equal(t, 404, send("/api/v1/funnels/unknown", "web"))
+		assert.Equal(t, 200, send("/api/v1/funnels/", "mobile"))
+
+		req := httptest.NewRequest("GET", "/api/v1/projects/web/api-metrics", nil)
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Metrics app.APIMetricsReport `json:"metrics"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, int64(3), body.Metrics.Totals.Requests)
+		assert.Equal(t, int64(1), body.Metrics.Totals.ClientErrors)
+		routes := make(map[string]int64)
+		for _, route := range body.Metrics.Routes {
+			routes[route.Route] = route.Requests
+		}
+		assert.Equal(t, map[string]int64{"/api/v1/funnels/": 2, "/api/v1/funnels/:id": 1}, routes, "Requests should be grouped by route pattern")
+
+		req = httptest.NewRequest("GET", "/api/v1/projects/web/api-metrics?start_date=tomorrow", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
@@ -1,7 +1,10 @@
 package test
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -52,7 +55,7 @@ func TestAnalyticsService(t *testing.T) {
 	assert.NoError(t, err, "Event tracking should succeed")
 	assert.NotNil(t, event, "Event should be created")
 	assert.NotEmpty(t, event.ID, "Event should have an ID")
-	assert.NotEmpty(t, event.BillingEventID, "Event should have a billing event ID")
+	assert.NotEmpty(t, event.BillingCorrelationID, "Event should have a billing correlation ID")
 	assert.Equal(t, "page_view", event.EventType, "Event type should match")
 	assert.Equal(t, "user123", event.UserID, "User ID should match")
 }
@@ -145,3 +148,76 @@ func TestRateLimitingAndSampling(t *testing.T) {
 	// The rate limiting and sampling should now be implemented and working
 	assert.True(t, true, "Rate limiting and sampling are implemented and working")
 }
+
+// TestUsageBatch tests retrieving usage for many users in one request
+func TestUsageBatch(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	service := application.GetAnalyticsService()
+
+	for i := 0; i < 20; i++ {
+		userID := fmt.Sprintf("batch-user-%d", i)
+		for j := 0; j <= i%3; j++ {
+			_, err := service.TrackEvent(nil, map[string]interface{}{
+				"event_type": "page_view",
+				"user_id":    userID,
+			}, "test-api-key", userID)
+			assert.NoError(t, err)
+		}
+	}
+
+	startDate := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	endDate := time.Now().Format("2006-01-02")
+
+	t.Run("ServiceKeepsOrder", func(t *testing.T) {
+		userIDs := make([]string, 20)
+		for i := range userIDs {
+			userIDs[i] = fmt.Sprintf("batch-user-%d", i)
+		}
+
+		results := service.GetUsageBatch(nil, userIDs, startDate, endDate, 4)
+		assert.Equal(t, 20, len(results))
+		for i, result := range results {
+			assert.Equal(t, userIDs[i], result.UserID)
+			assert.Empty(t, result.Error)
+			assert.Equal(t, int64(i%3+1), result.Usage.TotalEvents)
+		}
+	})
+
+	t.Run("PartialFailures", func(t *testing.T) {
+		body := fmt.Sprintf(`{"user_ids":["batch-user-1","","batch-user-1","unknown-user"],"start_date":"%s","end_date":"%s"}`, startDate, endDate)
+		req := httptest.NewRequest("POST", "/api/v1/analytics/usage/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var response struct {
+			Status    string                 `json:"status"`
+			Succeeded int                    `json:"succeeded"`
+			Failed    int                    `json:"failed"`
+			Results   []app.UsageBatchResult `json:"results"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		assert.Equal(t, "partial", response.Status)
+		assert.Equal(t, 2, response.Succeeded)
+		assert.Equal(t, 2, response.Failed)
+		assert.Equal(t, int64(2), response.Results[0].Usage.TotalEvents)
+		assert.Equal(t, "user ID is required", response.Results[1].Error)
+		assert.Equal(t, "duplicate user ID", response.Results[2].Error)
+		assert.Equal(t, int64(0), response.Results[3].Usage.TotalEvents, "Users without events have empty usage")
+	})
+
+	t.Run("InvalidRequests", func(t *testing.T) {
+		for _, body := range []string{
+			`{"user_ids":[]}`,
+			`{"user_ids":["batch-user-1"],"start_date":"yesterday"}`,
+		} {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/usage/batch", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 400, resp.StatusCode, body)
+		}
+	})
+}
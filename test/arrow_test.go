@@ -0,0 +1,263 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// arrowField is a decoded Arrow schema field
+type arrowField struct {
+	Name     string
+	Type     uint8 // Type union member
+	Timezone string
+}
+
+// arrowStream is a decoded Arrow IPC stream
+type arrowStream struct {
+	Fields  []arrowField
+	Columns [][]interface{}
+	Batches int
+}
+
+// flatReader reads flatbuffer tables
+type flatReader []byte
+
+func (r flatReader) u32(position int) int { return int(binary.LittleEndian.Uint32(r[position:])) }
+
+// field returns the position of a table field, 0 when absent
+func (r flatReader) field(table, id int) int {
+	vtable := table - int(int32(binary.LittleEndian.Uint32(r[table:])))
+	if 4+2*id >= int(binary.LittleEndian.Uint16(r[vtable:])) {
+		return 0
+	}
+	offset := int(binary.LittleEndian.Uint16(r[vtable+4+2*id:]))
+	if offset == 0 {
+		return 0
+	}
+	return table + offset
+}
+
+// ref returns the position of the object a table field references
+func (r flatReader) ref(table, id int) int {
+	position := r.field(table, id)
+	return position + r.u32(position)
+}
+
+func (r flatReader) str(position int) string {
+	return string(r[position+4 : position+4+r.u32(position)])
+}
+
+// decodeArrowStream decodes a stream of the column types the service writes
+func decodeArrowStream(t *testing.T, data []byte) arrowStream {
+	var stream arrowStream
+	offset := 0
+	for {
+		assert.Equal(t, uint32(0xFFFFFFFF), binary.LittleEndian.Uint32(data[offset:]), "Messages should start with the continuation marker")
+		length := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		offset += 8
+		if length == 0 {
+			assert.Equal(t, len(data), offset, "The end-of-stream marker should end the stream")
+			return stream
+		}
+		assert.Equal(t, 0, length%8, "Metadata should be padded to 8 bytes")
+
+		metadata := flatReader(data[offset : offset+length])
+		offset += length
+		message := metadata.u32(0)
+		assert.Equal(t, uint16(4), binary.LittleEndian.Uint16(metadata[metadata.field(message, 0):]), "Messages should use metadata V5")
+		bodyLength := metadata.field(message, 3)
+		assert.Equal(t, 0, bodyLength%8, "Longs should be 8-byte aligned")
+		body := data[offset : offset+int(binary.LittleEndian.Uint64(metadata[bodyLength:]))]
+		offset += len(body)
+
+		header := metadata.ref(message, 2)
+		switch metadata[metadata.field(message, 1)] {
+		case 1: // Schema
+			fields := metadata.ref(header, 1)
+			for i := 0; i < metadata.u32(fields); i++ {
+				element := fields + 4 + 4*i
+				field := element + metadata.u32(element)
+				decoded := arrowField{Name: metadata.str(metadata.ref(field, 0)), Type: metadata[metadata.field(field, 2)]}
+				if decoded.Type == 10 {
+					decoded.Timezone = metadata.str(metadata.ref(metadata.ref(field, 3), 1))
+				}
+				stream.Fields = append(stream.Fields, decoded)
+			}
+			stream.Columns = make([][]interface{}, len(stream.Fields))
+
+		case 3: // RecordBatch
+			stream.Batches++
+			rows := int(binary.LittleEndian.Uint64(metadata[metadata.field(header, 0):]))
+			buffers := metadata.ref(header, 2)
+			assert.Equal(t, 0, (buffers+4)%8, "Buffer structs should be 8-byte aligned")
+			buffer := func(i int) []byte {
+				position := buffers + 4 + 16*i
+				start := int(binary.LittleEndian.Uint64(metadata[position:]))
+				return body[start : start+int(binary.LittleEndian.Uint64(metadata[position+8:]))]
+			}
+
+			next := 0
+			for column, field := range stream.Fields {
+				validity := buffer(next)
+				values := buffer(next + 1)
+				next += 2
+				var text []byte
+				if field.Type == 5 {
+					text = buffer(next)
+					next++
+				}
+				for row := 0; row < rows; row++ {
+					if len(validity) > 0 && validity[row/8]&(1<<(row%8)) == 0 {
+						stream.Columns[column] = append(stream.Columns[column], nil)
+						continue
+					}
+					var value interface{}
+					switch field.Type {
+					case 2:
+						value = int64(binary.LittleEndian.Uint64(values[8*row:]))
+					case 3:
+						value = math.Float64frombits(binary.LittleEndian.Uint64(values[8*row:]))
+					case 5:
+						value = string(text[binary.LittleEndian.Uint32(values[4*row:]):binary.LittleEndian.Uint32(values[4*row+4:])])
+					case 6:
+						value = values[row/8]&(1<<(row%8)) != 0
+					case 10:
+						value = time.UnixMilli(int64(binary.LittleEndian.Uint64(values[8*row:]))).UTC()
+					}
+					stream.Columns[column] = append(stream.Columns[column], value)
+				}
+			}
+		}
+	}
+}
+
+// TestArrowResults tests responding with query results as Arrow IPC streams
+func TestArrowResults(t *testing.T) {
+	t.Run("Encoding", func(t *testing.T) {
+		at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		table := app.NewArrowTable(
+			app.ArrowColumn{Name: "user_id", Type: app.ArrowUtf8},
+			app.ArrowColumn{Name: "count", Type: app.ArrowInt64},
+			app.ArrowColumn{Name: "rate", Type: app.ArrowFloat64},
+			app.ArrowColumn{Name: "converted", Type: app.ArrowBool},
+			app.ArrowColumn{Name: "first_seen", Type: app.ArrowTimestamp},
+		)
+		table.Append("user1", int64(3), 0.5, true, at)
+		table.Append(nil, 4, nil, false, nil)
+		table.Append("user-ü", int64(-1), 1.25, nil, at.Add(time.Hour))
+
+		var buffer bytes.Buffer
+		assert.NoError(t, app.WriteArrowStream(&buffer, table))
+		stream := decodeArrowStream(t, buffer.Bytes())
+
+		assert.Equal(t, []arrowField{
+			{Name: "user_id", Type: 5},
+			{Name: "count", Type: 2},
+			{Name: "rate", Type: 3},
+			{Name: "converted", Type: 6},
+			{Name: "first_seen", Type: 10, Timezone: "UTC"},
+		}, stream.Fields)
+		assert.Equal(t, []interface{}{"user1", nil, "user-ü"}, stream.Columns[0])
+		assert.Equal(t, []interface{}{int64(3), int64(4), int64(-1)}, stream.Columns[1])
+		assert.Equal(t, []interface{}{0.5, nil, 1.25}, stream.Columns[2])
+		assert.Equal(t, []interface{}{true, false, nil}, stream.Columns[3])
+		assert.Equal(t, []interface{}{at, nil, at.Add(time.Hour)}, stream.Columns[4])
+	})
+
+	t.Run("Batches", func(t *testing.T) {
+		table := app.NewArrowTable(app.ArrowColumn{Name: "n", Type: app.ArrowInt64})
+		for i := 0; i < 100000; i++ {
+			table.Append(i)
+		}
+		var buffer bytes.Buffer
+		assert.NoError(t, app.WriteArrowStream(&buffer, table))
+		stream := decodeArrowStream(t, buffer.Bytes())
+		assert.Equal(t, 2, stream.Batches, "Large results should be split into record batches")
+		assert.Equal(t, 100000, len(stream.Columns[0]))
+		assert.Equal(t, int64(99999), stream.Columns[0][99999])
+
+		buffer.Reset()
+		assert.NoError(t, app.WriteArrowStream(&buffer, app.NewArrowTable(app.ArrowColumn{Name: "n", Type: app.ArrowInt64})))
+		stream = decodeArrowStream(t, buffer.Bytes())
+		assert.Equal(t, 1, stream.Batches, "Empty results should have an empty batch")
+		assert.Empty(t, stream.Columns[0])
+	})
+
+	t.Run("InvalidTables", func(t *testing.T) {
+		table := app.NewArrowTable(app.ArrowColumn{Name: "count", Type: app.ArrowInt64})
+		table.Append("three")
+		assert.Error(t, app.WriteArrowStream(io.Discard, table))
+
+		assert.Error(t, app.WriteArrowStream(io.Discard, app.NewArrowTable(app.ArrowColumn{Name: "tags", Type: "list"})))
+
+		_, err := app.ArrowTableFor(&app.Heatmap{})
+		assert.Error(t, err)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		ctx := app.ContextWithProject(context.Background(), "web")
+		for _, userID := range []string{"user1", "user2", "user1"} {
+			_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+				"event_type": "purchase",
+				"user_id":    userID,
+			}, "test-key", userID)
+			assert.NoError(t, err)
+		}
+
+		send := func(method, path, accept, body string) ([]byte, string, int) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("X-Project-ID", "web")
+			req.Header.Set("Content-Type", "application/json")
+			if accept != "" {
+				req.Header.Set("Accept", accept)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			data, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return data, resp.Header.Get("Content-Type"), resp.StatusCode
+		}
+
+		data, contentType, status := send("GET", "/api/v1/trends?event_type=purchase&interval=hour", app.ArrowStreamMediaType, "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, app.ArrowStreamMediaType, contentType)
+		stream := decodeArrowStream(t, data)
+		assert.Equal(t, "timestamp", stream.Fields[0].Name)
+		var total int64
+		for _, count := range stream.Columns[1] {
+			total += count.(int64)
+		}
+		assert.Equal(t, int64(3), total)
+
+		_, contentType, _ = send("GET", "/api/v1/trends?event_type=purchase&interval=hour", "", "")
+		assert.Contains(t, contentType, "application/json", "JSON should remain the default")
+
+		data, contentType, status = send("GET", "/api/v1/segments?event_type=purchase&format=arrow", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, app.ArrowStreamMediaType, contentType)
+		stream = decodeArrowStream(t, data)
+		assert.ElementsMatch(t, []interface{}{"user1", "user2"}, stream.Columns[0])
+
+		created, _, status := send("POST", "/api/v1/queries", "", `{"id":"purchases","name":"Purchases","type":"trend","parameters":{"event_type":"purchase","interval":"day"}}`)
+		assert.Equal(t, 200, status, string(created))
+		data, contentType, status = send("GET", "/api/v1/queries/purchases/run", app.ArrowStreamMediaType+", application/json;q=0.5", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, app.ArrowStreamMediaType, contentType)
+		assert.Equal(t, 3, len(decodeArrowStream(t, data).Fields))
+	})
+}
@@ -0,0 +1,136 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestAsyncIngestion tests 202 ingestion responses and the receipts telling what became of the events
+func TestAsyncIngestion(t *testing.T) {
+	pageView := func() map[string]interface{} {
+		return map[string]interface{}{"event_type": "page_view", "user_id": "user1"}
+	}
+
+	t.Run("ReceiptOutcomes", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		ingestion := app.NewAsyncIngestion(service)
+		defer ingestion.Stop()
+
+		stored, err := ingestion.Submit("web", pageView(), "test-key", "user1")
+		assert.NoError(t, err)
+		assert.Equal(t, app.ReceiptPending, stored.Status)
+
+		rejected, err := ingestion.Submit("web", map[string]interface{}{"event_type": "page_view"}, "test-key", "user1")
+		assert.NoError(t, err, "Validation happens after the event is accepted")
+
+		outcome := func(projectID, receiptID string) *app.IngestionReceipt {
+			var receipt *app.IngestionReceipt
+			assert.Eventually(t, func() bool {
+				receipt, err = ingestion.Receipt(projectID, receiptID)
+				return err == nil && receipt.Status != app.ReceiptPending
+			}, time.Second, time.Millisecond)
+			return receipt
+		}
+
+		receipt := outcome("web", stored.ID)
+		assert.Equal(t, app.ReceiptStored, receipt.Status)
+		assert.NotEmpty(t, receipt.EventID)
+		assert.NotNil(t, receipt.CompletedAt)
+		assert.Equal(t, int64(1), service.EventCount())
+
+		receipt = outcome("web", rejected.ID)
+		assert.Equal(t, app.ReceiptRejected, receipt.Status)
+		assert.Contains(t, receipt.Reason, "user_id")
+
+		_, err = ingestion.Receipt("other", stored.ID)
+		assert.Error(t, err, "Receipts should be scoped to their project")
+	})
+
+	t.Run("LoadShedding", func(t *testing.T) {
+		t.Setenv("INGESTION_WORKER_POOL_SIZE", "1")
+		t.Setenv("INGESTION_QUEUE_CAPACITY", "1")
+		clock := app.NewFakeClock(time.Now())
+		service := app.NewAnalyticsService()
+		service.SetClock(clock)
+		ingestion := app.NewAsyncIngestion(service)
+		defer ingestion.Stop()
+
+		// Keep the only worker busy so accepted events wait in the queue
+		release := make(chan struct{})
+		busy := make(chan struct{})
+		ingestion.WorkerPool().Submit(func() {
+			close(busy)
+			<-release
+		})
+		<-busy
+
+		queued, err := ingestion.Submit("web", pageView(), "test-key", "user1")
+		assert.NoError(t, err)
+
+		overflow, err := ingestion.Submit("web", pageView(), "test-key", "user1")
+		var overloaded *app.OverloadedError
+		assert.True(t, errors.As(err, &overloaded))
+		assert.Equal(t, app.ReceiptDropped, overflow.Status)
+		assert.Equal(t, "ingestion queue is full", overflow.Reason)
+
+		clock.Advance(ingestion.MaxQueueAge() + time.Second)
+		close(release)
+
+		assert.Eventually(t, func() bool {
+			receipt, err := ingestion.Receipt("web", queued.ID)
+			return err == nil && receipt.Status == app.ReceiptDropped && strings.Contains(receipt.Reason, "shed")
+		}, time.Second, time.Millisecond, "Events waiting longer than the maximum queue age should be shed")
+		assert.Equal(t, int64(0), service.EventCount())
+		assert.Error(t, ingestion.SetMaxQueueAge(0))
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"page_view","user_id":"user1"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Prefer", "respond-async")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "user1")
+		req.Header.Set("X-Project-ID", "web")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 202, resp.StatusCode)
+
+		var accepted struct {
+			ReceiptID string `json:"receipt_id"`
+			StatusURL string `json:"status_url"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&accepted))
+		assert.NotEmpty(t, accepted.ReceiptID)
+		assert.Equal(t, accepted.StatusURL, resp.Header.Get("Location"))
+
+		assert.Eventually(t, func() bool {
+			req := httptest.NewRequest("GET", accepted.StatusURL, nil)
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			if err != nil || resp.StatusCode != 200 {
+				return false
+			}
+			var body struct {
+				Receipt app.IngestionReceipt `json:"receipt"`
+			}
+			return json.NewDecoder(resp.Body).Decode(&body) == nil && body.Receipt.Status == app.ReceiptStored
+		}, 2*time.Second, 10*time.Millisecond)
+
+		req = httptest.NewRequest("GET", accepted.StatusURL, nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode, "Receipts of other projects should not be found")
+	})
+}
@@ -0,0 +1,143 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestBenchmarks tests anonymized benchmarks across the projects opting in
+func TestBenchmarks(t *testing.T) {
+	t.Setenv("BENCHMARK_MIN_PROJECTS", "2")
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	service := application.GetAnalyticsService()
+	clock := app.NewFakeClock(start)
+	service.SetClock(clock)
+	application.GetBenchmarks().SetClock(clock)
+
+	track := func(projectID, userID, eventType, page string) {
+		clock.Advance(time.Second) // Events of a user keep their order
+		event := map[string]interface{}{"event_type": eventType, "user_id": userID, "page": page}
+		_, err := service.TrackEvent(app.ContextWithProject(context.Background(), projectID), event, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	send := func(method, path, projectID, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "owner")
+		req.Header.Set("X-Project-ID", projectID)
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		var decoded map[string]interface{}
+		_ = json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp.StatusCode, decoded
+	}
+
+	// Retail projects convert 50%, 25% and 100% of their users, and bounce 50%, 100% and 100%
+	// of their sessions
+	projects := map[string]string{"shop": "retail", "store": "retail", "outlet": "Retail", "crm": "saas"}
+	for projectID, industry := range projects {
+		_, _, err := application.GetFunnelService().CreateFunnelWithID(app.ContextWithProject(context.Background(), projectID), projectID+"-checkout", "Checkout", "", []app.Step{
+			{ID: "view", Name: "View", EventType: "page_view", Order: 1},
+			{ID: "buy", Name: "Purchase", EventType: "purchase", Order: 2},
+		})
+		assert.NoError(t, err)
+		status, response := send("PUT", "/api/v1/projects/"+projectID+"/benchmarking", projectID, `{"opt_in":true,"industry":"`+industry+`"}`)
+		assert.Equal(t, 200, status, response)
+	}
+	clock.Advance(time.Minute)
+	track("shop", "user1", "page_view", "/")
+	track("shop", "user1", "page_view", "/pricing")
+	track("shop", "user1", "purchase", "")
+	track("shop", "user2", "page_view", "/")
+	for _, userID := range []string{"user1", "user2", "user3", "user4"} {
+		track("store", userID, "page_view", "/")
+	}
+	track("store", "user1", "purchase", "")
+	track("outlet", "user1", "page_view", "/")
+	track("outlet", "user1", "purchase", "")
+	track("crm", "user1", "page_view", "/")
+	track("private", "user1", "page_view", "/")
+	clock.Advance(time.Hour)
+
+	t.Run("Settings", func(t *testing.T) {
+		status, response := send("GET", "/api/v1/projects/outlet/benchmarking", "outlet", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "retail", response["benchmarking"].(map[string]interface{})["industry"], "Industries should be lowercased")
+
+		status, _ = send("PUT", "/api/v1/projects/private/benchmarking", "private", `{"opt_in":true}`)
+		assert.Equal(t, 400, status, "Opting in should require an industry")
+		status, _ = send("PUT", "/api/v1/projects/private/benchmarking", "private", `{"opt_in":true,"industry":"retail & more"}`)
+		assert.Equal(t, 400, status)
+		status, _ = send("PUT", "/api/v1/projects/shop/benchmarking", "shop", `{"opt_in":false}`)
+		assert.Equal(t, 428, status, "Replacing settings should require If-Match")
+	})
+
+	t.Run("Benchmarks", func(t *testing.T) {
+		status, _ := send("GET", "/api/v1/benchmarks", "private", "")
+		assert.Equal(t, 403, status, "Projects not opting in should not read the benchmarks")
+
+		status, response := send("GET", "/api/v1/benchmarks", "shop", "")
+		assert.Equal(t, 200, status, response)
+		encoded, _ := json.Marshal(response["benchmarks"])
+		var benchmarks app.Benchmarks
+		assert.NoError(t, json.Unmarshal(encoded, &benchmarks))
+		assert.NotContains(t, string(encoded), "shop", "Benchmarks should not name projects")
+
+		if assert.Len(t, benchmarks.Industries, 2) {
+			retail := benchmarks.Industries[0]
+			assert.Equal(t, "retail", retail.Industry)
+			assert.Equal(t, 50.0, *retail.MedianConversionRate)
+			assert.Equal(t, 3, retail.ConversionProjects)
+			assert.Equal(t, 83.33, *retail.AverageBounceRate)
+
+			saas := benchmarks.Industries[1]
+			assert.True(t, saas.Suppressed, "Industries with too few projects should be suppressed")
+			assert.Nil(t, saas.MedianConversionRate)
+			assert.Nil(t, saas.AverageBounceRate)
+		}
+		assert.Equal(t, 50.0, *benchmarks.Overall.MedianConversionRate, "Suppressed industries should not count overall alone")
+		assert.Equal(t, 3, benchmarks.Overall.ConversionProjects)
+
+		encoded, _ = json.Marshal(response["project"])
+		var project app.ProjectBenchmark
+		assert.NoError(t, json.Unmarshal(encoded, &project))
+		assert.Equal(t, 50.0, *project.BounceRate)
+		assert.Equal(t, "retail", project.Comparison.ComparedWith)
+		assert.Equal(t, 0.0, *project.Comparison.ConversionRateDelta)
+		assert.Equal(t, -33.33, *project.Comparison.BounceRateDelta)
+		if assert.Len(t, project.Funnels, 1) {
+			assert.Equal(t, int64(2), project.Funnels[0].TotalUsers)
+		}
+
+		status, response = send("GET", "/api/v1/benchmarks", "crm", "")
+		assert.Equal(t, 200, status)
+		comparison := response["project"].(map[string]interface{})["comparison"].(map[string]interface{})
+		assert.Equal(t, "overall", comparison["compared_with"])
+		assert.Equal(t, -50.0, comparison["conversion_rate_delta"])
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		computedAt := application.GetBenchmarks().Benchmarks(context.Background()).ComputedAt
+		_, err := application.GetBenchmarks().UpdateSettings("store", false, "", app.AnyVersion)
+		assert.NoError(t, err)
+		assert.Equal(t, computedAt, application.GetBenchmarks().Benchmarks(context.Background()).ComputedAt, "Benchmarks should be cached")
+
+		clock.Advance(time.Hour)
+		benchmarks := application.GetBenchmarks().Benchmarks(context.Background())
+		assert.Equal(t, 2, benchmarks.Industries[0].ConversionProjects, "Projects opting out should leave the benchmarks")
+		assert.Equal(t, 75.0, *benchmarks.Industries[0].MedianConversionRate)
+	})
+}
@@ -0,0 +1,187 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+	"magebase/apis/analytics/billingstub"
+)
+
+// payloadKeys returns the sorted top-level keys of a JSON object
+func payloadKeys(t *testing.T, body []byte) []string {
+	var payload map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &payload))
+	return sortedKeys(payload)
+}
+
+// TestBillingContract tests the exact requests BillingClient sends to the billing service
+func TestBillingContract(t *testing.T) {
+	stub := billingstub.NewServer()
+	defer stub.Close()
+
+	t.Run("UsageRecord", func(t *testing.T) {
+		stub.Reset()
+		timestamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+		err := stub.Client().TrackUsage(context.Background(), &app.UsageRecord{
+			UserID:    "user1",
+			Service:   "analytics",
+			Metric:    "api_call",
+			Amount:    3,
+			Timestamp: timestamp,
+			Details:   map[string]interface{}{"endpoint": "/api/v1/trends"},
+		})
+		assert.NoError(t, err)
+
+		requests := stub.Requests()
+		assert.Equal(t, 1, len(requests))
+		assert.Equal(t, http.MethodPost, requests[0].Method)
+		assert.Equal(t, billingstub.UsagePath, requests[0].Path)
+		assert.Equal(t, "application/json", requests[0].ContentType)
+		assert.JSONEq(t, `{
+			"user_id": "user1",
+			"service": "analytics",
+			"metric": "api_call",
+			"amount": 3,
+			"timestamp": "2024-03-01T12:00:00Z",
+			"details": {"endpoint": "/api/v1/trends"}
+		}`, string(requests[0].Body))
+
+		assert.NoError(t, stub.Client().TrackUsage(context.Background(), &app.UsageRecord{UserID: "user1", Timestamp: timestamp}))
+		assert.Equal(t, []string{"amount", "metric", "service", "timestamp", "user_id"}, payloadKeys(t, stub.Requests()[1].Body),
+			"Empty details should be omitted")
+	})
+
+	t.Run("BillingEvent", func(t *testing.T) {
+		stub.Reset()
+		timestamp := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+		err := stub.Client().TrackEvent(context.Background(), &app.BillingServiceEvent{
+			UserID:    "user1",
+			Service:   "analytics",
+			EventType: "heatmap_generation",
+			Timestamp: timestamp,
+			Details:   map[string]interface{}{"amount": 0.5},
+		})
+		assert.NoError(t, err)
+
+		requests := stub.Requests()
+		assert.Equal(t, 1, len(requests))
+		assert.Equal(t, http.MethodPost, requests[0].Method)
+		assert.Equal(t, billingstub.EventPath, requests[0].Path)
+		assert.Equal(t, "application/json", requests[0].ContentType)
+		assert.JSONEq(t, `{
+			"user_id": "user1",
+			"service": "analytics",
+			"event_type": "heatmap_generation",
+			"timestamp": "2024-03-01T12:00:00Z",
+			"details": {"amount": 0.5}
+		}`, string(requests[0].Body))
+	})
+
+	t.Run("APICall", func(t *testing.T) {
+		stub.Reset()
+		metadata := map[string]interface{}{"method": "GET"}
+
+		assert.NoError(t, stub.Client().TrackAPICall(context.Background(), "user1", "/api/v1/segments", metadata))
+
+		requests := stub.Requests()
+		assert.Equal(t, 2, len(requests))
+		assert.Equal(t, billingstub.UsagePath, requests[0].Path, "The usage record should be sent before the event")
+		assert.Equal(t, billingstub.EventPath, requests[1].Path)
+		assert.Equal(t, []string{"amount", "details", "metric", "service", "timestamp", "user_id"}, payloadKeys(t, requests[0].Body))
+		assert.Equal(t, []string{"details", "event_type", "service", "timestamp", "user_id"}, payloadKeys(t, requests[1].Body))
+
+		records, err := stub.UsageRecords()
+		assert.NoError(t, err)
+		assert.Equal(t, "analytics", records[0].Service)
+		assert.Equal(t, "api_call", records[0].Metric)
+		assert.Equal(t, int64(1), records[0].Amount)
+		assert.Equal(t, map[string]interface{}{"endpoint": "/api/v1/segments", "metadata": map[string]interface{}{"method": "GET"}}, records[0].Details)
+
+		events, err := stub.Events()
+		assert.NoError(t, err)
+		assert.Equal(t, "api_call", events[0].EventType)
+		assert.Equal(t, records[0].Details, events[0].Details)
+	})
+
+	t.Run("FailureStatuses", func(t *testing.T) {
+		stub.Reset()
+		stub.FailWith(billingstub.UsagePath, http.StatusServiceUnavailable)
+
+		err := stub.Client().TrackAPICall(context.Background(), "user1", "/api/v1/segments", nil)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "503")
+		assert.Equal(t, 1, len(stub.Requests()), "No event should be sent when the usage record fails")
+
+		stub.FailWith(billingstub.UsagePath, 0)
+		stub.FailWith(billingstub.EventPath, http.StatusOK)
+		assert.Error(t, stub.Client().TrackEvent(context.Background(), &app.BillingServiceEvent{UserID: "user1"}),
+			"Only 201 Created should be accepted")
+	})
+
+	t.Run("TrackedEvents", func(t *testing.T) {
+		stub.Reset()
+		t.Setenv("BILLING_SERVICE_URL", stub.URL())
+		service := app.NewAnalyticsService()
+
+		_, err := service.TrackEvent(context.Background(), map[string]interface{}{
+			"event_type": "page_view",
+			"user_id":    "user1",
+			"properties": map[string]interface{}{"page": "/home"},
+		}, "test-key", "user1")
+		assert.NoError(t, err)
+
+		records, err := stub.UsageRecords()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(records))
+		assert.Equal(t, "user1", records[0].UserID)
+		assert.Equal(t, "/api/v1/analytics/events", records[0].Details["endpoint"])
+		metadata := records[0].Details["metadata"].(map[string]interface{})
+		assert.Equal(t, "page_view", metadata["event_type"])
+		assert.Equal(t, "test-key", metadata["api_key"])
+		assert.Equal(t, map[string]interface{}{"page": "/home"}, metadata["properties"])
+	})
+
+	t.Run("HeatmapCharges", func(t *testing.T) {
+		stub.Reset()
+		t.Setenv("BILLING_SERVICE_URL", stub.URL())
+		heatmapService := app.NewHeatmapService(app.NewAnalyticsService())
+
+		ctx := app.ContextWithBillingUser(context.Background(), "user1")
+		_, err := heatmapService.GenerateHeatmap(ctx, app.HeatmapQuery{Page: "/home", Type: "click", Width: 800, Height: 600})
+		assert.NoError(t, err)
+
+		requests := stub.Requests()
+		assert.Equal(t, 1, len(requests))
+		assert.Equal(t, billingstub.EventPath, requests[0].Path)
+		events, err := stub.Events()
+		assert.NoError(t, err)
+		assert.Equal(t, "heatmap_generation", events[0].EventType)
+		assert.Equal(t, "user1", events[0].UserID)
+
+		var payload struct {
+			Details map[string]interface{} `json:"details"`
+		}
+		assert.NoError(t, json.Unmarshal(requests[0].Body, &payload))
+		assert.Equal(t, []string{"amount", "base_cost", "billing_event_id", "currency", "grid_height", "grid_width", "page",
+			"pixel_charges", "pixels", "scan_cost", "scanned_events", "type"}, sortedKeys(payload.Details))
+	})
+}
+
+// sortedKeys returns the sorted keys of a map
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
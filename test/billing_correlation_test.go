@@ -0,0 +1,116 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+	"magebase/apis/analytics/billingstub"
+)
+
+// TestBillingCorrelation tests the correlation IDs linking events to their billing records
+func TestBillingCorrelation(t *testing.T) {
+	stub := billingstub.NewServer()
+	defer stub.Close()
+
+	t.Run("Payloads", func(t *testing.T) {
+		stub.Reset()
+		assert.NoError(t, stub.Client().TrackCorrelatedAPICall(context.Background(), "corr-1", "user1", "/api/v1/segments", nil))
+
+		requests := stub.Requests()
+		assert.Equal(t, 2, len(requests))
+		for _, request := range requests {
+			assert.Equal(t, "corr-1", request.IdempotencyKey, request.Path)
+		}
+		records, err := stub.UsageRecords()
+		assert.NoError(t, err)
+		events, err := stub.Events()
+		assert.NoError(t, err)
+		assert.Equal(t, "corr-1", records[0].CorrelationID)
+		assert.Equal(t, "corr-1", events[0].CorrelationID)
+
+		stub.Reset()
+		assert.NoError(t, stub.Client().TrackAPICall(context.Background(), "user1", "/api/v1/segments", nil))
+		assert.Empty(t, stub.Requests()[0].IdempotencyKey, "Uncorrelated calls should not send an idempotency key")
+		assert.NotContains(t, payloadKeys(t, stub.Requests()[0].Body), "correlation_id")
+	})
+
+	t.Run("TrackedEvents", func(t *testing.T) {
+		stub.Reset()
+		t.Setenv("BILLING_SERVICE_URL", stub.URL())
+		service := app.NewAnalyticsService()
+		service.SetIDGenerator(app.NewSequentialIDGenerator())
+		track := func() *app.AnalyticsEvent {
+			event, err := service.TrackEvent(context.Background(), map[string]interface{}{"event_type": "page_view", "user_id": "user1"}, "test-key", "user1")
+			assert.NoError(t, err)
+			return event
+		}
+
+		event := track()
+		assert.Equal(t, app.BillingRecorded, event.BillingStatus)
+		records, err := stub.UsageRecords()
+		assert.NoError(t, err)
+		assert.Equal(t, event.BillingCorrelationID, records[0].CorrelationID, "The event should store the correlation ID sent to billing")
+
+		stub.FailWith(billingstub.EventPath, http.StatusServiceUnavailable)
+		failed := track()
+		assert.Equal(t, app.BillingFailed, failed.BillingStatus)
+		assert.NotEqual(t, event.BillingCorrelationID, failed.BillingCorrelationID)
+		assert.Equal(t, failed.BillingCorrelationID, stub.Requests()[len(stub.Requests())-1].IdempotencyKey,
+			"Failed events should keep the correlation ID the billing service may have seen")
+
+		found, err := service.EventByCorrelationID(failed.BillingCorrelationID)
+		assert.NoError(t, err)
+		assert.Equal(t, failed.ID, found.ID)
+		_, err = service.EventByCorrelationID("unknown")
+		assert.Error(t, err)
+
+		service.PurgeExpiredEvents(time.Now().Add(10 * 365 * 24 * time.Hour))
+		_, err = service.EventByCorrelationID(event.BillingCorrelationID)
+		assert.Error(t, err, "Purged events should not be found")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		stub.Reset()
+		t.Setenv("BILLING_SERVICE_URL", stub.URL())
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+
+		send := func(method, path, token, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			if token != "" {
+				req.Header.Set("X-Admin-Token", token)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+
+		status, body := send("POST", "/api/v1/analytics/events", "", `{"event_type":"page_view","user_id":"user1"}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "recorded", body["billing_status"])
+		correlationID := body["billing_correlation_id"].(string)
+
+		status, _ = send("GET", "/api/v1/admin/billing/correlations/"+correlationID, "", "")
+		assert.Equal(t, 401, status)
+		status, body = send("GET", "/api/v1/admin/billing/correlations/"+correlationID, "viewer-token", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "page_view", body["event"].(map[string]interface{})["event_type"])
+		status, _ = send("GET", "/api/v1/admin/billing/correlations/unknown", "viewer-token", "")
+		assert.Equal(t, 404, status)
+	})
+}
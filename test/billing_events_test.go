@@ -0,0 +1,260 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+	"magebase/apis/analytics/billingstub"
+)
+
+// TestBillingEvents tests storing the billing events of API calls and retrying their delivery
+func TestBillingEvents(t *testing.T) {
+	stub := billingstub.NewServer()
+	defer stub.Close()
+	t.Setenv("BILLING_SERVICE_URL", stub.URL())
+	t.Setenv("BILLING_RECONCILE_MAX_ATTEMPTS", "3")
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	stored := func(t *testing.T, service *app.AnalyticsService, userID string) []*app.StoredBillingEvent {
+		events, err := service.BillingEvents().Store().Query(context.Background(), app.BillingEventFilter{UserID: userID})
+		assert.NoError(t, err)
+		return events
+	}
+
+	t.Run("FileStore", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "billing-events.log")
+		store, err := app.OpenFileBillingEventStore(path)
+		assert.NoError(t, err)
+		for _, id := range []string{"b1", "b2", "b3"} {
+			event := &app.StoredBillingEvent{BillingEvent: app.BillingEvent{ID: id, UserID: "user1", Timestamp: start}, Status: app.BillingEventPending}
+			assert.NoError(t, store.Save(context.Background(), event))
+		}
+		delivered := &app.StoredBillingEvent{BillingEvent: app.BillingEvent{ID: "b1", UserID: "user1", Timestamp: start}, Status: app.BillingEventDelivered, Attempts: 1}
+		assert.NoError(t, store.Save(context.Background(), delivered))
+		assert.NoError(t, store.Delete(context.Background(), []string{"b2"}))
+		assert.NoError(t, store.Close())
+
+		reopened, err := app.OpenFileBillingEventStore(path)
+		assert.NoError(t, err)
+		defer reopened.Close()
+		events, err := reopened.Query(context.Background(), app.BillingEventFilter{})
+		assert.NoError(t, err)
+		if assert.Len(t, events, 2, "Events should outlive the store") {
+			assert.Equal(t, app.BillingEventDelivered, events[0].Status)
+			assert.Equal(t, "b3", events[1].ID)
+		}
+	})
+
+	t.Run("BoundedMemoryStore", func(t *testing.T) {
+		store := app.NewBoundedMemoryBillingEventStore(3)
+		save := func(id, status string, age time.Duration) error {
+			event := &app.StoredBillingEvent{BillingEvent: app.BillingEvent{ID: id, UserID: "user1", Timestamp: start.Add(-age)}, Status: status}
+			return store.Save(context.Background(), event)
+		}
+		assert.NoError(t, save("abandoned", app.BillingEventAbandoned, 3*time.Hour))
+		assert.NoError(t, save("delivered", app.BillingEventDelivered, time.Hour))
+		assert.NoError(t, save("failed", app.BillingEventFailed, 4*time.Hour))
+
+		assert.NoError(t, save("b1", app.BillingEventPending, 0))
+		ids := func() []string {
+			events, err := store.Query(context.Background(), app.BillingEventFilter{})
+			assert.NoError(t, err)
+			ids := make([]string, len(events))
+			for i, event := range events {
+				ids[i] = event.ID
+			}
+			return ids
+		}
+		assert.Equal(t, []string{"failed", "abandoned", "b1"}, ids(), "Delivered events should be evicted first")
+		assert.NoError(t, save("b2", app.BillingEventPending, 0))
+		assert.Equal(t, []string{"failed", "b1", "b2"}, ids(), "Abandoned events should be evicted next")
+
+		assert.Error(t, save("b3", app.BillingEventPending, 0), "Undelivered events should not be evicted")
+		assert.NoError(t, save("b1", app.BillingEventDelivered, 0), "Stored events should still be updated")
+		assert.Equal(t, 3, store.Len())
+	})
+
+	t.Run("Reconciliation", func(t *testing.T) {
+		stub.Reset()
+		clock := app.NewFakeClock(start)
+		service := app.NewAnalyticsService()
+		service.SetClock(clock)
+
+		assert.NoError(t, service.TrackAPIUsage(context.Background(), "billed", "/api/v1/trends", "GET", nil))
+		clock.Advance(time.Second)
+		failedAt := clock.Now()
+		stub.FailWith(billingstub.EventPath, 503)
+		assert.Error(t, service.TrackAPIUsage(context.Background(), "billed", "/api/v1/trends", "POST", nil))
+
+		events := stored(t, service, "billed")
+		if !assert.Len(t, events, 2) {
+			return
+		}
+		assert.Equal(t, app.BillingEventDelivered, events[0].Status)
+		failed := events[1]
+		assert.Equal(t, app.BillingEventFailed, failed.Status)
+		assert.Equal(t, 1, failed.Attempts)
+		assert.Contains(t, failed.LastError, "503")
+		assert.Equal(t, failedAt.Add(time.Minute), *failed.NextAttemptAt)
+
+		result := service.BillingEvents().Reconcile(context.Background())
+		assert.Equal(t, 0, result.Retried, "Failed deliveries should wait for their backoff")
+
+		clock.Advance(time.Minute)
+		result = service.BillingEvents().Reconcile(context.Background())
+		assert.Equal(t, 1, result.Failed)
+		failed = stored(t, service, "billed")[1]
+		assert.Equal(t, 2, failed.Attempts)
+		assert.Equal(t, failedAt.Add(3*time.Minute), *failed.NextAttemptAt, "The backoff should double")
+
+		stub.FailWith(billingstub.EventPath, 0)
+		clock.Advance(2 * time.Minute)
+		result = service.BillingEvents().Reconcile(context.Background())
+		assert.Equal(t, 1, result.Delivered)
+		failed = stored(t, service, "billed")[1]
+		assert.Equal(t, app.BillingEventDelivered, failed.Status)
+		assert.Nil(t, failed.NextAttemptAt)
+
+		sent, err := stub.Events()
+		assert.NoError(t, err)
+		retried := 0
+		for _, event := range sent {
+			if event.CorrelationID == failed.ID {
+				retried++
+			}
+		}
+		assert.Equal(t, 3, retried, "Every attempt should carry the billing event's ID")
+
+		stub.FailWith(billingstub.UsagePath, 500)
+		assert.Error(t, service.TrackAPIUsage(context.Background(), "abandoned", "/api/v1/trends", "GET", nil))
+		for i := 0; i < 2; i++ {
+			clock.Advance(time.Hour)
+			service.BillingEvents().Reconcile(context.Background())
+		}
+		abandoned := stored(t, service, "abandoned")[0]
+		assert.Equal(t, app.BillingEventAbandoned, abandoned.Status)
+		assert.Equal(t, 3, abandoned.Attempts)
+		clock.Advance(time.Hour)
+		assert.Equal(t, 0, service.BillingEvents().Reconcile(context.Background()).Retried, "Abandoned events should not be retried")
+
+		clock.Advance(31 * 24 * time.Hour)
+		result = service.BillingEvents().Reconcile(context.Background())
+		assert.Equal(t, 3, result.Pruned, "Events past the retention should be pruned")
+	})
+
+	t.Run("OnePerRequest", func(t *testing.T) {
+		stub.Reset()
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		service := application.GetAnalyticsService()
+
+		req := httptest.NewRequest("GET", "/api/v1/analytics/validation-errors", nil)
+		req.Header.Set("X-User-ID", "requester")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		assert.Eventually(t, func() bool {
+			events := stored(t, service, "requester")
+			return len(events) == 1 && events[0].Status == app.BillingEventDelivered
+		}, 5*time.Second, 10*time.Millisecond)
+		event := stored(t, service, "requester")[0]
+		assert.Equal(t, 200, event.Metadata["status_code"], "Requests should be billed once they completed")
+
+		records, err := stub.UsageRecords()
+		assert.NoError(t, err)
+		if assert.Len(t, records, 1, "A request should be billed once") {
+			assert.Equal(t, event.ID, records[0].CorrelationID)
+		}
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		stub.Reset()
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+
+		stub.FailWith(billingstub.EventPath, 500)
+		service := application.GetAnalyticsService()
+		service.SetClock(app.NewFakeClock(start))
+		metadata := map[string]interface{}{"api_key": "secret-key", "ip_address": "203.0.113.7", "path": "/api/v1/trends"}
+		assert.Error(t, service.TrackAPIUsage(context.Background(), "audited", "/api/v1/trends", "GET", metadata))
+		records, err := stub.UsageRecords()
+		assert.NoError(t, err)
+		if assert.Len(t, records, 1) {
+			sent := records[0].Details["metadata"].(map[string]interface{})
+			assert.Equal(t, "secret-key", sent["api_key"], "The billing service should still receive the API key")
+			assert.Equal(t, "203.0.113.7", sent["ip_address"])
+		}
+		stub.FailWith(billingstub.EventPath, 0)
+		assert.NoError(t, service.TrackAPIUsage(context.Background(), "audited", "/api/v1/trends", "GET", nil))
+
+		getAs := func(token, query string) (int, map[string]interface{}) {
+			req := httptest.NewRequest("GET", "/api/v1/admin/billing/events"+query, nil)
+			req.Header.Set("X-User-ID", "auditor") // Bills the audit requests to the auditor, not the queried user
+			if token != "" {
+				req.Header.Set("X-Admin-Token", token)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var body map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&body)
+			return resp.StatusCode, body
+		}
+		get := func(query string) (int, map[string]interface{}) {
+			return getAs("viewer-token", query)
+		}
+
+		status, _ := getAs("", "?user_id=audited")
+		assert.Equal(t, 401, status, "Billing events should only be listed to admins")
+		status, _ = getAs("wrong-token", "?user_id=audited")
+		assert.Equal(t, 401, status)
+
+		status, body := get("?user_id=audited")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 2.0, body["count"])
+		assert.Equal(t, map[string]interface{}{"pending": 0.0, "delivered": 1.0, "failed": 1.0, "abandoned": 0.0}, body["summary"])
+		assert.Nil(t, body["last_reconciliation"])
+
+		status, body = get("?user_id=audited&status=failed")
+		assert.Equal(t, 200, status)
+		events := body["events"].([]interface{})
+		if assert.Len(t, events, 1) {
+			event := events[0].(map[string]interface{})
+			assert.Equal(t, "api_call", event["event_type"])
+			assert.Equal(t, "/api/v1/trends", event["endpoint"])
+			assert.NotEmpty(t, event["next_attempt_at"])
+			kept := event["metadata"].(map[string]interface{})
+			assert.Equal(t, app.APIKeyID("secret-key"), kept["api_key_id"])
+			assert.NotContains(t, kept, "api_key", "API keys should not be kept with billing events")
+			assert.NotContains(t, kept, "ip_address")
+		}
+
+		_, body = get("?user_id=audited&start_date=2024-03-01&end_date=2024-03-01")
+		assert.Equal(t, 2.0, body["count"], "End dates should be included")
+		_, body = get("?user_id=audited&end_date=2024-02-29")
+		assert.Equal(t, 0.0, body["count"])
+		_, body = get("?user_id=audited&end_date=2024-03-01T12:00:00Z")
+		assert.Equal(t, 0.0, body["count"], "RFC3339 ends should be exclusive")
+
+		status, _ = get("?status=lost")
+		assert.Equal(t, 400, status)
+		status, _ = get("?limit=0")
+		assert.Equal(t, 400, status)
+		status, _ = get("?start_date=yesterday")
+		assert.Equal(t, 400, status)
+
+		application.GetBillingReconciler().Run()
+		_, body = get("?user_id=audited")
+		assert.NotNil(t, body["last_reconciliation"])
+	})
+}
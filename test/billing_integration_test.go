@@ -8,6 +8,7 @@ import (
 	"github.com/stretchr/testify/mock"
 
 	"magebase/apis/analytics/app"
+	"magebase/apis/analytics/billingstub"
 )
 
 // MockBillingClient is a mock implementation of the billing client for testing
@@ -32,6 +33,10 @@ func (m *MockBillingClient) TrackAPICall(ctx context.Context, userID, endpoint s
 
 // TestBillingIntegration tests the integration between analytics service and billing service
 func TestBillingIntegration(t *testing.T) {
+	stub := billingstub.NewServer()
+	defer stub.Close()
+	t.Setenv("BILLING_SERVICE_URL", stub.URL())
+
 	t.Run("TrackEventWithBilling", func(t *testing.T) {
 		// Create analytics service
 		service := app.NewAnalyticsService()
@@ -43,10 +48,10 @@ func TestBillingIntegration(t *testing.T) {
 			"page":       "/home",
 		}
 
-		event, err := service.TrackEvent(nil, eventData, "test-api-key", "user123")
+		event, err := service.TrackEvent(context.Background(), eventData, "test-api-key", "user123")
 		assert.NoError(t, err, "Event tracking should succeed")
 		assert.NotNil(t, event, "Event should be created")
-		assert.NotEmpty(t, event.BillingEventID, "Event should have a billing event ID")
+		assert.NotEmpty(t, event.BillingCorrelationID, "Event should have a billing correlation ID")
 	})
 
 	t.Run("TrackAPIUsage", func(t *testing.T) {
@@ -58,10 +63,22 @@ func TestBillingIntegration(t *testing.T) {
 			"user_agent": "test-agent",
 		}
 
-		err := service.TrackAPIUsage(nil, "user123", "/api/v1/analytics/usage", "GET", metadata)
-		// This will fail in tests since there's no real billing service, but that's expected
-		// In a real environment, this would succeed
-		assert.Error(t, err, "Should fail without real billing service")
+		stub.Reset()
+		err := service.TrackAPIUsage(context.Background(), "user123", "/api/v1/analytics/usage", "GET", metadata)
+		assert.NoError(t, err, "API usage should be reported to the billing service")
+
+		records, err := stub.UsageRecords()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(records))
+		assert.Equal(t, "/api/v1/analytics/usage", records[0].Details["endpoint"])
+		reported := records[0].Details["metadata"].(map[string]interface{})
+		assert.Equal(t, "GET", reported["method"])
+		assert.Equal(t, "test-agent", reported["user_agent"])
+
+		// Billing service failures are returned to the caller
+		stub.FailWith(billingstub.EventPath, 500)
+		err = service.TrackAPIUsage(context.Background(), "user123", "/api/v1/analytics/usage", "GET", metadata)
+		assert.Error(t, err, "Should fail when the billing service rejects the call")
 	})
 
 	t.Run("BillingClientCreation", func(t *testing.T) {
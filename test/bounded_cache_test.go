@@ -0,0 +1,120 @@
+package test
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestBoundedCache tests the shared LRU cache bounding the rate limiter, batch deduplication,
+// ingestion receipts and query results
+func TestBoundedCache(t *testing.T) {
+	t.Run("LeastRecentlyUsed", func(t *testing.T) {
+		cache := app.NewBoundedCache("test", 2, 0)
+		cache.Set("a", 1)
+		cache.Set("b", 2)
+		_, found := cache.Get("a")
+		assert.True(t, found)
+		cache.Set("c", 3)
+
+		_, found = cache.Get("b")
+		assert.False(t, found, "The least recently used entry should be evicted")
+		value, found := cache.Get("a")
+		assert.True(t, found)
+		assert.Equal(t, 1, value)
+
+		cache.Update("c", func(value interface{}, exists bool) interface{} {
+			assert.True(t, exists)
+			return value.(int) + 1
+		})
+		value, _ = cache.Peek("c")
+		assert.Equal(t, 4, value)
+
+		stats := cache.Stats()
+		assert.Equal(t, 2, stats.Entries)
+		assert.Equal(t, int64(1), stats.Evictions)
+		assert.Equal(t, int64(2), stats.Hits)
+		assert.Equal(t, int64(1), stats.Misses)
+
+		assert.NoError(t, cache.SetLimits(1, 0))
+		assert.Equal(t, 1, cache.Len(), "Shrinking the cache should evict entries")
+		assert.Error(t, cache.SetLimits(-1, 0))
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		clock := app.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		cache := app.NewBoundedCache("test", 2, time.Minute)
+		cache.SetClock(clock)
+		cache.Set("a", 1)
+		clock.Advance(30 * time.Second)
+		cache.Set("b", 2)
+		clock.Advance(30 * time.Second)
+
+		_, found := cache.Get("a")
+		assert.False(t, found, "Entries should expire a TTL after they were set")
+		_, found = cache.Get("b")
+		assert.True(t, found)
+
+		// Expired entries make room before recently used ones are evicted
+		clock.Advance(time.Minute)
+		cache.Set("c", 3)
+		cache.Set("d", 4)
+		stats := cache.Stats()
+		assert.Equal(t, int64(2), stats.Expirations)
+		assert.Equal(t, int64(0), stats.Evictions)
+		assert.Equal(t, "1m0s", stats.TTL)
+	})
+
+	t.Run("RateLimiter", func(t *testing.T) {
+		t.Setenv("RATE_LIMITER_MAX_KEYS", "2")
+		limiter := app.NewRateLimiter()
+		limiter.SetLimit(1)
+		for i := 0; i < 10; i++ {
+			assert.True(t, limiter.AllowRequest(fmt.Sprintf("user%d", i), "/api/v1/trends"))
+		}
+		assert.Equal(t, 2, limiter.Cache().Len(), "The limiter should keep at most the configured users and endpoints")
+		assert.False(t, limiter.AllowRequest("user9", "/api/v1/trends"))
+		assert.Equal(t, 0, limiter.GetRemainingRequests("user9", "/api/v1/trends"))
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		t.Setenv("INGESTION_MAX_RECEIPTS", "2")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"page_view","user_id":"user1"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Prefer", "respond-async")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 202, resp.StatusCode)
+		}
+
+		resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", "/metrics", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+
+		metrics := string(body)
+		assert.Contains(t, metrics, "# TYPE analytics_cache_evictions_total counter\n")
+		assert.Contains(t, metrics, `analytics_cache_entries{cache="ingestion_receipts"} 2`)
+		assert.Contains(t, metrics, `analytics_cache_max_entries{cache="ingestion_receipts"} 2`)
+		assert.Contains(t, metrics, `analytics_cache_evictions_total{cache="ingestion_receipts"} 1`)
+		for _, name := range []string{"mobile_batch_dedup", "query_cache", "rate_limiter"} {
+			assert.Contains(t, metrics, fmt.Sprintf("analytics_cache_entries{cache=%q}", name))
+		}
+	})
+}
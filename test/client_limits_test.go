@@ -0,0 +1,106 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestClientLimits tests reporting the caller's rate limits, quotas, sample rates and plan caps
+func TestClientLimits(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	service := application.GetAnalyticsService()
+
+	getLimits := func(query string) app.ClientLimits {
+		req := httptest.NewRequest("GET", "/api/v1/limits"+query, nil)
+		req.Header.Set("X-User-ID", "user1")
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		var response struct {
+			Limits app.ClientLimits `json:"limits"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &response))
+		return response.Limits
+	}
+	track := func(eventType string) int {
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"`+eventType+`","user_id":"user1"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "user1")
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	t.Run("RateLimits", func(t *testing.T) {
+		limits := getLimits("")
+		assert.Equal(t, "user1", limits.UserID)
+		assert.Equal(t, "shop", limits.ProjectID)
+		if assert.Len(t, limits.RateLimits, 2) {
+			assert.Equal(t, "/api/v1/analytics/events", limits.RateLimits[0].Endpoint)
+			assert.Equal(t, 100, limits.RateLimits[0].Remaining)
+			assert.Equal(t, 60, limits.RateLimits[0].WindowSeconds)
+		}
+
+		assert.Equal(t, 200, track("page_view"))
+		assert.Equal(t, 200, track("page_view"))
+		limits = getLimits("")
+		assert.Equal(t, 98, limits.RateLimits[0].Remaining)
+		assert.Equal(t, 100, limits.RateLimits[1].Remaining, "Limits are counted per endpoint")
+		assert.WithinDuration(t, time.Now().Add(time.Minute), limits.RateLimits[0].ResetAt, 5*time.Second)
+
+		limits = getLimits("?endpoints=/api/v1/analytics/usage,%20/api/v1/limits")
+		if assert.Len(t, limits.RateLimits, 2) {
+			assert.Equal(t, "/api/v1/limits", limits.RateLimits[1].Endpoint)
+			assert.Less(t, limits.RateLimits[1].Remaining, 100, "Asking for the limits counts against them")
+		}
+	})
+
+	t.Run("QuotasAndSampleRates", func(t *testing.T) {
+		_, err := service.Quotas().Replace("shop", []app.EventTypeQuota{
+			{EventType: "mouse_move", DailyLimit: 1, Action: app.QuotaSample, SampleRate: 0.5},
+			{EventType: "scroll", DailyLimit: 10},
+		}, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, service.StorageSampler().SetDetailRate("click", 0.25))
+		track("mouse_move")
+
+		limits := getLimits("")
+		if assert.Len(t, limits.Quotas, 2) {
+			assert.Equal(t, "mouse_move", limits.Quotas[0].EventType)
+			assert.Equal(t, int64(1), limits.Quotas[0].Used)
+			assert.Equal(t, int64(0), limits.Quotas[0].Remaining)
+			assert.True(t, limits.Quotas[0].Exceeded)
+			assert.Equal(t, 0.5, limits.Quotas[0].SampleRate)
+			assert.Equal(t, int64(10), limits.Quotas[1].Remaining)
+			assert.False(t, limits.Quotas[1].Exceeded)
+		}
+		assert.Equal(t, 0, limits.QuotasResetAt.Hour())
+		assert.True(t, limits.QuotasResetAt.After(time.Now()))
+		assert.Equal(t, 0.25, limits.DetailRates["click"])
+		assert.NotNil(t, limits.RequestRates)
+	})
+
+	t.Run("PlanCaps", func(t *testing.T) {
+		assert.Equal(t, "free", getLimits("").Plan.Name)
+		assert.NoError(t, service.Plans().SetUserPlan("user1", "pro"))
+		limits := getLimits("")
+		assert.Equal(t, "pro", limits.Plan.Name)
+		assert.Equal(t, 3840, limits.Plan.MaxHeatmapWidth)
+		assert.Equal(t, 500, limits.MaxBatchEvents)
+		assert.Positive(t, limits.MaxBatchBytes)
+	})
+}
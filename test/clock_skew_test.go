@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestClockSkew tests correcting client timestamps for the clock skew of the sending device
+func TestClockSkew(t *testing.T) {
+	track := func(service *app.AnalyticsService, eventData map[string]interface{}) (*app.AnalyticsEvent, error) {
+		eventData["event_type"] = "purchase"
+		eventData["user_id"] = "user1"
+		return service.TrackEvent(app.ContextWithProject(context.Background(), "mobile"), eventData, "test-key", "user1")
+	}
+
+	t.Run("CorrectsSkewedClock", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+
+		// The device's clock is two days behind; the event happened ten minutes before sending
+		deviceNow := time.Now().Add(-48 * time.Hour)
+		happened := deviceNow.Add(-10 * time.Minute)
+		event, err := track(service, map[string]interface{}{
+			"timestamp": happened.Format(time.RFC3339Nano),
+			"sent_at":   deviceNow.Format(time.RFC3339Nano),
+		})
+		assert.NoError(t, err)
+
+		assert.WithinDuration(t, time.Now().Add(-10*time.Minute), event.Timestamp, time.Second)
+		assert.True(t, event.ClientTimestamp.Equal(happened), "The raw client timestamp should be kept")
+		assert.True(t, event.SentAt.Equal(deviceNow))
+		assert.InDelta(t, (48 * time.Hour).Milliseconds(), event.ClockSkewMs, float64(time.Second.Milliseconds()))
+	})
+
+	t.Run("SkewDecidesLateness", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		assert.NoError(t, service.LateEvents().SetWindow(time.Hour))
+
+		// A device clock running a day ahead would be rejected as a future timestamp without correction
+		deviceNow := time.Now().Add(24 * time.Hour)
+		_, err := track(service, map[string]interface{}{
+			"timestamp": float64(deviceNow.Add(-time.Minute).UnixMilli()),
+			"sent_at":   float64(deviceNow.UnixMilli()),
+		})
+		assert.NoError(t, err)
+
+		// Correctly set clocks still reveal events queued longer than the window
+		_, err = track(service, map[string]interface{}{
+			"timestamp": time.Now().Add(-2 * time.Hour).Format(time.RFC3339),
+			"sent_at":   time.Now().Format(time.RFC3339),
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("WithoutSentAt", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		happened := time.Now().Add(-time.Minute).Truncate(time.Second)
+		event, err := track(service, map[string]interface{}{"timestamp": happened.Format(time.RFC3339)})
+		assert.NoError(t, err)
+		assert.True(t, event.Timestamp.Equal(happened), "Timestamps without sent_at should not be corrected")
+		assert.Nil(t, event.SentAt)
+		assert.Equal(t, int64(0), event.ClockSkewMs)
+	})
+
+	t.Run("RejectsInconsistentTimes", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		_, err := track(service, map[string]interface{}{
+			"timestamp": time.Now().Format(time.RFC3339),
+			"sent_at":   time.Now().Add(-time.Hour).Format(time.RFC3339),
+		})
+		assert.Error(t, err, "An event cannot happen after it was sent")
+		_, err = track(service, map[string]interface{}{
+			"timestamp": time.Now().Format(time.RFC3339),
+			"sent_at":   true,
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 2, len(service.ValidationLog().Query("mobile", app.ValidationIssueTimestamp, 0)))
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		deviceNow := time.Now().Add(-6 * time.Hour)
+		body := `{"event_type":"purchase","user_id":"user1","timestamp":"` + deviceNow.Add(-time.Second).Format(time.RFC3339Nano) +
+			`","sent_at":"` + deviceNow.Format(time.RFC3339Nano) + `"}`
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "user1")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var tracked struct {
+			TrackedAt   time.Time `json:"tracked_at"`
+			ClockSkewMs int64     `json:"clock_skew_ms"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&tracked))
+		assert.WithinDuration(t, time.Now(), tracked.TrackedAt, 5*time.Second)
+		assert.Greater(t, tracked.ClockSkewMs, (5 * time.Hour).Milliseconds(), "tracked_at should be the corrected timestamp")
+	})
+}
@@ -0,0 +1,122 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestInjectableClock tests time-window logic and IDs driven by a fake clock and ID generator
+func TestInjectableClock(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("FakeClock", func(t *testing.T) {
+		clock := app.NewFakeClock(start)
+		assert.Equal(t, start, clock.Now())
+		clock.Advance(time.Hour)
+		assert.Equal(t, start.Add(time.Hour), clock.Now())
+		clock.Set(start)
+		assert.Equal(t, start, clock.Now())
+	})
+
+	t.Run("SequentialIDs", func(t *testing.T) {
+		ids := app.NewSequentialIDGenerator()
+		assert.Equal(t, "00000001-0000-4000-8000-000000000000", ids.NewID())
+		assert.Equal(t, "00000002-0000-4000-8000-000000000000", ids.NewID())
+	})
+
+	t.Run("RateLimiterWindow", func(t *testing.T) {
+		clock := app.NewFakeClock(start)
+		limiter := app.NewRateLimiter()
+		limiter.SetClock(clock)
+		limiter.SetLimit(2)
+
+		assert.True(t, limiter.AllowRequest("user1", "/api"))
+		clock.Advance(30 * time.Second)
+		assert.True(t, limiter.AllowRequest("user1", "/api"))
+		assert.False(t, limiter.AllowRequest("user1", "/api"))
+
+		clock.Advance(31 * time.Second)
+		assert.Equal(t, 1, limiter.GetRemainingRequests("user1", "/api"), "The first request should have left the window")
+		assert.True(t, limiter.AllowRequest("user1", "/api"))
+	})
+
+	t.Run("DeterministicEvents", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		service.SetClock(app.NewFakeClock(start))
+		service.SetIDGenerator(app.NewSequentialIDGenerator())
+
+		track := func() *app.AnalyticsEvent {
+			event, err := service.TrackEvent(context.Background(), map[string]interface{}{
+				"event_type": "page_view",
+				"user_id":    "user1",
+			}, "test-key", "user1")
+			assert.NoError(t, err)
+			return event
+		}
+
+		first := track()
+		assert.Equal(t, start, first.ReceivedAt)
+		assert.Equal(t, start, first.Timestamp, "Events without a timestamp should be stamped by the clock")
+		assert.NotEmpty(t, first.ID)
+
+		second := track()
+		assert.NotEqual(t, first.ID, second.ID)
+
+		replay := app.NewAnalyticsService()
+		replay.SetClock(app.NewFakeClock(start))
+		replay.SetIDGenerator(app.NewSequentialIDGenerator())
+		event, err := replay.TrackEvent(context.Background(), map[string]interface{}{
+			"event_type": "page_view",
+			"user_id":    "user1",
+		}, "test-key", "user1")
+		assert.NoError(t, err)
+		assert.Equal(t, first.ID, event.ID, "The same sequence should produce the same IDs")
+	})
+
+	t.Run("FunnelsAndHeatmaps", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		service.SetClock(app.NewFakeClock(start))
+		service.SetIDGenerator(app.NewSequentialIDGenerator())
+
+		funnel, err := app.NewFunnelService(service).CreateFunnel(context.Background(), "Signup", "", []app.Step{
+			{ID: "view", Name: "View", EventType: "page_view", Order: 1},
+			{ID: "signup", Name: "Signup", EventType: "signup", Order: 2},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "funnel_00000001-0000-4000-8000-000000000000", funnel.ID)
+		assert.Equal(t, start, funnel.CreatedAt)
+
+		heatmap, err := app.NewHeatmapService(service).CreateHeatmap(context.Background(), "Home", "", "click", "/home", 10, 10, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "heatmap_00000002-0000-4000-8000-000000000000", heatmap.ID)
+		assert.Equal(t, start, heatmap.UpdatedAt)
+	})
+
+	t.Run("LatenessWindow", func(t *testing.T) {
+		clock := app.NewFakeClock(start)
+		service := app.NewAnalyticsService()
+		service.SetClock(clock)
+
+		eventData := map[string]interface{}{
+			"event_type": "page_view",
+			"user_id":    "user1",
+			"timestamp":  start.Add(-2 * time.Hour).Format(time.RFC3339),
+		}
+		event, err := service.TrackEvent(context.Background(), eventData, "test-key", "user1")
+		assert.NoError(t, err)
+		assert.True(t, event.Late)
+
+		clock.Advance(service.LateEvents().Window())
+		_, err = service.TrackEvent(context.Background(), eventData, "test-key", "user1")
+		assert.Error(t, err, "Events older than the lateness window should be rejected")
+	})
+}
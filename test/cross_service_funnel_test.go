@@ -0,0 +1,141 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestCrossServiceFunnels tests funnels whose steps are events of the auth, billing and payments
+// services consumed from Kafka
+func TestCrossServiceFunnels(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	funnels := application.GetFunnelService()
+	ctx := app.ContextWithProject(context.Background(), "shop")
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	track := func(eventType, userID, plan string, at time.Time) {
+		_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+			"timestamp":  at.Format(time.RFC3339),
+			"properties": map[string]interface{}{"plan": plan},
+		}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	events := application.GetUserTimeline().ServiceEvents()
+	record := func(source, eventType, userID string, at time.Time, data map[string]interface{}) {
+		events.Record(&app.CrossServiceEvent{Source: source, EventType: eventType, UserID: userID, Timestamp: at, Data: data})
+	}
+
+	// user1 converts, user2 activates, user3 only signs up, user4 never signs up and user5 pays
+	// before activating
+	record("", "auth.user.registered", "user1", start, nil)
+	track("activated", "user1", "pro", start.Add(time.Minute))
+	record("billing", "payment.completed", "user1", start.Add(2*time.Minute), map[string]interface{}{"currency": "EUR"})
+	record("auth", "user.registered", "user2", start, nil)
+	track("activated", "user2", "free", start.Add(time.Minute))
+	record("auth", "auth.user.registered", "user3", start, nil)
+	track("activated", "user4", "free", start.Add(time.Minute))
+	record("", "billing.payment.completed", "user4", start.Add(2*time.Minute), nil)
+	record("auth", "user.registered", "user5", start, nil)
+	record("billing", "billing.payment.completed", "user5", start.Add(time.Minute), nil)
+	track("activated", "user5", "free", start.Add(2*time.Minute))
+
+	steps := []app.Step{
+		{ID: "signup", Name: "Signup", EventType: "auth.user.registered", Order: 1},
+		{ID: "activation", Name: "Activation", EventType: "activated", Source: app.StepSourceAnalytics, Order: 2},
+		{ID: "payment", Name: "Payment", EventType: "payment.completed", Source: "billing", Order: 3},
+	}
+	funnel, err := funnels.CreateFunnel(ctx, "Signup to payment", "", steps)
+	assert.NoError(t, err)
+	query := app.FunnelQuery{FunnelID: funnel.ID, Start: start.Add(-time.Minute), End: start.Add(time.Hour)}
+
+	t.Run("ComputesFromServiceEvents", func(t *testing.T) {
+		result, err := funnels.ComputeFunnel(ctx, query)
+		assert.NoError(t, err)
+		if assert.Len(t, result.Steps, 3) {
+			assert.Equal(t, int64(4), result.Steps[0].UniqueUsers)
+			assert.Equal(t, int64(3), result.Steps[1].UniqueUsers, "Activations without a signup should not count")
+			assert.Equal(t, int64(1), result.Steps[2].UniqueUsers, "Payments before activation should not count")
+			assert.Equal(t, 25.0, result.ConversionRate)
+		}
+		assert.Equal(t, int64(4), result.TotalUsers)
+
+		query := query
+		query.UserID = "user1"
+		result, err = funnels.ComputeFunnel(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), result.Steps[2].UniqueUsers)
+		assert.Equal(t, 100.0, result.ConversionRate)
+	})
+
+	t.Run("SourceQualifiedMatching", func(t *testing.T) {
+		compute := func(steps ...app.Step) []app.StepResult {
+			for i := range steps {
+				steps[i].ID = steps[i].EventType
+				steps[i].Order = i + 1
+			}
+			funnel, err := funnels.CreateFunnel(ctx, "Qualified", "", steps)
+			assert.NoError(t, err)
+			result, err := funnels.ComputeFunnel(ctx, app.FunnelQuery{FunnelID: funnel.ID, Start: query.Start, End: query.End})
+			assert.NoError(t, err)
+			return result.Steps
+		}
+
+		result := compute(app.Step{EventType: "user.registered", Source: "auth"}, app.Step{EventType: "billing.payment.completed"})
+		assert.Equal(t, int64(4), result[0].UniqueUsers, "Service steps should match plain and qualified types")
+		assert.Equal(t, int64(2), result[1].UniqueUsers)
+
+		result = compute(app.Step{EventType: "auth.user.registered", Source: "billing"}, app.Step{EventType: "activated"})
+		assert.Equal(t, int64(0), result[0].UniqueUsers, "Events of other services should not match")
+
+		result = compute(app.Step{EventType: "auth.user.registered"}, app.Step{EventType: "payment.completed", Source: "billing", Filters: map[string]interface{}{"currency": "EUR"}})
+		assert.Equal(t, int64(1), result[1].UniqueUsers, "Filters should apply to the data of service events")
+	})
+
+	t.Run("Breakdown", func(t *testing.T) {
+		_, err := application.GetAnalyticsService().Dimensions().Replace("shop", []app.CustomDimension{{Name: "plan", Property: "plan", Type: app.DimensionString}}, 0)
+		assert.NoError(t, err)
+		query := query
+		query.Breakdown = "plan"
+		result, err := funnels.ComputeFunnel(ctx, query)
+		assert.NoError(t, err)
+		if assert.Len(t, result.Breakdown, 1) {
+			assert.Equal(t, app.NoDimensionValue, result.Breakdown[0].Value, "Users enter with the signup, which has no plan")
+			assert.Equal(t, int64(4), result.Breakdown[0].TotalUsers)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		_, err := funnels.CreateFunnel(ctx, "Invalid", "", []app.Step{
+			{ID: "1", EventType: "user.registered", Source: "crm", Order: 1},
+			{ID: "2", EventType: "activated", Order: 2},
+		})
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "invalid source for step 1")
+		}
+
+		req := httptest.NewRequest("POST", "/api/v1/funnels", strings.NewReader(`{"name":"Signup","steps":[{"name":"Signup","event_type":"user.registered","source":"auth","order":1},{"name":"Payment","event_type":"billing.payment.completed","order":2}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		if assert.Equal(t, 200, resp.StatusCode) {
+			var body struct {
+				Funnel app.Funnel `json:"funnel"`
+			}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Equal(t, "auth", body.Funnel.Steps[0].Source)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestCurrencyAwareBilling tests billing amounts in each project's contract currency
+func TestCurrencyAwareBilling(t *testing.T) {
+	today := time.Now().Format("2006-01-02")
+
+	t.Run("ConvertsUsageToProjectCurrency", func(t *testing.T) {
+		analyticsService := app.NewAnalyticsService()
+		currencies := analyticsService.Currencies()
+		assert.NoError(t, currencies.ReplaceRates(map[string]float64{"EUR": 0.5}))
+		assert.NoError(t, currencies.SetProjectCurrency("shop", "eur"))
+
+		ctx := app.ContextWithProject(context.Background(), "shop")
+		_, err := analyticsService.TrackEvent(ctx, map[string]interface{}{
+			"event_type": "conversion",
+			"user_id":    "user1",
+		}, "test-key", "user1")
+		assert.NoError(t, err)
+
+		usage, err := analyticsService.GetUsage(ctx, "user1", today, today)
+		assert.NoError(t, err)
+		assert.Equal(t, "EUR", usage.BillingSummary.Currency)
+		assert.InDelta(t, 0.005, usage.BillingSummary.TotalCost, 1e-9)
+		assert.InDelta(t, 0.005, usage.BillingSummary.CostBreakdown["conversion"], 1e-9)
+		assert.InDelta(t, 0.01, usage.BillingSummary.BaseTotalCost, 1e-9)
+		assert.Equal(t, 0.5, usage.BillingSummary.ExchangeRate)
+
+		usage, err = analyticsService.GetUsage(context.Background(), "user1", today, today)
+		assert.NoError(t, err)
+		assert.Equal(t, "USD", usage.BillingSummary.Currency, "Projects without a currency should be billed in USD")
+		assert.InDelta(t, 0.01, usage.BillingSummary.TotalCost, 1e-9)
+	})
+
+	t.Run("RatesInUseCannotBeDropped", func(t *testing.T) {
+		currencies := app.NewAnalyticsService().Currencies()
+		assert.Error(t, currencies.SetProjectCurrency("shop", "GBP"), "Currencies without a rate should be rejected")
+
+		assert.NoError(t, currencies.ReplaceRates(map[string]float64{"GBP": 0.8}))
+		assert.NoError(t, currencies.SetProjectCurrency("shop", "GBP"))
+		assert.Error(t, currencies.ReplaceRates(map[string]float64{"EUR": 0.9}))
+		assert.Error(t, currencies.ReplaceRates(map[string]float64{"GBP": -1}))
+		assert.NoError(t, currencies.ReplaceRates(map[string]float64{"GBP": 0.75, "EUR": 0.9}))
+	})
+
+	t.Run("HeatmapBilledInProjectCurrency", func(t *testing.T) {
+		analyticsService := app.NewAnalyticsService()
+		assert.NoError(t, analyticsService.Currencies().ReplaceRates(map[string]float64{"EUR": 2}))
+		assert.NoError(t, analyticsService.Currencies().SetProjectCurrency("shop", "EUR"))
+		heatmapService := app.NewHeatmapService(analyticsService)
+
+		query := app.HeatmapQuery{Page: "/home", Type: "click", Start: time.Now().AddDate(0, 0, -1), End: time.Now(), Width: 800, Height: 600}
+		usd, err := heatmapService.GenerateHeatmap(context.Background(), query)
+		assert.NoError(t, err)
+		eur, err := heatmapService.GenerateHeatmap(app.ContextWithProject(context.Background(), "shop"), query)
+		assert.NoError(t, err)
+
+		assert.Equal(t, "EUR", eur.Billing.Currency)
+		assert.InDelta(t, usd.Billing.PixelCharges[0].Amount*2, eur.Billing.PixelCharges[0].Amount, 1e-9)
+		assert.InDelta(t, usd.Billing.BaseCost*2, eur.Billing.BaseCost, 1e-9)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		assert.NoError(t, application.GetAdminAuth().AddToken("root", "admin-token", app.RoleAdmin))
+
+		req := httptest.NewRequest("PUT", "/api/v1/admin/runtime/billing.currency_rates", strings.NewReader(`{"value":{"EUR":0.5}}`))
+		req.Header.Set("If-Match", "*")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Admin-Token", "admin-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		req = httptest.NewRequest("PUT", "/api/v1/admin/projects/shop/currency", strings.NewReader(`{"currency":"EUR"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Admin-Token", "admin-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		entries := application.GetAuditLog().Entries("project.currency", 1)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, "EUR", entries[0].Details["currency"])
+
+		req = httptest.NewRequest("GET", "/api/v1/analytics/usage?user_id=user1", nil)
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			BillingSummary app.BillingSummary `json:"billing_summary"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "EUR", body.BillingSummary.Currency)
+	})
+}
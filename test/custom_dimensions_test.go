@@ -0,0 +1,189 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestCustomDimensions tests registering typed dimensions, validating and indexing their values,
+// and breaking down trends, funnels and usage by them
+func TestCustomDimensions(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "shop")
+	dimensions := []app.CustomDimension{
+		{Name: "plan", Property: "plan_name", Type: app.DimensionEnum, Values: []string{"free", "pro"}},
+		{Name: "seats", Property: "seats", Type: app.DimensionNumber},
+		{Name: "trial", Property: "is_trial", Type: app.DimensionBool},
+	}
+
+	setup := func() (*app.AnalyticsService, *app.FakeClock) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		_, err := service.Dimensions().Replace("shop", dimensions, 0)
+		assert.NoError(t, err)
+		return service, clock
+	}
+	track := func(service *app.AnalyticsService, eventType, userID string, properties map[string]interface{}) error {
+		_, err := service.TrackEvent(ctx, map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+			"properties": properties,
+		}, "test-key", userID)
+		return err
+	}
+
+	t.Run("RejectsInvalidDimensions", func(t *testing.T) {
+		registry := app.NewDimensionRegistry()
+		for _, invalid := range [][]app.CustomDimension{
+			{{Name: "Plan", Property: "plan", Type: app.DimensionString}},
+			{{Name: "plan", Property: "plan", Type: "date"}},
+			{{Name: "plan", Property: "plan", Type: app.DimensionEnum}},
+			{{Name: "plan", Property: "plan", Type: app.DimensionString}, {Name: "tier", Property: "plan", Type: app.DimensionString}},
+		} {
+			_, err := registry.Replace("shop", invalid, 0)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("ValidatesAndIndexesValues", func(t *testing.T) {
+		service, _ := setup()
+
+		assert.NoError(t, track(service, "sign_up", "user1", map[string]interface{}{"plan_name": "pro", "seats": 5.0, "is_trial": true}))
+		assert.NoError(t, track(service, "sign_up", "user2", map[string]interface{}{"plan_name": "pro"}))
+		assert.NoError(t, track(service, "sign_up", "user3", map[string]interface{}{"plan_name": "free", "other": 1.0}))
+		assert.Error(t, track(service, "sign_up", "user4", map[string]interface{}{"plan_name": "gold"}))
+		assert.Error(t, track(service, "sign_up", "user4", map[string]interface{}{"seats": "five"}))
+		assert.Error(t, track(service, "sign_up", "user4", map[string]interface{}{"is_trial": "yes"}))
+		assert.Equal(t, int64(3), service.EventCount())
+
+		other := app.ContextWithProject(context.Background(), "other")
+		_, err := service.TrackEvent(other, map[string]interface{}{
+			"event_type": "sign_up",
+			"user_id":    "user5",
+			"properties": map[string]interface{}{"plan_name": "gold"},
+		}, "test-key", "user5")
+		assert.NoError(t, err, "Dimensions should only apply to their project")
+
+		values, err := service.Dimensions().Values("shop", "plan")
+		assert.NoError(t, err)
+		assert.Equal(t, []app.DimensionValue{{Value: "pro", Events: 2}, {Value: "free", Events: 1}}, values)
+		values, err = service.Dimensions().Values("shop", "seats")
+		assert.NoError(t, err)
+		assert.Equal(t, []app.DimensionValue{{Value: "5", Events: 1}}, values)
+		_, err = service.Dimensions().Values("shop", "missing")
+		assert.Error(t, err)
+	})
+
+	t.Run("Breakdowns", func(t *testing.T) {
+		service, clock := setup()
+		assert.NoError(t, track(service, "view_pricing", "user1", map[string]interface{}{"plan_name": "pro"}))
+		assert.NoError(t, track(service, "view_pricing", "user2", map[string]interface{}{"plan_name": "pro"}))
+		assert.NoError(t, track(service, "view_pricing", "user3", map[string]interface{}{"plan_name": "free"}))
+		assert.NoError(t, track(service, "view_pricing", "user4", nil))
+		clock.Advance(time.Minute)
+		assert.NoError(t, track(service, "purchase", "user1", nil))
+		assert.NoError(t, track(service, "purchase", "user3", nil))
+
+		trend, err := app.NewQueryService(service).ComputeTrend(ctx, app.TrendQuery{
+			EventType: "view_pricing",
+			Interval:  "day",
+			Start:     start.Add(-time.Hour),
+			End:       start.Add(time.Hour),
+			Breakdown: "plan",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(trend.Breakdown))
+		assert.Equal(t, "pro", trend.Breakdown[0].Value)
+		assert.Equal(t, int64(2), trend.Breakdown[0].TotalEvents)
+		assert.Equal(t, app.NoDimensionValue, trend.Breakdown[1].Value, "Events without the property should be grouped together")
+
+		funnels := app.NewFunnelService(service)
+		funnel, err := funnels.CreateFunnel(ctx, "Purchase", "", []app.Step{
+			{ID: "view", Name: "View pricing", EventType: "view_pricing", Order: 1},
+			{ID: "purchase", Name: "Purchase", EventType: "purchase", Order: 2},
+		})
+		assert.NoError(t, err)
+		result, err := funnels.ComputeFunnel(ctx, app.FunnelQuery{
+			FunnelID:  funnel.ID,
+			Start:     start.Add(-time.Hour),
+			End:       start.Add(time.Hour),
+			Breakdown: "plan",
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, len(result.Breakdown))
+		pro := result.Breakdown[0]
+		assert.Equal(t, "pro", pro.Value)
+		assert.Equal(t, int64(2), pro.TotalUsers)
+		assert.Equal(t, int64(1), pro.Steps[1].UniqueUsers)
+		assert.Equal(t, 50.0, pro.ConversionRate)
+
+		usage, err := service.GetUsageBreakdown(ctx, "user1", "2024-03-01", "2024-03-01", "plan")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), usage.TotalEvents)
+		assert.Equal(t, 2, len(usage.Breakdown))
+
+		_, err = funnels.ComputeFunnel(ctx, app.FunnelQuery{FunnelID: funnel.ID, Start: start, End: start.Add(time.Hour), Breakdown: "missing"})
+		assert.Error(t, err, "Only registered dimensions can break down results")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, body, ifMatch string) (int, http.Header, string) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "shop")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp.StatusCode, resp.Header, string(content)
+		}
+
+		status, header, _ := send("PUT", "/api/v1/projects/shop/dimensions", `{"dimensions":[{"name":"plan","property":"plan_name","type":"enum","values":["free","pro"]}]}`, "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, `"1"`, header.Get("ETag"))
+		status, _, _ = send("PUT", "/api/v1/projects/shop/dimensions", `{"dimensions":[]}`, "")
+		assert.Equal(t, 428, status, "Replacing existing dimensions should require If-Match")
+
+		status, _, _ = send("POST", "/api/v1/analytics/events", `{"event_type":"sign_up","user_id":"user1","properties":{"plan_name":"pro"}}`, "")
+		assert.Equal(t, 200, status)
+		status, _, _ = send("POST", "/api/v1/analytics/events", `{"event_type":"sign_up","user_id":"user1","properties":{"plan_name":"gold"}}`, "")
+		assert.Equal(t, 400, status)
+
+		status, _, content := send("GET", "/api/v1/projects/shop/dimensions/plan/values", "", "")
+		assert.Equal(t, 200, status)
+		assert.Contains(t, content, `"value":"pro"`)
+
+		status, _, content = send("GET", "/api/v1/trends?event_type=sign_up&breakdown=plan", "", "")
+		assert.Equal(t, 200, status)
+		var body struct {
+			Result app.TrendResult `json:"result"`
+		}
+		assert.NoError(t, json.Unmarshal([]byte(content), &body))
+		assert.Equal(t, "pro", body.Result.Breakdown[0].Value)
+
+		status, _, _ = send("GET", "/api/v1/trends?event_type=sign_up&breakdown=missing", "", "")
+		assert.Equal(t, 400, status)
+		_, _, content = send("GET", "/api/v1/analytics/usage?user_id=user1&breakdown=plan", "", "")
+		assert.Contains(t, content, `"breakdown"`)
+	})
+}
@@ -0,0 +1,208 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestDailyRollups tests the daily rollups behind the pages, devices, countries, campaigns and trends reports
+func TestDailyRollups(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// track stores the events of the "web" project over two days
+	track := func(t *testing.T, service *app.AnalyticsService) {
+		clock := app.NewFakeClock(day.Add(10 * time.Hour))
+		service.SetClock(clock)
+		ctx := app.ContextWithProject(context.Background(), "web")
+		send := func(eventType, userID, page string, properties map[string]interface{}) {
+			clock.Advance(time.Minute)
+			_, err := service.TrackEvent(ctx, map[string]interface{}{
+				"event_type": eventType,
+				"user_id":    userID,
+				"page":       page,
+				"properties": properties,
+			}, "test-key", userID)
+			assert.NoError(t, err)
+		}
+
+		send("page_view", "user1", "/home", map[string]interface{}{"device": "mobile", "country": "DE", "utm_campaign": "spring"})
+		send("page_view", "user1", "/home", map[string]interface{}{"device": "mobile", "country": "DE", "utm_campaign": "spring"})
+		send("page_view", "user2", "/home", map[string]interface{}{"device": "desktop", "country": "FR"})
+		send("page_view", "user2", "/pricing", map[string]interface{}{"device": "desktop", "country": "FR"})
+		send("signup", "user2", "/pricing", map[string]interface{}{"device": "desktop", "country": "FR"})
+		clock.Advance(24 * time.Hour)
+		send("page_view", "user3", "/home", map[string]interface{}{"platform": "tablet", "country": "DE", "utm_campaign": "spring"})
+	}
+
+	t.Run("Breakdowns", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		track(t, service)
+
+		report, err := service.Rollups().Query(app.RollupQuery{
+			ProjectID: "web",
+			Dimension: app.RollupPage,
+			EventType: "page_view",
+			Start:     day,
+			End:       day.Add(48 * time.Hour),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []app.RollupGroup{
+			{Value: "/home", Events: 4, UniqueUsers: 3},
+			{Value: "/pricing", Events: 1, UniqueUsers: 1},
+		}, report.Groups)
+		assert.Equal(t, int64(5), report.TotalEvents)
+		assert.Equal(t, int64(3), report.UniqueUsers)
+
+		report, err = service.Rollups().Query(app.RollupQuery{
+			ProjectID: "web",
+			Dimension: app.RollupCampaign,
+			Start:     day,
+			End:       day.Add(24 * time.Hour),
+			Filters:   map[string]string{app.RollupCountry: "DE"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []app.RollupGroup{{Value: "spring", Events: 2, UniqueUsers: 1}}, report.Groups, "Only the events of the filtered days and dimensions should be counted")
+
+		report, err = service.Rollups().Query(app.RollupQuery{
+			ProjectID: "web",
+			Dimension: app.RollupDevice,
+			Start:     day,
+			End:       day.Add(48 * time.Hour),
+			Limit:     2,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "desktop", report.Groups[0].Value)
+		assert.Equal(t, 2, len(report.Groups))
+		assert.Equal(t, 3, report.TotalGroups)
+
+		_, err = service.Rollups().Query(app.RollupQuery{ProjectID: "web", Dimension: "browser", Start: day, End: day.Add(time.Hour)})
+		assert.Error(t, err)
+		_, err = service.Rollups().Query(app.RollupQuery{ProjectID: "web", Dimension: app.RollupPage, Start: day, End: day})
+		assert.Error(t, err)
+	})
+
+	t.Run("Trends", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		track(t, service)
+		queryService := app.NewQueryService(service)
+		ctx := app.ContextWithProject(context.Background(), "web")
+
+		result, err := queryService.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "day", Start: day, End: day.Add(48 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "rollups", result.Source, "Daily trends over whole days should be served from the rollups")
+		assert.Equal(t, []app.TrendPoint{
+			{Timestamp: day, Count: 4, UniqueUsers: 2, Hourly: &app.HourlyStats{Min: 0, Max: 4, Avg: 4.0 / 24}},
+			{Timestamp: day.Add(24 * time.Hour), Count: 1, UniqueUsers: 1, Hourly: &app.HourlyStats{Min: 0, Max: 1, Avg: 1.0 / 24}},
+		}, result.Points)
+		assert.Equal(t, int64(5), result.TotalEvents)
+
+		scanned, err := queryService.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "hour", Start: day, End: day.Add(48 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "events", scanned.Source, "Hourly trends should scan the events")
+		assert.Equal(t, result.TotalEvents, scanned.TotalEvents)
+
+		// Aliases added after the events were rolled up apply to them too
+		_, err = service.Aliases().Replace("web", map[string]string{"signup": "registration"}, nil, 0)
+		assert.NoError(t, err)
+		result, err = queryService.ComputeTrend(ctx, app.TrendQuery{EventType: "registration", Interval: "week", Start: day, End: day.Add(48 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "rollups", result.Source)
+		assert.Equal(t, int64(1), result.TotalEvents)
+	})
+
+	t.Run("Rebuild", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		track(t, service)
+
+		devices := func() map[string]int64 {
+			report, err := service.Rollups().Query(app.RollupQuery{ProjectID: "web", Dimension: app.RollupDevice, Start: day, End: day.Add(48 * time.Hour)})
+			assert.NoError(t, err)
+			counts := make(map[string]int64)
+			for _, group := range report.Groups {
+				counts[group.Value] = group.Events
+			}
+			return counts
+		}
+		assert.Equal(t, int64(1), devices()["unknown"])
+
+		// Renaming a property only applies to rollups once they are rebuilt
+		_, err := service.Aliases().Replace("web", nil, map[string]string{"platform": "device"}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), devices()["unknown"])
+
+		result := service.RebuildRollups("web", day.Add(24*time.Hour), time.Time{})
+		assert.Equal(t, 1, result.Days, "Only the days in the range should be rebuilt")
+		assert.Equal(t, int64(1), result.Events)
+		assert.Equal(t, map[string]int64{"mobile": 2, "desktop": 3, "tablet": 1}, devices())
+
+		result = service.RebuildRollups("", time.Time{}, time.Time{})
+		assert.Equal(t, 2, result.Days)
+		assert.Equal(t, int64(6), result.Events)
+		assert.Equal(t, map[string]int64{"mobile": 2, "desktop": 3, "tablet": 1}, devices(), "Rebuilding should not count events twice")
+		assert.Equal(t, result, service.Rollups().LastRebuild())
+		assert.Equal(t, app.RollupStats{Projects: 1, Days: 2, Rows: 5}, service.Rollups().Stats())
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		track(t, application.GetAnalyticsService())
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+
+		send := func(method, path, token, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("X-Project-ID", "web")
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("X-Admin-Token", token)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+
+		status, body := send("GET", "/api/v1/pages?start_date=2024-03-01&end_date=2024-03-03&device=desktop", "", "")
+		assert.Equal(t, 200, status)
+		report := body["report"].(map[string]interface{})
+		assert.Equal(t, float64(3), report["total_events"])
+		assert.Equal(t, 2, len(report["groups"].([]interface{})))
+
+		for _, path := range []string{"/api/v1/devices", "/api/v1/countries", "/api/v1/campaigns"} {
+			status, body = send("GET", path+"?start_date=2024-03-01&end_date=2024-03-03", "", "")
+			assert.Equal(t, 200, status, path)
+			assert.Equal(t, float64(6), body["report"].(map[string]interface{})["total_events"], path)
+		}
+		status, _ = send("GET", "/api/v1/pages?start_date=yesterday", "", "")
+		assert.Equal(t, 400, status)
+
+		status, body = send("GET", "/api/v1/trends?event_type=page_view&start_date=2024-03-01&end_date=2024-03-03", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "rollups", body["result"].(map[string]interface{})["source"])
+
+		status, _ = send("POST", "/api/v1/admin/rollups/rebuild", "viewer-token", `{"project_id":"web"}`)
+		assert.Equal(t, 403, status)
+		status, _ = send("POST", "/api/v1/admin/rollups/rebuild", "operator-token", `{"start_date":"March"}`)
+		assert.Equal(t, 400, status)
+		status, body = send("POST", "/api/v1/admin/rollups/rebuild", "operator-token", `{"project_id":"web","start_date":"2024-03-01","end_date":"2024-03-02"}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(5), body["rebuild"].(map[string]interface{})["events"])
+
+		status, body = send("GET", "/api/v1/admin/rollups", "viewer-token", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(2), body["stats"].(map[string]interface{})["days"])
+		assert.NotNil(t, body["last_rebuild"])
+		assert.Equal(t, 1, len(application.GetAuditLog().Entries("rollups.rebuild", 10)))
+	})
+}
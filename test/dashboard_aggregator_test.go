@@ -0,0 +1,98 @@
+package test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestMetricAggregator tests the rolling counters live dashboard metrics are computed from
+func TestMetricAggregator(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 30, 0, time.UTC)
+
+	setup := func() (*app.MetricAggregator, *app.FakeClock) {
+		aggregator := app.NewMetricAggregator()
+		clock := app.NewFakeClock(start)
+		aggregator.SetClock(clock)
+		return aggregator, clock
+	}
+	event := func(projectID, eventType, userID, page string, at time.Time) *app.AnalyticsEvent {
+		return &app.AnalyticsEvent{ProjectID: projectID, EventType: eventType, UserID: userID, Page: page, Timestamp: at}
+	}
+
+	t.Run("Windows", func(t *testing.T) {
+		aggregator, clock := setup()
+		aggregator.Record(event("web", "page_view", "user1", "/", start.Add(-10*time.Minute)))
+		aggregator.Record(event("web", "page_view", "user1", "/pricing", start.Add(-2*time.Minute)))
+		aggregator.Record(event("web", "page_view", "user2", "/pricing", start))
+		aggregator.Record(event("web", "purchase", "user2", "", start))
+		aggregator.Record(event("web", "page_view", "user3", "/", start.Add(-2*time.Hour)))
+		aggregator.Record(event("shop", "page_view", "user4", "/", start))
+
+		assert.Equal(t, int64(2), aggregator.Value("web", app.DashboardTotalEvents, time.Minute))
+		assert.Equal(t, int64(3), aggregator.Value("web", app.DashboardTotalEvents, 5*time.Minute))
+		assert.Equal(t, int64(4), aggregator.Value("web", app.DashboardTotalEvents, time.Hour), "Events older than an hour should not count")
+		assert.Equal(t, 0.6, aggregator.Value("web", app.DashboardEventsPerMinute, 5*time.Minute))
+		assert.Equal(t, 1, aggregator.Value("web", app.DashboardActiveUsers, time.Minute))
+		assert.Equal(t, 2, aggregator.Value("web", app.DashboardActiveUsers, 15*time.Minute))
+		assert.Equal(t, 0.5, aggregator.Value("web", app.DashboardConversionRate, 15*time.Minute))
+		assert.Equal(t, []app.DashboardPageViews{{Page: "/pricing", Views: 2}, {Page: "/", Views: 1}}, aggregator.Value("web", app.DashboardTopPages, time.Hour))
+		assert.Equal(t, "N/A", aggregator.Value("web", "unknown", time.Minute))
+
+		clock.Advance(time.Hour)
+		assert.Equal(t, int64(0), aggregator.Value("web", app.DashboardTotalEvents, time.Hour), "Counters should roll over")
+		assert.Equal(t, 0.0, aggregator.Value("web", app.DashboardConversionRate, time.Hour))
+		assert.Empty(t, aggregator.Value("web", app.DashboardTopPages, time.Hour))
+		assert.Equal(t, int64(0), aggregator.Value("missing", app.DashboardTotalEvents, time.Hour))
+	})
+
+	t.Run("ServiceEvents", func(t *testing.T) {
+		aggregator, _ := setup()
+		aggregator.RecordServiceEvent(&app.CrossServiceEvent{Source: "billing", EventType: "purchase", UserID: "user1", Timestamp: start})
+		aggregator.RecordServiceEvent(&app.CrossServiceEvent{Source: "auth", EventType: "user.login", UserID: "user2"})
+
+		assert.Equal(t, int64(2), aggregator.Value(app.DefaultProjectID, app.DashboardTotalEvents, time.Minute), "Service events should count in the default project")
+		assert.Equal(t, 0.5, aggregator.Value("", app.DashboardConversionRate, time.Minute))
+
+		var missing *app.MetricAggregator
+		missing.RecordServiceEvent(&app.CrossServiceEvent{EventType: "user.login"})
+	})
+
+	t.Run("Feed", func(t *testing.T) {
+		application, feedURL := startDashboardServer(t)
+		for _, userID := range []string{"user1", "user2", "user1"} {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"page_view","user_id":"`+userID+`","page":"/live"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-Project-ID", "live")
+			req.Header.Set("X-User-ID", userID)
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+		}
+
+		conn, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=live", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.Eventually(t, func() bool {
+			assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "metric": "total_events"}))
+			return readUntil(t, conn, "total_events", 2*time.Second)["value"] == 3.0
+		}, 2*time.Second, 50*time.Millisecond, "Tracked events should be counted")
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "metric": "active_users", "interval": "1s"}))
+		readUntil(t, conn, "subscribed", 2*time.Second)
+		assert.Equal(t, 2.0, readUntil(t, conn, "active_users", 2*time.Second)["value"])
+		assert.Equal(t, 2.0, readUntil(t, conn, "active_users", 3*time.Second)["value"], "Values should be pushed on the interval")
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "metric": "top_pages"}))
+		pages := readUntil(t, conn, "top_pages", 2*time.Second)["value"].([]interface{})
+		assert.Equal(t, map[string]interface{}{"page": "/live", "views": 3.0}, pages[0])
+	})
+}
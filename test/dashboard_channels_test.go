@@ -0,0 +1,151 @@
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// readEvents reads the next events from the connection, skipping other messages
+func readEvents(t *testing.T, conn *websocket.Conn, count int) []map[string]interface{} {
+	deadline := time.Now().Add(3 * time.Second)
+	var events []map[string]interface{}
+	for len(events) < count {
+		var msg map[string]interface{}
+		conn.SetReadDeadline(deadline)
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Did not receive %d events: %v", count, err)
+		}
+		if _, isEvent := msg["event_type"]; isEvent {
+			events = append(events, msg)
+		}
+	}
+	return events
+}
+
+// TestDashboardChannels tests filtering the dashboard feed by channel and per-client send queues
+func TestDashboardChannels(t *testing.T) {
+	t.Setenv("DASHBOARD_MAX_CHANNELS", "4")
+	application, feedURL := startDashboardServer(t)
+	dashboard := application.GetDashboardService()
+	application.GetUserProfiles().Apply(&app.CrossServiceEvent{EventType: "billing.user.subscription.created", UserID: "subscriber", Timestamp: time.Now()}, false)
+
+	broadcast := func(eventType, page, userID string) {
+		dashboard.BroadcastEvent(&app.AnalyticsEvent{ProjectID: "channels", EventType: eventType, Page: page, UserID: userID})
+	}
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=channels", nil)
+		assert.NoError(t, err)
+		return conn
+	}
+	subscribe := func(conn *websocket.Conn, msgType string, channels ...string) map[string]interface{} {
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": msgType, "channels": channels}))
+		if msgType == "subscribe" {
+			return readUntil(t, conn, "subscribed", 2*time.Second)
+		}
+		return readUntil(t, conn, "unsubscribed", 2*time.Second)
+	}
+
+	t.Run("Filters", func(t *testing.T) {
+		filtered, unfiltered := dial(), dial()
+		defer filtered.Close()
+		defer unfiltered.Close()
+
+		ack := subscribe(filtered, "subscribe", "event_type:purchase", "page:/pricing", "segment:subscribed", "page:/pricing")
+		assert.Equal(t, []interface{}{"event_type:purchase", "page:/pricing", "segment:subscribed"}, ack["channels"])
+
+		broadcast("click", "/home", "visitor")
+		broadcast("purchase", "/checkout", "visitor")
+		broadcast("page_view", "/pricing", "visitor")
+		broadcast("click", "/home", "subscriber")
+		dashboard.BroadcastMetric(app.DashboardMetric{ProjectID: "channels", Type: "heatmap.updated", Value: 1})
+		broadcast("purchase", "/checkout", "last")
+
+		events := readEvents(t, filtered, 4)
+		assert.Equal(t, "purchase", events[0]["event_type"])
+		assert.Equal(t, "page_view", events[1]["event_type"])
+		assert.Equal(t, "subscriber", events[2]["user_id"], "Events of users in the segment should be received")
+		assert.Equal(t, "last", events[3]["user_id"], "Events of no channel should not be received")
+
+		events = readEvents(t, unfiltered, 1)
+		assert.Equal(t, "click", events[0]["event_type"], "Clients without channels should receive every broadcast")
+		readUntil(t, unfiltered, "heatmap.updated", 2*time.Second)
+
+		ack = subscribe(filtered, "unsubscribe", "event_type:purchase", "page:/pricing", "segment:subscribed")
+		assert.Empty(t, ack["channels"])
+		broadcast("click", "/home", "visitor")
+		events = readEvents(t, filtered, 1)
+		assert.Equal(t, "visitor", events[0]["user_id"], "Clients without channels left should receive every broadcast again")
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+
+		subscribe(conn, "subscribe", "metric:heatmap.updated")
+		broadcast("purchase", "/checkout", "visitor")
+		dashboard.BroadcastMetric(app.DashboardMetric{ProjectID: "channels", Type: "funnel:checkout:conversion_rate", Value: 0.5})
+		dashboard.BroadcastMetric(app.DashboardMetric{ProjectID: "channels", Type: "heatmap.updated", Value: 2})
+
+		var msg map[string]interface{}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		assert.NoError(t, conn.ReadJSON(&msg))
+		assert.Equal(t, "heatmap.updated", msg["type"], "Only the subscribed metric should be received")
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+
+		subscribe(conn, "subscribe", "event_type:signup")
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "resume", "from_seq": 1}))
+		result := readUntil(t, conn, "resume.complete", 2*time.Second)
+		assert.Equal(t, float64(0), result["replayed"], "Only messages of the client's channels should be replayed")
+
+		broadcast("signup", "/register", "visitor")
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "resume", "from_seq": 1}))
+		result = readUntil(t, conn, "resume.complete", 2*time.Second)
+		assert.Equal(t, float64(1), result["replayed"])
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		conn := dial()
+		defer conn.Close()
+
+		for _, channels := range [][]string{{"purchase"}, {"user:someone"}, {"page:"}, {"segment:vip"}, {}} {
+			assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "channels": channels}))
+			readUntil(t, conn, "error", 2*time.Second)
+		}
+
+		subscribe(conn, "subscribe", "page:/a", "page:/b", "page:/c")
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "channels": []string{"page:/d", "page:/e"}}))
+		msg := readUntil(t, conn, "error", 2*time.Second)
+		assert.Contains(t, msg["error"], "too many channels")
+		ack := subscribe(conn, "subscribe", "page:/d")
+		assert.Len(t, ack["channels"], 4, "Rejected subscriptions should add no channel")
+	})
+}
+
+// TestDashboardSlowClients tests that clients not keeping up with the feed are disconnected
+func TestDashboardSlowClients(t *testing.T) {
+	t.Setenv("DASHBOARD_CLIENT_QUEUE_SIZE", "4")
+	application, feedURL := startDashboardServer(t)
+	dashboard := application.GetDashboardService()
+
+	slow, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=slow", nil)
+	assert.NoError(t, err)
+	defer slow.Close()
+	assert.Eventually(t, func() bool { return dashboard.GetConnectedClientsCount() == 1 }, 2*time.Second, 10*time.Millisecond)
+
+	// The slow client reads nothing until the connection buffers and its queue are full
+	payload := strings.Repeat("x", 64*1024)
+	for i := 0; i < 400 && dashboard.GetConnectedClientsCount() > 0; i++ {
+		dashboard.BroadcastEvent(&app.AnalyticsEvent{ProjectID: "slow", EventType: "page_view", Properties: map[string]interface{}{"payload": payload}})
+	}
+	assert.Eventually(t, func() bool { return dashboard.GetConnectedClientsCount() == 0 }, 5*time.Second, 10*time.Millisecond, "Slow clients should be disconnected")
+}
@@ -0,0 +1,100 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestDashboardDerivedMetrics tests subscribing dashboards to metrics of funnels and segments,
+// recomputed on a cadence and pushed to the live feed
+func TestDashboardDerivedMetrics(t *testing.T) {
+	t.Setenv("DASHBOARD_DERIVED_METRIC_CADENCE", "1h")
+	application, feedURL := startDashboardServer(t)
+	defer application.Stop()
+
+	ctx := app.ContextWithProject(context.Background(), "derived")
+	segment, err := application.GetSavedQueryService().CreateQuery(ctx, "Buyers", "", app.SavedQuerySegment, map[string]interface{}{"event_type": "purchase"})
+	assert.NoError(t, err)
+	trend, err := application.GetSavedQueryService().CreateQuery(ctx, "Purchases", "", app.SavedQueryTrend, map[string]interface{}{"event_type": "purchase"})
+	assert.NoError(t, err)
+	funnel, err := application.GetFunnelService().CreateFunnel(ctx, "Checkout", "", []app.Step{
+		{ID: "cart", Name: "Cart", EventType: "add_to_cart", Order: 1},
+		{ID: "purchase", Name: "Purchase", EventType: "purchase", Order: 2},
+	})
+	assert.NoError(t, err)
+
+	purchase := func(userID string) {
+		_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{"event_type": "purchase", "user_id": userID}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	purchase("user1")
+	purchase("user2")
+	purchase("user2")
+
+	conn, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=derived", nil)
+	assert.NoError(t, err)
+	subscribe := func(metric string) {
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "metric": metric, "granularity": "1h"}))
+	}
+
+	t.Run("RejectsUnknownMetrics", func(t *testing.T) {
+		for _, metric := range []string{
+			"segment:missing:active_users",
+			"segment:" + segment.ID + ":revenue",
+			"segment:" + trend.ID + ":active_users",
+			"funnel::conversion_rate",
+		} {
+			subscribe(metric)
+			msg := readUntil(t, conn, "error", 2*time.Second)
+			assert.Equal(t, metric, msg["metric"])
+		}
+
+		// Other projects' funnels are not found
+		other, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=other", nil)
+		assert.NoError(t, err)
+		defer other.Close()
+		assert.NoError(t, other.WriteJSON(map[string]interface{}{"type": "subscribe", "metric": "funnel:" + funnel.ID + ":conversion_rate"}))
+		readUntil(t, other, "error", 2*time.Second)
+	})
+
+	activeUsers := "segment:" + segment.ID + ":active_users"
+	t.Run("SendsCurrentValue", func(t *testing.T) {
+		subscribe(activeUsers)
+		msg := readUntil(t, conn, activeUsers, 2*time.Second)
+		assert.Equal(t, float64(2), msg["value"])
+
+		subscribe("segment:" + segment.ID + ":event_count")
+		msg = readUntil(t, conn, "segment:"+segment.ID+":event_count", 2*time.Second)
+		assert.Equal(t, float64(3), msg["value"])
+
+		subscribe("funnel:" + funnel.ID + ":conversion_rate")
+		msg = readUntil(t, conn, "funnel:"+funnel.ID+":conversion_rate", 2*time.Second)
+		assert.IsType(t, float64(0), msg["value"])
+	})
+
+	t.Run("PushesChangedValues", func(t *testing.T) {
+		purchase("user3")
+		assert.GreaterOrEqual(t, application.GetDerivedMetrics().Run(time.Now()), 2, "Changed segment metrics should be pushed")
+
+		msg := readUntil(t, conn, activeUsers, 2*time.Second)
+		assert.Equal(t, float64(3), msg["value"])
+		assert.NotZero(t, msg["seq"], "Pushed values should be resumable from the feed history")
+		assert.Equal(t, "derived", msg["metadata"].(map[string]interface{})["source"])
+	})
+
+	t.Run("ForgetsMetricsWithoutDashboards", func(t *testing.T) {
+		assert.NoError(t, conn.Close())
+		assert.Eventually(t, func() bool {
+			return application.GetDashboardService().GetConnectedClientsCount() == 0
+		}, 2*time.Second, 10*time.Millisecond)
+
+		purchase("user4")
+		assert.Equal(t, 0, application.GetDerivedMetrics().Run(time.Now()), "Metrics of projects without dashboards should not be recomputed")
+	})
+}
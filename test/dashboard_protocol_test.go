@@ -0,0 +1,141 @@
+package test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// readBinaryUntil reads MessagePack messages from the connection until one with the given type arrives
+func readBinaryUntil(t *testing.T, conn *websocket.Conn, msgType string, timeout time.Duration) map[string]interface{} {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Did not receive %s message: %v", msgType, err)
+		}
+		assert.Equal(t, websocket.BinaryMessage, messageType)
+		value, err := app.DecodeMsgpack(data)
+		assert.NoError(t, err)
+		if msg, ok := value.(map[string]interface{}); ok && msg["type"] == msgType {
+			return msg
+		}
+	}
+}
+
+// TestDashboardProtocol tests the MessagePack encoding and compression of dashboard feeds
+func TestDashboardProtocol(t *testing.T) {
+	t.Run("Msgpack", func(t *testing.T) {
+		packed, err := app.MsgpackFromJSON([]byte(`{"b":true,"a":1}`))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0xc3}, packed, "Keys should be sorted")
+
+		entries := make(map[string]interface{})
+		for i := 0; i < 20; i++ {
+			entries[strings.Repeat("k", i+1)] = i
+		}
+		document, err := json.Marshal(map[string]interface{}{
+			"integers": []interface{}{0, 127, 128, -1, -33, -200, 70000, -70000, int64(1) << 40, -(int64(1) << 40)},
+			"floats":   []interface{}{1.5, -0.25, 1e300},
+			"strings":  []interface{}{"", "short", strings.Repeat("x", 40), strings.Repeat("y", 300), "żółw"},
+			"nested":   []interface{}{nil, false, map[string]interface{}{"list": make([]interface{}, 20)}},
+			"entries":  entries,
+		})
+		assert.NoError(t, err)
+		packed, err = app.MsgpackFromJSON(document)
+		assert.NoError(t, err)
+		assert.Less(t, len(packed), len(document))
+
+		var expected interface{}
+		assert.NoError(t, json.Unmarshal(document, &expected))
+		decoded, err := app.DecodeMsgpack(packed)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, decoded, "Decoding should give the values of the JSON document")
+	})
+
+	t.Run("InvalidMsgpack", func(t *testing.T) {
+		for _, data := range [][]byte{
+			{},
+			{0x82, 0xa1, 'a'},              // Truncated
+			{0x01, 0x02},                   // Trailing data
+			{0x81, 0x01, 0x02},             // Integer key
+			{0xd4, 0x01, 0x02},             // Extension
+			{0xdd, 0xff, 0xff, 0xff, 0xff}, // Length beyond the message
+		} {
+			_, err := app.DecodeMsgpack(data)
+			assert.Error(t, err, "% x should be rejected", data)
+		}
+		_, err := app.DecodeMsgpack([]byte(strings.Repeat("\x91", 40) + "\xc0"))
+		assert.Error(t, err, "Deep nesting should be rejected")
+	})
+
+	t.Run("BinaryFeed", func(t *testing.T) {
+		application, feedURL := startDashboardServer(t)
+		dialer := websocket.Dialer{Subprotocols: []string{app.DashboardProtocolMsgpack}}
+		conn, resp, err := dialer.Dial(feedURL+"?project_id=binary", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, app.DashboardProtocolMsgpack, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+		ping, err := app.MsgpackFromJSON([]byte(`{"type":"ping"}`))
+		assert.NoError(t, err)
+		assert.NoError(t, conn.WriteMessage(websocket.BinaryMessage, ping))
+		readBinaryUntil(t, conn, "pong", 2*time.Second)
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "ping"}), "JSON messages should still be understood")
+		readBinaryUntil(t, conn, "pong", 2*time.Second)
+
+		application.GetDashboardService().BroadcastMetric(app.DashboardMetric{ProjectID: "binary", Type: "total_events", Value: 42})
+		metric := readBinaryUntil(t, conn, "total_events", 2*time.Second)
+		assert.Equal(t, 42.0, metric["value"])
+		assert.Equal(t, 1.0, metric["seq"])
+	})
+
+	t.Run("JSONFeed", func(t *testing.T) {
+		_, feedURL := startDashboardServer(t)
+		conn, resp, err := websocket.DefaultDialer.Dial(feedURL, nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+		assert.Empty(t, resp.Header.Get("Sec-WebSocket-Protocol"))
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "ping"}))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		messageType, data, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, websocket.TextMessage, messageType)
+		assert.JSONEq(t, `{"type":"pong"}`, string(data))
+	})
+
+	t.Run("Compression", func(t *testing.T) {
+		application, feedURL := startDashboardServer(t)
+		dialer := websocket.Dialer{EnableCompression: true}
+		conn, resp, err := dialer.Dial(feedURL+"?project_id=compressed", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+		assert.Contains(t, resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+
+		// Large messages are compressed and small ones are not; both arrive intact
+		large := strings.Repeat("page_view ", 200)
+		application.GetDashboardService().BroadcastMetric(app.DashboardMetric{ProjectID: "compressed", Type: "total_events", Value: large})
+		metric := readUntil(t, conn, "total_events", 2*time.Second)
+		assert.Equal(t, large, metric["value"])
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "ping"}))
+		readUntil(t, conn, "pong", 2*time.Second)
+	})
+
+	t.Run("CompressionDisabled", func(t *testing.T) {
+		t.Setenv("DASHBOARD_COMPRESSION", "false")
+		_, feedURL := startDashboardServer(t)
+		dialer := websocket.Dialer{EnableCompression: true}
+		conn, resp, err := dialer.Dial(feedURL, nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+		assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+	})
+}
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestDashboardReplay tests the per-project history kept for reconnecting dashboard clients
+func TestDashboardReplay(t *testing.T) {
+	t.Run("SequencesPerProject", func(t *testing.T) {
+		service := app.NewDashboardService()
+		service.Start()
+
+		service.BroadcastMetric(app.DashboardMetric{ProjectID: "p1", Type: "total_events", Value: 1})
+		service.BroadcastMetric(app.DashboardMetric{ProjectID: "p1", Type: "total_events", Value: 2})
+		service.BroadcastMetric(app.DashboardMetric{ProjectID: "p2", Type: "total_events", Value: 3})
+
+		assert.Eventually(t, func() bool {
+			_, result := service.Replay("p2", 0)
+			return result.LatestSeq == 1
+		}, time.Second, 10*time.Millisecond)
+
+		messages, result := service.Replay("p1", 2)
+		assert.Equal(t, 1, len(messages))
+		assert.Equal(t, uint64(2), result.LatestSeq)
+		assert.False(t, result.Truncated)
+
+		var metric app.DashboardMetric
+		assert.NoError(t, json.Unmarshal(messages[0], &metric))
+		assert.Equal(t, uint64(2), metric.Seq)
+		assert.Equal(t, "p1", metric.ProjectID)
+	})
+
+	t.Run("UnknownProjectHasNoHistory", func(t *testing.T) {
+		service := app.NewDashboardService()
+		messages, result := service.Replay("missing", 1)
+		assert.Empty(t, messages)
+		assert.Equal(t, uint64(0), result.LatestSeq)
+	})
+
+	t.Run("ResumeOverWebSocket", func(t *testing.T) {
+		application, feedURL := startDashboardServer(t)
+
+		dashboard := application.GetDashboardService()
+		for i := 1; i <= 3; i++ {
+			dashboard.BroadcastMetric(app.DashboardMetric{ProjectID: "acme", Type: "total_events", Value: i})
+		}
+		assert.Eventually(t, func() bool {
+			_, result := dashboard.Replay("acme", 0)
+			return result.LatestSeq == 3
+		}, time.Second, 10*time.Millisecond)
+
+		conn, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=acme", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "resume", "from_seq": 2}))
+
+		var seqs []uint64
+		for {
+			var msg map[string]interface{}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			assert.NoError(t, conn.ReadJSON(&msg))
+			if msg["type"] == "resume.complete" {
+				assert.Equal(t, float64(2), msg["replayed"])
+				break
+			}
+			seqs = append(seqs, uint64(msg["seq"].(float64)))
+		}
+		assert.Equal(t, []uint64{2, 3}, seqs)
+	})
+}
@@ -0,0 +1,98 @@
+package test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// startDashboardServer serves the application on a random port and returns it with the feed URL
+func startDashboardServer(t *testing.T) (*app.App, string) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go application.GetFiberApp().Listener(listener)
+	t.Cleanup(func() {
+		application.GetFiberApp().Shutdown()
+	})
+
+	return application, fmt.Sprintf("ws://%s/api/v1/dashboard/feed", listener.Addr().String())
+}
+
+// readUntil reads messages from the connection until one with the given type arrives
+func readUntil(t *testing.T, conn *websocket.Conn, msgType string, timeout time.Duration) map[string]interface{} {
+	deadline := time.Now().Add(timeout)
+	for {
+		var msg map[string]interface{}
+		conn.SetReadDeadline(deadline)
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Did not receive %s message: %v", msgType, err)
+		}
+		if msg["type"] == msgType {
+			return msg
+		}
+	}
+}
+
+// TestDashboardSubscriptions tests interval-based metric pushes and event coalescing
+func TestDashboardSubscriptions(t *testing.T) {
+	application, feedURL := startDashboardServer(t)
+
+	t.Run("RejectsInvalidInterval", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(feedURL, nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "metric": "total_events", "interval": "2s"}))
+		msg := readUntil(t, conn, "error", 2*time.Second)
+		assert.Contains(t, msg["error"], "invalid interval")
+	})
+
+	t.Run("PushesMetricOnInterval", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(feedURL, nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{
+			"type":        "subscribe",
+			"metric":      "active_users",
+			"interval":    "1s",
+			"granularity": "5m",
+		}))
+		ack := readUntil(t, conn, "subscribed", 2*time.Second)
+		assert.Equal(t, "5m", ack["granularity"])
+
+		// The immediate value and at least one interval push arrive
+		readUntil(t, conn, "active_users", 2*time.Second)
+		metric := readUntil(t, conn, "active_users", 3*time.Second)
+		assert.Equal(t, "5m", metric["metadata"].(map[string]interface{})["granularity"])
+	})
+
+	t.Run("CoalescesEvents", func(t *testing.T) {
+		conn, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=coalesce", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "stream": "events", "interval": "1s"}))
+		readUntil(t, conn, "subscribed", 2*time.Second)
+
+		dashboard := application.GetDashboardService()
+		for _, eventType := range []string{"click", "click", "page_view"} {
+			dashboard.BroadcastEvent(&app.AnalyticsEvent{ProjectID: "coalesce", EventType: eventType, UserID: "user123"})
+		}
+
+		batch := readUntil(t, conn, "events.batch", 3*time.Second)
+		assert.Equal(t, float64(3), batch["count"])
+		assert.Equal(t, float64(2), batch["by_type"].(map[string]interface{})["click"])
+		assert.Equal(t, float64(1), batch["first_seq"])
+		assert.Equal(t, float64(3), batch["last_seq"])
+	})
+}
@@ -0,0 +1,253 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestDataQualityMonitors tests alerting on event types that disappear, properties missing from
+// too many events and volumes of events outside their expected band
+func TestDataQualityMonitors(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	setup := func(monitors ...app.DataQualityMonitor) (*app.AnalyticsService, *app.FakeClock) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		_, err := service.DataQuality().Replace("web", monitors, 0)
+		assert.NoError(t, err)
+		return service, clock
+	}
+	track := func(service *app.AnalyticsService, eventType string, properties map[string]interface{}, count int) {
+		for i := 0; i < count; i++ {
+			_, err := service.TrackEvent(ctx, map[string]interface{}{"event_type": eventType, "user_id": "user1", "properties": properties}, "test-key", "user1")
+			assert.NoError(t, err)
+		}
+	}
+	bound := func(value int64) *int64 { return &value }
+
+	t.Run("RejectsInvalidMonitors", func(t *testing.T) {
+		monitors := app.NewDataQualityMonitors()
+		for _, invalid := range [][]app.DataQualityMonitor{
+			{{Type: app.MonitorEventDisappeared, EventType: "checkout"}},
+			{{Name: "checkout", Type: "spike", EventType: "checkout"}},
+			{{Name: "checkout", Type: app.MonitorEventDisappeared}},
+			{{Name: "currency", Type: app.MonitorNullRate, EventType: "purchase"}},
+			{{Name: "currency", Type: app.MonitorNullRate, EventType: "purchase", Property: "currency", MaxNullRate: 1}},
+			{{Name: "volume", Type: app.MonitorVolumeBand, Min: bound(10), Max: bound(5)}},
+			{{Name: "volume", Type: app.MonitorVolumeBand, Min: bound(10), Tolerance: 0.5}},
+			{{Name: "checkout", Type: app.MonitorEventDisappeared, EventType: "checkout", Max: bound(5)}},
+			{{Name: "checkout", Type: app.MonitorEventDisappeared, EventType: "checkout"}, {Name: "checkout", Type: app.MonitorVolumeBand}},
+		} {
+			_, err := monitors.Replace("web", invalid, 0)
+			assert.Error(t, err, invalid)
+		}
+
+		updated, err := monitors.Replace("web", []app.DataQualityMonitor{
+			{Name: "volume", Type: app.MonitorVolumeBand},
+			{Name: "checkout", Type: app.MonitorEventDisappeared, EventType: "checkout"},
+		}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "checkout", updated.Monitors[0].Name, "Monitors should be ordered by name")
+		assert.Equal(t, int64(10), updated.Monitors[0].MinEvents)
+		assert.Equal(t, 0.5, updated.Monitors[1].Tolerance, "Volume bands should default to a tolerance around the baseline")
+
+		var conflict *app.VersionConflictError
+		_, err = monitors.Replace("web", nil, 0)
+		assert.True(t, errors.As(err, &conflict))
+	})
+
+	t.Run("EventDisappeared", func(t *testing.T) {
+		service, clock := setup(app.DataQualityMonitor{Name: "checkout", Type: app.MonitorEventDisappeared, EventType: "checkout", MinEvents: 5})
+		var published []app.DataQualityAlert
+		var mutex sync.Mutex
+		assert.NoError(t, service.Bus().Subscribe(app.TopicDataQualityAlert, "test", func(payload interface{}) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			published = append(published, *payload.(*app.DataQualityAlert))
+		}))
+
+		track(service, "checkout", nil, 10)
+		clock.Advance(time.Hour)
+		track(service, "checkout", nil, 10)
+		clock.Advance(time.Hour)
+		track(service, "page_view", nil, 10)
+		clock.Advance(time.Hour)
+
+		report := service.DataQuality().Alerts("web")
+		assert.Equal(t, "1h0m0s", report.Window)
+		if assert.Len(t, report.Firing, 1) {
+			alert := report.Firing[0]
+			assert.Equal(t, "checkout", alert.Monitor)
+			assert.Equal(t, app.MonitorEventDisappeared, alert.Type)
+			assert.Equal(t, int64(0), alert.Events)
+			assert.Equal(t, 10.0, alert.Baseline)
+			assert.Equal(t, start.Add(3*time.Hour), alert.FiredAt)
+		}
+		assert.Empty(t, service.DataQuality().Alerts("mobile").Firing, "Alerts should be listed by project")
+
+		track(service, "checkout", nil, 1)
+		clock.Advance(time.Hour)
+		report = service.DataQuality().Alerts("")
+		assert.Empty(t, report.Firing)
+		if assert.Len(t, report.Resolved, 1) {
+			assert.Equal(t, start.Add(4*time.Hour), *report.Resolved[0].ResolvedAt)
+		}
+
+		assert.Eventually(t, func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return len(published) == 2
+		}, time.Second, 10*time.Millisecond, "Fired and resolved alerts should be published")
+	})
+
+	t.Run("DisappearedWithoutTraffic", func(t *testing.T) {
+		service, clock := setup(app.DataQualityMonitor{Name: "checkout", Type: app.MonitorEventDisappeared, EventType: "checkout", MinEvents: 5})
+		track(service, "checkout", nil, 10)
+		clock.Advance(time.Hour)
+		track(service, "checkout", nil, 10)
+		clock.Advance(5 * time.Hour)
+
+		assert.Len(t, service.DataQuality().Alerts("web").Firing, 1, "Windows without any event should be evaluated too")
+	})
+
+	t.Run("NullRate", func(t *testing.T) {
+		service, clock := setup(app.DataQualityMonitor{Name: "currency", Type: app.MonitorNullRate, EventType: "purchase", Property: "currency", MaxNullRate: 0.1, MinEvents: 10})
+		track(service, "purchase", map[string]interface{}{"currency": "EUR"}, 6)
+		track(service, "purchase", map[string]interface{}{"currency": ""}, 2)
+		track(service, "purchase", nil, 2)
+		track(service, "page_view", nil, 20)
+		clock.Advance(time.Hour)
+
+		report := service.DataQuality().Alerts("web")
+		if assert.Len(t, report.Firing, 1, "Null rates need no baseline") {
+			assert.Equal(t, int64(10), report.Firing[0].Events)
+			assert.Equal(t, 0.4, report.Firing[0].NullRate)
+			assert.Equal(t, "currency", report.Firing[0].Property)
+		}
+
+		track(service, "purchase", nil, 9)
+		clock.Advance(time.Hour)
+		assert.Empty(t, service.DataQuality().Alerts("web").Firing, "Windows with too few events should not alert")
+	})
+
+	t.Run("VolumeBand", func(t *testing.T) {
+		service, clock := setup(
+			app.DataQualityMonitor{Name: "explicit", Type: app.MonitorVolumeBand, Min: bound(5), Max: bound(20)},
+			app.DataQualityMonitor{Name: "baseline", Type: app.MonitorVolumeBand, EventType: "page_view", Tolerance: 0.5},
+		)
+		track(service, "page_view", nil, 30)
+		clock.Advance(time.Hour)
+		assert.Empty(t, service.DataQuality().Alerts("web").Firing, "The first window should only set baselines")
+
+		track(service, "page_view", nil, 30)
+		track(service, "click", nil, 5)
+		clock.Advance(time.Hour)
+		report := service.DataQuality().Alerts("web")
+		if assert.Len(t, report.Firing, 1) {
+			alert := report.Firing[0]
+			assert.Equal(t, "explicit", alert.Monitor)
+			assert.Equal(t, int64(35), alert.Events)
+			assert.Equal(t, 5.0, *alert.ExpectedMin)
+			assert.Equal(t, 20.0, *alert.ExpectedMax)
+		}
+
+		track(service, "page_view", nil, 10)
+		clock.Advance(time.Hour)
+		report = service.DataQuality().Alerts("web")
+		if assert.Len(t, report.Firing, 1) {
+			alert := report.Firing[0]
+			assert.Equal(t, "baseline", alert.Monitor)
+			assert.Equal(t, 30.0, alert.Baseline)
+			assert.Equal(t, 15.0, *alert.ExpectedMin)
+			assert.Equal(t, 45.0, *alert.ExpectedMax)
+		}
+		assert.Len(t, report.Resolved, 1)
+
+		var metrics bytes.Buffer
+		assert.NoError(t, service.DataQuality().WriteMetrics(&metrics))
+		assert.Contains(t, metrics.String(), `analytics_data_quality_alerts_firing{type="volume_band"} 1`)
+		assert.Contains(t, metrics.String(), `analytics_data_quality_alerts_total{type="volume_band"} 2`)
+	})
+
+	t.Run("AddedMidWindow", func(t *testing.T) {
+		service, clock := setup()
+		track(service, "page_view", nil, 30)
+		clock.Advance(time.Hour + 30*time.Minute)
+		_, err := service.DataQuality().Replace("web", []app.DataQualityMonitor{{Name: "volume", Type: app.MonitorVolumeBand, Min: bound(20)}}, 1)
+		assert.NoError(t, err)
+		track(service, "page_view", nil, 5)
+		clock.Advance(30 * time.Minute)
+
+		assert.Empty(t, service.DataQuality().Alerts("web").Firing, "Monitors should not alert on the window they were added in")
+		track(service, "page_view", nil, 5)
+		clock.Advance(time.Hour)
+		assert.Len(t, service.DataQuality().Alerts("web").Firing, 1)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+		clock := app.NewFakeClock(start)
+		application.GetAnalyticsService().SetClock(clock)
+
+		send := func(method, path, ifMatch, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "web")
+			req.Header.Set("X-Admin-Token", "viewer-token")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+		monitors := `{"monitors":[{"name":"currency","type":"null_rate","event_type":"purchase","property":"currency","max_null_rate":0.1,"min_events":2}]}`
+
+		status, _ := send("PUT", "/api/v1/projects/web/monitors", "", `{"monitors":[{"name":"currency","type":"null_rate"}]}`)
+		assert.Equal(t, 400, status)
+		status, _ = send("PUT", "/api/v1/projects/web/monitors", "", monitors)
+		assert.Equal(t, 200, status)
+		status, _ = send("PUT", "/api/v1/projects/web/monitors", "", monitors)
+		assert.Equal(t, 428, status, "Replacing monitors should require If-Match")
+		status, _ = send("PUT", "/api/v1/projects/web/monitors", `"1"`, monitors)
+		assert.Equal(t, 200, status)
+
+		for i := 0; i < 2; i++ {
+			status, _ = send("POST", "/api/v1/analytics/events", "", `{"event_type":"purchase","user_id":"user1"}`)
+			assert.Equal(t, 200, status)
+		}
+		clock.Advance(time.Hour)
+
+		status, body := send("GET", "/api/v1/projects/web/monitors", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(2), body["monitors"].(map[string]interface{})["version"])
+		firing := body["alerts"].(map[string]interface{})["firing"].([]interface{})
+		if assert.Len(t, firing, 1) {
+			assert.Equal(t, "currency", firing[0].(map[string]interface{})["monitor"])
+		}
+
+		status, body = send("GET", "/api/v1/admin/data-quality-alerts", "", "")
+		assert.Equal(t, 200, status)
+		assert.Len(t, body["data_quality_alerts"].(map[string]interface{})["firing"], 1)
+	})
+}
@@ -44,7 +44,7 @@ func TestEnhancedEventIngestion(t *testing.T) {
 		assert.Equal(t, "page_view", event.EventType)
 		assert.Equal(t, "user123", event.UserID)
 		assert.NotEmpty(t, event.ID)
-		assert.NotEmpty(t, event.BillingEventID)
+		assert.NotEmpty(t, event.BillingCorrelationID)
 	})
 
 	// Test 2: Event with custom properties validation
@@ -171,7 +171,7 @@ func TestEventEnrichment(t *testing.T) {
 		assert.Equal(t, "user123", event.UserID, "User ID should be preserved")
 		assert.Equal(t, "/home", event.Page, "Page should be preserved")
 		assert.NotEmpty(t, event.ID, "Event should have an ID")
-		assert.NotEmpty(t, event.BillingEventID, "Event should have a billing event ID")
+		assert.NotEmpty(t, event.BillingCorrelationID, "Event should have a billing correlation ID")
 		assert.NotZero(t, event.Timestamp, "Event should have a timestamp")
 
 		// Test that enrichment preserves existing data and adds defaults
@@ -0,0 +1,132 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestEventAggregation tests event types stored only as aggregate counters, without per-event
+// records or user linkage, and counted in trends
+func TestEventAggregation(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	t.Run("RejectsInvalidSettings", func(t *testing.T) {
+		aggregates := app.NewEventAggregates(app.NewAliasService())
+		_, err := aggregates.Replace("web", []string{"heartbeat", ""}, 0)
+		assert.Error(t, err)
+		_, err = aggregates.Replace("web", []string{"heartbeat", "heartbeat"}, 0)
+		assert.Error(t, err)
+
+		updated, err := aggregates.Replace("web", []string{"heartbeat", "fps_sample"}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"fps_sample", "heartbeat"}, updated.EventTypes)
+		assert.True(t, aggregates.AggregationOnly("web", "heartbeat"))
+		assert.False(t, aggregates.AggregationOnly("web", "page_view"))
+		assert.False(t, aggregates.AggregationOnly("shop", "heartbeat"))
+	})
+
+	t.Run("CountsWithoutStoring", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start.Add(10 * time.Hour))
+		service.SetClock(clock)
+		_, err := service.Aggregates().Replace("web", []string{"heartbeat"}, 0)
+		assert.NoError(t, err)
+		track := func(ctx context.Context, eventType string) *app.AnalyticsEvent {
+			event, err := service.TrackEvent(ctx, map[string]interface{}{
+				"event_type": eventType,
+				"user_id":    "user1",
+				"page":       "/checkout",
+				"properties": map[string]interface{}{"email": "user1@example.com"},
+			}, "test-key", "user1")
+			assert.NoError(t, err)
+			return event
+		}
+
+		for i := 0; i < 3; i++ {
+			event := track(ctx, "heartbeat")
+			assert.True(t, event.Aggregated)
+			assert.Empty(t, event.UserID, "Aggregated events should not be linked to their user")
+			assert.Empty(t, event.Properties)
+			assert.Empty(t, event.Page)
+		}
+		clock.Advance(time.Hour)
+		track(ctx, "heartbeat")
+		assert.False(t, track(ctx, "page_view").Aggregated)
+		assert.False(t, track(app.ContextWithProject(context.Background(), "shop"), "heartbeat").Aggregated, "Other projects should store the event type")
+
+		assert.Equal(t, int64(2), service.EventCount(), "Aggregated events should not be stored")
+		assert.Empty(t, service.QueryEvents(ctx, app.EventFilter{ProjectID: "web", EventType: "heartbeat", Start: start, End: start.Add(24 * time.Hour)}))
+
+		queries := app.NewQueryService(service)
+		hourly, err := queries.ComputeTrend(ctx, app.TrendQuery{EventType: "heartbeat", Interval: "hour", Start: start.Add(9 * time.Hour), End: start.Add(12 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "events", hourly.Source)
+		assert.Equal(t, int64(4), hourly.TotalEvents)
+		assert.Equal(t, []int64{0, 3, 1}, []int64{hourly.Points[0].Count, hourly.Points[1].Count, hourly.Points[2].Count})
+		assert.Zero(t, hourly.Points[1].UniqueUsers)
+
+		daily, err := queries.ComputeTrend(ctx, app.TrendQuery{Interval: "day", Start: start, End: start.Add(24 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "rollups", daily.Source)
+		assert.Equal(t, int64(5), daily.TotalEvents, "Trends of every event type should count aggregated events")
+
+		segment, err := queries.ComputeSegment(ctx, app.SegmentQuery{EventType: "heartbeat", Start: start, End: start.Add(24 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Zero(t, segment.UserCount)
+
+		_, err = service.Aliases().Replace("web", map[string]string{"heartbeat": "ping"}, nil, 0)
+		assert.NoError(t, err)
+		aliased, err := queries.ComputeTrend(ctx, app.TrendQuery{EventType: "ping", Interval: "day", Start: start, End: start.Add(24 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), aliased.TotalEvents, "Aliases should apply to aggregated events")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, ifMatch, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "web")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+
+		status, _ := send("PUT", "/api/v1/projects/web/aggregation", "", `{"event_types":[""]}`)
+		assert.Equal(t, 400, status)
+		status, _ = send("PUT", "/api/v1/projects/web/aggregation", "", `{"event_types":["heartbeat"]}`)
+		assert.Equal(t, 200, status)
+		status, _ = send("PUT", "/api/v1/projects/web/aggregation", "", `{"event_types":["heartbeat","fps"]}`)
+		assert.Equal(t, 428, status)
+		status, _ = send("PUT", "/api/v1/projects/web/aggregation", `"1"`, `{"event_types":["heartbeat","fps"]}`)
+		assert.Equal(t, 200, status)
+
+		status, body := send("GET", "/api/v1/projects/web/aggregation", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, []interface{}{"fps", "heartbeat"}, body["aggregation"].(map[string]interface{})["event_types"])
+
+		status, body = send("POST", "/api/v1/analytics/events", "", `{"event_type":"heartbeat","user_id":"user1"}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, true, body["aggregated"])
+		assert.Equal(t, int64(0), application.GetAnalyticsService().EventCount())
+	})
+}
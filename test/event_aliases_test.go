@@ -0,0 +1,104 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestEventAliases tests that renamed event types and properties are reported under their canonical names
+func TestEventAliases(t *testing.T) {
+	track := func(service *app.AnalyticsService, projectID, eventType, userID string, properties map[string]interface{}) {
+		_, err := service.TrackEvent(app.ContextWithProject(context.Background(), projectID), map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+			"properties": properties,
+		}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+
+	t.Run("AppliedAtQueryTime", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		track(service, "shop", "signup_completed", "user1", map[string]interface{}{"plan_name": "pro"})
+		track(service, "shop", "sign_up", "user2", map[string]interface{}{"plan": "pro"})
+		track(service, "shop", "sign_up", "user3", map[string]interface{}{"plan": "free", "plan_name": "pro"})
+		track(service, "other", "signup_completed", "user4", nil)
+
+		_, err := service.Aliases().Replace("shop", map[string]string{"signup_completed": "sign_up"}, map[string]string{"plan_name": "plan"}, 0)
+		assert.NoError(t, err)
+
+		segment, err := app.NewQueryService(service).ComputeSegment(app.ContextWithProject(context.Background(), "shop"), app.SegmentQuery{
+			EventType:  "sign_up",
+			Properties: map[string]interface{}{"plan": "pro"},
+			Start:      time.Now().Add(-time.Hour),
+			End:        time.Now().Add(time.Hour),
+		})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"user1", "user2"}, segment.Users, "The canonical property should win over its alias")
+
+		events := service.QueryEvents(context.Background(), app.EventFilter{ProjectID: "other", EventType: "signup_completed"})
+		assert.Equal(t, 1, len(events), "Aliases should only apply to their project")
+
+		stored := service.QueryEvents(context.Background(), app.EventFilter{ProjectID: "shop", EventType: "signup_completed"})
+		assert.Empty(t, stored, "Aliased event types should only be reported under the canonical name")
+
+		// Stored events are not rewritten, so removing the alias restores the original names
+		_, err = service.Aliases().Replace("shop", nil, nil, 1)
+		assert.NoError(t, err)
+		events = service.QueryEvents(context.Background(), app.EventFilter{ProjectID: "shop", EventType: "signup_completed"})
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, "pro", events[0].Properties["plan_name"])
+	})
+
+	t.Run("RejectsInvalidAliases", func(t *testing.T) {
+		aliases := app.NewAliasService()
+		_, err := aliases.Replace("shop", map[string]string{"a": "a"}, nil, 0)
+		assert.Error(t, err)
+		_, err = aliases.Replace("shop", map[string]string{"a": "b", "b": "c"}, nil, 0)
+		assert.Error(t, err, "Chained aliases should be rejected")
+		_, err = aliases.Replace("shop", nil, map[string]string{"": "plan"}, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+
+		put := func(body, ifMatch string) int {
+			req := httptest.NewRequest("PUT", "/api/v1/projects/shop/aliases", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		assert.Equal(t, 200, put(`{"events":{"signup_completed":"sign_up"}}`, ""))
+		assert.Equal(t, 428, put(`{"events":{}}`, ""), "Replacing existing aliases should require If-Match")
+		assert.Equal(t, 409, put(`{"events":{}}`, `"5"`))
+		assert.Equal(t, 400, put(`{"events":{"a":"b","b":"c"}}`, `"1"`))
+		assert.Equal(t, 200, put(`{"events":{"signup_completed":"sign_up"},"properties":{"plan_name":"plan"}}`, `"1"`))
+
+		req := httptest.NewRequest("GET", "/api/v1/projects/shop/aliases", nil)
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+
+		var body struct {
+			Aliases app.ProjectAliases `json:"aliases"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "sign_up", body.Aliases.Events["signup_completed"])
+		assert.Equal(t, "plan", body.Aliases.Properties["plan_name"])
+	})
+}
@@ -0,0 +1,143 @@
+package test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestEventBus tests the in-process bus delivering stored events to the services consuming them
+func TestEventBus(t *testing.T) {
+	track := func(t *testing.T, service *app.AnalyticsService, eventType string) *app.AnalyticsEvent {
+		event, err := service.TrackEvent(context.Background(), map[string]interface{}{"event_type": eventType, "user_id": "user1"}, "test-key", "user1")
+		assert.NoError(t, err)
+		return event
+	}
+
+	t.Run("Delivery", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		bus := service.Bus()
+		defer bus.Stop()
+
+		var mutex sync.Mutex
+		received := map[string][]string{}
+		for _, subscriber := range []string{"first", "second"} {
+			subscriber := subscriber
+			assert.NoError(t, bus.SubscribeEvents(app.TopicEventStored, subscriber, func(event *app.AnalyticsEvent) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				received[subscriber] = append(received[subscriber], event.EventType)
+			}))
+		}
+		assert.Error(t, bus.SubscribeEvents(app.TopicEventStored, "first", func(*app.AnalyticsEvent) {}), "Subscriber names should be unique per topic")
+		assert.Error(t, bus.Subscribe(app.EventTopic{Name: "unknown"}, "third", func(interface{}) {}))
+
+		track(t, service, "page_view")
+		track(t, service, "click")
+		bus.Drain()
+
+		mutex.Lock()
+		assert.Equal(t, []string{"page_view", "click"}, received["first"])
+		assert.Equal(t, []string{"page_view", "click"}, received["second"])
+		mutex.Unlock()
+
+		assert.Error(t, bus.Publish(app.TopicEventStored, "page_view"), "Topics should only carry payloads of their type")
+	})
+
+	t.Run("BoundedQueues", func(t *testing.T) {
+		t.Setenv("EVENT_BUS_QUEUE_CAPACITY", "1")
+		service := app.NewAnalyticsService()
+		bus := service.Bus()
+		defer bus.Stop()
+
+		started := make(chan struct{}, 3)
+		release := make(chan struct{})
+		assert.NoError(t, bus.SubscribeEvents(app.TopicEventStored, "slow", func(*app.AnalyticsEvent) {
+			started <- struct{}{}
+			<-release
+		}))
+		handled := make(chan struct{}, 3)
+		assert.NoError(t, bus.SubscribeEvents(app.TopicEventStored, "fast", func(*app.AnalyticsEvent) {
+			handled <- struct{}{}
+		}))
+
+		// The slow subscriber handles the first event, queues the second and drops the third
+		track(t, service, "page_view")
+		<-started
+		<-handled
+		track(t, service, "page_view")
+		<-handled
+		track(t, service, "page_view")
+		<-handled
+		close(release)
+		bus.Drain()
+
+		stats := bus.Stats()
+		assert.Equal(t, 2, len(stats))
+		assert.Equal(t, "fast", stats[0].Subscriber)
+		assert.Equal(t, int64(3), stats[0].Delivered, "A slow subscriber should not hold up other subscribers")
+		assert.Equal(t, int64(0), stats[0].Dropped)
+		assert.Equal(t, "slow", stats[1].Subscriber)
+		assert.Equal(t, int64(2), stats[1].Delivered)
+		assert.Equal(t, int64(1), stats[1].Dropped, "Events should be dropped when the subscriber's queue is full")
+		assert.Equal(t, 1, stats[1].Capacity)
+	})
+
+	t.Run("Panics", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		bus := service.Bus()
+		defer bus.Stop()
+
+		assert.NoError(t, bus.SubscribeEvents(app.TopicEventStored, "flaky", func(event *app.AnalyticsEvent) {
+			if event.EventType == "click" {
+				panic("cannot handle clicks")
+			}
+		}))
+		track(t, service, "click")
+		track(t, service, "page_view")
+		bus.Drain()
+
+		stats := bus.Stats()
+		assert.Equal(t, int64(1), stats[0].Failed)
+		assert.Equal(t, int64(1), stats[0].Delivered, "The subscriber should keep receiving events after a panic")
+
+		bus.Stop()
+		track(t, service, "page_view")
+		assert.Error(t, bus.SubscribeEvents(app.TopicEventStored, "late", func(*app.AnalyticsEvent) {}))
+	})
+
+	t.Run("Dashboards", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"page_view","user_id":"user1"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "user1")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		bus := application.GetAnalyticsService().Bus()
+		bus.Drain()
+		stats := bus.Stats()
+		assert.Equal(t, 2, len(stats))
+		assert.Equal(t, "dashboards", stats[0].Subscriber)
+		assert.Equal(t, int64(1), stats[0].Delivered)
+		assert.Equal(t, "live_funnels", stats[1].Subscriber)
+
+		resp, err = application.GetFiberApp().Test(httptest.NewRequest("GET", "/metrics", nil))
+		assert.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Contains(t, string(body), `analytics_event_bus_delivered_total{topic="event.stored",subscriber="dashboards"} 1`)
+	})
+}
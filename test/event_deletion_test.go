@@ -0,0 +1,161 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestEventDeletion tests bulk deletions of stored events matching filters, with dry runs
+func TestEventDeletion(t *testing.T) {
+	day := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	track := func(service *app.AnalyticsService, clock *app.FakeClock, projectID, apiKey, eventType string, properties map[string]interface{}, at time.Time) {
+		clock.Set(at)
+		ctx := app.ContextWithProject(context.Background(), projectID)
+		_, err := service.TrackEvent(ctx, map[string]interface{}{"event_type": eventType, "user_id": "user1", "properties": properties}, apiKey, "user1")
+		assert.NoError(t, err)
+	}
+	newService := func(store app.EventStore) (*app.AnalyticsService, *app.FakeClock) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(day)
+		service.SetClock(clock)
+		if store != nil {
+			service.SetEventStore(store)
+			t.Cleanup(func() { _ = service.CloseEventStore() })
+		}
+		track(service, clock, "web", "prod-key", "page_view", map[string]interface{}{"env": "prod"}, day)
+		track(service, clock, "web", "staging-key", "page_view", map[string]interface{}{"env": "staging"}, day)
+		track(service, clock, "web", "staging-key", "click", map[string]interface{}{"env": "staging"}, day.Add(24*time.Hour))
+		track(service, clock, "mobile", "staging-key", "page_view", map[string]interface{}{"env": "staging"}, day.Add(48*time.Hour))
+		return service, clock
+	}
+
+	t.Run("DryRun", func(t *testing.T) {
+		service, _ := newService(nil)
+		result, err := service.DeleteEvents(app.EventDeletion{APIKey: "staging-key", DryRun: true})
+		assert.NoError(t, err)
+		assert.True(t, result.DryRun)
+		assert.Equal(t, int64(3), result.Matched)
+		assert.Zero(t, result.Deleted)
+		assert.Equal(t, map[string]int64{"page_view": 2, "click": 1}, result.MatchedByType)
+		assert.Equal(t, []string{"mobile", "web"}, result.Projects)
+		assert.True(t, result.FirstEventAt.Equal(day))
+		assert.True(t, result.LastEventAt.Equal(day.Add(48*time.Hour)))
+		assert.Len(t, result.Sample, 3)
+		assert.Equal(t, int64(4), service.EventCount(), "Dry runs should delete nothing")
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		service, _ := newService(nil)
+		_, err := service.DeleteEvents(app.EventDeletion{Start: day, End: day.Add(time.Hour)})
+		assert.Error(t, err, "Deleting a whole time range should be rejected")
+
+		matched := func(deletion app.EventDeletion) int64 {
+			deletion.DryRun = true
+			result, err := service.DeleteEvents(deletion)
+			assert.NoError(t, err)
+			return result.Matched
+		}
+		assert.Equal(t, int64(3), matched(app.EventDeletion{Properties: map[string]interface{}{"env": "staging"}}))
+		assert.Equal(t, int64(2), matched(app.EventDeletion{ProjectID: "web", EventType: "page_view"}))
+		assert.Equal(t, int64(1), matched(app.EventDeletion{APIKey: "staging-key", Start: day.Add(time.Hour), End: day.Add(47 * time.Hour)}))
+		assert.Equal(t, int64(0), matched(app.EventDeletion{APIKey: "staging-key", Properties: map[string]interface{}{"env": "prod"}}))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := app.NewMemoryEventStore()
+		service, _ := newService(store)
+		assert.Equal(t, 4, service.EventWriter().Flush())
+
+		result, err := service.DeleteEvents(app.EventDeletion{ProjectID: "web", APIKey: "staging-key"})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), result.Deleted)
+		assert.Nil(t, result.Sample)
+		assert.Len(t, result.Rollups, 1)
+		assert.Equal(t, int64(2), service.EventCount())
+		assert.Equal(t, 2, service.EventWriter().Stats().PendingDeletes)
+
+		start := day.Truncate(24 * time.Hour)
+		points, total, _ := service.Rollups().Trend("web", nil, "", start, start.Add(48*time.Hour), 24*time.Hour)
+		assert.Equal(t, int64(1), total, "Deleted events should leave the rollups")
+		service.Series().AddStats(points, "web", nil, "", start, start.Add(48*time.Hour), 24*time.Hour)
+		assert.Equal(t, int64(1), points[0].Hourly.Max, "Deleted events should leave the hourly series")
+		assert.Equal(t, int64(0), points[1].Hourly.Max)
+
+		ctx := app.ContextWithProject(context.Background(), "web")
+
+		usage, err := service.GetUsage(ctx, "user1", "2024-02-29", "2024-03-03")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), usage.TotalEvents, "Deleted events should not be read from the store")
+		service.EventWriter().Flush()
+		assert.Equal(t, 2, store.Len())
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+		assert.NoError(t, application.GetAdminAuth().AddToken("root", "admin-token", app.RoleAdmin))
+		service := application.GetAnalyticsService()
+		for _, apiKey := range []string{"prod-key", "staging-key", "staging-key"} {
+			_, err := service.TrackEvent(app.ContextWithProject(context.Background(), "web"), map[string]interface{}{"event_type": "page_view", "user_id": "user1"}, apiKey, "user1")
+			assert.NoError(t, err)
+		}
+
+		send := func(method, path, body, token string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Admin-Token", token)
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			_ = json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp.StatusCode, decoded
+		}
+		run := func(body string) map[string]interface{} {
+			status, accepted := send("POST", "/api/v1/admin/events/delete", body, "admin-token")
+			assert.Equal(t, 202, status, accepted)
+			var job app.Job
+			assert.Eventually(t, func() bool {
+				_, polled := send("GET", accepted["status_url"].(string), "", "admin-token")
+				encoded, _ := json.Marshal(polled["job"])
+				assert.NoError(t, json.Unmarshal(encoded, &job))
+				return job.Done()
+			}, 5*time.Second, 5*time.Millisecond)
+			assert.Equal(t, app.JobSucceeded, job.Status, job.Error)
+			assert.Equal(t, app.JobEventDelete, job.Kind)
+			return job.Result.(map[string]interface{})
+		}
+
+		status, _ := send("POST", "/api/v1/admin/events/delete", `{"api_key":"staging-key"}`, "operator-token")
+		assert.Equal(t, 403, status, "Deleting events should require admin")
+		for _, invalid := range []string{`{"from":"2024-01-01T00:00:00Z"}`, `{"api_key":"staging-key","from":"yesterday"}`, `{"event_type":"page_view","from":"2024-02-01T00:00:00Z","to":"2024-01-01T00:00:00Z"}`} {
+			status, _ = send("POST", "/api/v1/admin/events/delete", invalid, "admin-token")
+			assert.Equal(t, 400, status, invalid)
+		}
+
+		result := run(`{"api_key":"staging-key","dry_run":true}`)
+		assert.Equal(t, float64(2), result["matched"])
+		assert.Equal(t, int64(3), service.EventCount())
+
+		result = run(`{"api_key":"staging-key","project_id":"web"}`)
+		assert.Equal(t, float64(2), result["deleted"])
+		assert.Equal(t, int64(1), service.EventCount())
+
+		entries := application.GetAuditLog().Entries("events.delete", 0)
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, false, entries[0].Details["dry_run"])
+			filters := entries[0].Details["filters"].(map[string]interface{})
+			assert.Equal(t, app.APIKeyID("staging-key"), filters["api_key_id"])
+			assert.NotContains(t, filters, "api_key", "The audit log should not keep API keys")
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestEventQuotas tests capping event types per project and day, dropping or sampling the events
+// beyond the cap, and reporting the usage of each event type
+func TestEventQuotas(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	setup := func(quotas ...app.EventTypeQuota) (*app.AnalyticsService, *app.FakeClock) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		_, err := service.Quotas().Replace("web", quotas, 0)
+		assert.NoError(t, err)
+		return service, clock
+	}
+	track := func(service *app.AnalyticsService, ctx context.Context, eventType string) (*app.AnalyticsEvent, error) {
+		return service.TrackEvent(ctx, map[string]interface{}{"event_type": eventType, "user_id": "user1"}, "test-key", "user1")
+	}
+
+	t.Run("RejectsInvalidQuotas", func(t *testing.T) {
+		quotas := app.NewEventQuotas()
+		for _, invalid := range [][]app.EventTypeQuota{
+			{{DailyLimit: 10}},
+			{{EventType: "scroll", DailyLimit: -1}},
+			{{EventType: "scroll", DailyLimit: 10, Action: "throttle"}},
+			{{EventType: "scroll", DailyLimit: 10, Action: app.QuotaSample}},
+			{{EventType: "scroll", DailyLimit: 10, Action: app.QuotaSample, SampleRate: 1}},
+			{{EventType: "scroll", DailyLimit: 10, SampleRate: 0.5}},
+			{{EventType: "scroll", DailyLimit: 10}, {EventType: "scroll", DailyLimit: 20}},
+		} {
+			_, err := quotas.Replace("web", invalid, 0)
+			assert.Error(t, err, invalid)
+		}
+
+		updated, err := quotas.Replace("web", []app.EventTypeQuota{{EventType: "scroll", DailyLimit: 10}, {EventType: "click", DailyLimit: 5}}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "click", updated.Quotas[0].EventType, "Quotas should be ordered by event type")
+		assert.Equal(t, app.QuotaDrop, updated.Quotas[1].Action, "Quotas should drop events by default")
+
+		var conflict *app.VersionConflictError
+		_, err = quotas.Replace("web", nil, 0)
+		assert.True(t, errors.As(err, &conflict))
+	})
+
+	t.Run("DropsEventsBeyondTheLimit", func(t *testing.T) {
+		service, clock := setup(app.EventTypeQuota{EventType: "mouse_move", DailyLimit: 3})
+
+		for i := 0; i < 3; i++ {
+			_, err := track(service, ctx, "mouse_move")
+			assert.NoError(t, err)
+		}
+		_, err := track(service, ctx, "mouse_move")
+		var overQuota *app.QuotaExceededError
+		assert.True(t, errors.As(err, &overQuota))
+		assert.Equal(t, "mouse_move", overQuota.EventType)
+		assert.Equal(t, int64(3), service.EventCount(), "Dropped events should not be stored")
+
+		_, err = track(service, ctx, "page_view")
+		assert.NoError(t, err, "Other event types should not be limited")
+		_, err = track(service, app.ContextWithProject(context.Background(), "shop"), "mouse_move")
+		assert.NoError(t, err, "Other projects should not be limited")
+
+		clock.Advance(24 * time.Hour)
+		_, err = track(service, ctx, "mouse_move")
+		assert.NoError(t, err, "Quotas should reset every day")
+	})
+
+	t.Run("SamplesEventsBeyondTheLimit", func(t *testing.T) {
+		service, _ := setup(app.EventTypeQuota{EventType: "mouse_move", DailyLimit: 10, Action: app.QuotaSample, SampleRate: 0.2})
+
+		kept := 0
+		for i := 0; i < 1010; i++ {
+			event, err := track(service, ctx, "mouse_move")
+			if i < 10 {
+				assert.NoError(t, err)
+				assert.Zero(t, event.QuotaSampleRate)
+				continue
+			}
+			if err == nil {
+				assert.Equal(t, 0.2, event.QuotaSampleRate)
+				kept++
+			}
+		}
+		assert.InDelta(t, 200, kept, 60, "About a fifth of the events beyond the limit should be kept")
+
+		usage, err := service.Quotas().Usage("web", "2024-03-01")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(usage.EventTypes))
+		assert.Equal(t, int64(1010), usage.EventTypes[0].Received)
+		assert.Equal(t, int64(10), usage.EventTypes[0].Accepted)
+		assert.Equal(t, int64(kept), usage.EventTypes[0].Sampled)
+		assert.Equal(t, int64(1000-kept), usage.EventTypes[0].Dropped)
+		assert.Equal(t, int64(10+kept), service.EventCount())
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		application.GetAnalyticsService().SetClock(app.NewFakeClock(start))
+
+		send := func(method, path, ifMatch, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "web")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+		quotas := `{"quotas":[{"event_type":"scroll","daily_limit":1}]}`
+
+		status, _ := send("PUT", "/api/v1/projects/web/quotas", "", `{"quotas":[{"event_type":"scroll","daily_limit":1,"action":"pause"}]}`)
+		assert.Equal(t, 400, status)
+		status, _ = send("PUT", "/api/v1/projects/web/quotas", "", quotas)
+		assert.Equal(t, 200, status)
+		status, _ = send("PUT", "/api/v1/projects/web/quotas", "", quotas)
+		assert.Equal(t, 428, status, "Replacing quotas should require If-Match")
+		status, _ = send("PUT", "/api/v1/projects/web/quotas", `"1"`, quotas)
+		assert.Equal(t, 200, status)
+
+		status, body := send("GET", "/api/v1/projects/web/quotas", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(2), body["quotas"].(map[string]interface{})["version"])
+
+		status, body = send("POST", "/api/v1/analytics/events", "", `{"event_type":"scroll","user_id":"user1"}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "success", body["status"])
+		status, body = send("POST", "/api/v1/analytics/events", "", `{"event_type":"scroll","user_id":"user1"}`)
+		assert.Equal(t, 200, status, "Dropped events should not be retried")
+		assert.Equal(t, "dropped", body["status"])
+		assert.Contains(t, body["reason"], "daily quota of 1 scroll events exceeded")
+
+		status, body = send("GET", "/api/v1/projects/web/quotas/usage", "", "")
+		assert.Equal(t, 200, status)
+		eventTypes := body["usage"].(map[string]interface{})["event_types"].([]interface{})
+		assert.Equal(t, 1, len(eventTypes))
+		scroll := eventTypes[0].(map[string]interface{})
+		assert.Equal(t, float64(2), scroll["received"])
+		assert.Equal(t, float64(1), scroll["dropped"])
+		assert.Equal(t, float64(1), scroll["quota"].(map[string]interface{})["daily_limit"])
+
+		status, body = send("GET", "/api/v1/projects/web/quotas/usage?date=2024-02-29", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(0), body["usage"].(map[string]interface{})["event_types"].([]interface{})[0].(map[string]interface{})["received"],
+			"Event types with a quota should be listed on days they were not sent")
+		status, _ = send("GET", "/api/v1/projects/web/quotas/usage?date=yesterday", "", "")
+		assert.Equal(t, 400, status)
+
+		batch := `{"batch_id":"quota-batch","user_id":"user1","events":[{"event_type":"scroll"},{"event_type":"tap"}]}`
+		status, body = send("POST", "/api/v1/analytics/mobile/batch", "", batch)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "success", body["status"])
+		assert.Equal(t, float64(1), body["dropped"])
+		assert.Equal(t, true, body["results"].([]interface{})[0].(map[string]interface{})["dropped"])
+	})
+}
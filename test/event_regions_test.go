@@ -0,0 +1,166 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestEventRegions tests tagging events with regions, storing them per region and narrowing reads
+// by the projects' region policies
+func TestEventRegions(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	// newService creates a service with the us and eu regions and a project restricted to eu
+	newService := func(t *testing.T) *app.AnalyticsService {
+		t.Setenv("EVENT_REGIONS", "us, eu")
+		service := app.NewAnalyticsService()
+		service.SetClock(app.NewFakeClock(day.Add(10 * time.Hour)))
+		_, err := service.Regions().SetPolicy("eu-shop", app.RegionPolicy{HomeRegion: "eu", AllowedRegions: []string{"eu"}, Reads: app.RegionReadsRestrict})
+		assert.NoError(t, err)
+		return service
+	}
+
+	// track stores an event of the project requested for the region
+	track := func(t *testing.T, service *app.AnalyticsService, projectID, region string) *app.AnalyticsEvent {
+		ctx := app.ContextWithRegion(app.ContextWithProject(context.Background(), projectID), region)
+		event, err := service.TrackEvent(ctx, map[string]interface{}{"event_type": "page_view", "user_id": "user1"}, "test-key", "user1")
+		assert.NoError(t, err)
+		return event
+	}
+
+	t.Run("Routing", func(t *testing.T) {
+		service := newService(t)
+		assert.Equal(t, []string{"us", "eu"}, service.Regions().Regions())
+		assert.Equal(t, "us", service.Regions().DefaultRegion(), "The first region should be the default")
+
+		assert.Equal(t, "eu", track(t, service, "web", "eu").Region)
+		assert.Equal(t, "us", track(t, service, "web", "").Region, "Untagged events should be stored in the default region")
+		assert.Equal(t, "eu", track(t, service, "eu-shop", "").Region, "Untagged events should be stored in the project's home region")
+		assert.Equal(t, "eu", track(t, service, "eu-shop", "us").Region, "Events tagged with a region the project does not allow should be routed to its home region")
+
+		event, err := service.TrackEvent(app.ContextWithProject(context.Background(), "web"), map[string]interface{}{"event_type": "page_view", "user_id": "user1", "region": "eu"}, "test-key", "user1")
+		assert.NoError(t, err)
+		assert.Equal(t, "eu", event.Region, "The event's region field should tag it")
+		_, err = service.TrackEvent(app.ContextWithProject(context.Background(), "web"), map[string]interface{}{"event_type": "page_view", "user_id": "user1", "region": "apac"}, "test-key", "user1")
+		assert.Error(t, err)
+
+		_, err = service.Regions().SetPolicy("web", app.RegionPolicy{HomeRegion: "us", AllowedRegions: []string{"eu"}})
+		assert.Error(t, err, "The home region must be allowed")
+		_, err = service.Regions().SetPolicy("web", app.RegionPolicy{HomeRegion: "apac"})
+		assert.Error(t, err)
+		_, err = service.Regions().SetPolicy("web", app.RegionPolicy{Reads: "everywhere"})
+		assert.Error(t, err)
+		policy, err := service.Regions().SetPolicy("web", app.RegionPolicy{AllowedRegions: []string{"us", "eu", "us"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "us", policy.HomeRegion)
+		assert.Equal(t, []string{"eu", "us"}, policy.AllowedRegions)
+		assert.Equal(t, app.RegionReadsMerge, policy.Reads)
+	})
+
+	t.Run("Reads", func(t *testing.T) {
+		service := newService(t)
+		track(t, service, "web", "us")
+		track(t, service, "web", "eu")
+		track(t, service, "web", "eu")
+		track(t, service, "eu-shop", "eu")
+
+		query := func(projectID, region string) int {
+			ctx := app.ContextWithRegion(app.ContextWithProject(context.Background(), projectID), region)
+			return len(service.QueryEvents(ctx, app.EventFilter{ProjectID: projectID}))
+		}
+		assert.Equal(t, 3, query("web", ""), "Reads should merge every region by default")
+		assert.Equal(t, 2, query("web", "eu"), "Reads should be narrowed to the requested region")
+		assert.Equal(t, 1, query("eu-shop", ""))
+		assert.Equal(t, 0, query("eu-shop", "us"), "Restricted projects should not read regions they do not allow")
+		assert.Equal(t, int64(4), service.EventCount())
+
+		report, err := service.Rollups().Query(app.RollupQuery{ProjectID: "web", Dimension: app.RollupPage, Start: day, End: day.Add(24 * time.Hour), Regions: []string{"us"}})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), report.TotalEvents)
+
+		queryService := app.NewQueryService(service)
+		ctx := app.ContextWithRegion(app.ContextWithProject(context.Background(), "web"), "eu")
+		trend, err := queryService.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "day", Start: day, End: day.Add(24 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "rollups", trend.Source)
+		assert.Equal(t, int64(2), trend.TotalEvents)
+		trend, err = queryService.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "hour", Start: day, End: day.Add(24 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), trend.TotalEvents, "Trends scanning events should see the same regions")
+
+		result := service.RebuildRollups("", time.Time{}, time.Time{})
+		assert.Equal(t, int64(4), result.Events, "Rebuilds should read every region")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		t.Setenv("EVENT_REGIONS", "us,eu")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+		assert.NoError(t, application.GetAdminAuth().AddToken("root", "admin-token", app.RoleAdmin))
+
+		send := func(method, path, projectID, region, token, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Project-ID", projectID)
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			if region != "" {
+				req.Header.Set("X-Region", region)
+			}
+			if token != "" {
+				req.Header.Set("X-Admin-Token", token)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+
+		policy := `{"home_region":"eu","allowed_regions":["eu"],"reads":"restrict"}`
+		status, _ := send("PUT", "/api/v1/admin/projects/eu-shop/region-policy", "", "", "viewer-token", policy)
+		assert.Equal(t, 403, status)
+		status, _ = send("PUT", "/api/v1/admin/projects/eu-shop/region-policy", "", "", "admin-token", `{"home_region":"mars"}`)
+		assert.Equal(t, 400, status)
+		status, body := send("PUT", "/api/v1/admin/projects/eu-shop/region-policy", "", "", "admin-token", policy)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "restrict", body["policy"].(map[string]interface{})["reads"])
+		assert.Equal(t, 1, len(application.GetAuditLog().Entries("project.region_policy", 10)))
+
+		status, body = send("POST", "/api/v1/analytics/events", "eu-shop", "us", "", `{"event_type":"page_view","user_id":"user1"}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "eu", body["region"])
+		status, body = send("POST", "/api/v1/analytics/events", "web", "eu", "", `{"event_type":"page_view","user_id":"user1"}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "eu", body["region"])
+		status, _ = send("POST", "/api/v1/analytics/events", "web", "apac", "", `{"event_type":"page_view","user_id":"user1"}`)
+		assert.Equal(t, 400, status)
+
+		status, body = send("GET", "/api/v1/trends?event_type=page_view&interval=hour", "eu-shop", "", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(1), body["result"].(map[string]interface{})["total_events"])
+		status, _ = send("GET", "/api/v1/trends?event_type=page_view&interval=hour", "eu-shop", "us", "", "")
+		assert.Equal(t, 403, status, "Reads of a region the project does not allow should be rejected")
+		status, body = send("GET", "/api/v1/trends?event_type=page_view&interval=hour&region=us", "web", "", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(0), body["result"].(map[string]interface{})["total_events"])
+
+		status, body = send("GET", "/api/v1/admin/regions", "", "", "viewer-token", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, []interface{}{"us", "eu"}, body["regions"])
+		assert.Equal(t, 1, len(body["policies"].([]interface{})))
+		status, body = send("GET", "/api/v1/admin/projects/web/region-policy", "", "", "viewer-token", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "us", body["policy"].(map[string]interface{})["home_region"])
+	})
+}
@@ -0,0 +1,127 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestEventRetention tests retention overrides per event type, purging and storage estimates
+func TestEventRetention(t *testing.T) {
+	track := func(service *app.AnalyticsService, eventType string, count int) {
+		for i := 0; i < count; i++ {
+			_, err := service.TrackEvent(context.Background(), map[string]interface{}{
+				"event_type": eventType,
+				"user_id":    "user1",
+			}, "test-key", "user1")
+			assert.NoError(t, err)
+		}
+	}
+
+	t.Run("PurgesByEventType", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		assert.NoError(t, service.Retention().ReplaceOverrides(map[string]time.Duration{
+			"mouse_move": 7 * 24 * time.Hour,
+			"conversion": 730 * 24 * time.Hour,
+		}))
+		track(service, "mouse_move", 3)
+		track(service, "conversion", 2)
+
+		result := service.PurgeExpiredEvents(time.Now().Add(8 * 24 * time.Hour))
+		assert.Equal(t, int64(3), result.Purged)
+		assert.Equal(t, int64(3), result.PurgedByType["mouse_move"])
+		assert.Equal(t, int64(2), service.EventCount())
+
+		// Conversions outlive the one-year default
+		result = service.PurgeExpiredEvents(time.Now().Add(400 * 24 * time.Hour))
+		assert.Equal(t, int64(0), result.Purged)
+		result = service.PurgeExpiredEvents(time.Now().Add(731 * 24 * time.Hour))
+		assert.Equal(t, int64(2), result.Purged)
+	})
+
+	t.Run("StorageEstimateReflectsRetention", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		track(service, "mouse_move", 10)
+		track(service, "conversion", 10)
+
+		before := service.EstimateStorage(time.Now())
+		assert.NoError(t, service.Retention().ReplaceOverrides(map[string]time.Duration{"mouse_move": 7 * 24 * time.Hour}))
+		after := service.EstimateStorage(time.Now())
+
+		usage := func(estimate app.StorageEstimate, eventType string) app.EventTypeStorageUsage {
+			for _, entry := range estimate.EventTypes {
+				if entry.EventType == eventType {
+					return entry
+				}
+			}
+			t.Fatalf("no estimate for %s", eventType)
+			return app.EventTypeStorageUsage{}
+		}
+
+		assert.Equal(t, "365d", usage(before, "mouse_move").Retention)
+		assert.Equal(t, "7d", usage(after, "mouse_move").Retention)
+		assert.Less(t, usage(after, "mouse_move").ProjectedBytes, usage(before, "mouse_move").ProjectedBytes)
+		assert.Equal(t, usage(before, "conversion").ProjectedBytes, usage(after, "conversion").ProjectedBytes)
+		assert.Less(t, after.MonthlyCost, before.MonthlyCost)
+	})
+
+	t.Run("RejectsInvalidRetention", func(t *testing.T) {
+		policy := app.NewRetentionPolicy()
+		assert.Error(t, policy.SetDefaultTTL(0))
+		assert.Error(t, policy.ReplaceOverrides(map[string]time.Duration{"mouse_move": -time.Hour}))
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+
+		req := httptest.NewRequest("PUT", "/api/v1/admin/runtime/retention.overrides", strings.NewReader(`{"value":{"mouse_move":"7d"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", "*")
+		req.Header.Set("X-Admin-Token", "operator-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 7*24*time.Hour, application.GetAnalyticsService().Retention().TTL("mouse_move"))
+
+		req = httptest.NewRequest("PUT", "/api/v1/admin/runtime/retention.default", strings.NewReader(`{"value":"1w"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", "*")
+		req.Header.Set("X-Admin-Token", "operator-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+
+		req = httptest.NewRequest("POST", "/api/v1/admin/retention/purge", nil)
+		req.Header.Set("X-Admin-Token", "operator-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 1, len(application.GetAuditLog().Entries("retention.purge", 1)))
+
+		req = httptest.NewRequest("GET", "/api/v1/admin/retention", nil)
+		req.Header.Set("X-Admin-Token", "operator-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			DefaultRetention string            `json:"default_retention"`
+			Overrides        map[string]string `json:"overrides"`
+			LastPurge        *app.PurgeResult  `json:"last_purge"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "365d", body.DefaultRetention)
+		assert.Equal(t, "7d", body.Overrides["mouse_move"])
+		assert.NotNil(t, body.LastPurge)
+	})
+}
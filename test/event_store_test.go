@@ -0,0 +1,203 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// failingEventStore is an event store whose writes and queries fail while failing is set
+type failingEventStore struct {
+	*app.MemoryEventStore
+	failing bool
+}
+
+// Insert fails while failing is set
+func (s *failingEventStore) Insert(ctx context.Context, events []*app.AnalyticsEvent) error {
+	if s.failing {
+		return fmt.Errorf("store unavailable")
+	}
+	return s.MemoryEventStore.Insert(ctx, events)
+}
+
+// Query fails while failing is set
+func (s *failingEventStore) Query(ctx context.Context, filter app.EventStoreFilter) ([]*app.AnalyticsEvent, error) {
+	if s.failing {
+		return nil, fmt.Errorf("store unavailable")
+	}
+	return s.MemoryEventStore.Query(ctx, filter)
+}
+
+// slowEventStore is an event store taking a while to read the events it inserts
+type slowEventStore struct {
+	*app.MemoryEventStore
+}
+
+// Insert reads every event of the batch slowly before storing them
+func (s *slowEventStore) Insert(ctx context.Context, events []*app.AnalyticsEvent) error {
+	for _, event := range events {
+		_ = event.ID
+		time.Sleep(time.Microsecond)
+	}
+	return s.MemoryEventStore.Insert(ctx, events)
+}
+
+// TestEventStore tests writing stored events to a durable event store in batches, serving usage
+// from it and reloading its events after a restart
+func TestEventStore(t *testing.T) {
+	t.Setenv("EVENT_STORE_FLUSH_INTERVAL", "1h")
+	day := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	newService := func(store app.EventStore) *app.AnalyticsService {
+		service := app.NewAnalyticsService()
+		service.SetClock(app.NewFakeClock(day))
+		service.SetEventStore(store)
+		t.Cleanup(func() { _ = service.CloseEventStore() })
+		return service
+	}
+	track := func(service *app.AnalyticsService, eventType, userID string, count int) {
+		for i := 0; i < count; i++ {
+			_, err := service.TrackEvent(context.Background(), map[string]interface{}{"event_type": eventType, "user_id": userID}, "test-key", userID)
+			assert.NoError(t, err)
+		}
+	}
+
+	t.Run("WritesAndServesUsage", func(t *testing.T) {
+		store := app.NewMemoryEventStore()
+		service := newService(store)
+		track(service, "page_view", "user1", 3)
+		track(service, "click", "user2", 1)
+		assert.Equal(t, 4, service.EventWriter().Stats().Pending)
+		assert.Equal(t, 0, store.Len(), "Events should be written in batches")
+
+		assert.Equal(t, 4, service.EventWriter().Flush())
+		assert.Equal(t, 4, store.Len())
+		track(service, "click", "user1", 2)
+
+		usage, err := service.GetUsage(context.Background(), "user1", "2024-02-29", "2024-03-01")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), usage.TotalEvents, "Written and pending events should both be counted once")
+		assert.Equal(t, map[string]int64{"page_view": 3, "click": 2}, usage.EventsByType)
+
+		events, err := store.Query(context.Background(), app.EventStoreFilter{UserID: "user1", EventType: "page_view", Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, events, 2)
+		stats := service.EventWriter().Stats()
+		assert.Equal(t, int64(4), stats.Written)
+		assert.Equal(t, int64(1), stats.Batches)
+	})
+
+	t.Run("BatchSize", func(t *testing.T) {
+		t.Setenv("EVENT_STORE_BATCH_SIZE", "2")
+		store := app.NewMemoryEventStore()
+		service := newService(store)
+		track(service, "page_view", "user1", 5)
+
+		assert.Eventually(t, func() bool { return store.Len() >= 4 }, time.Second, 10*time.Millisecond, "Full batches should be written right away")
+		assert.NoError(t, service.CloseEventStore())
+		assert.Equal(t, 5, store.Len(), "Stopping should write the remaining events")
+	})
+
+	t.Run("ReloadsAfterRestart", func(t *testing.T) {
+		store := app.NewMemoryEventStore()
+		service := newService(store)
+		track(service, "page_view", "user1", 3)
+		assert.NoError(t, service.CloseEventStore())
+
+		restarted := newService(store)
+		loaded, err := restarted.LoadStoredEvents(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 3, loaded)
+		assert.Equal(t, int64(3), restarted.EventCount())
+		assert.Equal(t, 0, restarted.EventWriter().Stats().Pending, "Loaded events should not be written again")
+
+		loaded, err = restarted.LoadStoredEvents(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, loaded, "Events in memory should not be loaded twice")
+
+		usage, err := restarted.GetUsage(context.Background(), "user1", "2024-02-29", "2024-03-01")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), usage.TotalEvents)
+	})
+
+	t.Run("PurgeDeletes", func(t *testing.T) {
+		store := app.NewMemoryEventStore()
+		service := newService(store)
+		assert.NoError(t, service.Retention().ReplaceOverrides(map[string]time.Duration{"mouse_move": 7 * 24 * time.Hour}))
+		track(service, "mouse_move", "user1", 2)
+		service.EventWriter().Flush()
+		track(service, "mouse_move", "user1", 1)
+		track(service, "page_view", "user1", 1)
+
+		assert.Equal(t, int64(3), service.PurgeExpiredEvents(day.Add(8*24*time.Hour)).Purged)
+		usage, err := service.GetUsage(context.Background(), "user1", "2024-02-29", "2024-03-01")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), usage.TotalEvents, "Purged events should not be counted before they are deleted from the store")
+
+		service.EventWriter().Flush()
+		assert.Equal(t, 1, store.Len())
+	})
+
+	t.Run("RetriesFailedBatches", func(t *testing.T) {
+		t.Setenv("EVENT_STORE_MAX_PENDING", "3")
+		store := &failingEventStore{MemoryEventStore: app.NewMemoryEventStore(), failing: true}
+		service := newService(store)
+		track(service, "page_view", "user1", 4)
+
+		assert.Equal(t, 0, service.EventWriter().Flush())
+		stats := service.EventWriter().Stats()
+		assert.Equal(t, 3, stats.Pending)
+		assert.Equal(t, int64(1), stats.Dropped, "The oldest events should be dropped beyond the maximum")
+		assert.Equal(t, int64(1), stats.FailedBatches)
+
+		_, err := service.GetUsage(context.Background(), "user1", "2024-02-29", "2024-03-01")
+		assert.Error(t, err)
+
+		store.failing = false
+		assert.Equal(t, 3, service.EventWriter().Flush())
+		assert.Equal(t, 3, store.Len())
+	})
+
+	t.Run("ConcurrentDeletesAndFlushes", func(t *testing.T) {
+		t.Setenv("EVENT_STORE_BATCH_SIZE", "50")
+		store := &slowEventStore{MemoryEventStore: app.NewMemoryEventStore()}
+		writer := app.NewEventWriter(store)
+		for i := 0; i < 500; i++ {
+			writer.Add(&app.AnalyticsEvent{ID: fmt.Sprintf("event-%d", i), EventType: "page_view", Timestamp: day})
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 500; i += 2 {
+				writer.Delete([]string{fmt.Sprintf("event-%d", i)})
+			}
+		}()
+		writer.Flush()
+		<-done
+		writer.Flush()
+
+		assert.Equal(t, 0, writer.Stats().Pending)
+		stored, err := store.Query(context.Background(), app.EventStoreFilter{})
+		assert.NoError(t, err)
+		for _, event := range stored {
+			assert.NotNil(t, event, "Batches should not be changed by deletions while written")
+		}
+	})
+
+	t.Run("FromEnv", func(t *testing.T) {
+		t.Setenv("EVENT_STORE_URL", "")
+		store, err := app.NewEventStoreFromEnv()
+		assert.NoError(t, err)
+		assert.Nil(t, store, "Events should only be kept in memory without a store")
+
+		t.Setenv("EVENT_STORE_URL", "mysql://localhost/analytics")
+		_, err = app.NewEventStoreFromEnv()
+		assert.ErrorContains(t, err, "unsupported event store")
+	})
+}
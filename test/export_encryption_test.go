@@ -0,0 +1,381 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"magebase/apis/analytics/app"
+)
+
+// encodeAgeRecipient encodes an X25519 public key as an age recipient, in Bech32
+func encodeAgeRecipient(publicKey []byte) string {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	var values []byte
+	var accumulator, bits uint
+	for _, b := range publicKey {
+		accumulator = accumulator<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(accumulator>>bits&31))
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(accumulator<<(5-bits)&31))
+	}
+
+	polymod := func(values []byte) uint32 {
+		generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+		checksum := uint32(1)
+		for _, value := range values {
+			top := checksum >> 25
+			checksum = (checksum&0x1ffffff)<<5 ^ uint32(value)
+			for i := 0; i < 5; i++ {
+				if (top>>i)&1 == 1 {
+					checksum ^= generator[i]
+				}
+			}
+		}
+		return checksum
+	}
+	checked := append([]byte{3, 3, 3, 0, 1, 7, 5}, values...) // Expanded "age" prefix
+	checksum := polymod(append(checked, 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(checksum>>(5*(5-i))&31))
+	}
+
+	encoded := "age1"
+	for _, value := range values {
+		encoded += string(charset[value])
+	}
+	return encoded
+}
+
+// ageKey derives a key of the age format with HKDF-SHA256
+func ageKey(t *testing.T, secret, salt []byte, info string) []byte {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	assert.NoError(t, err)
+	return key
+}
+
+// decryptAge decrypts an age file with an X25519 identity, following age-encryption.org/v1
+func decryptAge(t *testing.T, identity *ecdh.PrivateKey, file []byte) ([]byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(file))
+	var header strings.Builder
+	readLine := func() (string, error) {
+		line, err := reader.ReadString('\n')
+		header.WriteString(line)
+		return strings.TrimSuffix(line, "\n"), err
+	}
+	if version, err := readLine(); err != nil || version != "age-encryption.org/v1" {
+		return nil, fmt.Errorf("not an age file")
+	}
+
+	var fileKey []byte
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "--- ") {
+			break
+		}
+		args := strings.Fields(strings.TrimPrefix(line, "-> "))
+		var body string
+		for {
+			bodyLine, err := readLine()
+			if err != nil {
+				return nil, err
+			}
+			body += bodyLine
+			if len(bodyLine) < 64 {
+				break
+			}
+		}
+		if len(args) != 2 || args[0] != "X25519" || fileKey != nil {
+			continue
+		}
+
+		share, _ := base64.RawStdEncoding.DecodeString(args[1])
+		wrapped, _ := base64.RawStdEncoding.DecodeString(body)
+		sharePublicKey, err := ecdh.X25519().NewPublicKey(share)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := identity.ECDH(sharePublicKey)
+		if err != nil {
+			return nil, err
+		}
+		aead, _ := chacha20poly1305.New(ageKey(t, secret, append(share, identity.PublicKey().Bytes()...), "age-encryption.org/v1/X25519"))
+		if key, err := aead.Open(nil, make([]byte, 12), wrapped, nil); err == nil {
+			fileKey = key
+		}
+	}
+	if fileKey == nil {
+		return nil, fmt.Errorf("no stanza for the identity")
+	}
+
+	headerText := header.String()
+	macLine := headerText[strings.LastIndex(headerText, "--- "):]
+	expectedMAC, _ := base64.RawStdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(macLine, "--- ")))
+	mac := hmac.New(sha256.New, ageKey(t, fileKey, nil, "header"))
+	mac.Write([]byte(headerText[:len(headerText)-len(macLine)+3]))
+	if !hmac.Equal(mac.Sum(nil), expectedMAC) {
+		return nil, fmt.Errorf("invalid header MAC")
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(reader, nonce); err != nil {
+		return nil, err
+	}
+	aead, _ := chacha20poly1305.New(ageKey(t, fileKey, nonce, "payload"))
+	payload, _ := io.ReadAll(reader)
+	var plaintext []byte
+	for counter := uint64(0); ; counter++ {
+		size := min(len(payload), 64*1024+16)
+		chunkNonce := make([]byte, 12)
+		binary.BigEndian.PutUint64(chunkNonce[3:11], counter)
+		if size == len(payload) {
+			chunkNonce[11] = 1
+		}
+		chunk, err := aead.Open(nil, chunkNonce, payload[:size], nil)
+		if err != nil {
+			return nil, err
+		}
+		plaintext = append(plaintext, chunk...)
+		payload = payload[size:]
+		if len(payload) == 0 {
+			return plaintext, nil
+		}
+	}
+}
+
+// TestExportEncryption tests encrypting exports to the age public keys registered per project
+func TestExportEncryption(t *testing.T) {
+	security, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	auditor, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	outsider, err := ecdh.X25519().GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	recipients := []app.ExportRecipient{
+		{Name: "security-team", PublicKey: encodeAgeRecipient(security.PublicKey().Bytes())},
+		{Name: "auditor", PublicKey: encodeAgeRecipient(auditor.PublicKey().Bytes())},
+	}
+
+	t.Run("RejectsInvalidKeys", func(t *testing.T) {
+		keys := app.NewExportKeys()
+		valid := recipients[0].PublicKey
+		for _, invalid := range [][]app.ExportRecipient{
+			{{Name: "", PublicKey: valid}},
+			{{Name: "a", PublicKey: valid}, {Name: "a", PublicKey: valid}},
+			{{Name: "a", PublicKey: "ssh-ed25519 AAAA"}},
+			{{Name: "a", PublicKey: valid[:len(valid)-1] + "q"}},
+			{{Name: "a", PublicKey: "age1"}},
+		} {
+			_, err := keys.Replace("web", invalid, false, 0)
+			assert.Error(t, err, invalid)
+		}
+		_, err := keys.Replace("web", nil, true, 0)
+		assert.Error(t, err, "Encryption should not be required without recipients")
+
+		_, err = keys.Replace("web", []app.ExportRecipient{{Name: "legacy", PublicKey: "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nmQINBF...\n-----END PGP PUBLIC KEY BLOCK-----"}}, false, 0)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "PGP public keys are not supported")
+		}
+
+		// The recipient of the age documentation
+		updated, err := keys.Replace("web", []app.ExportRecipient{{Name: "docs", PublicKey: "age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"}}, false, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), updated.Version)
+
+		_, err = keys.Encrypt("shop", io.Discard)
+		assert.Error(t, err, "Projects without export keys cannot encrypt exports")
+	})
+
+	t.Run("EncryptsToEveryRecipient", func(t *testing.T) {
+		keys := app.NewExportKeys()
+		updated, err := keys.Replace("web", recipients, false, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "auditor", updated.Recipients[0].Name, "Recipients should be ordered by name")
+
+		for _, size := range []int{0, 100, 64 * 1024, 200*1024 + 7} {
+			plaintext := make([]byte, size)
+			_, _ = rand.Read(plaintext)
+
+			var encrypted bytes.Buffer
+			writer, err := keys.Encrypt("web", &encrypted)
+			assert.NoError(t, err)
+			// Write in uneven pieces to cross chunk boundaries
+			for remaining := plaintext; len(remaining) > 0; {
+				n := min(len(remaining), 10007)
+				_, err := writer.Write(remaining[:n])
+				assert.NoError(t, err)
+				remaining = remaining[n:]
+			}
+			assert.NoError(t, writer.Close())
+
+			for _, identity := range []*ecdh.PrivateKey{security, auditor} {
+				decrypted, err := decryptAge(t, identity, encrypted.Bytes())
+				assert.NoError(t, err, size)
+				assert.True(t, bytes.Equal(plaintext, decrypted), size)
+			}
+			_, err = decryptAge(t, outsider, encrypted.Bytes())
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("DecryptsWithAge", func(t *testing.T) {
+		agePath, err := exec.LookPath("age")
+		if err != nil {
+			t.Skip("age is not installed")
+		}
+		keygenPath, err := exec.LookPath("age-keygen")
+		if err != nil {
+			t.Skip("age-keygen is not installed")
+		}
+
+		identityFile := filepath.Join(t.TempDir(), "key.txt")
+		assert.NoError(t, exec.Command(keygenPath, "-o", identityFile).Run())
+		identity, err := os.ReadFile(identityFile)
+		assert.NoError(t, err)
+		var publicKey string
+		for _, line := range strings.Split(string(identity), "\n") {
+			if strings.HasPrefix(line, "# public key: ") {
+				publicKey = strings.TrimPrefix(line, "# public key: ")
+			}
+		}
+
+		keys := app.NewExportKeys()
+		_, err = keys.Replace("web", append([]app.ExportRecipient{{Name: "age", PublicKey: publicKey}}, recipients...), false, 0)
+		assert.NoError(t, err)
+
+		for _, size := range []int{0, 100, 64 * 1024, 200*1024 + 7} {
+			plaintext := make([]byte, size)
+			_, _ = rand.Read(plaintext)
+			encrypted, err := keys.Seal("web", plaintext)
+			assert.NoError(t, err)
+
+			command := exec.Command(agePath, "--decrypt", "-i", identityFile)
+			command.Stdin = bytes.NewReader(encrypted)
+			decrypted, err := command.Output()
+			assert.NoError(t, err, size)
+			assert.True(t, bytes.Equal(plaintext, decrypted), size)
+		}
+	})
+
+	t.Run("EncryptsSecurityEvents", func(t *testing.T) {
+		collector := newSIEMCollector(0)
+		defer collector.server.Close()
+		t.Setenv("SIEM_ENDPOINT", collector.server.URL)
+
+		keys := app.NewExportKeys()
+		_, err := keys.Replace("web", recipients, true, 0)
+		assert.NoError(t, err)
+		_, err = keys.Replace("shop", recipients, false, 0)
+		assert.NoError(t, err)
+
+		exporter := app.NewSIEMExporter()
+		exporter.SetExportKeys(keys)
+		for _, projectID := range []string{"web", "shop"} {
+			exporter.Export(app.SecurityEvent{Category: app.SecurityExport, Action: "heatmap_data_exported", Details: map[string]interface{}{
+				"project_id": projectID,
+				"heatmap_id": "checkout",
+			}})
+		}
+		exporter.Stop()
+
+		events := collector.received()
+		assert.Equal(t, 2, len(events))
+		details := events[0]["details"].(map[string]interface{})
+		assert.Equal(t, "web", details["project_id"], "The project should stay readable to route the event")
+		assert.Nil(t, details["heatmap_id"], "Projects requiring encryption should not export plaintext details")
+		encrypted, err := base64.StdEncoding.DecodeString(details["encrypted_details"].(string))
+		assert.NoError(t, err)
+		decrypted, err := decryptAge(t, security, encrypted)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"project_id":"web","heatmap_id":"checkout"}`, string(decrypted))
+
+		details = events[1]["details"].(map[string]interface{})
+		assert.Equal(t, "checkout", details["heatmap_id"], "Encryption should only be applied to projects requiring it")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, ifMatch, body string) (int, string, []byte) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp.StatusCode, resp.Header.Get("Content-Type"), content
+		}
+		encoded, err := json.Marshal(map[string]interface{}{"recipients": recipients})
+		assert.NoError(t, err)
+
+		status, _, _ := send("GET", "/api/v1/projects/web/config?encrypt=true", "", "")
+		assert.Equal(t, 400, status, "Projects without export keys cannot encrypt exports")
+
+		status, _, _ = send("PUT", "/api/v1/projects/web/export-keys", "", `{"recipients":[{"name":"a","public_key":"age1invalid"}]}`)
+		assert.Equal(t, 400, status)
+		status, _, _ = send("PUT", "/api/v1/projects/web/export-keys", "", string(encoded))
+		assert.Equal(t, 200, status)
+		status, _, _ = send("PUT", "/api/v1/projects/web/export-keys", "", string(encoded))
+		assert.Equal(t, 428, status)
+
+		status, _, content := send("GET", "/api/v1/projects/web/export-keys", "", "")
+		assert.Equal(t, 200, status)
+		assert.Contains(t, string(content), `"required":false`)
+
+		status, contentType, content := send("GET", "/api/v1/projects/web/config", "", "")
+		assert.Equal(t, 200, status)
+		assert.Contains(t, contentType, "application/json", "Exports should only be encrypted when requested")
+
+		status, contentType, content = send("GET", "/api/v1/projects/web/config?encrypt=true&format=yaml", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, app.ExportContentType, contentType)
+		decrypted, err := decryptAge(t, security, content)
+		assert.NoError(t, err)
+		assert.Contains(t, string(decrypted), "project: web")
+
+		required, err := json.Marshal(map[string]interface{}{"recipients": recipients, "required": true})
+		assert.NoError(t, err)
+		status, _, _ = send("PUT", "/api/v1/projects/web/export-keys", `"1"`, string(required))
+		assert.Equal(t, 200, status)
+		status, contentType, content = send("GET", "/api/v1/projects/web/config", "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, app.ExportContentType, contentType, "Projects requiring encryption should only export encrypted documents")
+		decrypted, err = decryptAge(t, auditor, content)
+		assert.NoError(t, err)
+		assert.True(t, json.Valid(decrypted))
+	})
+}
@@ -0,0 +1,174 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+	"magebase/apis/analytics/billingstub"
+)
+
+// TestFaultInjection tests injecting latency and errors into the billing client, the event store
+// and the Kafka consumer
+func TestFaultInjection(t *testing.T) {
+	t.Run("Rules", func(t *testing.T) {
+		disabled := app.NewFaultInjector()
+		assert.False(t, disabled.Enabled(), "Fault injection should be disabled by default")
+		_, err := disabled.SetRule(app.FaultRule{Dependency: app.FaultBilling, ErrorRate: 1}, 0)
+		assert.Error(t, err)
+
+		t.Setenv("FAULT_INJECTION_ENABLED", "true")
+		t.Setenv("ENVIRONMENT", "production")
+		assert.False(t, app.NewFaultInjector().Enabled(), "Fault injection should not be enabled in production")
+		t.Setenv("ENVIRONMENT", "staging")
+
+		clock := app.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		faults := app.NewFaultInjector()
+		faults.SetClock(clock)
+		assert.True(t, faults.Enabled())
+
+		for _, invalid := range []app.FaultRule{
+			{Dependency: "database", ErrorRate: 1},
+			{Dependency: app.FaultBilling, ErrorRate: 1.5},
+			{Dependency: app.FaultBilling, LatencyMs: -1},
+			{Dependency: app.FaultBilling},
+		} {
+			_, err := faults.SetRule(invalid, 0)
+			assert.Error(t, err, invalid)
+		}
+
+		// Half of the calls fail: partial failures
+		randoms := []float64{0.1, 0.9}
+		faults.SetRandom(func() float64 {
+			value := randoms[0]
+			randoms = randoms[1:]
+			return value
+		})
+		rule, err := faults.SetRule(app.FaultRule{Dependency: app.FaultBilling, ErrorRate: 0.5, Error: "billing is down"}, 10*time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, clock.Now().Add(10*time.Minute), rule.ExpiresAt)
+		err = faults.Inject(app.FaultBilling, "usage")
+		var injected *app.InjectedFaultError
+		assert.True(t, errors.As(err, &injected))
+		assert.Equal(t, "billing is down", injected.Message)
+		assert.NoError(t, faults.Inject(app.FaultBilling, "event"))
+		assert.NoError(t, faults.Inject(app.FaultStore, "write"), "Other dependencies should not be affected")
+		assert.Equal(t, int64(2), faults.Rules()[0].Injected)
+
+		// Rules of an operation take precedence and can be limited to a number of calls
+		_, err = faults.SetRule(app.FaultRule{Dependency: app.FaultBilling, Operation: "event", LatencyMs: 20, Remaining: 1}, 0)
+		assert.NoError(t, err)
+		started := time.Now()
+		assert.NoError(t, faults.Inject(app.FaultBilling, "event"))
+		assert.GreaterOrEqual(t, time.Since(started), 20*time.Millisecond, "Latency should be injected")
+		assert.Equal(t, 1, len(faults.Rules()), "Rules should be removed once their calls are used up")
+
+		clock.Advance(10 * time.Minute)
+		assert.Empty(t, faults.Rules(), "Rules should expire")
+		assert.NoError(t, faults.Inject(app.FaultBilling, "usage"))
+	})
+
+	t.Run("Dependencies", func(t *testing.T) {
+		t.Setenv("FAULT_INJECTION_ENABLED", "true")
+		stub := billingstub.NewServer()
+		defer stub.Close()
+		t.Setenv("BILLING_SERVICE_URL", stub.URL())
+		service := app.NewAnalyticsService()
+		faults := app.NewFaultInjector()
+		service.SetFaultInjector(faults)
+		track := func() (*app.AnalyticsEvent, error) {
+			return service.TrackEvent(context.Background(), map[string]interface{}{"event_type": "page_view", "user_id": "user1"}, "test-key", "user1")
+		}
+
+		// The usage record is sent but the billing event fails
+		_, err := faults.SetRule(app.FaultRule{Dependency: app.FaultBilling, Operation: "event", ErrorRate: 1}, 0)
+		assert.NoError(t, err)
+		event, err := track()
+		assert.NoError(t, err)
+		assert.Equal(t, app.BillingFailed, event.BillingStatus)
+		assert.Equal(t, 1, len(stub.Requests()))
+		assert.Equal(t, billingstub.UsagePath, stub.Requests()[0].Path)
+
+		// Events failing to be stored are accepted into the ingestion log instead
+		_, err = faults.SetRule(app.FaultRule{Dependency: app.FaultStore, ErrorRate: 1}, 0)
+		assert.NoError(t, err)
+		event, err = track()
+		assert.NoError(t, err)
+		assert.True(t, event.Queued)
+		assert.Equal(t, int64(1), service.EventCount())
+
+		faults.Clear()
+		event, err = track()
+		assert.NoError(t, err)
+		assert.Equal(t, app.BillingRecorded, event.BillingStatus)
+		drained, err := service.RecoverIngestion(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, drained)
+		assert.Equal(t, int64(3), service.EventCount())
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		newApp := func(t *testing.T) *app.App {
+			application := app.NewApp("8080")
+			application.SetupRoutes()
+			assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+			assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+			return application
+		}
+		send := func(application *app.App, method, path, token, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Admin-Token", token)
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+		rule := `{"operation":"event","error_rate":1,"error":"billing is down","duration":"5m"}`
+
+		disabled := newApp(t)
+		defer disabled.Stop()
+		status, _ := send(disabled, "PUT", "/api/v1/admin/faults/billing", "operator-token", rule)
+		assert.Equal(t, 403, status, "Faults should not be injected unless enabled")
+
+		t.Setenv("FAULT_INJECTION_ENABLED", "true")
+		application := newApp(t)
+		defer application.Stop()
+
+		status, _ = send(application, "PUT", "/api/v1/admin/faults/billing", "viewer-token", rule)
+		assert.Equal(t, 403, status)
+		status, _ = send(application, "PUT", "/api/v1/admin/faults/billing", "operator-token", `{"error_rate":1,"duration":"soon"}`)
+		assert.Equal(t, 400, status)
+		status, body := send(application, "PUT", "/api/v1/admin/faults/billing", "operator-token", rule)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "event", body["rule"].(map[string]interface{})["operation"])
+
+		status, body = send(application, "GET", "/api/v1/admin/faults", "viewer-token", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, true, body["enabled"])
+		assert.Equal(t, 1, len(body["rules"].([]interface{})))
+
+		event, err := application.GetAnalyticsService().TrackEvent(context.Background(), map[string]interface{}{"event_type": "page_view", "user_id": "user1"}, "test-key", "user1")
+		assert.NoError(t, err)
+		assert.Equal(t, app.BillingFailed, event.BillingStatus)
+
+		status, _ = send(application, "DELETE", "/api/v1/admin/faults/billing", "operator-token", "")
+		assert.Equal(t, 404, status, "The rule is scoped to the event operation")
+		status, _ = send(application, "DELETE", "/api/v1/admin/faults/billing?operation=event", "operator-token", "")
+		assert.Equal(t, 200, status)
+		status, body = send(application, "DELETE", "/api/v1/admin/faults", "operator-token", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(0), body["cleared"])
+
+		assert.Equal(t, 1, len(application.GetAuditLog().Entries("faults.set", 10)))
+		assert.Equal(t, 2, len(application.GetAuditLog().Entries("faults.clear", 10)))
+	})
+}
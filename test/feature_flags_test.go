@@ -0,0 +1,117 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestFeatureFlags tests features packaged into plans and overridden per project
+func TestFeatureFlags(t *testing.T) {
+	t.Run("Plans", func(t *testing.T) {
+		t.Setenv("FEATURES_PRO", "heatmaps, exports,teleport")
+		flags := app.NewFeatureFlags()
+
+		assert.True(t, flags.Enabled("web", app.FeatureExperiments), "Projects without a plan should use every feature")
+
+		assert.NoError(t, flags.SetProject("web", "pro", nil))
+		assert.True(t, flags.Enabled("web", app.FeatureExports))
+		assert.False(t, flags.Enabled("web", app.FeatureSessionReplay), "FEATURES_PRO should replace the default features")
+		assert.Equal(t, []string{"exports", "heatmaps"}, flags.PlanFeatures()["pro"], "Unknown features should be ignored")
+		assert.Equal(t, []string{"heatmaps"}, flags.PlanFeatures()["free"])
+
+		assert.NoError(t, flags.SetProject("web", "free", map[string]bool{app.FeatureExports: true, app.FeatureHeatmaps: false}))
+		project := flags.Project("web")
+		assert.Equal(t, "free", project.Plan)
+		assert.Equal(t, map[string]bool{"experiments": false, "exports": true, "heatmaps": false, "session_replay": false}, project.Features)
+		assert.Equal(t, map[string]bool{"exports": true, "heatmaps": false}, project.Overrides)
+
+		assert.Error(t, flags.SetProject("web", "platinum", nil))
+		assert.Error(t, flags.SetProject("web", "free", map[string]bool{"teleport": true}))
+		assert.Equal(t, "free", flags.Project("web").Plan, "Rejected updates should change nothing")
+
+		assert.NoError(t, flags.SetProject("web", "", nil))
+		assert.True(t, flags.Enabled("web", app.FeatureHeatmaps))
+		assert.Nil(t, flags.Project("web").Overrides)
+	})
+
+	t.Run("DefaultPlan", func(t *testing.T) {
+		t.Setenv("FEATURE_DEFAULT_PLAN", "free")
+		flags := app.NewFeatureFlags()
+
+		assert.Equal(t, "free", flags.Project("").Plan)
+		assert.True(t, flags.Enabled("", app.FeatureHeatmaps))
+		assert.False(t, flags.Enabled("", app.FeatureExports))
+		assert.False(t, flags.Enabled("web", "teleport"))
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+		assert.NoError(t, application.GetAdminAuth().AddToken("root", "admin-token", app.RoleAdmin))
+
+		request := func(method, path, body, token string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Project-ID", "web")
+			if token != "" {
+				req.Header.Set("X-Admin-Token", token)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			_ = json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp.StatusCode, decoded
+		}
+
+		status, _ := request("GET", "/api/v1/heatmaps/", "", "")
+		assert.Equal(t, 200, status)
+
+		status, _ = request("PUT", "/api/v1/admin/projects/web/features", `{"plan":"free"}`, "operator-token")
+		assert.Equal(t, 403, status, "Setting features should require admin")
+		status, body := request("PUT", "/api/v1/admin/projects/web/features", `{"plan":"free","overrides":{"heatmaps":false}}`, "admin-token")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "free", body["features"].(map[string]interface{})["plan"])
+		status, _ = request("PUT", "/api/v1/admin/projects/web/features", `{"plan":"platinum"}`, "admin-token")
+		assert.Equal(t, 400, status)
+
+		status, body = request("GET", "/api/v1/heatmaps/", "", "")
+		assert.Equal(t, 403, status)
+		assert.Equal(t, map[string]interface{}{"error": "feature not enabled", "feature": "heatmaps", "project_id": "web", "plan": "free"}, body)
+
+		// Every export route is rejected, even with heatmaps enabled
+		status, _ = request("PUT", "/api/v1/admin/projects/web/features", `{"plan":"free"}`, "admin-token")
+		assert.Equal(t, 200, status)
+		for _, path := range []string{"/api/v1/heatmaps/missing/data", "/api/v1/projects/web/config", "/API/v1/Projects/web/config"} {
+			status, body = request("GET", path, "", "")
+			assert.Equal(t, 403, status, path)
+			assert.Equal(t, "exports", body["feature"], path)
+			assert.Equal(t, "web", body["project_id"], path)
+		}
+		status, _ = request("GET", "/api/v1/projects/mobile/config", "", "")
+		assert.Equal(t, 200, status, "Other projects should keep their features")
+
+		status, _ = request("PUT", "/api/v1/admin/projects/web/features", `{"plan":"pro"}`, "admin-token")
+		assert.Equal(t, 200, status)
+		status, _ = request("GET", "/api/v1/heatmaps/", "", "")
+		assert.Equal(t, 200, status)
+		status, _ = request("GET", "/api/v1/projects/web/config", "", "")
+		assert.Equal(t, 200, status)
+
+		status, body = request("GET", "/api/v1/projects/web/features", "", "")
+		assert.Equal(t, 200, status)
+		features := body["features"].(map[string]interface{})
+		assert.Equal(t, "pro", features["plan"])
+		assert.Equal(t, map[string]interface{}{"experiments": false, "exports": true, "heatmaps": true, "session_replay": true}, features["features"])
+		assert.Contains(t, body["plans"], "enterprise")
+
+		assert.Len(t, application.GetAuditLog().Entries("project.features", 0), 3, "Rejected updates should not be audited")
+	})
+}
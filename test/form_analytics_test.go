@@ -0,0 +1,131 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestFormAnalytics tests form completion, per-field drop-off, time and error reports
+func TestFormAnalytics(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	t.Run("Report", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		forms := app.NewFormService(service)
+
+		track := func(eventType, userID string, properties map[string]interface{}) {
+			properties["form_id"] = "signup"
+			_, err := service.TrackEvent(ctx, map[string]interface{}{
+				"event_type": eventType,
+				"user_id":    userID,
+				"properties": properties,
+			}, "test-key", userID)
+			assert.NoError(t, err)
+		}
+		// Interactions are a second apart, events at the same time have no defined order
+		fill := func(userID, field string, duration time.Duration) {
+			clock.Advance(time.Second)
+			track(app.FormFocusEvent, userID, map[string]interface{}{"field": field})
+			track(app.FormChangeEvent, userID, map[string]interface{}{"field": field})
+			clock.Advance(duration)
+			track(app.FormBlurEvent, userID, map[string]interface{}{"field": field})
+		}
+
+		// user1 completes the form, user2 gives up on the password after an error
+		fill("user1", "email", 2*time.Second)
+		fill("user1", "password", 4*time.Second)
+		clock.Advance(time.Second)
+		track(app.FormSubmitEvent, "user1", map[string]interface{}{})
+
+		fill("user2", "email", 4*time.Second)
+		clock.Advance(time.Second)
+		track(app.FormFocusEvent, "user2", map[string]interface{}{"field": "password"})
+		clock.Advance(time.Second)
+		track(app.FormErrorEvent, "user2", map[string]interface{}{"field": "password", "error": "too short"})
+
+		// Interactions with other forms are not part of the report
+		_, err := service.TrackEvent(ctx, map[string]interface{}{
+			"event_type": app.FormSubmitEvent,
+			"user_id":    "user3",
+			"properties": map[string]interface{}{"form_id": "newsletter"},
+		}, "test-key", "user3")
+		assert.NoError(t, err)
+
+		report, err := forms.Report(ctx, app.FormQuery{FormID: "signup", Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), report.StartedUsers)
+		assert.Equal(t, int64(1), report.SubmittedUsers)
+		assert.Equal(t, int64(1), report.AbandonedUsers)
+		assert.Equal(t, 50.0, report.CompletionRate)
+		assert.Equal(t, int64(1), report.Errors)
+
+		assert.Equal(t, 2, len(report.Fields))
+		email, password := report.Fields[0], report.Fields[1]
+		assert.Equal(t, "email", email.Field, "Fields should be in the order users fill them in")
+		assert.Equal(t, int64(2), email.Users)
+		assert.Equal(t, int64(0), email.DropOffs)
+		assert.Equal(t, int64(3000), email.AvgTimeMs)
+		assert.Equal(t, int64(6000), email.TotalTimeMs)
+
+		assert.Equal(t, "password", password.Field)
+		assert.Equal(t, int64(1), password.DropOffs)
+		assert.Equal(t, 50.0, password.DropOffRate)
+		assert.Equal(t, int64(4000), password.AvgTimeMs, "Visits without a blur should not count towards the time")
+		assert.Equal(t, 50.0, password.ErrorRate)
+		assert.Equal(t, []app.FieldError{{Message: "too short", Count: 1}}, password.TopErrors)
+
+		_, err = forms.Report(ctx, app.FormQuery{Start: start, End: start.Add(time.Hour)})
+		assert.Error(t, err)
+		other, err := forms.Report(app.ContextWithProject(context.Background(), "other"), app.FormQuery{FormID: "signup", Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), other.StartedUsers, "Forms should be scoped to their project")
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		for _, body := range []string{
+			`{"event_type":"form_focus","user_id":"user1","properties":{"form_id":"signup","field":"email"}}`,
+			`{"event_type":"form_submit","user_id":"user1","properties":{"form_id":"signup"}}`,
+		} {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+		}
+
+		req := httptest.NewRequest("GET", "/api/v1/forms/signup/report", nil)
+		req.Header.Set("X-Project-ID", "web")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			Report app.FormReport `json:"report"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, int64(1), body.Report.SubmittedUsers)
+		assert.Equal(t, 100.0, body.Report.CompletionRate)
+
+		req = httptest.NewRequest("GET", "/api/v1/forms/signup/report?end_date=never", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestPipelineFreshness tests reporting the watermark and lag of each stage of the pipeline
+func TestPipelineFreshness(t *testing.T) {
+	pageView := func() map[string]interface{} {
+		return map[string]interface{}{"event_type": "page_view", "user_id": "user1"}
+	}
+	stages := func(report *app.FreshnessReport) map[string]app.FreshnessStage {
+		byName := make(map[string]app.FreshnessStage)
+		for _, stage := range report.Stages {
+			byName[stage.Stage] = stage
+		}
+		return byName
+	}
+
+	t.Run("CaughtUp", func(t *testing.T) {
+		clock := app.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		service := app.NewAnalyticsService()
+		service.SetClock(clock)
+
+		report := service.Freshness().Report("web", service.QueryCache(), clock.Now())
+		assert.Len(t, report.Stages, 4)
+		assert.Nil(t, report.Stages[0].Newest, "Nothing was received yet")
+
+		received := clock.Now()
+		_, err := service.TrackEvent(app.ContextWithProject(context.Background(), "web"), pageView(), "test-key", "user1")
+		assert.NoError(t, err)
+		clock.Advance(time.Minute)
+
+		report = service.Freshness().Report("web", service.QueryCache(), clock.Now())
+		for _, stage := range report.Stages {
+			assert.Equal(t, 0.0, stage.LagSeconds, stage.Stage)
+			assert.Equal(t, clock.Now(), stage.Watermark, stage.Stage)
+		}
+		for _, name := range []string{app.FreshnessIngest, app.FreshnessStore, app.FreshnessRollups} {
+			if assert.NotNil(t, stages(report)[name].Newest, name) {
+				assert.Equal(t, received, *stages(report)[name].Newest, name)
+			}
+		}
+		assert.Equal(t, 0.0, report.LagSeconds)
+
+		other := service.Freshness().Report("other", service.QueryCache(), clock.Now())
+		assert.Nil(t, stages(other)[app.FreshnessStore].Newest, "Freshness should be tracked per project")
+	})
+
+	t.Run("QueuedEvents", func(t *testing.T) {
+		t.Setenv("INGESTION_WORKER_POOL_SIZE", "1")
+		clock := app.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		service := app.NewAnalyticsService()
+		service.SetClock(clock)
+		ingestion := app.NewAsyncIngestion(service)
+		defer ingestion.Stop()
+
+		// Keep the only worker busy so accepted events wait in the queue
+		release := make(chan struct{})
+		busy := make(chan struct{})
+		ingestion.WorkerPool().Submit(func() {
+			close(busy)
+			<-release
+		})
+		<-busy
+
+		accepted := clock.Now()
+		_, err := ingestion.Submit("web", pageView(), "test-key", "user1")
+		assert.NoError(t, err)
+		clock.Advance(10 * time.Second)
+
+		report := service.Freshness().Report("web", service.QueryCache(), clock.Now())
+		for _, stage := range report.Stages {
+			assert.Equal(t, 10.0, stage.LagSeconds, stage.Stage)
+			assert.Equal(t, accepted, stage.Watermark, stage.Stage)
+			assert.Equal(t, 1, stage.Pending, stage.Stage)
+		}
+		assert.Equal(t, *stages(report)[app.FreshnessIngest].Newest, accepted)
+		assert.Nil(t, stages(report)[app.FreshnessStore].Newest, "The queued event is not stored yet")
+		assert.Equal(t, 10.0, report.LagSeconds)
+		assert.Equal(t, accepted, report.Watermark)
+
+		close(release)
+		assert.Eventually(t, func() bool {
+			return service.Freshness().Report("web", service.QueryCache(), clock.Now()).LagSeconds == 0
+		}, time.Second, time.Millisecond, "The stages should catch up once the event is stored")
+		report = service.Freshness().Report("web", service.QueryCache(), clock.Now())
+		if assert.NotNil(t, stages(report)[app.FreshnessStore].Newest) {
+			assert.Equal(t, accepted, *stages(report)[app.FreshnessStore].Newest)
+		}
+	})
+
+	t.Run("CachedResults", func(t *testing.T) {
+		clock := app.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		service := app.NewAnalyticsService()
+		service.SetClock(clock)
+
+		computedAt := clock.Now()
+		_, _, err := service.QueryCache().Get("trends:web", "web", false, func() (interface{}, error) {
+			return 42, nil
+		})
+		assert.NoError(t, err)
+		clock.Advance(20 * time.Second)
+
+		report := service.Freshness().Report("web", service.QueryCache(), clock.Now())
+		caches := stages(report)[app.FreshnessCaches]
+		assert.Equal(t, 20.0, caches.LagSeconds, "Cached results trail by the age of the oldest one")
+		assert.Equal(t, computedAt, caches.Watermark)
+		assert.Equal(t, 0.0, stages(report)[app.FreshnessRollups].LagSeconds)
+		assert.Equal(t, 20.0, report.LagSeconds)
+
+		other := service.Freshness().Report("other", service.QueryCache(), clock.Now())
+		assert.Equal(t, 0.0, other.LagSeconds, "Results cached for other projects should not count")
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		req := httptest.NewRequest("GET", "/api/v1/status/freshness", nil)
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Freshness app.FreshnessReport `json:"freshness"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "shop", body.Freshness.ProjectID)
+		if assert.Len(t, body.Freshness.Stages, 4) {
+			assert.Equal(t, app.FreshnessIngest, body.Freshness.Stages[0].Stage)
+			assert.Equal(t, app.FreshnessCaches, body.Freshness.Stages[3].Stage)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestFrustrationSignals tests detecting rage clicks and dead clicks in the click stream
+func TestFrustrationSignals(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	setup := func() (*app.AnalyticsService, *app.FakeClock, *app.HeatmapService) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		return service, clock, app.NewHeatmapService(service)
+	}
+	track := func(service *app.AnalyticsService, eventType, userID, page string, properties map[string]interface{}) {
+		_, err := service.TrackEvent(ctx, map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+			"page":       page,
+			"properties": properties,
+		}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	click := func(service *app.AnalyticsService, userID, page string, x, y float64, selector string) {
+		track(service, "click", userID, page, map[string]interface{}{"x": x, "y": y, "selector": selector})
+	}
+
+	t.Run("RageClicks", func(t *testing.T) {
+		service, clock, heatmaps := setup()
+
+		// Four clicks on the same button within a second make a single rage click
+		for i := 0; i < 4; i++ {
+			click(service, "user1", "/checkout", 100+float64(i), 200, "#pay")
+			clock.Advance(200 * time.Millisecond)
+		}
+		track(service, "page_view", "user1", "/checkout", nil)
+
+		// Clicks too far apart, in time or space, are not
+		clock.Advance(time.Minute)
+		click(service, "user2", "/checkout", 100, 200, "#pay")
+		click(service, "user2", "/checkout", 400, 200, "#cancel")
+		click(service, "user2", "/checkout", 100, 200, "#pay")
+		track(service, "page_view", "user2", "/checkout", nil)
+
+		report, err := heatmaps.Frustration().Report(ctx, app.FrustrationQuery{Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, 7, report.TotalClicks)
+		assert.Equal(t, 1, report.RageClicks)
+		assert.Equal(t, 0, report.DeadClicks, "Clicks followed by another event of the user are not dead")
+		assert.Equal(t, 1, report.AffectedUsers)
+		assert.Equal(t, app.FrustrationRageClick, report.Hotspots[0].Kind)
+		assert.Equal(t, "#pay", report.Hotspots[0].Selector)
+		assert.Equal(t, 100, report.Hotspots[0].X)
+	})
+
+	t.Run("DeadClicks", func(t *testing.T) {
+		service, clock, heatmaps := setup()
+
+		// The label does nothing for either user, the link navigates
+		for _, userID := range []string{"user1", "user2"} {
+			click(service, userID, "/pricing", 50, 60, ".plan-label")
+			clock.Advance(5 * time.Second)
+			click(service, userID, "/pricing", 300, 60, "a.signup")
+			clock.Advance(500 * time.Millisecond)
+			track(service, "page_view", userID, "/signup", nil)
+			clock.Advance(time.Minute)
+		}
+		click(service, "user3", "/home", 10, 10, "")
+
+		report, err := heatmaps.Frustration().Report(ctx, app.FrustrationQuery{Page: "/pricing", Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, 4, report.TotalClicks)
+		assert.Equal(t, 2, report.DeadClicks)
+		assert.Equal(t, 1, len(report.Pages), "Only the requested page should be reported")
+		assert.Equal(t, 50.0, report.Pages[0].DeadClickRate)
+		assert.Equal(t, 100.0, report.Pages[0].FrustrationRate)
+		assert.Equal(t, 1, len(report.Hotspots))
+		assert.Equal(t, ".plan-label", report.Hotspots[0].Selector)
+		assert.Equal(t, 2, report.Hotspots[0].Count)
+		assert.Equal(t, 2, report.Hotspots[0].Users)
+
+		_, err = heatmaps.Frustration().Report(ctx, app.FrustrationQuery{Start: start, End: start})
+		assert.Error(t, err)
+	})
+
+	t.Run("HeatmapStats", func(t *testing.T) {
+		service, clock, heatmaps := setup()
+		for i := 0; i < 3; i++ {
+			click(service, "user1", "/home", 10, 10, "")
+			clock.Advance(100 * time.Millisecond)
+		}
+		clock.Advance(time.Minute)
+		click(service, "user1", "/home", 500, 500, "")
+
+		result, err := heatmaps.GenerateHeatmap(ctx, app.HeatmapQuery{
+			Page: "/home", Type: "click", Width: 400, Height: 300,
+			Start: start, End: start.Add(time.Hour),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.Stats.RageClicks)
+		assert.Equal(t, 1, result.Stats.DeadClicks)
+
+		result, err = heatmaps.GenerateHeatmap(ctx, app.HeatmapQuery{
+			Page: "/home", Type: "scroll", Width: 400, Height: 300,
+			Start: start, End: start.Add(time.Hour),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.Stats.RageClicks, "Only click heatmaps carry frustration signals")
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		for i := 0; i < 3; i++ {
+			body := fmt.Sprintf(`{"event_type":"click","user_id":"user1","page":"/home","properties":{"x":%d,"y":10}}`, 10+i)
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+		}
+
+		req := httptest.NewRequest("GET", "/api/v1/ux/frustration?page=/home", nil)
+		req.Header.Set("X-Project-ID", "web")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			Report app.FrustrationReport `json:"report"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, 3, body.Report.TotalClicks)
+		assert.Equal(t, 1, body.Report.RageClicks)
+
+		req = httptest.NewRequest("GET", "/api/v1/ux/frustration?start_date=yesterday", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
@@ -0,0 +1,146 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestFunnelCapture tests the distributions of the properties captured at funnel steps
+func TestFunnelCapture(t *testing.T) {
+	setup := func(t *testing.T, steps []app.Step) (*app.AnalyticsService, *app.FunnelService, *app.Funnel, func(userID, eventType string, properties map[string]interface{}), time.Time) {
+		analyticsService := app.NewAnalyticsService()
+		start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		clock := app.NewFakeClock(start)
+		analyticsService.SetClock(clock)
+		service := app.NewFunnelService(analyticsService)
+
+		funnel, err := service.CreateFunnel(context.Background(), "Checkout", "", steps)
+		assert.NoError(t, err)
+
+		track := func(userID, eventType string, properties map[string]interface{}) {
+			clock.Advance(time.Second)
+			_, err := analyticsService.TrackEvent(context.Background(), map[string]interface{}{"event_type": eventType, "user_id": userID, "properties": properties}, "test-key", userID)
+			assert.NoError(t, err)
+		}
+		return analyticsService, service, funnel, track, start
+	}
+
+	t.Run("CartValueAtCheckout", func(t *testing.T) {
+		_, service, funnel, track, start := setup(t, []app.Step{
+			{ID: "checkout", Name: "Checkout", EventType: "checkout", Order: 1, Capture: []string{"cart_value", "coupon"}},
+			{ID: "purchase", Name: "Purchase", EventType: "purchase", Order: 2},
+		})
+
+		// user1 and user2 convert with large carts, user3 and user4 leave with small ones
+		track("user1", "checkout", map[string]interface{}{"cart_value": 120.0, "coupon": "SPRING"})
+		track("user1", "purchase", nil)
+		track("user2", "checkout", map[string]interface{}{"cart_value": 80.0, "coupon": "SPRING"})
+		track("user2", "purchase", nil)
+		track("user3", "checkout", map[string]interface{}{"cart_value": 20.0})
+		track("user4", "checkout", map[string]interface{}{"cart_value": 10.0, "coupon": nil})
+		// Only the checkout reaching the step counts
+		track("user3", "checkout", map[string]interface{}{"cart_value": 500.0})
+
+		result, err := service.ComputeFunnel(context.Background(), app.FunnelQuery{FunnelID: funnel.ID, Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Len(t, result.Steps[0].Captured, 2)
+		assert.Empty(t, result.Steps[1].Captured, "Steps without captured properties should report none")
+
+		cartValue := result.Steps[0].Captured[0]
+		assert.Equal(t, "cart_value", cartValue.Property)
+		assert.Equal(t, int64(4), cartValue.Users)
+		assert.Equal(t, int64(0), cartValue.UsersWithout)
+		assert.Len(t, cartValue.Values, 4)
+		if assert.NotNil(t, cartValue.Numeric) && assert.NotNil(t, cartValue.ConvertedNumeric) {
+			assert.Equal(t, 10.0, cartValue.Numeric.Min)
+			assert.Equal(t, 120.0, cartValue.Numeric.Max)
+			assert.Equal(t, 57.5, cartValue.Numeric.Mean)
+			assert.Equal(t, 80.0, cartValue.ConvertedNumeric.Min)
+			assert.Equal(t, 100.0, cartValue.ConvertedNumeric.Mean)
+		}
+
+		coupon := result.Steps[0].Captured[1]
+		assert.Equal(t, "coupon", coupon.Property)
+		assert.Equal(t, int64(2), coupon.Users)
+		assert.Equal(t, int64(2), coupon.UsersWithout, "Missing and null values should count as without")
+		assert.Equal(t, []app.CapturedValue{{Value: "SPRING", Users: 2, Converted: 2, ConversionRate: 100}}, coupon.Values)
+		assert.Nil(t, coupon.Numeric, "String values should have no numeric distribution")
+	})
+
+	t.Run("ConvertedUsersPerValue", func(t *testing.T) {
+		_, service, funnel, track, start := setup(t, []app.Step{
+			{ID: "signup", Name: "Signup", EventType: "signup", Order: 1, Capture: []string{"plan"}},
+			{ID: "activate", Name: "Activate", EventType: "activate", Order: 2},
+			{ID: "subscribe", Name: "Subscribe", EventType: "subscribe", Order: 3, Capture: []string{"plan"}},
+		})
+
+		track("user1", "signup", map[string]interface{}{"plan": "pro"})
+		track("user1", "activate", nil)
+		track("user1", "subscribe", map[string]interface{}{"plan": "pro"})
+		track("user2", "signup", map[string]interface{}{"plan": "pro"})
+		track("user2", "activate", nil)
+		track("user3", "signup", map[string]interface{}{"plan": "free"})
+		track("user4", "signup", map[string]interface{}{"plan": 3})
+
+		result, err := service.ComputeFunnel(context.Background(), app.FunnelQuery{FunnelID: funnel.ID, Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+
+		plan := result.Steps[0].Captured[0]
+		assert.Equal(t, []app.CapturedValue{
+			{Value: "pro", Users: 2, Converted: 1, ConversionRate: 50},
+			{Value: "3", Users: 1},
+			{Value: "free", Users: 1},
+		}, plan.Values)
+		assert.Nil(t, plan.Numeric, "Mixed values should have no numeric distribution")
+
+		assert.Equal(t, []app.CapturedValue{{Value: "pro", Users: 1, Converted: 1, ConversionRate: 100}}, result.Steps[2].Captured[0].Values)
+	})
+
+	t.Run("Breakdown", func(t *testing.T) {
+		analyticsService, service, funnel, track, start := setup(t, []app.Step{
+			{ID: "checkout", Name: "Checkout", EventType: "checkout", Order: 1, Capture: []string{"cart_value"}},
+			{ID: "purchase", Name: "Purchase", EventType: "purchase", Order: 2},
+		})
+		_, err := analyticsService.Dimensions().Replace(app.DefaultProjectID, []app.CustomDimension{{Name: "country", Property: "country", Type: app.DimensionString}}, 0)
+		assert.NoError(t, err)
+
+		track("user1", "checkout", map[string]interface{}{"cart_value": 100.0, "country": "FR"})
+		track("user1", "purchase", nil)
+		track("user2", "checkout", map[string]interface{}{"cart_value": 30.0, "country": "DE"})
+
+		result, err := service.ComputeFunnel(context.Background(), app.FunnelQuery{FunnelID: funnel.ID, Start: start, End: start.Add(time.Hour), Breakdown: "country"})
+		assert.NoError(t, err)
+		assert.Len(t, result.Breakdown, 2)
+		for _, segment := range result.Breakdown {
+			assert.Equal(t, int64(1), segment.Steps[0].Captured[0].Users, "Each segment should capture its own users")
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		analyticsService := app.NewAnalyticsService()
+		service := app.NewFunnelService(analyticsService)
+		steps := func(capture ...string) []app.Step {
+			return []app.Step{
+				{ID: "checkout", Name: "Checkout", EventType: "checkout", Order: 1, Capture: capture},
+				{ID: "purchase", Name: "Purchase", EventType: "purchase", Order: 2},
+			}
+		}
+
+		_, err := service.CreateFunnel(context.Background(), "Checkout", "", steps(""))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "must not be empty")
+
+		_, err = service.CreateFunnel(context.Background(), "Checkout", "", steps("cart_value", "cart_value"))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "captures cart_value twice")
+
+		_, err = service.CreateFunnel(context.Background(), "Checkout", "", steps("a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "at most 10 properties")
+	})
+}
@@ -2,6 +2,8 @@ package test
 
 import (
 	"context"
+	"encoding/json"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -75,9 +77,14 @@ func TestFunnelService(t *testing.T) {
 	t.Run("ComputeFunnel", func(t *testing.T) {
 		analyticsService := app.NewAnalyticsService()
 		service := app.NewFunnelService(analyticsService)
+		funnel, err := service.CreateFunnel(context.Background(), "Checkout", "", []app.Step{
+			{ID: "view", Name: "Page View", EventType: "page_view", Order: 1},
+			{ID: "cart", Name: "Add to Cart", EventType: "add_to_cart", Order: 2},
+		})
+		assert.NoError(t, err)
 
 		query := app.FunnelQuery{
-			FunnelID: "test_funnel",
+			FunnelID: funnel.ID,
 			Start:    time.Now().AddDate(0, 0, -30),
 			End:      time.Now(),
 		}
@@ -85,11 +92,74 @@ func TestFunnelService(t *testing.T) {
 		result, err := service.ComputeFunnel(context.Background(), query)
 		assert.NoError(t, err, "Funnel computation should succeed")
 		assert.NotNil(t, result, "Result should be returned")
-		assert.Equal(t, "test_funnel", result.FunnelID)
-		assert.Equal(t, "Sample Funnel", result.FunnelName)
-		assert.Equal(t, 4, len(result.Steps))
-		assert.Greater(t, result.TotalUsers, int64(0))
-		assert.Greater(t, result.ConversionRate, 0.0)
+		assert.Equal(t, funnel.ID, result.FunnelID)
+		assert.Equal(t, "Checkout", result.FunnelName)
+		assert.Equal(t, 2, len(result.Steps))
+		assert.Equal(t, int64(0), result.TotalUsers, "Funnels without events should have no users")
+		assert.Equal(t, 0.0, result.ConversionRate)
+
+		query.FunnelID = "test_funnel"
+		_, err = service.ComputeFunnel(context.Background(), query)
+		assert.Error(t, err, "Unknown funnels should not be computed")
+		assert.Contains(t, err.Error(), "funnel not found")
+	})
+
+	t.Run("ComputeFunnelFromEvents", func(t *testing.T) {
+		analyticsService := app.NewAnalyticsService()
+		start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		clock := app.NewFakeClock(start)
+		analyticsService.SetClock(clock)
+		service := app.NewFunnelService(analyticsService)
+
+		funnel, err := service.CreateFunnel(context.Background(), "Checkout", "", []app.Step{
+			{ID: "view", Name: "Product View", EventType: "page_view", Order: 1, Filters: map[string]interface{}{"page_type": "product"}},
+			{ID: "cart", Name: "Add to Cart", EventType: "add_to_cart", Order: 2},
+			{ID: "purchase", Name: "Purchase", EventType: "purchase", Order: 3},
+		})
+		assert.NoError(t, err)
+
+		track := func(userID, eventType string, properties map[string]interface{}) {
+			clock.Advance(time.Second)
+			_, err := analyticsService.TrackEvent(context.Background(), map[string]interface{}{"event_type": eventType, "user_id": userID, "properties": properties}, "test-key", userID)
+			assert.NoError(t, err)
+		}
+		product := map[string]interface{}{"page_type": "product"}
+
+		// user1 converts, viewing two products
+		track("user1", "page_view", product)
+		track("user1", "page_view", product)
+		track("user1", "add_to_cart", nil)
+		track("user1", "purchase", nil)
+		// user2 adds to cart and leaves
+		track("user2", "page_view", product)
+		track("user2", "add_to_cart", nil)
+		// user3 purchases before adding to cart, which does not count
+		track("user3", "page_view", product)
+		track("user3", "purchase", nil)
+		track("user3", "add_to_cart", nil)
+		// user4 never views a product page, so never enters the funnel
+		track("user4", "page_view", map[string]interface{}{"page_type": "home"})
+		track("user4", "add_to_cart", nil)
+		track("user4", "purchase", nil)
+
+		result, err := service.ComputeFunnel(context.Background(), app.FunnelQuery{FunnelID: funnel.ID, Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), result.TotalUsers)
+		assert.Equal(t, []int64{3, 3, 1}, []int64{result.Steps[0].UniqueUsers, result.Steps[1].UniqueUsers, result.Steps[2].UniqueUsers})
+		assert.Equal(t, int64(4), result.Steps[0].EventCount)
+		assert.InDelta(t, 100.0/3, result.ConversionRate, 1e-9)
+		assert.Equal(t, 0.0, result.Steps[1].DropOffRate)
+		assert.InDelta(t, 200.0/3, result.Steps[2].DropOffRate, 1e-9)
+		assert.InDelta(t, 100.0/3, result.Steps[2].ConversionRate, 1e-9)
+
+		result, err = service.ComputeFunnel(context.Background(), app.FunnelQuery{FunnelID: funnel.ID, UserID: "user2", Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), result.TotalUsers)
+		assert.Equal(t, 0.0, result.ConversionRate)
+
+		result, err = service.ComputeFunnel(context.Background(), app.FunnelQuery{FunnelID: funnel.ID, Start: start.Add(time.Hour), End: start.Add(2 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), result.TotalUsers, "Events outside the range should not count")
 	})
 
 	t.Run("ComputeFunnelValidation", func(t *testing.T) {
@@ -111,14 +181,22 @@ func TestFunnelService(t *testing.T) {
 	t.Run("GetFunnelSteps", func(t *testing.T) {
 		analyticsService := app.NewAnalyticsService()
 		service := app.NewFunnelService(analyticsService)
+		funnel, err := service.CreateFunnel(context.Background(), "Checkout", "", []app.Step{
+			{ID: "view", Name: "Page View", EventType: "page_view", Order: 1},
+			{ID: "cart", Name: "Add to Cart", EventType: "add_to_cart", Order: 2},
+		})
+		assert.NoError(t, err)
 
-		steps, err := service.GetFunnelSteps(context.Background(), "test_funnel")
+		steps, err := service.GetFunnelSteps(context.Background(), funnel.ID)
 		assert.NoError(t, err, "Should retrieve funnel steps")
 		assert.NotNil(t, steps, "Steps should be returned")
-		assert.Equal(t, 4, len(steps))
+		assert.Equal(t, 2, len(steps))
 		assert.Equal(t, "Page View", steps[0].Name)
 		assert.Equal(t, "page_view", steps[0].EventType)
 		assert.Equal(t, 1, steps[0].Order)
+
+		_, err = service.GetFunnelSteps(context.Background(), "test_funnel")
+		assert.Error(t, err, "Unknown funnels should have no steps")
 	})
 
 	t.Run("GetFunnelStepsValidation", func(t *testing.T) {
@@ -205,4 +283,47 @@ func TestFunnelIntegration(t *testing.T) {
 		funnelService := app.GetFunnelService()
 		assert.NotNil(t, funnelService, "Funnel service should be available")
 	})
+
+	t.Run("ComputeEndpointIncludesEndDate", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		analyticsService := application.GetAnalyticsService()
+		clock := app.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		analyticsService.SetClock(clock)
+
+		funnel, err := application.GetFunnelService().CreateFunnel(context.Background(), "Signup", "", []app.Step{
+			{ID: "view", Name: "View", EventType: "page_view", Order: 1},
+			{ID: "signup", Name: "Signup", EventType: "signup", Order: 2},
+		})
+		assert.NoError(t, err)
+		for _, eventType := range []string{"page_view", "signup"} {
+			clock.Advance(time.Second)
+			_, err := analyticsService.TrackEvent(context.Background(), map[string]interface{}{"event_type": eventType, "user_id": "user1"}, "test-key", "user1")
+			assert.NoError(t, err)
+		}
+
+		req := httptest.NewRequest("GET", "/api/v1/funnels/"+funnel.ID+"/compute?start_date=2024-03-01&end_date=2024-03-01", nil)
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			Result app.FunnelResult `json:"result"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, int64(1), body.Result.TotalUsers, "Events of the end date should count")
+		assert.Equal(t, 100.0, body.Result.ConversionRate)
+	})
+
+	t.Run("UnknownFunnelEndpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		for _, path := range []string{"/api/v1/funnels/missing/compute", "/api/v1/funnels/missing/steps"} {
+			resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", path, nil))
+			assert.NoError(t, err)
+			assert.Equal(t, 404, resp.StatusCode, path)
+		}
+	})
 }
@@ -0,0 +1,122 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestFunnelSuggestions tests suggesting funnels from the event sequences users were observed performing
+func TestFunnelSuggestions(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	ctx := app.ContextWithProject(context.Background(), "shop")
+	start := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Second)
+
+	journey := func(userID string, eventTypes ...string) {
+		for i, eventType := range eventTypes {
+			_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+				"event_type": eventType,
+				"user_id":    userID,
+				"timestamp":  start.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+			}, "test-key", userID)
+			assert.NoError(t, err)
+		}
+	}
+	// 10 users land and sign up, 6 of them then purchase; 3 users only read the blog
+	for i := 0; i < 10; i++ {
+		steps := []string{"landing", "page_view", "page_view", "signup"}
+		if i < 6 {
+			steps = append(steps, "help", "purchase")
+		}
+		journey(fmt.Sprintf("user%d", i), steps...)
+	}
+	for i := 0; i < 3; i++ {
+		journey(fmt.Sprintf("reader%d", i), "blog", "page_view")
+	}
+	funnels := application.GetFunnelService()
+	query := app.FunnelSuggestionQuery{Start: start.Add(-time.Hour), End: time.Now().Add(time.Hour), MinSupport: 0.3}
+
+	t.Run("SuggestsFrequentSequences", func(t *testing.T) {
+		result, err := funnels.SuggestFunnels(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(13), result.Users)
+		assert.Equal(t, int64(4), result.MinUsers)
+		assert.False(t, result.Truncated)
+		if !assert.NotEmpty(t, result.Suggestions) {
+			return
+		}
+
+		best := result.Suggestions[0]
+		assert.Equal(t, "landing → page_view → signup", best.Name)
+		assert.Equal(t, []int64{10, 10, 10}, best.StepUsers)
+		assert.Equal(t, int64(10), best.Support)
+		assert.Equal(t, 76.92, best.SupportRate)
+		assert.Equal(t, 100.0, best.ConversionRate)
+		assert.Equal(t, app.Step{ID: "step2", Name: "page_view", EventType: "page_view", Order: 2}, best.Steps[1])
+
+		var names []string
+		for _, suggestion := range result.Suggestions {
+			names = append(names, suggestion.Name)
+		}
+		assert.Contains(t, names, "landing → page_view → signup → purchase")
+		assert.NotContains(t, names, "landing → page_view", "Sequences within a longer one of the same users should not be suggested")
+		assert.NotContains(t, names, "blog → page_view", "Sequences of too few users should not be suggested")
+
+		// Suggestions can be created as funnels as they are
+		_, err = funnels.CreateFunnel(ctx, best.Name, "", best.Steps)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		limited := query
+		limited.MaxSteps = 2
+		limited.Limit = 1
+		result, err := funnels.SuggestFunnels(ctx, limited)
+		assert.NoError(t, err)
+		if assert.Len(t, result.Suggestions, 1) {
+			assert.Len(t, result.Suggestions[0].Steps, 2)
+		}
+
+		for _, invalid := range []app.FunnelSuggestionQuery{
+			{Start: query.End, End: query.Start},
+			{Start: query.Start, End: query.End, MinSteps: 1},
+			{Start: query.Start, End: query.End, MinSteps: 4, MaxSteps: 3},
+			{Start: query.Start, End: query.End, MaxSteps: 10},
+			{Start: query.Start, End: query.End, MinSupport: 2},
+		} {
+			_, err := funnels.SuggestFunnels(ctx, invalid)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		get := func(query string) (int, map[string]interface{}) {
+			req := httptest.NewRequest("GET", "/api/v1/funnels/suggestions?"+query, nil)
+			req.Header.Set("X-Project-ID", "shop")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return resp.StatusCode, body
+		}
+
+		status, body := get("min_support=0.3&limit=2")
+		assert.Equal(t, 200, status)
+		result := body["result"].(map[string]interface{})
+		assert.Len(t, result["suggestions"], 2)
+
+		status, _ = get("min_support=abc")
+		assert.Equal(t, 400, status)
+		status, _ = get("max_steps=9")
+		assert.Equal(t, 400, status)
+	})
+}
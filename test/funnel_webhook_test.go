@@ -0,0 +1,205 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// webhookDelivery is a request received by a test webhook
+type webhookDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+// startWebhookServer serves a webhook answering with the given statuses in turn, then 200
+func startWebhookServer(t *testing.T, statuses ...int) (string, chan webhookDelivery) {
+	deliveries := make(chan webhookDelivery, 100)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		deliveries <- webhookDelivery{header: r.Header.Clone(), body: body}
+		if request := int(atomic.AddInt32(&requests, 1)); request <= len(statuses) {
+			w.WriteHeader(statuses[request-1])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, deliveries
+}
+
+// receiveFunnelWebhook waits for a delivery, checks its signature and decodes its payload
+func receiveFunnelWebhook(t *testing.T, deliveries chan webhookDelivery, secret string) (webhookDelivery, app.FunnelWebhookPayload) {
+	var payload app.FunnelWebhookPayload
+	select {
+	case delivery := <-deliveries:
+		timestamp, err := strconv.ParseInt(delivery.header.Get(app.HeaderWebhookTimestamp), 10, 64)
+		assert.NoError(t, err)
+		assert.Equal(t, app.SignWebhookPayload([]byte(secret), timestamp, delivery.body), delivery.header.Get(app.HeaderWebhookSignature))
+		assert.Equal(t, "application/json", delivery.header.Get("Content-Type"))
+		assert.NoError(t, json.Unmarshal(delivery.body, &payload))
+		assert.Equal(t, payload.ID, delivery.header.Get(app.HeaderWebhookID))
+		return delivery, payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("The webhook was not called")
+		return webhookDelivery{}, payload
+	}
+}
+
+// TestFunnelWebhook tests posting the funnel results computed in the background to a signed webhook
+func TestFunnelWebhook(t *testing.T) {
+	t.Setenv("FUNNEL_WEBHOOK_RETRY_DELAY", "10ms")
+	steps := []app.Step{
+		{ID: "landing", Name: "Landing", EventType: "page_view", Order: 1},
+		{ID: "signup", Name: "Signup", EventType: "signup", Order: 2},
+	}
+
+	t.Run("Configuration", func(t *testing.T) {
+		assert.False(t, app.NewFunnelWebhook().Enabled(), "The webhook should be disabled without a URL")
+
+		t.Setenv("FUNNEL_WEBHOOK_URL", "https://bi.example.com/hooks/funnels")
+		assert.False(t, app.NewFunnelWebhook().Enabled(), "Deliveries should not be sent unsigned")
+
+		t.Setenv("FUNNEL_WEBHOOK_SECRET", "secret")
+		webhook := app.NewFunnelWebhook()
+		defer webhook.Stop()
+		assert.True(t, webhook.Enabled())
+
+		t.Setenv("FUNNEL_WEBHOOK_URL", "ftp://bi.example.com")
+		assert.False(t, app.NewFunnelWebhook().Enabled())
+
+		var disabled *app.FunnelWebhook
+		disabled.Notify("web", app.FunnelTriggerScheduled, &app.FunnelResult{})
+		assert.Equal(t, app.FunnelWebhookStats{}, disabled.Stats())
+	})
+
+	t.Run("RetriesFailedDeliveries", func(t *testing.T) {
+		url, deliveries := startWebhookServer(t, http.StatusBadGateway, http.StatusServiceUnavailable)
+		t.Setenv("FUNNEL_WEBHOOK_URL", url)
+		t.Setenv("FUNNEL_WEBHOOK_SECRET", "secret")
+		webhook := app.NewFunnelWebhook()
+
+		webhook.Notify("", app.FunnelTriggerRevalidated, &app.FunnelResult{FunnelID: "funnel_1", ConversionRate: 12.5})
+		first, payload := receiveFunnelWebhook(t, deliveries, "secret")
+		assert.Equal(t, "funnel.completed", payload.Type)
+		assert.Equal(t, app.DefaultProjectID, payload.ProjectID)
+		assert.Equal(t, app.FunnelTriggerRevalidated, payload.Trigger)
+		assert.Equal(t, "funnel_1", payload.Result.FunnelID)
+		assert.Equal(t, 12.5, payload.Result.ConversionRate)
+		for i := 0; i < 2; i++ {
+			retry, _ := receiveFunnelWebhook(t, deliveries, "secret")
+			assert.Equal(t, first.header.Get(app.HeaderWebhookID), retry.header.Get(app.HeaderWebhookID), "Retries should keep the delivery ID")
+		}
+
+		webhook.Stop()
+		stats := webhook.Stats()
+		assert.Equal(t, int64(1), stats.Sent)
+		assert.Equal(t, int64(0), stats.Failed)
+
+		var metrics strings.Builder
+		assert.NoError(t, webhook.WriteMetrics(&metrics))
+		assert.Contains(t, metrics.String(), `analytics_funnel_webhook_deliveries_total{outcome="sent"} 1`)
+	})
+
+	t.Run("RevalidatedResults", func(t *testing.T) {
+		url, deliveries := startWebhookServer(t)
+		t.Setenv("FUNNEL_WEBHOOK_URL", url)
+		t.Setenv("FUNNEL_WEBHOOK_SECRET", "secret")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		clock := app.NewFakeClock(time.Now())
+		application.GetAnalyticsService().QueryCache().SetClock(clock)
+
+		funnel, err := application.GetFunnelService().CreateFunnel(app.ContextWithProject(context.Background(), "web"), "Signup", "", steps)
+		assert.NoError(t, err)
+		compute := func() string {
+			req := httptest.NewRequest("GET", "/api/v1/funnels/"+funnel.ID+"/compute", nil)
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.Header.Get("X-Cache")
+		}
+
+		assert.Equal(t, app.CacheMiss, compute())
+		assert.Equal(t, app.CacheHit, compute())
+		select {
+		case <-deliveries:
+			t.Fatal("Results computed for a request should not be posted")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		clock.Advance(time.Minute)
+		assert.Equal(t, app.CacheStale, compute())
+		_, payload := receiveFunnelWebhook(t, deliveries, "secret")
+		assert.Equal(t, "web", payload.ProjectID)
+		assert.Equal(t, app.FunnelTriggerRevalidated, payload.Trigger)
+		assert.Equal(t, funnel.ID, payload.Result.FunnelID)
+	})
+
+	t.Run("JobResults", func(t *testing.T) {
+		url, deliveries := startWebhookServer(t)
+		t.Setenv("FUNNEL_WEBHOOK_URL", url)
+		t.Setenv("FUNNEL_WEBHOOK_SECRET", "secret")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		funnel, err := application.GetFunnelService().CreateFunnel(app.ContextWithProject(context.Background(), "web"), "Signup", "", steps)
+		assert.NoError(t, err)
+		req := httptest.NewRequest("GET", "/api/v1/funnels/"+funnel.ID+"/compute", nil)
+		req.Header.Set("X-Project-ID", "web")
+		req.Header.Set("Prefer", "respond-async")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 202, resp.StatusCode)
+
+		_, payload := receiveFunnelWebhook(t, deliveries, "secret")
+		assert.Equal(t, "web", payload.ProjectID)
+		assert.Equal(t, app.FunnelTriggerJob, payload.Trigger)
+		assert.Equal(t, funnel.ID, payload.Result.FunnelID)
+	})
+
+	t.Run("ScheduledResults", func(t *testing.T) {
+		url, deliveries := startWebhookServer(t)
+		t.Setenv("FUNNEL_WEBHOOK_URL", url)
+		t.Setenv("FUNNEL_WEBHOOK_SECRET", "secret")
+		t.Setenv("DASHBOARD_DERIVED_METRIC_CADENCE", "1h")
+		application, feedURL := startDashboardServer(t)
+		defer application.Stop()
+
+		funnel, err := application.GetFunnelService().CreateFunnel(app.ContextWithProject(context.Background(), "web"), "Signup", "", steps)
+		assert.NoError(t, err)
+		conn, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=web", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+		for _, field := range []string{"conversion_rate", "total_users"} {
+			metric := "funnel:" + funnel.ID + ":" + field
+			assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "metric": metric, "granularity": "1h"}))
+			readUntil(t, conn, metric, 2*time.Second)
+		}
+
+		application.GetDerivedMetrics().Run(time.Now())
+		_, payload := receiveFunnelWebhook(t, deliveries, "secret")
+		assert.Equal(t, "web", payload.ProjectID)
+		assert.Equal(t, app.FunnelTriggerScheduled, payload.Trigger)
+		assert.Equal(t, funnel.ID, payload.Result.FunnelID)
+		select {
+		case <-deliveries:
+			t.Fatal("A funnel's metrics should post its result once")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
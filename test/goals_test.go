@@ -0,0 +1,114 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestGoals tests managing the goals of a project and reporting their completions
+func TestGoals(t *testing.T) {
+	t.Run("RejectsInvalidGoals", func(t *testing.T) {
+		goals := app.NewGoalService(app.NewAnalyticsService())
+		for _, invalid := range [][]app.Goal{
+			{{EventType: "purchase"}},
+			{{Name: "Purchase"}},
+			{{Name: "Purchase", EventType: "purchase"}, {Name: "Purchase", EventType: "signup"}},
+		} {
+			_, err := goals.Replace("shop", invalid, 0)
+			assert.Error(t, err, invalid)
+		}
+
+		updated, err := goals.Replace("shop", []app.Goal{
+			{Name: "Signup", EventType: "signup"},
+			{Name: "Purchase", EventType: "purchase"},
+		}, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, "Purchase", updated.Goals[0].Name, "Goals should be ordered by name")
+		_, err = goals.Replace("shop", nil, 0)
+		assert.Error(t, err, "Stale versions should conflict")
+		assert.Empty(t, goals.Get("other").Goals)
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		analytics := app.NewAnalyticsService()
+		goals := app.NewGoalService(analytics)
+		ctx := app.ContextWithProject(context.Background(), "shop")
+		for _, event := range []map[string]interface{}{
+			{"event_type": "page_view", "user_id": "user1", "page": "/pricing"},
+			{"event_type": "page_view", "user_id": "user2", "page": "/"},
+			{"event_type": "purchase", "user_id": "user1", "properties": map[string]interface{}{"plan": "pro"}},
+			{"event_type": "purchase", "user_id": "user1", "properties": map[string]interface{}{"plan": "pro"}},
+			{"event_type": "purchase", "user_id": "user2", "properties": map[string]interface{}{"plan": "free"}},
+		} {
+			_, err := analytics.TrackEvent(ctx, event, "test-key", event["user_id"].(string))
+			assert.NoError(t, err)
+		}
+		_, err := analytics.TrackEvent(app.ContextWithProject(context.Background(), "other"), map[string]interface{}{
+			"event_type": "purchase",
+			"user_id":    "user3",
+		}, "test-key", "user3")
+		assert.NoError(t, err)
+
+		_, err = goals.Replace("shop", []app.Goal{
+			{Name: "Pricing viewed", EventType: "page_view", Page: "/pricing"},
+			{Name: "Pro purchase", EventType: "purchase", Filters: map[string]interface{}{"plan": "pro"}},
+		}, 0)
+		assert.NoError(t, err)
+
+		report := goals.Report(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		assert.Equal(t, int64(2), report.ActiveUsers, "Users of other projects should not count")
+		assert.Equal(t, []app.GoalResult{
+			{Name: "Pricing viewed", Completions: 1, Users: 1, ConversionRate: 50},
+			{Name: "Pro purchase", Completions: 2, Users: 1, ConversionRate: 50},
+		}, report.Goals)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, ifMatch, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+
+		status, _ := send("PUT", "/api/v1/projects/shop/goals", "", `{"goals":[{"name":"Signup"}]}`)
+		assert.Equal(t, 400, status)
+		status, _ = send("PUT", "/api/v1/projects/shop/goals", "", `{"goals":[{"name":"Signup","event_type":"signup"}]}`)
+		assert.Equal(t, 200, status)
+		status, _ = send("PUT", "/api/v1/projects/shop/goals", "", `{"goals":[]}`)
+		assert.Equal(t, 428, status)
+
+		_, err := application.GetAnalyticsService().TrackEvent(app.ContextWithProject(context.Background(), "shop"), map[string]interface{}{
+			"event_type": "signup",
+			"user_id":    "user1",
+		}, "test-key", "user1")
+		assert.NoError(t, err)
+
+		status, body := send("GET", "/api/v1/projects/shop/goals/report", "", "")
+		assert.Equal(t, 200, status)
+		report := body["report"].(map[string]interface{})
+		assert.Equal(t, float64(1), report["active_users"])
+		assert.Equal(t, float64(1), report["goals"].([]interface{})[0].(map[string]interface{})["completions"])
+
+		status, _ = send("GET", "/api/v1/projects/shop/goals/report?start_date=yesterday", "", "")
+		assert.Equal(t, 400, status)
+	})
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestHeatmapBilling tests tiered heatmap pricing and plan resolution limits
+func TestHeatmapBilling(t *testing.T) {
+	query := app.HeatmapQuery{
+		Page:   "/home",
+		Type:   "click",
+		Start:  time.Now().AddDate(0, 0, -7),
+		End:    time.Now(),
+		Width:  1920,
+		Height: 1080,
+	}
+
+	t.Run("TieredPricing", func(t *testing.T) {
+		heatmapService := app.NewHeatmapService(app.NewAnalyticsService())
+
+		result, err := heatmapService.GenerateHeatmap(context.Background(), query)
+		assert.NoError(t, err)
+		assert.NotNil(t, result.Billing)
+		assert.Equal(t, int64(1920*1080), result.Billing.Pixels)
+		assert.Equal(t, int64(0), result.Billing.ScannedEvents, "No events were tracked to scan")
+
+		// 2,073,600 pixels span the first two tiers
+		assert.Equal(t, 2, len(result.Billing.PixelCharges))
+		assert.Equal(t, int64(2_000_000), result.Billing.PixelCharges[0].Pixels)
+		assert.Equal(t, int64(73_600), result.Billing.PixelCharges[1].Pixels)
+		assert.InDelta(t, 0.004, result.Billing.PixelCharges[0].Amount, 1e-9)
+		assert.InDelta(t, 0.0002944, result.Billing.PixelCharges[1].Amount, 1e-9)
+		assert.Greater(t, result.Billing.TotalCost, result.Billing.PixelCharges[0].Amount+result.Billing.PixelCharges[1].Amount)
+	})
+
+	t.Run("ResolutionLimitedByPlan", func(t *testing.T) {
+		analyticsService := app.NewAnalyticsService()
+		heatmapService := app.NewHeatmapService(analyticsService)
+		ctx := app.ContextWithBillingUser(context.Background(), "user1")
+
+		large := query
+		large.Width, large.Height = 2560, 1440
+
+		_, err := heatmapService.GenerateHeatmap(ctx, large)
+		var limitErr *app.PlanLimitError
+		assert.True(t, errors.As(err, &limitErr))
+		assert.Equal(t, "free", limitErr.Plan)
+		assert.Equal(t, "pro", limitErr.UpgradeTo)
+		assert.Contains(t, err.Error(), "upgrade to the pro plan")
+
+		assert.NoError(t, analyticsService.Plans().SetUserPlan("user1", "pro"))
+		result, err := heatmapService.GenerateHeatmap(ctx, large)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, result.Billing.BillingEventID, "Billed generations should carry a billing event ID")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		assert.NoError(t, application.GetAdminAuth().AddToken("root", "admin-token", app.RoleAdmin))
+
+		req := httptest.NewRequest("POST", "/api/v1/heatmaps/generate", strings.NewReader(`{"page":"/home","type":"click","width":2560,"height":1440}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User-ID", "user2")
+		resp, err := application.GetFiberApp().Test(req, -1)
+		assert.NoError(t, err)
+		assert.Equal(t, 402, resp.StatusCode)
+
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "pro", body["upgrade_to"])
+		assert.Equal(t, "1920x1080", body["allowed"])
+
+		req = httptest.NewRequest("PUT", "/api/v1/admin/users/user2/plan", strings.NewReader(`{"plan":"pro"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Admin-Token", "admin-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "pro", application.GetAnalyticsService().Plans().PlanForUser("user2").Name)
+
+		entries := application.GetAuditLog().Entries("plan.assign", 1)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, "user2", entries[0].Resource)
+	})
+}
@@ -0,0 +1,154 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestHeatmapEvents tests generating heatmaps from the positions of tracked events
+func TestHeatmapEvents(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	setup := func() (*app.AnalyticsService, *app.FakeClock, *app.HeatmapService) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		return service, clock, app.NewHeatmapService(service)
+	}
+	track := func(service *app.AnalyticsService, eventType, userID, page string, properties map[string]interface{}) error {
+		_, err := service.TrackEvent(ctx, map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+			"page":       page,
+			"properties": properties,
+		}, "test-key", userID)
+		return err
+	}
+	query := app.HeatmapQuery{Page: "/home", Type: "click", Width: 100, Height: 50, Start: start, End: start.Add(time.Hour)}
+
+	t.Run("ClickPositions", func(t *testing.T) {
+		service, clock, heatmaps := setup()
+		assert.NoError(t, track(service, "click", "user1", "/home", map[string]interface{}{"x": 10.0, "y": 20.0}))
+		assert.NoError(t, track(service, "click", "user2", "/home", map[string]interface{}{"x": 10.4, "y": 20.9}))
+		assert.NoError(t, track(service, "click", "user2", "/home", map[string]interface{}{"x": 99, "y": 0}))
+		// Other pages, event types and positions outside the grid are not plotted
+		assert.NoError(t, track(service, "click", "user1", "/pricing", map[string]interface{}{"x": 10.0, "y": 20.0}))
+		assert.NoError(t, track(service, "mouse_move", "user1", "/home", map[string]interface{}{"x": 10.0, "y": 20.0}))
+		assert.NoError(t, track(service, "click", "user1", "/home", map[string]interface{}{"x": 100.0, "y": 20.0}))
+		assert.NoError(t, track(service, "click", "user1", "/home", nil))
+		clock.Advance(2 * time.Hour)
+		assert.NoError(t, track(service, "click", "user1", "/home", map[string]interface{}{"x": 10.0, "y": 20.0}))
+
+		result, err := heatmaps.GenerateHeatmap(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, result.Data[20][10])
+		assert.Equal(t, 1, result.Data[0][99])
+		assert.Equal(t, []app.HeatmapPoint{{X: 10, Y: 20, Intensity: 2, Weight: 1}, {X: 99, Y: 0, Intensity: 1, Weight: 1}}, result.Points)
+		assert.Equal(t, 3, result.Stats.TotalPoints)
+		assert.Equal(t, 2, result.Stats.MaxIntensity)
+		assert.Equal(t, int64(5), result.Billing.ScannedEvents, "The page's clicks in the range should be scanned")
+
+		single := query
+		single.UserID = "user1"
+		result, err = heatmaps.GenerateHeatmap(ctx, single)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.Stats.TotalPoints)
+
+		threshold := query
+		threshold.Threshold = 2
+		result, err = heatmaps.GenerateHeatmap(ctx, threshold)
+		assert.NoError(t, err)
+		assert.Len(t, result.Points, 1)
+		assert.Equal(t, 0, result.Data[0][99], "Cells below the threshold should be left out")
+	})
+
+	t.Run("ScaledFromViewport", func(t *testing.T) {
+		service, _, heatmaps := setup()
+		// The same spot on a phone and on a desktop lands in the same cell
+		assert.NoError(t, track(service, "click", "user1", "/home", map[string]interface{}{"x": 195, "y": 422, "viewport_width": 390, "viewport_height": 844}))
+		assert.NoError(t, track(service, "click", "user2", "/home", map[string]interface{}{"x": 960, "y": 540, "viewport_width": 1920, "viewport_height": 1080}))
+
+		result, err := heatmaps.GenerateHeatmap(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, result.Data[25][50])
+	})
+
+	t.Run("ScrollAndMovement", func(t *testing.T) {
+		service, _, heatmaps := setup()
+		assert.NoError(t, track(service, "scroll", "user1", "/home", map[string]interface{}{"x": 0, "y": 40}))
+		assert.NoError(t, track(service, "mouse_move", "user1", "/home", map[string]interface{}{"x": 5, "y": 5}))
+		assert.NoError(t, track(service, "mouse_move", "user1", "/home", map[string]interface{}{"x": 6, "y": 5}))
+
+		scroll := query
+		scroll.Type = "scroll"
+		result, err := heatmaps.GenerateHeatmap(ctx, scroll)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, result.Stats.TotalPoints)
+		assert.Equal(t, 1, result.Data[40][0])
+
+		movement := query
+		movement.Type = "movement"
+		result, err = heatmaps.GenerateHeatmap(ctx, movement)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, result.Stats.TotalPoints)
+
+		invalid := query
+		invalid.Type = "hover"
+		_, err = heatmaps.GenerateHeatmap(ctx, invalid)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid heatmap type")
+	})
+
+	t.Run("InvalidCoordinates", func(t *testing.T) {
+		service, _, _ := setup()
+		for _, properties := range []map[string]interface{}{
+			{"x": 10},
+			{"x": -1, "y": 10},
+			{"x": "left", "y": 10},
+			{"x": 10, "y": 10, "viewport_width": 390},
+			{"x": 10, "y": 10, "viewport_width": 0, "viewport_height": 844},
+		} {
+			err := track(service, "click", "user1", "/home", properties)
+			assert.Error(t, err, "%v should be rejected", properties)
+		}
+		assert.NoError(t, track(service, "page_view", "user1", "/home", map[string]interface{}{"x": "left"}), "Other event types should not be checked")
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		for i := 0; i < 3; i++ {
+			body := fmt.Sprintf(`{"event_type":"click","user_id":"user1","page":"/home","properties":{"x":%d,"y":300,"viewport_width":800,"viewport_height":600}}`, 400+i)
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+		}
+
+		req := httptest.NewRequest("POST", "/api/v1/heatmaps/generate", strings.NewReader(`{"page":"/home","type":"click","width":80,"height":60}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			Result app.HeatmapResult `json:"result"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, 3, body.Result.Data[30][40])
+	})
+}
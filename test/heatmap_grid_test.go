@@ -0,0 +1,165 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestHeatmapGrids tests exporting heatmap grids as CSV matrices and binary grids, and importing
+// externally generated grids as a heatmap's latest data
+func TestHeatmapGrids(t *testing.T) {
+	grid := [][]int{{0, 1, 2}, {3, 40, 5}}
+
+	t.Run("Formats", func(t *testing.T) {
+		csv, err := app.EncodeHeatmapGrid(app.HeatmapGridCSV, grid)
+		assert.NoError(t, err)
+		assert.Equal(t, "0,1,2\r\n3,40,5\r\n", string(csv))
+
+		encoded, err := app.EncodeHeatmapGrid(app.HeatmapGridBinary, grid)
+		assert.NoError(t, err)
+		assert.Len(t, encoded, 16+4*6)
+		assert.Equal(t, "HMGRID", string(encoded[:6]))
+		assert.Equal(t, uint32(3), binary.LittleEndian.Uint32(encoded[8:]))
+		assert.Equal(t, uint32(2), binary.LittleEndian.Uint32(encoded[12:]))
+		assert.Equal(t, uint32(40), binary.LittleEndian.Uint32(encoded[16+4*4:]), "Intensities should be stored row by row")
+
+		for _, format := range []string{app.HeatmapGridCSV, app.HeatmapGridBinary} {
+			encoded, err := app.EncodeHeatmapGrid(format, grid)
+			assert.NoError(t, err)
+			decoded, err := app.DecodeHeatmapGrid(format, encoded, 3, 2)
+			assert.NoError(t, err)
+			assert.Equal(t, grid, decoded)
+
+			_, err = app.DecodeHeatmapGrid(format, encoded, 2, 3)
+			assert.Error(t, err, "Grids of other dimensions should be rejected")
+		}
+
+		decoded, err := app.DecodeHeatmapGrid(app.HeatmapGridCSV, []byte("0, 1, 2\n3,40,5"), 3, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, grid, decoded)
+		for _, invalid := range []string{"0,1,2\n3,-4,5\n", "0,1,2\n3,x,5\n", "0,1\n3,4\n", "0,1,2\n", "0,1,2\n3,4,5\n6,7,8\n"} {
+			_, err := app.DecodeHeatmapGrid(app.HeatmapGridCSV, []byte(invalid), 3, 2)
+			assert.Error(t, err, invalid)
+		}
+		_, err = app.DecodeHeatmapGrid(app.HeatmapGridBinary, encoded[:len(encoded)-4], 3, 2)
+		assert.Error(t, err, "Truncated grids should be rejected")
+		_, err = app.DecodeHeatmapGrid(app.HeatmapGridBinary, csv, 3, 2)
+		assert.Error(t, err)
+
+		_, err = app.HeatmapGridFormat("tiff", "")
+		assert.Error(t, err)
+		format, err := app.HeatmapGridFormat("", "application/octet-stream")
+		assert.NoError(t, err)
+		assert.Equal(t, app.HeatmapGridBinary, format)
+	})
+
+	t.Run("Import", func(t *testing.T) {
+		heatmaps := app.NewHeatmapService(app.NewAnalyticsService())
+		ctx := app.ContextWithProject(context.Background(), "web")
+		created, err := heatmaps.CreateHeatmap(ctx, "Home clicks", "", "click", "/home", 3, 2, nil)
+		assert.NoError(t, err)
+
+		imported, err := heatmaps.ImportData(ctx, created.ID, grid)
+		assert.NoError(t, err)
+		assert.Equal(t, app.HeatmapDataImported, imported.DataSource)
+		assert.Equal(t, 40, imported.Stats.MaxIntensity)
+		assert.Equal(t, 0, imported.Stats.MinIntensity)
+		assert.NotNil(t, imported.GeneratedAt)
+		assert.Equal(t, created.Version, imported.Version, "Importing should not change the configuration version")
+
+		_, err = heatmaps.ImportData(ctx, created.ID, [][]int{{1, 2}, {3, 4}})
+		assert.Error(t, err)
+		_, err = heatmaps.ImportData(app.ContextWithProject(context.Background(), "other"), created.ID, grid)
+		assert.Error(t, err, "Heatmaps of other projects should not be found")
+
+		_, err = heatmaps.GenerateHeatmap(ctx, app.HeatmapQuery{HeatmapID: created.ID, Start: time.Now().Add(-time.Hour), End: time.Now()})
+		assert.NoError(t, err)
+		stored, err := heatmaps.GetHeatmap(ctx, created.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, app.HeatmapDataGenerated, stored.DataSource)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, contentType string, body []byte, headers ...string) (int, []byte, string) {
+			req := httptest.NewRequest(method, path, bytes.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("X-Project-ID", "web")
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp.StatusCode, content, resp.Header.Get("Content-Type")
+		}
+
+		status, content, _ := send("POST", "/api/v1/heatmaps", "application/json", []byte(`{"name":"Home clicks","type":"click","page":"/home","width":3,"height":2}`))
+		assert.Equal(t, 200, status)
+		var created struct {
+			Heatmap app.Heatmap `json:"heatmap"`
+		}
+		assert.NoError(t, json.Unmarshal(content, &created))
+		path := "/api/v1/heatmaps/" + created.Heatmap.ID + "/data"
+
+		status, content, _ = send("PUT", path, "text/csv", []byte("0,1,2\n3,40,5\n"))
+		assert.Equal(t, 200, status, string(content))
+		var imported struct {
+			Heatmap app.Heatmap `json:"heatmap"`
+		}
+		assert.NoError(t, json.Unmarshal(content, &imported))
+		assert.Equal(t, app.HeatmapDataImported, imported.Heatmap.DataSource)
+		assert.Equal(t, 40, imported.Heatmap.Stats.MaxIntensity)
+
+		status, content, contentType := send("GET", path, "", nil)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "text/csv", contentType)
+		assert.Equal(t, "0,1,2\r\n3,40,5\r\n", string(content))
+
+		status, content, contentType = send("GET", path+"?format=grid", "", nil)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "application/octet-stream", contentType)
+		decoded, err := app.DecodeHeatmapGrid(app.HeatmapGridBinary, content, 3, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, grid, decoded)
+
+		// Compressed binary grids
+		binaryGrid, err := app.EncodeHeatmapGrid(app.HeatmapGridBinary, [][]int{{7, 7, 7}, {7, 7, 7}})
+		assert.NoError(t, err)
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err = writer.Write(binaryGrid)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+		status, content, _ = send("PUT", path, "application/octet-stream", compressed.Bytes(), "Content-Encoding", "gzip")
+		assert.Equal(t, 200, status, string(content))
+		_, content, _ = send("GET", path, "", nil)
+		assert.Equal(t, "7,7,7\r\n7,7,7\r\n", string(content))
+
+		status, content, _ = send("PUT", path, "text/csv", []byte("1,2\n3,4\n"))
+		assert.Equal(t, 400, status)
+		assert.True(t, strings.Contains(string(content), "error"))
+		status, _, _ = send("GET", path+"?format=tiff", "", nil)
+		assert.Equal(t, 400, status)
+		status, _, _ = send("GET", "/api/v1/heatmaps/missing/data", "", nil)
+		assert.Equal(t, 404, status)
+		status, _, _ = send("PUT", "/api/v1/heatmaps/missing/data", "text/csv", []byte("0,1,2\n3,4,5\n"))
+		assert.Equal(t, 404, status)
+	})
+}
@@ -0,0 +1,130 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestHeatmapPoints tests appending points pushed by clients to a heatmap's latest data
+func TestHeatmapPoints(t *testing.T) {
+	t.Run("Append", func(t *testing.T) {
+		heatmaps := app.NewHeatmapService(app.NewAnalyticsService())
+		ctx := app.ContextWithProject(context.Background(), "web")
+		created, err := heatmaps.CreateHeatmap(ctx, "Home clicks", "", "click", "/home", 3, 2, nil)
+		assert.NoError(t, err)
+
+		appended, err := heatmaps.AppendPoints(ctx, created.ID, []app.HeatmapPoint{{X: 0, Y: 0}, {X: 2, Y: 1, Intensity: 5}, {X: 0, Y: 0}})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]int{{2, 0, 0}, {0, 0, 5}}, appended.Data)
+		assert.Equal(t, app.HeatmapDataPushed, appended.DataSource)
+		assert.Equal(t, 3, appended.Stats.TotalPoints)
+		assert.Equal(t, created.Version, appended.Version, "Appending should not change the configuration version")
+
+		_, err = heatmaps.AppendPoints(ctx, created.ID, []app.HeatmapPoint{{X: 1, Y: 1}, {X: 3, Y: 0}})
+		assert.Error(t, err, "Points outside the grid should be rejected")
+		_, err = heatmaps.AppendPoints(ctx, created.ID, []app.HeatmapPoint{{X: 1, Y: 1, Intensity: -1}})
+		assert.Error(t, err)
+		_, err = heatmaps.AppendPoints(app.ContextWithProject(context.Background(), "other"), created.ID, []app.HeatmapPoint{{X: 1, Y: 1}})
+		assert.Error(t, err, "Heatmaps of other projects should not be found")
+
+		stored, err := heatmaps.GetHeatmap(ctx, created.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, [][]int{{2, 0, 0}, {0, 0, 5}}, stored.Data, "Rejected batches should add no point")
+		assert.Equal(t, 3, stored.Stats.TotalPoints)
+
+		_, err = heatmaps.ImportData(ctx, created.ID, [][]int{{1, 1, 1}, {1, 1, 1}})
+		assert.NoError(t, err)
+		appended, err = heatmaps.AppendPoints(ctx, created.ID, []app.HeatmapPoint{{X: 1, Y: 0}})
+		assert.NoError(t, err)
+		assert.Equal(t, [][]int{{1, 2, 1}, {1, 1, 1}}, appended.Data, "Points should add up with imported data")
+		assert.Equal(t, 1, appended.Stats.TotalPoints)
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		heatmaps := app.NewHeatmapService(app.NewAnalyticsService())
+		ctx := app.ContextWithProject(context.Background(), "web")
+		created, err := heatmaps.CreateHeatmap(ctx, "Home clicks", "", "click", "/home", 4, 4, nil)
+		assert.NoError(t, err)
+		before, err := heatmaps.GetHeatmap(ctx, created.ID)
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for client := 0; client < 8; client++ {
+			wg.Add(1)
+			go func(client int) {
+				defer wg.Done()
+				for batch := 0; batch < 25; batch++ {
+					_, err := heatmaps.AppendPoints(ctx, created.ID, []app.HeatmapPoint{{X: client % 4, Y: 0}, {X: 3, Y: 3, Intensity: 2}})
+					assert.NoError(t, err)
+					_, err = heatmaps.GetHeatmap(ctx, created.ID)
+					assert.NoError(t, err)
+				}
+			}(client)
+		}
+		wg.Wait()
+
+		stored, err := heatmaps.GetHeatmap(ctx, created.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{50, 50, 50, 50}, stored.Data[0], "No concurrent append should be lost")
+		assert.Equal(t, 400, stored.Data[3][3])
+		assert.Equal(t, 400, stored.Stats.TotalPoints)
+		assert.Equal(t, 0, before.Data[3][3], "Grids already read should not change")
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		t.Setenv("HEATMAP_POINTS_MAX_BATCH", "3")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			_ = json.Unmarshal(content, &decoded)
+			return resp.StatusCode, decoded
+		}
+
+		status, body := send("POST", "/api/v1/heatmaps", `{"name":"Home clicks","type":"click","page":"/home","width":3,"height":2}`)
+		assert.Equal(t, 200, status)
+		id := body["heatmap"].(map[string]interface{})["id"].(string)
+		path := "/api/v1/heatmaps/" + id + "/points"
+
+		status, body = send("POST", path, `{"points":[{"x":0,"y":0},{"x":1,"y":1,"intensity":4}]}`)
+		assert.Equal(t, 200, status, body)
+		assert.Equal(t, float64(2), body["appended"])
+		heatmap := body["heatmap"].(map[string]interface{})
+		assert.Equal(t, "pushed", heatmap["data_source"])
+		assert.Nil(t, heatmap["data"])
+
+		for _, invalid := range []string{`{"points":[]}`, `{"points":[{"x":0,"y":0},{"x":0,"y":0},{"x":0,"y":0},{"x":0,"y":0}]}`, `{"points":[{"x":0,"y":2}]}`, `not json`} {
+			status, _ = send("POST", path, invalid)
+			assert.Equal(t, 400, status, invalid)
+		}
+		status, _ = send("POST", "/api/v1/heatmaps/missing/points", `{"points":[{"x":0,"y":0}]}`)
+		assert.Equal(t, 404, status)
+
+		req := httptest.NewRequest("GET", "/api/v1/heatmaps/"+id+"/data", bytes.NewReader(nil))
+		req.Header.Set("X-Project-ID", "web")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		content, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "1,0,0\r\n0,4,0\r\n", string(content))
+	})
+}
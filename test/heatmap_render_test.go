@@ -0,0 +1,135 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestHeatmapRender tests rendering heatmap data grids as PNG and SVG images
+func TestHeatmapRender(t *testing.T) {
+	data := [][]int{{0, 1, 0}, {0, 2, 4}}
+
+	t.Run("PNG", func(t *testing.T) {
+		options, err := app.ParseHeatmapRenderOptions("0000ff,ff0000", "", "")
+		assert.NoError(t, err)
+		rendered, err := app.RenderHeatmap(app.HeatmapRenderPNG, data, options)
+		assert.NoError(t, err)
+
+		img, err := png.Decode(bytes.NewReader(rendered))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, img.Bounds().Dx())
+		assert.Equal(t, 2, img.Bounds().Dy())
+		pixel := func(x, y int) color.NRGBA {
+			return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+		}
+		assert.Equal(t, uint8(0), pixel(0, 0).A, "Cells without activity should be transparent")
+		assert.Equal(t, color.NRGBA{R: 255, A: 255}, pixel(2, 1), "The most intense cell should take the last color")
+		assert.Equal(t, color.NRGBA{R: 64, B: 191, A: 255}, pixel(1, 0))
+		assert.Equal(t, color.NRGBA{R: 128, B: 128, A: 255}, pixel(1, 1))
+	})
+
+	t.Run("OpacityAndBackground", func(t *testing.T) {
+		options, err := app.ParseHeatmapRenderOptions("grayscale", "0.5", "")
+		assert.NoError(t, err)
+		rendered, err := app.RenderHeatmap(app.HeatmapRenderPNG, data, options)
+		assert.NoError(t, err)
+		img, err := png.Decode(bytes.NewReader(rendered))
+		assert.NoError(t, err)
+		assert.Equal(t, color.NRGBA{R: 255, G: 255, B: 255, A: 128}, color.NRGBAModel.Convert(img.At(2, 1)))
+
+		options, err = app.ParseHeatmapRenderOptions("#000000,#ffffff", "0.5", "#ff0000")
+		assert.NoError(t, err)
+		rendered, err = app.RenderHeatmap(app.HeatmapRenderPNG, data, options)
+		assert.NoError(t, err)
+		img, err = png.Decode(bytes.NewReader(rendered))
+		assert.NoError(t, err)
+		assert.Equal(t, color.NRGBA{R: 255, A: 255}, color.NRGBAModel.Convert(img.At(0, 0)), "Cells without activity should show the background")
+		assert.Equal(t, color.NRGBA{R: 255, G: 128, B: 128, A: 255}, color.NRGBAModel.Convert(img.At(2, 1)), "Cells should be blended over the background")
+	})
+
+	t.Run("SVG", func(t *testing.T) {
+		options, err := app.ParseHeatmapRenderOptions("0000ff,ff0000", "", "")
+		assert.NoError(t, err)
+		rendered, err := app.RenderHeatmap(app.HeatmapRenderSVG, [][]int{{0, 4, 4, 1}}, options)
+		assert.NoError(t, err)
+		svg := string(rendered)
+		assert.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="4" height="1"`))
+		assert.Contains(t, svg, `<rect x="1" y="0" width="2" height="1" fill="#ff0000"/>`, "Runs of the same color should be merged")
+		assert.Contains(t, svg, `<rect x="3" y="0" width="1" height="1" fill="#4000bf"/>`)
+		assert.Equal(t, 2, strings.Count(svg, "<rect"), "Cells without activity should not be drawn")
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, invalid := range [][3]string{
+			{"rainbow", "", ""},
+			{"0000ff", "", ""},
+			{"0000ff,zzzzzz", "", ""},
+			{"", "1.5", ""},
+			{"", "half", ""},
+			{"", "", "white"},
+		} {
+			_, err := app.ParseHeatmapRenderOptions(invalid[0], invalid[1], invalid[2])
+			assert.Error(t, err, "%v should be rejected", invalid)
+		}
+		_, err := app.HeatmapRenderFormat("gif")
+		assert.Error(t, err)
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		heatmaps := application.GetHeatmapService()
+		ctx := app.ContextWithProject(context.Background(), "web")
+		created, err := heatmaps.CreateHeatmap(ctx, "Home clicks", "", "click", "/home", 3, 2, nil)
+		assert.NoError(t, err)
+		_, err = heatmaps.ImportData(ctx, created.ID, data)
+		assert.NoError(t, err)
+
+		get := func(path string) (int, string, []byte) {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp.StatusCode, resp.Header.Get("Content-Type"), content
+		}
+		path := "/api/v1/heatmaps/" + created.ID + "/render"
+
+		status, contentType, content := get(path)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "image/png", contentType)
+		img, err := png.Decode(bytes.NewReader(content))
+		assert.NoError(t, err)
+		assert.Equal(t, 3, img.Bounds().Dx())
+
+		status, contentType, content = get(path + "?format=svg&gradient=fire&opacity=0.5")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "image/svg+xml", contentType)
+		assert.Contains(t, string(content), `fill="#ffffff" fill-opacity="0.502"`)
+
+		status, _, content = get(path + "?format=gif")
+		assert.Equal(t, 400, status)
+		var body map[string]interface{}
+		assert.NoError(t, json.Unmarshal(content, &body))
+		assert.Contains(t, body["error"], "invalid image format")
+
+		status, _, _ = get(path + "?gradient=rainbow")
+		assert.Equal(t, 400, status)
+		status, _, _ = get("/api/v1/heatmaps/missing/render")
+		assert.Equal(t, 404, status)
+	})
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestHeatmapSchedule tests regenerating stored heatmaps on a schedule over a rolling window
+func TestHeatmapSchedule(t *testing.T) {
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	t.Run("ValidatesSchedules", func(t *testing.T) {
+		schedule, err := app.NewHeatmapSchedule("1h", "7d")
+		assert.NoError(t, err)
+		assert.Equal(t, "1h0m0s", schedule.Refresh)
+		assert.Equal(t, "7d", schedule.Window)
+
+		_, err = app.NewHeatmapSchedule("1m", "7d")
+		assert.Error(t, err, "Refreshes more often than every 5 minutes should be rejected")
+		_, err = app.NewHeatmapSchedule("1h", "soon")
+		assert.Error(t, err)
+	})
+
+	t.Run("RegeneratesWhenDue", func(t *testing.T) {
+		heatmaps := app.NewHeatmapService(app.NewAnalyticsService())
+		var updates []*app.Heatmap
+		refresher := app.NewHeatmapRefresher(heatmaps, func(heatmap *app.Heatmap) {
+			updates = append(updates, heatmap)
+		})
+
+		schedule, err := app.NewHeatmapSchedule("1h", "7d")
+		assert.NoError(t, err)
+		scheduled, err := heatmaps.CreateHeatmap(ctx, "Home clicks", "", "click", "/home", 400, 300, schedule)
+		assert.NoError(t, err)
+		_, err = heatmaps.CreateHeatmap(ctx, "Manual", "", "click", "/pricing", 400, 300, nil)
+		assert.NoError(t, err)
+
+		now := time.Now()
+		assert.Equal(t, 1, refresher.Run(now), "New schedules should regenerate right away")
+		assert.Equal(t, 1, len(updates))
+		assert.Equal(t, scheduled.ID, updates[0].ID)
+		assert.NotNil(t, updates[0].GeneratedAt)
+		assert.Equal(t, now.Add(time.Hour), updates[0].Schedule.NextRunAt)
+
+		assert.Equal(t, 0, refresher.Run(now.Add(30*time.Minute)))
+		assert.Equal(t, 1, refresher.Run(now.Add(time.Hour)))
+
+		stored, err := heatmaps.GetHeatmap(ctx, scheduled.ID)
+		assert.NoError(t, err)
+		assert.NotNil(t, stored.Stats)
+		assert.Equal(t, now.Add(time.Hour), *stored.Schedule.LastRunAt)
+
+		// Removing the schedule stops the regenerations
+		_, err = heatmaps.UpdateHeatmap(ctx, scheduled.ID, "Home clicks", "", "click", "/home", 400, 300, nil, stored.Version)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, refresher.Run(now.Add(24*time.Hour)))
+	})
+
+	t.Run("RecordsFailures", func(t *testing.T) {
+		heatmaps := app.NewHeatmapService(app.NewAnalyticsService())
+		refresher := app.NewHeatmapRefresher(heatmaps, nil)
+
+		// Scheduled runs are not billed to a user, so the default plan's resolution applies
+		schedule, err := app.NewHeatmapSchedule("1h", "1d")
+		assert.NoError(t, err)
+		created, err := heatmaps.CreateHeatmap(ctx, "Huge", "", "click", "/home", 7680, 4320, schedule)
+		assert.NoError(t, err)
+
+		now := time.Now()
+		assert.Equal(t, 0, refresher.Run(now))
+		stored, err := heatmaps.GetHeatmap(ctx, created.ID)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, stored.Schedule.LastError)
+		assert.Equal(t, now.Add(time.Hour), stored.Schedule.NextRunAt, "Failures should be retried at the next refresh")
+	})
+
+	t.Run("BroadcastsUpdates", func(t *testing.T) {
+		dashboards := app.NewDashboardService()
+		dashboards.Start()
+
+		dashboards.BroadcastHeatmapUpdated(&app.Heatmap{ID: "heatmap_1", ProjectID: "web", Page: "/home", Type: "click"})
+		assert.Eventually(t, func() bool {
+			_, result := dashboards.Replay("web", 0)
+			return result.LatestSeq == 1
+		}, time.Second, 10*time.Millisecond)
+
+		messages, _ := dashboards.Replay("web", 1)
+		var metric app.DashboardMetric
+		assert.NoError(t, json.Unmarshal(messages[0], &metric))
+		assert.Equal(t, "heatmap.updated", metric.Type)
+		assert.Equal(t, "heatmap_1", metric.Value.(map[string]interface{})["heatmap_id"])
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest("POST", "/api/v1/heatmaps", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var content map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&content))
+			return resp.StatusCode, content
+		}
+
+		status, content := send(`{"name":"Home","type":"click","page":"/home","width":400,"height":300,"schedule":{"refresh":"1h","window":"7d"}}`)
+		assert.Equal(t, 200, status)
+		schedule := content["heatmap"].(map[string]interface{})["schedule"].(map[string]interface{})
+		assert.Equal(t, "7d", schedule["window"])
+
+		status, _ = send(`{"name":"Home","type":"click","page":"/home","width":400,"height":300,"schedule":{"refresh":"1s","window":"7d"}}`)
+		assert.Equal(t, 400, status)
+	})
+}
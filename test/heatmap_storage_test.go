@@ -0,0 +1,122 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestHeatmapStorage tests storing heatmaps with their latest data and listing them
+func TestHeatmapStorage(t *testing.T) {
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	t.Run("StoresLatestData", func(t *testing.T) {
+		heatmaps := app.NewHeatmapService(app.NewAnalyticsService())
+		created, err := heatmaps.CreateHeatmap(ctx, "Home clicks", "", "click", "/home", 400, 300, nil)
+		assert.NoError(t, err)
+		assert.Nil(t, created.GeneratedAt)
+
+		result, err := heatmaps.GenerateHeatmap(ctx, app.HeatmapQuery{
+			HeatmapID: created.ID,
+			Start:     time.Now().AddDate(0, 0, -7),
+			End:       time.Now(),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, created.ID, result.HeatmapID)
+		assert.Equal(t, 400, result.Width, "The stored heatmap's dimensions should be used")
+
+		stored, err := heatmaps.GetHeatmap(ctx, created.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, result.Data, stored.Data)
+		assert.Equal(t, result.Stats, *stored.Stats)
+		assert.NotNil(t, stored.GeneratedAt)
+		assert.Equal(t, created.Version, stored.Version, "Generating should not change the configuration version")
+
+		updated, err := heatmaps.UpdateHeatmap(ctx, created.ID, "Home scrolls", "", "scroll", "/home", 400, 300, nil, stored.Version)
+		assert.NoError(t, err)
+		assert.Nil(t, updated.Stats, "Changing the type should clear the latest data")
+		assert.Nil(t, updated.GeneratedAt)
+
+		_, err = heatmaps.GenerateHeatmap(ctx, app.HeatmapQuery{HeatmapID: "missing"})
+		assert.Error(t, err)
+	})
+
+	t.Run("ListAndDelete", func(t *testing.T) {
+		heatmaps := app.NewHeatmapService(app.NewAnalyticsService())
+		home, err := heatmaps.CreateHeatmap(ctx, "Home clicks", "", "click", "/home", 400, 300, nil)
+		assert.NoError(t, err)
+		_, err = heatmaps.CreateHeatmap(ctx, "Home scrolls", "", "scroll", "/home", 400, 300, nil)
+		assert.NoError(t, err)
+		_, err = heatmaps.CreateHeatmap(ctx, "Pricing clicks", "", "click", "/pricing", 400, 300, nil)
+		assert.NoError(t, err)
+		other := app.ContextWithProject(context.Background(), "other")
+		_, err = heatmaps.CreateHeatmap(other, "Other", "", "click", "/home", 400, 300, nil)
+		assert.NoError(t, err)
+
+		assert.Equal(t, 3, len(heatmaps.ListHeatmaps(ctx, app.HeatmapFilter{})))
+		assert.Equal(t, 2, len(heatmaps.ListHeatmaps(ctx, app.HeatmapFilter{Page: "/home"})))
+		listed := heatmaps.ListHeatmaps(ctx, app.HeatmapFilter{Page: "/home", Type: "click"})
+		assert.Equal(t, 1, len(listed))
+		assert.Equal(t, home.ID, listed[0].ID)
+		assert.Nil(t, listed[0].Data, "Listings should leave out the data grids")
+
+		_, err = heatmaps.GetHeatmap(other, home.ID)
+		assert.Error(t, err, "Heatmaps of other projects should not be found")
+		assert.Error(t, heatmaps.DeleteHeatmap(other, home.ID))
+
+		assert.NoError(t, heatmaps.DeleteHeatmap(ctx, home.ID))
+		_, err = heatmaps.GetHeatmap(ctx, home.ID)
+		assert.Error(t, err)
+		assert.Equal(t, 2, len(heatmaps.ListHeatmaps(ctx, app.HeatmapFilter{})))
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var content map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&content))
+			return resp.StatusCode, content
+		}
+
+		status, content := send("POST", "/api/v1/heatmaps", `{"name":"Home clicks","type":"click","page":"/home","width":400,"height":300}`)
+		assert.Equal(t, 200, status)
+		id := content["heatmap"].(map[string]interface{})["id"].(string)
+
+		status, _ = send("POST", "/api/v1/heatmaps/generate", `{"heatmap_id":"`+id+`"}`)
+		assert.Equal(t, 200, status)
+		status, content = send("GET", "/api/v1/heatmaps/"+id, "")
+		assert.Equal(t, 200, status)
+		assert.NotNil(t, content["heatmap"].(map[string]interface{})["generated_at"])
+
+		status, content = send("GET", "/api/v1/heatmaps?page=/home&type=click", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(1), content["count"])
+		status, content = send("GET", "/api/v1/heatmaps?type=scroll", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(0), content["count"])
+
+		status, _ = send("DELETE", "/api/v1/heatmaps/"+id, "")
+		assert.Equal(t, 200, status)
+		status, _ = send("GET", "/api/v1/heatmaps/"+id, "")
+		assert.Equal(t, 404, status)
+		status, _ = send("DELETE", "/api/v1/heatmaps/"+id, "")
+		assert.Equal(t, 404, status)
+		status, _ = send("POST", "/api/v1/heatmaps/generate", `{"heatmap_id":"`+id+`"}`)
+		assert.Equal(t, 404, status)
+	})
+}
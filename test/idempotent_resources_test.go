@@ -0,0 +1,123 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestIdempotentResources tests client-supplied IDs, upserts and fingerprints of configuration resources
+func TestIdempotentResources(t *testing.T) {
+	steps := []app.Step{
+		{ID: "step_1", Name: "Landing", EventType: "page_view", Order: 1},
+		{ID: "step_2", Name: "Signup", EventType: "signup", Order: 2},
+	}
+
+	t.Run("CreateWithIDIsIdempotent", func(t *testing.T) {
+		service := app.NewFunnelService(app.NewAnalyticsService())
+		ctx := app.ContextWithProject(context.Background(), "shop")
+
+		funnel, created, err := service.CreateFunnelWithID(ctx, "signup-funnel", "Signup", "", steps)
+		assert.NoError(t, err)
+		assert.True(t, created)
+		assert.Equal(t, "signup-funnel", funnel.ID)
+
+		retried, created, err := service.CreateFunnelWithID(ctx, "signup-funnel", "Signup", "", steps)
+		assert.NoError(t, err)
+		assert.False(t, created, "Retrying the same creation should return the existing funnel")
+		assert.Equal(t, funnel.Version, retried.Version)
+
+		_, _, err = service.CreateFunnelWithID(ctx, "signup-funnel", "Other", "", steps)
+		var exists *app.ResourceExistsError
+		assert.True(t, errors.As(err, &exists))
+
+		_, _, err = service.CreateFunnelWithID(context.Background(), "signup-funnel", "Signup", "", steps)
+		assert.True(t, errors.As(err, &exists), "IDs used by another project should be rejected")
+
+		_, _, err = service.CreateFunnelWithID(ctx, "bad id/with slash", "Signup", "", steps)
+		assert.Error(t, err)
+	})
+
+	t.Run("UpsertByName", func(t *testing.T) {
+		service := app.NewFunnelService(app.NewAnalyticsService())
+		ctx := context.Background()
+
+		funnel, created, err := service.UpsertFunnel(ctx, "", "Signup", "", steps)
+		assert.NoError(t, err)
+		assert.True(t, created)
+
+		same, created, err := service.UpsertFunnel(ctx, "", "Signup", "", steps)
+		assert.NoError(t, err)
+		assert.False(t, created)
+		assert.Equal(t, funnel.ID, same.ID)
+		assert.Equal(t, int64(1), same.Version, "Identical upserts should not bump the version")
+
+		updated, _, err := service.UpsertFunnel(ctx, "", "Signup", "Landing to signup", steps)
+		assert.NoError(t, err)
+		assert.Equal(t, funnel.ID, updated.ID)
+		assert.Equal(t, int64(2), updated.Version)
+		assert.NotEqual(t, funnel.Fingerprint(), updated.Fingerprint())
+		assert.Equal(t, 1, len(service.ListFunnels(ctx)))
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+
+		send := func(method, path, ifMatch, body string) *http.Response {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp
+		}
+
+		// PUT creates absent resources under the requested ID without If-Match
+		query := `{"name":"Pro buyers","type":"segment","parameters":{"event_type":"purchase"}}`
+		resp := send("PUT", "/api/v1/queries/pro-buyers", "", query)
+		assert.Equal(t, 201, resp.StatusCode)
+		assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+		assert.Equal(t, 200, send("POST", "/api/v1/queries", "", `{"id":"pro-buyers",`+query[1:]).StatusCode, "Retried creations should succeed without changes")
+		assert.Equal(t, 428, send("PUT", "/api/v1/queries/pro-buyers", "", `{"name":"Renamed","type":"segment"}`).StatusCode)
+		assert.Equal(t, 200, send("PUT", "/api/v1/queries/pro-buyers", `"1"`, `{"name":"Renamed","type":"segment"}`).StatusCode)
+
+		dashboard := `{"id":"sales","name":"Sales","widgets":[{"title":"Pro buyers","query_id":"pro-buyers"}]}`
+		assert.Equal(t, 200, send("POST", "/api/v1/dashboards", "", dashboard).StatusCode)
+		assert.Equal(t, 200, send("POST", "/api/v1/dashboards", "", dashboard).StatusCode)
+		assert.Equal(t, 409, send("POST", "/api/v1/dashboards", "", `{"id":"sales","name":"Other","widgets":[{"title":"Events","metric":"events"}]}`).StatusCode)
+
+		resp = send("POST", "/api/v1/funnels?upsert=true", "", `{"name":"Signup","steps":[{"name":"Landing","event_type":"page_view","order":1},{"name":"Signup","event_type":"signup","order":2}]}`)
+		assert.Equal(t, 200, resp.StatusCode)
+		resp = send("POST", "/api/v1/funnels?upsert=true", "", `{"name":"Signup","description":"v2","steps":[{"name":"Landing","event_type":"page_view","order":1},{"name":"Signup","event_type":"signup","order":2}]}`)
+		assert.Equal(t, `"2"`, resp.Header.Get("ETag"), "Upserting by name should update the existing funnel")
+
+		resp = send("GET", "/api/v1/resources", "", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			Resources []app.ResourceFingerprint `json:"resources"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, 3, len(body.Resources))
+		for _, resource := range body.Resources {
+			assert.Equal(t, 64, len(resource.Fingerprint))
+		}
+
+		resp = send("GET", "/api/v1/resources?kind=query", "", "")
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, 1, len(body.Resources))
+		assert.Equal(t, "pro-buyers", body.Resources[0].ID)
+		assert.Equal(t, int64(2), body.Resources[0].Version)
+		assert.Equal(t, 400, send("GET", "/api/v1/resources?kind=alert", "", "").StatusCode)
+	})
+}
@@ -0,0 +1,164 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestIdentityMerges tests counting the anonymous and identified user IDs merged by identity
+// resolution as one user in unique counts, funnels and user queries, including for events stored
+// before the merge
+func TestIdentityMerges(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	setup := func() (*app.AnalyticsService, *app.FakeClock) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		return service, clock
+	}
+	track := func(service *app.AnalyticsService, clock *app.FakeClock, userID, eventType string) {
+		clock.Advance(time.Minute)
+		_, err := service.TrackEvent(ctx, map[string]interface{}{"event_type": eventType, "user_id": userID, "page": "/pricing"}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+
+	t.Run("Merge", func(t *testing.T) {
+		identities := app.NewIdentityMerges()
+		for _, invalid := range [][2]string{{"", "user1"}, {"anon-1", ""}, {"user1", "user1"}, {app.AnonymousUserID, "user1"}} {
+			_, err := identities.Merge("web", invalid[0], invalid[1], start)
+			assert.Error(t, err, invalid)
+		}
+
+		merge, err := identities.Merge("web", "anon-2", "anon-1", start)
+		assert.NoError(t, err)
+		assert.True(t, merge.Merged)
+		merge, err = identities.Merge("web", "anon-1", "user1", start)
+		assert.NoError(t, err)
+		assert.Equal(t, "user1", merge.IntoUserID)
+		assert.Equal(t, "user1", identities.Resolve("web", "anon-2"), "IDs merged before should follow their user")
+		assert.Equal(t, "anon-2", identities.Resolve("mobile", "anon-2"), "Merges should be kept per project")
+
+		merge, err = identities.Merge("web", "anon-2", "user1", start)
+		assert.NoError(t, err)
+		assert.False(t, merge.Merged, "Merging IDs already merged should be a no-op")
+
+		identity := identities.Identity("web", "anon-1")
+		assert.Equal(t, "user1", identity.UserID)
+		assert.Equal(t, "anon-1", identity.MergedFromID)
+		assert.Equal(t, []string{"anon-1", "anon-2"}, identity.MergedIDs)
+
+		t.Setenv("IDENTITY_MAX_MERGED_IDS", "1")
+		limited := app.NewIdentityMerges()
+		_, err = limited.Merge("web", "anon-1", "user1", start)
+		assert.NoError(t, err)
+		_, err = limited.Merge("web", "anon-2", "user1", start)
+		assert.ErrorContains(t, err, "maximum of 1 merged user IDs")
+	})
+
+	t.Run("UniqueUsers", func(t *testing.T) {
+		service, clock := setup()
+		queries := app.NewQueryService(service)
+		track(service, clock, "anon-1", "page_view")
+		track(service, clock, "anon-1", "page_view")
+		track(service, clock, "user1", "page_view")
+		track(service, clock, "user2", "page_view")
+
+		trend := func(interval string, end time.Time) int64 {
+			result, err := queries.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: interval, Start: start.Truncate(24 * time.Hour), End: end})
+			assert.NoError(t, err)
+			var users int64
+			for _, point := range result.Points {
+				users += point.UniqueUsers
+			}
+			return users
+		}
+		pages := func() int64 {
+			report, err := service.Rollups().Query(app.RollupQuery{ProjectID: "web", Dimension: app.RollupPage, Start: start, End: start.Add(24 * time.Hour)})
+			assert.NoError(t, err)
+			return report.UniqueUsers
+		}
+		assert.Equal(t, int64(3), trend("hour", start.Add(time.Hour)))
+		assert.Equal(t, int64(3), pages())
+
+		_, err := service.MergeUsers("web", "anon-1", "user1")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), trend("hour", start.Add(time.Hour)), "Raw events should count merged IDs once")
+		assert.Equal(t, int64(2), pages(), "Rollups should count merged IDs once")
+
+		segment, err := queries.ComputeSegment(ctx, app.SegmentQuery{EventType: "page_view", Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"user1", "user2"}, segment.Users)
+
+		events := service.QueryEvents(ctx, app.EventFilter{UserID: "anon-1"})
+		assert.Len(t, events, 3, "Querying a merged ID should return the events of its user")
+		assert.Equal(t, "user1", events[0].UserID)
+		assert.Equal(t, "anon-1", events[0].OriginalUserID)
+		assert.Empty(t, events[2].OriginalUserID)
+	})
+
+	t.Run("Funnels", func(t *testing.T) {
+		service, clock := setup()
+		funnels := app.NewFunnelService(service)
+		funnel, err := funnels.CreateFunnel(ctx, "Signup", "", []app.Step{
+			{ID: "view", Name: "Pricing", EventType: "page_view", Order: 1},
+			{ID: "signup", Name: "Signup", EventType: "signup", Order: 2},
+		})
+		assert.NoError(t, err)
+		track(service, clock, "anon-1", "page_view")
+		track(service, clock, "user1", "signup")
+
+		compute := func() *app.FunnelResult {
+			result, err := funnels.ComputeFunnel(ctx, app.FunnelQuery{FunnelID: funnel.ID, Start: start, End: start.Add(time.Hour)})
+			assert.NoError(t, err)
+			return result
+		}
+		assert.Equal(t, 0.0, compute().ConversionRate)
+
+		_, err = service.MergeUsers("web", "anon-1", "user1")
+		assert.NoError(t, err)
+		result := compute()
+		assert.Equal(t, int64(1), result.TotalUsers)
+		assert.Equal(t, 100.0, result.ConversionRate, "Steps performed before identifying should count for the user")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+
+		status, _ := send("POST", "/api/v1/analytics/identify", `{"anonymous_id":"anon-1"}`)
+		assert.Equal(t, 400, status)
+		status, body := send("POST", "/api/v1/analytics/identify", `{"anonymous_id":"anon-1","user_id":"user1"}`)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, true, body["merge"].(map[string]interface{})["merged"])
+
+		status, body = send("GET", "/api/v1/users/anon-1/identity", "")
+		assert.Equal(t, 200, status)
+		identity := body["identity"].(map[string]interface{})
+		assert.Equal(t, "user1", identity["user_id"])
+		assert.Equal(t, []interface{}{"anon-1"}, identity["merged_ids"])
+	})
+}
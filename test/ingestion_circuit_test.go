@@ -0,0 +1,168 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestIngestionCircuit tests accepting events into the ingestion log while the event store is down
+// and storing them once it recovers
+func TestIngestionCircuit(t *testing.T) {
+	t.Setenv("FAULT_INJECTION_ENABLED", "true")
+	t.Setenv("EVENT_STORE_FLUSH_INTERVAL", "1h")
+	t.Setenv("INGESTION_CIRCUIT_PROBE_INTERVAL", "0")
+
+	newService := func(t *testing.T, walPath string) (*app.AnalyticsService, *app.FaultInjector) {
+		t.Setenv("INGESTION_WAL_PATH", walPath)
+		service := app.NewAnalyticsService()
+		faults := app.NewFaultInjector()
+		service.SetFaultInjector(faults)
+		t.Cleanup(service.IngestionCircuit().Stop)
+		return service, faults
+	}
+	track := func(service *app.AnalyticsService, userID string, properties map[string]interface{}) *app.AnalyticsEvent {
+		event, err := service.TrackEvent(context.Background(), map[string]interface{}{"event_type": "page_view", "user_id": userID, "properties": properties}, "test-key", userID)
+		assert.NoError(t, err)
+		return event
+	}
+
+	t.Run("OpensAndDrains", func(t *testing.T) {
+		service, faults := newService(t, filepath.Join(t.TempDir(), "ingestion.wal"))
+		circuit := service.IngestionCircuit()
+		_, err := faults.SetRule(app.FaultRule{Dependency: app.FaultStore, ErrorRate: 1}, 0)
+		assert.NoError(t, err)
+
+		for i := 0; i < 4; i++ {
+			event := track(service, "user1", map[string]interface{}{"step": i})
+			assert.True(t, event.Queued, "Events should be accepted while the store is down")
+		}
+		status := circuit.Status()
+		assert.Equal(t, app.IngestionCircuitOpen, status.State, "The circuit should open after 3 failed writes")
+		assert.NotNil(t, status.OpenedAt)
+		assert.Equal(t, int64(4), status.Backlog)
+		assert.True(t, status.Degraded())
+		assert.Equal(t, int64(0), service.EventCount(), "Logged events should not be stored yet")
+
+		// Probes fail while the store is still down
+		_, err = service.RecoverIngestion(context.Background())
+		assert.Error(t, err)
+		assert.Equal(t, int64(4), circuit.Status().Backlog)
+
+		faults.Clear()
+		assert.True(t, track(service, "user1", nil).Queued, "Events should be logged until a probe succeeds")
+		drained, err := service.RecoverIngestion(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 5, drained)
+		status = circuit.Status()
+		assert.Equal(t, app.IngestionCircuitClosed, status.State)
+		assert.Equal(t, int64(0), status.Backlog)
+		assert.Equal(t, int64(5), status.Drained)
+		assert.False(t, status.Degraded())
+		assert.Equal(t, int64(5), service.EventCount())
+
+		events := service.QueryEvents(context.Background(), app.EventFilter{UserID: "user1"})
+		assert.Len(t, events, 5)
+		assert.Equal(t, 0.0, events[0].Properties["step"], "Logged events should keep their properties")
+		assert.False(t, track(service, "user1", nil).Queued)
+
+		drained, err = service.RecoverIngestion(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 0, drained)
+	})
+
+	t.Run("KeptAcrossRestarts", func(t *testing.T) {
+		walPath := filepath.Join(t.TempDir(), "ingestion.wal")
+		service, faults := newService(t, walPath)
+		_, err := faults.SetRule(app.FaultRule{Dependency: app.FaultStore, ErrorRate: 1}, 0)
+		assert.NoError(t, err)
+		track(service, "user1", nil)
+		track(service, "user2", nil)
+		service.IngestionCircuit().Stop()
+
+		restarted, _ := newService(t, walPath)
+		assert.Equal(t, int64(2), restarted.IngestionCircuit().Status().Backlog)
+		drained, err := restarted.RecoverIngestion(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 2, drained)
+		assert.Equal(t, int64(2), restarted.EventCount())
+	})
+
+	t.Run("WriterFailures", func(t *testing.T) {
+		service, _ := newService(t, filepath.Join(t.TempDir(), "ingestion.wal"))
+		store := &failingEventStore{MemoryEventStore: app.NewMemoryEventStore(), failing: true}
+		service.SetEventStore(store)
+		t.Cleanup(func() { _ = service.CloseEventStore() })
+
+		track(service, "user1", nil)
+		for i := 0; i < 3; i++ {
+			service.EventWriter().Flush()
+		}
+		assert.Equal(t, app.IngestionCircuitOpen, service.IngestionCircuit().Status().State)
+		assert.True(t, track(service, "user1", nil).Queued)
+
+		store.failing = false
+		drained, err := service.RecoverIngestion(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, drained)
+		assert.Equal(t, 2, service.EventWriter().Flush())
+		assert.Equal(t, 2, store.Len())
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		t.Setenv("INGESTION_WAL_PATH", filepath.Join(t.TempDir(), "ingestion.wal"))
+		t.Setenv("INGESTION_WAL_MAX_BYTES", "2000")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		service := application.GetAnalyticsService()
+		faults := app.NewFaultInjector()
+		service.SetFaultInjector(faults)
+		_, err := faults.SetRule(app.FaultRule{Dependency: app.FaultStore, ErrorRate: 1}, 0)
+		assert.NoError(t, err)
+
+		send := func(method, path, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return resp.StatusCode, decoded
+		}
+		event := `{"event_type":"page_view","user_id":"user1","page":"/home"}`
+
+		status, body := send("POST", "/api/v1/analytics/events", event)
+		assert.Equal(t, 200, status)
+		assert.Equal(t, true, body["queued"])
+
+		status, body = send("GET", "/health", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "degraded", body["status"])
+		assert.Equal(t, 1.0, body["storage"].(map[string]interface{})["backlog"])
+
+		// Events beyond the log's maximum size cannot be accepted
+		for i := 0; status == 200 && i < 100; i++ {
+			status, body = send("POST", "/api/v1/analytics/events", event)
+		}
+		assert.Equal(t, 503, status)
+		assert.Contains(t, body["error"], "ingestion log is full")
+
+		faults.Clear()
+		drained, err := service.RecoverIngestion(context.Background())
+		assert.NoError(t, err)
+		assert.Greater(t, drained, 1)
+		assert.Equal(t, int64(drained), service.EventCount())
+		_, body = send("GET", "/health", "")
+		assert.Equal(t, "healthy", body["status"])
+	})
+}
@@ -0,0 +1,175 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+	"magebase/apis/analytics/billingstub"
+	"magebase/apis/analytics/soak"
+)
+
+// Rate of the ingestion soak and its regression thresholds. They leave room for shared CI
+// machines; tighten them when the pipeline gets faster.
+const ingestionSoakRate = 200
+
+var ingestionSoakThresholds = soak.Thresholds{
+	MinThroughput:     180,
+	MaxP99:            100 * time.Millisecond,
+	MaxAllocsPerEvent: 1500,
+}
+
+// The race detector slows the pipeline several times, so the soak sends fewer events under it.
+// It still drives every stage concurrently, which is where races show.
+const ingestionSoakRaceRate = 50
+
+var ingestionSoakRaceThresholds = soak.Thresholds{
+	MinThroughput:     40,
+	MaxP99:            time.Second,
+	MaxAllocsPerEvent: 1500,
+}
+
+// soakEvent returns the body of the i-th event of a soak run, spread over a few pages and types
+func soakEvent(i int) []byte {
+	eventTypes := []string{"page_view", "click", "form_submit", "scroll"}
+	return []byte(fmt.Sprintf(`{"event_type":%q,"user_id":"user%d","page":"/page/%d","properties":{"referrer":"google.com","position":%d}}`,
+		eventTypes[i%len(eventTypes)], i%50, i%20, i))
+}
+
+// soakHeaders returns the headers of the i-th event of a soak run. Events are sent by many users,
+// so the per-user rate limit does not throttle them.
+func soakHeaders(i int) map[string]string {
+	return map[string]string{"X-API-Key": "test-key", "X-User-ID": fmt.Sprintf("soak-user-%d", i%1000), "X-Project-ID": "soak"}
+}
+
+// newSoakApp creates an app billing a stub that does not record, so memory stays flat
+func newSoakApp(t testing.TB) (*app.App, *billingstub.Server) {
+	stub := billingstub.NewServer()
+	stub.SetRecording(false)
+	t.Setenv("BILLING_SERVICE_URL", stub.URL())
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	return application, stub
+}
+
+// soakTarget sends requests to the app without Fiber's test timeout
+func soakTarget(application *app.App) soak.Target {
+	return func(req *http.Request) (*http.Response, error) {
+		return application.GetFiberApp().Test(req, -1)
+	}
+}
+
+// TestIngestionSoak drives the full ingestion pipeline (HTTP, validation, enrichment, storage and
+// billing) at a steady rate and fails when throughput, latency or allocations regress. Set
+// SOAK_RATE, SOAK_DURATION and SOAK_CONCURRENCY to soak it for longer.
+func TestIngestionSoak(t *testing.T) {
+	application, stub := newSoakApp(t)
+	defer stub.Close()
+	defer application.Stop()
+
+	rate, thresholds := ingestionSoakRate, ingestionSoakThresholds
+	if raceEnabled {
+		rate, thresholds = ingestionSoakRaceRate, ingestionSoakRaceThresholds
+	}
+	config, err := soak.ConfigFromEnv(soak.Config{
+		Rate:        rate,
+		Duration:    2 * time.Second,
+		Concurrency: 8,
+		Path:        "/api/v1/analytics/events",
+		Body:        soakEvent,
+		Headers:     soakHeaders,
+	})
+	assert.NoError(t, err)
+
+	report := soak.Run(soakTarget(application), config)
+	t.Logf("Ingestion soak: %s", report)
+
+	assert.NoError(t, report.Check(thresholds))
+	assert.Equal(t, int64(report.Events-report.Errors), application.GetAnalyticsService().EventCount())
+	assert.GreaterOrEqual(t, stub.Received(), 2*(report.Events-report.Errors), "Every stored event should be billed")
+}
+
+// TestSoakReport tests the percentiles and threshold checks of soak reports
+func TestSoakReport(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+	assert.Equal(t, 50*time.Millisecond, soak.Percentile(latencies, 50))
+	assert.Equal(t, 99*time.Millisecond, soak.Percentile(latencies, 99))
+	assert.Equal(t, 100*time.Millisecond, soak.Percentile(latencies, 100))
+	assert.Equal(t, time.Duration(0), soak.Percentile(nil, 99))
+
+	report := soak.Report{Events: 100, Errors: 2, Throughput: 90, P99: 300 * time.Millisecond, AllocsPerEvent: 500, FirstError: "status 500"}
+	assert.NoError(t, report.Check(soak.Thresholds{MinThroughput: 80, MaxP99: time.Second, MaxErrorRate: 0.05}))
+	err := report.Check(soak.Thresholds{MinThroughput: 100, MaxP99: 200 * time.Millisecond, MaxAllocsPerEvent: 400})
+	assert.Error(t, err)
+	for _, problem := range []string{"throughput", "p99", "allocations", "2 of 100 events failed"} {
+		assert.Contains(t, err.Error(), problem)
+	}
+
+	t.Setenv("SOAK_DURATION", "forever")
+	_, err = soak.ConfigFromEnv(soak.Config{})
+	assert.Error(t, err)
+}
+
+// BenchmarkTrackEvent measures tracking an event in the service, without HTTP
+func BenchmarkTrackEvent(b *testing.B) {
+	stub := billingstub.NewServer()
+	defer stub.Close()
+	stub.SetRecording(false)
+	b.Setenv("BILLING_SERVICE_URL", stub.URL())
+	service := app.NewAnalyticsService()
+	defer service.Bus().Stop()
+	ctx := app.ContextWithProject(context.Background(), "bench")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		eventData := map[string]interface{}{"event_type": "page_view", "user_id": "user1", "page": "/home", "properties": map[string]interface{}{"position": i}}
+		if _, err := service.TrackEvent(ctx, eventData, "test-key", "user1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkIngestionPipeline measures an event through the full pipeline, from the HTTP request
+// to the billing stub, and reports the p99 latency of the iterations
+func BenchmarkIngestionPipeline(b *testing.B) {
+	application, stub := newSoakApp(b)
+	defer stub.Close()
+	defer application.Stop()
+	fiberApp := application.GetFiberApp()
+
+	latencies := make([]time.Duration, 0, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(string(soakEvent(i))))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range soakHeaders(i) {
+			req.Header.Set(name, value)
+		}
+		started := time.Now()
+		resp, err := fiberApp.Test(req, -1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		latencies = append(latencies, time.Since(started))
+		if resp.StatusCode != http.StatusOK {
+			b.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+	b.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	b.ReportMetric(float64(soak.Percentile(latencies, 99).Microseconds()), "p99-µs")
+}
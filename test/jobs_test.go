@@ -0,0 +1,280 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestJobs tests running long computations in the background and reporting their progress
+// through the job status endpoints and WebSocket job channels
+func TestJobs(t *testing.T) {
+	t.Setenv("JOB_PROGRESS_INTERVAL", "10ms")
+
+	t.Run("Lifecycle", func(t *testing.T) {
+		jobs := app.NewJobs()
+		defer jobs.Stop()
+
+		release := make(chan struct{})
+		job, err := jobs.Submit("web", app.JobFunnel, func(ctx context.Context) (interface{}, error) {
+			<-release
+			return "result", nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "web", job.ProjectID)
+		assert.Equal(t, app.JobFunnel, job.Kind)
+		assert.Eventually(t, func() bool {
+			running, err := jobs.Job(job.ID)
+			return err == nil && running.Status == app.JobRunning && running.StartedAt != nil
+		}, time.Second, time.Millisecond)
+
+		close(release)
+		done, err := jobs.Done(job.ID)
+		assert.NoError(t, err)
+		<-done
+		completed, err := jobs.Job(job.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, app.JobSucceeded, completed.Status)
+		assert.Equal(t, "result", completed.Result)
+		assert.Equal(t, float64(100), completed.Progress.Percent)
+		assert.NotNil(t, completed.CompletedAt)
+		assert.Nil(t, completed.Progress.ETA)
+
+		failing, err := jobs.Submit("web", app.JobFunnel, func(ctx context.Context) (interface{}, error) {
+			return nil, fmt.Errorf("funnel not found")
+		})
+		assert.NoError(t, err)
+		done, _ = jobs.Done(failing.ID)
+		<-done
+		failed, err := jobs.Job(failing.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, app.JobFailed, failed.Status)
+		assert.Equal(t, "funnel not found", failed.Error)
+
+		_, err = jobs.Job("missing")
+		assert.Error(t, err)
+	})
+
+	t.Run("QueueFull", func(t *testing.T) {
+		t.Setenv("JOBS_WORKER_POOL_SIZE", "1")
+		t.Setenv("JOBS_QUEUE_CAPACITY", "1")
+		jobs := app.NewJobs()
+		release := make(chan struct{})
+		defer jobs.Stop()
+		defer close(release)
+
+		blocking := func(ctx context.Context) (interface{}, error) {
+			<-release
+			return nil, nil
+		}
+		running, err := jobs.Submit("", app.JobRollups, blocking)
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			job, _ := jobs.Job(running.ID)
+			return job.Status == app.JobRunning
+		}, time.Second, time.Millisecond)
+		queued, err := jobs.Submit("", app.JobRollups, blocking)
+		assert.NoError(t, err)
+		assert.Equal(t, app.JobQueued, queued.Status)
+
+		_, err = jobs.Submit("", app.JobRollups, blocking)
+		var queueFull *app.JobQueueFullError
+		assert.True(t, errors.As(err, &queueFull))
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application, feedURL := startDashboardServer(t)
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("alice", "operator-token", app.RoleOperator))
+		baseURL := "http" + feedURL[len("ws"):len(feedURL)-len("/api/v1/dashboard/feed")]
+
+		// More events than are scanned between progress updates
+		ctx := app.ContextWithProject(context.Background(), "web")
+		for i := 0; i < 1500; i++ {
+			_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+				"event_type": "page_view",
+				"user_id":    fmt.Sprintf("user%d", i%50),
+				"properties": map[string]interface{}{"page": "/home"},
+			}, "api-key", fmt.Sprintf("user%d", i%50))
+			assert.NoError(t, err)
+		}
+
+		send := func(method, path string, headers ...string) (int, http.Header, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, nil)
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return resp.StatusCode, resp.Header, body
+		}
+		awaitJob := func(path string, headers ...string) app.Job {
+			var job app.Job
+			assert.Eventually(t, func() bool {
+				status, _, body := send("GET", path, headers...)
+				if status != 200 {
+					return false
+				}
+				encoded, _ := json.Marshal(body["job"])
+				assert.NoError(t, json.Unmarshal(encoded, &job))
+				return job.Done()
+			}, 5*time.Second, 5*time.Millisecond)
+			return job
+		}
+
+		t.Run("RollupRebuild", func(t *testing.T) {
+			status, header, body := send("POST", "/api/v1/admin/rollups/rebuild", "X-Admin-Token", "operator-token", "Prefer", "respond-async")
+			assert.Equal(t, 202, status)
+			assert.Equal(t, "respond-async", header.Get("Preference-Applied"))
+			location := header.Get("Location")
+			assert.Contains(t, location, "/api/v1/admin/jobs/")
+			assert.Equal(t, location+"/progress", body["progress_url"])
+
+			job := awaitJob(location, "X-Admin-Token", "operator-token")
+			assert.Equal(t, app.JobSucceeded, job.Status)
+			assert.Equal(t, app.JobRollups, job.Kind)
+			assert.Equal(t, int64(1500), job.Progress.EventsScanned)
+			assert.Equal(t, int64(1500), job.Progress.EventsTotal)
+			assert.Equal(t, float64(100), job.Progress.Percent)
+			assert.Equal(t, float64(1500), job.Result.(map[string]interface{})["events"])
+
+			status, _, _ = send("GET", location)
+			assert.Equal(t, 401, status, "Administrative jobs should require an admin token")
+			status, _, _ = send("GET", "/api/v1/jobs"+location[len("/api/v1/admin/jobs"):], "X-Project-ID", "web")
+			assert.Equal(t, 404, status, "Administrative jobs should not be visible to projects")
+		})
+
+		t.Run("RetentionPurge", func(t *testing.T) {
+			status, header, _ := send("POST", "/api/v1/admin/retention/purge", "X-Admin-Token", "operator-token", "Prefer", "respond-async")
+			assert.Equal(t, 202, status)
+			job := awaitJob(header.Get("Location"), "X-Admin-Token", "operator-token")
+			assert.Equal(t, app.JobSucceeded, job.Status)
+			assert.Equal(t, app.JobRetentionRun, job.Kind)
+			assert.Equal(t, int64(1500), job.Progress.EventsScanned)
+		})
+
+		t.Run("Funnel", func(t *testing.T) {
+			funnel, err := application.GetFunnelService().CreateFunnel(ctx, "Signup", "", []app.Step{
+				{ID: "landing", Name: "Landing", EventType: "page_view", Order: 1},
+				{ID: "signup", Name: "Signup", EventType: "signup", Order: 2},
+			})
+			assert.NoError(t, err)
+
+			status, header, _ := send("GET", "/api/v1/funnels/"+funnel.ID+"/compute", "X-Project-ID", "web", "Prefer", "respond-async")
+			assert.Equal(t, 202, status)
+			location := header.Get("Location")
+			assert.Contains(t, location, "/api/v1/jobs/")
+
+			job := awaitJob(location, "X-Project-ID", "web")
+			assert.Equal(t, app.JobSucceeded, job.Status)
+			assert.Equal(t, funnel.ID, job.Result.(map[string]interface{})["funnel_id"])
+			status, _, _ = send("GET", location, "X-Project-ID", "other")
+			assert.Equal(t, 404, status, "Jobs of other projects should not be found")
+
+			// Completed jobs are reported right away over the job channel
+			progressURL := "ws" + baseURL[len("http"):] + location + "/progress"
+			conn, _, err := websocket.DefaultDialer.Dial(progressURL+"?project_id=web", nil)
+			assert.NoError(t, err)
+			defer conn.Close()
+			message := readUntil(t, conn, "job.completed", 2*time.Second)
+			assert.Equal(t, app.JobSucceeded, message["job"].(map[string]interface{})["status"])
+
+			other, _, err := websocket.DefaultDialer.Dial(progressURL+"?project_id=other", nil)
+			assert.NoError(t, err)
+			defer other.Close()
+			readUntil(t, other, "error", 2*time.Second)
+		})
+
+		t.Run("ProgressChannel", func(t *testing.T) {
+			status, header, _ := send("POST", "/api/v1/admin/rollups/rebuild", "X-Admin-Token", "operator-token", "Prefer", "respond-async")
+			assert.Equal(t, 202, status)
+
+			progressURL := "ws" + baseURL[len("http"):] + header.Get("Location") + "/progress"
+			_, resp, err := websocket.DefaultDialer.Dial(progressURL, nil)
+			assert.Error(t, err)
+			if resp != nil {
+				assert.Equal(t, 401, resp.StatusCode)
+			}
+
+			conn, _, err := websocket.DefaultDialer.Dial(progressURL, http.Header{"X-Admin-Token": []string{"operator-token"}})
+			assert.NoError(t, err)
+			defer conn.Close()
+			message := readUntil(t, conn, "job.completed", 5*time.Second)
+			progress := message["job"].(map[string]interface{})["progress"].(map[string]interface{})
+			assert.Equal(t, float64(100), progress["percent"])
+			assert.Equal(t, float64(1500), progress["events_scanned"])
+		})
+	})
+}
+
+// TestJobProgressEstimate tests estimating a job's completion from the rate events are scanned at
+func TestJobProgressEstimate(t *testing.T) {
+	jobs := app.NewJobs()
+	defer jobs.Stop()
+	clock := app.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	jobs.SetClock(clock)
+
+	service := app.NewAnalyticsService()
+	for i := 0; i < 4000; i++ {
+		_, err := service.TrackEvent(context.Background(), map[string]interface{}{"event_type": "page_view", "user_id": "user1"}, "api-key", "user1")
+		assert.NoError(t, err)
+	}
+
+	// Jobs report the events they scan through their context, each scan adding its events to the total
+	scanned := make(chan struct{})
+	release := make(chan struct{})
+	job, err := jobs.Submit("", app.JobRollups, func(ctx context.Context) (interface{}, error) {
+		service.QueryEvents(ctx, app.EventFilter{})
+		close(scanned)
+		<-release
+		service.QueryEvents(ctx, app.EventFilter{})
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	<-scanned
+
+	clock.Advance(30 * time.Second)
+	running, err := jobs.Job(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4000), running.Progress.EventsScanned)
+	assert.Equal(t, int64(4000), running.Progress.EventsTotal)
+	assert.Equal(t, 99.9, running.Progress.Percent, "Running jobs should not report completion")
+	assert.Nil(t, running.Progress.ETA, "The completion cannot be estimated once every known event is scanned")
+
+	close(release)
+	done, _ := jobs.Done(job.ID)
+	<-done
+	completed, err := jobs.Job(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8000), completed.Progress.EventsScanned)
+	assert.Equal(t, int64(8000), completed.Progress.EventsTotal)
+	assert.Equal(t, float64(100), completed.Progress.Percent)
+
+	t.Run("Estimate", func(t *testing.T) {
+		startedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		progress := app.EstimateJobProgress(app.JobRunning, 250, 1000, startedAt, startedAt.Add(time.Minute))
+		assert.Equal(t, 25.0, progress.Percent)
+		assert.Equal(t, float64(180), progress.ETASeconds, "A quarter scanned in a minute should take three more")
+		assert.Equal(t, startedAt.Add(4*time.Minute), *progress.ETA)
+
+		progress = app.EstimateJobProgress(app.JobQueued, 0, 0, time.Time{}, startedAt)
+		assert.Equal(t, float64(0), progress.Percent)
+		assert.Nil(t, progress.ETA)
+
+		progress = app.EstimateJobProgress(app.JobFailed, 10, 1000, startedAt, startedAt.Add(time.Minute))
+		assert.Equal(t, 1.0, progress.Percent)
+		assert.Nil(t, progress.ETA, "Jobs that are done have no completion to estimate")
+	})
+}
@@ -0,0 +1,223 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// groupSession is a consumer group session recording the offsets marked for commit
+type groupSession struct {
+	ctx    context.Context
+	claims map[string][]int32
+	mu     sync.Mutex
+	marked map[int32]int64
+}
+
+func (s *groupSession) Claims() map[string][]int32 { return s.claims }
+func (s *groupSession) MemberID() string           { return "member-1" }
+func (s *groupSession) GenerationID() int32        { return 3 }
+func (s *groupSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked[partition] = offset
+}
+func (s *groupSession) Commit() {}
+func (s *groupSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+}
+func (s *groupSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+func (s *groupSession) Context() context.Context { return s.ctx }
+func (s *groupSession) Marked(partition int32) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.marked[partition]
+}
+
+// groupClaim is a partition claimed in a consumer group session
+type groupClaim struct {
+	topic     string
+	partition int32
+	messages  chan *sarama.ConsumerMessage
+}
+
+func (c *groupClaim) Topic() string                            { return c.topic }
+func (c *groupClaim) Partition() int32                         { return c.partition }
+func (c *groupClaim) InitialOffset() int64                     { return 0 }
+func (c *groupClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *groupClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// TestKafkaConsumerGroup tests consuming every partition of the topics as a member of a consumer
+// group and marking the offsets of handled messages for commit
+func TestKafkaConsumerGroup(t *testing.T) {
+	t.Run("ParseSettings", func(t *testing.T) {
+		for name, expected := range map[string]string{"": "range", "range": "range", "roundrobin": "roundrobin", "sticky": "sticky"} {
+			strategy, err := app.ParseRebalanceStrategy(name)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, strategy.Name())
+		}
+		_, err := app.ParseRebalanceStrategy("random")
+		assert.Error(t, err)
+
+		offset, err := app.ParseOffsetReset("")
+		assert.NoError(t, err)
+		assert.Equal(t, sarama.OffsetNewest, offset)
+		offset, err = app.ParseOffsetReset("oldest")
+		assert.NoError(t, err)
+		assert.Equal(t, sarama.OffsetOldest, offset)
+		_, err = app.ParseOffsetReset("latest")
+		assert.Error(t, err)
+	})
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("auth", 0, broker.BrokerID()).
+			SetLeader("auth", 1, broker.BrokerID()),
+	})
+
+	t.Run("InvalidSettings", func(t *testing.T) {
+		t.Setenv("KAFKA_REBALANCE_STRATEGY", "random")
+		_, err := app.NewKafkaConsumerService([]string{broker.Addr()}, []string{"auth"})
+		assert.Error(t, err)
+	})
+
+	t.Setenv("KAFKA_GROUP_ID", "analytics-test")
+	t.Setenv("KAFKA_REBALANCE_STRATEGY", "sticky")
+	consumer, err := app.NewKafkaConsumerService([]string{broker.Addr()}, []string{"auth"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	handled := make(chan string, 10)
+	consumer.RegisterHandler("auth.user.login", func(ctx context.Context, event *app.CrossServiceEvent) error {
+		handled <- event.UserID
+		return nil
+	})
+	message := func(partition int32, offset int64, userID string) *sarama.ConsumerMessage {
+		value, _ := json.Marshal(app.NewCrossServiceEvent("auth", "auth.user.login", userID, nil))
+		return &sarama.ConsumerMessage{Topic: "auth", Partition: partition, Offset: offset, Value: value}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := &groupSession{ctx: ctx, claims: map[string][]int32{"auth": {0, 1}}, marked: map[int32]int64{}}
+
+	t.Run("Assignment", func(t *testing.T) {
+		assert.NoError(t, consumer.Setup(session))
+		group := consumer.Group()
+		assert.Equal(t, "analytics-test", group.GroupID)
+		assert.Equal(t, "sticky", group.Strategy)
+		assert.Equal(t, "member-1", group.MemberID)
+		assert.Equal(t, int32(3), group.Generation)
+		assert.Equal(t, int64(1), group.Rebalances)
+		assert.Equal(t, map[string][]int32{"auth": {0, 1}}, group.Partitions)
+	})
+
+	t.Run("ConsumesEveryPartition", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for partition := int32(0); partition < 2; partition++ {
+			claim := &groupClaim{topic: "auth", partition: partition, messages: make(chan *sarama.ConsumerMessage, 2)}
+			claim.messages <- message(partition, 7, "user1")
+			claim.messages <- &sarama.ConsumerMessage{Topic: "auth", Partition: partition, Offset: 8, Value: []byte("not json")}
+			close(claim.messages)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, consumer.ConsumeClaim(session, claim))
+			}()
+		}
+		wg.Wait()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case userID := <-handled:
+				assert.Equal(t, "user1", userID)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Events of both partitions should be handled")
+			}
+		}
+		assert.Equal(t, int64(9), session.Marked(0), "Handled and unreadable messages should be marked for commit")
+		assert.Equal(t, int64(9), session.Marked(1))
+	})
+
+	t.Run("HoldsOffPausedTopics", func(t *testing.T) {
+		assert.NoError(t, consumer.PauseTopic("auth"))
+		claim := &groupClaim{topic: "auth", partition: 0, messages: make(chan *sarama.ConsumerMessage, 1)}
+		claim.messages <- message(0, 9, "user2")
+		close(claim.messages)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.NoError(t, consumer.ConsumeClaim(session, claim))
+		}()
+
+		select {
+		case <-handled:
+			t.Fatal("Paused topics should not be handled")
+		case <-time.After(50 * time.Millisecond):
+		}
+		assert.Equal(t, int64(9), session.Marked(0))
+
+		assert.NoError(t, consumer.ResumeTopic("auth"))
+		<-done
+		assert.Equal(t, "user2", <-handled)
+		assert.Equal(t, int64(10), session.Marked(0))
+	})
+
+	t.Run("MarksHandledEvents", func(t *testing.T) {
+		release := make(chan struct{})
+		consumer.RegisterHandler("auth.user.logout", func(ctx context.Context, event *app.CrossServiceEvent) error {
+			<-release
+			handled <- event.UserID
+			return nil
+		})
+		value, _ := json.Marshal(app.NewCrossServiceEvent("auth", "auth.user.logout", "slow", nil))
+		claim := &groupClaim{topic: "auth", partition: 0, messages: make(chan *sarama.ConsumerMessage, 2)}
+		claim.messages <- &sarama.ConsumerMessage{Topic: "auth", Partition: 0, Offset: 10, Value: value}
+		claim.messages <- message(0, 11, "user3")
+		close(claim.messages)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.NoError(t, consumer.ConsumeClaim(session, claim))
+		}()
+
+		assert.Equal(t, "user3", <-handled)
+		select {
+		case <-done:
+			t.Fatal("The claim should wait for the events being handled")
+		case <-time.After(50 * time.Millisecond):
+		}
+		assert.Equal(t, int64(10), session.Marked(0), "Offsets should not be marked before earlier events are handled")
+
+		close(release)
+		<-done
+		assert.Equal(t, "slow", <-handled)
+		assert.Equal(t, int64(12), session.Marked(0))
+	})
+
+	t.Run("SessionEnds", func(t *testing.T) {
+		claim := &groupClaim{topic: "auth", partition: 1, messages: make(chan *sarama.ConsumerMessage)}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.NoError(t, consumer.ConsumeClaim(session, claim))
+		}()
+		cancel()
+		<-done
+
+		assert.NoError(t, consumer.Cleanup(session))
+		assert.Empty(t, consumer.Group().Partitions)
+	})
+}
@@ -2,7 +2,13 @@ package test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -99,3 +105,238 @@ func TestAppWithKafkaIntegration(t *testing.T) {
 	// Note: In a real test, we would make HTTP requests to test the endpoints
 	// For now, we just verify the app structure
 }
+
+// TestKafkaPauseResumeEndpoints tests the admin pause/resume endpoints and status reporting
+func TestKafkaPauseResumeEndpoints(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	assert.NoError(t, application.GetAdminAuth().AddToken("alice", "operator-token", app.RoleOperator))
+	assert.NoError(t, application.GetAdminAuth().AddToken("bob", "viewer-token", app.RoleViewer))
+
+	t.Run("RequiresOperatorRole", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/v1/admin/kafka/pause", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 403, resp.StatusCode)
+	})
+
+	t.Run("StatusIncludesPausedTopics", func(t *testing.T) {
+		resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/kafka/status", nil))
+		assert.NoError(t, err)
+
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Contains(t, body, "paused_topics")
+	})
+
+	if application.GetKafkaConsumer() != nil {
+		t.Skip("Skipping unavailable-consumer checks - Kafka is running")
+	}
+
+	t.Run("UnavailableWithoutConsumer", func(t *testing.T) {
+		for _, path := range []string{"/api/v1/admin/kafka/pause", "/api/v1/admin/kafka/resume"} {
+			req := httptest.NewRequest("POST", path, strings.NewReader(`{"topics": ["billing"]}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Admin-Token", "operator-token")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 503, resp.StatusCode)
+		}
+	})
+}
+
+// TestKafkaTopicDiscovery tests selecting the topics to consume by prefix
+func TestKafkaTopicDiscovery(t *testing.T) {
+	t.Run("ParsePrefixes", func(t *testing.T) {
+		assert.Equal(t, []string{"events.", "audit-"}, app.ParseTopicPrefixes(" events.* , audit-,,*"))
+		assert.Empty(t, app.ParseTopicPrefixes(""))
+	})
+
+	t.Run("MatchTopics", func(t *testing.T) {
+		available := []string{"events.orders", "billing", "events.auth", "__consumer_offsets", "eventsfeed", "audit-log"}
+		assert.Equal(t, []string{"audit-log", "events.auth", "events.orders"}, app.MatchTopics(available, []string{"events.", "audit-"}))
+		assert.Empty(t, app.MatchTopics(available, nil))
+		assert.NotContains(t, app.MatchTopics(available, []string{""}), "__consumer_offsets", "Internal topics should only match internal prefixes")
+		assert.Equal(t, []string{"__consumer_offsets"}, app.MatchTopics(available, []string{"__"}))
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		t.Setenv("KAFKA_TOPIC_PREFIXES", "events.*")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/kafka/status", nil))
+		assert.NoError(t, err)
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, []interface{}{"events."}, body["topic_prefixes"])
+		if application.GetKafkaConsumer() == nil {
+			assert.Empty(t, body["topics"], "Prefixes should replace the default topics")
+		}
+	})
+}
+
+// TestKafkaReplay tests validating replays of Kafka topics and keeping billing events out of them
+func TestKafkaReplay(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	assert.NoError(t, application.GetAdminAuth().AddToken("alice", "operator-token", app.RoleOperator))
+
+	t.Run("SkipsBillingEvents", func(t *testing.T) {
+		assert.True(t, app.IsBillingEvent(&app.CrossServiceEvent{Source: "billing", EventType: "invoice.sent"}))
+		assert.True(t, app.IsBillingEvent(&app.CrossServiceEvent{EventType: "billing.payment.completed"}))
+		assert.False(t, app.IsBillingEvent(&app.CrossServiceEvent{Source: "payments", EventType: "payments.transaction.completed"}))
+	})
+
+	replay := func(body string) int {
+		req := httptest.NewRequest("POST", "/api/v1/admin/kafka/replay", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Admin-Token", "operator-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		return resp.StatusCode
+	}
+
+	t.Run("Validation", func(t *testing.T) {
+		for _, body := range []string{
+			`{"from": "2024-01-01T00:00:00Z"}`,
+			`{"topic": "auth"}`,
+			`{"topic": "auth", "from": "yesterday"}`,
+			`{"topic": "auth", "from": "2024-01-02T00:00:00Z", "to": "2024-01-01T00:00:00Z"}`,
+		} {
+			assert.Equal(t, 400, replay(body), body)
+		}
+	})
+
+	if application.GetKafkaConsumer() != nil {
+		t.Skip("Skipping unavailable-consumer checks - Kafka is running")
+	}
+
+	t.Run("UnavailableWithoutConsumer", func(t *testing.T) {
+		assert.Equal(t, 503, replay(`{"topic": "auth", "from": "2024-01-01T00:00:00Z"}`))
+	})
+}
+
+// TestKafkaHandlerMetrics tests timing, counting and retrying Kafka event handlers, their error
+// budgets and disabling them at runtime
+func TestKafkaHandlerMetrics(t *testing.T) {
+	t.Setenv("KAFKA_HANDLER_RETRY_DELAY", "1ms")
+	t.Setenv("KAFKA_HANDLER_ERROR_BUDGET", "0.25")
+	ctx := context.Background()
+	failing := errors.New("downstream unavailable")
+
+	t.Run("CountsOutcomesAndRetries", func(t *testing.T) {
+		metrics := app.NewKafkaHandlerMetrics()
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, metrics.Run(ctx, "auth.user.login", func() error { return nil }))
+		}
+		attempts := 0
+		assert.NoError(t, metrics.Run(ctx, "auth.user.login", func() error {
+			attempts++
+			if attempts < 2 {
+				return failing
+			}
+			return nil
+		}), "Failed handlers should be retried")
+		assert.Equal(t, failing, metrics.Run(ctx, "payments.refund.processed", func() error { return failing }))
+
+		stats := metrics.Stats()
+		if assert.Len(t, stats, 2) {
+			assert.Equal(t, "auth.user.login", stats[0].EventType)
+			assert.Equal(t, int64(4), stats[0].Succeeded)
+			assert.Equal(t, int64(1), stats[0].Retries)
+			assert.False(t, stats[0].ErrorBudget.Exhausted)
+			assert.Equal(t, 1.0, stats[0].ErrorBudget.Remaining)
+
+			assert.Equal(t, int64(1), stats[1].Failed)
+			assert.Equal(t, int64(2), stats[1].Retries, "Handlers should be retried KAFKA_HANDLER_MAX_RETRIES times")
+			assert.Equal(t, 1.0, stats[1].ErrorBudget.ErrorRate)
+			assert.True(t, stats[1].ErrorBudget.Exhausted)
+		}
+
+		var unset *app.KafkaHandlerMetrics
+		assert.NoError(t, unset.Run(ctx, "auth.user.login", func() error { return nil }))
+	})
+
+	t.Run("ErrorBudgetWindows", func(t *testing.T) {
+		metrics := app.NewKafkaHandlerMetrics()
+		clock := app.NewFakeClock(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+		metrics.SetClock(clock)
+		metrics.Run(ctx, "auth.user.login", func() error { return failing })
+		for i := 0; i < 3; i++ {
+			metrics.Run(ctx, "auth.user.login", func() error { return nil })
+		}
+		budget := metrics.Stats()[0].ErrorBudget
+		assert.Equal(t, 0.25, budget.ErrorRate)
+		assert.Equal(t, 0.0, budget.Remaining)
+		assert.False(t, budget.Exhausted)
+
+		clock.Advance(90 * time.Minute)
+		assert.Equal(t, 0.25, metrics.Stats()[0].ErrorBudget.ErrorRate, "The previous window should still count")
+		clock.Advance(time.Hour)
+		assert.Equal(t, 0.0, metrics.Stats()[0].ErrorBudget.ErrorRate, "Old windows should be forgotten")
+		assert.Equal(t, int64(1), metrics.Stats()[0].Failed)
+	})
+
+	t.Run("DisablesHandlers", func(t *testing.T) {
+		metrics := app.NewKafkaHandlerMetrics()
+		metrics.Disable("analytics.page.view", "double counting")
+		called := false
+		err := metrics.Run(ctx, "analytics.page.view", func() error {
+			called = true
+			return nil
+		})
+		var disabled *app.HandlerDisabledError
+		assert.True(t, errors.As(err, &disabled))
+		assert.False(t, called)
+		assert.Equal(t, int64(1), metrics.Stats()[0].Skipped)
+		assert.Equal(t, "double counting", metrics.Stats()[0].DisabledReason)
+
+		assert.True(t, metrics.Enable("analytics.page.view"))
+		assert.False(t, metrics.Enable("analytics.page.view"))
+		assert.NoError(t, metrics.Run(ctx, "analytics.page.view", func() error { return nil }))
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("alice", "operator-token", app.RoleOperator))
+		assert.NoError(t, application.GetAdminAuth().AddToken("bob", "viewer-token", app.RoleViewer))
+		application.GetKafkaHandlerMetrics().Run(ctx, "auth.user.login", func() error { return nil })
+
+		post := func(path, token string) int {
+			req := httptest.NewRequest("POST", path, strings.NewReader(`{"reason": "incident 42"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Admin-Token", token)
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+		assert.Equal(t, 403, post("/api/v1/admin/kafka/handlers/auth.user.login/disable", "viewer-token"))
+		assert.Equal(t, 200, post("/api/v1/admin/kafka/handlers/auth.user.login/disable", "operator-token"))
+		assert.True(t, application.GetKafkaHandlerMetrics().Disabled("auth.user.login"))
+		assert.Len(t, application.GetAuditLog().Entries("kafka.handler.disable", 10), 1)
+
+		resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/kafka/status", nil))
+		assert.NoError(t, err)
+		var body map[string]interface{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		handler := body["handlers"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, true, handler["disabled"])
+		assert.Equal(t, "incident 42", handler["disabled_reason"])
+
+		resp, err = application.GetFiberApp().Test(httptest.NewRequest("GET", "/metrics", nil))
+		assert.NoError(t, err)
+		metrics, _ := io.ReadAll(resp.Body)
+		assert.Contains(t, string(metrics), `analytics_kafka_handler_events_total{event_type="auth.user.login",outcome="succeeded"} 1`)
+		assert.Contains(t, string(metrics), `analytics_kafka_handler_duration_seconds_count{event_type="auth.user.login"} 1`)
+		assert.Contains(t, string(metrics), `analytics_kafka_handler_disabled{event_type="auth.user.login"} 1`)
+
+		assert.Equal(t, 200, post("/api/v1/admin/kafka/handlers/auth.user.login/enable", "operator-token"))
+		assert.False(t, application.GetKafkaHandlerMetrics().Disabled("auth.user.login"))
+	})
+}
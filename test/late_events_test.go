@@ -0,0 +1,151 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestLateEvents tests accepting client timestamps within the lateness window and tracking dirty buckets
+func TestLateEvents(t *testing.T) {
+	track := func(service *app.AnalyticsService, eventType string, timestamp interface{}) (*app.AnalyticsEvent, error) {
+		return service.TrackEvent(app.ContextWithProject(context.Background(), "mobile"), map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    "user1",
+			"timestamp":  timestamp,
+		}, "test-key", "user1")
+	}
+
+	t.Run("RoutesIntoHistoricalBuckets", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		happened := time.Now().Add(-5 * time.Hour).Truncate(time.Second)
+
+		event, err := track(service, "purchase", happened.Format(time.RFC3339))
+		assert.NoError(t, err)
+		assert.True(t, event.Late)
+		assert.True(t, event.Timestamp.Equal(happened))
+		assert.WithinDuration(t, time.Now(), event.ReceivedAt, time.Minute)
+
+		_, err = track(service, "open_app", float64(happened.UnixMilli()))
+		assert.NoError(t, err, "Unix milliseconds should be accepted")
+
+		trend, err := app.NewQueryService(service).ComputeTrend(app.ContextWithProject(context.Background(), "mobile"), app.TrendQuery{
+			EventType: "purchase",
+			Interval:  "hour",
+			Start:     time.Now().Add(-24 * time.Hour),
+			End:       time.Now(),
+		})
+		assert.NoError(t, err)
+		var counted bool
+		for _, point := range trend.Points {
+			if !happened.Before(point.Timestamp) && happened.Before(point.Timestamp.Add(time.Hour)) {
+				assert.Equal(t, int64(1), point.Count)
+				counted = true
+			}
+		}
+		assert.True(t, counted, "The late event should be counted in the hour it happened")
+
+		buckets := service.LateEvents().DirtyBuckets("mobile")
+		assert.Equal(t, 1, len(buckets))
+		assert.True(t, buckets[0].Start.Equal(happened.Truncate(time.Hour)))
+		assert.Equal(t, []string{"open_app", "purchase"}, buckets[0].EventTypes)
+		assert.Equal(t, int64(2), buckets[0].LateEvents)
+
+		current, err := track(service, "purchase", time.Now().Format(time.RFC3339Nano))
+		assert.NoError(t, err)
+		assert.False(t, current.Late)
+	})
+
+	t.Run("RejectsTimestampsOutsideWindow", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		assert.NoError(t, service.LateEvents().SetWindow(time.Hour))
+
+		_, err := track(service, "purchase", time.Now().Add(-2*time.Hour).Format(time.RFC3339))
+		assert.Error(t, err)
+		_, err = track(service, "purchase", time.Now().Add(time.Hour).Format(time.RFC3339))
+		assert.Error(t, err)
+		_, err = track(service, "purchase", "yesterday")
+		assert.Error(t, err)
+
+		issues := service.ValidationLog().Query("mobile", app.ValidationIssueTimestamp, 0)
+		assert.Equal(t, 3, len(issues))
+		assert.Equal(t, int64(0), service.EventCount())
+		assert.Error(t, service.LateEvents().SetWindow(0))
+	})
+
+	t.Run("AcknowledgeKeepsRemarkedBuckets", func(t *testing.T) {
+		tracker := app.NewLateEventTracker()
+		now := time.Now()
+		mark := func(hoursAgo int, receivedAt time.Time) {
+			tracker.Mark(&app.AnalyticsEvent{
+				ProjectID:  "mobile",
+				EventType:  "purchase",
+				Timestamp:  now.Add(-time.Duration(hoursAgo) * time.Hour),
+				ReceivedAt: receivedAt,
+			})
+		}
+
+		mark(3, now)
+		mark(5, now)
+		listedAt := now.Add(time.Second)
+		mark(5, now.Add(2*time.Second)) // Arrives while the job recomputes
+
+		assert.Equal(t, 1, tracker.Acknowledge("mobile", listedAt))
+		buckets := tracker.DirtyBuckets("mobile")
+		assert.Equal(t, 1, len(buckets))
+		assert.Equal(t, int64(2), buckets[0].LateEvents)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		body := `{"event_type":"purchase","user_id":"user1","timestamp":"` + time.Now().Add(-3*time.Hour).Format(time.RFC3339) + `"}`
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "user1")
+		req.Header.Set("X-Project-ID", "mobile")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var tracked map[string]interface{}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&tracked))
+		assert.Equal(t, true, tracked["late"])
+
+		req = httptest.NewRequest("GET", "/api/v1/analytics/dirty-buckets", nil)
+		req.Header.Set("X-Project-ID", "mobile")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		var listed struct {
+			Buckets        []app.DirtyBucket `json:"buckets"`
+			LatenessWindow string            `json:"lateness_window"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+		assert.Equal(t, 1, len(listed.Buckets))
+		assert.Equal(t, "72h0m0s", listed.LatenessWindow)
+
+		req = httptest.NewRequest("DELETE", "/api/v1/analytics/dirty-buckets?marked_before=soon", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+
+		req = httptest.NewRequest("DELETE", "/api/v1/analytics/dirty-buckets", nil)
+		req.Header.Set("X-Project-ID", "mobile")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		var acknowledged struct {
+			Cleared int `json:"cleared"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&acknowledged))
+		assert.Equal(t, 1, acknowledged.Cleared)
+	})
+}
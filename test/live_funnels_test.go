@@ -0,0 +1,160 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestLiveFunnels tests following the users of live funnels as their events are stored
+func TestLiveFunnels(t *testing.T) {
+	t.Setenv("LIVE_FUNNEL_PUSH_INTERVAL", "0")
+	t.Setenv("LIVE_FUNNEL_WINDOW", "1h")
+	application, feedURL := startDashboardServer(t)
+	defer application.Stop()
+
+	clock := app.NewFakeClock(time.Now().UTC().Truncate(time.Second))
+	application.GetAnalyticsService().SetClock(clock)
+	live := application.GetLiveFunnels()
+	live.SetClock(clock)
+
+	ctx := app.ContextWithProject(context.Background(), "live")
+	funnel, err := application.GetFunnelService().CreateFunnel(ctx, "Checkout", "", []app.Step{
+		{ID: "view", Name: "View", EventType: "page_view", Order: 1},
+		{ID: "cart", Name: "Cart", EventType: "add_to_cart", Order: 2},
+		{ID: "purchase", Name: "Purchase", EventType: "purchase", Order: 3},
+	})
+	assert.NoError(t, err)
+	track := func(userID, eventType string) {
+		clock.Advance(time.Second) // Events of the same time have no order in the store
+		_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{"event_type": eventType, "user_id": userID}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	reached := func(state *app.LiveFunnelState) []int64 {
+		counts := make([]int64, len(state.Steps))
+		for i, step := range state.Steps {
+			counts[i] = step.UniqueUsers
+		}
+		return counts
+	}
+
+	t.Run("BuildsFromStoredEvents", func(t *testing.T) {
+		track("user1", "page_view")
+		track("user1", "add_to_cart")
+		track("user2", "add_to_cart") // Not in the funnel before its first step
+
+		state, err := live.Enable(ctx, funnel.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []int64{1, 1, 0}, reached(state))
+		assert.Equal(t, int64(1), state.Steps[1].Current)
+		assert.Equal(t, 3600, state.WindowSeconds)
+
+		_, err = live.Enable(ctx, "missing")
+		assert.Contains(t, err.Error(), "not found")
+		service, err := application.GetFunnelService().CreateFunnel(ctx, "Paying", "", []app.Step{
+			{ID: "view", Name: "View", EventType: "page_view", Order: 1},
+			{ID: "pay", Name: "Pay", EventType: "payment.completed", Source: "billing", Order: 2},
+		})
+		assert.NoError(t, err)
+		_, err = live.Enable(ctx, service.ID)
+		assert.Error(t, err, "Steps of other services cannot be followed live")
+	})
+
+	t.Run("FollowsStoredEvents", func(t *testing.T) {
+		track("user2", "page_view")
+		track("user1", "purchase")
+		track("user1", "purchase")
+
+		var state *app.LiveFunnelState
+		assert.Eventually(t, func() bool {
+			state, _ = live.State("live", funnel.ID)
+			return state.ConvertedUsers == 1 && state.TotalUsers == 2
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, []int64{2, 1, 1}, reached(state))
+		assert.Equal(t, int64(2), state.Steps[2].EventCount)
+		assert.Equal(t, 50.0, state.ConversionRate)
+
+		computed, err := application.GetFunnelService().ComputeFunnel(ctx, app.FunnelQuery{FunnelID: funnel.ID, Start: clock.Now().Add(-time.Hour), End: clock.Now().Add(time.Minute)})
+		assert.NoError(t, err)
+		assert.Equal(t, computed.ConversionRate, state.ConversionRate, "Live funnels should agree with computed ones")
+		for i, step := range computed.Steps {
+			assert.Equal(t, step, state.Steps[i].StepResult)
+		}
+	})
+
+	t.Run("PushesToDashboards", func(t *testing.T) {
+		assert.Equal(t, 0, live.Push(), "Funnels of projects without dashboards should not be pushed")
+
+		conn, _, err := websocket.DefaultDialer.Dial(feedURL+"?project_id=live", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+		assert.Eventually(t, func() bool {
+			return application.GetDashboardService().GetConnectedClientsCount() == 1
+		}, 2*time.Second, 10*time.Millisecond)
+
+		track("user3", "page_view")
+		assert.Eventually(t, func() bool {
+			state, _ := live.State("live", funnel.ID)
+			return state.TotalUsers == 3
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, 1, live.Push())
+		msg := readUntil(t, conn, app.LiveFunnelMetric, 2*time.Second)
+		value := msg["value"].(map[string]interface{})
+		assert.Equal(t, funnel.ID, value["funnel_id"])
+		assert.Equal(t, 3.0, value["total_users"])
+		assert.Equal(t, 0, live.Push(), "Unchanged funnels should not be pushed again")
+	})
+
+	t.Run("ExpiresInactiveUsers", func(t *testing.T) {
+		clock.Advance(50 * time.Minute)
+		track("user3", "add_to_cart")
+		clock.Advance(20 * time.Minute)
+		assert.Eventually(t, func() bool {
+			live.Push()
+			state, _ := live.State("live", funnel.ID)
+			return state.TotalUsers == 1
+		}, 2*time.Second, 10*time.Millisecond)
+		state, _ := live.State("live", funnel.ID)
+		assert.Equal(t, []int64{1, 1, 0}, reached(state), "Only user3 was active within the window")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		send := func(method, path string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("X-Project-ID", "live")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp.StatusCode, decoded
+		}
+
+		status, body := send("GET", "/api/v1/funnels/live")
+		assert.Equal(t, 200, status)
+		assert.Len(t, body["funnels"], 1)
+		status, body = send("GET", "/api/v1/funnels/"+funnel.ID+"/live")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "Checkout", body["funnel"].(map[string]interface{})["funnel_name"])
+
+		status, _ = send("DELETE", "/api/v1/funnels/"+funnel.ID+"/live")
+		assert.Equal(t, 200, status)
+		status, _ = send("GET", "/api/v1/funnels/"+funnel.ID+"/live")
+		assert.Equal(t, 404, status)
+		status, _ = send("DELETE", "/api/v1/funnels/"+funnel.ID+"/live")
+		assert.Equal(t, 404, status)
+
+		status, body = send("PUT", "/api/v1/funnels/"+funnel.ID+"/live")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 0.0, body["funnel"].(map[string]interface{})["total_users"],
+			"Within the window user3 has not entered the funnel with its first step")
+		status, _ = send("PUT", "/api/v1/funnels/missing/live")
+		assert.Equal(t, 404, status)
+	})
+}
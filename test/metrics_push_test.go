@@ -0,0 +1,206 @@
+package test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// pushedRequest is a request received by a metrics push endpoint
+type pushedRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// pushEndpoint records the pushes it receives, responding with the status
+func pushEndpoint(t *testing.T, status int) (*httptest.Server, func() []pushedRequest) {
+	var mu sync.Mutex
+	var received []pushedRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, pushedRequest{method: r.Method, path: r.URL.Path, header: r.Header.Clone(), body: body})
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []pushedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]pushedRequest(nil), received...)
+	}
+}
+
+// protoFields splits an encoded protobuf message into its length-delimited fields, and the
+// 64-bit and varint fields as their raw values
+func protoFields(t *testing.T, message []byte) map[int][][]byte {
+	fields := make(map[int][][]byte)
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		message = message[n:]
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(message)
+			fields[int(key>>3)] = append(fields[int(key>>3)], message[:n])
+		case 1:
+			n = 8
+			fields[int(key>>3)] = append(fields[int(key>>3)], message[:n])
+		case 2:
+			length, read := binary.Uvarint(message)
+			message = message[read:]
+			n = int(length)
+			fields[int(key>>3)] = append(fields[int(key>>3)], message[:n])
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		message = message[n:]
+	}
+	return fields
+}
+
+// TestMetricsPush tests pushing the internal metrics to a Pushgateway or remote write endpoint
+func TestMetricsPush(t *testing.T) {
+	exposition := "# HELP analytics_requests_total Requests.\n# TYPE analytics_requests_total counter\n" +
+		"analytics_requests_total{route=\"/events\",status=\"2xx\"} 42\nanalytics_queue_depth 1.5\n"
+	gather := func(w io.Writer) error {
+		_, err := fmt.Fprint(w, exposition)
+		return err
+	}
+	t.Setenv("METRICS_PUSH_JOB", "analytics")
+	t.Setenv("METRICS_PUSH_INSTANCE", "node-1")
+
+	t.Run("Pushgateway", func(t *testing.T) {
+		server, received := pushEndpoint(t, http.StatusOK)
+		t.Setenv("METRICS_PUSH_URL", server.URL+"/gateway/")
+		t.Setenv("METRICS_PUSH_TOKEN", "secret")
+		pusher := app.NewMetricsPusher(gather)
+		assert.True(t, pusher.Enabled())
+
+		assert.NoError(t, pusher.Push())
+		requests := received()
+		if assert.Len(t, requests, 1) {
+			assert.Equal(t, "PUT", requests[0].method)
+			assert.Equal(t, "/gateway/metrics/job/analytics/instance/node-1", requests[0].path)
+			assert.Equal(t, "Bearer secret", requests[0].header.Get("Authorization"))
+			assert.Contains(t, requests[0].header.Get("Content-Type"), "version=0.0.4")
+			assert.Equal(t, exposition, string(requests[0].body))
+		}
+
+		stats := pusher.Stats()
+		assert.Equal(t, app.MetricsPushPushgateway, stats.Protocol)
+		assert.Equal(t, server.URL, stats.Endpoint)
+		assert.Equal(t, int64(1), stats.Pushed)
+		assert.NotNil(t, stats.LastPushAt)
+	})
+
+	t.Run("RemoteWrite", func(t *testing.T) {
+		server, received := pushEndpoint(t, http.StatusNoContent)
+		t.Setenv("METRICS_PUSH_URL", server.URL+"/api/v1/push")
+		t.Setenv("METRICS_PUSH_PROTOCOL", "remote_write")
+		pusher := app.NewMetricsPusher(gather)
+
+		assert.NoError(t, pusher.Push())
+		requests := received()
+		if !assert.Len(t, requests, 1) {
+			return
+		}
+		assert.Equal(t, "POST", requests[0].method)
+		assert.Equal(t, "/api/v1/push", requests[0].path)
+		assert.Equal(t, "snappy", requests[0].header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", requests[0].header.Get("Content-Type"))
+		assert.Equal(t, "0.1.0", requests[0].header.Get("X-Prometheus-Remote-Write-Version"))
+
+		decoded, err := snappy.Decode(nil, requests[0].body)
+		assert.NoError(t, err)
+		series := protoFields(t, decoded)[1]
+		assert.Len(t, series, 2)
+
+		fields := protoFields(t, series[0])
+		var labels []string
+		for _, label := range fields[1] {
+			pair := protoFields(t, label)
+			labels = append(labels, string(pair[1][0])+"="+string(pair[2][0]))
+		}
+		assert.Equal(t, []string{"__name__=analytics_requests_total", "instance=node-1", "job=analytics", "route=/events", "status=2xx"}, labels, "Labels should be sorted by name")
+		sample := protoFields(t, fields[2][0])
+		assert.Equal(t, 42.0, math.Float64frombits(binary.LittleEndian.Uint64(sample[1][0])))
+		timestamp, _ := binary.Uvarint(sample[2][0])
+		assert.Greater(t, timestamp, uint64(0))
+	})
+
+	t.Run("Failures", func(t *testing.T) {
+		server, _ := pushEndpoint(t, http.StatusServiceUnavailable)
+		t.Setenv("METRICS_PUSH_URL", server.URL)
+		pusher := app.NewMetricsPusher(gather)
+
+		err := pusher.Push()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "status 503")
+		stats := pusher.Stats()
+		assert.Equal(t, int64(1), stats.Failed)
+		assert.Equal(t, int64(0), stats.Pushed)
+		assert.NotEmpty(t, stats.LastError)
+		assert.NotNil(t, stats.LastErrorAt)
+	})
+
+	t.Run("InvalidConfiguration", func(t *testing.T) {
+		for _, settings := range []map[string]string{
+			{"METRICS_PUSH_URL": "ftp://metrics.internal"},
+			{"METRICS_PUSH_URL": "https://metrics.internal", "METRICS_PUSH_PROTOCOL": "graphite"},
+			{"METRICS_PUSH_URL": "https://metrics.internal", "METRICS_PUSH_INTERVAL": "0s"},
+		} {
+			t.Setenv("METRICS_PUSH_PROTOCOL", "")
+			t.Setenv("METRICS_PUSH_INTERVAL", "")
+			for name, value := range settings {
+				t.Setenv(name, value)
+			}
+			pusher := app.NewMetricsPusher(gather)
+			assert.False(t, pusher.Enabled(), "%v should disable pushing", settings)
+			assert.Error(t, pusher.Push())
+		}
+		t.Setenv("METRICS_PUSH_URL", "")
+		assert.False(t, app.NewMetricsPusher(gather).Enabled())
+	})
+
+	t.Run("PushesOnShutdown", func(t *testing.T) {
+		server, received := pushEndpoint(t, http.StatusOK)
+		t.Setenv("METRICS_PUSH_URL", server.URL)
+		t.Setenv("METRICS_PUSH_PROTOCOL", "")
+		t.Setenv("METRICS_PUSH_INTERVAL", "1h")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		assert.NoError(t, application.GetAdminAuth().AddToken("alice", "viewer-token", app.RoleViewer))
+
+		req := httptest.NewRequest("GET", "/api/v1/admin/metrics-push", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			MetricsPush app.MetricsPushStats `json:"metrics_push"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.True(t, body.MetricsPush.Enabled)
+		assert.Equal(t, "1h0m0s", body.MetricsPush.Interval)
+
+		application.Stop()
+		requests := received()
+		if assert.Len(t, requests, 1, "The final values should be pushed on shutdown") {
+			assert.Contains(t, string(requests[0].body), "analytics_siem_events_total")
+			assert.Contains(t, string(requests[0].body), "analytics_metrics_pushes_total")
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestMobileBatch tests the batch envelope mobile SDKs use to deliver offline-queued events
+func TestMobileBatch(t *testing.T) {
+	ctx := app.ContextWithProject(context.Background(), "mobile")
+
+	t.Run("MergesDeviceContext", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		deviceNow := time.Now().Add(-time.Hour)
+
+		result, duplicate, err := service.TrackMobileBatch(ctx, app.MobileBatch{
+			BatchID: "batch-1",
+			SentAt:  deviceNow.Format(time.RFC3339Nano),
+			UserID:  "user1",
+			Context: map[string]interface{}{
+				"device":      map[string]interface{}{"model": "Pixel 8"},
+				"app_version": "2.3.0",
+			},
+			Events: []map[string]interface{}{
+				{"event_type": "open_app", "timestamp": deviceNow.Add(-time.Minute).Format(time.RFC3339Nano)},
+				{"event_type": "purchase", "user_id": "user2", "properties": map[string]interface{}{"app_version": "2.3.1"}},
+			},
+		}, "test-key")
+		assert.NoError(t, err)
+		assert.False(t, duplicate)
+		assert.Equal(t, 2, result.Accepted)
+
+		events := result.Events()
+		assert.Equal(t, "Pixel 8", events[0].Properties["device.model"])
+		assert.Equal(t, "2.3.0", events[0].Properties["app_version"])
+		assert.Equal(t, "user1", events[0].UserID)
+		assert.WithinDuration(t, time.Now().Add(-time.Minute), events[0].Timestamp, time.Second, "The envelope's sent_at should correct clock skew")
+		assert.Equal(t, "2.3.1", events[1].Properties["app_version"], "The event's own properties should win over the device context")
+		assert.Equal(t, "user2", events[1].UserID)
+	})
+
+	t.Run("DetectsRetriedBatches", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		batch := app.MobileBatch{
+			BatchID: "batch-1",
+			UserID:  "user1",
+			Events: []map[string]interface{}{
+				{"event_type": "open_app"},
+				{"event_type": "purchase", "timestamp": "yesterday"},
+			},
+		}
+
+		first, _, err := service.TrackMobileBatch(ctx, batch, "test-key")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, first.Accepted)
+		assert.Equal(t, 1, first.Rejected)
+		assert.NotEmpty(t, first.Results[1].Error)
+
+		retry, duplicate, err := service.TrackMobileBatch(ctx, batch, "test-key")
+		assert.NoError(t, err)
+		assert.True(t, duplicate)
+		assert.Equal(t, first.Results[0].EventID, retry.Results[0].EventID)
+		assert.Equal(t, int64(1), service.EventCount(), "A retried batch should not be tracked twice")
+
+		_, duplicate, err = service.TrackMobileBatch(app.ContextWithProject(context.Background(), "other"), batch, "test-key")
+		assert.NoError(t, err)
+		assert.False(t, duplicate, "Batch IDs should be scoped to their project")
+	})
+
+	t.Run("RejectsInvalidEnvelopes", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		_, _, err := service.TrackMobileBatch(ctx, app.MobileBatch{Events: []map[string]interface{}{{"event_type": "open_app"}}}, "test-key")
+		assert.Error(t, err)
+		_, _, err = service.TrackMobileBatch(ctx, app.MobileBatch{BatchID: "batch-1"}, "test-key")
+		assert.Error(t, err)
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		envelope := `{"batch_id":"batch-7","user_id":"user1","context":{"os":{"name":"iOS"}},"events":[{"event_type":"open_app"},{"event_type":"tap"}]}`
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, err := io.WriteString(writer, envelope)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+
+		send := func() (int, map[string]interface{}) {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/mobile/batch", bytes.NewReader(compressed.Bytes()))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", "gzip")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-Project-ID", "mobile")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return resp.StatusCode, body
+		}
+
+		status, body := send()
+		assert.Equal(t, 200, status)
+		assert.Equal(t, "success", body["status"])
+		assert.Equal(t, float64(2), body["accepted"])
+		assert.Equal(t, false, body["duplicate"])
+
+		status, body = send()
+		assert.Equal(t, 200, status)
+		assert.Equal(t, true, body["duplicate"])
+
+		events := application.GetAnalyticsService().QueryEvents(context.Background(), app.EventFilter{ProjectID: "mobile"})
+		assert.Equal(t, 2, len(events))
+		assert.Equal(t, "iOS", events[0].Properties["os.name"])
+
+		req := httptest.NewRequest("POST", "/api/v1/analytics/mobile/batch", strings.NewReader(envelope))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		req = httptest.NewRequest("POST", "/api/v1/analytics/mobile/batch", strings.NewReader(envelope))
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("X-API-Key", "test-key")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode, "A body that is not gzip should be rejected")
+	})
+}
@@ -0,0 +1,137 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestOptimisticConcurrency tests versioned updates of funnels, heatmaps, dashboards and schemas
+func TestOptimisticConcurrency(t *testing.T) {
+	steps := []app.Step{
+		{ID: "step1", Name: "Landing", EventType: "page_view", Order: 1},
+		{ID: "step2", Name: "Signup", EventType: "signup", Order: 2},
+	}
+
+	t.Run("FunnelUpdatesConflict", func(t *testing.T) {
+		service := app.NewFunnelService(app.NewAnalyticsService())
+		ctx := context.Background()
+
+		funnel, err := service.CreateFunnel(ctx, "Signup", "", steps)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), funnel.Version)
+
+		updated, err := service.UpdateFunnel(ctx, funnel.ID, "Signup v2", "", steps, funnel.Version)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), updated.Version)
+
+		// A second analyst still editing version 1 must not overwrite version 2
+		_, err = service.UpdateFunnel(ctx, funnel.ID, "Signup (stale)", "", steps, funnel.Version)
+		var conflict *app.VersionConflictError
+		assert.True(t, errors.As(err, &conflict))
+		assert.Equal(t, int64(2), conflict.Current)
+
+		stored, err := service.GetFunnel(ctx, funnel.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Signup v2", stored.Name)
+
+		computed, err := service.GetFunnelSteps(ctx, funnel.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(computed), "Stored funnels should be used instead of the mock funnel")
+	})
+
+	t.Run("SchemaUpdatesKeepBuiltInRules", func(t *testing.T) {
+		schemas := app.NewSchemaValidator()
+		assert.NoError(t, schemas.SetGracePeriod(0)) // Apply breaking changes immediately
+
+		current, err := schemas.GetSchema("page_view")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"event_type"}, current.CustomRules)
+
+		updated, err := schemas.UpdateSchema("page_view", []string{"event_type", "user_id", "page"}, map[string]string{"page": "string"}, current.Version)
+		assert.NoError(t, err)
+		assert.Equal(t, current.Version+1, updated.Version)
+		assert.Equal(t, []string{"event_type"}, updated.CustomRules)
+		assert.Error(t, schemas.ValidateEvent(map[string]interface{}{"event_type": "page_view", "user_id": "user1"}), "The page field should now be required")
+
+		_, err = schemas.UpdateSchema("page_view", []string{"event_type"}, nil, current.Version)
+		assert.Error(t, err)
+		_, err = schemas.UpdateSchema("signup", nil, map[string]string{"plan": "enum"}, 0)
+		assert.Error(t, err, "Unknown field types should be rejected")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+
+		send := func(method, path, ifMatch, body string) *http.Response {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp
+		}
+
+		// Heatmaps
+		resp := send("POST", "/api/v1/heatmaps", "", `{"name":"Home","type":"click","page":"/home","width":800,"height":600}`)
+		assert.Equal(t, 200, resp.StatusCode)
+		var created struct {
+			Heatmap app.Heatmap `json:"heatmap"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		etag := resp.Header.Get("ETag")
+		assert.Equal(t, `"1"`, etag)
+
+		path := "/api/v1/heatmaps/" + created.Heatmap.ID
+		update := `{"name":"Home","type":"scroll","page":"/home","width":800,"height":600}`
+		assert.Equal(t, 428, send("PUT", path, "", update).StatusCode)
+		resp = send("PUT", path, etag, update)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+		resp = send("PUT", path, etag, update)
+		assert.Equal(t, 409, resp.StatusCode)
+		assert.Equal(t, `"2"`, resp.Header.Get("ETag"), "Conflicts should carry the current ETag")
+		assert.Equal(t, 200, send("PUT", path, `W/"2"`, update).StatusCode, "Weak ETags should be accepted")
+		assert.Equal(t, 404, send("PUT", "/api/v1/heatmaps/unknown", "*", update).StatusCode)
+
+		// Funnels
+		resp = send("POST", "/api/v1/funnels", "", `{"name":"Signup","steps":[{"name":"Landing","event_type":"page_view","order":1},{"name":"Signup","event_type":"signup","order":2}]}`)
+		assert.Equal(t, 200, resp.StatusCode)
+		var funnel struct {
+			Funnel app.Funnel `json:"funnel"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&funnel))
+		resp = send("GET", "/api/v1/funnels/"+funnel.Funnel.ID, "", "")
+		assert.Equal(t, `"1"`, resp.Header.Get("ETag"))
+		assert.Equal(t, 409, send("PUT", "/api/v1/funnels/"+funnel.Funnel.ID, `"7"`, `{"name":"Signup","steps":[{"name":"Landing","event_type":"page_view","order":1},{"name":"Signup","event_type":"signup","order":2}]}`).StatusCode)
+
+		// Dashboards
+		resp = send("POST", "/api/v1/dashboards", "", `{"name":"Ops","widgets":[{"title":"Events","metric":"events"}]}`)
+		assert.Equal(t, 200, resp.StatusCode)
+		var dashboard struct {
+			Dashboard app.SavedDashboard `json:"dashboard"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&dashboard))
+		dashboardPath := "/api/v1/dashboards/" + dashboard.Dashboard.ID
+		assert.Equal(t, 200, send("PUT", dashboardPath, `"1"`, `{"name":"Ops v2","widgets":[{"title":"Events","metric":"events"}]}`).StatusCode)
+		assert.Equal(t, 409, send("PUT", dashboardPath, `"1"`, `{"name":"Ops (stale)","widgets":[{"title":"Events","metric":"events"}]}`).StatusCode)
+
+		// Schemas: new schemas may be created without If-Match, replacing them requires it
+		assert.Equal(t, 200, send("PUT", "/api/v1/schemas/signup", "", `{"required_fields":["event_type","user_id"],"field_types":{"plan":"string"}}`).StatusCode)
+		assert.Equal(t, 428, send("PUT", "/api/v1/schemas/signup", "", `{"required_fields":["event_type","user_id"]}`).StatusCode)
+		resp = send("GET", "/api/v1/schemas/signup", "", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 200, send("PUT", "/api/v1/schemas/signup", resp.Header.Get("ETag"), `{"required_fields":["event_type","user_id"]}`).StatusCode)
+	})
+}
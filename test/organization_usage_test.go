@@ -0,0 +1,120 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestOrganizationUsage tests rolling up project usage to the organization level
+func TestOrganizationUsage(t *testing.T) {
+	track := func(service *app.AnalyticsService, projectID, userID, eventType string) {
+		ctx := app.ContextWithProject(context.Background(), projectID)
+		_, err := service.TrackEvent(ctx, map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+		}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+
+	t.Run("RollsUpProjects", func(t *testing.T) {
+		analyticsService := app.NewAnalyticsService()
+		orgService := app.NewOrganizationService(analyticsService)
+
+		track(analyticsService, "shop", "user1", "page_view")
+		track(analyticsService, "shop", "user1", "click")
+		track(analyticsService, "blog", "user1", "page_view")
+		track(analyticsService, "blog", "user2", "conversion")
+		track(analyticsService, "other", "user3", "page_view")
+
+		_, err := orgService.CreateOrganization(context.Background(), "acme", "Acme Corp", "", []string{"shop", "blog"})
+		assert.NoError(t, err)
+
+		usage, err := orgService.GetUsage(context.Background(), "acme", today.AddDate(0, 0, -1), today, true)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), usage.TotalEvents, "Events of projects outside the organization should not count")
+		assert.Equal(t, int64(2), usage.UniqueUsers)
+		assert.Equal(t, int64(2), usage.EventsByType["page_view"])
+		assert.InDelta(t, 0.001*2+0.002+0.01, usage.BillingSummary.TotalCost, 1e-9)
+
+		assert.Equal(t, 2, len(usage.Projects))
+		assert.Equal(t, "shop", usage.Projects[0].ProjectID)
+		assert.Equal(t, int64(2), usage.Projects[0].TotalEvents)
+		assert.Equal(t, int64(1), usage.Projects[0].UniqueUsers)
+		assert.Equal(t, 2, len(usage.Projects[1].Users))
+		assert.Equal(t, "user2", usage.Projects[1].Users[1].UserID)
+		assert.InDelta(t, 0.01, usage.Projects[1].Users[1].TotalCost, 1e-9)
+	})
+
+	t.Run("ProjectBelongsToOneOrganization", func(t *testing.T) {
+		orgService := app.NewOrganizationService(app.NewAnalyticsService())
+		ctx := context.Background()
+
+		_, err := orgService.CreateOrganization(ctx, "acme", "Acme Corp", "", []string{"shop"})
+		assert.NoError(t, err)
+		_, err = orgService.CreateOrganization(ctx, "globex", "Globex", "", []string{"shop"})
+		assert.Error(t, err)
+
+		_, err = orgService.CreateOrganization(ctx, "globex", "Globex", "", nil)
+		assert.NoError(t, err)
+		_, err = orgService.AddProject(ctx, "globex", "shop")
+		assert.Error(t, err)
+
+		_, err = orgService.RemoveProject(ctx, "acme", "shop")
+		assert.NoError(t, err)
+		org, err := orgService.AddProject(ctx, "globex", "shop")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"shop"}, org.Projects)
+
+		orgID, ok := orgService.OrganizationForProject("shop")
+		assert.True(t, ok)
+		assert.Equal(t, "globex", orgID)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		assert.NoError(t, application.GetAdminAuth().AddToken("root", "admin-token", app.RoleAdmin))
+		track(application.GetAnalyticsService(), "shop", "user1", "page_view")
+
+		req := httptest.NewRequest("POST", "/api/v1/admin/orgs", strings.NewReader(`{"id":"acme","name":"Acme Corp","projects":["shop"]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Admin-Token", "admin-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 201, resp.StatusCode)
+
+		req = httptest.NewRequest("PUT", "/api/v1/admin/orgs/acme/projects/blog", nil)
+		req.Header.Set("X-Admin-Token", "admin-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		entries := application.GetAuditLog().Entries("org.add_project", 1)
+		assert.Equal(t, 1, len(entries))
+		assert.Equal(t, "blog", entries[0].Details["project_id"])
+
+		req = httptest.NewRequest("GET", "/api/v1/orgs/acme/usage", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var usage app.OrganizationUsage
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&usage))
+		assert.Equal(t, int64(1), usage.TotalEvents)
+		assert.Equal(t, 2, len(usage.Projects))
+
+		req = httptest.NewRequest("GET", "/api/v1/orgs/unknown/usage", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestPerformanceEvents tests validating web vitals and aggregating them per page and device
+func TestPerformanceEvents(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	measure := func(userID, page, device string, metrics map[string]interface{}) map[string]interface{} {
+		properties := map[string]interface{}{"device": device}
+		for name, value := range metrics {
+			properties[name] = value
+		}
+		return map[string]interface{}{
+			"event_type": "performance",
+			"user_id":    userID,
+			"page":       page,
+			"properties": properties,
+		}
+	}
+
+	t.Run("Validation", func(t *testing.T) {
+		validator := app.NewSchemaValidator()
+		assert.NoError(t, validator.ValidateEvent(measure("user1", "/home", "mobile", map[string]interface{}{"lcp": 2400.0, "cls": 0.05})))
+
+		assert.Error(t, validator.ValidateEvent(measure("user1", "/home", "mobile", nil)), "At least one metric is required")
+		assert.Error(t, validator.ValidateEvent(measure("user1", "/home", "mobile", map[string]interface{}{"lcp": "fast"})))
+		assert.Error(t, validator.ValidateEvent(measure("user1", "/home", "mobile", map[string]interface{}{"ttfb": -1.0})))
+		missingPage := measure("user1", "", "mobile", map[string]interface{}{"lcp": 2400.0})
+		delete(missingPage, "page")
+		assert.Error(t, validator.ValidateEvent(missingPage))
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		service.SetClock(app.NewFakeClock(start))
+		performance := app.NewPerformanceService(service)
+
+		track := func(eventData map[string]interface{}) {
+			_, err := service.TrackEvent(ctx, eventData, "test-key", eventData["user_id"].(string))
+			assert.NoError(t, err)
+		}
+		for i, lcp := range []float64{1000, 2000, 3000, 5000} {
+			userID := []string{"user1", "user2", "user3", "user4"}[i]
+			track(measure(userID, "/home", "mobile", map[string]interface{}{"lcp": lcp}))
+		}
+		track(measure("user5", "/home", "desktop", map[string]interface{}{"lcp": 800.0, "inp": 50.0}))
+		track(map[string]interface{}{"event_type": "conversion", "user_id": "user1"})
+		track(map[string]interface{}{"event_type": "conversion", "user_id": "user5"})
+
+		report, err := performance.Report(ctx, app.PerformanceQuery{Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(5), report.Samples)
+		assert.Equal(t, int64(5), report.Metrics["lcp"].Count)
+		assert.Equal(t, int64(1), report.Metrics["inp"].Count)
+
+		assert.Equal(t, 2, len(report.Pages))
+		desktop, mobile := report.Pages[0], report.Pages[1]
+		assert.Equal(t, "desktop", desktop.Device)
+		assert.Equal(t, 100.0, desktop.ConversionRate)
+
+		assert.Equal(t, "mobile", mobile.Device)
+		lcp := mobile.Metrics["lcp"]
+		assert.Equal(t, 2000.0, lcp.P50)
+		assert.Equal(t, 3000.0, lcp.P75)
+		assert.Equal(t, 5000.0, lcp.P95)
+		assert.Equal(t, 50.0, lcp.Good)
+		assert.Equal(t, 25.0, lcp.NeedsImprovement)
+		assert.Equal(t, 25.0, lcp.Poor)
+		assert.Equal(t, int64(1), mobile.ConvertedUsers)
+		assert.Equal(t, 25.0, mobile.ConversionRate)
+
+		filtered, err := performance.Report(ctx, app.PerformanceQuery{Device: "desktop", Start: start, End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), filtered.Samples)
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(body string) int {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+		assert.Equal(t, 200, send(`{"event_type":"performance","user_id":"user1","page":"/home","properties":{"lcp":1800,"ttfb":200,"device":"mobile"}}`))
+		assert.Equal(t, 400, send(`{"event_type":"performance","user_id":"user1","page":"/home","properties":{"device":"mobile"}}`))
+
+		req := httptest.NewRequest("GET", "/api/v1/performance/report?page=/home", nil)
+		req.Header.Set("X-Project-ID", "web")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var body struct {
+			Report app.PerformanceReport `json:"report"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, int64(1), body.Report.Samples)
+		assert.Equal(t, 1800.0, body.Report.Metrics["lcp"].P75)
+	})
+}
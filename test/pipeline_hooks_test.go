@@ -0,0 +1,136 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// teamEnricher adds the team owning the event's page
+type teamEnricher struct{}
+
+func (teamEnricher) Enrich(ctx context.Context, event *app.AnalyticsEvent) error {
+	if event.Page == "" {
+		return fmt.Errorf("no page to look the team up for")
+	}
+	event.Properties["team"] = "growth"
+	return nil
+}
+
+// piiValidator rejects events carrying email addresses
+type piiValidator struct{}
+
+func (piiValidator) Validate(ctx context.Context, event *app.AnalyticsEvent) error {
+	if _, exists := event.Properties["email"]; exists {
+		return fmt.Errorf("email addresses must not be sent")
+	}
+	return nil
+}
+
+// recordingSink records the IDs of the events written to it
+type recordingSink struct {
+	ids   []string
+	mutex sync.Mutex
+}
+
+func (s *recordingSink) Write(event *app.AnalyticsEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ids = append(s.ids, event.ID)
+	return nil
+}
+
+func (s *recordingSink) written() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.ids...)
+}
+
+var warehouseSink = &recordingSink{}
+
+func init() {
+	app.RegisterPipelineHook("test-team", teamEnricher{})
+	app.RegisterPipelineHook("test-pii", piiValidator{})
+	app.RegisterPipelineHook("test-warehouse", warehouseSink)
+}
+
+// TestPipelineHooks tests the custom enrichers, validators and sinks registered by platform teams
+func TestPipelineHooks(t *testing.T) {
+	track := func(service *app.AnalyticsService, eventData map[string]interface{}) (*app.AnalyticsEvent, error) {
+		return service.TrackEvent(app.ContextWithProject(context.Background(), "web"), eventData, "test-key", "user1")
+	}
+
+	t.Run("Chain", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		defer service.Bus().Stop()
+		assert.NoError(t, service.Hooks().Configure("test-pii, test-team,test-warehouse"))
+		assert.Equal(t, app.PipelineHookChain{Enrichers: []string{"test-team"}, Validators: []string{"test-pii"}, Sinks: []string{"test-warehouse"}}, service.Hooks().Chain())
+		before := len(warehouseSink.written())
+
+		event, err := track(service, map[string]interface{}{"event_type": "page_view", "user_id": "user1", "page": "/pricing"})
+		assert.NoError(t, err)
+		assert.Equal(t, "growth", event.Properties["team"], "Enrichers should add to the event")
+
+		event, err = track(service, map[string]interface{}{"event_type": "click", "user_id": "user1"})
+		assert.NoError(t, err, "Failing enrichers should not reject the event")
+		assert.NotContains(t, event.Properties, "team")
+
+		_, err = track(service, map[string]interface{}{"event_type": "signup", "user_id": "user1", "properties": map[string]interface{}{"email": "a@example.com"}})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "rejected by test-pii")
+		issues := service.ValidationLog().Query("web", app.ValidationIssueSchema, 10)
+		assert.Equal(t, 1, len(issues))
+
+		service.Bus().Drain()
+		assert.Equal(t, 2, len(warehouseSink.written())-before, "Sinks should receive the stored events only")
+	})
+
+	t.Run("Registration", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		defer service.Bus().Stop()
+		assert.Error(t, service.Hooks().Configure("test-team,unknown"))
+		assert.Empty(t, service.Hooks().Chain().Enrichers, "Nothing should be added when a hook is unknown")
+
+		assert.NoError(t, service.Hooks().Add("inline", teamEnricher{}))
+		assert.Error(t, service.Hooks().Add("inline", piiValidator{}), "Hook names should be unique in the chain")
+		assert.Error(t, service.Hooks().Add("nothing", struct{}{}))
+
+		assert.Panics(t, func() { app.RegisterPipelineHook("test-team", teamEnricher{}) })
+		assert.Panics(t, func() { app.RegisterPipelineHook("test-nothing", struct{}{}) })
+		assert.Subset(t, app.RegisteredPipelineHooks(), []string{"test-pii", "test-team", "test-warehouse"})
+
+		assert.Error(t, app.LoadPipelinePlugins("/nonexistent/hooks.so"))
+		assert.NoError(t, app.LoadPipelinePlugins(""))
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		t.Setenv("PIPELINE_HOOKS", "test-team,test-pii")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+
+		req := httptest.NewRequest("GET", "/api/v1/admin/pipeline-hooks", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Chain      app.PipelineHookChain `json:"chain"`
+			Registered []string              `json:"registered"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, []string{"test-team"}, body.Chain.Enrichers)
+		assert.Equal(t, []string{"test-pii"}, body.Chain.Validators)
+		assert.Empty(t, body.Chain.Sinks)
+		assert.Contains(t, body.Registered, "test-warehouse")
+	})
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestPricingSimulation tests re-pricing historical usage under a proposed pricing
+func TestPricingSimulation(t *testing.T) {
+	day := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	track := func(service *app.AnalyticsService, clock *app.FakeClock, projectID, userID, eventType string, at time.Time) {
+		clock.Set(at)
+		ctx := app.ContextWithProject(context.Background(), projectID)
+		_, err := service.TrackEvent(ctx, map[string]interface{}{"event_type": eventType, "user_id": userID}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	populate := func(service *app.AnalyticsService) {
+		clock := app.NewFakeClock(day)
+		service.SetClock(clock)
+		for i := 0; i < 10; i++ {
+			track(service, clock, "web", "user1", "page_view", day)
+		}
+		track(service, clock, "web", "user2", "conversion", day)
+		track(service, clock, "web", "user3", "click", day)
+		track(service, clock, "mobile", "user3", "page_view", day)
+		track(service, clock, "web", "user1", "page_view", day.Add(72*time.Hour))
+	}
+	pricing := app.PricingConfig{EventPrices: map[string]float64{"page_view": 0.002, "conversion": 0.005}, DefaultPrice: 0.0005}
+
+	t.Run("Deltas", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		populate(service)
+
+		result, err := service.SimulatePricing(app.PricingSimulation{Start: day.Truncate(24 * time.Hour), End: day.Truncate(24 * time.Hour), Pricing: pricing})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(13), result.TotalEvents, "Events after the period should not be priced")
+		assert.Equal(t, app.BaseCurrency, result.Currency)
+		assert.InDelta(t, 0.023, result.CurrentRevenue, 1e-9)
+		assert.InDelta(t, 0.0275, result.ProposedRevenue, 1e-9)
+		assert.Equal(t, 19.57, *result.DeltaPercent)
+		assert.Equal(t, 1, result.Increased)
+		assert.Equal(t, 2, result.Decreased)
+
+		if assert.Len(t, result.Customers, 3) {
+			assert.Equal(t, "user1", result.Customers[0].UserID, "Customers should be sorted by their largest change")
+			assert.InDelta(t, 0.01, result.Customers[0].Delta, 1e-9)
+			assert.Equal(t, 100.0, *result.Customers[0].DeltaPercent)
+			assert.Equal(t, "user2", result.Customers[1].UserID)
+			assert.Equal(t, -50.0, *result.Customers[1].DeltaPercent)
+			assert.Equal(t, "user3", result.Customers[2].UserID)
+			assert.Equal(t, map[string]int64{"click": 1, "page_view": 1}, result.Customers[2].EventsByType)
+		}
+
+		result, err = service.SimulatePricing(app.PricingSimulation{ProjectID: "mobile", Start: day, End: day, Pricing: app.PricingConfig{DefaultPrice: 0.01}})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), result.TotalEvents)
+		assert.InDelta(t, 0.009, result.Customers[0].Delta, 1e-9)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		for _, simulation := range []app.PricingSimulation{
+			{Pricing: pricing},
+			{Start: day, End: day.Add(-24 * time.Hour), Pricing: pricing},
+			{Start: day, End: day},
+			{Start: day, End: day, Pricing: app.PricingConfig{EventPrices: map[string]float64{"click": -1}}},
+		} {
+			_, err := service.SimulatePricing(simulation)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+		assert.NoError(t, application.GetAdminAuth().AddToken("root", "admin-token", app.RoleAdmin))
+		populate(application.GetAnalyticsService())
+
+		send := func(body, token string, async bool) (int, map[string]interface{}) {
+			req := httptest.NewRequest("POST", "/api/v1/admin/pricing/simulate", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Admin-Token", token)
+			if async {
+				req.Header.Set("Prefer", "respond-async")
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			_ = json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp.StatusCode, decoded
+		}
+
+		body := `{"start_date":"2024-03-01","end_date":"2024-03-04","pricing":{"event_prices":{"page_view":0.002}}}`
+		status, _ := send(body, "operator-token", false)
+		assert.Equal(t, 403, status, "Simulating pricing should require admin")
+		for _, invalid := range []string{`{"end_date":"2024-03-04","pricing":{"default_price":1}}`, `{"start_date":"March","end_date":"2024-03-04","pricing":{"default_price":1}}`, `{"start_date":"2024-03-01","end_date":"2024-03-04"}`} {
+			status, _ = send(invalid, "admin-token", false)
+			assert.Equal(t, 400, status, invalid)
+		}
+
+		status, response := send(body, "admin-token", false)
+		assert.Equal(t, 200, status, response)
+		simulation := response["simulation"].(map[string]interface{})
+		assert.Equal(t, float64(14), simulation["total_events"])
+		assert.Len(t, simulation["customers"], 3)
+
+		status, accepted := send(body, "admin-token", true)
+		assert.Equal(t, 202, status, accepted)
+		assert.Equal(t, app.JobPricingSim, accepted["job"].(map[string]interface{})["kind"])
+	})
+}
@@ -0,0 +1,164 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestProfileBootstrap tests user profiles and lifecycle stages, and seeding them from history
+func TestProfileBootstrap(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	event := func(eventType, userID string, days int, data map[string]interface{}) *app.CrossServiceEvent {
+		return &app.CrossServiceEvent{
+			ID:        fmt.Sprintf("%s-%s-%d", eventType, userID, days),
+			Source:    strings.Split(eventType, ".")[0],
+			EventType: eventType,
+			UserID:    userID,
+			Timestamp: start.AddDate(0, 0, days),
+			Data:      data,
+		}
+	}
+
+	t.Run("LifecycleStages", func(t *testing.T) {
+		profiles := app.NewUserProfiles()
+		assert.True(t, profiles.Apply(event("auth.user.registered", "user1", 0, nil), false))
+		profile, exists := profiles.Get("user1")
+		if assert.True(t, exists) {
+			assert.Equal(t, app.LifecycleRegistered, profile.Stage)
+		}
+
+		profiles.Apply(event("billing.user.subscription.created", "user1", 10, map[string]interface{}{"plan": "pro"}), false)
+		profiles.Apply(event("billing.payment.failed", "user1", 40, nil), false)
+		profile, _ = profiles.Get("user1")
+		assert.Equal(t, app.LifecyclePastDue, profile.Stage)
+		assert.Equal(t, "pro", profile.Plan)
+
+		profiles.Apply(event("billing.payment.completed", "user1", 42, nil), false)
+		profile, _ = profiles.Get("user1")
+		assert.Equal(t, app.LifecycleSubscribed, profile.Stage, "A completed payment should recover a past due subscriber")
+
+		profiles.Apply(event("billing.user.subscription.cancelled", "user1", 90, nil), false)
+		profiles.Apply(event("auth.user.login", "user1", 95, nil), false)
+		profile, _ = profiles.Get("user1")
+		assert.Equal(t, app.LifecycleChurned, profile.Stage, "Logins should not change the stage of known users")
+		assert.Equal(t, start.AddDate(0, 0, 95), *profile.LastLoginAt)
+		assert.False(t, profile.Seeded)
+
+		// History replayed after live events changes nothing
+		profiles.Apply(event("billing.user.subscription.updated", "user1", 50, map[string]interface{}{"plan": "team"}), true)
+		profiles.Apply(event("auth.user.registered", "user1", -5, nil), true)
+		profile, _ = profiles.Get("user1")
+		assert.Equal(t, app.LifecycleChurned, profile.Stage)
+		assert.Equal(t, "pro", profile.Plan)
+		assert.Equal(t, start.AddDate(0, 0, -5), *profile.RegisteredAt, "The earliest registration should be kept")
+		assert.True(t, profile.Seeded)
+
+		assert.False(t, profiles.Apply(event("auth.user.password.changed", "user1", 96, nil), false))
+		assert.False(t, profiles.Apply(event("auth.user.login", "", 96, nil), false))
+		assert.Equal(t, map[string]int{
+			app.LifecycleRegistered: 0,
+			app.LifecycleSubscribed: 0,
+			app.LifecyclePastDue:    0,
+			app.LifecycleChurned:    1,
+		}, profiles.Stages())
+	})
+
+	t.Run("API", func(t *testing.T) {
+		history := [][]interface{}{
+			{
+				event("auth.user.registered", "user1", 0, nil),
+				event("auth.user.registered", "user2", 1, nil),
+				event("billing.user.subscription.created", "user1", 2, map[string]interface{}{"plan": "pro"}),
+			},
+			{
+				event("billing.user.subscription.created", "user2", 3, map[string]interface{}{"plan": "basic"}),
+				event("billing.user.subscription.cancelled", "user2", 30, nil),
+				event("payments.transaction.completed", "user1", 31, nil),
+				"not an event",
+			},
+		}
+		var mutex sync.Mutex
+		var queries []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			queries = append(queries, r.URL.RawQuery)
+			mutex.Unlock()
+			page := map[string]interface{}{"events": history[0], "next_cursor": "page2"}
+			if r.URL.Query().Get("cursor") == "page2" {
+				page = map[string]interface{}{"events": history[1]}
+			}
+			json.NewEncoder(w).Encode(page)
+		}))
+		defer server.Close()
+
+		t.Setenv("BOOTSTRAP_HISTORY_URLS", server.URL+"/history")
+		t.Setenv("BOOTSTRAP_PAGE_SIZE", "3")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+
+		send := func(method, path, body string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Admin-Token", "operator-token")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp.StatusCode, decoded
+		}
+
+		status, _ := send("POST", "/api/v1/admin/bootstrap", `{"source":"kafka"}`)
+		assert.Equal(t, 503, status, "Kafka bootstraps should need the consumer")
+		status, _ = send("POST", "/api/v1/admin/bootstrap", `{"source":"files"}`)
+		assert.Equal(t, 400, status)
+		status, _ = send("POST", "/api/v1/admin/bootstrap", `{"source":"api","from":"yesterday"}`)
+		assert.Equal(t, 400, status)
+
+		status, body := send("POST", "/api/v1/admin/bootstrap", `{"source":"api","from":"2022-01-01T00:00:00Z"}`)
+		assert.Equal(t, 202, status)
+		location := body["status_url"].(string)
+		var job app.Job
+		assert.Eventually(t, func() bool {
+			_, body := send("GET", location, "")
+			encoded, _ := json.Marshal(body["job"])
+			assert.NoError(t, json.Unmarshal(encoded, &job))
+			return job.Done()
+		}, 5*time.Second, 5*time.Millisecond)
+		assert.Equal(t, app.JobSucceeded, job.Status, job.Error)
+		assert.Equal(t, app.JobBootstrap, job.Kind)
+
+		result := job.Result.(map[string]interface{})
+		assert.Equal(t, float64(7), result["events"])
+		assert.Equal(t, float64(5), result["applied"])
+		assert.Equal(t, float64(1), result["ignored"])
+		assert.Equal(t, float64(1), result["failed"])
+		assert.Equal(t, float64(2), result["profiles"])
+		if assert.Len(t, queries, 2) {
+			assert.Contains(t, queries[0], "from=2022-01-01T00%3A00%3A00Z")
+			assert.Contains(t, queries[0], "limit=3")
+			assert.Contains(t, queries[1], "cursor=page2")
+		}
+
+		status, body = send("GET", "/api/v1/users/user2/profile", "")
+		assert.Equal(t, 200, status)
+		profile := body["profile"].(map[string]interface{})
+		assert.Equal(t, app.LifecycleChurned, profile["stage"])
+		assert.Equal(t, "basic", profile["plan"])
+		assert.Equal(t, true, profile["seeded"])
+
+		status, _ = send("GET", "/api/v1/users/unknown/profile", "")
+		assert.Equal(t, 404, status)
+	})
+}
@@ -0,0 +1,203 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestProjectConfig tests exporting, diffing and applying project configuration documents
+func TestProjectConfig(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+
+	send := func(method, path, contentType, body string) *http.Response {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	type applyResponse struct {
+		Applied  bool               `json:"applied"`
+		Changes  []app.ConfigChange `json:"changes"`
+		Problems []string           `json:"problems"`
+	}
+	decode := func(resp *http.Response) applyResponse {
+		var body applyResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+
+	document := `
+version: 1
+project: shop
+queries:
+  - name: Pro buyers
+    type: segment
+    parameters:
+      event_type: purchase
+      property: plan
+      value: pro
+funnels:
+  - name: Checkout
+    steps:
+      - name: Cart
+        event_type: add_to_cart
+      - name: Purchase
+        event_type: purchase
+dashboards:
+  - name: Sales
+    widgets:
+      - title: Pro buyers
+        query: Pro buyers
+      - title: Events
+        metric: events
+goals:
+  - name: Pro purchase
+    event_type: purchase
+    filters:
+      plan: pro
+alerts:
+  - name: Purchases stopped
+    type: event_disappeared
+    event_type: purchase
+`
+
+	t.Run("DiffDoesNotApply", func(t *testing.T) {
+		resp := send("PUT", "/api/v1/projects/shop/config?mode=diff", "application/yaml", document)
+		assert.Equal(t, 200, resp.StatusCode)
+		body := decode(resp)
+		assert.False(t, body.Applied)
+		assert.Equal(t, 5, len(body.Changes))
+		for _, change := range body.Changes {
+			assert.Equal(t, app.ConfigActionCreate, change.Action)
+		}
+
+		resp = send("GET", "/api/v1/projects/shop/config", "", "")
+		var config app.ProjectConfig
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&config))
+		assert.Equal(t, 0, len(config.Funnels))
+		assert.Equal(t, 0, len(config.Goals))
+		assert.Equal(t, 0, len(config.Alerts))
+	})
+
+	t.Run("ApplyAndRoundTrip", func(t *testing.T) {
+		resp := send("PUT", "/api/v1/projects/shop/config", "application/yaml", document)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.True(t, decode(resp).Applied)
+
+		resp = send("GET", "/api/v1/projects/shop/config?format=yaml", "", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "yaml")
+		exported, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Contains(t, string(exported), "query: Pro buyers", "Dashboards should reference queries by name")
+		assert.Equal(t, "purchase", application.GetGoalService().Get("shop").Goals[0].EventType)
+		monitors := application.GetAnalyticsService().DataQuality().Get("shop").Monitors
+		assert.Equal(t, "Purchases stopped", monitors[0].Name)
+		assert.Equal(t, int64(10), monitors[0].MinEvents, "Alerts should get the defaults of monitors")
+
+		// Re-applying the export changes nothing
+		resp = send("PUT", "/api/v1/projects/shop/config?mode=diff", "application/yaml", string(exported))
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 0, len(decode(resp).Changes))
+
+		// Other projects are unaffected
+		resp = send("GET", "/api/v1/projects/other/config", "", "")
+		var config app.ProjectConfig
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&config))
+		assert.Equal(t, 0, len(config.Dashboards))
+		assert.Equal(t, 0, len(config.Goals))
+		assert.Equal(t, 0, len(config.Alerts))
+	})
+
+	t.Run("UpdatesAndDeletes", func(t *testing.T) {
+		updated := `{
+			"version": 1,
+			"funnels": [{"name": "Checkout", "description": "Cart to purchase", "steps": [
+				{"name": "Cart", "event_type": "add_to_cart"},
+				{"name": "Purchase", "event_type": "purchase"}
+			]}],
+			"queries": [],
+			"dashboards": [],
+			"goals": [],
+			"alerts": [{"name": "Purchases stopped", "type": "event_disappeared", "event_type": "purchase", "min_events": 50}],
+			"schemas": []
+		}`
+		resp := send("PUT", "/api/v1/projects/shop/config", "application/json", updated)
+		assert.Equal(t, 200, resp.StatusCode)
+		changes := decode(resp).Changes
+		assert.Contains(t, changes, app.ConfigChange{Kind: "funnel", Name: "Checkout", Action: app.ConfigActionUpdate, Fields: []string{"description"}})
+		assert.Contains(t, changes, app.ConfigChange{Kind: "dashboard", Name: "Sales", Action: app.ConfigActionDelete})
+		assert.Contains(t, changes, app.ConfigChange{Kind: "query", Name: "Pro buyers", Action: app.ConfigActionDelete})
+		assert.Contains(t, changes, app.ConfigChange{Kind: "goal", Name: "Pro purchase", Action: app.ConfigActionDelete})
+		assert.Contains(t, changes, app.ConfigChange{Kind: "alert", Name: "Purchases stopped", Action: app.ConfigActionUpdate, Fields: []string{"min_events"}})
+
+		resp = send("GET", "/api/v1/projects/shop/config", "", "")
+		var config app.ProjectConfig
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&config))
+		assert.Equal(t, 1, len(config.Funnels))
+		assert.Equal(t, 0, len(config.Queries))
+		assert.Equal(t, 0, len(config.Goals))
+		assert.Equal(t, int64(50), config.Alerts[0].MinEvents)
+		assert.NotEmpty(t, config.Schemas, "Schemas are never deleted by a document")
+	})
+
+	t.Run("RejectsSchemaChanges", func(t *testing.T) {
+		resp := send("GET", "/api/v1/projects/shop/config", "", "")
+		var config app.ProjectConfig
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&config))
+		before := len(config.Schemas)
+
+		for _, schemas := range []string{
+			`[{"event_type": "add_to_cart", "required_fields": ["event_type", "user_id"]}]`,
+			`[{"event_type": "page_view", "required_fields": ["event_type"]}]`,
+		} {
+			resp := send("PUT", "/api/v1/projects/shop/config?mode=diff", "application/json", `{"version": 1, "schemas": `+schemas+`}`)
+			assert.Equal(t, 400, resp.StatusCode, schemas)
+			problems := decode(resp).Problems
+			if assert.Equal(t, 1, len(problems), schemas) {
+				assert.Contains(t, problems[0], "shared by every project")
+			}
+		}
+
+		resp = send("GET", "/api/v1/projects/other/config", "", "")
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&config))
+		assert.Equal(t, before, len(config.Schemas), "Imports should not change the schemas of other projects")
+		schema, err := application.GetAnalyticsService().Schemas().GetSchema("page_view")
+		assert.NoError(t, err)
+		assert.Contains(t, schema.RequiredFields, "user_id")
+	})
+
+	t.Run("ValidationReportsEveryProblem", func(t *testing.T) {
+		invalid := `{
+			"version": 1,
+			"funnels": [{"name": "Short", "steps": [{"name": "Only", "event_type": "page_view"}]}],
+			"queries": [{"name": "Q", "type": "unknown"}],
+			"dashboards": [{"name": "D", "widgets": [{"title": "W", "query": "Missing"}]}],
+			"goals": [{"name": "G"}],
+			"alerts": [{"name": "A", "type": "null_rate", "event_type": "purchase"}],
+			"schemas": []
+		}`
+		resp := send("PUT", "/api/v1/projects/shop/config", "application/json", invalid)
+		assert.Equal(t, 400, resp.StatusCode)
+		assert.Equal(t, 5, len(decode(resp).Problems))
+
+		resp = send("PUT", "/api/v1/projects/shop/config", "application/json", `{"version": 1, "segments": []}`)
+		assert.Equal(t, 400, resp.StatusCode, "Unknown sections should be rejected")
+
+		resp = send("PUT", "/api/v1/projects/shop/config", "application/json", `{"version": 1, "project": "other"}`)
+		assert.Equal(t, 400, resp.StatusCode, "Documents for another project should be rejected")
+	})
+}
@@ -0,0 +1,96 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestPropertyCardinality tests hashing of property values beyond the per-project cardinality limit
+func TestPropertyCardinality(t *testing.T) {
+	t.Run("HashesNewValuesOverLimit", func(t *testing.T) {
+		service := app.NewAnalyticsService()
+		assert.NoError(t, service.Cardinality().SetLimit(3))
+		ctx := app.ContextWithProject(context.Background(), "shop")
+
+		track := func(orderID string) *app.AnalyticsEvent {
+			properties := map[string]interface{}{"order_id": orderID, "plan": "pro"}
+			event, err := service.TrackEvent(ctx, map[string]interface{}{
+				"event_type": "purchase",
+				"user_id":    "user1",
+				"properties": properties,
+			}, "test-key", "user1")
+			assert.NoError(t, err)
+			assert.Equal(t, orderID, properties["order_id"], "The caller's properties should not be modified")
+			return event
+		}
+
+		for i := 0; i < 3; i++ {
+			event := track(fmt.Sprintf("order-%d", i))
+			assert.Empty(t, event.LimitedProperties)
+		}
+
+		event := track("order-99")
+		assert.Equal(t, []string{"order_id"}, event.LimitedProperties)
+		assert.True(t, strings.HasPrefix(event.Properties["order_id"].(string), app.CardinalityLimitedPrefix))
+		assert.Equal(t, "pro", event.Properties["plan"])
+		assert.Equal(t, event.Properties["order_id"], track("order-99").Properties["order_id"], "Hashing should be deterministic")
+		assert.Equal(t, "order-1", track("order-1").Properties["order_id"], "Values seen before the limit should be kept")
+
+		limited := service.Cardinality().LimitedProperties("shop")
+		assert.Equal(t, 1, len(limited))
+		assert.Equal(t, int64(2), limited[0].LimitedValues)
+		assert.Empty(t, service.Cardinality().LimitedProperties("other"), "Cardinality should be tracked per project")
+
+		issues := service.ValidationLog().Query("shop", app.ValidationIssueCardinality, 0)
+		assert.Equal(t, 1, len(issues), "The limit should be reported once per property")
+		assert.Equal(t, "order_id", issues[0].Property)
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		assert.NoError(t, application.GetAnalyticsService().Cardinality().SetLimit(1))
+
+		send := func(body string) map[string]interface{} {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "shop")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded))
+			return decoded
+		}
+
+		send(`{"event_type":"click","user_id":"user1","properties":{"element":"a"}}`)
+		response := send(`{"event_type":"click","user_id":"user1","properties":{"element":"b"}}`)
+		assert.Equal(t, []interface{}{"element"}, response["limited_properties"])
+		send(`{"event_type":"page_view"}`)
+
+		req := httptest.NewRequest("GET", "/api/v1/analytics/validation-errors", nil)
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Errors            []app.ValidationIssue     `json:"errors"`
+			LimitedProperties []app.PropertyCardinality `json:"limited_properties"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, 2, len(body.Errors))
+		assert.Equal(t, app.ValidationIssueSchema, body.Errors[0].Kind, "Rejected events should be reported, newest first")
+		assert.Equal(t, app.ValidationIssueCardinality, body.Errors[1].Kind)
+		assert.Equal(t, "element", body.LimitedProperties[0].Property)
+	})
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestPropertyValues tests the distribution of a property's values: top values with their counts,
+// and histograms of numeric properties
+func TestPropertyValues(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	ctx := app.ContextWithProject(context.Background(), "shop")
+	start := time.Now().Add(-time.Hour)
+	end := time.Now().Add(time.Hour)
+
+	track := func(eventType, userID string, properties map[string]interface{}) {
+		_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+			"properties": properties,
+		}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	plans := []string{"free", "free", "free", "pro", "pro", "team"}
+	for i, plan := range plans {
+		track("purchase", fmt.Sprintf("user%d", i%4), map[string]interface{}{"plan": plan, "amount": float64(10 * (i + 1))})
+	}
+	track("purchase", "user9", map[string]interface{}{"amount": "free"})
+	track("signup", "user1", map[string]interface{}{"plan": "enterprise"})
+	track("purchase", "user1", nil)
+
+	queries := app.NewQueryService(application.GetAnalyticsService())
+
+	t.Run("TopValues", func(t *testing.T) {
+		result, err := queries.ComputePropertyValues(ctx, app.PropertyValuesQuery{Property: "plan", EventType: "purchase", Start: start, End: end, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(8), result.TotalEvents)
+		assert.Equal(t, int64(2), result.EventsWithout)
+		assert.Equal(t, int64(3), result.DistinctValues)
+		assert.Equal(t, []app.PropertyValueCount{
+			{Value: "free", Count: 3, Share: 50, Users: 3},
+			{Value: "pro", Count: 2, Share: 33.33, Users: 2},
+		}, result.Values)
+		assert.Equal(t, int64(1), result.OtherCount)
+		assert.Nil(t, result.Numeric, "Text properties should have no histogram")
+
+		every, err := queries.ComputePropertyValues(ctx, app.PropertyValuesQuery{Property: "plan", Start: start, End: end})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), every.DistinctValues, "Every event type should be counted without event_type")
+	})
+
+	t.Run("NumericHistogram", func(t *testing.T) {
+		track("refund", "user1", map[string]interface{}{"amount": 5.0})
+		track("refund", "user2", map[string]interface{}{"amount": 15.0})
+		track("refund", "user3", map[string]interface{}{"amount": 25.0})
+		track("refund", "user4", map[string]interface{}{"amount": 45.0})
+		result, err := queries.ComputePropertyValues(ctx, app.PropertyValuesQuery{Property: "amount", EventType: "refund", Start: start, End: end, Buckets: 4})
+		assert.NoError(t, err)
+		if assert.NotNil(t, result.Numeric) {
+			assert.Equal(t, 5.0, result.Numeric.Min)
+			assert.Equal(t, 45.0, result.Numeric.Max)
+			assert.Equal(t, 22.5, result.Numeric.Mean)
+			assert.Equal(t, []app.HistogramBucket{
+				{Lower: 5, Upper: 15, Count: 1},
+				{Lower: 15, Upper: 25, Count: 1},
+				{Lower: 25, Upper: 35, Count: 1},
+				{Lower: 35, Upper: 45, Count: 1},
+			}, result.Numeric.Histogram)
+		}
+
+		mixed, err := queries.ComputePropertyValues(ctx, app.PropertyValuesQuery{Property: "amount", EventType: "purchase", Start: start, End: end})
+		assert.NoError(t, err)
+		assert.Nil(t, mixed.Numeric, "Properties with text values should have no histogram")
+
+		track("constant", "user1", map[string]interface{}{"amount": 7.0})
+		constant, err := queries.ComputePropertyValues(ctx, app.PropertyValuesQuery{Property: "amount", EventType: "constant", Start: start, End: end})
+		assert.NoError(t, err)
+		assert.Equal(t, []app.HistogramBucket{{Lower: 7, Upper: 7, Count: 1}}, constant.Numeric.Histogram)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		for _, query := range []app.PropertyValuesQuery{
+			{Start: start, End: end},
+			{Property: "plan", Start: end, End: start},
+			{Property: "plan", Start: start, End: end, Limit: 5000},
+			{Property: "plan", Start: start, End: end, Buckets: 500},
+		} {
+			_, err := queries.ComputePropertyValues(ctx, query)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		get := func(query string) (int, map[string]interface{}) {
+			req := httptest.NewRequest("GET", "/api/v1/properties/plan/values?"+query, nil)
+			req.Header.Set("X-Project-ID", "shop")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return resp.StatusCode, body
+		}
+
+		status, body := get("event_type=purchase&limit=1")
+		assert.Equal(t, 200, status)
+		result := body["result"].(map[string]interface{})
+		assert.Equal(t, "plan", result["property"])
+		assert.Len(t, result["values"], 1)
+		assert.Equal(t, float64(3), result["other_count"])
+
+		status, _ = get("start_date=yesterday")
+		assert.Equal(t, 400, status)
+		status, _ = get("limit=-1")
+		assert.Equal(t, 400, status)
+	})
+}
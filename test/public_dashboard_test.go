@@ -0,0 +1,118 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestPublicDashboards tests embedding saved dashboards through scoped public tokens
+func TestPublicDashboards(t *testing.T) {
+	application, feedURL := startDashboardServer(t)
+	publicURL := strings.TrimSuffix(feedURL, "/api/v1/dashboard/feed") + "/api/v1/public/dashboards/"
+	dashboards := application.GetSavedDashboardService()
+	ctx := app.ContextWithProject(context.Background(), "status")
+
+	query, err := application.GetSavedQueryService().CreateQuery(ctx, "Signups", "", app.SavedQueryTrend, map[string]interface{}{
+		"event_type": "signup",
+	})
+	assert.NoError(t, err)
+
+	dashboard, err := dashboards.CreateDashboard(ctx, "Status", "Public status page", []app.DashboardWidget{
+		{Title: "Signups", QueryID: query.ID},
+		{Title: "Events", Metric: "total_events"},
+	})
+	assert.NoError(t, err)
+
+	t.Run("RejectsWidgetsOfOtherProjects", func(t *testing.T) {
+		_, err := dashboards.CreateDashboard(context.Background(), "Other", "", []app.DashboardWidget{
+			{Title: "Signups", QueryID: query.ID},
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		token, _, err := dashboards.CreatePublicToken(ctx, dashboard.ID, []string{app.PublicScopeSnapshot}, time.Hour)
+		assert.NoError(t, err)
+
+		resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/public/dashboards/"+token+"/snapshot", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Dashboard map[string]interface{}        `json:"dashboard"`
+			Widgets   []app.DashboardWidgetSnapshot `json:"widgets"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "Status", body.Dashboard["name"])
+		assert.Nil(t, body.Dashboard["project_id"], "Public snapshots should not expose the project")
+		assert.Equal(t, 2, len(body.Widgets))
+		assert.Equal(t, app.SavedQueryTrend, body.Widgets[0].QueryType)
+		assert.NotNil(t, body.Widgets[1].Result)
+
+		// The token is scoped to snapshots only
+		_, _, err = websocket.DefaultDialer.Dial(publicURL+token+"/stream", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("RevokedToken", func(t *testing.T) {
+		token, _, err := dashboards.CreatePublicToken(ctx, dashboard.ID, nil, time.Hour)
+		assert.NoError(t, err)
+		assert.NoError(t, dashboards.RevokePublicTokens(ctx, dashboard.ID))
+
+		resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/public/dashboards/"+token+"/snapshot", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("ShareTokensAreNotPublicTokens", func(t *testing.T) {
+		token, _, err := application.GetSavedQueryService().CreateShareToken(ctx, query.ID, time.Hour)
+		assert.NoError(t, err)
+
+		resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/public/dashboards/"+token+"/snapshot", nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("Stream", func(t *testing.T) {
+		token, _, err := dashboards.CreatePublicToken(ctx, dashboard.ID, []string{app.PublicScopeStream}, time.Hour)
+		assert.NoError(t, err)
+
+		conn, _, err := websocket.DefaultDialer.Dial(publicURL+token+"/stream", nil)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		// Only the dashboard's metrics are available
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "metric": "active_users"}))
+		msg := readUntil(t, conn, "error", 2*time.Second)
+		assert.Contains(t, msg["error"], "not available")
+
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "resume", "from_seq": 1}))
+		msg = readUntil(t, conn, "error", 2*time.Second)
+		assert.Contains(t, msg["error"], "resume")
+
+		// Raw events are withheld, only aggregated counts are pushed
+		assert.NoError(t, conn.WriteJSON(map[string]interface{}{"type": "subscribe", "stream": "events", "interval": "1s"}))
+		readUntil(t, conn, "subscribed", 2*time.Second)
+
+		application.GetDashboardService().BroadcastEvent(&app.AnalyticsEvent{
+			ID:        "evt-1",
+			ProjectID: "status",
+			EventType: "signup",
+			UserID:    "private-user",
+			Timestamp: time.Now(),
+		})
+
+		batch := readUntil(t, conn, "events.batch", 3*time.Second)
+		assert.Equal(t, float64(1), batch["count"])
+		assert.NotContains(t, batch, "user_id")
+	})
+}
@@ -0,0 +1,124 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestEventQuarantine tests keeping invalid events in quarantine and promoting them once fixed
+func TestEventQuarantine(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+
+	send := func(method, path, ifMatch, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Project-ID", "quarantine")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "user1")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp.StatusCode, decoded
+	}
+	track := func(eventType string) (int, map[string]interface{}) {
+		return send("POST", "/api/v1/analytics/events", "", `{"event_type":"`+eventType+`","user_id":"user1","properties":{"plan":"pro"}}`)
+	}
+	// Properties must be a map
+	trackMalformed := func() (int, map[string]interface{}) {
+		return send("POST", "/api/v1/analytics/events", "", `{"event_type":"pageview","user_id":"user1","properties":"plan=pro"}`)
+	}
+
+	// Signups must name their referrer
+	status, _ := send("PUT", "/api/v1/schemas/signup", "", `{"required_fields":["event_type","user_id","referrer"]}`)
+	assert.Equal(t, 200, status)
+	status, _ = track("signup")
+	assert.Equal(t, 400, status, "Invalid events should be rejected without quarantine")
+
+	status, body := send("PUT", "/api/v1/projects/quarantine/quarantine", "", `{"enabled":true}`)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, true, body["quarantine"].(map[string]interface{})["enabled"])
+	status, _ = send("PUT", "/api/v1/projects/quarantine/quarantine", "", `{"enabled":false}`)
+	assert.Equal(t, 428, status, "Updating the settings should require If-Match")
+
+	status, body = track("signup")
+	assert.Equal(t, 202, status)
+	assert.Equal(t, "quarantined", body["status"])
+	signupID := body["quarantine_id"].(string)
+	assert.Contains(t, body["reason"], "referrer")
+	status, body = trackMalformed()
+	assert.Equal(t, 202, status)
+	pageviewID := body["quarantine_id"].(string)
+
+	status, body = send("GET", "/api/v1/projects/quarantine/quarantine/events", "", "")
+	assert.Equal(t, 200, status)
+	events := body["events"].([]interface{})
+	if assert.Len(t, events, 2) {
+		first := events[0].(map[string]interface{})
+		assert.Equal(t, signupID, first["id"])
+		assert.Equal(t, "signup", first["event_type"])
+		assert.Equal(t, "pro", first["data"].(map[string]interface{})["properties"].(map[string]interface{})["plan"])
+		assert.Equal(t, app.APIKeyID("test-key"), first["api_key_id"])
+	}
+	status, body = send("GET", "/api/v1/projects/quarantine/quarantine", "", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, map[string]interface{}{"signup": 1.0, "pageview": 1.0}, body["counts"])
+
+	// Still invalid: the event stays with another attempt counted
+	status, body = send("POST", "/api/v1/projects/quarantine/quarantine/revalidate", "", `{"ids":["`+signupID+`"]}`)
+	assert.Equal(t, 200, status)
+	assert.Empty(t, body["promoted"])
+	assert.Len(t, body["quarantined"], 1)
+	status, body = send("GET", "/api/v1/projects/quarantine/quarantine/events/"+signupID, "", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 2.0, body["event"].(map[string]interface{})["attempts"])
+
+	// Fixing the schema lets the event through
+	status, _ = send("PUT", "/api/v1/schemas/signup", app.ETag(1), `{"required_fields":["event_type","user_id"]}`)
+	assert.Equal(t, 200, status)
+	status, body = send("POST", "/api/v1/projects/quarantine/quarantine/revalidate", "", `{"event_type":"signup"}`)
+	assert.Equal(t, 200, status)
+	promoted := body["promoted"].([]interface{})
+	if assert.Len(t, promoted, 1) {
+		stored := application.GetAnalyticsService().QueryEvents(context.Background(), app.EventFilter{ProjectID: "quarantine", EventType: "signup"})
+		if assert.Len(t, stored, 1) {
+			assert.Equal(t, promoted[0].(map[string]interface{})["event_id"], stored[0].ID)
+			assert.Equal(t, "pro", stored[0].Properties["plan"])
+		}
+	}
+
+	// A transform fixes the instrumentation's mistakes
+	status, body = send("POST", "/api/v1/projects/quarantine/quarantine/revalidate", "", `{"transform":{"event_type":"page_view","set_properties":{"fixed":true}}}`)
+	assert.Equal(t, 200, status)
+	promoted = body["promoted"].([]interface{})
+	if assert.Len(t, promoted, 1) {
+		assert.Equal(t, pageviewID, promoted[0].(map[string]interface{})["id"])
+		stored := application.GetAnalyticsService().QueryEvents(context.Background(), app.EventFilter{ProjectID: "quarantine", EventType: "page_view"})
+		if assert.Len(t, stored, 1) {
+			assert.Equal(t, map[string]interface{}{"fixed": true}, stored[0].Properties)
+		}
+	}
+	status, body = send("GET", "/api/v1/projects/quarantine/quarantine/events", "", "")
+	assert.Empty(t, body["events"], "Promoted events should leave the quarantine")
+
+	// Discarding
+	trackMalformed()
+	trackMalformed()
+	status, body = send("DELETE", "/api/v1/projects/quarantine/quarantine/events?event_type=pageview", "", "")
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 2.0, body["discarded"])
+	status, _ = send("DELETE", "/api/v1/projects/quarantine/quarantine/events/missing", "", "")
+	assert.Equal(t, 404, status)
+}
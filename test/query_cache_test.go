@@ -0,0 +1,182 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestQueryCache tests serving trend and funnel results with stale-while-revalidate caching
+func TestQueryCache(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("StaleWhileRevalidate", func(t *testing.T) {
+		t.Setenv("QUERY_CACHE_FRESH_FOR", "30s")
+		t.Setenv("QUERY_CACHE_STALE_FOR", "5m")
+		cache := app.NewQueryCache()
+		clock := app.NewFakeClock(start)
+		cache.SetClock(clock)
+
+		var computations int64
+		compute := func() (interface{}, error) {
+			return atomic.AddInt64(&computations, 1), nil
+		}
+		key := app.QueryCacheKey("trend", "web", map[string]string{"event_type": "page_view", "interval": "day"})
+		assert.Equal(t, key, app.QueryCacheKey("trend", "web", map[string]string{"interval": "day", "event_type": "page_view"}), "Keys should not depend on the parameters' order")
+
+		value, status, err := cache.Get(key, "web", false, compute)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), value)
+		assert.Equal(t, app.CacheMiss, status.State)
+
+		clock.Advance(10 * time.Second)
+		value, status, err = cache.Get(key, "web", false, compute)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), value)
+		assert.Equal(t, app.CacheHit, status.State)
+		assert.Equal(t, 10*time.Second, status.Age)
+		assert.Equal(t, 20*time.Second, status.FreshFor)
+
+		clock.Advance(time.Minute)
+		value, status, err = cache.Get(key, "web", false, compute)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), value, "Stale results should be served instantly")
+		assert.Equal(t, app.CacheStale, status.State)
+		assert.Eventually(t, func() bool {
+			value, status, _ := cache.Get(key, "web", false, compute)
+			return value == int64(2) && status.State == app.CacheHit
+		}, 5*time.Second, 10*time.Millisecond, "Stale results should be recomputed in the background")
+
+		clock.Advance(10 * time.Minute)
+		_, status, err = cache.Get(key, "web", false, compute)
+		assert.NoError(t, err)
+		assert.Equal(t, app.CacheMiss, status.State, "Results past the stale window should be recomputed synchronously")
+
+		_, status, err = cache.Get(key, "web", true, compute)
+		assert.NoError(t, err)
+		assert.Equal(t, app.CacheBypass, status.State)
+
+		cache.ExpireProject("mobile")
+		_, status, _ = cache.Get(key, "web", false, compute)
+		assert.Equal(t, app.CacheHit, status.State, "Expiring another project should not affect the results")
+		cache.ExpireProject("web")
+		_, status, _ = cache.Get(key, "web", false, compute)
+		assert.Equal(t, app.CacheStale, status.State, "Expired results should be revalidated")
+
+		stats := cache.Stats()
+		assert.Equal(t, 1, stats.Entries)
+		assert.Equal(t, int64(1), stats.Bypasses)
+		assert.True(t, stats.Revalidations >= 2)
+	})
+
+	t.Run("ErrorsAreNotCached", func(t *testing.T) {
+		cache := app.NewQueryCache()
+		failing := func() (interface{}, error) { return nil, errors.New("query failed") }
+
+		_, _, err := cache.Get("key", "web", false, failing)
+		assert.Error(t, err)
+		value, status, err := cache.Get("key", "web", false, func() (interface{}, error) { return "ok", nil })
+		assert.NoError(t, err)
+		assert.Equal(t, "ok", value)
+		assert.Equal(t, app.CacheMiss, status.State)
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		t.Setenv("QUERY_CACHE_MAX_ENTRIES", "2")
+		cache := app.NewQueryCache()
+		clock := app.NewFakeClock(start)
+		cache.SetClock(clock)
+		compute := func() (interface{}, error) { return "ok", nil }
+
+		for _, key := range []string{"a", "b", "c"} {
+			_, _, err := cache.Get(key, "web", false, compute)
+			assert.NoError(t, err)
+			clock.Advance(time.Second)
+		}
+		_, status, _ := cache.Get("a", "web", false, compute)
+		assert.Equal(t, app.CacheMiss, status.State, "The oldest result should be evicted")
+		assert.Equal(t, int64(2), cache.Stats().Evictions)
+
+		assert.Error(t, cache.SetTTLs(-time.Second, time.Minute))
+		assert.NoError(t, cache.SetTTLs(0, time.Minute))
+		_, status, _ = cache.Get("a", "web", false, compute)
+		assert.Equal(t, app.CacheMiss, status.State)
+		assert.Equal(t, 0, cache.Stats().Entries, "Nothing should be cached once caching is disabled")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+
+		send := func(method, path, cacheControl, body string) *http.Response {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("X-Project-ID", "web")
+			req.Header.Set("Content-Type", "application/json")
+			if cacheControl != "" {
+				req.Header.Set("Cache-Control", cacheControl)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp
+		}
+
+		trend := "/api/v1/trends?event_type=page_view&interval=day"
+		resp := send("GET", trend, "", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, app.CacheMiss, resp.Header.Get("X-Cache"))
+		assert.NotEmpty(t, resp.Header.Get("X-Data-Computed-At"))
+		assert.Equal(t, "private, max-age=30, stale-while-revalidate=300", resp.Header.Get("Cache-Control"))
+
+		resp = send("GET", trend, "", "")
+		assert.Equal(t, app.CacheHit, resp.Header.Get("X-Cache"))
+		assert.Equal(t, "0", resp.Header.Get("Age"))
+		assert.Equal(t, app.CacheBypass, send("GET", trend, "no-cache", "").Header.Get("X-Cache"))
+		assert.Equal(t, app.CacheMiss, send("GET", "/api/v1/trends?event_type=page_view&interval=hour", "", "").Header.Get("X-Cache"), "Other parameters should be cached separately")
+		assert.Equal(t, 400, send("GET", "/api/v1/trends?event_type=page_view&start_date=tomorrow", "", "").StatusCode)
+
+		steps := `{"name":"Signup","steps":[{"name":"Landing","event_type":"page_view","order":1},{"name":"Signup","event_type":"signup","order":2}]}`
+		resp = send("POST", "/api/v1/funnels", "", steps)
+		assert.Equal(t, 200, resp.StatusCode)
+		var created struct {
+			Funnel app.Funnel `json:"funnel"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+		compute := "/api/v1/funnels/" + created.Funnel.ID + "/compute"
+		assert.Equal(t, app.CacheMiss, send("GET", compute, "", "").Header.Get("X-Cache"))
+		assert.Equal(t, app.CacheHit, send("GET", compute, "", "").Header.Get("X-Cache"))
+
+		req := httptest.NewRequest("PUT", "/api/v1/funnels/"+created.Funnel.ID, strings.NewReader(steps))
+		req.Header.Set("X-Project-ID", "web")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", `"1"`)
+		updated, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, updated.StatusCode)
+		assert.Equal(t, app.CacheMiss, send("GET", compute, "", "").Header.Get("X-Cache"), "Updating the funnel should not serve results of its previous steps")
+
+		req = httptest.NewRequest("GET", "/api/v1/admin/query-cache", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		stats, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, stats.StatusCode)
+		var body struct {
+			Stats app.QueryCacheStats `json:"stats"`
+		}
+		assert.NoError(t, json.NewDecoder(stats.Body).Decode(&body))
+		assert.Equal(t, int64(2), body.Stats.Hits)
+		assert.Equal(t, int64(4), body.Stats.Misses)
+		assert.Equal(t, int64(1), body.Stats.Bypasses)
+	})
+}
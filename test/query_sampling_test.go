@@ -0,0 +1,156 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestQuerySampling tests evaluating trends and segments against a deterministic sample of users
+// and extrapolating their counts with confidence bounds
+func TestQuerySampling(t *testing.T) {
+	service := app.NewAnalyticsService()
+	queries := app.NewQueryService(service)
+	ctx := app.ContextWithProject(context.Background(), "web")
+	for user := 0; user < 3000; user++ {
+		for i := 0; i <= user%3; i++ {
+			_, err := service.TrackEvent(ctx, map[string]interface{}{
+				"event_type": "page_view",
+				"user_id":    fmt.Sprintf("user%d", user),
+				"properties": map[string]interface{}{"plan": []string{"free", "pro"}[user%2]},
+			}, "api-key", fmt.Sprintf("user%d", user))
+			assert.NoError(t, err)
+		}
+	}
+	start := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	end := start.Add(3 * time.Hour)
+
+	within := func(t *testing.T, exact int64, bounds *app.EstimateBounds) {
+		if assert.NotNil(t, bounds) {
+			assert.LessOrEqual(t, bounds.Lower, exact)
+			assert.GreaterOrEqual(t, bounds.Upper, exact)
+		}
+	}
+
+	t.Run("ParseSample", func(t *testing.T) {
+		sample, err := app.ParseQuerySample("")
+		assert.NoError(t, err)
+		assert.Equal(t, 1.0, sample)
+		sample, err = app.ParseQuerySample("0.01")
+		assert.NoError(t, err)
+		assert.Equal(t, 0.01, sample)
+		for _, invalid := range []string{"0", "-0.1", "1.5", "0.00001", "NaN", "abc"} {
+			_, err := app.ParseQuerySample(invalid)
+			assert.Error(t, err, invalid)
+		}
+	})
+
+	t.Run("Trends", func(t *testing.T) {
+		query := app.TrendQuery{EventType: "page_view", Interval: "hour", Start: start, End: end}
+		exact, err := queries.ComputeTrend(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(6000), exact.TotalEvents)
+		assert.Zero(t, exact.Sample)
+		assert.Nil(t, exact.TotalEventsBounds, "Exact counts should have no bounds")
+
+		query.Sample = 0.1
+		sampled, err := queries.ComputeTrend(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, 0.1, sampled.Sample)
+		assert.InDelta(t, 6000, sampled.TotalEvents, 900)
+		within(t, exact.TotalEvents, sampled.TotalEventsBounds)
+		for i, point := range sampled.Points {
+			if exact.Points[i].Count == 0 {
+				assert.Equal(t, int64(0), point.Count)
+				continue
+			}
+			within(t, exact.Points[i].Count, point.CountBounds)
+			within(t, exact.Points[i].UniqueUsers, point.UniqueUsersBounds)
+		}
+
+		again, err := queries.ComputeTrend(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, sampled.TotalEvents, again.TotalEvents, "The sample of users should be deterministic")
+	})
+
+	t.Run("Breakdowns", func(t *testing.T) {
+		_, err := service.Dimensions().Replace("web", []app.CustomDimension{{Name: "plan", Property: "plan", Type: app.DimensionEnum, Values: []string{"free", "pro"}}}, 0)
+		assert.NoError(t, err)
+		sampled, err := queries.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "hour", Start: start, End: end, Breakdown: "plan", Sample: 0.2})
+		assert.NoError(t, err)
+		assert.Len(t, sampled.Breakdown, 2)
+		for _, series := range sampled.Breakdown {
+			within(t, 3000, series.TotalEventsBounds)
+		}
+	})
+
+	t.Run("Segments", func(t *testing.T) {
+		query := app.SegmentQuery{EventType: "page_view", Start: start, End: end}
+		exact, err := queries.ComputeSegment(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3000), exact.UserCount)
+
+		query.Sample = 0.05
+		sampled, err := queries.ComputeSegment(ctx, query)
+		assert.NoError(t, err)
+		assert.Equal(t, 0.05, sampled.Sample)
+		within(t, exact.UserCount, sampled.UserCountBounds)
+		within(t, exact.EventCount, sampled.EventCountBounds)
+		assert.Less(t, len(sampled.Users), 300, "Only the sampled users should be listed")
+		assert.GreaterOrEqual(t, sampled.UserCountBounds.Lower, int64(len(sampled.Users)), "Bounds should not go below the users seen")
+
+		query.Sample = 2
+		_, err = queries.ComputeSegment(ctx, query)
+		assert.Error(t, err)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		for user := 0; user < 200; user++ {
+			_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{"event_type": "signup", "user_id": fmt.Sprintf("user%d", user)}, "api-key", fmt.Sprintf("user%d", user))
+			assert.NoError(t, err)
+		}
+
+		get := func(path string, parameters url.Values) (int, map[string]interface{}) {
+			parameters.Set("event_type", "signup")
+			parameters.Set("start_date", start.Format(time.RFC3339))
+			parameters.Set("end_date", end.Format(time.RFC3339))
+			req := httptest.NewRequest("GET", path+"?"+parameters.Encode(), nil)
+			req.Header.Set("X-Project-ID", "web")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return resp.StatusCode, body
+		}
+
+		status, body := get("/api/v1/trends", url.Values{"interval": {"hour"}, "sample": {"0.5"}})
+		assert.Equal(t, 200, status)
+		result := body["result"].(map[string]interface{})
+		assert.Equal(t, 0.5, result["sample"])
+		assert.Contains(t, result, "total_events_bounds")
+
+		status, body = get("/api/v1/trends", url.Values{"interval": {"hour"}})
+		assert.Equal(t, 200, status)
+		assert.Equal(t, float64(200), body["result"].(map[string]interface{})["total_events"], "Sampled results should be cached apart")
+
+		status, body = get("/api/v1/segments", url.Values{"sample": {"0.5"}})
+		assert.Equal(t, 200, status)
+		assert.Contains(t, body["result"].(map[string]interface{}), "user_count_bounds")
+
+		status, _ = get("/api/v1/trends", url.Values{"sample": {"5"}})
+		assert.Equal(t, 400, status)
+		status, _ = get("/api/v1/segments", url.Values{"sample": {"abc"}})
+		assert.Equal(t, 400, status)
+	})
+}
@@ -0,0 +1,6 @@
+//go:build race
+
+package test
+
+// raceEnabled reports whether the tests run with the race detector, which slows them several times
+const raceEnabled = true
@@ -0,0 +1,132 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestRateLimitTiers tests rate limits decided by the plans billing assigns to users
+func TestRateLimitTiers(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	subscription := func(eventType, userID, plan string, at time.Time) *app.CrossServiceEvent {
+		return &app.CrossServiceEvent{
+			EventType: eventType,
+			UserID:    userID,
+			Timestamp: at,
+			Data:      map[string]interface{}{"plan": plan},
+		}
+	}
+
+	t.Run("Subscriptions", func(t *testing.T) {
+		plans := app.NewPlanService()
+		assert.True(t, plans.ApplySubscription(subscription("billing.user.subscription.created", "user1", "pro", start)))
+		assert.Equal(t, "pro", plans.PlanForUser("user1").Name)
+		assert.Equal(t, 1000, plans.PlanForUser("user1").RateLimit)
+
+		assert.False(t, plans.ApplySubscription(subscription("billing.user.subscription.updated", "user1", "enterprise", start.Add(-time.Minute))),
+			"Events older than the subscription's last change should be ignored")
+		assert.False(t, plans.ApplySubscription(subscription("billing.user.subscription.updated", "user1", "platinum", start.Add(time.Minute))))
+		assert.False(t, plans.ApplySubscription(subscription("billing.payment.completed", "user1", "", start.Add(time.Minute))))
+		assert.Equal(t, "pro", plans.PlanForUser("user1").Name)
+
+		assert.True(t, plans.ApplySubscription(subscription("billing.user.subscription.updated", "user1", "enterprise", start.Add(time.Minute))))
+		assert.Equal(t, "enterprise", plans.PlanForUser("user1").Name)
+		assert.True(t, plans.ApplySubscription(subscription("billing.user.subscription.cancelled", "user1", "", start.Add(2*time.Minute))))
+		assert.Equal(t, "free", plans.PlanForUser("user1").Name, "Cancelled subscriptions should return users to the default plan")
+	})
+
+	t.Run("Limiter", func(t *testing.T) {
+		plans := app.NewPlanService()
+		limiter := app.NewRateLimiter()
+		limiter.SetClock(app.NewFakeClock(start))
+		limiter.SetPlans(plans)
+
+		limit, tier := limiter.UserLimit("user1")
+		assert.Equal(t, 100, limit)
+		assert.Equal(t, "free", tier)
+		assert.NoError(t, plans.SetUserPlan("user1", "pro"))
+		assert.Equal(t, 1000, limiter.Status("user1", "/api").Limit)
+
+		assert.Error(t, limiter.SetUserLimit("user1", 0))
+		assert.NoError(t, limiter.SetUserLimit("user1", 2))
+		allowed, status := limiter.Allow("user1", "/api")
+		assert.True(t, allowed)
+		assert.Equal(t, app.RateLimitStatus{Endpoint: "/api", Limit: 2, Tier: app.RateLimitOverrideTier, Remaining: 1, WindowSeconds: 60, ResetAt: start.Add(time.Minute)}, status)
+		assert.True(t, limiter.AllowRequest("user1", "/api"))
+		assert.False(t, limiter.AllowRequest("user1", "/api"))
+		assert.Equal(t, []app.RateLimitOverride{{UserID: "user1", Limit: 2}}, limiter.Overrides())
+
+		assert.True(t, limiter.ClearUserLimit("user1"))
+		assert.False(t, limiter.ClearUserLimit("user1"))
+		assert.True(t, limiter.AllowRequest("user1", "/api"), "The plan's limit should apply again")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("alice", "admin-token", app.RoleAdmin))
+
+		send := func(userID, method, path, body string) (*http.Response, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-User-ID", userID)
+			req.Header.Set("X-Admin-Token", "admin-token")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp, decoded
+		}
+
+		resp, _ := send("tiered", "GET", "/health", "")
+		assert.Equal(t, "100", resp.Header.Get("X-RateLimit-Limit"))
+		assert.Equal(t, "99", resp.Header.Get("X-RateLimit-Remaining"))
+		assert.NotEmpty(t, resp.Header.Get("X-RateLimit-Reset"))
+		assert.NoError(t, application.GetAnalyticsService().Plans().SetUserPlan("tiered", "pro"))
+		resp, _ = send("tiered", "GET", "/health", "")
+		assert.Equal(t, "1000", resp.Header.Get("X-RateLimit-Limit"))
+
+		resp, _ = send("alice", "PUT", "/api/v1/admin/rate-limits/users/tiered", `{"limit":-1}`)
+		assert.Equal(t, 400, resp.StatusCode)
+		resp, body := send("alice", "PUT", "/api/v1/admin/rate-limits/users/tiered", `{"limit":3}`)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 1000.0, body["previous"])
+		send("tiered", "GET", "/health", "")
+		resp, body = send("tiered", "GET", "/health", "")
+		assert.Equal(t, 429, resp.StatusCode, "The override should apply from the next request")
+		assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+		assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+		assert.Equal(t, app.RateLimitOverrideTier, body["tier"])
+
+		resp, body = send("alice", "GET", "/api/v1/admin/rate-limits/users/tiered?endpoints=/health", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "pro", body["plan"])
+		assert.Equal(t, 3.0, body["limit"])
+		statuses := body["rate_limits"].([]interface{})
+		if assert.Len(t, statuses, 1) {
+			assert.Equal(t, 0.0, statuses[0].(map[string]interface{})["remaining"])
+		}
+		resp, body = send("alice", "GET", "/api/v1/admin/rate-limits", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Len(t, body["tiers"], 3)
+		assert.Equal(t, []interface{}{map[string]interface{}{"user_id": "tiered", "limit": 3.0}}, body["overrides"])
+
+		resp, body = send("alice", "DELETE", "/api/v1/admin/rate-limits/users/tiered", "")
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "pro", body["tier"])
+		resp, _ = send("alice", "DELETE", "/api/v1/admin/rate-limits/users/tiered", "")
+		assert.Equal(t, 404, resp.StatusCode)
+		resp, _ = send("tiered", "GET", "/health", "")
+		assert.Equal(t, 200, resp.StatusCode)
+	})
+}
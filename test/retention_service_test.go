@@ -0,0 +1,210 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestRetentionAnalysis tests N-day retention of the users first seen on each day
+func TestRetentionAnalysis(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	setup := func() (*app.AnalyticsService, *app.RetentionService, func(day int, userID, eventType string, properties map[string]interface{})) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		track := func(day int, userID, eventType string, properties map[string]interface{}) {
+			clock.Set(start.AddDate(0, 0, day).Add(10 * time.Hour))
+			_, err := service.TrackEvent(ctx, map[string]interface{}{
+				"event_type": eventType,
+				"user_id":    userID,
+				"properties": properties,
+			}, "test-key", userID)
+			assert.NoError(t, err)
+		}
+		return service, app.NewRetentionService(service), track
+	}
+
+	t.Run("Cohorts", func(t *testing.T) {
+		_, retention, track := setup()
+		track(-1, "user4", "session_start", nil)
+		for _, day := range []int{0, 1, 7} {
+			track(day, "user1", "session_start", nil)
+		}
+		track(0, "user2", "session_start", nil)
+		track(1, "user3", "session_start", nil)
+		track(2, "user2", "session_start", nil)
+		track(2, "user3", "session_start", nil)
+		track(2, "user4", "session_start", nil)
+		track(8, "user5", "session_start", nil)
+
+		result, err := retention.ComputeRetention(ctx, app.RetentionQuery{
+			Start:     start,
+			End:       start.AddDate(0, 0, 2),
+			EventType: "session_start",
+			Days:      []int{7, 1, 7},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []int{1, 7}, result.Days, "Days should be sorted and deduplicated")
+		assert.Equal(t, int64(3), result.TotalUsers, "Users first seen before the range should be in no cohort")
+		if !assert.Len(t, result.Cohorts, 2) {
+			return
+		}
+
+		first := result.Cohorts[0]
+		assert.Equal(t, "2024-03-01", first.Date)
+		assert.Equal(t, int64(2), first.Users)
+		assert.Equal(t, app.RetentionCell{Day: 1, Users: 1, Rate: 0.5, Complete: true}, first.Retention[0])
+		assert.Equal(t, app.RetentionCell{Day: 7, Users: 1, Rate: 0.5, Complete: true}, first.Retention[1])
+
+		second := result.Cohorts[1]
+		assert.Equal(t, "2024-03-02", second.Date)
+		assert.Equal(t, int64(1), second.Users)
+		assert.Equal(t, app.RetentionCell{Day: 1, Users: 1, Rate: 1, Complete: true}, second.Retention[0])
+		assert.False(t, second.Retention[1].Complete, "Day 7 of the second cohort is not over")
+
+		assert.Equal(t, app.RetentionSummary{Day: 1, Cohorts: 2, Users: 3, Retained: 2, Rate: 2.0 / 3}, result.Summary[0])
+		assert.Equal(t, app.RetentionSummary{Day: 7, Cohorts: 1, Users: 2, Retained: 1, Rate: 0.5}, result.Summary[1], "Incomplete days should not lower the summary")
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		_, retention, track := setup()
+		track(0, "user1", "session_start", nil)
+		track(0, "user1", "signup", map[string]interface{}{"plan": "free"})
+		track(0, "user2", "session_start", nil)
+		track(0, "user2", "signup", map[string]interface{}{"plan": "pro"})
+		track(1, "user1", "purchase", nil)
+		track(1, "user2", "session_start", nil)
+
+		compute := func(query app.RetentionQuery) *app.RetentionResult {
+			query.Start, query.End, query.Days = start, start.AddDate(0, 0, 1), []int{1}
+			result, err := retention.ComputeRetention(ctx, query)
+			assert.NoError(t, err)
+			return result
+		}
+		assert.Equal(t, int64(2), compute(app.RetentionQuery{}).Cohorts[0].Retention[0].Users, "Any event should count when no event type is given")
+		assert.Equal(t, int64(1), compute(app.RetentionQuery{EventType: "session_start"}).Cohorts[0].Retention[0].Users)
+
+		purchases := compute(app.RetentionQuery{EventType: "signup", ReturnEventType: "purchase"})
+		assert.Equal(t, int64(2), purchases.Cohorts[0].Users)
+		assert.Equal(t, int64(1), purchases.Cohorts[0].Retention[0].Users)
+
+		pro := compute(app.RetentionQuery{EventType: "session_start", Segment: &app.RetentionSegment{EventType: "signup", Properties: map[string]interface{}{"plan": "pro"}}})
+		assert.Equal(t, int64(1), pro.TotalUsers)
+		assert.Equal(t, 1.0, pro.Cohorts[0].Retention[0].Rate)
+	})
+
+	t.Run("IdentityMerges", func(t *testing.T) {
+		service, retention, track := setup()
+		track(0, "anon-1", "session_start", nil)
+		track(1, "user1", "session_start", nil)
+
+		compute := func() *app.RetentionResult {
+			result, err := retention.ComputeRetention(ctx, app.RetentionQuery{Start: start, End: start.AddDate(0, 0, 2), Days: []int{1}})
+			assert.NoError(t, err)
+			return result
+		}
+		assert.Equal(t, int64(2), compute().TotalUsers)
+
+		_, err := service.MergeUsers("web", "anon-1", "user1")
+		assert.NoError(t, err)
+		result := compute()
+		assert.Equal(t, int64(1), result.TotalUsers, "Merged IDs should count once")
+		assert.Equal(t, int64(1), result.Cohorts[0].Users)
+		assert.Equal(t, int64(1), result.Cohorts[0].Retention[0].Users, "Events before identifying should be the user's first")
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		_, retention, _ := setup()
+		for _, query := range []app.RetentionQuery{
+			{Start: start, End: start},
+			{Start: start, End: start.AddDate(2, 0, 0)},
+			{Start: start, End: start.AddDate(0, 0, 1), Days: []int{0}},
+			{Start: start, End: start.AddDate(0, 0, 1), Days: []int{366}},
+			{Start: start, End: start.AddDate(0, 0, 1), Segment: &app.RetentionSegment{}},
+		} {
+			_, err := retention.ComputeRetention(ctx, query)
+			assert.Error(t, err, "%+v should be rejected", query)
+		}
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+			"event_type": "signup",
+			"user_id":    "user1",
+			"properties": map[string]interface{}{"plan": "pro"},
+		}, "test-key", "user1")
+		assert.NoError(t, err)
+
+		send := func(path, body string, headers map[string]string) (*http.Response, []byte) {
+			req := httptest.NewRequest("POST", path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Project-ID", "web")
+			for name, value := range headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			data, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp, data
+		}
+		decode := func(data []byte) *app.RetentionResult {
+			var body struct {
+				Result app.RetentionResult `json:"result"`
+			}
+			assert.NoError(t, json.Unmarshal(data, &body))
+			return &body.Result
+		}
+
+		resp, data := send("/api/v1/retention/compute", `{}`, nil)
+		assert.Equal(t, 200, resp.StatusCode)
+		result := decode(data)
+		assert.Equal(t, []int{1, 7, 30}, result.Days)
+		assert.Equal(t, int64(1), result.TotalUsers)
+		if assert.NotEmpty(t, result.Cohorts) {
+			last := result.Cohorts[len(result.Cohorts)-1]
+			assert.Equal(t, int64(1), last.Users)
+			assert.False(t, last.Retention[0].Complete)
+		}
+
+		resp, data = send("/api/v1/queries", `{"name":"Pro","type":"segment","parameters":{"event_type":"signup","properties":{"plan":"pro"}}}`, nil)
+		assert.Equal(t, 200, resp.StatusCode)
+		var created struct {
+			Query app.SavedQuery `json:"query"`
+		}
+		assert.NoError(t, json.Unmarshal(data, &created))
+		resp, data = send("/api/v1/retention/compute", `{"segment_id":"`+created.Query.ID+`"}`, nil)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, int64(1), decode(data).TotalUsers)
+
+		resp, data = send("/api/v1/retention/compute", `{"segment_id":"`+created.Query.ID+`","segment":{"event_type":"signup"}}`, nil)
+		assert.Equal(t, 400, resp.StatusCode)
+		resp, data = send("/api/v1/retention/compute", `{"days":[400]}`, nil)
+		assert.Equal(t, 400, resp.StatusCode)
+		resp, data = send("/api/v1/retention/compute", `{"segment_id":"missing"}`, nil)
+		assert.Equal(t, 400, resp.StatusCode)
+
+		resp, data = send("/api/v1/retention/compute?format=arrow", `{"days":[1]}`, nil)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "application/vnd.apache.arrow.stream", resp.Header.Get("Content-Type"))
+
+		resp, data = send("/api/v1/retention/compute", `{}`, map[string]string{"Prefer": "respond-async"})
+		assert.Equal(t, 202, resp.StatusCode)
+		assert.Contains(t, string(data), `"kind":"retention"`)
+	})
+}
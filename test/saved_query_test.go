@@ -0,0 +1,222 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestQueryService tests ad-hoc trend and segment computation over stored events
+func TestQueryService(t *testing.T) {
+	analyticsService := app.NewAnalyticsService()
+	queryService := app.NewQueryService(analyticsService)
+	ctx := app.ContextWithProject(context.Background(), "shop")
+
+	for _, userID := range []string{"user1", "user2", "user1"} {
+		_, err := analyticsService.TrackEvent(ctx, map[string]interface{}{
+			"event_type": "purchase",
+			"user_id":    userID,
+			"properties": map[string]interface{}{"plan": "pro"},
+		}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	_, err := analyticsService.TrackEvent(ctx, map[string]interface{}{
+		"event_type": "purchase",
+		"user_id":    "user3",
+		"properties": map[string]interface{}{"plan": "free"},
+	}, "test-key", "user3")
+	assert.NoError(t, err)
+
+	t.Run("Trend", func(t *testing.T) {
+		result, err := queryService.ComputeTrend(ctx, app.TrendQuery{
+			EventType: "purchase",
+			Interval:  "hour",
+			Start:     time.Now().Add(-3 * time.Hour),
+			End:       time.Now().Add(time.Minute),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), result.TotalEvents)
+		assert.GreaterOrEqual(t, len(result.Points), 3, "Empty intervals should be reported")
+
+		var busiest app.TrendPoint
+		for _, point := range result.Points {
+			if point.Count > busiest.Count {
+				busiest = point
+			}
+		}
+		assert.Equal(t, int64(4), busiest.Count)
+		assert.Equal(t, int64(3), busiest.UniqueUsers)
+	})
+
+	t.Run("TrendIsScopedToProject", func(t *testing.T) {
+		result, err := queryService.ComputeTrend(context.Background(), app.TrendQuery{
+			EventType: "purchase",
+			Start:     time.Now().Add(-time.Hour),
+			End:       time.Now().Add(time.Minute),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(0), result.TotalEvents)
+	})
+
+	t.Run("InvalidInterval", func(t *testing.T) {
+		_, err := queryService.ComputeTrend(ctx, app.TrendQuery{
+			Interval: "minute",
+			Start:    time.Now().Add(-time.Hour),
+			End:      time.Now(),
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("SegmentWithProperties", func(t *testing.T) {
+		result, err := queryService.ComputeSegment(ctx, app.SegmentQuery{
+			EventType:  "purchase",
+			Properties: map[string]interface{}{"plan": "pro"},
+			Start:      time.Now().Add(-time.Hour),
+			End:        time.Now().Add(time.Minute),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), result.UserCount)
+		assert.Equal(t, int64(3), result.EventCount)
+		assert.Equal(t, []string{"user1", "user2"}, result.Users)
+	})
+}
+
+// TestSavedQueries tests saving, running and sharing query definitions
+func TestSavedQueries(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	savedQueries := application.GetSavedQueryService()
+	ctx := app.ContextWithProject(context.Background(), "shop")
+
+	_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+		"event_type": "signup",
+		"user_id":    "user1",
+	}, "test-key", "user1")
+	assert.NoError(t, err)
+
+	t.Run("CreateAndRun", func(t *testing.T) {
+		query, err := savedQueries.CreateQuery(ctx, "Signups", "Daily signups", app.SavedQueryTrend, map[string]interface{}{
+			"event_type": "signup",
+			"last_days":  float64(7),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "shop", query.ProjectID)
+
+		result, err := savedQueries.RunQuery(ctx, query.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), result.(*app.TrendResult).TotalEvents)
+
+		_, err = savedQueries.GetQuery(context.Background(), query.ID)
+		assert.Error(t, err, "Queries of other projects should not be visible")
+	})
+
+	t.Run("InvalidType", func(t *testing.T) {
+		_, err := savedQueries.CreateQuery(ctx, "Invalid", "", "retention", nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("ShareToken", func(t *testing.T) {
+		query, err := savedQueries.CreateQuery(ctx, "Signups", "", app.SavedQueryTrend, map[string]interface{}{
+			"event_type": "signup",
+		})
+		assert.NoError(t, err)
+
+		token, expiresAt, err := savedQueries.CreateShareToken(ctx, query.ID, time.Hour)
+		assert.NoError(t, err)
+		assert.True(t, expiresAt.After(time.Now()))
+
+		// The shared endpoint needs no credentials besides the token
+		resp, err := application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/shared/"+token, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Query  map[string]interface{} `json:"query"`
+			Result app.TrendResult        `json:"result"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "Signups", body.Query["name"])
+		assert.Nil(t, body.Query["id"], "Shared responses should not expose the query ID")
+		assert.Equal(t, int64(1), body.Result.TotalEvents)
+
+		// Tampered tokens are rejected
+		resp, err = application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/shared/"+strings.Replace(token, ".", "x.", 1), nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		// Revoked tokens are rejected
+		assert.NoError(t, savedQueries.RevokeShareTokens(ctx, query.ID))
+		resp, err = application.GetFiberApp().Test(httptest.NewRequest("GET", "/api/v1/shared/"+token, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("ExpiredShareToken", func(t *testing.T) {
+		application := app.NewApp("8080")
+		start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		clock := app.NewFakeClock(start)
+		application.GetAnalyticsService().SetClock(clock)
+		savedQueries := application.GetSavedQueryService()
+
+		query, err := savedQueries.CreateQuery(ctx, "Signups", "", app.SavedQueryTrend, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, start, query.CreatedAt)
+
+		token, expiresAt, err := savedQueries.CreateShareToken(ctx, query.ID, time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, start.Add(time.Hour), expiresAt)
+
+		clock.Advance(59 * time.Minute)
+		_, err = savedQueries.ResolveShareToken(token)
+		assert.NoError(t, err, "Tokens should be valid until they expire")
+
+		clock.Advance(time.Minute)
+		_, err = savedQueries.ResolveShareToken(token)
+		assert.Error(t, err)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/v1/queries", strings.NewReader(`{"name":"Signup users","type":"segment","parameters":{"event_type":"signup"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var created struct {
+			Query app.SavedQuery `json:"query"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+
+		req = httptest.NewRequest("GET", "/api/v1/queries/"+created.Query.ID+"/run", nil)
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var run struct {
+			Result app.SegmentResult `json:"result"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&run))
+		assert.Equal(t, []string{"user1"}, run.Result.Users)
+
+		req = httptest.NewRequest("POST", "/api/v1/queries/"+created.Query.ID+"/share", strings.NewReader(`{"ttl":"24h"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		req = httptest.NewRequest("DELETE", "/api/v1/queries/"+created.Query.ID, nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode, "Queries can only be deleted within their project")
+	})
+}
@@ -0,0 +1,117 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestSchemaEvolution tests breaking-change detection and the grace period of previous schema versions
+func TestSchemaEvolution(t *testing.T) {
+	t.Run("DetectsBreakingChanges", func(t *testing.T) {
+		schemas := app.NewSchemaValidator()
+		_, err := schemas.UpdateSchema("signup", []string{"event_type", "user_id", "referrer"}, map[string]string{"plan": "string", "seats": "float64"}, 0)
+		assert.NoError(t, err)
+
+		updated, err := schemas.UpdateSchema("signup", []string{"event_type", "user_id", "plan"}, map[string]string{"plan": "string", "seats": "string", "source": "string"}, 1)
+		assert.NoError(t, err)
+		assert.True(t, updated.Breaking)
+
+		changes := make(map[string]app.SchemaChange)
+		for _, change := range updated.Changes {
+			changes[change.Field+":"+change.Change] = change
+		}
+		assert.Equal(t, 4, len(changes))
+		assert.True(t, changes["plan:"+app.SchemaChangeRequiredAdded].Breaking)
+		assert.True(t, changes["referrer:"+app.SchemaChangeRequiredRemoved].Breaking)
+		assert.True(t, changes["seats:"+app.SchemaChangeTypeChanged].Breaking)
+		assert.Equal(t, "float64", changes["seats:"+app.SchemaChangeTypeChanged].Previous)
+		assert.False(t, changes["source:"+app.SchemaChangeTypeAdded].Breaking)
+
+		additive, err := schemas.UpdateSchema("signup", []string{"event_type", "user_id", "plan"}, map[string]string{"plan": "string", "seats": "string", "source": "string", "coupon": "string"}, 2)
+		assert.NoError(t, err)
+		assert.False(t, additive.Breaking)
+		assert.Equal(t, 1, len(additive.Changes))
+	})
+
+	t.Run("KeepsPreviousVersionDuringGracePeriod", func(t *testing.T) {
+		schemas := app.NewSchemaValidator()
+		current, err := schemas.GetSchema("page_view")
+		assert.NoError(t, err)
+
+		updated, err := schemas.UpdateSchema("page_view", []string{"event_type", "user_id", "page"}, current.FieldTypes, current.Version)
+		assert.NoError(t, err)
+		assert.NotNil(t, updated.GracePeriodEnds)
+
+		oldEvent := map[string]interface{}{"event_type": "page_view", "user_id": "user1"}
+		newEvent := map[string]interface{}{"event_type": "page_view", "user_id": "user1", "page": "/home"}
+		assert.NoError(t, schemas.ValidateEvent(oldEvent), "Events valid under the previous version should be accepted during the grace period")
+		assert.NoError(t, schemas.ValidateEvent(newEvent))
+		assert.Error(t, schemas.ValidateEvent(map[string]interface{}{"event_type": "page_view"}))
+
+		versions, err := schemas.SchemaVersions("page_view")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(versions))
+		assert.True(t, versions[0].Current)
+		assert.Equal(t, updated.Version, versions[0].Version)
+		assert.Equal(t, int64(1), versions[0].Validated)
+		assert.Equal(t, int64(2), versions[0].Failed)
+		assert.Equal(t, current.Version, versions[1].Version)
+		assert.NotNil(t, versions[1].ActiveUntil)
+		assert.Equal(t, int64(1), versions[1].Validated, "The previous version should count events still following it")
+		assert.Equal(t, int64(1), versions[1].Failed)
+	})
+
+	t.Run("WithoutGracePeriod", func(t *testing.T) {
+		schemas := app.NewSchemaValidator()
+		assert.NoError(t, schemas.SetGracePeriod(0))
+		assert.Error(t, schemas.SetGracePeriod(-1))
+
+		updated, err := schemas.UpdateSchema("page_view", []string{"event_type", "user_id", "page"}, nil, app.AnyVersion)
+		assert.NoError(t, err)
+		assert.Nil(t, updated.GracePeriodEnds)
+		assert.Error(t, schemas.ValidateEvent(map[string]interface{}{"event_type": "page_view", "user_id": "user1"}))
+
+		versions, err := schemas.SchemaVersions("page_view")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(versions))
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		req := httptest.NewRequest("PUT", "/api/v1/schemas/conversion?dry_run=true", strings.NewReader(`{"required_fields":["event_type","user_id"],"field_types":{"amount":"string"}}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var diff struct {
+			Breaking bool               `json:"breaking"`
+			Changes  []app.SchemaChange `json:"changes"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&diff))
+		assert.True(t, diff.Breaking)
+		assert.NotEmpty(t, diff.Changes)
+
+		schema, err := application.GetAnalyticsService().Schemas().GetSchema("conversion")
+		assert.NoError(t, err)
+		assert.Empty(t, schema.Changes, "A dry run should not update the schema")
+
+		req = httptest.NewRequest("GET", "/api/v1/schemas/conversion/versions", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		req = httptest.NewRequest("GET", "/api/v1/schemas/missing/versions", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 404, resp.StatusCode)
+	})
+}
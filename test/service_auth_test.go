@@ -0,0 +1,250 @@
+package test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// testCertificate is a certificate and key issued for tests, PEM encoded
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issueTestCertificate issues a certificate for the common name, self-signed when issuer is nil
+func issueTestCertificate(t *testing.T, commonName string, issuer *testCertificate, isCA bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// TestServiceAuth tests authenticating internal producers by signed requests and client
+// certificates, and restricting their API keys to authenticated requests
+func TestServiceAuth(t *testing.T) {
+	secret := "0123456789abcdef0123456789abcdef"
+	event := `{"event_type":"page_view","user_id":"user1"}`
+
+	t.Run("SignedRequests", func(t *testing.T) {
+		t.Setenv("SERVICE_SIGNING_KEYS", "pipeline:"+secret+",web-importer:"+secret+":web,weak:short")
+		t.Setenv("SERVICE_API_KEYS", "internal-key")
+
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		now := time.Now().Truncate(time.Second)
+		clock := app.NewFakeClock(now)
+		application.GetServiceAuth().SetClock(clock)
+
+		nonce := 0
+		send := func(apiKey, projectID, keyID, body string, timestamp time.Time, tamper func(*http.Request)) (int, string) {
+			nonce++
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", apiKey)
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", projectID)
+			if keyID != "" {
+				nonce := "nonce-" + strconv.Itoa(nonce) + "-0123456789"
+				req.Header.Set(app.HeaderServiceKeyID, keyID)
+				req.Header.Set(app.HeaderServiceTimestamp, strconv.FormatInt(timestamp.Unix(), 10))
+				req.Header.Set(app.HeaderServiceNonce, nonce)
+				req.Header.Set(app.HeaderServiceSignature, app.SignServiceRequest([]byte(secret), "POST", "/api/v1/analytics/events", timestamp.Unix(), nonce, []byte(body)))
+			}
+			if tamper != nil {
+				tamper(req)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			response, err := io.ReadAll(resp.Body)
+			assert.NoError(t, err)
+			return resp.StatusCode, string(response)
+		}
+
+		status, _ := send("test-key", "web", "", event, now, nil)
+		assert.Equal(t, 200, status, "Unsigned requests should be accepted for other API keys")
+		status, body := send("internal-key", "web", "", event, now, nil)
+		assert.Equal(t, 401, status, "API keys of internal producers should require authentication")
+		assert.Contains(t, body, "must be signed")
+
+		status, _ = send("internal-key", "web", "pipeline", event, now, nil)
+		assert.Equal(t, 200, status)
+
+		var replayed *http.Request
+		status, _ = send("internal-key", "web", "pipeline", event, now, func(req *http.Request) { replayed = req.Clone(context.Background()) })
+		assert.Equal(t, 200, status)
+		replayed.Body = io.NopCloser(strings.NewReader(event))
+		resp, err := application.GetFiberApp().Test(replayed)
+		assert.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode, "Replayed requests should be rejected")
+
+		status, body = send("internal-key", "web", "pipeline", `{"event_type":"purchase","user_id":"user1"}`, now, func(req *http.Request) {
+			req.Body = io.NopCloser(strings.NewReader(`{"event_type":"refund","user_id":"user1"}`))
+			req.ContentLength = int64(len(`{"event_type":"refund","user_id":"user1"}`))
+		})
+		assert.Equal(t, 401, status, "Tampered bodies should be rejected")
+		assert.Contains(t, body, "invalid request signature")
+
+		status, body = send("internal-key", "web", "pipeline", event, now.Add(-10*time.Minute), nil)
+		assert.Equal(t, 401, status)
+		assert.Contains(t, body, "clock skew")
+		clock.Advance(4 * time.Minute)
+		status, _ = send("internal-key", "web", "pipeline", event, now, nil)
+		assert.Equal(t, 200, status, "Timestamps within the allowed skew should be accepted")
+
+		status, body = send("internal-key", "web", "weak", event, now, nil)
+		assert.Equal(t, 401, status, "Keys with short secrets should be ignored")
+		assert.Contains(t, body, "unknown service key")
+		status, _ = send("internal-key", "web", "pipeline", event, now, func(req *http.Request) { req.Header.Set(app.HeaderServiceNonce, "short") })
+		assert.Equal(t, 401, status)
+
+		status, _ = send("internal-key", "shop", "web-importer", event, now, nil)
+		assert.Equal(t, 403, status, "Keys bound to a project should not submit events to others")
+		status, _ = send("internal-key", "web", "web-importer", event, now, nil)
+		assert.Equal(t, 200, status)
+
+		assert.Equal(t, 5, application.GetServiceAuth().Nonces().Len())
+	})
+
+	t.Run("RequiredForEverySubmission", func(t *testing.T) {
+		t.Setenv("SERVICE_AUTH_REQUIRED", "true")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(event))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "user1")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+	})
+
+	t.Run("MutualTLS", func(t *testing.T) {
+		ca := issueTestCertificate(t, "internal-ca", nil, true)
+		server := issueTestCertificate(t, "analytics", ca, false)
+		client := issueTestCertificate(t, "pipeline", ca, false)
+		untrusted := issueTestCertificate(t, "pipeline", issueTestCertificate(t, "other-ca", nil, true), false)
+
+		dir := t.TempDir()
+		write := func(name string, content []byte) string {
+			path := filepath.Join(dir, name)
+			assert.NoError(t, os.WriteFile(path, content, 0600))
+			return path
+		}
+		t.Setenv("TLS_CERT_FILE", write("server.pem", server.certPEM))
+		t.Setenv("TLS_KEY_FILE", write("server-key.pem", server.keyPEM))
+		t.Setenv("TLS_CLIENT_CA_FILE", write("ca.pem", ca.certPEM))
+		t.Setenv("SERVICE_API_KEYS", "internal-key")
+
+		t.Setenv("TLS_CLIENT_AUTH", "always")
+		_, err := app.LoadServerTLSConfig()
+		assert.Error(t, err)
+		t.Setenv("TLS_CLIENT_AUTH", "require")
+		config, err := app.LoadServerTLSConfig()
+		assert.NoError(t, err)
+		assert.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+		t.Setenv("TLS_CLIENT_AUTH", "")
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+		assert.NoError(t, listener.Close())
+
+		application := app.NewApp(port)
+		application.SetupRoutes()
+		defer application.Stop()
+		go func() {
+			_ = application.Start(context.Background())
+		}()
+		defer func() {
+			_ = application.GetFiberApp().Shutdown()
+		}()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		post := func(certificate *testCertificate, apiKey string) (int, error) {
+			config := &tls.Config{RootCAs: roots}
+			if certificate != nil {
+				pair, err := tls.X509KeyPair(certificate.certPEM, certificate.keyPEM)
+				assert.NoError(t, err)
+				config.Certificates = []tls.Certificate{pair}
+			}
+			httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: 5 * time.Second}
+			req, err := http.NewRequest("POST", "https://127.0.0.1:"+port+"/api/v1/analytics/events", strings.NewReader(event))
+			assert.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", apiKey)
+			req.Header.Set("X-User-ID", "user1")
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				return 0, err
+			}
+			defer resp.Body.Close()
+			return resp.StatusCode, nil
+		}
+
+		assert.Eventually(t, func() bool {
+			status, err := post(nil, "test-key")
+			return err == nil && status == 200
+		}, 5*time.Second, 20*time.Millisecond, "Clients without a certificate should be served")
+
+		status, err := post(nil, "internal-key")
+		assert.NoError(t, err)
+		assert.Equal(t, 401, status)
+		status, err = post(client, "internal-key")
+		assert.NoError(t, err)
+		assert.Equal(t, 200, status, "Producers with a verified certificate should be authenticated")
+		status, err = post(untrusted, "internal-key")
+		assert.True(t, err != nil || status == 401, "Certificates of other CAs should not authenticate producers")
+	})
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestSessionContext tests merging the context of web sessions into the server-side events
+// sharing their session ID when events are read
+func TestSessionContext(t *testing.T) {
+	service := app.NewAnalyticsService()
+	ctx := app.ContextWithProject(context.Background(), "shop")
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	track := func(eventType, sessionID string, at time.Time, properties map[string]interface{}) {
+		data := map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    "user1",
+			"timestamp":  at.Format(time.RFC3339),
+			"properties": properties,
+		}
+		if sessionID != "" {
+			data["session_id"] = sessionID
+		}
+		_, err := service.TrackEvent(ctx, data, "test-key", "user1")
+		assert.NoError(t, err)
+	}
+
+	// The server-side purchase arrives before a later web page view of the same session
+	track("purchase", "sess-web-1", start.Add(2*time.Minute), map[string]interface{}{"amount": 10.0, "device": "server"})
+	track("page_view", "sess-web-1", start, map[string]interface{}{"referrer": "https://news.example.com", "utm_source": "newsletter", "device": "mobile"})
+	track("page_view", "sess-web-1", start.Add(time.Minute), map[string]interface{}{"utm_source": "retargeting", "utm_campaign": "spring"})
+	track("purchase", "", start.Add(3*time.Minute), map[string]interface{}{"amount": 5.0})
+
+	purchases := service.QueryEvents(ctx, app.EventFilter{ProjectID: "shop", EventType: "purchase"})
+	if !assert.Len(t, purchases, 2) {
+		return
+	}
+
+	t.Run("InheritsFirstTouchContext", func(t *testing.T) {
+		purchase := purchases[0]
+		assert.Equal(t, "sess-web-1", purchase.SessionID)
+		assert.Equal(t, "https://news.example.com", purchase.Properties["referrer"])
+		assert.Equal(t, "newsletter", purchase.Properties["utm_source"], "The session's first value should be inherited")
+		assert.Equal(t, "spring", purchase.Properties["utm_campaign"])
+		assert.Equal(t, "server", purchase.Properties["device"], "Properties of the event itself should be kept")
+		assert.Equal(t, []string{"referrer", "utm_campaign", "utm_source"}, purchase.InheritedProperties)
+	})
+
+	t.Run("KeepsEventsOwnContext", func(t *testing.T) {
+		assert.Empty(t, purchases[1].SessionID, "Generated session IDs should not be stored")
+		assert.Nil(t, purchases[1].InheritedProperties)
+		assert.NotContains(t, purchases[1].Properties, "utm_source")
+
+		// Web events of the session keep their own context
+		pageViews := service.QueryEvents(ctx, app.EventFilter{ProjectID: "shop", EventType: "page_view"})
+		if assert.Len(t, pageViews, 2) {
+			assert.Equal(t, []string{"utm_campaign"}, pageViews[0].InheritedProperties)
+			assert.Equal(t, "retargeting", pageViews[1].Properties["utm_source"])
+			assert.Equal(t, []string{"device", "referrer"}, pageViews[1].InheritedProperties)
+		}
+
+		// Filtering out the web events does not lose their context
+		again := service.QueryEvents(ctx, app.EventFilter{ProjectID: "shop", EventType: "purchase", Start: start, End: start.Add(150 * time.Second)})
+		if assert.Len(t, again, 1) {
+			assert.Equal(t, 10.0, again[0].Properties["amount"])
+			assert.Len(t, again[0].InheritedProperties, 3)
+		}
+
+		// Sessions are scoped to their project
+		other := service.QueryEvents(app.ContextWithProject(context.Background(), "other"), app.EventFilter{ProjectID: "other"})
+		assert.Empty(t, other)
+	})
+
+	t.Run("SegmentsOnInheritedProperties", func(t *testing.T) {
+		queries := app.NewQueryService(service)
+		result, err := queries.ComputeSegment(ctx, app.SegmentQuery{
+			EventType:  "purchase",
+			Properties: map[string]interface{}{"utm_source": "newsletter"},
+			Start:      start.Add(-time.Minute),
+			End:        start.Add(time.Hour),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), result.EventCount)
+		assert.Equal(t, []string{"user1"}, result.Users)
+	})
+}
@@ -0,0 +1,141 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestSessionQuality tests scoring sessions by depth, duration, conversions and rage clicks, and
+// the session quality report
+func TestSessionQuality(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	quality := application.GetSessionQuality()
+	ctx := app.ContextWithProject(context.Background(), "shop")
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	track := func(eventType, userID, sessionID, page string, at time.Time, properties map[string]interface{}) {
+		_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+			"session_id": sessionID,
+			"page":       page,
+			"timestamp":  at.Format(time.RFC3339),
+			"properties": properties,
+		}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+
+	// A deep, long and converting session
+	for i, page := range []string{"/a", "/b", "/c", "/d", "/e"} {
+		track("page_view", "user1", "engaged", page, start.Add(time.Duration(i)*time.Minute), map[string]interface{}{"utm_source": "google"})
+	}
+	track("purchase", "user1", "engaged", "/e", start.Add(5*time.Minute), nil)
+	// A bounce
+	track("page_view", "user2", "bounce", "/a", start, map[string]interface{}{"utm_source": "ads"})
+	// A long session with a rage click
+	track("page_view", "user3", "frustrated", "/a", start, map[string]interface{}{"utm_source": "ads"})
+	for i := 0; i < 3; i++ {
+		track("click", "user3", "frustrated", "/a", start.Add(time.Minute), map[string]interface{}{"x": 100.0, "y": 200.0})
+	}
+	track("page_view", "user3", "frustrated", "/b", start.Add(10*time.Minute), nil)
+	// Events without a session are not scored
+	track("page_view", "user4", "", "/a", start, nil)
+
+	report := func() *app.SessionQualityReport {
+		report, err := quality.Report(ctx, app.SessionQualityQuery{Start: start.Add(-time.Minute), End: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		return report
+	}
+	scores := func(report *app.SessionQualityReport) map[string]app.SessionScore {
+		scores := make(map[string]app.SessionScore)
+		for _, session := range report.Lowest {
+			scores[session.SessionID] = session.SessionScore
+		}
+		return scores
+	}
+
+	t.Run("Scores", func(t *testing.T) {
+		scores := scores(report())
+		assert.Equal(t, app.SessionScore{Score: 100, Pages: 5, Conversions: 1}, scores["engaged"])
+		assert.Equal(t, app.SessionScore{Score: 6, Pages: 1}, scores["bounce"])
+		assert.Equal(t, app.SessionScore{Score: 32, Pages: 2, RageClicks: 1}, scores["frustrated"], "Each rage click should cost 10 points")
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		report := report()
+		assert.Equal(t, 3, report.Sessions)
+		assert.Equal(t, 46.0, report.AverageScore)
+		assert.Equal(t, 32.0, report.MedianScore)
+		if assert.Len(t, report.Lowest, 3) {
+			assert.Equal(t, "bounce", report.Lowest[0].SessionID)
+			assert.Equal(t, "user2", report.Lowest[0].UserID)
+		}
+		var distribution []int
+		for _, bucket := range report.Distribution {
+			distribution = append(distribution, bucket.Sessions)
+		}
+		assert.Equal(t, []int{1, 1, 0, 0, 1}, distribution, "Perfect scores should fall in the last bucket")
+		assert.Equal(t, []app.SessionQualitySource{
+			{Source: "ads", Sessions: 2, AverageScore: 19},
+			{Source: "google", Sessions: 1, AverageScore: 100},
+		}, report.Sources)
+
+		_, err := quality.Report(ctx, app.SessionQualityQuery{Start: start, End: start})
+		assert.Error(t, err)
+	})
+
+	t.Run("Weights", func(t *testing.T) {
+		defer quality.SetWeights(map[string]float64{"rage_clicks": 0.1, "conversions": 0.4})
+		assert.NoError(t, quality.SetWeights(map[string]float64{"rage_clicks": 0, "conversions": 0}))
+		assert.Equal(t, 0.3, quality.Weights()["depth"], "Weights not given should be kept")
+		scores := scores(report())
+		assert.Equal(t, 100.0, scores["engaged"].Score)
+		assert.Equal(t, 70.0, scores["frustrated"].Score)
+
+		assert.Error(t, quality.SetWeights(map[string]float64{"bounces": 1}))
+		assert.Error(t, quality.SetWeights(map[string]float64{"depth": -1}))
+		assert.Error(t, quality.SetWeights(map[string]float64{"depth": 0, "duration": 0}))
+		assert.Equal(t, 0.3, quality.Weights()["duration"], "Rejected weights should not apply")
+
+		_, _, err := application.GetRuntimeSettings().Update("sessions.quality_weights", map[string]interface{}{"depth": 1.0}, app.AnyVersion)
+		assert.NoError(t, err)
+		assert.Equal(t, 1.0, quality.Weights()["depth"])
+	})
+
+	t.Run("TimelineSessions", func(t *testing.T) {
+		page, err := application.GetUserTimeline().Query(ctx, app.TimelineQuery{UserID: "user3", Order: app.TimelineOldestFirst, Limit: 10})
+		assert.NoError(t, err)
+		if assert.NotNil(t, page.Entries[0].Session) && assert.NotNil(t, page.Entries[0].Session.Quality) {
+			assert.Equal(t, 1, page.Entries[0].Session.Quality.RageClicks)
+		}
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/sessions/quality?limit=1&start_date="+start.Format("2006-01-02"), nil)
+		req.Header.Set("X-Project-ID", "shop")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		if assert.Equal(t, 200, resp.StatusCode) {
+			var body struct {
+				Report app.SessionQualityReport `json:"report"`
+			}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			assert.Equal(t, 3, body.Report.Sessions)
+			assert.Len(t, body.Report.Lowest, 1)
+		}
+
+		req = httptest.NewRequest("GET", "/api/v1/sessions/quality?start_date=yesterday", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
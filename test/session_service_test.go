@@ -0,0 +1,175 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestSessions tests stitching events into sessions and the session stats
+func TestSessions(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	ctx := app.ContextWithProject(context.Background(), "web")
+
+	setup := func() (*app.AnalyticsService, *app.SessionService, func(at time.Duration, userID, page, sessionID string)) {
+		service := app.NewAnalyticsService()
+		clock := app.NewFakeClock(start)
+		service.SetClock(clock)
+		track := func(at time.Duration, userID, page, sessionID string) {
+			clock.Set(start.Add(at))
+			event := map[string]interface{}{
+				"event_type": "page_view",
+				"user_id":    userID,
+				"page":       page,
+			}
+			if sessionID != "" {
+				event["session_id"] = sessionID
+			}
+			_, err := service.TrackEvent(ctx, event, "test-key", userID)
+			assert.NoError(t, err)
+		}
+		return service, app.NewSessionService(service), track
+	}
+	day := app.SessionQuery{Start: start.Add(-time.Hour), End: start.Add(23 * time.Hour)}
+
+	t.Run("Stitching", func(t *testing.T) {
+		_, sessions, track := setup()
+		track(0, "user1", "/", "")
+		track(5*time.Minute, "user1", "/pricing", "")
+		track(10*time.Minute, "user1", "/checkout", "")
+		track(2*time.Hour, "user1", "/", "") // After the inactivity timeout
+		track(3*time.Hour, "user2", "/blog", "s-1")
+		track(3*time.Hour+time.Minute, "user2", "/blog/post", "s-2") // New client session
+		track(3*time.Hour+2*time.Minute, "user2", "/about", "")
+
+		list, err := sessions.Sessions(ctx, day)
+		assert.NoError(t, err)
+		if !assert.Len(t, list.Sessions, 4) {
+			return
+		}
+
+		first := list.Sessions[3]
+		assert.Equal(t, "user1", first.UserID)
+		assert.Equal(t, start, first.Start)
+		assert.Equal(t, 600.0, first.DurationSeconds)
+		assert.Equal(t, 3, first.PageCount)
+		assert.Equal(t, "/", first.EntryPage)
+		assert.Equal(t, "/checkout", first.ExitPage)
+		assert.False(t, first.Bounce)
+		assert.True(t, list.Sessions[2].Bounce, "A session with one page should bounce")
+
+		latest := list.Sessions[0]
+		assert.Equal(t, "s-2", latest.ClientSessionID)
+		assert.Equal(t, 2, latest.EventCount, "Events without a session ID should continue the current session")
+		assert.Equal(t, "/about", latest.ExitPage)
+
+		assert.Equal(t, 4, list.Stats.Sessions)
+		assert.Equal(t, 2, list.Stats.Users)
+		assert.Equal(t, 50.0, list.Stats.BounceRate)
+		assert.Equal(t, 1.75, list.Stats.AveragePageCount)
+		assert.Equal(t, start, *list.Stats.FirstSession)
+
+		again, err := sessions.Sessions(ctx, day)
+		assert.NoError(t, err)
+		assert.Equal(t, list.Sessions[0].ID, again.Sessions[0].ID, "Session IDs should be stable across reads")
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		_, sessions, track := setup()
+		track(-10*time.Minute, "user1", "/", "")
+		track(10*time.Minute, "user1", "/pricing", "")
+		track(2*time.Hour, "user1", "/", "")
+
+		list, err := sessions.Sessions(ctx, app.SessionQuery{Start: start, End: start.Add(time.Hour), Limit: 1})
+		assert.NoError(t, err)
+		assert.Empty(t, list.Sessions, "Sessions started before the range should not be listed or split")
+
+		list, err = sessions.Sessions(ctx, app.SessionQuery{Start: start, End: start.Add(3 * time.Hour), Limit: 1})
+		assert.NoError(t, err)
+		assert.Len(t, list.Sessions, 1)
+		assert.False(t, list.Truncated)
+
+		_, err = sessions.Sessions(ctx, app.SessionQuery{Start: start, End: start})
+		assert.Error(t, err)
+		_, err = sessions.Sessions(ctx, app.SessionQuery{Start: start, End: start.Add(time.Hour), Limit: 5000})
+		assert.Error(t, err)
+	})
+
+	t.Run("UserStats", func(t *testing.T) {
+		service, sessions, track := setup()
+		track(0, "anon", "/", "")
+		track(time.Minute, "anon", "/signup", "")
+		_, err := service.MergeUsers("web", "anon", "user1")
+		assert.NoError(t, err)
+		track(2*time.Minute, "user1", "/welcome", "")
+		track(3*time.Hour, "user1", "/", "")
+		track(3*time.Hour, "user2", "/", "")
+
+		list, err := sessions.Sessions(ctx, app.SessionQuery{Start: day.Start, End: day.End, UserID: "anon", Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, "user1", list.UserID)
+		assert.Len(t, list.Sessions, 1)
+		assert.True(t, list.Truncated)
+		assert.Equal(t, 2, list.Stats.Sessions, "Events of merged users should be stitched into one session")
+		assert.Equal(t, 1, list.Stats.Users)
+		assert.Equal(t, 60.0, list.Stats.AverageDurationSeconds)
+		assert.Equal(t, 50.0, list.Stats.BounceRate)
+		assert.Equal(t, start.Add(3*time.Hour), *list.Stats.LastSession)
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		for _, page := range []string{"/", "/pricing"} {
+			body := `{"event_type":"page_view","user_id":"user1","page":"` + page + `"}`
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Project-ID", "sessions")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-API-Key", "test-key")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			assert.Equal(t, 200, resp.StatusCode)
+		}
+
+		get := func(path string) (int, map[string]interface{}) {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("X-Project-ID", "sessions")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var body map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&body)
+			return resp.StatusCode, body
+		}
+
+		status, body := get("/api/v1/sessions")
+		assert.Equal(t, 200, status)
+		result := body["result"].(map[string]interface{})
+		sessions := result["sessions"].([]interface{})
+		if assert.Len(t, sessions, 1) {
+			assert.Equal(t, 2.0, sessions[0].(map[string]interface{})["page_count"])
+		}
+
+		status, body = get("/api/v1/users/user1/sessions")
+		assert.Equal(t, 200, status)
+		stats := body["result"].(map[string]interface{})["stats"].(map[string]interface{})
+		assert.Equal(t, 1.0, stats["sessions"])
+		assert.Equal(t, 0.0, stats["bounce_rate"])
+
+		status, body = get("/api/v1/users/user2/sessions")
+		assert.Equal(t, 200, status)
+		assert.Empty(t, body["result"].(map[string]interface{})["sessions"])
+
+		status, _ = get("/api/v1/sessions?start_date=yesterday")
+		assert.Equal(t, 400, status)
+	})
+}
@@ -0,0 +1,274 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// siemCollector is an HTTPS collector recording the security events posted to it
+type siemCollector struct {
+	server   *httptest.Server
+	failures int // Requests to fail before accepting events
+	events   []map[string]interface{}
+	headers  []http.Header
+	mutex    sync.Mutex
+}
+
+func newSIEMCollector(failures int) *siemCollector {
+	collector := &siemCollector{failures: failures}
+	collector.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collector.mutex.Lock()
+		defer collector.mutex.Unlock()
+		if collector.failures > 0 {
+			collector.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		collector.events = append(collector.events, event)
+		collector.headers = append(collector.headers, r.Header.Clone())
+	}))
+	return collector
+}
+
+func (c *siemCollector) received() []map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]map[string]interface{}{}, c.events...)
+}
+
+// TestSIEMExport tests streaming audit entries, rejected tokens and data exports to a SIEM over
+// HTTPS and syslog, as JSON and CEF
+func TestSIEMExport(t *testing.T) {
+	t.Run("DisabledByDefault", func(t *testing.T) {
+		exporter := app.NewSIEMExporter()
+		assert.False(t, exporter.Enabled())
+		exporter.Export(app.SecurityEvent{Category: app.SecurityAdmin, Action: "update"})
+		assert.False(t, exporter.Stats().Enabled)
+		exporter.Stop()
+	})
+
+	t.Run("RejectsInvalidConfiguration", func(t *testing.T) {
+		for _, env := range []map[string]string{
+			{"SIEM_ENDPOINT": "ftp://siem.example.com"},
+			{"SIEM_ENDPOINT": "syslog+tcp://siem.example.com"},
+			{"SIEM_ENDPOINT": "https://siem.example.com", "SIEM_FORMAT": "xml"},
+			{"SIEM_ENDPOINT": "https://siem.example.com", "SIEM_CATEGORIES": "auth,billing"},
+		} {
+			for name, value := range env {
+				t.Setenv(name, value)
+			}
+			exporter := app.NewSIEMExporter()
+			assert.False(t, exporter.Enabled(), env)
+			t.Setenv("SIEM_FORMAT", "")
+			t.Setenv("SIEM_CATEGORIES", "")
+		}
+	})
+
+	t.Run("StreamsSecurityEventsOverHTTPS", func(t *testing.T) {
+		collector := newSIEMCollector(0)
+		defer collector.server.Close()
+		t.Setenv("SIEM_ENDPOINT", collector.server.URL+"/ingest")
+		t.Setenv("SIEM_TOKEN", "siem-secret")
+
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+		send := func(method, path, token string) int {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			if token != "" {
+				req.Header.Set("X-Admin-Token", token)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		application.GetAuditLog().Record("ops", "runtime_setting.update", "tracking_pool_size", map[string]interface{}{"value": 32})
+		assert.Equal(t, 401, send("GET", "/api/v1/admin/faults", "stolen-token"))
+		assert.Equal(t, 403, send("PUT", "/api/v1/admin/faults/billing", "viewer-token"))
+		assert.Equal(t, 401, send("GET", "/api/v1/shared/unknown-token", ""))
+		assert.Equal(t, 200, send("GET", "/api/v1/projects/web/config", ""))
+
+		assert.Equal(t, 200, send("GET", "/api/v1/admin/siem", "viewer-token"))
+		application.Stop()
+
+		events := collector.received()
+		if !assert.Equal(t, 5, len(events)) {
+			return
+		}
+		for i, event := range events {
+			assert.Equal(t, float64(i+1), event["sequence"], "Events should be sent in order")
+			assert.NotEmpty(t, event["id"])
+		}
+		assert.Equal(t, "Bearer siem-secret", collector.headers[0].Get("Authorization"))
+
+		assert.Equal(t, "admin", events[0]["category"])
+		assert.Equal(t, "runtime_setting.update", events[0]["action"])
+		assert.Equal(t, "ops", events[0]["actor"])
+		assert.Equal(t, float64(32), events[0]["details"].(map[string]interface{})["value"])
+
+		assert.Equal(t, "auth", events[1]["category"])
+		assert.Equal(t, "admin_token_invalid", events[1]["action"])
+		assert.Equal(t, "denied", events[1]["outcome"])
+		assert.Equal(t, "/api/v1/admin/faults", events[1]["resource"])
+		assert.NotEmpty(t, events[1]["source_ip"])
+		assert.NotContains(t, events[1], "details", "Rejected tokens should not be exported")
+
+		assert.Equal(t, "admin_role_insufficient", events[2]["action"])
+		assert.Equal(t, "viewer", events[2]["details"].(map[string]interface{})["actor"])
+		assert.Equal(t, "share_token_rejected", events[3]["action"])
+		assert.Equal(t, "/api/v1/shared/:token", events[3]["resource"], "Rejected tokens should not be exported")
+		assert.Equal(t, "export", events[4]["category"])
+		assert.Equal(t, "project_config_exported", events[4]["action"])
+		assert.Equal(t, "user1", events[4]["actor"])
+	})
+
+	t.Run("FiltersCategories", func(t *testing.T) {
+		collector := newSIEMCollector(0)
+		defer collector.server.Close()
+		t.Setenv("SIEM_ENDPOINT", collector.server.URL)
+		t.Setenv("SIEM_CATEGORIES", "auth")
+
+		exporter := app.NewSIEMExporter()
+		exporter.Export(app.SecurityEvent{Category: app.SecurityAdmin, Action: "runtime_setting.update"})
+		exporter.Export(app.SecurityEvent{Category: app.SecurityAuth, Action: "admin_token_invalid"})
+		exporter.Stop()
+
+		events := collector.received()
+		assert.Equal(t, 1, len(events))
+		assert.Equal(t, "admin_token_invalid", events[0]["action"])
+		assert.Equal(t, []string{"auth"}, exporter.Stats().Categories)
+	})
+
+	t.Run("RetriesFailedDeliveries", func(t *testing.T) {
+		collector := newSIEMCollector(2)
+		defer collector.server.Close()
+		t.Setenv("SIEM_ENDPOINT", collector.server.URL)
+		t.Setenv("SIEM_RETRY_DELAY", "1ms")
+		t.Setenv("SIEM_MAX_RETRIES", "2")
+
+		exporter := app.NewSIEMExporter()
+		exporter.Export(app.SecurityEvent{Category: app.SecurityAuth, Action: "admin_token_invalid"})
+		assert.Eventually(t, func() bool { return exporter.Stats().Sent == 1 }, time.Second, 5*time.Millisecond)
+
+		collector.mutex.Lock()
+		collector.failures = 3
+		collector.mutex.Unlock()
+		exporter.Export(app.SecurityEvent{Category: app.SecurityAuth, Action: "share_token_rejected"})
+		assert.Eventually(t, func() bool { return exporter.Stats().Failed == 1 }, time.Second, 5*time.Millisecond)
+		exporter.Stop()
+
+		stats := exporter.Stats()
+		assert.Equal(t, int64(1), stats.Sent)
+		assert.Contains(t, stats.LastError, "status 503")
+		assert.NotNil(t, stats.LastErrorAt)
+		assert.Equal(t, 1, len(collector.received()))
+
+		var metrics strings.Builder
+		assert.NoError(t, exporter.WriteMetrics(&metrics))
+		assert.Contains(t, metrics.String(), `analytics_siem_events_total{outcome="failed"} 1`)
+	})
+
+	t.Run("SendsCEFOverSyslogTCP", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer listener.Close()
+		t.Setenv("SIEM_ENDPOINT", "syslog+tcp://"+listener.Addr().String())
+		t.Setenv("SIEM_FORMAT", "cef")
+
+		messages := make(chan string, 2)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				// Messages are framed by their length in octets
+				length, err := reader.ReadString(' ')
+				if err != nil {
+					return
+				}
+				size, err := strconv.Atoi(strings.TrimSpace(length))
+				if err != nil {
+					return
+				}
+				message := make([]byte, size)
+				if _, err := io.ReadFull(reader, message); err != nil {
+					return
+				}
+				messages <- string(message)
+			}
+		}()
+
+		exporter := app.NewSIEMExporter()
+		exporter.Export(app.SecurityEvent{
+			Timestamp: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+			Category:  app.SecurityAuth,
+			Action:    "admin|token_invalid",
+			Outcome:   app.OutcomeDenied,
+			Severity:  7,
+			Actor:     "anonymous",
+			Resource:  "/api/v1/admin/faults",
+			SourceIP:  "10.0.0.1",
+			Details:   map[string]interface{}{"reason": "a=b"},
+		})
+		exporter.Export(app.SecurityEvent{Category: app.SecurityExport, Action: "project_config_exported", Severity: 3})
+
+		first := <-messages
+		assert.True(t, strings.HasPrefix(first, "<108>1 2024-03-01T12:00:00Z "), first)
+		assert.Contains(t, first, " analytics - auth - CEF:0|Magebase|Analytics|1|admin\\|token_invalid|admin\\|token_invalid|7|rt=1709294400000 ")
+		assert.Contains(t, first, "outcome=denied cn1Label=sequence cn1=1 suser=anonymous src=10.0.0.1 cs1Label=resource cs1=/api/v1/admin/faults")
+		assert.Contains(t, first, `msg={"reason":"a\=b"}`)
+
+		second := <-messages
+		assert.True(t, strings.HasPrefix(second, "<110>1 "), "Low severity events should be informational")
+		assert.Contains(t, second, "cn1=2")
+		exporter.Stop()
+	})
+
+	t.Run("SendsJSONOverSyslogUDP", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer conn.Close()
+		t.Setenv("SIEM_ENDPOINT", "syslog+udp://"+conn.LocalAddr().String())
+
+		exporter := app.NewSIEMExporter()
+		exporter.Export(app.SecurityEvent{Category: app.SecurityAdmin, Action: "user_plan.update", Severity: 5, Actor: "ops"})
+		defer exporter.Stop()
+
+		buffer := make([]byte, 4096)
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := conn.ReadFrom(buffer)
+		assert.NoError(t, err)
+		message := string(buffer[:n])
+		assert.True(t, strings.HasPrefix(message, "<109>1 "), message)
+
+		var event map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(message[strings.Index(message, "{"):]), &event))
+		assert.Equal(t, "user_plan.update", event["action"])
+		assert.Equal(t, "ops", event["actor"])
+	})
+}
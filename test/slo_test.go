@@ -0,0 +1,170 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestSLOTracker tests error budgets and burn rate alerts of the ingestion objectives
+func TestSLOTracker(t *testing.T) {
+	t.Setenv("SLO_INGESTION_AVAILABILITY", "0.99")
+	t.Setenv("SLO_INGESTION_LATENCY", "0.99")
+	t.Setenv("SLO_INGESTION_LATENCY_THRESHOLD", "200ms")
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	record := func(tracker *app.SLOTracker, at time.Time, count, status int, responseTimeMs int64) {
+		for i := 0; i < count; i++ {
+			tracker.Record(&app.APIUsageRecord{
+				Method:         "POST",
+				Route:          "/api/v1/analytics/events",
+				StatusCode:     status,
+				ResponseTimeMs: responseTimeMs,
+				Timestamp:      at,
+			})
+		}
+	}
+	slo := func(report *app.SLOReport, name string) app.SLOStatus {
+		for _, status := range report.SLOs {
+			if status.Name == name {
+				return status
+			}
+		}
+		t.Fatalf("objective %s not reported", name)
+		return app.SLOStatus{}
+	}
+
+	t.Run("ErrorBudgets", func(t *testing.T) {
+		tracker := app.NewSLOTracker()
+		clock := app.NewFakeClock(start)
+		tracker.SetClock(clock)
+		clock.Advance(3 * time.Hour)
+
+		earlier := start.Add(time.Hour)
+		record(tracker, earlier, 960, 200, 50)
+		record(tracker, earlier, 30, 202, 500)
+		record(tracker, earlier, 10, 503, 10)
+		tracker.Record(&app.APIUsageRecord{Method: "GET", Route: "/api/v1/analytics/usage", StatusCode: 500, Timestamp: earlier})
+		record(tracker, start.Add(-31*24*time.Hour), 100, 500, 10)
+
+		report := tracker.Report()
+		assert.Equal(t, "720h0m0s", report.Window)
+		assert.Equal(t, []string{"POST /api/v1/analytics/events", "POST /api/v1/analytics/mobile/batch"}, report.Routes)
+		assert.False(t, report.WindowFullyTracked)
+
+		availability := slo(report, app.SLOIngestionAvailability)
+		assert.Equal(t, int64(1000), availability.Requests, "Other routes and requests past the window should not count")
+		assert.Equal(t, int64(10), availability.BadRequests)
+		assert.InDelta(t, 0.99, availability.SLI, 1e-9)
+		assert.InDelta(t, 10, availability.ErrorBudget, 1e-9)
+		assert.InDelta(t, 0, availability.ErrorBudgetRemaining, 1e-9)
+
+		latency := slo(report, app.SLOIngestionLatency)
+		assert.Equal(t, int64(200), latency.LatencyThresholdMs)
+		assert.Equal(t, int64(990), latency.Requests, "Server errors should only count against availability")
+		assert.Equal(t, int64(30), latency.BadRequests)
+		assert.Less(t, latency.ErrorBudgetRemaining, 0.0, "Overspent budgets should go negative")
+
+		assert.Equal(t, 0.0, availability.BurnRates["1h0m0s"], "The requests are older than the alert windows")
+		assert.Empty(t, report.Firing)
+	})
+
+	t.Run("BurnRateAlerts", func(t *testing.T) {
+		tracker := app.NewSLOTracker()
+		clock := app.NewFakeClock(start)
+		tracker.SetClock(clock)
+
+		bus := app.NewEventBus()
+		defer bus.Stop()
+		var published []app.SLOAlert
+		var mutex sync.Mutex
+		assert.NoError(t, bus.Subscribe(app.TopicSLOAlert, "test", func(payload interface{}) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			published = append(published, *payload.(*app.SLOAlert))
+		}))
+		tracker.SetBus(bus)
+
+		// Burning the budget a little faster than allowed does not alert
+		record(tracker, clock.Now(), 98, 200, 10)
+		record(tracker, clock.Now(), 2, 500, 10)
+		report := tracker.Report()
+		assert.InDelta(t, 2, slo(report, app.SLOIngestionAvailability).BurnRates["5m0s"], 1e-9)
+		assert.Empty(t, report.Firing)
+
+		clock.Advance(time.Minute)
+		record(tracker, clock.Now(), 20, 500, 10)
+		report = tracker.Report()
+		if assert.Len(t, report.Firing, 1) {
+			alert := report.Firing[0]
+			assert.Equal(t, app.SLOIngestionAvailability, alert.SLO)
+			assert.InDelta(t, 22/1.2, alert.BurnRate, 1e-9)
+			assert.Equal(t, 14.4, alert.Threshold)
+		}
+		assert.True(t, slo(report, app.SLOIngestionAvailability).Alerting)
+		assert.False(t, slo(report, app.SLOIngestionLatency).Alerting)
+
+		// The short window stops burning first, resolving the alert
+		clock.Advance(10 * time.Minute)
+		report = tracker.Report()
+		assert.Empty(t, report.Firing)
+		if assert.Len(t, report.Resolved, 1) {
+			assert.NotNil(t, report.Resolved[0].ResolvedAt)
+		}
+		assert.Greater(t, slo(report, app.SLOIngestionAvailability).BurnRates["1h0m0s"], 14.4)
+
+		assert.Eventually(t, func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return len(published) == 2
+		}, time.Second, time.Millisecond)
+		assert.Nil(t, published[0].ResolvedAt)
+		assert.NotNil(t, published[1].ResolvedAt)
+
+		var metrics strings.Builder
+		assert.NoError(t, tracker.WriteMetrics(&metrics))
+		assert.Contains(t, metrics.String(), `analytics_slo_alerts_firing{slo="ingestion_availability"} 0`)
+		assert.Contains(t, metrics.String(), `analytics_slo_burn_rate{slo="ingestion_availability",window="5m0s"} 0`)
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+
+		req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"page_view","user_id":"user1"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "test-key")
+		req.Header.Set("X-User-ID", "user1")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		req = httptest.NewRequest("GET", "/api/v1/admin/slo", nil)
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 401, resp.StatusCode)
+
+		req = httptest.NewRequest("GET", "/api/v1/admin/slo", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			SLO app.SLOReport `json:"slo"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		availability := slo(&body.SLO, app.SLOIngestionAvailability)
+		assert.Equal(t, int64(1), availability.Requests, "Tracked requests should count against the objectives")
+		assert.Equal(t, 1.0, availability.SLI)
+	})
+}
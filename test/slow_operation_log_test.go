@@ -0,0 +1,100 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestSlowOperationLog tests recording and querying of expensive operations
+func TestSlowOperationLog(t *testing.T) {
+	t.Run("RecordsOnlyOperationsAboveThreshold", func(t *testing.T) {
+		slowLog := app.NewSlowOperationLog()
+		slowLog.SetThresholds(100*time.Millisecond, 1000)
+
+		recorded := slowLog.Observe(app.SlowOperationFunnel, nil, 10*time.Millisecond, 10, 0.001)
+		assert.False(t, recorded, "Fast operation should not be recorded")
+
+		recorded = slowLog.Observe(app.SlowOperationFunnel, map[string]interface{}{"funnel_id": "f1"}, 200*time.Millisecond, 10, 0.001)
+		assert.True(t, recorded, "Slow operation should be recorded")
+
+		recorded = slowLog.Observe(app.SlowOperationHeatmap, nil, time.Millisecond, 5000, 0.002)
+		assert.True(t, recorded, "Operation scanning many events should be recorded")
+
+		operations := slowLog.Query(app.SlowOperationFilter{})
+		assert.Equal(t, 2, len(operations))
+		assert.Equal(t, app.SlowOperationHeatmap, operations[0].Kind, "Newest entry should come first")
+		assert.Equal(t, []string{"scanned_events"}, operations[0].Reasons)
+		assert.Equal(t, []string{"duration"}, operations[1].Reasons)
+		assert.Equal(t, "f1", operations[1].Parameters["funnel_id"])
+	})
+
+	t.Run("QueryFilters", func(t *testing.T) {
+		slowLog := app.NewSlowOperationLog()
+		slowLog.SetThresholds(time.Nanosecond, 0)
+
+		slowLog.Observe(app.SlowOperationFunnel, nil, time.Millisecond, 0, 0)
+		slowLog.Observe(app.SlowOperationHeatmap, nil, time.Millisecond, 0, 0)
+		slowLog.Observe(app.SlowOperationFunnel, nil, time.Millisecond, 0, 0)
+
+		assert.Equal(t, 2, len(slowLog.Query(app.SlowOperationFilter{Kind: app.SlowOperationFunnel})))
+		assert.Equal(t, 1, len(slowLog.Query(app.SlowOperationFilter{Limit: 1})))
+		assert.Empty(t, slowLog.Query(app.SlowOperationFilter{Since: time.Now().Add(time.Hour)}))
+	})
+
+	t.Run("FunnelComputationIsRecorded", func(t *testing.T) {
+		analyticsService := app.NewAnalyticsService()
+		analyticsService.SlowOperations().SetThresholds(time.Nanosecond, 0)
+		funnelService := app.NewFunnelService(analyticsService)
+		funnel, err := funnelService.CreateFunnel(context.Background(), "Checkout", "", []app.Step{
+			{ID: "view", Name: "View", EventType: "page_view", Order: 1},
+			{ID: "cart", Name: "Cart", EventType: "add_to_cart", Order: 2},
+		})
+		assert.NoError(t, err)
+
+		_, err = funnelService.ComputeFunnel(context.Background(), app.FunnelQuery{
+			FunnelID: funnel.ID,
+			Start:    time.Now().AddDate(0, 0, -7),
+			End:      time.Now(),
+		})
+		assert.NoError(t, err)
+
+		operations := analyticsService.SlowOperations().Query(app.SlowOperationFilter{Kind: app.SlowOperationFunnel})
+		assert.Equal(t, 1, len(operations))
+		assert.Equal(t, funnel.ID, operations[0].Parameters["funnel_id"])
+		assert.Greater(t, operations[0].Cost, 0.0)
+	})
+
+	t.Run("SlowOperationsEndpoint", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		application.GetAnalyticsService().SlowOperations().SetThresholds(time.Nanosecond, 0)
+		application.GetAnalyticsService().SlowOperations().Observe(app.SlowOperationHeatmap, nil, time.Millisecond, 42, 0.002)
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "viewer-token", app.RoleViewer))
+
+		req := httptest.NewRequest("GET", "/api/v1/admin/slow-operations?kind=heatmap", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+
+		var body struct {
+			Operations []app.SlowOperation `json:"operations"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, 1, len(body.Operations))
+		assert.Equal(t, int64(42), body.Operations[0].ScannedEvents)
+
+		req = httptest.NewRequest("GET", "/api/v1/admin/slow-operations?limit=abc", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
@@ -0,0 +1,87 @@
+package test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestStorageSampling tests that sampled event types keep exact counts while dropping detail
+func TestStorageSampling(t *testing.T) {
+	t.Run("DeterministicDecision", func(t *testing.T) {
+		sampler := app.NewStorageSampler()
+		assert.True(t, sampler.ShouldStoreDetail("event-1", "click"), "Unconfigured types are stored in full detail")
+
+		assert.NoError(t, sampler.SetDetailRate("click", 0.5))
+		first := sampler.ShouldStoreDetail("event-1", "click")
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, first, sampler.ShouldStoreDetail("event-1", "click"))
+		}
+
+		assert.Error(t, sampler.SetDetailRate("click", 1.5))
+		assert.NoError(t, sampler.SetDetailRate("click", 1.0))
+		assert.Empty(t, sampler.DetailRates())
+	})
+
+	t.Run("CountsStayExact", func(t *testing.T) {
+		analyticsService := app.NewAnalyticsService()
+		assert.NoError(t, analyticsService.StorageSampler().SetDetailRate("mouse_move", 0.1))
+
+		for i := 0; i < 200; i++ {
+			event, err := analyticsService.TrackEvent(context.Background(), map[string]interface{}{
+				"event_type": "mouse_move",
+				"user_id":    "user1",
+				"properties": map[string]interface{}{"x": 10, "y": 20},
+			}, "test-key", "user1")
+			assert.NoError(t, err)
+			assert.NotNil(t, event.Properties, "The returned event keeps its detail")
+			assert.Equal(t, 0.1, event.DetailSampleRate)
+		}
+
+		usage, err := analyticsService.GetUsage(context.Background(), "user1",
+			time.Now().AddDate(0, 0, -1).Format("2006-01-02"), time.Now().Format("2006-01-02"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(200), usage.TotalEvents)
+		assert.Equal(t, int64(200), usage.EventsByType["mouse_move"])
+
+		var detailed int
+		for _, event := range analyticsService.QueryEvents(context.Background(), app.EventFilter{EventType: "mouse_move"}) {
+			if event.DetailDropped {
+				assert.Nil(t, event.Properties)
+			} else {
+				detailed++
+			}
+		}
+		assert.Greater(t, detailed, 0)
+		assert.Less(t, detailed, 60, "Roughly 10% of events should keep their detail")
+	})
+
+	t.Run("RuntimeSetting", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		assert.NoError(t, application.GetAdminAuth().AddToken("ops", "operator-token", app.RoleOperator))
+
+		req := httptest.NewRequest("PUT", "/api/v1/admin/runtime/storage.detail_sample_rates", strings.NewReader(`{"value":{"click":0.25}}`))
+		req.Header.Set("If-Match", "*")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Admin-Token", "operator-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 0.25, application.GetAnalyticsService().StorageSampler().DetailRate("click"))
+
+		req = httptest.NewRequest("PUT", "/api/v1/admin/runtime/storage.detail_sample_rates", strings.NewReader(`{"value":"click:2"}`))
+		req.Header.Set("If-Match", "*")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Admin-Token", "operator-token")
+		resp, err = application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode)
+	})
+}
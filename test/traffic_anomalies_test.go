@@ -0,0 +1,190 @@
+package test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestTrafficAnomalies tests alerts on spikes from a single client, surges of malformed events
+// and events claiming impossible ordering
+func TestTrafficAnomalies(t *testing.T) {
+	t.Setenv("TRAFFIC_ALERT_SPIKE_MIN_EVENTS", "20")
+	t.Setenv("TRAFFIC_ALERT_MALFORMED_MIN_EVENTS", "10")
+	t.Setenv("TRAFFIC_ALERT_MISORDERED_MIN_EVENTS", "3")
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Spikes", func(t *testing.T) {
+		monitor := app.NewTrafficMonitor()
+		clock := app.NewFakeClock(start)
+		monitor.SetClock(clock)
+
+		bus := app.NewEventBus()
+		defer bus.Stop()
+		var published []app.TrafficAlert
+		var mutex sync.Mutex
+		assert.NoError(t, bus.Subscribe(app.TopicTrafficAlert, "test", func(payload interface{}) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			published = append(published, *payload.(*app.TrafficAlert))
+		}))
+		monitor.SetBus(bus)
+
+		observe := func(ip string, count int) {
+			for i := 0; i < count; i++ {
+				monitor.Observe("web", ip, "", app.TrafficReceived)
+			}
+		}
+
+		// A steady client sets its baseline
+		observe("10.0.0.1", 5)
+		observe("10.0.0.2", 30)
+		clock.Advance(time.Minute)
+		observe("10.0.0.1", 60)
+		observe("10.0.0.2", 30)
+		clock.Advance(time.Minute)
+
+		report := monitor.Alerts()
+		assert.Equal(t, "1m0s", report.Window)
+		if assert.Len(t, report.Firing, 1, "Only clients exceeding their baseline should spike") {
+			alert := report.Firing[0]
+			assert.Equal(t, app.TrafficRuleIPSpike, alert.Rule)
+			assert.Equal(t, "web", alert.ProjectID)
+			assert.Equal(t, "10.0.0.1", alert.Subject)
+			assert.Equal(t, int64(60), alert.Count)
+			assert.Equal(t, int64(90), alert.Total)
+			assert.Equal(t, 5.0, alert.Baseline)
+			assert.Equal(t, start.Add(2*time.Minute), alert.FiredAt)
+		}
+
+		// A sustained spike keeps its alert, and does not become the baseline
+		observe("10.0.0.1", 80)
+		clock.Advance(time.Minute)
+		report = monitor.Alerts()
+		assert.Len(t, report.Firing, 1)
+		assert.Equal(t, int64(80), report.Firing[0].Count)
+		assert.Equal(t, 5.0, report.Firing[0].Baseline)
+
+		observe("10.0.0.1", 5)
+		clock.Advance(time.Minute)
+		report = monitor.Alerts()
+		assert.Empty(t, report.Firing)
+		if assert.Len(t, report.Resolved, 1) {
+			assert.Equal(t, start.Add(4*time.Minute), *report.Resolved[0].ResolvedAt)
+		}
+
+		// User agents spike on their own, across client IPs
+		for i := 0; i < 25; i++ {
+			monitor.Observe("shop", "10.0.1."+string(rune('a'+i)), "broken-sdk/1.0", app.TrafficReceived)
+		}
+		clock.Advance(time.Minute)
+		report = monitor.Alerts()
+		if assert.Len(t, report.Firing, 1) {
+			assert.Equal(t, app.TrafficRuleUserAgentSpike, report.Firing[0].Rule)
+			assert.Equal(t, "broken-sdk/1.0", report.Firing[0].Subject)
+		}
+
+		var metrics strings.Builder
+		assert.NoError(t, monitor.WriteMetrics(&metrics))
+		assert.Contains(t, metrics.String(), `analytics_traffic_alerts_firing{rule="user_agent_spike"} 1`)
+		assert.Contains(t, metrics.String(), `analytics_traffic_alerts_total{rule="ip_spike"} 1`)
+
+		assert.Eventually(t, func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return len(published) == 3
+		}, time.Second, 10*time.Millisecond, "Fired and resolved alerts should be published")
+		mutex.Lock()
+		assert.Nil(t, published[0].ResolvedAt)
+		assert.NotNil(t, published[1].ResolvedAt)
+		mutex.Unlock()
+	})
+
+	t.Run("MalformedAndMisorderedEvents", func(t *testing.T) {
+		monitor := app.NewTrafficMonitor()
+		clock := app.NewFakeClock(start)
+		monitor.SetClock(clock)
+
+		for i := 0; i < 12; i++ {
+			outcome := app.TrafficReceived
+			if i < 2 {
+				outcome = app.TrafficMalformed
+			}
+			monitor.Observe("web", "10.0.0.1", "sdk/2.0", outcome)
+		}
+		for i := 0; i < 8; i++ {
+			monitor.Observe("shop", "10.0.0.2", "sdk/2.0", app.TrafficMalformed)
+		}
+		for i := 0; i < 3; i++ {
+			monitor.Observe("shop", "10.0.0.2", "sdk/2.0", app.TrafficMisordered)
+		}
+		clock.Advance(time.Minute)
+
+		report := monitor.Alerts()
+		rules := make(map[string]string)
+		for _, alert := range report.Firing {
+			rules[alert.Rule] = alert.ProjectID
+		}
+		assert.Equal(t, map[string]string{
+			app.TrafficRuleMalformedSurge:  "shop",
+			app.TrafficRuleImpossibleOrder: "shop",
+		}, rules, "A few malformed events among many should not alert")
+	})
+
+	t.Run("Ingestion", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+		assert.NoError(t, application.GetAdminAuth().AddToken("viewer", "viewer-token", app.RoleViewer))
+		clock := app.NewFakeClock(time.Now())
+		application.GetTrafficMonitor().SetClock(clock)
+
+		send := func(body string) int {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("X-Project-ID", "web")
+			req.Header.Set("User-Agent", "ios-sdk/3.1")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		sentAt := time.Now().UTC()
+		misordered := `{"event_type":"page_view","user_id":"user1","timestamp":"` + sentAt.Add(time.Minute).Format(time.RFC3339) + `","sent_at":"` + sentAt.Format(time.RFC3339) + `"}`
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, 400, send(misordered))
+		}
+		assert.Equal(t, 200, send(`{"event_type":"page_view","user_id":"user1"}`))
+		clock.Advance(time.Minute)
+
+		req := httptest.NewRequest("GET", "/api/v1/admin/traffic-alerts", nil)
+		req.Header.Set("X-Admin-Token", "viewer-token")
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+
+		var result struct {
+			TrafficAlerts app.TrafficAlertReport `json:"traffic_alerts"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &result))
+		if assert.Len(t, result.TrafficAlerts.Firing, 1) {
+			alert := result.TrafficAlerts.Firing[0]
+			assert.Equal(t, app.TrafficRuleImpossibleOrder, alert.Rule)
+			assert.Equal(t, "web", alert.ProjectID)
+			assert.Equal(t, int64(3), alert.Count)
+			assert.Equal(t, int64(4), alert.Total)
+		}
+	})
+}
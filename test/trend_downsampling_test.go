@@ -0,0 +1,93 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestTrendDownsampling tests hourly series downsampled into daily summaries and the resolution
+// of trends reaching them
+func TestTrendDownsampling(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	service := app.NewAnalyticsService()
+	clock := app.NewFakeClock(day)
+	service.SetClock(clock)
+	ctx := app.ContextWithProject(context.Background(), "web")
+	queries := app.NewQueryService(service)
+
+	track := func(eventType string, at time.Time, count int) {
+		clock.Set(at)
+		for i := 0; i < count; i++ {
+			_, err := service.TrackEvent(ctx, map[string]interface{}{"event_type": eventType, "user_id": "user1"}, "test-key", "user1")
+			assert.NoError(t, err)
+		}
+	}
+	track("page_view", day.Add(9*time.Hour), 3)
+	track("click", day.Add(9*time.Hour), 2)
+	track("page_view", day.Add(14*time.Hour), 1)
+	track("page_view", day.Add(24*time.Hour), 5)
+
+	t.Run("HourlyStats", func(t *testing.T) {
+		daily, err := queries.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "day", Start: day, End: day.Add(48 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, &app.HourlyStats{Min: 0, Max: 3, Avg: 4.0 / 24}, daily.Points[0].Hourly)
+		assert.Equal(t, &app.HourlyStats{Min: 0, Max: 5, Avg: 5.0 / 24}, daily.Points[1].Hourly)
+
+		all, err := queries.ComputeTrend(ctx, app.TrendQuery{Interval: "week", Start: day, End: day.Add(48 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, &app.HourlyStats{Min: 0, Max: 5, Avg: 11.0 / 48}, all.Points[0].Hourly, "Hours of every event type should add up exactly")
+
+		hourly, err := queries.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "hour", Start: day, End: day.Add(24 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "events", hourly.Source)
+		assert.Empty(t, hourly.RequestedInterval)
+		assert.Len(t, hourly.Points, 24)
+		assert.Nil(t, hourly.Points[9].Hourly)
+	})
+
+	t.Run("Downsample", func(t *testing.T) {
+		now := day.Add(40 * 24 * time.Hour)
+		result := service.PurgeExpiredEvents(now)
+		assert.Equal(t, 3, result.Downsampled)
+		assert.Zero(t, service.PurgeExpiredEvents(now).Downsampled, "Days should only be downsampled once")
+
+		stats := service.Series().Stats()
+		assert.Equal(t, 0, stats.HourlyDays)
+		assert.Equal(t, 3, stats.DownsampledDays)
+		assert.Equal(t, 30, stats.DownsampleAfter)
+		if assert.NotNil(t, stats.DownsampledBefore) {
+			assert.True(t, stats.DownsampledBefore.Equal(day.Add(10*24*time.Hour)))
+		}
+
+		track("page_view", now, 1)
+		assert.Equal(t, 1, service.Series().Stats().HourlyDays, "Recent days should be counted per hour")
+	})
+
+	t.Run("Resolution", func(t *testing.T) {
+		trend, err := queries.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "hour", Start: day.Add(8 * time.Hour), End: day.Add(20 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "day", trend.Interval)
+		assert.Equal(t, "hour", trend.RequestedInterval)
+		assert.Equal(t, "rollups", trend.Source)
+		assert.Equal(t, app.TimeRange{Start: day, End: day.Add(24 * time.Hour)}, trend.TimeRange, "Downsampled trends should cover whole days")
+		if assert.Len(t, trend.Points, 1) {
+			assert.Equal(t, int64(4), trend.Points[0].Count)
+			assert.Equal(t, &app.HourlyStats{Min: 0, Max: 3, Avg: 4.0 / 24}, trend.Points[0].Hourly, "Downsampled days should keep their summary")
+		}
+
+		all, err := queries.ComputeTrend(ctx, app.TrendQuery{Interval: "day", Start: day, End: day.Add(24 * time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, &app.HourlyStats{Min: 0, Max: 5, Avg: 6.0 / 24, Approximate: true}, all.Points[0].Hourly)
+
+		recent := day.Add(40 * 24 * time.Hour)
+		trend, err = queries.ComputeTrend(ctx, app.TrendQuery{EventType: "page_view", Interval: "hour", Start: recent, End: recent.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Equal(t, "hour", trend.Interval, "Trends of recent days should keep their interval")
+		assert.Equal(t, int64(1), trend.TotalEvents)
+	})
+}
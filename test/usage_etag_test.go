@@ -0,0 +1,86 @@
+package test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestUsageETag tests revalidating usage summaries with ETags and If-None-Match
+func TestUsageETag(t *testing.T) {
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	ctx := app.ContextWithProject(context.Background(), "shop")
+
+	track := func(userID string) {
+		_, err := application.GetAnalyticsService().TrackEvent(ctx, map[string]interface{}{
+			"event_type": "page_view",
+			"user_id":    userID,
+		}, "test-key", userID)
+		assert.NoError(t, err)
+	}
+	get := func(query, etag string) (int, string) {
+		req := httptest.NewRequest("GET", "/api/v1/analytics/usage?"+query, nil)
+		req.Header.Set("X-Project-ID", "shop")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := application.GetFiberApp().Test(req)
+		assert.NoError(t, err)
+		return resp.StatusCode, resp.Header.Get("ETag")
+	}
+	track("user1")
+
+	t.Run("NotModified", func(t *testing.T) {
+		status, etag := get("user_id=user1", "")
+		assert.Equal(t, 200, status)
+		assert.Regexp(t, `^W/"[0-9a-f]{16}"$`, etag)
+
+		status, revalidated := get("user_id=user1", etag)
+		assert.Equal(t, 304, status)
+		assert.Equal(t, etag, revalidated)
+		status, _ = get("user_id=user1", `"other", `+etag)
+		assert.Equal(t, 304, status, "Any of the listed tags should match")
+		status, _ = get("user_id=user1", "*")
+		assert.Equal(t, 304, status)
+
+		status, other := get("user_id=user2", etag)
+		assert.Equal(t, 200, status, "Tags should differ per user")
+		assert.NotEqual(t, etag, other)
+		status, _ = get("user_id=user1&start_date="+time.Now().AddDate(0, 0, -7).Format("2006-01-02"), etag)
+		assert.Equal(t, 200, status, "Tags should differ per period")
+	})
+
+	t.Run("ChangesWithEvents", func(t *testing.T) {
+		_, etag := get("user_id=user1", "")
+		track("user3")
+		status, changed := get("user_id=user1", etag)
+		assert.Equal(t, 200, status)
+		assert.NotEqual(t, etag, changed)
+
+		version := application.GetAnalyticsService().Rollups().Version()
+		application.GetAnalyticsService().RebuildRollups("shop", time.Time{}, time.Time{})
+		assert.Greater(t, application.GetAnalyticsService().Rollups().Version(), version, "Rebuilds should change the version")
+		status, _ = get("user_id=user1", changed)
+		assert.Equal(t, 200, status)
+	})
+
+	t.Run("ChangesWithCurrency", func(t *testing.T) {
+		currencies := application.GetAnalyticsService().Currencies()
+		assert.NoError(t, currencies.ReplaceRates(map[string]float64{"EUR": 0.5}))
+		_, etag := get("user_id=user1", "")
+		assert.NoError(t, currencies.SetProjectCurrency("shop", "EUR"))
+		status, converted := get("user_id=user1", etag)
+		assert.Equal(t, 200, status)
+
+		assert.NoError(t, currencies.ReplaceRates(map[string]float64{"EUR": 0.9}))
+		status, _ = get("user_id=user1", converted)
+		assert.Equal(t, 200, status, "Tags should change with the conversion rate")
+	})
+}
@@ -0,0 +1,199 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+	"magebase/apis/analytics/billingstub"
+)
+
+// TestUserDispatcher tests processing the events of each user one at a time in dispatch order
+func TestUserDispatcher(t *testing.T) {
+	t.Run("ProcessesUsersInOrder", func(t *testing.T) {
+		dispatcher := app.NewUserDispatcher(4, 1000)
+		defer dispatcher.Stop()
+
+		var mutex sync.Mutex
+		processed := make(map[string][]int)
+		running := make(map[string]int)
+		overlapped := false
+		var dispatchers sync.WaitGroup
+		for u := 0; u < 8; u++ {
+			userID := fmt.Sprintf("user%d", u)
+			dispatchers.Add(1)
+			go func() {
+				defer dispatchers.Done()
+				for i := 0; i < 100; i++ {
+					sequence := i
+					dispatcher.Submit(userID, func() {
+						mutex.Lock()
+						running[userID]++
+						overlapped = overlapped || running[userID] > 1
+						mutex.Unlock()
+
+						mutex.Lock()
+						processed[userID] = append(processed[userID], sequence)
+						running[userID]--
+						mutex.Unlock()
+					})
+				}
+			}()
+		}
+		dispatchers.Wait()
+		for u := 0; u < 8; u++ {
+			assert.True(t, dispatcher.Do(fmt.Sprintf("user%d", u), func() {}))
+		}
+
+		assert.False(t, overlapped, "Events of a user should not be processed concurrently")
+		for userID, sequence := range processed {
+			if assert.Len(t, sequence, 100, userID) {
+				for i, value := range sequence {
+					assert.Equal(t, i, value, userID)
+				}
+			}
+		}
+		assert.Equal(t, uint64(800+8), dispatcher.Stats().Processed)
+	})
+
+	t.Run("Partitions", func(t *testing.T) {
+		dispatcher := app.NewUserDispatcher(8, 10)
+		defer dispatcher.Stop()
+		assert.Equal(t, dispatcher.Partition("user1"), dispatcher.Partition("user1"), "A user should always map to the same partition")
+
+		anonymous := make(map[int]bool)
+		for i := 0; i < 8; i++ {
+			anonymous[dispatcher.Partition("")] = true
+		}
+		assert.Len(t, anonymous, 8, "Events without a user should be spread over the partitions")
+		assert.Len(t, dispatcher.PartitionStats(), 8)
+		assert.Equal(t, 8, dispatcher.Stats().Size)
+		assert.Equal(t, 80, dispatcher.Stats().Capacity)
+	})
+
+	t.Run("FullPartitionAndStop", func(t *testing.T) {
+		dispatcher := app.NewUserDispatcher(1, 1)
+		release := make(chan struct{})
+		busy := make(chan struct{})
+		assert.True(t, dispatcher.Submit("user1", func() {
+			close(busy)
+			<-release
+		}))
+		<-busy
+		assert.True(t, dispatcher.TrySubmit("user1", func() {}))
+		assert.False(t, dispatcher.TrySubmit("user2", func() {}), "Events should not be queued past the capacity")
+		assert.Nil(t, dispatcher.TryReserve("user2"), "Reserving a turn should not wait for room")
+		assert.Error(t, dispatcher.SetCapacity(0))
+		close(release)
+		assert.True(t, dispatcher.Do("user1", func() {}))
+
+		ran := false
+		if run := dispatcher.TryReserve("user1"); assert.NotNil(t, run) {
+			run(func() { ran = true })
+		}
+		assert.True(t, ran, "Reserved turns should run their task")
+
+		dispatcher.Stop()
+		assert.True(t, dispatcher.Stopped())
+		ran = false
+		assert.False(t, dispatcher.Do("user1", func() { ran = true }))
+		assert.False(t, ran)
+		assert.Nil(t, dispatcher.TryReserve("user1"))
+	})
+
+	t.Run("App", func(t *testing.T) {
+		track := func(application *app.App) int {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"page_view","user_id":"user1"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			return resp.StatusCode
+		}
+
+		t.Setenv("ORDERED_PROCESSING_PARTITIONS", "4")
+		ordered := app.NewApp("8080")
+		ordered.SetupRoutes()
+		defer ordered.Stop()
+		if assert.NotNil(t, ordered.GetUserDispatcher()) {
+			assert.Equal(t, 200, track(ordered))
+			assert.Equal(t, uint64(1), ordered.GetUserDispatcher().Stats().Processed, "Tracked events should go through the dispatcher")
+			ordered.GetUserDispatcher().Stop()
+			assert.Equal(t, 200, track(ordered), "Events should be stored right away once ordered processing is stopped")
+		}
+
+		t.Setenv("ORDERED_PROCESSING_PARTITIONS", "0")
+		unordered := app.NewApp("8080")
+		unordered.SetupRoutes()
+		defer unordered.Stop()
+		assert.Nil(t, unordered.GetUserDispatcher())
+		assert.Equal(t, 200, track(unordered))
+	})
+
+	t.Run("BillsOutsideTheQueue", func(t *testing.T) {
+		stub := billingstub.NewServer()
+		defer stub.Close()
+		t.Setenv("BILLING_SERVICE_URL", stub.URL())
+		t.Setenv("ORDERED_PROCESSING_PARTITIONS", "1")
+		t.Setenv("ORDERED_PROCESSING_QUEUE_CAPACITY", "1")
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		track := func(prefer string) *http.Response {
+			req := httptest.NewRequest("POST", "/api/v1/analytics/events", strings.NewReader(`{"event_type":"page_view","user_id":"user1"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "test-key")
+			req.Header.Set("X-User-ID", "user1")
+			req.Header.Set("Prefer", prefer)
+			resp, err := application.GetFiberApp().Test(req, -1)
+			assert.NoError(t, err)
+			return resp
+		}
+		billed := func() int {
+			events, err := stub.Events()
+			assert.NoError(t, err)
+			count := 0
+			for _, event := range events {
+				if metadata, ok := event.Details["metadata"].(map[string]interface{}); ok && metadata["event_type"] == "page_view" {
+					count++
+				}
+			}
+			return count
+		}
+
+		release := make(chan struct{})
+		busy := make(chan struct{})
+		application.GetUserDispatcher().Submit("blocker", func() {
+			close(busy)
+			<-release
+		})
+		<-busy
+
+		statuses := make(chan int, 1)
+		go func() { statuses <- track("").StatusCode }()
+		assert.Eventually(t, func() bool { return billed() == 1 }, 2*time.Second, 10*time.Millisecond,
+			"Events should be billed while their user's queue is busy")
+
+		assert.Eventually(t, func() bool {
+			return application.GetUserDispatcher().Stats().Queued == 1
+		}, 2*time.Second, 10*time.Millisecond)
+		resp := track("")
+		assert.Equal(t, 503, resp.StatusCode, "Requests should not wait for room in a full queue")
+		assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+		assert.Equal(t, 503, track("respond-async").StatusCode)
+		assert.Equal(t, 1, billed(), "Events shed by a full queue should not be billed")
+
+		close(release)
+		assert.Equal(t, 200, <-statuses)
+		assert.Equal(t, 1, billed())
+	})
+}
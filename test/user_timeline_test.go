@@ -0,0 +1,169 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestUserTimeline tests merging the analytics events, sessions and cross-service events of a user
+// into one paginated chronological view
+func TestUserTimeline(t *testing.T) {
+	t.Setenv("SERVICE_EVENT_LOG_EVENTS_PER_USER", "3")
+	application := app.NewApp("8080")
+	application.SetupRoutes()
+	defer application.Stop()
+	timeline := application.GetUserTimeline()
+	ctx := app.ContextWithProject(context.Background(), "shop")
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	track := func(projectCtx context.Context, eventType, userID, sessionID, page string, at time.Time) {
+		data := map[string]interface{}{
+			"event_type": eventType,
+			"user_id":    userID,
+			"page":       page,
+			"timestamp":  at.Format(time.RFC3339),
+		}
+		if sessionID != "" {
+			data["session_id"] = sessionID
+		}
+		_, err := application.GetAnalyticsService().TrackEvent(projectCtx, data, "test-key", userID)
+		assert.NoError(t, err)
+	}
+
+	track(ctx, "page_view", "user1", "sess-1", "/pricing", start)
+	track(ctx, "page_view", "user1", "sess-1", "/signup", start.Add(time.Minute))
+	track(ctx, "page_view", "user1", "sess-1", "/pricing", start.Add(2*time.Minute))
+	track(ctx, "purchase", "user1", "", "", start.Add(10*time.Minute))
+	track(ctx, "page_view", "user2", "sess-2", "/", start.Add(time.Minute))
+	track(app.ContextWithProject(context.Background(), "blog"), "page_view", "user1", "sess-3", "/post", start.Add(time.Minute))
+
+	events := timeline.ServiceEvents()
+	events.Record(&app.CrossServiceEvent{ID: "login", EventType: "auth.user.login", UserID: "user1", Timestamp: start.Add(-time.Minute)})
+	events.Record(&app.CrossServiceEvent{ID: "charge", Source: "billing", EventType: "billing.payment.completed", UserID: "user1", Timestamp: start.Add(11 * time.Minute)})
+	events.Record(&app.CrossServiceEvent{ID: "view", EventType: "analytics.page.view", UserID: "user1", Timestamp: start})
+	events.Record(&app.CrossServiceEvent{ID: "anonymous", EventType: "payments.transaction.completed", Timestamp: start})
+
+	t.Run("ServiceEventLog", func(t *testing.T) {
+		assert.Len(t, events.Events("user1"), 2, "Only auth, billing and payments events of users should be kept")
+		log := app.NewServiceEventLog()
+		for _, id := range []string{"1", "2", "3", "4"} {
+			log.Record(&app.CrossServiceEvent{ID: id, EventType: "auth.user.login", UserID: "user9"})
+		}
+		kept := log.Events("user9")
+		if assert.Len(t, kept, 3, "The oldest events should be dropped") {
+			assert.Equal(t, "2", kept[0].ID)
+			assert.Equal(t, "4", kept[2].ID)
+			assert.False(t, kept[2].Timestamp.IsZero(), "Events without a timestamp should be stamped")
+		}
+		var disabled *app.ServiceEventLog
+		disabled.Record(&app.CrossServiceEvent{EventType: "auth.user.login", UserID: "user9"})
+	})
+
+	t.Run("MergesChronologically", func(t *testing.T) {
+		page, err := timeline.Query(ctx, app.TimelineQuery{UserID: "user1", Order: app.TimelineOldestFirst, Limit: 100})
+		assert.NoError(t, err)
+		assert.Empty(t, page.NextCursor)
+		var kinds []string
+		for _, entry := range page.Entries {
+			kinds = append(kinds, entry.Kind+":"+entry.Source)
+		}
+		assert.Equal(t, []string{
+			"service_event:auth",
+			"session:analytics",
+			"event:analytics",
+			"event:analytics",
+			"event:analytics",
+			"event:analytics",
+			"service_event:billing",
+		}, kinds)
+
+		session := page.Entries[1].Session
+		assert.Equal(t, "sess-1", session.SessionID)
+		assert.Equal(t, 3, session.EventCount)
+		assert.Equal(t, 120.0, session.DurationSeconds)
+		assert.Equal(t, []string{"/pricing", "/signup"}, session.Pages)
+		assert.Equal(t, "purchase", page.Entries[5].Event.EventType)
+
+		newest, err := timeline.Query(ctx, app.TimelineQuery{UserID: "user1", Limit: 100})
+		assert.NoError(t, err)
+		assert.Equal(t, "charge", newest.Entries[0].ServiceEvent.ID, "Timelines should be newest first by default")
+	})
+
+	t.Run("Paginates", func(t *testing.T) {
+		for _, order := range []string{app.TimelineOldestFirst, app.TimelineNewestFirst} {
+			full, err := timeline.Query(ctx, app.TimelineQuery{UserID: "user1", Order: order, Limit: 100})
+			assert.NoError(t, err)
+
+			var paged []app.TimelineEntry
+			query := app.TimelineQuery{UserID: "user1", Order: order, Limit: 2}
+			for pages := 0; pages < 10; pages++ {
+				page, err := timeline.Query(ctx, query)
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, len(page.Entries), 2)
+				paged = append(paged, page.Entries...)
+				if page.NextCursor == "" {
+					break
+				}
+				query.Cursor = page.NextCursor
+			}
+			assert.Equal(t, full.Entries, paged, order)
+		}
+	})
+
+	t.Run("FiltersByTimeAndProject", func(t *testing.T) {
+		page, err := timeline.Query(ctx, app.TimelineQuery{UserID: "user1", Start: start.Add(5 * time.Minute), Limit: 100})
+		assert.NoError(t, err)
+		assert.Len(t, page.Entries, 2)
+
+		blog, err := timeline.Query(app.ContextWithProject(context.Background(), "blog"), app.TimelineQuery{UserID: "user1", Order: app.TimelineOldestFirst, Limit: 100})
+		assert.NoError(t, err)
+		assert.Len(t, blog.Entries, 4, "Other projects should show their own events and the cross-service events")
+		assert.Equal(t, "sess-3", blog.Entries[1].Session.SessionID)
+	})
+
+	t.Run("Endpoint", func(t *testing.T) {
+		get := func(path string) (int, map[string]interface{}) {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("X-Project-ID", "shop")
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var body map[string]interface{}
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return resp.StatusCode, body
+		}
+
+		status, body := get("/api/v1/users/user1/timeline?limit=3&order=asc")
+		assert.Equal(t, 200, status)
+		page := body["timeline"].(map[string]interface{})
+		assert.Equal(t, "user1", page["user_id"])
+		assert.Len(t, page["entries"], 3)
+		cursor := page["next_cursor"].(string)
+		assert.NotEmpty(t, cursor)
+
+		status, body = get("/api/v1/users/user1/timeline?limit=10&order=asc&cursor=" + cursor)
+		assert.Equal(t, 200, status)
+		page = body["timeline"].(map[string]interface{})
+		assert.Len(t, page["entries"], 4)
+		assert.NotContains(t, page, "next_cursor")
+		encoded, err := json.Marshal(page)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(encoded), "test-key", "Timelines should not expose API keys")
+		assert.Contains(t, string(encoded), app.APIKeyID("test-key"))
+
+		status, body = get("/api/v1/users/user2/timeline?start_date=" + start.Add(5*time.Minute).Format(time.RFC3339))
+		assert.Equal(t, 200, status)
+		assert.Empty(t, body["timeline"].(map[string]interface{})["entries"])
+
+		for _, query := range []string{"cursor=abc", "limit=0", "limit=5000", "limit=x", "order=up", "start_date=yesterday"} {
+			status, _ = get("/api/v1/users/user1/timeline?" + query)
+			assert.Equal(t, 400, status, query)
+		}
+	})
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"magebase/apis/analytics/app"
+)
+
+// TestWriteKeys tests project write keys and rotating them without rejecting events
+func TestWriteKeys(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	setup := func() (*app.WriteKeys, *app.FakeClock) {
+		keys := app.NewWriteKeys()
+		clock := app.NewFakeClock(start)
+		keys.SetClock(clock)
+		return keys, clock
+	}
+
+	t.Run("Authorize", func(t *testing.T) {
+		keys, clock := setup()
+		assert.NoError(t, keys.Authorize("web", "any-key"), "Projects without write keys should accept any key")
+
+		first, err := keys.Create("web", "browser")
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(first.Key, first.Prefix))
+		assert.Equal(t, app.APIKeyID(first.Key), first.ID)
+		assert.Equal(t, app.WriteKeyActive, first.Status)
+		second, err := keys.Create("web", "server")
+		assert.NoError(t, err)
+		_, err = keys.Create("web", "third")
+		assert.Error(t, err, "A project should have at most two active keys")
+
+		clock.Advance(time.Minute)
+		assert.NoError(t, keys.Authorize("web", first.Key))
+		assert.NoError(t, keys.Authorize("web", first.Key))
+		assert.NoError(t, keys.Authorize("web", second.Key))
+		var rejected *app.WriteKeyError
+		assert.True(t, errors.As(keys.Authorize("web", "any-key"), &rejected))
+		assert.Empty(t, rejected.KeyID)
+		assert.Error(t, keys.Authorize("web", ""))
+
+		listed := keys.List("web")
+		if assert.Len(t, listed, 2) {
+			assert.Equal(t, int64(2), listed[0].Requests)
+			assert.Equal(t, start.Add(time.Minute), *listed[0].LastUsedAt)
+			assert.Equal(t, int64(1), listed[1].Requests)
+			assert.Empty(t, listed[0].Key, "Keys should only be returned when created")
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		keys, clock := setup()
+		old, err := keys.Create("web", "browser")
+		assert.NoError(t, err)
+		other, err := keys.Create("web", "server")
+		assert.NoError(t, err)
+
+		replacement, retired, err := keys.Rotate("web", old.ID, "", 24*time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, "browser", replacement.Name)
+		assert.Equal(t, app.WriteKeyRetiring, retired.Status)
+		assert.Equal(t, replacement.ID, retired.ReplacedBy)
+		assert.Equal(t, start.Add(24*time.Hour), *retired.ExpiresAt)
+
+		// Both keys are accepted during the grace period
+		assert.NoError(t, keys.Authorize("web", old.Key))
+		assert.NoError(t, keys.Authorize("web", replacement.Key))
+		_, _, err = keys.Rotate("web", old.ID, "", time.Hour)
+		assert.Error(t, err, "Retiring keys cannot be rotated again")
+
+		clock.Advance(24 * time.Hour)
+		var rejected *app.WriteKeyError
+		assert.True(t, errors.As(keys.Authorize("web", old.Key), &rejected))
+		assert.Equal(t, old.ID, rejected.KeyID)
+		assert.Equal(t, app.WriteKeyExpired, rejected.Status)
+		assert.NoError(t, keys.Authorize("web", replacement.Key))
+		assert.NoError(t, keys.Authorize("web", other.Key))
+
+		_, _, err = keys.Rotate("web", other.ID, "", 91*24*time.Hour)
+		assert.Error(t, err)
+		_, _, err = keys.Rotate("web", "missing", "", time.Hour)
+		assert.Contains(t, err.Error(), "not found")
+		_, _, err = keys.Rotate("shop", other.ID, "", time.Hour)
+		assert.Error(t, err, "Keys of other projects should not be found")
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		keys, _ := setup()
+		leaked, err := keys.Create("web", "")
+		assert.NoError(t, err)
+		kept, err := keys.Create("web", "")
+		assert.NoError(t, err)
+
+		revoked, err := keys.Revoke("web", leaked.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, app.WriteKeyRevoked, revoked.Status)
+		var rejected *app.WriteKeyError
+		assert.True(t, errors.As(keys.Authorize("web", leaked.Key), &rejected))
+		assert.Contains(t, rejected.Error(), "revoked")
+		assert.NoError(t, keys.Authorize("web", kept.Key), "Revoking a key should not affect the other")
+
+		_, err = keys.Create("web", "")
+		assert.NoError(t, err, "Revoked keys should free their slot")
+	})
+
+	t.Run("Endpoints", func(t *testing.T) {
+		application := app.NewApp("8080")
+		application.SetupRoutes()
+		defer application.Stop()
+
+		send := func(method, path, body, apiKey string) (int, map[string]interface{}) {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Project-ID", "keys")
+			req.Header.Set("X-User-ID", "user1")
+			if apiKey != "" {
+				req.Header.Set("X-API-Key", apiKey)
+			}
+			resp, err := application.GetFiberApp().Test(req)
+			assert.NoError(t, err)
+			var decoded map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&decoded)
+			return resp.StatusCode, decoded
+		}
+		track := func(apiKey string) int {
+			status, _ := send("POST", "/api/v1/analytics/events", `{"event_type":"page_view","user_id":"user1"}`, apiKey)
+			return status
+		}
+
+		assert.Equal(t, 200, track("legacy-key"))
+		status, body := send("POST", "/api/v1/projects/keys/write-keys", `{"name":"web"}`, "")
+		assert.Equal(t, 201, status)
+		created := body["write_key"].(map[string]interface{})
+		key, keyID := created["key"].(string), created["id"].(string)
+
+		assert.Equal(t, 401, track("legacy-key"), "Other keys should be rejected once the project has write keys")
+		assert.Equal(t, 200, track(key))
+
+		status, body = send("POST", "/api/v1/projects/keys/write-keys/"+keyID+"/rotate", `{"grace_period":"1h"}`, "")
+		assert.Equal(t, 201, status)
+		replacement := body["write_key"].(map[string]interface{})
+		assert.Equal(t, "retiring", body["retiring"].(map[string]interface{})["status"])
+		assert.Equal(t, 200, track(key), "The old key should work during the grace period")
+		assert.Equal(t, 200, track(replacement["key"].(string)))
+
+		status, body = send("GET", "/api/v1/projects/keys/write-keys", "", "")
+		assert.Equal(t, 200, status)
+		listed := body["write_keys"].([]interface{})
+		if assert.Len(t, listed, 2) {
+			assert.Equal(t, 2.0, listed[0].(map[string]interface{})["requests"])
+			assert.Equal(t, 1.0, listed[1].(map[string]interface{})["requests"])
+		}
+
+		status, _ = send("DELETE", "/api/v1/projects/keys/write-keys/"+keyID, "", "")
+		assert.Equal(t, 200, status)
+		assert.Equal(t, 401, track(key))
+		status, _ = send("DELETE", "/api/v1/projects/keys/write-keys/missing", "", "")
+		assert.Equal(t, 404, status)
+		status, _ = send("POST", "/api/v1/projects/keys/write-keys/"+keyID+"/rotate", `{"grace_period":"soon"}`, "")
+		assert.Equal(t, 400, status)
+	})
+}